@@ -18,7 +18,7 @@ module.exports = {
       type: 'category',
       label: 'Features',
       collapsed: false,
-      items: ['features/endpoints'],
+      items: ['features/endpoints', 'features/embedding'],
     },
     {
       type: 'category',
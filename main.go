@@ -10,6 +10,7 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/oauthproxy"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
 	"github.com/spf13/pflag"
 )
@@ -50,19 +51,43 @@ func main() {
 		return
 	}
 
+	if opts.UpstreamConfigDir != "" {
+		upstreams, err := options.LoadUpstreamConfigDir(opts.UpstreamConfigDir, opts.UpstreamServers.Upstreams)
+		if err != nil {
+			logger.Fatalf("ERROR: could not load upstream config dir: %v", err)
+		}
+		opts.UpstreamServers.Upstreams = upstreams
+	}
+
 	if err = validation.Validate(opts); err != nil {
 		logger.Fatalf("%s", err)
 	}
 
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
-	oauthproxy, err := NewOAuthProxy(opts, validator)
+	oauthproxy.Version = VERSION
+	validator := oauthproxy.NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	proxy, err := oauthproxy.NewOAuthProxy(opts, validator)
 	if err != nil {
 		logger.Fatalf("ERROR: Failed to initialise OAuth2 Proxy: %v", err)
 	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	if err := oauthproxy.Start(); err != nil {
+	if opts.ReloadUpstreams {
+		files := []string{}
+		for _, file := range []string{*config, *alphaConfig} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+		err := proxy.WatchUpstreamConfig(files, opts.UpstreamConfigDir, func() (options.UpstreamConfig, error) {
+			return reloadUpstreamConfig(opts, *config, *alphaConfig, configFlagSet, os.Args[1:])
+		})
+		if err != nil {
+			logger.Fatalf("ERROR: Failed to watch the upstream configuration: %v", err)
+		}
+	}
+
+	if err := proxy.Start(); err != nil {
 		logger.Fatalf("ERROR: Failed to start OAuth2 Proxy: %v", err)
 	}
 }
@@ -78,6 +103,35 @@ func loadConfiguration(config, alphaConfig string, extraFlags *pflag.FlagSet, ar
 	return loadLegacyOptions(config, extraFlags, args)
 }
 
+// reloadUpstreamConfig loads the configuration again, with the upstreams of
+// the upstream config dir, and returns its upstreams once they are validated
+// against the options the proxy was started with.
+// Only the upstreams are reloaded, changes to any other options are ignored.
+func reloadUpstreamConfig(opts *options.Options, config, alphaConfig string, extraFlags *pflag.FlagSet, args []string) (options.UpstreamConfig, error) {
+	var reloaded *options.Options
+	var err error
+	if alphaConfig != "" {
+		reloaded, err = loadAlphaOptions(config, alphaConfig, extraFlags, args)
+	} else {
+		reloaded, err = loadLegacyOptions(config, extraFlags, args)
+	}
+	if err != nil {
+		return options.UpstreamConfig{}, err
+	}
+
+	upstreams := reloaded.UpstreamServers
+	if opts.UpstreamConfigDir != "" {
+		upstreams.Upstreams, err = options.LoadUpstreamConfigDir(opts.UpstreamConfigDir, upstreams.Upstreams)
+		if err != nil {
+			return options.UpstreamConfig{}, fmt.Errorf("could not load upstream config dir: %v", err)
+		}
+	}
+	if err := validation.ValidateUpstreamConfig(opts, upstreams); err != nil {
+		return options.UpstreamConfig{}, err
+	}
+	return upstreams, nil
+}
+
 // loadLegacyOptions loads the old toml options using the legacy flagset
 // and legacy options struct.
 func loadLegacyOptions(config string, extraFlags *pflag.FlagSet, args []string) (*options.Options, error) {
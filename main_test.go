@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -71,9 +72,14 @@ providers:
   clientID: oauth2-proxy
   azureConfig:
     tenant: common
+  googleConfig:
+    groupCacheTTL: 5m
+    groupCheckConcurrency: 5
   oidcConfig:
     groupsClaim: groups
     emailClaim: email
+    emailVerifiedClaim: email_verified
+    emailVerification: ifPresent
     userIDClaim: email
     insecureSkipNonce: true
     audienceClaims: [aud]
@@ -151,13 +157,19 @@ redirect_url="http://localhost:4180/oauth2/callback"
 				AzureConfig: options.AzureOptions{
 					Tenant: "common",
 				},
+				GoogleConfig: options.GoogleOptions{
+					GroupCacheTTL:         options.Duration(options.DefaultGoogleGroupCacheTTL),
+					GroupCheckConcurrency: options.DefaultGoogleGroupCheckConcurrency,
+				},
 				OIDCConfig: options.OIDCOptions{
-					GroupsClaim:       "groups",
-					EmailClaim:        "email",
-					UserIDClaim:       "email",
-					AudienceClaims:    []string{"aud"},
-					ExtraAudiences:    []string{},
-					InsecureSkipNonce: true,
+					GroupsClaim:        "groups",
+					EmailClaim:         "email",
+					EmailVerifiedClaim: "email_verified",
+					EmailVerification:  options.EmailVerificationIfPresent,
+					UserIDClaim:        "email",
+					AudienceClaims:     []string{"aud"},
+					ExtraAudiences:     []string{},
+					InsecureSkipNonce:  true,
 				},
 				LoginURLParameters: []options.LoginURLParameter{
 					{Name: "approval_prompt", Default: []string{"force"}},
@@ -257,3 +269,78 @@ redirect_url="http://localhost:4180/oauth2/callback"
 		}),
 	)
 })
+
+var _ = Describe("Upstream Reload Suite", func() {
+	const testCoreConfig = `
+cookie_secret="OQINaROshtE9TcZkNAm-5Zs2Pv3xaWytBmc5W7sPX7w="
+email_domains="example.com"
+upstream_config_dir="%s"
+`
+
+	const testAlphaConfig = `
+upstreamConfig:
+  upstreams:
+  - id: app
+    path: /
+    uri: http://app.internal:8080
+%s
+providers:
+- provider: google
+  ID: google=oauth2-proxy
+  clientSecret: b2F1dGgyLXByb3h5LWNsaWVudC1zZWNyZXQK
+  clientID: oauth2-proxy
+`
+
+	var dir, configFileName, alphaConfigFileName string
+	var opts *options.Options
+
+	writeAlphaConfig := func(upstreams string) {
+		Expect(ioutil.WriteFile(alphaConfigFileName, []byte(fmt.Sprintf(testAlphaConfig, upstreams)), 0600)).To(Succeed())
+	}
+
+	reload := func() (options.UpstreamConfig, error) {
+		return reloadUpstreamConfig(opts, configFileName, alphaConfigFileName, pflag.NewFlagSet("test-flagset", pflag.ExitOnError), nil)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "oauth2-proxy-test-upstream-config-dir")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "api.yaml"), []byte("- id: api\n  path: /api/\n  uri: http://api.internal:8080\n"), 0600)).To(Succeed())
+
+		configFileName = filepath.Join(dir, "oauth2-proxy.cfg")
+		alphaConfigFileName = filepath.Join(dir, "oauth2-proxy.yaml.alpha")
+		Expect(ioutil.WriteFile(configFileName, []byte(fmt.Sprintf(testCoreConfig, dir)), 0600)).To(Succeed())
+		writeAlphaConfig("")
+
+		opts, err = loadConfiguration(configFileName, alphaConfigFileName, pflag.NewFlagSet("test-flagset", pflag.ExitOnError), nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reloads the upstreams of the config files and the upstream config dir", func() {
+		writeAlphaConfig("  - id: admin\n    path: /admin/\n    uri: http://admin.internal:8080")
+
+		upstreams, err := reload()
+		Expect(err).ToNot(HaveOccurred())
+		ids := []string{}
+		for _, upstream := range upstreams.Upstreams {
+			ids = append(ids, upstream.ID)
+		}
+		Expect(ids).To(Equal([]string{"app", "admin", "api"}))
+	})
+
+	It("rejects invalid upstreams", func() {
+		writeAlphaConfig("  - id: api\n    path: /v2/\n    uri: http://api-v2.internal:8080")
+
+		_, err := reload()
+		Expect(err).To(MatchError(ContainSubstring("could not load upstream config dir: ")))
+
+		writeAlphaConfig("  - id: admin\n    path: /admin/")
+		_, err = reload()
+		Expect(err).To(MatchError("invalid upstream configuration:\n  upstream \"admin\" has empty uri: uris are required for all non-static upstreams"))
+	})
+})
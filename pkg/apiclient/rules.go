@@ -0,0 +1,162 @@
+package apiclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	apiOutcome     = "api"
+	browserOutcome = "browser"
+)
+
+// Rules classify requests as coming from API clients, such as scripts and
+// native applications, or from browsers, based on the request headers.
+// API clients can't follow a redirect to sign in, so they should be sent an
+// error instead.
+// The first rule whose conditions all match the request decides the outcome,
+// requests that match no rule are from browsers.
+type Rules []rule
+
+// rule is a single rule, in the format:
+// `<api|browser>:<condition>[&<condition>...]`
+type rule struct {
+	api        bool
+	conditions []condition
+}
+
+// condition is a predicate on a request header, in one of the formats:
+// - `Header`: the header is present
+// - `!Header`: the header is absent
+// - `Header=value`: one of the comma separated values of the header is value
+// - `Header~regex`: one of the values of the header matches the regex
+type condition struct {
+	header  string
+	absent  bool
+	value   string
+	pattern *regexp.Regexp
+}
+
+// NewRules parses the rules, keeping their order
+func NewRules(rules []string) (Rules, error) {
+	parsed := make(Rules, 0, len(rules))
+	for _, r := range rules {
+		rule, err := parseRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", r, err)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// IsAPIClient checks whether the request is from an API client according to
+// the first matching rule
+func (r Rules) IsAPIClient(req *http.Request) bool {
+	for _, rule := range r {
+		if rule.matches(req.Header) {
+			return rule.api
+		}
+	}
+	return false
+}
+
+func parseRule(r string) (rule, error) {
+	parts := strings.SplitN(r, ":", 2)
+	if len(parts) != 2 {
+		return rule{}, errors.New("expected format <api|browser>:<condition>[&<condition>...]")
+	}
+
+	var parsed rule
+	switch parts[0] {
+	case apiOutcome:
+		parsed.api = true
+	case browserOutcome:
+		parsed.api = false
+	default:
+		return rule{}, fmt.Errorf("unknown outcome %q, expected %q or %q", parts[0], apiOutcome, browserOutcome)
+	}
+
+	for _, c := range strings.Split(parts[1], "&") {
+		cond, err := parseCondition(c)
+		if err != nil {
+			return rule{}, err
+		}
+		parsed.conditions = append(parsed.conditions, cond)
+	}
+	return parsed, nil
+}
+
+func parseCondition(c string) (condition, error) {
+	if strings.HasPrefix(c, "!") {
+		return newCondition(c[1:], condition{absent: true})
+	}
+
+	i := strings.IndexAny(c, "=~")
+	if i < 0 {
+		return newCondition(c, condition{})
+	}
+	if c[i] == '=' {
+		if c[i+1:] == "" {
+			return condition{}, fmt.Errorf("condition %q has no value", c)
+		}
+		return newCondition(c[:i], condition{value: c[i+1:]})
+	}
+
+	pattern, err := regexp.Compile(c[i+1:])
+	if err != nil {
+		return condition{}, fmt.Errorf("condition %q has an invalid regex: %v", c, err)
+	}
+	return newCondition(c[:i], condition{pattern: pattern})
+}
+
+// newCondition sets the header of the condition, once it is checked to be
+// a header name
+func newCondition(header string, cond condition) (condition, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || strings.ContainsAny(header, " !=~") {
+		return condition{}, fmt.Errorf("invalid header name %q", header)
+	}
+	cond.header = http.CanonicalHeaderKey(header)
+	return cond, nil
+}
+
+func (r rule) matches(header http.Header) bool {
+	for _, cond := range r.conditions {
+		if !cond.matches(header) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) matches(header http.Header) bool {
+	values := header.Values(c.header)
+	switch {
+	case c.absent:
+		return len(values) == 0
+	case c.pattern != nil:
+		for _, value := range values {
+			if c.pattern.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	case c.value != "":
+		// Iterate over multiple values in a single header, i.e.
+		// Accept: application/json, text/plain, */*
+		for _, value := range values {
+			for _, v := range strings.Split(value, ",") {
+				if strings.TrimSpace(v) == c.value {
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		return len(values) > 0
+	}
+}
@@ -0,0 +1,148 @@
+package apiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+	type isAPIClientTableInput struct {
+		rules    []string
+		headers  map[string][]string
+		expected bool
+	}
+
+	defaultRules := []string{"api:Accept=application/json"}
+	customRules := []string{
+		"browser:User-Agent~Mozilla/&!X-Requested-With",
+		"api:X-Requested-With=XMLHttpRequest",
+		"api:Authorization",
+		"api:User-Agent~^(curl|Electron)/",
+		"api:!Accept",
+		"api:Accept=application/json",
+	}
+
+	DescribeTable("IsAPIClient",
+		func(in isAPIClientTableInput) {
+			rules, err := NewRules(in.rules)
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, values := range in.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			Expect(rules.IsAPIClient(req)).To(Equal(in.expected))
+		},
+		Entry("with no rules", isAPIClientTableInput{
+			rules:    []string{},
+			headers:  map[string][]string{"Accept": {"application/json"}},
+			expected: false,
+		}),
+		Entry("with the default rules and no headers", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{},
+			expected: false,
+		}),
+		Entry("with the default rules and a JSON Accept header", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{"Accept": {"application/json"}},
+			expected: true,
+		}),
+		Entry("with the default rules and JSON in a list of media types", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{"Accept": {"text/html, application/json, */*"}},
+			expected: true,
+		}),
+		Entry("with the default rules and JSON in a second Accept header", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{"Accept": {"text/plain", "application/json"}},
+			expected: true,
+		}),
+		Entry("with the default rules and a JSON media type with parameters", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{"Accept": {"application/json; charset=utf-8"}},
+			expected: false,
+		}),
+		Entry("with the default rules and an HTML Accept header", isAPIClientTableInput{
+			rules:    defaultRules,
+			headers:  map[string][]string{"Accept": {"text/html"}, "User-Agent": {"curl/7.79.1"}},
+			expected: false,
+		}),
+		Entry("with custom rules and a browser", isAPIClientTableInput{
+			rules: customRules,
+			headers: map[string][]string{
+				"Accept":     {"application/json"},
+				"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64)"},
+			},
+			expected: false,
+		}),
+		Entry("with custom rules and an XHR from a browser", isAPIClientTableInput{
+			rules: customRules,
+			headers: map[string][]string{
+				"Accept":           {"text/html"},
+				"User-Agent":       {"Mozilla/5.0 (X11; Linux x86_64)"},
+				"X-Requested-With": {"XMLHttpRequest"},
+			},
+			expected: true,
+		}),
+		Entry("with custom rules and an Authorization header", isAPIClientTableInput{
+			rules: customRules,
+			headers: map[string][]string{
+				"Accept":        {"text/html"},
+				"Authorization": {"Bearer abcdef"},
+			},
+			expected: true,
+		}),
+		Entry("with custom rules and a curl User-Agent", isAPIClientTableInput{
+			rules: customRules,
+			headers: map[string][]string{
+				"Accept":     {"*/*"},
+				"User-Agent": {"curl/7.79.1"},
+			},
+			expected: true,
+		}),
+		Entry("with custom rules and no Accept header", isAPIClientTableInput{
+			rules:    customRules,
+			headers:  map[string][]string{"User-Agent": {"Go-http-client/1.1"}},
+			expected: true,
+		}),
+		Entry("with custom rules and no matching rule", isAPIClientTableInput{
+			rules: customRules,
+			headers: map[string][]string{
+				"Accept":     {"text/html"},
+				"User-Agent": {"Go-http-client/1.1"},
+			},
+			expected: false,
+		}),
+		Entry("with lower case header names", isAPIClientTableInput{
+			rules:    []string{"api:x-requested-with=XMLHttpRequest"},
+			headers:  map[string][]string{"X-Requested-With": {"XMLHttpRequest"}},
+			expected: true,
+		}),
+	)
+
+	DescribeTable("NewRules with invalid rules",
+		func(rule string, expectedError string) {
+			_, err := NewRules([]string{"api:Authorization", rule})
+			Expect(err).To(MatchError(expectedError))
+		},
+		Entry("with no outcome", "Authorization",
+			`invalid rule "Authorization": expected format <api|browser>:<condition>[&<condition>...]`),
+		Entry("with an unknown outcome", "json:Accept=application/json",
+			`invalid rule "json:Accept=application/json": unknown outcome "json", expected "api" or "browser"`),
+		Entry("with an empty condition", "api:Authorization&",
+			`invalid rule "api:Authorization&": invalid header name ""`),
+		Entry("with an empty value", "api:Accept=",
+			`invalid rule "api:Accept=": condition "Accept=" has no value`),
+		Entry("with an invalid regex", "api:User-Agent~(curl",
+			"invalid rule \"api:User-Agent~(curl\": condition \"User-Agent~(curl\" has an invalid regex: error parsing regexp: missing closing ): `(curl`"),
+		Entry("with no header name", "api:~curl",
+			`invalid rule "api:~curl": invalid header name ""`),
+	)
+})
@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 )
@@ -21,10 +22,17 @@ type RequestScope struct {
 	// mode and if request `X-Forwarded-*` headers should be trusted
 	ReverseProxy bool
 
-	// RequestID is set to the request's `X-Request-Id` header if set.
+	// RequestID is set to the request's `X-Request-Id` header if it is set
+	// by a trusted peer and is well formed.
 	// Otherwise a random UUID is set.
 	RequestID string
 
+	// DebugLogging indicates that all log lines of the request should be
+	// written, including debug lines, regardless of the configured logging.
+	// It is set for requests carrying the request debug header secret, or
+	// the session of a request debug email.
+	DebugLogging bool
+
 	// Session details the authenticated users information (if it exists).
 	Session *sessions.SessionState
 
@@ -35,17 +43,96 @@ type RequestScope struct {
 	// ClearSession indicates whether the user should be logged out or not.
 	ClearSession bool
 
+	// SessionReset indicates that the session cookie could not be decoded,
+	// eg. after the cookie secret was changed, and has been cleared.
+	SessionReset bool
+
+	// SessionStoreUnavailable indicates that the session could not be loaded
+	// because the session store is unavailable.
+	SessionStoreUnavailable bool
+
+	// SessionDegraded indicates that the request is being proxied despite the
+	// session store being unavailable, according to the session store
+	// unavailable policy of the upstream.
+	// The Session, if set, was loaded from the in-memory session cache.
+	SessionDegraded bool
+
+	// AuthenticationSkipped indicates that the request is allowed without a
+	// session by the proxy, by the skip auth routes or trusted IPs, or by a
+	// signed URL whose upstream policies the proxy checked, so that the
+	// policies of the upstream don't require it to be allowed anonymously.
+	AuthenticationSkipped bool
+
+	// BearerTokenRejected indicates that the bearer token of the request was
+	// rejected by the token introspection endpoint, because it is not active
+	// or could not be introspected.
+	BearerTokenRejected bool
+
+	// SessionToken is set by session stores returning sessions to clients as
+	// bearer tokens, rather than in a cookie, to the bearer token of the
+	// session they saved.
+	SessionToken string
+
+	// EvictedSessions is set by session stores limiting the concurrent
+	// sessions of each user to the number of sessions of the user they
+	// removed to save a new session.
+	EvictedSessions int
+
+	// SessionRefreshed indicates that the session was refreshed with the
+	// provider while it was loaded for this request.
+	SessionRefreshed bool
+
+	// SessionRefreshFailed indicates that the session needed refreshing while
+	// it was loaded for this request, but the provider failed to refresh it.
+	SessionRefreshFailed bool
+
 	// SessionRevalidated indicates whether the session has been revalidated since
 	// it was loaded or not.
 	SessionRevalidated bool
 
 	// Upstream tracks which upstream was used for this request
 	Upstream string
+
+	// UpstreamAddress is the address of the upstream server the request was
+	// last sent to, eg. the IP and port of the connection to an HTTP(S)
+	// upstream.
+	UpstreamAddress string
+
+	// UpstreamDuration is the time the upstream server took to serve the
+	// request, from sending the request to the end of its response, over
+	// all the attempts at sending it.
+	UpstreamDuration time.Duration
+
+	// UpstreamRetries is the number of times the request was sent to the
+	// upstream server again after a failed attempt.
+	UpstreamRetries int
+
+	// ResponseHeaderPolicyApplied indicates whether a response header policy
+	// has been applied to the response, so that the policy of the upstream
+	// serving the request takes precedence over the global policy.
+	ResponseHeaderPolicyApplied bool
+
+	// IdentityHeaders are the names of the request headers injected with the
+	// identity of the session, which are removed for upstreams with identity
+	// headers disabled.
+	IdentityHeaders []string
+
+	// ClientAuthorization is the Authorization header of the client request,
+	// when an Authorization header is injected from the session in its place,
+	// so that it can still be sent to upstreams according to their
+	// authorization conflict policy.
+	ClientAuthorization string
 }
 
 // GetRequestScope returns the current request scope from the given request
 func GetRequestScope(req *http.Request) *RequestScope {
-	scope := req.Context().Value(RequestScopeKey)
+	return GetRequestScopeFromContext(req.Context())
+}
+
+// GetRequestScopeFromContext returns the current request scope from the given
+// context
+func GetRequestScopeFromContext(ctx context.Context) *RequestScope {
+	scope := ctx.Value(RequestScopeKey)
 	if scope == nil {
 		return nil
 	}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -20,11 +21,13 @@ type VerifyFunc func(ctx context.Context, token string) (*oidc.IDToken, error)
 func CreateTokenToSessionFunc(verify VerifyFunc) TokenToSessionFunc {
 	return func(ctx context.Context, token string) (*sessionsapi.SessionState, error) {
 		var claims struct {
-			Subject           string   `json:"sub"`
-			Email             string   `json:"email"`
-			Verified          *bool    `json:"email_verified"`
-			PreferredUsername string   `json:"preferred_username"`
-			Groups            []string `json:"groups"`
+			Subject           string      `json:"sub"`
+			Email             string      `json:"email"`
+			Verified          *bool       `json:"email_verified"`
+			PreferredUsername string      `json:"preferred_username"`
+			Groups            []string    `json:"groups"`
+			Scope             interface{} `json:"scope"`
+			Scp               interface{} `json:"scp"`
 		}
 
 		idToken, err := verify(ctx, token)
@@ -53,8 +56,50 @@ func CreateTokenToSessionFunc(verify VerifyFunc) TokenToSessionFunc {
 			IDToken:           token,
 			RefreshToken:      "",
 			ExpiresOn:         &idToken.Expiry,
+			BearerToken: &sessionsapi.BearerToken{
+				Audiences: idToken.Audience,
+				Scopes:    parseScopes(claims.Scope, claims.Scp),
+			},
 		}
 
 		return newSession, nil
 	}
 }
+
+// NewBearerToken describes the verified bearer token for the session created
+// from it.
+// The scopes are read from the `scope` claim, or the `scp` claim used by some
+// providers instead.
+func NewBearerToken(idToken *oidc.IDToken) (*sessionsapi.BearerToken, error) {
+	var claims struct {
+		Scope interface{} `json:"scope"`
+		Scp   interface{} `json:"scp"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse bearer token scopes: %v", err)
+	}
+	return &sessionsapi.BearerToken{
+		Audiences: idToken.Audience,
+		Scopes:    parseScopes(claims.Scope, claims.Scp),
+	}, nil
+}
+
+// parseScopes returns the scopes of a `scope` claim, a space separated
+// string, or otherwise of a `scp` claim, a list or a space separated string
+func parseScopes(scope, scp interface{}) []string {
+	for _, claim := range []interface{}{scope, scp} {
+		switch v := claim.(type) {
+		case string:
+			return strings.Fields(v)
+		case []interface{}:
+			scopes := make([]string, 0, len(v))
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					scopes = append(scopes, str)
+				}
+			}
+			return scopes
+		}
+	}
+	return nil
+}
@@ -29,6 +29,16 @@ type AlphaOptions struct {
 	// or from a static secret value.
 	InjectResponseHeaders []Header `json:"injectResponseHeaders,omitempty"`
 
+	// AuthResponse is used to configure the headers returned by the auth
+	// endpoint when the proxy is used for forward authentication.
+	AuthResponse AuthResponse `json:"authResponse,omitempty"`
+
+	// ResponseHeaderPolicy is used to configure static headers, such as
+	// security headers, that are set on the responses of all upstreams and
+	// of the proxy's own pages.
+	// Upstreams may extend the policy with their own ResponseHeaderPolicy.
+	ResponseHeaderPolicy []ResponseHeaderPolicy `json:"responseHeaderPolicy,omitempty"`
+
 	// Server is used to configure the HTTP(S) server for the proxy application.
 	// You may choose to run both HTTP and HTTPS servers simultaneously.
 	// This can be done by setting the BindAddress and the SecureBindAddress simultaneously.
@@ -41,6 +51,13 @@ type AlphaOptions struct {
 	// To use the secure server you must configure a TLS certificate and key.
 	MetricsServer Server `json:"metricsServer,omitempty"`
 
+	// ManagementServer is used to configure the HTTP(S) server for the
+	// management endpoints: metrics, profiling, readiness and the admin APIs.
+	// When it is configured, these endpoints are no longer served by the
+	// proxy's Server.
+	// To use the secure server you must configure a TLS certificate and key.
+	ManagementServer Server `json:"managementServer,omitempty"`
+
 	// Providers is used to configure multiple providers.
 	Providers Providers `json:"providers,omitempty"`
 }
@@ -51,8 +68,11 @@ func (a *AlphaOptions) MergeInto(opts *Options) {
 	opts.UpstreamServers = a.UpstreamConfig
 	opts.InjectRequestHeaders = a.InjectRequestHeaders
 	opts.InjectResponseHeaders = a.InjectResponseHeaders
+	opts.AuthResponse = a.AuthResponse
+	opts.ResponseHeaderPolicy = a.ResponseHeaderPolicy
 	opts.Server = a.Server
 	opts.MetricsServer = a.MetricsServer
+	opts.ManagementServer = a.ManagementServer
 	opts.Providers = a.Providers
 }
 
@@ -62,7 +82,10 @@ func (a *AlphaOptions) ExtractFrom(opts *Options) {
 	a.UpstreamConfig = opts.UpstreamServers
 	a.InjectRequestHeaders = opts.InjectRequestHeaders
 	a.InjectResponseHeaders = opts.InjectResponseHeaders
+	a.AuthResponse = opts.AuthResponse
+	a.ResponseHeaderPolicy = opts.ResponseHeaderPolicy
 	a.Server = opts.Server
 	a.MetricsServer = opts.MetricsServer
+	a.ManagementServer = opts.ManagementServer
 	a.Providers = opts.Providers
 }
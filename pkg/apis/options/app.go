@@ -35,6 +35,18 @@ type Templates struct {
 	// information.
 	// Use only for diagnosing backend errors.
 	Debug bool `flag:"show-debug-on-error" cfg:"show_debug_on_error"`
+
+	// ProblemJSON renders errors as RFC 7807 problem details
+	// (application/problem+json) instead of HTML error pages.
+	// Without this, problem details are only rendered for requests whose Accept
+	// header prefers JSON.
+	ProblemJSON bool `flag:"problem-json-errors" cfg:"problem_json_errors"`
+
+	// HideProviderErrorDescription omits the error_description returned by the
+	// identity provider from error pages, for deployments where descriptions
+	// may contain sensitive information.
+	// The error itself is still shown and the description is still logged.
+	HideProviderErrorDescription bool `flag:"hide-provider-error-description" cfg:"hide_provider_error_description"`
 }
 
 func templatesFlagSet() *pflag.FlagSet {
@@ -46,6 +58,8 @@ func templatesFlagSet() *pflag.FlagSet {
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.Bool("show-debug-on-error", false, "show detailed error information on error pages (WARNING: this may contain sensitive information - do not use in production)")
+	flagSet.Bool("problem-json-errors", false, "render errors as RFC 7807 application/problem+json instead of HTML error and sign-in pages")
+	flagSet.Bool("hide-provider-error-description", false, "omit the error_description returned by the identity provider from error pages")
 
 	return flagSet
 }
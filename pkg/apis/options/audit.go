@@ -0,0 +1,82 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The events that can be written to the audit log
+const (
+	AuditEventSessionCreated      = "session_created"
+	AuditEventSessionRefreshed    = "session_refreshed"
+	AuditEventSessionRevoked      = "session_revoked"
+	AuditEventAuthorizationDenied = "authorization_denied"
+	AuditEventUpstreamAccess      = "upstream_access"
+)
+
+const (
+	// DefaultAuditQueueSize is the default number of events queued for each
+	// audit log sink
+	DefaultAuditQueueSize = 1000
+
+	// DefaultAuditSyslogTag is the default tag of the audit events written to
+	// syslog
+	DefaultAuditSyslogTag = "oauth2-proxy-audit"
+
+	// DefaultAuditWebhookMaxRetries is the default number of times the
+	// delivery of an audit event to the webhook is retried
+	DefaultAuditWebhookMaxRetries = 3
+
+	// DefaultAuditWebhookTimeout is the default timeout of each delivery of
+	// an audit event to the webhook
+	DefaultAuditWebhookTimeout = 5 * time.Second
+)
+
+// Audit contains configuration options for the audit log of security
+// relevant actions, written as JSON events to a file, syslog and/or a webhook,
+// separately from the access logs
+type Audit struct {
+	File              string        `flag:"audit-log-file" cfg:"audit_log_file"`
+	Syslog            bool          `flag:"audit-log-syslog" cfg:"audit_log_syslog"`
+	SyslogAddress     string        `flag:"audit-log-syslog-address" cfg:"audit_log_syslog_address"`
+	SyslogTag         string        `flag:"audit-log-syslog-tag" cfg:"audit_log_syslog_tag"`
+	WebhookURL        string        `flag:"audit-log-webhook-url" cfg:"audit_log_webhook_url"`
+	SigningKeyFiles   []string      `flag:"audit-log-signing-key-file" cfg:"audit_log_signing_key_files"`
+	WebhookMaxRetries int           `flag:"audit-log-webhook-max-retries" cfg:"audit_log_webhook_max_retries"`
+	WebhookTimeout    time.Duration `flag:"audit-log-webhook-timeout" cfg:"audit_log_webhook_timeout"`
+	Types             []string      `flag:"audit-event" cfg:"audit_events"`
+	QueueSize         int           `flag:"audit-log-queue-size" cfg:"audit_log_queue_size"`
+}
+
+// Enabled checks whether audit events are written to any sink
+func (a Audit) Enabled() bool {
+	return a.File != "" || a.Syslog || a.WebhookURL != ""
+}
+
+func auditFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("audit", pflag.ExitOnError)
+
+	flagSet.String("audit-log-file", "", "the file audit events are appended to as JSON lines; enables the audit log")
+	flagSet.Bool("audit-log-syslog", false, "write audit events to syslog; enables the audit log")
+	flagSet.String("audit-log-syslog-address", "", "the syslog server audit events are written to, as udp://host:port or tcp://host:port. Defaults to the local syslog daemon")
+	flagSet.String("audit-log-syslog-tag", DefaultAuditSyslogTag, "the tag of the audit events written to syslog")
+	flagSet.String("audit-log-webhook-url", "", "the HTTPS endpoint audit events are delivered to as JSON; enables the audit log")
+	flagSet.StringSlice("audit-log-signing-key-file", []string{}, "path to a file containing a secret key (at least 32 bytes) audit events delivered to the webhook are signed with; give a second key while rotating keys (may be given up to twice)")
+	flagSet.Int("audit-log-webhook-max-retries", DefaultAuditWebhookMaxRetries, "the number of times the delivery of an audit event to the webhook is retried, with exponential backoff")
+	flagSet.Duration("audit-log-webhook-timeout", DefaultAuditWebhookTimeout, "the timeout of each delivery of an audit event to the webhook")
+	flagSet.StringSlice("audit-event", []string{}, "the events written to the audit log: session_created, session_refreshed, session_revoked, authorization_denied or upstream_access (may be given multiple times). Defaults to all events")
+	flagSet.Int("audit-log-queue-size", DefaultAuditQueueSize, "the number of audit events queued for each sink, events are dropped while the queue is full")
+
+	return flagSet
+}
+
+// auditDefaults creates an Audit populating each field with its default value
+func auditDefaults() Audit {
+	return Audit{
+		SyslogTag:         DefaultAuditSyslogTag,
+		WebhookMaxRetries: DefaultAuditWebhookMaxRetries,
+		WebhookTimeout:    DefaultAuditWebhookTimeout,
+		QueueSize:         DefaultAuditQueueSize,
+	}
+}
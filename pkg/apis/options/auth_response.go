@@ -0,0 +1,25 @@
+package options
+
+// AuthResponse configures how the auth endpoint responds when OAuth2 Proxy is
+// used for forward authentication, eg by Traefik's forwardAuth middleware or
+// Envoy's ext_authz filter.
+type AuthResponse struct {
+	// Headers is the exact set of headers added to successful responses from
+	// the auth endpoint.
+	// When set, these are used in place of InjectResponseHeaders (and the
+	// GAP-Auth header) for the auth endpoint.
+	// Headers may source values from either the authenticated user's session
+	// or from a static secret value.
+	Headers []Header `json:"headers,omitempty"`
+
+	// PrefixHeaders adds the `X-Auth-Request-` prefix to the name of each of
+	// the Headers that does not already have it.
+	// Disable this to emit the bare header names.
+	PrefixHeaders bool `json:"prefixHeaders,omitempty"`
+
+	// RedirectHeader is the name of a header added to 401 responses from the
+	// auth endpoint. Its value is the URL that starts the login flow and
+	// returns the user to the original request once they are authenticated.
+	// This allows the proxy in front to redirect the user on failure.
+	RedirectHeader string `json:"redirectHeader,omitempty"`
+}
@@ -0,0 +1,55 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultClaimEnrichmentPrefix is the default prefix of the names of the
+	// claims from the claim enrichment endpoint
+	DefaultClaimEnrichmentPrefix = "directory_"
+
+	// DefaultClaimEnrichmentTimeout is the default timeout of the requests to
+	// the claim enrichment endpoint
+	DefaultClaimEnrichmentTimeout = 2 * time.Second
+
+	// DefaultClaimEnrichmentMaxResponseSize is the default maximum size, in
+	// bytes, of the responses of the claim enrichment endpoint
+	DefaultClaimEnrichmentMaxResponseSize = 64 * 1024
+)
+
+// ClaimEnrichment contains configuration options for the endpoint the claims
+// of sessions are enriched from, at login and on refresh
+type ClaimEnrichment struct {
+	URL             string        `flag:"claim-enrichment-url" cfg:"claim_enrichment_url"`
+	Prefix          string        `flag:"claim-enrichment-prefix" cfg:"claim_enrichment_prefix"`
+	Timeout         time.Duration `flag:"claim-enrichment-timeout" cfg:"claim_enrichment_timeout"`
+	FailOpen        bool          `flag:"claim-enrichment-fail-open" cfg:"claim_enrichment_fail_open"`
+	MaxResponseSize int64         `flag:"claim-enrichment-max-response-size" cfg:"claim_enrichment_max_response_size"`
+}
+
+func claimEnrichmentFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("claimenrichment", pflag.ExitOnError)
+
+	flagSet.String("claim-enrichment-url", "", "the HTTPS endpoint called with the email and subject of users at login and on refresh, whose JSON response fields are added to the session's claims; enables claim enrichment")
+	flagSet.String("claim-enrichment-prefix", DefaultClaimEnrichmentPrefix, "the prefix added to the names of the claims from the claim enrichment endpoint")
+	flagSet.Duration("claim-enrichment-timeout", DefaultClaimEnrichmentTimeout, "the timeout of the requests to the claim enrichment endpoint")
+	flagSet.Bool("claim-enrichment-fail-open", false, "allow logins, without the enriched claims, when the claim enrichment endpoint fails")
+	flagSet.Int64("claim-enrichment-max-response-size", DefaultClaimEnrichmentMaxResponseSize, "the maximum size in bytes of the responses of the claim enrichment endpoint")
+
+	return flagSet
+}
+
+// claimEnrichmentDefaults creates a ClaimEnrichment populating each field
+// with its default value
+func claimEnrichmentDefaults() ClaimEnrichment {
+	return ClaimEnrichment{
+		URL:             "",
+		Prefix:          DefaultClaimEnrichmentPrefix,
+		Timeout:         DefaultClaimEnrichmentTimeout,
+		FailOpen:        false,
+		MaxResponseSize: DefaultClaimEnrichmentMaxResponseSize,
+	}
+}
@@ -14,6 +14,8 @@ type Cookie struct {
 	Path           string        `flag:"cookie-path" cfg:"cookie_path"`
 	Expire         time.Duration `flag:"cookie-expire" cfg:"cookie_expire"`
 	Refresh        time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh"`
+	RefreshJitter  int           `flag:"cookie-refresh-jitter" cfg:"cookie_refresh_jitter"`
+	RefreshWindow  time.Duration `flag:"cookie-refresh-window" cfg:"cookie_refresh_window"`
 	Secure         bool          `flag:"cookie-secure" cfg:"cookie_secure"`
 	HTTPOnly       bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
 	SameSite       string        `flag:"cookie-samesite" cfg:"cookie_samesite"`
@@ -30,9 +32,11 @@ func cookieFlagSet() *pflag.FlagSet {
 	flagSet.String("cookie-path", "/", "an optional cookie path to force cookies to (ie: /poc/)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
+	flagSet.Int("cookie-refresh-jitter", 0, "shorten the cookie refresh duration of each session by up to this percentage, so that sessions created together don't refresh together")
+	flagSet.Duration("cookie-refresh-window", time.Duration(0), "refresh sessions whose tokens expire within this duration, even if the cookie refresh duration hasn't passed; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
-	flagSet.String("cookie-samesite", "", "set SameSite cookie attribute (ie: \"lax\", \"strict\", \"none\", or \"\"). ")
+	flagSet.String("cookie-samesite", "", "set SameSite cookie attribute (ie: \"lax\", \"strict\", \"none\", or \"\"). Must be \"none\" with the apple provider, whose callback is a cross-site POST")
 	flagSet.Bool("cookie-csrf-per-request", false, "When this property is set to true, then the CSRF cookie name is built based on the state and varies per request. If property is set to false, then CSRF cookie has the same name for all requests.")
 	flagSet.Duration("cookie-csrf-expire", time.Duration(15)*time.Minute, "expire timeframe for CSRF cookie")
 	return flagSet
@@ -47,6 +51,8 @@ func cookieDefaults() Cookie {
 		Path:           "/",
 		Expire:         time.Duration(168) * time.Hour,
 		Refresh:        time.Duration(0),
+		RefreshJitter:  0,
+		RefreshWindow:  time.Duration(0),
 		Secure:         true,
 		HTTPOnly:       true,
 		SameSite:       "",
@@ -0,0 +1,46 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// CORS contains configuration options for cross-origin requests to the
+// OAuth2 Proxy endpoints, and for preflight requests to upstream routes
+type CORS struct {
+	AllowedOrigins     []string      `flag:"cors-allowed-origin" cfg:"cors_allowed_origins"`
+	AllowedMethods     []string      `flag:"cors-allowed-method" cfg:"cors_allowed_methods"`
+	AllowedHeaders     []string      `flag:"cors-allowed-header" cfg:"cors_allowed_headers"`
+	AllowCredentials   bool          `flag:"cors-allow-credentials" cfg:"cors_allow_credentials"`
+	MaxAge             time.Duration `flag:"cors-max-age" cfg:"cors_max_age"`
+	PreflightRoutes    []string      `flag:"cors-preflight-route" cfg:"cors_preflight_routes"`
+	RespondToPreflight bool          `flag:"cors-respond-to-preflight" cfg:"cors_respond_to_preflight"`
+}
+
+func corsFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("cors", pflag.ExitOnError)
+
+	flagSet.StringSlice("cors-allowed-origin", []string{}, "origins allowed to make cross-origin requests to the OAuth2 Proxy endpoints (eg https://app.example.com or https://*.example.com)")
+	flagSet.StringSlice("cors-allowed-method", []string{}, "methods allowed in cross-origin requests to the OAuth2 Proxy endpoints (default GET, POST)")
+	flagSet.StringSlice("cors-allowed-header", []string{}, "request headers allowed in cross-origin requests to the OAuth2 Proxy endpoints")
+	flagSet.Bool("cors-allow-credentials", false, "allow cross-origin requests to the OAuth2 Proxy endpoints to include credentials such as cookies")
+	flagSet.Duration("cors-max-age", time.Duration(0), "how long browsers may cache the result of a CORS preflight request; 0 to not set")
+	flagSet.StringSlice("cors-preflight-route", []string{}, "skip authentication for CORS preflight requests from the allowed origins to paths matching this regex (may be given multiple times)")
+	flagSet.Bool("cors-respond-to-preflight", false, "answer CORS preflight requests to the preflight routes with the CORS headers, rather than proxying them to the upstream")
+
+	return flagSet
+}
+
+// corsDefaults creates a CORS populating each field with its default value
+func corsDefaults() CORS {
+	return CORS{
+		AllowedOrigins:     nil,
+		AllowedMethods:     nil,
+		AllowedHeaders:     nil,
+		AllowCredentials:   false,
+		MaxAge:             time.Duration(0),
+		PreflightRoutes:    nil,
+		RespondToPreflight: false,
+	}
+}
@@ -0,0 +1,53 @@
+package options
+
+import (
+	"net/http"
+
+	"github.com/spf13/pflag"
+)
+
+// DefaultCrawlerResponseStatus is the default status of the responses to
+// crawlers.
+const DefaultCrawlerResponseStatus = http.StatusForbidden
+
+// DefaultCrawlerUserAgents are the patterns crawlers are detected with when
+// no user agents are configured. They only match the search engine and SEO
+// crawlers that identify themselves, so that real users are never matched.
+var DefaultCrawlerUserAgents = []string{
+	"Googlebot",
+	"bingbot",
+	"Slurp",
+	"DuckDuckBot",
+	"Baiduspider",
+	"YandexBot",
+	"Applebot",
+	"AhrefsBot",
+	"SemrushBot",
+	"MJ12bot",
+	"PetalBot",
+}
+
+// Crawlers contains configuration options for the detection of crawlers,
+// which are refused protected routes and the sign in flow
+type Crawlers struct {
+	Detection      bool     `flag:"crawler-detection" cfg:"crawler_detection"`
+	UserAgents     []string `flag:"crawler-user-agent" cfg:"crawler_user_agents"`
+	ResponseStatus int      `flag:"crawler-response-status" cfg:"crawler_response_status"`
+}
+
+func crawlersFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("crawlers", pflag.ExitOnError)
+
+	flagSet.Bool("crawler-detection", false, "respond to requests from crawlers to protected routes and the sign in endpoints with the crawler response status, without starting a sign in flow")
+	flagSet.StringSlice("crawler-user-agent", []string{}, "regex matched case-insensitively against the User-Agent of requests to detect crawlers (may be given multiple times), replacing the default list of search engine crawlers")
+	flagSet.Int("crawler-response-status", DefaultCrawlerResponseStatus, "the status of the responses to crawlers: 403 or 404")
+
+	return flagSet
+}
+
+// crawlersDefaults creates a Crawlers populating each field with its default value
+func crawlersDefaults() Crawlers {
+	return Crawlers{
+		ResponseStatus: DefaultCrawlerResponseStatus,
+	}
+}
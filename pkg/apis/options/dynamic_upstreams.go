@@ -0,0 +1,41 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// DynamicUpstreams contains configuration options for the upstreams
+// registered at runtime from the JSON files of a watched directory
+type DynamicUpstreams struct {
+	Dir        string        `flag:"dynamic-upstreams-dir" cfg:"dynamic_upstreams_dir"`
+	DefaultTTL time.Duration `flag:"dynamic-upstreams-default-ttl" cfg:"dynamic_upstreams_default_ttl"`
+}
+
+// DynamicUpstream is an upstream registered at runtime, from a file of the
+// dynamic upstreams directory.
+type DynamicUpstream struct {
+	Upstream
+
+	// TTL is how long the upstream is registered for after its file was last
+	// modified, once it expires the upstream is removed.
+	// Defaults to the dynamic upstreams default TTL, upstreams with a TTL of
+	// 0 never expire.
+	TTL *Duration `json:"ttl,omitempty"`
+}
+
+func dynamicUpstreamsFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("dynamicupstreams", pflag.ExitOnError)
+
+	flagSet.String("dynamic-upstreams-dir", "", "directory of JSON upstream definitions registered and removed at runtime as the files are added, changed and removed")
+	flagSet.Duration("dynamic-upstreams-default-ttl", time.Duration(0), "how long dynamic upstreams without a ttl are registered for after their file was last modified; 0 to never expire them")
+
+	return flagSet
+}
+
+// dynamicUpstreamsDefaults creates a DynamicUpstreams populating each field
+// with its default value
+func dynamicUpstreamsDefaults() DynamicUpstreams {
+	return DynamicUpstreams{}
+}
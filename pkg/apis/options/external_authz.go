@@ -0,0 +1,66 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The types of external authorization endpoints
+const (
+	// ExternalAuthzTypeWebhook endpoints are sent the input describing the
+	// request, and respond with the decision
+	ExternalAuthzTypeWebhook = "webhook"
+
+	// ExternalAuthzTypeOPA endpoints are the decisions of Open Policy Agent
+	// policies, sent the input describing the request under `input`
+	ExternalAuthzTypeOPA = "opa"
+)
+
+const (
+	// DefaultExternalAuthzTimeout is the default timeout of the requests to
+	// the external authorization endpoint
+	DefaultExternalAuthzTimeout = 2 * time.Second
+
+	// DefaultExternalAuthzCacheTTL is the default duration the decisions of
+	// the external authorization endpoint are cached for
+	DefaultExternalAuthzCacheTTL = 30 * time.Second
+)
+
+// ExternalAuthz contains configuration options for the endpoint that
+// authorizes every authenticated request before it is proxied, such as an
+// Open Policy Agent sidecar
+type ExternalAuthz struct {
+	URL      string        `flag:"external-authz-url" cfg:"external_authz_url"`
+	Type     string        `flag:"external-authz-type" cfg:"external_authz_type"`
+	Timeout  time.Duration `flag:"external-authz-timeout" cfg:"external_authz_timeout"`
+	FailOpen bool          `flag:"external-authz-fail-open" cfg:"external_authz_fail_open"`
+	CacheTTL time.Duration `flag:"external-authz-cache-ttl" cfg:"external_authz_cache_ttl"`
+	Headers  []string      `flag:"external-authz-header" cfg:"external_authz_headers"`
+}
+
+func externalAuthzFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("externalauthz", pflag.ExitOnError)
+
+	flagSet.String("external-authz-url", "", "the endpoint sent the method, path and client IP of every authenticated request, and the claims of its session, to allow or deny it before it is proxied; enables external authorization")
+	flagSet.String("external-authz-type", ExternalAuthzTypeWebhook, "the type of the external authorization endpoint: webhook or opa")
+	flagSet.Duration("external-authz-timeout", DefaultExternalAuthzTimeout, "the timeout of the requests to the external authorization endpoint")
+	flagSet.Bool("external-authz-fail-open", false, "allow requests when the external authorization endpoint fails, rather than responding with a 503")
+	flagSet.Duration("external-authz-cache-ttl", DefaultExternalAuthzCacheTTL, "how long the decisions of the external authorization endpoint are cached for identical requests and sessions; 0 to disable")
+	flagSet.StringSlice("external-authz-header", []string{}, "a request header sent to the external authorization endpoint (may be given multiple times)")
+
+	return flagSet
+}
+
+// externalAuthzDefaults creates an ExternalAuthz populating each field with
+// its default value
+func externalAuthzDefaults() ExternalAuthz {
+	return ExternalAuthz{
+		URL:      "",
+		Type:     ExternalAuthzTypeWebhook,
+		Timeout:  DefaultExternalAuthzTimeout,
+		FailOpen: false,
+		CacheTTL: DefaultExternalAuthzCacheTTL,
+		Headers:  nil,
+	}
+}
@@ -25,12 +25,18 @@ type HeaderValue struct {
 
 	// Allow users to load the value from a session claim
 	*ClaimSource `json:",omitempty"`
+
+	// Allow users to render the value from a template of the session claims
+	*TemplateSource `json:",omitempty"`
 }
 
 // ClaimSource allows loading a header value from a claim within the session
 type ClaimSource struct {
 	// Claim is the name of the claim in the session that the value should be
 	// loaded from.
+	// Claims other than those held by the session, such as `user`, `email` and
+	// `groups`, are loaded from the session's ID token and may be a path to a
+	// nested claim, eg: `resource.roles[*].name`.
 	Claim string `json:"claim,omitempty"`
 
 	// Prefix is an optional prefix that will be prepended to the value of the
@@ -42,3 +48,38 @@ type ClaimSource struct {
 	// basicAuthPassword will be used as the password value.
 	BasicAuthPassword *SecretSource `json:"basicAuthPassword,omitempty"`
 }
+
+// TemplateSource allows rendering a header value from the claims within the
+// session with a Go template
+type TemplateSource struct {
+	// Template is a Go text/template rendered per request as the value of the
+	// header, eg: `{{ .PreferredUsername }}@{{ .TenantID }}`.
+	// The template is given the `User`, `Email`, `Groups` and
+	// `PreferredUsername` of the session, and the claims named by Claims.
+	// Lists, such as the Groups, may be joined with `join`,
+	// eg: `{{ join "," .Groups }}`.
+	// The header isn't added when the template renders an empty value.
+	Template string `json:"template,omitempty"`
+
+	// Claims names the claims the template may use, by the name of their
+	// field in the template, eg: `TenantID: tid`.
+	// Claims are loaded like the claim of a ClaimSource, and may be a path to
+	// a nested claim. Claims with a single value are strings, claims with
+	// several values are lists.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// ResponseHeaderPolicy sets a static header on responses, eg. a security
+// header such as Strict-Transport-Security or Content-Security-Policy.
+type ResponseHeaderPolicy struct {
+	// Name is the name of the header.
+	Name string `json:"name,omitempty"`
+
+	// Value is the value the header is set to.
+	Value string `json:"value,omitempty"`
+
+	// Overwrite replaces any value already set for the header, eg. by the
+	// upstream server.
+	// Defaults to false, the header is only set when it is absent.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
@@ -0,0 +1,57 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultIdentityAssertionHeader is the default header the identity assertion
+	// is injected into.
+	DefaultIdentityAssertionHeader = "X-Forwarded-Id-Token-Assertion"
+
+	// DefaultIdentityAssertionExpiry is the default lifetime of an identity
+	// assertion.
+	DefaultIdentityAssertionExpiry = time.Minute
+)
+
+// IdentityAssertion contains configuration options for the signed JWT
+// asserting the user's identity that is injected into requests to upstreams
+type IdentityAssertion struct {
+	SigningKeyFile       string        `flag:"identity-assertion-signing-key-file" cfg:"identity_assertion_signing_key_file"`
+	SigningJWKSFile      string        `flag:"identity-assertion-signing-jwks-file" cfg:"identity_assertion_signing_jwks_file"`
+	VerificationKeyFiles []string      `flag:"identity-assertion-verification-key-file" cfg:"identity_assertion_verification_key_files"`
+	Header               string        `flag:"identity-assertion-header" cfg:"identity_assertion_header"`
+	Issuer               string        `flag:"identity-assertion-issuer" cfg:"identity_assertion_issuer"`
+	Audience             string        `flag:"identity-assertion-audience" cfg:"identity_assertion_audience"`
+	Expiry               time.Duration `flag:"identity-assertion-expiry" cfg:"identity_assertion_expiry"`
+}
+
+func identityAssertionFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("identity-assertion", pflag.ExitOnError)
+
+	flagSet.String("identity-assertion-signing-key-file", "", "path to a PEM encoded RSA or EC private key used to sign identity assertions; enables identity assertions")
+	flagSet.String("identity-assertion-signing-jwks-file", "", "path to a JSON Web Key Set holding the private key used to sign identity assertions, and public keys to keep publishing; enables identity assertions")
+	flagSet.StringSlice("identity-assertion-verification-key-file", []string{}, "paths to PEM encoded public keys of previous signing keys to keep publishing while upstreams rotate (may be given multiple times)")
+	flagSet.String("identity-assertion-header", DefaultIdentityAssertionHeader, "request header the identity assertion is injected into")
+	flagSet.String("identity-assertion-issuer", "", "issuer (iss) claim of identity assertions")
+	flagSet.String("identity-assertion-audience", "", "audience (aud) claim of identity assertions")
+	flagSet.Duration("identity-assertion-expiry", DefaultIdentityAssertionExpiry, "how long an identity assertion is valid for after the request is proxied")
+
+	return flagSet
+}
+
+// identityAssertionDefaults creates an IdentityAssertion populating each field
+// with its default value
+func identityAssertionDefaults() IdentityAssertion {
+	return IdentityAssertion{
+		SigningKeyFile:       "",
+		SigningJWKSFile:      "",
+		VerificationKeyFiles: nil,
+		Header:               DefaultIdentityAssertionHeader,
+		Issuer:               "",
+		Audience:             "",
+		Expiry:               DefaultIdentityAssertionExpiry,
+	}
+}
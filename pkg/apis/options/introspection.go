@@ -0,0 +1,42 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// DefaultIntrospectionCacheTTL is the default duration the introspection of
+// an active token is cached for.
+const DefaultIntrospectionCacheTTL = time.Minute
+
+// Introspection contains configuration options for verifying opaque bearer
+// tokens with an RFC 7662 token introspection endpoint
+type Introspection struct {
+	URL          string        `flag:"introspection-url" cfg:"introspection_url"`
+	ClientID     string        `flag:"introspection-client-id" cfg:"introspection_client_id"`
+	ClientSecret string        `flag:"introspection-client-secret" cfg:"introspection_client_secret"`
+	CacheTTL     time.Duration `flag:"introspection-cache-ttl" cfg:"introspection_cache_ttl"`
+}
+
+func introspectionFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("introspection", pflag.ExitOnError)
+
+	flagSet.String("introspection-url", "", "the RFC 7662 token introspection endpoint opaque bearer tokens are verified with; enables opaque bearer tokens")
+	flagSet.String("introspection-client-id", "", "the client ID to authenticate to the token introspection endpoint with")
+	flagSet.String("introspection-client-secret", "", "the client secret to authenticate to the token introspection endpoint with")
+	flagSet.Duration("introspection-cache-ttl", DefaultIntrospectionCacheTTL, "how long the introspection of an active token is cached for, at most until the token expires; 0 to disable")
+
+	return flagSet
+}
+
+// introspectionDefaults creates an Introspection populating each field with
+// its default value
+func introspectionDefaults() Introspection {
+	return Introspection{
+		URL:          "",
+		ClientID:     "",
+		ClientSecret: "",
+		CacheTTL:     DefaultIntrospectionCacheTTL,
+	}
+}
@@ -0,0 +1,26 @@
+package options
+
+import "github.com/spf13/pflag"
+
+// KubernetesDiscovery contains configuration options for the upstreams
+// discovered from the Services of a Kubernetes namespace, and kept in sync
+// with their EndpointSlices
+type KubernetesDiscovery struct {
+	Selector  string `flag:"kubernetes-discovery-selector" cfg:"kubernetes_discovery_selector"`
+	Namespace string `flag:"kubernetes-discovery-namespace" cfg:"kubernetes_discovery_namespace"`
+}
+
+func kubernetesDiscoveryFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("kubernetesdiscovery", pflag.ExitOnError)
+
+	flagSet.String("kubernetes-discovery-selector", "", "label selector of the Kubernetes Services registered as upstreams, with their ready endpoints as backends")
+	flagSet.String("kubernetes-discovery-namespace", "", "namespace of the Kubernetes Services registered as upstreams; defaults to the namespace of the pod")
+
+	return flagSet
+}
+
+// kubernetesDiscoveryDefaults creates a KubernetesDiscovery populating each
+// field with its default value
+func kubernetesDiscoveryDefaults() KubernetesDiscovery {
+	return KubernetesDiscovery{}
+}
@@ -48,15 +48,19 @@ func NewLegacyOptions() *LegacyOptions {
 		},
 
 		LegacyProvider: LegacyProvider{
-			ProviderType:          "google",
-			AzureTenant:           "common",
-			ApprovalPrompt:        "force",
-			UserIDClaim:           "email",
-			OIDCEmailClaim:        "email",
-			OIDCGroupsClaim:       "groups",
-			OIDCAudienceClaims:    []string{"aud"},
-			OIDCExtraAudiences:    []string{},
-			InsecureOIDCSkipNonce: true,
+			ProviderType:                "google",
+			AzureTenant:                 "common",
+			GoogleGroupCacheTTL:         DefaultGoogleGroupCacheTTL,
+			GoogleGroupCheckConcurrency: DefaultGoogleGroupCheckConcurrency,
+			ApprovalPrompt:              "force",
+			UserIDClaim:                 "email",
+			OIDCEmailClaim:              "email",
+			OIDCEmailVerifiedClaim:      "email_verified",
+			OIDCEmailVerification:       "ifPresent",
+			OIDCGroupsClaim:             "groups",
+			OIDCAudienceClaims:          []string{"aud"},
+			OIDCExtraAudiences:          []string{},
+			InsecureOIDCSkipNonce:       true,
 		},
 
 		Options: *NewOptions(),
@@ -83,7 +87,7 @@ func (l *LegacyOptions) ToOptions() (*Options, error) {
 
 	l.Options.InjectRequestHeaders, l.Options.InjectResponseHeaders = l.LegacyHeaders.convert()
 
-	l.Options.Server, l.Options.MetricsServer = l.LegacyServer.convert()
+	l.Options.Server, l.Options.MetricsServer, l.Options.ManagementServer = l.LegacyServer.convert()
 
 	l.Options.LegacyPreferEmailToUser = l.LegacyHeaders.PreferEmailToUser
 
@@ -103,6 +107,8 @@ type LegacyUpstreams struct {
 	SSLUpstreamInsecureSkipVerify bool          `flag:"ssl-upstream-insecure-skip-verify" cfg:"ssl_upstream_insecure_skip_verify"`
 	Upstreams                     []string      `flag:"upstream" cfg:"upstreams"`
 	Timeout                       time.Duration `flag:"upstream-timeout" cfg:"upstream_timeout"`
+	AuthorizationConflict         string        `flag:"authorization-conflict" cfg:"authorization_conflict"`
+	ClientAuthorizationHeader     string        `flag:"client-authorization-header" cfg:"client_authorization_header"`
 }
 
 func legacyUpstreamsFlagSet() *pflag.FlagSet {
@@ -114,6 +120,8 @@ func legacyUpstreamsFlagSet() *pflag.FlagSet {
 	flagSet.Bool("ssl-upstream-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS upstreams")
 	flagSet.StringSlice("upstream", []string{}, "the http url(s) of the upstream endpoint, file:// paths for static files or static://<status_code> for static response. Routing is based on the path")
 	flagSet.Duration("upstream-timeout", DefaultUpstreamTimeout, "maximum amount of time the server will wait for a response from the upstream")
+	flagSet.String("authorization-conflict", "", "how the Authorization header of client requests is sent upstream when an Authorization header is injected from the session: overwrite (default), preserve-client or move-client")
+	flagSet.String("client-authorization-header", "", "the header the client's Authorization header is moved to with the move-client authorization-conflict (default X-Original-Authorization)")
 
 	return flagSet
 }
@@ -142,6 +150,9 @@ func (l *LegacyUpstreams) convert() (UpstreamConfig, error) {
 			ProxyWebSockets:       &l.ProxyWebSockets,
 			FlushInterval:         &flushInterval,
 			Timeout:               &timeout,
+
+			AuthorizationConflict:     l.AuthorizationConflict,
+			ClientAuthorizationHeader: l.ClientAuthorizationHeader,
 		}
 
 		switch u.Scheme {
@@ -174,6 +185,8 @@ func (l *LegacyUpstreams) convert() (UpstreamConfig, error) {
 			upstream.ProxyWebSockets = nil
 			upstream.FlushInterval = nil
 			upstream.Timeout = nil
+			upstream.AuthorizationConflict = ""
+			upstream.ClientAuthorizationHeader = ""
 		}
 
 		upstreams.Upstreams = append(upstreams.Upstreams, upstream)
@@ -447,16 +460,24 @@ func getXAuthRequestAccessTokenHeader() Header {
 }
 
 type LegacyServer struct {
-	MetricsAddress       string   `flag:"metrics-address" cfg:"metrics_address"`
-	MetricsSecureAddress string   `flag:"metrics-secure-address" cfg:"metrics_secure_address"`
-	MetricsTLSCertFile   string   `flag:"metrics-tls-cert-file" cfg:"metrics_tls_cert_file"`
-	MetricsTLSKeyFile    string   `flag:"metrics-tls-key-file" cfg:"metrics_tls_key_file"`
-	HTTPAddress          string   `flag:"http-address" cfg:"http_address"`
-	HTTPSAddress         string   `flag:"https-address" cfg:"https_address"`
-	TLSCertFile          string   `flag:"tls-cert-file" cfg:"tls_cert_file"`
-	TLSKeyFile           string   `flag:"tls-key-file" cfg:"tls_key_file"`
-	TLSMinVersion        string   `flag:"tls-min-version" cfg:"tls_min_version"`
-	TLSCipherSuites      []string `flag:"tls-cipher-suite" cfg:"tls_cipher_suites"`
+	MetricsAddress          string        `flag:"metrics-address" cfg:"metrics_address"`
+	MetricsSecureAddress    string        `flag:"metrics-secure-address" cfg:"metrics_secure_address"`
+	MetricsTLSCertFile      string        `flag:"metrics-tls-cert-file" cfg:"metrics_tls_cert_file"`
+	MetricsTLSKeyFile       string        `flag:"metrics-tls-key-file" cfg:"metrics_tls_key_file"`
+	MetricsTLSMinVersion    string        `flag:"metrics-tls-min-version" cfg:"metrics_tls_min_version"`
+	MetricsTLSCipherSuites  []string      `flag:"metrics-tls-cipher-suite" cfg:"metrics_tls_cipher_suites"`
+	ManagementAddress       string        `flag:"management-address" cfg:"management_address"`
+	ManagementSecureAddress string        `flag:"management-secure-address" cfg:"management_secure_address"`
+	ManagementTLSCertFile   string        `flag:"management-tls-cert-file" cfg:"management_tls_cert_file"`
+	ManagementTLSKeyFile    string        `flag:"management-tls-key-file" cfg:"management_tls_key_file"`
+	HTTPAddress             string        `flag:"http-address" cfg:"http_address"`
+	HTTPSAddress            string        `flag:"https-address" cfg:"https_address"`
+	TLSCertFile             string        `flag:"tls-cert-file" cfg:"tls_cert_file"`
+	TLSKeyFile              string        `flag:"tls-key-file" cfg:"tls_key_file"`
+	TLSMinVersion           string        `flag:"tls-min-version" cfg:"tls_min_version"`
+	TLSCipherSuites         []string      `flag:"tls-cipher-suite" cfg:"tls_cipher_suites"`
+	TLSClientCAFile         string        `flag:"tls-client-ca-file" cfg:"tls_client_ca_file"`
+	TLSReloadInterval       time.Duration `flag:"tls-reload-interval" cfg:"tls_reload_interval"`
 }
 
 func legacyServerFlagset() *pflag.FlagSet {
@@ -466,12 +487,20 @@ func legacyServerFlagset() *pflag.FlagSet {
 	flagSet.String("metrics-secure-address", "", "the address /metrics will be served on for HTTPS clients (e.g. \":9100\")")
 	flagSet.String("metrics-tls-cert-file", "", "path to certificate file for secure metrics server")
 	flagSet.String("metrics-tls-key-file", "", "path to private key file for secure metrics server")
+	flagSet.String("metrics-tls-min-version", "", "minimal TLS version for the secure metrics server (either \"TLS1.2\" or \"TLS1.3\")")
+	flagSet.StringSlice("metrics-tls-cipher-suite", []string{}, "restricts TLS cipher suites of the secure metrics server to those listed (e.g. TLS_RSA_WITH_RC4_128_SHA) (may be given multiple times)")
+	flagSet.String("management-address", "", "the address the management endpoints (metrics, pprof, readiness, admin APIs) will be served on (e.g. \"127.0.0.1:9200\"); they are no longer served on the http-address when set")
+	flagSet.String("management-secure-address", "", "the address the management endpoints will be served on for HTTPS clients (e.g. \"127.0.0.1:9201\")")
+	flagSet.String("management-tls-cert-file", "", "path to certificate file for secure management server")
+	flagSet.String("management-tls-key-file", "", "path to private key file for secure management server")
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("tls-cert-file", "", "path to certificate file")
 	flagSet.String("tls-key-file", "", "path to private key file")
 	flagSet.String("tls-min-version", "", "minimal TLS version for HTTPS clients (either \"TLS1.2\" or \"TLS1.3\")")
 	flagSet.StringSlice("tls-cipher-suite", []string{}, "restricts TLS cipher suites to those listed (e.g. TLS_RSA_WITH_RC4_128_SHA) (may be given multiple times)")
+	flagSet.String("tls-client-ca-file", "", "path to the CA certificates that client certificates presented to the HTTPS server are verified against")
+	flagSet.Duration("tls-reload-interval", 0, "interval at which the TLS certificate and key are loaded again, so they can be rotated without a restart; they are also loaded again on SIGHUP (0 to disable)")
 
 	return flagSet
 }
@@ -483,8 +512,12 @@ type LegacyProvider struct {
 
 	KeycloakGroups           []string `flag:"keycloak-group" cfg:"keycloak_groups"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
+	AppleTeamID              string   `flag:"apple-team-id" cfg:"apple_team_id"`
+	AppleKeyID               string   `flag:"apple-key-id" cfg:"apple_key_id"`
+	ApplePrivateKeyFile      string   `flag:"apple-private-key-file" cfg:"apple_private_key_file"`
 	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team"`
 	BitbucketRepository      string   `flag:"bitbucket-repository" cfg:"bitbucket_repository"`
+	CognitoLogoutURI         string   `flag:"cognito-logout-uri" cfg:"cognito_logout_uri"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
 	GitHubRepo               string   `flag:"github-repo" cfg:"github_repo"`
@@ -496,6 +529,10 @@ type LegacyProvider struct {
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
 
+	GoogleGroupCacheTTL         time.Duration `flag:"google-group-cache-ttl" cfg:"google_group_cache_ttl"`
+	GoogleTransitiveMembership  bool          `flag:"google-transitive-membership" cfg:"google_transitive_membership"`
+	GoogleGroupCheckConcurrency int           `flag:"google-group-check-concurrency" cfg:"google_group_check_concurrency"`
+
 	// These options allow for other providers besides Google, with
 	// potential overrides.
 	ProviderType                       string   `flag:"provider" cfg:"provider"`
@@ -508,19 +545,31 @@ type LegacyProvider struct {
 	SkipOIDCDiscovery                  bool     `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery"`
 	OIDCJwksURL                        string   `flag:"oidc-jwks-url" cfg:"oidc_jwks_url"`
 	OIDCEmailClaim                     string   `flag:"oidc-email-claim" cfg:"oidc_email_claim"`
+	OIDCEmailVerifiedClaim             string   `flag:"oidc-email-verified-claim" cfg:"oidc_email_verified_claim"`
+	OIDCEmailVerification              string   `flag:"oidc-email-verification" cfg:"oidc_email_verification"`
 	OIDCGroupsClaim                    string   `flag:"oidc-groups-claim" cfg:"oidc_groups_claim"`
 	OIDCAudienceClaims                 []string `flag:"oidc-audience-claim" cfg:"oidc_audience_claims"`
 	OIDCExtraAudiences                 []string `flag:"oidc-extra-audience" cfg:"oidc_extra_audiences"`
+	OIDCRPInitiatedLogout              bool     `flag:"oidc-rp-initiated-logout" cfg:"oidc_rp_initiated_logout"`
+	OIDCEndSessionURL                  string   `flag:"oidc-end-session-url" cfg:"oidc_end_session_url"`
+	OIDCPostLogoutRedirectURL          string   `flag:"oidc-post-logout-redirect-url" cfg:"oidc_post_logout_redirect_url"`
 	LoginURL                           string   `flag:"login-url" cfg:"login_url"`
 	RedeemURL                          string   `flag:"redeem-url" cfg:"redeem_url"`
 	ProfileURL                         string   `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource                  string   `flag:"resource" cfg:"resource"`
 	ValidateURL                        string   `flag:"validate-url" cfg:"validate_url"`
+	RevocationURL                      string   `flag:"revocation-url" cfg:"revocation_url"`
+	RevokeAccessToken                  bool     `flag:"revoke-access-token" cfg:"revoke_access_token"`
+	DeviceAuthorizationURL             string   `flag:"device-authorization-url" cfg:"device_authorization_url"`
 	Scope                              string   `flag:"scope" cfg:"scope"`
 	Prompt                             string   `flag:"prompt" cfg:"prompt"`
 	ApprovalPrompt                     string   `flag:"approval-prompt" cfg:"approval_prompt"` // Deprecated by OIDC 1.0
 	UserIDClaim                        string   `flag:"user-id-claim" cfg:"user_id_claim"`
 	AllowedGroups                      []string `flag:"allowed-group" cfg:"allowed_groups"`
+	DeniedGroups                       []string `flag:"denied-group" cfg:"denied_groups"`
+	GroupsTransform                    string   `flag:"groups-transform" cfg:"groups_transform"`
+	GroupsFilter                       []string `flag:"groups-filter" cfg:"groups_filter"`
+	MaxGroups                          int      `flag:"max-groups" cfg:"max_groups"`
 	AllowedRoles                       []string `flag:"allowed-role" cfg:"allowed_roles"`
 
 	AcrValues  string `flag:"acr-values" cfg:"acr_values"`
@@ -538,8 +587,12 @@ func legacyProviderFlagSet() *pflag.FlagSet {
 
 	flagSet.StringSlice("keycloak-group", []string{}, "restrict logins to members of these groups (may be given multiple times)")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.String("apple-team-id", "", "the Apple Developer team ID used to sign client secrets")
+	flagSet.String("apple-key-id", "", "the ID of the Sign in with Apple private key")
+	flagSet.String("apple-private-key-file", "", "the path to the Sign in with Apple private key (.p8) file")
 	flagSet.String("bitbucket-team", "", "restrict logins to members of this team")
 	flagSet.String("bitbucket-repository", "", "restrict logins to user with access to this repository")
+	flagSet.String("cognito-logout-uri", "", "the URI Cognito redirects to after signing out of the hosted UI (must be a sign out URL of the app client)")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
 	flagSet.String("github-repo", "", "restrict logins to collaborators of this repository")
@@ -549,7 +602,10 @@ func legacyProviderFlagSet() *pflag.FlagSet {
 	flagSet.StringSlice("gitlab-project", []string{}, "restrict logins to members of this project (may be given multiple times) (eg `group/project=accesslevel`). Access level should be a value matching Gitlab access levels (see https://docs.gitlab.com/ee/api/members.html#valid-access-levels), defaulted to 20 if absent")
 	flagSet.StringSlice("google-group", []string{}, "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
-	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.String("google-service-account-json", "", "the path to the service account json credentials (Application Default Credentials are used if unset)")
+	flagSet.Duration("google-group-cache-ttl", DefaultGoogleGroupCacheTTL, "how long to cache a user's Google Group memberships before checking them again (0 to disable)")
+	flagSet.Bool("google-transitive-membership", false, "check Google Group memberships with the Cloud Identity API, so that members of nested groups are allowed")
+	flagSet.Int("google-group-check-concurrency", DefaultGoogleGroupCheckConcurrency, "the number of Google Groups checked in parallel for each user")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("client-secret-file", "", "the file with OAuth Client Secret")
@@ -565,13 +621,21 @@ func legacyProviderFlagSet() *pflag.FlagSet {
 	flagSet.String("oidc-jwks-url", "", "OpenID Connect JWKS URL (ie: https://www.googleapis.com/oauth2/v3/certs)")
 	flagSet.String("oidc-groups-claim", OIDCGroupsClaim, "which OIDC claim contains the user groups")
 	flagSet.String("oidc-email-claim", OIDCEmailClaim, "which OIDC claim contains the user's email")
+	flagSet.String("oidc-email-verified-claim", OIDCEmailVerifiedClaim, "which OIDC claim contains whether the user's email is verified")
+	flagSet.String("oidc-email-verification", string(EmailVerificationIfPresent), "whether the OIDC email verified claim must be present in the id_token (required) or is only checked when present (ifPresent)")
 	flagSet.StringSlice("oidc-audience-claim", OIDCAudienceClaims, "which OIDC claims are used as audience to verify against client id")
 	flagSet.StringSlice("oidc-extra-audience", []string{}, "additional audiences allowed to pass audience verification")
+	flagSet.Bool("oidc-rp-initiated-logout", false, "sign users out of the provider when they sign out, at its end session endpoint")
+	flagSet.String("oidc-end-session-url", "", "OpenID Connect end session endpoint for RP-initiated logout (defaults to the discovered end_session_endpoint)")
+	flagSet.String("oidc-post-logout-redirect-url", "", "where the provider returns users to after RP-initiated logout, must be registered with the provider (defaults to the sign out redirect when it is an absolute URL)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("revocation-url", "", "Token revocation endpoint, tokens are revoked there on sign out (defaults to the discovered revocation_endpoint)")
+	flagSet.Bool("revoke-access-token", false, "Revoke the access token along with the refresh token")
+	flagSet.String("device-authorization-url", "", "Device authorization endpoint the device flow of CLI clients is started at (defaults to the discovered device_authorization_endpoint)")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("prompt", "", "OIDC prompt")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
@@ -585,12 +649,16 @@ func legacyProviderFlagSet() *pflag.FlagSet {
 
 	flagSet.String("user-id-claim", OIDCEmailClaim, "(DEPRECATED for `oidc-email-claim`) which claim contains the user ID")
 	flagSet.StringSlice("allowed-group", []string{}, "restrict logins to members of this group (may be given multiple times)")
+	flagSet.StringSlice("denied-group", []string{}, "deny logins to members of this group, even if they are members of an allowed group (may be given multiple times)")
+	flagSet.String("groups-transform", "", "regex whose first capture group replaces the names of the groups it matches before they are stored in the session (eg `^CN=([^,]+),` for the common name of LDAP DNs)")
+	flagSet.StringSlice("groups-filter", []string{}, "only store the groups whose transformed names start with this prefix, or match this regex when it starts with ~ (may be given multiple times)")
+	flagSet.Int("max-groups", 0, "maximum number of groups stored in the session, the groups beyond it are dropped with a warning (0 for no limit)")
 	flagSet.StringSlice("allowed-role", []string{}, "(keycloak-oidc) restrict logins to members of these roles (may be given multiple times)")
 
 	return flagSet
 }
 
-func (l LegacyServer) convert() (Server, Server) {
+func (l LegacyServer) convert() (Server, Server, Server) {
 	appServer := Server{
 		BindAddress:       l.HTTPAddress,
 		SecureBindAddress: l.HTTPSAddress,
@@ -608,6 +676,12 @@ func (l LegacyServer) convert() (Server, Server) {
 		if len(l.TLSCipherSuites) != 0 {
 			appServer.TLS.CipherSuites = l.TLSCipherSuites
 		}
+		if l.TLSClientCAFile != "" {
+			appServer.TLS.ClientCA = &SecretSource{
+				FromFile: l.TLSClientCAFile,
+			}
+		}
+		appServer.TLS.ReloadInterval = Duration(l.TLSReloadInterval)
 		// Preserve backwards compatibility, only run one server
 		appServer.BindAddress = ""
 	} else {
@@ -628,29 +702,57 @@ func (l LegacyServer) convert() (Server, Server) {
 			Cert: &SecretSource{
 				FromFile: l.MetricsTLSCertFile,
 			},
+			MinVersion: l.MetricsTLSMinVersion,
+		}
+		if len(l.MetricsTLSCipherSuites) != 0 {
+			metricsServer.TLS.CipherSuites = l.MetricsTLSCipherSuites
+		}
+	}
+
+	managementServer := Server{
+		BindAddress:       l.ManagementAddress,
+		SecureBindAddress: l.ManagementSecureAddress,
+	}
+	if l.ManagementTLSKeyFile != "" || l.ManagementTLSCertFile != "" {
+		managementServer.TLS = &TLS{
+			Key: &SecretSource{
+				FromFile: l.ManagementTLSKeyFile,
+			},
+			Cert: &SecretSource{
+				FromFile: l.ManagementTLSCertFile,
+			},
 		}
 	}
 
-	return appServer, metricsServer
+	return appServer, metricsServer, managementServer
 }
 
 func (l *LegacyProvider) convert() (Providers, error) {
 	providers := Providers{}
 
 	provider := Provider{
-		ClientID:            l.ClientID,
-		ClientSecret:        l.ClientSecret,
-		ClientSecretFile:    l.ClientSecretFile,
-		Type:                ProviderType(l.ProviderType),
-		CAFiles:             l.ProviderCAFiles,
-		LoginURL:            l.LoginURL,
-		RedeemURL:           l.RedeemURL,
-		ProfileURL:          l.ProfileURL,
-		ProtectedResource:   l.ProtectedResource,
-		ValidateURL:         l.ValidateURL,
-		Scope:               l.Scope,
-		AllowedGroups:       l.AllowedGroups,
-		CodeChallengeMethod: l.CodeChallengeMethod,
+		ClientID:               l.ClientID,
+		ClientSecret:           l.ClientSecret,
+		ClientSecretFile:       l.ClientSecretFile,
+		Type:                   ProviderType(l.ProviderType),
+		CAFiles:                l.ProviderCAFiles,
+		LoginURL:               l.LoginURL,
+		RedeemURL:              l.RedeemURL,
+		ProfileURL:             l.ProfileURL,
+		ProtectedResource:      l.ProtectedResource,
+		ValidateURL:            l.ValidateURL,
+		RevocationURL:          l.RevocationURL,
+		RevokeAccessToken:      l.RevokeAccessToken,
+		DeviceAuthorizationURL: l.DeviceAuthorizationURL,
+		Scope:                  l.Scope,
+		AllowedGroups:          l.AllowedGroups,
+		DeniedGroups:           l.DeniedGroups,
+		CodeChallengeMethod:    l.CodeChallengeMethod,
+		GroupsNormalization: GroupsNormalization{
+			Transform: l.GroupsTransform,
+			Filter:    l.GroupsFilter,
+			MaxGroups: l.MaxGroups,
+		},
 	}
 
 	// This part is out of the switch section for all providers that support OIDC
@@ -663,9 +765,14 @@ func (l *LegacyProvider) convert() (Providers, error) {
 		JwksURL:                        l.OIDCJwksURL,
 		UserIDClaim:                    l.UserIDClaim,
 		EmailClaim:                     l.OIDCEmailClaim,
+		EmailVerifiedClaim:             l.OIDCEmailVerifiedClaim,
+		EmailVerification:              EmailVerificationMode(l.OIDCEmailVerification),
 		GroupsClaim:                    l.OIDCGroupsClaim,
 		AudienceClaims:                 l.OIDCAudienceClaims,
 		ExtraAudiences:                 l.OIDCExtraAudiences,
+		RPInitiatedLogout:              l.OIDCRPInitiatedLogout,
+		EndSessionURL:                  l.OIDCEndSessionURL,
+		PostLogoutRedirectURL:          l.OIDCPostLogoutRedirectURL,
 	}
 
 	// Support for legacy configuration option
@@ -713,11 +820,24 @@ func (l *LegacyProvider) convert() (Providers, error) {
 			Team:       l.BitbucketTeam,
 			Repository: l.BitbucketRepository,
 		}
+	case "apple":
+		provider.AppleConfig = AppleOptions{
+			TeamID:         l.AppleTeamID,
+			KeyID:          l.AppleKeyID,
+			PrivateKeyFile: l.ApplePrivateKeyFile,
+		}
+	case "cognito":
+		provider.CognitoConfig = CognitoOptions{
+			LogoutURI: l.CognitoLogoutURI,
+		}
 	case "google":
 		provider.GoogleConfig = GoogleOptions{
-			Groups:             l.GoogleGroups,
-			AdminEmail:         l.GoogleAdminEmail,
-			ServiceAccountJSON: l.GoogleServiceAccountJSON,
+			Groups:                l.GoogleGroups,
+			AdminEmail:            l.GoogleAdminEmail,
+			ServiceAccountJSON:    l.GoogleServiceAccountJSON,
+			GroupCacheTTL:         Duration(l.GoogleGroupCacheTTL),
+			TransitiveMembership:  l.GoogleTransitiveMembership,
+			GroupCheckConcurrency: l.GoogleGroupCheckConcurrency,
 		}
 	}
 
@@ -135,9 +135,10 @@ var _ = Describe("Legacy Options", func() {
 
 	Context("Legacy Upstreams", func() {
 		type convertUpstreamsTableInput struct {
-			upstreamStrings   []string
-			expectedUpstreams []Upstream
-			errMsg            string
+			upstreamStrings       []string
+			authorizationConflict string
+			expectedUpstreams     []Upstream
+			errMsg                string
 		}
 
 		// Non defaults for these options
@@ -215,6 +216,10 @@ var _ = Describe("Legacy Options", func() {
 			Timeout:               nil,
 		}
 
+		moveClientHTTPUpstream := validHTTPUpstream
+		moveClientHTTPUpstream.AuthorizationConflict = AuthorizationConflictMoveClient
+		moveClientHTTPUpstream.ClientAuthorizationHeader = "X-Api-Authorization"
+
 		invalidHTTP := ":foo"
 		invalidHTTPErrMsg := "could not parse upstream \":foo\": parse \":foo\": missing protocol scheme"
 
@@ -228,6 +233,10 @@ var _ = Describe("Legacy Options", func() {
 					FlushInterval:                 time.Duration(flushInterval),
 					Timeout:                       time.Duration(timeout),
 				}
+				if in.authorizationConflict != "" {
+					legacyUpstreams.AuthorizationConflict = in.authorizationConflict
+					legacyUpstreams.ClientAuthorizationHeader = "X-Api-Authorization"
+				}
 
 				upstreams, err := legacyUpstreams.convert()
 
@@ -280,6 +289,12 @@ var _ = Describe("Legacy Options", func() {
 				expectedUpstreams: []Upstream{},
 				errMsg:            invalidHTTPErrMsg,
 			}),
+			Entry("with an authorization conflict policy", &convertUpstreamsTableInput{
+				upstreamStrings:       []string{validHTTP, validStatic},
+				authorizationConflict: AuthorizationConflictMoveClient,
+				expectedUpstreams:     []Upstream{moveClientHTTPUpstream, validStaticUpstream},
+				errMsg:                "",
+			}),
 			Entry("with multiple valid upstreams", &convertUpstreamsTableInput{
 				upstreamStrings:   []string{validHTTP, validFileWithFragment, validStatic},
 				expectedUpstreams: []Upstream{validHTTPUpstream, validFileWithFragmentUpstream, validStaticUpstream},
@@ -790,9 +805,10 @@ var _ = Describe("Legacy Options", func() {
 
 	Context("Legacy Servers", func() {
 		type legacyServersTableInput struct {
-			legacyServer          LegacyServer
-			expectedAppServer     Server
-			expectedMetricsServer Server
+			legacyServer             LegacyServer
+			expectedAppServer        Server
+			expectedMetricsServer    Server
+			expectedManagementServer Server
 		}
 
 		const (
@@ -830,11 +846,20 @@ var _ = Describe("Legacy Options", func() {
 			},
 		}
 
-		DescribeTable("should convert to app and metrics servers",
+		var tlsConfigClientCA = &TLS{
+			Cert: tlsConfig.Cert,
+			Key:  tlsConfig.Key,
+			ClientCA: &SecretSource{
+				FromFile: "tls-client-ca.crt",
+			},
+		}
+
+		DescribeTable("should convert to app, metrics and management servers",
 			func(in legacyServersTableInput) {
-				appServer, metricsServer := in.legacyServer.convert()
+				appServer, metricsServer, managementServer := in.legacyServer.convert()
 				Expect(appServer).To(Equal(in.expectedAppServer))
 				Expect(metricsServer).To(Equal(in.expectedMetricsServer))
+				Expect(managementServer).To(Equal(in.expectedManagementServer))
 			},
 			Entry("with default options only starts app HTTP server", legacyServersTableInput{
 				legacyServer: LegacyServer{
@@ -883,6 +908,19 @@ var _ = Describe("Legacy Options", func() {
 					TLS:               tlsConfigCipherSuites,
 				},
 			}),
+			Entry("with TLS options specified with a client CA", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:     insecureAddr,
+					HTTPSAddress:    secureAddr,
+					TLSKeyFile:      keyPath,
+					TLSCertFile:     crtPath,
+					TLSClientCAFile: "tls-client-ca.crt",
+				},
+				expectedAppServer: Server{
+					SecureBindAddress: secureAddr,
+					TLS:               tlsConfigClientCA,
+				},
+			}),
 			Entry("with metrics HTTP and HTTPS addresses", legacyServersTableInput{
 				legacyServer: LegacyServer{
 					HTTPAddress:          insecureAddr,
@@ -916,6 +954,48 @@ var _ = Describe("Legacy Options", func() {
 					TLS:               tlsConfig,
 				},
 			}),
+			Entry("with metrics HTTPS and independent tls min version and cipher suites", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:            insecureAddr,
+					HTTPSAddress:           secureAddr,
+					TLSMinVersion:          "TLS1.2",
+					MetricsSecureAddress:   secureMetricsAddr,
+					MetricsTLSKeyFile:      keyPath,
+					MetricsTLSCertFile:     crtPath,
+					MetricsTLSMinVersion:   "TLS1.3",
+					MetricsTLSCipherSuites: []string{"TLS_AES_128_GCM_SHA256"},
+				},
+				expectedAppServer: Server{
+					BindAddress: insecureAddr,
+				},
+				expectedMetricsServer: Server{
+					SecureBindAddress: secureMetricsAddr,
+					TLS: &TLS{
+						Key:          tlsConfig.Key,
+						Cert:         tlsConfig.Cert,
+						MinVersion:   "TLS1.3",
+						CipherSuites: []string{"TLS_AES_128_GCM_SHA256"},
+					},
+				},
+			}),
+			Entry("with management HTTP and HTTPS and tls cert/key", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:             insecureAddr,
+					HTTPSAddress:            secureAddr,
+					ManagementAddress:       "127.0.0.1:9200",
+					ManagementSecureAddress: "127.0.0.1:9201",
+					ManagementTLSKeyFile:    keyPath,
+					ManagementTLSCertFile:   crtPath,
+				},
+				expectedAppServer: Server{
+					BindAddress: insecureAddr,
+				},
+				expectedManagementServer: Server{
+					BindAddress:       "127.0.0.1:9200",
+					SecureBindAddress: "127.0.0.1:9201",
+					TLS:               tlsConfig,
+				},
+			}),
 		)
 	})
 
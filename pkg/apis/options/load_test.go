@@ -37,14 +37,18 @@ var _ = Describe("Load", func() {
 		},
 
 		LegacyProvider: LegacyProvider{
-			ProviderType:          "google",
-			AzureTenant:           "common",
-			ApprovalPrompt:        "force",
-			UserIDClaim:           "email",
-			OIDCEmailClaim:        "email",
-			OIDCGroupsClaim:       "groups",
-			OIDCAudienceClaims:    []string{"aud"},
-			InsecureOIDCSkipNonce: true,
+			ProviderType:                "google",
+			AzureTenant:                 "common",
+			GoogleGroupCacheTTL:         DefaultGoogleGroupCacheTTL,
+			GoogleGroupCheckConcurrency: DefaultGoogleGroupCheckConcurrency,
+			ApprovalPrompt:              "force",
+			UserIDClaim:                 "email",
+			OIDCEmailClaim:              "email",
+			OIDCEmailVerifiedClaim:      "email_verified",
+			OIDCEmailVerification:       "ifPresent",
+			OIDCGroupsClaim:             "groups",
+			OIDCAudienceClaims:          []string{"aud"},
+			InsecureOIDCSkipNonce:       true,
 		},
 
 		Options: Options{
@@ -56,7 +60,28 @@ var _ = Describe("Load", func() {
 			Session:            sessionOptionsDefaults(),
 			Templates:          templatesDefaults(),
 			SkipAuthPreflight:  false,
+			APIClientRules:     []string{"api:Accept=application/json"},
 			Logging:            loggingDefaults(),
+			Redirect:           redirectDefaults(),
+			SignOut:            signOutDefaults(),
+			MetricsAuth:        metricsAuthDefaults(),
+			IdentityAssertion:  identityAssertionDefaults(),
+			SignedURL:          signedURLDefaults(),
+			Introspection:      introspectionDefaults(),
+			Probe:              probeDefaults(),
+			SessionEvents:      sessionEventsDefaults(),
+			Audit:              auditDefaults(),
+			Crawlers:           crawlersDefaults(),
+			DynamicUpstreams:   dynamicUpstreamsDefaults(),
+			ProviderFallback:   providerFallbackDefaults(),
+			ClaimEnrichment:    claimEnrichmentDefaults(),
+			ExternalAuthz:      externalAuthzDefaults(),
+			SessionExpiry:      sessionExpiryDefaults(),
+			SessionDebug:       sessionDebugDefaults(),
+			StrictSecurity:     strictSecurityDefaults(),
+			Management:         managementDefaults(),
+			Maintenance:        maintenanceDefaults(),
+			Tracing:            tracingDefaults(),
 		},
 	}
 
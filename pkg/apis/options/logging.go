@@ -1,24 +1,56 @@
 package options
 
 import (
+	"time"
+
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 	"github.com/spf13/pflag"
 )
 
+const (
+	// RequestIDTrustAlways adopts any well formed incoming request ID
+	RequestIDTrustAlways = "always"
+	// RequestIDTrustNever always generates a new request ID
+	RequestIDTrustNever = "never"
+	// RequestIDTrustTrustedProxies adopts incoming request IDs only when the
+	// peer is one of the trusted proxies
+	RequestIDTrustTrustedProxies = "trusted-proxies"
+)
+
 // Logging contains all options required for configuring the logging
 type Logging struct {
-	AuthEnabled     bool           `flag:"auth-logging" cfg:"auth_logging"`
-	AuthFormat      string         `flag:"auth-logging-format" cfg:"auth_logging_format"`
-	RequestEnabled  bool           `flag:"request-logging" cfg:"request_logging"`
-	RequestFormat   string         `flag:"request-logging-format" cfg:"request_logging_format"`
-	StandardEnabled bool           `flag:"standard-logging" cfg:"standard_logging"`
-	StandardFormat  string         `flag:"standard-logging-format" cfg:"standard_logging_format"`
-	ErrToInfo       bool           `flag:"errors-to-info-log" cfg:"errors_to_info_log"`
-	ExcludePaths    []string       `flag:"exclude-logging-path" cfg:"exclude_logging_paths"`
-	LocalTime       bool           `flag:"logging-local-time" cfg:"logging_local_time"`
-	SilencePing     bool           `flag:"silence-ping-logging" cfg:"silence_ping_logging"`
-	RequestIDHeader string         `flag:"request-id-header" cfg:"request_id_header"`
-	File            LogFileOptions `cfg:",squash"`
+	AuthEnabled     bool            `flag:"auth-logging" cfg:"auth_logging"`
+	AuthFormat      string          `flag:"auth-logging-format" cfg:"auth_logging_format"`
+	RequestEnabled  bool            `flag:"request-logging" cfg:"request_logging"`
+	RequestFormat   string          `flag:"request-logging-format" cfg:"request_logging_format"`
+	RequestEncoding string          `flag:"request-logging-encoding" cfg:"request_logging_encoding"`
+	StandardEnabled bool            `flag:"standard-logging" cfg:"standard_logging"`
+	StandardFormat  string          `flag:"standard-logging-format" cfg:"standard_logging_format"`
+	ErrToInfo       bool            `flag:"errors-to-info-log" cfg:"errors_to_info_log"`
+	DebugEnabled    bool            `flag:"debug-logging" cfg:"debug_logging"`
+	ExcludePaths    []string        `flag:"exclude-logging-path" cfg:"exclude_logging_paths"`
+	LocalTime       bool            `flag:"logging-local-time" cfg:"logging_local_time"`
+	SilencePing     bool            `flag:"silence-ping-logging" cfg:"silence_ping_logging"`
+	RequestIDHeader string          `flag:"request-id-header" cfg:"request_id_header"`
+	RequestIDTrust  string          `flag:"request-id-trust" cfg:"request_id_trust"`
+	File            LogFileOptions  `cfg:",squash"`
+	SlowRequests    SlowRequestLog  `cfg:",squash"`
+	RequestDebug    RequestDebugLog `cfg:",squash"`
+}
+
+// RequestDebugLog contains options for writing all log lines of selected
+// requests, including debug lines, regardless of the configured logging
+type RequestDebugLog struct {
+	Header string   `flag:"request-debug-header" cfg:"request_debug_header"`
+	Secret string   `flag:"request-debug-secret" cfg:"request_debug_secret"`
+	Emails []string `flag:"request-debug-email" cfg:"request_debug_emails"`
+}
+
+// SlowRequestLog contains options for logging slow requests to upstreams
+type SlowRequestLog struct {
+	Threshold     time.Duration `flag:"slow-request-threshold" cfg:"slow_request_threshold"`
+	SampleRate    float64       `flag:"slow-request-sample-rate" cfg:"slow_request_sample_rate"`
+	MaxPathLength int           `flag:"slow-request-max-path-length" cfg:"slow_request_max_path_length"`
 }
 
 // LogFileOptions contains options for configuring logging to a file
@@ -39,12 +71,23 @@ func loggingFlagSet() *pflag.FlagSet {
 	flagSet.String("standard-logging-format", logger.DefaultStandardLoggingFormat, "Template for standard log lines")
 	flagSet.Bool("request-logging", true, "Log HTTP requests")
 	flagSet.String("request-logging-format", logger.DefaultRequestLoggingFormat, "Template for HTTP request log lines")
+	flagSet.String("request-logging-encoding", logger.RequestLoggingEncodingText, "Encoding of HTTP request log lines (one of: text, json, logfmt); json and logfmt lines ignore the request logging format")
 	flagSet.Bool("errors-to-info-log", false, "Log errors to the standard logging channel instead of stderr")
+	flagSet.Bool("debug-logging", false, "Log debug information, such as the size of new sessions, on the standard logging channel")
 
 	flagSet.StringSlice("exclude-logging-path", []string{}, "Exclude logging requests to paths (eg: '/path1,/path2,/path3')")
 	flagSet.Bool("logging-local-time", true, "If the time in log files and backup filenames are local or UTC time")
 	flagSet.Bool("silence-ping-logging", false, "Disable logging of requests to ping endpoint")
 	flagSet.String("request-id-header", "X-Request-Id", "Request header to use as the request ID")
+	flagSet.String("request-id-trust", RequestIDTrustTrustedProxies, "When to adopt the request ID from an incoming request (one of: always, never, trusted-proxies)")
+
+	flagSet.Duration("slow-request-threshold", 0, "Log requests to upstreams that take longer than this duration; 0 to disable")
+	flagSet.Float64("slow-request-sample-rate", 0, "Fraction of requests to upstreams below the slow request threshold to log, between 0 and 1")
+	flagSet.Int("slow-request-max-path-length", 0, "Truncate paths in slow request log lines to this length; 0 to log the full path")
+
+	flagSet.String("request-debug-header", "", "Request header enabling debug logging for requests carrying the request debug secret; removed before proxying upstream")
+	flagSet.String("request-debug-secret", "", "Secret value of the request debug header enabling debug logging for the request")
+	flagSet.StringSlice("request-debug-email", []string{}, "Enable debug logging for the requests of sessions with this email (may be given multiple times)")
 
 	flagSet.String("logging-filename", "", "File to log requests to, empty for stdout")
 	flagSet.Int("logging-max-size", 100, "Maximum size in megabytes of the log file before rotation")
@@ -62,13 +105,16 @@ func loggingDefaults() Logging {
 		LocalTime:       true,
 		SilencePing:     false,
 		RequestIDHeader: "X-Request-Id",
+		RequestIDTrust:  RequestIDTrustTrustedProxies,
 		AuthEnabled:     true,
 		AuthFormat:      logger.DefaultAuthLoggingFormat,
 		RequestEnabled:  true,
 		RequestFormat:   logger.DefaultRequestLoggingFormat,
+		RequestEncoding: logger.RequestLoggingEncodingText,
 		StandardEnabled: true,
 		StandardFormat:  logger.DefaultStandardLoggingFormat,
 		ErrToInfo:       false,
+		DebugEnabled:    false,
 		File: LogFileOptions{
 			Filename:   "",
 			MaxSize:    100,
@@ -76,5 +122,15 @@ func loggingDefaults() Logging {
 			MaxBackups: 0,
 			Compress:   false,
 		},
+		SlowRequests: SlowRequestLog{
+			Threshold:     0,
+			SampleRate:    0,
+			MaxPathLength: 0,
+		},
+		RequestDebug: RequestDebugLog{
+			Header: "",
+			Secret: "",
+			Emails: nil,
+		},
 	}
 }
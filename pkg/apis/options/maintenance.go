@@ -0,0 +1,47 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Maintenance contains configuration options for the maintenance mode, in
+// which the proxied routes are answered with a maintenance page while the
+// proxy endpoints keep working.
+// The maintenance mode is toggled at runtime by the maintenance file, the
+// toggle signal or the maintenance endpoint of the management server.
+type Maintenance struct {
+	Enabled      bool          `flag:"maintenance-mode" cfg:"maintenance_mode"`
+	File         string        `flag:"maintenance-file" cfg:"maintenance_file"`
+	Signal       bool          `flag:"maintenance-signal" cfg:"maintenance_signal"`
+	RetryAfter   time.Duration `flag:"maintenance-retry-after" cfg:"maintenance_retry_after"`
+	BypassGroups []string      `flag:"maintenance-bypass-group" cfg:"maintenance_bypass_groups"`
+	Unready      bool          `flag:"maintenance-unready" cfg:"maintenance_unready"`
+}
+
+func maintenanceFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("maintenance", pflag.ExitOnError)
+
+	flagSet.Bool("maintenance-mode", false, "start in maintenance mode, answering the proxied routes with a 503 maintenance page")
+	flagSet.String("maintenance-file", "", "path to a file enabling the maintenance mode while it exists; the file is watched for changes")
+	flagSet.Bool("maintenance-signal", false, "toggle the maintenance mode when the process receives SIGUSR1 (not supported on Windows)")
+	flagSet.Duration("maintenance-retry-after", time.Duration(0), "the Retry-After of maintenance pages, rounded up to whole seconds (0 to omit the header)")
+	flagSet.StringSlice("maintenance-bypass-group", []string{}, "the groups of sessions allowed through to the upstreams during maintenance (may be given multiple times)")
+	flagSet.Bool("maintenance-unready", false, "make the readiness endpoint respond 503 during maintenance, so that load balancers can drain the proxy")
+
+	return flagSet
+}
+
+// maintenanceDefaults creates a Maintenance populating each field with its
+// default value
+func maintenanceDefaults() Maintenance {
+	return Maintenance{
+		Enabled:      false,
+		File:         "",
+		Signal:       false,
+		RetryAfter:   time.Duration(0),
+		BypassGroups: nil,
+		Unready:      false,
+	}
+}
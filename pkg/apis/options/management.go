@@ -0,0 +1,70 @@
+package options
+
+import "github.com/spf13/pflag"
+
+// Management contains configuration options for the endpoints of the
+// management server, and for protecting it.
+// The management server itself is configured by the ManagementServer.
+// When several auth methods are configured, requests must come from an
+// allowed IP and present either the bearer token or valid basic auth
+// credentials.
+type Management struct {
+	Metrics          bool `flag:"management-metrics" cfg:"management_metrics"`
+	Pprof            bool `flag:"management-pprof" cfg:"management_pprof"`
+	Readiness        bool `flag:"management-readiness" cfg:"management_readiness"`
+	DynamicUpstreams bool `flag:"management-dynamic-upstreams" cfg:"management_dynamic_upstreams"`
+	Upstreams        bool `flag:"management-upstreams" cfg:"management_upstreams"`
+	Maintenance      bool `flag:"management-maintenance" cfg:"management_maintenance"`
+	Cache            bool `flag:"management-cache" cfg:"management_cache"`
+	Sessions         bool `flag:"management-sessions" cfg:"management_sessions"`
+
+	BearerToken string   `flag:"management-bearer-token" cfg:"management_bearer_token"`
+	BasicAuth   bool     `flag:"management-basic-auth" cfg:"management_basic_auth"`
+	AllowedIPs  []string `flag:"management-allowed-ip" cfg:"management_allowed_ips"`
+}
+
+func managementFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("management", pflag.ExitOnError)
+
+	flagSet.Bool("management-metrics", true, "serve /metrics on the management server")
+	flagSet.Bool("management-pprof", false, "serve the Go profiler on /debug/pprof/ of the management server; never enable it on a server reachable by untrusted clients")
+	flagSet.Bool("management-readiness", true, "serve the readiness endpoint /ready on the management server")
+	flagSet.Bool("management-dynamic-upstreams", true, "serve the dynamic upstreams listing /dynamic-upstreams on the management server")
+	flagSet.Bool("management-upstreams", true, "serve the upstream health listing /upstreams on the management server")
+	flagSet.Bool("management-maintenance", false, "serve the maintenance endpoint /maintenance on the management server, reporting and toggling the maintenance mode")
+	flagSet.Bool("management-cache", false, "serve the cache endpoint /cache on the management server, purging the response caches of the upstreams")
+	flagSet.Bool("management-sessions", false, "serve the sessions endpoint /sessions on the management server, listing and revoking the sessions of the session inventory")
+	flagSet.String("management-bearer-token", "", "require requests to the management server to present this bearer token")
+	flagSet.Bool("management-basic-auth", false, "require requests to the management server to authenticate with basic auth against the htpasswd-file")
+	flagSet.StringSlice("management-allowed-ip", []string{}, "list of IPs or CIDR ranges allowed to reach the management server (may be given multiple times)")
+
+	return flagSet
+}
+
+// managementDefaults creates a Management populating each field with its
+// default value
+func managementDefaults() Management {
+	return Management{
+		Metrics:          true,
+		Pprof:            false,
+		Readiness:        true,
+		DynamicUpstreams: true,
+		Upstreams:        true,
+		Maintenance:      false,
+		Cache:            false,
+		Sessions:         false,
+		BearerToken:      "",
+		BasicAuth:        false,
+		AllowedIPs:       nil,
+	}
+}
+
+// Auth returns the options protecting the management server, which are
+// checked in the same way as those of the metrics server
+func (m Management) Auth() MetricsAuth {
+	return MetricsAuth{
+		BearerToken: m.BearerToken,
+		BasicAuth:   m.BasicAuth,
+		AllowedIPs:  m.AllowedIPs,
+	}
+}
@@ -0,0 +1,32 @@
+package options
+
+import "github.com/spf13/pflag"
+
+// MetricsAuth contains configuration options for protecting the metrics
+// server.
+// When several methods are configured, scrapes must come from an allowed IP
+// and present either the bearer token or valid basic auth credentials.
+type MetricsAuth struct {
+	BearerToken string   `flag:"metrics-bearer-token" cfg:"metrics_bearer_token"`
+	BasicAuth   bool     `flag:"metrics-basic-auth" cfg:"metrics_basic_auth"`
+	AllowedIPs  []string `flag:"metrics-allowed-ip" cfg:"metrics_allowed_ips"`
+}
+
+func metricsAuthFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("metrics", pflag.ExitOnError)
+
+	flagSet.String("metrics-bearer-token", "", "require scrapes of the metrics server to present this bearer token")
+	flagSet.Bool("metrics-basic-auth", false, "require scrapes of the metrics server to authenticate with basic auth against the htpasswd-file")
+	flagSet.StringSlice("metrics-allowed-ip", []string{}, "list of IPs or CIDR ranges allowed to scrape the metrics server (may be given multiple times)")
+
+	return flagSet
+}
+
+// metricsAuthDefaults creates a MetricsAuth populating each field with its default value
+func metricsAuthDefaults() MetricsAuth {
+	return MetricsAuth{
+		BearerToken: "",
+		BasicAuth:   false,
+		AllowedIPs:  nil,
+	}
+}
@@ -0,0 +1,33 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// DefaultProbeCredentialHeader is the default header probes present their
+// token in.
+const DefaultProbeCredentialHeader = "X-Probe-Token"
+
+// Probe contains configuration options for the static credentials that allow
+// monitoring probes to reach a limited set of upstream paths without a
+// session
+type Probe struct {
+	Credentials []string `flag:"probe-credential" cfg:"probe_credentials"`
+	Header      string   `flag:"probe-credential-header" cfg:"probe_credential_header"`
+}
+
+func probeFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("probe", pflag.ExitOnError)
+
+	flagSet.StringSlice("probe-credential", []string{}, "named static credentials allowing requests presenting the token in the probe credential header to the path prefixes and methods without a session (may be given multiple times). Format: name:token-file=path&path=prefix[,prefix...][&method=method[,method...]][&user=user]")
+	flagSet.String("probe-credential-header", DefaultProbeCredentialHeader, "the header probes present their token in")
+
+	return flagSet
+}
+
+// probeDefaults creates a Probe populating each field with its default value
+func probeDefaults() Probe {
+	return Probe{
+		Header: DefaultProbeCredentialHeader,
+	}
+}
@@ -0,0 +1,64 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The providers that can be the fallback of the primary provider
+const (
+	// FallbackProviderHtpasswd signs users in with the login form of the
+	// htpasswd file
+	FallbackProviderHtpasswd = "htpasswd"
+)
+
+// The modes the fallback provider is offered in
+const (
+	// FallbackModeAuto only offers the fallback provider while the primary
+	// provider is unavailable
+	FallbackModeAuto = "auto"
+	// FallbackModeOffer always offers the fallback provider on the sign in
+	// page, next to the primary provider
+	FallbackModeOffer = "offer"
+)
+
+const (
+	// DefaultFallbackHealthCheckInterval is the default interval between the
+	// health checks of the primary provider
+	DefaultFallbackHealthCheckInterval = 15 * time.Second
+
+	// DefaultFallbackUnhealthyAfter is the default period the health checks
+	// of the primary provider must fail for before it is unavailable
+	DefaultFallbackUnhealthyAfter = time.Minute
+)
+
+// ProviderFallback contains configuration options for the provider users can
+// sign in with when the primary provider is unavailable
+type ProviderFallback struct {
+	Provider            string        `flag:"fallback-provider" cfg:"fallback_provider"`
+	Mode                string        `flag:"fallback-provider-mode" cfg:"fallback_provider_mode"`
+	HealthCheckInterval time.Duration `flag:"fallback-provider-health-check-interval" cfg:"fallback_provider_health_check_interval"`
+	UnhealthyAfter      time.Duration `flag:"fallback-provider-unhealthy-after" cfg:"fallback_provider_unhealthy_after"`
+}
+
+func providerFallbackFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("providerfallback", pflag.ExitOnError)
+
+	flagSet.String("fallback-provider", "", "the provider users can sign in with when the primary provider is unavailable: htpasswd")
+	flagSet.String("fallback-provider-mode", FallbackModeAuto, "when the fallback provider is offered: auto, only while the primary provider is unavailable, or offer, always")
+	flagSet.Duration("fallback-provider-health-check-interval", DefaultFallbackHealthCheckInterval, "the interval between the health checks of the discovery and token endpoints of the primary provider")
+	flagSet.Duration("fallback-provider-unhealthy-after", DefaultFallbackUnhealthyAfter, "how long the health checks of the primary provider must fail for before it is unavailable")
+
+	return flagSet
+}
+
+// providerFallbackDefaults creates a ProviderFallback populating each field
+// with its default value
+func providerFallbackDefaults() ProviderFallback {
+	return ProviderFallback{
+		Mode:                FallbackModeAuto,
+		HealthCheckInterval: DefaultFallbackHealthCheckInterval,
+		UnhealthyAfter:      DefaultFallbackUnhealthyAfter,
+	}
+}
@@ -1,11 +1,25 @@
 package options
 
+import "time"
+
 const (
 	// OIDCEmailClaim is the generic email claim used by the OIDC provider.
 	OIDCEmailClaim = "email"
 
 	// OIDCGroupsClaim is the generic groups claim used by the OIDC provider.
 	OIDCGroupsClaim = "groups"
+
+	// OIDCEmailVerifiedClaim is the generic email verified claim used by the
+	// OIDC provider.
+	OIDCEmailVerifiedClaim = "email_verified"
+
+	// DefaultGoogleGroupCacheTTL is the default value for the Google provider
+	// GroupCacheTTL.
+	DefaultGoogleGroupCacheTTL = 5 * time.Minute
+
+	// DefaultGoogleGroupCheckConcurrency is the default value for the Google
+	// provider GroupCheckConcurrency.
+	DefaultGoogleGroupCheckConcurrency = 5
 )
 
 // OIDCAudienceClaims is the generic audience claim list used by the OIDC provider.
@@ -32,8 +46,12 @@ type Provider struct {
 	AzureConfig AzureOptions `json:"azureConfig,omitempty"`
 	// ADFSConfig holds all configurations for ADFS provider.
 	ADFSConfig ADFSOptions `json:"ADFSConfig,omitempty"`
+	// AppleConfig holds all configurations for Apple provider.
+	AppleConfig AppleOptions `json:"appleConfig,omitempty"`
 	// BitbucketConfig holds all configurations for Bitbucket provider.
 	BitbucketConfig BitbucketOptions `json:"bitbucketConfig,omitempty"`
+	// CognitoConfig holds all configurations for Cognito provider.
+	CognitoConfig CognitoOptions `json:"cognitoConfig,omitempty"`
 	// GitHubConfig holds all configurations for GitHubC provider.
 	GitHubConfig GitHubOptions `json:"githubConfig,omitempty"`
 	// GitLabConfig holds all configurations for GitLab provider.
@@ -60,6 +78,31 @@ type Provider struct {
 	// If not specified, the default Go trust sources are used instead
 	CAFiles []string `json:"caFiles,omitempty"`
 
+	// CookieSuffix is appended to the cookie name for the session and CSRF
+	// cookies of this provider, so that proxies sharing a cookie domain don't
+	// overwrite each other's sessions.
+	CookieSuffix string `json:"cookieSuffix,omitempty"`
+	// ProxyPrefix overrides the URL root path of the OAuth2 Proxy endpoints
+	// (eg /oauth2) for this provider.
+	ProxyPrefix string `json:"proxyPrefix,omitempty"`
+
+	// Hosts are the request hosts this provider signs users in for, when
+	// several providers are configured.
+	// A host may start with a wildcard label, eg: `*.tenant.example.com`.
+	Hosts []string `json:"hosts,omitempty"`
+	// PathPrefixes are the request paths this provider signs users in for,
+	// when several providers are configured, eg: `/partners/`.
+	PathPrefixes []string `json:"pathPrefixes,omitempty"`
+	// DisableCookieSelection stops the session cookie of this provider from
+	// selecting it for the requests outside of its Hosts and PathPrefixes,
+	// when several providers are configured.
+	DisableCookieSelection bool `json:"disableCookieSelection,omitempty"`
+	// CookieExpire overrides the expiry of the sessions of this provider.
+	CookieExpire *Duration `json:"cookieExpire,omitempty"`
+	// CookieRefresh overrides the period after which the sessions of this
+	// provider are refreshed.
+	CookieRefresh *Duration `json:"cookieRefresh,omitempty"`
+
 	// LoginURL is the authentication endpoint
 	LoginURL string `json:"loginURL,omitempty"`
 	// LoginURLParameters defines the parameters that can be passed from the start URL to the IdP login URL
@@ -72,30 +115,75 @@ type Provider struct {
 	ProtectedResource string `json:"resource,omitempty"`
 	// ValidateURL is the access token validation endpoint
 	ValidateURL string `json:"validateURL,omitempty"`
+	// RevocationURL is the RFC 7009 token revocation endpoint, tokens are
+	// revoked there when users sign out, or their session is cleared because
+	// they are no longer authorized.
+	// Defaults to the revocation_endpoint of OIDC discovery.
+	RevocationURL string `json:"revocationURL,omitempty"`
+	// RevokeAccessToken revokes the access token along with the refresh token
+	RevokeAccessToken bool `json:"revokeAccessToken,omitempty"`
+	// DeviceAuthorizationURL is the RFC 8628 device authorization endpoint,
+	// which the device authorization endpoints of OAuth2 Proxy start device
+	// authorizations at.
+	// Defaults to the device_authorization_endpoint of OIDC discovery.
+	DeviceAuthorizationURL string `json:"deviceAuthorizationURL,omitempty"`
 	// Scope is the OAuth scope specification
 	Scope string `json:"scope,omitempty"`
 	// AllowedGroups is a list of restrict logins to members of this group
 	AllowedGroups []string `json:"allowedGroups,omitempty"`
+	// DeniedGroups is a list of groups whose members may not login, even if
+	// they are members of an allowed group
+	DeniedGroups []string `json:"deniedGroups,omitempty"`
+	// GroupsNormalization configures how the groups returned by the provider
+	// are normalized before they are stored in the session
+	GroupsNormalization GroupsNormalization `json:"groupsNormalization,omitempty"`
 	// The code challenge method
 	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
 }
 
+// GroupsNormalization configures how the groups of the user returned by the
+// provider are normalized before they are stored in the session.
+// The allowed and denied groups are compared to, and the groups headers
+// contain, the normalized groups.
+type GroupsNormalization struct {
+	// Transform is a regular expression whose first capture group replaces
+	// the names of the groups it matches, eg `^CN=([^,]+),` to keep the
+	// common name of LDAP DNs.
+	// Groups it doesn't match are kept unchanged.
+	Transform string `json:"transform,omitempty"`
+	// Filter only keeps the groups whose transformed names start with one of
+	// the prefixes, or match one of the regular expressions given with a
+	// leading `~`.
+	// All groups are kept when it is empty.
+	Filter []string `json:"filter,omitempty"`
+	// MaxGroups is the maximum number of groups stored in the session, the
+	// groups beyond it are dropped with a warning.
+	// There is no limit when it is 0.
+	MaxGroups int `json:"maxGroups,omitempty"`
+}
+
 // ProviderType is used to enumerate the different provider type options
-// Valid options are: adfs, azure, bitbucket, digitalocean facebook, github,
-// gitlab, google, keycloak, keycloak-oidc, linkedin, login.gov, nextcloud
-// and oidc.
+// Valid options are: adfs, apple, azure, bitbucket, cognito, digitalocean
+// facebook, github, gitlab, google, keycloak, keycloak-oidc, linkedin,
+// login.gov, nextcloud, oidc and okta.
 type ProviderType string
 
 const (
 	// ADFSProvider is the provider type for ADFS
 	ADFSProvider ProviderType = "adfs"
 
+	// AppleProvider is the provider type for Sign in with Apple
+	AppleProvider ProviderType = "apple"
+
 	// AzureProvider is the provider type for Azure
 	AzureProvider ProviderType = "azure"
 
 	// BitbucketProvider is the provider type for Bitbucket
 	BitbucketProvider ProviderType = "bitbucket"
 
+	// CognitoProvider is the provider type for AWS Cognito
+	CognitoProvider ProviderType = "cognito"
+
 	// DigitalOceanProvider is the provider type for DigitalOcean
 	DigitalOceanProvider ProviderType = "digitalocean"
 
@@ -128,6 +216,24 @@ const (
 
 	// OIDCProvider is the provider type for OIDC
 	OIDCProvider ProviderType = "oidc"
+
+	// OktaProvider is the provider type for Okta
+	OktaProvider ProviderType = "okta"
+)
+
+// EmailVerificationMode determines how the email verified claim of an
+// id_token is checked.
+type EmailVerificationMode string
+
+const (
+	// EmailVerificationIfPresent treats an email as verified when the id_token
+	// doesn't have the email verified claim.
+	// Only emails with the claim explicitly set to false are denied.
+	EmailVerificationIfPresent EmailVerificationMode = "ifPresent"
+
+	// EmailVerificationRequired denies emails unless the id_token has the email
+	// verified claim set to true.
+	EmailVerificationRequired EmailVerificationMode = "required"
 )
 
 type KeycloakOptions struct {
@@ -150,6 +256,16 @@ type ADFSOptions struct {
 	SkipScope bool `json:"skipScope,omitempty"`
 }
 
+type AppleOptions struct {
+	// TeamID is the ID of the Apple Developer team that owns the Services ID
+	TeamID string `json:"teamID,omitempty"`
+	// KeyID is the ID of the Sign in with Apple private key
+	KeyID string `json:"keyID,omitempty"`
+	// PrivateKeyFile is the path to the .p8 private key file used to sign the
+	// client secret JWTs
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+}
+
 type BitbucketOptions struct {
 	// Team sets restrict logins to members of this team
 	Team string `json:"team,omitempty"`
@@ -157,6 +273,14 @@ type BitbucketOptions struct {
 	Repository string `json:"repository,omitempty"`
 }
 
+type CognitoOptions struct {
+	// LogoutURI is where Cognito redirects users after signing them out of
+	// the hosted UI. It must be one of the sign out URLs of the app client.
+	// When not set, the sign out redirect is used if it is an absolute URL,
+	// otherwise signing out only clears the OAuth2 Proxy session.
+	LogoutURI string `json:"logoutURI,omitempty"`
+}
+
 type GitHubOptions struct {
 	// Org sets restrict logins to members of this organisation
 	Org string `json:"org,omitempty"`
@@ -184,8 +308,25 @@ type GoogleOptions struct {
 	Groups []string `json:"group,omitempty"`
 	// AdminEmail is the google admin to impersonate for api calls
 	AdminEmail string `json:"adminEmail,omitempty"`
-	// ServiceAccountJSON is the path to the service account json credentials
+	// ServiceAccountJSON is the path to the service account json credentials.
+	// When not set, Application Default Credentials are used instead, with the
+	// AdminEmail impersonated through the IAM Credentials API.
 	ServiceAccountJSON string `json:"serviceAccountJson,omitempty"`
+	// GroupCacheTTL is how long a user's group memberships are cached in
+	// the session before they are checked against the Google API again,
+	// independently of how often the session is refreshed.
+	// Set to 0 to disable caching.
+	GroupCacheTTL Duration `json:"groupCacheTTL,omitempty"`
+	// TransitiveMembership checks group memberships with the Cloud Identity
+	// API, so that the members of nested groups are members of the groups
+	// they are nested in. The AdminEmail must be allowed the
+	// `cloud-identity.groups.readonly` scope by domain-wide delegation.
+	// Defaults to false, memberships are checked with the Admin SDK.
+	TransitiveMembership bool `json:"transitiveMembership,omitempty"`
+	// GroupCheckConcurrency is the number of groups checked in parallel for
+	// each user.
+	// Defaults to 5.
+	GroupCheckConcurrency int `json:"groupCheckConcurrency,omitempty"`
 }
 
 type OIDCOptions struct {
@@ -195,6 +336,17 @@ type OIDCOptions struct {
 	// InsecureAllowUnverifiedEmail prevents failures if an email address in an id_token is not verified
 	// default set to 'false'
 	InsecureAllowUnverifiedEmail bool `json:"insecureAllowUnverifiedEmail,omitempty"`
+	// EmailVerifiedClaim indicates which claim contains whether the user email is verified
+	// default set to 'email_verified'
+	EmailVerifiedClaim string `json:"emailVerifiedClaim,omitempty"`
+	// EmailVerification determines whether the EmailVerifiedClaim must be present
+	// in the id_token.
+	// With `ifPresent`, a missing claim is treated as verified and only a claim
+	// explicitly set to false is denied.
+	// With `required`, the claim must be present and set to true.
+	// The email is only verified when the EmailClaim is 'email'.
+	// default set to 'ifPresent'
+	EmailVerification EmailVerificationMode `json:"emailVerification,omitempty"`
 	// InsecureSkipIssuerVerification skips verification of ID token issuers. When false, ID Token Issuers must match the OIDC discovery URL
 	// default set to 'false'
 	InsecureSkipIssuerVerification bool `json:"insecureSkipIssuerVerification,omitempty"`
@@ -212,6 +364,9 @@ type OIDCOptions struct {
 	JwksURL string `json:"jwksURL,omitempty"`
 	// EmailClaim indicates which claim contains the user email,
 	// default set to 'email'
+	// The EmailClaim, GroupsClaim and UserIDClaim may be paths to nested claims,
+	// with keys separated by dots and `[N]` or `[*]` to select an entry or every
+	// entry of an array, eg: `resource.roles[*].name`.
 	EmailClaim string `json:"emailClaim,omitempty"`
 	// GroupsClaim indicates which claim contains the user groups
 	// default set to 'groups'
@@ -225,6 +380,18 @@ type OIDCOptions struct {
 	// ExtraAudiences is a list of additional audiences that are allowed
 	// to pass verification in addition to the client id.
 	ExtraAudiences []string `json:"extraAudiences,omitempty"`
+	// RPInitiatedLogout signs users out of the provider when they sign out,
+	// by redirecting them to its end session endpoint (OIDC RP-Initiated
+	// Logout) with their ID token as a hint.
+	// default set to 'false'
+	RPInitiatedLogout bool `json:"rpInitiatedLogout,omitempty"`
+	// EndSessionURL is the OIDC RP-Initiated Logout end session endpoint.
+	// Defaults to the end_session_endpoint of OIDC discovery.
+	EndSessionURL string `json:"endSessionURL,omitempty"`
+	// PostLogoutRedirectURL is where the provider returns users to after
+	// ending their session, it must be registered with the provider.
+	// Defaults to the sign out redirect, when it is an absolute URL.
+	PostLogoutRedirectURL string `json:"postLogoutRedirectURL,omitempty"`
 }
 
 type LoginGovOptions struct {
@@ -243,12 +410,18 @@ func providerDefaults() Providers {
 			AzureConfig: AzureOptions{
 				Tenant: "common",
 			},
+			GoogleConfig: GoogleOptions{
+				GroupCacheTTL:         Duration(DefaultGoogleGroupCacheTTL),
+				GroupCheckConcurrency: DefaultGoogleGroupCheckConcurrency,
+			},
 			OIDCConfig: OIDCOptions{
 				InsecureAllowUnverifiedEmail: false,
 				InsecureSkipNonce:            true,
 				SkipDiscovery:                false,
 				UserIDClaim:                  OIDCEmailClaim, // Deprecated: Use OIDCEmailClaim
 				EmailClaim:                   OIDCEmailClaim,
+				EmailVerifiedClaim:           OIDCEmailVerifiedClaim,
+				EmailVerification:            EmailVerificationIfPresent,
 				GroupsClaim:                  OIDCGroupsClaim,
 				AudienceClaims:               OIDCAudienceClaims,
 				ExtraAudiences:               []string{},
@@ -0,0 +1,66 @@
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultRedirectMaxLength is the default maximum length of the redirect
+	// followed once a user has authenticated.
+	DefaultRedirectMaxLength = 4096
+
+	// RedirectMaxLengthTruncate truncates redirects exceeding the maximum length
+	// to their origin and path.
+	RedirectMaxLengthTruncate = "truncate"
+
+	// RedirectMaxLengthDeny fails the login with an error page when the
+	// redirect exceeds the maximum length.
+	RedirectMaxLengthDeny = "deny"
+
+	// DefaultAppStateMaxSize is the default maximum size of the app state
+	// carried through the login flow.
+	DefaultAppStateMaxSize = 256
+
+	// MaxAppStateMaxSize bounds the app state size, as it is stored in the
+	// CSRF cookie.
+	MaxAppStateMaxSize = 1024
+)
+
+// Redirect contains configuration options for the redirect followed once a
+// user has authenticated
+type Redirect struct {
+	MaxLength       int    `flag:"redirect-max-length" cfg:"redirect_max_length"`
+	MaxLengthAction string `flag:"redirect-max-length-action" cfg:"redirect_max_length_action"`
+
+	AllowLoopback bool   `flag:"redirect-allow-loopback" cfg:"redirect_allow_loopback"`
+	LoopbackPorts string `flag:"redirect-loopback-ports" cfg:"redirect_loopback_ports"`
+
+	AppStateParameter         string `flag:"app-state-parameter" cfg:"app_state_parameter"`
+	AppStateRedirectParameter string `flag:"app-state-redirect-parameter" cfg:"app_state_redirect_parameter"`
+	AppStateMaxSize           int    `flag:"app-state-max-size" cfg:"app_state_max_size"`
+}
+
+func redirectFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("redirect", pflag.ExitOnError)
+
+	flagSet.Int("redirect-max-length", DefaultRedirectMaxLength, "maximum length of the redirect followed after authentication (eg the rd parameter); 0 for no limit")
+	flagSet.String("redirect-max-length-action", RedirectMaxLengthTruncate, "what to do with redirects longer than the maximum length: truncate them to their origin and path, or deny the login (one of: truncate, deny)")
+	flagSet.Bool("redirect-allow-loopback", false, "allow redirects over http or https to the loopback addresses 127.0.0.1, [::1] and localhost, for native apps completing their login on a local port (RFC 8252)")
+	flagSet.String("redirect-loopback-ports", "", "the port or range of ports (eg. 49152-65535) loopback redirects may use with redirect-allow-loopback (defaults to any port)")
+	flagSet.String("app-state-parameter", "", "the /oauth2/start parameter holding an opaque app state that is added to the redirect once the user has authenticated (eg. app_state); disabled when empty")
+	flagSet.String("app-state-redirect-parameter", "", "the query parameter of the redirect the app state is returned in (defaults to the app-state-parameter)")
+	flagSet.Int("app-state-max-size", DefaultAppStateMaxSize, fmt.Sprintf("maximum size of the app state in bytes (at most %d)", MaxAppStateMaxSize))
+
+	return flagSet
+}
+
+// redirectDefaults creates a Redirect populating each field with its default value
+func redirectDefaults() Redirect {
+	return Redirect{
+		MaxLength:       DefaultRedirectMaxLength,
+		MaxLengthAction: RedirectMaxLengthTruncate,
+		AppStateMaxSize: DefaultAppStateMaxSize,
+	}
+}
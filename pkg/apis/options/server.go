@@ -15,6 +15,13 @@ type Server struct {
 	TLS *TLS
 }
 
+// Enabled checks whether the server has an HTTP or HTTPS address, they are
+// disabled when empty or "-"
+func (s Server) Enabled() bool {
+	return (s.BindAddress != "" && s.BindAddress != "-") ||
+		(s.SecureBindAddress != "" && s.SecureBindAddress != "-")
+}
+
 // TLS contains the information for loading a TLS certificate and key
 // as well as an optional minimal TLS version that is acceptable.
 type TLS struct {
@@ -37,4 +44,41 @@ type TLS struct {
 	// If not specified, the default Go safe cipher list is used.
 	// List of valid cipher suites can be found in the [crypto/tls documentation](https://pkg.go.dev/crypto/tls#pkg-constants).
 	CipherSuites []string
+
+	// ClientCA is the PEM encoded CA certificate bundle that client
+	// certificates are verified against.
+	// When set, clients may present a certificate, which upstreams can be sent
+	// with their PassTLSHeaders. Connections without a certificate are still
+	// accepted.
+	// Typically this will come from a file.
+	ClientCA *SecretSource
+
+	// SNICertificates are further certificates and keys, each presented to
+	// clients requesting one of its hostnames through SNI.
+	// The Cert and Key are presented to clients requesting any other hostname,
+	// or not using SNI.
+	SNICertificates []SNICertificate
+
+	// ReloadInterval is the interval at which the certificates and keys are
+	// loaded again, so that they can be rotated without a restart.
+	// They are also loaded again when the process receives a SIGHUP.
+	// Disabled when 0.
+	ReloadInterval Duration
+}
+
+// SNICertificate is a TLS certificate and key presented to clients requesting
+// one of its hostnames.
+type SNICertificate struct {
+	// Hostnames are the server names the certificate is presented for.
+	// A hostname starting with "*." matches any single label in its place,
+	// exact hostnames take precedence over these wildcards.
+	Hostnames []string
+
+	// Key is the TLS key data to use.
+	// Typically this will come from a file.
+	Key *SecretSource
+
+	// Cert is the TLS certificate data to use.
+	// Typically this will come from a file.
+	Cert *SecretSource
 }
@@ -0,0 +1,29 @@
+package options
+
+import "github.com/spf13/pflag"
+
+// SessionDebug contains configuration options for the debug response headers
+// describing how the session of each request was handled, so that support
+// can see whether a session was refreshed without access to the logs
+type SessionDebug struct {
+	HeaderRoutes []string `flag:"session-debug-header-route" cfg:"session_debug_header_routes"`
+	OptInHeader  string   `flag:"session-debug-header-opt-in" cfg:"session_debug_header_opt_in"`
+}
+
+func sessionDebugFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("sessiondebug", pflag.ExitOnError)
+
+	flagSet.StringSlice("session-debug-header-route", []string{}, "add the X-Auth-Session-Age, X-Auth-Token-Expires-In and X-Auth-Refreshed debug headers to the proxied and auth endpoint responses of requests whose path matches (may be given multiple times). Format: path_regex")
+	flagSet.String("session-debug-header-opt-in", "", "only add the session debug headers to the responses of requests carrying this request header, on every route unless --session-debug-header-route is set")
+
+	return flagSet
+}
+
+// sessionDebugDefaults creates a SessionDebug populating each field with its
+// default value
+func sessionDebugDefaults() SessionDebug {
+	return SessionDebug{
+		HeaderRoutes: nil,
+		OptInHeader:  "",
+	}
+}
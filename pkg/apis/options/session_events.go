@@ -0,0 +1,79 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The session events that can be delivered to the session events webhook
+const (
+	SessionEventLogin               = "login"
+	SessionEventLogout              = "logout"
+	SessionEventRefreshFailure      = "refresh_failure"
+	SessionEventAuthorizationDenied = "authorization_denied"
+	SessionEventFallbackLogin       = "fallback_login"
+	SessionEventEvicted             = "session_evicted"
+	SessionEventMaintenance         = "maintenance"
+)
+
+// The policies for events sent while the session events queue is full
+const (
+	// SessionEventsDropNewest drops the events sent while the queue is full
+	SessionEventsDropNewest = "drop-newest"
+	// SessionEventsDropOldest drops the oldest queued event to queue the event
+	// sent while the queue is full
+	SessionEventsDropOldest = "drop-oldest"
+)
+
+const (
+	// DefaultSessionEventsQueueSize is the default number of events queued
+	// for delivery to the session events webhook
+	DefaultSessionEventsQueueSize = 1000
+
+	// DefaultSessionEventsMaxRetries is the default number of times the
+	// delivery of an event is retried
+	DefaultSessionEventsMaxRetries = 3
+
+	// DefaultSessionEventsTimeout is the default timeout of each delivery of
+	// an event
+	DefaultSessionEventsTimeout = 5 * time.Second
+)
+
+// SessionEvents contains configuration options for delivering login, logout,
+// refresh failure, authorization denial and eviction events to a webhook
+type SessionEvents struct {
+	WebhookURL      string        `flag:"session-events-webhook-url" cfg:"session_events_webhook_url"`
+	SigningKeyFiles []string      `flag:"session-events-signing-key-file" cfg:"session_events_signing_key_files"`
+	Types           []string      `flag:"session-event" cfg:"session_events"`
+	QueueSize       int           `flag:"session-events-queue-size" cfg:"session_events_queue_size"`
+	DropPolicy      string        `flag:"session-events-drop-policy" cfg:"session_events_drop_policy"`
+	MaxRetries      int           `flag:"session-events-max-retries" cfg:"session_events_max_retries"`
+	Timeout         time.Duration `flag:"session-events-timeout" cfg:"session_events_timeout"`
+}
+
+func sessionEventsFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("session-events", pflag.ExitOnError)
+
+	flagSet.String("session-events-webhook-url", "", "the HTTPS endpoint session events are delivered to as JSON; enables session events")
+	flagSet.StringSlice("session-events-signing-key-file", []string{}, "path to a file containing a secret key (at least 32 bytes) session events are signed with; give a second key while rotating keys (may be given up to twice)")
+	flagSet.StringSlice("session-event", []string{}, "the session events delivered to the webhook: login, logout, refresh_failure, authorization_denied, fallback_login, session_evicted or maintenance (may be given multiple times). Defaults to all events")
+	flagSet.Int("session-events-queue-size", DefaultSessionEventsQueueSize, "the number of session events queued for delivery")
+	flagSet.String("session-events-drop-policy", SessionEventsDropNewest, "the events dropped while the queue is full: drop-newest or drop-oldest")
+	flagSet.Int("session-events-max-retries", DefaultSessionEventsMaxRetries, "the number of times the delivery of a session event is retried, with exponential backoff")
+	flagSet.Duration("session-events-timeout", DefaultSessionEventsTimeout, "the timeout of each delivery of a session event")
+
+	return flagSet
+}
+
+// sessionEventsDefaults creates a SessionEvents populating each field with
+// its default value
+func sessionEventsDefaults() SessionEvents {
+	return SessionEvents{
+		WebhookURL: "",
+		QueueSize:  DefaultSessionEventsQueueSize,
+		DropPolicy: SessionEventsDropNewest,
+		MaxRetries: DefaultSessionEventsMaxRetries,
+		Timeout:    DefaultSessionEventsTimeout,
+	}
+}
@@ -0,0 +1,28 @@
+package options
+
+import "github.com/spf13/pflag"
+
+// SessionExpiry contains configuration options for warning users that their
+// session is about to lapse, and renewing it without interrupting them
+type SessionExpiry struct {
+	Header      bool `flag:"session-expiry-header" cfg:"session_expiry_header"`
+	SilentRenew bool `flag:"session-expiry-silent-renew" cfg:"session_expiry_silent_renew"`
+}
+
+func sessionExpiryFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("sessionexpiry", pflag.ExitOnError)
+
+	flagSet.Bool("session-expiry-header", false, "add the seconds until the session lapses in the X-Auth-Expires-In header of proxied text/html responses")
+	flagSet.Bool("session-expiry-silent-renew", false, "pass prompt=none from /oauth2/start to the provider to renew sessions without interaction, returning to the application when the provider requires a login")
+
+	return flagSet
+}
+
+// sessionExpiryDefaults creates a SessionExpiry populating each field with
+// its default value
+func sessionExpiryDefaults() SessionExpiry {
+	return SessionExpiry{
+		Header:      false,
+		SilentRenew: false,
+	}
+}
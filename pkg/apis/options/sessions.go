@@ -1,10 +1,24 @@
 package options
 
+import "time"
+
 // SessionOptions contains configuration options for the SessionStore providers.
 type SessionOptions struct {
-	Type   string             `flag:"session-store-type" cfg:"session_store_type"`
-	Cookie CookieStoreOptions `cfg:",squash"`
-	Redis  RedisStoreOptions  `cfg:",squash"`
+	Type               string             `flag:"session-store-type" cfg:"session_store_type"`
+	RefreshMinInterval time.Duration      `flag:"session-refresh-min-interval" cfg:"session_refresh_min_interval"`
+	StoreClaims        []string           `flag:"session-store-claims" cfg:"session_store_claims"`
+	ResetPage          bool               `flag:"session-reset-page" cfg:"session_reset_page"`
+	StoreUnavailable   string             `flag:"session-store-unavailable" cfg:"session_store_unavailable"`
+	BearerTokens       bool               `flag:"session-bearer-tokens" cfg:"session_bearer_tokens"`
+	MaxPerUser         int                `flag:"session-max-per-user" cfg:"session_max_per_user"`
+	MaxPerUserPolicy   string             `flag:"session-max-per-user-policy" cfg:"session_max_per_user_policy"`
+	BackchannelLogout  bool               `flag:"session-backchannel-logout" cfg:"session_backchannel_logout"`
+	Inventory          bool               `flag:"session-inventory" cfg:"session_inventory"`
+	Cookie             CookieStoreOptions `cfg:",squash"`
+	Redis              RedisStoreOptions  `cfg:",squash"`
+	Memory             MemoryStoreOptions `cfg:",squash"`
+	SQL                SQLStoreOptions    `cfg:",squash"`
+	KMS                KMSOptions         `cfg:",squash"`
 }
 
 // CookieSessionStoreType is used to indicate the CookieSessionStore should be
@@ -15,31 +29,125 @@ var CookieSessionStoreType = "cookie"
 // used for storing sessions.
 var RedisSessionStoreType = "redis"
 
+// MemorySessionStoreType is used to indicate the MemorySessionStore should be
+// used for storing sessions.
+var MemorySessionStoreType = "memory"
+
+// SQLSessionStoreType is used to indicate the SQLSessionStore should be
+// used for storing sessions.
+var SQLSessionStoreType = "sql"
+
+// SessionStoreFailClosed is used to indicate that requests whose session
+// can't be loaded because the session store is unavailable are treated as
+// unauthenticated.
+var SessionStoreFailClosed = "fail-closed"
+
+// SessionStoreFailOpenAnonymous is used to indicate that requests whose
+// session can't be loaded because the session store is unavailable are proxied
+// without the user's identity.
+var SessionStoreFailOpenAnonymous = "fail-open-anonymous"
+
+// SessionStoreFailOpenCached is used to indicate that requests whose session
+// can't be loaded because the session store is unavailable are proxied with
+// the session last loaded for their cookie, if it is cached in memory.
+var SessionStoreFailOpenCached = "fail-open-cached"
+
+// SessionMaxPerUserRejectNew is used to indicate that logins are refused once
+// the user has the maximum number of concurrent sessions.
+var SessionMaxPerUserRejectNew = "reject-new"
+
+// SessionMaxPerUserEvictOldest is used to indicate that the oldest sessions of
+// the user are removed to save the session of a new login past the maximum.
+var SessionMaxPerUserEvictOldest = "evict-oldest"
+
 // CookieStoreOptions contains configuration options for the CookieSessionStore.
 type CookieStoreOptions struct {
-	Minimal bool `flag:"session-cookie-minimal" cfg:"session_cookie_minimal"`
+	Minimal     bool `flag:"session-cookie-minimal" cfg:"session_cookie_minimal"`
+	RefreshLock bool `flag:"session-cookie-refresh-lock" cfg:"session_cookie_refresh_lock"`
 }
 
 // RedisStoreOptions contains configuration options for the RedisSessionStore.
 type RedisStoreOptions struct {
-	ConnectionURL          string   `flag:"redis-connection-url" cfg:"redis_connection_url"`
-	Password               string   `flag:"redis-password" cfg:"redis_password"`
-	UseSentinel            bool     `flag:"redis-use-sentinel" cfg:"redis_use_sentinel"`
-	SentinelPassword       string   `flag:"redis-sentinel-password" cfg:"redis_sentinel_password"`
-	SentinelMasterName     string   `flag:"redis-sentinel-master-name" cfg:"redis_sentinel_master_name"`
-	SentinelConnectionURLs []string `flag:"redis-sentinel-connection-urls" cfg:"redis_sentinel_connection_urls"`
-	UseCluster             bool     `flag:"redis-use-cluster" cfg:"redis_use_cluster"`
-	ClusterConnectionURLs  []string `flag:"redis-cluster-connection-urls" cfg:"redis_cluster_connection_urls"`
-	CAPath                 string   `flag:"redis-ca-path" cfg:"redis_ca_path"`
-	InsecureSkipTLSVerify  bool     `flag:"redis-insecure-skip-tls-verify" cfg:"redis_insecure_skip_tls_verify"`
-	IdleTimeout            int      `flag:"redis-connection-idle-timeout" cfg:"redis_connection_idle_timeout"`
+	ConnectionURL          string        `flag:"redis-connection-url" cfg:"redis_connection_url"`
+	Username               string        `flag:"redis-username" cfg:"redis_username"`
+	Password               string        `flag:"redis-password" cfg:"redis_password"`
+	UseSentinel            bool          `flag:"redis-use-sentinel" cfg:"redis_use_sentinel"`
+	SentinelUsername       string        `flag:"redis-sentinel-username" cfg:"redis_sentinel_username"`
+	SentinelPassword       string        `flag:"redis-sentinel-password" cfg:"redis_sentinel_password"`
+	SentinelMasterName     string        `flag:"redis-sentinel-master-name" cfg:"redis_sentinel_master_name"`
+	SentinelConnectionURLs []string      `flag:"redis-sentinel-connection-urls" cfg:"redis_sentinel_connection_urls"`
+	UseCluster             bool          `flag:"redis-use-cluster" cfg:"redis_use_cluster"`
+	ClusterConnectionURLs  []string      `flag:"redis-cluster-connection-urls" cfg:"redis_cluster_connection_urls"`
+	CAPath                 string        `flag:"redis-ca-path" cfg:"redis_ca_path"`
+	InsecureSkipTLSVerify  bool          `flag:"redis-insecure-skip-tls-verify" cfg:"redis_insecure_skip_tls_verify"`
+	IdleTimeout            int           `flag:"redis-connection-idle-timeout" cfg:"redis_connection_idle_timeout"`
+	CleanupInterval        time.Duration `flag:"redis-cleanup-interval" cfg:"redis_cleanup_interval"`
+	CleanupKeysPerSecond   int           `flag:"redis-cleanup-keys-per-second" cfg:"redis_cleanup_keys_per_second"`
+	DNSRefreshInterval     time.Duration `flag:"redis-dns-refresh-interval" cfg:"redis_dns_refresh_interval"`
+}
+
+// MemoryStoreOptions contains configuration options for the MemorySessionStore.
+type MemoryStoreOptions struct {
+	MaxEntries int `flag:"memory-store-max-entries" cfg:"memory_store_max_entries"`
 }
 
+// SQLStoreOptions contains configuration options for the SQLSessionStore.
+type SQLStoreOptions struct {
+	Driver          string        `flag:"sql-store-driver" cfg:"sql_store_driver"`
+	DSN             string        `flag:"sql-store-dsn" cfg:"sql_store_dsn"`
+	Table           string        `flag:"sql-store-table" cfg:"sql_store_table"`
+	MaxOpenConns    int           `flag:"sql-store-max-open-connections" cfg:"sql_store_max_open_connections"`
+	CleanupInterval time.Duration `flag:"sql-store-cleanup-interval" cfg:"sql_store_cleanup_interval"`
+}
+
+// PostgresSQLDriver is used to indicate that sessions are stored in a
+// PostgreSQL database.
+var PostgresSQLDriver = "postgres"
+
+// MySQLSQLDriver is used to indicate that sessions are stored in a MySQL or
+// MariaDB database.
+var MySQLSQLDriver = "mysql"
+
+// KMSOptions contains configuration options for the envelope encryption of
+// sessions in persistent session stores with a key management service.
+type KMSOptions struct {
+	Type string `flag:"session-kms-type" cfg:"session_kms_type"`
+	Key  string `flag:"session-kms-key" cfg:"session_kms_key"`
+}
+
+// LocalKMSType is used to indicate that session data keys should be wrapped
+// with a static key, eg. for testing.
+var LocalKMSType = "local"
+
+// GCPKMSType is used to indicate that session data keys should be wrapped
+// with a Google Cloud KMS key.
+var GCPKMSType = "gcp"
+
+// AWSKMSType is used to indicate that session data keys should be wrapped
+// with an AWS KMS key.
+var AWSKMSType = "aws"
+
 func sessionOptionsDefaults() SessionOptions {
 	return SessionOptions{
-		Type: CookieSessionStoreType,
+		Type:               CookieSessionStoreType,
+		RefreshMinInterval: time.Duration(30) * time.Second,
+		StoreUnavailable:   SessionStoreFailClosed,
+		MaxPerUserPolicy:   SessionMaxPerUserRejectNew,
 		Cookie: CookieStoreOptions{
-			Minimal: false,
+			Minimal:     false,
+			RefreshLock: false,
+		},
+		Redis: RedisStoreOptions{
+			CleanupKeysPerSecond: 1000,
+		},
+		Memory: MemoryStoreOptions{
+			MaxEntries: 10000,
+		},
+		SQL: SQLStoreOptions{
+			Driver:          PostgresSQLDriver,
+			Table:           "oauth2_proxy_sessions",
+			MaxOpenConns:    10,
+			CleanupInterval: time.Duration(5) * time.Minute,
 		},
 	}
 }
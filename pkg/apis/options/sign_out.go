@@ -0,0 +1,29 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// SignOut contains configuration options for the /oauth2/sign_out endpoint
+type SignOut struct {
+	RedirectURL string `flag:"sign-out-redirect-url" cfg:"sign_out_redirect_url"`
+	AllowGet    bool   `flag:"sign-out-allow-get" cfg:"sign_out_allow_get"`
+}
+
+func signOutFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("sign-out", pflag.ExitOnError)
+
+	flagSet.String("sign-out-redirect-url", "", "the URL users are redirected to once signed out when the sign out request has no redirect; must be allowed by the redirect allowlist (defaults to the root of the application)")
+	flagSet.Bool("sign-out-allow-get", false, "sign users out on GET requests to the sign out endpoint, and on POST requests without a CSRF token, rather than rendering a confirmation page that signs out with a POST request")
+
+	return flagSet
+}
+
+// signOutDefaults creates a SignOut populating each field with its default
+// value
+func signOutDefaults() SignOut {
+	return SignOut{
+		RedirectURL: "",
+		AllowGet:    false,
+	}
+}
@@ -0,0 +1,35 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// DefaultSignedURLMaxLifetime is the default maximum lifetime of a signed URL.
+const DefaultSignedURLMaxLifetime = time.Hour
+
+// SignedURL contains configuration options for the signed URLs that grant
+// access to a single upstream path without a session
+type SignedURL struct {
+	KeyFile     string        `flag:"signed-url-key-file" cfg:"signed_url_key_file"`
+	MaxLifetime time.Duration `flag:"signed-url-max-lifetime" cfg:"signed_url_max_lifetime"`
+}
+
+func signedURLFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("signed-url", pflag.ExitOnError)
+
+	flagSet.String("signed-url-key-file", "", "path to a file containing the secret key (at least 32 bytes) signed URLs are signed with; enables signed URLs. Replacing the key revokes all signed URLs")
+	flagSet.Duration("signed-url-max-lifetime", DefaultSignedURLMaxLifetime, "the maximum lifetime of a signed URL")
+
+	return flagSet
+}
+
+// signedURLDefaults creates a SignedURL populating each field with its
+// default value
+func signedURLDefaults() SignedURL {
+	return SignedURL{
+		KeyFile:     "",
+		MaxLifetime: DefaultSignedURLMaxLifetime,
+	}
+}
@@ -0,0 +1,27 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// StrictSecurity contains configuration options for the strict security
+// mode, in which insecure option combinations are refused at startup
+type StrictSecurity struct {
+	Enabled bool     `flag:"strict-security" cfg:"strict_security"`
+	Exempt  []string `flag:"strict-security-exempt" cfg:"strict_security_exempt"`
+}
+
+func strictSecurityFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("strictsecurity", pflag.ExitOnError)
+
+	flagSet.Bool("strict-security", false, "refuse to start with insecure option combinations, such as insecure cookies or TLS verification skipped, instead of allowing them")
+	flagSet.StringSlice("strict-security-exempt", []string{}, "the name of a strict security check that isn't enforced (may be given multiple times)")
+
+	return flagSet
+}
+
+// strictSecurityDefaults creates a StrictSecurity populating each field with
+// its default value
+func strictSecurityDefaults() StrictSecurity {
+	return StrictSecurity{}
+}
@@ -0,0 +1,48 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+)
+
+const (
+	// DefaultTracingServiceName is the default service name of the traces
+	// exported by the proxy
+	DefaultTracingServiceName = "oauth2-proxy"
+
+	// DefaultTracingSampleRatio is the default ratio of the traces started by
+	// the proxy that are sampled
+	DefaultTracingSampleRatio = 1.0
+)
+
+// Tracing contains configuration options for exporting OpenTelemetry traces
+// of the requests through the proxy to an OTLP collector.
+// The trace context of requests is propagated to the upstreams with the W3C
+// traceparent header, whether or not the traces are exported.
+type Tracing struct {
+	OTLPEndpoint string   `flag:"tracing-otlp-endpoint" cfg:"tracing_otlp_endpoint"`
+	OTLPHeaders  []string `flag:"tracing-otlp-header" cfg:"tracing_otlp_headers"`
+	ServiceName  string   `flag:"tracing-service-name" cfg:"tracing_service_name"`
+	SampleRatio  float64  `flag:"tracing-sample-ratio" cfg:"tracing_sample_ratio"`
+}
+
+func tracingFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("tracing", pflag.ExitOnError)
+
+	flagSet.String("tracing-otlp-endpoint", "", "the OTLP/HTTP traces endpoint of the collector traces are exported to, eg. http://otel-collector:4318/v1/traces; enables tracing")
+	flagSet.StringSlice("tracing-otlp-header", []string{}, "a header sent with the traces exported to the collector (may be given multiple times). Format: Name=value")
+	flagSet.String("tracing-service-name", DefaultTracingServiceName, "the service name of the exported traces")
+	flagSet.Float64("tracing-sample-ratio", DefaultTracingSampleRatio, "the ratio, from 0 to 1, of the traces started by the proxy that are sampled; the sampling decision of propagated traces is followed")
+
+	return flagSet
+}
+
+// tracingDefaults creates a Tracing populating each field with its default
+// value
+func tracingDefaults() Tracing {
+	return Tracing{
+		OTLPEndpoint: "",
+		OTLPHeaders:  nil,
+		ServiceName:  DefaultTracingServiceName,
+		SampleRatio:  DefaultTracingSampleRatio,
+	}
+}
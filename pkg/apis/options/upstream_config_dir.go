@@ -0,0 +1,105 @@
+package options
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// LoadUpstreamConfigDir loads the upstreams defined in the `*.yaml` files of
+// the directory, and merges them after the upstreams given.
+// Each file may contain a single upstream or a list of upstreams.
+// Files are loaded in lexical order so that the order of the upstreams, and
+// therefore route precedence, is stable.
+// The upstreams given are not modified, so that the directory can be loaded
+// again to replace the upstreams it defined.
+func LoadUpstreamConfigDir(dir string, upstreams []Upstream) ([]Upstream, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read upstream config dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("upstream config dir %s is not a directory", dir)
+	}
+
+	// Glob sorts the files lexically
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list upstream config dir: %w", err)
+	}
+
+	merged := make([]Upstream, len(upstreams), len(upstreams)+len(files))
+	copy(merged, upstreams)
+
+	// Record where each ID and path was defined to report conflicts
+	ids := make(map[string]string)
+	paths := make(map[string]string)
+	for _, upstream := range upstreams {
+		ids[upstream.ID] = "the upstream configuration"
+		paths[upstream.Path] = "the upstream configuration"
+	}
+
+	msgs := []string{}
+	for _, file := range files {
+		fileUpstreams, err := loadUpstreamConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Base(file)
+		for _, upstream := range fileUpstreams {
+			if source, ok := ids[upstream.ID]; ok {
+				msgs = append(msgs, fmt.Sprintf("upstream id %q in %s is already defined in %s", upstream.ID, name, source))
+			} else {
+				ids[upstream.ID] = name
+			}
+			if source, ok := paths[upstream.Path]; ok {
+				msgs = append(msgs, fmt.Sprintf("upstream %q in %s has path %q already defined in %s", upstream.ID, name, upstream.Path, source))
+			} else {
+				paths[upstream.Path] = name
+			}
+		}
+		merged = append(merged, fileUpstreams...)
+	}
+
+	if len(msgs) > 0 {
+		return nil, fmt.Errorf("conflicting upstreams in upstream config dir:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return merged, nil
+}
+
+// loadUpstreamConfigFile loads either a single upstream or a list of upstreams
+// from the file.
+func loadUpstreamConfigFile(file string) ([]Upstream, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load upstream config file: %w", err)
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling upstream config file %s: %w", filepath.Base(file), err)
+	}
+	jsonData = bytes.TrimSpace(jsonData)
+
+	upstreams := []Upstream{}
+	switch {
+	case len(jsonData) == 0 || bytes.Equal(jsonData, []byte("null")):
+		// An empty file defines no upstreams
+	case jsonData[0] == '{':
+		upstream := Upstream{}
+		err = yaml.UnmarshalStrict(data, &upstream, yaml.DisallowUnknownFields)
+		upstreams = append(upstreams, upstream)
+	default:
+		err = yaml.UnmarshalStrict(data, &upstreams, yaml.DisallowUnknownFields)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling upstream config file %s: %w", filepath.Base(file), err)
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,138 @@
+package options
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadUpstreamConfigDir", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "oauth2-proxy-test-upstream-config-dir")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	type loadUpstreamConfigDirTableInput struct {
+		files          map[string]string
+		upstreams      []Upstream
+		expectedErr    string
+		expectedOutput []Upstream
+	}
+
+	DescribeTable("loading the directory",
+		func(in loadUpstreamConfigDirTableInput) {
+			for name, content := range in.files {
+				Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)).To(Succeed())
+			}
+
+			upstreams, err := LoadUpstreamConfigDir(dir, in.upstreams)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(in.expectedErr)))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(upstreams).To(Equal(in.expectedOutput))
+		},
+		Entry("with an empty directory", loadUpstreamConfigDirTableInput{
+			expectedOutput: []Upstream{},
+		}),
+		Entry("with a single upstream in a file", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"app.yaml": "id: app\npath: /app/\nuri: http://app:8080\n",
+			},
+			expectedOutput: []Upstream{
+				{ID: "app", Path: "/app/", URI: "http://app:8080"},
+			},
+		}),
+		Entry("with a list of upstreams in a file", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"apps.yaml": "- id: app\n  path: /app/\n  uri: http://app:8080\n- id: api\n  path: /api/\n  uri: http://api:8080\n",
+			},
+			expectedOutput: []Upstream{
+				{ID: "app", Path: "/app/", URI: "http://app:8080"},
+				{ID: "api", Path: "/api/", URI: "http://api:8080"},
+			},
+		}),
+		Entry("with files merged in lexical order after the configured upstreams", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"20-b.yaml": "id: b\npath: /b/\nuri: http://b:8080\n",
+				"10-a.yaml": "id: a\npath: /a/\nuri: http://a:8080\n",
+				"30-c.yaml": "id: c\npath: /c/\nuri: http://c:8080\n",
+			},
+			upstreams: []Upstream{
+				{ID: "root", Path: "/", URI: "http://root:8080"},
+			},
+			expectedOutput: []Upstream{
+				{ID: "root", Path: "/", URI: "http://root:8080"},
+				{ID: "a", Path: "/a/", URI: "http://a:8080"},
+				{ID: "b", Path: "/b/", URI: "http://b:8080"},
+				{ID: "c", Path: "/c/", URI: "http://c:8080"},
+			},
+		}),
+		Entry("with files that are not YAML and empty files", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"app.yaml":   "id: app\npath: /app/\nuri: http://app:8080\n",
+				"empty.yaml": "",
+				"README.md":  "# Upstreams\n",
+			},
+			expectedOutput: []Upstream{
+				{ID: "app", Path: "/app/", URI: "http://app:8080"},
+			},
+		}),
+		Entry("with a duplicate ID across files", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"a.yaml": "id: app\npath: /a/\nuri: http://a:8080\n",
+				"b.yaml": "id: app\npath: /b/\nuri: http://b:8080\n",
+			},
+			expectedErr: `upstream id "app" in b.yaml is already defined in a.yaml`,
+		}),
+		Entry("with a path conflict across files", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"a.yaml": "id: a\npath: /app/\nuri: http://a:8080\n",
+				"b.yaml": "id: b\npath: /app/\nuri: http://b:8080\n",
+			},
+			expectedErr: `upstream "b" in b.yaml has path "/app/" already defined in a.yaml`,
+		}),
+		Entry("with a conflict with the configured upstreams", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"a.yaml": "id: root\npath: /a/\nuri: http://a:8080\n",
+			},
+			upstreams: []Upstream{
+				{ID: "root", Path: "/", URI: "http://root:8080"},
+			},
+			expectedErr: `upstream id "root" in a.yaml is already defined in the upstream configuration`,
+		}),
+		Entry("with an unknown field", loadUpstreamConfigDirTableInput{
+			files: map[string]string{
+				"a.yaml": "id: a\npath: /a/\nurl: http://a:8080\n",
+			},
+			expectedErr: `error unmarshalling upstream config file a.yaml: error unmarshaling JSON: while decoding JSON: json: unknown field "url"`,
+		}),
+	)
+
+	It("returns an error if the directory does not exist", func() {
+		_, err := LoadUpstreamConfigDir(filepath.Join(dir, "missing"), nil)
+		Expect(err).To(MatchError(ContainSubstring("unable to read upstream config dir")))
+	})
+
+	It("does not modify the configured upstreams", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("id: a\npath: /a/\nuri: http://a:8080\n"), 0600)).To(Succeed())
+
+		configured := make([]Upstream, 1, 2)
+		configured[0] = Upstream{ID: "root", Path: "/"}
+		_, err := LoadUpstreamConfigDir(dir, configured)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(configured[:cap(configured)][1]).To(Equal(Upstream{}))
+	})
+})
@@ -8,6 +8,136 @@ const (
 
 	// DefaultUpstreamTimeout is the maximum duration a network dial to a upstream server for a response.
 	DefaultUpstreamTimeout = 30 * time.Second
+
+	// DefaultUpstreamQueueTimeout is the default value for the Upstream QueueTimeout.
+	DefaultUpstreamQueueTimeout = 5 * time.Second
+
+	// DefaultUpstreamDialTimeout is the default value for the Upstream DialTimeout.
+	DefaultUpstreamDialTimeout = 30 * time.Second
+
+	// DefaultUpstreamMirrorTimeout is the default value for the UpstreamMirror Timeout.
+	DefaultUpstreamMirrorTimeout = 5 * time.Second
+
+	// DefaultUpstreamMirrorMaxBodySize is the default value for the UpstreamMirror MaxBodySize.
+	DefaultUpstreamMirrorMaxBodySize = 1 << 20
+
+	// DefaultUpstreamMaxResponseBufferSize is the default value for the Upstream MaxResponseBufferSize.
+	DefaultUpstreamMaxResponseBufferSize = 1 << 20
+
+	// DefaultUpstreamCacheTTL is the default value for the UpstreamCache TTL.
+	DefaultUpstreamCacheTTL = 1 * time.Minute
+
+	// DefaultUpstreamCacheMaxEntrySize is the default value for the UpstreamCache MaxEntrySize.
+	DefaultUpstreamCacheMaxEntrySize = 1 << 20
+
+	// DefaultUpstreamCacheMaxSize is the default value for the UpstreamCache MaxSize.
+	DefaultUpstreamCacheMaxSize = 64 << 20
+
+	// UpstreamCacheStoreMemory caches the responses of an upstream in memory.
+	UpstreamCacheStoreMemory = "memory"
+
+	// UpstreamCacheStoreRedis caches the responses of an upstream in Redis.
+	UpstreamCacheStoreRedis = "redis"
+
+	// DefaultUpstreamHealthCheckPath is the default value for the UpstreamHealthCheck Path.
+	DefaultUpstreamHealthCheckPath = "/"
+
+	// DefaultUpstreamHealthCheckInterval is the default value for the UpstreamHealthCheck Interval.
+	DefaultUpstreamHealthCheckInterval = 10 * time.Second
+
+	// DefaultUpstreamHealthCheckTimeout is the default value for the UpstreamHealthCheck Timeout.
+	DefaultUpstreamHealthCheckTimeout = 5 * time.Second
+
+	// DefaultUpstreamHealthyThreshold is the default value for the UpstreamHealthCheck HealthyThreshold.
+	DefaultUpstreamHealthyThreshold = 2
+
+	// DefaultUpstreamUnhealthyThreshold is the default value for the UpstreamHealthCheck UnhealthyThreshold.
+	DefaultUpstreamUnhealthyThreshold = 3
+
+	// DefaultCircuitBreakerErrorRatePercent is the default value for the UpstreamCircuitBreaker ErrorRatePercent.
+	DefaultCircuitBreakerErrorRatePercent = 50
+
+	// DefaultCircuitBreakerMinimumRequests is the default value for the UpstreamCircuitBreaker MinimumRequests.
+	DefaultCircuitBreakerMinimumRequests = 20
+
+	// DefaultCircuitBreakerWindow is the default value for the UpstreamCircuitBreaker Window.
+	DefaultCircuitBreakerWindow = 10 * time.Second
+
+	// DefaultCircuitBreakerCoolDown is the default value for the UpstreamCircuitBreaker CoolDown.
+	DefaultCircuitBreakerCoolDown = 30 * time.Second
+
+	// DefaultCircuitBreakerHalfOpenRequests is the default value for the UpstreamCircuitBreaker HalfOpenRequests.
+	DefaultCircuitBreakerHalfOpenRequests = 1
+
+	// DefaultUpstreamRateLimitPeriod is the default value for the UpstreamRateLimit Period.
+	DefaultUpstreamRateLimitPeriod = 1 * time.Second
+
+	// DefaultUpstreamRetryMaxAttempts is the default value for the UpstreamRetry MaxAttempts.
+	DefaultUpstreamRetryMaxAttempts = 3
+
+	// DefaultUpstreamRetryBackoff is the default value for the UpstreamRetry Backoff.
+	DefaultUpstreamRetryBackoff = 100 * time.Millisecond
+
+	// DefaultUpstreamRetryMaxBackoff is the default value for the UpstreamRetry MaxBackoff.
+	DefaultUpstreamRetryMaxBackoff = 1 * time.Second
+
+	// DefaultUpstreamRetryMaxBodySize is the default value for the UpstreamRetry MaxBodySize.
+	DefaultUpstreamRetryMaxBodySize = 64 << 10
+)
+
+// The classes of connection failures the requests to an upstream are
+// retried on
+const (
+	UpstreamRetryErrorConnect = "connect"
+	UpstreamRetryErrorReset   = "reset"
+	UpstreamRetryErrorTimeout = "timeout"
+)
+
+// The headers that can be sent to upstreams with PassTLSHeaders
+const (
+	TLSHeaderForwardedProto = "X-Forwarded-Proto"
+	TLSHeaderProtocol       = "X-SSL-Protocol"
+	TLSHeaderCipher         = "X-SSL-Cipher"
+	TLSHeaderClientCert     = "X-SSL-Client-Cert"
+	TLSHeaderClientDN       = "X-SSL-Client-DN"
+)
+
+// The policies for the Authorization header of client requests when an
+// Authorization header is injected from the user's session
+const (
+	AuthorizationConflictOverwrite      = "overwrite"
+	AuthorizationConflictPreserveClient = "preserve-client"
+	AuthorizationConflictMoveClient     = "move-client"
+
+	// DefaultClientAuthorizationHeader is the default value for the Upstream
+	// ClientAuthorizationHeader.
+	DefaultClientAuthorizationHeader = "X-Original-Authorization"
+)
+
+// The actions of the header rewrites of an upstream
+const (
+	HeaderRewriteAdd     = "add"
+	HeaderRewriteSet     = "set"
+	HeaderRewriteRemove  = "remove"
+	HeaderRewriteReplace = "replace"
+)
+
+// The policies for balancing the requests to an upstream across its backends
+const (
+	LoadBalancingRoundRobin       = "round-robin"
+	LoadBalancingLeastConnections = "least-connections"
+)
+
+// The keys the requests to an upstream are rate limited by
+const (
+	RateLimitKeyUser = "user"
+	RateLimitKeyIP   = "ip"
+)
+
+// The actions of the authorization policies of an upstream
+const (
+	UpstreamPolicyAllow = "allow"
+	UpstreamPolicyDeny  = "deny"
 )
 
 // UpstreamConfig is a collection of definitions for upstream servers.
@@ -29,7 +159,8 @@ type Upstream struct {
 	ID string `json:"id,omitempty"`
 
 	// Path is used to map requests to the upstream server.
-	// The closest match will take precedence and all Paths must be unique.
+	// The closest match will take precedence and all Paths must be unique,
+	// except for those of upstreams with a SessionMatch.
 	// Path can also take a pattern when used with RewriteTarget.
 	// Path segments can be captured and matched using regular experessions.
 	// Eg:
@@ -38,6 +169,15 @@ type Upstream struct {
 	// - `^/baz/(.*)$`: Match any path prefixed with `/baz` and capture the remaining path for use with RewriteTarget
 	Path string `json:"path,omitempty"`
 
+	// SessionMatch restricts this upstream to the requests whose session
+	// matches it, eg. to send the requests of beta testers to a canary
+	// deployment.
+	// Upstreams with a SessionMatch may have the same Path as another
+	// upstream: they are matched first, in the order they are configured,
+	// and the requests of other sessions, or without a session, are sent to
+	// the upstream without a SessionMatch.
+	SessionMatch *UpstreamSessionMatch `json:"sessionMatch,omitempty"`
+
 	// RewriteTarget allows users to rewrite the request path before it is sent to
 	// the upstream server.
 	// Use the Path to capture segments for reuse within the rewrite target.
@@ -46,6 +186,22 @@ type Upstream struct {
 	// upstream server.
 	RewriteTarget string `json:"rewriteTarget,omitempty"`
 
+	// StripPath removes the Path from the start of the request path before the
+	// request is sent to the upstream server.
+	// A request for exactly the Path is sent to the root of the upstream.
+	// When the Path has a trailing `/`, requests for the Path without it are
+	// redirected to the Path before they are proxied.
+	// Eg: With a Path of `/service/`, the request `/service/abc` is sent as `/abc`.
+	// This option can only be used with HTTP(S) upstreams without a RewriteTarget.
+	StripPath bool `json:"stripPath,omitempty"`
+
+	// PrependPath is added to the start of the request path before the request
+	// is sent to the upstream server.
+	// When used with StripPath, the Path is stripped first.
+	// Eg: With a Path of `/service/`, StripPath and a PrependPath of `/api`, the
+	// request `/service/abc` is sent as `/api/abc`.
+	PrependPath string `json:"prependPath,omitempty"`
+
 	// The URI of the upstream server. This may be an HTTP(S) server of a File
 	// based URL. It may include a path, in which case all requests will be served
 	// under that path.
@@ -54,18 +210,121 @@ type Upstream struct {
 	// - https://service.localhost
 	// - https://service.localhost/path
 	// - file://host/path
+	// - h2c://grpc.localhost:50051
+	// - unix:///var/run/app.sock
+	// The h2c scheme sends requests over HTTP/2 without TLS, eg. to gRPC
+	// servers. The unix scheme sends requests over HTTP to the unix domain
+	// socket at the path of the URI, eg. of a sidecar.
+	// Programs embedding OAuth2 Proxy may register handlers for other schemes.
 	// If the URI's path is "/base" and the incoming request was for "/dir",
 	// the upstream request will be for "/base/dir".
+	// The host of an HTTP(S) URI may be templated with claims from the user's
+	// session to select the upstream server per request.
+	// Eg:
+	// - `http://{{ .Claims.tenant }}.svc.cluster.local:8080`
+	// Claim values must be DNS labels and be allowed by AllowedClaimValues or
+	// AllowedClaimPattern, requests with any other values are forbidden.
 	URI string `json:"uri,omitempty"`
 
+	// Backends are further servers that requests to this upstream are
+	// balanced across, along with the server of the URI, so that replicated
+	// servers don't need a load balancer in front of them.
+	// The server of the URI is balanced as a backend with a weight of 1.
+	// The number of requests sent to each backend is reported per upstream ID
+	// and backend by the `oauth2_proxy_upstream_backend_requests_total`
+	// metric.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI or a DNSRefreshInterval.
+	Backends []UpstreamBackend `json:"backends,omitempty"`
+
+	// LoadBalancing is the policy the requests are balanced across the
+	// Backends with:
+	// - `round-robin` sends requests to each backend in turn, in proportion
+	//   to their weights
+	// - `least-connections` sends requests to the backend with the fewest
+	//   requests in flight relative to its weight
+	// Defaults to `round-robin`.
+	LoadBalancing string `json:"loadBalancing,omitempty"`
+
+	// HealthCheck probes the server of the URI and the Backends periodically,
+	// and stops sending requests to the servers that fail their probes until
+	// they pass them again.
+	// The health of the servers is reported by the `/oauth2/upstreams`
+	// endpoint, and per upstream ID and backend by the
+	// `oauth2_proxy_upstream_backend_healthy` metric.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	HealthCheck *UpstreamHealthCheck `json:"healthCheck,omitempty"`
+
+	// CircuitBreaker rejects the requests to this upstream with a 503
+	// response, without sending them, for a cool-down period once too many of
+	// its recent requests have failed.
+	// The state of the circuit breaker is reported per upstream ID by the
+	// `oauth2_proxy_upstream_circuit_breaker_state` metric.
+	// This option can only be used with HTTP(S) upstreams.
+	CircuitBreaker *UpstreamCircuitBreaker `json:"circuitBreaker,omitempty"`
+
+	// AllowedClaimValues lists the claim values that may be substituted into a
+	// templated URI.
+	AllowedClaimValues []string `json:"allowedClaimValues,omitempty"`
+
+	// AllowedClaimPattern is a regular expression that claim values substituted
+	// into a templated URI must match in full.
+	AllowedClaimPattern string `json:"allowedClaimPattern,omitempty"`
+
 	// InsecureSkipTLSVerify will skip TLS verification of upstream HTTPS hosts.
 	// This option is insecure and will allow potential Man-In-The-Middle attacks
 	// betweem OAuth2 Proxy and the usptream server.
 	// Defaults to false.
 	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify,omitempty"`
 
+	// TLSServerName is the name sent to the upstream server with SNI, and
+	// which its certificate is verified against, instead of the host of the
+	// URI.
+	// Eg. when the URI targets an IP address, but the certificate of the
+	// upstream server is issued for `internal.example.com`.
+	// This option can only be used with HTTPS upstreams.
+	TLSServerName string `json:"tlsServerName,omitempty"`
+
+	// DisableTLSSNI stops sending the server name to the upstream server with
+	// SNI, for legacy servers that fail TLS handshakes with it.
+	// The certificate of the upstream server is still verified against the
+	// TLSServerName, or the host of the URI.
+	// This option can only be used with HTTPS upstreams.
+	DisableTLSSNI bool `json:"disableTLSSNI,omitempty"`
+
+	// TLSClientCert is the PEM encoded certificate OAuth2 Proxy presents to
+	// the upstream server when it requests a client certificate, so that the
+	// proxy can authenticate itself to upstreams requiring mutual TLS.
+	// It must be set along with the TLSClientKey.
+	// The certificate is loaded when the upstream is configured, and
+	// presented to every server of the upstream, including its backends and
+	// health checks.
+	// This option can only be used with HTTPS upstreams.
+	TLSClientCert *SecretSource `json:"tlsClientCert,omitempty"`
+
+	// TLSClientKey is the PEM encoded private key of the TLSClientCert.
+	TLSClientKey *SecretSource `json:"tlsClientKey,omitempty"`
+
+	// TLSCA is the PEM encoded bundle of CA certificates the certificate of
+	// the upstream server is verified against, instead of the system's
+	// trusted CAs, eg. the CA of a private network.
+	// This option can only be used with HTTPS upstreams.
+	TLSCA *SecretSource `json:"tlsCA,omitempty"`
+
+	// SPIFFE authenticates OAuth2 Proxy to this upstream with its X.509 SVID
+	// from the SPIFFE Workload API, eg. of a SPIRE agent, and verifies the
+	// SVID of the upstream server against the trust bundles of the Workload
+	// API, instead of using certificate files.
+	// The SVIDs and bundles are rotated as the Workload API updates them.
+	// This option can only be used with HTTPS upstreams, and can't be
+	// combined with the TLSClientCert, TLSClientKey, TLSCA,
+	// InsecureSkipTLSVerify and DisableTLSSNI.
+	SPIFFE *UpstreamSPIFFE `json:"spiffe,omitempty"`
+
 	// Static will make all requests to this upstream have a static response.
-	// The response will have a body of "Authenticated" and a response code
+	// The response will have a body of "Authenticated", or the rendered
+	// StaticBody or StaticTemplate, the StaticHeaders, and a response code
 	// matching StaticCode.
 	// If StaticCode is not set, the response will return a 200 response.
 	Static bool `json:"static,omitempty"`
@@ -74,11 +333,78 @@ type Upstream struct {
 	// This option can only be used with Static enabled.
 	StaticCode *int `json:"staticCode,omitempty"`
 
+	// StaticTemplate is the path to a Go template file rendered per request as
+	// the body of the Static response.
+	// The template is given the `Email`, `User`, `Groups` and `Claims` of the
+	// session, the request `Method`, `Path`, `Host`, `Query` and `Headers`,
+	// and the configured `Upstreams`, each with an `ID` and `Path`.
+	// HTML content types are rendered with html/template, other content types
+	// with text/template.
+	// This option can only be used with Static enabled.
+	StaticTemplate string `json:"staticTemplate,omitempty"`
+
+	// StaticBody is a Go template rendered per request as the body of the
+	// Static response, like the StaticTemplate, but inline.
+	// Eg: `{"user": "{{ .User }}"}`
+	// This option can only be used with Static enabled, and not with a
+	// StaticTemplate.
+	StaticBody string `json:"staticBody,omitempty"`
+
+	// StaticHeaders are added to the Static response, after its
+	// Content-Type, which they replace when they set it.
+	// This option can only be used with Static enabled.
+	StaticHeaders []UpstreamStaticHeader `json:"staticHeaders,omitempty"`
+
+	// StaticContentType sets the Content-Type of the Static response.
+	// Defaults to `text/html; charset=utf-8` when a StaticBody or
+	// StaticTemplate is set.
+	// This option can only be used with Static enabled.
+	StaticContentType string `json:"staticContentType,omitempty"`
+
+	// FileServer configures how the files of a file upstream are served,
+	// eg. to serve single-page apps, whose client-side routes aren't files.
+	// Defaults to the files being served as they are, with listings of the
+	// directories without an index.html.
+	// This option can only be used with file upstreams.
+	FileServer *UpstreamFileServer `json:"fileServer,omitempty"`
+
 	// FlushInterval is the period between flushing the response buffer when
 	// streaming response from the upstream.
+	// A negative interval flushes the response after each write.
+	// Responses of server-sent events, with a Content-Type of
+	// `text/event-stream`, and responses of unknown length are always
+	// flushed after each write.
 	// Defaults to 1 second.
 	FlushInterval *Duration `json:"flushInterval,omitempty"`
 
+	// StreamingContentTypes are the media types of the responses of this
+	// upstream that are flushed after each write, like server-sent events,
+	// so that long-polling and streaming endpoints reach the client as soon
+	// as the upstream sends them, eg: `application/x-ndjson`.
+	// These responses are never buffered by BufferResponses.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	StreamingContentTypes []string `json:"streamingContentTypes,omitempty"`
+
+	// BufferResponses reads the responses of this upstream into memory, up
+	// to the MaxResponseBufferSize, before they are sent to the client, so
+	// that the upstream is released as soon as it has responded, however
+	// slow the client is.
+	// Responses larger than the MaxResponseBufferSize are sent as they are
+	// received once the buffer is full, so that large downloads don't use
+	// more memory. Server-sent events, and responses of the
+	// StreamingContentTypes, are never buffered.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	// Defaults to false, responses are sent as they are received and flushed
+	// every FlushInterval.
+	BufferResponses bool `json:"bufferResponses,omitempty"`
+
+	// MaxResponseBufferSize is the largest response body, in bytes, that is
+	// buffered in memory by BufferResponses.
+	// Defaults to 1MiB.
+	MaxResponseBufferSize int64 `json:"maxResponseBufferSize,omitempty"`
+
 	// PassHostHeader determines whether the request host header should be proxied
 	// to the upstream server.
 	// Defaults to true.
@@ -88,7 +414,849 @@ type Upstream struct {
 	// Defaults to true.
 	ProxyWebSockets *bool `json:"proxyWebSockets,omitempty"`
 
+	// WebSocketAllowedOrigins lists the origins WebSocket upgrade requests to
+	// this upstream may come from, in the form scheme://host[:port], where the
+	// host may start with a `*.` wildcard to match its subdomains.
+	// Upgrade requests from any other origin are rejected with a 403 response,
+	// protecting upstreams that don't check the origin themselves from
+	// cross-site WebSocket hijacking. Other requests are unaffected.
+	// Defaults to unset, upgrade requests are allowed from any origin.
+	WebSocketAllowedOrigins []string `json:"webSocketAllowedOrigins,omitempty"`
+
+	// WebSocketAllowedSubprotocols lists the subprotocols that may be
+	// negotiated with this upstream.
+	// Other subprotocols are removed from the Sec-WebSocket-Protocol header of
+	// upgrade requests, and upgrade requests offering none of the allowed
+	// subprotocols are rejected with a 403 response. Upgrade requests that
+	// don't offer a subprotocol are allowed.
+	// Defaults to unset, any subprotocol may be negotiated.
+	WebSocketAllowedSubprotocols []string `json:"webSocketAllowedSubprotocols,omitempty"`
+
+	// WebSocketRequireOrigin rejects WebSocket upgrade requests to this
+	// upstream without an Origin header, as sent by non-browser clients, when
+	// WebSocketAllowedOrigins is set.
+	// Defaults to false, upgrade requests without an Origin header are allowed.
+	WebSocketRequireOrigin bool `json:"webSocketRequireOrigin,omitempty"`
+
+	// WebSocketIdleTimeout closes the WebSocket connections to this upstream
+	// once no data has been sent on them, in either direction, for this long.
+	// The upgrade request must also be answered within the timeout.
+	// Defaults to unset, idle connections are kept open.
+	WebSocketIdleTimeout *Duration `json:"webSocketIdleTimeout,omitempty"`
+
 	// Timeout is the maximum duration the server will wait for a response from the upstream server.
 	// Defaults to 30 seconds.
 	Timeout *Duration `json:"timeout,omitempty"`
+
+	// DialTimeout is the maximum duration of dialing a connection to the
+	// upstream server.
+	// Defaults to 30 seconds.
+	DialTimeout *Duration `json:"dialTimeout,omitempty"`
+
+	// ResponseHeaderTimeout is the maximum duration the server will wait for
+	// the response headers of the upstream server, once the request is sent.
+	// It takes precedence over the Timeout when both are set.
+	// Defaults to the Timeout.
+	ResponseHeaderTimeout *Duration `json:"responseHeaderTimeout,omitempty"`
+
+	// MaxIdleConns is the maximum number of idle connections kept open to the
+	// upstream server, in total and to each of its hosts, for reuse by later
+	// requests. Each upstream has its own pool of connections.
+	// Defaults to 0, Go's defaults of 100 in total and 2 per host are used.
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+
+	// IdleConnTimeout is the maximum duration an idle connection to the
+	// upstream server is kept open.
+	// Defaults to 90 seconds.
+	IdleConnTimeout *Duration `json:"idleConnTimeout,omitempty"`
+
+	// DisableKeepAlives closes the connection to the upstream server after
+	// each request, rather than keeping it open for reuse.
+	// Defaults to false.
+	DisableKeepAlives bool `json:"disableKeepAlives,omitempty"`
+
+	// MaxConcurrentRequests limits the number of requests in flight to the
+	// upstream at once.
+	// Requests above the limit wait in a queue of QueueSize, and are rejected
+	// with a 503 response when the queue is full or they have waited for longer
+	// than the QueueTimeout.
+	// The limit is reported per upstream ID by the
+	// `oauth2_proxy_upstream_requests_in_flight`,
+	// `oauth2_proxy_upstream_requests_queued` and
+	// `oauth2_proxy_upstream_requests_rejected_total` metrics.
+	// Defaults to 0, requests are not limited.
+	MaxConcurrentRequests int `json:"maxConcurrentRequests,omitempty"`
+
+	// QueueSize is the number of requests that may wait for one of the
+	// MaxConcurrentRequests to complete.
+	// Defaults to 0, requests above the limit are rejected straight away.
+	QueueSize int `json:"queueSize,omitempty"`
+
+	// QueueTimeout is the maximum duration a request waits in the queue.
+	// Defaults to 5 seconds.
+	QueueTimeout *Duration `json:"queueTimeout,omitempty"`
+
+	// MaxRequestBodySize is the largest request body, in bytes, that is sent
+	// to the upstream.
+	// Requests with a larger Content-Length are rejected with a 413 response
+	// before they are proxied. Requests without a Content-Length, such as
+	// chunked requests, are streamed to the upstream until the limit is
+	// crossed, when the upstream request is aborted and a 413 response is
+	// returned, unless the upstream has already responded.
+	// WebSocket upgrade requests are never limited.
+	// Rejections are reported per upstream ID by the
+	// `oauth2_proxy_upstream_request_body_rejected_total` metric.
+	// Defaults to 0, request bodies are not limited.
+	MaxRequestBodySize int64 `json:"maxRequestBodySize,omitempty"`
+
+	// RateLimit limits the rate of the requests of each user, or each client
+	// IP, to this upstream.
+	// Requests above the rate are rejected with a 429 response.
+	// Rejections are reported per upstream ID by the
+	// `oauth2_proxy_upstream_rate_limited_total` metric.
+	// Defaults to unset, requests are not rate limited.
+	RateLimit *UpstreamRateLimit `json:"rateLimit,omitempty"`
+
+	// FaultInjection delays, or aborts, a percentage of the authorized
+	// requests to this upstream that carry a header or are made by members
+	// of groups, to run chaos experiments on the upstream and its clients.
+	// Injected faults are reported per upstream ID by the
+	// `oauth2_proxy_upstream_faults_injected_total` metric.
+	// Defaults to unset, no faults are injected.
+	FaultInjection *UpstreamFaultInjection `json:"faultInjection,omitempty"`
+
+	// DNSRefreshInterval enables re-resolving the hostname of the upstream
+	// server at this interval, for hostnames with multiple addresses such as
+	// Kubernetes headless services.
+	// New connections are spread across all resolved addresses in turn, and
+	// connections to addresses that are no longer resolved are closed once
+	// idle. The number of addresses is reported per upstream ID by the
+	// `oauth2_proxy_upstream_backend_addresses` metric.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	// Defaults to unset, connections are dialed with the standard resolver.
+	DNSRefreshInterval *Duration `json:"dnsRefreshInterval,omitempty"`
+
+	// BasicAuthUser is the username of the basic auth credentials sent to the
+	// upstream server, independent of the user's identity.
+	// This option can only be used with HTTP(S) upstreams and requires a
+	// BasicAuthPassword.
+	BasicAuthUser string `json:"basicAuthUser,omitempty"`
+
+	// BasicAuthPassword is the password of the basic auth credentials sent to
+	// the upstream server.
+	BasicAuthPassword *SecretSource `json:"basicAuthPassword,omitempty"`
+
+	// CredentialHeaders are headers with secret values, such as API keys, sent
+	// to the upstream server, independent of the user's identity.
+	// Values may only be loaded from secret sources, any values for these
+	// headers in the request are replaced.
+	// This option can only be used with HTTP(S) upstreams.
+	CredentialHeaders []Header `json:"credentialHeaders,omitempty"`
+
+	// OverrideAuthorization allows the BasicAuthUser or an Authorization
+	// credential header to replace an Authorization header injected from the
+	// user's session by InjectRequestHeaders.
+	// Defaults to false, such configurations are rejected.
+	OverrideAuthorization bool `json:"overrideAuthorization,omitempty"`
+
+	// AuthorizationConflict determines how the Authorization header of a
+	// client request, eg. a bearer token meant for the upstream API, is sent
+	// to this upstream when an Authorization header is injected from the
+	// user's session by InjectRequestHeaders, eg. with pass-basic-auth:
+	// - `overwrite`: the injected header replaces the client's
+	// - `preserve-client`: the client's header is sent rather than the
+	//   injected one, which is only sent when the client has none
+	// - `move-client`: the injected header is sent, and the client's header
+	//   is sent in the ClientAuthorizationHeader
+	// This option can only be used with HTTP(S) upstreams.
+	// Defaults to overwrite.
+	AuthorizationConflict string `json:"authorizationConflict,omitempty"`
+
+	// ClientAuthorizationHeader is the request header the client's
+	// Authorization header is moved to with the move-client
+	// AuthorizationConflict policy. Any value of this header in the client
+	// request is removed.
+	// Defaults to X-Original-Authorization.
+	ClientAuthorizationHeader string `json:"clientAuthorizationHeader,omitempty"`
+
+	// DisableIdentityHeaders stops the request headers injected with the
+	// user's identity by InjectRequestHeaders, the identity assertion and the
+	// GAP-Auth header from being sent to this upstream.
+	// Other upstreams still receive these headers for the same session.
+	DisableIdentityHeaders bool `json:"disableIdentityHeaders,omitempty"`
+
+	// DisableSignature stops requests to this upstream from being signed with
+	// the GAP-Signature header when a signature key is configured.
+	DisableSignature bool `json:"disableSignature,omitempty"`
+
+	// PassTLSHeaders lists the headers describing the client's connection to
+	// send to this upstream:
+	// - `X-Forwarded-Proto`: `https` or `http`, taken from the
+	//   X-Forwarded-Proto header of trusted reverse proxies
+	// - `X-SSL-Protocol`: the TLS version, eg. `TLSv1.3`
+	// - `X-SSL-Cipher`: the TLS cipher suite name
+	// - `X-SSL-Client-Cert`: the URL encoded PEM of the client certificate
+	// - `X-SSL-Client-DN`: the subject DN of the client certificate
+	// The X-SSL headers are only sent when the client connected to OAuth2 Proxy
+	// over TLS, the client certificate headers when a certificate verified
+	// against the ClientCA was presented. The X-SSL headers are always
+	// removed from client requests.
+	PassTLSHeaders []string `json:"passTLSHeaders,omitempty"`
+
+	// ResponseHeaderPolicy sets static headers, such as security headers, on
+	// the responses of this upstream in addition to the global
+	// ResponseHeaderPolicy.
+	// Headers named in both replace those of the global policy.
+	ResponseHeaderPolicy []ResponseHeaderPolicy `json:"responseHeaderPolicy,omitempty"`
+
+	// HeaderRewrites adds, removes and rewrites the headers of the requests
+	// sent to this upstream and of the responses it returns, eg. to strip
+	// the Set-Cookie headers of a backend or to send it a static API key.
+	// Unlike InjectRequestHeaders, the rewrites only apply to this upstream.
+	HeaderRewrites *UpstreamHeaderRewrites `json:"headerRewrites,omitempty"`
+
+	// SessionStoreUnavailable overrides the session-store-unavailable policy
+	// for requests to this upstream:
+	// - `fail-closed`: requests are rejected with a 503 response
+	// - `fail-open-anonymous`: requests are proxied without the user's
+	//   identity headers and with an `X-Auth-Degraded: true` header
+	// - `fail-open-cached`: requests are proxied with the session last loaded
+	//   for their cookie and an `X-Auth-Degraded: true` header, if the session
+	//   is cached in memory, and rejected otherwise
+	// Defaults to the global policy.
+	SessionStoreUnavailable string `json:"sessionStoreUnavailable,omitempty"`
+
+	// RequiredTokenAudiences lists the audiences a bearer token must have, at
+	// least one of, to be accepted for requests to this upstream, so that
+	// tokens issued for other services can't be replayed against it.
+	// Tokens are only accepted when SkipJwtBearerTokens is enabled, and
+	// requests that don't meet the requirements are rejected with a 403
+	// response describing them.
+	RequiredTokenAudiences []string `json:"requiredTokenAudiences,omitempty"`
+
+	// RequiredTokenScopes lists the scopes a bearer token must have, all of,
+	// to be accepted for requests to this upstream, from its `scope` or `scp`
+	// claim.
+	RequiredTokenScopes []string `json:"requiredTokenScopes,omitempty"`
+
+	// RequireBearerToken rejects requests to this upstream authenticated by
+	// the session cookie or basic auth rather than a bearer token.
+	// Defaults to false, these requests are exempt from the
+	// RequiredTokenAudiences and RequiredTokenScopes.
+	RequireBearerToken bool `json:"requireBearerToken,omitempty"`
+
+	// Policies authorize the requests to this upstream by their path, method
+	// and client IP, and the groups and claims of their session, once the
+	// session has been validated and before the request is proxied.
+	// The policies are evaluated in order, and the first one matching the
+	// request allows or denies it. Requests matching none of the policies
+	// are denied with a 403 response.
+	// Requests without a session must sign in, unless the first policy they
+	// match allows them anonymously. Requests that skip authentication,
+	// such as those to skip auth routes, are not checked.
+	Policies []UpstreamPolicy `json:"policies,omitempty"`
+
+	// TokenExchange exchanges the access token of the user's session for a
+	// token for the audience of this upstream, with OAuth 2.0 token exchange
+	// (RFC 8693) at the provider's token endpoint, for backends that reject
+	// tokens issued for OAuth2 Proxy. The exchanged token is sent instead of
+	// the original one, in every header the access token was injected into.
+	// Exchanged tokens are cached per session and audience until they expire.
+	// This option can only be used with HTTP(S) upstreams.
+	TokenExchange *UpstreamTokenExchange `json:"tokenExchange,omitempty"`
+
+	// ResponseRewrite rewrites the absolute URLs of the upstream server in its
+	// responses to the URL the upstream is reached at through the proxy, for
+	// upstreams that link to their internal hostname.
+	// Rewriting response bodies streams them through the proxy, decompressing
+	// them when needed, so this should only be enabled for the upstreams that
+	// need it.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	ResponseRewrite *UpstreamResponseRewrite `json:"responseRewrite,omitempty"`
+
+	// RetryStreamErrors retries a request to the upstream once when the
+	// upstream response fails after it has started, but before any of the
+	// body has been sent to the client.
+	// Only GET, HEAD and OPTIONS requests without a body are retried.
+	// Responses that fail once the body has been sent are aborted, so that
+	// the client can tell the response is incomplete, and all failures are
+	// reported per upstream ID, error class and outcome by the
+	// `oauth2_proxy_upstream_stream_errors_total` metric.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	// Defaults to false, failures before the body is sent render the error
+	// page.
+	RetryStreamErrors bool `json:"retryStreamErrors,omitempty"`
+
+	// Retry retries the requests to this upstream whose attempts fail to
+	// reach the upstream, or are answered with a retryable status, so that
+	// transient failures of the upstream don't reach the client.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	Retry *UpstreamRetry `json:"retry,omitempty"`
+
+	// Mirror sends copies of a sample of the requests to this upstream to a
+	// secondary upstream server, eg. a new backend being migrated to, while
+	// the responses are only served from this upstream.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	Mirror *UpstreamMirror `json:"mirror,omitempty"`
+
+	// Cache caches the responses of this upstream to GET and HEAD requests
+	// in memory or in Redis, and serves identical requests from the cache
+	// until the responses expire, so that they don't reach the upstream.
+	// Responses are cached along with the values of the request headers
+	// listed in their Vary header, and are marked with an X-Cache header of
+	// HIT, MISS or BYPASS. Successful requests with other methods, such as
+	// POST, invalidate the cached responses to their URL.
+	// This option can only be used with HTTP(S) upstreams without a templated
+	// URI.
+	Cache *UpstreamCache `json:"cache,omitempty"`
+
+	// AllowedRequestHeaders lists the client request headers sent to this
+	// upstream, every other client header is removed, so that only the
+	// headers the upstream expects reach it.
+	// Headers set by OAuth2 Proxy, such as the identity headers of
+	// InjectRequestHeaders, the PassTLSHeaders, X-Auth-Degraded, GAP-Auth,
+	// the signature and the credential headers, are always sent.
+	// Hop-by-hop headers are always removed, other than the headers needed
+	// to upgrade WebSocket requests, and the Host is sent as configured by
+	// PassHostHeader.
+	// The Cookie header is controlled by PassCookies and StripProxyCookies
+	// instead.
+	// Defaults to all client headers being sent.
+	AllowedRequestHeaders []string `json:"allowedRequestHeaders,omitempty"`
+
+	// PassCookies determines whether the Cookie header of client requests is
+	// sent to this upstream.
+	// Defaults to true.
+	PassCookies *bool `json:"passCookies,omitempty"`
+
+	// StripProxyCookies removes the cookies of OAuth2 Proxy, the session
+	// cookie and the CSRF cookies, from the Cookie header of requests to this
+	// upstream, while its other cookies are still sent.
+	// Defaults to false.
+	StripProxyCookies bool `json:"stripProxyCookies,omitempty"`
+}
+
+// UpstreamSPIFFE configures the SPIFFE workload identity of the connections
+// to an upstream.
+// The upstream server must present an SVID with one of the IDs, or an ID of
+// the TrustDomain.
+type UpstreamSPIFFE struct {
+	// EndpointSocket is the address of the SPIFFE Workload API, eg.
+	// `unix:///run/spire/sockets/agent.sock`.
+	// The upstreams with the same EndpointSocket share their connection to
+	// the Workload API.
+	// Defaults to the SPIFFE_ENDPOINT_SOCKET environment variable.
+	EndpointSocket string `json:"endpointSocket,omitempty"`
+
+	// IDs are the SPIFFE IDs the upstream server may present, eg.
+	// `spiffe://example.org/ns/payments/sa/ledger`.
+	IDs []string `json:"ids,omitempty"`
+
+	// TrustDomain is the trust domain, eg. `example.org`, the SPIFFE ID of the
+	// upstream server may be any member of, when it isn't one of the IDs.
+	TrustDomain string `json:"trustDomain,omitempty"`
+}
+
+// UpstreamBackend is one of the servers the requests to an upstream are
+// balanced across.
+type UpstreamBackend struct {
+	// URI is the scheme and host of the backend server, which must have the
+	// scheme of the upstream URI.
+	// Eg: `http://app-2.internal:8080`
+	URI string `json:"uri,omitempty"`
+
+	// Weight is the share of the requests sent to this backend, relative to
+	// the weights of the other backends.
+	// Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// UpstreamHealthCheck configures the active health checks of the servers of
+// an upstream.
+// Servers are healthy until they fail the UnhealthyThreshold of probes in a
+// row, and healthy again once they pass the HealthyThreshold of probes in a
+// row. A probe passes when the server responds with a 2xx or 3xx status
+// within the Timeout.
+type UpstreamHealthCheck struct {
+	// Path is the path the servers are probed with a GET request to.
+	// Defaults to `/`.
+	Path string `json:"path,omitempty"`
+
+	// Interval is the duration between the probes of each server.
+	// Defaults to 10 seconds.
+	Interval *Duration `json:"interval,omitempty"`
+
+	// Timeout is the maximum duration of a probe, including reading its
+	// response headers.
+	// Defaults to 5 seconds.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// HealthyThreshold is the number of probes in a row an unhealthy server
+	// must pass to be sent requests again.
+	// Defaults to 2.
+	HealthyThreshold int `json:"healthyThreshold,omitempty"`
+
+	// UnhealthyThreshold is the number of probes in a row a healthy server
+	// must fail to stop being sent requests.
+	// Defaults to 3.
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty"`
+
+	// FallbackURI is the scheme and host of the server requests are sent to
+	// while all the servers of the upstream are unhealthy, eg. a static
+	// status page, which must have the scheme of the upstream URI.
+	// The fallback server isn't probed.
+	// Defaults to unset, the error page is rendered while all the servers are
+	// unhealthy.
+	FallbackURI string `json:"fallbackURI,omitempty"`
+}
+
+// UpstreamCircuitBreaker configures the circuit breaker of an upstream.
+// Requests fail when the upstream can't be reached, or responds with a 5xx
+// status. Once the ErrorRatePercent of the requests in the Window have
+// failed, the circuit opens and requests are rejected for the CoolDown. The
+// HalfOpenRequests are then sent to the upstream: the circuit closes again
+// once they have all succeeded, and opens for another CoolDown as soon as
+// one of them fails.
+// Rejected requests are reported per upstream ID by the
+// `oauth2_proxy_upstream_circuit_breaker_rejected_total` metric.
+type UpstreamCircuitBreaker struct {
+	// ErrorRatePercent is the percentage of the requests in the Window that
+	// must fail for the circuit to open, from 1 to 100.
+	// Defaults to 50.
+	ErrorRatePercent int `json:"errorRatePercent,omitempty"`
+
+	// MinimumRequests is the number of requests there must have been in the
+	// Window for the circuit to open, so that a few failures of an idle
+	// upstream don't open it.
+	// Defaults to 20.
+	MinimumRequests int `json:"minimumRequests,omitempty"`
+
+	// Window is the duration of the recent requests whose error rate is
+	// measured.
+	// Defaults to 10 seconds.
+	Window *Duration `json:"window,omitempty"`
+
+	// CoolDown is how long requests are rejected once the circuit is open.
+	// Defaults to 30 seconds.
+	CoolDown *Duration `json:"coolDown,omitempty"`
+
+	// HalfOpenRequests is the number of trial requests sent to the upstream
+	// once the cool-down has passed. Other requests are rejected until they
+	// have completed.
+	// Defaults to 1.
+	HalfOpenRequests int `json:"halfOpenRequests,omitempty"`
+}
+
+// UpstreamRetry configures the retries of the requests to an upstream.
+// An attempt is retried when its connection to the upstream fails with one of
+// the Errors, or the upstream responds with one of the StatusCodes, after a
+// backoff that is doubled for each retry.
+// Requests with an idempotent method, GET, HEAD, OPTIONS, TRACE, PUT or
+// DELETE, or with an Idempotency-Key header, are retried on any of these
+// failures. Other requests, such as POST, are only retried when they
+// couldn't be sent to the upstream at all.
+// Request bodies are buffered so that they can be sent again, and requests
+// whose body is larger than the MaxBodySize aren't retried.
+// Retried requests are balanced like other requests, so with Backends they
+// may be sent to another server. The retries are counted in the request log.
+type UpstreamRetry struct {
+	// MaxAttempts is the maximum number of times a request is sent to the
+	// upstream, including the first attempt.
+	// Defaults to 3.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+
+	// Backoff is the wait before the first retry, doubled before each
+	// further retry. A random jitter of up to half of the wait is taken off
+	// it, so that the retries of many requests are spread out.
+	// Defaults to 100 milliseconds.
+	Backoff *Duration `json:"backoff,omitempty"`
+
+	// MaxBackoff is the longest wait before a retry.
+	// Defaults to 1 second.
+	MaxBackoff *Duration `json:"maxBackoff,omitempty"`
+
+	// StatusCodes are the statuses of the upstream responses that are
+	// retried. The response of the last attempt is always sent to the
+	// client.
+	// Defaults to 502, 503 and 504.
+	StatusCodes []int `json:"statusCodes,omitempty"`
+
+	// Errors are the classes of connection failures that are retried:
+	// `connect`, the upstream couldn't be connected to, `reset`, the
+	// connection was reset or closed before the response, and `timeout`, the
+	// upstream didn't respond in time.
+	// Defaults to `connect` and `reset`.
+	Errors []string `json:"errors,omitempty"`
+
+	// MaxBodySize is the largest request body, in bytes, that is buffered
+	// so that the request can be retried.
+	// Defaults to 64 KiB.
+	MaxBodySize int64 `json:"maxBodySize,omitempty"`
+}
+
+// UpstreamRateLimit configures the rate limit of the requests to an upstream.
+// Each user, or client IP, has a bucket of Burst tokens, refilled at the rate
+// of Requests every Period. Each request takes a token, and requests are
+// rejected with a 429 response, whose Retry-After is the time until a token
+// is refilled, while the bucket is empty.
+// The buckets are kept in memory, so each instance of the proxy limits the
+// requests it serves separately.
+type UpstreamRateLimit struct {
+	// Requests is the number of requests allowed every Period.
+	Requests int `json:"requests,omitempty"`
+
+	// Period is the duration over which the Requests are allowed.
+	// Defaults to 1 second.
+	Period *Duration `json:"period,omitempty"`
+
+	// Burst is the number of requests that may be made at once, above the
+	// rate, after a quiet period.
+	// Defaults to the Requests.
+	Burst int `json:"burst,omitempty"`
+
+	// Key is what the requests are limited by: `user`, the user of the
+	// session, or `ip`, the client IP.
+	// Requests without a session, such as those to routes skipping
+	// authentication, are always limited by their client IP.
+	// The client IP is the real client IP when the real client IP header is
+	// trusted.
+	// Defaults to `user`.
+	Key string `json:"key,omitempty"`
+}
+
+// UpstreamFaultInjection configures the faults injected into the requests to
+// an upstream.
+// Faults are only injected into the requests of the experiment: those that
+// carry the Header, when it is set, and whose session is in one of the
+// Groups, when they are set. A Percent of these requests are delayed by the
+// Delay, and then answered with the AbortStatusCode without being sent to
+// the upstream.
+type UpstreamFaultInjection struct {
+	// Header is the name of the request header the requests of the
+	// experiment carry, with any value, eg: `X-Chaos-Experiment`.
+	Header string `json:"header,omitempty"`
+
+	// Groups are the groups of the sessions of the experiment, any one of
+	// them being enough.
+	Groups []string `json:"groups,omitempty"`
+
+	// Percent is the percentage of the requests of the experiment faults are
+	// injected into, from 1 to 100.
+	Percent int `json:"percent,omitempty"`
+
+	// Delay is how long the requests are held before they are sent to the
+	// upstream, or aborted.
+	Delay *Duration `json:"delay,omitempty"`
+
+	// AbortStatusCode is the status of the error page the requests are
+	// answered with instead of the response of the upstream, from 400 to
+	// 599.
+	// Defaults to 0, requests are sent to the upstream after the Delay.
+	AbortStatusCode int `json:"abortStatusCode,omitempty"`
+}
+
+// UpstreamSessionMatch matches the sessions of the requests routed to an
+// upstream.
+// Sessions match when they are in one of the Groups, if any, and have one
+// of the values of each of the Claims.
+type UpstreamSessionMatch struct {
+	// Groups are the groups of the sessions that match, any one of them
+	// being enough.
+	Groups []string `json:"groups,omitempty"`
+
+	// Claims are the claim values of the sessions that match.
+	Claims []UpstreamClaimMatch `json:"claims,omitempty"`
+}
+
+// UpstreamPolicy is an authorization policy of the requests to an upstream.
+// A policy matches a request when it matches all of its conditions, those
+// that are empty matching every request.
+type UpstreamPolicy struct {
+	// Name describes the policy in the logs and error pages of the requests
+	// it denies.
+	// Defaults to the index of the policy, eg. `policies[0]`.
+	Name string `json:"name,omitempty"`
+
+	// Action is what the policy does with the requests it matches: `allow`
+	// or `deny` them.
+	// Defaults to `allow`.
+	Action string `json:"action,omitempty"`
+
+	// Path is a regular expression matched against the request path, before
+	// it is rewritten or stripped for the upstream.
+	Path string `json:"path,omitempty"`
+
+	// Methods are the HTTP methods of the requests the policy matches.
+	Methods []string `json:"methods,omitempty"`
+
+	// CIDRs are the client networks of the requests the policy matches.
+	// The client IP is the real client IP when the real client IP header is
+	// trusted.
+	CIDRs []string `json:"cidrs,omitempty"`
+
+	// Groups are the groups of the sessions the policy matches, any one of
+	// them being enough.
+	Groups []string `json:"groups,omitempty"`
+
+	// Claims are the claim values of the sessions the policy matches, such
+	// as their roles.
+	Claims []UpstreamClaimMatch `json:"claims,omitempty"`
+
+	// AllowAnonymous allows the requests matching the policy without a
+	// session, rather than having them sign in. The requests with a session
+	// are still only allowed once it has been validated.
+	// Only allow policies without Groups or Claims may allow anonymous
+	// requests.
+	AllowAnonymous bool `json:"allowAnonymous,omitempty"`
+}
+
+// UpstreamClaimMatch matches a claim of the session of a request.
+type UpstreamClaimMatch struct {
+	// Claim is the name of the claim, a field of the session such as `email`,
+	// or a claim of the session's ID token or enriched claims.
+	// Nested claims are selected with dot separated paths, eg. `realm.role`.
+	Claim string `json:"claim,omitempty"`
+
+	// Values are the values of the claim that match. Claims with multiple
+	// values match when any one of them is listed.
+	Values []string `json:"values,omitempty"`
+}
+
+// UpstreamTokenExchange configures the exchange of the access token of the
+// user's session for a token for the audience of an upstream.
+// Requests whose token can't be exchanged are rejected with a 502 response,
+// and the exchanges are reported per upstream ID and result by the
+// `oauth2_proxy_upstream_token_exchanges_total` metric.
+type UpstreamTokenExchange struct {
+	// Audience is the audience the token is requested for, eg. the client ID
+	// or URI of the upstream API.
+	Audience string `json:"audience,omitempty"`
+
+	// Scopes are the scopes requested for the token, if any.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Header is the request header the exchanged token is sent in, replacing
+	// any value of the header in the request. The Authorization header is
+	// sent the token as a bearer token, other headers the token alone.
+	// Defaults to Authorization.
+	Header string `json:"header,omitempty"`
+}
+
+// UpstreamMirror configures the secondary upstream server requests are
+// mirrored to.
+// Mirrored requests are copies of the requests sent to the upstream, with the
+// same path, headers, including the identity headers, and body. They are
+// sent asynchronously once the upstream has responded, and their responses
+// are discarded, so they never delay or change the responses of the
+// upstream.
+// The mirrored requests are reported per upstream ID and result by the
+// `oauth2_proxy_upstream_mirror_requests_total` metric. Failures are only
+// logged with debug logging enabled.
+type UpstreamMirror struct {
+	// URI is the scheme and host of the server requests are mirrored to.
+	// Eg: `http://app-v2.internal:8080`
+	URI string `json:"uri,omitempty"`
+
+	// SamplePercent is the percentage of the requests that are mirrored,
+	// from 1 to 100.
+	SamplePercent int `json:"samplePercent,omitempty"`
+
+	// MaxBodySize is the largest request body, in bytes, that is mirrored.
+	// Requests with larger bodies are not mirrored.
+	// Defaults to 1MiB.
+	MaxBodySize int64 `json:"maxBodySize,omitempty"`
+
+	// Timeout is the maximum duration of a mirrored request, including
+	// reading its response.
+	// Defaults to 5 seconds.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// AllowNonIdempotent allows requests with methods that are not
+	// idempotent, such as POST and PATCH, to be mirrored.
+	// Defaults to false, only GET, HEAD, OPTIONS, TRACE, PUT and DELETE
+	// requests are mirrored.
+	AllowNonIdempotent bool `json:"allowNonIdempotent,omitempty"`
+}
+
+// UpstreamHeaderRewrites configures the header rewrites of an upstream.
+// The rewrites are applied in order, each to the headers left by the
+// previous rewrites.
+// Request rewrites are applied after the client headers have been filtered
+// and the identity headers injected, and before the request is signed, so
+// that added headers are sent even when they aren't allowed request headers.
+// The CredentialHeaders of the upstream are set after the rewrites.
+// Response rewrites are applied to the responses of the upstream before they
+// are cached, and before the ResponseHeaderPolicy is applied.
+type UpstreamHeaderRewrites struct {
+	// Request rewrites the headers of the requests sent to the upstream.
+	Request []HeaderRewrite `json:"request,omitempty"`
+
+	// Response rewrites the headers of the responses of the upstream.
+	Response []HeaderRewrite `json:"response,omitempty"`
+}
+
+// HeaderRewrite adds, removes or rewrites a header.
+type HeaderRewrite struct {
+	// Name is the name of the header.
+	Name string `json:"name,omitempty"`
+
+	// Action is what the rewrite does to the header:
+	// - `add`: adds Value to the values of the header
+	// - `set`: replaces the values of the header with Value
+	// - `remove`: removes the header
+	// - `replace`: replaces the matches of Pattern in each value of the
+	//   header with Value, which may refer to the submatches of Pattern as
+	//   `$1` or `${name}`
+	Action string `json:"action,omitempty"`
+
+	// Value is the value added, set or replacing the matches of Pattern.
+	// Secrets, such as API keys, should be sent with the CredentialHeaders
+	// of the upstream instead, which load them from a secret source.
+	Value string `json:"value,omitempty"`
+
+	// Pattern is the regular expression matched against the values of the
+	// header by the `replace` action.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// UpstreamStaticHeader is a header of the static response of an upstream.
+type UpstreamStaticHeader struct {
+	// Name is the name of the header.
+	Name string `json:"name,omitempty"`
+
+	// Value is a Go template rendered per request as the value of the
+	// header, with the data of the StaticTemplate of the upstream.
+	// Eg: `https://example.com{{ .Path }}`
+	Value string `json:"value,omitempty"`
+}
+
+// UpstreamFileServer configures the file server of a file upstream.
+type UpstreamFileServer struct {
+	// IndexFallback serves the index.html of the root directory for the
+	// GET and HEAD requests of paths that don't exist and don't have a file
+	// extension, so that the client-side routes of single-page apps can be
+	// loaded directly. Missing assets, such as `/app.js`, are still not
+	// found.
+	IndexFallback bool `json:"indexFallback,omitempty"`
+
+	// DisableDirectoryListing responds to the requests of directories
+	// without an index.html with a 404, instead of listing their files.
+	DisableDirectoryListing bool `json:"disableDirectoryListing,omitempty"`
+
+	// CacheControl is the Cache-Control header of the files, other than
+	// the index.html files.
+	// Eg: `public, max-age=31536000, immutable` for assets whose names
+	// change with their content.
+	CacheControl string `json:"cacheControl,omitempty"`
+
+	// IndexCacheControl is the Cache-Control header of the index.html
+	// files, including the index served by the IndexFallback.
+	// Eg: `no-cache`, so that new releases are loaded right away.
+	IndexCacheControl string `json:"indexCacheControl,omitempty"`
+
+	// ETags sends a weak ETag, from the size and modification time of the
+	// files, so that clients can revalidate them with If-None-Match.
+	ETags bool `json:"etags,omitempty"`
+
+	// Precompressed serves the `.br` and `.gz` files next to the files, eg.
+	// `app.js.br` for `app.js`, to the clients that accept the Brotli or
+	// gzip encodings, preferring Brotli.
+	Precompressed bool `json:"precompressed,omitempty"`
+}
+
+// UpstreamCache configures the response cache of an upstream.
+// The caches of the upstreams can be purged with the cache endpoint of the
+// management server.
+// Responses with a Set-Cookie header, with Cache-Control no-store, private or
+// no-cache, or with a Vary header of `*` are never cached, and only the
+// responses with a status that is cacheable by default, such as 200, 301 and
+// 404, are cached. Range requests are never served from the cache.
+// Cache hits, misses and bypassed requests, and the responses evicted to keep
+// the cache within its MaxSize, are reported per upstream ID by the
+// `oauth2_proxy_upstream_cache_requests_total` and
+// `oauth2_proxy_upstream_cache_evictions_total` metrics.
+type UpstreamCache struct {
+	// Store is where the responses are cached: `memory`, or `redis` to
+	// share them between the instances of OAuth2 Proxy. The redis store
+	// connects to the Redis server of the redis session store options.
+	// Defaults to `memory`.
+	Store string `json:"store,omitempty"`
+
+	// TTL is how long responses are served from the cache.
+	// Responses with a shorter s-maxage or max-age in their Cache-Control
+	// header are only cached for that long.
+	// Defaults to 1 minute.
+	TTL *Duration `json:"ttl,omitempty"`
+
+	// MaxEntrySize is the largest response body, in bytes, that is cached.
+	// Defaults to 1MiB.
+	MaxEntrySize int64 `json:"maxEntrySize,omitempty"`
+
+	// MaxSize is the maximum total size, in bytes, of the cached response
+	// bodies. The least recently used responses are evicted to make room
+	// for new responses. Only applies to the memory store, Redis evicts
+	// responses according to its own maxmemory policy.
+	// Defaults to 64MiB.
+	MaxSize int64 `json:"maxSize,omitempty"`
+
+	// VaryOnUser caches responses separately for each user, for upstreams
+	// whose responses depend on the identity headers they are sent.
+	// Defaults to false, responses are shared by all users.
+	VaryOnUser bool `json:"varyOnUser,omitempty"`
+
+	// AllowAuthorization allows the responses to requests with an
+	// Authorization header, including those injected from the session,
+	// to be cached.
+	// Defaults to false, requests with an Authorization header bypass the
+	// cache.
+	AllowAuthorization bool `json:"allowAuthorization,omitempty"`
+
+	// BypassHeader is the name of a request header, such as
+	// X-Cache-Bypass, with which requests are always sent to the upstream.
+	// Their response replaces the cached response, so that it can be
+	// refreshed before it expires.
+	// Defaults to empty, no header bypasses the cache.
+	BypassHeader string `json:"bypassHeader,omitempty"`
+}
+
+// UpstreamResponseRewrite configures how the absolute URLs of an upstream
+// server are rewritten in its responses.
+// The URI of the upstream is replaced with the ExternalURL at the start of the
+// Location and Content-Location response headers.
+type UpstreamResponseRewrite struct {
+	// ExternalURL is the URL the upstream URI is replaced with.
+	// Defaults to the scheme and host of the request.
+	ExternalURL string `json:"externalURL,omitempty"`
+
+	// BodyReplacements are find-and-replace pairs applied to text/html and
+	// application/json response bodies as they are streamed.
+	// At each position of the body, the first pair whose find matches is
+	// replaced.
+	// The upstream is only asked for gzip or uncompressed bodies, without the
+	// Range of the request. Gzip encoded bodies are decompressed and
+	// compressed again, bodies in other encodings, such as brotli or zstd,
+	// are sent unchanged.
+	// Rewritten bodies are sent chunked, without a Content-Length or
+	// Accept-Ranges, and with a weak ETag.
+	BodyReplacements []BodyReplacement `json:"bodyReplacements,omitempty"`
+
+	// IdentityEncoding requests uncompressed responses from the upstream when
+	// rewriting bodies, rather than decompressing and compressing again gzip
+	// encoded responses.
+	IdentityEncoding bool `json:"identityEncoding,omitempty"`
+}
+
+// BodyReplacement replaces each occurrence of Find in a response body with
+// Replace.
+type BodyReplacement struct {
+	// Find is the text to replace.
+	Find string `json:"find,omitempty"`
+
+	// Replace is the text Find is replaced with.
+	Replace string `json:"replace,omitempty"`
 }
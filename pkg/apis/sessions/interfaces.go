@@ -14,6 +14,83 @@ type SessionStore interface {
 	Clear(rw http.ResponseWriter, req *http.Request) error
 }
 
+// SessionCache is implemented by SessionStores that cache the sessions they
+// load in memory, so that they can still be served while the store is
+// unavailable.
+type SessionCache interface {
+	// LoadCached returns the session last loaded for the request's session
+	// cookie, or nil if it isn't cached.
+	LoadCached(req *http.Request) *SessionState
+}
+
+// UserSessionCounter is implemented by SessionStores that track the sessions
+// of each user.
+type UserSessionCounter interface {
+	// CountUserSessions returns the number of sessions the user of the
+	// session currently has in the store.
+	CountUserSessions(ctx context.Context, s *SessionState) (int, error)
+}
+
+// ProviderSessionRevoker is implemented by SessionStores that index sessions
+// by the provider session they were logged in with, so that they can be
+// signed out by the provider with back-channel logout.
+type ProviderSessionRevoker interface {
+	// ClearProviderSessions removes the sessions logged in with the provider
+	// session of the issuer with the session ID, or all sessions of the
+	// subject when there is no session ID, returning how many were removed.
+	ClearProviderSessions(ctx context.Context, issuer, subject, sessionID string) (int, error)
+}
+
+// SessionInventory is implemented by SessionStores that keep an inventory of
+// the users of their sessions, so that administrators can list and revoke
+// them.
+type SessionInventory interface {
+	// ListSessions returns the records of the sessions currently in the
+	// store, from the oldest session to the newest.
+	ListSessions(ctx context.Context) ([]SessionRecord, error)
+	// RevokeSession removes the session with the ID of its record, returning
+	// ErrSessionNotFound when the store has no such session.
+	RevokeSession(ctx context.Context, id string) error
+}
+
+// SessionRecord is the record of a stored session in a SessionInventory.
+// It identifies the user of the session, but never holds its tokens.
+type SessionRecord struct {
+	ID                string     `json:"id"`
+	User              string     `json:"user,omitempty"`
+	Email             string     `json:"email,omitempty"`
+	PreferredUsername string     `json:"preferredUsername,omitempty"`
+	Groups            []string   `json:"groups,omitempty"`
+	Provider          string     `json:"provider,omitempty"`
+	CreatedAt         *time.Time `json:"createdAt,omitempty"`
+
+	// ExpiresOn is when the session expires from the store, unless it is
+	// refreshed before
+	ExpiresOn *time.Time `json:"expiresOn,omitempty"`
+}
+
+// ErrSessionNotFound is returned by SessionInventories revoking a session
+// that isn't in the store.
+var ErrSessionNotFound = errors.New("the session was not found")
+
+// ErrTooManySessions is returned by SessionStores refusing to save a new
+// session as its user already has the maximum number of concurrent sessions.
+var ErrTooManySessions = errors.New("the user has too many concurrent sessions")
+
+// StoreUnavailableError is returned by SessionStores when the session storage
+// could not be reached, as opposed to the session not being found.
+type StoreUnavailableError struct {
+	Err error
+}
+
+func (e *StoreUnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StoreUnavailableError) Unwrap() error {
+	return e.Err
+}
+
 var ErrLockNotObtained = errors.New("lock: not obtained")
 var ErrNotLocked = errors.New("tried to release not existing lock")
 
@@ -19,22 +19,63 @@ type SessionState struct {
 	CreatedAt *time.Time `msgpack:"ca,omitempty"`
 	ExpiresOn *time.Time `msgpack:"eo,omitempty"`
 
+	// AuthTime is when the user last authenticated with the provider, from
+	// the auth_time claim of the ID token or otherwise the time of the login
+	AuthTime *time.Time `msgpack:"au,omitempty"`
+
 	AccessToken  string `msgpack:"at,omitempty"`
 	IDToken      string `msgpack:"it,omitempty"`
 	RefreshToken string `msgpack:"rt,omitempty"`
 
 	Nonce []byte `msgpack:"n,omitempty"`
 
+	// DeviceAuthorization indicates that the session was created by a device
+	// authorization, whose ID token has no nonce claim to check against the
+	// Nonce
+	DeviceAuthorization bool `msgpack:"da,omitempty"`
+
 	Email             string   `msgpack:"e,omitempty"`
 	User              string   `msgpack:"u,omitempty"`
 	Groups            []string `msgpack:"g,omitempty"`
 	PreferredUsername string   `msgpack:"pu,omitempty"`
 
+	// GroupsExpiresOn is when the Groups should be checked against the
+	// provider again, for providers that look memberships up on refresh
+	GroupsExpiresOn *time.Time `msgpack:"gx,omitempty"`
+
+	// AuthProvider is the ID of the provider the session was authenticated
+	// by, or htpasswd for the sessions of the htpasswd login form
+	AuthProvider string `msgpack:"ap,omitempty"`
+
+	// Claims holds the raw claims selected by the session store claims, other
+	// claims are only available from the ID token
+	Claims map[string]interface{} `msgpack:"cl,omitempty"`
+
+	// EnrichedClaims holds the claims from the claim enrichment endpoint,
+	// under the enrichment prefix, fetched at login and on refresh
+	EnrichedClaims map[string]interface{} `msgpack:"ec,omitempty"`
+
+	// BearerToken holds the audiences and scopes of the verified bearer token
+	// the session was created from, it is nil for all other sessions.
+	// Sessions created from bearer tokens are never stored, so it is not
+	// serialized.
+	BearerToken *BearerToken `msgpack:"-"`
+
 	// Internal helpers, not serialized
 	Clock clock.Clock `msgpack:"-"`
 	Lock  Lock        `msgpack:"-"`
 }
 
+// BearerToken describes the verified bearer token a session was created from,
+// for checking it against the requirements of upstreams
+type BearerToken struct {
+	// Audiences are the values of the token's `aud` claim
+	Audiences []string
+
+	// Scopes are the values of the token's `scope` or `scp` claim
+	Scopes []string
+}
+
 func (s *SessionState) ObtainLock(ctx context.Context, expiration time.Duration) error {
 	if s.Lock == nil {
 		s.Lock = &NoOpLock{}
@@ -92,6 +133,17 @@ func (s *SessionState) IsExpired() bool {
 	return false
 }
 
+// LifetimeExpiresOn returns when the session lapses, the lifetime of the
+// session cookie after the session was created or last refreshed.
+// It returns nil when the session has no CreatedAt.
+func (s *SessionState) LifetimeExpiresOn(lifetime time.Duration) *time.Time {
+	if s.CreatedAt == nil || s.CreatedAt.IsZero() {
+		return nil
+	}
+	exp := s.CreatedAt.Add(lifetime)
+	return &exp
+}
+
 // Age returns the age of a session
 func (s *SessionState) Age() time.Duration {
 	if s.CreatedAt != nil && !s.CreatedAt.IsZero() {
@@ -154,6 +206,19 @@ func (s *SessionState) GetClaim(claim string) []string {
 	}
 }
 
+// HasClaim determines whether the claim is one of the fields of the session,
+// which GetClaim returns values for.
+// Other claims may only be found in the session's ID token.
+func (s *SessionState) HasClaim(claim string) bool {
+	switch claim {
+	case "access_token", "id_token", "created_at", "expires_on", "refresh_token",
+		"email", "user", "groups", "preferred_username":
+		return true
+	default:
+		return false
+	}
+}
+
 // CheckNonce compares the Nonce against a potential hash of it
 func (s *SessionState) CheckNonce(hashed string) bool {
 	return encryption.CheckNonce(s.Nonce, hashed)
@@ -177,30 +242,60 @@ func (s *SessionState) EncodeSessionState(c encryption.Cipher, compress bool) ([
 	return c.Encrypt(compressed)
 }
 
-// DecodeSessionState decodes a LZ4 compressed MessagePack into a Session State
+// DecodeError is returned by DecodeSessionState when the data could not be
+// decrypted or decoded, eg. because it was encrypted with a different secret
+// or has been corrupted.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeSessionState decodes a LZ4 compressed MessagePack into a Session State.
+// Any error returned is a *DecodeError.
 func DecodeSessionState(data []byte, c encryption.Cipher, compressed bool) (*SessionState, error) {
 	decrypted, err := c.Decrypt(data)
 	if err != nil {
-		return nil, fmt.Errorf("error decrypting the session state: %w", err)
+		return nil, &DecodeError{Err: fmt.Errorf("error decrypting the session state: %w", err)}
 	}
 
 	packed := decrypted
 	if compressed {
 		packed, err = lz4Decompress(decrypted)
 		if err != nil {
-			return nil, err
+			return nil, &DecodeError{Err: err}
 		}
 	}
 
 	var ss SessionState
 	err = msgpack.Unmarshal(packed, &ss)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling data to session state: %w", err)
+		return nil, &DecodeError{Err: fmt.Errorf("error unmarshalling data to session state: %w", err)}
 	}
 
 	return &ss, nil
 }
 
+// SerializedSize returns the size of the lz4 compressed, MessagePack encoded
+// session, before it is encrypted for storage
+func (s *SessionState) SerializedSize() (int, error) {
+	packed, err := msgpack.Marshal(s)
+	if err != nil {
+		return 0, fmt.Errorf("error marshalling session state to msgpack: %w", err)
+	}
+	compressed, err := lz4Compress(packed)
+	if err != nil {
+		return 0, err
+	}
+	return len(compressed), nil
+}
+
 // lz4Compress compresses with LZ4
 //
 // The Compress:Decompress ratio is 1:Many. LZ4 gives fastest decompress speeds
@@ -146,6 +146,15 @@ func TestIsExpired(t *testing.T) {
 	assert.Equal(t, false, s.IsExpired())
 }
 
+func TestLifetimeExpiresOn(t *testing.T) {
+	ss := &SessionState{}
+	assert.Nil(t, ss.LifetimeExpiresOn(time.Hour))
+
+	createdAt := time.Now().Add(-10 * time.Minute)
+	ss.CreatedAt = &createdAt
+	assert.Equal(t, createdAt.Add(time.Hour), *ss.LifetimeExpiresOn(time.Hour))
+}
+
 func TestAge(t *testing.T) {
 	ss := &SessionState{}
 
@@ -11,11 +11,17 @@ import (
 
 // errorMessages are default error messages for each of the different
 // http status codes expected to be rendered in the error page.
+// maxProviderErrorLength is the maximum length of the error and description
+// returned by the identity provider when rendered in the error page.
+const maxProviderErrorLength = 512
+
 var errorMessages = map[int]string{
-	http.StatusInternalServerError: "Oops! Something went wrong. For more information contact your server administrator.",
-	http.StatusNotFound:            "We could not find the resource you were looking for.",
-	http.StatusForbidden:           "You do not have permission to access this resource.",
-	http.StatusUnauthorized:        "You need to be logged in to access this resource.",
+	http.StatusInternalServerError:         "Oops! Something went wrong. For more information contact your server administrator.",
+	http.StatusNotFound:                    "We could not find the resource you were looking for.",
+	http.StatusForbidden:                   "You do not have permission to access this resource.",
+	http.StatusUnauthorized:                "You need to be logged in to access this resource.",
+	http.StatusTooManyRequests:             "Too many requests, please try again later.",
+	http.StatusRequestHeaderFieldsTooLarge: "Your browser sent too many or too large cookies. Clear the cookies for this site and try again.",
 }
 
 // errorPageWriter is used to render error pages.
@@ -36,6 +42,14 @@ type errorPageWriter struct {
 	// debug determines whether errors pages should be rendered with detailed
 	// errors.
 	debug bool
+
+	// problemJSON determines whether errors are always written as
+	// application/problem+json, regardless of the Accept header.
+	problemJSON bool
+
+	// hideProviderErrorDescription determines whether the error description
+	// returned by the identity provider is omitted from error pages.
+	hideProviderErrorDescription bool
 }
 
 // ErrorPageOpts bundles up all the content needed to write the Error Page
@@ -50,34 +64,62 @@ type ErrorPageOpts struct {
 	AppError string
 	// Generic error messages shown in non-debug mode
 	Messages []interface{}
+	// The Accept header of the request, used to choose between an HTML page
+	// and JSON problem details
+	Accept string
+	// The error returned by the identity provider, if any
+	ProviderError string
+	// The description of the error returned by the identity provider
+	ProviderErrorDescription string
+	// URL for the "Try again" button, restarting the sign in
+	RetryURL string
+	// URL for the "Clear cookies" button, clearing all OAuth2 Proxy cookies
+	ClearCookiesURL string
 }
 
 // WriteErrorPage writes an error page to the given response writer.
 // It uses the passed redirectURL to give users the option to go back to where
 // they originally came from or try signing in again.
+// The error is written as JSON problem details instead when the JSON mode is
+// enabled or the request prefers JSON.
 func (e *errorPageWriter) WriteErrorPage(rw http.ResponseWriter, opts ErrorPageOpts) {
+	if e.problemJSON || prefersJSON(opts.Accept) {
+		e.writeProblem(rw, opts)
+		return
+	}
+
 	rw.WriteHeader(opts.Status)
 
+	providerError, providerErrorDescription := e.getProviderError(opts)
+
 	// We allow unescaped template.HTML since it is user configured options
 	/* #nosec G203 */
 	data := struct {
-		Title       string
-		Message     string
-		ProxyPrefix string
-		StatusCode  int
-		Redirect    string
-		RequestID   string
-		Footer      template.HTML
-		Version     string
+		Title                    string
+		Message                  string
+		ProxyPrefix              string
+		StatusCode               int
+		Redirect                 string
+		RequestID                string
+		ProviderError            string
+		ProviderErrorDescription string
+		RetryURL                 string
+		ClearCookiesURL          string
+		Footer                   template.HTML
+		Version                  string
 	}{
-		Title:       http.StatusText(opts.Status),
-		Message:     e.getMessage(opts.Status, opts.AppError, opts.Messages...),
-		ProxyPrefix: e.proxyPrefix,
-		StatusCode:  opts.Status,
-		Redirect:    opts.RedirectURL,
-		RequestID:   opts.RequestID,
-		Footer:      template.HTML(e.footer),
-		Version:     e.version,
+		Title:                    http.StatusText(opts.Status),
+		Message:                  e.getMessage(opts.Status, opts.AppError, opts.Messages...),
+		ProxyPrefix:              e.proxyPrefix,
+		StatusCode:               opts.Status,
+		Redirect:                 opts.RedirectURL,
+		RequestID:                opts.RequestID,
+		ProviderError:            providerError,
+		ProviderErrorDescription: providerErrorDescription,
+		RetryURL:                 opts.RetryURL,
+		ClearCookiesURL:          opts.ClearCookiesURL,
+		Footer:                   template.HTML(e.footer),
+		Version:                  e.version,
 	}
 
 	if err := e.template.Execute(rw, data); err != nil {
@@ -98,6 +140,7 @@ func (e *errorPageWriter) ProxyErrorHandler(rw http.ResponseWriter, req *http.Re
 		RequestID:   scope.RequestID,
 		AppError:    proxyErr.Error(),
 		Messages:    []interface{}{"There was a problem connecting to the upstream server."},
+		Accept:      req.Header.Get("Accept"),
 	})
 }
 
@@ -119,3 +162,27 @@ func (e *errorPageWriter) getMessage(status int, appError string, messages ...in
 	}
 	return "Unknown error"
 }
+
+// getProviderError returns the error and description returned by the identity
+// provider, limited in length for display.
+// The description is omitted when it should be hidden.
+func (e *errorPageWriter) getProviderError(opts ErrorPageOpts) (string, string) {
+	if opts.ProviderError == "" {
+		return "", ""
+	}
+	description := opts.ProviderErrorDescription
+	if e.hideProviderErrorDescription {
+		description = ""
+	}
+	return truncate(opts.ProviderError, maxProviderErrorLength), truncate(description, maxProviderErrorLength)
+}
+
+// truncate shortens the string to at most max characters, marking that it was
+// shortened with an ellipsis
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-3]) + "..."
+}
@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http/httptest"
+	"strings"
 
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	. "github.com/onsi/ginkgo"
@@ -103,6 +104,56 @@ var _ = Describe("Error Page Writer", func() {
 		})
 	})
 
+	Context("With a provider error", func() {
+		BeforeEach(func() {
+			tmpl, err := template.New("").Parse("{{.ProviderError}} | {{.ProviderErrorDescription}} | {{.RetryURL}}")
+			Expect(err).ToNot(HaveOccurred())
+			errorPage.template = tmpl
+		})
+
+		It("Writes the provider error, description and retry URL", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:                   403,
+				ProviderError:            "access_denied",
+				ProviderErrorDescription: "<b>Email domain is not allowed</b>",
+				RetryURL:                 "/prefix/start?rd=%2Ffoo",
+			})
+
+			body, err := ioutil.ReadAll(recorder.Result().Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("access_denied | &lt;b&gt;Email domain is not allowed&lt;/b&gt; | /prefix/start?rd=%2Ffoo"))
+		})
+
+		It("Truncates long provider errors", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:                   403,
+				ProviderError:            "access_denied",
+				ProviderErrorDescription: strings.Repeat("a", maxProviderErrorLength+1),
+			})
+
+			body, err := ioutil.ReadAll(recorder.Result().Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("access_denied | " + strings.Repeat("a", maxProviderErrorLength-3) + "... | "))
+		})
+
+		It("Omits the description when it is hidden", func() {
+			errorPage.hideProviderErrorDescription = true
+
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:                   403,
+				ProviderError:            "access_denied",
+				ProviderErrorDescription: "Email domain is not allowed",
+			})
+
+			body, err := ioutil.ReadAll(recorder.Result().Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("access_denied |  | "))
+		})
+	})
+
 	Context("With Debug enabled", func() {
 		BeforeEach(func() {
 			tmpl, err := template.New("").Parse("{{.Message}}")
@@ -0,0 +1,85 @@
+package pagewriter
+
+import (
+	"html/template"
+	"net/http"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// maintenanceMessage is the message of the maintenance page
+const maintenanceMessage = "This service is down for maintenance. Please try again later."
+
+// maintenancePageWriter is used to render the maintenance page.
+type maintenancePageWriter struct {
+	// template is the maintenance page HTML template.
+	template *template.Template
+
+	// errorPageWriter is used to write the maintenance page as JSON problem details.
+	errorPageWriter *errorPageWriter
+
+	// proxyPrefix is the prefix under which OAuth2 Proxy pages are served.
+	proxyPrefix string
+
+	// footer is the footer to be displayed at the bottom of the page.
+	// If not set, a default footer will be used.
+	footer string
+
+	// version is the OAuth2 Proxy version to be used in the default footer.
+	version string
+
+	// logoData is the logo to render in the template.
+	// This should contain valid html.
+	logoData string
+}
+
+// WriteMaintenancePage writes the maintenance page, with a 503 status, to the
+// given response writer.
+// It is written as JSON problem details instead when the JSON mode is enabled
+// or the request prefers JSON.
+func (m *maintenancePageWriter) WriteMaintenancePage(rw http.ResponseWriter, req *http.Request) {
+	scope := middlewareapi.GetRequestScope(req)
+	var requestID string
+	if scope != nil {
+		requestID = scope.RequestID
+	}
+
+	if m.errorPageWriter.problemJSON || prefersJSON(req.Header.Get("Accept")) {
+		m.errorPageWriter.writeProblem(rw, ErrorPageOpts{
+			Status:    http.StatusServiceUnavailable,
+			RequestID: requestID,
+			AppError:  maintenanceMessage,
+			Messages:  []interface{}{maintenanceMessage},
+		})
+		return
+	}
+
+	// We allow unescaped template.HTML since it is user configured options
+	/* #nosec G203 */
+	t := struct {
+		Title       string
+		Message     string
+		StatusCode  int
+		RequestID   string
+		ProxyPrefix string
+		Footer      template.HTML
+		Version     string
+		LogoData    template.HTML
+	}{
+		Title:       http.StatusText(http.StatusServiceUnavailable),
+		Message:     maintenanceMessage,
+		StatusCode:  http.StatusServiceUnavailable,
+		RequestID:   requestID,
+		ProxyPrefix: m.proxyPrefix,
+		Footer:      template.HTML(m.footer),
+		Version:     m.version,
+		LogoData:    template.HTML(m.logoData),
+	}
+
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	if err := m.template.Execute(rw, t); err != nil {
+		logger.Printf("Error rendering maintenance template: %v", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,64 @@
+package pagewriter
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Maintenance Page", func() {
+	var request *http.Request
+	var maintenancePage *maintenancePageWriter
+
+	BeforeEach(func() {
+		tmpl, err := template.New("").Parse("{{.ProxyPrefix}} {{.StatusCode}} {{.Title}} {{.Message}} {{.RequestID}} {{.Footer}} {{.Version}} {{.LogoData}}")
+		Expect(err).ToNot(HaveOccurred())
+
+		maintenancePage = &maintenancePageWriter{
+			template:        tmpl,
+			errorPageWriter: &errorPageWriter{},
+			proxyPrefix:     "/prefix/",
+			footer:          "Custom Footer Text",
+			version:         "v0.0.0-test",
+			logoData:        "Logo Data",
+		}
+
+		request = httptest.NewRequest("", "http://127.0.0.1/", nil)
+		request = middlewareapi.AddRequestScope(request, &middlewareapi.RequestScope{
+			RequestID: testRequestID,
+		})
+	})
+
+	It("Writes the template to the response writer", func() {
+		recorder := httptest.NewRecorder()
+		maintenancePage.WriteMaintenancePage(recorder, request)
+
+		Expect(recorder.Result().StatusCode).To(Equal(http.StatusServiceUnavailable))
+		body, err := ioutil.ReadAll(recorder.Result().Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal("/prefix/ 503 Service Unavailable This service is down for maintenance. Please try again later. " + testRequestID + " Custom Footer Text v0.0.0-test Logo Data"))
+	})
+
+	It("Writes problem details when the request prefers JSON", func() {
+		request.Header.Set("Accept", "application/json")
+		recorder := httptest.NewRecorder()
+		maintenancePage.WriteMaintenancePage(recorder, request)
+
+		Expect(recorder.Result().StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(recorder.Result().Header.Get("Content-Type")).To(Equal(problemContentType))
+		body, err := ioutil.ReadAll(recorder.Result().Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(MatchJSON(`{
+			"type": "about:blank",
+			"title": "Service Unavailable",
+			"status": 503,
+			"detail": "This service is down for maintenance. Please try again later.",
+			"requestId": "` + testRequestID + `"
+		}`))
+	})
+})
@@ -5,13 +5,15 @@ import (
 	"net/http"
 )
 
-// Writer is an interface for rendering html templates for both sign-in and
-// error pages.
+// Writer is an interface for rendering html templates for the sign-in,
+// sign-out, maintenance and error pages.
 // It can also be used to write errors for the http.ReverseProxy used in the
 // upstream package.
 type Writer interface {
-	WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int)
+	WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int, csrfToken string)
+	WriteSignOutPage(rw http.ResponseWriter, req *http.Request, opts SignOutPageOpts)
 	WriteErrorPage(rw http.ResponseWriter, opts ErrorPageOpts)
+	WriteMaintenancePage(rw http.ResponseWriter, req *http.Request)
 	ProxyErrorHandler(rw http.ResponseWriter, req *http.Request, proxyErr error)
 	WriteRobotsTxt(rw http.ResponseWriter, req *http.Request)
 }
@@ -20,13 +22,15 @@ type Writer interface {
 type pageWriter struct {
 	*errorPageWriter
 	*signInPageWriter
+	*signOutPageWriter
+	*maintenancePageWriter
 	*staticPageWriter
 }
 
 // Opts contains all options required to configure the template
 // rendering within OAuth2 Proxy.
 type Opts struct {
-	// TemplatesPath is the path from which to load custom templates for the sign-in and error pages.
+	// TemplatesPath is the path from which to load custom templates for the sign-in, sign-out, maintenance and error pages.
 	TemplatesPath string
 
 	// ProxyPrefix is the prefix under which OAuth2 Proxy pages are served.
@@ -43,12 +47,29 @@ type Opts struct {
 	// errors.
 	Debug bool
 
+	// ProblemJSON determines whether errors are always written as RFC 7807
+	// application/problem+json rather than only when the request prefers JSON.
+	ProblemJSON bool
+
+	// HideProviderErrorDescription determines whether the error description
+	// returned by the identity provider is omitted from error pages.
+	HideProviderErrorDescription bool
+
 	// DisplayLoginForm determines whether or not the basic auth password form is displayed on the sign-in page.
 	DisplayLoginForm bool
 
+	// ProviderUnavailable, when set, reports whether the provider is
+	// unavailable. The basic auth password form is then displayed as the
+	// fallback, with a notice, even if DisplayLoginForm is false.
+	ProviderUnavailable func() bool
+
 	// ProviderName is the name of the provider that should be displayed on the login button.
 	ProviderName string
 
+	// SignInProviders are the providers users can choose to sign in with,
+	// each with a login button, in place of the button of the ProviderName.
+	SignInProviders []SignInProvider
+
 	// SignInMessage is the messge displayed above the login button.
 	SignInMessage string
 
@@ -72,23 +93,45 @@ func NewWriter(opts Opts) (Writer, error) {
 	}
 
 	errorPage := &errorPageWriter{
-		template:    templates.Lookup("error.html"),
-		proxyPrefix: opts.ProxyPrefix,
-		footer:      opts.Footer,
-		version:     opts.Version,
-		debug:       opts.Debug,
+		template:                     templates.Lookup("error.html"),
+		proxyPrefix:                  opts.ProxyPrefix,
+		footer:                       opts.Footer,
+		version:                      opts.Version,
+		debug:                        opts.Debug,
+		problemJSON:                  opts.ProblemJSON,
+		hideProviderErrorDescription: opts.HideProviderErrorDescription,
 	}
 
 	signInPage := &signInPageWriter{
-		template:         templates.Lookup("sign_in.html"),
-		errorPageWriter:  errorPage,
-		proxyPrefix:      opts.ProxyPrefix,
-		providerName:     opts.ProviderName,
-		signInMessage:    opts.SignInMessage,
-		footer:           opts.Footer,
-		version:          opts.Version,
-		displayLoginForm: opts.DisplayLoginForm,
-		logoData:         logoData,
+		template:            templates.Lookup("sign_in.html"),
+		errorPageWriter:     errorPage,
+		proxyPrefix:         opts.ProxyPrefix,
+		providerName:        opts.ProviderName,
+		providers:           opts.SignInProviders,
+		signInMessage:       opts.SignInMessage,
+		footer:              opts.Footer,
+		version:             opts.Version,
+		displayLoginForm:    opts.DisplayLoginForm,
+		providerUnavailable: opts.ProviderUnavailable,
+		logoData:            logoData,
+	}
+
+	signOutPage := &signOutPageWriter{
+		template:        templates.Lookup("sign_out.html"),
+		errorPageWriter: errorPage,
+		proxyPrefix:     opts.ProxyPrefix,
+		footer:          opts.Footer,
+		version:         opts.Version,
+		logoData:        logoData,
+	}
+
+	maintenancePage := &maintenancePageWriter{
+		template:        templates.Lookup("maintenance.html"),
+		errorPageWriter: errorPage,
+		proxyPrefix:     opts.ProxyPrefix,
+		footer:          opts.Footer,
+		version:         opts.Version,
+		logoData:        logoData,
 	}
 
 	staticPages, err := newStaticPageWriter(opts.TemplatesPath, errorPage)
@@ -97,9 +140,11 @@ func NewWriter(opts Opts) (Writer, error) {
 	}
 
 	return &pageWriter{
-		errorPageWriter:  errorPage,
-		signInPageWriter: signInPage,
-		staticPageWriter: staticPages,
+		errorPageWriter:       errorPage,
+		signInPageWriter:      signInPage,
+		signOutPageWriter:     signOutPage,
+		maintenancePageWriter: maintenancePage,
+		staticPageWriter:      staticPages,
 	}, nil
 }
 
@@ -108,18 +153,20 @@ func NewWriter(opts Opts) (Writer, error) {
 // If any of the funcs are not provided, a default implementation will be used.
 // This is primarily for us in testing.
 type WriterFuncs struct {
-	SignInPageFunc func(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int)
-	ErrorPageFunc  func(rw http.ResponseWriter, opts ErrorPageOpts)
-	ProxyErrorFunc func(rw http.ResponseWriter, req *http.Request, proxyErr error)
-	RobotsTxtfunc  func(rw http.ResponseWriter, req *http.Request)
+	SignInPageFunc      func(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int, csrfToken string)
+	SignOutPageFunc     func(rw http.ResponseWriter, req *http.Request, opts SignOutPageOpts)
+	ErrorPageFunc       func(rw http.ResponseWriter, opts ErrorPageOpts)
+	MaintenancePageFunc func(rw http.ResponseWriter, req *http.Request)
+	ProxyErrorFunc      func(rw http.ResponseWriter, req *http.Request, proxyErr error)
+	RobotsTxtfunc       func(rw http.ResponseWriter, req *http.Request)
 }
 
 // WriteSignInPage implements the Writer interface.
 // If the SignInPageFunc is provided, this will be used, else a default
 // implementation will be used.
-func (w *WriterFuncs) WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int) {
+func (w *WriterFuncs) WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int, csrfToken string) {
 	if w.SignInPageFunc != nil {
-		w.SignInPageFunc(rw, req, redirectURL, statusCode)
+		w.SignInPageFunc(rw, req, redirectURL, statusCode, csrfToken)
 		return
 	}
 
@@ -128,6 +175,20 @@ func (w *WriterFuncs) WriteSignInPage(rw http.ResponseWriter, req *http.Request,
 	}
 }
 
+// WriteSignOutPage implements the Writer interface.
+// If the SignOutPageFunc is provided, this will be used, else a default
+// implementation will be used.
+func (w *WriterFuncs) WriteSignOutPage(rw http.ResponseWriter, req *http.Request, opts SignOutPageOpts) {
+	if w.SignOutPageFunc != nil {
+		w.SignOutPageFunc(rw, req, opts)
+		return
+	}
+
+	if _, err := rw.Write([]byte("Sign Out")); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 // WriteErrorPage implements the Writer interface.
 // If the ErrorPageFunc is provided, this will be used, else a default
 // implementation will be used.
@@ -144,6 +205,21 @@ func (w *WriterFuncs) WriteErrorPage(rw http.ResponseWriter, opts ErrorPageOpts)
 	}
 }
 
+// WriteMaintenancePage implements the Writer interface.
+// If the MaintenancePageFunc is provided, this will be used, else a default
+// implementation will be used.
+func (w *WriterFuncs) WriteMaintenancePage(rw http.ResponseWriter, req *http.Request) {
+	if w.MaintenancePageFunc != nil {
+		w.MaintenancePageFunc(rw, req)
+		return
+	}
+
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := rw.Write([]byte("Maintenance")); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 // ProxyErrorHandler implements the Writer interface.
 // If the ProxyErrorFunc is provided, this will be used, else a default
 // implementation will be used.
@@ -57,12 +57,39 @@ var _ = Describe("Writer", func() {
 
 			It("Writes the default sign in template", func() {
 				recorder := httptest.NewRecorder()
-				writer.WriteSignInPage(recorder, request, "/redirect", http.StatusOK)
+				writer.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "<csrfToken>")
 
 				body, err := ioutil.ReadAll(recorder.Result().Body)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(string(body)).To(HavePrefix("\n<!DOCTYPE html>"))
 			})
+
+			It("Writes the default sign out template", func() {
+				recorder := httptest.NewRecorder()
+				writer.WriteSignOutPage(recorder, request, SignOutPageOpts{
+					RedirectURL: "/redirect",
+					Email:       "user@example.com",
+					CSRFToken:   "<csrfToken>",
+				})
+
+				body, err := ioutil.ReadAll(recorder.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(HavePrefix("\n<!DOCTYPE html>"))
+				Expect(string(body)).To(ContainSubstring(`<form method="POST" action="/prefix/sign_out" class="block">`))
+				Expect(string(body)).To(ContainSubstring(`<input type="hidden" name="csrf_token" value="&lt;csrfToken&gt;">`))
+				Expect(string(body)).To(ContainSubstring("user@example.com"))
+			})
+
+			It("Writes the default maintenance template", func() {
+				recorder := httptest.NewRecorder()
+				writer.WriteMaintenancePage(recorder, request)
+
+				Expect(recorder.Result().StatusCode).To(Equal(http.StatusServiceUnavailable))
+				body, err := ioutil.ReadAll(recorder.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(HavePrefix("\n<!DOCTYPE html>"))
+				Expect(string(body)).To(ContainSubstring("This service is down for maintenance."))
+			})
 		})
 
 		Context("With custom templates", func() {
@@ -76,8 +103,12 @@ var _ = Describe("Writer", func() {
 				templateHTML := `Custom Template`
 				signInFile := filepath.Join(customDir, signInTemplateName)
 				Expect(ioutil.WriteFile(signInFile, []byte(templateHTML), 0600)).To(Succeed())
+				signOutFile := filepath.Join(customDir, signOutTemplateName)
+				Expect(ioutil.WriteFile(signOutFile, []byte(templateHTML), 0600)).To(Succeed())
 				errorFile := filepath.Join(customDir, errorTemplateName)
 				Expect(ioutil.WriteFile(errorFile, []byte(templateHTML), 0600)).To(Succeed())
+				maintenanceFile := filepath.Join(customDir, maintenanceTemplateName)
+				Expect(ioutil.WriteFile(maintenanceFile, []byte(templateHTML), 0600)).To(Succeed())
 
 				opts.TemplatesPath = customDir
 
@@ -104,12 +135,31 @@ var _ = Describe("Writer", func() {
 
 			It("Writes the custom sign in template", func() {
 				recorder := httptest.NewRecorder()
-				writer.WriteSignInPage(recorder, request, "/redirect", http.StatusOK)
+				writer.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "<csrfToken>")
+
+				body, err := ioutil.ReadAll(recorder.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal("Custom Template"))
+			})
+
+			It("Writes the custom sign out template", func() {
+				recorder := httptest.NewRecorder()
+				writer.WriteSignOutPage(recorder, request, SignOutPageOpts{RedirectURL: "/redirect"})
 
 				body, err := ioutil.ReadAll(recorder.Result().Body)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(string(body)).To(Equal("Custom Template"))
 			})
+
+			It("Writes the custom maintenance template", func() {
+				recorder := httptest.NewRecorder()
+				writer.WriteMaintenancePage(recorder, request)
+
+				Expect(recorder.Result().StatusCode).To(Equal(http.StatusServiceUnavailable))
+				body, err := ioutil.ReadAll(recorder.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal("Custom Template"))
+			})
 		})
 
 		Context("With an invalid custom template", func() {
@@ -151,7 +201,7 @@ var _ = Describe("Writer", func() {
 				rw := httptest.NewRecorder()
 				req := httptest.NewRequest("", "/sign-in", nil)
 				redirectURL := "<redirectURL>"
-				in.writer.WriteSignInPage(rw, req, redirectURL, http.StatusOK)
+				in.writer.WriteSignInPage(rw, req, redirectURL, http.StatusOK, "<csrfToken>")
 
 				Expect(rw.Result().StatusCode).To(Equal(in.expectedStatus))
 
@@ -166,13 +216,45 @@ var _ = Describe("Writer", func() {
 			}),
 			Entry("With an override function", writerFuncsTableInput{
 				writer: &WriterFuncs{
-					SignInPageFunc: func(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int) {
+					SignInPageFunc: func(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int, csrfToken string) {
+						rw.WriteHeader(202)
+						rw.Write([]byte(fmt.Sprintf("%s %s %s", req.URL.Path, redirectURL, csrfToken)))
+					},
+				},
+				expectedStatus: 202,
+				expectedBody:   "/sign-in <redirectURL> <csrfToken>",
+			}),
+		)
+
+		DescribeTable("WriteSignOutPage",
+			func(in writerFuncsTableInput) {
+				rw := httptest.NewRecorder()
+				req := httptest.NewRequest("", "/sign-out", nil)
+				in.writer.WriteSignOutPage(rw, req, SignOutPageOpts{
+					RedirectURL: "<redirectURL>",
+					Email:       "<email>",
+				})
+
+				Expect(rw.Result().StatusCode).To(Equal(in.expectedStatus))
+
+				body, err := ioutil.ReadAll(rw.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(in.expectedBody))
+			},
+			Entry("With no override", writerFuncsTableInput{
+				writer:         &WriterFuncs{},
+				expectedStatus: 200,
+				expectedBody:   "Sign Out",
+			}),
+			Entry("With an override function", writerFuncsTableInput{
+				writer: &WriterFuncs{
+					SignOutPageFunc: func(rw http.ResponseWriter, req *http.Request, opts SignOutPageOpts) {
 						rw.WriteHeader(202)
-						rw.Write([]byte(fmt.Sprintf("%s %s", req.URL.Path, redirectURL)))
+						rw.Write([]byte(fmt.Sprintf("%s %s %s", req.URL.Path, opts.RedirectURL, opts.Email)))
 					},
 				},
 				expectedStatus: 202,
-				expectedBody:   "/sign-in <redirectURL>",
+				expectedBody:   "/sign-out <redirectURL> <email>",
 			}),
 		)
 
@@ -209,6 +291,35 @@ var _ = Describe("Writer", func() {
 			}),
 		)
 
+		DescribeTable("WriteMaintenancePage",
+			func(in writerFuncsTableInput) {
+				rw := httptest.NewRecorder()
+				req := httptest.NewRequest("", "/app", nil)
+				in.writer.WriteMaintenancePage(rw, req)
+
+				Expect(rw.Result().StatusCode).To(Equal(in.expectedStatus))
+
+				body, err := ioutil.ReadAll(rw.Result().Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(in.expectedBody))
+			},
+			Entry("With no override", writerFuncsTableInput{
+				writer:         &WriterFuncs{},
+				expectedStatus: 503,
+				expectedBody:   "Maintenance",
+			}),
+			Entry("With an override function", writerFuncsTableInput{
+				writer: &WriterFuncs{
+					MaintenancePageFunc: func(rw http.ResponseWriter, req *http.Request) {
+						rw.WriteHeader(202)
+						rw.Write([]byte(req.URL.Path))
+					},
+				},
+				expectedStatus: 202,
+				expectedBody:   "/app",
+			}),
+		)
+
 		DescribeTable("ProxyErrorHandler",
 			func(in writerFuncsTableInput) {
 				rw := httptest.NewRecorder()
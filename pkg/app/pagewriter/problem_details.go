@@ -0,0 +1,96 @@
+package pagewriter
+
+import (
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// problemContentType is the media type of RFC 7807 problem details.
+const problemContentType = "application/problem+json"
+
+// problemDetails is an RFC 7807 problem details object.
+// RequestID, LoginURL, RetryURL, ClearCookiesURL and the provider errors are
+// extension members.
+type problemDetails struct {
+	Type                     string `json:"type"`
+	Title                    string `json:"title"`
+	Status                   int    `json:"status"`
+	Detail                   string `json:"detail,omitempty"`
+	RequestID                string `json:"requestId,omitempty"`
+	LoginURL                 string `json:"loginUrl,omitempty"`
+	RetryURL                 string `json:"retryUrl,omitempty"`
+	ClearCookiesURL          string `json:"clearCookiesUrl,omitempty"`
+	ProviderError            string `json:"providerError,omitempty"`
+	ProviderErrorDescription string `json:"providerErrorDescription,omitempty"`
+}
+
+// writeProblem writes the error as problem details to the given response writer.
+// Unauthorized errors include the URL of the sign-in page, which redirects back
+// to the RedirectURL once signed in.
+func (e *errorPageWriter) writeProblem(rw http.ResponseWriter, opts ErrorPageOpts) {
+	problem := problemDetails{
+		Type:            "about:blank",
+		Title:           http.StatusText(opts.Status),
+		Status:          opts.Status,
+		Detail:          e.getMessage(opts.Status, opts.AppError, opts.Messages...),
+		RequestID:       opts.RequestID,
+		RetryURL:        opts.RetryURL,
+		ClearCookiesURL: opts.ClearCookiesURL,
+	}
+	problem.ProviderError, problem.ProviderErrorDescription = e.getProviderError(opts)
+	if opts.Status == http.StatusUnauthorized {
+		problem.LoginURL = e.proxyPrefix + "/sign_in"
+		if opts.RedirectURL != "" {
+			problem.LoginURL += "?rd=" + url.QueryEscape(opts.RedirectURL)
+		}
+	}
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		logger.Printf("Error encoding problem details: %v", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", problemContentType)
+	rw.WriteHeader(opts.Status)
+	if _, err := rw.Write(body); err != nil {
+		logger.Printf("Error writing problem details: %v", err)
+	}
+}
+
+// prefersJSON determines whether the Accept header ranks a JSON media type
+// above HTML.
+// Wildcards are not counted for either, so that HTML remains the default.
+func prefersJSON(accept string) bool {
+	var jsonQuality, htmlQuality float64
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/json", problemContentType:
+			jsonQuality = math.Max(jsonQuality, quality)
+		case "text/html", "application/xhtml+xml":
+			htmlQuality = math.Max(htmlQuality, quality)
+		}
+	}
+	return jsonQuality > htmlQuality
+}
@@ -0,0 +1,180 @@
+package pagewriter
+
+import (
+	"errors"
+	"html/template"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Problem Details", func() {
+	var errorPage *errorPageWriter
+
+	BeforeEach(func() {
+		tmpl, err := template.New("").Parse("{{.Title}} {{.Message}}")
+		Expect(err).ToNot(HaveOccurred())
+
+		errorPage = &errorPageWriter{
+			template:    tmpl,
+			proxyPrefix: "/prefix",
+		}
+	})
+
+	Context("WriteErrorPage", func() {
+		It("Writes problem details when the request prefers JSON", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:      403,
+				RedirectURL: "/redirect",
+				RequestID:   testRequestID,
+				AppError:    "Access Denied",
+				Accept:      "application/json",
+			})
+
+			Expect(recorder.Code).To(Equal(403))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/problem+json"))
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Forbidden",
+				"status": 403,
+				"detail": "You do not have permission to access this resource.",
+				"requestId": "11111111-2222-4333-8444-555555555555"
+			}`))
+		})
+
+		It("Includes the login URL for unauthorized errors", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:      401,
+				RedirectURL: "/redirect?foo=bar",
+				RequestID:   testRequestID,
+				AppError:    "Unauthorized",
+				Accept:      "application/problem+json",
+			})
+
+			Expect(recorder.Code).To(Equal(401))
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Unauthorized",
+				"status": 401,
+				"detail": "You need to be logged in to access this resource.",
+				"requestId": "11111111-2222-4333-8444-555555555555",
+				"loginUrl": "/prefix/sign_in?rd=%2Fredirect%3Ffoo%3Dbar"
+			}`))
+		})
+
+		It("Includes the clear cookies URL for request header fields too large errors", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:          431,
+				RequestID:       testRequestID,
+				AppError:        "request has 200 cookies, more than the limit of 100",
+				Accept:          "application/json",
+				ClearCookiesURL: "/prefix/sign_out?clear=all&rd=%2Ffoo",
+			})
+
+			Expect(recorder.Code).To(Equal(431))
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Request Header Fields Too Large",
+				"status": 431,
+				"detail": "Your browser sent too many or too large cookies. Clear the cookies for this site and try again.",
+				"requestId": "11111111-2222-4333-8444-555555555555",
+				"clearCookiesUrl": "/prefix/sign_out?clear=all\u0026rd=%2Ffoo"
+			}`))
+		})
+
+		It("Writes the HTML page when the request prefers HTML", func() {
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:   500,
+				AppError: "Some error",
+				Accept:   "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			})
+
+			Expect(recorder.Code).To(Equal(500))
+			Expect(recorder.Body.String()).To(Equal("Internal Server Error Oops! Something went wrong. For more information contact your server administrator."))
+		})
+
+		It("Writes problem details regardless of the Accept header when the JSON mode is enabled", func() {
+			errorPage.problemJSON = true
+
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:   500,
+				AppError: "Some error",
+				Accept:   "text/html",
+			})
+
+			Expect(recorder.Code).To(Equal(500))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/problem+json"))
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Internal Server Error",
+				"status": 500,
+				"detail": "Oops! Something went wrong. For more information contact your server administrator."
+			}`))
+		})
+
+		It("Writes the detailed error as the detail with Debug enabled", func() {
+			errorPage.debug = true
+
+			recorder := httptest.NewRecorder()
+			errorPage.WriteErrorPage(recorder, ErrorPageOpts{
+				Status:   403,
+				AppError: "Debug error",
+				Accept:   "application/json",
+			})
+
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Forbidden",
+				"status": 403,
+				"detail": "Debug error"
+			}`))
+		})
+	})
+
+	Context("ProxyErrorHandler", func() {
+		It("Writes a bad gateway problem when the request prefers JSON", func() {
+			req := httptest.NewRequest("", "/bad-gateway", nil)
+			req.Header.Set("Accept", "application/json")
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				RequestID: testRequestID,
+			})
+			recorder := httptest.NewRecorder()
+			errorPage.ProxyErrorHandler(recorder, req, errors.New("some upstream error"))
+
+			Expect(recorder.Code).To(Equal(502))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/problem+json"))
+			Expect(recorder.Body.String()).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Bad Gateway",
+				"status": 502,
+				"detail": "There was a problem connecting to the upstream server.",
+				"requestId": "11111111-2222-4333-8444-555555555555"
+			}`))
+		})
+	})
+
+	DescribeTable("prefersJSON",
+		func(accept string, expected bool) {
+			Expect(prefersJSON(accept)).To(Equal(expected))
+		},
+		Entry("with no Accept header", "", false),
+		Entry("with any media type", "*/*", false),
+		Entry("with JSON", "application/json", true),
+		Entry("with problem details", "application/problem+json", true),
+		Entry("with mixed case and parameters", "Application/JSON; charset=utf-8", true),
+		Entry("with JSON and a wildcard", "application/json, text/plain, */*", true),
+		Entry("with a browser Accept header", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false),
+		Entry("with JSON and HTML of equal quality", "application/json, text/html", false),
+		Entry("with JSON of a higher quality than HTML", "text/html;q=0.5, application/json", true),
+		Entry("with HTML of a higher quality than JSON", "application/json;q=0.5, text/html", false),
+		Entry("with an invalid quality", "application/json;q=abc", false),
+	)
+})
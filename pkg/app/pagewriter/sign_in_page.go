@@ -34,6 +34,10 @@ type signInPageWriter struct {
 	// ProviderName is the name of the provider that should be displayed on the login button.
 	providerName string
 
+	// Providers are the providers users can choose to sign in with, when
+	// there are several.
+	providers []SignInProvider
+
 	// SignInMessage is the messge displayed above the login button.
 	signInMessage string
 
@@ -47,36 +51,61 @@ type signInPageWriter struct {
 	// DisplayLoginForm determines whether or not the basic auth password form is displayed on the sign-in page.
 	displayLoginForm bool
 
+	// ProviderUnavailable reports whether the provider is unavailable, when
+	// the basic auth password form is its fallback.
+	providerUnavailable func() bool
+
 	// LogoData is the logo to render in the template.
 	// This should contain valid html.
 	logoData string
 }
 
+// SignInProvider is a provider users can choose to sign in with on the
+// sign-in page
+type SignInProvider struct {
+	// Name is the name of the provider displayed on its login button.
+	Name string
+
+	// ProxyPrefix is the prefix under which the endpoints of the provider
+	// are served, its login button starts the login flow there.
+	ProxyPrefix string
+}
+
 // WriteSignInPage writes the sign-in page to the given response writer.
 // It uses the redirectURL to be able to set the final destination for the user post login.
-func (s *signInPageWriter) WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int) {
+// The csrfToken is posted by the login form, to be checked against the form
+// CSRF cookie.
+func (s *signInPageWriter) WriteSignInPage(rw http.ResponseWriter, req *http.Request, redirectURL string, statusCode int, csrfToken string) {
+	providerUnavailable := s.providerUnavailable != nil && s.providerUnavailable()
+
 	// We allow unescaped template.HTML since it is user configured options
 	/* #nosec G203 */
 	t := struct {
-		ProviderName  string
-		SignInMessage template.HTML
-		StatusCode    int
-		CustomLogin   bool
-		Redirect      string
-		Version       string
-		ProxyPrefix   string
-		Footer        template.HTML
-		LogoData      template.HTML
+		ProviderName        string
+		Providers           []SignInProvider
+		SignInMessage       template.HTML
+		StatusCode          int
+		CustomLogin         bool
+		ProviderUnavailable bool
+		Redirect            string
+		CSRFToken           string
+		Version             string
+		ProxyPrefix         string
+		Footer              template.HTML
+		LogoData            template.HTML
 	}{
-		ProviderName:  s.providerName,
-		SignInMessage: template.HTML(s.signInMessage),
-		StatusCode:    statusCode,
-		CustomLogin:   s.displayLoginForm,
-		Redirect:      redirectURL,
-		Version:       s.version,
-		ProxyPrefix:   s.proxyPrefix,
-		Footer:        template.HTML(s.footer),
-		LogoData:      template.HTML(s.logoData),
+		ProviderName:        s.providerName,
+		Providers:           s.providers,
+		SignInMessage:       template.HTML(s.signInMessage),
+		StatusCode:          statusCode,
+		CustomLogin:         s.displayLoginForm || providerUnavailable,
+		ProviderUnavailable: providerUnavailable,
+		Redirect:            redirectURL,
+		CSRFToken:           csrfToken,
+		Version:             s.version,
+		ProxyPrefix:         s.proxyPrefix,
+		Footer:              template.HTML(s.footer),
+		LogoData:            template.HTML(s.logoData),
 	}
 
 	err := s.template.Execute(rw, t)
@@ -88,6 +117,7 @@ func (s *signInPageWriter) WriteSignInPage(rw http.ResponseWriter, req *http.Req
 			RedirectURL: redirectURL,
 			RequestID:   scope.RequestID,
 			AppError:    err.Error(),
+			Accept:      req.Header.Get("Accept"),
 		})
 	}
 }
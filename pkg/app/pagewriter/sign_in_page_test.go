@@ -30,7 +30,7 @@ var _ = Describe("SignIn Page", func() {
 				template: errorTmpl,
 			}
 
-			tmpl, err := template.New("").Parse("{{.ProxyPrefix}} {{.ProviderName}} {{.SignInMessage}} {{.Footer}} {{.Version}} {{.Redirect}} {{.CustomLogin}} {{.LogoData}}")
+			tmpl, err := template.New("").Parse("{{.ProxyPrefix}} {{.ProviderName}} {{.SignInMessage}} {{.Footer}} {{.Version}} {{.Redirect}} {{.CSRFToken}} {{.CustomLogin}} {{.LogoData}}")
 			Expect(err).ToNot(HaveOccurred())
 
 			signInPage = &signInPageWriter{
@@ -54,11 +54,50 @@ var _ = Describe("SignIn Page", func() {
 		Context("WriteSignInPage", func() {
 			It("Writes the template to the response writer", func() {
 				recorder := httptest.NewRecorder()
-				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK)
+				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "csrf-token")
 
 				body, err := ioutil.ReadAll(recorder.Result().Body)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(string(body)).To(Equal("/prefix/ My Provider Sign In Here Custom Footer Text v0.0.0-test /redirect true Logo Data"))
+				Expect(string(body)).To(Equal("/prefix/ My Provider Sign In Here Custom Footer Text v0.0.0-test /redirect csrf-token true Logo Data"))
+			})
+
+			It("Displays the login form as the fallback while the provider is unavailable", func() {
+				tmpl, err := template.New("").Parse("{{.CustomLogin}} {{.ProviderUnavailable}}")
+				Expect(err).ToNot(HaveOccurred())
+				signInPage.template = tmpl
+				signInPage.displayLoginForm = false
+
+				unavailable := false
+				signInPage.providerUnavailable = func() bool { return unavailable }
+
+				recorder := httptest.NewRecorder()
+				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "csrf-token")
+				Expect(recorder.Body.String()).To(Equal("false false"))
+
+				unavailable = true
+				recorder = httptest.NewRecorder()
+				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "csrf-token")
+				Expect(recorder.Body.String()).To(Equal("true true"))
+			})
+
+			It("Writes a login button for each of the providers", func() {
+				templates, err := loadTemplates("")
+				Expect(err).ToNot(HaveOccurred())
+				signInPage.template = templates.Lookup("sign_in.html")
+				signInPage.providers = []SignInProvider{
+					{Name: "Staff", ProxyPrefix: "/oauth2/staff"},
+					{Name: "Partners", ProxyPrefix: "/oauth2/partners"},
+				}
+
+				recorder := httptest.NewRecorder()
+				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "csrf-token")
+				body := recorder.Body.String()
+				Expect(body).To(ContainSubstring(`<form method="GET" action="/oauth2/staff/start" class="block">`))
+				Expect(body).To(ContainSubstring("Sign in with Staff"))
+				Expect(body).To(ContainSubstring(`<form method="GET" action="/oauth2/partners/start" class="block">`))
+				Expect(body).To(ContainSubstring("Sign in with Partners"))
+				Expect(body).ToNot(ContainSubstring("Sign in with My Provider"))
+				Expect(strings.Count(body, `<input type="hidden" name="rd" value="/redirect">`)).To(Equal(3))
 			})
 
 			It("Writes an error if the template can't be rendered", func() {
@@ -68,7 +107,7 @@ var _ = Describe("SignIn Page", func() {
 				signInPage.template = tmpl
 
 				recorder := httptest.NewRecorder()
-				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK)
+				signInPage.WriteSignInPage(recorder, request, "/redirect", http.StatusOK, "csrf-token")
 
 				body, err := ioutil.ReadAll(recorder.Result().Body)
 				Expect(err).ToNot(HaveOccurred())
@@ -0,0 +1,87 @@
+package pagewriter
+
+import (
+	"html/template"
+	"net/http"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// signOutPageWriter is used to render sign-out confirmation pages.
+type signOutPageWriter struct {
+	// template is the sign-out page HTML template.
+	template *template.Template
+
+	// errorPageWriter is used to render an error if there are problems with rendering the sign-out page.
+	errorPageWriter *errorPageWriter
+
+	// proxyPrefix is the prefix under which OAuth2 Proxy pages are served.
+	proxyPrefix string
+
+	// footer is the footer to be displayed at the bottom of the page.
+	// If not set, a default footer will be used.
+	footer string
+
+	// version is the OAuth2 Proxy version to be used in the default footer.
+	version string
+
+	// logoData is the logo to render in the template.
+	// This should contain valid html.
+	logoData string
+}
+
+// SignOutPageOpts bundles up the content needed to write the sign-out
+// confirmation page
+type SignOutPageOpts struct {
+	// RedirectURL is where the user is sent once signed out, or when they
+	// cancel.
+	RedirectURL string
+	// Email is the email of the signed in user, if any.
+	Email string
+	// ClearAllCookies is set when the CSRF and provider cookies are cleared
+	// along with the session cookie.
+	ClearAllCookies bool
+	// CSRFToken is posted by the form, to be checked against the form CSRF
+	// cookie.
+	CSRFToken string
+}
+
+// WriteSignOutPage writes the sign-out confirmation page, whose form signs
+// the user out with a POST request, to the given response writer.
+func (s *signOutPageWriter) WriteSignOutPage(rw http.ResponseWriter, req *http.Request, opts SignOutPageOpts) {
+	// We allow unescaped template.HTML since it is user configured options
+	/* #nosec G203 */
+	t := struct {
+		Email           string
+		Redirect        string
+		ClearAllCookies bool
+		CSRFToken       string
+		Version         string
+		ProxyPrefix     string
+		Footer          template.HTML
+		LogoData        template.HTML
+	}{
+		Email:           opts.Email,
+		Redirect:        opts.RedirectURL,
+		ClearAllCookies: opts.ClearAllCookies,
+		CSRFToken:       opts.CSRFToken,
+		Version:         s.version,
+		ProxyPrefix:     s.proxyPrefix,
+		Footer:          template.HTML(s.footer),
+		LogoData:        template.HTML(s.logoData),
+	}
+
+	err := s.template.Execute(rw, t)
+	if err != nil {
+		logger.Printf("Error rendering sign-out template: %v", err)
+		scope := middlewareapi.GetRequestScope(req)
+		s.errorPageWriter.WriteErrorPage(rw, ErrorPageOpts{
+			Status:      http.StatusInternalServerError,
+			RedirectURL: opts.RedirectURL,
+			RequestID:   scope.RequestID,
+			AppError:    err.Error(),
+			Accept:      req.Header.Get("Accept"),
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package pagewriter
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SignOut Page", func() {
+	var request *http.Request
+	var signOutPage *signOutPageWriter
+
+	BeforeEach(func() {
+		errorTmpl, err := template.New("").Parse("{{.Title}} | {{.RequestID}}")
+		Expect(err).ToNot(HaveOccurred())
+		errorPage := &errorPageWriter{
+			template: errorTmpl,
+		}
+
+		tmpl, err := template.New("").Parse("{{.ProxyPrefix}} {{.Email}} {{.Footer}} {{.Version}} {{.Redirect}} {{.ClearAllCookies}} {{.CSRFToken}} {{.LogoData}}")
+		Expect(err).ToNot(HaveOccurred())
+
+		signOutPage = &signOutPageWriter{
+			template:        tmpl,
+			errorPageWriter: errorPage,
+			proxyPrefix:     "/prefix/",
+			footer:          "Custom Footer Text",
+			version:         "v0.0.0-test",
+			logoData:        "Logo Data",
+		}
+
+		request = httptest.NewRequest("", "http://127.0.0.1/", nil)
+		request = middlewareapi.AddRequestScope(request, &middlewareapi.RequestScope{
+			RequestID: testRequestID,
+		})
+	})
+
+	It("Writes the template to the response writer", func() {
+		recorder := httptest.NewRecorder()
+		signOutPage.WriteSignOutPage(recorder, request, SignOutPageOpts{
+			RedirectURL:     "/redirect",
+			Email:           "user@example.com",
+			ClearAllCookies: true,
+			CSRFToken:       "csrf-token",
+		})
+
+		body, err := ioutil.ReadAll(recorder.Result().Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal("/prefix/ user@example.com Custom Footer Text v0.0.0-test /redirect true csrf-token Logo Data"))
+	})
+
+	It("Writes an error if the template can't be rendered", func() {
+		// Overwrite the template with something bad
+		tmpl, err := template.New("").Parse("{{.Unknown}}")
+		Expect(err).ToNot(HaveOccurred())
+		signOutPage.template = tmpl
+
+		recorder := httptest.NewRecorder()
+		signOutPage.WriteSignOutPage(recorder, request, SignOutPageOpts{RedirectURL: "/redirect"})
+
+		body, err := ioutil.ReadAll(recorder.Result().Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal(fmt.Sprintf("Internal Server Error | %s", testRequestID)))
+	})
+})
@@ -40,6 +40,7 @@ func (s *staticPageWriter) writePage(rw http.ResponseWriter, req *http.Request,
 			Status:    http.StatusInternalServerError,
 			RequestID: scope.RequestID,
 			AppError:  err.Error(),
+			Accept:    req.Header.Get("Accept"),
 		})
 		return
 	}
@@ -14,8 +14,11 @@ import (
 )
 
 const (
-	errorTemplateName  = "error.html"
-	signInTemplateName = "sign_in.html"
+	errorTemplateName   = "error.html"
+	signInTemplateName  = "sign_in.html"
+	signOutTemplateName = "sign_out.html"
+
+	maintenanceTemplateName = "maintenance.html"
 )
 
 //go:embed error.html
@@ -24,7 +27,13 @@ var defaultErrorTemplate string
 //go:embed sign_in.html
 var defaultSignInTemplate string
 
-// loadTemplates adds the Sign In and Error templates from the custom template
+//go:embed sign_out.html
+var defaultSignOutTemplate string
+
+//go:embed maintenance.html
+var defaultMaintenanceTemplate string
+
+// loadTemplates adds the Sign In, Sign Out, Maintenance and Error templates from the custom template
 // directory, or uses the defaults if they do not exist or the custom directory
 // is not provided.
 func loadTemplates(customDir string) (*template.Template, error) {
@@ -37,6 +46,14 @@ func loadTemplates(customDir string) (*template.Template, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not add Sign In template: %v", err)
 	}
+	t, err = addTemplate(t, customDir, signOutTemplateName, defaultSignOutTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("could not add Sign Out template: %v", err)
+	}
+	t, err = addTemplate(t, customDir, maintenanceTemplateName, defaultMaintenanceTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("could not add Maintenance template: %v", err)
+	}
 	t, err = addTemplate(t, customDir, errorTemplateName, defaultErrorTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("could not add Error template: %v", err)
@@ -41,17 +41,29 @@ var _ = Describe("Templates", func() {
 				Redirect    string
 				Footer      string
 
+				// For default sign_in and sign_out templates
+				CSRFToken string
+
+				// For default sign_out template
+				Email           string
+				ClearAllCookies bool
+
 				// For default sign_in template
 				SignInMessage string
 				ProviderName  string
+				Providers     []SignInProvider
 				CustomLogin   bool
 				LogoData      string
 
 				// For default error template
-				StatusCode int
-				Title      string
-				Message    string
-				RequestID  string
+				StatusCode               int
+				Title                    string
+				Message                  string
+				RequestID                string
+				ProviderError            string
+				ProviderErrorDescription string
+				RetryURL                 string
+				ClearCookiesURL          string
 
 				// For custom templates
 				TestString string
@@ -60,15 +72,24 @@ var _ = Describe("Templates", func() {
 				Redirect:    "<redirect>",
 				Footer:      "<footer>",
 
+				CSRFToken: "<csrf-token>",
+
+				Email:           "<email>",
+				ClearAllCookies: true,
+
 				SignInMessage: "<sign-in-message>",
 				ProviderName:  "<provider-name>",
 				CustomLogin:   false,
 				LogoData:      "<logo>",
 
-				StatusCode: 404,
-				Title:      "<title>",
-				Message:    "<message>",
-				RequestID:  "<request-id>",
+				StatusCode:               404,
+				Title:                    "<title>",
+				Message:                  "<message>",
+				RequestID:                "<request-id>",
+				ProviderError:            "<provider-error>",
+				ProviderErrorDescription: "<provider-error-description>",
+				RetryURL:                 "<retry-url>",
+				ClearCookiesURL:          "<clear-cookies-url>",
 
 				TestString: "Testing",
 			}
@@ -87,11 +108,23 @@ var _ = Describe("Templates", func() {
 				Expect(buf.String()).To(HavePrefix("\n<!DOCTYPE html>"))
 			})
 
+			It("Use the default sign_out page", func() {
+				buf := bytes.NewBuffer([]byte{})
+				Expect(t.ExecuteTemplate(buf, signOutTemplateName, data)).To(Succeed())
+				Expect(buf.String()).To(HavePrefix("\n<!DOCTYPE html>"))
+			})
+
 			It("Use the default error page", func() {
 				buf := bytes.NewBuffer([]byte{})
 				Expect(t.ExecuteTemplate(buf, errorTemplateName, data)).To(Succeed())
 				Expect(buf.String()).To(HavePrefix("\n<!DOCTYPE html>"))
 			})
+
+			It("Use the default maintenance page", func() {
+				buf := bytes.NewBuffer([]byte{})
+				Expect(t.ExecuteTemplate(buf, maintenanceTemplateName, data)).To(Succeed())
+				Expect(buf.String()).To(HavePrefix("\n<!DOCTYPE html>"))
+			})
 		})
 
 		Context("With a custom directory", func() {
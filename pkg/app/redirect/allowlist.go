@@ -0,0 +1,307 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+
+	// regexEntryPrefix marks an allowlist entry as a regular expression that
+	// should be matched against the full redirect URL.
+	regexEntryPrefix = "~"
+
+	// schemeSeparator marks an allowlist entry as a URL pattern.
+	schemeSeparator = "://"
+)
+
+var (
+	// Redirects that an allowlist entry must never match.
+	// If a pattern matches any of these, it is too broad to be safe.
+	matchEverythingProbes = []string{
+		"https://oauth2-proxy.invalid/",
+		"https://oauth2-proxy.invalid:8443/callback",
+		"https://oauth2-proxy.invalid/callback?rd=https://oauth2-proxy.invalid",
+		"http://oauth2-proxy.invalid/",
+	}
+
+	// Hosts that may be redirected to over plain http.
+	loopbackHosts = map[string]struct{}{
+		"localhost": {},
+		"127.0.0.1": {},
+		"::1":       {},
+	}
+)
+
+// redirectMatcher matches absolute redirect URLs against an allowlist
+// entry given as a URL pattern or a regular expression.
+type redirectMatcher interface {
+	matches(redirectURL *url.URL, redirect string) bool
+}
+
+// IsPatternEntry returns whether an allowlist entry is a URL pattern or a
+// regular expression, rather than a plain domain.
+func IsPatternEntry(entry string) bool {
+	return strings.HasPrefix(entry, regexEntryPrefix) || strings.Contains(entry, schemeSeparator)
+}
+
+// ValidatePatternEntry checks that an allowlist URL pattern or regular
+// expression is well formed and safe to use.
+func ValidatePatternEntry(entry string) error {
+	_, err := newRedirectMatcher(entry)
+	return err
+}
+
+// newRedirectMatcher compiles an allowlist URL pattern or regular expression.
+// Entries that would allow redirects to any domain are rejected.
+func newRedirectMatcher(entry string) (redirectMatcher, error) {
+	var matcher redirectMatcher
+	var err error
+	if strings.HasPrefix(entry, regexEntryPrefix) {
+		matcher, err = newRegexMatcher(strings.TrimPrefix(entry, regexEntryPrefix))
+	} else {
+		matcher, err = newPatternMatcher(entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, probe := range matchEverythingProbes {
+		probeURL, _ := url.Parse(probe)
+		if matcher.matches(probeURL, probe) {
+			return nil, errors.New("pattern would allow redirects to any domain")
+		}
+	}
+	return matcher, nil
+}
+
+// regexMatcher matches the full redirect URL against a regular expression.
+type regexMatcher struct {
+	regex *regexp.Regexp
+}
+
+func newRegexMatcher(expr string) (*regexMatcher, error) {
+	if !strings.HasPrefix(expr, "^") || !strings.HasSuffix(expr, "$") {
+		return nil, errors.New("regex must be anchored with ^ and $ so that it matches the full redirect URL")
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regex: %v", err)
+	}
+	return &regexMatcher{regex: regex}, nil
+}
+
+func (m *regexMatcher) matches(redirectURL *url.URL, redirect string) bool {
+	return isSchemeAllowed(redirectURL.Scheme, redirectURL.Hostname()) && m.regex.MatchString(redirect)
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	low  int
+	high int
+}
+
+// patternMatcher matches redirect URLs against a URL pattern in the form
+// scheme://host[:ports][/path].
+// The host may start with a `*.` wildcard, ports may be `*`, a single port,
+// or a range (eg 8000-8010) and the path may end with a `*` wildcard.
+type patternMatcher struct {
+	scheme     string
+	host       string
+	wildcard   bool
+	anyPort    bool
+	ports      []portRange
+	path       string
+	pathPrefix bool
+}
+
+func newPatternMatcher(pattern string) (*patternMatcher, error) {
+	parts := strings.SplitN(pattern, schemeSeparator, 2)
+	m := &patternMatcher{
+		scheme: strings.ToLower(parts[0]),
+	}
+
+	hostPort := parts[1]
+	if i := strings.Index(hostPort, "/"); i >= 0 {
+		hostPort, m.path = hostPort[:i], hostPort[i:]
+	}
+
+	host, ports := splitPatternHostPort(hostPort)
+	if err := m.setHost(strings.ToLower(host)); err != nil {
+		return nil, err
+	}
+	if err := m.setPorts(ports); err != nil {
+		return nil, err
+	}
+	if err := m.setPath(); err != nil {
+		return nil, err
+	}
+
+	if m.scheme != schemeHTTP && m.scheme != schemeHTTPS {
+		return nil, fmt.Errorf("unsupported scheme %q, must be https", m.scheme)
+	}
+	if !isSchemeAllowed(m.scheme, m.host) || (m.scheme == schemeHTTP && m.wildcard) {
+		return nil, errors.New("http is only allowed for localhost, use https")
+	}
+	return m, nil
+}
+
+// splitPatternHostPort separates the host from the ports of a URL pattern.
+// Unlike net.SplitHostPort, the ports may be a wildcard or a range.
+func splitPatternHostPort(hostPort string) (string, string) {
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return hostPort, ""
+		}
+		return hostPort[1:end], strings.TrimPrefix(hostPort[end+1:], ":")
+	}
+	if i := strings.LastIndex(hostPort, ":"); i >= 0 {
+		return hostPort[:i], hostPort[i+1:]
+	}
+	return hostPort, ""
+}
+
+func (m *patternMatcher) setHost(host string) error {
+	if strings.HasPrefix(host, "*.") {
+		m.wildcard = true
+		host = strings.TrimPrefix(host, "*.")
+		if strings.Count(host, ".") < 1 {
+			return fmt.Errorf("wildcard host %q must be followed by at least two domain labels", "*."+host)
+		}
+	}
+	switch {
+	case host == "" || host == "*":
+		return errors.New("host must be specified")
+	case strings.Contains(host, "*"):
+		return errors.New("wildcards are only supported as the leftmost label of the host")
+	}
+	m.host = host
+	return nil
+}
+
+func (m *patternMatcher) setPorts(ports string) error {
+	if ports == "" {
+		return nil
+	}
+	if ports == "*" {
+		m.anyPort = true
+		return nil
+	}
+
+	r, err := parsePortRange(ports)
+	if err != nil {
+		return err
+	}
+	m.ports = append(m.ports, r)
+	return nil
+}
+
+// parsePortRange parses a single port, or an inclusive range of ports in the
+// form low-high
+func parsePortRange(ports string) (portRange, error) {
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := parsePort(bounds[0])
+	if err != nil {
+		return portRange{}, err
+	}
+	high := low
+	if len(bounds) == 2 {
+		high, err = parsePort(bounds[1])
+		if err != nil {
+			return portRange{}, err
+		}
+	}
+	if low > high {
+		return portRange{}, fmt.Errorf("invalid port range %q", ports)
+	}
+	return portRange{low: low, high: high}, nil
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return p, nil
+}
+
+func (m *patternMatcher) setPath() error {
+	if strings.HasSuffix(m.path, "*") {
+		m.pathPrefix = true
+		m.path = strings.TrimSuffix(m.path, "*")
+	}
+	if strings.Contains(m.path, "*") {
+		return errors.New("wildcards are only supported at the end of the path")
+	}
+	return nil
+}
+
+func (m *patternMatcher) matches(redirectURL *url.URL, _ string) bool {
+	return strings.ToLower(redirectURL.Scheme) == m.scheme &&
+		m.matchesHost(strings.ToLower(redirectURL.Hostname())) &&
+		m.matchesPort(redirectURL.Port()) &&
+		m.matchesPath(redirectURL.Path)
+}
+
+func (m *patternMatcher) matchesHost(host string) bool {
+	if m.wildcard {
+		return strings.HasSuffix(host, "."+m.host)
+	}
+	return host == m.host
+}
+
+func (m *patternMatcher) matchesPort(port string) bool {
+	if m.anyPort {
+		return true
+	}
+	if port == "" {
+		return len(m.ports) == 0
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range m.ports {
+		if p >= r.low && p <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *patternMatcher) matchesPath(redirectPath string) bool {
+	if m.path == "" {
+		return true
+	}
+	// Reject paths that could traverse out of the allowed path
+	if cleaned := path.Clean(redirectPath); cleaned != redirectPath && cleaned+"/" != redirectPath {
+		return false
+	}
+	if m.pathPrefix {
+		return strings.HasPrefix(redirectPath, m.path)
+	}
+	return redirectPath == m.path
+}
+
+// isSchemeAllowed checks that redirects use https, unless they are
+// redirecting to the local machine.
+func isSchemeAllowed(scheme, host string) bool {
+	switch strings.ToLower(scheme) {
+	case schemeHTTPS:
+		return true
+	case schemeHTTP:
+		_, ok := loopbackHosts[strings.ToLower(host)]
+		return ok
+	default:
+		return false
+	}
+}
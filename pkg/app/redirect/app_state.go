@@ -0,0 +1,77 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInvalidAppState is returned when the app state of a request exceeds the
+// maximum size or isn't printable text.
+var ErrInvalidAppState = errors.New("invalid app state")
+
+// AppState carries an opaque value given by the application when it starts
+// the login flow to the redirect followed once the user has authenticated.
+type AppState struct {
+	// Parameter is the request parameter the app state is read from when the
+	// login flow is started. The app state is disabled when it is empty.
+	Parameter string
+
+	// RedirectParameter is the query parameter the app state is added to on the
+	// redirect.
+	// Defaults to the Parameter.
+	RedirectParameter string
+
+	// MaxSize is the maximum size of the app state in bytes.
+	MaxSize int
+}
+
+// FromRequest returns the app state of the request, or an empty string when
+// the request has none or the app state is disabled.
+// App states exceeding the maximum size, or that aren't printable text, are
+// rejected with an ErrInvalidAppState.
+func (a AppState) FromRequest(req *http.Request) (string, error) {
+	if a.Parameter == "" {
+		return "", nil
+	}
+
+	value := req.FormValue(a.Parameter)
+	if len(value) > a.MaxSize {
+		return "", fmt.Errorf("%w: %d bytes is larger than %d", ErrInvalidAppState, len(value), a.MaxSize)
+	}
+	if !utf8.ValidString(value) {
+		return "", fmt.Errorf("%w: must be UTF-8 text", ErrInvalidAppState)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: must not contain control characters", ErrInvalidAppState)
+		}
+	}
+	return value, nil
+}
+
+// AppendTo returns the redirect with the app state added to its query.
+// The redirect is returned unchanged when there is no app state.
+func (a AppState) AppendTo(redirect, value string) string {
+	if a.Parameter == "" || value == "" {
+		return redirect
+	}
+
+	u, err := url.Parse(redirect)
+	if err != nil {
+		// Redirects have been validated, so this should not happen
+		return redirect
+	}
+
+	param := a.RedirectParameter
+	if param == "" {
+		param = a.Parameter
+	}
+	query := u.Query()
+	query.Set(param, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
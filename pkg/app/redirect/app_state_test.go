@@ -0,0 +1,80 @@
+package redirect
+
+import (
+	"errors"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppState", func() {
+	appState := AppState{
+		Parameter:         "app_state",
+		RedirectParameter: "ui_state",
+		MaxSize:           16,
+	}
+
+	type fromRequestTableInput struct {
+		appState      AppState
+		query         string
+		expectedValue string
+		expectedErr   string
+	}
+
+	DescribeTable("FromRequest",
+		func(in fromRequestTableInput) {
+			req := httptest.NewRequest("GET", "/oauth2/start"+in.query, nil)
+			value, err := in.appState.FromRequest(req)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				Expect(errors.Is(err, ErrInvalidAppState)).To(BeTrue())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal(in.expectedValue))
+		},
+		Entry("when disabled", fromRequestTableInput{
+			appState: AppState{},
+			query:    "?app_state=token",
+		}),
+		Entry("without an app state", fromRequestTableInput{
+			appState: appState,
+			query:    "?rd=%2F",
+		}),
+		Entry("with an app state", fromRequestTableInput{
+			appState:      appState,
+			query:         "?app_state=deep%2Flink%3F%C3%A9",
+			expectedValue: "deep/link?é",
+		}),
+		Entry("with an app state larger than the maximum size", fromRequestTableInput{
+			appState:    appState,
+			query:       "?app_state=0123456789abcdefg",
+			expectedErr: "invalid app state: 17 bytes is larger than 16",
+		}),
+		Entry("with invalid UTF-8", fromRequestTableInput{
+			appState:    appState,
+			query:       "?app_state=%FF",
+			expectedErr: "invalid app state: must be UTF-8 text",
+		}),
+		Entry("with control characters", fromRequestTableInput{
+			appState:    appState,
+			query:       "?app_state=a%0D%0Ab",
+			expectedErr: "invalid app state: must not contain control characters",
+		}),
+	)
+
+	DescribeTable("AppendTo",
+		func(in AppState, redirect, value, expected string) {
+			Expect(in.AppendTo(redirect, value)).To(Equal(expected))
+		},
+		Entry("when disabled", AppState{}, "/foo", "token", "/foo"),
+		Entry("without an app state", appState, "/foo", "", "/foo"),
+		Entry("with a path", appState, "/foo", "token", "/foo?ui_state=token"),
+		Entry("with a query and fragment", appState, "https://app.example.com/foo?bar=1#baz", "token", "https://app.example.com/foo?bar=1&ui_state=token#baz"),
+		Entry("replacing an app state in the redirect", appState, "/foo?ui_state=spoofed", "token", "/foo?ui_state=token"),
+		Entry("escaping the app state", appState, "/foo", `"><script>&x=1`, "/foo?ui_state=%22%3E%3Cscript%3E%26x%3D1"),
+		Entry("defaulting to the parameter", AppState{Parameter: "app_state", MaxSize: 16}, "/foo", "token", "/foo?app_state=token"),
+	)
+})
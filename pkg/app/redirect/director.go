@@ -1,13 +1,19 @@
 package redirect
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 )
 
+// ErrRedirectTooLong is returned when the redirect exceeds the maximum length
+// and can't be truncated to fit.
+var ErrRedirectTooLong = errors.New("redirect exceeds the maximum length")
+
 // AppDirector is responsible for determining where OAuth2 Proxy should redirect
 // a users request to after the user has authenticated with the identity provider.
 type AppDirector interface {
@@ -18,6 +24,25 @@ type AppDirector interface {
 type AppDirectorOpts struct {
 	ProxyPrefix string
 	Validator   Validator
+
+	// MaxLength is the maximum length of the redirect, 0 for no limit.
+	MaxLength int
+
+	// TruncateLongRedirects truncates redirects exceeding the MaxLength to their
+	// origin and path, rather than returning an ErrRedirectTooLong.
+	TruncateLongRedirects bool
+
+	// ExternalURLPrefix is the path prefix OAuth2 Proxy is served under by the
+	// ingress. The default redirect is the root of the prefix.
+	ExternalURLPrefix string
+
+	// PrefixStripped is set when the ingress removes the ExternalURLPrefix
+	// from requests, so that it is restored in redirects to the request URI.
+	PrefixStripped bool
+
+	// DefaultRedirect is used when the request has no valid redirect, rather
+	// than the root of the ExternalURLPrefix.
+	DefaultRedirect string
 }
 
 // NewAppDirector constructs a new AppDirector for getting the application
@@ -28,16 +53,38 @@ func NewAppDirector(opts AppDirectorOpts) AppDirector {
 		prefix = fmt.Sprintf("%s/", prefix)
 	}
 
+	var strippedPrefix string
+	if opts.PrefixStripped {
+		strippedPrefix = opts.ExternalURLPrefix
+	}
+
+	defaultRedirect := opts.DefaultRedirect
+	if defaultRedirect == "" {
+		defaultRedirect = opts.ExternalURLPrefix + "/"
+	}
+
 	return &appDirector{
-		proxyPrefix: prefix,
-		validator:   opts.Validator,
+		proxyPrefix:           prefix,
+		validator:             opts.Validator,
+		maxLength:             opts.MaxLength,
+		truncateLongRedirects: opts.TruncateLongRedirects,
+		defaultRedirect:       defaultRedirect,
+		strippedPrefix:        strippedPrefix,
 	}
 }
 
 // appDirector implements the AppDirector interface.
 type appDirector struct {
-	proxyPrefix string
-	validator   Validator
+	proxyPrefix           string
+	validator             Validator
+	maxLength             int
+	truncateLongRedirects bool
+
+	// defaultRedirect is the root of the application
+	defaultRedirect string
+
+	// strippedPrefix is removed from request URIs by the ingress
+	strippedPrefix string
 }
 
 // GetRedirect determines the full URL or URI path to redirect clients to once
@@ -49,7 +96,11 @@ type appDirector struct {
 // - `X-Forwarded-(Proto|Host)` if `Uri` has the ProxyPath (i.e. /oauth2/*)
 // - `X-Forwarded-Uri` direct URI path (when ReverseProxy mode is enabled)
 // - `req.URL.RequestURI` if not under the ProxyPath (i.e. /oauth2/*)
-// - `/`
+// - the DefaultRedirect, or `/` or the root of the external URL prefix
+// Request URIs have the external URL prefix restored when the ingress strips
+// it.
+// Redirects exceeding the maximum length are truncated or rejected with an
+// ErrRedirectTooLong.
 func (a *appDirector) GetRedirect(req *http.Request) (string, error) {
 	err := req.ParseForm()
 	if err != nil {
@@ -67,11 +118,11 @@ func (a *appDirector) GetRedirect(req *http.Request) (string, error) {
 		redirect := rdGetter(req)
 		// Call `p.IsValidRedirect` again here a final time to be safe
 		if redirect != "" && a.validator.IsValidRedirect(redirect) {
-			return redirect, nil
+			return a.limitLength(redirect)
 		}
 	}
 
-	return "/", nil
+	return a.defaultRedirect, nil
 }
 
 // validateRedirect checks that the redirect is valid.
@@ -87,6 +138,32 @@ func (a *appDirector) validateRedirect(redirect string, errorFormat string) stri
 	return ""
 }
 
+// limitLength ensures the redirect is within the maximum length, truncating
+// the query and fragment of longer redirects when allowed.
+func (a *appDirector) limitLength(redirect string) (string, error) {
+	if a.maxLength <= 0 || len(redirect) <= a.maxLength {
+		return redirect, nil
+	}
+	if !a.truncateLongRedirects {
+		return "", fmt.Errorf("%w: %d characters is longer than %d", ErrRedirectTooLong, len(redirect), a.maxLength)
+	}
+
+	redirectURL, err := url.Parse(redirect)
+	if err != nil {
+		return "", fmt.Errorf("could not parse redirect to truncate it: %v", err)
+	}
+	redirectURL.RawQuery = ""
+	redirectURL.Fragment = ""
+	redirectURL.RawFragment = ""
+
+	truncated := redirectURL.String()
+	if len(truncated) > a.maxLength {
+		return "", fmt.Errorf("%w: %d characters is longer than %d, even without the query", ErrRedirectTooLong, len(truncated), a.maxLength)
+	}
+	logger.Printf("Truncated redirect of %d characters to %s", len(redirect), truncated)
+	return truncated, nil
+}
+
 // hasProxyPrefix determines whether the obtained path would be a request to
 // one of OAuth2 Proxy's own endpoints, eg. th callback URL.
 // Redirects to these endpoints should not be allowed as they will create
@@ -1,7 +1,10 @@
 package redirect
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	. "github.com/onsi/ginkgo"
@@ -174,4 +177,163 @@ var _ = Describe("Director Suite", func() {
 			expectedRedirect: "https://a-service.example.com/foo/bar",
 		}),
 	)
+
+	type limitLengthTableInput struct {
+		redirect         string
+		maxLength        int
+		truncate         bool
+		expectedRedirect string
+		expectedErr      string
+	}
+
+	longQuery := "?state=" + strings.Repeat("a", 8192) + "#section"
+
+	DescribeTable("GetRedirect with a maximum length",
+		func(in limitLengthTableInput) {
+			appDirector := NewAppDirector(AppDirectorOpts{
+				ProxyPrefix:           testProxyPrefix,
+				Validator:             testValidator(true),
+				MaxLength:             in.maxLength,
+				TruncateLongRedirects: in.truncate,
+			})
+
+			req, _ := http.NewRequest("GET", "/oauth2/start?rd="+url.QueryEscape(in.redirect), nil)
+			req = middleware.AddRequestScope(req, &middleware.RequestScope{})
+
+			redirect, err := appDirector.GetRedirect(req)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				Expect(errors.Is(err, ErrRedirectTooLong)).To(BeTrue())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redirect).To(Equal(in.expectedRedirect))
+		},
+		Entry("within the maximum length", limitLengthTableInput{
+			redirect:         "https://app.example.com/dashboard?tab=1",
+			maxLength:        4096,
+			expectedRedirect: "https://app.example.com/dashboard?tab=1",
+		}),
+		Entry("without a maximum length", limitLengthTableInput{
+			redirect:         "https://app.example.com/dashboard" + longQuery,
+			maxLength:        0,
+			expectedRedirect: "https://app.example.com/dashboard" + longQuery,
+		}),
+		Entry("exceeding the maximum length, truncates to the origin and path", limitLengthTableInput{
+			redirect:         "https://app.example.com/dashboard" + longQuery,
+			maxLength:        4096,
+			truncate:         true,
+			expectedRedirect: "https://app.example.com/dashboard",
+		}),
+		Entry("exceeding the maximum length with a relative redirect, truncates to the path", limitLengthTableInput{
+			redirect:         "/dashboard" + longQuery,
+			maxLength:        4096,
+			truncate:         true,
+			expectedRedirect: "/dashboard",
+		}),
+		Entry("exceeding the maximum length, denies the redirect", limitLengthTableInput{
+			redirect:    "https://app.example.com/dashboard" + longQuery,
+			maxLength:   4096,
+			truncate:    false,
+			expectedErr: "redirect exceeds the maximum length: 8240 characters is longer than 4096",
+		}),
+		Entry("exceeding the maximum length without the query, denies the redirect", limitLengthTableInput{
+			redirect:    "https://app.example.com/" + strings.Repeat("a", 8192),
+			maxLength:   4096,
+			truncate:    true,
+			expectedErr: "redirect exceeds the maximum length: 8216 characters is longer than 4096, even without the query",
+		}),
+	)
+
+	type externalURLPrefixTableInput struct {
+		requestURL       string
+		headers          map[string]string
+		prefixStripped   bool
+		expectedRedirect string
+	}
+
+	DescribeTable("GetRedirect with an external URL prefix",
+		func(in externalURLPrefixTableInput) {
+			appDirector := NewAppDirector(AppDirectorOpts{
+				ProxyPrefix:       "/myapp" + testProxyPrefix,
+				Validator:         testValidator(true),
+				ExternalURLPrefix: "/myapp",
+				PrefixStripped:    in.prefixStripped,
+			})
+
+			req, _ := http.NewRequest("GET", in.requestURL, nil)
+			for header, value := range in.headers {
+				req.Header.Add(header, value)
+			}
+			req = middleware.AddRequestScope(req, &middleware.RequestScope{
+				ReverseProxy: true,
+			})
+
+			redirect, err := appDirector.GetRedirect(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redirect).To(Equal(in.expectedRedirect))
+		},
+		Entry("with the prefix stripped, restores the prefix to the request URI", externalURLPrefixTableInput{
+			requestURL:       "/foo/bar?baz",
+			prefixStripped:   true,
+			expectedRedirect: "/myapp/foo/bar?baz",
+		}),
+		Entry("with the prefix preserved, redirects to the request URI", externalURLPrefixTableInput{
+			requestURL:       "/myapp/foo/bar?baz",
+			prefixStripped:   false,
+			expectedRedirect: "/myapp/foo/bar?baz",
+		}),
+		Entry("with the prefix stripped, under the proxy prefix, redirects to the root of the prefix", externalURLPrefixTableInput{
+			requestURL:       testProxyPrefix + "/sign_in",
+			prefixStripped:   true,
+			expectedRedirect: "/myapp/",
+		}),
+		Entry("with the prefix preserved, under the proxy prefix, redirects to the root of the prefix", externalURLPrefixTableInput{
+			requestURL:       "/myapp" + testProxyPrefix + "/sign_in",
+			prefixStripped:   false,
+			expectedRedirect: "/myapp/",
+		}),
+		Entry("with the prefix stripped, and the X-Forwarded-Uri header, uses the header", externalURLPrefixTableInput{
+			requestURL:       "/foo/bar",
+			headers:          map[string]string{"X-Forwarded-Uri": "/myapp/foo/bar"},
+			prefixStripped:   true,
+			expectedRedirect: "/myapp/foo/bar",
+		}),
+		Entry("with the prefix stripped, and a proxied host, restores the prefix", externalURLPrefixTableInput{
+			requestURL: "https://oauth.example.com/foo/bar",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+			},
+			prefixStripped:   true,
+			expectedRedirect: "https://example.com/myapp/foo/bar",
+		}),
+	)
+
+	Context("with a default redirect", func() {
+		var appDirector AppDirector
+
+		BeforeEach(func() {
+			appDirector = NewAppDirector(AppDirectorOpts{
+				ProxyPrefix:       "/myapp" + testProxyPrefix,
+				Validator:         testValidator(true),
+				ExternalURLPrefix: "/myapp",
+				DefaultRedirect:   "https://example.com/signed-out",
+			})
+		})
+
+		It("uses the default redirect when the request has none", func() {
+			req, _ := http.NewRequest("GET", "/myapp"+testProxyPrefix+"/sign_out", nil)
+			redirect, err := appDirector.GetRedirect(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redirect).To(Equal("https://example.com/signed-out"))
+		})
+
+		It("prefers the redirect of the request", func() {
+			req, _ := http.NewRequest("GET", "/myapp"+testProxyPrefix+"/sign_out?rd=%2Fmyapp%2Fhome", nil)
+			redirect, err := appDirector.GetRedirect(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(redirect).To(Equal("/myapp/home"))
+		})
+	})
 })
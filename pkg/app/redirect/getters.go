@@ -37,9 +37,9 @@ func (a *appDirector) getXForwardedHeadersRedirect(req *http.Request) string {
 		return ""
 	}
 
-	uri := requestutil.GetRequestURI(req)
+	uri := a.requestURI(req)
 	if a.hasProxyPrefix(uri) {
-		uri = "/"
+		uri = a.defaultRedirect
 	}
 
 	redirect := fmt.Sprintf(
@@ -59,15 +59,25 @@ func (a *appDirector) getXForwardedHeadersRedirect(req *http.Request) string {
 // - `/`
 func (a *appDirector) getURIRedirect(req *http.Request) string {
 	redirect := a.validateRedirect(
-		requestutil.GetRequestURI(req),
+		a.requestURI(req),
 		"Invalid redirect generated from X-Forwarded-Uri header: %s",
 	)
 	if redirect == "" {
-		redirect = req.URL.RequestURI()
+		redirect = a.strippedPrefix + req.URL.RequestURI()
 	}
 
 	if a.hasProxyPrefix(redirect) {
-		return "/"
+		return a.defaultRedirect
 	}
 	return redirect
 }
+
+// requestURI returns the X-Forwarded-Uri of proxied requests, which is the URI
+// requested by the client, or otherwise the request URI with the prefix
+// stripped by the ingress restored
+func (a *appDirector) requestURI(req *http.Request) string {
+	if requestutil.IsProxied(req) && req.Header.Get(requestutil.XForwardedURI) != "" {
+		return requestutil.GetRequestURI(req)
+	}
+	return a.strippedPrefix + req.URL.RequestURI()
+}
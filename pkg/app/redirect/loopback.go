@@ -0,0 +1,79 @@
+package redirect
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Loopback configures the redirects allowed to native apps, such as CLI
+// tools, that listen on the loopback interface for the end of their login
+// flow, as described in RFC 8252, section 7.3.
+type Loopback struct {
+	// Allow allows redirects over http or https to 127.0.0.1, [::1] and
+	// localhost, without them being allowed by the allowlist.
+	Allow bool
+
+	// Ports is the port, or inclusive range of ports (eg 49152-65535), that
+	// loopback redirects may use. Any port is allowed when empty.
+	Ports string
+}
+
+// ValidateLoopbackPorts checks that the loopback redirect ports are a port
+// or a range of ports.
+func ValidateLoopbackPorts(ports string) error {
+	_, err := parsePortRange(ports)
+	return err
+}
+
+// loopbackMatcher matches redirects to the loopback interface, on any port
+// or on the ports of the loopback policy.
+type loopbackMatcher struct {
+	anyPort bool
+	ports   portRange
+}
+
+// newLoopbackMatcher returns the matcher of the loopback policy, or nil when
+// loopback redirects aren't allowed
+func newLoopbackMatcher(loopback Loopback) (*loopbackMatcher, error) {
+	if !loopback.Allow {
+		return nil, nil
+	}
+	if loopback.Ports == "" {
+		return &loopbackMatcher{anyPort: true}, nil
+	}
+	ports, err := parsePortRange(loopback.Ports)
+	if err != nil {
+		return nil, err
+	}
+	return &loopbackMatcher{ports: ports}, nil
+}
+
+// matches checks that the redirect is to one of the loopback hosts, over
+// http or https, on an allowed port.
+// The host must be the loopback host exactly, so that hosts only starting
+// with one, such as localhost.evil.com, don't match, and the IPv6 loopback
+// address must be in brackets.
+func (m *loopbackMatcher) matches(redirectURL *url.URL, _ string) bool {
+	switch strings.ToLower(redirectURL.Scheme) {
+	case schemeHTTP, schemeHTTPS:
+	default:
+		return false
+	}
+	host := strings.ToLower(redirectURL.Hostname())
+	if _, ok := loopbackHosts[host]; !ok {
+		return false
+	}
+	if strings.Contains(host, ":") && !strings.HasPrefix(redirectURL.Host, "[") {
+		return false
+	}
+	if m.anyPort {
+		return true
+	}
+
+	p, err := strconv.Atoi(redirectURL.Port())
+	if err != nil {
+		return false
+	}
+	return p >= m.ports.low && p <= m.ports.high
+}
@@ -25,16 +25,40 @@ type Validator interface {
 }
 
 // NewValidator constructs a new redirect validator.
-func NewValidator(allowedDomains []string) Validator {
-	return &validator{
-		allowedDomains: allowedDomains,
+// Allowed domains may also be given as URL patterns or regular expressions
+// which are matched against the full redirect URL.
+// Redirects to the loopback interface are allowed on top of the allowed
+// domains according to the loopback policy.
+// Invalid patterns and loopback ports should be rejected during options
+// validation, any that remain are ignored.
+func NewValidator(allowedDomains []string, loopback Loopback) Validator {
+	v := &validator{}
+	if matcher, err := newLoopbackMatcher(loopback); err != nil {
+		logger.Errorf("Ignoring invalid loopback redirect ports %q: %v", loopback.Ports, err)
+	} else if matcher != nil {
+		v.matchers = append(v.matchers, matcher)
 	}
+	for _, allowedDomain := range allowedDomains {
+		if !IsPatternEntry(allowedDomain) {
+			v.allowedDomains = append(v.allowedDomains, allowedDomain)
+			continue
+		}
+
+		matcher, err := newRedirectMatcher(allowedDomain)
+		if err != nil {
+			logger.Errorf("Ignoring invalid redirect allowlist entry %q: %v", allowedDomain, err)
+			continue
+		}
+		v.matchers = append(v.matchers, matcher)
+	}
+	return v
 }
 
 // validator implements the Validator interface to allow validation
 // of redirect URLs.
 type validator struct {
 	allowedDomains []string
+	matchers       []redirectMatcher
 }
 
 // IsValidRedirect checks whether the redirect URL is safe and allowed.
@@ -44,6 +68,9 @@ func (v *validator) IsValidRedirect(redirect string) bool {
 		// The user didn't specify a redirect.
 		// In this case, we expect the proxt to fallback to `/`
 		return false
+	case !hasValidPercentEncoding(redirect):
+		logger.Printf("Rejecting invalid redirect %q: invalid percent-encoding", redirect)
+		return false
 	case strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !invalidRedirectRegex.MatchString(redirect):
 		return true
 	case strings.HasPrefix(redirect, "http://") || strings.HasPrefix(redirect, "https://"):
@@ -57,6 +84,12 @@ func (v *validator) IsValidRedirect(redirect string) bool {
 			return true
 		}
 
+		for _, matcher := range v.matchers {
+			if matcher.matches(redirectURL, redirect) {
+				return true
+			}
+		}
+
 		logger.Printf("Rejecting invalid redirect %q: domain / port not in whitelist", redirect)
 		return false
 	default:
@@ -64,3 +97,22 @@ func (v *validator) IsValidRedirect(redirect string) bool {
 		return false
 	}
 }
+
+// hasValidPercentEncoding checks that every `%` in the redirect starts a
+// percent-encoded octet, ie is followed by two hex digits.
+func hasValidPercentEncoding(redirect string) bool {
+	for i := 0; i < len(redirect); i++ {
+		if redirect[i] != '%' {
+			continue
+		}
+		if i+2 >= len(redirect) || !isHex(redirect[i+1]) || !isHex(redirect[i+2]) {
+			return false
+		}
+		i += 2
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
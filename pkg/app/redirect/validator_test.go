@@ -13,6 +13,7 @@ import (
 
 var _ = Describe("Validator suite", func() {
 	var testAllowedDomains []string
+	var testAllowedPatterns []string
 
 	BeforeEach(func() {
 		testAllowedDomains = []string{
@@ -28,6 +29,15 @@ var _ = Describe("Validator suite", func() {
 			"*.wildcard.bar",
 			"*.wildcard.proxy.foo.bar",
 		}
+		testAllowedPatterns = []string{
+			"https://*.whitelisteddomain.tld:*",
+			`~^https://www\.whitelisteddomain\.tld(:\d+)?/[a-z/]*$`,
+			"https://*.preview.example.com:*/callback",
+			"https://app.example.com:8443-8445/oauth/*",
+			"http://localhost:8000-8010/callback",
+			"http://[::1]:9000",
+			`~^https://[a-z]+\.review\.example\.com/callback$`,
+		}
 	})
 
 	Context("OpenRedirect List", func() {
@@ -44,7 +54,29 @@ var _ = Describe("Validator suite", func() {
 				rdUnescaped, err := url.QueryUnescape(rd)
 				Expect(err).ToNot(HaveOccurred())
 
-				validator := NewValidator(testAllowedDomains)
+				validator := NewValidator(testAllowedDomains, Loopback{})
+				Expect(validator.IsValidRedirect(rdUnescaped)).To(BeFalse(), "Expected redirect not to be valid")
+			})
+		}
+
+		Expect(scanner.Err()).ToNot(HaveOccurred())
+	})
+
+	Context("OpenRedirect List with patterns", func() {
+		file, err := os.Open("../../../testdata/openredirects.txt")
+		Expect(err).ToNot(HaveOccurred())
+		defer func() {
+			Expect(file.Close()).To(Succeed())
+		}()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			rd := scanner.Text()
+			It(rd, func() {
+				rdUnescaped, err := url.QueryUnescape(rd)
+				Expect(err).ToNot(HaveOccurred())
+
+				validator := NewValidator(testAllowedPatterns, Loopback{})
 				Expect(validator.IsValidRedirect(rdUnescaped)).To(BeFalse(), "Expected redirect not to be valid")
 			})
 		}
@@ -55,7 +87,7 @@ var _ = Describe("Validator suite", func() {
 	Context("Validator", func() {
 		DescribeTable("IsValidRedirect",
 			func(testRedirect string, expected bool) {
-				validator := NewValidator(testAllowedDomains)
+				validator := NewValidator(testAllowedDomains, Loopback{})
 				Expect(validator.IsValidRedirect(testRedirect)).To(Equal(expected))
 			},
 			Entry("No Redirect", "", false),
@@ -115,6 +147,65 @@ var _ = Describe("Validator suite", func() {
 			Entry("Valid HTTPS Wildcard Subdomain Defined Port Root", "https://wildcard.sub.port.bar:8080/redirect", true),
 			Entry("Missing Protocol Root Domain", "foo.bar/redirect", false),
 			Entry("Missing Protocol Wildcard Subdomain", "proxy.wildcard.bar/redirect", false),
+			Entry("Valid Percent-Encoding", "/redirect%2Fpath?q=a%20b", true),
+			Entry("Valid Percent-Encoding Absolute URL", "https://foo.bar/redirect?q=%E2%9C%93", true),
+			Entry("Invalid Percent-Encoding Non-Hex", "/redirect?q=100%zz", false),
+			Entry("Invalid Percent-Encoding Truncated", "/redirect?q=100%2", false),
+			Entry("Invalid Percent-Encoding Bare Percent", "https://foo.bar/redirect?q=100%", false),
+		)
+	})
+
+	Context("Validator with patterns", func() {
+		DescribeTable("IsValidRedirect",
+			func(testRedirect string, expected bool) {
+				validator := NewValidator(testAllowedPatterns, Loopback{})
+				Expect(validator.IsValidRedirect(testRedirect)).To(Equal(expected))
+			},
+			Entry("Valid Wildcard Subdomain Any Port", "https://pr-42.preview.example.com:4443/callback", true),
+			Entry("Valid Wildcard Subdomain Default Port", "https://pr-42.preview.example.com/callback", true),
+			Entry("Valid Nested Wildcard Subdomain", "https://a.pr-42.preview.example.com/callback", true),
+			Entry("Invalid Wildcard Root Domain", "https://preview.example.com/callback", false),
+			Entry("Invalid Wildcard Similar Domain", "https://pr-42.preview.example.com.evil.corp/callback", false),
+			Entry("Invalid Wildcard Path", "https://pr-42.preview.example.com/other", false),
+			Entry("Invalid Wildcard Subpath", "https://pr-42.preview.example.com/callback/other", false),
+			Entry("Invalid Wildcard HTTP", "http://pr-42.preview.example.com/callback", false),
+			Entry("Valid Port Range Lower Bound", "https://app.example.com:8443/oauth/", true),
+			Entry("Valid Port Range Upper Bound", "https://app.example.com:8445/oauth/done", true),
+			Entry("Invalid Port Range Below", "https://app.example.com:8442/oauth/", false),
+			Entry("Invalid Port Range Above", "https://app.example.com:8446/oauth/", false),
+			Entry("Invalid Port Range Default Port", "https://app.example.com/oauth/", false),
+			Entry("Invalid Path Prefix Traversal", "https://app.example.com:8443/oauth/../admin", false),
+			Entry("Valid Localhost HTTP", "http://localhost:8000/callback", true),
+			Entry("Valid Localhost HTTP Upper Port", "http://localhost:8010/callback", true),
+			Entry("Invalid Localhost HTTP Port", "http://localhost:8011/callback", false),
+			Entry("Invalid Localhost HTTPS", "https://localhost:8000/callback", false),
+			Entry("Valid IPv6 Localhost HTTP", "http://[::1]:9000/anything", true),
+			Entry("Valid Regex", "https://pr.review.example.com/callback", true),
+			Entry("Invalid Regex Suffix", "https://pr.review.example.com/callback.evil.corp", false),
+			Entry("Invalid Regex HTTP", "http://pr.review.example.com/callback", false),
+			Entry("Invalid Regex Host", "https://pr-1.review.example.com/callback", false),
+			Entry("Valid Relative Path", "/redirect", true),
+			Entry("Invalid Unlisted Domain", "https://evil.corp/callback", false),
+		)
+
+		DescribeTable("ValidatePatternEntry",
+			func(entry string, expectedErr string) {
+				err := ValidatePatternEntry(entry)
+				if expectedErr == "" {
+					Expect(err).ToNot(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(expectedErr))
+				}
+			},
+			Entry("Wildcard Subdomain", "https://*.preview.example.com:*/callback", ""),
+			Entry("Localhost Port Range", "http://localhost:8000-8010/callback", ""),
+			Entry("Anchored Regex", `~^https://app\.example\.com/.*$`, ""),
+			Entry("Match Everything Host", "https://*:*", "host must be specified"),
+			Entry("Match Everything Regex", `~^.*$`, "pattern would allow redirects to any domain"),
+			Entry("Match Any HTTPS Regex", `~^https://[^/]+/callback$`, "pattern would allow redirects to any domain"),
+			Entry("Unanchored Regex", `~example\.com`, "regex must be anchored with ^ and $ so that it matches the full redirect URL"),
+			Entry("HTTP Non-Localhost", "http://app.example.com", "http is only allowed for localhost, use https"),
+			Entry("Invalid Port", "https://app.example.com:0", "invalid port \"0\""),
 		)
 	})
 
@@ -0,0 +1,89 @@
+package assertion
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	keysDir string
+)
+
+func TestAssertionSuite(t *testing.T) {
+	logger.SetOutput(GinkgoWriter)
+	logger.SetErrOutput(GinkgoWriter)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Assertion")
+}
+
+var _ = BeforeSuite(func() {
+	dir, err := ioutil.TempDir("", "oauth2-proxy-assertion-suite")
+	Expect(err).ToNot(HaveOccurred())
+	keysDir = dir
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	writePEM("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	ecKeyData, err := x509.MarshalECPrivateKey(ecKey)
+	Expect(err).ToNot(HaveOccurred())
+	writePEM("ec.pem", "EC PRIVATE KEY", ecKeyData)
+
+	previousKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	previousKeyData, err := x509.MarshalPKIXPublicKey(previousKey.Public())
+	Expect(err).ToNot(HaveOccurred())
+	writePEM("previous.pub", "PUBLIC KEY", previousKeyData)
+
+	unsupportedKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	unsupportedKeyData, err := x509.MarshalECPrivateKey(unsupportedKey)
+	Expect(err).ToNot(HaveOccurred())
+	writePEM("unsupported.pem", "EC PRIVATE KEY", unsupportedKeyData)
+
+	Expect(ioutil.WriteFile(path.Join(keysDir, "invalid.pem"), []byte("not a key"), 0600)).To(Succeed())
+
+	writeJWKS("signing.json",
+		jose.JSONWebKey{Key: ecKey, KeyID: "2022-05", Algorithm: "ES256", Use: "sig"},
+		jose.JSONWebKey{Key: previousKey.Public(), KeyID: "2022-01", Use: "sig"},
+		// Keys for other uses aren't published
+		jose.JSONWebKey{Key: rsaKey.Public(), KeyID: "encryption", Use: "enc"},
+	)
+	writeJWKS("unidentified.json", jose.JSONWebKey{Key: rsaKey})
+	writeJWKS("public.json", jose.JSONWebKey{Key: rsaKey.Public(), KeyID: "2022-05"})
+	writeJWKS("two-private.json", jose.JSONWebKey{Key: rsaKey, KeyID: "a"}, jose.JSONWebKey{Key: ecKey, KeyID: "b"})
+	writeJWKS("mismatched-alg.json", jose.JSONWebKey{Key: ecKey, KeyID: "2022-05", Algorithm: "RS256"})
+	Expect(ioutil.WriteFile(path.Join(keysDir, "invalid.json"), []byte("not a key set"), 0600)).To(Succeed())
+})
+
+var _ = AfterSuite(func() {
+	Expect(os.RemoveAll(keysDir)).To(Succeed())
+})
+
+func writeJWKS(name string, keys ...jose.JSONWebKey) {
+	keySetData, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(ioutil.WriteFile(path.Join(keysDir, name), keySetData, 0600)).To(Succeed())
+}
+
+func writePEM(name, blockType string, data []byte) {
+	keyData := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+	Expect(ioutil.WriteFile(path.Join(keysDir, name), keyData, 0600)).To(Succeed())
+}
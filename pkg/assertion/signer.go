@@ -0,0 +1,279 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Signer mints signed JWTs asserting the identity of the user of a session, so
+// that upstreams can verify the identity of the user offline.
+// The public keys to verify the assertions are published as a JSON Web Key Set.
+type Signer struct {
+	header   string
+	issuer   string
+	audience string
+	expiry   time.Duration
+
+	method     jwt.SigningMethod
+	signingKey crypto.Signer
+	keyID      string
+	keySet     jose.JSONWebKeySet
+
+	clock clock.Clock
+}
+
+// identityClaims are the claims of an identity assertion
+type identityClaims struct {
+	Email             string   `json:"email,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	jwt.StandardClaims
+}
+
+// NewSigner loads the signing and verification keys for the identity
+// assertions, from a PEM file or a JSON Web Key Set.
+// Each key is identified by its JWK thumbprint, or by its kid in the key set
+// when it has one, which is used as the kid of the assertions, so that
+// upstreams can select the key while keys are rotated.
+func NewSigner(opts options.IdentityAssertion) (*Signer, error) {
+	if opts.SigningKeyFile == "" && opts.SigningJWKSFile == "" {
+		return nil, errors.New("no signing key file configured")
+	}
+	if opts.SigningKeyFile != "" && opts.SigningJWKSFile != "" {
+		return nil, errors.New("only one of a signing key file and a signing JWKS file may be configured")
+	}
+	if opts.Header == "" {
+		return nil, errors.New("no header configured")
+	}
+	if opts.Expiry <= 0 {
+		return nil, fmt.Errorf("expiry must be greater than 0, got %s", opts.Expiry)
+	}
+
+	keyFile := opts.SigningKeyFile
+	var signingKey crypto.Signer
+	var signingKeyID string
+	var verificationKeys []jose.JSONWebKey
+	var err error
+	if opts.SigningJWKSFile != "" {
+		keyFile = opts.SigningJWKSFile
+		signingKey, signingKeyID, verificationKeys, err = loadSigningJWKS(keyFile)
+	} else {
+		signingKey, err = loadSigningKey(keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	method, err := signingMethod(signingKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("unsupported signing key %s: %v", keyFile, err)
+	}
+
+	s := &Signer{
+		header:     opts.Header,
+		issuer:     opts.Issuer,
+		audience:   opts.Audience,
+		expiry:     opts.Expiry,
+		method:     method,
+		signingKey: signingKey,
+	}
+
+	s.keyID, err = s.addKey(signingKey.Public(), method, signingKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("could not publish signing key %s: %v", keyFile, err)
+	}
+	for _, key := range verificationKeys {
+		method, err := signingMethod(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported verification key %q in %s: %v", key.KeyID, keyFile, err)
+		}
+		if _, err := s.addKey(key.Key, method, key.KeyID); err != nil {
+			return nil, fmt.Errorf("could not publish verification key %q in %s: %v", key.KeyID, keyFile, err)
+		}
+	}
+	for _, keyFile := range opts.VerificationKeyFiles {
+		key, err := loadVerificationKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		method, err := signingMethod(key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported verification key %s: %v", keyFile, err)
+		}
+		if _, err := s.addKey(key, method, ""); err != nil {
+			return nil, fmt.Errorf("could not publish verification key %s: %v", keyFile, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Header is the name of the header the assertion should be injected into
+func (s *Signer) Header() string {
+	return s.header
+}
+
+// Sign mints an identity assertion for the session, valid from now until the
+// configured expiry.
+func (s *Signer) Sign(session *sessions.SessionState) (string, error) {
+	now := s.clock.Now()
+	token := jwt.NewWithClaims(s.method, identityClaims{
+		Email:             session.Email,
+		Groups:            session.Groups,
+		PreferredUsername: session.PreferredUsername,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.issuer,
+			Audience:  s.audience,
+			Subject:   session.User,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(s.expiry).Unix(),
+		},
+	})
+	token.Header["kid"] = s.keyID
+
+	assertion, err := token.SignedString(s.signingKey)
+	if err != nil {
+		return "", fmt.Errorf("could not sign identity assertion: %v", err)
+	}
+	return assertion, nil
+}
+
+// ServeJWKS writes the JSON Web Key Set of the keys that identity assertions
+// may be verified with.
+func (s *Signer) ServeJWKS(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(s.keySet); err != nil {
+		logger.Errorf("Error encoding identity assertion key set: %v", err)
+	}
+}
+
+// addKey adds the public key to the key set, returning its key ID.
+// Keys without a key ID are identified by their thumbprint.
+func (s *Signer) addKey(key crypto.PublicKey, method jwt.SigningMethod, keyID string) (string, error) {
+	jwk := jose.JSONWebKey{
+		Key:       key,
+		KeyID:     keyID,
+		Algorithm: method.Alg(),
+		Use:       "sig",
+	}
+	if jwk.KeyID == "" {
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return "", fmt.Errorf("could not compute key thumbprint: %v", err)
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+
+	s.keySet.Keys = append(s.keySet.Keys, jwk)
+	return jwk.KeyID, nil
+}
+
+// loadSigningKey reads an RSA or EC private key from a PEM encoded file
+func loadSigningKey(keyFile string) (crypto.Signer, error) {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key file: %v", keyFile)
+	}
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(keyData); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(keyData); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("could not parse RSA or EC private key from PEM file %s", keyFile)
+}
+
+// loadSigningJWKS reads the signing key from a JSON Web Key Set file, which
+// must hold a single RSA or EC private key.
+// It returns the key ID of the signing key, and the public keys of the set,
+// such as previous signing keys, which are published alongside it.
+func loadSigningJWKS(jwksFile string) (crypto.Signer, string, []jose.JSONWebKey, error) {
+	jwksData, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("could not read signing JWKS file: %v", jwksFile)
+	}
+	keySet := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(jwksData, &keySet); err != nil {
+		return nil, "", nil, fmt.Errorf("could not parse JSON Web Key Set from file %s: %v", jwksFile, err)
+	}
+
+	var signingKey *jose.JSONWebKey
+	verificationKeys := []jose.JSONWebKey{}
+	for i := range keySet.Keys {
+		key := &keySet.Keys[i]
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.IsPublic() {
+			verificationKeys = append(verificationKeys, *key)
+			continue
+		}
+		if signingKey != nil {
+			return nil, "", nil, fmt.Errorf("JSON Web Key Set file %s has more than one private key", jwksFile)
+		}
+		signingKey = key
+	}
+	if signingKey == nil {
+		return nil, "", nil, fmt.Errorf("JSON Web Key Set file %s has no private key", jwksFile)
+	}
+
+	signer, ok := signingKey.Key.(crypto.Signer)
+	if !ok {
+		return nil, "", nil, fmt.Errorf("unsupported signing key %s: unsupported key type %T", jwksFile, signingKey.Key)
+	}
+	if method, err := signingMethod(signer.Public()); err == nil && signingKey.Algorithm != "" && signingKey.Algorithm != method.Alg() {
+		return nil, "", nil, fmt.Errorf("unsupported signing key %s: algorithm %s does not match the key, which signs with %s", jwksFile, signingKey.Algorithm, method.Alg())
+	}
+	return signer, signingKey.KeyID, verificationKeys, nil
+}
+
+// loadVerificationKey reads an RSA or EC public key from a PEM encoded file
+func loadVerificationKey(keyFile string) (crypto.PublicKey, error) {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read verification key file: %v", keyFile)
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(keyData); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(keyData); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("could not parse RSA or EC public key from PEM file %s", keyFile)
+}
+
+// signingMethod picks the JWT signing method for the type of key
+func signingMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
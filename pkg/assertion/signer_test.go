@@ -0,0 +1,255 @@
+package assertion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var _ = Describe("Identity Assertion Signer Suite", func() {
+	newOpts := func(signingKey string, verificationKeys ...string) options.IdentityAssertion {
+		opts := options.IdentityAssertion{
+			SigningKeyFile: path.Join(keysDir, signingKey),
+			Header:         options.DefaultIdentityAssertionHeader,
+			Issuer:         "https://oauth2-proxy.example.com",
+			Audience:       "upstream",
+			Expiry:         time.Minute,
+		}
+		for _, key := range verificationKeys {
+			opts.VerificationKeyFiles = append(opts.VerificationKeyFiles, path.Join(keysDir, key))
+		}
+		return opts
+	}
+
+	jwksOpts := func(jwks string) options.IdentityAssertion {
+		opts := newOpts("")
+		opts.SigningKeyFile = ""
+		opts.SigningJWKSFile = path.Join(keysDir, jwks)
+		return opts
+	}
+
+	getKeySet := func(signer *Signer) jose.JSONWebKeySet {
+		rw := httptest.NewRecorder()
+		signer.ServeJWKS(rw, httptest.NewRequest(http.MethodGet, "/oauth2/.well-known/jwks.json", nil))
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		keySet := jose.JSONWebKeySet{}
+		Expect(json.Unmarshal(rw.Body.Bytes(), &keySet)).To(Succeed())
+		return keySet
+	}
+
+	type signTableInput struct {
+		signingKey  string
+		expectedAlg string
+	}
+
+	DescribeTable("Sign",
+		func(in signTableInput) {
+			signer, err := NewSigner(newOpts(in.signingKey, "previous.pub"))
+			Expect(err).ToNot(HaveOccurred())
+			signer.clock.Set(time.Unix(1650000000, 0))
+			defer signer.clock.Reset()
+
+			assertion, err := signer.Sign(&sessions.SessionState{
+				User:              "123456789",
+				Email:             "john.doe@example.com",
+				Groups:            []string{"admins", "devs"},
+				PreferredUsername: "john",
+				AccessToken:       "access-token",
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Upstreams verify the assertion with the published key matching the kid
+			keySet := getKeySet(signer)
+			Expect(keySet.Keys).To(HaveLen(2))
+			Expect(keySet.Keys[1].Algorithm).To(Equal("ES384"))
+
+			claims := &identityClaims{}
+			token, err := new(jwt.Parser).ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+				keys := keySet.Key(token.Header["kid"].(string))
+				Expect(keys).To(HaveLen(1))
+				return keys[0].Key, nil
+			})
+			if err != nil {
+				// The assertion expired in the past, only the expiry may fail
+				Expect(err.(*jwt.ValidationError).Errors).To(Equal(jwt.ValidationErrorExpired))
+			}
+			Expect(token.Method.Alg()).To(Equal(in.expectedAlg))
+			Expect(token.Header["kid"]).To(Equal(keySet.Keys[0].KeyID))
+			Expect(claims).To(Equal(&identityClaims{
+				Email:             "john.doe@example.com",
+				Groups:            []string{"admins", "devs"},
+				PreferredUsername: "john",
+				StandardClaims: jwt.StandardClaims{
+					Issuer:    "https://oauth2-proxy.example.com",
+					Audience:  "upstream",
+					Subject:   "123456789",
+					IssuedAt:  1650000000,
+					NotBefore: 1650000000,
+					ExpiresAt: 1650000060,
+				},
+			}))
+		},
+		Entry("with an RSA key", signTableInput{
+			signingKey:  "rsa.pem",
+			expectedAlg: "RS256",
+		}),
+		Entry("with an EC key", signTableInput{
+			signingKey:  "ec.pem",
+			expectedAlg: "ES256",
+		}),
+	)
+
+	It("identifies keys by their thumbprint", func() {
+		signer, err := NewSigner(newOpts("ec.pem"))
+		Expect(err).ToNot(HaveOccurred())
+
+		// Rotating in a new signing key keeps the previous key's ID
+		rotated, err := NewSigner(newOpts("rsa.pem", "previous.pub"))
+		Expect(err).ToNot(HaveOccurred())
+		previous, err := NewSigner(newOpts("ec.pem", "previous.pub"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(getKeySet(rotated).Keys[1].KeyID).To(Equal(getKeySet(previous).Keys[1].KeyID))
+		Expect(getKeySet(signer).Keys[0].KeyID).To(Equal(getKeySet(previous).Keys[0].KeyID))
+		Expect(getKeySet(rotated).Keys[0].KeyID).ToNot(Equal(getKeySet(previous).Keys[0].KeyID))
+	})
+
+	Context("with a signing JWKS", func() {
+		It("signs with the private key of the set, and publishes its public keys", func() {
+			signer, err := NewSigner(jwksOpts("signing.json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			assertion, err := signer.Sign(&sessions.SessionState{User: "123456789", Email: "john.doe@example.com"})
+			Expect(err).ToNot(HaveOccurred())
+
+			keySet := getKeySet(signer)
+			Expect(keySet.Keys).To(HaveLen(2))
+			Expect(keySet.Keys[0].KeyID).To(Equal("2022-05"))
+			Expect(keySet.Keys[0].IsPublic()).To(BeTrue())
+			Expect(keySet.Keys[1].KeyID).To(Equal("2022-01"))
+			Expect(keySet.Keys[1].Algorithm).To(Equal("ES384"))
+
+			token, err := new(jwt.Parser).Parse(assertion, func(token *jwt.Token) (interface{}, error) {
+				keys := keySet.Key(token.Header["kid"].(string))
+				Expect(keys).To(HaveLen(1))
+				return keys[0].Key, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Method.Alg()).To(Equal("ES256"))
+			Expect(token.Header["kid"]).To(Equal("2022-05"))
+		})
+
+		It("identifies keys without a kid by their thumbprint", func() {
+			signer, err := NewSigner(jwksOpts("unidentified.json"))
+			Expect(err).ToNot(HaveOccurred())
+			pemSigner, err := NewSigner(newOpts("rsa.pem"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(getKeySet(signer).Keys[0].KeyID).To(Equal(getKeySet(pemSigner).Keys[0].KeyID))
+		})
+	})
+
+	type newSignerTableInput struct {
+		opts        func() options.IdentityAssertion
+		expectedErr string
+	}
+
+	DescribeTable("NewSigner errors",
+		func(in newSignerTableInput) {
+			_, err := NewSigner(in.opts())
+			// The keys directory is only known once the suite has started
+			Expect(err).To(MatchError(strings.ReplaceAll(in.expectedErr, "$KEYS_DIR", keysDir)))
+		},
+		Entry("without a signing key", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return options.IdentityAssertion{Header: options.DefaultIdentityAssertionHeader, Expiry: time.Minute}
+			},
+			expectedErr: "no signing key file configured",
+		}),
+		Entry("without a header", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				opts := newOpts("rsa.pem")
+				opts.Header = ""
+				return opts
+			},
+			expectedErr: "no header configured",
+		}),
+		Entry("without an expiry", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				opts := newOpts("rsa.pem")
+				opts.Expiry = 0
+				return opts
+			},
+			expectedErr: "expiry must be greater than 0, got 0s",
+		}),
+		Entry("with an invalid signing key", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return newOpts("invalid.pem")
+			},
+			expectedErr: "could not parse RSA or EC private key from PEM file $KEYS_DIR/invalid.pem",
+		}),
+		Entry("with a signing key on an unsupported curve", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return newOpts("unsupported.pem")
+			},
+			expectedErr: "unsupported signing key $KEYS_DIR/unsupported.pem: unsupported curve P-224",
+		}),
+		Entry("with a missing verification key", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return newOpts("rsa.pem", "missing.pub")
+			},
+			expectedErr: "could not read verification key file: $KEYS_DIR/missing.pub",
+		}),
+		Entry("with a private key as a verification key", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return newOpts("rsa.pem", "ec.pem")
+			},
+			expectedErr: "could not parse RSA or EC public key from PEM file $KEYS_DIR/ec.pem",
+		}),
+		Entry("with a signing key and a signing JWKS", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				opts := newOpts("rsa.pem")
+				opts.SigningJWKSFile = path.Join(keysDir, "signing.json")
+				return opts
+			},
+			expectedErr: "only one of a signing key file and a signing JWKS file may be configured",
+		}),
+		Entry("with an invalid signing JWKS", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return jwksOpts("invalid.json")
+			},
+			expectedErr: "could not parse JSON Web Key Set from file $KEYS_DIR/invalid.json: invalid character 'o' in literal null (expecting 'u')",
+		}),
+		Entry("with a signing JWKS without a private key", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return jwksOpts("public.json")
+			},
+			expectedErr: "JSON Web Key Set file $KEYS_DIR/public.json has no private key",
+		}),
+		Entry("with a signing JWKS with two private keys", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return jwksOpts("two-private.json")
+			},
+			expectedErr: "JSON Web Key Set file $KEYS_DIR/two-private.json has more than one private key",
+		}),
+		Entry("with a signing JWKS key with another algorithm", newSignerTableInput{
+			opts: func() options.IdentityAssertion {
+				return jwksOpts("mismatched-alg.json")
+			},
+			expectedErr: "unsupported signing key $KEYS_DIR/mismatched-alg.json: algorithm RS256 does not match the key, which signs with ES256",
+		}),
+	)
+})
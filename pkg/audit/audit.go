@@ -0,0 +1,248 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SchemaVersion is the version of the schema of audit events.
+// Fields are only ever added within a version, a field that is removed or
+// changes its meaning requires a new version.
+const SchemaVersion = "1"
+
+// Outcome is the outcome of the action of an audit event
+type Outcome string
+
+// The outcomes of audited actions
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// Event is an audit event, written to each sink as a single line of JSON
+type Event struct {
+	SchemaVersion string  `json:"schemaVersion"`
+	Type          string  `json:"type"`
+	Timestamp     string  `json:"timestamp"`
+	Outcome       Outcome `json:"outcome"`
+	Message       string  `json:"message,omitempty"`
+
+	RequestID string `json:"requestID,omitempty"`
+	Client    string `json:"client,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// User is the identity the action was taken for, it is nil for anonymous
+	// requests
+	User *User `json:"user,omitempty"`
+
+	// Upstream is set for upstream_access events and the authorization_denied
+	// events of upstreams, Status for upstream_access events
+	Upstream string `json:"upstream,omitempty"`
+	Status   int    `json:"status,omitempty"`
+}
+
+// User is the identity of the session of an audit event.
+// The tokens of the session are never included.
+type User struct {
+	Username          string   `json:"username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	PreferredUsername string   `json:"preferredUsername,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Provider          string   `json:"provider,omitempty"`
+}
+
+// Logger writes audit events to its sinks in the background.
+// Each sink has its own queue, so that a slow sink doesn't hold the others
+// back, and writing events never blocks the request they are written for.
+type Logger struct {
+	types map[string]struct{}
+	sinks []*queuedSink
+}
+
+// NewLogger opens the sinks of the audit options and starts writing the
+// events recorded with the logger to them, until it is stopped
+func NewLogger(opts options.Audit, registerer prometheus.Registerer) (*Logger, error) {
+	if opts.QueueSize <= 0 {
+		return nil, fmt.Errorf("queue size (%d) must be positive", opts.QueueSize)
+	}
+	types, err := eventTypes(opts.Types)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []sink
+	if opts.File != "" {
+		s, err := newFileSink(opts.File)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if opts.Syslog {
+		s, err := newSyslogSink(opts.SyslogAddress, opts.SyslogTag)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if opts.WebhookURL != "" {
+		s, err := newWebhookSink(opts)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	m := newMetrics(registerer)
+	l := &Logger{types: types}
+	for _, s := range sinks {
+		l.sinks = append(l.sinks, newQueuedSink(s, opts.QueueSize, m))
+	}
+	return l, nil
+}
+
+// eventTypes returns the set of event types to record, all of them when none
+// are selected
+func eventTypes(selected []string) (map[string]struct{}, error) {
+	all := []string{
+		options.AuditEventSessionCreated,
+		options.AuditEventSessionRefreshed,
+		options.AuditEventSessionRevoked,
+		options.AuditEventAuthorizationDenied,
+		options.AuditEventUpstreamAccess,
+	}
+	if len(selected) == 0 {
+		selected = all
+	}
+
+	types := map[string]struct{}{}
+	for _, eventType := range selected {
+		known := false
+		for _, name := range all {
+			if eventType == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown audit event %q: must be one of %s", eventType, strings.Join(all, ", "))
+		}
+		types[eventType] = struct{}{}
+	}
+	return types, nil
+}
+
+// Enabled checks whether events of the type are recorded
+func (l *Logger) Enabled(eventType string) bool {
+	_, ok := l.types[eventType]
+	return ok
+}
+
+// Record writes an event of the type, when the type is selected, with the
+// request fields of the request and the identity of the session.
+// The message is formatted in the manner of fmt.Sprintf.
+// The session is nil for anonymous requests.
+func (l *Logger) Record(eventType string, req *http.Request, session *sessionsapi.SessionState, outcome Outcome, format string, a ...interface{}) {
+	if !l.Enabled(eventType) {
+		return
+	}
+	event := newEvent(eventType, req, session, outcome)
+	event.Message = fmt.Sprintf(format, a...)
+	l.write(event)
+}
+
+// RecordUpstreamAccess writes an upstream_access event, when it is selected,
+// for a request proxied to the upstream with the status of its response.
+// Responses with an error status are recorded as failures.
+func (l *Logger) RecordUpstreamAccess(req *http.Request, session *sessionsapi.SessionState, upstream string, status int) {
+	if !l.Enabled(options.AuditEventUpstreamAccess) {
+		return
+	}
+	outcome := OutcomeSuccess
+	if status >= http.StatusBadRequest {
+		outcome = OutcomeFailure
+	}
+	event := newEvent(options.AuditEventUpstreamAccess, req, session, outcome)
+	event.Upstream = upstream
+	event.Status = status
+	l.write(event)
+}
+
+// RecordUpstreamDenial writes an authorization_denied event, when it is
+// selected, for a request the policies or token requirements of the upstream
+// denied for the reason.
+func (l *Logger) RecordUpstreamDenial(req *http.Request, session *sessionsapi.SessionState, upstream string, reason string) {
+	if !l.Enabled(options.AuditEventAuthorizationDenied) {
+		return
+	}
+	event := newEvent(options.AuditEventAuthorizationDenied, req, session, OutcomeFailure)
+	event.Message = fmt.Sprintf("Denied authorization via upstream: %s", reason)
+	event.Upstream = upstream
+	l.write(event)
+}
+
+// newEvent creates the event of the type with the request fields of the
+// request and the identity of the session
+func newEvent(eventType string, req *http.Request, session *sessionsapi.SessionState, outcome Outcome) Event {
+	event := Event{
+		SchemaVersion: SchemaVersion,
+		Type:          eventType,
+		Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
+		Outcome:       outcome,
+	}
+	if req != nil {
+		event.Client = logger.GetClient(req)
+		event.Host = requestutil.GetRequestHost(req)
+		event.Method = req.Method
+		event.Path = req.URL.Path
+		event.UserAgent = req.UserAgent()
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			event.RequestID = scope.RequestID
+		}
+	}
+	if session != nil {
+		event.User = &User{
+			Username:          session.User,
+			Email:             session.Email,
+			PreferredUsername: session.PreferredUsername,
+			Groups:            session.Groups,
+			Provider:          session.AuthProvider,
+		}
+	}
+	return event
+}
+
+// write encodes the event and queues it for each sink
+func (l *Logger) write(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Error encoding audit event: %v", err)
+		return
+	}
+	for _, s := range l.sinks {
+		s.enqueue(event.Type, line)
+	}
+}
+
+// Stop stops writing events once the events still queued are written, and
+// closes the sinks.
+// Writes that fail while stopping are not retried.
+func (l *Logger) Stop() {
+	for _, s := range l.sinks {
+		s.stop()
+	}
+}
@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Logger", func() {
+	var dir string
+	var file string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "oauth2-proxy-audit")
+		Expect(err).ToNot(HaveOccurred())
+		file = filepath.Join(dir, "audit.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	newLogger := func(types ...string) *Logger {
+		l, err := NewLogger(options.Audit{
+			File:      file,
+			Types:     types,
+			QueueSize: 10,
+		}, prometheus.NewRegistry())
+		Expect(err).ToNot(HaveOccurred())
+		return l
+	}
+
+	writtenEvents := func() []Event {
+		f, err := os.Open(file)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+
+		events := []Event{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event Event
+			Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+			events = append(events, event)
+		}
+		Expect(scanner.Err()).ToNot(HaveOccurred())
+		return events
+	}
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/reports?id=1", nil)
+		req.RemoteAddr = "10.0.0.1:51234"
+		req.Header.Set("User-Agent", "curl/8.0")
+		return middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{RequestID: "11111111-2222-3333-4444-555555555555"})
+	}
+
+	session := &sessionsapi.SessionState{
+		User:              "jane",
+		Email:             "jane.doe@example.com",
+		PreferredUsername: "Jane Doe",
+		Groups:            []string{"finance"},
+		AuthProvider:      "corp",
+		AccessToken:       "secret-access-token",
+		IDToken:           "secret-id-token",
+	}
+
+	It("writes the events with the identity of the session to the file", func() {
+		l := newLogger()
+		l.Record(options.AuditEventSessionCreated, newRequest(), session, OutcomeSuccess, "Authenticated via %s", "OAuth2")
+		l.Record(options.AuditEventAuthorizationDenied, newRequest(), nil, OutcomeFailure, "Denied authorization via route access rule")
+		l.Stop()
+
+		events := writtenEvents()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Timestamp).ToNot(BeEmpty())
+		events[0].Timestamp = ""
+		Expect(events[0]).To(Equal(Event{
+			SchemaVersion: SchemaVersion,
+			Type:          options.AuditEventSessionCreated,
+			Outcome:       OutcomeSuccess,
+			Message:       "Authenticated via OAuth2",
+			RequestID:     "11111111-2222-3333-4444-555555555555",
+			Client:        "10.0.0.1:51234",
+			Host:          "app.example.com",
+			Method:        http.MethodGet,
+			Path:          "/reports",
+			UserAgent:     "curl/8.0",
+			User: &User{
+				Username:          "jane",
+				Email:             "jane.doe@example.com",
+				PreferredUsername: "Jane Doe",
+				Groups:            []string{"finance"},
+				Provider:          "corp",
+			},
+		}))
+		Expect(events[1].Type).To(Equal(options.AuditEventAuthorizationDenied))
+		Expect(events[1].Outcome).To(Equal(OutcomeFailure))
+		Expect(events[1].User).To(BeNil())
+	})
+
+	It("never writes the tokens of the session", func() {
+		l := newLogger()
+		l.Record(options.AuditEventSessionRefreshed, newRequest(), session, OutcomeSuccess, "Refreshed session")
+		l.Stop()
+
+		data, err := ioutil.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("secret"))
+	})
+
+	It("records the upstream accesses with their status", func() {
+		l := newLogger()
+		l.RecordUpstreamAccess(newRequest(), session, "reports", http.StatusOK)
+		l.RecordUpstreamAccess(newRequest(), session, "reports", http.StatusBadGateway)
+		l.Stop()
+
+		events := writtenEvents()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Type).To(Equal(options.AuditEventUpstreamAccess))
+		Expect(events[0].Upstream).To(Equal("reports"))
+		Expect(events[0].Status).To(Equal(http.StatusOK))
+		Expect(events[0].Outcome).To(Equal(OutcomeSuccess))
+		Expect(events[1].Status).To(Equal(http.StatusBadGateway))
+		Expect(events[1].Outcome).To(Equal(OutcomeFailure))
+	})
+
+	It("records the upstream denials with their reason", func() {
+		l := newLogger()
+		l.RecordUpstreamDenial(newRequest(), nil, "reports", "the request requires a session")
+		l.Stop()
+
+		events := writtenEvents()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Type).To(Equal(options.AuditEventAuthorizationDenied))
+		Expect(events[0].Upstream).To(Equal("reports"))
+		Expect(events[0].Message).To(Equal("Denied authorization via upstream: the request requires a session"))
+		Expect(events[0].Outcome).To(Equal(OutcomeFailure))
+		Expect(events[0].User).To(BeNil())
+	})
+
+	It("only writes the selected events", func() {
+		l := newLogger(options.AuditEventSessionRevoked)
+		Expect(l.Enabled(options.AuditEventSessionRevoked)).To(BeTrue())
+		Expect(l.Enabled(options.AuditEventUpstreamAccess)).To(BeFalse())
+
+		l.Record(options.AuditEventSessionCreated, newRequest(), session, OutcomeSuccess, "Authenticated via OAuth2")
+		l.RecordUpstreamAccess(newRequest(), session, "reports", http.StatusOK)
+		l.Record(options.AuditEventSessionRevoked, newRequest(), session, OutcomeSuccess, "Signed out")
+		l.Stop()
+
+		events := writtenEvents()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Type).To(Equal(options.AuditEventSessionRevoked))
+	})
+
+	It("appends to an existing file", func() {
+		Expect(ioutil.WriteFile(file, []byte(`{"schemaVersion":"1","type":"session_created"}`+"\n"), 0600)).To(Succeed())
+
+		l := newLogger()
+		l.Record(options.AuditEventSessionRevoked, newRequest(), session, OutcomeSuccess, "Signed out")
+		l.Stop()
+
+		events := writtenEvents()
+		Expect(events).To(HaveLen(2))
+		Expect(events[1].Type).To(Equal(options.AuditEventSessionRevoked))
+	})
+
+	It("drops the events recorded while the queue is full", func() {
+		writes := make(chan struct{})
+		m := newMetrics(prometheus.NewRegistry())
+		q := newQueuedSink(&blockingSink{writes: writes}, 1, m)
+
+		// The first event is being written, the second is queued
+		q.enqueue(options.AuditEventSessionCreated, []byte("{}"))
+		Eventually(func() float64 {
+			return testutil.ToFloat64(m.queued.WithLabelValues("blocking"))
+		}).Should(Equal(float64(0)))
+		q.enqueue(options.AuditEventSessionCreated, []byte("{}"))
+		q.enqueue(options.AuditEventSessionCreated, []byte("{}"))
+		Expect(testutil.ToFloat64(m.dropped.WithLabelValues("blocking", options.AuditEventSessionCreated, dropQueueFull))).To(Equal(float64(1)))
+
+		close(writes)
+		q.stop()
+		Expect(testutil.ToFloat64(m.written.WithLabelValues("blocking", options.AuditEventSessionCreated))).To(Equal(float64(2)))
+	})
+
+	It("rejects unknown events", func() {
+		_, err := NewLogger(options.Audit{File: file, Types: []string{"login"}, QueueSize: 10}, prometheus.NewRegistry())
+		Expect(err).To(MatchError("unknown audit event \"login\": must be one of session_created, session_refreshed, session_revoked, authorization_denied, upstream_access"))
+	})
+
+	It("fails when the file can't be opened", func() {
+		_, err := NewLogger(options.Audit{File: filepath.Join(dir, "missing", "audit.log"), QueueSize: 10}, prometheus.NewRegistry())
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("could not open audit log file"))
+	})
+})
+
+// blockingSink is a sink whose writes wait for the writes channel to be closed
+type blockingSink struct {
+	writes chan struct{}
+}
+
+func (b *blockingSink) name() string {
+	return "blocking"
+}
+
+func (b *blockingSink) write(_ []byte, _ <-chan struct{}) error {
+	<-b.writes
+	return nil
+}
+
+func (b *blockingSink) close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileSink appends events to a file as JSON lines.
+// The file is opened in append mode, so that it can be rotated by copying and
+// truncating it.
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	// Audit events identify users, they are only readable by the proxy
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log file %q: %v", path, err)
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (f *fileSink) name() string {
+	return "file"
+}
+
+func (f *fileSink) write(line []byte, _ <-chan struct{}) error {
+	// The line is shared with the other sinks, it isn't appended to
+	buf := make([]byte, 0, len(line)+1)
+	_, err := f.file.Write(append(append(buf, line...), '\n'))
+	return err
+}
+
+func (f *fileSink) close() error {
+	return f.file.Close()
+}
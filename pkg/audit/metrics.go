@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics records the queued, written and dropped audit events of each sink
+type metrics struct {
+	queued  *prometheus.GaugeVec
+	written *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
+
+// newMetrics registers the audit log metrics with the registerer.
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	return &metrics{
+		queued: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_audit_events_queued",
+				Help: "Number of audit events queued for writing by sink.",
+			},
+			[]string{"sink"},
+		)).(*prometheus.GaugeVec),
+		written: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_audit_events_written_total",
+				Help: "Total number of audit events written by sink and type.",
+			},
+			[]string{"sink", "type"},
+		)).(*prometheus.CounterVec),
+		dropped: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_audit_events_dropped_total",
+				Help: "Total number of audit events dropped by sink, type and reason: queue_full or write_failed.",
+			},
+			[]string{"sink", "type", "reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// The reasons audit events are dropped
+const (
+	dropQueueFull   = "queue_full"
+	dropWriteFailed = "write_failed"
+)
+
+// sink is a destination of audit events
+type sink interface {
+	// name is the name of the sink in metrics and logs
+	name() string
+
+	// write writes a JSON encoded event. Writes are retried by the sink
+	// itself, until the done channel is closed.
+	write(line []byte, done <-chan struct{}) error
+
+	close() error
+}
+
+// queuedEvent is an event waiting to be written to a sink
+type queuedEvent struct {
+	eventType string
+	line      []byte
+}
+
+// queuedSink writes the events queued for a sink one at a time, in the order
+// they were recorded
+type queuedSink struct {
+	sink    sink
+	queue   chan queuedEvent
+	metrics *metrics
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newQueuedSink(s sink, queueSize int, m *metrics) *queuedSink {
+	q := &queuedSink{
+		sink:    s,
+		queue:   make(chan queuedEvent, queueSize),
+		metrics: m,
+		done:    make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go q.writeQueued()
+	return q
+}
+
+// enqueue queues the event without waiting, dropping it when the queue is
+// full
+func (q *queuedSink) enqueue(eventType string, line []byte) {
+	select {
+	case q.queue <- queuedEvent{eventType: eventType, line: line}:
+		q.metrics.queued.WithLabelValues(q.sink.name()).Inc()
+	default:
+		logger.Errorf("Dropping %s audit event: the %s audit log queue is full", eventType, q.sink.name())
+		q.metrics.dropped.WithLabelValues(q.sink.name(), eventType, dropQueueFull).Inc()
+	}
+}
+
+// writeQueued writes the queued events until the sink is stopped, and then
+// the events still queued
+func (q *queuedSink) writeQueued() {
+	defer q.wg.Done()
+	for {
+		select {
+		case event := <-q.queue:
+			q.writeEvent(event)
+		case <-q.done:
+			for {
+				select {
+				case event := <-q.queue:
+					q.writeEvent(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *queuedSink) writeEvent(event queuedEvent) {
+	q.metrics.queued.WithLabelValues(q.sink.name()).Dec()
+	if err := q.sink.write(event.line, q.done); err != nil {
+		logger.Errorf("Error writing %s audit event to the %s audit log: %v", event.eventType, q.sink.name(), err)
+		q.metrics.dropped.WithLabelValues(q.sink.name(), event.eventType, dropWriteFailed).Inc()
+		return
+	}
+	q.metrics.written.WithLabelValues(q.sink.name(), event.eventType).Inc()
+}
+
+// stop writes the events still queued and closes the sink
+func (q *queuedSink) stop() {
+	close(q.done)
+	q.wg.Wait()
+	if err := q.sink.close(); err != nil {
+		logger.Errorf("Error closing the %s audit log: %v", q.sink.name(), err)
+	}
+}
+
+// closeSinks closes the sinks opened before another sink failed to open
+func closeSinks(sinks []sink) {
+	for _, s := range sinks {
+		_ = s.close()
+	}
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink writes events to syslog, with the authpriv facility as they
+// identify users
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the syslog server at the address, given as
+// udp://host:port or tcp://host:port, or to the local syslog daemon when the
+// address is empty
+func newSyslogSink(address, tag string) (*syslogSink, error) {
+	var network, raddr string
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: must be udp://host:port or tcp://host:port", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %v", err)
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) write(line []byte, _ <-chan struct{}) error {
+	// The writer reconnects to the server when a write fails
+	return s.writer.Info(string(line))
+}
+
+func (s *syslogSink) close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Syslog sink", func() {
+	It("writes the events to the syslog server", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		s, err := newSyslogSink("udp://"+conn.LocalAddr().String(), "oauth2-proxy-audit")
+		Expect(err).ToNot(HaveOccurred())
+		defer s.close()
+		Expect(s.write([]byte(`{"schemaVersion":"1","type":"session_created"}`), nil)).To(Succeed())
+
+		buf := make([]byte, 1024)
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		// The authpriv facility (10) at the info severity (6)
+		Expect(string(buf[:n])).To(HavePrefix("<86>"))
+		Expect(string(buf[:n])).To(ContainSubstring(`oauth2-proxy-audit[`))
+		Expect(string(buf[:n])).To(HaveSuffix(`{"schemaVersion":"1","type":"session_created"}` + "\n"))
+	})
+
+	It("rejects other addresses", func() {
+		_, err := newSyslogSink("syslog.example.com:514", "oauth2-proxy-audit")
+		Expect(err).To(MatchError(`invalid syslog address "syslog.example.com:514": must be udp://host:port or tcp://host:port`))
+	})
+})
@@ -0,0 +1,22 @@
+package audit
+
+import "errors"
+
+// syslogSink is not available on Windows, which has no syslog
+type syslogSink struct{}
+
+func newSyslogSink(_, _ string) (*syslogSink, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
+
+func (s *syslogSink) name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) write(_ []byte, _ <-chan struct{}) error {
+	return errors.New("syslog is not available on Windows")
+}
+
+func (s *syslogSink) close() error {
+	return nil
+}
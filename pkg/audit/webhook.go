@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+)
+
+// The initial and maximum wait between the retries of a delivery
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// webhookSink delivers events to a webhook, signed in the same way as
+// session events with an HMAC of each signing key
+type webhookSink struct {
+	url        string
+	keys       [][]byte
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+}
+
+func newWebhookSink(opts options.Audit) (*webhookSink, error) {
+	u, err := url.Parse(opts.WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit webhook url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid audit webhook url %q: the scheme must be http or https", opts.WebhookURL)
+	}
+	if opts.WebhookMaxRetries < 0 {
+		return nil, fmt.Errorf("webhook max retries (%d) must not be negative", opts.WebhookMaxRetries)
+	}
+	if opts.WebhookTimeout <= 0 {
+		return nil, fmt.Errorf("webhook timeout (%s) must be positive", opts.WebhookTimeout)
+	}
+
+	keys, err := sessionevents.LoadSigningKeys(opts.SigningKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookSink{
+		url:        opts.WebhookURL,
+		keys:       keys,
+		maxRetries: opts.WebhookMaxRetries,
+		backoff:    initialBackoff,
+		client:     &http.Client{Timeout: opts.WebhookTimeout},
+	}, nil
+}
+
+func (w *webhookSink) name() string {
+	return "webhook"
+}
+
+// write delivers the event, retrying failures that may be temporary with
+// exponential backoff until the sink is stopped
+func (w *webhookSink) write(line []byte, done <-chan struct{}) error {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.deliver(line)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.maxRetries {
+			return err
+		}
+
+		select {
+		case <-done:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// deliver posts the event to the webhook, returning whether a failure may be
+// temporary
+func (w *webhookSink) deliver(line []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(line))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sessionevents.SignatureHeader, w.sign(line))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// sign returns the signatures of the body with each signing key, so that
+// the webhook can verify it with either key while the keys are rotated
+func (w *webhookSink) sign(body []byte) string {
+	signatures := make([]string, 0, len(w.keys))
+	for _, key := range w.keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		signatures = append(signatures, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(signatures, ",")
+}
+
+func (w *webhookSink) close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhook sink", func() {
+	const signingKey = "0123456789abcdef0123456789abcdef"
+
+	var server *httptest.Server
+	var keyFile string
+
+	var mu sync.Mutex
+	var received []Event
+	// statuses are the statuses of the next responses of the server
+	var statuses []int
+
+	BeforeEach(func() {
+		received = nil
+		statuses = nil
+
+		f, err := ioutil.TempFile("", "oauth2-proxy-audit-key")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(signingKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		keyFile = f.Name()
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(statuses) > 0 {
+				status := statuses[0]
+				statuses = statuses[1:]
+				rw.WriteHeader(status)
+				return
+			}
+
+			body, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+			mac := hmac.New(sha256.New, []byte(signingKey))
+			mac.Write(body)
+			Expect(req.Header.Get(sessionevents.SignatureHeader)).To(Equal("sha256=" + hex.EncodeToString(mac.Sum(nil))))
+
+			var event Event
+			Expect(json.Unmarshal(body, &event)).To(Succeed())
+			received = append(received, event)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.Remove(keyFile)).To(Succeed())
+	})
+
+	newSink := func() *webhookSink {
+		s, err := newWebhookSink(options.Audit{
+			WebhookURL:        server.URL,
+			SigningKeyFiles:   []string{keyFile},
+			WebhookMaxRetries: 2,
+			WebhookTimeout:    time.Second,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		s.backoff = time.Millisecond
+		return s
+	}
+
+	receivedEvents := func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event{}, received...)
+	}
+
+	It("delivers the signed events", func() {
+		Expect(newSink().write([]byte(`{"schemaVersion":"1","type":"session_revoked"}`), nil)).To(Succeed())
+		Expect(receivedEvents()).To(Equal([]Event{{SchemaVersion: SchemaVersion, Type: options.AuditEventSessionRevoked}}))
+	})
+
+	It("retries the deliveries that may succeed later", func() {
+		statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		Expect(newSink().write([]byte(`{"type":"session_created"}`), nil)).To(Succeed())
+		Expect(receivedEvents()).To(HaveLen(1))
+	})
+
+	It("gives up after the maximum number of retries", func() {
+		statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+		Expect(newSink().write([]byte(`{"type":"session_created"}`), nil)).To(MatchError("unexpected status 502"))
+		Expect(receivedEvents()).To(BeEmpty())
+	})
+
+	It("doesn't retry the events the webhook rejects", func() {
+		statuses = []int{http.StatusBadRequest}
+		Expect(newSink().write([]byte(`{"type":"session_created"}`), nil)).To(MatchError("unexpected status 400"))
+		Expect(statuses).To(BeEmpty())
+	})
+
+	It("stops retrying once the sink is stopped", func() {
+		statuses = []int{http.StatusBadGateway, http.StatusBadGateway}
+		s := newSink()
+		s.backoff = time.Hour
+		done := make(chan struct{})
+		close(done)
+		Expect(s.write([]byte(`{"type":"session_created"}`), done)).To(MatchError("unexpected status 502"))
+		Expect(statuses).To(HaveLen(1))
+	})
+
+	It("requires a signing key", func() {
+		_, err := newWebhookSink(options.Audit{
+			WebhookURL:     server.URL,
+			WebhookTimeout: time.Second,
+		})
+		Expect(err).To(MatchError("no signing key file configured"))
+	})
+})
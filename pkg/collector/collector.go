@@ -0,0 +1,19 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Register registers the collector, returning the existing collector if one
+// has already been registered, so that metrics created again when the proxy
+// is reloaded are reused.
+// It panics if the collector can't be registered, like MustRegister.
+func Register(registerer prometheus.Registerer, collector prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(collector); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return collector
+}
@@ -0,0 +1,44 @@
+package collector
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Register", func() {
+	newCounter := func() prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "oauth2_proxy_test_total",
+			Help: "Total number of tests.",
+		})
+	}
+
+	It("registers the collector", func() {
+		registry := prometheus.NewRegistry()
+		counter := newCounter()
+
+		Expect(Register(registry, counter)).To(BeIdenticalTo(counter))
+		Expect(registry.Unregister(counter)).To(BeTrue())
+	})
+
+	It("returns the collector that is already registered", func() {
+		registry := prometheus.NewRegistry()
+		counter := newCounter()
+		Expect(Register(registry, counter)).To(BeIdenticalTo(counter))
+
+		Expect(Register(registry, newCounter())).To(BeIdenticalTo(counter))
+	})
+
+	It("panics when the collector can't be registered", func() {
+		registry := prometheus.NewRegistry()
+		Register(registry, newCounter())
+
+		Expect(func() {
+			Register(registry, prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "oauth2_proxy_test_total",
+				Help: "Number of tests.",
+			}))
+		}).To(Panic())
+	})
+})
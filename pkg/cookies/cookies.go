@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
@@ -41,6 +42,70 @@ func MakeCookieFromOptions(req *http.Request, name string, value string, opts *o
 	return c
 }
 
+// MakeClearCookiesFromOptions constructs expired cookies that clear the named
+// cookie, and any cookies split from it, that are present in the request from
+// every configured cookie domain.
+// The cookies may have been set from any host matching the domains, so only
+// clearing them from the domain matching this request could leave them behind.
+func MakeClearCookiesFromOptions(req *http.Request, name string, opts *options.Cookie, now time.Time) []*http.Cookie {
+	// matches name, name_<number>
+	nameRegex := regexp.MustCompile(fmt.Sprintf("^%s(_\\d+)?$", regexp.QuoteMeta(name)))
+	names := []string{}
+	for _, c := range req.Cookies() {
+		if nameRegex.MatchString(c.Name) {
+			names = append(names, c.Name)
+		}
+	}
+	return makeClearCookies(names, opts, now)
+}
+
+// MakeClearAllCookiesFromOptions constructs expired cookies that clear every
+// OAuth2 Proxy cookie present in the request from every configured cookie
+// domain: the session cookie and any cookies split from it, and the other
+// cookies named after it, such as the CSRF and provider cookies.
+func MakeClearAllCookiesFromOptions(req *http.Request, opts *options.Cookie, now time.Time) []*http.Cookie {
+	names := []string{}
+	for _, c := range req.Cookies() {
+		if c.Name == opts.Name || strings.HasPrefix(c.Name, opts.Name+"_") {
+			names = append(names, c.Name)
+		}
+	}
+	return makeClearCookies(names, opts, now)
+}
+
+// makeClearCookies constructs expired cookies clearing each of the named
+// cookies from every configured cookie domain
+func makeClearCookies(names []string, opts *options.Cookie, now time.Time) []*http.Cookie {
+	domains := []string{""}
+	if len(opts.Domains) > 0 {
+		domains = opts.Domains
+	}
+
+	cookies := []*http.Cookie{}
+	seen := make(map[string]struct{})
+	for _, domain := range domains {
+		for _, n := range names {
+			key := n + ";" + domain
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			cookies = append(cookies, &http.Cookie{
+				Name:     n,
+				Value:    "",
+				Path:     opts.Path,
+				Domain:   domain,
+				Expires:  now.Add(time.Hour * -1),
+				HttpOnly: opts.HTTPOnly,
+				Secure:   opts.Secure,
+				SameSite: ParseSameSite(opts.SameSite),
+			})
+		}
+	}
+	return cookies
+}
+
 // GetCookieDomain returns the correct cookie domain given a list of domains
 // by checking the X-Fowarded-Host and host header of an an http request
 func GetCookieDomain(req *http.Request, cookieDomains []string) string {
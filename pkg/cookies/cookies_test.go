@@ -3,8 +3,10 @@ package cookies
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -76,4 +78,105 @@ var _ = Describe("Cookie Tests", func() {
 			}),
 		)
 	})
+
+	Context("MakeClearCookiesFromOptions", func() {
+		type makeClearCookiesTableInput struct {
+			requestCookies []string
+			cookieDomains  []string
+			expectedClears []string
+		}
+
+		DescribeTable("should clear every cookie for the session",
+			func(in makeClearCookiesTableInput) {
+				req, err := http.NewRequest(
+					http.MethodGet,
+					fmt.Sprintf("https://%s/%s", cookieDomain, cookiePath),
+					nil,
+				)
+				Expect(err).ToNot(HaveOccurred())
+				for _, name := range in.requestCookies {
+					req.AddCookie(&http.Cookie{Name: name, Value: "value"})
+				}
+
+				opts := &options.Cookie{
+					Name:     cookieName,
+					Path:     cookiePath,
+					Domains:  in.cookieDomains,
+					HTTPOnly: true,
+					Secure:   true,
+				}
+				now := time.Unix(nowEpoch, 0)
+
+				clears := []string{}
+				for _, c := range MakeClearCookiesFromOptions(req, cookieName, opts, now) {
+					Expect(c.Value).To(BeEmpty())
+					Expect(c.Path).To(Equal(cookiePath))
+					Expect(c.Expires).To(Equal(now.Add(-time.Hour)))
+					clears = append(clears, c.Name+"@"+c.Domain)
+				}
+				Expect(clears).To(ConsistOf(in.expectedClears))
+			},
+			Entry("a single cookie without domains", makeClearCookiesTableInput{
+				requestCookies: []string{cookieName, "other"},
+				expectedClears: []string{cookieName + "@"},
+			}),
+			Entry("split cookies without domains", makeClearCookiesTableInput{
+				requestCookies: []string{cookieName + "_0", cookieName + "_1", cookieName + "_2", cookieName + "_csrf"},
+				expectedClears: []string{cookieName + "_0@", cookieName + "_1@", cookieName + "_2@"},
+			}),
+			Entry("split cookies in every domain", makeClearCookiesTableInput{
+				requestCookies: []string{cookieName + "_0", cookieName + "_1"},
+				cookieDomains:  []string{cookieDomain, ".cookies.test"},
+				expectedClears: []string{
+					cookieName + "_0@" + cookieDomain,
+					cookieName + "_1@" + cookieDomain,
+					cookieName + "_0@.cookies.test",
+					cookieName + "_1@.cookies.test",
+				},
+			}),
+			Entry("no cookies in the request", makeClearCookiesTableInput{
+				requestCookies: []string{"other"},
+				cookieDomains:  []string{cookieDomain},
+				expectedClears: []string{},
+			}),
+		)
+	})
+
+	Context("MakeClearAllCookiesFromOptions", func() {
+		It("should clear every OAuth2 Proxy cookie in every domain", func() {
+			req, err := http.NewRequest(
+				http.MethodGet,
+				fmt.Sprintf("https://%s/%s", cookieDomain, cookiePath),
+				nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			for _, name := range []string{cookieName + "_0", cookieName + "_1", cookieName + "_csrf", cookieName + "_provider", cookieName + "other", "other"} {
+				req.AddCookie(&http.Cookie{Name: name, Value: "value"})
+			}
+
+			opts := &options.Cookie{
+				Name:    cookieName,
+				Path:    cookiePath,
+				Domains: []string{cookieDomain, ".cookies.test"},
+			}
+			now := time.Unix(nowEpoch, 0)
+
+			clears := []string{}
+			for _, c := range MakeClearAllCookiesFromOptions(req, opts, now) {
+				Expect(c.Value).To(BeEmpty())
+				Expect(c.Expires).To(Equal(now.Add(-time.Hour)))
+				clears = append(clears, c.Name+"@"+c.Domain)
+			}
+			Expect(clears).To(ConsistOf(
+				cookieName+"_0@"+cookieDomain,
+				cookieName+"_1@"+cookieDomain,
+				cookieName+"_csrf@"+cookieDomain,
+				cookieName+"_provider@"+cookieDomain,
+				cookieName+"_0@.cookies.test",
+				cookieName+"_1@.cookies.test",
+				cookieName+"_csrf@.cookies.test",
+				cookieName+"_provider@.cookies.test",
+			))
+		})
+	})
 })
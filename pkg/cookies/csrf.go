@@ -21,11 +21,14 @@ type CSRF interface {
 	CheckOAuthState(string) bool
 	CheckOIDCNonce(string) bool
 	GetCodeVerifier() string
+	GetAppState() string
 
 	SetSessionNonce(s *sessions.SessionState)
+	SetAppState(string)
 
 	SetCookie(http.ResponseWriter, *http.Request) (*http.Cookie, error)
 	ClearCookie(http.ResponseWriter, *http.Request)
+	EncodeState() (string, error)
 }
 
 type csrf struct {
@@ -44,6 +47,10 @@ type csrf struct {
 	// authentication code.
 	CodeVerifier string `msgpack:"cv,omitempty"`
 
+	// AppState holds the opaque value the application started the login flow
+	// with, which is returned to it in the redirect after the callback.
+	AppState string `msgpack:"as,omitempty"`
+
 	cookieOpts *options.Cookie
 	time       clock.Clock
 }
@@ -51,6 +58,10 @@ type csrf struct {
 // csrtStateTrim will indicate the length of the state trimmed for the name of the csrf cookie
 const csrfStateLength int = 9
 
+// csrfStateName is the name the CSRF is signed with when it is carried by the
+// OAuth state parameter rather than a cookie
+const csrfStateName = "csrf_state"
+
 // NewCSRF creates a CSRF with random nonces
 func NewCSRF(opts *options.Cookie, codeVerifier string) (CSRF, error) {
 	state, err := encryption.Nonce(32)
@@ -84,6 +95,12 @@ func LoadCSRFCookie(req *http.Request, opts *options.Cookie) (CSRF, error) {
 	return decodeCSRFCookie(cookie, opts)
 }
 
+// LoadCSRFState loads a CSRF object from the encoded CSRF carried by the OAuth
+// state parameter, for login flows that don't set cookies
+func LoadCSRFState(state string, opts *options.Cookie) (CSRF, error) {
+	return decodeCSRFCookie(&http.Cookie{Name: csrfStateName, Value: state}, opts)
+}
+
 // GenerateCookieName in case cookie options state that CSRF cookie has fixed name then set fixed name, otherwise
 // build name based on the state
 func GenerateCookieName(req *http.Request, opts *options.Cookie) string {
@@ -100,6 +117,16 @@ func (c *csrf) GetCodeVerifier() string {
 	return c.CodeVerifier
 }
 
+// GetAppState returns the app state of the login flow
+func (c *csrf) GetAppState() string {
+	return c.AppState
+}
+
+// SetAppState sets the app state of the login flow
+func (c *csrf) SetAppState(appState string) {
+	c.AppState = appState
+}
+
 // HashOAuthState returns the hash of the OAuth state nonce
 func (c *csrf) HashOAuthState() string {
 	return encryption.HashNonce(c.OAuthState)
@@ -158,9 +185,22 @@ func (c *csrf) ClearCookie(rw http.ResponseWriter, req *http.Request) {
 	))
 }
 
+// EncodeState encodes the CSRF to a signed value for the OAuth state
+// parameter, in place of the CSRF cookie. The value is signed and encrypted
+// like the cookie, so only the proxy can have issued it.
+func (c *csrf) EncodeState() (string, error) {
+	return c.encode(csrfStateName)
+}
+
 // encodeCookie MessagePack encodes and encrypts the CSRF and then creates a
 // signed cookie value
 func (c *csrf) encodeCookie() (string, error) {
+	return c.encode(c.cookieName())
+}
+
+// encode MessagePack encodes and encrypts the CSRF and then creates a
+// signed cookie value with the name
+func (c *csrf) encode(name string) (string, error) {
 	packed, err := msgpack.Marshal(c)
 	if err != nil {
 		return "", fmt.Errorf("error marshalling CSRF to msgpack: %v", err)
@@ -171,7 +211,7 @@ func (c *csrf) encodeCookie() (string, error) {
 		return "", err
 	}
 
-	return encryption.SignedValue(c.cookieOpts.Secret, c.cookieName(), encrypted, c.time.Now())
+	return encryption.SignedValue(c.cookieOpts.Secret, name, encrypted, c.time.Now())
 }
 
 // decodeCSRFCookie validates the signature then decrypts and decodes a CSRF
@@ -107,6 +107,20 @@ var _ = Describe("CSRF Cookie Tests", func() {
 			Expect(decoded.OIDCNonce).To(Equal([]byte(csrfNonce)))
 		})
 
+		It("encodes and decodes the app state", func() {
+			privateCSRF.SetAppState("deep-link")
+
+			encoded, err := privateCSRF.encodeCookie()
+			Expect(err).ToNot(HaveOccurred())
+
+			decoded, err := decodeCSRFCookie(&http.Cookie{
+				Name:  privateCSRF.cookieName(),
+				Value: encoded,
+			}, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.GetAppState()).To(Equal("deep-link"))
+		})
+
 		It("signs the encoded cookie value", func() {
 			encoded, err := privateCSRF.encodeCookie()
 			Expect(err).ToNot(HaveOccurred())
@@ -121,6 +135,32 @@ var _ = Describe("CSRF Cookie Tests", func() {
 		})
 	})
 
+	Context("EncodeState and LoadCSRFState", func() {
+		It("encodes and loads the same nonces", func() {
+			privateCSRF.OAuthState = []byte(csrfState)
+			privateCSRF.OIDCNonce = []byte(csrfNonce)
+			privateCSRF.CodeVerifier = "verifier"
+
+			encoded, err := publicCSRF.EncodeState()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(encoded).ToNot(ContainSubstring(":"))
+
+			loaded, err := LoadCSRFState(encoded, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.CheckOAuthState(publicCSRF.HashOAuthState())).To(BeTrue())
+			Expect(loaded.CheckOIDCNonce(publicCSRF.HashOIDCNonce())).To(BeTrue())
+			Expect(loaded.GetCodeVerifier()).To(Equal("verifier"))
+		})
+
+		It("rejects CSRF cookie values", func() {
+			encoded, err := privateCSRF.encodeCookie()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = LoadCSRFState(encoded, cookieOpts)
+			Expect(err).To(MatchError("CSRF cookie failed validation"))
+		})
+	})
+
 	Context("Cookie Management", func() {
 		var req *http.Request
 
@@ -0,0 +1,61 @@
+package cookies
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// FormCSRFTokenField is the name of the form field the sign-in and sign-out
+// forms post their CSRF token in
+const FormCSRFTokenField = "csrf_token"
+
+// MakeFormCSRFCookie generates a new CSRF token for the forms rendered by
+// OAuth2 Proxy, and constructs the signed cookie it is checked against when
+// the form is posted.
+// The cookie expires with the CSRF cookie expiration, so that forms left open
+// for longer have to be reloaded.
+// It is separate from the CSRF cookie of the OAuth flow, which is only
+// checked against the state of the callback.
+func MakeFormCSRFCookie(req *http.Request, opts *options.Cookie, now time.Time) (string, *http.Cookie, error) {
+	nonce, err := encryption.Nonce(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate form CSRF token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(nonce)
+
+	name := formCSRFCookieName(opts)
+	value, err := encryption.SignedValue(opts.Secret, name, []byte(token), now)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not sign form CSRF cookie: %v", err)
+	}
+	return token, MakeCookieFromOptions(req, name, value, opts, opts.CSRFExpire, now), nil
+}
+
+// CheckFormCSRFToken checks that the CSRF token posted in a form matches the
+// token of a validly signed, unexpired form CSRF cookie.
+func CheckFormCSRFToken(req *http.Request, opts *options.Cookie, token string) bool {
+	if token == "" {
+		return false
+	}
+	cookie, err := req.Cookie(formCSRFCookieName(opts))
+	if err != nil {
+		return false
+	}
+	value, _, ok := encryption.Validate(cookie, opts.Secret, opts.CSRFExpire)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare(value, []byte(token)) == 1
+}
+
+// formCSRFCookieName is the name of the form CSRF cookie, derived from the
+// session cookie name
+func formCSRFCookieName(opts *options.Cookie) string {
+	return fmt.Sprintf("%s_form_csrf", opts.Name)
+}
@@ -0,0 +1,106 @@
+package cookies
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Form CSRF Cookie Tests", func() {
+	var cookieOpts *options.Cookie
+	var req *http.Request
+
+	BeforeEach(func() {
+		cookieOpts = &options.Cookie{
+			Name:       cookieName,
+			Secret:     cookieSecret,
+			Domains:    []string{cookieDomain},
+			Path:       cookiePath,
+			Secure:     true,
+			HTTPOnly:   true,
+			SameSite:   "lax",
+			CSRFExpire: 15 * time.Minute,
+		}
+		req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://%s%s", cookieDomain, cookiePath), nil)
+	})
+
+	It("makes a short-lived cookie with the cookie options", func() {
+		now := time.Now()
+		token, cookie, err := MakeFormCSRFCookie(req, cookieOpts, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).ToNot(BeEmpty())
+
+		Expect(cookie.Name).To(Equal(cookieName + "_form_csrf"))
+		Expect(cookie.Value).ToNot(ContainSubstring(token))
+		Expect(cookie.Domain).To(Equal(cookieDomain))
+		Expect(cookie.Path).To(Equal(cookiePath))
+		Expect(cookie.Secure).To(BeTrue())
+		Expect(cookie.HttpOnly).To(BeTrue())
+		Expect(cookie.SameSite).To(Equal(http.SameSiteLaxMode))
+		Expect(cookie.Expires).To(Equal(now.Add(cookieOpts.CSRFExpire)))
+	})
+
+	It("generates a new token each time", func() {
+		first, _, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		second, _, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first).ToNot(Equal(second))
+	})
+
+	It("accepts the token of the cookie", func() {
+		token, cookie, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		req.AddCookie(cookie)
+
+		Expect(CheckFormCSRFToken(req, cookieOpts, token)).To(BeTrue())
+	})
+
+	It("rejects another token", func() {
+		_, cookie, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		other, _, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		req.AddCookie(cookie)
+
+		Expect(CheckFormCSRFToken(req, cookieOpts, other)).To(BeFalse())
+		Expect(CheckFormCSRFToken(req, cookieOpts, "")).To(BeFalse())
+	})
+
+	It("rejects a cookie that has been tampered with", func() {
+		token, cookie, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		other, otherCookie, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Swap in the value of the other cookie, keeping the signature
+		parts := strings.Split(cookie.Value, "|")
+		parts[0] = strings.Split(otherCookie.Value, "|")[0]
+		cookie.Value = strings.Join(parts, "|")
+		req.AddCookie(cookie)
+
+		Expect(CheckFormCSRFToken(req, cookieOpts, token)).To(BeFalse())
+		Expect(CheckFormCSRFToken(req, cookieOpts, other)).To(BeFalse())
+	})
+
+	It("rejects an expired cookie", func() {
+		token, cookie, err := MakeFormCSRFCookie(req, cookieOpts, time.Now().Add(-16*time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		req.AddCookie(cookie)
+
+		Expect(CheckFormCSRFToken(req, cookieOpts, token)).To(BeFalse())
+	})
+
+	It("rejects a token without a cookie", func() {
+		token, _, err := MakeFormCSRFCookie(req, cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(CheckFormCSRFToken(req, cookieOpts, token)).To(BeFalse())
+	})
+})
@@ -0,0 +1,47 @@
+package cookies
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// ProviderCookieExpiration is how long the provider a user last signed in
+// with is remembered for
+const ProviderCookieExpiration = 365 * 24 * time.Hour
+
+// MakeProviderCookie constructs a signed cookie remembering the ID of the
+// provider the user signed in with.
+// The cookie only holds the provider ID, which isn't sensitive, but is signed
+// so that it can't be changed to select another provider.
+func MakeProviderCookie(req *http.Request, providerID string, opts *options.Cookie, now time.Time) (*http.Cookie, error) {
+	name := providerCookieName(opts)
+	value, err := encryption.SignedValue(opts.Secret, name, []byte(providerID), now)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign provider cookie: %v", err)
+	}
+	return MakeCookieFromOptions(req, name, value, opts, ProviderCookieExpiration, now), nil
+}
+
+// LoadProviderCookie returns the ID of the provider the user last signed in
+// with, if the request has a validly signed provider cookie.
+func LoadProviderCookie(req *http.Request, opts *options.Cookie) (string, bool) {
+	cookie, err := req.Cookie(providerCookieName(opts))
+	if err != nil {
+		return "", false
+	}
+	value, _, ok := encryption.Validate(cookie, opts.Secret, ProviderCookieExpiration)
+	if !ok {
+		return "", false
+	}
+	return string(value), true
+}
+
+// providerCookieName is the name of the provider cookie, derived from the
+// session cookie name
+func providerCookieName(opts *options.Cookie) string {
+	return fmt.Sprintf("%s_provider", opts.Name)
+}
@@ -0,0 +1,76 @@
+package cookies
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Provider Cookie Tests", func() {
+	var cookieOpts *options.Cookie
+	var req *http.Request
+
+	BeforeEach(func() {
+		cookieOpts = &options.Cookie{
+			Name:     cookieName,
+			Secret:   cookieSecret,
+			Domains:  []string{cookieDomain},
+			Path:     cookiePath,
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: "lax",
+		}
+		req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://%s%s", cookieDomain, cookiePath), nil)
+	})
+
+	It("makes a long-lived cookie with the cookie options", func() {
+		now := time.Now()
+		cookie, err := MakeProviderCookie(req, "keycloak", cookieOpts, now)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(cookie.Name).To(Equal(cookieName + "_provider"))
+		Expect(cookie.Domain).To(Equal(cookieDomain))
+		Expect(cookie.Path).To(Equal(cookiePath))
+		Expect(cookie.Secure).To(BeTrue())
+		Expect(cookie.HttpOnly).To(BeTrue())
+		Expect(cookie.SameSite).To(Equal(http.SameSiteLaxMode))
+		Expect(cookie.Expires).To(Equal(now.Add(ProviderCookieExpiration)))
+	})
+
+	It("loads the provider from a signed cookie", func() {
+		cookie, err := MakeProviderCookie(req, "keycloak", cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		req.AddCookie(cookie)
+
+		providerID, ok := LoadProviderCookie(req, cookieOpts)
+		Expect(ok).To(BeTrue())
+		Expect(providerID).To(Equal("keycloak"))
+	})
+
+	It("rejects a cookie that has been tampered with", func() {
+		cookie, err := MakeProviderCookie(req, "keycloak", cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		other, err := MakeProviderCookie(req, "github", cookieOpts, time.Now())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Swap in the value of the other provider, keeping the signature
+		parts := strings.Split(cookie.Value, "|")
+		parts[0] = strings.Split(other.Value, "|")[0]
+		cookie.Value = strings.Join(parts, "|")
+		req.AddCookie(cookie)
+
+		_, ok := LoadProviderCookie(req, cookieOpts)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("returns no provider without a cookie", func() {
+		_, ok := LoadProviderCookie(req, cookieOpts)
+		Expect(ok).To(BeFalse())
+	})
+})
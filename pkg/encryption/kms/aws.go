@@ -0,0 +1,242 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsKMS wraps data keys with an AWS KMS symmetric key, calling the KMS API
+// directly with requests signed with Signature Version 4.
+type awsKMS struct {
+	keyID    string
+	region   string
+	service  string
+	endpoint string
+
+	credentials awsCredentials
+	client      *http.Client
+	now         func() time.Time
+}
+
+// awsCredentials are the credentials requests to AWS KMS are signed with
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// NewAWSKMS creates a KMS that wraps data keys with the AWS KMS key, given as
+// a key ID, key ARN or alias.
+// The credentials and the region, unless the key is given as an ARN, are
+// taken from the standard AWS environment variables.
+// Data keys are wrapped with the current key material of the key, so the key
+// can be rotated within AWS KMS.
+func NewAWSKMS(keyID string) (KMS, error) {
+	if keyID == "" {
+		return nil, errors.New("an aws kms requires a key id, arn or alias")
+	}
+
+	region := awsRegion(keyID)
+	if region == "" {
+		return nil, errors.New("an aws kms requires a region: set AWS_REGION or give the key as an ARN")
+	}
+
+	creds := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return nil, errors.New("an aws kms requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+
+	return newAWSKMS(keyID, region, fmt.Sprintf("https://kms.%s.amazonaws.com/", region), creds), nil
+}
+
+func newAWSKMS(keyID, region, endpoint string, creds awsCredentials) *awsKMS {
+	return &awsKMS{
+		keyID:       keyID,
+		region:      region,
+		service:     "kms",
+		endpoint:    endpoint,
+		credentials: creds,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		now:         time.Now,
+	}
+}
+
+// awsRegion returns the region of a key ARN, or the region configured in the
+// environment
+func awsRegion(keyID string) string {
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if parts := strings.Split(keyID, ":"); len(parts) >= 6 && parts[0] == "arn" {
+		return parts[3]
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// KeyID returns the key ID, ARN or alias of the key
+func (k *awsKMS) KeyID() string {
+	return k.keyID
+}
+
+// Wrap encrypts the data key with the key
+func (k *awsKMS) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+	err := k.call(ctx, "Encrypt", map[string]interface{}{
+		"KeyId":     k.keyID,
+		"Plaintext": dataKey,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key with %s: %w", k.keyID, err)
+	}
+	return resp.CiphertextBlob, nil
+}
+
+// Unwrap decrypts the data key with the key identified by keyID
+func (k *awsKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+	err := k.call(ctx, "Decrypt", map[string]interface{}{
+		"KeyId":          keyID,
+		"CiphertextBlob": wrapped,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key with %s: %w", keyID, err)
+	}
+	return resp.Plaintext, nil
+}
+
+// call makes a signed request to an action of the KMS API.
+// Byte slices in the request and response are base64 encoded by the JSON
+// encoding, as the API expects.
+func (k *awsKMS) call(ctx context.Context, action string, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.sign(req, body)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Type != "" {
+			return fmt.Errorf("aws kms returned %d: %s: %s", resp.StatusCode, apiErr.Type, apiErr.Message)
+		}
+		return fmt.Errorf("aws kms returned %d: %s", resp.StatusCode, respBody)
+	}
+	return json.Unmarshal(respBody, output)
+}
+
+// sign adds the Signature Version 4 authorization for the request to its
+// headers
+func (k *awsKMS) sign(req *http.Request, body []byte) {
+	now := k.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := strings.Join([]string{now.Format("20060102"), k.region, k.service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if k.credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", k.credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + k.credentials.secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), k.region, k.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		k.credentials.accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes the query sorted by key, as url.Values.Encode does,
+// with spaces escaped as %20 rather than +
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
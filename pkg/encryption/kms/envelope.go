@@ -0,0 +1,209 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+const (
+	// dataKeySize is the size of the AES-256 data keys
+	dataKeySize = 32
+
+	// maxCachedDataKeys bounds the number of unwrapped data keys kept
+	maxCachedDataKeys = 1024
+)
+
+// envelopePrefix marks envelope encrypted values, so that values stored
+// before envelope encryption was enabled can still be read
+var envelopePrefix = []byte("oauth2-proxy-kms-v1:")
+
+// ErrMalformedEnvelope is returned when an envelope encrypted value can't be
+// parsed
+var ErrMalformedEnvelope = errors.New("malformed envelope encrypted value")
+
+// Envelope encrypts values with a data key generated locally, and stores the
+// data key wrapped by a KMS alongside the ciphertext.
+// A single data key is used for all values encrypted by the Envelope, so that
+// the KMS is only called once to wrap it. Unwrapped data keys are cached, so
+// that the KMS is only called once per data key to decrypt values.
+type Envelope struct {
+	kms KMS
+
+	mu      sync.Mutex
+	current *dataKey
+	cache   map[string]encryption.Cipher
+}
+
+// dataKey is a data key along with the key it is wrapped with
+type dataKey struct {
+	keyID   string
+	wrapped []byte
+	cipher  encryption.Cipher
+}
+
+// NewEnvelope creates an Envelope wrapping its data keys with the KMS
+func NewEnvelope(kms KMS) *Envelope {
+	return &Envelope{
+		kms:   kms,
+		cache: make(map[string]encryption.Cipher),
+	}
+}
+
+// IsEnveloped returns whether the value was encrypted by an Envelope
+func IsEnveloped(value []byte) bool {
+	return bytes.HasPrefix(value, envelopePrefix)
+}
+
+// Encrypt encrypts the value with the current data key.
+// A new data key is generated, and wrapped with the current key of the KMS,
+// when the KMS key has changed since the data key was generated. Values
+// decrypted with previous data keys are therefore re-wrapped with the current
+// key when they are next encrypted.
+func (e *Envelope) Encrypt(ctx context.Context, value []byte) ([]byte, error) {
+	key, err := e.currentDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := key.cipher.Encrypt(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt value with the data key: %w", err)
+	}
+
+	// <prefix><key ID length><key ID><wrapped key length><wrapped key><ciphertext>
+	out := make([]byte, 0, len(envelopePrefix)+4+len(key.keyID)+len(key.wrapped)+len(ciphertext))
+	out = append(out, envelopePrefix...)
+	out = appendField(out, []byte(key.keyID))
+	out = appendField(out, key.wrapped)
+	return append(out, ciphertext...), nil
+}
+
+// Decrypt decrypts a value encrypted by Encrypt, unwrapping its data key with
+// the KMS unless it is cached.
+func (e *Envelope) Decrypt(ctx context.Context, value []byte) ([]byte, error) {
+	if !IsEnveloped(value) {
+		return nil, ErrMalformedEnvelope
+	}
+	rest := value[len(envelopePrefix):]
+
+	keyID, rest, ok := readField(rest)
+	if !ok {
+		return nil, ErrMalformedEnvelope
+	}
+	wrapped, ciphertext, ok := readField(rest)
+	if !ok {
+		return nil, ErrMalformedEnvelope
+	}
+
+	c, err := e.dataKeyCipher(ctx, string(keyID), wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.Decrypt(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value with the data key: %w", err)
+	}
+	return plaintext, nil
+}
+
+// currentDataKey returns the data key values are encrypted with, generating
+// and wrapping it if needed
+func (e *Envelope) currentDataKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keyID := e.kms.KeyID()
+	if e.current != nil && e.current.keyID == keyID {
+		return e.current, nil
+	}
+
+	raw, err := encryption.Nonce(dataKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a data key: %w", err)
+	}
+	c, err := encryption.NewGCMCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make an AES-GCM cipher from the data key: %w", err)
+	}
+	wrapped, err := e.kms.Wrap(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	e.current = &dataKey{
+		keyID:   keyID,
+		wrapped: wrapped,
+		cipher:  c,
+	}
+	e.cacheCipher(keyID, wrapped, c)
+	return e.current, nil
+}
+
+// dataKeyCipher returns the cipher of a wrapped data key, unwrapping it with
+// the KMS unless it is cached
+func (e *Envelope) dataKeyCipher(ctx context.Context, keyID string, wrapped []byte) (encryption.Cipher, error) {
+	e.mu.Lock()
+	c, ok := e.cache[cacheKey(keyID, wrapped)]
+	e.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	raw, err := e.kms.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c, err = encryption.NewGCMCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make an AES-GCM cipher from the data key: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cacheCipher(keyID, wrapped, c)
+	return c, nil
+}
+
+// cacheCipher caches the cipher of a data key, evicting an arbitrary data key
+// when the cache is full. e.mu must be held.
+func (e *Envelope) cacheCipher(keyID string, wrapped []byte, c encryption.Cipher) {
+	if len(e.cache) >= maxCachedDataKeys {
+		for key := range e.cache {
+			delete(e.cache, key)
+			break
+		}
+	}
+	e.cache[cacheKey(keyID, wrapped)] = c
+}
+
+func cacheKey(keyID string, wrapped []byte) string {
+	return keyID + "\x00" + string(wrapped)
+}
+
+// appendField appends the value prefixed by its length
+func appendField(out, value []byte) []byte {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(value)))
+	return append(append(out, length[:]...), value...)
+}
+
+// readField reads a value prefixed by its length, returning the rest of the
+// input
+func readField(in []byte) ([]byte, []byte, bool) {
+	if len(in) < 2 {
+		return nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(in))
+	in = in[2:]
+	if len(in) < length {
+		return nil, nil, false
+	}
+	return in[:length], in[length:], true
+}
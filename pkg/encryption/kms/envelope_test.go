@@ -0,0 +1,136 @@
+package kms
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingKMS counts the calls made to a KMS
+type countingKMS struct {
+	KMS
+	wraps   int
+	unwraps int
+}
+
+func (k *countingKMS) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	k.wraps++
+	return k.KMS.Wrap(ctx, dataKey)
+}
+
+func (k *countingKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	k.unwraps++
+	return k.KMS.Unwrap(ctx, keyID, wrapped)
+}
+
+func newCountingKMS(t *testing.T, keys ...string) *countingKMS {
+	rawKeys := [][]byte{}
+	for _, key := range keys {
+		rawKeys = append(rawKeys, []byte(key))
+	}
+	local, err := NewLocalKMS(rawKeys...)
+	require.NoError(t, err)
+	return &countingKMS{KMS: local}
+}
+
+func TestEnvelopeEncryptAndDecrypt(t *testing.T) {
+	ctx := context.Background()
+	keys := newCountingKMS(t, "0123456789abcdef")
+	envelope := NewEnvelope(keys)
+
+	first, err := envelope.Encrypt(ctx, []byte("first"))
+	require.NoError(t, err)
+	second, err := envelope.Encrypt(ctx, []byte("second"))
+	require.NoError(t, err)
+	assert.True(t, IsEnveloped(first))
+	assert.NotContains(t, string(first), "first")
+
+	// The data key is only wrapped once, and isn't unwrapped while cached
+	plaintext, err := envelope.Decrypt(ctx, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(plaintext))
+	plaintext, err = envelope.Decrypt(ctx, second)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(plaintext))
+	assert.Equal(t, 1, keys.wraps)
+	assert.Equal(t, 0, keys.unwraps)
+
+	// Another Envelope, eg. of another replica, unwraps the data key once
+	other := NewEnvelope(keys)
+	for _, value := range [][]byte{first, second} {
+		_, err = other.Decrypt(ctx, value)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, keys.unwraps)
+}
+
+func TestEnvelopeRotation(t *testing.T) {
+	ctx := context.Background()
+
+	ciphertext, err := NewEnvelope(newCountingKMS(t, "0123456789abcdef")).Encrypt(ctx, []byte("value"))
+	require.NoError(t, err)
+
+	// Values wrapped with the old key can be read once the key is rotated
+	rotated := NewEnvelope(newCountingKMS(t, "fedcba9876543210", "0123456789abcdef"))
+	plaintext, err := rotated.Decrypt(ctx, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(plaintext))
+
+	// and are wrapped with the new key when encrypted again
+	ciphertext, err = rotated.Encrypt(ctx, plaintext)
+	require.NoError(t, err)
+	plaintext, err = NewEnvelope(newCountingKMS(t, "fedcba9876543210")).Decrypt(ctx, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(plaintext))
+}
+
+func TestEnvelopeDecryptErrors(t *testing.T) {
+	ctx := context.Background()
+	envelope := NewEnvelope(newCountingKMS(t, "0123456789abcdef"))
+	ciphertext, err := envelope.Encrypt(ctx, []byte("value"))
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		value       []byte
+		expectedErr string
+	}{
+		"without the envelope prefix": {
+			value:       []byte("value"),
+			expectedErr: ErrMalformedEnvelope.Error(),
+		},
+		"with a truncated envelope": {
+			value:       ciphertext[:len(envelopePrefix)+4],
+			expectedErr: ErrMalformedEnvelope.Error(),
+		},
+		"with a modified ciphertext": {
+			value:       append(append([]byte{}, ciphertext[:len(ciphertext)-1]...), ciphertext[len(ciphertext)-1]^1),
+			expectedErr: "failed to decrypt value with the data key: cipher: message authentication failed",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := envelope.Decrypt(ctx, tc.value)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestLocalKMS(t *testing.T) {
+	_, err := NewLocalKMS()
+	assert.EqualError(t, err, "a local kms requires at least one key")
+
+	_, err = NewLocalKMS([]byte("short"))
+	assert.EqualError(t, err, "invalid local kms key: crypto/aes: invalid key size 5")
+
+	local, err := NewLocalKMS([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	assert.NotContains(t, local.KeyID(), "0123456789abcdef")
+
+	wrapped, err := local.Wrap(context.Background(), []byte("data key"))
+	require.NoError(t, err)
+	_, err = local.Unwrap(context.Background(), "local:unknown", wrapped)
+	assert.EqualError(t, err, `unknown local kms key "local:unknown"`)
+}
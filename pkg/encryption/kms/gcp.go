@@ -0,0 +1,78 @@
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// gcpKMS wraps data keys with a Google Cloud KMS symmetric crypto key.
+type gcpKMS struct {
+	keyName string
+	keys    *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+}
+
+// NewGCPKMS creates a KMS that wraps data keys with the Google Cloud KMS
+// crypto key, named as
+// `projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>`.
+// The Application Default Credentials are used unless client options are
+// given.
+// Data keys are encrypted with the primary version of the crypto key, so the
+// crypto key can be rotated within Cloud KMS.
+func NewGCPKMS(ctx context.Context, keyName string, opts ...option.ClientOption) (KMS, error) {
+	if keyName == "" {
+		return nil, errors.New("a gcp kms requires the name of a crypto key")
+	}
+
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a cloud kms client: %w", err)
+	}
+
+	return &gcpKMS{
+		keyName: keyName,
+		keys:    service.Projects.Locations.KeyRings.CryptoKeys,
+	}, nil
+}
+
+// KeyID returns the name of the crypto key
+func (k *gcpKMS) KeyID() string {
+	return k.keyName
+}
+
+// Wrap encrypts the data key with the primary version of the crypto key
+func (k *gcpKMS) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	resp, err := k.keys.Encrypt(k.keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key with %s: %w", k.keyName, err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode data key wrapped with %s: %w", k.keyName, err)
+	}
+	return wrapped, nil
+}
+
+// Unwrap decrypts the data key with the crypto key named by keyID.
+// Cloud KMS determines the version of the crypto key from the wrapped key.
+func (k *gcpKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	resp, err := k.keys.Decrypt(keyID, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key with %s: %w", keyID, err)
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode data key unwrapped with %s: %w", keyID, err)
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,41 @@
+package kms
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// KMS wraps and unwraps data keys with a key held by a key management
+// service, so that the key encrypting the data keys never leaves the service.
+type KMS interface {
+	// KeyID identifies the key that Wrap wraps data keys with.
+	// It is stored with each wrapped data key, so that data keys wrapped
+	// with a previous key can still be unwrapped once the key is rotated.
+	KeyID() string
+
+	// Wrap encrypts the data key with the current key.
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// Unwrap decrypts a data key wrapped with the key identified by keyID.
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKMS creates the KMS configured by the options.
+// A nil KMS is returned when envelope encryption isn't enabled.
+func NewKMS(ctx context.Context, opts options.KMSOptions) (KMS, error) {
+	switch opts.Type {
+	case "":
+		return nil, nil
+	case options.LocalKMSType:
+		return NewLocalKMS(encryption.SecretBytes(opts.Key))
+	case options.GCPKMSType:
+		return NewGCPKMS(ctx, opts.Key)
+	case options.AWSKMSType:
+		return NewAWSKMS(opts.Key)
+	default:
+		return nil, fmt.Errorf("unknown session kms type '%s'", opts.Type)
+	}
+}
@@ -0,0 +1,164 @@
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestNewKMS(t *testing.T) {
+	keys, err := NewKMS(context.Background(), options.KMSOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+
+	keys, err = NewKMS(context.Background(), options.KMSOptions{Type: options.LocalKMSType, Key: "0123456789abcdef"})
+	require.NoError(t, err)
+	assert.IsType(t, &localKMS{}, keys)
+
+	_, err = NewKMS(context.Background(), options.KMSOptions{Type: "vault"})
+	assert.EqualError(t, err, "unknown session kms type 'vault'")
+}
+
+func TestGCPKMS(t *testing.T) {
+	const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+	// The fake Cloud KMS "wraps" keys by reversing them
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+
+		switch req.URL.Path {
+		case "/v1/" + keyName + ":encrypt":
+			json.NewEncoder(rw).Encode(map[string]string{"name": keyName + "/cryptoKeyVersions/1", "ciphertext": reverseBase64(body["plaintext"])})
+		case "/v1/" + keyName + ":decrypt":
+			json.NewEncoder(rw).Encode(map[string]string{"plaintext": reverseBase64(body["ciphertext"])})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	keys, err := NewGCPKMS(context.Background(), keyName, option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+	assert.Equal(t, keyName, keys.KeyID())
+
+	wrapped, err := keys.Wrap(context.Background(), []byte("data key"))
+	require.NoError(t, err)
+	assert.Equal(t, "yek atad", string(wrapped))
+
+	dataKey, err := keys.Unwrap(context.Background(), keyName, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, "data key", string(dataKey))
+
+	_, err = keys.Unwrap(context.Background(), "projects/p/locations/global/keyRings/r/cryptoKeys/other", wrapped)
+	assert.Error(t, err)
+}
+
+func TestAWSKMS(t *testing.T) {
+	const keyID = "arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+	// The fake AWS KMS "wraps" keys by reversing them
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20210102/eu-west-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") {
+			rw.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(rw).Encode(map[string]string{"__type": "InvalidSignatureException", "message": auth})
+			return
+		}
+		assert.Equal(t, "20210102T030405Z", req.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		if body["KeyId"] != keyID {
+			rw.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(rw).Encode(map[string]string{"__type": "NotFoundException", "message": "unknown key"})
+			return
+		}
+
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(rw).Encode(map[string]string{"KeyId": keyID, "CiphertextBlob": reverseBase64(body["Plaintext"])})
+		case "TrentService.Decrypt":
+			json.NewEncoder(rw).Encode(map[string]string{"KeyId": keyID, "Plaintext": reverseBase64(body["CiphertextBlob"])})
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	keys := newAWSKMS(keyID, "eu-west-1", server.URL+"/", awsCredentials{
+		accessKeyID:     "AKID",
+		secretAccessKey: "secret",
+		sessionToken:    "token",
+	})
+	keys.now = func() time.Time {
+		return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	wrapped, err := keys.Wrap(context.Background(), []byte("data key"))
+	require.NoError(t, err)
+	assert.Equal(t, "yek atad", string(wrapped))
+
+	dataKey, err := keys.Unwrap(context.Background(), keyID, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, "data key", string(dataKey))
+
+	_, err = keys.Unwrap(context.Background(), "alias/other", wrapped)
+	assert.EqualError(t, err, "unable to unwrap data key with alias/other: aws kms returned 400: NotFoundException: unknown key")
+}
+
+func TestAWSSignature(t *testing.T) {
+	// The get-vanilla example of the Signature Version 4 test suite
+	keys := newAWSKMS("", "us-east-1", "", awsCredentials{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	})
+	keys.service = "service"
+	keys.now = func() time.Time {
+		return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	keys.sign(req, nil)
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestNewAWSKMS(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	_, err := NewAWSKMS("alias/sessions")
+	assert.EqualError(t, err, "an aws kms requires a region: set AWS_REGION or give the key as an ARN")
+
+	_, err = NewAWSKMS("arn:aws:kms:eu-west-1:111122223333:alias/sessions")
+	assert.EqualError(t, err, "an aws kms requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	keys, err := NewAWSKMS("alias/sessions")
+	require.NoError(t, err)
+	assert.Equal(t, "https://kms.us-east-1.amazonaws.com/", keys.(*awsKMS).endpoint)
+}
+
+// reverseBase64 reverses the bytes of a base64 encoded value
+func reverseBase64(value string) string {
+	b, _ := base64.StdEncoding.DecodeString(value)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
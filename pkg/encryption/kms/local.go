@@ -0,0 +1,72 @@
+package kms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// localKMS wraps data keys with static keys held in memory.
+// It provides no more protection than the static keys themselves and is
+// intended for testing envelope encryption without a key management service.
+type localKMS struct {
+	keyID   string
+	ciphers map[string]encryption.Cipher
+}
+
+// NewLocalKMS creates a KMS that wraps data keys with the first of the static
+// AES keys given.
+// Any further keys can still unwrap the data keys they wrapped, eg. to test
+// key rotation.
+func NewLocalKMS(keys ...[]byte) (KMS, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("a local kms requires at least one key")
+	}
+
+	kms := &localKMS{
+		ciphers: make(map[string]encryption.Cipher, len(keys)),
+	}
+	for i, key := range keys {
+		c, err := encryption.NewGCMCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local kms key: %w", err)
+		}
+
+		keyID := localKeyID(key)
+		kms.ciphers[keyID] = c
+		if i == 0 {
+			kms.keyID = keyID
+		}
+	}
+	return kms, nil
+}
+
+// localKeyID identifies a key by a fingerprint, so that the key itself isn't
+// stored with the data keys it wraps
+func localKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "local:" + hex.EncodeToString(sum[:8])
+}
+
+// KeyID returns the fingerprint of the current key
+func (k *localKMS) KeyID() string {
+	return k.keyID
+}
+
+// Wrap encrypts the data key with the current key
+func (k *localKMS) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	return k.ciphers[k.keyID].Encrypt(dataKey)
+}
+
+// Unwrap decrypts the data key with the key identified by keyID
+func (k *localKMS) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	c, ok := k.ciphers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown local kms key %q", keyID)
+	}
+	return c.Decrypt(wrapped)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"hash"
 	"net/http"
@@ -38,34 +39,61 @@ func SecretBytes(secret string) []byte {
 // cookies are stored in a 3 part (value + timestamp + signature) to enforce that the values are as originally set.
 // additionally, the 'value' is encrypted so it's opaque to the browser
 
+var (
+	// ErrMalformedCookie is returned when a cookie value is not in the signed
+	// value|timestamp|signature format
+	ErrMalformedCookie = errors.New("cookie value is malformed")
+
+	// ErrInvalidSignature is returned when a cookie's signature does not
+	// match its value, eg. because it was signed with a different secret
+	ErrInvalidSignature = errors.New("cookie signature not valid")
+
+	// ErrExpiredCookie is returned when a cookie's timestamp is outside of its
+	// expiration window
+	ErrExpiredCookie = errors.New("cookie has expired")
+
+	// ErrCorruptBase64 is returned when a correctly signed cookie value could
+	// not be base64 decoded
+	ErrCorruptBase64 = errors.New("cookie value is not valid base64")
+)
+
 // Validate ensures a cookie is properly signed
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value []byte, t time.Time, ok bool) {
+	value, t, err := ValidateCookie(cookie, seed, expiration)
+	return value, t, err == nil
+}
+
+// ValidateCookie ensures a cookie is properly signed, returning an error
+// describing why the cookie is not valid otherwise.
+// The error wraps one of ErrMalformedCookie, ErrInvalidSignature,
+// ErrExpiredCookie or ErrCorruptBase64.
+func ValidateCookie(cookie *http.Cookie, seed string, expiration time.Duration) ([]byte, time.Time, error) {
 	// value, timestamp, sig
 	parts := strings.Split(cookie.Value, "|")
 	if len(parts) != 3 {
-		return
+		return nil, time.Time{}, ErrMalformedCookie
 	}
-	if checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
-		ts, err := strconv.Atoi(parts[1])
-		if err != nil {
-			return
-		}
-		// The expiration timestamp set when the cookie was created
-		// isn't sent back by the browser. Hence, we check whether the
-		// creation timestamp stored in the cookie falls within the
-		// window defined by (Now()-expiration, Now()].
-		t = time.Unix(int64(ts), 0)
-		if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
-			// it's a valid cookie. now get the contents
-			rawValue, err := base64.URLEncoding.DecodeString(parts[0])
-			if err == nil {
-				value = rawValue
-				ok = true
-				return
-			}
-		}
+	if !checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
+		return nil, time.Time{}, ErrInvalidSignature
+	}
+	ts, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, time.Time{}, ErrMalformedCookie
+	}
+	// The expiration timestamp set when the cookie was created
+	// isn't sent back by the browser. Hence, we check whether the
+	// creation timestamp stored in the cookie falls within the
+	// window defined by (Now()-expiration, Now()].
+	t := time.Unix(int64(ts), 0)
+	if !t.After(time.Now().Add(expiration*-1)) || !t.Before(time.Now().Add(time.Minute*5)) {
+		return nil, time.Time{}, ErrExpiredCookie
+	}
+	// it's a valid cookie. now get the contents
+	value, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %v", ErrCorruptBase64, err)
 	}
-	return
+	return value, t, nil
 }
 
 // SignedValue returns a cookie that is signed and can later be checked with Validate
@@ -7,7 +7,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -100,3 +102,62 @@ func TestSignAndValidate(t *testing.T) {
 	assert.False(t, checkSignature(sha256sig, seed, key, "tampered", epoch))
 	assert.False(t, checkSignature(sha1sig, seed, key, "tampered", epoch))
 }
+
+func TestValidateCookie(t *testing.T) {
+	seed := "0123456789abcdef"
+	now := time.Now()
+	signed, err := SignedValue(seed, "cookie-name", []byte("value"), now)
+	assert.NoError(t, err)
+
+	// sign returns a correctly signed cookie value for the raw parts
+	sign := func(value, timestamp string) string {
+		sig, err := cookieSignature(sha256.New, seed, "cookie-name", value, timestamp)
+		assert.NoError(t, err)
+		return fmt.Sprintf("%s|%s|%s", value, timestamp, sig)
+	}
+
+	testCases := map[string]struct {
+		value       string
+		expectedErr error
+	}{
+		"with a valid cookie": {
+			value: signed,
+		},
+		"with a cookie signed with a different secret": {
+			value: func() string {
+				v, err := SignedValue("fedcba9876543210", "cookie-name", []byte("value"), now)
+				assert.NoError(t, err)
+				return v
+			}(),
+			expectedErr: ErrInvalidSignature,
+		},
+		"with a truncated cookie": {
+			value:       signed[:len(signed)-4],
+			expectedErr: ErrInvalidSignature,
+		},
+		"with a malformed cookie": {
+			value:       "value",
+			expectedErr: ErrMalformedCookie,
+		},
+		"with an expired cookie": {
+			value:       sign(base64.URLEncoding.EncodeToString([]byte("value")), fmt.Sprintf("%d", now.Add(-2*time.Hour).Unix())),
+			expectedErr: ErrExpiredCookie,
+		},
+		"with corrupt base64": {
+			value:       sign("not*base64", fmt.Sprintf("%d", now.Unix())),
+			expectedErr: ErrCorruptBase64,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			value, _, err := ValidateCookie(&http.Cookie{Name: "cookie-name", Value: tc.value}, seed, time.Hour)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value"), value)
+		})
+	}
+}
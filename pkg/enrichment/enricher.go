@@ -0,0 +1,179 @@
+package enrichment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// The results of claim enrichment requests
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Request is the JSON body sent to the claim enrichment endpoint
+type Request struct {
+	Email   string `json:"email"`
+	Subject string `json:"subject"`
+}
+
+// Enricher enriches the claims of sessions with the fields of the JSON object
+// returned by the claim enrichment endpoint for the user, such as the cost
+// center and manager from a directory service.
+// The claims are cached in the session, the endpoint is only called at login
+// and when the session is refreshed.
+type Enricher struct {
+	url             string
+	prefix          string
+	failOpen        bool
+	maxResponseSize int64
+	client          *http.Client
+	requests        *prometheus.CounterVec
+}
+
+// NewEnricher creates an Enricher for the claim enrichment endpoint
+func NewEnricher(opts options.ClaimEnrichment, registerer prometheus.Registerer) (*Enricher, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claim enrichment url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid claim enrichment url %q: the scheme must be http or https", opts.URL)
+	}
+	if opts.Timeout <= 0 {
+		return nil, fmt.Errorf("claim enrichment timeout (%s) must be positive", opts.Timeout)
+	}
+	if opts.MaxResponseSize <= 0 {
+		return nil, fmt.Errorf("claim enrichment max response size (%d) must be positive", opts.MaxResponseSize)
+	}
+
+	return &Enricher{
+		url:             opts.URL,
+		prefix:          opts.Prefix,
+		failOpen:        opts.FailOpen,
+		maxResponseSize: opts.MaxResponseSize,
+		client:          &http.Client{Timeout: opts.Timeout},
+		requests:        registerRequestsCounter(registerer),
+	}, nil
+}
+
+// Enrich sets the enriched claims of a new session from the response of the
+// claim enrichment endpoint for the user.
+// When the endpoint fails, the error is returned so that the login is denied,
+// unless the enricher fails open, in which case the session has no enriched
+// claims.
+func (e *Enricher) Enrich(ctx context.Context, session *sessionsapi.SessionState) error {
+	if err := e.enrich(ctx, session); err != nil {
+		if e.failOpen {
+			logger.Errorf("Claim enrichment failed for %s, continuing without enriched claims: %v", session.Email, err)
+			return nil
+		}
+		return fmt.Errorf("claim enrichment failed: %v", err)
+	}
+	return nil
+}
+
+// Refresh replaces the enriched claims of a refreshed session with the
+// response of the claim enrichment endpoint for the user.
+// Failures never fail the refresh, as the provider may have rotated the
+// session's tokens. Instead, the session keeps its previous enriched claims
+// when the enricher fails open, and otherwise loses them until the session
+// is next refreshed.
+func (e *Enricher) Refresh(ctx context.Context, session *sessionsapi.SessionState) {
+	if err := e.enrich(ctx, session); err != nil {
+		if e.failOpen {
+			logger.Errorf("Claim enrichment failed for %s, keeping the previous enriched claims: %v", session.Email, err)
+			return
+		}
+		logger.Errorf("Claim enrichment failed for %s, removing the enriched claims: %v", session.Email, err)
+		session.EnrichedClaims = nil
+	}
+}
+
+// enrich replaces the enriched claims of the session, leaving them unchanged
+// when the endpoint fails
+func (e *Enricher) enrich(ctx context.Context, session *sessionsapi.SessionState) error {
+	claims, err := e.fetch(ctx, session)
+	if err != nil {
+		e.requests.WithLabelValues(resultError).Inc()
+		return err
+	}
+	e.requests.WithLabelValues(resultSuccess).Inc()
+
+	enriched := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		enriched[e.prefix+name] = value
+	}
+	session.EnrichedClaims = enriched
+	return nil
+}
+
+// fetch requests the claims of the user of the session from the endpoint
+func (e *Enricher) fetch(ctx context.Context, session *sessionsapi.SessionState) (map[string]interface{}, error) {
+	body, err := json.Marshal(Request{Email: session.Email, Subject: session.User})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %q: %v", e.url, err)
+	}
+	defer resp.Body.Close()
+
+	// Read one more byte than allowed, to tell responses over the limit apart
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, e.maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if int64(len(data)) > e.maxResponseSize {
+		return nil, fmt.Errorf("response is larger than %d bytes", e.maxResponseSize)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("response is not a JSON object: %v", err)
+	}
+	return claims, nil
+}
+
+// registerRequestsCounter registers the counter of claim enrichment requests,
+// returning the existing counter if it is already registered
+func registerRequestsCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_claim_enrichment_requests_total",
+			Help: "Total number of claim enrichment requests by result.",
+		},
+		[]string{"result"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return counter
+}
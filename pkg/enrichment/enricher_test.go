@@ -0,0 +1,173 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Enricher Suite", func() {
+	var (
+		server    *httptest.Server
+		status    int
+		response  string
+		delay     time.Duration
+		requests  []Request
+		opts      options.ClaimEnrichment
+		registry  *prometheus.Registry
+		newTested func() *Enricher
+		session   func() *sessionsapi.SessionState
+	)
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		response = `{"cost_center": "CC-1234", "manager": {"email": "manager@example.com"}}`
+		delay = 0
+		requests = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			defer GinkgoRecover()
+			Expect(req.Method).To(Equal(http.MethodPost))
+			request := Request{}
+			Expect(json.NewDecoder(req.Body).Decode(&request)).To(Succeed())
+			requests = append(requests, request)
+
+			time.Sleep(delay)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			_, _ = rw.Write([]byte(response))
+		}))
+
+		opts = options.ClaimEnrichment{
+			URL:             server.URL,
+			Prefix:          "directory_",
+			Timeout:         time.Second,
+			MaxResponseSize: 1024,
+		}
+		registry = prometheus.NewRegistry()
+
+		newTested = func() *Enricher {
+			enricher, err := NewEnricher(opts, registry)
+			Expect(err).ToNot(HaveOccurred())
+			return enricher
+		}
+		session = func() *sessionsapi.SessionState {
+			return &sessionsapi.SessionState{Email: "john@example.com", User: "1234567890"}
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	requestCount := func(result string) float64 {
+		return testutil.ToFloat64(registerRequestsCounter(registry).WithLabelValues(result))
+	}
+
+	Context("Enrich", func() {
+		It("adds the fields of the response under the prefix", func() {
+			s := session()
+			Expect(newTested().Enrich(context.Background(), s)).To(Succeed())
+			Expect(requests).To(Equal([]Request{{Email: "john@example.com", Subject: "1234567890"}}))
+			Expect(s.EnrichedClaims).To(Equal(map[string]interface{}{
+				"directory_cost_center": "CC-1234",
+				"directory_manager":     map[string]interface{}{"email": "manager@example.com"},
+			}))
+			Expect(requestCount(resultSuccess)).To(Equal(float64(1)))
+		})
+
+		It("fails closed when the endpoint returns an error", func() {
+			status = http.StatusInternalServerError
+			response = "directory unavailable"
+			s := session()
+			err := newTested().Enrich(context.Background(), s)
+			Expect(err).To(MatchError("claim enrichment failed: unexpected status 500: directory unavailable"))
+			Expect(s.EnrichedClaims).To(BeNil())
+			Expect(requestCount(resultError)).To(Equal(float64(1)))
+		})
+
+		It("fails closed when the response is too large", func() {
+			response = `{"cost_center": "` + strings.Repeat("a", 1024) + `"}`
+			err := newTested().Enrich(context.Background(), session())
+			Expect(err).To(MatchError("claim enrichment failed: response is larger than 1024 bytes"))
+		})
+
+		It("fails closed when the response is not a JSON object", func() {
+			response = `["CC-1234"]`
+			err := newTested().Enrich(context.Background(), session())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("claim enrichment failed: response is not a JSON object"))
+		})
+
+		It("fails closed when the endpoint times out", func() {
+			opts.Timeout = 10 * time.Millisecond
+			delay = 100 * time.Millisecond
+			err := newTested().Enrich(context.Background(), session())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Timeout"))
+		})
+
+		It("continues without enriched claims when failing open", func() {
+			opts.FailOpen = true
+			status = http.StatusBadGateway
+			s := session()
+			Expect(newTested().Enrich(context.Background(), s)).To(Succeed())
+			Expect(s.EnrichedClaims).To(BeNil())
+			Expect(requestCount(resultError)).To(Equal(float64(1)))
+		})
+	})
+
+	Context("Refresh", func() {
+		var s *sessionsapi.SessionState
+
+		BeforeEach(func() {
+			s = session()
+			s.EnrichedClaims = map[string]interface{}{"directory_cost_center": "CC-0001"}
+		})
+
+		It("replaces the enriched claims", func() {
+			response = `{"cost_center": "CC-1234"}`
+			newTested().Refresh(context.Background(), s)
+			Expect(s.EnrichedClaims).To(Equal(map[string]interface{}{"directory_cost_center": "CC-1234"}))
+		})
+
+		It("keeps the previous enriched claims on failure when failing open", func() {
+			opts.FailOpen = true
+			status = http.StatusServiceUnavailable
+			newTested().Refresh(context.Background(), s)
+			Expect(s.EnrichedClaims).To(Equal(map[string]interface{}{"directory_cost_center": "CC-0001"}))
+		})
+
+		It("removes the enriched claims on failure when failing closed", func() {
+			status = http.StatusServiceUnavailable
+			newTested().Refresh(context.Background(), s)
+			Expect(s.EnrichedClaims).To(BeNil())
+		})
+	})
+
+	DescribeTable("NewEnricher errors",
+		func(modify func(*options.ClaimEnrichment), expected string) {
+			o := options.ClaimEnrichment{URL: "https://directory.example.com", Prefix: "directory_", Timeout: time.Second, MaxResponseSize: 1024}
+			modify(&o)
+			_, err := NewEnricher(o, prometheus.NewRegistry())
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("with an invalid scheme", func(o *options.ClaimEnrichment) { o.URL = "ftp://directory.example.com" },
+			"invalid claim enrichment url \"ftp://directory.example.com\": the scheme must be http or https"),
+		Entry("without a timeout", func(o *options.ClaimEnrichment) { o.Timeout = 0 },
+			"claim enrichment timeout (0s) must be positive"),
+		Entry("without a max response size", func(o *options.ClaimEnrichment) { o.MaxResponseSize = 0 },
+			"claim enrichment max response size (0) must be positive"),
+	)
+})
@@ -0,0 +1,375 @@
+package externalauthz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// The results of external authorization requests
+	resultAllow = "allow"
+	resultDeny  = "deny"
+	resultError = "error"
+
+	// maxResponseSize bounds the size of the responses of the endpoint
+	maxResponseSize = 64 * 1024
+
+	// maxCacheEntries bounds the number of cached decisions, so that clients
+	// making many distinct requests can't exhaust the memory
+	maxCacheEntries = 10000
+)
+
+// DeniedError is returned for the requests denied by the external
+// authorization endpoint
+type DeniedError struct {
+	// Reason is the reason given by the endpoint, if any
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "denied by the external authorization endpoint"
+	}
+	return fmt.Sprintf("denied by the external authorization endpoint: %s", e.Reason)
+}
+
+// Input describes the request to authorize, and its session, to the
+// external authorization endpoint
+type Input struct {
+	Request InputRequest  `json:"request"`
+	Session *InputSession `json:"session"`
+}
+
+// InputRequest describes the request to authorize
+type InputRequest struct {
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	Path     string              `json:"path"`
+	Query    url.Values          `json:"query,omitempty"`
+	Headers  map[string][]string `json:"headers,omitempty"`
+	ClientIP string              `json:"clientIP,omitempty"`
+}
+
+// InputSession describes the session of the request to authorize, it is nil
+// for requests without a session
+type InputSession struct {
+	Email             string                 `json:"email,omitempty"`
+	User              string                 `json:"user,omitempty"`
+	PreferredUsername string                 `json:"preferredUsername,omitempty"`
+	Groups            []string               `json:"groups,omitempty"`
+	AuthProvider      string                 `json:"authProvider,omitempty"`
+	Claims            map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Decision is the response of the endpoint, and of the result of Open Policy
+// Agent policies returning an object
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Authorizer allows or denies requests with the decision of an external
+// authorization endpoint, such as an Open Policy Agent sidecar, sent the
+// method, path and client IP of the request, and the claims of its session.
+// Decisions are cached for the cache TTL for identical inputs.
+type Authorizer struct {
+	url      string
+	opa      bool
+	failOpen bool
+	cacheTTL time.Duration
+	headers  []string
+	client   *http.Client
+
+	cache   *cache
+	metrics *metrics
+	clock   clock.Clock
+}
+
+// NewAuthorizer creates an Authorizer for the external authorization endpoint
+func NewAuthorizer(opts options.ExternalAuthz, registerer prometheus.Registerer) (*Authorizer, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external authorization url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid external authorization url %q: the scheme must be http or https", opts.URL)
+	}
+	if opts.Type != options.ExternalAuthzTypeWebhook && opts.Type != options.ExternalAuthzTypeOPA {
+		return nil, fmt.Errorf("unknown external authorization type %q", opts.Type)
+	}
+	if opts.Timeout <= 0 {
+		return nil, fmt.Errorf("external authorization timeout (%s) must be positive", opts.Timeout)
+	}
+
+	headers := make([]string, 0, len(opts.Headers))
+	for _, header := range opts.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(header))
+	}
+	return &Authorizer{
+		url:      opts.URL,
+		opa:      opts.Type == options.ExternalAuthzTypeOPA,
+		failOpen: opts.FailOpen,
+		cacheTTL: opts.CacheTTL,
+		headers:  headers,
+		client:   &http.Client{Timeout: opts.Timeout},
+		cache:    &cache{entries: map[string]cacheEntry{}},
+		metrics:  newMetrics(registerer),
+	}, nil
+}
+
+// Authorize asks the endpoint whether the request from the client IP, with
+// the session, is allowed.
+// A DeniedError is returned for denied requests. When the endpoint fails,
+// the error is returned so that the request is rejected, unless the
+// authorizer fails open, in which case the request is allowed.
+func (a *Authorizer) Authorize(req *http.Request, session *sessionsapi.SessionState, clientIP net.IP) error {
+	body, err := json.Marshal(a.newInput(req, session, clientIP))
+	if err != nil {
+		return fmt.Errorf("could not encode the external authorization input: %v", err)
+	}
+
+	key := cacheKey(body)
+	decision, ok := a.cache.get(key, a.clock.Now())
+	if ok {
+		a.metrics.cacheHits.Inc()
+	} else {
+		decision, err = a.decide(req, body)
+		if err != nil {
+			a.metrics.requests.WithLabelValues(resultError).Inc()
+			if a.failOpen {
+				logger.Errorf("External authorization failed for %s, allowing the request: %v", req.URL.Path, err)
+				return nil
+			}
+			return fmt.Errorf("external authorization failed: %v", err)
+		}
+		if decision.Allow {
+			a.metrics.requests.WithLabelValues(resultAllow).Inc()
+		} else {
+			a.metrics.requests.WithLabelValues(resultDeny).Inc()
+		}
+		if a.cacheTTL > 0 {
+			now := a.clock.Now()
+			a.cache.set(key, decision, now.Add(a.cacheTTL), now)
+		}
+	}
+
+	if !decision.Allow {
+		return &DeniedError{Reason: decision.Reason}
+	}
+	return nil
+}
+
+// newInput describes the request and its session, with the claims of the
+// session and its enriched claims
+func (a *Authorizer) newInput(req *http.Request, session *sessionsapi.SessionState, clientIP net.IP) Input {
+	input := Input{
+		Request: InputRequest{
+			Method: req.Method,
+			Host:   req.Host,
+			Path:   req.URL.Path,
+			Query:  req.URL.Query(),
+		},
+	}
+	if len(input.Request.Query) == 0 {
+		input.Request.Query = nil
+	}
+	if clientIP != nil {
+		input.Request.ClientIP = clientIP.String()
+	}
+	for _, header := range a.headers {
+		if values := req.Header.Values(header); len(values) > 0 {
+			if input.Request.Headers == nil {
+				input.Request.Headers = map[string][]string{}
+			}
+			input.Request.Headers[header] = values
+		}
+	}
+
+	if session == nil {
+		return input
+	}
+	input.Session = &InputSession{
+		Email:             session.Email,
+		User:              session.User,
+		PreferredUsername: session.PreferredUsername,
+		Groups:            session.Groups,
+		AuthProvider:      session.AuthProvider,
+	}
+	if len(session.Claims) > 0 || len(session.EnrichedClaims) > 0 {
+		input.Session.Claims = make(map[string]interface{}, len(session.Claims)+len(session.EnrichedClaims))
+		for name, value := range session.Claims {
+			input.Session.Claims[name] = value
+		}
+		for name, value := range session.EnrichedClaims {
+			input.Session.Claims[name] = value
+		}
+	}
+	return input
+}
+
+// decide posts the input to the endpoint, wrapped in an `input` object for
+// Open Policy Agent, and returns its decision
+func (a *Authorizer) decide(req *http.Request, input []byte) (Decision, error) {
+	body := input
+	if a.opa {
+		body = append(append([]byte(`{"input":`), input...), '}')
+	}
+	outReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, fmt.Errorf("could not create request: %v", err)
+	}
+	outReq.Header.Set("Content-Type", "application/json")
+	outReq.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(outReq)
+	if err != nil {
+		return Decision{}, fmt.Errorf("error requesting %q: %v", a.url, err)
+	}
+	defer resp.Body.Close()
+
+	// Read one more byte than allowed, to tell responses over the limit apart
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return Decision{}, fmt.Errorf("error reading response: %v", err)
+	}
+	if len(data) > maxResponseSize {
+		return Decision{}, fmt.Errorf("response is larger than %d bytes", maxResponseSize)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	if a.opa {
+		return parseOPADecision(data)
+	}
+	decision := Decision{}
+	if err := json.Unmarshal(data, &decision); err != nil {
+		return Decision{}, fmt.Errorf("response is not a decision: %v", err)
+	}
+	return decision, nil
+}
+
+// parseOPADecision parses the result of an Open Policy Agent policy, either a
+// boolean or a decision object.
+// Undefined results, of policies that don't apply to the input, deny the
+// request.
+func parseOPADecision(data []byte) (Decision, error) {
+	response := struct {
+		Result json.RawMessage `json:"result"`
+	}{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return Decision{}, fmt.Errorf("response is not a policy result: %v", err)
+	}
+	if len(response.Result) == 0 {
+		return Decision{Reason: "the policy decision is undefined"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(response.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	decision := Decision{}
+	if err := json.Unmarshal(response.Result, &decision); err != nil {
+		return Decision{}, errors.New("the policy result must be a boolean or an object with an allow field")
+	}
+	return decision, nil
+}
+
+// cacheKey hashes the input, so that the claims of sessions aren't kept in
+// the cache keys
+func cacheKey(input []byte) string {
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+// cache keeps the decisions of the endpoint until they expire
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	decision Decision
+	expires  time.Time
+}
+
+// get returns the cached decision, if it hasn't expired
+func (c *cache) get(key string, now time.Time) (Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return Decision{}, false
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return Decision{}, false
+	}
+	return entry.decision, true
+}
+
+// set caches the decision until it expires.
+// The expired entries are removed when the cache is full, and the decision
+// isn't cached if it is still full.
+func (c *cache) set(key string, decision Decision, expires, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = cacheEntry{decision: decision, expires: expires}
+}
+
+// metrics records the external authorization requests and cache hits
+type metrics struct {
+	requests  *prometheus.CounterVec
+	cacheHits prometheus.Counter
+}
+
+// newMetrics registers the external authorization metrics with the
+// registerer.
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	return &metrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_external_authz_requests_total",
+				Help: "Total number of external authorization requests by result.",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+		cacheHits: collector.Register(registerer, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_external_authz_cache_hits_total",
+				Help: "Total number of requests authorized from the external authorization cache.",
+			},
+		)).(prometheus.Counter),
+	}
+}
@@ -0,0 +1,212 @@
+package externalauthz
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Authorizer Suite", func() {
+	var (
+		server    *httptest.Server
+		status    int
+		response  string
+		requests  []map[string]interface{}
+		opts      options.ExternalAuthz
+		registry  *prometheus.Registry
+		newTested func() *Authorizer
+		session   *sessionsapi.SessionState
+		clientIP  net.IP
+	)
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		response = `{"allow": true}`
+		requests = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			defer GinkgoRecover()
+			Expect(req.Method).To(Equal(http.MethodPost))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+			request := map[string]interface{}{}
+			Expect(json.NewDecoder(req.Body).Decode(&request)).To(Succeed())
+			requests = append(requests, request)
+
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			_, _ = rw.Write([]byte(response))
+		}))
+
+		opts = options.ExternalAuthz{
+			URL:      server.URL,
+			Type:     options.ExternalAuthzTypeWebhook,
+			Timeout:  time.Second,
+			CacheTTL: time.Minute,
+			Headers:  []string{"x-tenant"},
+		}
+		registry = prometheus.NewRegistry()
+
+		newTested = func() *Authorizer {
+			authorizer, err := NewAuthorizer(opts, registry)
+			Expect(err).ToNot(HaveOccurred())
+			return authorizer
+		}
+		session = &sessionsapi.SessionState{
+			Email:          "john@example.com",
+			User:           "1234567890",
+			Groups:         []string{"devs"},
+			AuthProvider:   "oidc",
+			Claims:         map[string]interface{}{"roles": []interface{}{"editor"}},
+			EnrichedClaims: map[string]interface{}{"directory_cost_center": "CC-1234"},
+		}
+		clientIP = net.ParseIP("10.0.0.1")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newRequest := func(method, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("Cookie", "_oauth2_proxy=secret")
+		return req
+	}
+
+	requestCount := func(result string) float64 {
+		return testutil.ToFloat64(newMetrics(registry).requests.WithLabelValues(result))
+	}
+
+	It("sends the request and its session to the webhook, allowing the requests it allows", func() {
+		Expect(newTested().Authorize(newRequest(http.MethodDelete, "https://app.example.com/documents/42?force=true"), session, clientIP)).To(Succeed())
+		Expect(requests).To(Equal([]map[string]interface{}{{
+			"request": map[string]interface{}{
+				"method":   "DELETE",
+				"host":     "app.example.com",
+				"path":     "/documents/42",
+				"query":    map[string]interface{}{"force": []interface{}{"true"}},
+				"headers":  map[string]interface{}{"X-Tenant": []interface{}{"acme"}},
+				"clientIP": "10.0.0.1",
+			},
+			"session": map[string]interface{}{
+				"email":        "john@example.com",
+				"user":         "1234567890",
+				"groups":       []interface{}{"devs"},
+				"authProvider": "oidc",
+				"claims": map[string]interface{}{
+					"roles":                 []interface{}{"editor"},
+					"directory_cost_center": "CC-1234",
+				},
+			},
+		}}))
+		Expect(requestCount(resultAllow)).To(Equal(float64(1)))
+	})
+
+	It("denies the requests the webhook denies, with its reason", func() {
+		response = `{"allow": false, "reason": "documents can only be deleted by their owner"}`
+		err := newTested().Authorize(newRequest(http.MethodDelete, "/documents/42"), nil, nil)
+		Expect(err).To(MatchError("denied by the external authorization endpoint: documents can only be deleted by their owner"))
+		Expect(err).To(BeAssignableToTypeOf(&DeniedError{}))
+		Expect(requests[0]["session"]).To(BeNil())
+		Expect(requestCount(resultDeny)).To(Equal(float64(1)))
+	})
+
+	DescribeTable("reads the decisions of Open Policy Agent policies",
+		func(response string, expected error) {
+			opts.Type = options.ExternalAuthzTypeOPA
+			authorizer := newTested()
+			server.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				defer GinkgoRecover()
+				request := map[string]interface{}{}
+				Expect(json.NewDecoder(req.Body).Decode(&request)).To(Succeed())
+				Expect(request).To(HaveKey("input"))
+				Expect(request["input"]).To(HaveKey("request"))
+				_, _ = rw.Write([]byte(response))
+			})
+
+			err := authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)
+			if expected == nil {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(expected.Error()))
+			}
+		},
+		Entry("with a true result", `{"result": true}`, nil),
+		Entry("with a false result", `{"result": false}`, &DeniedError{}),
+		Entry("with a decision result", `{"result": {"allow": false, "reason": "outside office hours"}}`, &DeniedError{Reason: "outside office hours"}),
+		Entry("with an undefined result", `{}`, &DeniedError{Reason: "the policy decision is undefined"}),
+		Entry("with an invalid result", `{"result": "yes"}`, &errorString{"external authorization failed: the policy result must be a boolean or an object with an allow field"}),
+	)
+
+	It("caches the decisions for identical requests and sessions", func() {
+		authorizer := newTested()
+		now := time.Now()
+		authorizer.clock.Set(now)
+
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)).To(Succeed())
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)).To(Succeed())
+		Expect(requests).To(HaveLen(1))
+		Expect(testutil.ToFloat64(authorizer.metrics.cacheHits)).To(Equal(float64(1)))
+
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents/42"), session, clientIP)).To(Succeed())
+		Expect(requests).To(HaveLen(2))
+
+		Expect(authorizer.clock.Add(time.Minute)).To(Succeed())
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)).To(Succeed())
+		Expect(requests).To(HaveLen(3))
+	})
+
+	It("fails closed when the endpoint returns an error", func() {
+		status = http.StatusInternalServerError
+		response = "policy engine unavailable"
+		err := newTested().Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)
+		Expect(err).To(MatchError("external authorization failed: unexpected status 500: policy engine unavailable"))
+		Expect(requestCount(resultError)).To(Equal(float64(1)))
+	})
+
+	It("allows the requests when the endpoint fails when failing open, without caching the failure", func() {
+		opts.FailOpen = true
+		status = http.StatusBadGateway
+		authorizer := newTested()
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)).To(Succeed())
+
+		status = http.StatusOK
+		response = `{"allow": false}`
+		Expect(authorizer.Authorize(newRequest(http.MethodGet, "/documents"), session, clientIP)).To(MatchError("denied by the external authorization endpoint"))
+		Expect(requests).To(HaveLen(2))
+	})
+
+	DescribeTable("NewAuthorizer errors",
+		func(modify func(*options.ExternalAuthz), expected string) {
+			o := options.ExternalAuthz{URL: "http://localhost:8181/v1/data/oauth2proxy", Type: options.ExternalAuthzTypeOPA, Timeout: time.Second}
+			modify(&o)
+			_, err := NewAuthorizer(o, prometheus.NewRegistry())
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("with an invalid scheme", func(o *options.ExternalAuthz) { o.URL = "ftp://localhost" },
+			"invalid external authorization url \"ftp://localhost\": the scheme must be http or https"),
+		Entry("with an unknown type", func(o *options.ExternalAuthz) { o.Type = "grpc" },
+			"unknown external authorization type \"grpc\""),
+		Entry("without a timeout", func(o *options.ExternalAuthz) { o.Timeout = 0 },
+			"external authorization timeout (0s) must be positive"),
+	)
+})
+
+// errorString is an error with a fixed message, for table entries
+type errorString struct {
+	message string
+}
+
+func (e *errorString) Error() string {
+	return e.message
+}
@@ -0,0 +1,168 @@
+package fallback
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxCheckTimeout is the longest a health check waits for an endpoint
+const maxCheckTimeout = 10 * time.Second
+
+// Monitor checks the health of the endpoints of the primary provider, and
+// reports it as unavailable once its checks have been failing for the
+// unhealthy period, so that users can sign in with the fallback provider.
+// The primary provider is available again as soon as a check succeeds.
+type Monitor struct {
+	endpoints      []string
+	client         *http.Client
+	interval       time.Duration
+	unhealthyAfter time.Duration
+	clock          clock.Clock
+	active         prometheus.Gauge
+
+	mutex        sync.Mutex
+	failingSince *time.Time
+	unavailable  bool
+}
+
+// NewMonitor creates a Monitor for the endpoints of the primary provider,
+// such as its discovery and token endpoints. The fallback state is reported
+// with the registerer.
+// The endpoints aren't checked until Start is called.
+func NewMonitor(opts options.ProviderFallback, endpoints []string, registerer prometheus.Registerer) *Monitor {
+	timeout := opts.HealthCheckInterval
+	if timeout > maxCheckTimeout {
+		timeout = maxCheckTimeout
+	}
+	return &Monitor{
+		endpoints:      endpoints,
+		client:         &http.Client{Timeout: timeout},
+		interval:       opts.HealthCheckInterval,
+		unhealthyAfter: opts.UnhealthyAfter,
+		active:         registerActiveGauge(registerer),
+	}
+}
+
+// Start checks the endpoints straight away, and then at every health check
+// interval until done is closed
+func (m *Monitor) Start(done <-chan bool) {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			m.Check(context.Background())
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check checks every endpoint once, and updates whether the primary provider
+// is unavailable
+func (m *Monitor) Check(ctx context.Context) {
+	var failure error
+	for _, endpoint := range m.endpoints {
+		if err := m.checkEndpoint(ctx, endpoint); err != nil {
+			failure = err
+			break
+		}
+	}
+	m.record(failure)
+}
+
+// checkEndpoint checks that the endpoint responds without a server error.
+// The token endpoint rejects requests without a grant, which still shows it
+// is up.
+func (m *Monitor) checkEndpoint(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting %q: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%q responded with %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// record updates the state of the primary provider with the result of a
+// check, logging the transitions to and from the fallback
+func (m *Monitor) record(failure error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	if failure == nil {
+		if m.unavailable {
+			logger.Printf("The primary provider is available again after failing health checks since %s, the fallback provider is no longer offered", m.failingSince.Format(time.RFC3339))
+		}
+		m.failingSince = nil
+		m.setUnavailable(false)
+		return
+	}
+
+	if m.failingSince == nil {
+		m.failingSince = &now
+		logger.Errorf("Primary provider health check failed: %v", failure)
+	}
+	if !m.unavailable && now.Sub(*m.failingSince) >= m.unhealthyAfter {
+		logger.Errorf("The primary provider has been failing health checks since %s, offering the fallback provider: %v", m.failingSince.Format(time.RFC3339), failure)
+		m.setUnavailable(true)
+	}
+}
+
+func (m *Monitor) setUnavailable(unavailable bool) {
+	m.unavailable = unavailable
+	if unavailable {
+		m.active.Set(1)
+	} else {
+		m.active.Set(0)
+	}
+}
+
+// Unavailable checks whether the primary provider is unavailable, so that
+// the fallback provider should be offered
+func (m *Monitor) Unavailable() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.unavailable
+}
+
+// registerActiveGauge registers the gauge of the fallback state, returning
+// the existing gauge if it is already registered
+func registerActiveGauge(registerer prometheus.Registerer) prometheus.Gauge {
+	gauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "oauth2_proxy_provider_fallback_active",
+			Help: "Whether the primary provider is unavailable and the fallback provider is offered (1) or not (0).",
+		},
+	)
+
+	if err := registerer.Register(gauge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Gauge)
+		}
+		panic(err)
+	}
+	return gauge
+}
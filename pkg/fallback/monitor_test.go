@@ -0,0 +1,100 @@
+package fallback
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Monitor", func() {
+	var server *httptest.Server
+	var status int32
+	var registry *prometheus.Registry
+	var monitor *Monitor
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&status, http.StatusOK)
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+
+		registry = prometheus.NewRegistry()
+		monitor = NewMonitor(options.ProviderFallback{
+			Provider:            options.FallbackProviderHtpasswd,
+			Mode:                options.FallbackModeAuto,
+			HealthCheckInterval: time.Second,
+			UnhealthyAfter:      time.Minute,
+		}, []string{server.URL + "/.well-known/openid-configuration", server.URL + "/token"}, registry)
+		monitor.clock.Set(time.Unix(1700000000, 0))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	active := func() float64 {
+		return testutil.ToFloat64(registerActiveGauge(registry))
+	}
+
+	It("keeps the primary provider available while its endpoints respond", func() {
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+		Expect(active()).To(Equal(float64(0)))
+	})
+
+	It("treats client errors as the endpoints being up", func() {
+		atomic.StoreInt32(&status, http.StatusBadRequest)
+		monitor.Check(context.Background())
+		Expect(monitor.clock.Add(2 * time.Minute)).To(Succeed())
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+	})
+
+	It("reports the primary provider unavailable once checks fail for the unhealthy period", func() {
+		atomic.StoreInt32(&status, http.StatusBadGateway)
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+
+		Expect(monitor.clock.Add(30 * time.Second)).To(Succeed())
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+
+		Expect(monitor.clock.Add(30 * time.Second)).To(Succeed())
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeTrue())
+		Expect(active()).To(Equal(float64(1)))
+	})
+
+	It("reports the primary provider available again as soon as a check succeeds", func() {
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		monitor.Check(context.Background())
+		Expect(monitor.clock.Add(time.Minute)).To(Succeed())
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeTrue())
+
+		atomic.StoreInt32(&status, http.StatusOK)
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+		Expect(active()).To(Equal(float64(0)))
+
+		// The unhealthy period starts over with the next failure
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeFalse())
+	})
+
+	It("fails the checks of unreachable endpoints", func() {
+		server.Close()
+		monitor.unhealthyAfter = 0
+		monitor.Check(context.Background())
+		Expect(monitor.Unavailable()).To(BeTrue())
+	})
+})
@@ -1,6 +1,7 @@
 package header
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -8,6 +9,8 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	providerutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
 )
 
 type Injector interface {
@@ -45,10 +48,12 @@ type valueInjector interface {
 
 func newValueinjector(name string, value options.HeaderValue) (valueInjector, error) {
 	switch {
-	case value.SecretSource != nil && value.ClaimSource == nil:
+	case value.SecretSource != nil && value.ClaimSource == nil && value.TemplateSource == nil:
 		return newSecretInjector(name, value.SecretSource)
-	case value.SecretSource == nil && value.ClaimSource != nil:
+	case value.SecretSource == nil && value.ClaimSource != nil && value.TemplateSource == nil:
 		return newClaimInjector(name, value.ClaimSource)
+	case value.SecretSource == nil && value.ClaimSource == nil && value.TemplateSource != nil:
+		return newTemplateInjector(name, value.TemplateSource)
 	default:
 		return nil, fmt.Errorf("header %q value has multiple entries: only one entry per value is allowed", name)
 	}
@@ -85,7 +90,7 @@ func newClaimInjector(name string, source *options.ClaimSource) (valueInjector,
 			return nil, fmt.Errorf("error loading basicAuthPassword: %v", err)
 		}
 		return newInjectorFunc(func(header http.Header, session *sessionsapi.SessionState) {
-			claimValues := session.GetClaim(source.Claim)
+			claimValues := getClaimValues(session, source.Claim)
 			for _, claim := range claimValues {
 				if claim == "" {
 					continue
@@ -96,7 +101,7 @@ func newClaimInjector(name string, source *options.ClaimSource) (valueInjector,
 		}), nil
 	case source.Prefix != "":
 		return newInjectorFunc(func(header http.Header, session *sessionsapi.SessionState) {
-			claimValues := session.GetClaim(source.Claim)
+			claimValues := getClaimValues(session, source.Claim)
 			for _, claim := range claimValues {
 				if claim == "" {
 					continue
@@ -106,7 +111,7 @@ func newClaimInjector(name string, source *options.ClaimSource) (valueInjector,
 		}), nil
 	default:
 		return newInjectorFunc(func(header http.Header, session *sessionsapi.SessionState) {
-			claimValues := session.GetClaim(source.Claim)
+			claimValues := getClaimValues(session, source.Claim)
 			for _, claim := range claimValues {
 				if claim == "" {
 					continue
@@ -116,3 +121,28 @@ func newClaimInjector(name string, source *options.ClaimSource) (valueInjector,
 		}), nil
 	}
 }
+
+// getClaimValues gets the values of a claim from the session.
+// Claims that aren't fields of the session are extracted from the claims
+// stored in the session, or the session's ID token, instead, these may be
+// claim paths such as `resource.roles[*].name`.
+func getClaimValues(session *sessionsapi.SessionState, claim string) []string {
+	if session == nil || session.HasClaim(claim) {
+		return session.GetClaim(claim)
+	}
+
+	extractor, err := providerutil.NewSessionClaimExtractor(context.TODO(), session)
+	if err != nil {
+		logger.Errorf("Could not read claim %q from session: %v", claim, err)
+		return []string{}
+	}
+	if extractor == nil {
+		return []string{}
+	}
+	values := []string{}
+	if _, err := extractor.GetClaimInto(claim, &values); err != nil {
+		logger.Errorf("Could not read claim %q from session: %v", claim, err)
+		return []string{}
+	}
+	return values
+}
@@ -191,6 +191,89 @@ var _ = Describe("Injector Suite", func() {
 				},
 				expectedErr: nil,
 			}),
+			Entry("with a claim path valued header from the ID token", newInjectorTableInput{
+				headers: []options.Header{
+					{
+						Name: "X-Roles",
+						Values: []options.HeaderValue{
+							{
+								ClaimSource: &options.ClaimSource{
+									Claim:  "resource.roles[*].name",
+									Prefix: "role:",
+								},
+							},
+						},
+					},
+				},
+				initialHeaders: http.Header{
+					"foo": []string{"bar", "baz"},
+				},
+				session: &sessionsapi.SessionState{
+					IDToken: "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"resource":{"roles":[{"name":"admin"},{"name":"viewer"}]}}`)) + ".signature",
+				},
+				expectedHeaders: http.Header{
+					"foo":     []string{"bar", "baz"},
+					"X-Roles": []string{"role:admin", "role:viewer"},
+				},
+				expectedErr: nil,
+			}),
+			Entry("with a claim path valued header from the stored claims", newInjectorTableInput{
+				headers: []options.Header{
+					{
+						Name: "X-Roles",
+						Values: []options.HeaderValue{
+							{
+								ClaimSource: &options.ClaimSource{
+									Claim: "resource.roles[*].name",
+								},
+							},
+						},
+					},
+				},
+				initialHeaders: http.Header{
+					"foo": []string{"bar", "baz"},
+				},
+				session: &sessionsapi.SessionState{
+					// Stored claims take precedence over the ID token
+					IDToken: "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"resource":{"roles":[{"name":"admin"}]}}`)) + ".signature",
+					Claims: map[string]interface{}{
+						"resource": map[string]interface{}{
+							"roles": []interface{}{
+								map[string]interface{}{"name": "viewer"},
+							},
+						},
+					},
+				},
+				expectedHeaders: http.Header{
+					"foo":     []string{"bar", "baz"},
+					"X-Roles": []string{"viewer"},
+				},
+				expectedErr: nil,
+			}),
+			Entry("with a claim path valued header selecting objects", newInjectorTableInput{
+				headers: []options.Header{
+					{
+						Name: "X-Roles",
+						Values: []options.HeaderValue{
+							{
+								ClaimSource: &options.ClaimSource{
+									Claim: "resource.roles",
+								},
+							},
+						},
+					},
+				},
+				initialHeaders: http.Header{
+					"foo": []string{"bar", "baz"},
+				},
+				session: &sessionsapi.SessionState{
+					IDToken: "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"resource":{"roles":[{"name":"admin"}]}}`)) + ".signature",
+				},
+				expectedHeaders: http.Header{
+					"foo": []string{"bar", "baz"},
+				},
+				expectedErr: nil,
+			}),
 			Entry("with a basicAuthPassword and claim valued header", newInjectorTableInput{
 				headers: []options.Header{
 					{
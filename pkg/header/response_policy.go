@@ -0,0 +1,102 @@
+package header
+
+import (
+	"net/http"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// ResponsePolicy sets static headers on responses, each either only when the
+// response doesn't already have the header or overwriting it.
+type ResponsePolicy struct {
+	headers []options.ResponseHeaderPolicy
+}
+
+// NewResponsePolicy constructs a ResponsePolicy from the global policy and
+// the policy of an upstream.
+// Headers in the upstream policy replace the headers of the global policy
+// with the same name.
+func NewResponsePolicy(global, upstream []options.ResponseHeaderPolicy) *ResponsePolicy {
+	overridden := make(map[string]struct{}, len(upstream))
+	for _, header := range upstream {
+		overridden[http.CanonicalHeaderKey(header.Name)] = struct{}{}
+	}
+
+	headers := []options.ResponseHeaderPolicy{}
+	for _, header := range global {
+		if _, ok := overridden[http.CanonicalHeaderKey(header.Name)]; !ok {
+			headers = append(headers, header)
+		}
+	}
+	return &ResponsePolicy{headers: append(headers, upstream...)}
+}
+
+// Empty returns whether the policy sets no headers.
+func (p *ResponsePolicy) Empty() bool {
+	return len(p.headers) == 0
+}
+
+// Apply sets the headers of the policy.
+func (p *ResponsePolicy) Apply(header http.Header) {
+	for _, h := range p.headers {
+		if h.Overwrite || header.Get(h.Name) == "" {
+			header.Set(h.Name, h.Value)
+		}
+	}
+}
+
+// Handler applies the policy to the responses of the handler when they are
+// written.
+// The policy isn't applied if the policy of another handler, eg. of the
+// upstream serving the request, has already been applied to the response.
+func (p *ResponsePolicy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&policyResponse{
+			Wrapper: responsewriter.Wrapper{ResponseWriter: rw},
+			policy:  p,
+			scope:   middlewareapi.GetRequestScope(req),
+		}, req)
+	})
+}
+
+// policyResponse is a custom http.ResponseWriter that applies the response
+// header policy before the response is started.
+type policyResponse struct {
+	responsewriter.Wrapper
+
+	policy *ResponsePolicy
+	scope  *middlewareapi.RequestScope
+}
+
+// apply applies the policy unless a policy has already been applied to the
+// response
+func (r *policyResponse) apply() {
+	if r.scope != nil {
+		if r.scope.ResponseHeaderPolicyApplied {
+			return
+		}
+		r.scope.ResponseHeaderPolicyApplied = true
+	}
+	r.policy.Apply(r.ResponseWriter.Header())
+}
+
+// Write writes the response using the ResponseWriter
+func (r *policyResponse) Write(b []byte) (int, error) {
+	r.apply()
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteHeader writes the status code for the Response
+func (r *policyResponse) WriteHeader(s int) {
+	r.apply()
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *policyResponse) Flush() {
+	r.apply()
+	r.Wrapper.Flush()
+}
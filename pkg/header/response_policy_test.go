@@ -0,0 +1,112 @@
+package header
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response Policy Suite", func() {
+	type responsePolicyTableInput struct {
+		global          []options.ResponseHeaderPolicy
+		upstream        []options.ResponseHeaderPolicy
+		initialHeaders  http.Header
+		expectedHeaders http.Header
+	}
+
+	DescribeTable("Apply",
+		func(in responsePolicyTableInput) {
+			headers := http.Header{}
+			for key, values := range in.initialHeaders {
+				headers[key] = values
+			}
+
+			NewResponsePolicy(in.global, in.upstream).Apply(headers)
+			Expect(headers).To(Equal(in.expectedHeaders))
+		},
+		Entry("with no policy", responsePolicyTableInput{
+			initialHeaders:  http.Header{"Foo": []string{"bar"}},
+			expectedHeaders: http.Header{"Foo": []string{"bar"}},
+		}),
+		Entry("sets an absent header", responsePolicyTableInput{
+			global: []options.ResponseHeaderPolicy{
+				{Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+			},
+			expectedHeaders: http.Header{
+				"Strict-Transport-Security": []string{"max-age=31536000"},
+			},
+		}),
+		Entry("keeps a header set by the response", responsePolicyTableInput{
+			global: []options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "DENY"},
+			},
+			initialHeaders:  http.Header{"X-Frame-Options": []string{"SAMEORIGIN"}},
+			expectedHeaders: http.Header{"X-Frame-Options": []string{"SAMEORIGIN"}},
+		}),
+		Entry("overwrites a header set by the response", responsePolicyTableInput{
+			global: []options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "DENY", Overwrite: true},
+			},
+			initialHeaders:  http.Header{"X-Frame-Options": []string{"SAMEORIGIN"}},
+			expectedHeaders: http.Header{"X-Frame-Options": []string{"DENY"}},
+		}),
+		Entry("replaces global headers with the upstream headers of the same name", responsePolicyTableInput{
+			global: []options.ResponseHeaderPolicy{
+				{Name: "Content-Security-Policy", Value: "default-src 'self'", Overwrite: true},
+				{Name: "X-Content-Type-Options", Value: "nosniff"},
+			},
+			upstream: []options.ResponseHeaderPolicy{
+				{Name: "content-security-policy", Value: "default-src *"},
+			},
+			initialHeaders: http.Header{"Content-Security-Policy": []string{"default-src 'none'"}},
+			expectedHeaders: http.Header{
+				"Content-Security-Policy": []string{"default-src 'none'"},
+				"X-Content-Type-Options":  []string{"nosniff"},
+			},
+		}),
+	)
+
+	Context("Handler", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			handler = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("X-Frame-Options", "SAMEORIGIN")
+				rw.WriteHeader(http.StatusTeapot)
+			})
+		})
+
+		It("applies the policy when the response is written", func() {
+			policy := NewResponsePolicy([]options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "DENY", Overwrite: true},
+			}, nil)
+
+			rw := httptest.NewRecorder()
+			policy.Handler(handler).ServeHTTP(rw, httptest.NewRequest("", "/", nil))
+			Expect(rw.Code).To(Equal(http.StatusTeapot))
+			Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+		})
+
+		It("applies only the innermost policy of a request", func() {
+			outer := NewResponsePolicy([]options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "DENY", Overwrite: true},
+				{Name: "X-Content-Type-Options", Value: "nosniff"},
+			}, nil)
+			inner := NewResponsePolicy(nil, []options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "ALLOW-FROM https://example.com", Overwrite: true},
+			})
+
+			req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			outer.Handler(inner.Handler(handler)).ServeHTTP(rw, req)
+			Expect(rw.Header().Get("X-Frame-Options")).To(Equal("ALLOW-FROM https://example.com"))
+			Expect(rw.Header().Get("X-Content-Type-Options")).To(BeEmpty())
+			Expect(middlewareapi.GetRequestScope(req).ResponseHeaderPolicyApplied).To(BeTrue())
+		})
+	})
+})
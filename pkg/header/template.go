@@ -0,0 +1,177 @@
+package header
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// templateFieldRegex matches the names of claims that can be used as fields
+// of a template
+var templateFieldRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// templateSessionFields are the fields of the session given to templates,
+// with the claims they are loaded from
+var templateSessionFields = map[string]string{
+	"User":              "user",
+	"Email":             "email",
+	"Groups":            "groups",
+	"PreferredUsername": "preferred_username",
+}
+
+var templateFuncs = template.FuncMap{
+	"join": joinTemplateValue,
+}
+
+// ParseTemplate parses the template of a header value, checking that it only
+// uses the fields of the session and the claims it names.
+func ParseTemplate(name string, source options.TemplateSource) (*template.Template, error) {
+	for field := range source.Claims {
+		if !templateFieldRegex.MatchString(field) {
+			return nil, fmt.Errorf("invalid claim field %q: must be a template identifier", field)
+		}
+		if _, ok := templateSessionFields[field]; ok {
+			return nil, fmt.Errorf("invalid claim field %q: the field is set from the session", field)
+		}
+		if source.Claims[field] == "" {
+			return nil, fmt.Errorf("claim field %q has an empty claim", field)
+		}
+	}
+
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(source.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	fields := map[string]struct{}{}
+	templateFields(tmpl.Tree.Root, fields)
+	for field := range fields {
+		_, isSessionField := templateSessionFields[field]
+		if _, isClaim := source.Claims[field]; !isSessionField && !isClaim {
+			return nil, fmt.Errorf("template uses unknown field %q: add it to claims", field)
+		}
+	}
+	return tmpl, nil
+}
+
+// templateFields collects the names of the fields the template node uses
+func templateFields(node parse.Node, fields map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		templateFields(n.Pipe, fields)
+	case *parse.IfNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.RangeNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.WithNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			templateFields(cmd, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			templateFields(arg, fields)
+		}
+	case *parse.ChainNode:
+		templateFields(n.Node, fields)
+	case *parse.FieldNode:
+		fields[n.Ident[0]] = struct{}{}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			fields[n.Ident[1]] = struct{}{}
+		}
+	}
+}
+
+func templateBranchFields(n *parse.BranchNode, fields map[string]struct{}) {
+	templateFields(n.Pipe, fields)
+	templateFields(n.List, fields)
+	templateFields(n.ElseList, fields)
+}
+
+// joinTemplateValue joins the values of a list with the separator, single
+// values are returned as they are
+func joinTemplateValue(sep string, value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, sep)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func newTemplateInjector(name string, source *options.TemplateSource) (valueInjector, error) {
+	tmpl, err := ParseTemplate(name, *source)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]string, len(templateSessionFields)+len(source.Claims))
+	for field, claim := range templateSessionFields {
+		claims[field] = claim
+	}
+	for field, claim := range source.Claims {
+		claims[field] = claim
+	}
+
+	return newInjectorFunc(func(header http.Header, session *sessionsapi.SessionState) {
+		if session == nil {
+			return
+		}
+
+		data := make(map[string]interface{}, len(claims))
+		for field, claim := range claims {
+			data[field] = templateValue(getClaimValues(session, claim))
+		}
+		// Groups are always a list, so that they can be ranged over whatever
+		// their number
+		data["Groups"] = session.GetClaim("groups")
+
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			logger.Errorf("Could not render template for header %q: %v", name, err)
+			return
+		}
+		switch {
+		case value.Len() == 0:
+			return
+		case strings.ContainsAny(value.String(), "\r\n"):
+			logger.Errorf("Rendered template for header %q contains a line break, the header isn't added", name)
+			return
+		}
+		header.Add(name, value.String())
+	}), nil
+}
+
+// templateValue is a single claim value as a string, otherwise the list of
+// the values of the claim
+func templateValue(values []string) interface{} {
+	switch len(values) {
+	case 0:
+		return ""
+	case 1:
+		return values[0]
+	default:
+		return values
+	}
+}
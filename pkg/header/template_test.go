@@ -0,0 +1,136 @@
+package header
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Template Injector Suite", func() {
+	idToken := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(
+		`{"tid":"contoso","roles":["admin","viewer"],"resource":{"region":"eu"},"note":"a\nb"}`,
+	)) + ".signature"
+
+	session := &sessionsapi.SessionState{
+		User:              "jdoe",
+		Email:             "john.doe@example.com",
+		Groups:            []string{"staff"},
+		PreferredUsername: "john",
+		IDToken:           idToken,
+	}
+
+	type templateInjectorTableInput struct {
+		source          options.TemplateSource
+		session         *sessionsapi.SessionState
+		expectedHeaders http.Header
+		expectedErr     error
+	}
+
+	DescribeTable("injects the rendered template",
+		func(in templateInjectorTableInput) {
+			injector, err := NewInjector([]options.Header{
+				{
+					Name:   "X-User",
+					Values: []options.HeaderValue{{TemplateSource: &in.source}},
+				},
+			})
+			if in.expectedErr != nil {
+				Expect(err).To(MatchError(in.expectedErr))
+				Expect(injector).To(BeNil())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := http.Header{}
+			injector.Inject(headers, in.session)
+			Expect(headers).To(Equal(in.expectedHeaders))
+		},
+		Entry("with the fields of the session", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .User }} <{{ .Email }}> {{ .PreferredUsername }} {{ join "," .Groups }}`,
+			},
+			session: session,
+			expectedHeaders: http.Header{
+				"X-User": []string{"jdoe <john.doe@example.com> john staff"},
+			},
+		}),
+		Entry("with named claims", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .PreferredUsername }}@{{ .TenantID }}.{{ .Region }}`,
+				Claims: map[string]string{
+					"TenantID": "tid",
+					"Region":   "resource.region",
+				},
+			},
+			session: session,
+			expectedHeaders: http.Header{
+				"X-User": []string{"john@contoso.eu"},
+			},
+		}),
+		Entry("with a joined list claim", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `roles={{ join ";" .Roles }}`,
+				Claims:   map[string]string{"Roles": "roles"},
+			},
+			session: session,
+			expectedHeaders: http.Header{
+				"X-User": []string{"roles=admin;viewer"},
+			},
+		}),
+		Entry("with a missing claim rendering an empty value", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .Department }}`,
+				Claims:   map[string]string{"Department": "department"},
+			},
+			session:         session,
+			expectedHeaders: http.Header{},
+		}),
+		Entry("with a claim rendering a line break", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .Note }}`,
+				Claims:   map[string]string{"Note": "note"},
+			},
+			session:         session,
+			expectedHeaders: http.Header{},
+		}),
+		Entry("without a session", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .User }}`,
+			},
+			session:         nil,
+			expectedHeaders: http.Header{},
+		}),
+		Entry("with an invalid template", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .User`,
+			},
+			expectedErr: errors.New("error building injector for header \"X-User\": invalid template: template: X-User:1: unclosed action"),
+		}),
+		Entry("with an unknown field", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ if .Admin }}admin{{ end }}`,
+			},
+			expectedErr: errors.New("error building injector for header \"X-User\": template uses unknown field \"Admin\": add it to claims"),
+		}),
+		Entry("with a claim named as a session field", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .User }}`,
+				Claims:   map[string]string{"User": "sub"},
+			},
+			expectedErr: errors.New("error building injector for header \"X-User\": invalid claim field \"User\": the field is set from the session"),
+		}),
+		Entry("with an invalid claim name", templateInjectorTableInput{
+			source: options.TemplateSource{
+				Template: `{{ .User }}`,
+				Claims:   map[string]string{"tenant-id": "tid"},
+			},
+			expectedErr: errors.New("error building injector for header \"X-User\": invalid claim field \"tenant-id\": must be a template identifier"),
+		}),
+	)
+})
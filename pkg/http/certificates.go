@@ -0,0 +1,208 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultCertificateName is the name of the certificate presented to clients
+// that don't request one of the SNI certificates in the expiry metric
+const defaultCertificateName = "default"
+
+// certificateStore holds the certificates presented by a TLS server, selecting
+// them by the server name clients request through SNI.
+// The certificates are loaded again at the reload interval and on SIGHUP, so
+// that they can be rotated without a restart.
+type certificateStore struct {
+	opts    *options.TLS
+	address string
+
+	mu          sync.RWMutex
+	defaultCert *tls.Certificate
+	byName      map[string]*tls.Certificate
+	expiries    map[string]time.Time
+}
+
+// newCertificateStore loads the certificates of the TLS options
+func newCertificateStore(opts *options.TLS, address string) (*certificateStore, error) {
+	s := &certificateStore{
+		opts:    opts,
+		address: address,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load loads all certificates from their sources, only replacing the current
+// certificates once all of them have been loaded
+func (s *certificateStore) load() error {
+	defaultCert, err := getCertificate(s.opts.Cert, s.opts.Key)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	expiries := map[string]time.Time{
+		defaultCertificateName: defaultCert.Leaf.NotAfter,
+	}
+	for _, sni := range s.opts.SNICertificates {
+		name := strings.Join(sni.Hostnames, ",")
+		cert, err := getCertificate(sni.Cert, sni.Key)
+		if err != nil {
+			return fmt.Errorf("certificate for %q: %v", name, err)
+		}
+		for _, hostname := range sni.Hostnames {
+			byName[strings.ToLower(hostname)] = cert
+		}
+		expiries[name] = cert.Leaf.NotAfter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultCert = defaultCert
+	s.byName = byName
+	s.expiries = expiries
+	return nil
+}
+
+// GetCertificate returns the certificate for the server name of the client:
+// the certificate of the exact hostname, then that of a wildcard matching it,
+// and the default certificate otherwise.
+// It is used as the GetCertificate function of the tls.Config.
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.defaultCert, nil
+}
+
+// watch loads the certificates again at the reload interval and on SIGHUP
+// until the context is cancelled.
+// The previous certificates are kept when they can't be loaded.
+func (s *certificateStore) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval := s.opts.ReloadInterval.Duration(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		if err := s.load(); err != nil {
+			logger.Errorf("Error reloading TLS certificates for %s, keeping the previous certificates: %v", s.address, err)
+		}
+	}
+}
+
+// getExpiries returns when each of the certificates expires by their name
+func (s *certificateStore) getExpiries() map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expiries
+}
+
+// getCertificate loads the certificate from its cert and key data.
+func getCertificate(certSrc, keySrc *options.SecretSource) (*tls.Certificate, error) {
+	keyData, err := getSecretValue(keySrc)
+	if err != nil {
+		return nil, fmt.Errorf("could not load key data: %v", err)
+	}
+
+	certData, err := getSecretValue(certSrc)
+	if err != nil {
+		return nil, fmt.Errorf("could not load cert data: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate data: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate data: %v", err)
+	}
+
+	return &cert, nil
+}
+
+// certificateCollector exposes the days until the certificates of the TLS
+// servers expire, computed whenever the metrics are collected
+type certificateCollector struct {
+	desc *prometheus.Desc
+	now  func() time.Time
+
+	mu     sync.Mutex
+	stores []*certificateStore
+}
+
+var (
+	certificateExpiry = &certificateCollector{
+		desc: prometheus.NewDesc(
+			"oauth2_proxy_tls_certificate_expiry_days",
+			"Days until the certificates of the TLS servers expire, negative once they have expired.",
+			[]string{"address", "certificate"},
+			nil,
+		),
+		now: time.Now,
+	}
+	registerCertificateExpiry sync.Once
+)
+
+// add adds the certificates of the store to the metric
+func (c *certificateCollector) add(s *certificateStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stores = append(c.stores, s)
+}
+
+// Describe implements the prometheus.Collector interface
+func (c *certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements the prometheus.Collector interface
+func (c *certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, s := range c.stores {
+		for name, notAfter := range s.getExpiries() {
+			days := notAfter.Sub(now).Hours() / 24
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, days, s.address, name)
+		}
+	}
+}
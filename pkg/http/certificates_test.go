@@ -0,0 +1,153 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Certificates Suite", func() {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// generateCertificate returns the PEM encoded certificate and key for the
+	// DNS names, expiring after the given number of days
+	generateCertificate := func(days int, dnsNames ...string) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: dnsNames[0]},
+			DNSNames:     dnsNames,
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.AddDate(0, 0, days),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+
+		certOut := new(bytes.Buffer)
+		Expect(pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der})).To(Succeed())
+		keyOut := new(bytes.Buffer)
+		Expect(pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})).To(Succeed())
+		return certOut.Bytes(), keyOut.Bytes()
+	}
+
+	// writeCertificate writes the certificate and key for the DNS names to the
+	// directory, returning their sources
+	var dir string
+	writeCertificate := func(days int, dnsNames ...string) (*options.SecretSource, *options.SecretSource) {
+		cert, key := generateCertificate(days, dnsNames...)
+		certFile := filepath.Join(dir, dnsNames[0]+".crt")
+		keyFile := filepath.Join(dir, dnsNames[0]+".key")
+		Expect(ioutil.WriteFile(certFile, cert, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(keyFile, key, 0600)).To(Succeed())
+		return &options.SecretSource{FromFile: certFile}, &options.SecretSource{FromFile: keyFile}
+	}
+
+	serverName := func(store *certificateStore, name string) string {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		Expect(err).ToNot(HaveOccurred())
+		return cert.Leaf.Subject.CommonName
+	}
+
+	var opts *options.TLS
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "oauth2-proxy-certificates")
+		Expect(err).ToNot(HaveOccurred())
+
+		defaultCert, defaultKey := writeCertificate(30, "default.example.com")
+		appCert, appKey := writeCertificate(60, "app.example.com", "*.app.example.com")
+		adminCert, adminKey := writeCertificate(90, "admin.app.example.com")
+		opts = &options.TLS{
+			Cert: defaultCert,
+			Key:  defaultKey,
+			SNICertificates: []options.SNICertificate{
+				{Hostnames: []string{"app.example.com", "*.app.example.com"}, Cert: appCert, Key: appKey},
+				{Hostnames: []string{"Admin.App.Example.com"}, Cert: adminCert, Key: adminKey},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("selects the certificate by the server name", func() {
+		store, err := newCertificateStore(opts, "127.0.0.1:443")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(serverName(store, "app.example.com")).To(Equal("app.example.com"))
+		Expect(serverName(store, "www.app.example.com")).To(Equal("app.example.com"))
+		Expect(serverName(store, "ADMIN.app.example.com.")).To(Equal("admin.app.example.com"))
+		// Wildcards only match a single label
+		Expect(serverName(store, "www.admin.app.example.com")).To(Equal("default.example.com"))
+		Expect(serverName(store, "other.example.com")).To(Equal("default.example.com"))
+		// Clients without SNI get the default certificate
+		Expect(serverName(store, "")).To(Equal("default.example.com"))
+	})
+
+	It("fails when an SNI certificate can't be loaded", func() {
+		opts.SNICertificates[1].Key = &options.SecretSource{FromFile: filepath.Join(dir, "missing.key")}
+		_, err := newCertificateStore(opts, "127.0.0.1:443")
+		Expect(err).To(MatchError(HavePrefix("certificate for \"Admin.App.Example.com\": could not load key data:")))
+	})
+
+	It("reloads the certificates, keeping the previous ones when they can't be loaded", func() {
+		opts.ReloadInterval = options.Duration(10 * time.Millisecond)
+		store, err := newCertificateStore(opts, "127.0.0.1:443")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go store.watch(ctx)
+
+		Expect(ioutil.WriteFile(opts.SNICertificates[0].Cert.FromFile, []byte("invalid"), 0600)).To(Succeed())
+		Consistently(func() string { return serverName(store, "app.example.com") }, 50*time.Millisecond).Should(Equal("app.example.com"))
+
+		cert, key := generateCertificate(60, "rotated.app.example.com")
+		Expect(ioutil.WriteFile(opts.SNICertificates[0].Key.FromFile, key, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(opts.SNICertificates[0].Cert.FromFile, cert, 0600)).To(Succeed())
+		Eventually(func() string { return serverName(store, "app.example.com") }).Should(Equal("rotated.app.example.com"))
+	})
+
+	It("exposes the days until the certificates expire", func() {
+		store, err := newCertificateStore(opts, "127.0.0.1:443")
+		Expect(err).ToNot(HaveOccurred())
+
+		collector := &certificateCollector{
+			desc: certificateExpiry.desc,
+			now:  func() time.Time { return now.Add(24 * time.Hour) },
+		}
+		collector.add(store)
+
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP oauth2_proxy_tls_certificate_expiry_days Days until the certificates of the TLS servers expire, negative once they have expired.
+# TYPE oauth2_proxy_tls_certificate_expiry_days gauge
+oauth2_proxy_tls_certificate_expiry_days{address="127.0.0.1:443",certificate="Admin.App.Example.com"} 89
+oauth2_proxy_tls_certificate_expiry_days{address="127.0.0.1:443",certificate="app.example.com,*.app.example.com"} 59
+oauth2_proxy_tls_certificate_expiry_days{address="127.0.0.1:443",certificate="default"} 29
+`))).To(Succeed())
+		Expect(prometheus.NewPedanticRegistry().Register(collector)).To(Succeed())
+	})
+})
@@ -0,0 +1,228 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// proxyProtocolHeaderTimeout is the maximum time allowed to receive the
+	// PROXY protocol header of a connection
+	proxyProtocolHeaderTimeout = 10 * time.Second
+
+	// proxyProtocolV1MaxLength is the maximum length of a v1 header, including
+	// the CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+// proxyProtocolV2Signature starts the binary v2 headers
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections starting with a PROXY protocol v1
+// or v2 header, as sent by L4 load balancers, whose remote address is the
+// address of the client given by the header.
+// The header is read on the first use of the connection rather than when it
+// is accepted, so that a slow client never holds back the other connections.
+type proxyProtocolListener struct {
+	net.Listener
+
+	// trusted are the addresses sending the headers, connections from other
+	// addresses are served without a header. Every connection must send a
+	// header when it is nil.
+	trusted *ip.NetSet
+}
+
+// newProxyProtocolListener wraps the listener to accept PROXY protocol headers
+// from the trusted IPs or CIDR ranges
+func newProxyProtocolListener(listener net.Listener, trustedIPs []string) (net.Listener, error) {
+	l := &proxyProtocolListener{Listener: listener}
+	if len(trustedIPs) > 0 {
+		l.trusted = ip.NewNetSet()
+		for _, ipStr := range trustedIPs {
+			ipNet := ip.ParseIPNet(ipStr)
+			if ipNet == nil {
+				return nil, fmt.Errorf("could not parse PROXY protocol trusted IP %q", ipStr)
+			}
+			l.trusted.AddIPNet(*ipNet)
+		}
+	}
+	return l, nil
+}
+
+// Accept accepts the next connection, whose header is read when it is first
+// used
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:     conn,
+		reader:   bufio.NewReader(conn),
+		required: l.requiresHeader(conn.RemoteAddr()),
+	}, nil
+}
+
+// requiresHeader checks whether connections from the address must send a
+// header
+func (l *proxyProtocolListener) requiresHeader(addr net.Addr) bool {
+	if l.trusted == nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && l.trusted.Has(tcpAddr.IP)
+}
+
+// proxyProtocolConn is a connection whose remote address is the client
+// address of its PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read reads the data following the header.
+// Invalid headers fail as read errors of the connection, so that the server
+// closes it without a response.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: c.Conn.RemoteAddr(), Err: c.err}
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the address of the
+// connection when the header has none
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header of the connection, when it must send one.
+// Connections with an invalid header fail on their first read.
+func (c *proxyProtocolConn) readHeader() {
+	if !c.required {
+		return
+	}
+
+	if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout)); err != nil {
+		c.err = err
+		return
+	}
+	c.remote, c.err = readProxyProtocolHeader(c.reader)
+	if c.err != nil {
+		logger.Errorf("Error reading the PROXY protocol header of the connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+		return
+	}
+	c.err = c.Conn.SetReadDeadline(time.Time{})
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header, returning the address of
+// the client, or nil when the header has none, such as for the health checks
+// of the load balancer
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	// The signature of v2 headers is shorter than any v1 header
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header: %v", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyProtocolV2Signature):
+		return readProxyProtocolV2Header(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyProtocolV1Header(r)
+	default:
+		return nil, errors.New("the connection doesn't start with a PROXY protocol header")
+	}
+}
+
+// readProxyProtocolV1Header reads a human readable v1 header, such as
+// `PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`
+func readProxyProtocolV1Header(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("could not read the v1 header: %v", err)
+	}
+	if len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	clientIP := net.ParseIP(fields[2])
+	if clientIP == nil || (clientIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 header source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 header source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: clientIP, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2Header reads a binary v2 header, ignoring its TLVs
+func readProxyProtocolV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("could not read the v2 header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("could not read the v2 header addresses: %v", err)
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL connections are opened by the load balancer itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 header command %d", command)
+	}
+
+	switch family {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errors.New("malformed v2 header IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errors.New("malformed v2 header IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// Unix sockets and unspecified addresses don't identify the client
+		return nil, nil
+	}
+}
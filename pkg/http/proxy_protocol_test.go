@@ -0,0 +1,155 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// proxyProtocolV2Header builds a v2 header with the command, family and
+// payload
+func proxyProtocolV2Header(command, family byte, payload []byte) string {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+var _ = Describe("PROXY protocol", func() {
+	ipv4Payload := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6Payload := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+
+	DescribeTable("readProxyProtocolHeader",
+		func(header string, expectedAddr string, expectedErr string) {
+			r := bufio.NewReader(strings.NewReader(header + "GET / HTTP/1.1\r\n"))
+			addr, err := readProxyProtocolHeader(r)
+			if expectedErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			if expectedAddr == "" {
+				Expect(addr).To(BeNil())
+			} else {
+				Expect(addr.String()).To(Equal(expectedAddr))
+			}
+
+			rest, err := ioutil.ReadAll(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(rest)).To(Equal("GET / HTTP/1.1\r\n"))
+		},
+		Entry("a v1 TCP4 header", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", ""),
+		Entry("a v1 TCP6 header", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", ""),
+		Entry("a v1 UNKNOWN header", "PROXY UNKNOWN\r\n", "", ""),
+		Entry("a v1 header with a mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", "invalid v1 header source address"),
+		Entry("a v1 header with an invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", "invalid v1 header source port"),
+		Entry("a v1 header without a CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", "malformed v1 header"),
+		Entry("a v2 IPv4 header", proxyProtocolV2Header(0x1, 0x1, ipv4Payload), "192.0.2.1:56324", ""),
+		Entry("a v2 IPv6 header", proxyProtocolV2Header(0x1, 0x2, ipv6Payload), "[2001:db8::1]:56324", ""),
+		Entry("a v2 IPv4 header with TLVs", proxyProtocolV2Header(0x1, 0x1, append(append([]byte{}, ipv4Payload...), 0x04, 0x00, 0x00)), "192.0.2.1:56324", ""),
+		Entry("a v2 LOCAL header", proxyProtocolV2Header(0x0, 0x0, nil), "", ""),
+		Entry("a v2 header with truncated addresses", proxyProtocolV2Header(0x1, 0x1, ipv4Payload[:8]), "", "malformed v2 header IPv4 addresses"),
+		Entry("a v2 header with an unknown command", proxyProtocolV2Header(0x2, 0x1, ipv4Payload), "", "unsupported v2 header command 2"),
+		Entry("a connection without a header", "", "", "the connection doesn't start with a PROXY protocol header"),
+	)
+
+	Context("proxyProtocolListener", func() {
+		var listener net.Listener
+
+		// serve serves the remote address of the requests of the listener with
+		// the PROXY protocol trusted IPs
+		serve := func(trustedIPs []string) {
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			listener, err = newProxyProtocolListener(tcpListener, trustedIPs)
+			Expect(err).ToNot(HaveOccurred())
+
+			srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(req.RemoteAddr))
+			})}
+			go func() {
+				defer GinkgoRecover()
+				_ = srv.Serve(listener)
+			}()
+		}
+
+		AfterEach(func() {
+			Expect(listener.Close()).To(Succeed())
+		})
+
+		// request sends a request after the header, returning the response
+		// body, or an error when the connection is closed without a response
+		request := func(header string) (string, error) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", header)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return string(body), nil
+		}
+
+		It("takes the remote address from the header", func() {
+			serve(nil)
+
+			body, err := request("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(Equal("192.0.2.1:56324"))
+
+			body, err = request(proxyProtocolV2Header(0x1, 0x2, ipv6Payload))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(Equal("[2001:db8::1]:56324"))
+		})
+
+		It("keeps the address of the connection without a client address", func() {
+			serve(nil)
+
+			body, err := request("PROXY UNKNOWN\r\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(HavePrefix("127.0.0.1:"))
+		})
+
+		It("closes the connections without a header", func() {
+			serve(nil)
+
+			_, err := request("")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("only reads the headers of the trusted IPs", func() {
+			serve([]string{"192.0.2.0/24"})
+
+			body, err := request("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(HavePrefix("127.0.0.1:"))
+
+			// The header of an untrusted connection is an invalid request
+			body, err = request("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(ContainSubstring("400 Bad Request"))
+		})
+
+		It("rejects invalid trusted IPs", func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = newProxyProtocolListener(listener, []string{"lb.local"})
+			Expect(err).To(MatchError(`could not parse PROXY protocol trusted IP "lb.local"`))
+		})
+	})
+})
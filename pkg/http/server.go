@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -13,6 +14,9 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -35,12 +39,28 @@ type Opts struct {
 
 	// TLS is the TLS configuration for the server.
 	TLS *options.TLS
+
+	// HTTP2 serves HTTP/2 to the clients that support it, such as gRPC
+	// clients, negotiated over TLS on the HTTPS server, and with prior
+	// knowledge or an h2c upgrade on the HTTP server.
+	HTTP2 bool
+
+	// ProxyProtocol accepts PROXY protocol headers on the connections of the
+	// HTTP and HTTPS listeners, taking the address of the client from them.
+	ProxyProtocol bool
+
+	// ProxyProtocolTrustedIPs are the IPs or CIDR ranges of the load
+	// balancers sending PROXY protocol headers. Connections from other
+	// addresses are served without a header, while every connection must send
+	// one when it is empty.
+	ProxyProtocolTrustedIPs []string
 }
 
 // NewServer creates a new Server from the options given.
 func NewServer(opts Opts) (Server, error) {
 	s := &server{
 		handler: opts.Handler,
+		http2:   opts.HTTP2,
 	}
 	if err := s.setupListener(opts); err != nil {
 		return nil, fmt.Errorf("error setting up listener: %v", err)
@@ -55,9 +75,13 @@ func NewServer(opts Opts) (Server, error) {
 // server is an implementation of the Server interface.
 type server struct {
 	handler http.Handler
+	http2   bool
 
 	listener    net.Listener
 	tlsListener net.Listener
+
+	// certificates are the certificates of the TLS listener
+	certificates *certificateStore
 }
 
 // setupListener sets the server listener if the HTTP server is enabled.
@@ -76,6 +100,12 @@ func (s *server) setupListener(opts Opts) error {
 	if err != nil {
 		return fmt.Errorf("listen (%s, %s) failed: %v", networkType, listenAddr, err)
 	}
+	if opts.ProxyProtocol {
+		listener, err = newProxyProtocolListener(listener, opts.ProxyProtocolTrustedIPs)
+		if err != nil {
+			return err
+		}
+	}
 	s.listener = listener
 
 	return nil
@@ -116,14 +146,17 @@ func (s *server) setupTLSListener(opts Opts) error {
 		MaxVersion: tls.VersionTLS13,
 		NextProtos: []string{"http/1.1"},
 	}
+	if opts.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
 	if opts.TLS == nil {
 		return errors.New("no TLS config provided")
 	}
-	cert, err := getCertificate(opts.TLS)
+	certificates, err := newCertificateStore(opts.TLS, opts.SecureBindAddress)
 	if err != nil {
 		return fmt.Errorf("could not load certificate: %v", err)
 	}
-	config.Certificates = []tls.Certificate{cert}
+	config.GetCertificate = certificates.GetCertificate
 
 	if len(opts.TLS.CipherSuites) > 0 {
 		cipherSuites, err := parseCipherSuites(opts.TLS.CipherSuites)
@@ -133,6 +166,19 @@ func (s *server) setupTLSListener(opts Opts) error {
 		config.CipherSuites = cipherSuites
 	}
 
+	if opts.TLS.ClientCA != nil {
+		caData, err := getSecretValue(opts.TLS.ClientCA)
+		if err != nil {
+			return fmt.Errorf("could not load client CA data: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return errors.New("could not parse client CA data: no PEM encoded certificates found")
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
 	if len(opts.TLS.MinVersion) > 0 {
 		switch opts.TLS.MinVersion {
 		case "TLS1.2":
@@ -151,7 +197,21 @@ func (s *server) setupTLSListener(opts Opts) error {
 		return fmt.Errorf("listen (%s) failed: %v", listenAddr, err)
 	}
 
-	s.tlsListener = tls.NewListener(tcpKeepAliveListener{listener.(*net.TCPListener)}, config)
+	// The PROXY protocol header precedes the TLS handshake
+	var tcpListener net.Listener = tcpKeepAliveListener{listener.(*net.TCPListener)}
+	if opts.ProxyProtocol {
+		tcpListener, err = newProxyProtocolListener(tcpListener, opts.ProxyProtocolTrustedIPs)
+		if err != nil {
+			return err
+		}
+	}
+	s.tlsListener = tls.NewListener(tcpListener, config)
+	s.certificates = certificates
+
+	registerCertificateExpiry.Do(func() {
+		prometheus.MustRegister(certificateExpiry)
+	})
+	certificateExpiry.add(certificates)
 	return nil
 }
 
@@ -162,8 +222,14 @@ func (s *server) Start(ctx context.Context) error {
 	g, groupCtx := errgroup.WithContext(ctx)
 
 	if s.listener != nil {
+		handler := s.handler
+		if s.http2 {
+			// HTTP/2 without TLS can't be negotiated, the clients either
+			// know the server supports it or ask to upgrade to it
+			handler = h2c.NewHandler(handler, &http2.Server{})
+		}
 		g.Go(func() error {
-			if err := s.startServer(groupCtx, s.listener); err != nil {
+			if err := s.startServer(groupCtx, s.listener, handler); err != nil {
 				return fmt.Errorf("error starting insecure server: %v", err)
 			}
 			return nil
@@ -172,21 +238,26 @@ func (s *server) Start(ctx context.Context) error {
 
 	if s.tlsListener != nil {
 		g.Go(func() error {
-			if err := s.startServer(groupCtx, s.tlsListener); err != nil {
+			if err := s.startServer(groupCtx, s.tlsListener, s.handler); err != nil {
 				return fmt.Errorf("error starting secure server: %v", err)
 			}
 			return nil
 		})
+		g.Go(func() error {
+			s.certificates.watch(groupCtx)
+			return nil
+		})
 	}
 
 	return g.Wait()
 }
 
-// startServer creates and starts a new server with the given listener.
+// startServer creates and starts a new server with the given listener and
+// handler.
 // When the given context is cancelled the server will be shutdown.
 // If any errors occur, only the first error will be returned.
-func (s *server) startServer(ctx context.Context, listener net.Listener) error {
-	srv := &http.Server{Handler: s.handler}
+func (s *server) startServer(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler}
 	g, groupCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
@@ -230,26 +301,6 @@ func getListenAddress(addr string) string {
 	return slice[len(slice)-1]
 }
 
-// getCertificate loads the certificate data from the TLS config.
-func getCertificate(opts *options.TLS) (tls.Certificate, error) {
-	keyData, err := getSecretValue(opts.Key)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not load key data: %v", err)
-	}
-
-	certData, err := getSecretValue(opts.Cert)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not load cert data: %v", err)
-	}
-
-	cert, err := tls.X509KeyPair(certData, keyData)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not parse certificate data: %v", err)
-	}
-
-	return cert, nil
-}
-
 // getSecretValue wraps util.GetSecretValue so that we can return an error if no
 // source is provided.
 func getSecretValue(src *options.SecretSource) ([]byte, error) {
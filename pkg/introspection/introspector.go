@@ -0,0 +1,305 @@
+package introspection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// The results of introspection requests
+	resultActive   = "active"
+	resultInactive = "inactive"
+	resultError    = "error"
+
+	// maxCacheEntries bounds the number of cached introspections, so that
+	// clients presenting many tokens can't exhaust the memory
+	maxCacheEntries = 10000
+)
+
+var (
+	// ErrInactive is returned when the introspection endpoint reports that
+	// the token is not active, eg. because it expired or was revoked
+	ErrInactive = errors.New("token is not active")
+)
+
+// Introspector verifies opaque bearer tokens with an RFC 7662 token
+// introspection endpoint, creating sessions from the introspection of the
+// active tokens.
+// Active tokens are cached for the cache TTL, at most until they expire.
+type Introspector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	cacheTTL     time.Duration
+
+	emailClaim  string
+	groupsClaim string
+	storeClaims []string
+
+	cache   *cache
+	metrics *metrics
+	clock   clock.Clock
+}
+
+// NewIntrospector creates an Introspector for the introspection endpoint.
+// The email and groups of the sessions are read from the introspection
+// response with the claim paths of the OIDC options, and the session store
+// claims are copied into the sessions.
+func NewIntrospector(opts options.Introspection, oidc options.OIDCOptions, storeClaims []string, registerer prometheus.Registerer) (*Introspector, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid introspection url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid introspection url %q: the scheme must be http or https", opts.URL)
+	}
+	if opts.CacheTTL < 0 {
+		return nil, fmt.Errorf("invalid introspection cache ttl %q: must not be negative", opts.CacheTTL)
+	}
+
+	return &Introspector{
+		url:          opts.URL,
+		clientID:     opts.ClientID,
+		clientSecret: opts.ClientSecret,
+		cacheTTL:     opts.CacheTTL,
+		emailClaim:   oidc.EmailClaim,
+		groupsClaim:  oidc.GroupsClaim,
+		storeClaims:  storeClaims,
+		cache:        &cache{entries: map[string]cacheEntry{}},
+		metrics:      newMetrics(registerer),
+	}, nil
+}
+
+// TokenToSession introspects the token, returning a session for it when it
+// is active.
+// ErrInactive is returned for tokens that aren't active.
+func (i *Introspector) TokenToSession(ctx context.Context, token string) (*sessionsapi.SessionState, error) {
+	key := cacheKey(token)
+	if session, ok := i.cache.get(key, i.clock.Now()); ok {
+		i.metrics.cacheHits.Inc()
+		return session, nil
+	}
+
+	claims, err := i.introspect(ctx, token)
+	if err != nil {
+		if errors.Is(err, ErrInactive) {
+			i.metrics.requests.WithLabelValues(resultInactive).Inc()
+		} else {
+			i.metrics.requests.WithLabelValues(resultError).Inc()
+		}
+		return nil, err
+	}
+	i.metrics.requests.WithLabelValues(resultActive).Inc()
+
+	session, err := i.newSession(ctx, token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.cacheTTL > 0 {
+		expires := i.clock.Now().Add(i.cacheTTL)
+		if session.ExpiresOn != nil && session.ExpiresOn.Before(expires) {
+			expires = *session.ExpiresOn
+		}
+		i.cache.set(key, session, expires, i.clock.Now())
+	}
+	return session, nil
+}
+
+// introspect posts the token to the introspection endpoint, authenticating
+// with the client credentials, and returns the response of active tokens
+func (i *Introspector) introspect(ctx context.Context, token string) (*simplejson.Json, error) {
+	params := url.Values{}
+	params.Set("token", token)
+	params.Set("token_type_hint", "access_token")
+
+	builder := requests.New(i.url).
+		WithContext(ctx).
+		WithMethod(http.MethodPost).
+		WithBody(strings.NewReader(params.Encode())).
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		SetHeader("Accept", "application/json")
+	if i.clientID != "" {
+		// The client credentials are form encoded before they are combined,
+		// as described by RFC 6749 section 2.3.1
+		credentials := url.QueryEscape(i.clientID) + ":" + url.QueryEscape(i.clientSecret)
+		builder = builder.SetHeader("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	claims, err := builder.Do().UnmarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("error introspecting token: %v", err)
+	}
+	if active, _ := claims.Get("active").Bool(); !active {
+		return nil, ErrInactive
+	}
+	return claims, nil
+}
+
+// newSession creates a session from the introspection response of an active
+// token
+func (i *Introspector) newSession(ctx context.Context, token string, claims *simplejson.Json) (*sessionsapi.SessionState, error) {
+	now := i.clock.Now()
+	subject := claims.Get("sub").MustString()
+	username := claims.Get("username").MustString()
+
+	session := &sessionsapi.SessionState{
+		User:              subject,
+		PreferredUsername: username,
+		AccessToken:       token,
+		CreatedAt:         &now,
+		BearerToken: &sessionsapi.BearerToken{
+			Audiences: audiences(claims.Get("aud").Interface()),
+			Scopes:    strings.Fields(claims.Get("scope").MustString()),
+		},
+	}
+	if session.User == "" {
+		session.User = username
+	}
+
+	if exp, err := claims.Get("exp").Int64(); err == nil {
+		expiresOn := time.Unix(exp, 0)
+		if !expiresOn.After(now) {
+			return nil, ErrInactive
+		}
+		session.ExpiresOn = &expiresOn
+	}
+
+	extractor := util.NewJSONClaimExtractor(ctx, claims)
+	if _, err := extractor.GetClaimInto(i.emailClaim, &session.Email); err != nil {
+		return nil, err
+	}
+	if session.Email == "" {
+		session.Email = session.User
+	}
+	if session.Email == "" {
+		return nil, errors.New("introspection response has no sub, username or email")
+	}
+	if _, err := extractor.GetClaimInto(i.groupsClaim, &session.Groups); err != nil {
+		return nil, err
+	}
+	if len(i.storeClaims) > 0 {
+		selected, err := util.SelectClaims(extractor, i.storeClaims)
+		if err != nil {
+			return nil, err
+		}
+		session.Claims = selected
+	}
+	return session, nil
+}
+
+// audiences returns the audiences of an `aud` claim, a string or a list
+func audiences(aud interface{}) []string {
+	switch v := aud.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		auds := make([]string, 0, len(v))
+		for _, a := range v {
+			if str, ok := a.(string); ok {
+				auds = append(auds, str)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// cacheKey hashes the token, so that the tokens aren't kept in the cache keys
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// cache keeps the sessions of active tokens until they expire
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	session *sessionsapi.SessionState
+	expires time.Time
+}
+
+// get returns a copy of the cached session, so that the cached session isn't
+// modified by the request it is loaded for
+func (c *cache) get(key string, now time.Time) (*sessionsapi.SessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	session := *entry.session
+	return &session, true
+}
+
+// set caches the session until it expires.
+// The expired entries are removed when the cache is full, and the session
+// isn't cached if it is still full.
+func (c *cache) set(key string, session *sessionsapi.SessionState, expires, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	cached := *session
+	c.entries[key] = cacheEntry{session: &cached, expires: expires}
+}
+
+// metrics records the introspection requests and cache hits
+type metrics struct {
+	requests  *prometheus.CounterVec
+	cacheHits prometheus.Counter
+}
+
+// newMetrics registers the introspection metrics with the registerer.
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	return &metrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_introspection_requests_total",
+				Help: "Total number of token introspection requests by result.",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+		cacheHits: collector.Register(registerer, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_introspection_cache_hits_total",
+				Help: "Total number of bearer tokens verified from the token introspection cache.",
+			},
+		)).(prometheus.Counter),
+	}
+}
@@ -0,0 +1,258 @@
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Introspector Suite", func() {
+	const token = "opaque-token"
+
+	var (
+		server    *httptest.Server
+		response  map[string]interface{}
+		status    int
+		requests  []*http.Request
+		forms     []string
+		now       time.Time
+		opts      options.Introspection
+		oidcOpts  options.OIDCOptions
+		registry  *prometheus.Registry
+		newTested func() *Introspector
+	)
+
+	BeforeEach(func() {
+		now = time.Unix(1700000000, 0)
+		status = http.StatusOK
+		requests = nil
+		forms = nil
+		response = map[string]interface{}{
+			"active":   true,
+			"sub":      "1234567890",
+			"username": "john",
+			"email":    "john@example.com",
+			"groups":   []string{"ops", "dev"},
+			"tenant":   "acme",
+			"aud":      []string{"api", "web"},
+			"scope":    "openid profile",
+			"exp":      now.Add(time.Hour).Unix(),
+		}
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			Expect(req.ParseForm()).To(Succeed())
+			requests = append(requests, req)
+			forms = append(forms, req.PostForm.Encode())
+
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			Expect(json.NewEncoder(rw).Encode(response)).To(Succeed())
+		}))
+
+		opts = options.Introspection{
+			URL:          server.URL,
+			ClientID:     "proxy",
+			ClientSecret: "s3cr&t",
+			CacheTTL:     time.Minute,
+		}
+		oidcOpts = options.OIDCOptions{
+			EmailClaim:  "email",
+			GroupsClaim: "groups",
+		}
+		registry = prometheus.NewRegistry()
+
+		newTested = func() *Introspector {
+			introspector, err := NewIntrospector(opts, oidcOpts, []string{"tenant"}, registry)
+			Expect(err).ToNot(HaveOccurred())
+			introspector.clock.Set(now)
+			return introspector
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("NewIntrospector", func() {
+		It("rejects URLs without an http or https scheme", func() {
+			opts.URL = "ftp://auth.example.com/introspect"
+			_, err := NewIntrospector(opts, oidcOpts, nil, registry)
+			Expect(err).To(MatchError(`invalid introspection url "ftp://auth.example.com/introspect": the scheme must be http or https`))
+		})
+
+		It("rejects negative cache TTLs", func() {
+			opts.CacheTTL = -time.Second
+			_, err := NewIntrospector(opts, oidcOpts, nil, registry)
+			Expect(err).To(MatchError(`invalid introspection cache ttl "-1s": must not be negative`))
+		})
+
+		It("reuses metrics that are already registered", func() {
+			newTested()
+			newTested()
+		})
+	})
+
+	Context("TokenToSession", func() {
+		It("creates a session from the introspection of an active token", func() {
+			session, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+
+			expiresOn := now.Add(time.Hour)
+			Expect(session.User).To(Equal("1234567890"))
+			Expect(session.PreferredUsername).To(Equal("john"))
+			Expect(session.Email).To(Equal("john@example.com"))
+			Expect(session.Groups).To(Equal([]string{"ops", "dev"}))
+			Expect(session.Claims).To(Equal(map[string]interface{}{"tenant": "acme"}))
+			Expect(session.AccessToken).To(Equal(token))
+			Expect(session.ExpiresOn).To(Equal(&expiresOn))
+			Expect(session.CreatedAt).To(Equal(&now))
+			Expect(session.BearerToken.Audiences).To(Equal([]string{"api", "web"}))
+			Expect(session.BearerToken.Scopes).To(Equal([]string{"openid", "profile"}))
+		})
+
+		It("posts the token with the client credentials", func() {
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].Method).To(Equal(http.MethodPost))
+			Expect(forms[0]).To(Equal("token=opaque-token&token_type_hint=access_token"))
+			clientID, clientSecret, ok := requests[0].BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(clientID).To(Equal("proxy"))
+			Expect(clientSecret).To(Equal("s3cr%26t"))
+		})
+
+		It("doesn't authenticate without a client ID", func() {
+			opts.ClientID = ""
+			opts.ClientSecret = ""
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests[0].Header.Get("Authorization")).To(BeEmpty())
+		})
+
+		It("falls back to the username and the user for the email", func() {
+			delete(response, "sub")
+			delete(response, "email")
+			session, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.User).To(Equal("john"))
+			Expect(session.Email).To(Equal("john"))
+		})
+
+		It("reads the email and groups with the configured claims", func() {
+			oidcOpts.EmailClaim = "ext.mail"
+			oidcOpts.GroupsClaim = "ext.roles"
+			response["ext"] = map[string]interface{}{
+				"mail":  "jane@example.com",
+				"roles": []string{"admin"},
+			}
+			session, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Email).To(Equal("jane@example.com"))
+			Expect(session.Groups).To(Equal([]string{"admin"}))
+		})
+
+		It("returns ErrInactive for inactive tokens", func() {
+			response = map[string]interface{}{"active": false}
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).To(Equal(ErrInactive))
+			Expect(testutil.ToFloat64(newMetrics(registry).requests.WithLabelValues(resultInactive))).To(Equal(1.0))
+		})
+
+		It("returns ErrInactive for expired tokens", func() {
+			response["exp"] = now.Add(-time.Second).Unix()
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).To(Equal(ErrInactive))
+		})
+
+		It("returns an error when the introspection fails", func() {
+			status = http.StatusInternalServerError
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).To(HaveOccurred())
+			Expect(err).ToNot(Equal(ErrInactive))
+			Expect(testutil.ToFloat64(newMetrics(registry).requests.WithLabelValues(resultError))).To(Equal(1.0))
+		})
+
+		It("returns an error without a sub, username or email", func() {
+			response = map[string]interface{}{"active": true}
+			_, err := newTested().TokenToSession(context.Background(), token)
+			Expect(err).To(MatchError("introspection response has no sub, username or email"))
+		})
+	})
+
+	Context("with the cache", func() {
+		It("caches active tokens for the cache TTL", func() {
+			introspector := newTested()
+			first, err := introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(introspector.clock.Add(30 * time.Second)).To(Succeed())
+			second, err := introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(Equal(first))
+			Expect(requests).To(HaveLen(1))
+
+			metrics := newMetrics(registry)
+			Expect(testutil.ToFloat64(metrics.requests.WithLabelValues(resultActive))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(metrics.cacheHits)).To(Equal(1.0))
+
+			Expect(introspector.clock.Add(30 * time.Second)).To(Succeed())
+			_, err = introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests).To(HaveLen(2))
+		})
+
+		It("doesn't cache tokens beyond their expiry", func() {
+			response["exp"] = now.Add(10 * time.Second).Unix()
+			introspector := newTested()
+			_, err := introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(introspector.clock.Add(10 * time.Second)).To(Succeed())
+			response["exp"] = now.Add(time.Hour).Unix()
+			_, err = introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests).To(HaveLen(2))
+		})
+
+		It("doesn't cache inactive tokens", func() {
+			response = map[string]interface{}{"active": false}
+			introspector := newTested()
+			for i := 0; i < 2; i++ {
+				_, err := introspector.TokenToSession(context.Background(), token)
+				Expect(err).To(Equal(ErrInactive))
+			}
+			Expect(requests).To(HaveLen(2))
+		})
+
+		It("doesn't cache tokens with a zero cache TTL", func() {
+			opts.CacheTTL = 0
+			introspector := newTested()
+			for i := 0; i < 2; i++ {
+				_, err := introspector.TokenToSession(context.Background(), token)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(requests).To(HaveLen(2))
+		})
+
+		It("returns copies of the cached sessions", func() {
+			introspector := newTested()
+			first, err := introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			first.Email = "modified@example.com"
+
+			second, err := introspector.TokenToSession(context.Background(), token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second.Email).To(Equal("john@example.com"))
+		})
+	})
+})
@@ -7,22 +7,53 @@ import (
 	"strings"
 
 	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 )
 
-func GetRealClientIPParser(headerKey string) (ipapi.RealClientIPParser, error) {
+// GetRealClientIPParser returns the parser of the real client IP from the
+// header.
+// The addresses of the trustedProxyIPs are skipped when walking the hops of
+// the header from the right, invalid IPs or CIDR ranges are ignored.
+func GetRealClientIPParser(headerKey string, trustedProxyIPs []string) (ipapi.RealClientIPParser, error) {
 	headerKey = http.CanonicalHeaderKey(headerKey)
 
+	var trustedProxies *NetSet
+	if len(trustedProxyIPs) > 0 {
+		trustedProxies = NewNetSet()
+		for _, ipStr := range trustedProxyIPs {
+			if ipNet := ParseIPNet(ipStr); ipNet != nil {
+				trustedProxies.AddIPNet(*ipNet)
+			}
+		}
+	}
+
 	switch headerKey {
 	case http.CanonicalHeaderKey("X-Forwarded-For"), http.CanonicalHeaderKey("X-Real-IP"), http.CanonicalHeaderKey("X-ProxyUser-IP"):
-		return &xForwardedForClientIPParser{header: headerKey}, nil
+		return &xForwardedForClientIPParser{header: headerKey, trustedProxies: trustedProxies}, nil
+	case http.CanonicalHeaderKey("Forwarded"):
+		return &forwardedClientIPParser{trustedProxies: trustedProxies}, nil
 	}
 
-	// TODO: implement the more standardized but more complex `Forwarded` header.
 	return nil, fmt.Errorf("the http header key (%s) is either invalid or unsupported", headerKey)
 }
 
-type xForwardedForClientIPParser struct {
+// hopClientIPParser is implemented by the parsers of this package to report
+// the hop of the header that the real client IP was chosen from
+type hopClientIPParser interface {
+	getRealClientIP(http.Header) (net.IP, hop, error)
+}
+
+// hop is the position of an address in the hops of a header, counted from 1
+// on the left
+type hop struct {
 	header string
+	index  int
+	count  int
+}
+
+type xForwardedForClientIPParser struct {
+	header         string
+	trustedProxies *NetSet
 }
 
 // GetRealClientIP obtain the IP address of the end-user (not proxy).
@@ -32,38 +63,135 @@ type xForwardedForClientIPParser struct {
 // Additionally, is capable of parsing IPs with the port included, for v4 in the format "<ip>:<port>" and for v6 in the
 // format "[<ip>]:<port>".  With-port and without-port formats are seamlessly supported concurrently.
 func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, error) {
-	var ipStr string
-	if realIP := h.Get(p.header); realIP != "" {
-		ipStr = realIP
-	} else {
-		return nil, nil
+	ip, _, err := p.getRealClientIP(h)
+	return ip, err
+}
+
+func (p xForwardedForClientIPParser) getRealClientIP(h http.Header) (net.IP, hop, error) {
+	// Each successive proxy may append itself, comma separated, to the end of the X-Forwarded-for header,
+	// or add the header again, which is equivalent.
+	var hops []string
+	for _, value := range h.Values(p.header) {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		for _, address := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(address))
+		}
 	}
+	return chooseClientIP(p.header, hops, p.trustedProxies)
+}
 
-	// Each successive proxy may append itself, comma separated, to the end of the X-Forwarded-for header.
-	// Select only the first IP listed, as it is the client IP recorded by the first proxy.
-	if commaIndex := strings.IndexRune(ipStr, ','); commaIndex != -1 {
-		ipStr = ipStr[:commaIndex]
+// forwardedClientIPParser parses the addresses of the `for` parameters of the
+// Forwarded header, as specified by RFC 7239
+type forwardedClientIPParser struct {
+	trustedProxies *NetSet
+}
+
+// GetRealClientIP obtains the IP address of the end-user (not proxy) from
+// the Forwarded header.
+// Elements of the header without a `for` parameter are ignored.
+// A hop with an unknown or obfuscated identifier, such as `for=unknown` or
+// `for=_hidden`, is never trusted, and no IP is obtained when it is reached.
+func (p forwardedClientIPParser) GetRealClientIP(h http.Header) (net.IP, error) {
+	ip, _, err := p.getRealClientIP(h)
+	return ip, err
+}
+
+func (p forwardedClientIPParser) getRealClientIP(h http.Header) (net.IP, hop, error) {
+	var hops []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, address, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(address, `"`))
+				}
+			}
+		}
 	}
-	ipStr = strings.TrimSpace(ipStr)
+	return chooseClientIP("Forwarded", hops, p.trustedProxies)
+}
+
+// chooseClientIP walks the hops from the right, past the addresses of the
+// trusted proxies, to the address of the client as seen by the first trusted
+// proxy.
+// When all the hops are trusted proxies, the leftmost hop is chosen.
+// Without trusted proxies, the leftmost hop is chosen, as the client IP
+// recorded by the first proxy.
+// No IP is chosen when the walk reaches a hop without an address.
+func chooseClientIP(header string, hops []string, trustedProxies *NetSet) (net.IP, hop, error) {
+	if len(hops) == 0 {
+		return nil, hop{}, nil
+	}
+
+	if trustedProxies == nil {
+		ip, err := parseHop(header, hops[0])
+		if ip == nil {
+			return nil, hop{}, err
+		}
+		return ip, hop{header: header, index: 1, count: len(hops)}, err
+	}
+
+	var ip net.IP
+	var index int
+	for index = len(hops); index > 0; index-- {
+		var err error
+		if ip, err = parseHop(header, hops[index-1]); err != nil || ip == nil {
+			return nil, hop{}, err
+		}
+		if !trustedProxies.Has(ip) {
+			break
+		}
+	}
+	if index == 0 {
+		index = 1
+	}
+	return ip, hop{header: header, index: index, count: len(hops)}, nil
+}
 
+// parseHop parses an IPv4 or IPv6 address, with or without a port, and in
+// brackets or not for IPv6.
+// The unknown and obfuscated identifiers of the Forwarded header have no
+// address, so that nil is returned for them without an error.
+func parseHop(header, ipStr string) (net.IP, error) {
 	if ipHost, _, err := net.SplitHostPort(ipStr); err == nil {
 		ipStr = ipHost
+	} else if strings.HasPrefix(ipStr, "[") && strings.HasSuffix(ipStr, "]") {
+		ipStr = ipStr[1 : len(ipStr)-1]
+	}
+	if header == "Forwarded" && isObfuscatedNode(ipStr) {
+		return nil, nil
 	}
 
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return nil, fmt.Errorf("unable to parse ip (%s) from %s header", ipStr, http.CanonicalHeaderKey(p.header))
+		return nil, fmt.Errorf("unable to parse ip (%s) from %s header", ipStr, header)
 	}
-
 	return ip, nil
 }
 
+// isObfuscatedNode checks whether the node name of a Forwarded header hop is
+// the unknown identifier or an obfuscated identifier, as specified by
+// RFC 7239
+func isObfuscatedNode(name string) bool {
+	return strings.EqualFold(name, "unknown") || strings.HasPrefix(name, "_")
+}
+
 // GetClientIP obtains the perceived end-user IP address from headers if p != nil else from req.RemoteAddr.
+// The hop of the header the address was chosen from is logged at debug level.
 func GetClientIP(p ipapi.RealClientIPParser, req *http.Request) (net.IP, error) {
-	if p != nil {
-		return p.GetRealClientIP(req.Header)
+	if p == nil {
+		return getRemoteIP(req)
+	}
+	if hp, ok := p.(hopClientIPParser); ok {
+		ip, h, err := hp.getRealClientIP(req.Header)
+		if ip != nil {
+			logger.DebugfContext(req.Context(), "Real client IP %s chosen from hop %d of %d of the %s header", ip, h.index, h.count, h.header)
+		}
+		return ip, err
 	}
-	return getRemoteIP(req)
+	return p.GetRealClientIP(req.Header)
 }
 
 // getRemoteIP obtains the IP of the low-level connected network host
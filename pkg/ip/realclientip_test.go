@@ -12,6 +12,7 @@ import (
 
 func TestGetRealClientIPParser(t *testing.T) {
 	forwardedForType := reflect.TypeOf((*xForwardedForClientIPParser)(nil))
+	forwardedType := reflect.TypeOf((*forwardedClientIPParser)(nil))
 
 	tests := []struct {
 		header     string
@@ -22,12 +23,12 @@ func TestGetRealClientIPParser(t *testing.T) {
 		{"X-REAL-IP", "", forwardedForType},
 		{"x-proxyuser-ip", "", forwardedForType},
 		{"", "the http header key () is either invalid or unsupported", nil},
-		{"Forwarded", "the http header key (Forwarded) is either invalid or unsupported", nil},
+		{"forwarded", "", forwardedType},
 		{"2#* @##$$:kd", "the http header key (2#* @##$$:kd) is either invalid or unsupported", nil},
 	}
 
 	for _, test := range tests {
-		p, err := GetRealClientIPParser(test.header)
+		p, err := GetRealClientIPParser(test.header, nil)
 
 		if test.errString == "" {
 			assert.Nil(t, err)
@@ -90,6 +91,170 @@ func TestXForwardedForClientIPParser(t *testing.T) {
 	}
 }
 
+func TestRealClientIPParserTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          string
+		headerValues    []string
+		trustedProxyIPs []string
+		errString       string
+		expectedIP      net.IP
+		expectedHop     hop
+	}{
+		{
+			name:         "leftmost IPv6 without trusted proxies",
+			header:       "X-Forwarded-For",
+			headerValues: []string{"2001:db8::1, 10.0.0.5"},
+			expectedIP:   net.ParseIP("2001:db8::1"),
+			expectedHop:  hop{header: "X-Forwarded-For", index: 1, count: 2},
+		},
+		{
+			name:            "IPv6 client past a trusted IPv4 proxy",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"2001:db8::1, 10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("2001:db8::1"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 1, count: 2},
+		},
+		{
+			name:            "spoofed leftmost hop before an untrusted hop",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"1.1.1.1, 203.0.113.7, 10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("203.0.113.7"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 2, count: 3},
+		},
+		{
+			name:            "IPv4 client past trusted IPv6 proxies",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"203.0.113.7, [fd00::2]:8443, fd00::1"},
+			trustedProxyIPs: []string{"fd00::/8"},
+			expectedIP:      net.ParseIP("203.0.113.7"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 1, count: 3},
+		},
+		{
+			name:            "bracketed IPv6 without a port",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"[2001:db8::1], 10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.5"},
+			expectedIP:      net.ParseIP("2001:db8::1"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 1, count: 2},
+		},
+		{
+			name:            "bracketed IPv6 with a port",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"[2001:db8::1]:4711"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("2001:db8::1"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 1, count: 1},
+		},
+		{
+			name:            "multiple header lines",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"203.0.113.7, 192.0.2.1", "10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("192.0.2.1"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 2, count: 3},
+		},
+		{
+			name:            "all hops are trusted proxies",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"10.0.0.7, 10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("10.0.0.7"),
+			expectedHop:     hop{header: "X-Forwarded-For", index: 1, count: 2},
+		},
+		{
+			name:            "invalid hop before an untrusted hop",
+			header:          "X-Forwarded-For",
+			headerValues:    []string{"203.0.113.7, unknown, 10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			errString:       "unable to parse ip (unknown) from X-Forwarded-For header",
+		},
+		{
+			name:            "Forwarded with quoted IPv6 and a trusted proxy",
+			header:          "Forwarded",
+			headerValues:    []string{`for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.5;by=10.0.0.6`},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("2001:db8:cafe::17"),
+			expectedHop:     hop{header: "Forwarded", index: 1, count: 2},
+		},
+		{
+			name:            "Forwarded with an untrusted IPv4 hop",
+			header:          "Forwarded",
+			headerValues:    []string{"for=192.0.2.43, For=198.51.100.17", "for=10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			expectedIP:      net.ParseIP("198.51.100.17"),
+			expectedHop:     hop{header: "Forwarded", index: 2, count: 3},
+		},
+		{
+			name:         "Forwarded without trusted proxies",
+			header:       "Forwarded",
+			headerValues: []string{"proto=https;for=192.0.2.43, for=10.0.0.5"},
+			expectedIP:   net.ParseIP("192.0.2.43"),
+			expectedHop:  hop{header: "Forwarded", index: 1, count: 2},
+		},
+		{
+			name:            "Forwarded with an obfuscated hop",
+			header:          "Forwarded",
+			headerValues:    []string{"for=_hidden, for=10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+		},
+		{
+			name:            "Forwarded with an obfuscated hop and port before trusted proxies",
+			header:          "Forwarded",
+			headerValues:    []string{`for=192.0.2.43, for="_hidden:_port", for=10.0.0.5`},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+		},
+		{
+			name:            "Forwarded with an unknown hop",
+			header:          "Forwarded",
+			headerValues:    []string{"for=192.0.2.43, for=unknown", "for=10.0.0.5"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+		},
+		{
+			name:         "Forwarded with an unknown hop without trusted proxies",
+			header:       "Forwarded",
+			headerValues: []string{"for=unknown, for=10.0.0.5"},
+		},
+		{
+			name:            "Forwarded without for parameters",
+			header:          "Forwarded",
+			headerValues:    []string{"proto=https;host=example.com"},
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := GetRealClientIPParser(test.header, test.trustedProxyIPs)
+			assert.Nil(t, err)
+
+			h := http.Header{}
+			for _, value := range test.headerValues {
+				h.Add(test.header, value)
+			}
+
+			ip, chosen, err := p.(hopClientIPParser).getRealClientIP(h)
+			if test.errString == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+				assert.Equal(t, test.errString, err.Error())
+			}
+			assert.Equal(t, test.expectedIP, ip)
+			assert.Equal(t, test.expectedHop, chosen)
+
+			// The parsers choose the same IP whatever they are used for
+			realIP, err := p.GetRealClientIP(h)
+			assert.Equal(t, ip, realIP)
+			if test.errString != "" {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
 func TestXForwardedForClientIPParserIgnoresOthers(t *testing.T) {
 	p := &xForwardedForClientIPParser{header: http.CanonicalHeaderKey("X-Forwarded-For")}
 
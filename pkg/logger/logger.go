@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -24,12 +25,21 @@ type Level int
 
 const (
 	// DefaultStandardLoggingFormat defines the default standard log format
-	DefaultStandardLoggingFormat = "[{{.Timestamp}}] [{{.File}}] {{.Message}}"
+	DefaultStandardLoggingFormat = "[{{.Timestamp}}] [{{.File}}] {{if .RequestID}}[{{.RequestID}}] {{end}}{{.Message}}"
 	// DefaultAuthLoggingFormat defines the default auth log format
 	DefaultAuthLoggingFormat = "{{.Client}} - {{.RequestID}} - {{.Username}} [{{.Timestamp}}] [{{.Status}}] {{.Message}}"
 	// DefaultRequestLoggingFormat defines the default request log format
 	DefaultRequestLoggingFormat = "{{.Client}} - {{.RequestID}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}"
 
+	// RequestLoggingEncodingText writes request log lines with the request
+	// logging template
+	RequestLoggingEncodingText = "text"
+	// RequestLoggingEncodingJSON writes request log lines as JSON objects
+	RequestLoggingEncodingJSON = "json"
+	// RequestLoggingEncodingLogfmt writes request log lines as logfmt
+	// key=value pairs
+	RequestLoggingEncodingLogfmt = "logfmt"
+
 	// AuthSuccess indicates that an auth attempt has succeeded explicitly
 	AuthSuccess AuthStatus = "AuthSuccess"
 	// AuthFailure indicates that an auth attempt has failed explicitly
@@ -50,6 +60,8 @@ const (
 	DEFAULT Level = iota
 	// ERROR is for error-level logging
 	ERROR
+	// DEBUG is for debug-level logging, only output when enabled
+	DEBUG
 )
 
 // These are the containers for all values that are available as variables in the logging formats.
@@ -57,6 +69,7 @@ const (
 type stdLogMessageData struct {
 	Timestamp,
 	File,
+	RequestID,
 	Message string
 }
 
@@ -80,11 +93,15 @@ type reqLogMessageData struct {
 	RequestID,
 	RequestDuration,
 	RequestMethod,
+	RequestSize,
 	RequestURI,
 	ResponseSize,
 	StatusCode,
 	Timestamp,
 	Upstream,
+	UpstreamAddress,
+	UpstreamDuration,
+	UpstreamRetries,
 	UserAgent,
 	Username string
 }
@@ -103,6 +120,7 @@ type Logger struct {
 	writer         io.Writer
 	errWriter      io.Writer
 	stdEnabled     bool
+	debugEnabled   bool
 	authEnabled    bool
 	reqEnabled     bool
 	getClientFunc  GetClientFunc
@@ -110,6 +128,7 @@ type Logger struct {
 	stdLogTemplate *template.Template
 	authTemplate   *template.Template
 	reqTemplate    *template.Template
+	reqEncoding    string
 }
 
 // New creates a new Standarderr Logger.
@@ -126,12 +145,13 @@ func New(flag int) *Logger {
 		stdLogTemplate: template.Must(template.New("std-log").Parse(DefaultStandardLoggingFormat)),
 		authTemplate:   template.Must(template.New("auth-log").Parse(DefaultAuthLoggingFormat)),
 		reqTemplate:    template.Must(template.New("req-log").Parse(DefaultRequestLoggingFormat)),
+		reqEncoding:    RequestLoggingEncodingText,
 	}
 }
 
 var std = New(LstdFlags)
 
-func (l *Logger) formatLogMessage(calldepth int, message string) []byte {
+func (l *Logger) formatLogMessage(calldepth int, requestID, message string) []byte {
 	now := time.Now()
 	file := "???:0"
 
@@ -143,6 +163,7 @@ func (l *Logger) formatLogMessage(calldepth int, message string) []byte {
 	err := l.stdLogTemplate.Execute(logBuff, stdLogMessageData{
 		Timestamp: FormatTimestamp(now),
 		File:      file,
+		RequestID: requestID,
 		Message:   message,
 	})
 	if err != nil {
@@ -160,12 +181,32 @@ func (l *Logger) formatLogMessage(calldepth int, message string) []byte {
 // Output a standard log template with a simple message to default output channel.
 // Write a final newline at the end of every message.
 func (l *Logger) Output(lvl Level, calldepth int, message string) {
+	l.output(lvl, calldepth+1, "", false, message)
+}
+
+// OutputContext outputs a standard log template with a simple message to the
+// default output channel, including the request ID of the request scope held
+// in the context, if any.
+// Messages of requests with debug logging enabled in their scope are always
+// written, even when standard or debug logging is disabled.
+// Write a final newline at the end of every message.
+func (l *Logger) OutputContext(ctx context.Context, lvl Level, calldepth int, message string) {
+	var requestID string
+	var force bool
+	if scope := middlewareapi.GetRequestScopeFromContext(ctx); scope != nil {
+		requestID = scope.RequestID
+		force = scope.DebugLogging
+	}
+	l.output(lvl, calldepth+1, requestID, force, message)
+}
+
+func (l *Logger) output(lvl Level, calldepth int, requestID string, force bool, message string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	if !l.stdEnabled {
+	if !force && (!l.stdEnabled || (lvl == DEBUG && !l.debugEnabled)) {
 		return
 	}
-	msg := l.formatLogMessage(calldepth+1, message)
+	msg := l.formatLogMessage(calldepth+1, requestID, message)
 
 	var err error
 	switch lvl {
@@ -222,9 +263,10 @@ func (l *Logger) PrintAuthf(username string, req *http.Request, status AuthStatu
 }
 
 // PrintReq writes request details to the Logger using the http.Request,
-// url, and timestamp of the request.  Writes a final newline to the end
-// of every message.
-func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
+// url, and timestamp of the request, and the sizes of the request body and
+// response. The upstream server details are read from the request scope.
+// Writes a final newline to the end of every message.
+func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, requestSize int) {
 	if !l.reqEnabled {
 		return
 	}
@@ -255,21 +297,59 @@ func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.
 	defer l.mu.Unlock()
 
 	scope := middlewareapi.GetRequestScope(req)
-	err := l.reqTemplate.Execute(l.writer, reqLogMessageData{
-		Client:          client,
-		Host:            requestutil.GetRequestHost(req),
-		Protocol:        req.Proto,
-		RequestID:       scope.RequestID,
-		RequestDuration: fmt.Sprintf("%0.3f", duration),
-		RequestMethod:   req.Method,
-		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
-		ResponseSize:    fmt.Sprintf("%d", size),
-		StatusCode:      fmt.Sprintf("%d", status),
-		Timestamp:       FormatTimestamp(ts),
-		Upstream:        upstream,
-		UserAgent:       fmt.Sprintf("%q", req.UserAgent()),
-		Username:        username,
-	})
+	var err error
+	switch l.reqEncoding {
+	case RequestLoggingEncodingJSON, RequestLoggingEncodingLogfmt:
+		fields := reqLogFields(reqLogRecord{
+			Timestamp:     l.formatStructuredTimestamp(ts),
+			Client:        client,
+			RequestID:     scope.RequestID,
+			Username:      username,
+			Host:          requestutil.GetRequestHost(req),
+			RequestMethod: req.Method,
+			RequestURI:    url.RequestURI(),
+			Protocol:      req.Proto,
+			UserAgent:     req.UserAgent(),
+			StatusCode:    status,
+			RequestSize:   requestSize,
+			ResponseSize:  size,
+			Duration:      duration,
+			Upstream:      upstream,
+			Scope:         scope,
+		})
+		if l.reqEncoding == RequestLoggingEncodingJSON {
+			_, err = l.writer.Write(encodeJSONFields(fields))
+		} else {
+			_, err = l.writer.Write(encodeLogfmtFields(fields))
+		}
+	default:
+		upstreamAddress, upstreamDuration := "-", "-"
+		if scope.UpstreamAddress != "" {
+			upstreamAddress = scope.UpstreamAddress
+		}
+		if scope.UpstreamDuration > 0 {
+			upstreamDuration = fmt.Sprintf("%0.3f", scope.UpstreamDuration.Seconds())
+		}
+		err = l.reqTemplate.Execute(l.writer, reqLogMessageData{
+			Client:           client,
+			Host:             requestutil.GetRequestHost(req),
+			Protocol:         req.Proto,
+			RequestID:        scope.RequestID,
+			RequestDuration:  fmt.Sprintf("%0.3f", duration),
+			RequestMethod:    req.Method,
+			RequestSize:      fmt.Sprintf("%d", requestSize),
+			RequestURI:       fmt.Sprintf("%q", url.RequestURI()),
+			ResponseSize:     fmt.Sprintf("%d", size),
+			StatusCode:       fmt.Sprintf("%d", status),
+			Timestamp:        FormatTimestamp(ts),
+			Upstream:         upstream,
+			UpstreamAddress:  upstreamAddress,
+			UpstreamDuration: upstreamDuration,
+			UpstreamRetries:  fmt.Sprintf("%d", scope.UpstreamRetries),
+			UserAgent:        fmt.Sprintf("%q", req.UserAgent()),
+			Username:         username,
+		})
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -338,6 +418,13 @@ func (l *Logger) SetStandardEnabled(e bool) {
 	l.stdEnabled = e
 }
 
+// SetDebugEnabled enables or disables debug logging.
+func (l *Logger) SetDebugEnabled(e bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.debugEnabled = e
+}
+
 // SetErrToInfo enables or disables error logging to error writer instead of the default.
 func (l *Logger) SetErrToInfo(e bool) {
 	l.mu.Lock()
@@ -370,6 +457,15 @@ func (l *Logger) SetGetClientFunc(f GetClientFunc) {
 	l.getClientFunc = f
 }
 
+// GetClient returns the apparent "real client IP" of the request, as it is
+// written in the auth and request logs.
+func (l *Logger) GetClient(req *http.Request) string {
+	l.mu.Lock()
+	getClientFunc := l.getClientFunc
+	l.mu.Unlock()
+	return getClientFunc(req)
+}
+
 // SetExcludePaths sets the paths to exclude from logging.
 func (l *Logger) SetExcludePaths(s []string) {
 	l.mu.Lock()
@@ -401,6 +497,14 @@ func (l *Logger) SetReqTemplate(t string) {
 	l.reqTemplate = template.Must(template.New("req-log").Parse(t))
 }
 
+// SetReqEncoding sets the encoding of request log lines: the request
+// logging template, JSON or logfmt.
+func (l *Logger) SetReqEncoding(e string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqEncoding = e
+}
+
 // These functions utilize the standard logger.
 
 // FormatTimestamp returns a formatted timestamp for the standard logger.
@@ -438,6 +542,11 @@ func SetStandardEnabled(e bool) {
 	std.SetStandardEnabled(e)
 }
 
+// SetDebugEnabled enables or disables debug logging for the standard logger.
+func SetDebugEnabled(e bool) {
+	std.SetDebugEnabled(e)
+}
+
 // SetErrToInfo enables or disables error logging to output writer instead of
 // error writer.
 func SetErrToInfo(e bool) {
@@ -462,6 +571,12 @@ func SetGetClientFunc(f GetClientFunc) {
 	std.SetGetClientFunc(f)
 }
 
+// GetClient returns the apparent "real client IP" of the request, as it is
+// written in the logs of the standard logger.
+func GetClient(req *http.Request) string {
+	return std.GetClient(req)
+}
+
 // SetExcludePaths sets the path to exclude from logging, eg: health checks
 func SetExcludePaths(s []string) {
 	std.SetExcludePaths(s)
@@ -485,6 +600,12 @@ func SetReqTemplate(t string) {
 	std.SetReqTemplate(t)
 }
 
+// SetReqEncoding sets the encoding of request log lines for the standard
+// logger.
+func SetReqEncoding(e string) {
+	std.SetReqEncoding(e)
+}
+
 // Print calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Print.
 func Print(v ...interface{}) {
@@ -515,6 +636,27 @@ func Errorf(format string, v ...interface{}) {
 	std.Output(ERROR, 2, fmt.Sprintf(format, v...))
 }
 
+// PrintfContext calls OutputContext to print to the standard logger, including
+// the request ID of the context's request scope.
+// Arguments are handled in the manner of fmt.Printf.
+func PrintfContext(ctx context.Context, format string, v ...interface{}) {
+	std.OutputContext(ctx, DEFAULT, 2, fmt.Sprintf(format, v...))
+}
+
+// ErrorfContext calls OutputContext to print to the standard logger's error
+// channel, including the request ID of the context's request scope.
+// Arguments are handled in the manner of fmt.Printf.
+func ErrorfContext(ctx context.Context, format string, v ...interface{}) {
+	std.OutputContext(ctx, ERROR, 2, fmt.Sprintf(format, v...))
+}
+
+// DebugfContext calls OutputContext to print to the standard logger when debug
+// logging is enabled, including the request ID of the context's request scope.
+// Arguments are handled in the manner of fmt.Printf.
+func DebugfContext(ctx context.Context, format string, v ...interface{}) {
+	std.OutputContext(ctx, DEBUG, 2, fmt.Sprintf(format, v...))
+}
+
 // Errorln calls OutputErr to print to the standard logger's error channel.
 // Arguments are handled in the manner of fmt.Println.
 func Errorln(v ...interface{}) {
@@ -567,6 +709,6 @@ func PrintAuthf(username string, req *http.Request, status AuthStatus, format st
 }
 
 // PrintReq writes request details to the standard logger.
-func PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
-	std.PrintReq(username, upstream, req, url, ts, status, size)
+func PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, requestSize int) {
+	std.PrintReq(username, upstream, req, url, ts, status, size, requestSize)
 }
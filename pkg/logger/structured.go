@@ -0,0 +1,146 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+)
+
+// structuredTimestampFormat is the RFC 3339 format, with milliseconds, of the
+// timestamps of structured log lines
+const structuredTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// reqLogRecord contains the values of a structured request log line, before
+// they are encoded
+type reqLogRecord struct {
+	Timestamp     string
+	Client        string
+	RequestID     string
+	Username      string
+	Host          string
+	RequestMethod string
+	RequestURI    string
+	Protocol      string
+	UserAgent     string
+	StatusCode    int
+	RequestSize   int
+	ResponseSize  int
+	Duration      float64
+	Upstream      string
+	Scope         *middlewareapi.RequestScope
+}
+
+// logField is a key and value of a structured log line
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// reqLogFields returns the fields of a structured request log line, in the
+// order they are written.
+// The username, upstream and upstream server fields are omitted when they are
+// unknown, eg. for requests that weren't proxied to an upstream server.
+func reqLogFields(r reqLogRecord) []logField {
+	fields := []logField{
+		{"timestamp", r.Timestamp},
+		{"client", r.Client},
+		{"requestId", r.RequestID},
+	}
+	if r.Username != "-" {
+		fields = append(fields, logField{"username", r.Username})
+	}
+	fields = append(fields,
+		logField{"host", r.Host},
+		logField{"method", r.RequestMethod},
+		logField{"uri", r.RequestURI},
+		logField{"protocol", r.Protocol},
+		logField{"userAgent", r.UserAgent},
+		logField{"status", r.StatusCode},
+		logField{"requestSize", r.RequestSize},
+		logField{"responseSize", r.ResponseSize},
+		logField{"duration", r.Duration},
+	)
+	if r.Upstream != "-" {
+		fields = append(fields, logField{"upstream", r.Upstream})
+	}
+	if r.Scope.UpstreamAddress != "" {
+		fields = append(fields, logField{"upstreamAddress", r.Scope.UpstreamAddress})
+	}
+	if r.Scope.UpstreamDuration > 0 {
+		fields = append(fields,
+			logField{"upstreamDuration", r.Scope.UpstreamDuration.Seconds()},
+			logField{"upstreamRetries", r.Scope.UpstreamRetries},
+		)
+	}
+	return fields
+}
+
+// encodeJSONFields encodes the fields as a JSON object
+func encodeJSONFields(fields []logField) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		// The keys are fixed and the values are strings and numbers, which
+		// always encode
+		key, _ := json.Marshal(field.key)
+		value, _ := json.Marshal(field.value)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// encodeLogfmtFields encodes the fields as logfmt key=value pairs.
+// String values are quoted when they are empty or contain spaces, quotes,
+// equal signs or control characters.
+func encodeLogfmtFields(fields []logField) []byte {
+	buf := new(bytes.Buffer)
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(field.key)
+		buf.WriteByte('=')
+		switch value := field.value.(type) {
+		case string:
+			if needsLogfmtQuoting(value) {
+				buf.WriteString(strconv.Quote(value))
+			} else {
+				buf.WriteString(value)
+			}
+		case int:
+			buf.WriteString(strconv.Itoa(value))
+		case float64:
+			buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+	return buf.Bytes()
+}
+
+// needsLogfmtQuoting returns whether the logfmt value must be quoted
+func needsLogfmtQuoting(value string) bool {
+	if value == "" {
+		return true
+	}
+	return strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f
+	}) >= 0
+}
+
+// formatStructuredTimestamp returns the RFC 3339 timestamp of structured log
+// lines
+func (l *Logger) formatStructuredTimestamp(ts time.Time) string {
+	if l.flag&LUTC != 0 {
+		ts = ts.UTC()
+	}
+	return ts.Format(structuredTimestampFormat)
+}
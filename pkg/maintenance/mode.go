@@ -0,0 +1,232 @@
+package maintenance
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+)
+
+// The sources of the state of the maintenance mode, other than the
+// maintenance file
+const (
+	SourceConfig   = "configuration"
+	SourceSignal   = "signal SIGUSR1"
+	SourceAdminAPI = "management API"
+)
+
+// State is the current state of the maintenance mode, and the source of the
+// toggle that set it
+type State struct {
+	Enabled bool      `json:"enabled"`
+	Since   time.Time `json:"since"`
+	Source  string    `json:"source"`
+}
+
+// AuditFunc records that the maintenance mode was toggled to the state.
+// The request and username are only set when it was toggled by a request.
+type AuditFunc func(state State, username string, req *http.Request)
+
+// Mode is the maintenance mode: while it is enabled, the proxied routes are
+// answered with a maintenance page, except for the sessions of the bypass
+// groups.
+// It is toggled at runtime, without a restart, by the maintenance file, the
+// toggle signal and the management API, every toggle being audited.
+type Mode struct {
+	file         string
+	signal       bool
+	retryAfter   time.Duration
+	bypassGroups map[string]struct{}
+	unready      bool
+	audit        AuditFunc
+
+	// fileExists is whether the maintenance file existed when it was last
+	// checked, so that the file only toggles the mode when it is created or
+	// removed
+	fileExists bool
+
+	state State
+	mu    sync.RWMutex
+	clock clock.Clock
+}
+
+// NewMode creates the maintenance mode of the options, enabled when the
+// options enable it or when the maintenance file exists.
+// The file and signal aren't watched until Watch is called.
+func NewMode(opts options.Maintenance, audit AuditFunc) *Mode {
+	m := &Mode{
+		file:         opts.File,
+		signal:       opts.Signal,
+		retryAfter:   opts.RetryAfter,
+		bypassGroups: map[string]struct{}{},
+		unready:      opts.Unready,
+		audit:        audit,
+	}
+	for _, group := range opts.BypassGroups {
+		m.bypassGroups[group] = struct{}{}
+	}
+
+	m.state = State{Enabled: opts.Enabled, Since: m.clock.Now(), Source: SourceConfig}
+	if m.file != "" {
+		m.fileExists = fileExists(m.file)
+		if m.fileExists {
+			m.state.Enabled = true
+			m.state.Source = fileSource(m.file)
+		}
+	}
+	return m
+}
+
+// Watch toggles the maintenance mode when the maintenance file is created or
+// removed, and on the toggle signal when it is enabled, until done is closed.
+func (m *Mode) Watch(done <-chan bool) error {
+	if m.file != "" {
+		// The directory is watched, as the file doesn't exist while the
+		// maintenance mode is disabled
+		if err := watcher.WatchDirForUpdates(filepath.Dir(m.file), filepath.Ext(m.file), done, m.checkFile); err != nil {
+			return fmt.Errorf("could not watch maintenance file: %v", err)
+		}
+	}
+	if m.signal {
+		if len(toggleSignals) == 0 {
+			return fmt.Errorf("toggling the maintenance mode with a signal is not supported on this platform")
+		}
+		m.watchSignals(done)
+	}
+	return nil
+}
+
+// watchSignals toggles the maintenance mode on each toggle signal
+func (m *Mode) watchSignals(done <-chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, toggleSignals...)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				m.Toggle(SourceSignal, "", nil)
+			}
+		}
+	}()
+}
+
+// checkFile enables the maintenance mode when the maintenance file has been
+// created, and disables it when the file has been removed
+func (m *Mode) checkFile() {
+	exists := fileExists(m.file)
+
+	m.mu.Lock()
+	changed := exists != m.fileExists
+	m.fileExists = exists
+	m.mu.Unlock()
+
+	if changed {
+		m.Set(exists, fileSource(m.file), "", nil)
+	}
+}
+
+// Enabled returns whether the maintenance mode is enabled
+func (m *Mode) Enabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.Enabled
+}
+
+// State returns the state of the maintenance mode
+func (m *Mode) State() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// Set enables or disables the maintenance mode, auditing the toggle by the
+// source.
+// Nothing is audited when the mode is already in the state, it returns
+// whether the state was changed.
+func (m *Mode) Set(enabled bool, source, username string, req *http.Request) bool {
+	m.mu.Lock()
+	if m.state.Enabled == enabled {
+		m.mu.Unlock()
+		return false
+	}
+	m.state = State{Enabled: enabled, Since: m.clock.Now(), Source: source}
+	state := m.state
+	m.mu.Unlock()
+
+	if m.audit != nil {
+		m.audit(state, username, req)
+	}
+	return true
+}
+
+// Toggle enables the maintenance mode when it is disabled, and disables it
+// otherwise, auditing the toggle by the source
+func (m *Mode) Toggle(source, username string, req *http.Request) {
+	m.mu.Lock()
+	enabled := !m.state.Enabled
+	m.state = State{Enabled: enabled, Since: m.clock.Now(), Source: source}
+	state := m.state
+	m.mu.Unlock()
+
+	if m.audit != nil {
+		m.audit(state, username, req)
+	}
+}
+
+// Bypass returns whether the session is in one of the bypass groups, and is
+// allowed through to the upstreams during maintenance
+func (m *Mode) Bypass(session *sessionsapi.SessionState) bool {
+	if session == nil {
+		return false
+	}
+	for _, group := range session.Groups {
+		if _, ok := m.bypassGroups[group]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfter returns the Retry-After header of the maintenance pages, in
+// seconds, or an empty string when it is omitted
+func (m *Mode) RetryAfter() string {
+	if m.retryAfter <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(math.Ceil(m.retryAfter.Seconds())))
+}
+
+// Ready returns whether the readiness endpoint reports the proxy as ready:
+// it is unready during maintenance when the options ask for it, so that load
+// balancers can drain it
+func (m *Mode) Ready() bool {
+	return !m.unready || !m.Enabled()
+}
+
+// fileExists returns whether the maintenance file exists
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Error checking maintenance file %s: %v", file, err)
+	}
+	return err == nil
+}
+
+// fileSource is the source of the toggles by the maintenance file
+func fileSource(file string) string {
+	return fmt.Sprintf("file %s", file)
+}
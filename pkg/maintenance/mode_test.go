@@ -0,0 +1,156 @@
+package maintenance
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// auditedToggle is a toggle recorded by the audit func
+type auditedToggle struct {
+	state    State
+	username string
+	req      *http.Request
+}
+
+var _ = Describe("Mode", func() {
+	var mu sync.Mutex
+	var audited []auditedToggle
+
+	audit := func(state State, username string, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		audited = append(audited, auditedToggle{state: state, username: username, req: req})
+	}
+
+	auditedToggles := func() []auditedToggle {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]auditedToggle{}, audited...)
+	}
+
+	BeforeEach(func() {
+		audited = nil
+	})
+
+	It("starts in the state of the options", func() {
+		m := NewMode(options.Maintenance{Enabled: true}, audit)
+		Expect(m.Enabled()).To(BeTrue())
+		Expect(m.State().Source).To(Equal(SourceConfig))
+
+		Expect(NewMode(options.Maintenance{}, audit).Enabled()).To(BeFalse())
+		Expect(auditedToggles()).To(BeEmpty())
+	})
+
+	It("audits the toggles that change the state", func() {
+		now := time.Now()
+		m := NewMode(options.Maintenance{}, audit)
+		m.clock.Set(now)
+		req := httptest.NewRequest(http.MethodPut, "/maintenance", nil)
+
+		Expect(m.Set(true, SourceAdminAPI, "admin", req)).To(BeTrue())
+		Expect(m.Enabled()).To(BeTrue())
+		Expect(m.State()).To(Equal(State{Enabled: true, Since: now, Source: SourceAdminAPI}))
+
+		// Setting the same state again is not a toggle
+		Expect(m.Set(true, SourceAdminAPI, "admin", req)).To(BeFalse())
+
+		m.Toggle(SourceSignal, "", nil)
+		Expect(m.Enabled()).To(BeFalse())
+
+		Expect(auditedToggles()).To(Equal([]auditedToggle{
+			{state: State{Enabled: true, Since: now, Source: SourceAdminAPI}, username: "admin", req: req},
+			{state: State{Enabled: false, Since: now, Source: SourceSignal}},
+		}))
+	})
+
+	DescribeTable("Bypass",
+		func(session *sessionsapi.SessionState, expected bool) {
+			m := NewMode(options.Maintenance{BypassGroups: []string{"admins", "sre"}}, audit)
+			Expect(m.Bypass(session)).To(Equal(expected))
+		},
+		Entry("No Session", nil, false),
+		Entry("No Groups", &sessionsapi.SessionState{Email: "user@example.com"}, false),
+		Entry("Other Groups", &sessionsapi.SessionState{Groups: []string{"users"}}, false),
+		Entry("Bypass Group", &sessionsapi.SessionState{Groups: []string{"users", "sre"}}, true),
+	)
+
+	DescribeTable("RetryAfter",
+		func(retryAfter time.Duration, expected string) {
+			m := NewMode(options.Maintenance{RetryAfter: retryAfter}, audit)
+			Expect(m.RetryAfter()).To(Equal(expected))
+		},
+		Entry("Omitted", time.Duration(0), ""),
+		Entry("Whole Seconds", 5*time.Minute, "300"),
+		Entry("Rounded Up", 1500*time.Millisecond, "2"),
+	)
+
+	DescribeTable("Ready",
+		func(unready, enabled, expected bool) {
+			m := NewMode(options.Maintenance{Unready: unready, Enabled: enabled}, audit)
+			Expect(m.Ready()).To(Equal(expected))
+		},
+		Entry("Ready Outside Maintenance", true, false, true),
+		Entry("Unready During Maintenance", true, true, false),
+		Entry("Ready During Maintenance", false, true, true),
+	)
+
+	Context("with a maintenance file", func() {
+		var dir string
+		var file string
+		var done chan bool
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "oauth2-proxy-maintenance")
+			Expect(err).ToNot(HaveOccurred())
+			file = filepath.Join(dir, "maintenance")
+			done = make(chan bool)
+		})
+
+		AfterEach(func() {
+			close(done)
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("is enabled when the file exists at startup", func() {
+			Expect(ioutil.WriteFile(file, []byte{}, 0600)).To(Succeed())
+
+			m := NewMode(options.Maintenance{File: file}, audit)
+			Expect(m.Enabled()).To(BeTrue())
+			Expect(m.State().Source).To(Equal("file " + file))
+		})
+
+		It("is toggled when the file is created and removed", func() {
+			m := NewMode(options.Maintenance{File: file}, audit)
+			Expect(m.Watch(done)).To(Succeed())
+			Expect(m.Enabled()).To(BeFalse())
+
+			Expect(ioutil.WriteFile(file, []byte{}, 0600)).To(Succeed())
+			Eventually(m.Enabled).Should(BeTrue())
+
+			// Other files of the directory don't toggle the mode
+			Expect(ioutil.WriteFile(filepath.Join(dir, "other"), []byte{}, 0600)).To(Succeed())
+			Consistently(m.Enabled, 100*time.Millisecond).Should(BeTrue())
+
+			Expect(os.Remove(file)).To(Succeed())
+			Eventually(m.Enabled).Should(BeFalse())
+
+			Expect(auditedToggles()).To(HaveLen(2))
+			for _, toggle := range auditedToggles() {
+				Expect(toggle.state.Source).To(Equal("file " + file))
+				Expect(toggle.req).To(BeNil())
+			}
+		})
+	})
+})
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package maintenance
+
+import (
+	"os"
+	"syscall"
+)
+
+// toggleSignals are the signals toggling the maintenance mode
+var toggleSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package maintenance
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Toggle signal", func() {
+	It("toggles the maintenance mode", func() {
+		done := make(chan bool)
+		defer close(done)
+
+		m := NewMode(options.Maintenance{Signal: true}, nil)
+		Expect(m.Watch(done)).To(Succeed())
+
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).To(Succeed())
+		Eventually(m.Enabled).Should(BeTrue())
+		Expect(m.State().Source).To(Equal(SourceSignal))
+
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGUSR1)).To(Succeed())
+		Eventually(m.Enabled).Should(BeFalse())
+	})
+})
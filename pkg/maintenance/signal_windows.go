@@ -0,0 +1,7 @@
+package maintenance
+
+import "os"
+
+// toggleSignals are the signals toggling the maintenance mode, there are no
+// user signals on Windows
+var toggleSignals = []os.Signal{}
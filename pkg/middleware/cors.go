@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+const (
+	corsAllowOriginHeader      = "Access-Control-Allow-Origin"
+	corsAllowCredentialsHeader = "Access-Control-Allow-Credentials"
+	corsAllowMethodsHeader     = "Access-Control-Allow-Methods"
+	corsAllowHeadersHeader     = "Access-Control-Allow-Headers"
+	corsMaxAgeHeader           = "Access-Control-Max-Age"
+	corsRequestMethodHeader    = "Access-Control-Request-Method"
+)
+
+// defaultCORSMethods are allowed in cross-origin requests when no methods are
+// configured
+var defaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+
+// NewCORS creates a new middleware that adds CORS headers to responses for
+// requests from the allowed origins.
+// Preflight requests from allowed origins are answered directly so that they
+// don't require an authenticated session.
+// Requests from any other origin are passed on without CORS headers.
+func NewCORS(opts options.CORS) alice.Constructor {
+	c := newCORS(opts)
+	return func(next http.Handler) http.Handler {
+		if len(c.origins) == 0 {
+			return next
+		}
+		return c.handler(next)
+	}
+}
+
+// CORSPreflight identifies CORS preflight requests from the allowed origins to
+// the preflight routes, which are served without an authenticated session.
+// Any other OPTIONS requests to these routes still require authentication.
+type CORSPreflight struct {
+	cors   *cors
+	routes []*regexp.Regexp
+}
+
+// NewCORSPreflight compiles the preflight routes of the CORS options.
+func NewCORSPreflight(opts options.CORS) (*CORSPreflight, error) {
+	p := &CORSPreflight{cors: newCORS(opts)}
+	for _, route := range opts.PreflightRoutes {
+		compiledRegex, err := regexp.Compile(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CORS preflight route %q: %v", route, err)
+		}
+		p.routes = append(p.routes, compiledRegex)
+	}
+	return p, nil
+}
+
+// IsAllowed checks whether the request is a preflight request from an allowed
+// origin to one of the preflight routes.
+func (p *CORSPreflight) IsAllowed(req *http.Request) bool {
+	if len(p.routes) == 0 || !isPreflight(req) || !p.cors.isAllowedOrigin(req.Header.Get("Origin")) {
+		return false
+	}
+	for _, route := range p.routes {
+		if route.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP answers an allowed preflight request with the CORS headers.
+func (p *CORSPreflight) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Vary", "Origin")
+	p.cors.writePreflight(rw, req.Header.Get("Origin"))
+}
+
+// newCORS builds the CORS headers from the options
+func newCORS(opts options.CORS) *cors {
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+
+	c := &cors{
+		allowCredentials: opts.AllowCredentials,
+		allowMethods:     strings.Join(methods, ", "),
+		allowHeaders:     strings.Join(opts.AllowedHeaders, ", "),
+	}
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if o := parseCORSOrigin(origin); o != nil {
+			c.origins = append(c.origins, *o)
+		}
+	}
+	return c
+}
+
+// isPreflight checks whether the request is a CORS preflight request
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get(corsRequestMethodHeader) != ""
+}
+
+// corsOrigin is an allowed origin, optionally with a wildcard subdomain.
+type corsOrigin struct {
+	scheme   string
+	host     string
+	wildcard bool
+}
+
+// parseCORSOrigin parses an allowed origin in the form scheme://host[:port]
+// where the host may start with a `*.` wildcard.
+func parseCORSOrigin(origin string) *corsOrigin {
+	o := &corsOrigin{}
+	origin = strings.ToLower(origin)
+	if i := strings.Index(origin, "://*."); i >= 0 {
+		o.wildcard = true
+		origin = origin[:i] + "://" + origin[i+len("://*."):]
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil
+	}
+	o.scheme = u.Scheme
+	o.host = u.Host
+	return o
+}
+
+func (o corsOrigin) matches(scheme, host string) bool {
+	if scheme != o.scheme {
+		return false
+	}
+	if o.wildcard {
+		return strings.HasSuffix(host, "."+o.host)
+	}
+	return host == o.host
+}
+
+type cors struct {
+	origins          []corsOrigin
+	allowCredentials bool
+	allowMethods     string
+	allowHeaders     string
+	maxAge           string
+}
+
+func (c *cors) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		// The response depends on the origin, so don't let caches share it
+		rw.Header().Add("Vary", "Origin")
+		if !c.isAllowedOrigin(origin) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if !isPreflight(req) {
+			c.writeAllowOrigin(rw, origin)
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		// Answer the preflight request without passing it on
+		c.writePreflight(rw, origin)
+	})
+}
+
+// writeAllowOrigin sets the headers allowing the origin to read the response
+func (c *cors) writeAllowOrigin(rw http.ResponseWriter, origin string) {
+	rw.Header().Set(corsAllowOriginHeader, origin)
+	if c.allowCredentials {
+		rw.Header().Set(corsAllowCredentialsHeader, "true")
+	}
+}
+
+// writePreflight answers a preflight request from an allowed origin
+func (c *cors) writePreflight(rw http.ResponseWriter, origin string) {
+	c.writeAllowOrigin(rw, origin)
+	rw.Header().Set(corsAllowMethodsHeader, c.allowMethods)
+	if c.allowHeaders != "" {
+		rw.Header().Set(corsAllowHeadersHeader, c.allowHeaders)
+	}
+	if c.maxAge != "" {
+		rw.Header().Set(corsMaxAgeHeader, c.maxAge)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// isAllowedOrigin checks the Origin request header against the allowed origins.
+func (c *cors) isAllowedOrigin(origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.User != nil {
+		return false
+	}
+	for _, o := range c.origins {
+		if o.matches(u.Scheme, u.Host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,320 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CORS Suite", func() {
+	corsOpts := options.CORS{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.apps.example.com", "http://localhost:3000"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "X-Requested-With"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	type corsTableInput struct {
+		opts            options.CORS
+		method          string
+		headers         map[string]string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}
+
+	DescribeTable("when serving a request",
+		func(in *corsTableInput) {
+			req := httptest.NewRequest(in.method, "http://auth.example.com/oauth2/userinfo", nil)
+			for k, v := range in.headers {
+				req.Header.Add(k, v)
+			}
+			rw := httptest.NewRecorder()
+
+			handler := NewCORS(in.opts)(testHandler())
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedStatus))
+			for _, header := range []string{
+				corsAllowOriginHeader,
+				corsAllowCredentialsHeader,
+				corsAllowMethodsHeader,
+				corsAllowHeadersHeader,
+				corsMaxAgeHeader,
+			} {
+				Expect(rw.Header().Get(header)).To(Equal(in.expectedHeaders[header]), header)
+			}
+		},
+		Entry("without an Origin header", &corsTableInput{
+			opts:            corsOpts,
+			method:          "GET",
+			headers:         map[string]string{},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with an exact allowed origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "https://app.example.com",
+			},
+			expectedStatus: 200,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:      "https://app.example.com",
+				corsAllowCredentialsHeader: "true",
+			},
+		}),
+		Entry("with a wildcard allowed origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "https://foo.apps.example.com",
+			},
+			expectedStatus: 200,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:      "https://foo.apps.example.com",
+				corsAllowCredentialsHeader: "true",
+			},
+		}),
+		Entry("with the bare domain of a wildcard origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "https://apps.example.com",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with an allowed origin on a port", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "http://localhost:3000",
+			},
+			expectedStatus: 200,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:      "http://localhost:3000",
+				corsAllowCredentialsHeader: "true",
+			},
+		}),
+		Entry("with an allowed host on the wrong scheme", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "http://app.example.com",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with an origin that only has an allowed origin as a prefix", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "https://app.example.com.evil.com",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with a null origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "GET",
+			headers: map[string]string{
+				"Origin": "null",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with a preflight request from an allowed origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				corsRequestMethodHeader:          "POST",
+				"Access-Control-Request-Headers": "Content-Type",
+			},
+			expectedStatus: 204,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:      "https://app.example.com",
+				corsAllowCredentialsHeader: "true",
+				corsAllowMethodsHeader:     "GET, POST",
+				corsAllowHeadersHeader:     "Content-Type, X-Requested-With",
+				corsMaxAgeHeader:           "600",
+			},
+		}),
+		Entry("with a preflight request from a disallowed origin", &corsTableInput{
+			opts:   corsOpts,
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                "https://evil.com",
+				corsRequestMethodHeader: "POST",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+		Entry("with an OPTIONS request that is not a preflight", &corsTableInput{
+			opts:   corsOpts,
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin": "https://app.example.com",
+			},
+			expectedStatus: 200,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:      "https://app.example.com",
+				corsAllowCredentialsHeader: "true",
+			},
+		}),
+		Entry("without credentials allowed", &corsTableInput{
+			opts: options.CORS{
+				AllowedOrigins: []string{"https://app.example.com"},
+				AllowedMethods: []string{"GET"},
+			},
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                "https://app.example.com",
+				corsRequestMethodHeader: "GET",
+			},
+			expectedStatus: 204,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:  "https://app.example.com",
+				corsAllowMethodsHeader: "GET",
+			},
+		}),
+		Entry("without any allowed methods", &corsTableInput{
+			opts: options.CORS{
+				AllowedOrigins: []string{"https://app.example.com"},
+			},
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                "https://app.example.com",
+				corsRequestMethodHeader: "POST",
+			},
+			expectedStatus: 204,
+			expectedHeaders: map[string]string{
+				corsAllowOriginHeader:  "https://app.example.com",
+				corsAllowMethodsHeader: "GET, POST",
+			},
+		}),
+		Entry("without any allowed origins", &corsTableInput{
+			opts:   options.CORS{},
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                "https://app.example.com",
+				corsRequestMethodHeader: "GET",
+			},
+			expectedStatus:  200,
+			expectedHeaders: map[string]string{},
+		}),
+	)
+
+	Context("CORSPreflight", func() {
+		preflightOpts := corsOpts
+		preflightOpts.PreflightRoutes = []string{"^/api/"}
+
+		type preflightTableInput struct {
+			opts            options.CORS
+			method          string
+			path            string
+			headers         map[string]string
+			expectedAllowed bool
+		}
+
+		DescribeTable("IsAllowed",
+			func(in *preflightTableInput) {
+				req := httptest.NewRequest(in.method, "http://app.example.com"+in.path, nil)
+				for k, v := range in.headers {
+					req.Header.Add(k, v)
+				}
+
+				preflight, err := NewCORSPreflight(in.opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(preflight.IsAllowed(req)).To(Equal(in.expectedAllowed))
+			},
+			Entry("with a preflight request from an allowed origin to a preflight route", &preflightTableInput{
+				opts:   preflightOpts,
+				method: "OPTIONS",
+				path:   "/api/users",
+				headers: map[string]string{
+					"Origin":                "https://app.example.com",
+					corsRequestMethodHeader: "POST",
+				},
+				expectedAllowed: true,
+			}),
+			Entry("with a preflight request to another route", &preflightTableInput{
+				opts:   preflightOpts,
+				method: "OPTIONS",
+				path:   "/admin",
+				headers: map[string]string{
+					"Origin":                "https://app.example.com",
+					corsRequestMethodHeader: "POST",
+				},
+				expectedAllowed: false,
+			}),
+			Entry("with a preflight request from a disallowed origin", &preflightTableInput{
+				opts:   preflightOpts,
+				method: "OPTIONS",
+				path:   "/api/users",
+				headers: map[string]string{
+					"Origin":                "https://evil.com",
+					corsRequestMethodHeader: "POST",
+				},
+				expectedAllowed: false,
+			}),
+			Entry("with an OPTIONS request that is not a preflight", &preflightTableInput{
+				opts:   preflightOpts,
+				method: "OPTIONS",
+				path:   "/api/users",
+				headers: map[string]string{
+					"Origin": "https://app.example.com",
+				},
+				expectedAllowed: false,
+			}),
+			Entry("with a preflight request without an Origin header", &preflightTableInput{
+				opts:   preflightOpts,
+				method: "OPTIONS",
+				path:   "/api/users",
+				headers: map[string]string{
+					corsRequestMethodHeader: "POST",
+				},
+				expectedAllowed: false,
+			}),
+			Entry("without any preflight routes", &preflightTableInput{
+				opts:   corsOpts,
+				method: "OPTIONS",
+				path:   "/api/users",
+				headers: map[string]string{
+					"Origin":                "https://app.example.com",
+					corsRequestMethodHeader: "POST",
+				},
+				expectedAllowed: false,
+			}),
+		)
+
+		It("answers the preflight request with the CORS headers", func() {
+			req := httptest.NewRequest("OPTIONS", "http://app.example.com/api/users", nil)
+			req.Header.Add("Origin", "https://app.example.com")
+			req.Header.Add(corsRequestMethodHeader, "POST")
+			rw := httptest.NewRecorder()
+
+			preflight, err := NewCORSPreflight(preflightOpts)
+			Expect(err).ToNot(HaveOccurred())
+			preflight.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(204))
+			Expect(rw.Header().Get("Vary")).To(Equal("Origin"))
+			Expect(rw.Header().Get(corsAllowOriginHeader)).To(Equal("https://app.example.com"))
+			Expect(rw.Header().Get(corsAllowCredentialsHeader)).To(Equal("true"))
+			Expect(rw.Header().Get(corsAllowMethodsHeader)).To(Equal("GET, POST"))
+			Expect(rw.Header().Get(corsAllowHeadersHeader)).To(Equal("Content-Type, X-Requested-With"))
+			Expect(rw.Header().Get(corsMaxAgeHeader)).To(Equal("600"))
+		})
+
+		It("returns an error for an invalid preflight route", func() {
+			_, err := NewCORSPreflight(options.CORS{PreflightRoutes: []string{"^/api/("}})
+			Expect(err).To(MatchError(ContainSubstring("invalid CORS preflight route \"^/api/(\"")))
+		})
+	})
+})
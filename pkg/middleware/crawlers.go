@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CrawlerFilter detects crawlers by their User-Agent, so that they can be
+// refused the endpoints that would otherwise start sign in flows for them.
+type CrawlerFilter struct {
+	userAgents []*regexp.Regexp
+	status     int
+	suppressed *prometheus.CounterVec
+}
+
+// NewCrawlerFilter creates a CrawlerFilter detecting the crawlers matching the
+// user agent patterns of the options, or the default patterns when none are
+// configured. The patterns are matched case-insensitively.
+// The requests refused to crawlers are counted by endpoint with the
+// registerer.
+func NewCrawlerFilter(opts options.Crawlers, registerer prometheus.Registerer) (*CrawlerFilter, error) {
+	patterns := opts.UserAgents
+	if len(patterns) == 0 {
+		patterns = options.DefaultCrawlerUserAgents
+	}
+
+	f := &CrawlerFilter{
+		status:     opts.ResponseStatus,
+		suppressed: registerCrawlerRequestsCounter(registerer),
+	}
+	for _, pattern := range patterns {
+		userAgent, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crawler user agent %q: %v", pattern, err)
+		}
+		f.userAgents = append(f.userAgents, userAgent)
+	}
+	return f, nil
+}
+
+// IsCrawler checks whether the User-Agent of the request matches any of the
+// crawler patterns
+func (f *CrawlerFilter) IsCrawler(req *http.Request) bool {
+	userAgent := req.Header.Get("User-Agent")
+	if userAgent == "" {
+		return false
+	}
+	for _, pattern := range f.userAgents {
+		if pattern.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse creates a middleware responding to crawlers with the crawler
+// response status instead of passing their requests to the endpoint, unless
+// the skip function allows them.
+// The responses never set cookies, as crawlers don't return them.
+func (f *CrawlerFilter) Refuse(endpoint string, skip func(*http.Request) bool) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !f.IsCrawler(req) || (skip != nil && skip(req)) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			f.suppressed.WithLabelValues(endpoint).Inc()
+			rw.Header().Del("Set-Cookie")
+			http.Error(rw, http.StatusText(f.status), f.status)
+		})
+	}
+}
+
+// registerCrawlerRequestsCounter registers the counter of the requests
+// refused to crawlers, returning the existing counter if it is already
+// registered
+func registerCrawlerRequestsCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_crawler_requests_suppressed_total",
+			Help: "Total number of requests from crawlers refused by endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return counter
+}
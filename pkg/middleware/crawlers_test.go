@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Crawler Filter Suite", func() {
+	const (
+		googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		firefox   = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+		chrome    = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36"
+		safari    = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	)
+
+	DescribeTable("IsCrawler",
+		func(userAgents []string, userAgent string, expected bool) {
+			filter, err := NewCrawlerFilter(options.Crawlers{
+				Detection:      true,
+				UserAgents:     userAgents,
+				ResponseStatus: http.StatusForbidden,
+			}, prometheus.NewRegistry())
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", userAgent)
+			Expect(filter.IsCrawler(req)).To(Equal(expected))
+		},
+		Entry("a search engine crawler with the default user agents", nil, googlebot, true),
+		Entry("a lower case crawler user agent", nil, "duckduckbot/1.1", true),
+		Entry("Firefox with the default user agents", nil, firefox, false),
+		Entry("Chrome with the default user agents", nil, chrome, false),
+		Entry("Safari with the default user agents", nil, safari, false),
+		Entry("no user agent", nil, "", false),
+		Entry("a matching configured user agent", []string{"^UptimeRobot/"}, "UptimeRobot/2.0", true),
+		Entry("a default user agent with configured user agents", []string{"^UptimeRobot/"}, googlebot, false),
+	)
+
+	Context("Refuse", func() {
+		var registry *prometheus.Registry
+		var handler http.Handler
+
+		BeforeEach(func() {
+			registry = prometheus.NewRegistry()
+			filter, err := NewCrawlerFilter(options.Crawlers{
+				Detection:      true,
+				ResponseStatus: http.StatusNotFound,
+			}, registry)
+			Expect(err).ToNot(HaveOccurred())
+
+			skip := func(req *http.Request) bool {
+				return req.URL.Path == "/public"
+			}
+			handler = filter.Refuse("proxy", skip)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				http.SetCookie(rw, &http.Cookie{Name: "_oauth2_proxy_csrf", Value: "csrf"})
+				rw.WriteHeader(http.StatusFound)
+			}))
+		})
+
+		serve := func(path, userAgent string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("User-Agent", userAgent)
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("responds to crawlers with the response status and no cookies", func() {
+			rw := serve("/private", googlebot)
+			Expect(rw.Code).To(Equal(http.StatusNotFound))
+			Expect(rw.Header().Values("Set-Cookie")).To(BeEmpty())
+			Expect(testutil.ToFloat64(registerCrawlerRequestsCounter(registry).WithLabelValues("proxy"))).To(Equal(float64(1)))
+		})
+
+		It("passes the requests of users to the endpoint", func() {
+			for _, userAgent := range []string{firefox, chrome, safari, ""} {
+				rw := serve("/private", userAgent)
+				Expect(rw.Code).To(Equal(http.StatusFound))
+				Expect(rw.Header().Values("Set-Cookie")).To(HaveLen(1))
+			}
+			Expect(testutil.ToFloat64(registerCrawlerRequestsCounter(registry).WithLabelValues("proxy"))).To(Equal(float64(0)))
+		})
+
+		It("passes the requests of crawlers allowed by the skip function", func() {
+			Expect(serve("/public", googlebot).Code).To(Equal(http.StatusFound))
+		})
+	})
+})
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+)
+
+// forwardedHeaders are the headers a proxy in front of OAuth2 Proxy may use to
+// describe the original request. They are removed when set by untrusted peers.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	requestutil.XForwardedProto,
+	requestutil.XForwardedHost,
+	requestutil.XForwardedURI,
+	"X-Real-IP",
+}
+
+// NewForwardedHeadersSanitizer creates a new middleware that removes the
+// forwarded headers from requests whose peer is not a trusted proxy.
+// The X-Real-IP header is overwritten with the peer address, and the peer is
+// appended to X-Forwarded-For when the request is proxied upstream.
+// Requests from untrusted peers are also not treated as reverse proxied, so
+// redirect URLs are derived from the request itself.
+func NewForwardedHeadersSanitizer(isTrustedProxy func(*http.Request) bool) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return sanitizeForwardedHeaders(isTrustedProxy, next)
+	}
+}
+
+func sanitizeForwardedHeaders(isTrustedProxy func(*http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if isTrustedProxy(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		for _, header := range forwardedHeaders {
+			req.Header.Del(header)
+		}
+		if peer, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			req.Header.Set("X-Real-IP", peer)
+		}
+
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			scope.ReverseProxy = false
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
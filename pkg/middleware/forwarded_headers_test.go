@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Forwarded Headers Sanitizer Suite", func() {
+	const trustedProxy = "10.0.0.1"
+
+	isTrustedProxy := func(req *http.Request) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		return err == nil && host == trustedProxy
+	}
+
+	type forwardedHeadersTableInput struct {
+		remoteAddr           string
+		headers              map[string]string
+		expectedHeaders      map[string]string
+		expectedReverseProxy bool
+	}
+
+	DescribeTable("when serving a request",
+		func(in *forwardedHeadersTableInput) {
+			req := httptest.NewRequest("", "http://example.com/", nil)
+			req.RemoteAddr = in.remoteAddr
+			for k, v := range in.headers {
+				req.Header.Add(k, v)
+			}
+			scope := &middlewareapi.RequestScope{
+				ReverseProxy: true,
+			}
+			req = middlewareapi.AddRequestScope(req, scope)
+
+			var nextRequest *http.Request
+			handler := NewForwardedHeadersSanitizer(isTrustedProxy)(
+				http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					nextRequest = r
+					rw.WriteHeader(200)
+				}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(nextRequest).ToNot(BeNil())
+			for _, header := range forwardedHeaders {
+				Expect(nextRequest.Header.Get(header)).To(Equal(in.expectedHeaders[header]), header)
+			}
+			Expect(scope.ReverseProxy).To(Equal(in.expectedReverseProxy))
+		},
+		Entry("from a trusted proxy", &forwardedHeadersTableInput{
+			remoteAddr: trustedProxy + ":34567",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com",
+				"X-Forwarded-Uri":   "/foo",
+				"X-Real-IP":         "1.2.3.4",
+				"Forwarded":         "for=1.2.3.4;proto=https",
+			},
+			expectedHeaders: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com",
+				"X-Forwarded-Uri":   "/foo",
+				"X-Real-IP":         "1.2.3.4",
+				"Forwarded":         "for=1.2.3.4;proto=https",
+			},
+			expectedReverseProxy: true,
+		}),
+		Entry("from an untrusted client", &forwardedHeadersTableInput{
+			remoteAddr: "12.34.56.78:34567",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.example.com",
+				"X-Forwarded-Uri":   "/foo",
+				"X-Real-IP":         "1.2.3.4",
+				"Forwarded":         "for=1.2.3.4;proto=https",
+			},
+			expectedHeaders: map[string]string{
+				"X-Real-IP": "12.34.56.78",
+			},
+			expectedReverseProxy: false,
+		}),
+		Entry("from an untrusted client without forwarded headers", &forwardedHeadersTableInput{
+			remoteAddr: "[2001:db8::1]:34567",
+			headers:    map[string]string{},
+			expectedHeaders: map[string]string{
+				"X-Real-IP": "2001:db8::1",
+			},
+			expectedReverseProxy: false,
+		}),
+	)
+})
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// HeaderLimitReasonHeaderBytes is the reason requests with more header
+	// bytes than the limit are rejected
+	HeaderLimitReasonHeaderBytes = "header_bytes"
+
+	// HeaderLimitReasonCookies is the reason requests with more cookies than
+	// the limit are rejected
+	HeaderLimitReasonCookies = "cookies"
+)
+
+// RequestHeaderLimits are the limits on the headers of requests
+type RequestHeaderLimits struct {
+	// MaxHeaderBytes is the maximum size of the request headers in bytes,
+	// including the Host header.
+	// There is no limit when it is 0.
+	MaxHeaderBytes int
+
+	// MaxCookies is the maximum number of cookies in the request.
+	// There is no limit when it is 0.
+	MaxCookies int
+
+	// Rejected writes the response to requests exceeding a limit, with the
+	// reason the request was rejected and a description of the limit exceeded
+	Rejected func(rw http.ResponseWriter, req *http.Request, reason, detail string)
+}
+
+// NewRequestHeaderLimitsWithDefaultRegistry returns a middleware that rejects
+// requests exceeding the limits, counting them in the default
+// prometheus.Registry
+func NewRequestHeaderLimitsWithDefaultRegistry(limits RequestHeaderLimits) alice.Constructor {
+	return NewRequestHeaderLimits(prometheus.DefaultRegisterer, limits)
+}
+
+// NewRequestHeaderLimits returns a middleware that rejects requests exceeding
+// the limits, counting them in the provided prometheus.Registerer
+func NewRequestHeaderLimits(registerer prometheus.Registerer, limits RequestHeaderLimits) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		if limits.MaxHeaderBytes <= 0 && limits.MaxCookies <= 0 {
+			return next
+		}
+		counter := registerHeaderLimitRejectedCounter(registerer)
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			reason, detail := checkRequestHeaderLimits(req, limits)
+			if reason == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			counter.WithLabelValues(reason).Inc()
+			limits.Rejected(rw, req, reason, detail)
+		})
+	}
+}
+
+// checkRequestHeaderLimits returns the reason the request exceeds the limits,
+// and a description of the limit exceeded, or empty strings when it doesn't
+func checkRequestHeaderLimits(req *http.Request, limits RequestHeaderLimits) (string, string) {
+	if limits.MaxHeaderBytes > 0 {
+		if size := requestHeaderBytes(req); size > limits.MaxHeaderBytes {
+			return HeaderLimitReasonHeaderBytes, fmt.Sprintf("request headers are %d bytes, larger than the limit of %d", size, limits.MaxHeaderBytes)
+		}
+	}
+	if limits.MaxCookies > 0 {
+		if count := len(req.Cookies()); count > limits.MaxCookies {
+			return HeaderLimitReasonCookies, fmt.Sprintf("request has %d cookies, more than the limit of %d", count, limits.MaxCookies)
+		}
+	}
+	return "", ""
+}
+
+// requestHeaderBytes returns the size of the request headers as they are
+// written on the wire, with each one on a "Name: value\r\n" line
+func requestHeaderBytes(req *http.Request) int {
+	size := len("Host: \r\n") + len(req.Host)
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += len(name) + len(": \r\n") + len(value)
+		}
+	}
+	return size
+}
+
+// registerHeaderLimitRejectedCounter registers the
+// 'oauth2_proxy_request_header_limit_rejected_total' metric
+// This keeps a tally of the requests rejected for exceeding the request header
+// limits, bucketed by the limit they exceeded
+func registerHeaderLimitRejectedCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_request_header_limit_rejected_total",
+			Help: "Total number of requests rejected with a 431 for exceeding the request header limits, by the limit exceeded.",
+		},
+		[]string{"reason"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return counter
+}
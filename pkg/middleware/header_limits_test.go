@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Request Header Limits", func() {
+	type headerLimitsTableInput struct {
+		maxHeaderBytes int
+		maxCookies     int
+		headers        map[string]string
+		cookies        int
+		expectedReason string
+		expectedDetail string
+	}
+
+	DescribeTable("when serving a request",
+		func(in headerLimitsTableInput) {
+			registry := prometheus.NewRegistry()
+			var reason, detail string
+			handler := NewRequestHeaderLimits(registry, RequestHeaderLimits{
+				MaxHeaderBytes: in.maxHeaderBytes,
+				MaxCookies:     in.maxCookies,
+				Rejected: func(rw http.ResponseWriter, _ *http.Request, r, d string) {
+					reason, detail = r, d
+					rw.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+				},
+			})(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			for name, value := range in.headers {
+				req.Header.Set(name, value)
+			}
+			for i := 0; i < in.cookies; i++ {
+				req.AddCookie(&http.Cookie{Name: fmt.Sprintf("c%d", i), Value: "v"})
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(reason).To(Equal(in.expectedReason))
+			Expect(detail).To(Equal(in.expectedDetail))
+			if in.expectedReason == "" {
+				Expect(rw.Code).To(Equal(http.StatusOK))
+				return
+			}
+			Expect(rw.Code).To(Equal(http.StatusRequestHeaderFieldsTooLarge))
+			Expect(testutil.ToFloat64(registerHeaderLimitRejectedCounter(registry).WithLabelValues(in.expectedReason))).To(Equal(1.0))
+		},
+		Entry("with no limits", headerLimitsTableInput{
+			headers: map[string]string{"X-Large": strings.Repeat("a", 100000)},
+			cookies: 1000,
+		}),
+		Entry("with headers within the limit", headerLimitsTableInput{
+			// "Host: example.com\r\n" and "X-Header: 12345\r\n"
+			maxHeaderBytes: 36,
+			headers:        map[string]string{"X-Header": "12345"},
+		}),
+		Entry("with headers larger than the limit", headerLimitsTableInput{
+			maxHeaderBytes: 35,
+			headers:        map[string]string{"X-Header": "12345"},
+			expectedReason: HeaderLimitReasonHeaderBytes,
+			expectedDetail: "request headers are 36 bytes, larger than the limit of 35",
+		}),
+		Entry("with cookies within the limit", headerLimitsTableInput{
+			maxCookies: 3,
+			cookies:    3,
+		}),
+		Entry("with more cookies than the limit", headerLimitsTableInput{
+			maxCookies:     3,
+			cookies:        4,
+			expectedReason: HeaderLimitReasonCookies,
+			expectedDetail: "request has 4 cookies, more than the limit of 3",
+		}),
+	)
+})
@@ -17,11 +17,40 @@ func NewRequestHeaderInjector(headers []options.Header) (alice.Constructor, erro
 		return nil, fmt.Errorf("error building request header injector: %v", err)
 	}
 
-	strip := newStripHeaders(headers)
-	if strip != nil {
-		return alice.New(strip, headerInjector).Then, nil
+	constructors := []alice.Constructor{}
+	if injectsAuthorization(headers) {
+		constructors = append(constructors, recordClientAuthorization)
 	}
-	return headerInjector, nil
+	if strip := newStripHeaders(headers); strip != nil {
+		constructors = append(constructors, strip)
+	}
+	if len(constructors) == 0 {
+		return headerInjector, nil
+	}
+	return alice.New(append(constructors, headerInjector)...).Then, nil
+}
+
+func injectsAuthorization(headers []options.Header) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, "Authorization") {
+			return true
+		}
+	}
+	return false
+}
+
+// recordClientAuthorization keeps the Authorization header of the client
+// request in the scope before it is stripped or joined with the injected
+// Authorization header
+func recordClientAuthorization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := middlewareapi.GetRequestScope(req)
+
+		// If scope is nil, this will panic.
+		// A scope should always be injected before this handler is called.
+		scope.ClientAuthorization = req.Header.Get("Authorization")
+		next.ServeHTTP(rw, req)
+	})
 }
 
 func newStripHeaders(headers []options.Header) alice.Constructor {
@@ -65,12 +94,17 @@ func newRequestHeaderInjector(headers []options.Header) (alice.Constructor, erro
 		return nil, fmt.Errorf("error building request injector: %v", err)
 	}
 
+	names := make([]string, 0, len(headers))
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+
 	return func(next http.Handler) http.Handler {
-		return injectRequestHeaders(injector, next)
+		return injectRequestHeaders(injector, names, next)
 	}, nil
 }
 
-func injectRequestHeaders(injector header.Injector, next http.Handler) http.Handler {
+func injectRequestHeaders(injector header.Injector, names []string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		scope := middlewareapi.GetRequestScope(req)
 
@@ -78,6 +112,7 @@ func injectRequestHeaders(injector header.Injector, next http.Handler) http.Hand
 		// A scope should always be injected before this handler is called.
 		injector.Inject(req.Header, scope.Session)
 		flattenHeaders(req.Header)
+		scope.IdentityHeaders = append(scope.IdentityHeaders, names...)
 		next.ServeHTTP(rw, req)
 	})
 }
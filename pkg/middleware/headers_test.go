@@ -20,6 +20,8 @@ var _ = Describe("Headers Suite", func() {
 		session         *sessionsapi.SessionState
 		expectedHeaders http.Header
 		expectedErr     string
+
+		expectedClientAuthorization string
 	}
 
 	DescribeTable("the request header injector",
@@ -51,6 +53,7 @@ var _ = Describe("Headers Suite", func() {
 			handler.ServeHTTP(rw, req)
 
 			Expect(gotHeaders).To(Equal(in.expectedHeaders))
+			Expect(scope.ClientAuthorization).To(Equal(in.expectedClientAuthorization))
 		},
 		Entry("with no configured headers", headersTableInput{
 			headers: []options.Header{},
@@ -206,6 +209,31 @@ var _ = Describe("Headers Suite", func() {
 			expectedHeaders: nil,
 			expectedErr:     "error building request header injector: error building request injector: error building injector for header \"X-Auth-Request-Authorization\": error loading basicAuthPassword: secret source is invalid: exactly one entry required, specify either value, fromEnv or fromFile",
 		}),
+		Entry("with an Authorization header replacing the client's", headersTableInput{
+			headers: []options.Header{
+				{
+					Name: "Authorization",
+					Values: []options.HeaderValue{
+						{
+							ClaimSource: &options.ClaimSource{
+								Claim:  "access_token",
+								Prefix: "Bearer ",
+							},
+						},
+					},
+				},
+			},
+			initialHeaders: http.Header{
+				"Authorization": []string{"Bearer client-token"},
+			},
+			session: &sessionsapi.SessionState{
+				AccessToken: "session-token",
+			},
+			expectedHeaders: http.Header{
+				"Authorization": []string{"Bearer session-token"},
+			},
+			expectedClientAuthorization: "Bearer client-token",
+		}),
 	)
 
 	DescribeTable("the response header injector",
@@ -435,4 +463,28 @@ var _ = Describe("Headers Suite", func() {
 			expectedErr:     "error building response header injector: error building response injector: error building injector for header \"X-Auth-Request-Authorization\": error loading basicAuthPassword: secret source is invalid: exactly one entry required, specify either value, fromEnv or fromFile",
 		}),
 	)
+
+	It("records the names of the injected request headers in the request scope", func() {
+		scope := &middlewareapi.RequestScope{
+			Session:         &sessionsapi.SessionState{Email: "john.doe@example.com"},
+			IdentityHeaders: []string{"X-Identity-Assertion"},
+		}
+		req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), scope)
+
+		injector, err := NewRequestHeaderInjector([]options.Header{
+			{
+				Name:   "X-Forwarded-Email",
+				Values: []options.HeaderValue{{ClaimSource: &options.ClaimSource{Claim: "email"}}},
+			},
+			{
+				Name:                 "X-Forwarded-Groups",
+				PreserveRequestValue: true,
+				Values:               []options.HeaderValue{{ClaimSource: &options.ClaimSource{Claim: "groups"}}},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		injector(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(scope.IdentityHeaders).To(Equal([]string{"X-Identity-Assertion", "X-Forwarded-Email", "X-Forwarded-Groups"}))
+	})
 })
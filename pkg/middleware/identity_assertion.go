@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/assertion"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// NewIdentityAssertionInjector creates a new middleware that injects a signed
+// identity assertion for the session into the request.
+// Any assertion sent by the client is removed so that it can't be spoofed.
+func NewIdentityAssertionInjector(signer *assertion.Signer) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.Header.Del(signer.Header())
+			injectIdentityAssertion(signer, req.Header, req)
+
+			// If scope is nil, injectIdentityAssertion will have panicked.
+			scope := middlewareapi.GetRequestScope(req)
+			scope.IdentityHeaders = append(scope.IdentityHeaders, signer.Header())
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// NewIdentityAssertionResponseInjector creates a new middleware that injects a
+// signed identity assertion for the session into the response, for proxies
+// using the auth endpoint to forward to the upstream.
+func NewIdentityAssertionResponseInjector(signer *assertion.Signer) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			injectIdentityAssertion(signer, rw.Header(), req)
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func injectIdentityAssertion(signer *assertion.Signer, header http.Header, req *http.Request) {
+	scope := middlewareapi.GetRequestScope(req)
+
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	if scope.Session == nil {
+		return
+	}
+
+	identityAssertion, err := signer.Sign(scope.Session)
+	if err != nil {
+		logger.Errorf("Error creating identity assertion: %v", err)
+		return
+	}
+	header.Set(signer.Header(), identityAssertion)
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/assertion"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identity Assertion Suite", func() {
+	const header = "X-Forwarded-Id-Token-Assertion"
+
+	var signer *assertion.Signer
+	var key *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		keyData, err := x509.MarshalECPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+
+		keyFile, err := ioutil.TempFile("", "oauth2-proxy-identity-assertion")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(keyFile.Name())
+		Expect(pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData})).To(Succeed())
+		Expect(keyFile.Close()).To(Succeed())
+
+		signer, err = assertion.NewSigner(options.IdentityAssertion{
+			SigningKeyFile: keyFile.Name(),
+			Header:         header,
+			Expiry:         time.Minute,
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	serve := func(injector func(http.Handler) http.Handler, session *sessionsapi.SessionState) (http.Header, http.Header) {
+		req := httptest.NewRequest("", "/", nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+			Session: session,
+		})
+		req.Header.Set(header, "spoofed")
+
+		rw := httptest.NewRecorder()
+		var gotHeaders http.Header
+		injector(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotHeaders = r.Header.Clone()
+		})).ServeHTTP(rw, req)
+		return gotHeaders, rw.Header()
+	}
+
+	verify := func(identityAssertion string) *jwt.StandardClaims {
+		claims := &jwt.StandardClaims{}
+		_, err := new(jwt.Parser).ParseWithClaims(identityAssertion, claims, func(*jwt.Token) (interface{}, error) {
+			return key.Public(), nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return claims
+	}
+
+	Context("the request injector", func() {
+		It("replaces the client's assertion with a signed assertion", func() {
+			requestHeaders, _ := serve(NewIdentityAssertionInjector(signer), &sessionsapi.SessionState{User: "john"})
+			Expect(verify(requestHeaders.Get(header)).Subject).To(Equal("john"))
+		})
+
+		It("removes the client's assertion without a session", func() {
+			requestHeaders, _ := serve(NewIdentityAssertionInjector(signer), nil)
+			Expect(requestHeaders).ToNot(HaveKey(header))
+		})
+	})
+
+	Context("the response injector", func() {
+		It("adds a signed assertion to the response", func() {
+			_, responseHeaders := serve(NewIdentityAssertionResponseInjector(signer), &sessionsapi.SessionState{User: "john"})
+			Expect(verify(responseHeaders.Get(header)).Subject).To(Equal("john"))
+		})
+
+		It("adds no assertion without a session", func() {
+			_, responseHeaders := serve(NewIdentityAssertionResponseInjector(signer), nil)
+			Expect(responseHeaders).ToNot(HaveKey(header))
+		})
+	})
+})
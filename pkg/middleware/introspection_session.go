@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// NewIntrospectionSessionLoader creates a new handler which loads sessions
+// from the bearer tokens in Authorization headers by introspecting them,
+// for opaque tokens which can't be verified as JWTs.
+// Requests whose bearer token is rejected are marked in the request scope so
+// that they can be denied rather than sent to sign in.
+// If a session was loaded by a previous handler, it will not be replaced.
+func NewIntrospectionSessionLoader(tokenToSession middlewareapi.TokenToSessionFunc) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope := middlewareapi.GetRequestScope(req)
+			// If scope is nil, this will panic.
+			// A scope should always be injected before this handler is called.
+			if scope.Session != nil {
+				// The session was already loaded, pass to the next handler
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			auth := req.Header.Get("Authorization")
+			if auth == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			tokenType, token, err := splitAuthHeader(auth)
+			if err != nil || tokenType != "Bearer" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			session, err := tokenToSession(req.Context(), token)
+			if err != nil {
+				logger.Errorf("Error introspecting bearer token in Authorization header: %v", err)
+				scope.BearerTokenRejected = true
+			}
+
+			scope.Session = session
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Introspection Session Suite", func() {
+	const activeToken = "opaque-active-token"
+
+	var activeSession = &sessionsapi.SessionState{
+		User:        "user",
+		Email:       "user@example.com",
+		AccessToken: activeToken,
+	}
+
+	tokenToSession := func(_ context.Context, token string) (*sessionsapi.SessionState, error) {
+		if token != activeToken {
+			return nil, errors.New("token is not active")
+		}
+		return activeSession, nil
+	}
+
+	type introspectionSessionLoaderTableInput struct {
+		authorizationHeader string
+		existingSession     *sessionsapi.SessionState
+		expectedSession     *sessionsapi.SessionState
+		expectedRejected    bool
+	}
+
+	DescribeTable("NewIntrospectionSessionLoader",
+		func(in introspectionSessionLoaderTableInput) {
+			scope := &middlewareapi.RequestScope{
+				Session: in.existingSession,
+			}
+
+			req := httptest.NewRequest("", "/", nil)
+			req.Header.Set("Authorization", in.authorizationHeader)
+			req = middlewareapi.AddRequestScope(req, scope)
+
+			var gotScope *middlewareapi.RequestScope
+			handler := NewIntrospectionSessionLoader(tokenToSession)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotScope = middlewareapi.GetRequestScope(r)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(gotScope.Session).To(Equal(in.expectedSession))
+			Expect(gotScope.BearerTokenRejected).To(Equal(in.expectedRejected))
+		},
+		Entry("<no value>", introspectionSessionLoaderTableInput{
+			authorizationHeader: "",
+			expectedSession:     nil,
+			expectedRejected:    false,
+		}),
+		Entry("Bearer <activeToken>", introspectionSessionLoaderTableInput{
+			authorizationHeader: "Bearer " + activeToken,
+			expectedSession:     activeSession,
+			expectedRejected:    false,
+		}),
+		Entry("Bearer <inactiveToken>", introspectionSessionLoaderTableInput{
+			authorizationHeader: "Bearer opaque-inactive-token",
+			expectedSession:     nil,
+			expectedRejected:    true,
+		}),
+		Entry("Bearer <inactiveToken> (with existing session)", introspectionSessionLoaderTableInput{
+			authorizationHeader: "Bearer opaque-inactive-token",
+			existingSession:     &sessionsapi.SessionState{User: "existing"},
+			expectedSession:     &sessionsapi.SessionState{User: "existing"},
+			expectedRejected:    false,
+		}),
+		Entry("Basic credentials", introspectionSessionLoaderTableInput{
+			authorizationHeader: "Basic dXNlcjpwYXNzd29yZA==",
+			expectedSession:     nil,
+			expectedRejected:    false,
+		}),
+	)
+})
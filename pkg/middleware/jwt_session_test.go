@@ -67,6 +67,9 @@ Nnc3a3lGVWFCNUMxQnNJcnJMTWxka1dFaHluYmI4Ongtb2F1dGgtYmFzaWM=`
 		Email:       "john@example.com",
 		User:        "1234567890",
 		ExpiresOn:   &verifiedSessionExpiry,
+		BearerToken: &sessionsapi.BearerToken{
+			Audiences: []string{"https://test.myapp.com"},
+		},
 	}
 
 	// validToken will pass the token regex so can be used to check token fetching
@@ -401,6 +404,7 @@ Nnc3a3lGVWFCNUMxQnNJcnJMTWxka1dFaHluYmI4Ongtb2F1dGgtYmFzaWM=`
 		type idTokenClaims struct {
 			Email    string `json:"email,omitempty"`
 			Verified *bool  `json:"email_verified,omitempty"`
+			Scope    string `json:"scope,omitempty"`
 			jwt.StandardClaims
 		}
 
@@ -410,6 +414,7 @@ Nnc3a3lGVWFCNUMxQnNJcnJMTWxka1dFaHluYmI4Ongtb2F1dGgtYmFzaWM=`
 			expectedUser    string
 			expectedEmail   string
 			expectedExpires *time.Time
+			expectedScopes  []string
 		}
 
 		DescribeTable("when creating a session from an IDToken",
@@ -448,6 +453,10 @@ Nnc3a3lGVWFCNUMxQnNJcnJMTWxka1dFaHluYmI4Ongtb2F1dGgtYmFzaWM=`
 				Expect(session.ExpiresOn.Unix()).To(Equal(in.expectedExpires.Unix()))
 				Expect(session.RefreshToken).To(BeEmpty())
 				Expect(session.PreferredUsername).To(BeEmpty())
+				Expect(session.BearerToken).To(Equal(&sessionsapi.BearerToken{
+					Audiences: []string{"asdf1234"},
+					Scopes:    in.expectedScopes,
+				}))
 			},
 			Entry("with no email", tokenToSessionTableInput{
 				idToken: idTokenClaims{
@@ -501,6 +510,25 @@ Nnc3a3lGVWFCNUMxQnNJcnJMTWxka1dFaHluYmI4Ongtb2F1dGgtYmFzaWM=`
 				},
 				expectedErr: errors.New("email in id_token (foo@example.com) isn't verified"),
 			}),
+			Entry("with scopes", tokenToSessionTableInput{
+				idToken: idTokenClaims{
+					StandardClaims: jwt.StandardClaims{
+						Audience:  "asdf1234",
+						ExpiresAt: expiresFuture.Unix(),
+						Id:        "id-some-id",
+						IssuedAt:  time.Now().Unix(),
+						Issuer:    "https://issuer.example.com",
+						NotBefore: 0,
+						Subject:   "123456789",
+					},
+					Scope: "openid reports:read",
+				},
+				expectedErr:     nil,
+				expectedUser:    "123456789",
+				expectedEmail:   "123456789",
+				expectedExpires: &expiresFuture,
+				expectedScopes:  []string{"openid", "reports:read"},
+			}),
 		)
 	})
 })
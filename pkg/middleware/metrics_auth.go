@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/authentication/basic"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+)
+
+// NewMetricsAuth creates a new middleware that protects the metrics server.
+// Scrapes from outside the allowed IPs are forbidden and, when a bearer token
+// or basic auth is configured, scrapes without valid credentials are
+// unauthorized.
+// Rejected scrapes are not logged as Prometheus retries them at every scrape
+// interval.
+func NewMetricsAuth(opts options.MetricsAuth, validator basic.Validator) (alice.Constructor, error) {
+	if opts.BasicAuth && validator == nil {
+		return nil, fmt.Errorf("metrics basic auth requires an htpasswd file")
+	}
+
+	var allowedIPs *ip.NetSet
+	if len(opts.AllowedIPs) > 0 {
+		allowedIPs = ip.NewNetSet()
+		for _, ipStr := range opts.AllowedIPs {
+			ipNet := ip.ParseIPNet(ipStr)
+			if ipNet == nil {
+				return nil, fmt.Errorf("could not parse IP network (%s)", ipStr)
+			}
+			allowedIPs.AddIPNet(*ipNet)
+		}
+	}
+
+	a := &metricsAuth{
+		bearerToken: opts.BearerToken,
+		allowedIPs:  allowedIPs,
+	}
+	if opts.BasicAuth {
+		a.validator = validator
+	}
+	return a.protect, nil
+}
+
+// metricsAuth checks scrapes of the metrics server
+type metricsAuth struct {
+	bearerToken string
+	validator   basic.Validator
+	allowedIPs  *ip.NetSet
+}
+
+func (a *metricsAuth) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !a.isAllowedIP(req) {
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if !a.isAuthorized(req) {
+			if a.validator != nil {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			} else {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			}
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// isAllowedIP checks the address the scrape was received from.
+// Forwarding headers are ignored as scrapes are expected to connect directly.
+func (a *metricsAuth) isAllowedIP(req *http.Request) bool {
+	if a.allowedIPs == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	remoteIP := net.ParseIP(host)
+	return remoteIP != nil && a.allowedIPs.Has(remoteIP)
+}
+
+// isAuthorized checks the credentials of the scrape when a bearer token or
+// basic auth is configured.
+func (a *metricsAuth) isAuthorized(req *http.Request) bool {
+	if a.bearerToken == "" && a.validator == nil {
+		return true
+	}
+
+	auth := req.Header.Get("Authorization")
+	if a.bearerToken != "" && strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(a.bearerToken)) == 1
+	}
+	if a.validator != nil {
+		if user, password, ok := req.BasicAuth(); ok {
+			return a.validator.Validate(user, password)
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// metricsTestValidator accepts a single user and password
+type metricsTestValidator struct{}
+
+func (metricsTestValidator) Validate(user, password string) bool {
+	return user == "prometheus" && password == "scrape"
+}
+
+var _ = Describe("Metrics Auth Suite", func() {
+	type metricsAuthTableInput struct {
+		opts                    options.MetricsAuth
+		remoteAddr              string
+		bearerToken             string
+		basicAuth               bool
+		expectedCode            int
+		expectedWWWAuthenticate string
+	}
+
+	DescribeTable("when scraping metrics",
+		func(in metricsAuthTableInput) {
+			metricsAuth, err := NewMetricsAuth(in.opts, metricsTestValidator{})
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.RemoteAddr = in.remoteAddr
+			// Forwarding headers must never be trusted by the metrics server
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			req.Header.Set("X-Real-IP", "10.0.0.1")
+			if in.bearerToken != "" {
+				req.Header.Set("Authorization", "Bearer "+in.bearerToken)
+			}
+			if in.basicAuth {
+				req.SetBasicAuth("prometheus", "scrape")
+			}
+
+			rw := httptest.NewRecorder()
+			metricsAuth(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			Expect(rw.Header().Get("WWW-Authenticate")).To(Equal(in.expectedWWWAuthenticate))
+		},
+		Entry("without protection", metricsAuthTableInput{
+			remoteAddr:   "192.168.1.1:43670",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a valid bearer token", metricsAuthTableInput{
+			opts:         options.MetricsAuth{BearerToken: "s3cr3t"},
+			remoteAddr:   "192.168.1.1:43670",
+			bearerToken:  "s3cr3t",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with an invalid bearer token", metricsAuthTableInput{
+			opts:                    options.MetricsAuth{BearerToken: "s3cr3t"},
+			remoteAddr:              "192.168.1.1:43670",
+			bearerToken:             "guess",
+			expectedCode:            http.StatusUnauthorized,
+			expectedWWWAuthenticate: `Bearer realm="metrics"`,
+		}),
+		Entry("without a bearer token", metricsAuthTableInput{
+			opts:                    options.MetricsAuth{BearerToken: "s3cr3t"},
+			remoteAddr:              "192.168.1.1:43670",
+			expectedCode:            http.StatusUnauthorized,
+			expectedWWWAuthenticate: `Bearer realm="metrics"`,
+		}),
+		Entry("with valid basic auth", metricsAuthTableInput{
+			opts:         options.MetricsAuth{BasicAuth: true},
+			remoteAddr:   "192.168.1.1:43670",
+			basicAuth:    true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a bearer token when basic auth is required", metricsAuthTableInput{
+			opts:                    options.MetricsAuth{BasicAuth: true},
+			remoteAddr:              "192.168.1.1:43670",
+			bearerToken:             "s3cr3t",
+			expectedCode:            http.StatusUnauthorized,
+			expectedWWWAuthenticate: `Basic realm="metrics"`,
+		}),
+		Entry("with basic auth when either credential is accepted", metricsAuthTableInput{
+			opts:         options.MetricsAuth{BearerToken: "s3cr3t", BasicAuth: true},
+			remoteAddr:   "192.168.1.1:43670",
+			basicAuth:    true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("from an allowed IP", metricsAuthTableInput{
+			opts:         options.MetricsAuth{AllowedIPs: []string{"192.168.0.0/16"}},
+			remoteAddr:   "192.168.1.1:43670",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("from an IP that isn't allowed, with a forwarded allowed IP", metricsAuthTableInput{
+			opts:         options.MetricsAuth{AllowedIPs: []string{"10.0.0.0/8"}},
+			remoteAddr:   "192.168.1.1:43670",
+			expectedCode: http.StatusForbidden,
+		}),
+		Entry("from an allowed IP without a bearer token", metricsAuthTableInput{
+			opts:                    options.MetricsAuth{BearerToken: "s3cr3t", AllowedIPs: []string{"192.168.0.0/16"}},
+			remoteAddr:              "192.168.1.1:43670",
+			expectedCode:            http.StatusUnauthorized,
+			expectedWWWAuthenticate: `Bearer realm="metrics"`,
+		}),
+	)
+
+	It("requires a validator for basic auth", func() {
+		_, err := NewMetricsAuth(options.MetricsAuth{BasicAuth: true}, nil)
+		Expect(err).To(MatchError("metrics basic auth requires an htpasswd file"))
+	})
+
+	It("rejects invalid allowed IPs", func() {
+		_, err := NewMetricsAuth(options.MetricsAuth{AllowedIPs: []string{"not-an-ip"}}, nil)
+		Expect(err).To(MatchError("could not parse IP network (not-an-ip)"))
+	})
+})
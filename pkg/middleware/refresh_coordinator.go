@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// refreshCoordinator lets one of the concurrent requests with the same
+// session refresh it, while the others wait for the refreshed session rather
+// than each queueing for the session lock to then refresh it.
+type refreshCoordinator struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+// refreshCall is a refresh in progress, its result is set before done is
+// closed
+type refreshCall struct {
+	done   chan struct{}
+	result refreshResult
+}
+
+// refreshResult is the outcome of a refresh, shared with the requests that
+// waited for it
+type refreshResult struct {
+	// session is a copy of the session after the refresh
+	session *sessionsapi.SessionState
+
+	// refreshFailed is set when the provider couldn't refresh the session,
+	// which was kept as it was still valid
+	refreshFailed bool
+
+	// cancelled is set when the request refreshing the session was cancelled,
+	// so that the waiting requests refresh it themselves
+	cancelled bool
+
+	err error
+}
+
+func newRefreshCoordinator() *refreshCoordinator {
+	return &refreshCoordinator{
+		calls: make(map[string]*refreshCall),
+	}
+}
+
+// do calls refresh for the session, unless another request is already
+// refreshing the same session, in which case the result of that refresh is
+// returned once it completes.
+// shared reports whether the result is that of another request.
+func (c *refreshCoordinator) do(ctx context.Context, session *sessionsapi.SessionState, refresh func() refreshResult) (result refreshResult, shared bool) {
+	key := refreshCallKey(session)
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.result, true
+		case <-ctx.Done():
+			return refreshResult{err: fmt.Errorf("request cancelled while waiting for the session refresh: %w", ctx.Err())}, true
+		}
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.result = refresh()
+	return call.result, false
+}
+
+// refreshCallKey identifies the session by a hash of its tokens and creation
+// time, which are the same for all requests with the session until it is
+// refreshed
+func refreshCallKey(session *sessionsapi.SessionState) string {
+	h := sha256.New()
+	if session.CreatedAt != nil {
+		fmt.Fprintf(h, "%d\x00", session.CreatedAt.UnixNano())
+	}
+	for _, value := range []string{session.AccessToken, session.IDToken, session.RefreshToken, session.Email, session.User} {
+		fmt.Fprintf(h, "%s\x00", value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
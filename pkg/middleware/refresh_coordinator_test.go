@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Refresh Coordinator Suite", func() {
+	var (
+		coordinator *refreshCoordinator
+		session     *sessionsapi.SessionState
+		release     chan struct{}
+		leaderDone  chan refreshResult
+	)
+
+	BeforeEach(func() {
+		coordinator = newRefreshCoordinator()
+		createdAt := time.Now().Add(-time.Hour)
+		session = &sessionsapi.SessionState{
+			Email:        "john@example.com",
+			RefreshToken: "refresh-token",
+			CreatedAt:    &createdAt,
+		}
+		release = make(chan struct{})
+		leaderDone = make(chan refreshResult, 1)
+
+		// The leader refreshes the session once it is released
+		go func() {
+			defer GinkgoRecover()
+			result, shared := coordinator.do(context.Background(), session, func() refreshResult {
+				<-release
+				return refreshResult{session: &sessionsapi.SessionState{RefreshToken: "refreshed-token"}}
+			})
+			Expect(shared).To(BeFalse())
+			leaderDone <- result
+		}()
+		Eventually(func() int {
+			coordinator.mu.Lock()
+			defer coordinator.mu.Unlock()
+			return len(coordinator.calls)
+		}).Should(Equal(1))
+	})
+
+	AfterEach(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		Eventually(leaderDone).Should(Receive())
+	})
+
+	It("shares the refresh in progress with the requests with the same session", func() {
+		followerDone := make(chan bool, 1)
+		go func() {
+			loaded := *session
+			result, shared := coordinator.do(context.Background(), &loaded, func() refreshResult {
+				return refreshResult{err: errors.New("refreshed again")}
+			})
+			followerDone <- shared && result.err == nil && result.session.RefreshToken == "refreshed-token"
+		}()
+
+		// Give the follower the time to wait for the refresh in progress
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		Eventually(followerDone).Should(Receive(BeTrue()))
+	})
+
+	It("refreshes other sessions without waiting", func() {
+		other := *session
+		other.RefreshToken = "other-refresh-token"
+		result, shared := coordinator.do(context.Background(), &other, func() refreshResult {
+			return refreshResult{session: &other}
+		})
+		Expect(shared).To(BeFalse())
+		Expect(result.session).To(Equal(&other))
+	})
+
+	It("stops waiting for the refresh in progress when the request is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		result, shared := coordinator.do(ctx, session, func() refreshResult {
+			return refreshResult{err: errors.New("refreshed again")}
+		})
+		Expect(shared).To(BeTrue())
+		Expect(result.err).To(MatchError("request cancelled while waiting for the session refresh: context canceled"))
+	})
+})
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// NewRequestDebugHeader enables debug logging for requests carrying the secret
+// in the header.
+// The header is always removed from the request, so that it is never proxied
+// to upstreams, whether or not it carries the secret.
+func NewRequestDebugHeader(header, secret string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			value := req.Header.Get(header)
+			req.Header.Del(header)
+			if value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(secret)) == 1 {
+				enableDebugLogging(req, "the request debug header")
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// NewRequestDebugEmails enables debug logging for requests of sessions with
+// one of the emails.
+// It must be placed after the session loaders, only the log lines of the
+// request written after its session is loaded are affected.
+func NewRequestDebugEmails(emails []string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope := middlewareapi.GetRequestScope(req)
+			if scope != nil && scope.Session != nil && matchesEmail(scope.Session.Email, emails) {
+				enableDebugLogging(req, "the session email")
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// enableDebugLogging marks the request scope so that all log lines of the
+// request are written
+func enableDebugLogging(req *http.Request, reason string) {
+	scope := middlewareapi.GetRequestScope(req)
+	if scope == nil || scope.DebugLogging {
+		return
+	}
+	scope.DebugLogging = true
+	logger.PrintfContext(req.Context(), "Debug logging enabled for %s %s by %s", req.Method, req.URL.Path, reason)
+}
+
+func matchesEmail(email string, emails []string) bool {
+	if email == "" {
+		return false
+	}
+	for _, e := range emails {
+		if strings.EqualFold(email, e) {
+			return true
+		}
+	}
+	return false
+}
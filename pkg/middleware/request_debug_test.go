@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Debug Suite", func() {
+	const (
+		debugHeader = "X-Debug-Logging"
+		debugSecret = "debug-secret"
+		requestID   = "11111111-2222-4333-8444-555555555555"
+	)
+
+	serve := func(constructor func(http.Handler) http.Handler, req *http.Request) (*middlewareapi.RequestScope, http.Header) {
+		scope := middlewareapi.GetRequestScope(req)
+		var upstreamHeaders http.Header
+		constructor(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			upstreamHeaders = req.Header
+			logger.DebugfContext(req.Context(), "upstream debug line")
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return scope, upstreamHeaders
+	}
+
+	var buf *bytes.Buffer
+
+	BeforeEach(func() {
+		buf = bytes.NewBuffer(nil)
+		logger.SetOutput(buf)
+		logger.SetStandardEnabled(false)
+		logger.SetDebugEnabled(false)
+	})
+
+	AfterEach(func() {
+		logger.SetOutput(GinkgoWriter)
+		logger.SetStandardEnabled(true)
+	})
+
+	type requestDebugHeaderTableInput struct {
+		headerValue string
+		expectDebug bool
+	}
+
+	DescribeTable("NewRequestDebugHeader",
+		func(in requestDebugHeaderTableInput) {
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			if in.headerValue != "" {
+				req.Header.Set(debugHeader, in.headerValue)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{RequestID: requestID})
+
+			scope, upstreamHeaders := serve(NewRequestDebugHeader(debugHeader, debugSecret), req)
+			Expect(scope.DebugLogging).To(Equal(in.expectDebug))
+			Expect(upstreamHeaders).ToNot(HaveKey(debugHeader))
+
+			if in.expectDebug {
+				Expect(buf.String()).To(ContainSubstring("[" + requestID + "] upstream debug line"))
+			} else {
+				Expect(buf.String()).To(BeEmpty())
+			}
+		},
+		Entry("with the secret", requestDebugHeaderTableInput{
+			headerValue: debugSecret,
+			expectDebug: true,
+		}),
+		Entry("with another value", requestDebugHeaderTableInput{
+			headerValue: "guess",
+			expectDebug: false,
+		}),
+		Entry("without the header", requestDebugHeaderTableInput{
+			expectDebug: false,
+		}),
+	)
+
+	type requestDebugEmailsTableInput struct {
+		session     *sessionsapi.SessionState
+		expectDebug bool
+	}
+
+	DescribeTable("NewRequestDebugEmails",
+		func(in requestDebugEmailsTableInput) {
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				RequestID: requestID,
+				Session:   in.session,
+			})
+
+			scope, _ := serve(NewRequestDebugEmails([]string{"admin@example.com"}), req)
+			Expect(scope.DebugLogging).To(Equal(in.expectDebug))
+
+			if in.expectDebug {
+				Expect(buf.String()).To(ContainSubstring("[" + requestID + "] upstream debug line"))
+			} else {
+				Expect(buf.String()).To(BeEmpty())
+			}
+		},
+		Entry("with a listed email", requestDebugEmailsTableInput{
+			session:     &sessionsapi.SessionState{Email: "admin@example.com"},
+			expectDebug: true,
+		}),
+		Entry("with a listed email in another case", requestDebugEmailsTableInput{
+			session:     &sessionsapi.SessionState{Email: "Admin@Example.com"},
+			expectDebug: true,
+		}),
+		Entry("with another email", requestDebugEmailsTableInput{
+			session:     &sessionsapi.SessionState{Email: "user@example.com"},
+			expectDebug: false,
+		}),
+		Entry("without a session", requestDebugEmailsTableInput{
+			expectDebug: false,
+		}),
+	)
+})
@@ -3,8 +3,10 @@ package middleware
 import (
 	"bufio"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/justinas/alice"
@@ -13,7 +15,8 @@ import (
 )
 
 // NewRequestLogger returns middleware which logs requests
-// It uses a custom ResponseWriter to track status code & response size details
+// It uses a custom ResponseWriter to track status code & response size details,
+// and counts the bytes of the request body read while serving the request
 func NewRequestLogger() alice.Constructor {
 	return requestLogger
 }
@@ -23,6 +26,12 @@ func requestLogger(next http.Handler) http.Handler {
 		startTime := time.Now()
 		url := *req.URL
 
+		var body *loggingBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &loggingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+
 		responseLogger := &loggingResponse{ResponseWriter: rw}
 		next.ServeHTTP(responseLogger, req)
 
@@ -37,6 +46,7 @@ func requestLogger(next http.Handler) http.Handler {
 			startTime,
 			responseLogger.Status(),
 			responseLogger.Size(),
+			body.Size(),
 		)
 	})
 }
@@ -52,6 +62,31 @@ func getUser(scope *middlewareapi.RequestScope) string {
 	return ""
 }
 
+// loggingBody is a request body counting the bytes read from it.
+// The size is updated atomically as the body may still be read by the
+// transport of a proxied request while the request is logged.
+type loggingBody struct {
+	io.ReadCloser
+
+	size int64
+}
+
+// Read reads from the request body
+func (b *loggingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.size, int64(n))
+	return n, err
+}
+
+// Size returns the number of bytes read from the body, or 0 for requests
+// without a body
+func (b *loggingBody) Size() int {
+	if b == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&b.size))
+}
+
 // loggingResponse is a custom http.ResponseWriter that allows tracking certain
 // details for request logging.
 type loggingResponse struct {
@@ -2,8 +2,12 @@ package middleware
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"time"
 
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -30,6 +34,7 @@ var _ = Describe("Request logger suite", func() {
 			buf := bytes.NewBuffer(nil)
 			logger.SetOutput(buf)
 			logger.SetReqTemplate(in.Format)
+			logger.SetReqEncoding(logger.RequestLoggingEncodingText)
 			logger.SetExcludePaths(in.ExcludePaths)
 
 			req, err := http.NewRequest("GET", in.Path, nil)
@@ -120,5 +125,111 @@ var _ = Describe("Request logger suite", func() {
 			Path:               "/ping",
 			ExcludePaths:       []string{"/ping"},
 		}),
+		Entry("custom format without upstream server details", &requestLoggerTableInput{
+			Format:             "{{.Upstream}} {{.UpstreamAddress}} {{.UpstreamDuration}} {{.UpstreamRetries}} {{.RequestSize}}",
+			ExpectedLogMessage: "static - - 0 0\n",
+			Path:               "/foo/bar",
+			Upstream:           "static",
+		}),
 	)
+
+	Context("with the upstream server details of the request", func() {
+		var buf *bytes.Buffer
+
+		// upstream reads the request body and records the upstream server
+		// details, as the upstream proxy does
+		upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, err := io.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+
+			scope := middlewareapi.GetRequestScope(req)
+			scope.Upstream = "api"
+			scope.UpstreamAddress = "10.0.0.1:8080"
+			scope.UpstreamDuration = 1250 * time.Millisecond
+			scope.UpstreamRetries = 1
+
+			rw.WriteHeader(http.StatusCreated)
+			rw.Write([]byte("created"))
+		})
+
+		serve := func(encoding, format string) string {
+			buf = bytes.NewBuffer(nil)
+			logger.SetOutput(buf)
+			logger.SetReqTemplate(format)
+			logger.SetReqEncoding(encoding)
+			logger.SetExcludePaths(nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/items?page=2", strings.NewReader("name=item"))
+			req.RemoteAddr = "127.0.0.1"
+			req.Host = "test-server"
+			req.Header.Set("User-Agent", "test agent")
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				RequestID: "11111111-2222-4333-8444-555555555555",
+				Session:   &sessions.SessionState{Email: "user@example.com"},
+			})
+
+			NewRequestLogger()(upstream).ServeHTTP(httptest.NewRecorder(), req)
+			return buf.String()
+		}
+
+		AfterEach(func() {
+			logger.SetReqEncoding(logger.RequestLoggingEncodingText)
+		})
+
+		It("writes them with the request logging format", func() {
+			Expect(serve(logger.RequestLoggingEncodingText, "{{.Upstream}} {{.UpstreamAddress}} {{.UpstreamDuration}} {{.UpstreamRetries}} {{.RequestSize}} {{.ResponseSize}}")).
+				To(Equal("api 10.0.0.1:8080 1.250 1 9 7\n"))
+		})
+
+		It("writes them as JSON", func() {
+			line := serve(logger.RequestLoggingEncodingJSON, "ignored")
+			Expect(line).To(HaveSuffix("}\n"))
+
+			var fields map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &fields)).To(Succeed())
+			Expect(fields).To(HaveKey("timestamp"))
+			Expect(fields).To(HaveKey("duration"))
+			delete(fields, "timestamp")
+			delete(fields, "duration")
+			Expect(fields).To(Equal(map[string]interface{}{
+				"client":           "127.0.0.1",
+				"requestId":        "11111111-2222-4333-8444-555555555555",
+				"username":         "user@example.com",
+				"host":             "test-server",
+				"method":           "POST",
+				"uri":              "/api/items?page=2",
+				"protocol":         "HTTP/1.1",
+				"userAgent":        "test agent",
+				"status":           float64(201),
+				"requestSize":      float64(9),
+				"responseSize":     float64(7),
+				"upstream":         "api",
+				"upstreamAddress":  "10.0.0.1:8080",
+				"upstreamDuration": 1.25,
+				"upstreamRetries":  float64(1),
+			}))
+		})
+
+		It("writes them as logfmt", func() {
+			line := serve(logger.RequestLoggingEncodingLogfmt, "ignored")
+			Expect(line).To(MatchRegexp(`^timestamp=\S+ client=127\.0\.0\.1 requestId=11111111-2222-4333-8444-555555555555 username=user@example\.com ` +
+				`host=test-server method=POST uri="/api/items\?page=2" protocol=HTTP/1\.1 userAgent="test agent" status=201 requestSize=9 responseSize=7 ` +
+				`duration=\S+ upstream=api upstreamAddress=10\.0\.0\.1:8080 upstreamDuration=1\.25 upstreamRetries=1\n$`))
+		})
+
+		It("omits the unknown fields of structured lines", func() {
+			buf = bytes.NewBuffer(nil)
+			logger.SetOutput(buf)
+			logger.SetReqEncoding(logger.RequestLoggingEncodingLogfmt)
+			logger.SetExcludePaths(nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			req.Header.Del("User-Agent")
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{RequestID: "ping"})
+			NewRequestLogger()(testUpstreamHandler("")).ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(buf.String()).To(MatchRegexp(`^timestamp=\S+ client=192\.0\.2\.1:1234 requestId=ping host=example\.com method=GET uri=/ping ` +
+				`protocol=HTTP/1\.1 userAgent="" status=200 requestSize=0 responseSize=4 duration=\S+\n$`))
+		})
+	})
 })
@@ -2,18 +2,32 @@ package middleware
 
 import (
 	"net/http"
+	"regexp"
 
 	"github.com/google/uuid"
 	"github.com/justinas/alice"
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 )
 
-func NewScope(reverseProxy bool, idHeader string) alice.Constructor {
+// requestIDRegex limits incoming request IDs to a safe character set and
+// length, so that they can't be used to inject content into logs or headers.
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:;=+/-]{1,128}$`)
+
+// NewScope creates a new request scope for each request.
+// The request ID is adopted from the idHeader when trustRequestID returns true
+// for the request, and is forwarded on in the same header.
+func NewScope(reverseProxy bool, idHeader string, trustRequestID func(*http.Request) bool) alice.Constructor {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			scope := &middlewareapi.RequestScope{
 				ReverseProxy: reverseProxy,
-				RequestID:    genRequestID(req, idHeader),
+				RequestID:    genRequestID(req, idHeader, trustRequestID),
+			}
+			if idHeader != "" {
+				if req.Header == nil {
+					req.Header = http.Header{}
+				}
+				req.Header.Set(idHeader, scope.RequestID)
 			}
 			req = middlewareapi.AddRequestScope(req, scope)
 			next.ServeHTTP(rw, req)
@@ -22,11 +36,14 @@ func NewScope(reverseProxy bool, idHeader string) alice.Constructor {
 }
 
 // genRequestID sets a request-wide ID for use in logging or error pages.
-// If a RequestID header is set, it uses that. Otherwise, it generates a random
-// UUID for the lifespan of the request.
-func genRequestID(req *http.Request, idHeader string) string {
+// If a RequestID header is set by a trusted peer and is well formed, it uses
+// that. Otherwise, it generates a random UUID for the lifespan of the request.
+func genRequestID(req *http.Request, idHeader string, trustRequestID func(*http.Request) bool) string {
+	if idHeader == "" || trustRequestID == nil || !trustRequestID(req) {
+		return uuid.New().String()
+	}
 	rid := req.Header.Get(idHeader)
-	if rid != "" {
+	if requestIDRegex.MatchString(rid) {
 		return rid
 	}
 	return uuid.New().String()
@@ -32,7 +32,7 @@ var _ = Describe("Scope Suite", func() {
 
 		Context("ReverseProxy is false", func() {
 			BeforeEach(func() {
-				handler := NewScope(false, testRequestHeader)(
+				handler := NewScope(false, testRequestHeader, trustAllRequestIDs)(
 					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 						nextRequest = r
 						w.WriteHeader(200)
@@ -61,7 +61,7 @@ var _ = Describe("Scope Suite", func() {
 
 		Context("ReverseProxy is true", func() {
 			BeforeEach(func() {
-				handler := NewScope(true, testRequestHeader)(
+				handler := NewScope(true, testRequestHeader, trustAllRequestIDs)(
 					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 						nextRequest = r
 						w.WriteHeader(200)
@@ -79,7 +79,7 @@ var _ = Describe("Scope Suite", func() {
 		Context("Request ID header is present", func() {
 			BeforeEach(func() {
 				request.Header.Add(testRequestHeader, testRequestID)
-				handler := NewScope(false, testRequestHeader)(
+				handler := NewScope(false, testRequestHeader, trustAllRequestIDs)(
 					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 						nextRequest = r
 						w.WriteHeader(200)
@@ -93,11 +93,65 @@ var _ = Describe("Scope Suite", func() {
 			})
 		})
 
+		Context("Request ID header is present from an untrusted peer", func() {
+			BeforeEach(func() {
+				uuid.SetRand(mockRand{})
+
+				request.Header.Add(testRequestHeader, testRequestID)
+				handler := NewScope(false, testRequestHeader, func(*http.Request) bool { return false })(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						nextRequest = r
+						w.WriteHeader(200)
+					}))
+				handler.ServeHTTP(rw, request)
+			})
+
+			AfterEach(func() {
+				uuid.SetRand(nil)
+			})
+
+			It("sets the RequestID using a random UUID", func() {
+				scope := middlewareapi.GetRequestScope(nextRequest)
+				Expect(scope.RequestID).To(Equal(testRandomUUID))
+			})
+
+			It("forwards the generated RequestID in the request header", func() {
+				Expect(nextRequest.Header.Get(testRequestHeader)).To(Equal(testRandomUUID))
+			})
+		})
+
+		Context("Request ID header is malformed", func() {
+			BeforeEach(func() {
+				uuid.SetRand(mockRand{})
+
+				request.Header.Add(testRequestHeader, "bad id\n[injected]")
+				handler := NewScope(false, testRequestHeader, trustAllRequestIDs)(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						nextRequest = r
+						w.WriteHeader(200)
+					}))
+				handler.ServeHTTP(rw, request)
+			})
+
+			AfterEach(func() {
+				uuid.SetRand(nil)
+			})
+
+			It("sets the RequestID using a random UUID", func() {
+				scope := middlewareapi.GetRequestScope(nextRequest)
+				Expect(scope.RequestID).To(Equal(testRandomUUID))
+			})
+
+			It("replaces the malformed request header", func() {
+				Expect(nextRequest.Header.Get(testRequestHeader)).To(Equal(testRandomUUID))
+			})
+		})
+
 		Context("Request ID header is missing", func() {
 			BeforeEach(func() {
 				uuid.SetRand(mockRand{})
 
-				handler := NewScope(true, testRequestHeader)(
+				handler := NewScope(true, testRequestHeader, trustAllRequestIDs)(
 					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 						nextRequest = r
 						w.WriteHeader(200)
@@ -117,6 +171,10 @@ var _ = Describe("Scope Suite", func() {
 	})
 })
 
+func trustAllRequestIDs(*http.Request) bool {
+	return true
+}
+
 type mockRand struct{}
 
 func (mockRand) Read(p []byte) (int, error) {
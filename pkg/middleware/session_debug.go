@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// The debug response headers describing how the session of the request was
+// handled
+const (
+	SessionAgeHeader            = "X-Auth-Session-Age"
+	SessionTokenExpiresInHeader = "X-Auth-Token-Expires-In"
+	SessionRefreshedHeader      = "X-Auth-Refreshed"
+)
+
+// NewSessionDebugHeaders creates a new middleware that adds the age of the
+// session, the seconds until its tokens expire and whether it was refreshed
+// while it was loaded (true, false or failed) to the responses of the handler.
+// The headers are only added for requests whose path matches one of the
+// routes, or any path without routes, and which carry the opt-in header when
+// it is set.
+// The headers never include token material.
+func NewSessionDebugHeaders(opts options.SessionDebug) (alice.Constructor, error) {
+	routes := make([]*regexp.Regexp, 0, len(opts.HeaderRoutes))
+	for _, route := range opts.HeaderRoutes {
+		compiled, err := regexp.Compile(route)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling session debug header route /%s/: %v", route, err)
+		}
+		routes = append(routes, compiled)
+	}
+
+	enabled := func(req *http.Request) bool {
+		if opts.OptInHeader != "" && req.Header.Get(opts.OptInHeader) == "" {
+			return false
+		}
+		if len(routes) == 0 {
+			return true
+		}
+		for _, route := range routes {
+			if route.MatchString(req.URL.Path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope := middlewareapi.GetRequestScope(req)
+			if scope != nil && scope.Session != nil && enabled(req) {
+				addSessionDebugHeaders(rw.Header(), scope)
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// addSessionDebugHeaders sets the session debug headers from the session of
+// the request scope
+func addSessionDebugHeaders(header http.Header, scope *middlewareapi.RequestScope) {
+	session := scope.Session
+	if session.CreatedAt != nil && !session.CreatedAt.IsZero() {
+		header.Set(SessionAgeHeader, strconv.FormatInt(int64(session.Age()/time.Second), 10))
+	}
+	if expiresIn, ok := tokenExpiresIn(session); ok {
+		header.Set(SessionTokenExpiresInHeader, strconv.FormatInt(int64(expiresIn/time.Second), 10))
+	}
+
+	switch {
+	case scope.SessionRefreshFailed:
+		header.Set(SessionRefreshedHeader, "failed")
+	case scope.SessionRefreshed:
+		header.Set(SessionRefreshedHeader, "true")
+	default:
+		header.Set(SessionRefreshedHeader, "false")
+	}
+}
+
+// tokenExpiresIn returns the time until the tokens of the session expire, or
+// false when their expiry isn't known
+func tokenExpiresIn(session *sessionsapi.SessionState) (time.Duration, bool) {
+	if session.ExpiresOn == nil || session.ExpiresOn.IsZero() {
+		return 0, false
+	}
+	expiresIn := session.ExpiresOn.Sub(session.Clock.Now())
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	return expiresIn, true
+}
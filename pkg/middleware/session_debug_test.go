@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Debug Headers Suite", func() {
+	type sessionDebugHeadersTableInput struct {
+		opts           options.SessionDebug
+		path           string
+		requestHeaders map[string]string
+		noSession      bool
+		scope          middlewareapi.RequestScope
+		expected       map[string]string
+	}
+
+	now := time.Unix(1700000000, 0)
+	createdAt := now.Add(-90 * time.Second)
+	expiresOn := now.Add(10 * time.Minute)
+
+	noHeaders := map[string]string{
+		SessionAgeHeader:            "",
+		SessionTokenExpiresInHeader: "",
+		SessionRefreshedHeader:      "",
+	}
+
+	DescribeTable("adds the session debug headers",
+		func(in sessionDebugHeadersTableInput) {
+			scope := in.scope
+			if !in.noSession && scope.Session == nil {
+				scope.Session = &sessionsapi.SessionState{
+					AccessToken: "access-token",
+					CreatedAt:   &createdAt,
+					ExpiresOn:   &expiresOn,
+				}
+			}
+			if scope.Session != nil {
+				scope.Session.Clock.Set(now)
+			}
+
+			path := in.path
+			if path == "" {
+				path = "/"
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			for name, value := range in.requestHeaders {
+				req.Header.Set(name, value)
+			}
+			req = middlewareapi.AddRequestScope(req, &scope)
+
+			debugHeaders, err := NewSessionDebugHeaders(in.opts)
+			Expect(err).ToNot(HaveOccurred())
+			rw := httptest.NewRecorder()
+			debugHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})).ServeHTTP(rw, req)
+
+			for name, value := range in.expected {
+				Expect(rw.Header().Get(name)).To(Equal(value), name)
+			}
+			for _, values := range rw.Header() {
+				for _, value := range values {
+					Expect(value).ToNot(ContainSubstring("access-token"))
+				}
+			}
+		},
+		Entry("for a session that wasn't refreshed", sessionDebugHeadersTableInput{
+			opts: options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			expected: map[string]string{
+				SessionAgeHeader:            "90",
+				SessionTokenExpiresInHeader: "600",
+				SessionRefreshedHeader:      "false",
+			},
+		}),
+		Entry("for a refreshed session", sessionDebugHeadersTableInput{
+			opts:  options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			scope: middlewareapi.RequestScope{SessionRefreshed: true},
+			expected: map[string]string{
+				SessionAgeHeader:            "90",
+				SessionTokenExpiresInHeader: "600",
+				SessionRefreshedHeader:      "true",
+			},
+		}),
+		Entry("for a session that failed to refresh", sessionDebugHeadersTableInput{
+			opts:  options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			scope: middlewareapi.RequestScope{SessionRefreshFailed: true},
+			expected: map[string]string{
+				SessionRefreshedHeader: "failed",
+			},
+		}),
+		Entry("with expired tokens", sessionDebugHeadersTableInput{
+			opts: options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			scope: middlewareapi.RequestScope{Session: &sessionsapi.SessionState{
+				CreatedAt: &createdAt,
+				ExpiresOn: &createdAt,
+			}},
+			expected: map[string]string{
+				SessionAgeHeader:            "90",
+				SessionTokenExpiresInHeader: "0",
+			},
+		}),
+		Entry("without the age and expiry of a session that doesn't have them", sessionDebugHeadersTableInput{
+			opts:  options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			scope: middlewareapi.RequestScope{Session: &sessionsapi.SessionState{}},
+			expected: map[string]string{
+				SessionAgeHeader:            "",
+				SessionTokenExpiresInHeader: "",
+				SessionRefreshedHeader:      "false",
+			},
+		}),
+		Entry("but not for a path that doesn't match the routes", sessionDebugHeadersTableInput{
+			opts:     options.SessionDebug{HeaderRoutes: []string{"^/api/"}},
+			path:     "/app",
+			expected: noHeaders,
+		}),
+		Entry("for a path that matches one of the routes", sessionDebugHeadersTableInput{
+			opts: options.SessionDebug{HeaderRoutes: []string{"^/api/", "^/app"}},
+			path: "/app",
+			expected: map[string]string{
+				SessionRefreshedHeader: "false",
+			},
+		}),
+		Entry("for a request carrying the opt-in header", sessionDebugHeadersTableInput{
+			opts:           options.SessionDebug{OptInHeader: "X-Debug-Session"},
+			requestHeaders: map[string]string{"X-Debug-Session": "1"},
+			expected: map[string]string{
+				SessionRefreshedHeader: "false",
+			},
+		}),
+		Entry("but not for a request without the opt-in header", sessionDebugHeadersTableInput{
+			opts:     options.SessionDebug{OptInHeader: "X-Debug-Session"},
+			expected: noHeaders,
+		}),
+		Entry("but not for a request with the opt-in header outside the routes", sessionDebugHeadersTableInput{
+			opts:           options.SessionDebug{HeaderRoutes: []string{"^/api/"}, OptInHeader: "X-Debug-Session"},
+			path:           "/app",
+			requestHeaders: map[string]string{"X-Debug-Session": "1"},
+			expected:       noHeaders,
+		}),
+		Entry("but not without a session", sessionDebugHeadersTableInput{
+			opts:      options.SessionDebug{HeaderRoutes: []string{"^/"}},
+			noSession: true,
+			expected:  noHeaders,
+		}),
+	)
+
+	It("fails with an invalid route", func() {
+		_, err := NewSessionDebugHeaders(options.SessionDebug{HeaderRoutes: []string{"^/api/("}})
+		Expect(err).To(MatchError("error compiling session debug header route /^/api/(/: error parsing regexp: missing closing ): `^/api/(`"))
+	})
+})
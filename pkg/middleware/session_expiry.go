@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// SessionExpiresInHeader is the response header with the number of seconds
+// until the session lapses
+const SessionExpiresInHeader = "X-Auth-Expires-In"
+
+// NewSessionExpiryHeader creates a new middleware that adds the seconds until
+// the session lapses, at the end of its lifetime, to the text/html responses
+// of the handler, so that pages can warn users before they lose unsaved
+// work.
+// Other responses, such as those of API calls, are left unchanged.
+func NewSessionExpiryHeader(lifetime time.Duration) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope := middlewareapi.GetRequestScope(req)
+			if scope == nil || scope.Session == nil {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			next.ServeHTTP(&expiryResponse{
+				Wrapper:  responsewriter.Wrapper{ResponseWriter: rw},
+				session:  scope.Session,
+				lifetime: lifetime,
+			}, req)
+		})
+	}
+}
+
+// expiryResponse is a custom http.ResponseWriter that adds the session expiry
+// header to text/html responses before they are started
+type expiryResponse struct {
+	responsewriter.Wrapper
+
+	session  *sessionsapi.SessionState
+	lifetime time.Duration
+	started  bool
+}
+
+// addHeader adds the expiry header when the response is HTML
+func (r *expiryResponse) addHeader() {
+	if r.started {
+		return
+	}
+	r.started = true
+
+	header := r.ResponseWriter.Header()
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return
+	}
+	expiresOn := r.session.LifetimeExpiresOn(r.lifetime)
+	if expiresOn == nil {
+		return
+	}
+	expiresIn := expiresOn.Sub(r.session.Clock.Now()) / time.Second
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	header.Set(SessionExpiresInHeader, strconv.FormatInt(int64(expiresIn), 10))
+}
+
+// Write writes the response using the ResponseWriter
+func (r *expiryResponse) Write(b []byte) (int, error) {
+	r.addHeader()
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteHeader writes the status code for the Response
+func (r *expiryResponse) WriteHeader(s int) {
+	r.addHeader()
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *expiryResponse) Flush() {
+	r.addHeader()
+	r.Wrapper.Flush()
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Expiry Header Suite", func() {
+	DescribeTable("adds the seconds until the session lapses",
+		func(contentType string, session func(now time.Time) *sessionsapi.SessionState, expected string) {
+			now := time.Unix(1700000000, 0)
+			var ss *sessionsapi.SessionState
+			if session != nil {
+				ss = session(now)
+				ss.Clock.Set(now)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: ss})
+			rw := httptest.NewRecorder()
+			NewSessionExpiryHeader(time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if contentType != "" {
+					w.Header().Set("Content-Type", contentType)
+				}
+				_, _ = w.Write([]byte("body"))
+			})).ServeHTTP(rw, req)
+
+			Expect(rw.Header().Get(SessionExpiresInHeader)).To(Equal(expected))
+			Expect(rw.Body.String()).To(Equal("body"))
+		},
+		Entry("to an HTML response", "text/html; charset=utf-8", func(now time.Time) *sessionsapi.SessionState {
+			createdAt := now.Add(-50 * time.Minute)
+			return &sessionsapi.SessionState{CreatedAt: &createdAt}
+		}, "600"),
+		Entry("of 0 to an HTML response of a lapsed session", "text/html", func(now time.Time) *sessionsapi.SessionState {
+			createdAt := now.Add(-2 * time.Hour)
+			return &sessionsapi.SessionState{CreatedAt: &createdAt}
+		}, "0"),
+		Entry("but not to a JSON response", "application/json", func(now time.Time) *sessionsapi.SessionState {
+			createdAt := now.Add(-50 * time.Minute)
+			return &sessionsapi.SessionState{CreatedAt: &createdAt}
+		}, ""),
+		Entry("but not to a response without a content type", "", func(now time.Time) *sessionsapi.SessionState {
+			createdAt := now.Add(-50 * time.Minute)
+			return &sessionsapi.SessionState{CreatedAt: &createdAt}
+		}, ""),
+		Entry("but not without a session", "text/html", nil, ""),
+		Entry("but not for a session without a creation time", "text/html", func(now time.Time) *sessionsapi.SessionState {
+			return &sessionsapi.SessionState{}
+		}, ""),
+	)
+})
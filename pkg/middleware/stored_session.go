@@ -2,15 +2,20 @@ package middleware
 
 import (
 	"context"
+	"crypto/aes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"time"
 
 	"github.com/justinas/alice"
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
 )
 
@@ -29,8 +34,21 @@ const (
 	// How long to wait after failing to obtain the lock before trying again.
 	// TODO: This should probably be configurable by the end user.
 	sessionRefreshRetryPeriod = 10 * time.Millisecond
+
+	// Maximum time allowed for the provider to refresh the session.
+	// The refresh is also abandoned if the request is cancelled.
+	sessionRefreshProviderTimeout = 5 * time.Second
+
+	// Maximum time allowed to save a refreshed session and release its lock.
+	// These are completed even if the request is cancelled, so that a refresh
+	// token rotated by the provider isn't lost.
+	sessionRefreshSaveTimeout = 5 * time.Second
 )
 
+// ErrSessionNotRefreshed is returned by a SessionRefresher when the provider
+// was unable to refresh the session, eg. because it has no refresh token.
+var ErrSessionNotRefreshed = errors.New("session could not be refreshed by the provider")
+
 // StoredSessionLoaderOptions contains all of the requirements to construct
 // a stored session loader.
 // All options must be provided.
@@ -41,6 +59,15 @@ type StoredSessionLoaderOptions struct {
 	// How often should sessions be refreshed
 	RefreshPeriod time.Duration
 
+	// The percentage the refresh period of each session is shortened by at
+	// most, so that sessions created at the same time are refreshed at
+	// different times
+	RefreshJitter int
+
+	// Sessions whose tokens expire within the refresh window are refreshed
+	// before the refresh period has passed
+	RefreshWindow time.Duration
+
 	// Provider based session refreshing
 	RefreshSession func(context.Context, *sessionsapi.SessionState) (bool, error)
 
@@ -48,6 +75,21 @@ type StoredSessionLoaderOptions struct {
 	// If the sesssion is older than `RefreshPeriod` but the provider doesn't
 	// refresh it, we must re-validate using this validation.
 	ValidateSession func(context.Context, *sessionsapi.SessionState) bool
+
+	// DegradeOnStoreUnavailable keeps the session cookie when the session
+	// store is unavailable, marking the request scope instead so that the
+	// request can be served according to the session store unavailable policy.
+	DegradeOnStoreUnavailable bool
+
+	// RefreshFailed is called when a session loaded for a request could not
+	// be refreshed, before the session is validated.
+	// Optional.
+	RefreshFailed func(*http.Request, *sessionsapi.SessionState, error)
+
+	// Refreshed is called when a session loaded for a request was refreshed
+	// by the provider and saved, before the session is validated.
+	// Optional.
+	Refreshed func(*http.Request, *sessionsapi.SessionState)
 }
 
 // NewStoredSessionLoader creates a new storedSessionLoader which loads
@@ -55,13 +97,41 @@ type StoredSessionLoaderOptions struct {
 // If no session is found, the request will be passed to the nex handler.
 // If a session was loader by a previous handler, it will not be replaced.
 func NewStoredSessionLoader(opts *StoredSessionLoaderOptions) alice.Constructor {
+	ss := &storedSessionLoader{
+		store:                     opts.SessionStore,
+		refreshPeriod:             opts.RefreshPeriod,
+		refreshJitter:             opts.RefreshJitter,
+		refreshWindow:             opts.RefreshWindow,
+		sessionRefresher:          opts.RefreshSession,
+		sessionValidator:          opts.ValidateSession,
+		degradeOnStoreUnavailable: opts.DegradeOnStoreUnavailable,
+		refreshFailed:             opts.RefreshFailed,
+		refreshed:                 opts.Refreshed,
+		refreshes:                 newRefreshCoordinator(),
+	}
+	return ss.loadSession
+}
+
+// SessionRefresher forces a refresh of an already loaded session.
+type SessionRefresher func(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error
+
+// NewStoredSessionRefresher creates a SessionRefresher which refreshes
+// sessions with the provider, regardless of the refresh period, and saves
+// them back to the session store.
+// The refresh honours the session lock so that concurrent requests do not
+// refresh the same session multiple times.
+// ErrSessionNotRefreshed is returned when the provider could not refresh the
+// session.
+func NewStoredSessionRefresher(opts *StoredSessionLoaderOptions) SessionRefresher {
 	ss := &storedSessionLoader{
 		store:            opts.SessionStore,
 		refreshPeriod:    opts.RefreshPeriod,
+		refreshJitter:    opts.RefreshJitter,
+		refreshWindow:    opts.RefreshWindow,
 		sessionRefresher: opts.RefreshSession,
 		sessionValidator: opts.ValidateSession,
 	}
-	return ss.loadSession
+	return ss.forceRefresh
 }
 
 // storedSessionLoader is responsible for loading sessions from cookie
@@ -69,8 +139,17 @@ func NewStoredSessionLoader(opts *StoredSessionLoaderOptions) alice.Constructor
 type storedSessionLoader struct {
 	store            sessionsapi.SessionStore
 	refreshPeriod    time.Duration
+	refreshJitter    int
+	refreshWindow    time.Duration
 	sessionRefresher func(context.Context, *sessionsapi.SessionState) (bool, error)
 	sessionValidator func(context.Context, *sessionsapi.SessionState) bool
+
+	degradeOnStoreUnavailable bool
+	refreshFailed             func(*http.Request, *sessionsapi.SessionState, error)
+	refreshed                 func(*http.Request, *sessionsapi.SessionState)
+
+	// refreshes coalesces the concurrent refreshes of the same session, if set
+	refreshes *refreshCoordinator
 }
 
 // loadSession attempts to load a session as identified by the request cookies.
@@ -87,14 +166,36 @@ func (s *storedSessionLoader) loadSession(next http.Handler) http.Handler {
 			return
 		}
 
-		session, err := s.getValidatedSession(rw, req)
+		session, err := s.traceValidatedSession(rw, req)
+		var unavailableErr *sessionsapi.StoreUnavailableError
+		if s.degradeOnStoreUnavailable && errors.As(err, &unavailableErr) {
+			// The session may still be valid, so the cookie is kept for when
+			// the store recovers
+			logger.ErrorfContext(req.Context(), "Session store unavailable: %v", err)
+			scope.SessionStoreUnavailable = true
+			next.ServeHTTP(rw, req)
+			return
+		}
 		if err != nil && !errors.Is(err, http.ErrNoCookie) {
-			// In the case when there was an error loading the session,
-			// we should clear the session
-			logger.Errorf("Error loading cookied session: %v, removing session", err)
-			err = s.store.Clear(rw, req)
-			if err != nil {
-				logger.Errorf("Error removing session: %v", err)
+			if req.Context().Err() != nil {
+				// The request was cancelled before the session could be loaded
+				// and validated, this doesn't mean the session is invalid
+				logger.ErrorfContext(req.Context(), "Error loading cookied session for cancelled request: %v", err)
+			} else {
+				// In the case when there was an error loading the session,
+				// we should clear the session
+				if class := sessionDecodeFailure(err); class != "" {
+					// A stale or corrupted cookie isn't an error of the proxy,
+					// eg. the cookie secret has been rotated
+					logger.PrintfContext(req.Context(), "Session cookie could not be decoded (%s): %v, removing session", class, err)
+					scope.SessionReset = true
+				} else {
+					logger.ErrorfContext(req.Context(), "Error loading cookied session: %v, removing session", err)
+				}
+				err = s.store.Clear(rw, req)
+				if err != nil {
+					logger.ErrorfContext(req.Context(), "Error removing session: %v", err)
+				}
 			}
 		}
 
@@ -104,6 +205,45 @@ func (s *storedSessionLoader) loadSession(next http.Handler) http.Handler {
 	})
 }
 
+// sessionDecodeFailure classifies errors loading a session from a cookie that
+// could not be validated or decoded.
+// An empty string is returned for any other error.
+func sessionDecodeFailure(err error) string {
+	var keySizeErr aes.KeySizeError
+	var base64Err base64.CorruptInputError
+	var decodeErr *sessionsapi.DecodeError
+	switch {
+	case errors.Is(err, encryption.ErrInvalidSignature):
+		return "bad signature"
+	case errors.Is(err, encryption.ErrMalformedCookie):
+		return "malformed cookie"
+	case errors.Is(err, encryption.ErrExpiredCookie):
+		return "expired cookie"
+	case errors.As(err, &keySizeErr):
+		return "wrong key size"
+	case errors.Is(err, encryption.ErrCorruptBase64), errors.As(err, &base64Err):
+		return "corrupt base64"
+	case errors.As(err, &decodeErr):
+		return "undecryptable session"
+	}
+	return ""
+}
+
+// traceValidatedSession loads and validates the session in the session load
+// span of the request's trace.
+// Requests without a session cookie aren't errors of the span.
+func (s *storedSessionLoader) traceValidatedSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "session.load")
+	session, err := s.getValidatedSession(rw, req.WithContext(ctx))
+	span.SetAttributes(tracing.SessionFoundKey.Bool(session != nil))
+	if errors.Is(err, http.ErrNoCookie) {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+	return session, err
+}
+
 // getValidatedSession is responsible for loading a session and making sure
 // that is is valid.
 func (s *storedSessionLoader) getValidatedSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
@@ -112,6 +252,7 @@ func (s *storedSessionLoader) getValidatedSession(rw http.ResponseWriter, req *h
 		// No session was found in the storage or error occurred, nothing more to do
 		return nil, err
 	}
+	logger.DebugfContext(req.Context(), "Loaded session - User: %s; SessionAge: %s", session.User, session.Age())
 
 	err = s.refreshSessionIfNeeded(rw, req, session)
 	if err != nil {
@@ -123,23 +264,173 @@ func (s *storedSessionLoader) getValidatedSession(rw http.ResponseWriter, req *h
 
 // refreshSessionIfNeeded will attempt to refresh a session if the session
 // is older than the refresh period.
+// Concurrent requests with the same session wait for one of them to refresh
+// it, and use the refreshed session.
 // Success or fail, we will then validate the session.
 func (s *storedSessionLoader) refreshSessionIfNeeded(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
-	if !needsRefresh(s.refreshPeriod, session) {
+	if !s.needsRefresh(session) {
 		// Refresh is disabled or the session is not old enough, do nothing
+		logger.DebugfContext(req.Context(), "Session doesn't need refreshing - User: %s; SessionAge: %s", session.User, session.Age())
+		return nil
+	}
+
+	if s.refreshes == nil {
+		return s.refreshSessionUnderLock(rw, req, session)
+	}
+
+	result, shared := s.refreshes.do(req.Context(), session, func() refreshResult {
+		err := s.refreshSessionUnderLock(rw, req, session)
+		refreshed := *session
+		result := refreshResult{
+			session:   &refreshed,
+			cancelled: req.Context().Err() != nil,
+			err:       err,
+		}
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			result.refreshFailed = scope.SessionRefreshFailed
+		}
+		return result
+	})
+	if !shared {
+		return result.err
+	}
+	if result.err != nil && !result.cancelled {
+		return result.err
+	}
+	if result.cancelled || result.session == nil {
+		// The request refreshing the session didn't complete the refresh
+		return s.refreshSessionUnderLock(rw, req, session)
+	}
+	return s.useRefreshedSession(rw, req, session, result)
+}
+
+// useRefreshedSession restores the session refreshed by a concurrent request
+// into the session of the request, saving it so that a session stored in the
+// cookie of the request is updated too.
+// The refreshed session was already validated by the request that refreshed
+// it.
+func (s *storedSessionLoader) useRefreshedSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, result refreshResult) error {
+	loadedCreatedAt := session.CreatedAt
+	lock := session.Lock
+	*session = *result.session
+	session.Lock = lock
+	logger.DebugfContext(req.Context(), "Session was refreshed by a concurrent request - User: %s; SessionAge: %s", session.User, session.Age())
+
+	if result.refreshFailed {
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			scope.SessionRefreshFailed = true
+		}
+	}
+	if !isNewerSession(session, loadedCreatedAt) {
 		return nil
 	}
+	return s.saveSession(rw, req, session)
+}
+
+// refreshSessionUnderLock refreshes the session while holding the session
+// lock, unless it was refreshed by another request while waiting for the lock.
+func (s *storedSessionLoader) refreshSessionUnderLock(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+	loadedCreatedAt := session.CreatedAt
+
+	if err := s.obtainSessionLock(req, session); err != nil {
+		return err
+	}
+
+	// The rest of this function is carried out under lock, but we must release it
+	// wherever we exit from this function.
+	defer s.releaseSessionLock(req, session)
+
+	if err := s.reloadSession(req, session); err != nil {
+		return err
+	}
+
+	if !s.needsRefresh(session) {
+		// The session must have already been refreshed while we were waiting to
+		// obtain the lock.
+		logger.DebugfContext(req.Context(), "Session was refreshed by another request - User: %s; SessionAge: %s", session.User, session.Age())
+		if isNewerSession(session, loadedCreatedAt) {
+			// Sessions stored in cookies are only refreshed in the cookie of
+			// the request that refreshed them
+			return s.saveSession(rw, req, session)
+		}
+		return nil
+	}
+
+	// We are holding the lock and the session needs a refresh
+	logger.PrintfContext(req.Context(), "Refreshing session - User: %s; SessionAge: %s", session.User, session.Age())
+	if err := s.refreshSession(rw, req, session); err != nil {
+		// If a preemptive refresh fails, we still keep the session
+		// if validateSession succeeds.
+		logger.ErrorfContext(req.Context(), "Unable to refresh session: %v", err)
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			scope.SessionRefreshFailed = true
+		}
+		if s.refreshFailed != nil {
+			s.refreshFailed(req, session, err)
+		}
+	}
+
+	// Validate all sessions after any Redeem/Refresh operation (fail or success)
+	return s.validateSession(req.Context(), session)
+}
+
+// forceRefresh refreshes the session with the provider regardless of the
+// refresh period.
+// The refresh is carried out under the session lock, if another request
+// refreshed the session while we were waiting for the lock, the session is
+// not refreshed again.
+func (s *storedSessionLoader) forceRefresh(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+	var loadedCreatedAt time.Time
+	if session.CreatedAt != nil {
+		loadedCreatedAt = *session.CreatedAt
+	}
+
+	if err := s.obtainSessionLock(req, session); err != nil {
+		return err
+	}
+	defer s.releaseSessionLock(req, session)
 
-	var lockObtained bool
-	ctx, cancel := context.WithTimeout(context.Background(), sessionRefreshObtainTimeout)
+	if err := s.reloadSession(req, session); err != nil {
+		return err
+	}
+
+	if session.CreatedAt != nil && session.CreatedAt.After(loadedCreatedAt) {
+		// The session must have already been refreshed while we were waiting to
+		// obtain the lock.
+		return nil
+	}
+
+	logger.PrintfContext(req.Context(), "Forcing session refresh - User: %s; SessionAge: %s", session.User, session.Age())
+	refreshed, err := s.refreshWithProvider(req, session)
+	if err != nil && !errors.Is(err, providers.ErrNotImplemented) {
+		return fmt.Errorf("error refreshing tokens: %v", err)
+	}
+	if !refreshed || errors.Is(err, providers.ErrNotImplemented) {
+		return ErrSessionNotRefreshed
+	}
+
+	if err := s.saveRefreshedSession(rw, req, session); err != nil {
+		return err
+	}
+
+	return s.validateSession(req.Context(), session)
+}
+
+// obtainSessionLock attempts to obtain the session lock until the
+// sessionRefreshObtainTimeout is reached or the request is cancelled.
+func (s *storedSessionLoader) obtainSessionLock(req *http.Request, session *sessionsapi.SessionState) error {
+	ctx, cancel := context.WithTimeout(req.Context(), sessionRefreshObtainTimeout)
 	defer cancel()
 
-	for !lockObtained {
+	for {
 		select {
 		case <-ctx.Done():
+			if req.Context().Err() != nil {
+				return fmt.Errorf("request cancelled while obtaining session lock: %w", req.Context().Err())
+			}
 			return errors.New("timeout obtaining session lock")
 		default:
-			err := session.ObtainLock(req.Context(), sessionRefreshLockDuration)
+			err := session.ObtainLock(ctx, sessionRefreshLockDuration)
 			if err != nil && !errors.Is(err, sessionsapi.ErrLockNotObtained) {
 				return fmt.Errorf("error occurred while trying to obtain lock: %v", err)
 			} else if errors.Is(err, sessionsapi.ErrLockNotObtained) {
@@ -147,22 +438,28 @@ func (s *storedSessionLoader) refreshSessionIfNeeded(rw http.ResponseWriter, req
 				continue
 			}
 			// No error means we obtained the lock
-			lockObtained = true
+			return nil
 		}
 	}
+}
 
-	// The rest of this function is carried out under lock, but we must release it
-	// wherever we exit from this function.
-	defer func() {
-		if session == nil {
-			return
-		}
-		if err := session.ReleaseLock(req.Context()); err != nil {
-			logger.Errorf("unable to release lock: %v", err)
-		}
-	}()
+// releaseSessionLock releases the session lock, logging any error.
+// The lock is released even if the request was cancelled, so that other
+// requests don't have to wait for it to expire.
+func (s *storedSessionLoader) releaseSessionLock(req *http.Request, session *sessionsapi.SessionState) {
+	if session == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withoutCancel(req.Context()), sessionRefreshSaveTimeout)
+	defer cancel()
+	if err := session.ReleaseLock(ctx); err != nil {
+		logger.Errorf("unable to release lock: %v", err)
+	}
+}
 
-	// Reload the session in case it was changed underneath us.
+// reloadSession reloads the session from the store in case it was changed
+// underneath us while we were waiting to obtain the lock.
+func (s *storedSessionLoader) reloadSession(req *http.Request, session *sessionsapi.SessionState) error {
 	freshSession, err := s.store.Load(req)
 	if err != nil {
 		return fmt.Errorf("could not load session: %v", err)
@@ -178,34 +475,57 @@ func (s *storedSessionLoader) refreshSessionIfNeeded(rw http.ResponseWriter, req
 	// Ensure we maintain the session lock after we have refreshed the session.
 	// Loading from the session store creates a new lock in the session.
 	session.Lock = lock
+	return nil
+}
 
-	if !needsRefresh(s.refreshPeriod, session) {
-		// The session must have already been refreshed while we were waiting to
-		// obtain the lock.
-		return nil
+// needsRefresh determines whether we should attempt to refresh a session or not.
+// Sessions are refreshed once they are older than their refresh period, or
+// when their tokens expire within the refresh window.
+func (s *storedSessionLoader) needsRefresh(session *sessionsapi.SessionState) bool {
+	if s.refreshPeriod <= time.Duration(0) {
+		return false
 	}
+	return session.Age() > s.sessionRefreshPeriod(session) || s.expiresWithinRefreshWindow(session)
+}
 
-	// We are holding the lock and the session needs a refresh
-	logger.Printf("Refreshing session - User: %s; SessionAge: %s", session.User, session.Age())
-	if err := s.refreshSession(rw, req, session); err != nil {
-		// If a preemptive refresh fails, we still keep the session
-		// if validateSession succeeds.
-		logger.Errorf("Unable to refresh session: %v", err)
+// sessionRefreshPeriod shortens the refresh period by up to the refresh
+// jitter, so that sessions created at the same time, eg. by a surge of logins,
+// don't all refresh with the provider at the same time.
+// The jitter is derived from the session so that it is the same for every
+// request until the session is refreshed.
+func (s *storedSessionLoader) sessionRefreshPeriod(session *sessionsapi.SessionState) time.Duration {
+	if s.refreshJitter <= 0 {
+		return s.refreshPeriod
 	}
 
-	// Validate all sessions after any Redeem/Refresh operation (fail or success)
-	return s.validateSession(req.Context(), session)
+	h := fnv.New64a()
+	if session.CreatedAt != nil {
+		fmt.Fprintf(h, "%d\x00", session.CreatedAt.UnixNano())
+	}
+	for _, value := range []string{session.AccessToken, session.IDToken, session.RefreshToken, session.Email, session.User} {
+		fmt.Fprintf(h, "%s\x00", value)
+	}
+	fraction := float64(h.Sum64()%10000) / 10000
+	jitter := float64(s.refreshPeriod) * float64(s.refreshJitter) / 100 * fraction
+	return s.refreshPeriod - time.Duration(jitter)
 }
 
-// needsRefresh determines whether we should attempt to refresh a session or not.
-func needsRefresh(refreshPeriod time.Duration, session *sessionsapi.SessionState) bool {
-	return refreshPeriod > time.Duration(0) && session.Age() > refreshPeriod
+// expiresWithinRefreshWindow checks whether the session's tokens expire within
+// the refresh window, and the session hasn't been refreshed since the window
+// began, so that a provider which doesn't extend the expiry isn't asked to
+// refresh the session on every request.
+func (s *storedSessionLoader) expiresWithinRefreshWindow(session *sessionsapi.SessionState) bool {
+	if s.refreshWindow <= time.Duration(0) || session.ExpiresOn == nil || session.ExpiresOn.IsZero() || session.CreatedAt == nil {
+		return false
+	}
+	windowStart := session.ExpiresOn.Add(-s.refreshWindow)
+	return session.Clock.Now().After(windowStart) && session.CreatedAt.Before(windowStart)
 }
 
 // refreshSession attempts to refresh the session with the provider
 // and will save the session if it was updated.
 func (s *storedSessionLoader) refreshSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
-	refreshed, err := s.sessionRefresher(req.Context(), session)
+	refreshed, err := s.refreshWithProvider(req, session)
 	if err != nil && !errors.Is(err, providers.ErrNotImplemented) {
 		return fmt.Errorf("error refreshing tokens: %v", err)
 	}
@@ -225,12 +545,55 @@ func (s *storedSessionLoader) refreshSession(rw http.ResponseWriter, req *http.R
 		return nil
 	}
 
+	if saveErr := s.saveRefreshedSession(rw, req, session); saveErr != nil {
+		return saveErr
+	}
+	// Only sessions the provider actually refreshed are reported as refreshed
+	if err != nil {
+		return nil
+	}
+	if scope := middlewareapi.GetRequestScope(req); scope != nil {
+		scope.SessionRefreshed = true
+	}
+	if s.refreshed != nil {
+		s.refreshed(req, session)
+	}
+	return nil
+}
+
+// refreshWithProvider refreshes the session with the provider, unless the
+// request has already been cancelled, so that the provider's rate limit isn't
+// spent on requests that can't use the refreshed session.
+func (s *storedSessionLoader) refreshWithProvider(req *http.Request, session *sessionsapi.SessionState) (bool, error) {
+	if err := req.Context().Err(); err != nil {
+		return false, fmt.Errorf("request cancelled before refreshing session: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), sessionRefreshProviderTimeout)
+	defer cancel()
+	return s.sessionRefresher(ctx, session)
+}
+
+// saveRefreshedSession resets the refresh timer of a refreshed session and
+// persists it to the session store.
+// The session is saved even if the request was cancelled, as the provider may
+// have rotated the refresh token, making the stored session unusable.
+func (s *storedSessionLoader) saveRefreshedSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
 	// If we refreshed, update the `CreatedAt` time to reset the refresh timer
 	// (In case underlying provider implementations forget)
 	session.CreatedAtNow()
 
 	// Because the session was refreshed, make sure to save it
-	err = s.store.Save(rw, req, session)
+	return s.saveSession(rw, req, session)
+}
+
+// saveSession persists the session to the session store, even if the request
+// was cancelled.
+func (s *storedSessionLoader) saveSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+	ctx, cancel := context.WithTimeout(withoutCancel(req.Context()), sessionRefreshSaveTimeout)
+	defer cancel()
+
+	err := s.store.Save(rw, req.WithContext(ctx), session)
 	if err != nil {
 		logger.PrintAuthf(session.Email, req, logger.AuthError, "error saving session: %v", err)
 		return fmt.Errorf("error saving session: %v", err)
@@ -238,6 +601,15 @@ func (s *storedSessionLoader) refreshSession(rw http.ResponseWriter, req *http.R
 	return nil
 }
 
+// isNewerSession checks whether the session was created after the session
+// loaded for the request, ie. it was refreshed since
+func isNewerSession(session *sessionsapi.SessionState, loadedCreatedAt *time.Time) bool {
+	if session.CreatedAt == nil {
+		return false
+	}
+	return loadedCreatedAt == nil || session.CreatedAt.After(*loadedCreatedAt)
+}
+
 // validateSession checks whether the session has expired and performs
 // provider validation on the session.
 // An error implies the session is not longer valid.
@@ -252,3 +624,23 @@ func (s *storedSessionLoader) validateSession(ctx context.Context, session *sess
 
 	return nil
 }
+
+// withoutCancel returns a context with the values of the parent that isn't
+// cancelled when the parent is, and has no deadline.
+func withoutCancel(parent context.Context) context.Context {
+	return detachedContext{parent: parent}
+}
+
+// detachedContext is a context.Context that keeps the values of its parent,
+// but not its cancellation or deadline.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -2,8 +2,11 @@ package middleware
 
 import (
 	"context"
+	"crypto/aes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -12,10 +15,17 @@ import (
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type testLock struct {
@@ -336,6 +346,43 @@ var _ = Describe("Stored Session Suite", func() {
 			}),
 		)
 
+		DescribeTable("when the session store is unavailable",
+			func(degrade bool, expectCleared bool) {
+				cleared := false
+				store := &fakeSessionStore{
+					LoadFunc: func(*http.Request) (*sessionsapi.SessionState, error) {
+						return nil, &sessionsapi.StoreUnavailableError{Err: errors.New("connection refused")}
+					},
+					ClearFunc: func(http.ResponseWriter, *http.Request) error {
+						cleared = true
+						return nil
+					},
+				}
+
+				req := httptest.NewRequest("", "/", nil)
+				req.Header.Set("Cookie", "_oauth2_proxy=Session")
+				req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+
+				var gotScope *middlewareapi.RequestScope
+				handler := NewStoredSessionLoader(&StoredSessionLoaderOptions{
+					SessionStore:              store,
+					RefreshPeriod:             1 * time.Minute,
+					RefreshSession:            defaultRefreshFunc,
+					ValidateSession:           defaultValidateFunc,
+					DegradeOnStoreUnavailable: degrade,
+				})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					gotScope = middlewareapi.GetRequestScope(r)
+				}))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(gotScope.Session).To(BeNil())
+				Expect(gotScope.SessionStoreUnavailable).To(Equal(degrade))
+				Expect(cleared).To(Equal(expectCleared))
+			},
+			Entry("clears the session when not degrading", false, true),
+			Entry("keeps the session and marks the scope when degrading", true, false),
+		)
+
 		type storedSessionLoaderConcurrentTableInput struct {
 			existingSession *sessionsapi.SessionState
 			refreshPeriod   time.Duration
@@ -436,6 +483,296 @@ var _ = Describe("Stored Session Suite", func() {
 		)
 	})
 
+	Context("with concurrent requests with the same session cookie", func() {
+		It("refreshes the session once, saving the refreshed session for each request", func() {
+			const numReqs = 5
+			createdPast := time.Now().Add(-5 * time.Minute)
+
+			var (
+				mu        sync.Mutex
+				refreshes int
+				saved     []string
+			)
+			loads := make(chan struct{}, 2*numReqs+1)
+			release := make(chan struct{})
+
+			// The sessions are kept in the cookie of each request, without a
+			// lock shared between the requests
+			store := &fakeSessionStore{
+				LoadFunc: func(_ *http.Request) (*sessionsapi.SessionState, error) {
+					loads <- struct{}{}
+					return &sessionsapi.SessionState{
+						RefreshToken: refresh,
+						CreatedAt:    &createdPast,
+					}, nil
+				},
+				SaveFunc: func(_ http.ResponseWriter, _ *http.Request, session *sessionsapi.SessionState) error {
+					mu.Lock()
+					defer mu.Unlock()
+					saved = append(saved, session.RefreshToken)
+					return nil
+				},
+			}
+			opts := &StoredSessionLoaderOptions{
+				SessionStore:  store,
+				RefreshPeriod: 1 * time.Minute,
+				RefreshSession: func(_ context.Context, ss *sessionsapi.SessionState) (bool, error) {
+					mu.Lock()
+					refreshes++
+					mu.Unlock()
+					<-release
+					ss.RefreshToken = refreshed
+					return true, nil
+				},
+				ValidateSession: func(context.Context, *sessionsapi.SessionState) bool {
+					return true
+				},
+			}
+
+			sessions := make(chan *sessionsapi.SessionState, numReqs)
+			handler := NewStoredSessionLoader(opts)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				sessions <- middlewareapi.GetRequestScope(r).Session
+			}))
+			for i := 0; i < numReqs; i++ {
+				go func() {
+					req := httptest.NewRequest("", "/", nil)
+					req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+					handler.ServeHTTP(httptest.NewRecorder(), req)
+				}()
+			}
+
+			// Each request loads its session, and the refreshing request
+			// reloads it under lock
+			for i := 0; i < numReqs+1; i++ {
+				Eventually(loads).Should(Receive())
+			}
+			// Give the other requests the time to wait for the refresh
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+
+			for i := 0; i < numReqs; i++ {
+				var session *sessionsapi.SessionState
+				Eventually(sessions).Should(Receive(&session))
+				Expect(session).ToNot(BeNil())
+				Expect(session.RefreshToken).To(Equal(refreshed))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(refreshes).To(Equal(1))
+			Expect(saved).To(ConsistOf(refreshed, refreshed, refreshed, refreshed, refreshed))
+		})
+	})
+
+	Context("with a cancelled request", func() {
+		var (
+			storedSession  *sessionsapi.SessionState
+			lock           *testLock
+			providerCalled bool
+			cleared        bool
+			store          *fakeSessionStore
+		)
+
+		BeforeEach(func() {
+			createdPast := time.Now().Add(-5 * time.Minute)
+			createdFuture := time.Now().Add(5 * time.Minute)
+			storedSession = &sessionsapi.SessionState{
+				RefreshToken: refresh,
+				CreatedAt:    &createdPast,
+				ExpiresOn:    &createdFuture,
+			}
+			lock = &testLock{}
+			providerCalled = false
+			cleared = false
+
+			store = &fakeSessionStore{
+				LoadFunc: func(req *http.Request) (*sessionsapi.SessionState, error) {
+					session := *storedSession
+					session.Lock = lock
+					return &session, nil
+				},
+				SaveFunc: func(_ http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+					// A cancelled context would abort saving to a real store
+					if err := req.Context().Err(); err != nil {
+						return err
+					}
+					saved := *session
+					storedSession = &saved
+					return nil
+				},
+				ClearFunc: func(_ http.ResponseWriter, _ *http.Request) error {
+					cleared = true
+					return nil
+				},
+			}
+		})
+
+		// serveRequest serves a request that needs a refresh, the request
+		// can be cancelled by the setup function or the provider refresh
+		serveRequest := func(setup func(cancel context.CancelFunc), refreshSession func(context.Context, context.CancelFunc, *sessionsapi.SessionState) (bool, error)) *sessionsapi.SessionState {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			setup(cancel)
+
+			req := httptest.NewRequest("", "/", nil).WithContext(ctx)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+
+			opts := &StoredSessionLoaderOptions{
+				SessionStore:  store,
+				RefreshPeriod: 1 * time.Minute,
+				RefreshSession: func(ctx context.Context, ss *sessionsapi.SessionState) (bool, error) {
+					providerCalled = true
+					return refreshSession(ctx, cancel, ss)
+				},
+				ValidateSession: func(ctx context.Context, _ *sessionsapi.SessionState) bool {
+					// A cancelled context would abort validating with the provider
+					return ctx.Err() == nil
+				},
+			}
+
+			var gotSession *sessionsapi.SessionState
+			handler := NewStoredSessionLoader(opts)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				gotSession = middlewareapi.GetRequestScope(r).Session
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			return gotSession
+		}
+
+		refreshTokens := func(_ context.Context, _ context.CancelFunc, ss *sessionsapi.SessionState) (bool, error) {
+			ss.RefreshToken = refreshed
+			return true, nil
+		}
+
+		It("doesn't refresh or remove the session when cancelled before the refresh", func() {
+			session := serveRequest(func(cancel context.CancelFunc) { cancel() }, refreshTokens)
+
+			Expect(session).To(BeNil())
+			Expect(providerCalled).To(BeFalse())
+			Expect(cleared).To(BeFalse())
+			Expect(storedSession.RefreshToken).To(Equal(refresh))
+			Expect(lock.locked).To(BeFalse())
+		})
+
+		It("saves the refreshed session when cancelled during the refresh", func() {
+			session := serveRequest(func(context.CancelFunc) {}, func(ctx context.Context, cancel context.CancelFunc, ss *sessionsapi.SessionState) (bool, error) {
+				// The client disconnects once the provider has rotated the tokens
+				cancel()
+				Expect(ctx.Err()).To(HaveOccurred())
+				return refreshTokens(ctx, cancel, ss)
+			})
+
+			Expect(session).To(BeNil())
+			Expect(providerCalled).To(BeTrue())
+			Expect(cleared).To(BeFalse())
+			Expect(storedSession.RefreshToken).To(Equal(refreshed))
+			Expect(lock.locked).To(BeFalse())
+		})
+
+		It("stops waiting for the session lock when cancelled", func() {
+			lock.obtainOnAttempt = math.MaxInt32
+
+			start := time.Now()
+			session := serveRequest(func(cancel context.CancelFunc) {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}, refreshTokens)
+
+			Expect(time.Since(start)).To(BeNumerically("<", sessionRefreshObtainTimeout))
+			Expect(lock.obtainAttempts).To(BeNumerically(">", 1))
+			Expect(session).To(BeNil())
+			Expect(providerCalled).To(BeFalse())
+			Expect(cleared).To(BeFalse())
+			Expect(storedSession.RefreshToken).To(Equal(refresh))
+		})
+	})
+
+	Context("needsRefresh", func() {
+		type needsRefreshTableInput struct {
+			refreshJitter int
+			refreshWindow time.Duration
+			createdAgo    time.Duration
+			expiresIn     time.Duration
+			expected      bool
+		}
+
+		DescribeTable("with a refresh period of 10 minutes",
+			func(in needsRefreshTableInput) {
+				s := &storedSessionLoader{
+					refreshPeriod: 10 * time.Minute,
+					refreshJitter: in.refreshJitter,
+					refreshWindow: in.refreshWindow,
+				}
+				created := time.Now().Add(-in.createdAgo)
+				session := &sessionsapi.SessionState{CreatedAt: &created, AccessToken: "AccessToken"}
+				if in.expiresIn != 0 {
+					session.SetExpiresOn(time.Now().Add(in.expiresIn))
+				}
+				Expect(s.needsRefresh(session)).To(Equal(in.expected))
+			},
+			Entry("a session younger than the refresh period", needsRefreshTableInput{
+				createdAgo: 5 * time.Minute,
+				expected:   false,
+			}),
+			Entry("a session older than the refresh period", needsRefreshTableInput{
+				createdAgo: 11 * time.Minute,
+				expected:   true,
+			}),
+			Entry("a session younger than the refresh period shortened by the jitter", needsRefreshTableInput{
+				refreshJitter: 30,
+				createdAgo:    6 * time.Minute,
+				expected:      false,
+			}),
+			Entry("a session expiring within the refresh window", needsRefreshTableInput{
+				refreshWindow: 5 * time.Minute,
+				createdAgo:    5 * time.Minute,
+				expiresIn:     2 * time.Minute,
+				expected:      true,
+			}),
+			Entry("a session expiring after the refresh window", needsRefreshTableInput{
+				refreshWindow: 5 * time.Minute,
+				createdAgo:    5 * time.Minute,
+				expiresIn:     10 * time.Minute,
+				expected:      false,
+			}),
+			Entry("a session refreshed within the refresh window", needsRefreshTableInput{
+				refreshWindow: 5 * time.Minute,
+				createdAgo:    1 * time.Minute,
+				expiresIn:     2 * time.Minute,
+				expected:      false,
+			}),
+			Entry("a session expiring soon without a refresh window", needsRefreshTableInput{
+				createdAgo: 5 * time.Minute,
+				expiresIn:  2 * time.Minute,
+				expected:   false,
+			}),
+		)
+
+		It("gives sessions created at the same time different refresh periods", func() {
+			s := &storedSessionLoader{
+				refreshPeriod: 10 * time.Minute,
+				refreshJitter: 20,
+			}
+			created := time.Now()
+			first := &sessionsapi.SessionState{CreatedAt: &created, AccessToken: "FirstAccessToken", RefreshToken: "FirstRefreshToken"}
+			second := &sessionsapi.SessionState{CreatedAt: &created, AccessToken: "SecondAccessToken", RefreshToken: "SecondRefreshToken"}
+
+			firstPeriod := s.sessionRefreshPeriod(first)
+			secondPeriod := s.sessionRefreshPeriod(second)
+			Expect(firstPeriod).ToNot(Equal(secondPeriod))
+			for _, period := range []time.Duration{firstPeriod, secondPeriod} {
+				Expect(period).To(BeNumerically("<=", 10*time.Minute))
+				Expect(period).To(BeNumerically(">=", 8*time.Minute))
+			}
+
+			// The period of a session doesn't change until it is refreshed
+			Expect(s.sessionRefreshPeriod(first)).To(Equal(firstPeriod))
+		})
+
+		It("doesn't shorten the refresh period without a jitter", func() {
+			s := &storedSessionLoader{refreshPeriod: 10 * time.Minute}
+			created := time.Now()
+			Expect(s.sessionRefreshPeriod(&sessionsapi.SessionState{CreatedAt: &created})).To(Equal(10 * time.Minute))
+		})
+	})
+
 	Context("refreshSessionIfNeeded", func() {
 		type refreshSessionIfNeededTableInput struct {
 			refreshPeriod            time.Duration
@@ -445,6 +782,8 @@ var _ = Describe("Stored Session Suite", func() {
 			expectRefreshed          bool
 			expectValidated          bool
 			expectedLockObtained     bool
+			expectRefreshFailed      bool
+			expectScopeRefreshed     bool
 		}
 
 		createdPast := time.Now().Add(-5 * time.Minute)
@@ -454,6 +793,8 @@ var _ = Describe("Stored Session Suite", func() {
 			func(in refreshSessionIfNeededTableInput) {
 				refreshed := false
 				validated := false
+				refreshFailed := false
+				sessionRefreshed := false
 
 				session := &sessionsapi.SessionState{}
 				*session = *in.session
@@ -494,9 +835,17 @@ var _ = Describe("Stored Session Suite", func() {
 						validated = true
 						return ss.AccessToken != "Invalid"
 					},
+					refreshFailed: func(_ *http.Request, _ *sessionsapi.SessionState, err error) {
+						Expect(err).To(MatchError("error refreshing tokens: error refreshing session"))
+						refreshFailed = true
+					},
+					refreshed: func(_ *http.Request, _ *sessionsapi.SessionState) {
+						sessionRefreshed = true
+					},
 				}
 
-				req := httptest.NewRequest("", "/", nil)
+				scope := &middlewareapi.RequestScope{}
+				req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), scope)
 				err := s.refreshSessionIfNeeded(nil, req, in.session)
 				if in.expectedErr != nil {
 					Expect(err).To(MatchError(in.expectedErr))
@@ -505,6 +854,10 @@ var _ = Describe("Stored Session Suite", func() {
 				}
 				Expect(refreshed).To(Equal(in.expectRefreshed))
 				Expect(validated).To(Equal(in.expectValidated))
+				Expect(refreshFailed).To(Equal(in.expectRefreshFailed))
+				Expect(scope.SessionRefreshed).To(Equal(in.expectScopeRefreshed))
+				Expect(sessionRefreshed).To(Equal(in.expectScopeRefreshed))
+				Expect(scope.SessionRefreshFailed).To(Equal(in.expectRefreshFailed))
 				testLock, ok := in.session.Lock.(*testLock)
 				Expect(ok).To(Equal(true))
 
@@ -560,6 +913,7 @@ var _ = Describe("Stored Session Suite", func() {
 				expectRefreshed:      true,
 				expectValidated:      true,
 				expectedLockObtained: true,
+				expectScopeRefreshed: true,
 			}),
 			Entry("when obtaining lock failed, but concurrent request refreshed", refreshSessionIfNeededTableInput{
 				refreshPeriod: 1 * time.Minute,
@@ -629,6 +983,160 @@ var _ = Describe("Stored Session Suite", func() {
 				expectValidated:      true,
 				expectedLockObtained: true,
 			}),
+			Entry("when the provider fails to refresh the session", refreshSessionIfNeededTableInput{
+				refreshPeriod: 1 * time.Minute,
+				session: &sessionsapi.SessionState{
+					RefreshToken: "RefreshError",
+					CreatedAt:    &createdPast,
+					ExpiresOn:    &createdFuture,
+					Lock:         &testLock{},
+				},
+				expectedErr:          nil,
+				expectRefreshed:      true,
+				expectValidated:      true,
+				expectedLockObtained: true,
+				expectRefreshFailed:  true,
+			}),
+		)
+	})
+
+	Context("forceRefresh", func() {
+		type forceRefreshTableInput struct {
+			session                  *sessionsapi.SessionState
+			concurrentSessionRefresh bool
+			expectedErr              error
+			expectRefreshed          bool
+			expectSaved              bool
+		}
+
+		createdPast := time.Now().Add(-5 * time.Minute)
+		createdFuture := time.Now().Add(5 * time.Minute)
+
+		DescribeTable("with a session",
+			func(in forceRefreshTableInput) {
+				refreshed := false
+				saved := false
+
+				session := &sessionsapi.SessionState{}
+				*session = *in.session
+				if in.concurrentSessionRefresh {
+					// Update the session that Load returns.
+					// This simulates a concurrent refresh in the background.
+					session.CreatedAt = &createdFuture
+				}
+				store := &fakeSessionStore{
+					LoadFunc: func(req *http.Request) (*sessionsapi.SessionState, error) {
+						loaded := *session
+						loaded.Lock = &testLock{}
+						return &loaded, nil
+					},
+					SaveFunc: func(_ http.ResponseWriter, _ *http.Request, s *sessionsapi.SessionState) error {
+						saved = true
+						return nil
+					},
+				}
+
+				refresher := NewStoredSessionRefresher(&StoredSessionLoaderOptions{
+					SessionStore:  store,
+					RefreshPeriod: time.Hour,
+					RefreshSession: func(_ context.Context, ss *sessionsapi.SessionState) (bool, error) {
+						refreshed = true
+						switch ss.RefreshToken {
+						case refresh:
+							return true, nil
+						case noRefresh:
+							return false, nil
+						case notImplemented:
+							return false, providers.ErrNotImplemented
+						default:
+							return false, errors.New("error refreshing session")
+						}
+					},
+					ValidateSession: func(_ context.Context, ss *sessionsapi.SessionState) bool {
+						return ss.AccessToken != "Invalid"
+					},
+				})
+
+				req := httptest.NewRequest("", "/", nil)
+				err := refresher(nil, req, in.session)
+				if in.expectedErr != nil {
+					Expect(err).To(MatchError(in.expectedErr))
+				} else {
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(refreshed).To(Equal(in.expectRefreshed))
+				Expect(saved).To(Equal(in.expectSaved))
+
+				testLock, ok := in.session.Lock.(*testLock)
+				Expect(ok).To(Equal(true))
+				Expect(testLock.obtainAttempts).Should(BeNumerically(">", 0), "Expected at least one attempt at obtaining the session lock")
+				Expect(testLock.locked).To(BeFalse(), "Expected lock should always be released")
+			},
+			Entry("when the session is within the refresh period", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					RefreshToken: refresh,
+					CreatedAt:    &createdPast,
+					ExpiresOn:    &createdFuture,
+					Lock:         &testLock{},
+				},
+				expectedErr:     nil,
+				expectRefreshed: true,
+				expectSaved:     true,
+			}),
+			Entry("when a concurrent request refreshed the session", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					RefreshToken: refresh,
+					CreatedAt:    &createdPast,
+					Lock: &testLock{
+						obtainOnAttempt: 4,
+					},
+				},
+				concurrentSessionRefresh: true,
+				expectedErr:              nil,
+				expectRefreshed:          false,
+				expectSaved:              false,
+			}),
+			Entry("when the provider does not refresh the session", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					RefreshToken: noRefresh,
+					CreatedAt:    &createdPast,
+					Lock:         &testLock{},
+				},
+				expectedErr:     ErrSessionNotRefreshed,
+				expectRefreshed: true,
+				expectSaved:     false,
+			}),
+			Entry("when the provider doesn't implement refresh", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					RefreshToken: notImplemented,
+					CreatedAt:    &createdPast,
+					Lock:         &testLock{},
+				},
+				expectedErr:     ErrSessionNotRefreshed,
+				expectRefreshed: true,
+				expectSaved:     false,
+			}),
+			Entry("when the provider returns an error", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					RefreshToken: "RefreshError",
+					CreatedAt:    &createdPast,
+					Lock:         &testLock{},
+				},
+				expectedErr:     errors.New("error refreshing tokens: error refreshing session"),
+				expectRefreshed: true,
+				expectSaved:     false,
+			}),
+			Entry("when the refreshed session is invalid", forceRefreshTableInput{
+				session: &sessionsapi.SessionState{
+					AccessToken:  "Invalid",
+					RefreshToken: refresh,
+					CreatedAt:    &createdPast,
+					Lock:         &testLock{},
+				},
+				expectedErr:     errors.New("session is invalid"),
+				expectRefreshed: true,
+				expectSaved:     true,
+			}),
 		)
 	})
 
@@ -766,6 +1274,127 @@ var _ = Describe("Stored Session Suite", func() {
 			})
 		})
 	})
+
+	Context("when the session cannot be loaded", func() {
+		type loadErrorTableInput struct {
+			loadErr       error
+			expectedClass string
+		}
+
+		DescribeTable("clears the session",
+			func(in loadErrorTableInput) {
+				cleared := false
+				store := &fakeSessionStore{
+					LoadFunc: func(*http.Request) (*sessionsapi.SessionState, error) {
+						return nil, in.loadErr
+					},
+					ClearFunc: func(http.ResponseWriter, *http.Request) error {
+						cleared = true
+						return nil
+					},
+				}
+
+				scope := &middlewareapi.RequestScope{}
+				req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), scope)
+
+				handler := NewStoredSessionLoader(&StoredSessionLoaderOptions{
+					SessionStore: store,
+				})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(cleared).To(BeTrue())
+				Expect(scope.Session).To(BeNil())
+				Expect(sessionDecodeFailure(in.loadErr)).To(Equal(in.expectedClass))
+				Expect(scope.SessionReset).To(Equal(in.expectedClass != ""))
+			},
+			Entry("with a bad signature", loadErrorTableInput{
+				loadErr:       fmt.Errorf("session cookie failed validation: %w", encryption.ErrInvalidSignature),
+				expectedClass: "bad signature",
+			}),
+			Entry("with a malformed cookie", loadErrorTableInput{
+				loadErr:       fmt.Errorf("session cookie failed validation: %w", encryption.ErrMalformedCookie),
+				expectedClass: "malformed cookie",
+			}),
+			Entry("with an expired cookie", loadErrorTableInput{
+				loadErr:       fmt.Errorf("session cookie failed validation: %w", encryption.ErrExpiredCookie),
+				expectedClass: "expired cookie",
+			}),
+			Entry("with a ticket secret of the wrong key size", loadErrorTableInput{
+				loadErr:       fmt.Errorf("failed to make an AES-GCM cipher from the ticket secret: %w", aes.KeySizeError(5)),
+				expectedClass: "wrong key size",
+			}),
+			Entry("with corrupt base64", loadErrorTableInput{
+				loadErr:       fmt.Errorf("session cookie failed validation: %w", fmt.Errorf("%w: %v", encryption.ErrCorruptBase64, base64.CorruptInputError(3))),
+				expectedClass: "corrupt base64",
+			}),
+			Entry("with a session that cannot be decrypted", loadErrorTableInput{
+				loadErr:       &sessionsapi.DecodeError{Err: errors.New("error decrypting the session state: cipher: message authentication failed")},
+				expectedClass: "undecryptable session",
+			}),
+			Entry("with an error from the session store", loadErrorTableInput{
+				loadErr:       errors.New("failed to load the session state with the ticket: connection refused"),
+				expectedClass: "",
+			}),
+		)
+	})
+
+	Context("when tracing", func() {
+		var recorder *tracetest.SpanRecorder
+
+		BeforeEach(func() {
+			recorder = tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		})
+
+		AfterEach(func() {
+			otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		})
+
+		loadSession := func(loadErr error) {
+			store := &fakeSessionStore{
+				LoadFunc: func(*http.Request) (*sessionsapi.SessionState, error) {
+					if loadErr != nil {
+						return nil, loadErr
+					}
+					return &sessionsapi.SessionState{Email: "user@example.com"}, nil
+				},
+			}
+			req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), &middlewareapi.RequestScope{})
+			handler := NewStoredSessionLoader(&StoredSessionLoaderOptions{
+				SessionStore:    store,
+				ValidateSession: func(context.Context, *sessionsapi.SessionState) bool { return true },
+			})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		It("loads the session in a span", func() {
+			loadSession(nil)
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].Name()).To(Equal("session.load"))
+			Expect(spans[0].Attributes()).To(ConsistOf(tracing.SessionFoundKey.Bool(true)))
+			Expect(spans[0].Status().Code).To(Equal(codes.Unset))
+		})
+
+		It("doesn't record requests without a session cookie as errors", func() {
+			loadSession(http.ErrNoCookie)
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].Attributes()).To(ConsistOf(tracing.SessionFoundKey.Bool(false)))
+			Expect(spans[0].Status().Code).To(Equal(codes.Unset))
+		})
+
+		It("records the errors loading the session", func() {
+			loadSession(errors.New("connection refused"))
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].Status().Code).To(Equal(codes.Error))
+			Expect(spans[0].Status().Description).To(Equal("connection refused"))
+		})
+	})
 })
 
 type fakeSessionStore struct {
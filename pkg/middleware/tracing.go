@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracing returns middleware which traces requests in a server span,
+// continuing the trace propagated by the client in the traceparent header,
+// if any.
+// The span is in the context of the request passed to the next handler, so
+// that the spans of the session loaders, the authorization and the upstreams
+// are its children.
+func NewTracing() alice.Constructor {
+	return traceRequest
+}
+
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := tracing.Extract(req.Context(), req.Header)
+		ctx, span := tracing.Tracer().Start(ctx, "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(httpconv.ServerRequest("", req)...),
+			// The query isn't traced, as it may hold tokens
+			trace.WithAttributes(semconv.HTTPTargetKey.String(req.URL.Path)),
+		)
+		defer span.End()
+
+		response := &loggingResponse{ResponseWriter: rw}
+		next.ServeHTTP(response, req.WithContext(ctx))
+
+		// Hijacked connections have no status
+		if status := response.Status(); status != 0 {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+			span.SetStatus(httpconv.ServerStatus(status))
+		}
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			span.SetAttributes(tracing.RequestIDKey.String(scope.RequestID))
+			if scope.Upstream != "" {
+				span.SetAttributes(tracing.UpstreamKey.String(scope.Upstream))
+			}
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Tracing Suite", func() {
+	const (
+		traceID   = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID  = "00f067aa0ba902b7"
+		requestID = "11111111-2222-4333-8444-555555555555"
+	)
+
+	var recorder *tracetest.SpanRecorder
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+
+	AfterEach(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	})
+
+	// serve serves the request through the tracing middleware, with the
+	// response code, returning the headers the handler propagates the trace
+	// context of its request with
+	serve := func(req *http.Request, code int) http.Header {
+		scope := &middlewareapi.RequestScope{RequestID: requestID}
+		req = middlewareapi.AddRequestScope(req, scope)
+		propagated := http.Header{}
+		NewTracing()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope.Upstream = "app"
+			tracing.Inject(req.Context(), propagated)
+			rw.WriteHeader(code)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return propagated
+	}
+
+	It("traces requests in a server span continuing the trace of the client", func() {
+		req := httptest.NewRequest(http.MethodGet, "/app/page", nil)
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+		propagated := serve(req, http.StatusOK)
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(1))
+		span := spans[0]
+		Expect(span.Name()).To(Equal("HTTP GET"))
+		Expect(span.SpanKind()).To(Equal(trace.SpanKindServer))
+		Expect(span.SpanContext().TraceID().String()).To(Equal(traceID))
+		Expect(span.Parent().SpanID().String()).To(Equal(parentID))
+		Expect(span.Parent().IsRemote()).To(BeTrue())
+		Expect(span.Attributes()).To(ContainElements(
+			semconv.HTTPMethodKey.String(http.MethodGet),
+			semconv.HTTPTargetKey.String("/app/page"),
+			semconv.HTTPStatusCodeKey.Int(http.StatusOK),
+			tracing.RequestIDKey.String(requestID),
+			tracing.UpstreamKey.String("app"),
+		))
+		Expect(span.Status().Code).To(Equal(codes.Unset))
+
+		Expect(propagated.Get("traceparent")).To(Equal("00-" + traceID + "-" + span.SpanContext().SpanID().String() + "-01"))
+	})
+
+	It("starts a trace for requests without a trace context", func() {
+		serve(httptest.NewRequest(http.MethodPost, "/app/page", nil), http.StatusBadGateway)
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Parent().IsValid()).To(BeFalse())
+		Expect(spans[0].SpanContext().IsValid()).To(BeTrue())
+		Expect(spans[0].Status().Code).To(Equal(codes.Error))
+	})
+
+	It("propagates the trace context of the client while traces aren't recorded", func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+		req := httptest.NewRequest(http.MethodGet, "/app/page", nil)
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+		propagated := serve(req, http.StatusOK)
+
+		Expect(recorder.Ended()).To(BeEmpty())
+		Expect(propagated.Get("traceparent")).To(Equal("00-" + traceID + "-" + parentID + "-01"))
+	})
+})
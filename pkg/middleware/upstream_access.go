@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// UpstreamAccessFunc records a request proxied to an upstream, with the
+// session of the request, if any, and the status of the response
+type UpstreamAccessFunc func(req *http.Request, session *sessionsapi.SessionState, upstream string, status int)
+
+// NewUpstreamAccessRecorder creates a new middleware that records each
+// request served by an upstream once the upstream has responded.
+// Requests that no upstream served are not recorded.
+func NewUpstreamAccessRecorder(record UpstreamAccessFunc) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			response := &loggingResponse{ResponseWriter: rw}
+			next.ServeHTTP(response, req)
+
+			scope := middlewareapi.GetRequestScope(req)
+			// If scope is nil, this will panic.
+			// A scope should always be injected before this handler is called.
+			if scope.Upstream == "" {
+				return
+			}
+			record(req, scope.Session, scope.Upstream, response.Status())
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream Access Recorder Suite", func() {
+	type access struct {
+		session  *sessionsapi.SessionState
+		upstream string
+		status   int
+	}
+
+	var accesses []access
+
+	BeforeEach(func() {
+		accesses = nil
+	})
+
+	serve := func(upstream string, status int, session *sessionsapi.SessionState) {
+		handler := NewUpstreamAccessRecorder(func(_ *http.Request, session *sessionsapi.SessionState, upstream string, status int) {
+			accesses = append(accesses, access{session: session, upstream: upstream, status: status})
+		})(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			middlewareapi.GetRequestScope(req).Upstream = upstream
+			rw.WriteHeader(status)
+		}))
+
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, "/", nil), &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(status))
+	}
+
+	It("records the requests served by an upstream with their status", func() {
+		session := &sessionsapi.SessionState{Email: "jane.doe@example.com"}
+		serve("reports", http.StatusForbidden, session)
+		Expect(accesses).To(Equal([]access{{session: session, upstream: "reports", status: http.StatusForbidden}}))
+	})
+
+	It("records the anonymous requests", func() {
+		serve("static", http.StatusOK, nil)
+		Expect(accesses).To(Equal([]access{{upstream: "static", status: http.StatusOK}}))
+	})
+
+	It("doesn't record the requests no upstream served", func() {
+		serve("", http.StatusNotFound, nil)
+		Expect(accesses).To(BeEmpty())
+	})
+})
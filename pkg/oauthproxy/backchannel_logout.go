@@ -0,0 +1,106 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/audit"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+)
+
+const (
+	backchannelLogoutPath = "/backchannel_logout"
+
+	// maxBackchannelLogoutBodyBytes is the maximum size of the body of the
+	// back-channel logout requests, which only hold the logout token
+	maxBackchannelLogoutBodyBytes = 64 * 1024
+)
+
+// backchannelLogout signs out the stored sessions of the provider sessions in
+// the logout tokens the provider posts to the back-channel logout endpoint
+type backchannelLogout struct {
+	verifier internaloidc.LogoutTokenVerifier
+	sessions sessionsapi.ProviderSessionRevoker
+}
+
+// newBackchannelLogout returns the back-channel logout of the provider's
+// logout tokens, or nil when back-channel logout isn't enabled.
+// The sessions are cleared from the session store, so that they are signed
+// out on every replica, which requires a persistent session store.
+func newBackchannelLogout(opts *options.Options, provider providers.Provider, sessionStore sessionsapi.SessionStore) (*backchannelLogout, error) {
+	if !opts.Session.BackchannelLogout {
+		return nil, nil
+	}
+
+	verifier := provider.Data().LogoutTokenVerifier
+	if verifier == nil {
+		return nil, errors.New("back-channel logout requires a provider verifying OIDC ID tokens")
+	}
+	revoker, ok := sessionStore.(sessionsapi.ProviderSessionRevoker)
+	if !ok {
+		return nil, errors.New("back-channel logout requires a session store tracking provider sessions")
+	}
+	return &backchannelLogout{
+		verifier: verifier,
+		sessions: revoker,
+	}, nil
+}
+
+// BackchannelLogout signs out the sessions of the logout token posted by the
+// provider, as an OIDC Back-Channel Logout request.
+// Invalid logout tokens are refused with a 400 error, while sessions that
+// can't be cleared from the session store fail with a 500 error so that the
+// provider can retry.
+func (p *OAuthProxy) BackchannelLogout(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, maxBackchannelLogoutBodyBytes)
+	rawLogoutToken := req.PostFormValue("logout_token")
+	if rawLogoutToken == "" {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Back-channel logout request without a logout token")
+		writeBackchannelLogoutError(rw, "missing logout_token")
+		return
+	}
+	token, err := p.backchannelLogout.verifier.Verify(req.Context(), rawLogoutToken)
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid back-channel logout token: %v", err)
+		writeBackchannelLogoutError(rw, "invalid logout_token")
+		return
+	}
+
+	cleared, err := p.backchannelLogout.sessions.ClearProviderSessions(req.Context(), token.Issuer, token.Subject, token.SessionID)
+	if err != nil {
+		logger.Errorf("Error clearing the sessions of a back-channel logout: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+	if cleared > 0 {
+		logger.PrintAuthf(token.Subject, req, logger.AuthSuccess, "Back-channel logout signed out %d sessions", cleared)
+		p.sendSessionEvent(options.SessionEventLogout, token.Subject, req, logger.AuthSuccess, "Signed out by back-channel logout")
+		// The cleared sessions are only known by the subject of the token
+		p.recordAudit(options.AuditEventSessionRevoked, req, &sessionsapi.SessionState{User: token.Subject, AuthProvider: p.providerID}, audit.OutcomeSuccess, "Signed out %d sessions by back-channel logout", cleared)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// writeBackchannelLogoutError refuses a back-channel logout request with the
+// JSON error of the specification
+func writeBackchannelLogoutError(rw http.ResponseWriter, description string) {
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(rw).Encode(map[string]string{
+		"error":             "invalid_request",
+		"error_description": description,
+	}); err != nil {
+		logger.Errorf("Error encoding back-channel logout error: %v", err)
+	}
+}
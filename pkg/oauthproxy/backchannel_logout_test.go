@@ -0,0 +1,142 @@
+package oauthproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLogoutTokenVerifier returns the logout tokens it knows, by raw token
+type fakeLogoutTokenVerifier map[string]*internaloidc.LogoutToken
+
+func (v fakeLogoutTokenVerifier) Verify(_ context.Context, rawLogoutToken string) (*internaloidc.LogoutToken, error) {
+	if token, ok := v[rawLogoutToken]; ok {
+		return token, nil
+	}
+	return nil, errors.New("failed to verify token: oidc: malformed jwt")
+}
+
+func newBackchannelLogoutTestProxy(t *testing.T) *OAuthProxy {
+	opts := baseTestOptions()
+	opts.Providers[0].Type = options.OIDCProvider
+	opts.Providers[0].LoginURL = "https://idp.example.com/authorize"
+	opts.Providers[0].RedeemURL = "https://idp.example.com/token"
+	opts.Providers[0].OIDCConfig.IssuerURL = "https://idp.example.com"
+	opts.Providers[0].OIDCConfig.SkipDiscovery = true
+	opts.Providers[0].OIDCConfig.JwksURL = "https://idp.example.com/jwks"
+	opts.Session.Type = options.MemorySessionStoreType
+	opts.Session.BackchannelLogout = true
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, proxy.backchannelLogout)
+	proxy.backchannelLogout.verifier = fakeLogoutTokenVerifier{
+		"logout-first": {Issuer: "https://idp.example.com", Subject: "user", SessionID: "first"},
+		"logout-user":  {Issuer: "https://idp.example.com", Subject: "user"},
+	}
+	return proxy
+}
+
+// saveProviderSession saves a session with an ID token of the provider
+// session, returning a request with its cookie
+func saveProviderSession(t *testing.T, proxy *OAuthProxy, sid string) *http.Request {
+	claims := `{"iss":"https://idp.example.com","sub":"user","sid":"` + sid + `"}`
+	session := &sessions.SessionState{
+		Email:   "john.doe@example.com",
+		IDToken: "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln",
+	}
+	rw := httptest.NewRecorder()
+	require.NoError(t, proxy.SaveSession(rw, httptest.NewRequest(http.MethodGet, "/oauth2/callback", nil), session))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func postLogoutToken(proxy *OAuthProxy, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/backchannel_logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	t.Run("signs out the sessions of the provider session", func(t *testing.T) {
+		proxy := newBackchannelLogoutTestProxy(t)
+		first := saveProviderSession(t, proxy, "first")
+		second := saveProviderSession(t, proxy, "second")
+
+		rw := postLogoutToken(proxy, url.Values{"logout_token": {"logout-first"}})
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Header().Get("Cache-Control"), "no-store")
+
+		_, err := proxy.LoadCookiedSession(first)
+		assert.Error(t, err)
+		_, err = proxy.LoadCookiedSession(second)
+		assert.NoError(t, err)
+	})
+
+	t.Run("signs out all sessions of the subject", func(t *testing.T) {
+		proxy := newBackchannelLogoutTestProxy(t)
+		first := saveProviderSession(t, proxy, "first")
+		second := saveProviderSession(t, proxy, "second")
+
+		rw := postLogoutToken(proxy, url.Values{"logout_token": {"logout-user"}})
+		assert.Equal(t, http.StatusOK, rw.Code)
+
+		for _, req := range []*http.Request{first, second} {
+			_, err := proxy.LoadCookiedSession(req)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("refuses invalid logout tokens", func(t *testing.T) {
+		proxy := newBackchannelLogoutTestProxy(t)
+		first := saveProviderSession(t, proxy, "first")
+
+		rw := postLogoutToken(proxy, url.Values{"logout_token": {"forged"}})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"error":"invalid_request","error_description":"invalid logout_token"}`, rw.Body.String())
+
+		rw = postLogoutToken(proxy, url.Values{})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"error":"invalid_request","error_description":"missing logout_token"}`, rw.Body.String())
+
+		_, err := proxy.LoadCookiedSession(first)
+		assert.NoError(t, err)
+	})
+
+	t.Run("only accepts POST requests", func(t *testing.T) {
+		proxy := newBackchannelLogoutTestProxy(t)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/backchannel_logout?logout_token=logout-user", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodPost, rw.Header().Get("Allow"))
+	})
+
+	t.Run("requires a provider verifying ID tokens", func(t *testing.T) {
+		opts := baseTestOptions()
+		opts.Session.Type = options.MemorySessionStoreType
+		opts.Session.BackchannelLogout = true
+		require.NoError(t, validation.Validate(opts))
+
+		_, err := NewOAuthProxy(opts, func(string) bool { return true })
+		assert.EqualError(t, err, "error initialising back-channel logout: back-channel logout requires a provider verifying OIDC ID tokens")
+	})
+}
@@ -0,0 +1,56 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
+)
+
+const managementCachePath = "/cache"
+
+// ManagementCache purges the response caches of the upstreams on the
+// management server with a DELETE: the cache of the upstream with the ID of
+// the `upstream` query parameter, or the caches of every upstream.
+// The IDs of the upstreams whose caches were purged are listed, such as
+// `{"purged": ["app"]}`.
+func (p *OAuthProxy) ManagementCache(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		rw.Header().Set("Allow", http.MethodDelete)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	purger, ok := p.upstreamProxy.(upstream.CachePurger)
+	if !ok {
+		p.errorJSON(rw, req, http.StatusNotFound)
+		return
+	}
+
+	id := req.URL.Query().Get("upstream")
+	purged, err := purger.PurgeCache(req.Context(), id)
+	if err != nil {
+		logger.Errorf("Error purging the response caches: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+	if id != "" && len(purged) == 0 {
+		p.errorJSON(rw, req, http.StatusNotFound)
+		return
+	}
+
+	// The management server may be protected with basic auth, whose user is
+	// recorded as the user purging the caches
+	username, _, _ := req.BasicAuth()
+	if len(purged) > 0 {
+		logger.PrintAuthf(username, req, logger.AuthSuccess, "Purged the response caches of upstreams %s", strings.Join(purged, ", "))
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	if err := json.NewEncoder(rw).Encode(struct {
+		Purged []string `json:"purged"`
+	}{Purged: purged}); err != nil {
+		logger.Errorf("Error encoding purged caches: %v", err)
+	}
+}
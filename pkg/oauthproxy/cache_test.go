@@ -0,0 +1,77 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementCache(t *testing.T) {
+	serve := func(t *testing.T, handler http.Handler, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	purged := func(t *testing.T, rw *httptest.ResponseRecorder) []string {
+		var body struct {
+			Purged []string `json:"purged"`
+		}
+		require.NoError(t, json.NewDecoder(bytes.NewReader(rw.Body.Bytes())).Decode(&body))
+		return body.Purged
+	}
+
+	t.Run("is not served by default", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", nil)
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodDelete, "/cache").Code)
+	})
+
+	t.Run("purges the response caches of the upstreams", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.Cache = true
+			opts.Management.AllowedIPs = []string{"192.0.2.1"}
+			opts.UpstreamServers.Upstreams[0].Cache = &options.UpstreamCache{}
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, "MISS", serve(t, proxy, http.MethodGet, "/").Header().Get("X-Cache"))
+		assert.Equal(t, "HIT", serve(t, proxy, http.MethodGet, "/").Header().Get("X-Cache"))
+
+		rw := serve(t, handler, http.MethodDelete, "/cache?upstream=app")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, []string{"app"}, purged(t, rw))
+		assert.Equal(t, "MISS", serve(t, proxy, http.MethodGet, "/").Header().Get("X-Cache"))
+
+		rw = serve(t, handler, http.MethodDelete, "/cache")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, []string{"app"}, purged(t, rw))
+		assert.Equal(t, "MISS", serve(t, proxy, http.MethodGet, "/").Header().Get("X-Cache"))
+	})
+
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.Cache = true
+			opts.Management.AllowedIPs = []string{"192.0.2.1"}
+			opts.UpstreamServers.Upstreams[0].Cache = &options.UpstreamCache{}
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodDelete, "/cache?upstream=unknown").Code)
+
+		rw := serve(t, handler, http.MethodGet, "/cache")
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodDelete, rw.Header().Get("Allow"))
+	})
+}
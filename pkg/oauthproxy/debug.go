@@ -0,0 +1,298 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/routeaccess"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
+)
+
+// debugSettings are the settings described by the debug endpoints which
+// aren't kept by the proxy once it is built. They never include secrets.
+type debugSettings struct {
+	TrustedIPs []string        `json:"trustedIPs"`
+	Providers  []debugProvider `json:"providers"`
+	Cookie     debugCookie     `json:"cookie"`
+}
+
+type debugProvider struct {
+	ID            string   `json:"id"`
+	Type          string   `json:"type"`
+	Name          string   `json:"name,omitempty"`
+	ClientID      string   `json:"clientID"`
+	Scope         string   `json:"scope,omitempty"`
+	IssuerURL     string   `json:"issuerURL,omitempty"`
+	LoginURL      string   `json:"loginURL,omitempty"`
+	RedeemURL     string   `json:"redeemURL,omitempty"`
+	ProfileURL    string   `json:"profileURL,omitempty"`
+	ValidateURL   string   `json:"validateURL,omitempty"`
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+}
+
+type debugCookie struct {
+	Name     string   `json:"name"`
+	Domains  []string `json:"domains,omitempty"`
+	Path     string   `json:"path"`
+	Expire   string   `json:"expire"`
+	Refresh  string   `json:"refresh"`
+	Secure   bool     `json:"secure"`
+	HTTPOnly bool     `json:"httpOnly"`
+	SameSite string   `json:"sameSite,omitempty"`
+}
+
+type debugSkipAuthRoute struct {
+	Method string `json:"method,omitempty"`
+	Negate bool   `json:"negate,omitempty"`
+	Path   string `json:"path"`
+}
+
+type debugRecentAuthRoute struct {
+	Path   string `json:"path"`
+	MaxAge string `json:"maxAge"`
+}
+
+// debugConfig is the response of the debug config endpoint
+type debugConfig struct {
+	Upstreams        []upstream.Route       `json:"upstreams"`
+	SkipAuthRoutes   []debugSkipAuthRoute   `json:"skipAuthRoutes"`
+	APIRoutes        []string               `json:"apiRoutes"`
+	RecentAuthRoutes []debugRecentAuthRoute `json:"recentAuthRoutes"`
+	RouteAccessRules []routeaccess.RuleInfo `json:"routeAccessRules"`
+	*debugSettings
+}
+
+// debugRoute is the response of the debug route endpoint
+type debugRoute struct {
+	Method   string               `json:"method"`
+	Path     string               `json:"path"`
+	Upstream *upstream.RouteMatch `json:"upstream"`
+
+	// SkipAuth is set when the request is allowed without authentication,
+	// by a skip auth route or a trusted IP
+	SkipAuth         bool   `json:"skipAuth"`
+	SkipAuthRoute    bool   `json:"skipAuthRoute"`
+	TrustedIP        bool   `json:"trustedIP"`
+	APIRoute         bool   `json:"apiRoute"`
+	RecentAuthMaxAge string `json:"recentAuthMaxAge,omitempty"`
+
+	ClientIP         string                 `json:"clientIP,omitempty"`
+	Groups           []string               `json:"groups"`
+	AuthProvider     string                 `json:"authProvider,omitempty"`
+	RouteAccessRules []routeaccess.RuleInfo `json:"routeAccessRules"`
+	Allowed          bool                   `json:"allowed"`
+	DeniedBy         string                 `json:"deniedBy,omitempty"`
+	DeniedReason     string                 `json:"deniedReason,omitempty"`
+}
+
+// buildDebugSettings describes the settings for the debug endpoints, or
+// returns nil when they are disabled
+func buildDebugSettings(opts *options.Options) *debugSettings {
+	if !opts.DebugEndpoints {
+		return nil
+	}
+
+	settings := &debugSettings{
+		TrustedIPs: append([]string{}, opts.TrustedIPs...),
+		Cookie: debugCookie{
+			Name:     opts.Cookie.Name,
+			Domains:  opts.Cookie.Domains,
+			Path:     opts.Cookie.Path,
+			Expire:   opts.Cookie.Expire.String(),
+			Refresh:  opts.Cookie.Refresh.String(),
+			Secure:   opts.Cookie.Secure,
+			HTTPOnly: opts.Cookie.HTTPOnly,
+			SameSite: opts.Cookie.SameSite,
+		},
+	}
+	for _, provider := range opts.Providers {
+		settings.Providers = append(settings.Providers, debugProvider{
+			ID:            provider.ID,
+			Type:          string(provider.Type),
+			Name:          provider.Name,
+			ClientID:      provider.ClientID,
+			Scope:         provider.Scope,
+			IssuerURL:     redactURL(provider.OIDCConfig.IssuerURL),
+			LoginURL:      redactURL(provider.LoginURL),
+			RedeemURL:     redactURL(provider.RedeemURL),
+			ProfileURL:    redactURL(provider.ProfileURL),
+			ValidateURL:   redactURL(provider.ValidateURL),
+			AllowedGroups: provider.AllowedGroups,
+		})
+	}
+	return settings
+}
+
+// redactURL removes any password and query from the URL, as either may hold
+// credentials
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	return u.Redacted()
+}
+
+// DebugConfig writes the upstream routes and the authorization rules, in the
+// order they are evaluated, with the provider and cookie settings, as JSON.
+func (p *OAuthProxy) DebugConfig(rw http.ResponseWriter, req *http.Request) {
+	if _, ok := p.debugSession(rw, req); !ok {
+		return
+	}
+
+	config := debugConfig{
+		Upstreams:        []upstream.Route{},
+		SkipAuthRoutes:   make([]debugSkipAuthRoute, 0, len(p.allowedRoutes)),
+		APIRoutes:        make([]string, 0, len(p.apiRoutes)),
+		RecentAuthRoutes: make([]debugRecentAuthRoute, 0, len(p.recentAuthRoutes)),
+		RouteAccessRules: p.routeAccessRules.Info(),
+		debugSettings:    p.debugSettings,
+	}
+	if routes, ok := p.upstreamProxy.(upstream.RouteTable); ok {
+		config.Upstreams = routes.Routes()
+	}
+	for _, route := range p.allowedRoutes {
+		config.SkipAuthRoutes = append(config.SkipAuthRoutes, debugSkipAuthRoute{
+			Method: route.method,
+			Negate: route.negate,
+			Path:   route.pathRegex.String(),
+		})
+	}
+	for _, route := range p.apiRoutes {
+		config.APIRoutes = append(config.APIRoutes, route.pathRegex.String())
+	}
+	for _, route := range p.recentAuthRoutes {
+		config.RecentAuthRoutes = append(config.RecentAuthRoutes, debugRecentAuthRoute{
+			Path:   route.pathRegex.String(),
+			MaxAge: route.maxAge.String(),
+		})
+	}
+
+	p.writeDebugJSON(rw, req, config)
+}
+
+// DebugRoute dry runs a request with the `method` and `path` query
+// parameters, writing the upstream it would be proxied to and the
+// authorization rules that would apply to it as JSON.
+// The route access rules are evaluated with the client IP, groups and
+// provider of the debug request at the current time, unless the `ip`,
+// `groups`, `provider` and `at` (RFC 3339) query parameters are given.
+func (p *OAuthProxy) DebugRoute(rw http.ResponseWriter, req *http.Request) {
+	session, ok := p.debugSession(rw, req)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	path := query.Get("path")
+	if !strings.HasPrefix(path, "/") {
+		http.Error(rw, "the path query parameter must be an absolute path", http.StatusBadRequest)
+		return
+	}
+	method := strings.ToUpper(query.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	clientIP, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for the debug route: %v", err)
+	}
+	if query.Has("ip") {
+		clientIP = net.ParseIP(query.Get("ip"))
+		if clientIP == nil {
+			http.Error(rw, "the ip query parameter must be an IP address", http.StatusBadRequest)
+			return
+		}
+	}
+	groups := session.Groups
+	if query.Has("groups") {
+		groups = []string{}
+		for _, group := range strings.Split(query.Get("groups"), ",") {
+			if group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	authProvider := session.AuthProvider
+	if query.Has("provider") {
+		authProvider = query.Get("provider")
+	}
+	now := p.clock.Now()
+	if query.Has("at") {
+		if now, err = time.Parse(time.RFC3339, query.Get("at")); err != nil {
+			http.Error(rw, "the at query parameter must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dryRun := &http.Request{Method: method, URL: &url.URL{Path: path}, Header: http.Header{}}
+	result := debugRoute{
+		Method:           method,
+		Path:             path,
+		SkipAuthRoute:    p.isAllowedRoute(dryRun),
+		TrustedIP:        clientIP != nil && p.trustedIPs.Has(clientIP),
+		APIRoute:         p.isAPIPath(dryRun),
+		Groups:           groups,
+		AuthProvider:     authProvider,
+		RouteAccessRules: p.routeAccessRules.Matching(path),
+		Allowed:          true,
+	}
+	if routes, ok := p.upstreamProxy.(upstream.RouteTable); ok {
+		match := routes.MatchRoute(method, path)
+		result.Upstream = &match
+	}
+	if maxAge, ok := p.recentAuthMaxAge(dryRun); ok {
+		result.RecentAuthMaxAge = maxAge.String()
+	}
+	if clientIP != nil {
+		result.ClientIP = clientIP.String()
+	}
+
+	// Requests allowed without authentication aren't checked against the
+	// route access rules
+	result.SkipAuth = result.SkipAuthRoute || result.TrustedIP
+	if !result.SkipAuth {
+		if err := p.routeAccessRules.Authorize(path, now, clientIP, groups, authProvider); err != nil {
+			result.Allowed = false
+			if denied, ok := err.(*routeaccess.DeniedError); ok {
+				result.DeniedBy = denied.Rule
+				result.DeniedReason = denied.Reason
+			}
+		}
+	}
+
+	p.writeDebugJSON(rw, req, result)
+}
+
+// debugSession requires an authenticated session for the debug
+// endpoints, even when the request would otherwise be allowed without one
+func (p *OAuthProxy) debugSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, bool) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil || session == nil {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	return session, true
+}
+
+func (p *OAuthProxy) writeDebugJSON(rw http.ResponseWriter, req *http.Request, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logger.Printf("Error encoding debug response: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,204 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/audit"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+)
+
+const (
+	devicePath      = "/device"
+	deviceTokenPath = "/device/token"
+
+	// maxDeviceTokenBodyBytes is the maximum size of the body of the device
+	// token requests, which only hold the device code
+	maxDeviceTokenBodyBytes = 64 * 1024
+)
+
+// checkDeviceAuthorization checks that the provider has a device
+// authorization endpoint when the device authorization endpoints are served
+func checkDeviceAuthorization(opts *options.Options, provider providers.Provider) error {
+	if !opts.DeviceAuthorization {
+		return nil
+	}
+	if u := provider.Data().DeviceAuthorizationURL; u == nil || u.String() == "" {
+		return errors.New("device authorization requires a device authorization URL, the provider doesn't advertise a device_authorization_endpoint")
+	}
+	return nil
+}
+
+// DeviceAuthorization starts the sign in of a CLI client with the device
+// authorization grant (RFC 8628) of the provider.
+// The client is answered the user code the user verifies with the provider,
+// and the device code it polls the device token endpoint with meanwhile.
+func (p *OAuthProxy) DeviceAuthorization(rw http.ResponseWriter, req *http.Request) {
+	if !p.checkDeviceRequest(rw, req) {
+		return
+	}
+
+	authorization, err := p.provider.Data().StartDeviceAuthorization(req.Context())
+	if err != nil {
+		logger.Errorf("Error starting a device authorization: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(authorization); err != nil {
+		logger.Errorf("Error encoding device authorization: %v", err)
+	}
+}
+
+// DeviceToken redeems the device code of a device authorization once the
+// user has verified its user code, signing the client in with a session like
+// the OAuth2 callback does.
+// The session is given to the client as a bearer token with bearer sessions,
+// otherwise as a session cookie. Until the user code is verified, the client
+// is answered the error of the provider, such as authorization_pending.
+func (p *OAuthProxy) DeviceToken(rw http.ResponseWriter, req *http.Request) {
+	if !p.checkDeviceRequest(rw, req) {
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, maxDeviceTokenBodyBytes)
+	deviceCode := req.PostFormValue("device_code")
+	if deviceCode == "" {
+		writeDeviceTokenError(rw, http.StatusBadRequest, "invalid_request", "missing device_code")
+		return
+	}
+
+	session, err := p.provider.RedeemDeviceCode(req.Context(), deviceCode)
+	var tokenErr *providers.DeviceTokenError
+	switch {
+	case errors.As(err, &tokenErr):
+		// The client keeps polling while the authorization is pending
+		if tokenErr.Code != "authorization_pending" && tokenErr.Code != "slow_down" {
+			logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via device authorization: %v", tokenErr)
+		}
+		writeDeviceTokenError(rw, http.StatusBadRequest, tokenErr.Code, tokenErr.Description)
+		return
+	case errors.Is(err, providers.ErrEmailNotVerified):
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via device authorization: %v", err)
+		writeDeviceTokenError(rw, http.StatusForbidden, "access_denied", "email address not verified")
+		return
+	case err != nil:
+		logger.Errorf("Error redeeming device code: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+
+	if session.ExpiresOn == nil {
+		session.ExpiresIn(p.CookieOptions.Expire)
+	}
+	setAuthTime(req.Context(), session)
+	if err := p.enrichSessionState(req.Context(), session); err != nil {
+		logger.Errorf("Error creating session during device authorization: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+	if !p.provider.ValidateSession(req.Context(), session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session validation failed: %s", session)
+		writeDeviceTokenError(rw, http.StatusForbidden, "access_denied", "session validation failed")
+		return
+	}
+
+	if !p.authorizeDeviceSession(rw, req, session) {
+		return
+	}
+
+	session.AuthProvider = p.providerID
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via device authorization: %s", session)
+	p.sendSessionEvent(options.SessionEventLogin, session.Email, req, logger.AuthSuccess, "Authenticated via device authorization")
+	logSessionSize(req, session)
+	err = p.saveLoginSession(rw, req, session)
+	if errors.Is(err, sessionsapi.ErrTooManySessions) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via device authorization: %v", err)
+		writeDeviceTokenError(rw, http.StatusForbidden, "access_denied", err.Error())
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error saving session state for device authorization: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+
+	if p.bearerSessions {
+		p.writeSessionToken(rw, req)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeDeviceSession authorizes the session of a device authorization
+// with the rules of the OAuth2 callback, answering the client when it is
+// denied. It returns whether the session is authorized.
+func (p *OAuthProxy) authorizeDeviceSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) bool {
+	authorized, err := p.provider.Authorize(req.Context(), session)
+	if err != nil {
+		logger.Errorf("Error with authorization: %v", err)
+	}
+	if !p.Validator(session.Email) || !authorized {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via device authorization: unauthorized")
+		p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Invalid authentication via device authorization: unauthorized")
+		p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Invalid authentication via device authorization: unauthorized")
+		writeDeviceTokenError(rw, http.StatusForbidden, "access_denied", "unauthorized")
+		return false
+	}
+
+	// Deny lists take precedence over any allow rules
+	if err := p.checkDenyLists(session); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Denied authentication via device authorization: %v", err)
+		p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Denied authentication via device authorization: %v", err)
+		p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Denied authentication via device authorization: %v", err)
+		p.revokeSession(req, session, "denied authentication")
+		writeDeviceTokenError(rw, http.StatusForbidden, "access_denied", "denied")
+		return false
+	}
+
+	if p.claimEnricher != nil {
+		if err := p.claimEnricher.Enrich(req.Context(), session); err != nil {
+			logger.PrintAuthf(session.Email, req, logger.AuthError, "Invalid authentication via device authorization: %v", err)
+			p.errorJSON(rw, req, http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// checkDeviceRequest checks that the request to a device authorization
+// endpoint is a POST request of a CLI client. Browsers send an Origin header
+// with the POST requests of forms, which are refused so that other sites
+// can't sign users in with the session of another device authorization.
+func (p *OAuthProxy) checkDeviceRequest(rw http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return false
+	}
+	if req.Header.Get("Origin") != "" {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Refused device authorization request from origin %q", req.Header.Get("Origin"))
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeDeviceTokenError answers a device token request with the JSON error of
+// the OAuth2 specification
+func writeDeviceTokenError(rw http.ResponseWriter, code int, oauthError, description string) {
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(map[string]string{
+		"error":             oauthError,
+		"error_description": description,
+	}); err != nil {
+		logger.Errorf("Error encoding device token error: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDeviceTestProxy starts a fake identity provider, and a proxy signing in
+// its users with device authorizations
+func newDeviceTestProxy(t *testing.T, configure func(opts *options.Options)) (*fakeidp.Server, *OAuthProxy) {
+	server, err := fakeidp.New(fakeidp.Options{})
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	opts := baseTestOptions()
+	opts.Providers[0].Type = options.OIDCProvider
+	opts.Providers[0].ClientID = server.ClientID()
+	opts.Providers[0].ClientSecret = server.ClientSecret()
+	opts.Providers[0].OIDCConfig.IssuerURL = server.Issuer()
+	opts.DeviceAuthorization = true
+	if configure != nil {
+		configure(opts)
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	return server, proxy
+}
+
+func postDevice(proxy *OAuthProxy, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+// startDeviceAuthorization starts a device authorization with the proxy, and
+// verifies its user code with the provider
+func startDeviceAuthorization(t *testing.T, server *fakeidp.Server, proxy *OAuthProxy) string {
+	rw := postDevice(proxy, "/oauth2/device", nil)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var authorization providers.DeviceAuthorization
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &authorization))
+	assert.Equal(t, server.Issuer()+fakeidp.DeviceVerificationPath, authorization.VerificationURI)
+
+	rw = postDevice(proxy, "/oauth2/device/token", url.Values{"device_code": {authorization.DeviceCode}})
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.JSONEq(t, `{"error":"authorization_pending","error_description":"the user code has not been verified yet"}`, rw.Body.String())
+
+	require.NoError(t, server.VerifyDevice(authorization.UserCode))
+	return authorization.DeviceCode
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	t.Run("signs the client in with a session cookie", func(t *testing.T) {
+		server, proxy := newDeviceTestProxy(t, nil)
+		deviceCode := startDeviceAuthorization(t, server, proxy)
+
+		rw := postDevice(proxy, "/oauth2/device/token", url.Values{"device_code": {deviceCode}})
+		require.Equal(t, http.StatusNoContent, rw.Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), "jane.doe@example.com")
+	})
+
+	t.Run("signs the client in without a nonce when nonces are checked", func(t *testing.T) {
+		server, proxy := newDeviceTestProxy(t, func(opts *options.Options) {
+			opts.Providers[0].OIDCConfig.InsecureSkipNonce = false
+		})
+		deviceCode := startDeviceAuthorization(t, server, proxy)
+
+		rw := postDevice(proxy, "/oauth2/device/token", url.Values{"device_code": {deviceCode}})
+		require.Equal(t, http.StatusNoContent, rw.Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		session, err := proxy.LoadCookiedSession(req)
+		require.NoError(t, err)
+		assert.True(t, session.DeviceAuthorization)
+		assert.True(t, proxy.provider.ValidateSession(req.Context(), session))
+	})
+
+	t.Run("signs the client in with a bearer session token", func(t *testing.T) {
+		mr, err := miniredis.Run()
+		require.NoError(t, err)
+		t.Cleanup(mr.Close)
+
+		server, proxy := newDeviceTestProxy(t, func(opts *options.Options) {
+			opts.Session.Type = options.RedisSessionStoreType
+			opts.Session.Redis.ConnectionURL = "redis://" + mr.Addr()
+			opts.Session.BearerTokens = true
+		})
+		deviceCode := startDeviceAuthorization(t, server, proxy)
+
+		rw := postDevice(proxy, "/oauth2/device/token", url.Values{"device_code": {deviceCode}})
+		require.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Result().Cookies())
+		var tokenInfo struct {
+			Token     string `json:"token"`
+			TokenType string `json:"tokenType"`
+		}
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &tokenInfo))
+		assert.Equal(t, "Bearer", tokenInfo.TokenType)
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenInfo.Token)
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), "jane.doe@example.com")
+	})
+
+	t.Run("refuses the sessions of unauthorized users", func(t *testing.T) {
+		server, proxy := newDeviceTestProxy(t, func(opts *options.Options) {
+			opts.DeniedEmails = []string{"jane.doe@example.com"}
+		})
+		deviceCode := startDeviceAuthorization(t, server, proxy)
+
+		rw := postDevice(proxy, "/oauth2/device/token", url.Values{"device_code": {deviceCode}})
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.JSONEq(t, `{"error":"access_denied","error_description":"denied"}`, rw.Body.String())
+		assert.Empty(t, rw.Result().Cookies())
+	})
+
+	t.Run("refuses requests from browsers and other methods", func(t *testing.T) {
+		_, proxy := newDeviceTestProxy(t, nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/oauth2/device/token", strings.NewReader("device_code=code"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", "https://evil.example.com")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/device", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodPost, rw.Header().Get("Allow"))
+
+		rw = postDevice(proxy, "/oauth2/device/token", url.Values{})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"error":"invalid_request","error_description":"missing device_code"}`, rw.Body.String())
+	})
+
+	t.Run("requires a device authorization endpoint", func(t *testing.T) {
+		opts := baseTestOptions()
+		opts.DeviceAuthorization = true
+		require.NoError(t, validation.Validate(opts))
+
+		_, err := NewOAuthProxy(opts, func(string) bool { return true })
+		assert.EqualError(t, err, "error initialising device authorization: device authorization requires a device authorization URL, the provider doesn't advertise a device_authorization_endpoint")
+	})
+}
@@ -0,0 +1,19 @@
+// Package oauthproxy provides the OAuth2 Proxy handler, so that it can be
+// embedded in another Go program rather than run as a separate process.
+//
+// To embed the proxy, construct the options in code starting from
+// options.NewOptions, check them with validation.Validate and build the proxy
+// with NewOAuthProxy. The OAuthProxy is an http.Handler serving the
+// /oauth2 endpoints under the proxy prefix and the configured upstreams, so
+// that it can be mounted in the embedding program's own router alongside its
+// other routes.
+// No listeners are opened unless the server bind addresses are set in the
+// options, in which case Start serves the proxy on them.
+//
+// NewOAuthProxy, NewValidator and the exported methods of OAuthProxy are a
+// stable API, as are the constructors for the pieces of the proxy that can be
+// used on their own:
+//   - upstream.NewProxy, for proxying to the upstreams
+//   - sessions.NewSessionStore, for storing sessions
+//   - providers.NewProvider, for the identity providers
+package oauthproxy
@@ -0,0 +1,71 @@
+package oauthproxy_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/oauthproxy"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+)
+
+// This example embeds OAuth2 Proxy in a program's own router, protecting the
+// application under /app/ while the program serves its own health check.
+func Example() {
+	// Keep the proxy's logs out of the example output
+	logger.SetOutput(ioutil.Discard)
+
+	// Options are constructed in code from the defaults, without any flags
+	opts := options.NewOptions()
+	opts.Cookie.Secret = "secretthirtytwobytes+abcdefghijk"
+	opts.EmailDomains = []string{"example.com"}
+	opts.Providers[0].ID = "google"
+	opts.Providers[0].ClientID = "client-id"
+	opts.Providers[0].ClientSecret = "client-secret"
+
+	statusCode := 200
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:         "app",
+				Path:       "/app/",
+				Static:     true,
+				StaticCode: &statusCode,
+			},
+		},
+	}
+
+	if err := validation.Validate(opts); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	validator := oauthproxy.NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	proxy, err := oauthproxy.NewOAuthProxy(opts, validator)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The proxy is an http.Handler, routed to alongside the program's own
+	// handlers
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("/", proxy)
+
+	for _, path := range []string{"/healthz", "/oauth2/sign_in", "/app/"} {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		fmt.Println(path, rw.Code)
+	}
+
+	// Output:
+	// /healthz 204
+	// /oauth2/sign_in 200
+	// /app/ 403
+}
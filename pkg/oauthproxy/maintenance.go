@@ -0,0 +1,95 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/maintenance"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+)
+
+const (
+	managementMaintenancePath = "/maintenance"
+
+	// maxMaintenanceBodyBytes is the maximum size of the body of the
+	// requests toggling the maintenance mode
+	maxMaintenanceBodyBytes = 1024
+)
+
+// newMaintenanceAudit records the toggles of the maintenance mode in the
+// logs, with the user and client of the request that toggled it, and
+// delivers them to the session events webhook when it is enabled
+func newMaintenanceAudit(sessionEvents *sessionevents.Webhook) maintenance.AuditFunc {
+	return func(state maintenance.State, username string, req *http.Request) {
+		action := "disabled"
+		if state.Enabled {
+			action = "enabled"
+		}
+
+		if req != nil {
+			logger.PrintAuthf(username, req, logger.AuthSuccess, "Maintenance mode %s by the %s", action, state.Source)
+		} else {
+			logger.Printf("Maintenance mode %s by the %s", action, state.Source)
+		}
+		if sessionEvents != nil {
+			sessionEvents.Send(options.SessionEventMaintenance, username, req, logger.AuthSuccess, "Maintenance mode %s by the %s", action, state.Source)
+		}
+	}
+}
+
+// serveMaintenance writes the maintenance page in place of the proxied
+// route, unless the maintenance mode is disabled or the session of the
+// request is in a bypass group.
+// The session is the one loaded by the session chain, the request is still
+// authenticated and authorized as usual when it is allowed through.
+func (p *OAuthProxy) serveMaintenance(rw http.ResponseWriter, req *http.Request) bool {
+	if !p.maintenance.Enabled() {
+		return false
+	}
+	if p.maintenance.Bypass(middlewareapi.GetRequestScope(req).Session) {
+		return false
+	}
+
+	if retryAfter := p.maintenance.RetryAfter(); retryAfter != "" {
+		rw.Header().Set("Retry-After", retryAfter)
+	}
+	if p.forceJSONErrors {
+		p.errorJSON(rw, req, http.StatusServiceUnavailable)
+		return true
+	}
+	p.pageWriter.WriteMaintenancePage(rw, req)
+	return true
+}
+
+// ManagementMaintenance reports the state of the maintenance mode on the
+// management server, and toggles it with a PUT of the state, such as
+// `{"enabled": true}`
+func (p *OAuthProxy) ManagementMaintenance(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxMaintenanceBodyBytes)).Decode(&body); err != nil || body.Enabled == nil {
+			p.errorJSON(rw, req, http.StatusBadRequest)
+			return
+		}
+		// The management server may be protected with basic auth, whose
+		// user is recorded as the user toggling the mode
+		username, _, _ := req.BasicAuth()
+		p.maintenance.Set(*body.Enabled, maintenance.SourceAdminAPI, username, req)
+	default:
+		rw.Header().Set("Allow", "GET, PUT")
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	if err := json.NewEncoder(rw).Encode(p.maintenance.State()); err != nil {
+		logger.Errorf("Error encoding maintenance state: %v", err)
+	}
+}
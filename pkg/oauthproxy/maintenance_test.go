@@ -0,0 +1,222 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/maintenance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMaintenanceTest(t *testing.T, modify func(*options.Options)) *ProcessCookieTest {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Write([]byte("upstream"))
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	test, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+		opts.UpstreamServers = options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:   upstreamServer.URL,
+					Path: "/",
+					URI:  upstreamServer.URL,
+				},
+			},
+		}
+		opts.Maintenance.Enabled = true
+		opts.Maintenance.RetryAfter = 5 * time.Minute
+		opts.Maintenance.BypassGroups = []string{"admins"}
+		if modify != nil {
+			modify(opts)
+		}
+	})
+	require.NoError(t, err)
+	test.proxy.pageWriter = &pagewriter.WriterFuncs{}
+	return test
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	created := time.Now()
+
+	testCases := []struct {
+		name           string
+		path           string
+		session        *sessions.SessionState
+		disabled       bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "serves the maintenance page without a session",
+			path:           "/app",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "Maintenance",
+		},
+		{
+			name:           "serves the maintenance page to sessions outside the bypass groups",
+			path:           "/app",
+			session:        &sessions.SessionState{Email: "user@example.com", Groups: []string{"users"}, AccessToken: "token", CreatedAt: &created},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "Maintenance",
+		},
+		{
+			name:           "allows sessions of the bypass groups through",
+			path:           "/app",
+			session:        &sessions.SessionState{Email: "admin@example.com", Groups: []string{"users", "admins"}, AccessToken: "token", CreatedAt: &created},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "upstream",
+		},
+		{
+			name:           "keeps the proxy endpoints working",
+			path:           "/oauth2/sign_in",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Sign In",
+		},
+		{
+			name:           "serves the upstreams when it is disabled",
+			path:           "/app",
+			disabled:       true,
+			session:        &sessions.SessionState{Email: "user@example.com", AccessToken: "token", CreatedAt: &created},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "upstream",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test := newMaintenanceTest(t, func(opts *options.Options) {
+				if tc.disabled {
+					opts.Maintenance = options.Maintenance{}
+				}
+			})
+			test.req = httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.session != nil {
+				require.NoError(t, test.SaveSession(tc.session))
+			}
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+			assert.Equal(t, tc.expectedStatus, test.rw.Code)
+			assert.Equal(t, tc.expectedBody, test.rw.Body.String())
+			if tc.expectedStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, "300", test.rw.Header().Get("Retry-After"))
+			} else {
+				assert.Empty(t, test.rw.Header().Get("Retry-After"))
+			}
+		})
+	}
+
+	t.Run("writes JSON errors when they are forced", func(t *testing.T) {
+		test := newMaintenanceTest(t, func(opts *options.Options) {
+			opts.ForceJSONErrors = true
+		})
+		test.req = httptest.NewRequest(http.MethodGet, "/app", nil)
+
+		test.proxy.ServeHTTP(test.rw, test.req)
+		assert.Equal(t, http.StatusServiceUnavailable, test.rw.Code)
+		assert.Equal(t, applicationJSON, test.rw.Header().Get("Content-Type"))
+		assert.Equal(t, "300", test.rw.Header().Get("Retry-After"))
+	})
+
+	t.Run("is toggled without a restart", func(t *testing.T) {
+		test := newMaintenanceTest(t, func(opts *options.Options) {
+			opts.Maintenance = options.Maintenance{}
+		})
+
+		serve := func() int {
+			rw := httptest.NewRecorder()
+			test.proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/app", nil))
+			return rw.Code
+		}
+		// Without a session, the request is sent to sign in
+		assert.Equal(t, http.StatusForbidden, serve())
+
+		test.proxy.maintenance.Toggle(maintenance.SourceSignal, "", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+		test.proxy.maintenance.Toggle(maintenance.SourceSignal, "", nil)
+		assert.Equal(t, http.StatusForbidden, serve())
+	})
+}
+
+func TestManagementMaintenance(t *testing.T) {
+	serve := func(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "password")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	state := func(t *testing.T, rw *httptest.ResponseRecorder) maintenance.State {
+		var s maintenance.State
+		require.NoError(t, json.NewDecoder(bytes.NewReader(rw.Body.Bytes())).Decode(&s))
+		return s
+	}
+
+	t.Run("is not served by default", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", nil)
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, "/maintenance", "").Code)
+	})
+
+	t.Run("reports and toggles the maintenance mode", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.Maintenance = true
+			opts.Management.AllowedIPs = []string{"192.0.2.1"}
+			opts.Maintenance.Unready = true
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		rw := serve(t, handler, http.MethodGet, "/maintenance", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.False(t, state(t, rw).Enabled)
+		assert.Equal(t, maintenance.SourceConfig, state(t, rw).Source)
+		assert.Equal(t, http.StatusOK, serve(t, handler, http.MethodGet, "/ready", "").Code)
+
+		rw = serve(t, handler, http.MethodPut, "/maintenance", `{"enabled": true}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.True(t, state(t, rw).Enabled)
+		assert.Equal(t, maintenance.SourceAdminAPI, state(t, rw).Source)
+		assert.True(t, proxy.maintenance.Enabled())
+
+		// The readiness endpoint drains the proxy during maintenance
+		rw = serve(t, handler, http.MethodGet, "/ready", "")
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+		assert.Equal(t, "Maintenance", rw.Body.String())
+
+		rw = serve(t, handler, http.MethodPut, "/maintenance", `{"enabled": false}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.False(t, state(t, rw).Enabled)
+		assert.Equal(t, http.StatusOK, serve(t, handler, http.MethodGet, "/ready", "").Code)
+	})
+
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.Maintenance = true
+			opts.Management.AllowedIPs = []string{"192.0.2.1"}
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodPut, "/maintenance", `{}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodPut, "/maintenance", `enabled`).Code)
+
+		rw := serve(t, handler, http.MethodPost, "/maintenance", `{"enabled": true}`)
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, "GET, PUT", rw.Header().Get("Allow"))
+		assert.False(t, proxy.maintenance.Enabled())
+	})
+}
@@ -0,0 +1,133 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/middleware"
+)
+
+const (
+	managementMetricsPath = "/metrics"
+	managementPprofPath   = "/debug/pprof/"
+	managementReadyPath   = "/ready"
+)
+
+// serverAddresses returns the enabled addresses of the server
+func serverAddresses(server options.Server) []string {
+	addresses := []string{}
+	for _, address := range []string{server.BindAddress, server.SecureBindAddress} {
+		if address != "" && address != "-" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// buildManagementHandler builds the handler of the management server, with
+// the endpoints enabled by the management options, all protected by the
+// management auth.
+func (p *OAuthProxy) buildManagementHandler(opts *options.Options) (http.Handler, error) {
+	managementAuth, err := middleware.NewMetricsAuth(opts.Management.Auth(), p.basicAuthValidator)
+	if err != nil {
+		return nil, fmt.Errorf("could not build management auth: %v", err)
+	}
+
+	r := mux.NewRouter()
+	if opts.Management.Metrics {
+		r.Path(managementMetricsPath).Handler(middleware.DefaultMetricsHandler)
+	}
+	if opts.Management.Readiness {
+		r.Path(managementReadyPath).HandlerFunc(p.Ready)
+	}
+	if opts.Management.DynamicUpstreams && p.dynamicUpstreams != nil {
+		r.Path(dynamicUpstreamsPath).HandlerFunc(p.ManagementDynamicUpstreams)
+	}
+	if opts.Management.Upstreams && p.upstreamHealth != nil {
+		r.Path(upstreamsPath).HandlerFunc(p.ManagementUpstreamsHealth)
+	}
+	if opts.Management.Maintenance {
+		r.Path(managementMaintenancePath).HandlerFunc(p.ManagementMaintenance)
+	}
+	if opts.Management.Cache {
+		r.Path(managementCachePath).HandlerFunc(p.ManagementCache)
+	}
+	if opts.Management.Sessions {
+		r.Path(managementSessionsPath).HandlerFunc(p.ManagementSessions)
+	}
+	if opts.Management.Pprof {
+		logger.Printf("WARNING: the Go profiler is enabled on %s* of the management server (%s): it exposes the memory and internals of the process, never expose it to untrusted clients",
+			managementPprofPath, strings.Join(serverAddresses(opts.ManagementServer), ", "))
+		r.Path(managementPprofPath + "cmdline").HandlerFunc(pprof.Cmdline)
+		r.Path(managementPprofPath + "profile").HandlerFunc(pprof.Profile)
+		r.Path(managementPprofPath + "symbol").HandlerFunc(pprof.Symbol)
+		r.Path(managementPprofPath + "trace").HandlerFunc(pprof.Trace)
+		r.PathPrefix(managementPprofPath).HandlerFunc(pprof.Index)
+	}
+	// The requests are scoped, so that the toggles of the maintenance mode
+	// are audited with their request ID
+	scope := middleware.NewScope(opts.ReverseProxy, opts.Logging.RequestIDHeader, buildRequestIDTrust(opts))
+	return scope(managementAuth(r)), nil
+}
+
+// registerManagementNotFound makes the proxy respond 404 to the paths of the
+// management endpoints, so that they are only reachable on the management
+// server, and never proxied to the upstreams instead.
+func (p *OAuthProxy) registerManagementNotFound(r *mux.Router, proxyPrefix string) {
+	notFound := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.ErrorPage(rw, req, http.StatusNotFound, "The management endpoints are served on the management server")
+	})
+	r.Path(managementMetricsPath).Handler(notFound)
+	r.PathPrefix(managementPprofPath).Handler(notFound)
+	r.Path(managementReadyPath).Handler(notFound)
+	r.Path(proxyPrefix + dynamicUpstreamsPath).Handler(notFound)
+	r.Path(proxyPrefix + upstreamsPath).Handler(notFound)
+}
+
+// Ready is the readiness endpoint of the management server. The management
+// server is only started once the proxy is built, so the proxy is ready to
+// serve requests whenever it responds, unless it is unready during
+// maintenance so that load balancers drain it.
+func (p *OAuthProxy) Ready(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.maintenance.Ready() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "Maintenance")
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
+}
+
+// ManagementDynamicUpstreams lists the files of the dynamic upstreams
+// directory on the management server, where the management auth protects
+// it instead of a session
+func (p *OAuthProxy) ManagementDynamicUpstreams(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeDynamicUpstreams(rw)
+}
+
+// ManagementUpstreamsHealth lists the health of the servers of the upstreams
+// with health checks on the management server, where the management auth
+// protects it instead of a session
+func (p *OAuthProxy) ManagementUpstreamsHealth(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeUpstreamsHealth(rw)
+}
@@ -0,0 +1,161 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newManagementTestProxy(t *testing.T, managementAddress string, configure func(*options.Options)) (*OAuthProxy, *options.Options) {
+	appServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Write([]byte("app"))
+	}))
+	t.Cleanup(appServer.Close)
+
+	dir, err := ioutil.TempDir("", "dynamic-upstreams")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/",
+				URI:  appServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{"^/"}
+	opts.DynamicUpstreams.Dir = dir
+	opts.ManagementServer.BindAddress = managementAddress
+	if configure != nil {
+		configure(opts)
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	return proxy, opts
+}
+
+func TestManagementPathsOnTheProxy(t *testing.T) {
+	paths := []string{"/metrics", "/debug/pprof/", "/debug/pprof/heap", "/ready", "/oauth2/dynamic-upstreams", "/oauth2/upstreams"}
+
+	t.Run("are served by the proxy without a management server", func(t *testing.T) {
+		proxy, _ := newManagementTestProxy(t, "", nil)
+		for _, path := range paths[:4] {
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusOK, rw.Code, path)
+			assert.Equal(t, "app", rw.Body.String(), path)
+		}
+	})
+
+	t.Run("are not found with a management server", func(t *testing.T) {
+		proxy, _ := newManagementTestProxy(t, "127.0.0.1:0", nil)
+		for _, path := range paths {
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusNotFound, rw.Code, path)
+		}
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/other", nil))
+		assert.Equal(t, "app", rw.Body.String())
+	})
+}
+
+func TestManagementHandler(t *testing.T) {
+	serve := func(t *testing.T, handler http.Handler, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	t.Run("serves the default endpoints", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", nil)
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, serve(t, handler, "/metrics", "").Code)
+
+		rw := serve(t, handler, "/ready", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "OK", rw.Body.String())
+
+		rw = serve(t, handler, "/dynamic-upstreams", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `{"upstreams": []}`, rw.Body.String())
+
+		// The upstreams aren't health checked
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, "/upstreams", "").Code)
+
+		// pprof is disabled by default
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, "/debug/pprof/", "").Code)
+	})
+
+	t.Run("serves only the enabled endpoints", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.Metrics = false
+			opts.Management.Readiness = false
+			opts.Management.DynamicUpstreams = false
+			opts.Management.Pprof = true
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		for _, path := range []string{"/metrics", "/ready", "/dynamic-upstreams"} {
+			assert.Equal(t, http.StatusNotFound, serve(t, handler, path, "").Code, path)
+		}
+		assert.Equal(t, http.StatusOK, serve(t, handler, "/debug/pprof/", "").Code)
+		assert.Equal(t, http.StatusOK, serve(t, handler, "/debug/pprof/cmdline", "").Code)
+		assert.Equal(t, http.StatusOK, serve(t, handler, "/debug/pprof/heap", "").Code)
+	})
+
+	t.Run("serves the health of the upstreams", func(t *testing.T) {
+		interval := options.Duration(time.Hour)
+		configure := func(opts *options.Options) {
+			opts.UpstreamServers.Upstreams[0].HealthCheck = &options.UpstreamHealthCheck{Interval: &interval}
+		}
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", configure)
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		rw := serve(t, handler, "/upstreams", "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), `"id":"app","healthy":true`)
+
+		proxy, opts = newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			configure(opts)
+			opts.Management.Upstreams = false
+		})
+		handler, err = proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, "/upstreams", "").Code)
+	})
+
+	t.Run("protects the endpoints with the management auth", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Management.BearerToken = "management-token"
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, serve(t, handler, "/ready", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, serve(t, handler, "/ready", "other-token").Code)
+		assert.Equal(t, http.StatusOK, serve(t, handler, "/ready", "management-token").Code)
+	})
+}
@@ -0,0 +1,3555 @@
+package oauthproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apiclient"
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/redirect"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/assertion"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/audit"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/authentication/basic"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/cookies"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/enrichment"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/externalauthz"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/fallback"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/header"
+	proxyhttp "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/http"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/introspection"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/util"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/maintenance"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/probe"
+	providerutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/routeaccess"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/signedurl"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	schemeHTTP      = "http"
+	schemeHTTPS     = "https"
+	applicationJSON = "application/json"
+
+	robotsPath        = "/robots.txt"
+	signInPath        = "/sign_in"
+	signOutPath       = "/sign_out"
+	oauthStartPath    = "/start"
+	oauthCallbackPath = "/callback"
+	authOnlyPath      = "/auth"
+	userInfoPath      = "/userinfo"
+	refreshPath       = "/refresh"
+	sessionPath       = "/session"
+	sessionExpiryPath = "/session/expiry"
+	signURLPath       = "/sign-url"
+	jwksPath          = "/.well-known/jwks.json"
+	debugConfigPath   = "/debug/config"
+	debugRoutePath    = "/debug/route"
+
+	dynamicUpstreamsPath = "/dynamic-upstreams"
+	upstreamsPath        = "/upstreams"
+
+	// tooManySessionsMessage is shown to users refused a new session as they
+	// already have the maximum number of concurrent sessions
+	tooManySessionsMessage = "Login Failed: You have too many active sessions. Please sign out of another session and try again."
+
+	// invalidFormCSRFMessage is shown to users whose sign-out form was
+	// posted without a valid CSRF token, eg. from another site or once the
+	// form had expired
+	invalidFormCSRFMessage = "Sign Out Failed: The form has expired or was not sent from this site. Please try signing out again."
+
+	// silentRenewErrorParameter is added to the application redirect when the
+	// provider requires a login to renew a session silently
+	silentRenewErrorParameter = "oauth2_renew_error"
+
+	// refreshRequiredHeader must be present on requests to the refresh and
+	// sign-url endpoints.
+	// Browsers will not send custom headers cross-origin without a CORS
+	// preflight, so this protects the endpoint against CSRF.
+	refreshRequiredHeader = "X-Requested-With"
+
+	// authResponseHeaderPrefix is added to auth endpoint response headers
+	// when prefixing is enabled.
+	authResponseHeaderPrefix = "X-Auth-Request-"
+
+	// revokeSessionTimeout bounds the time spent revoking a session's tokens
+	// at the provider, so that signing out isn't held up by a slow provider.
+	revokeSessionTimeout = 5 * time.Second
+
+	// flushTracesTimeout bounds the time spent exporting the remaining spans
+	// on shutdown
+	flushTracesTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNeedsLogin means the user should be redirected to the login page
+	ErrNeedsLogin = errors.New("redirect to login page")
+
+	// ErrAccessDenied means the user should receive a 401 Unauthorized response
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// allowedRoute manages method + path based allowlists
+type allowedRoute struct {
+	method    string
+	negate    bool
+	pathRegex *regexp.Regexp
+}
+
+type apiRoute struct {
+	pathRegex *regexp.Regexp
+}
+
+// recentAuthRoute requires the user to have authenticated within the maxAge
+// for requests whose path matches
+type recentAuthRoute struct {
+	pathRegex *regexp.Regexp
+	maxAge    time.Duration
+}
+
+// OAuthProxy is the main authentication proxy
+type OAuthProxy struct {
+	CookieOptions *options.Cookie
+	Validator     func(string) bool
+
+	// deniedEmailValidator reports whether an email is on the deny lists
+	deniedEmailValidator func(string) bool
+
+	SignInPath string
+
+	// defaultRedirect is where users are sent after signing in or out when
+	// the request doesn't give a redirect
+	defaultRedirect string
+
+	allowedRoutes       []allowedRoute
+	apiRoutes           []apiRoute
+	recentAuthRoutes    []recentAuthRoute
+	apiClientRules      apiclient.Rules
+	routeAccessRules    routeaccess.Rules
+	clock               clock.Clock // the clock the access windows of the route access rules are evaluated with
+	redirectURL         *url.URL    // the url to receive requests at
+	whitelistDomains    []string
+	provider            providers.Provider
+	sessionStore        sessionsapi.SessionStore
+	ProxyPrefix         string
+	basicAuthValidator  basic.Validator
+	basicAuthGroups     []string
+	SkipProviderButton  bool
+	skipAuthPreflight   bool
+	skipJwtBearerTokens bool
+	forceJSONErrors     bool
+	problemJSONErrors   bool
+	realClientIPParser  ipapi.RealClientIPParser
+	trustedIPs          *ip.NetSet
+
+	// corsPreflight allows CORS preflight requests to the preflight routes
+	// without authentication, answering them directly when respondToPreflight
+	// is set rather than passing them on to the upstream
+	corsPreflight      *middleware.CORSPreflight
+	respondToPreflight bool
+
+	// sessionResetPage renders a page explaining that the session was reset,
+	// rather than starting the login flow, when a session cookie that could
+	// not be decoded was cleared
+	sessionResetPage bool
+
+	// providerID is remembered in the provider cookie, which returning users
+	// are redirected to the login flow of when autoRedirectKnownProvider is set
+	providerID                string
+	autoRedirectKnownProvider bool
+
+	sessionRefresher   middleware.SessionRefresher
+	refreshMinInterval time.Duration
+
+	// silentRenew is set when sessions can be renewed without interaction,
+	// by passing prompt=none to the provider
+	silentRenew bool
+
+	identityAssertion *assertion.Signer
+	signedURL         *signedurl.Signer
+	probeCredentials  *probe.Credentials
+	sessionEvents     *sessionevents.Webhook
+	auditLogger       *audit.Logger
+	claimEnricher     *enrichment.Enricher
+	externalAuthz     *externalauthz.Authorizer
+
+	// crawlerFilter is set when crawlers are refused protected routes and
+	// the sign in endpoints
+	crawlerFilter *middleware.CrawlerFilter
+
+	// providerFallback is set when users can sign in with the fallback
+	// provider, the htpasswd login form, in the fallback mode
+	providerFallback *fallback.Monitor
+	fallbackMode     string
+
+	// debugSettings are set when the debug endpoints are enabled
+	debugSettings *debugSettings
+
+	// dynamicUpstreams is set when upstreams are registered at runtime from
+	// the dynamic upstreams directory
+	dynamicUpstreams *upstream.DynamicUpstreamsDir
+
+	// upstreamHealth is set when the servers of any of the upstreams are
+	// health checked
+	upstreamHealth upstream.HealthTable
+
+	// webSocketDrainTimeout is how long the proxied WebSocket connections are
+	// given to close on shutdown
+	webSocketDrainTimeout time.Duration
+
+	// shutdownTracing flushes the spans still to be exported on shutdown
+	shutdownTracing func(context.Context) error
+
+	// managementServer is set when the management endpoints are served by
+	// the management server rather than the proxy
+	managementServer bool
+
+	// maintenance is the maintenance mode, which answers the proxied routes
+	// with the maintenance page while it is enabled
+	maintenance *maintenance.Mode
+
+	// bearerSessions is set when sessions are given to clients as bearer
+	// tokens, so that no cookies are ever set
+	bearerSessions bool
+
+	// maxSessionsPerUser is the maximum number of concurrent sessions of each
+	// user, whose sessions are then tracked by the session store
+	maxSessionsPerUser int
+
+	// backchannelLogout signs out the sessions of the logout tokens posted by
+	// the provider, it is nil unless back-channel logout is enabled
+	backchannelLogout *backchannelLogout
+
+	// deviceAuthorization serves the endpoints of the device authorization
+	// grant, which sign in CLI clients
+	deviceAuthorization bool
+
+	// providerSelector serves the requests with the proxies of each of the
+	// providers, it is nil unless several providers are configured
+	providerSelector *providerSelector
+
+	// authResponseHeaders is set when the auth endpoint response headers are
+	// configured, in place of the default response headers
+	authResponseHeaders bool
+	authRedirectHeader  string
+
+	sessionChain      alice.Chain
+	headersChain      alice.Chain
+	headerLimitsChain alice.Chain
+	preAuthChain      alice.Chain
+	corsChain         alice.Chain
+	authResponseChain alice.Chain
+	pageWriter        pagewriter.Writer
+	server            proxyhttp.Server
+	upstreamProxy     http.Handler
+	serveMux          *mux.Router
+	redirectValidator redirect.Validator
+	appDirector       redirect.AppDirector
+	signOutDirector   redirect.AppDirector
+	signOutAllowGet   bool
+	appState          redirect.AppState
+}
+
+// NewOAuthProxy creates a new instance of OAuthProxy from the options provided
+func NewOAuthProxy(opts *options.Options, validator func(string) bool) (*OAuthProxy, error) {
+	baseOpts := opts
+	opts = applyProviderOverrides(opts)
+
+	routePrefix := buildRoutePrefix(opts)
+	opts = applyExternalURLPrefix(opts)
+
+	sessionStore, err := buildSessionStore(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var basicAuthValidator basic.Validator
+	if opts.HtpasswdFile != "" {
+		logger.Printf("using htpasswd file: %s", opts.HtpasswdFile)
+		var err error
+		basicAuthValidator, err = basic.NewHTPasswdValidator(opts.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not validate htpasswd: %v", err)
+		}
+	}
+
+	provider, err := providers.NewProvider(opts.Providers[0])
+	if err != nil {
+		return nil, fmt.Errorf("error intiailising provider: %v", err)
+	}
+	provider.Data().StoreClaims = opts.Session.StoreClaims
+
+	// The other providers are created first, so that the sign in page of the
+	// first provider can offer them all
+	otherProviders, err := buildOtherProviders(baseOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	backchannelLogout, err := newBackchannelLogout(opts, provider, sessionStore)
+	if err != nil {
+		return nil, fmt.Errorf("error initialising back-channel logout: %v", err)
+	}
+	if err := checkDeviceAuthorization(opts, provider); err != nil {
+		return nil, fmt.Errorf("error initialising device authorization: %v", err)
+	}
+
+	var providerFallback *fallback.Monitor
+	if opts.ProviderFallback.Provider != "" {
+		endpoints := buildProviderHealthEndpoints(opts.Providers[0], provider)
+		logger.Printf("Offering the %s fallback provider in %s mode, checking the health of %s", opts.ProviderFallback.Provider, opts.ProviderFallback.Mode, strings.Join(endpoints, ", "))
+		providerFallback = fallback.NewMonitor(opts.ProviderFallback, endpoints, prometheus.DefaultRegisterer)
+		providerFallback.Start(nil)
+	}
+
+	pageWriter, err := buildPageWriter(opts, provider, basicAuthValidator, providerFallback, buildSignInProviders(baseOpts, provider, otherProviders))
+	if err != nil {
+		return nil, err
+	}
+
+	var auditLogger *audit.Logger
+	if opts.Audit.Enabled() {
+		logger.Printf("Writing audit events to the audit log")
+		auditLogger, err = audit.NewLogger(opts.Audit, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising audit log: %v", err)
+		}
+	}
+
+	var recordDenial upstream.DenialFunc
+	if auditLogger != nil {
+		recordDenial = auditLogger.RecordUpstreamDenial
+	}
+	upstreamProxy, err := upstream.NewProxy(opts.UpstreamServers, opts.GetSignatureData(), pageWriter, opts.Logging.SlowRequests, opts.ResponseHeaderPolicy, opts.Session.StoreUnavailable, opts.Cookie.Name, opts.Session.Redis, opts.GetRealClientIPParser(), provider.Data(), recordDenial)
+	if err != nil {
+		return nil, fmt.Errorf("error initialising upstream proxy: %v", err)
+	}
+
+	var identityAssertion *assertion.Signer
+	if opts.IdentityAssertion.SigningKeyFile != "" || opts.IdentityAssertion.SigningJWKSFile != "" {
+		identityAssertion, err = assertion.NewSigner(opts.IdentityAssertion)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising identity assertion signer: %v", err)
+		}
+	}
+
+	var signedURL *signedurl.Signer
+	if opts.SignedURL.KeyFile != "" {
+		signedURL, err = signedurl.NewSigner(opts.SignedURL)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising signed url signer: %v", err)
+		}
+	}
+
+	var introspector *introspection.Introspector
+	if opts.Introspection.URL != "" {
+		logger.Printf("Introspecting opaque bearer tokens with %q", opts.Introspection.URL)
+		introspector, err = introspection.NewIntrospector(opts.Introspection, opts.Providers[0].OIDCConfig, opts.Session.StoreClaims, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising token introspection: %v", err)
+		}
+	}
+
+	var claimEnricher *enrichment.Enricher
+	if opts.ClaimEnrichment.URL != "" {
+		logger.Printf("Enriching session claims from %q", opts.ClaimEnrichment.URL)
+		claimEnricher, err = enrichment.NewEnricher(opts.ClaimEnrichment, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising claim enrichment: %v", err)
+		}
+	}
+
+	var externalAuthz *externalauthz.Authorizer
+	if opts.ExternalAuthz.URL != "" {
+		logger.Printf("Authorizing requests with %q", opts.ExternalAuthz.URL)
+		externalAuthz, err = externalauthz.NewAuthorizer(opts.ExternalAuthz, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising external authorization: %v", err)
+		}
+	}
+
+	var probeCredentials *probe.Credentials
+	if len(opts.Probe.Credentials) > 0 {
+		for _, credential := range opts.Probe.Credentials {
+			logger.Printf("Probe credential: %s", credential)
+		}
+		probeCredentials, err = probe.NewCredentials(opts.Probe)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising probe credentials: %v", err)
+		}
+		if err := probeCredentials.WatchTokenFiles(nil); err != nil {
+			return nil, fmt.Errorf("error watching probe credentials: %v", err)
+		}
+	}
+
+	var sessionEvents *sessionevents.Webhook
+	if opts.SessionEvents.WebhookURL != "" {
+		logger.Printf("Delivering session events to %q", opts.SessionEvents.WebhookURL)
+		sessionEvents, err = sessionevents.NewWebhook(opts.SessionEvents, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising session events: %v", err)
+		}
+	}
+
+	maintenanceMode := maintenance.NewMode(opts.Maintenance, newMaintenanceAudit(sessionEvents))
+	if err := maintenanceMode.Watch(nil); err != nil {
+		return nil, fmt.Errorf("error initialising maintenance mode: %v", err)
+	}
+	if maintenanceMode.Enabled() {
+		logger.Printf("Starting in maintenance mode, set by the %s", maintenanceMode.State().Source)
+	}
+
+	var dynamicUpstreams *upstream.DynamicUpstreamsDir
+	if opts.DynamicUpstreams.Dir != "" {
+		logger.Printf("Registering dynamic upstreams from %q", opts.DynamicUpstreams.Dir)
+		dynamicUpstreams, err = buildDynamicUpstreams(opts, upstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising dynamic upstreams: %v", err)
+		}
+	}
+	if opts.KubernetesDiscovery.Selector != "" {
+		logger.Printf("Registering the upstreams of the Kubernetes Services matching %q", opts.KubernetesDiscovery.Selector)
+		if err := buildKubernetesDiscovery(opts, upstreamProxy); err != nil {
+			return nil, fmt.Errorf("error initialising Kubernetes discovery: %v", err)
+		}
+	}
+
+	var crawlerFilter *middleware.CrawlerFilter
+	if opts.Crawlers.Detection {
+		crawlerFilter, err = middleware.NewCrawlerFilter(opts.Crawlers, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising crawler detection: %v", err)
+		}
+	}
+
+	if opts.SkipJwtBearerTokens {
+		logger.Printf("Skipping JWT tokens from configured OIDC issuer: %q", opts.Providers[0].OIDCConfig.IssuerURL)
+		for _, issuer := range opts.ExtraJwtIssuers {
+			logger.Printf("Skipping JWT tokens from extra JWT issuer: %q", issuer)
+		}
+	}
+	redirectURL := opts.GetRedirectURL()
+	if redirectURL.Path == "" {
+		redirectURL.Path = fmt.Sprintf("%s%s", opts.ProxyPrefix, oauthCallbackPath)
+	}
+
+	logger.Printf("OAuthProxy configured for %s Client ID: %s", provider.Data().ProviderName, opts.Providers[0].ClientID)
+	refresh := "disabled"
+	if opts.Cookie.Refresh != time.Duration(0) {
+		refresh = fmt.Sprintf("after %s", opts.Cookie.Refresh)
+	}
+
+	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domains:%s path:%s samesite:%s refresh:%s", opts.Cookie.Name, opts.Cookie.Secure, opts.Cookie.HTTPOnly, opts.Cookie.Expire, strings.Join(opts.Cookie.Domains, ","), opts.Cookie.Path, opts.Cookie.SameSite, refresh)
+
+	trustedIPs := ip.NewNetSet()
+	for _, ipStr := range opts.TrustedIPs {
+		if ipNet := ip.ParseIPNet(ipStr); ipNet != nil {
+			trustedIPs.AddIPNet(*ipNet)
+		} else {
+			return nil, fmt.Errorf("could not parse IP network (%s)", ipStr)
+		}
+	}
+
+	allowedRoutes, err := buildRoutesAllowlist(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	apiRoutes, err := buildAPIRoutes(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	recentAuthRoutes, err := buildRecentAuthRoutes(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	apiClientRules, err := buildAPIClientRules(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	routeAccessRules, err := buildRouteAccessRules(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	corsPreflight, err := middleware.NewCORSPreflight(opts.CORS)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTracing, err := tracing.Configure(opts.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure tracing: %v", err)
+	}
+
+	preAuthChain, err := buildPreAuthChain(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not build pre-auth chain: %v", err)
+	}
+	sessionChain := buildSessionChain(opts, provider, sessionStore, basicAuthValidator, introspector, sessionEvents, auditLogger, claimEnricher)
+	headersChain, err := buildHeadersChain(opts, identityAssertion)
+	if err != nil {
+		return nil, fmt.Errorf("could not build headers chain: %v", err)
+	}
+	authResponseChain, err := buildAuthResponseChain(opts, headersChain, identityAssertion)
+	if err != nil {
+		return nil, fmt.Errorf("could not build auth response chain: %v", err)
+	}
+	if len(opts.SessionDebug.HeaderRoutes) > 0 || opts.SessionDebug.OptInHeader != "" {
+		sessionDebugHeaders, err := middleware.NewSessionDebugHeaders(opts.SessionDebug)
+		if err != nil {
+			return nil, fmt.Errorf("could not build session debug headers: %v", err)
+		}
+		headersChain = headersChain.Append(sessionDebugHeaders)
+		authResponseChain = authResponseChain.Append(sessionDebugHeaders)
+	}
+	if opts.SessionExpiry.Header {
+		// Only the responses proxied from the upstreams are pages that can
+		// warn users, the auth endpoint responses never are
+		headersChain = headersChain.Append(middleware.NewSessionExpiryHeader(opts.Cookie.Expire))
+	}
+	if auditLogger != nil && auditLogger.Enabled(options.AuditEventUpstreamAccess) {
+		headersChain = headersChain.Append(middleware.NewUpstreamAccessRecorder(auditLogger.RecordUpstreamAccess))
+	}
+
+	// The same policy applies to every redirect, and to the URLs signed by
+	// the sign-url endpoint
+	redirectValidator := redirect.NewValidator(opts.WhitelistDomains, redirect.Loopback{
+		Allow: opts.Redirect.AllowLoopback,
+		Ports: opts.Redirect.LoopbackPorts,
+	})
+	appDirector, signOutDirector := buildAppDirectors(opts, redirectValidator)
+
+	p := &OAuthProxy{
+		CookieOptions: &opts.Cookie,
+		Validator:     validator,
+
+		deniedEmailValidator: NewDenyValidator(opts.DeniedEmails, opts.DeniedEmailDomains),
+
+		SignInPath: fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
+
+		// Users are sent to the root of the application by default
+		defaultRedirect: opts.ExternalURLPrefix + "/",
+
+		ProxyPrefix:         opts.ProxyPrefix,
+		provider:            provider,
+		sessionStore:        sessionStore,
+		redirectURL:         redirectURL,
+		apiRoutes:           apiRoutes,
+		recentAuthRoutes:    recentAuthRoutes,
+		apiClientRules:      apiClientRules,
+		routeAccessRules:    routeAccessRules,
+		allowedRoutes:       allowedRoutes,
+		whitelistDomains:    opts.WhitelistDomains,
+		skipAuthPreflight:   opts.SkipAuthPreflight,
+		skipJwtBearerTokens: opts.SkipJwtBearerTokens,
+		realClientIPParser:  opts.GetRealClientIPParser(),
+		SkipProviderButton:  opts.SkipProviderButton,
+		forceJSONErrors:     opts.ForceJSONErrors,
+		problemJSONErrors:   opts.Templates.ProblemJSON,
+		trustedIPs:          trustedIPs,
+
+		corsPreflight:      corsPreflight,
+		respondToPreflight: opts.CORS.RespondToPreflight,
+
+		sessionResetPage: opts.Session.ResetPage,
+
+		providerID:                opts.Providers[0].ID,
+		autoRedirectKnownProvider: opts.AutoRedirectKnownProvider,
+
+		basicAuthValidator: basicAuthValidator,
+		basicAuthGroups:    opts.HtpasswdUserGroups,
+		sessionRefresher:   buildSessionRefresher(opts, provider, sessionStore, claimEnricher),
+		refreshMinInterval: opts.Session.RefreshMinInterval,
+		silentRenew:        opts.SessionExpiry.SilentRenew,
+
+		identityAssertion:  identityAssertion,
+		signedURL:          signedURL,
+		probeCredentials:   probeCredentials,
+		sessionEvents:      sessionEvents,
+		auditLogger:        auditLogger,
+		claimEnricher:      claimEnricher,
+		externalAuthz:      externalAuthz,
+		crawlerFilter:      crawlerFilter,
+		providerFallback:   providerFallback,
+		fallbackMode:       opts.ProviderFallback.Mode,
+		debugSettings:      buildDebugSettings(opts),
+		dynamicUpstreams:   dynamicUpstreams,
+		upstreamHealth:     buildUpstreamHealth(opts, upstreamProxy),
+		managementServer:   opts.ManagementServer.Enabled(),
+		maintenance:        maintenanceMode,
+		bearerSessions:     opts.Session.BearerTokens,
+		maxSessionsPerUser: opts.Session.MaxPerUser,
+		backchannelLogout:  backchannelLogout,
+
+		deviceAuthorization: opts.DeviceAuthorization,
+
+		authResponseHeaders: len(opts.AuthResponse.Headers) > 0,
+		authRedirectHeader:  opts.AuthResponse.RedirectHeader,
+
+		webSocketDrainTimeout: opts.WebSocketDrainTimeout,
+		shutdownTracing:       shutdownTracing,
+
+		sessionChain:      sessionChain,
+		headersChain:      headersChain,
+		preAuthChain:      preAuthChain,
+		corsChain:         alice.New(middleware.NewCORS(opts.CORS)),
+		authResponseChain: authResponseChain,
+		pageWriter:        pageWriter,
+		upstreamProxy:     upstreamProxy,
+		redirectValidator: redirectValidator,
+		appDirector:       appDirector,
+		signOutDirector:   signOutDirector,
+		signOutAllowGet:   opts.SignOut.AllowGet,
+		appState: redirect.AppState{
+			Parameter:         opts.Redirect.AppStateParameter,
+			RedirectParameter: opts.Redirect.AppStateRedirectParameter,
+			MaxSize:           opts.Redirect.AppStateMaxSize,
+		},
+	}
+	// Rejected requests are written by the proxy, so the chain is built once
+	// it exists
+	p.buildHeaderLimitsChain(opts)
+	p.buildServeMux(routePrefix)
+
+	if len(otherProviders) > 0 {
+		p.providerSelector, err = p.buildProviderSelector(baseOpts, routePrefix, otherProviders, introspector)
+		if err != nil {
+			return nil, fmt.Errorf("error initialising providers: %v", err)
+		}
+	}
+
+	if err := p.setupServer(opts); err != nil {
+		return nil, fmt.Errorf("error setting up server: %v", err)
+	}
+
+	return p, nil
+}
+
+// buildHeaderLimitsChain builds the chain rejecting the requests exceeding the
+// request header limits with the error page of the proxy
+func (p *OAuthProxy) buildHeaderLimitsChain(opts *options.Options) {
+	p.headerLimitsChain = alice.New(middleware.NewRequestHeaderLimitsWithDefaultRegistry(middleware.RequestHeaderLimits{
+		MaxHeaderBytes: opts.MaxRequestHeaderBytes,
+		MaxCookies:     opts.MaxRequestCookies,
+		Rejected:       p.requestHeaderLimitsExceeded,
+	}))
+}
+
+func (p *OAuthProxy) Start() error {
+	if p.server == nil {
+		// We have to call setupServer before Start is called.
+		// If this doesn't happen it's a programming error.
+		panic("server has not been initialised")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Observe signals in background goroutine.
+	go func() {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+		<-sigint
+		cancel() // cancel the context
+	}()
+
+	err := p.server.Start(ctx)
+	p.drainWebSockets()
+	p.flushTraces()
+	p.stopAudit()
+	return err
+}
+
+// stopAudit writes the audit events still queued and closes the audit sinks,
+// once the servers have been shut down and no more events are recorded
+func (p *OAuthProxy) stopAudit() {
+	if p.auditLogger != nil {
+		p.auditLogger.Stop()
+	}
+}
+
+// flushTraces exports the spans still to be exported, once the servers have
+// been shut down
+func (p *OAuthProxy) flushTraces() {
+	if p.shutdownTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flushTracesTimeout)
+	defer cancel()
+	if err := p.shutdownTracing(ctx); err != nil {
+		logger.Errorf("Error flushing traces: %v", err)
+	}
+}
+
+// drainWebSockets gives the proxied WebSocket connections the drain timeout
+// to close, once the servers have been shut down.
+// The servers don't wait for them, as they are hijacked from the servers by
+// their upgrade.
+func (p *OAuthProxy) drainWebSockets() {
+	drainer, ok := p.upstreamProxy.(upstream.WebSocketDrainer)
+	if !ok {
+		return
+	}
+	if p.webSocketDrainTimeout > 0 {
+		logger.Printf("Draining WebSocket connections for up to %s", p.webSocketDrainTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.webSocketDrainTimeout)
+	defer cancel()
+	drainer.DrainWebSockets(ctx)
+}
+
+func (p *OAuthProxy) setupServer(opts *options.Options) error {
+	serverOpts := proxyhttp.Opts{
+		Handler:           p,
+		BindAddress:       opts.Server.BindAddress,
+		SecureBindAddress: opts.Server.SecureBindAddress,
+		TLS:               opts.Server.TLS,
+		// gRPC clients of h2c upstreams can only reach them over HTTP/2
+		HTTP2: hasH2CUpstream(opts.UpstreamServers),
+		// Only the traffic of the users passes through the L4 load balancers
+		ProxyProtocol:           opts.ProxyProtocol,
+		ProxyProtocolTrustedIPs: opts.ProxyProtocolTrustedIPs,
+	}
+
+	appServer, err := proxyhttp.NewServer(serverOpts)
+	if err != nil {
+		return fmt.Errorf("could not build app server: %v", err)
+	}
+
+	metricsAuth, err := middleware.NewMetricsAuth(opts.MetricsAuth, p.basicAuthValidator)
+	if err != nil {
+		return fmt.Errorf("could not build metrics auth: %v", err)
+	}
+
+	metricsServer, err := proxyhttp.NewServer(proxyhttp.Opts{
+		Handler:           metricsAuth(middleware.DefaultMetricsHandler),
+		BindAddress:       opts.MetricsServer.BindAddress,
+		SecureBindAddress: opts.MetricsServer.SecureBindAddress,
+		TLS:               opts.MetricsServer.TLS,
+	})
+	if err != nil {
+		return fmt.Errorf("could not build metrics server: %v", err)
+	}
+
+	servers := []proxyhttp.Server{appServer, metricsServer}
+	if p.managementServer {
+		managementHandler, err := p.buildManagementHandler(opts)
+		if err != nil {
+			return err
+		}
+		managementServer, err := proxyhttp.NewServer(proxyhttp.Opts{
+			Handler:           managementHandler,
+			BindAddress:       opts.ManagementServer.BindAddress,
+			SecureBindAddress: opts.ManagementServer.SecureBindAddress,
+			TLS:               opts.ManagementServer.TLS,
+		})
+		if err != nil {
+			return fmt.Errorf("could not build management server: %v", err)
+		}
+		servers = append(servers, managementServer)
+	}
+
+	p.server = proxyhttp.NewServerGroup(servers...)
+	return nil
+}
+
+func (p *OAuthProxy) buildServeMux(proxyPrefix string) {
+	// Use the encoded path here so we can have the option to pass it on in the upstream mux.
+	// Otherwise something like /%2F/ would be redirected to / here already.
+	r := mux.NewRouter().UseEncodedPath()
+	// Everything served by the router must go through the preAuthChain first.
+	r.Use(p.preAuthChain.Then)
+
+	// Register the robots path writer
+	r.Path(robotsPath).HandlerFunc(p.pageWriter.WriteRobotsTxt)
+
+	if p.managementServer {
+		p.registerManagementNotFound(r, proxyPrefix)
+	}
+
+	// The authonly path should be registered separately to prevent it from getting no-cache headers.
+	// We do this to allow users to have a short cache (via nginx) of the response to reduce the
+	// likelihood of multiple reuests trying to referesh sessions simultaneously.
+	r.Path(proxyPrefix + authOnlyPath).Handler(p.corsChain.Then(p.sessionChain.ThenFunc(p.AuthOnly)))
+
+	// This will register all of the paths under the proxy prefix, except the auth only path so that no cache headers
+	// are not applied.
+	p.buildProxySubrouter(r.PathPrefix(proxyPrefix).Subrouter())
+
+	// Register serveHTTP last so it catches anything that isn't already caught earlier.
+	// Anything that got to this point needs to have a session loaded.
+	// The request header limits only apply to requests to the upstreams, so
+	// that users can still reach the endpoints clearing their cookies.
+	// Crawlers are refused protected routes before their session is loaded.
+	r.PathPrefix("/").Handler(p.headerLimitsChain.Then(p.refuseCrawlers("proxy", p.isPublicRequest, p.sessionChain.ThenFunc(p.Proxy))))
+	p.serveMux = r
+}
+
+// refuseCrawlers wraps the handler of the endpoint so that crawlers are
+// refused it, unless the skip function allows them, when crawler detection
+// is enabled.
+func (p *OAuthProxy) refuseCrawlers(endpoint string, skip func(*http.Request) bool, next http.Handler) http.Handler {
+	if p.crawlerFilter == nil {
+		return next
+	}
+	return p.crawlerFilter.Refuse(endpoint, skip)(next)
+}
+
+// isPublicRequest checks whether the request is allowed without a session,
+// so that crawlers can still reach the routes that aren't protected
+func (p *OAuthProxy) isPublicRequest(req *http.Request) bool {
+	return p.IsAllowedRequest(req) || p.isAnonymousRequest(req) || (p.signedURL != nil && signedurl.IsSigned(req))
+}
+
+func (p *OAuthProxy) buildProxySubrouter(s *mux.Router) {
+	s.Use(prepareNoCacheMiddleware)
+	// CORS headers are only ever added to the OAuth2 Proxy endpoints, never
+	// to upstream responses
+	s.Use(p.corsChain.Then)
+
+	// Crawlers are never allowed to start sign in flows
+	s.Path(signInPath).Handler(p.refuseCrawlers("sign_in", nil, http.HandlerFunc(p.SignIn)))
+	// Bearer sessions are signed out by deleting them, there are no cookies
+	// to clear
+	if p.bearerSessions {
+		s.Path(sessionPath).Handler(p.sessionChain.ThenFunc(p.DeleteSession))
+	} else {
+		s.Path(signOutPath).HandlerFunc(p.SignOut)
+	}
+	s.Path(oauthStartPath).Handler(p.refuseCrawlers("oauth_start", nil, http.HandlerFunc(p.OAuthStart)))
+	// The provider posts logout tokens without the session of the user
+	if p.backchannelLogout != nil {
+		s.Path(backchannelLogoutPath).HandlerFunc(p.BackchannelLogout)
+	}
+	s.Path(oauthCallbackPath).Handler(p.refuseCrawlers("oauth_callback", nil, http.HandlerFunc(p.OAuthCallback)))
+	if p.deviceAuthorization {
+		s.Path(devicePath).HandlerFunc(p.DeviceAuthorization)
+		s.Path(deviceTokenPath).HandlerFunc(p.DeviceToken)
+	}
+
+	// The userinfo endpoint needs to load sessions before handling the request
+	s.Path(userInfoPath).Handler(p.sessionChain.ThenFunc(p.UserInfo))
+	s.Path(refreshPath).Handler(p.sessionChain.ThenFunc(p.SessionRefresh))
+	s.Path(sessionExpiryPath).Handler(p.sessionChain.ThenFunc(p.SessionExpiry))
+
+	// Upstreams verify identity assertions with the published keys
+	if p.identityAssertion != nil {
+		s.Path(jwksPath).HandlerFunc(p.identityAssertion.ServeJWKS)
+	}
+
+	// Signing URLs requires a session, requests to the signed URLs don't
+	if p.signedURL != nil {
+		s.Path(signURLPath).Handler(p.sessionChain.ThenFunc(p.SignURL))
+	}
+
+	// The debug endpoints are only served when enabled, and always require a
+	// session
+	if p.debugSettings != nil {
+		s.Path(debugConfigPath).Handler(p.sessionChain.ThenFunc(p.DebugConfig))
+		s.Path(debugRoutePath).Handler(p.sessionChain.ThenFunc(p.DebugRoute))
+	}
+
+	// The dynamic upstreams can only be listed with a session, unless they
+	// are listed by the management server
+	if p.dynamicUpstreams != nil && !p.managementServer {
+		s.Path(dynamicUpstreamsPath).Handler(p.sessionChain.ThenFunc(p.DynamicUpstreams))
+	}
+
+	// The health of the upstreams can only be listed with a session, unless
+	// it is listed by the management server
+	if p.upstreamHealth != nil && !p.managementServer {
+		s.Path(upstreamsPath).Handler(p.sessionChain.ThenFunc(p.UpstreamsHealth))
+	}
+}
+
+// hasH2CUpstream returns whether any of the upstreams is served over HTTP/2
+// without TLS
+func hasH2CUpstream(upstreams options.UpstreamConfig) bool {
+	for _, u := range upstreams.Upstreams {
+		if strings.HasPrefix(u.URI, "h2c://") {
+			return true
+		}
+	}
+	return false
+}
+
+// buildUpstreamHealth returns the health of the upstreams of the upstream
+// proxy, when any of them is health checked, or they can be reloaded with
+// health checks
+func buildUpstreamHealth(opts *options.Options, upstreamProxy http.Handler) upstream.HealthTable {
+	health, ok := upstreamProxy.(upstream.HealthTable)
+	if !ok {
+		return nil
+	}
+	if opts.ReloadUpstreams {
+		return health
+	}
+	for _, u := range opts.UpstreamServers.Upstreams {
+		if u.HealthCheck != nil {
+			return health
+		}
+	}
+	return nil
+}
+
+// buildDynamicUpstreams registers the upstreams of the dynamic upstreams
+// directory with the upstream proxy, validating them as at startup, and
+// watches the directory for changes
+func buildDynamicUpstreams(opts *options.Options, upstreamProxy http.Handler) (*upstream.DynamicUpstreamsDir, error) {
+	router, ok := upstreamProxy.(upstream.DynamicRouter)
+	if !ok {
+		return nil, errors.New("the upstream proxy can't register upstreams at runtime")
+	}
+	validate := func(dynamic options.DynamicUpstream, accepted []options.Upstream) error {
+		return validation.ValidateDynamicUpstream(opts, dynamic, accepted)
+	}
+
+	dynamicUpstreams := upstream.NewDynamicUpstreamsDir(opts.DynamicUpstreams, router, validate, prometheus.DefaultRegisterer)
+	if err := dynamicUpstreams.Watch(nil); err != nil {
+		return nil, err
+	}
+	return dynamicUpstreams, nil
+}
+
+// buildKubernetesDiscovery registers the upstreams of the Kubernetes
+// Services matching the selector with the upstream proxy, validating them as
+// dynamic upstreams, and watches the Services and their endpoints for changes
+func buildKubernetesDiscovery(opts *options.Options, upstreamProxy http.Handler) error {
+	router, ok := upstreamProxy.(upstream.DynamicRouter)
+	if !ok {
+		return errors.New("the upstream proxy can't register upstreams at runtime")
+	}
+	validate := func(dynamic options.DynamicUpstream, accepted []options.Upstream) error {
+		return validation.ValidateDynamicUpstream(opts, dynamic, accepted)
+	}
+
+	discovery, err := upstream.NewKubernetesDiscovery(opts.KubernetesDiscovery, router, validate, prometheus.DefaultRegisterer)
+	if err != nil {
+		return err
+	}
+	return discovery.Watch(nil)
+}
+
+// WatchUpstreamConfig reloads the upstreams of the upstream proxy with the
+// upstreams of the loader whenever the files, or the YAML files of the
+// directory, change, or on SIGHUP
+func (p *OAuthProxy) WatchUpstreamConfig(files []string, dir string, load upstream.UpstreamConfigLoader) error {
+	router, ok := p.upstreamProxy.(upstream.ConfigRouter)
+	if !ok {
+		return errors.New("the upstream proxy can't reload its upstreams")
+	}
+	return upstream.NewUpstreamConfigWatcher(files, dir, load, router, prometheus.DefaultRegisterer).Watch(nil)
+}
+
+// buildPreAuthChain constructs a chain that should process every request before
+// the OAuth2 Proxy authentication logic kicks in.
+// For example forcing HTTPS or health checks.
+func buildPreAuthChain(opts *options.Options) (alice.Chain, error) {
+	chain := alice.New(middleware.NewScope(opts.ReverseProxy, opts.Logging.RequestIDHeader, buildRequestIDTrust(opts)))
+
+	// The request debug header is removed before anything else handles the
+	// request, so that all log lines of the request are written
+	if debug := opts.Logging.RequestDebug; debug.Header != "" {
+		chain = chain.Append(middleware.NewRequestDebugHeader(debug.Header, debug.Secret))
+	}
+
+	// The global response header policy applies to the proxy's own pages,
+	// upstreams apply it along with their own policy
+	if policy := header.NewResponsePolicy(opts.ResponseHeaderPolicy, nil); !policy.Empty() {
+		chain = chain.Append(policy.Handler)
+	}
+
+	if opts.SanitizeForwardedHeaders {
+		chain = chain.Append(middleware.NewForwardedHeadersSanitizer(newTrustedProxyMatcher(opts.TrustedProxyIPs)))
+	}
+
+	if opts.ForceHTTPS {
+		_, httpsPort, err := net.SplitHostPort(opts.Server.SecureBindAddress)
+		if err != nil {
+			return alice.Chain{}, fmt.Errorf("invalid HTTPS address %q: %v", opts.Server.SecureBindAddress, err)
+		}
+		chain = chain.Append(middleware.NewRedirectToHTTPS(httpsPort))
+	}
+
+	healthCheckPaths := []string{opts.PingPath}
+	healthCheckUserAgents := []string{opts.PingUserAgent}
+	if opts.GCPHealthChecks {
+		logger.Printf("WARNING: GCP HealthChecks are now deprecated: Reconfigure apps to use the ping path for liveness and readiness checks, set the ping user agent to \"GoogleHC/1.0\" to preserve existing behaviour")
+		healthCheckPaths = append(healthCheckPaths, "/liveness_check", "/readiness_check")
+		healthCheckUserAgents = append(healthCheckUserAgents, "GoogleHC/1.0")
+	}
+
+	// To silence logging of health checks, register the health check handler before
+	// the logging handler
+	if opts.Logging.SilencePing {
+		chain = chain.Append(
+			middleware.NewHealthCheck(healthCheckPaths, healthCheckUserAgents),
+			middleware.NewRequestLogger(),
+		)
+	} else {
+		chain = chain.Append(
+			middleware.NewRequestLogger(),
+			middleware.NewHealthCheck(healthCheckPaths, healthCheckUserAgents),
+		)
+	}
+
+	// Health checks aren't traced
+	chain = chain.Append(
+		middleware.NewTracing(),
+		middleware.NewRequestMetricsWithDefaultRegistry(),
+	)
+
+	return chain, nil
+}
+
+// buildRequestIDTrust determines whether the request ID of an incoming
+// request should be adopted, based on the configured request ID trust mode.
+func buildRequestIDTrust(opts *options.Options) func(*http.Request) bool {
+	switch opts.Logging.RequestIDTrust {
+	case options.RequestIDTrustAlways:
+		return func(*http.Request) bool { return true }
+	case options.RequestIDTrustTrustedProxies:
+		return newTrustedProxyMatcher(opts.TrustedProxyIPs)
+	default:
+		return func(*http.Request) bool { return false }
+	}
+}
+
+// newTrustedProxyMatcher returns a function that checks whether the peer
+// connected to oauth2-proxy is one of the trusted proxies.
+func newTrustedProxyMatcher(trustedProxyIPs []string) func(*http.Request) bool {
+	trustedProxies := ip.NewNetSet()
+	for _, ipStr := range trustedProxyIPs {
+		if ipNet := ip.ParseIPNet(ipStr); ipNet != nil {
+			trustedProxies.AddIPNet(*ipNet)
+		}
+	}
+
+	return func(req *http.Request) bool {
+		remoteAddr, err := ip.GetClientIP(nil, req)
+		if err != nil || remoteAddr == nil {
+			return false
+		}
+		return trustedProxies.Has(remoteAddr)
+	}
+}
+
+func buildSessionChain(opts *options.Options, provider providers.Provider, sessionStore sessionsapi.SessionStore, validator basic.Validator, introspector *introspection.Introspector, sessionEvents *sessionevents.Webhook, auditLogger *audit.Logger, claimEnricher *enrichment.Enricher) alice.Chain {
+	chain := alice.New()
+
+	if opts.SkipJwtBearerTokens {
+		providerID := opts.Providers[0].ID
+		sessionLoaders := []middlewareapi.TokenToSessionFunc{
+			func(ctx context.Context, token string) (*sessionsapi.SessionState, error) {
+				// Bearer tokens of the provider are tagged like its logins
+				session, err := provider.CreateSessionFromToken(ctx, token)
+				if session != nil {
+					session.AuthProvider = providerID
+				}
+				return session, err
+			},
+		}
+
+		for _, verifier := range opts.GetJWTBearerVerifiers() {
+			sessionLoaders = append(sessionLoaders,
+				middlewareapi.CreateTokenToSessionFunc(verifier.Verify))
+		}
+
+		chain = chain.Append(middleware.NewJwtSessionLoader(sessionLoaders))
+	}
+
+	// Opaque bearer tokens are introspected when they aren't verified as JWTs
+	if introspector != nil {
+		chain = chain.Append(middleware.NewIntrospectionSessionLoader(introspector.TokenToSession))
+	}
+
+	if validator != nil {
+		chain = chain.Append(middleware.NewBasicAuthSessionLoader(validator, opts.HtpasswdUserGroups, opts.LegacyPreferEmailToUser))
+	}
+
+	var refreshFailed func(*http.Request, *sessionsapi.SessionState, error)
+	var refreshed func(*http.Request, *sessionsapi.SessionState)
+	if sessionEvents != nil || auditLogger != nil {
+		refreshFailed = func(req *http.Request, session *sessionsapi.SessionState, err error) {
+			if sessionEvents != nil {
+				sessionEvents.Send(options.SessionEventRefreshFailure, session.Email, req, logger.AuthError, "Unable to refresh session: %v", err)
+			}
+			if auditLogger != nil {
+				auditLogger.Record(options.AuditEventSessionRefreshed, req, session, audit.OutcomeFailure, "Unable to refresh session: %v", err)
+			}
+		}
+	}
+	if auditLogger != nil {
+		refreshed = func(req *http.Request, session *sessionsapi.SessionState) {
+			auditLogger.Record(options.AuditEventSessionRefreshed, req, session, audit.OutcomeSuccess, "Refreshed session")
+		}
+	}
+
+	chain = chain.Append(middleware.NewStoredSessionLoader(&middleware.StoredSessionLoaderOptions{
+		SessionStore:    sessionStore,
+		RefreshPeriod:   opts.Cookie.Refresh,
+		RefreshJitter:   opts.Cookie.RefreshJitter,
+		RefreshWindow:   opts.Cookie.RefreshWindow,
+		RefreshSession:  buildRefreshSession(provider, claimEnricher),
+		ValidateSession: provider.ValidateSession,
+		DegradeOnStoreUnavailable: usesSessionStorePolicy(opts, options.SessionStoreFailOpenAnonymous) ||
+			usesSessionStorePolicy(opts, options.SessionStoreFailOpenCached),
+		RefreshFailed: refreshFailed,
+		Refreshed:     refreshed,
+	}))
+
+	if len(opts.Logging.RequestDebug.Emails) > 0 {
+		chain = chain.Append(middleware.NewRequestDebugEmails(opts.Logging.RequestDebug.Emails))
+	}
+
+	return chain
+}
+
+// usesSessionStorePolicy checks whether the session store unavailable policy
+// is used globally or by any upstream
+func usesSessionStorePolicy(opts *options.Options, policy string) bool {
+	if opts.Session.StoreUnavailable == policy {
+		return true
+	}
+	for _, u := range opts.UpstreamServers.Upstreams {
+		if u.SessionStoreUnavailable == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSessionRefresher constructs the refresher used by the refresh endpoint.
+// It must use the same session store and provider as the session chain.
+func buildSessionRefresher(opts *options.Options, provider providers.Provider, sessionStore sessionsapi.SessionStore, claimEnricher *enrichment.Enricher) middleware.SessionRefresher {
+	return middleware.NewStoredSessionRefresher(&middleware.StoredSessionLoaderOptions{
+		SessionStore:    sessionStore,
+		RefreshPeriod:   opts.Cookie.Refresh,
+		RefreshJitter:   opts.Cookie.RefreshJitter,
+		RefreshWindow:   opts.Cookie.RefreshWindow,
+		RefreshSession:  buildRefreshSession(provider, claimEnricher),
+		ValidateSession: provider.ValidateSession,
+	})
+}
+
+// buildRefreshSession returns the provider's session refresh, which also
+// enriches the claims of the refreshed sessions when claim enrichment is
+// enabled.
+// Sessions of providers that don't implement refreshing are treated as
+// refreshed by the session loader, so their claims are enriched as well.
+func buildRefreshSession(provider providers.Provider, claimEnricher *enrichment.Enricher) func(context.Context, *sessionsapi.SessionState) (bool, error) {
+	if claimEnricher == nil {
+		return provider.RefreshSession
+	}
+	return func(ctx context.Context, session *sessionsapi.SessionState) (bool, error) {
+		refreshed, err := provider.RefreshSession(ctx, session)
+		if (err == nil && refreshed) || errors.Is(err, providers.ErrNotImplemented) {
+			claimEnricher.Refresh(ctx, session)
+		}
+		return refreshed, err
+	}
+}
+
+func buildHeadersChain(opts *options.Options, identityAssertion *assertion.Signer) (alice.Chain, error) {
+	requestInjector, err := middleware.NewRequestHeaderInjector(opts.InjectRequestHeaders)
+	if err != nil {
+		return alice.Chain{}, fmt.Errorf("error constructing request header injector: %v", err)
+	}
+
+	responseInjector, err := middleware.NewResponseHeaderInjector(opts.InjectResponseHeaders)
+	if err != nil {
+		return alice.Chain{}, fmt.Errorf("error constructing request header injector: %v", err)
+	}
+
+	chain := alice.New(requestInjector, responseInjector)
+	if identityAssertion != nil {
+		chain = chain.Append(middleware.NewIdentityAssertionInjector(identityAssertion))
+	}
+	return chain, nil
+}
+
+// buildAuthResponseChain constructs the chain that adds headers to successful
+// responses from the auth endpoint.
+// Unless the auth response headers are configured, this is the headers chain.
+// Identity assertions are added to the response so that they can be forwarded
+// to the upstream.
+func buildAuthResponseChain(opts *options.Options, headersChain alice.Chain, identityAssertion *assertion.Signer) (alice.Chain, error) {
+	if len(opts.AuthResponse.Headers) == 0 {
+		if identityAssertion != nil {
+			return headersChain.Append(middleware.NewIdentityAssertionResponseInjector(identityAssertion)), nil
+		}
+		return headersChain, nil
+	}
+
+	headers := make([]options.Header, 0, len(opts.AuthResponse.Headers))
+	for _, header := range opts.AuthResponse.Headers {
+		if opts.AuthResponse.PrefixHeaders && !strings.HasPrefix(strings.ToLower(header.Name), strings.ToLower(authResponseHeaderPrefix)) {
+			header.Name = authResponseHeaderPrefix + header.Name
+		}
+		headers = append(headers, header)
+	}
+
+	responseInjector, err := middleware.NewResponseHeaderInjector(headers)
+	if err != nil {
+		return alice.Chain{}, fmt.Errorf("error constructing auth response header injector: %v", err)
+	}
+	chain := alice.New(responseInjector)
+	if identityAssertion != nil {
+		chain = chain.Append(middleware.NewIdentityAssertionResponseInjector(identityAssertion))
+	}
+	return chain, nil
+}
+
+// displayLoginForm checks whether the htpasswd login form is always displayed
+// on the sign in page. As the fallback provider in auto mode, it is only
+// displayed while the primary provider is unavailable.
+func displayLoginForm(opts *options.Options) bool {
+	switch {
+	case opts.ProviderFallback.Provider == "":
+		return opts.Templates.DisplayLoginForm
+	case opts.ProviderFallback.Mode == options.FallbackModeOffer:
+		return true
+	default:
+		return false
+	}
+}
+
+// fallbackUnavailable returns the check of whether the primary provider is
+// unavailable, or nil without a fallback provider
+func fallbackUnavailable(providerFallback *fallback.Monitor) func() bool {
+	if providerFallback == nil {
+		return nil
+	}
+	return providerFallback.Unavailable
+}
+
+// buildProviderHealthEndpoints returns the endpoints of the provider checked
+// to detect that it is unavailable: its discovery endpoint, unless discovery
+// is skipped, and its token endpoint
+func buildProviderHealthEndpoints(providerOpts options.Provider, provider providers.Provider) []string {
+	endpoints := []string{}
+	if providerOpts.OIDCConfig.IssuerURL != "" && !providerOpts.OIDCConfig.SkipDiscovery {
+		endpoints = append(endpoints, strings.TrimSuffix(providerOpts.OIDCConfig.IssuerURL, "/")+"/.well-known/openid-configuration")
+	}
+	if redeemURL := provider.Data().RedeemURL; redeemURL != nil && redeemURL.String() != "" {
+		endpoints = append(endpoints, redeemURL.String())
+	}
+	return endpoints
+}
+
+func buildSignInMessage(opts *options.Options) string {
+	var msg string
+	if len(opts.Templates.Banner) >= 1 {
+		if opts.Templates.Banner == "-" {
+			msg = ""
+		} else {
+			msg = opts.Templates.Banner
+		}
+	} else if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+		if len(opts.EmailDomains) > 1 {
+			msg = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
+		} else if opts.EmailDomains[0] != "*" {
+			msg = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
+		}
+	}
+	return msg
+}
+
+// applyProviderOverrides returns a copy of the options with the cookie name,
+// proxy prefix and session lifetimes of the provider being served, so that
+// several proxies, or the providers of a proxy, can share a cookie domain
+// without overwriting each other's session and CSRF cookies
+func applyProviderOverrides(opts *options.Options) *options.Options {
+	provider := opts.Providers[0]
+	if provider.CookieSuffix == "" && provider.ProxyPrefix == "" && provider.CookieExpire == nil && provider.CookieRefresh == nil {
+		return opts
+	}
+
+	overridden := *opts
+	overridden.Cookie.Name += provider.CookieSuffix
+	if provider.ProxyPrefix != "" {
+		overridden.ProxyPrefix = provider.ProxyPrefix
+	}
+	if provider.CookieExpire != nil {
+		overridden.Cookie.Expire = time.Duration(*provider.CookieExpire)
+	}
+	if provider.CookieRefresh != nil {
+		overridden.Cookie.Refresh = time.Duration(*provider.CookieRefresh)
+	}
+	return &overridden
+}
+
+// buildRoutePrefix returns the prefix the endpoints are routed at, which is
+// the proxy prefix under the external URL prefix when the ingress doesn't
+// strip it from requests
+func buildRoutePrefix(opts *options.Options) string {
+	if opts.ExternalURLPrefixRoutes {
+		return opts.ExternalURLPrefix + opts.ProxyPrefix
+	}
+	return opts.ProxyPrefix
+}
+
+// buildSessionStore builds the session store, caching the sessions loaded
+// when a route fails open with cached sessions while the store is unavailable
+func buildSessionStore(opts *options.Options) (sessionsapi.SessionStore, error) {
+	sessionStore, err := sessions.NewSessionStore(&opts.Session, &opts.Cookie)
+	if err != nil {
+		return nil, fmt.Errorf("error initialising session store: %v", err)
+	}
+	if opts.Session.Type != options.CookieSessionStoreType && usesSessionStorePolicy(opts, options.SessionStoreFailOpenCached) {
+		sessionStore = sessions.NewCachedSessionStore(sessionStore, &opts.Cookie)
+	}
+	return sessionStore, nil
+}
+
+// buildPageWriter builds the writer of the pages of the provider, whose sign
+// in page offers the sign in providers when there are several
+func buildPageWriter(opts *options.Options, provider providers.Provider, basicAuthValidator basic.Validator, providerFallback *fallback.Monitor, signInProviders []pagewriter.SignInProvider) (pagewriter.Writer, error) {
+	pageWriter, err := pagewriter.NewWriter(pagewriter.Opts{
+		TemplatesPath:                opts.Templates.Path,
+		CustomLogo:                   opts.Templates.CustomLogo,
+		ProxyPrefix:                  opts.ProxyPrefix,
+		Footer:                       opts.Templates.Footer,
+		Version:                      Version,
+		Debug:                        opts.Templates.Debug,
+		ProblemJSON:                  opts.Templates.ProblemJSON,
+		HideProviderErrorDescription: opts.Templates.HideProviderErrorDescription,
+		ProviderName:                 buildProviderName(provider, opts.Providers[0].Name),
+		SignInProviders:              signInProviders,
+		SignInMessage:                buildSignInMessage(opts),
+		DisplayLoginForm:             basicAuthValidator != nil && displayLoginForm(opts),
+		ProviderUnavailable:          fallbackUnavailable(providerFallback),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error initialising page writer: %v", err)
+	}
+	return pageWriter, nil
+}
+
+// buildAppDirectors builds the directors of the redirects after signing in
+// and after signing out.
+// Users are sent to the sign out redirect URL once signed out, when the
+// request doesn't ask for another redirect.
+func buildAppDirectors(opts *options.Options, redirectValidator redirect.Validator) (redirect.AppDirector, redirect.AppDirector) {
+	appDirector := redirect.NewAppDirector(redirect.AppDirectorOpts{
+		ProxyPrefix:           opts.ProxyPrefix,
+		ExternalURLPrefix:     opts.ExternalURLPrefix,
+		PrefixStripped:        opts.ExternalURLPrefix != "" && !opts.ExternalURLPrefixRoutes,
+		Validator:             redirectValidator,
+		MaxLength:             opts.Redirect.MaxLength,
+		TruncateLongRedirects: opts.Redirect.MaxLengthAction == options.RedirectMaxLengthTruncate,
+	})
+	signOutDirector := redirect.NewAppDirector(redirect.AppDirectorOpts{
+		ProxyPrefix:           opts.ProxyPrefix,
+		ExternalURLPrefix:     opts.ExternalURLPrefix,
+		PrefixStripped:        opts.ExternalURLPrefix != "" && !opts.ExternalURLPrefixRoutes,
+		Validator:             redirectValidator,
+		MaxLength:             opts.Redirect.MaxLength,
+		TruncateLongRedirects: opts.Redirect.MaxLengthAction == options.RedirectMaxLengthTruncate,
+		DefaultRedirect:       opts.SignOut.RedirectURL,
+	})
+	return appDirector, signOutDirector
+}
+
+// applyExternalURLPrefix returns a copy of the options with the external URL
+// prefix added to the proxy prefix, so that the URLs of the endpoints given to
+// clients and the identity provider include it.
+// Cookies are limited to the prefix unless a cookie path is configured.
+func applyExternalURLPrefix(opts *options.Options) *options.Options {
+	if opts.ExternalURLPrefix == "" {
+		return opts
+	}
+
+	prefixed := *opts
+	prefixed.ProxyPrefix = opts.ExternalURLPrefix + opts.ProxyPrefix
+	if opts.Cookie.Path == "/" {
+		prefixed.Cookie.Path = opts.ExternalURLPrefix
+	}
+	return &prefixed
+}
+
+func buildProviderName(p providers.Provider, override string) string {
+	if override != "" {
+		return override
+	}
+	return p.Data().ProviderName
+}
+
+// buildRoutesAllowlist builds an []allowedRoute  list from either the legacy
+// SkipAuthRegex option (paths only support) or newer SkipAuthRoutes option
+// (method=path support)
+func buildRoutesAllowlist(opts *options.Options) ([]allowedRoute, error) {
+	routes := make([]allowedRoute, 0, len(opts.SkipAuthRegex)+len(opts.SkipAuthRoutes))
+
+	for _, path := range opts.SkipAuthRegex {
+		compiledRegex, err := regexp.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("Skipping auth - Method: ALL | Path: %s", path)
+		routes = append(routes, allowedRoute{
+			method:    "",
+			pathRegex: compiledRegex,
+		})
+	}
+
+	for _, methodPath := range opts.SkipAuthRoutes {
+		var (
+			method string
+			path   string
+			negate = strings.Contains(methodPath, "!=")
+		)
+
+		parts := regexp.MustCompile("!?=").Split(methodPath, 2)
+		if len(parts) == 1 {
+			method = ""
+			path = parts[0]
+		} else {
+			method = strings.ToUpper(parts[0])
+			path = parts[1]
+		}
+
+		compiledRegex, err := regexp.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("Skipping auth - Method: %s | Path: %s", method, path)
+		routes = append(routes, allowedRoute{
+			method:    method,
+			negate:    negate,
+			pathRegex: compiledRegex,
+		})
+	}
+
+	return routes, nil
+}
+
+// buildAPIRoutes builds an []apiRoute from ApiRoutes option
+func buildAPIRoutes(opts *options.Options) ([]apiRoute, error) {
+	routes := make([]apiRoute, 0, len(opts.APIRoutes))
+
+	for _, path := range opts.APIRoutes {
+		compiledRegex, err := regexp.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("API route - Path: %s", path)
+		routes = append(routes, apiRoute{
+			pathRegex: compiledRegex,
+		})
+	}
+
+	return routes, nil
+}
+
+// buildRecentAuthRoutes builds the routes requiring a recent authentication
+// from the RequireRecentAuth option, in the format `path_regex=max_age`
+func buildRecentAuthRoutes(opts *options.Options) ([]recentAuthRoute, error) {
+	routes := make([]recentAuthRoute, 0, len(opts.RequireRecentAuth))
+
+	for _, rule := range opts.RequireRecentAuth {
+		// The regex may contain an =, the max age can't
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid require-recent-auth rule %q: expected format path_regex=max_age", rule)
+		}
+		path, maxAge := rule[:i], rule[i+1:]
+
+		compiledRegex, err := regexp.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(maxAge)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid require-recent-auth rule %q: max age must be a positive duration", rule)
+		}
+		logger.Printf("Recent authentication required - Path: %s | Max age: %s", path, duration)
+		routes = append(routes, recentAuthRoute{
+			pathRegex: compiledRegex,
+			maxAge:    duration,
+		})
+	}
+
+	return routes, nil
+}
+
+// buildAPIClientRules builds the apiclient.Rules from APIClientRules option
+func buildAPIClientRules(opts *options.Options) (apiclient.Rules, error) {
+	for _, rule := range opts.APIClientRules {
+		logger.Printf("API client rule: %s", rule)
+	}
+	return apiclient.NewRules(opts.APIClientRules)
+}
+
+// buildRouteAccessRules builds the routeaccess.Rules from RouteAccessRules
+// option
+func buildRouteAccessRules(opts *options.Options) (routeaccess.Rules, error) {
+	for _, rule := range opts.RouteAccessRules {
+		logger.Printf("Route access rule: %s", rule)
+	}
+	return routeaccess.NewRules(opts.RouteAccessRules)
+}
+
+// ClearSessionCookie creates a cookie to unset the user's authentication cookie
+// stored in the user's session
+func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) error {
+	return p.sessionStore.Clear(rw, req)
+}
+
+// LoadCookiedSession reads the user's authentication details from the request
+func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*sessionsapi.SessionState, error) {
+	return p.sessionStore.Load(req)
+}
+
+// SaveSession creates a new session cookie value and sets this on the response
+func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *sessionsapi.SessionState) error {
+	return p.sessionStore.Save(rw, req, s)
+}
+
+func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.providerSelector != nil {
+		p.providerSelector.ServeHTTP(rw, req)
+		return
+	}
+	p.serveMux.ServeHTTP(rw, req)
+}
+
+// ErrorPage writes an error response
+func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, req *http.Request, code int, appError string, messages ...interface{}) {
+	p.pageWriter.WriteErrorPage(rw, p.errorPageOpts(req, code, appError, messages...))
+}
+
+// errorPageOpts builds the options to write an error page for the request
+func (p *OAuthProxy) errorPageOpts(req *http.Request, code int, appError string, messages ...interface{}) pagewriter.ErrorPageOpts {
+	redirectURL, err := p.appDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining redirect: %v", err)
+	}
+	if redirectURL == p.SignInPath || redirectURL == "" {
+		redirectURL = p.defaultRedirect
+	}
+
+	scope := middlewareapi.GetRequestScope(req)
+	return pagewriter.ErrorPageOpts{
+		Status:      code,
+		RedirectURL: redirectURL,
+		RequestID:   scope.RequestID,
+		AppError:    appError,
+		Messages:    messages,
+		Accept:      req.Header.Get("Accept"),
+	}
+}
+
+// providerErrorPage writes an error page for an error returned by the identity
+// provider to the OAuth callback.
+// The page shows the error and its description, with a link to restart the
+// sign in for the original redirect.
+// The full error and description are recorded in the auth log.
+func (p *OAuthProxy) providerErrorPage(rw http.ResponseWriter, req *http.Request, providerError, description string) {
+	logger.PrintAuthf("", req, logger.AuthFailure, "Identity provider returned an error to the OAuth2 callback: error=%s error_description=%s", providerError, description)
+
+	appRedirect := p.defaultRedirect
+	if _, rd, err := decodeState(req); err == nil && p.redirectValidator.IsValidRedirect(rd) {
+		appRedirect = rd
+	}
+
+	// Set the debug message and override the non debug message to be the same for this case
+	message := "Login Failed: The upstream identity provider returned an error."
+	opts := p.errorPageOpts(req, http.StatusForbidden, message, message)
+	opts.ProviderError = providerError
+	opts.ProviderErrorDescription = description
+	opts.RetryURL = fmt.Sprintf("%s%s?rd=%s", p.ProxyPrefix, oauthStartPath, url.QueryEscape(appRedirect))
+	p.pageWriter.WriteErrorPage(rw, opts)
+}
+
+// isSilentRenewError checks whether the provider's error is one of the OIDC
+// errors to a prompt=none authentication request that requires the user to
+// interact with the provider
+func isSilentRenewError(providerError string) bool {
+	switch providerError {
+	case "login_required", "interaction_required", "consent_required", "account_selection_required":
+		return true
+	}
+	return false
+}
+
+// silentRenewFailed returns to the application when a session can't be
+// renewed without interaction, with the provider's error in a query
+// parameter so that the frontend can fall back to an interactive sign in.
+// The current session is left untouched, it remains valid until it lapses.
+func (p *OAuthProxy) silentRenewFailed(rw http.ResponseWriter, req *http.Request, providerError, description string) {
+	logger.PrintAuthf("", req, logger.AuthFailure, "Silent session renewal failed, keeping the current session: error=%s error_description=%s", providerError, description)
+
+	appRedirect := p.defaultRedirect
+	if _, rd, err := decodeState(req); err == nil && p.redirectValidator.IsValidRedirect(rd) {
+		appRedirect = rd
+	}
+	if csrf, err := cookies.LoadCSRFCookie(req, p.CookieOptions); err == nil {
+		csrf.ClearCookie(rw, req)
+	}
+
+	u, err := url.Parse(appRedirect)
+	if err != nil {
+		// Redirects have been validated, so this should not happen
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	query := u.Query()
+	query.Set(silentRenewErrorParameter, providerError)
+	u.RawQuery = query.Encode()
+	http.Redirect(rw, req, u.String(), http.StatusFound)
+}
+
+// requestHeaderLimitsExceeded writes an error page for requests to the
+// upstreams with too many or too large headers, usually from an accumulation
+// of cookies.
+// The page links to the sign out endpoint to clear every OAuth2 Proxy cookie,
+// before returning to the request.
+func (p *OAuthProxy) requestHeaderLimitsExceeded(rw http.ResponseWriter, req *http.Request, reason, detail string) {
+	logger.Errorf("Rejecting request with too large headers (%s): %s", reason, detail)
+	if p.forceJSONErrors {
+		p.errorJSON(rw, req, http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	opts := p.errorPageOpts(req, http.StatusRequestHeaderFieldsTooLarge, detail)
+	opts.ClearCookiesURL = fmt.Sprintf("%s%s?clear=all&rd=%s", p.ProxyPrefix, signOutPath, url.QueryEscape(req.URL.RequestURI()))
+	p.pageWriter.WriteErrorPage(rw, opts)
+}
+
+// redirectErrorPage writes an error response for an error obtaining the
+// application redirect, explaining to the user when the redirect was too long.
+func (p *OAuthProxy) redirectErrorPage(rw http.ResponseWriter, req *http.Request, code int, err error) {
+	if errors.Is(err, redirect.ErrRedirectTooLong) {
+		p.ErrorPage(rw, req, http.StatusBadRequest, err.Error(), "Login Failed: The address of the page you requested is too long to return to after signing in. Please try again from a shorter address.")
+		return
+	}
+	p.ErrorPage(rw, req, code, err.Error())
+}
+
+// IsAllowedRequest is used to check if auth should be skipped for this request
+func (p *OAuthProxy) IsAllowedRequest(req *http.Request) bool {
+	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
+	return isPreflightRequestAllowed || p.corsPreflight.IsAllowed(req) || p.isAllowedRoute(req) || p.isTrustedIP(req)
+}
+
+func isAllowedMethod(req *http.Request, route allowedRoute) bool {
+	return route.method == "" || req.Method == route.method
+}
+
+func isAllowedPath(req *http.Request, route allowedRoute) bool {
+	matches := route.pathRegex.MatchString(req.URL.Path)
+
+	if route.negate {
+		return !matches
+	}
+
+	return matches
+}
+
+// IsAllowedRoute is used to check if the request method & path is allowed without auth
+func (p *OAuthProxy) isAllowedRoute(req *http.Request) bool {
+	for _, route := range p.allowedRoutes {
+		if isAllowedMethod(req, route) && isAllowedPath(req, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnonymousRequest checks whether the policies of the upstream the request
+// is routed to allow it without a session
+func (p *OAuthProxy) isAnonymousRequest(req *http.Request) bool {
+	access, ok := p.upstreamProxy.(upstream.AnonymousAccess)
+	return ok && access.AllowsAnonymous(req)
+}
+
+// authorizePolicies checks the request with the session against the policies
+// of the upstream the request is routed to, for the requests the upstream
+// doesn't check itself, such as signed URLs.
+// Requests without a session that are allowed without authentication are not
+// checked, in the same way as by the upstream.
+func (p *OAuthProxy) authorizePolicies(req *http.Request, session *sessionsapi.SessionState) error {
+	authorizer, ok := p.upstreamProxy.(upstream.PolicyAuthorizer)
+	if !ok || (session == nil && p.IsAllowedRequest(req)) {
+		return nil
+	}
+	return authorizer.AuthorizePolicies(req, session)
+}
+
+func (p *OAuthProxy) isAPIPath(req *http.Request) bool {
+	for _, route := range p.apiRoutes {
+		if route.pathRegex.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentAuthMaxAge returns the shortest max age of the recent authentication
+// routes matching the request, if any match
+func (p *OAuthProxy) recentAuthMaxAge(req *http.Request) (time.Duration, bool) {
+	var maxAge time.Duration
+	for _, route := range p.recentAuthRoutes {
+		if route.pathRegex.MatchString(req.URL.Path) && (maxAge == 0 || route.maxAge < maxAge) {
+			maxAge = route.maxAge
+		}
+	}
+	return maxAge, maxAge > 0
+}
+
+// isTrustedIP is used to check if a request comes from a trusted client IP address.
+func (p *OAuthProxy) isTrustedIP(req *http.Request) bool {
+	if p.trustedIPs == nil {
+		return false
+	}
+
+	remoteAddr, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for trusted IP list: %v", err)
+		// Possibly spoofed X-Real-IP header
+		return false
+	}
+
+	if remoteAddr == nil {
+		return false
+	}
+
+	return p.trustedIPs.Has(remoteAddr)
+}
+
+// SignInPage writes the sign in template to the response
+func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
+	prepareNoCache(rw)
+	err := p.ClearSessionCookie(rw, req)
+	if err != nil {
+		logger.Printf("Error clearing session cookie: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// The token is only needed while the login form can sign users in
+	var csrfToken string
+	if p.basicAuthValidator != nil && p.loginFormEnabled() {
+		csrfToken, err = p.setFormCSRFCookie(rw, req)
+		if err != nil {
+			logger.Errorf("Error setting form CSRF cookie: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	rw.WriteHeader(code)
+
+	redirectURL, err := p.appDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining redirect: %v", err)
+		p.redirectErrorPage(rw, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	if redirectURL == p.SignInPath {
+		redirectURL = p.defaultRedirect
+	}
+
+	p.pageWriter.WriteSignInPage(rw, req, redirectURL, code, csrfToken)
+}
+
+// setFormCSRFCookie generates the CSRF token of a sign-in or sign-out form
+// being rendered, and sets the cookie it is checked against once posted.
+// No token is generated for bearer sessions, which aren't kept in cookies.
+func (p *OAuthProxy) setFormCSRFCookie(rw http.ResponseWriter, req *http.Request) (string, error) {
+	if p.bearerSessions {
+		return "", nil
+	}
+	token, cookie, err := cookies.MakeFormCSRFCookie(req, p.CookieOptions, time.Now())
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(rw, cookie)
+	return token, nil
+}
+
+// checkFormCSRFToken checks the CSRF token posted by a sign-in or sign-out
+// form against its cookie, so that forms posted from other sites don't sign
+// users in or out.
+// Like the OAuth state, it isn't checked for bearer sessions, as forms
+// posted from other sites can't set their session.
+func (p *OAuthProxy) checkFormCSRFToken(req *http.Request) bool {
+	if p.bearerSessions {
+		return true
+	}
+	return cookies.CheckFormCSRFToken(req, p.CookieOptions, req.PostFormValue(cookies.FormCSRFTokenField))
+}
+
+// redirectToKnownProvider redirects returning users straight to the login flow
+// of the provider they last signed in with, rather than showing the sign-in
+// page, when autoRedirectKnownProvider is set.
+// The `prompt=select` query parameter always shows the sign-in page, so that
+// users can switch providers.
+// It returns whether the request was redirected.
+func (p *OAuthProxy) redirectToKnownProvider(rw http.ResponseWriter, req *http.Request, appRedirect string) bool {
+	if !p.autoRedirectKnownProvider || req.URL.Query().Get("prompt") == "select" {
+		return false
+	}
+
+	// The cookie is signed, but only providers that are still configured
+	// are trusted
+	providerID, ok := cookies.LoadProviderCookie(req, p.CookieOptions)
+	if !ok || providerID != p.providerID {
+		return false
+	}
+
+	if appRedirect == "" {
+		var err error
+		appRedirect, err = p.appDirector.GetRedirect(req)
+		if err != nil {
+			logger.Errorf("Error obtaining redirect: %v", err)
+			return false
+		}
+	}
+	if appRedirect == p.SignInPath {
+		appRedirect = p.defaultRedirect
+	}
+
+	prepareNoCache(rw)
+	http.Redirect(rw, req, fmt.Sprintf("%s%s?rd=%s", p.ProxyPrefix, oauthStartPath, url.QueryEscape(appRedirect)), http.StatusFound)
+	return true
+}
+
+// setProviderCookie remembers the provider the user signed in with, so that
+// they can be redirected to it when they return
+func (p *OAuthProxy) setProviderCookie(rw http.ResponseWriter, req *http.Request) {
+	if !p.autoRedirectKnownProvider {
+		return
+	}
+	cookie, err := cookies.MakeProviderCookie(req, p.providerID, p.CookieOptions, time.Now())
+	if err != nil {
+		logger.Errorf("Error setting provider cookie: %v", err)
+		return
+	}
+	http.SetCookie(rw, cookie)
+}
+
+// ManualSignIn handles basic auth logins to the proxy
+func (p *OAuthProxy) ManualSignIn(req *http.Request) (string, bool, int) {
+	if req.Method != "POST" || p.basicAuthValidator == nil || !p.loginFormEnabled() {
+		return "", false, http.StatusOK
+	}
+	user := req.FormValue("username")
+	passwd := req.FormValue("password")
+	if !p.checkFormCSRFToken(req) {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: invalid CSRF token")
+		return "", false, http.StatusForbidden
+	}
+	if user == "" {
+		return "", false, http.StatusBadRequest
+	}
+	// check auth
+	if p.basicAuthValidator.Validate(user, passwd) {
+		if p.providerFallback != nil {
+			// Fallback logins are audited apart from the primary provider's
+			logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via fallback provider HtpasswdFile (primary provider unavailable: %t)", p.providerFallback.Unavailable())
+			p.sendSessionEvent(options.SessionEventFallbackLogin, user, req, logger.AuthSuccess, "Authenticated via fallback provider HtpasswdFile")
+			return user, true, http.StatusOK
+		}
+		logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via HtpasswdFile")
+		p.sendSessionEvent(options.SessionEventLogin, user, req, logger.AuthSuccess, "Authenticated via HtpasswdFile")
+		return user, true, http.StatusOK
+	}
+	logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile")
+	return "", false, http.StatusUnauthorized
+}
+
+// loginFormEnabled checks whether users can sign in with the htpasswd login
+// form. As the fallback provider in auto mode, they only can while the
+// primary provider is unavailable.
+func (p *OAuthProxy) loginFormEnabled() bool {
+	if p.providerFallback == nil || p.fallbackMode != options.FallbackModeAuto {
+		return true
+	}
+	return p.providerFallback.Unavailable()
+}
+
+// primaryUnavailable checks whether the primary provider is unavailable, so
+// that users are offered the fallback provider instead of its login flow
+func (p *OAuthProxy) primaryUnavailable() bool {
+	return p.providerFallback != nil && p.providerFallback.Unavailable()
+}
+
+// SignIn serves a page prompting users to sign in
+func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.appDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining redirect: %v", err)
+		p.redirectErrorPage(rw, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	user, ok, statusCode := p.ManualSignIn(req)
+	if ok {
+		session := &sessionsapi.SessionState{User: user, Groups: p.basicAuthGroups, AuthProvider: options.FallbackProviderHtpasswd}
+		err = p.saveLoginSession(rw, req, session)
+		if errors.Is(err, sessionsapi.ErrTooManySessions) {
+			logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: %v", err)
+			p.sendSessionEvent(options.SessionEventAuthorizationDenied, user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: %v", err)
+			p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Invalid authentication via HtpasswdFile: %v", err)
+			p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), tooManySessionsMessage)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error saving session: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if p.bearerSessions {
+			p.writeSessionToken(rw, req)
+			return
+		}
+		http.Redirect(rw, req, redirect, http.StatusFound)
+	} else {
+		switch {
+		case statusCode == http.StatusForbidden:
+			// Forms with an invalid CSRF token are rendered again, with a
+			// new token
+			p.SignInPage(rw, req, statusCode)
+		case p.SkipProviderButton:
+			p.OAuthStart(rw, req)
+		case p.redirectToKnownProvider(rw, req, redirect):
+			return
+		default:
+			// TODO - should we pass on /oauth2/sign_in query params to /oauth2/start?
+			p.SignInPage(rw, req, statusCode)
+		}
+	}
+}
+
+// UserInfo endpoint outputs session email and preferred username in JSON format
+func (p *OAuthProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if session == nil {
+		if _, err := rw.Write([]byte("{}")); err != nil {
+			logger.Printf("Error encoding empty user info: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	userInfo := struct {
+		User              string   `json:"user"`
+		Email             string   `json:"email"`
+		Groups            []string `json:"groups,omitempty"`
+		PreferredUsername string   `json:"preferredUsername,omitempty"`
+		Sessions          *int     `json:"sessions,omitempty"`
+	}{
+		User:              session.User,
+		Email:             session.Email,
+		Groups:            session.Groups,
+		PreferredUsername: session.PreferredUsername,
+	}
+
+	// The sessions of users are only tracked when they are limited
+	if counter, ok := p.sessionStore.(sessionsapi.UserSessionCounter); ok && p.maxSessionsPerUser > 0 {
+		if count, err := counter.CountUserSessions(req.Context(), session); err != nil {
+			logger.Errorf("Error counting the sessions of %s: %v", session.Email, err)
+		} else {
+			userInfo.Sessions = &count
+		}
+	}
+
+	if err := json.NewEncoder(rw).Encode(userInfo); err != nil {
+		logger.Printf("Error encoding user info: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// SessionRefresh endpoint forces a refresh of the current session with the
+// provider and outputs the new session timestamps in JSON format.
+// This allows frontends to renew a session before it expires.
+func (p *OAuthProxy) SessionRefresh(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get(refreshRequiredHeader) == "" {
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	case err != nil || session == nil:
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	if age := session.Age(); age < p.refreshMinInterval {
+		retryAfter := (p.refreshMinInterval - age + time.Second - 1) / time.Second
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+		p.errorJSON(rw, req, http.StatusTooManyRequests)
+		return
+	}
+
+	if err := p.sessionRefresher(rw, req, session); err != nil {
+		if !errors.Is(err, middleware.ErrSessionNotRefreshed) {
+			logger.PrintAuthf(session.Email, req, logger.AuthError, "Unable to refresh session: %v", err)
+			p.sendSessionEvent(options.SessionEventRefreshFailure, session.Email, req, logger.AuthError, "Unable to refresh session: %v", err)
+			p.recordAudit(options.AuditEventSessionRefreshed, req, session, audit.OutcomeFailure, "Unable to refresh session: %v", err)
+			if err := p.ClearSessionCookie(rw, req); err != nil {
+				logger.Errorf("Error clearing session cookie: %v", err)
+			}
+		}
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+	p.recordAudit(options.AuditEventSessionRefreshed, req, session, audit.OutcomeSuccess, "Refreshed session via the refresh endpoint")
+
+	sessionInfo := struct {
+		CreatedAt *time.Time `json:"createdAt,omitempty"`
+		ExpiresOn *time.Time `json:"expiresOn,omitempty"`
+	}{
+		CreatedAt: session.CreatedAt,
+		ExpiresOn: session.ExpiresOn,
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(sessionInfo); err != nil {
+		logger.Printf("Error encoding session info: %v", err)
+	}
+}
+
+// SessionExpiry endpoint outputs when the current session lapses, at the end
+// of its lifetime, and the seconds remaining in JSON format.
+// This allows frontends to warn users before they lose unsaved work, and to
+// renew the session in time.
+func (p *OAuthProxy) SessionExpiry(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	case err != nil || session == nil:
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	expiryInfo := struct {
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+		ExpiresIn *int64     `json:"expiresIn,omitempty"`
+		RenewURL  string     `json:"renewURL,omitempty"`
+	}{}
+	if expiresAt := session.LifetimeExpiresOn(p.CookieOptions.Expire); expiresAt != nil {
+		expiresIn := int64(expiresAt.Sub(session.Clock.Now()) / time.Second)
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		expiryInfo.ExpiresAt = expiresAt
+		expiryInfo.ExpiresIn = &expiresIn
+	}
+	if p.silentRenew {
+		expiryInfo.RenewURL = p.ProxyPrefix + oauthStartPath + "?prompt=none"
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(expiryInfo); err != nil {
+		logger.Printf("Error encoding session expiry: %v", err)
+	}
+}
+
+// SignURL endpoint signs the URL given in the url parameter for the method
+// parameter (GET by default), and outputs the signed URL and its expiry in
+// JSON format.
+// Requests to the signed URL with the method are proxied without a session
+// until it expires after the expires_in parameter (the maximum lifetime by
+// default). When the client_ip parameter is given, only requests from the
+// client IP are allowed.
+func (p *OAuthProxy) SignURL(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get(refreshRequiredHeader) == "" {
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	case err != nil || session == nil:
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	method := http.MethodGet
+	if m := req.FormValue("method"); m != "" {
+		method = strings.ToUpper(m)
+	}
+
+	target, err := p.signURLTarget(req)
+	if err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Unable to sign URL: %v", err)
+		p.errorJSON(rw, req, http.StatusBadRequest)
+		return
+	}
+	if err := p.authorizeSigner(req, session, method, target); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Denied signing URL %s %s: %v", method, target.Path, err)
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+	signed, expires, err := p.signURL(req, method, target)
+	if err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Unable to sign URL: %v", err)
+		p.errorJSON(rw, req, http.StatusBadRequest)
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Signed URL %s %s expiring at %s", method, signed.Path, expires.UTC().Format(time.RFC3339))
+
+	signedURLInfo := struct {
+		URL       string    `json:"url"`
+		ExpiresOn time.Time `json:"expiresOn"`
+	}{
+		URL:       signed.String(),
+		ExpiresOn: expires,
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(signedURLInfo); err != nil {
+		logger.Printf("Error encoding signed url: %v", err)
+	}
+}
+
+// DynamicUpstreams lists the files of the dynamic upstreams directory in
+// JSON format, with the state and expiry of their upstreams
+func (p *OAuthProxy) DynamicUpstreams(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	case err != nil || session == nil:
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	p.writeDynamicUpstreams(rw)
+}
+
+// UpstreamsHealth lists the health of the servers of the upstreams with
+// health checks in JSON format
+func (p *OAuthProxy) UpstreamsHealth(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	case err != nil || session == nil:
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	p.writeUpstreamsHealth(rw)
+}
+
+// writeUpstreamsHealth writes the health of the servers of the upstreams
+// with health checks
+func (p *OAuthProxy) writeUpstreamsHealth(rw http.ResponseWriter) {
+	upstreamsInfo := struct {
+		Upstreams []upstream.UpstreamHealth `json:"upstreams"`
+	}{
+		Upstreams: p.upstreamHealth.Health(),
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(upstreamsInfo); err != nil {
+		logger.Printf("Error encoding upstreams health: %v", err)
+	}
+}
+
+// writeDynamicUpstreams writes the files of the dynamic upstreams directory
+// and their state
+func (p *OAuthProxy) writeDynamicUpstreams(rw http.ResponseWriter) {
+	dynamicUpstreamsInfo := struct {
+		Upstreams []upstream.DynamicUpstreamEntry `json:"upstreams"`
+	}{
+		Upstreams: p.dynamicUpstreams.Entries(),
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(dynamicUpstreamsInfo); err != nil {
+		logger.Printf("Error encoding dynamic upstreams: %v", err)
+	}
+}
+
+// signURLTarget returns the URL given by the parameters of the sign-url
+// request to be signed
+func (p *OAuthProxy) signURLTarget(req *http.Request) (*url.URL, error) {
+	target, err := url.Parse(req.FormValue("url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if !strings.HasPrefix(target.Path, "/") {
+		return nil, fmt.Errorf("url %q must have an absolute path", req.FormValue("url"))
+	}
+	if strings.HasPrefix(target.Path, p.ProxyPrefix+"/") {
+		return nil, fmt.Errorf("url %q must not be under the proxy prefix", req.FormValue("url"))
+	}
+	// Signed URLs are handed out to be followed, so absolute URLs must be
+	// allowed in the same way as redirects
+	if target.IsAbs() && !p.redirectValidator.IsValidRedirect(target.String()) {
+		return nil, fmt.Errorf("url %q must be a path or a URL allowed by the redirect allowlist", req.FormValue("url"))
+	}
+	return target, nil
+}
+
+// authorizeSigner checks that the session is allowed to make the request the
+// target is signed for, so that signed URLs never grant more than their
+// signer has. The request to the target is checked against the route access
+// rules, recent authentication routes, upstream policies and external
+// authorization, with the headers and client IP of the sign-url request.
+func (p *OAuthProxy) authorizeSigner(req *http.Request, session *sessionsapi.SessionState, method string, target *url.URL) error {
+	targetReq := req.Clone(req.Context())
+	targetReq.Method = method
+	targetReq.URL = &url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery}
+	targetReq.RequestURI = targetReq.URL.RequestURI()
+	if target.IsAbs() {
+		targetReq.Host = target.Host
+	}
+	targetReq.Body = http.NoBody
+	targetReq.ContentLength = 0
+
+	if err := p.authorizeRoute(targetReq, session); err != nil {
+		return err
+	}
+	if maxAge, ok := p.recentAuthMaxAge(targetReq); ok && !p.IsAllowedRequest(targetReq) && !isRecentAuth(req.Context(), session, maxAge) {
+		return fmt.Errorf("the url requires an authentication within the last %s", maxAge)
+	}
+	if err := p.authorizePolicies(targetReq, session); err != nil {
+		return err
+	}
+	return p.authorizeExternally(targetReq, session)
+}
+
+// signURL signs the target for the method, with the lifetime and client IP
+// given by the parameters of the sign-url request
+func (p *OAuthProxy) signURL(req *http.Request, method string, target *url.URL) (*url.URL, time.Time, error) {
+	var err error
+	lifetime := p.signedURL.MaxLifetime()
+	if expiresIn := req.FormValue("expires_in"); expiresIn != "" {
+		lifetime, err = time.ParseDuration(expiresIn)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid expires_in: %v", err)
+		}
+	}
+
+	var clientIP net.IP
+	if ipStr := req.FormValue("client_ip"); ipStr != "" {
+		clientIP = net.ParseIP(ipStr)
+		if clientIP == nil {
+			return nil, time.Time{}, fmt.Errorf("invalid client_ip %q", ipStr)
+		}
+	}
+
+	return p.signedURL.Sign(method, target, lifetime, clientIP)
+}
+
+// DeleteSession signs out the bearer session of the request, revoking the
+// provider's grant and removing the session from the store.
+func (p *OAuthProxy) DeleteSession(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		rw.Header().Set("Allow", http.MethodDelete)
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := middlewareapi.GetRequestScope(req).Session
+	if session == nil {
+		p.errorJSON(rw, req, http.StatusUnauthorized)
+		return
+	}
+
+	p.revokeSession(req, session, "sign out")
+	if err := p.ClearSessionCookie(rw, req); err != nil {
+		logger.Errorf("Error deleting session: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+	p.sendSessionEvent(options.SessionEventLogout, session.Email, req, logger.AuthSuccess, "Signed out")
+	p.recordAudit(options.AuditEventSessionRevoked, req, session, audit.OutcomeSuccess, "Signed out")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// SignOut sends a response to clear the authentication cookie.
+// Only POST requests sign users out, unless signing out on GET is allowed:
+// other requests get a confirmation page with the form to sign out, so that
+// prefetched links don't sign users out. The form posts a CSRF token, so that
+// forms posted from other sites don't sign users out either.
+func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.signOutDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining redirect: %v", err)
+		p.redirectErrorPage(rw, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	session, err := p.LoadCookiedSession(req)
+	if err != nil {
+		session = nil
+	}
+
+	if req.Method != http.MethodPost && !p.signOutAllowGet {
+		csrfToken, err := p.setFormCSRFCookie(rw, req)
+		if err != nil {
+			logger.Errorf("Error setting form CSRF cookie: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+		opts := pagewriter.SignOutPageOpts{
+			RedirectURL:     redirect,
+			ClearAllCookies: req.FormValue("clear") == "all",
+			CSRFToken:       csrfToken,
+		}
+		if session != nil {
+			opts.Email = session.Email
+		}
+		p.pageWriter.WriteSignOutPage(rw, req, opts)
+		return
+	}
+
+	// Signing out on GET is only allowed without a confirmation, so the
+	// CSRF token is only required when it isn't
+	if !p.signOutAllowGet && !p.checkFormCSRFToken(req) {
+		logger.Printf("Refusing to sign out: invalid CSRF token")
+		p.ErrorPage(rw, req, http.StatusForbidden, "invalid CSRF token", invalidFormCSRFMessage)
+		return
+	}
+
+	// Revoke the provider's grant so it doesn't outlive the session
+	if session != nil {
+		p.revokeSession(req, session, "sign out")
+	}
+
+	err = p.ClearSessionCookie(rw, req)
+	if err != nil {
+		logger.Errorf("Error clearing session cookie: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session != nil {
+		p.sendSessionEvent(options.SessionEventLogout, session.Email, req, logger.AuthSuccess, "Signed out")
+		p.recordAudit(options.AuditEventSessionRevoked, req, session, audit.OutcomeSuccess, "Signed out")
+	}
+
+	// Clear the CSRF and provider cookies too when asked to, such as to
+	// recover from requests with too large headers
+	if req.FormValue("clear") == "all" {
+		for _, c := range cookies.MakeClearAllCookiesFromOptions(req, p.CookieOptions, time.Now()) {
+			http.SetCookie(rw, c)
+		}
+	}
+
+	// Sign out of the provider as well if it supports it, the sessions of
+	// the htpasswd login form were never signed in to it
+	if session != nil && session.AuthProvider == options.FallbackProviderHtpasswd {
+		http.Redirect(rw, req, redirect, http.StatusFound)
+		return
+	}
+	if logoutURL := p.provider.GetLogoutURL(session, redirect); logoutURL != "" {
+		redirect = logoutURL
+	}
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+// OAuthStart starts the OAuth2 authentication flow
+func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
+	// start the flow permitting login URL query parameters to be overridden from the request URL
+	p.doOAuthStart(rw, req, req.URL.Query())
+}
+
+func (p *OAuthProxy) doOAuthStart(rw http.ResponseWriter, req *http.Request, overrides url.Values) {
+	// The login flow of an unavailable provider can't succeed, the sign in
+	// page offers the fallback provider instead
+	if p.primaryUnavailable() {
+		p.SignInPage(rw, req, http.StatusOK)
+		return
+	}
+
+	extraParams := p.provider.Data().LoginURLParams(overrides)
+	if p.silentRenew && overrides.Get("prompt") == "none" {
+		// The provider is asked to renew the session without interacting
+		// with the user, whatever the login URL parameters allow
+		extraParams.Set("prompt", "none")
+	}
+	if len(p.recentAuthRoutes) > 0 && overrides.Get("prompt") == "login" {
+		// The provider is asked to re-authenticate the user for routes
+		// requiring a recent authentication, whatever the login URL
+		// parameters allow
+		if maxAge, err := strconv.Atoi(overrides.Get("max_age")); err == nil && maxAge >= 0 {
+			extraParams.Set("prompt", "login")
+			extraParams.Set("max_age", strconv.Itoa(maxAge))
+		}
+	}
+	prepareNoCache(rw)
+
+	var codeChallenge, codeVerifier, codeChallengeMethod string
+	if p.provider.Data().CodeChallengeMethod != "" {
+		codeChallengeMethod = p.provider.Data().CodeChallengeMethod
+		preEncodedCodeVerifier, err := encryption.Nonce(96)
+		if err != nil {
+			logger.Errorf("Unable to build random string: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+		codeVerifier = base64.RawURLEncoding.EncodeToString(preEncodedCodeVerifier)
+
+		codeChallenge, err = encryption.GenerateCodeChallenge(p.provider.Data().CodeChallengeMethod, codeVerifier)
+		if err != nil {
+			logger.Errorf("Error creating code challenge: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		extraParams.Add("code_challenge", codeChallenge)
+		extraParams.Add("code_challenge_method", codeChallengeMethod)
+	}
+
+	csrf, err := cookies.NewCSRF(p.CookieOptions, codeVerifier)
+	if err != nil {
+		logger.Errorf("Error creating CSRF nonce: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	appRedirect, err := p.appDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining application redirect: %v", err)
+		p.redirectErrorPage(rw, req, http.StatusBadRequest, err)
+		return
+	}
+
+	appState, err := p.appState.FromRequest(req)
+	if err != nil {
+		logger.Errorf("Error obtaining app state: %v", err)
+		p.ErrorPage(rw, req, http.StatusBadRequest, err.Error(), "Login Failed: The application gave an invalid state to sign in with. Please try again.")
+		return
+	}
+	csrf.SetAppState(appState)
+
+	stateNonce := csrf.HashOAuthState()
+	if p.bearerSessions {
+		// Without cookies, the state carries the signed CSRF itself
+		stateNonce, err = csrf.EncodeState()
+		if err != nil {
+			logger.Errorf("Error encoding CSRF state: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	callbackRedirect := p.getOAuthRedirectURI(req)
+	loginURL := p.provider.GetLoginURL(
+		callbackRedirect,
+		encodeState(stateNonce, appRedirect),
+		csrf.HashOIDCNonce(),
+		extraParams,
+	)
+
+	if !p.bearerSessions {
+		if _, err := csrf.SetCookie(rw, req); err != nil {
+			logger.Errorf("Error setting CSRF cookie: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	http.Redirect(rw, req, loginURL, http.StatusFound)
+}
+
+// OAuthCallback is the OAuth2 authentication flow callback that finishes the
+// OAuth2 authentication flow
+func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := ip.GetClientString(p.realClientIPParser, req, true)
+
+	// finish the oauth cycle
+	err := req.ParseForm()
+	if err != nil {
+		logger.Errorf("Error while parsing OAuth2 callback: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if providerError := req.Form.Get("error"); providerError != "" {
+		if p.silentRenew && isSilentRenewError(providerError) {
+			p.silentRenewFailed(rw, req, providerError, req.Form.Get("error_description"))
+			return
+		}
+		p.providerErrorPage(rw, req, providerError, req.Form.Get("error_description"))
+		return
+	}
+
+	csrf, err := p.loadCSRF(req)
+	if err != nil {
+		logger.Println(req, logger.AuthFailure, "Invalid authentication via OAuth2: unable to obtain CSRF cookie")
+		p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "Login Failed: Unable to find a valid CSRF token. Please try again.")
+		return
+	}
+
+	session, err := p.redeemCode(req, csrf.GetCodeVerifier())
+	if errors.Is(err, providers.ErrEmailNotVerified) {
+		logger.Errorf("Error redeeming code during OAuth2 callback: %v", err)
+		p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "Login Failed: Your email address has not been verified. Please verify it with your identity provider and try again.")
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error redeeming code during OAuth2 callback: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	setAuthTime(req.Context(), session)
+	err = p.enrichSessionState(req.Context(), session)
+	if err != nil {
+		logger.Errorf("Error creating session during OAuth2 callback: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !p.bearerSessions {
+		csrf.ClearCookie(rw, req)
+	}
+
+	nonce, appRedirect, err := decodeState(req)
+	if err != nil {
+		logger.Errorf("Error while parsing OAuth2 state: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The CSRF of bearer sessions was loaded from the state, its signature
+	// already proves the state was issued by the proxy
+	if !p.bearerSessions && !csrf.CheckOAuthState(nonce) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: CSRF token mismatch, potential attack")
+		p.ErrorPage(rw, req, http.StatusForbidden, "CSRF token mismatch, potential attack", "Login Failed: Unable to find a valid CSRF token. Please try again.")
+		return
+	}
+
+	csrf.SetSessionNonce(session)
+	if !p.provider.ValidateSession(req.Context(), session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session validation failed: %s", session)
+		p.ErrorPage(rw, req, http.StatusForbidden, "Session validation failed")
+		return
+	}
+
+	if !p.redirectValidator.IsValidRedirect(appRedirect) {
+		appRedirect = p.defaultRedirect
+	}
+	appRedirect = p.appState.AppendTo(appRedirect, csrf.GetAppState())
+
+	// set cookie, or deny
+	authorized, err := p.provider.Authorize(req.Context(), session)
+	if err != nil {
+		logger.Errorf("Error with authorization: %v", err)
+	}
+	if p.Validator(session.Email) && authorized {
+		// Deny lists take precedence over any allow rules
+		if err := p.checkDenyLists(session); err != nil {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Denied authentication via OAuth2: %v", err)
+			p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Denied authentication via OAuth2: %v", err)
+			p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Denied authentication via OAuth2: %v", err)
+			p.revokeSession(req, session, "denied authentication")
+			if err := p.ClearSessionCookie(rw, req); err != nil {
+				logger.Errorf("Error clearing session cookie: %v", err)
+			}
+			p.ErrorPage(rw, req, http.StatusForbidden, "Invalid session: denied")
+			return
+		}
+
+		if p.claimEnricher != nil {
+			if err := p.claimEnricher.Enrich(req.Context(), session); err != nil {
+				logger.PrintAuthf(session.Email, req, logger.AuthError, "Invalid authentication via OAuth2: %v", err)
+				p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error(), "Login Failed: Your account details could not be loaded. Please try again later.")
+				return
+			}
+		}
+
+		session.AuthProvider = p.providerID
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2: %s", session)
+		p.sendSessionEvent(options.SessionEventLogin, session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2")
+		logSessionSize(req, session)
+		err := p.saveLoginSession(rw, req, session)
+		if errors.Is(err, sessionsapi.ErrTooManySessions) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: %v", err)
+			p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: %v", err)
+			p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Invalid authentication via OAuth2: %v", err)
+			p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), tooManySessionsMessage)
+			return
+		}
+		if err != nil {
+			logger.Errorf("Error saving session state for %s: %v", remoteAddr, err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if p.bearerSessions {
+			p.writeSessionToken(rw, req)
+			return
+		}
+		p.setProviderCookie(rw, req)
+		http.Redirect(rw, req, appRedirect, http.StatusFound)
+	} else {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unauthorized")
+		p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unauthorized")
+		p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Invalid authentication via OAuth2: unauthorized")
+		p.ErrorPage(rw, req, http.StatusForbidden, "Invalid session: unauthorized")
+	}
+}
+
+// saveLoginSession saves the session of a new login, auditing the sessions of
+// the user that were evicted to save it
+func (p *OAuthProxy) saveLoginSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+	if err := p.SaveSession(rw, req, session); err != nil {
+		return err
+	}
+	p.recordAudit(options.AuditEventSessionCreated, req, session, audit.OutcomeSuccess, "Created session")
+
+	scope := middlewareapi.GetRequestScope(req)
+	if scope == nil || scope.EvictedSessions == 0 {
+		return nil
+	}
+	username := session.Email
+	if username == "" {
+		username = session.User
+	}
+	logger.PrintAuthf(username, req, logger.AuthSuccess, "Evicted the %d oldest sessions of the user past the maximum of %d sessions", scope.EvictedSessions, p.maxSessionsPerUser)
+	p.sendSessionEvent(options.SessionEventEvicted, username, req, logger.AuthSuccess, "Evicted the %d oldest sessions of the user past the maximum of %d sessions", scope.EvictedSessions, p.maxSessionsPerUser)
+	p.recordAudit(options.AuditEventSessionRevoked, req, session, audit.OutcomeSuccess, "Evicted the %d oldest sessions of the user past the maximum of %d sessions", scope.EvictedSessions, p.maxSessionsPerUser)
+	return nil
+}
+
+// loadCSRF loads the CSRF of the login flow from its cookie, or from the
+// state of the callback for bearer sessions
+func (p *OAuthProxy) loadCSRF(req *http.Request) (cookies.CSRF, error) {
+	if !p.bearerSessions {
+		return cookies.LoadCSRFCookie(req, p.CookieOptions)
+	}
+	state, _, err := decodeState(req)
+	if err != nil {
+		return nil, err
+	}
+	return cookies.LoadCSRFState(state, p.CookieOptions)
+}
+
+// writeSessionToken outputs the bearer token of the session just saved, with
+// its lifetime, in JSON format
+func (p *OAuthProxy) writeSessionToken(rw http.ResponseWriter, req *http.Request) {
+	tokenInfo := struct {
+		Token     string `json:"token"`
+		TokenType string `json:"tokenType"`
+		ExpiresIn int64  `json:"expiresIn"`
+	}{
+		Token:     middlewareapi.GetRequestScope(req).SessionToken,
+		TokenType: "Bearer",
+		ExpiresIn: int64(p.CookieOptions.Expire / time.Second),
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(tokenInfo); err != nil {
+		logger.Printf("Error encoding session token: %v", err)
+	}
+}
+
+// logSessionSize logs the serialized size of a new session at debug level, so
+// that operators can tune the claims stored in sessions
+func logSessionSize(req *http.Request, session *sessionsapi.SessionState) {
+	size, err := session.SerializedSize()
+	if err != nil {
+		logger.Errorf("Error serializing session for %s: %v", session.Email, err)
+		return
+	}
+	logger.DebugfContext(req.Context(), "Session for %s is %d bytes serialized, with %d stored claims", session.Email, size, len(session.Claims))
+}
+
+func (p *OAuthProxy) redeemCode(req *http.Request, codeVerifier string) (*sessionsapi.SessionState, error) {
+	code := req.Form.Get("code")
+	if code == "" {
+		return nil, providers.ErrMissingCode
+	}
+
+	redirectURI := p.getOAuthRedirectURI(req)
+	s, err := p.provider.Redeem(req.Context(), redirectURI, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// Force setting these in case the Provider didn't
+	if s.CreatedAt == nil {
+		s.CreatedAtNow()
+	}
+	if s.ExpiresOn == nil {
+		s.ExpiresIn(p.CookieOptions.Expire)
+	}
+
+	return s, nil
+}
+
+func (p *OAuthProxy) enrichSessionState(ctx context.Context, s *sessionsapi.SessionState) error {
+	var err error
+	if s.Email == "" {
+		// TODO(@NickMeves): Remove once all provider are updated to implement EnrichSession
+		// nolint:staticcheck
+		s.Email, err = p.provider.GetEmailAddress(ctx, s)
+		if err != nil && !errors.Is(err, providers.ErrNotImplemented) {
+			return err
+		}
+	}
+
+	return p.provider.EnrichSession(ctx, s)
+}
+
+// AuthOnly checks whether the user is currently logged in (both authentication
+// and optional authorization).
+func (p *OAuthProxy) AuthOnly(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		if p.authRedirectHeader != "" {
+			rw.Header().Set(p.authRedirectHeader, p.getAuthOnlyRedirectURL(req))
+		}
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// Unauthorized cases need to return 403 to prevent infinite redirects with
+	// subrequest architectures
+	if !authOnlyAuthorize(req, session) {
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// The external authorization decides on the request the auth request is
+	// made for, rather than the auth endpoint
+	if session != nil {
+		if err := p.authorizeExternally(authOnlyTarget(req), session); err != nil {
+			p.denyExternally(rw, req, session, err)
+			return
+		}
+	}
+
+	// we are authenticated
+	if !p.authResponseHeaders {
+		p.addHeadersForProxying(rw, session)
+	}
+	p.authResponseChain.Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	})).ServeHTTP(rw, req)
+}
+
+// Proxy proxies the user request if the user is authenticated else it prompts
+// them to authenticate
+func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
+	if p.respondToPreflight && p.corsPreflight.IsAllowed(req) {
+		p.corsPreflight.ServeHTTP(rw, req)
+		return
+	}
+
+	if p.serveMaintenance(rw, req) {
+		return
+	}
+
+	if p.signedURL != nil && signedurl.IsSigned(req) {
+		p.proxySignedURL(rw, req)
+		return
+	}
+
+	if p.probeCredentials != nil && p.proxyProbe(rw, req) {
+		return
+	}
+
+	scope := middlewareapi.GetRequestScope(req)
+	if scope.SessionStoreUnavailable {
+		if cache, ok := p.sessionStore.(sessionsapi.SessionCache); ok {
+			scope.Session = cache.LoadCached(req)
+		}
+	}
+
+	_, span := tracing.Tracer().Start(req.Context(), "authorize")
+	session, err := p.getAuthenticatedSession(rw, req)
+	if scope.SessionStoreUnavailable && (err == nil || err == ErrNeedsLogin) && !p.IsAllowedRequest(req) {
+		// The session couldn't be loaded from the store, the policy of the
+		// upstream decides whether the request is served
+		scope.SessionDegraded = true
+		err = nil
+	}
+	var routeErr error
+	if err == nil {
+		routeErr = p.authorizeRoute(req, session)
+	}
+	endAuthorizeSpan(span, err, routeErr)
+
+	switch err {
+	case nil:
+		// we are authenticated
+		if routeErr != nil {
+			p.denyRoute(rw, req, session, routeErr)
+			return
+		}
+		if maxAge, ok := p.recentAuthMaxAge(req); ok && session != nil && !p.IsAllowedRequest(req) && !isRecentAuth(req.Context(), session, maxAge) {
+			p.requireRecentAuth(rw, req, session, maxAge)
+			return
+		}
+		if err := p.authorizeExternally(req, session); err != nil {
+			p.denyExternally(rw, req, session, err)
+			return
+		}
+		p.addHeadersForProxying(rw, session)
+		if p.bearerSessions {
+			// The session token is never passed on to upstreams
+			req.Header.Del("Authorization")
+		}
+		scope.AuthenticationSkipped = session == nil && p.IsAllowedRequest(req)
+		p.headersChain.Then(p.upstreamProxy).ServeHTTP(rw, req)
+	case ErrNeedsLogin:
+		if middlewareapi.GetRequestScope(req).BearerTokenRejected {
+			// The client can't sign in to replace its bearer token
+			logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via bearer token: the token is not active or could not be introspected")
+			rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			p.errorJSON(rw, req, http.StatusUnauthorized)
+			return
+		}
+
+		// we need to send the user to a login screen
+		if p.forceJSONErrors || p.problemJSONErrors || p.bearerSessions || p.apiClientRules.IsAPIClient(req) || p.isAPIPath(req) {
+			logger.Printf("No valid authentication in request. Access Denied.")
+			// no point redirecting an AJAX request
+			p.errorJSON(rw, req, http.StatusUnauthorized)
+			return
+		}
+
+		if p.sessionResetPage && middlewareapi.GetRequestScope(req).SessionReset {
+			// The session cookie has already been cleared, so the page is only
+			// shown once before the user signs in again
+			logger.Printf("Session cookie could not be decoded. Rendering the session reset page.")
+			p.ErrorPage(rw, req, http.StatusUnauthorized, "The session cookie could not be decoded", "Your session has been reset. Please sign in again.")
+			return
+		}
+
+		logger.Printf("No valid authentication in request. Initiating login.")
+		if p.SkipProviderButton {
+			// start OAuth flow, but only with the default login URL params - do not
+			// consider this request's query params as potential overrides, since
+			// the user did not explicitly start the login flow
+			p.doOAuthStart(rw, req, nil)
+		} else if !p.redirectToKnownProvider(rw, req, "") {
+			p.SignInPage(rw, req, http.StatusForbidden)
+		}
+
+	case ErrAccessDenied:
+		if p.forceJSONErrors {
+			p.errorJSON(rw, req, http.StatusForbidden)
+		} else {
+			p.ErrorPage(rw, req, http.StatusForbidden, "The session failed authorization checks")
+		}
+
+	default:
+		// unknown error
+		logger.Errorf("Unexpected internal error: %v", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// endAuthorizeSpan ends the authorize span with the outcome of the
+// authentication and route authorization of the request.
+// Requests that must log in, or are denied, are expected outcomes rather than
+// errors of the span.
+func endAuthorizeSpan(span trace.Span, err, routeErr error) {
+	switch {
+	case err == nil && routeErr == nil:
+		span.SetAttributes(tracing.AuthorizationKey.String("allowed"))
+	case err == nil:
+		span.SetAttributes(tracing.AuthorizationKey.String("route_denied"))
+	case err == ErrNeedsLogin:
+		span.SetAttributes(tracing.AuthorizationKey.String("needs_login"))
+	case err == ErrAccessDenied:
+		span.SetAttributes(tracing.AuthorizationKey.String("denied"))
+	default:
+		tracing.End(span, err)
+		return
+	}
+	span.End()
+}
+
+// authorizeRoute checks the request against the route access rules matching
+// its path, with the current time, the real client IP and the groups of the
+// session.
+// Requests that are allowed without authentication, including those from
+// trusted IPs, are not checked.
+func (p *OAuthProxy) authorizeRoute(req *http.Request, session *sessionsapi.SessionState) error {
+	if len(p.routeAccessRules) == 0 || p.IsAllowedRequest(req) {
+		return nil
+	}
+
+	clientIP, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for route access rules: %v", err)
+	}
+	var groups []string
+	var authProvider string
+	if session != nil {
+		groups = session.Groups
+		authProvider = session.AuthProvider
+	}
+	return p.routeAccessRules.Authorize(req.URL.Path, p.clock.Now(), clientIP, groups, authProvider)
+}
+
+// denyRoute logs the route access rule the request was denied by and sends
+// a 403, even though the session is otherwise valid. Requests outside the
+// access window of the rule are told when the page can be accessed.
+func (p *OAuthProxy) denyRoute(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, err error) {
+	var email string
+	if session != nil {
+		email = session.Email
+	}
+	logger.PrintAuthf(email, req, logger.AuthFailure, "Denied authorization via route access rule: %v", err)
+	p.sendSessionEvent(options.SessionEventAuthorizationDenied, email, req, logger.AuthFailure, "Denied authorization via route access rule: %v", err)
+	p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Denied authorization via route access rule: %v", err)
+
+	if p.forceJSONErrors {
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+	if denied, ok := err.(*routeaccess.DeniedError); ok && denied.Window != "" {
+		p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "This page can only be accessed during its access window: %s.", denied.Window)
+		return
+	}
+	p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "You are not allowed to access this page from your network or account.")
+}
+
+// authorizeExternally asks the external authorization endpoint whether the
+// request may be proxied, with its session and real client IP.
+// Requests that are allowed without authentication are not checked.
+func (p *OAuthProxy) authorizeExternally(req *http.Request, session *sessionsapi.SessionState) error {
+	if p.externalAuthz == nil || p.IsAllowedRequest(req) {
+		return nil
+	}
+
+	clientIP, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for external authorization: %v", err)
+	}
+	return p.externalAuthz.Authorize(req, session, clientIP)
+}
+
+// denyExternally sends a 403 for the requests denied by the external
+// authorization endpoint, and a 503 when the endpoint could not decide.
+func (p *OAuthProxy) denyExternally(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, err error) {
+	var email string
+	if session != nil {
+		email = session.Email
+	}
+
+	if _, ok := err.(*externalauthz.DeniedError); !ok {
+		logger.Errorf("Error authorizing request for %s: %v", email, err)
+		if p.forceJSONErrors {
+			p.errorJSON(rw, req, http.StatusServiceUnavailable)
+			return
+		}
+		p.ErrorPage(rw, req, http.StatusServiceUnavailable, err.Error(), "The authorization service is unavailable. Please try again later.")
+		return
+	}
+
+	logger.PrintAuthf(email, req, logger.AuthFailure, "Denied authorization via external authorization: %v", err)
+	p.sendSessionEvent(options.SessionEventAuthorizationDenied, email, req, logger.AuthFailure, "Denied authorization via external authorization: %v", err)
+	p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Denied authorization via external authorization: %v", err)
+	if p.forceJSONErrors {
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+	p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "You are not allowed to access this page.")
+}
+
+// proxySignedURL proxies requests to signed URLs without a session when the
+// signature is valid for the request, and denies them otherwise.
+// The signed URL parameters are removed before the request is proxied.
+// Signed requests are still authorized by the route access rules, upstream
+// policies and external authorization, without a session, as they would
+// otherwise bypass them.
+func (p *OAuthProxy) proxySignedURL(rw http.ResponseWriter, req *http.Request) {
+	clientIP, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for signed URL: %v", err)
+	}
+
+	if err := p.signedURL.Verify(req, clientIP); err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid signed URL: %v", err)
+		if p.forceJSONErrors {
+			p.errorJSON(rw, req, http.StatusForbidden)
+		} else {
+			p.ErrorPage(rw, req, http.StatusForbidden, "The signed URL is invalid or has expired")
+		}
+		return
+	}
+
+	logger.PrintAuthf("", req, logger.AuthSuccess, "Authenticated via signed URL")
+	signedurl.Strip(req)
+	// The request is authorized by the signature, not a session the client
+	// may also have, so it is proxied anonymously
+	middlewareapi.GetRequestScope(req).Session = nil
+
+	if err := p.authorizeRoute(req, nil); err != nil {
+		p.denyRoute(rw, req, nil, err)
+		return
+	}
+	if err := p.authorizePolicies(req, nil); err != nil {
+		p.denyPolicies(rw, req, err)
+		return
+	}
+	if err := p.authorizeExternally(req, nil); err != nil {
+		p.denyExternally(rw, req, nil, err)
+		return
+	}
+	middlewareapi.GetRequestScope(req).AuthenticationSkipped = true
+	p.headersChain.Then(p.upstreamProxy).ServeHTTP(rw, req)
+}
+
+// denyPolicies sends a 403 for the requests without a session denied by the
+// policies of their upstream
+func (p *OAuthProxy) denyPolicies(rw http.ResponseWriter, req *http.Request, err error) {
+	logger.PrintAuthf("", req, logger.AuthFailure, "Denied authorization via upstream policies: %v", err)
+	p.recordAudit(options.AuditEventAuthorizationDenied, req, nil, audit.OutcomeFailure, "Denied authorization via upstream policies: %v", err)
+
+	if p.forceJSONErrors {
+		p.errorJSON(rw, req, http.StatusForbidden)
+		return
+	}
+	p.ErrorPage(rw, req, http.StatusForbidden, err.Error(), "You are not allowed to access this page.")
+}
+
+// proxyProbe proxies a request authenticated by a probe credential, returning
+// whether it did. The probe token is removed from every request presenting
+// one, and requests outside the scope of the credential are left to be
+// handled as any other request.
+func (p *OAuthProxy) proxyProbe(rw http.ResponseWriter, req *http.Request) bool {
+	credential, err := p.probeCredentials.Authenticate(req)
+	if err == probe.ErrNoCredential {
+		return false
+	}
+	p.probeCredentials.Strip(req)
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid probe credential: %v", err)
+		return false
+	}
+
+	logger.PrintAuthf(credential.User, req, logger.AuthSuccess, "Authenticated via probe credential %q", credential.Name)
+	// The request is authorized by the probe credential, not a session the
+	// client may also have, so it is proxied with the synthetic identity of
+	// the probe, if any
+	scope := middlewareapi.GetRequestScope(req)
+	scope.Session = nil
+	if credential.User != "" {
+		scope.Session = &sessionsapi.SessionState{User: credential.User}
+	}
+	p.headersChain.Then(p.upstreamProxy).ServeHTTP(rw, req)
+	return true
+}
+
+// requireRecentAuth sends the user to sign in again, with the provider asked
+// to re-authenticate them, as the request requires a more recent
+// authentication than that of the session.
+// API clients and requests authenticated by their Authorization header can't
+// sign in again, so are denied with a 401 explaining the error instead.
+func (p *OAuthProxy) requireRecentAuth(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, maxAge time.Duration) {
+	maxAgeSeconds := int(maxAge.Seconds())
+	if p.forceJSONErrors || p.problemJSONErrors || p.apiClientRules.IsAPIClient(req) || p.isAPIPath(req) || req.Header.Get("Authorization") != "" {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Recent authentication required: the session was not authenticated within %s", maxAge)
+		message := fmt.Sprintf("Authentication within the last %s is required", maxAge)
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description=%q, max_age=%d`, message, maxAgeSeconds))
+		if p.problemJSONErrors {
+			p.ErrorPage(rw, req, http.StatusUnauthorized, message)
+			return
+		}
+
+		rw.Header().Set("Content-Type", applicationJSON)
+		rw.WriteHeader(http.StatusUnauthorized)
+		if err := json.NewEncoder(rw).Encode(map[string]string{
+			"error":             "insufficient_user_authentication",
+			"error_description": message,
+		}); err != nil {
+			logger.Errorf("Error encoding recent authentication error: %v", err)
+		}
+		return
+	}
+
+	logger.Printf("Recent authentication required for %s. Initiating login.", session.Email)
+	http.Redirect(rw, req, p.getOAuthStartURL(req, url.Values{
+		"prompt":  []string{"login"},
+		"max_age": []string{strconv.Itoa(maxAgeSeconds)},
+	}), http.StatusFound)
+}
+
+// isRecentAuth checks whether the user of the session authenticated within
+// the max age
+func isRecentAuth(ctx context.Context, session *sessionsapi.SessionState, maxAge time.Duration) bool {
+	authTime := session.AuthTime
+	if authTime == nil {
+		// Bearer token sessions aren't created by a login
+		authTime = idTokenAuthTime(ctx, session.IDToken)
+	}
+	return authTime != nil && session.Clock.Now().Sub(*authTime) <= maxAge
+}
+
+// setAuthTime records when the user of a new session authenticated, from the
+// auth_time claim of the ID token or otherwise the time of the login
+func setAuthTime(ctx context.Context, session *sessionsapi.SessionState) {
+	authTime := idTokenAuthTime(ctx, session.IDToken)
+	if authTime == nil {
+		now := session.Clock.Now()
+		authTime = &now
+	}
+	session.AuthTime = authTime
+}
+
+// idTokenAuthTime returns the auth_time claim of the ID token, if it has one
+func idTokenAuthTime(ctx context.Context, idToken string) *time.Time {
+	if idToken == "" {
+		return nil
+	}
+	extractor, err := providerutil.NewClaimExtractor(ctx, idToken, nil, nil)
+	if err != nil {
+		return nil
+	}
+
+	var claim string
+	if exists, err := extractor.GetClaimInto("auth_time", &claim); err != nil || !exists {
+		return nil
+	}
+	seconds, err := strconv.ParseFloat(claim, 64)
+	if err != nil {
+		return nil
+	}
+	authTime := time.Unix(int64(seconds), 0)
+	return &authTime
+}
+
+// See https://developers.google.com/web/fundamentals/performance/optimizing-content-efficiency/http-caching?hl=en
+var noCacheHeaders = map[string]string{
+	"Expires":         time.Unix(0, 0).Format(time.RFC1123),
+	"Cache-Control":   "no-cache, no-store, must-revalidate, max-age=0",
+	"X-Accel-Expires": "0", // https://www.nginx.com/resources/wiki/start/topics/examples/x-accel/
+}
+
+// prepareNoCache prepares headers for preventing browser caching.
+func prepareNoCache(w http.ResponseWriter) {
+	// Set NoCache headers
+	for k, v := range noCacheHeaders {
+		w.Header().Set(k, v)
+	}
+}
+
+func prepareNoCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		prepareNoCache(rw)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// getAuthOnlyRedirectURL returns the URL that starts the login flow for a
+// request to the auth endpoint, returning the user to the original request
+// once authenticated.
+func (p *OAuthProxy) getAuthOnlyRedirectURL(req *http.Request) string {
+	return p.getOAuthStartURL(req, url.Values{})
+}
+
+// getOAuthStartURL returns the URL that starts the login flow with the query,
+// returning the user to the original request once authenticated.
+func (p *OAuthProxy) getOAuthStartURL(req *http.Request, query url.Values) string {
+	appRedirect, err := p.appDirector.GetRedirect(req)
+	if err != nil {
+		logger.Errorf("Error obtaining application redirect: %v", err)
+		appRedirect = p.defaultRedirect
+	}
+	query.Set("rd", appRedirect)
+
+	start := url.URL{
+		Scheme:   requestutil.GetRequestProto(req),
+		Host:     requestutil.GetRequestHost(req),
+		Path:     p.ProxyPrefix + oauthStartPath,
+		RawQuery: query.Encode(),
+	}
+
+	// If there's no scheme in the request, we should still include one
+	if start.Scheme == "" {
+		start.Scheme = schemeHTTP
+	}
+	if p.CookieOptions.Secure {
+		start.Scheme = schemeHTTPS
+	}
+	return start.String()
+}
+
+// getOAuthRedirectURI returns the redirectURL that the upstream OAuth Provider will
+// redirect clients to once authenticated.
+// This is usually the OAuthProxy callback URL.
+func (p *OAuthProxy) getOAuthRedirectURI(req *http.Request) string {
+	// if `p.redirectURL` already has a host, return it
+	if p.redirectURL.Host != "" {
+		return p.redirectURL.String()
+	}
+
+	// Otherwise figure out the scheme + host from the request
+	rd := *p.redirectURL
+	rd.Host = requestutil.GetRequestHost(req)
+	rd.Scheme = requestutil.GetRequestProto(req)
+
+	// If there's no scheme in the request, we should still include one
+	if rd.Scheme == "" {
+		rd.Scheme = schemeHTTP
+	}
+
+	// If CookieSecure is true, return `https` no matter what
+	// Not all reverse proxies set X-Forwarded-Proto
+	if p.CookieOptions.Secure {
+		rd.Scheme = schemeHTTPS
+	}
+	return rd.String()
+}
+
+// sendSessionEvent sends the event to the session events webhook, when it is
+// enabled.
+// The session itself is never included, as it holds the user's tokens.
+func (p *OAuthProxy) sendSessionEvent(eventType, username string, req *http.Request, status logger.AuthStatus, format string, a ...interface{}) {
+	if p.sessionEvents != nil {
+		p.sessionEvents.Send(eventType, username, req, status, format, a...)
+	}
+}
+
+// recordAudit writes the event to the audit log, when it is enabled, with the
+// identity of the session, if any
+func (p *OAuthProxy) recordAudit(eventType string, req *http.Request, session *sessionsapi.SessionState, outcome audit.Outcome, format string, a ...interface{}) {
+	if p.auditLogger != nil {
+		p.auditLogger.Record(eventType, req, session, outcome, format, a...)
+	}
+}
+
+// revokeSession revokes the tokens of a session that is being removed at the
+// provider, recording the outcome in the auth log.
+// This is best effort: the session is still removed locally when the tokens
+// can't be revoked. Providers without a revocation endpoint are skipped, as
+// are sessions from bearer tokens, which are not issued to the proxy.
+func (p *OAuthProxy) revokeSession(req *http.Request, session *sessionsapi.SessionState, reason string) {
+	if session.BearerToken != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), revokeSessionTimeout)
+	defer cancel()
+
+	err := p.provider.RevokeSession(ctx, session)
+	switch {
+	case errors.Is(err, providers.ErrNotImplemented):
+	case err != nil:
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "Unable to revoke session tokens on %s: %v", reason, err)
+	default:
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Revoked session tokens on %s", reason)
+	}
+}
+
+// getAuthenticatedSession checks whether a user is authenticated and returns a session object and nil error if so
+// Returns:
+// - `nil, ErrNeedsLogin` if user needs to login.
+// - `nil, nil` if there is no session, but the policies of the upstream allow
+// the request anonymously.
+// - `nil, ErrAccessDenied` if the authenticated user is not authorized
+// Set-Cookie headers may be set on the response as a side-effect of calling this method.
+func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
+	session := middlewareapi.GetRequestScope(req).Session
+
+	// Check this after loading the session so that if a valid session exists, we can add headers from it
+	if p.IsAllowedRequest(req) {
+		return session, nil
+	}
+
+	if session == nil {
+		if p.isAnonymousRequest(req) {
+			return nil, nil
+		}
+		return nil, ErrNeedsLogin
+	}
+
+	invalidEmail := session.Email != "" && !p.Validator(session.Email)
+	authorized, err := p.provider.Authorize(req.Context(), session)
+	if err != nil {
+		logger.Errorf("Error with authorization: %v", err)
+	}
+
+	if invalidEmail || !authorized {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authorization via session: removing session %s", session)
+		p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Invalid authorization via session: removing session")
+		p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Invalid authorization via session")
+		p.recordAudit(options.AuditEventSessionRevoked, req, session, audit.OutcomeSuccess, "Removed session on invalid authorization")
+		// Invalid session, clear it
+		p.revokeSession(req, session, "invalid authorization")
+		err := p.ClearSessionCookie(rw, req)
+		if err != nil {
+			logger.Errorf("Error clearing session cookie: %v", err)
+		}
+		return nil, ErrAccessDenied
+	}
+
+	// Deny lists take precedence over any allow rules
+	if err := p.checkDenyLists(session); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Denied authorization via session: removing session %s: %v", session, err)
+		p.sendSessionEvent(options.SessionEventAuthorizationDenied, session.Email, req, logger.AuthFailure, "Denied authorization via session: removing session: %v", err)
+		p.recordAudit(options.AuditEventAuthorizationDenied, req, session, audit.OutcomeFailure, "Denied authorization via session: %v", err)
+		p.recordAudit(options.AuditEventSessionRevoked, req, session, audit.OutcomeSuccess, "Removed session on denied authorization")
+		p.revokeSession(req, session, "denied authorization")
+		err := p.ClearSessionCookie(rw, req)
+		if err != nil {
+			logger.Errorf("Error clearing session cookie: %v", err)
+		}
+		return nil, ErrAccessDenied
+	}
+
+	return session, nil
+}
+
+// checkDenyLists checks the session against the denied emails, email domains
+// and groups, returning an error describing the denial if any match.
+func (p *OAuthProxy) checkDenyLists(s *sessionsapi.SessionState) error {
+	if p.deniedEmailValidator(s.Email) {
+		return fmt.Errorf("email %q is denied", s.Email)
+	}
+
+	deniedGroups := p.provider.Data().DeniedGroups
+	for _, group := range s.Groups {
+		if _, ok := deniedGroups[group]; ok {
+			return fmt.Errorf("group %q is denied", group)
+		}
+	}
+	return nil
+}
+
+// authOnlyTarget returns the request an auth request is made for, with the
+// host and URI forwarded by the reverse proxy when they are trusted
+func authOnlyTarget(req *http.Request) *http.Request {
+	target := req.Clone(req.Context())
+	target.Host = requestutil.GetRequestHost(req)
+	if uri, err := url.ParseRequestURI(requestutil.GetRequestURI(req)); err == nil {
+		target.URL = uri
+		target.RequestURI = uri.RequestURI()
+	}
+	return target
+}
+
+// authOnlyAuthorize handles special authorization logic that is only done
+// on the AuthOnly endpoint for use with Nginx subrequest architectures.
+func authOnlyAuthorize(req *http.Request, s *sessionsapi.SessionState) bool {
+	// Allow requests previously allowed to be bypassed
+	if s == nil {
+		return true
+	}
+
+	constraints := []func(*http.Request, *sessionsapi.SessionState) bool{
+		checkAllowedGroups,
+		checkAllowedEmailDomains,
+		checkAllowedEmails,
+	}
+
+	for _, constraint := range constraints {
+		if !constraint(req, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extractAllowedEntities aims to extract and split allowed entities linked by a key,
+// from an HTTP request query. Output is a map[string]struct{} where keys are valuable,
+// the goal is to avoid time complexity O(N^2) while finding matches during membership checks.
+func extractAllowedEntities(req *http.Request, key string) map[string]struct{} {
+	entities := map[string]struct{}{}
+
+	query := req.URL.Query()
+	for _, allowedEntities := range query[key] {
+		for _, entity := range strings.Split(allowedEntities, ",") {
+			if entity != "" {
+				entities[entity] = struct{}{}
+			}
+		}
+	}
+
+	return entities
+}
+
+// checkAllowedEmailDomains allow email domain restrictions based on the `allowed_email_domains`
+// querystring parameter
+func checkAllowedEmailDomains(req *http.Request, s *sessionsapi.SessionState) bool {
+	allowedEmailDomains := extractAllowedEntities(req, "allowed_email_domains")
+	if len(allowedEmailDomains) == 0 {
+		return true
+	}
+
+	splitEmail := strings.Split(s.Email, "@")
+	if len(splitEmail) != 2 {
+		return false
+	}
+
+	endpoint, _ := url.Parse("")
+	endpoint.Host = splitEmail[1]
+
+	allowedEmailDomainsList := []string{}
+	for ed := range allowedEmailDomains {
+		allowedEmailDomainsList = append(allowedEmailDomainsList, ed)
+	}
+
+	return util.IsEndpointAllowed(endpoint, allowedEmailDomainsList)
+}
+
+// checkAllowedGroups allow secondary group restrictions based on the `allowed_groups`
+// querystring parameter
+func checkAllowedGroups(req *http.Request, s *sessionsapi.SessionState) bool {
+	allowedGroups := extractAllowedEntities(req, "allowed_groups")
+	if len(allowedGroups) == 0 {
+		return true
+	}
+
+	for _, group := range s.Groups {
+		if _, ok := allowedGroups[group]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAllowedEmails allow email restrictions based on the `allowed_emails`
+// querystring parameter
+func checkAllowedEmails(req *http.Request, s *sessionsapi.SessionState) bool {
+	allowedEmails := extractAllowedEntities(req, "allowed_emails")
+	if len(allowedEmails) == 0 {
+		return true
+	}
+
+	allowed := false
+
+	for email := range allowedEmails {
+		if email == s.Email {
+			allowed = true
+			break
+		}
+	}
+
+	return allowed
+}
+
+// encodedState builds the OAuth state param out of our nonce and
+// original application redirect
+func encodeState(nonce string, redirect string) string {
+	return fmt.Sprintf("%v:%v", nonce, redirect)
+}
+
+// decodeState splits the reflected OAuth state response back into
+// the nonce and original application redirect
+func decodeState(req *http.Request) (string, string, error) {
+	state := strings.SplitN(req.Form.Get("state"), ":", 2)
+	if len(state) != 2 {
+		return "", "", errors.New("invalid length")
+	}
+	return state[0], state[1], nil
+}
+
+// addHeadersForProxying adds the appropriate headers the request / response for proxying
+func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, session *sessionsapi.SessionState) {
+	if session == nil {
+		return
+	}
+	if session.Email == "" {
+		rw.Header().Set("GAP-Auth", session.User)
+	} else {
+		rw.Header().Set("GAP-Auth", session.Email)
+	}
+}
+
+// errorJSON returns the error code with an application/json mime type.
+// When problem details are enabled, the error is written as problem details
+// instead.
+func (p *OAuthProxy) errorJSON(rw http.ResponseWriter, req *http.Request, code int) {
+	if p.problemJSONErrors {
+		p.ErrorPage(rw, req, code, http.StatusText(code))
+		return
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(code)
+	// we need to send some JSON response because we set the Content-Type to
+	// application/json
+	rw.Write([]byte("{}"))
+}
@@ -0,0 +1,8127 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/mbland/hmacauth"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/redirect"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/audit"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/cookies"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/fallback"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/middleware"
+	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+	sessionscookie "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/cookie"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// The rawCookieSecret is 32 bytes and the base64CookieSecret is the base64
+	// encoded version of this.
+	rawCookieSecret    = "secretthirtytwobytes+abcdefghijk"
+	base64CookieSecret = "c2VjcmV0dGhpcnR5dHdvYnl0ZXMrYWJjZGVmZ2hpams"
+	clientID           = "3984n253984d7348dm8234yf982t"
+	clientSecret       = "gv3498mfc9t23y23974dm2394dm9"
+)
+
+func init() {
+	logger.SetFlags(logger.Lshortfile)
+}
+
+func TestRobotsTxt(t *testing.T) {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/robots.txt", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", rw.Body.String())
+}
+
+func TestIdentityAssertionJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keyData, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	keyFile, err := ioutil.TempFile("", "oauth2-proxy-identity-assertion")
+	assert.NoError(t, err)
+	defer os.Remove(keyFile.Name())
+	assert.NoError(t, pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData}))
+	assert.NoError(t, keyFile.Close())
+
+	opts := baseTestOptions()
+	opts.IdentityAssertion.SigningKeyFile = keyFile.Name()
+	err = validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/.well-known/jwks.json", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	keySet := jose.JSONWebKeySet{}
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keySet))
+	assert.Len(t, keySet.Keys, 1)
+	assert.Equal(t, "ES256", keySet.Keys[0].Algorithm)
+	assert.Equal(t, key.Public(), keySet.Keys[0].Key)
+}
+
+type TestProvider struct {
+	*providers.ProviderData
+	EmailAddress   string
+	ValidToken     bool
+	GroupValidator func(string) bool
+}
+
+var _ providers.Provider = (*TestProvider)(nil)
+
+func NewTestProvider(providerURL *url.URL, emailAddress string) *TestProvider {
+	return &TestProvider{
+		ProviderData: &providers.ProviderData{
+			ProviderName: "Test Provider",
+			LoginURL: &url.URL{
+				Scheme: "http",
+				Host:   providerURL.Host,
+				Path:   "/oauth/authorize",
+			},
+			RedeemURL: &url.URL{
+				Scheme: "http",
+				Host:   providerURL.Host,
+				Path:   "/oauth/token",
+			},
+			ProfileURL: &url.URL{
+				Scheme: "http",
+				Host:   providerURL.Host,
+				Path:   "/api/v1/profile",
+			},
+			Scope: "profile.email",
+		},
+		EmailAddress: emailAddress,
+		GroupValidator: func(s string) bool {
+			return true
+		},
+	}
+}
+
+func (tp *TestProvider) GetEmailAddress(_ context.Context, _ *sessions.SessionState) (string, error) {
+	return tp.EmailAddress, nil
+}
+
+func (tp *TestProvider) ValidateSession(_ context.Context, _ *sessions.SessionState) bool {
+	return tp.ValidToken
+}
+
+func Test_redeemCode(t *testing.T) {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = proxy.redeemCode(req, "")
+	assert.Equal(t, providers.ErrMissingCode, err)
+}
+
+func Test_enrichSession(t *testing.T) {
+	const (
+		sessionUser   = "Mr Session"
+		sessionEmail  = "session@example.com"
+		providerEmail = "provider@example.com"
+	)
+
+	testCases := map[string]struct {
+		session       *sessions.SessionState
+		expectedUser  string
+		expectedEmail string
+	}{
+		"Session already has enrichable fields": {
+			session: &sessions.SessionState{
+				User:  sessionUser,
+				Email: sessionEmail,
+			},
+			expectedUser:  sessionUser,
+			expectedEmail: sessionEmail,
+		},
+		"Session is missing Email and GetEmailAddress is implemented": {
+			session: &sessions.SessionState{
+				User: sessionUser,
+			},
+			expectedUser:  sessionUser,
+			expectedEmail: providerEmail,
+		},
+		"Session is missing User and GetUserName is not implemented": {
+			session: &sessions.SessionState{
+				Email: sessionEmail,
+			},
+			expectedUser:  "",
+			expectedEmail: sessionEmail,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := baseTestOptions()
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy.provider = NewTestProvider(&url.URL{Host: "www.example.com"}, providerEmail)
+
+			err = proxy.enrichSessionState(context.Background(), tc.session)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedUser, tc.session.User)
+			assert.Equal(t, tc.expectedEmail, tc.session.Email)
+		})
+	}
+}
+
+func TestBasicAuthPassword(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("%#v", r)
+		var payload string
+		switch r.URL.Path {
+		case "/oauth/token":
+			payload = `{"access_token": "my_auth_token"}`
+		default:
+			payload = r.Header.Get("Authorization")
+			if payload == "" {
+				payload = "No Authorization header found."
+			}
+		}
+		w.WriteHeader(200)
+		_, err := w.Write([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	basicAuthPassword := "This is a secure password"
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   providerServer.URL,
+				Path: "/",
+				URI:  providerServer.URL,
+			},
+		},
+	}
+
+	opts.Cookie.Secure = false
+	opts.InjectRequestHeaders = []options.Header{
+		{
+			Name: "Authorization",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "email",
+						BasicAuthPassword: &options.SecretSource{
+							Value: []byte(basicAuthPassword),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	const emailAddress = "john.doe@example.com"
+
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return email == emailAddress
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.provider = NewTestProvider(providerURL, emailAddress)
+
+	// Save the required session
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	err = proxy.sessionStore.Save(rw, req, &sessions.SessionState{
+		Email: emailAddress,
+	})
+	assert.NoError(t, err)
+
+	// Extract the cookie value to inject into the test request
+	cookie := rw.Header().Values("Set-Cookie")[0]
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", cookie)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	// The username in the basic auth credentials is expected to be equal to the email address from the
+	// auth response, so we use the same variable here.
+	expectedHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(emailAddress+":"+basicAuthPassword))
+	assert.Equal(t, expectedHeader, rw.Body.String())
+	providerServer.Close()
+}
+
+func TestBasicAuthAuthorizationConflict(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Client-Authorization"))
+	}))
+	defer upstreamServer.Close()
+
+	const emailAddress = "john.doe@example.com"
+	const basicAuthPassword = "This is a secure password"
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(emailAddress+":"+basicAuthPassword))
+	const clientToken = "Bearer client-api-token"
+
+	testCases := []struct {
+		name                string
+		policy              string
+		clientAuthorization string
+		expected            string
+	}{
+		{
+			name:                "overwrite replaces the client's token",
+			policy:              options.AuthorizationConflictOverwrite,
+			clientAuthorization: clientToken,
+			expected:            basicAuth + "|",
+		},
+		{
+			name:                "the default policy replaces the client's token",
+			policy:              "",
+			clientAuthorization: clientToken,
+			expected:            basicAuth + "|",
+		},
+		{
+			name:                "preserve-client sends the client's token",
+			policy:              options.AuthorizationConflictPreserveClient,
+			clientAuthorization: clientToken,
+			expected:            clientToken + "|",
+		},
+		{
+			name:     "preserve-client sends the basic auth credentials without a client token",
+			policy:   options.AuthorizationConflictPreserveClient,
+			expected: basicAuth + "|",
+		},
+		{
+			name:                "move-client sends the client's token in the configured header",
+			policy:              options.AuthorizationConflictMoveClient,
+			clientAuthorization: clientToken,
+			expected:            basicAuth + "|" + clientToken,
+		},
+		{
+			name:     "move-client sends the basic auth credentials without a client token",
+			policy:   options.AuthorizationConflictMoveClient,
+			expected: basicAuth + "|",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    upstreamServer.URL,
+						Path:                  "/",
+						URI:                   upstreamServer.URL,
+						AuthorizationConflict: tc.policy,
+					},
+				},
+			}
+			if tc.policy == options.AuthorizationConflictMoveClient {
+				opts.UpstreamServers.Upstreams[0].ClientAuthorizationHeader = "X-Client-Authorization"
+			}
+			opts.InjectRequestHeaders = []options.Header{
+				{
+					Name: "Authorization",
+					Values: []options.HeaderValue{
+						{
+							ClaimSource: &options.ClaimSource{
+								Claim: "email",
+								BasicAuthPassword: &options.SecretSource{
+									Value: []byte(basicAuthPassword),
+								},
+							},
+						},
+					},
+				},
+			}
+			assert.NoError(t, validation.Validate(opts))
+
+			proxy, err := NewOAuthProxy(opts, func(email string) bool {
+				return email == emailAddress
+			})
+			assert.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			assert.NoError(t, proxy.sessionStore.Save(rw, req, &sessions.SessionState{Email: emailAddress}))
+			cookie := rw.Header().Values("Set-Cookie")[0]
+
+			req, _ = http.NewRequest("GET", "/", nil)
+			req.Header.Set("Cookie", cookie)
+			if tc.policy == options.AuthorizationConflictMoveClient {
+				// The client can't set the header the token is moved to
+				req.Header.Set("X-Client-Authorization", "spoofed")
+			}
+			if tc.clientAuthorization != "" {
+				req.Header.Set("Authorization", tc.clientAuthorization)
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tc.expected, rw.Body.String())
+		})
+	}
+}
+
+func TestPassGroupsHeadersWithGroups(t *testing.T) {
+	opts := baseTestOptions()
+	opts.InjectRequestHeaders = []options.Header{
+		{
+			Name: "X-Forwarded-Groups",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "groups",
+					},
+				},
+			},
+		},
+	}
+
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	const emailAddress = "john.doe@example.com"
+	const userName = "9fcab5c9b889a557"
+
+	groups := []string{"a", "b"}
+	created := time.Now()
+	session := &sessions.SessionState{
+		User:        userName,
+		Groups:      groups,
+		Email:       emailAddress,
+		AccessToken: "oauth_token",
+		CreatedAt:   &created,
+	}
+
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return email == emailAddress
+	})
+	assert.NoError(t, err)
+
+	// Save the required session
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	err = proxy.sessionStore.Save(rw, req, session)
+	assert.NoError(t, err)
+
+	// Extract the cookie value to inject into the test request
+	cookie := rw.Header().Values("Set-Cookie")[0]
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", cookie)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, []string{"a,b"}, req.Header["X-Forwarded-Groups"])
+}
+
+type PassAccessTokenTest struct {
+	providerServer *httptest.Server
+	proxy          *OAuthProxy
+	opts           *options.Options
+}
+
+type PassAccessTokenTestOptions struct {
+	PassAccessToken bool
+	ValidToken      bool
+	ProxyUpstream   options.Upstream
+}
+
+func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) (*PassAccessTokenTest, error) {
+	patt := &PassAccessTokenTest{}
+
+	patt.providerServer = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload string
+			switch r.URL.Path {
+			case "/oauth/token":
+				payload = `{"access_token": "my_auth_token"}`
+			default:
+				payload = r.Header.Get("X-Forwarded-Access-Token")
+				if payload == "" {
+					payload = "No access token found."
+				}
+			}
+			w.WriteHeader(200)
+			_, err := w.Write([]byte(payload))
+			if err != nil {
+				panic(err)
+			}
+		}))
+
+	patt.opts = baseTestOptions()
+	patt.opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   patt.providerServer.URL,
+				Path: "/",
+				URI:  patt.providerServer.URL,
+			},
+		},
+	}
+	if opts.ProxyUpstream.ID != "" {
+		patt.opts.UpstreamServers.Upstreams = append(patt.opts.UpstreamServers.Upstreams, opts.ProxyUpstream)
+	}
+
+	patt.opts.Cookie.Secure = false
+	if opts.PassAccessToken {
+		patt.opts.InjectRequestHeaders = []options.Header{
+			{
+				Name: "X-Forwarded-Access-Token",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim: "access_token",
+						},
+					},
+				},
+			},
+		}
+	}
+
+	err := validation.Validate(patt.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	providerURL, _ := url.Parse(patt.providerServer.URL)
+	const emailAddress = "michael.bland@gsa.gov"
+
+	testProvider := NewTestProvider(providerURL, emailAddress)
+	testProvider.ValidToken = opts.ValidToken
+	patt.proxy, err = NewOAuthProxy(patt.opts, func(email string) bool {
+		return email == emailAddress
+	})
+	patt.proxy.provider = testProvider
+	if err != nil {
+		return nil, err
+	}
+	return patt, nil
+}
+
+func (patTest *PassAccessTokenTest) Close() {
+	patTest.providerServer.Close()
+}
+
+func (patTest *PassAccessTokenTest) getCallbackEndpoint() (httpCode int, cookie string) {
+	rw := httptest.NewRecorder()
+
+	csrf, err := cookies.NewCSRF(patTest.proxy.CookieOptions, "")
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf(
+			"/oauth2/callback?code=callback_code&state=%s",
+			encodeState(csrf.HashOAuthState(), "%2F"),
+		),
+		strings.NewReader(""),
+	)
+	if err != nil {
+		return 0, ""
+	}
+
+	// rw is a dummy here, we just want the csrfCookie to add to our req
+	csrfCookie, err := csrf.SetCookie(httptest.NewRecorder(), req)
+	if err != nil {
+		panic(err)
+	}
+	req.AddCookie(csrfCookie)
+
+	patTest.proxy.ServeHTTP(rw, req)
+
+	if len(rw.Header().Values("Set-Cookie")) >= 2 {
+		cookie = rw.Header().Values("Set-Cookie")[1]
+	}
+
+	return rw.Code, cookie
+}
+
+// postCallbackEndpoint makes a form_post callback, as used by providers such as
+// Apple, and returns the status code and the auth cookie.
+func (patTest *PassAccessTokenTest) postCallbackEndpoint() (httpCode int, cookie string) {
+	rw := httptest.NewRecorder()
+
+	csrf, err := cookies.NewCSRF(patTest.proxy.CookieOptions, "")
+	if err != nil {
+		panic(err)
+	}
+
+	form := url.Values{}
+	form.Set("code", "callback_code")
+	form.Set("state", encodeState(csrf.HashOAuthState(), "/"))
+	req, err := http.NewRequest(http.MethodPost, "/oauth2/callback", strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, ""
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	csrfCookie, err := csrf.SetCookie(httptest.NewRecorder(), req)
+	if err != nil {
+		panic(err)
+	}
+	req.AddCookie(csrfCookie)
+
+	patTest.proxy.ServeHTTP(rw, req)
+
+	if len(rw.Header().Values("Set-Cookie")) >= 2 {
+		cookie = rw.Header().Values("Set-Cookie")[1]
+	}
+
+	return rw.Code, cookie
+}
+
+// getEndpointWithCookie makes a requests againt the oauthproxy with passed requestPath
+// and cookie and returns body and status code.
+func (patTest *PassAccessTokenTest) getEndpointWithCookie(cookie string, endpoint string) (httpCode int, accessToken string) {
+	cookieName := patTest.proxy.CookieOptions.Name
+	var value string
+	keyPrefix := cookieName + "="
+
+	for _, field := range strings.Split(cookie, "; ") {
+		value = strings.TrimPrefix(field, keyPrefix)
+		if value != field {
+			break
+		} else {
+			value = ""
+		}
+	}
+	if value == "" {
+		return 0, ""
+	}
+
+	req, err := http.NewRequest("GET", endpoint, strings.NewReader(""))
+	if err != nil {
+		return 0, ""
+	}
+	req.AddCookie(&http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Duration(24)),
+		HttpOnly: true,
+	})
+
+	rw := httptest.NewRecorder()
+	patTest.proxy.ServeHTTP(rw, req)
+	return rw.Code, rw.Body.String()
+}
+
+func TestForwardAccessTokenUpstream(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: true,
+		ValidToken:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(patTest.Close)
+
+	// A successful validation will redirect and set the auth cookie.
+	code, cookie := patTest.getCallbackEndpoint()
+	if code != 302 {
+		t.Fatalf("expected 302; got %d", code)
+	}
+	assert.NotNil(t, cookie)
+
+	// Now we make a regular request; the access_token from the cookie is
+	// forwarded as the "X-Forwarded-Access-Token" header. The token is
+	// read by the test provider server and written in the response body.
+	code, payload := patTest.getEndpointWithCookie(cookie, "/")
+	if code != 200 {
+		t.Fatalf("expected 200; got %d", code)
+	}
+	assert.Equal(t, "my_auth_token", payload)
+}
+
+func TestOAuthCallbackFormPost(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: true,
+		ValidToken:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(patTest.Close)
+
+	code, cookie := patTest.postCallbackEndpoint()
+	if code != 302 {
+		t.Fatalf("expected 302; got %d", code)
+	}
+	assert.NotEqual(t, "", cookie)
+
+	code, payload := patTest.getEndpointWithCookie(cookie, "/")
+	if code != 200 {
+		t.Fatalf("expected 200; got %d", code)
+	}
+	assert.Equal(t, "my_auth_token", payload)
+}
+
+func TestOAuthCallbackFormPostSameSiteNone(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: true,
+		ValidToken:      true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(patTest.Close)
+	// The cookie settings required by providers posting the callback
+	// cross-site, such as Apple
+	patTest.proxy.CookieOptions.SameSite = "none"
+	patTest.proxy.CookieOptions.Secure = true
+
+	rw := httptest.NewRecorder()
+	patTest.proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/start?rd=%2F", nil))
+	require.Equal(t, http.StatusFound, rw.Code)
+	location, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+
+	// Browsers only send the CSRF cookie with the cross-site POST of the
+	// callback when it is SameSite=None and Secure
+	var csrfCookie *http.Cookie
+	for _, cookie := range rw.Result().Cookies() {
+		if strings.HasSuffix(cookie.Name, "_csrf") {
+			csrfCookie = cookie
+		}
+	}
+	require.NotNil(t, csrfCookie)
+	assert.Equal(t, http.SameSiteNoneMode, csrfCookie.SameSite)
+	assert.True(t, csrfCookie.Secure)
+
+	form := url.Values{}
+	form.Set("code", "callback_code")
+	form.Set("state", location.Query().Get("state"))
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/callback", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://appleid.apple.com")
+	req.AddCookie(csrfCookie)
+	rw = httptest.NewRecorder()
+	patTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/", rw.Header().Get("Location"))
+}
+
+func TestStaticProxyUpstream(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: true,
+		ValidToken:      true,
+		ProxyUpstream: options.Upstream{
+			ID:     "static-proxy",
+			Path:   "/static-proxy",
+			Static: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(patTest.Close)
+
+	// A successful validation will redirect and set the auth cookie.
+	code, cookie := patTest.getCallbackEndpoint()
+	if code != 302 {
+		t.Fatalf("expected 302; got %d", code)
+	}
+	assert.NotEqual(t, nil, cookie)
+
+	// Now we make a regular request against the upstream proxy; And validate
+	// the returned status code through the static proxy.
+	code, payload := patTest.getEndpointWithCookie(cookie, "/static-proxy")
+	if code != 200 {
+		t.Fatalf("expected 200; got %d", code)
+	}
+	assert.Equal(t, "Authenticated", payload)
+}
+
+func TestDoNotForwardAccessTokenUpstream(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: false,
+		ValidToken:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(patTest.Close)
+
+	// A successful validation will redirect and set the auth cookie.
+	code, cookie := patTest.getCallbackEndpoint()
+	if code != 302 {
+		t.Fatalf("expected 302; got %d", code)
+	}
+	assert.NotEqual(t, nil, cookie)
+
+	// Now we make a regular request, but the access token header should
+	// not be present.
+	code, payload := patTest.getEndpointWithCookie(cookie, "/")
+	if code != 200 {
+		t.Fatalf("expected 200; got %d", code)
+	}
+	assert.Equal(t, "No access token found.", payload)
+}
+
+func TestSessionValidationFailure(t *testing.T) {
+	patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		ValidToken: false,
+	})
+	require.NoError(t, err)
+	t.Cleanup(patTest.Close)
+
+	// An unsuccessful validation will return 403 and not set the auth cookie.
+	code, cookie := patTest.getCallbackEndpoint()
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "", cookie)
+}
+
+type SignInPageTest struct {
+	opts                 *options.Options
+	proxy                *OAuthProxy
+	signInRegexp         *regexp.Regexp
+	signInProviderRegexp *regexp.Regexp
+}
+
+const signInRedirectPattern = `<input type="hidden" name="rd" value="(.*)">`
+const signInSkipProvider = `>Found<`
+
+func NewSignInPageTest(skipProvider bool) (*SignInPageTest, error) {
+	var sipTest SignInPageTest
+
+	sipTest.opts = baseTestOptions()
+	sipTest.opts.SkipProviderButton = skipProvider
+	err := validation.Validate(sipTest.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sipTest.proxy, err = NewOAuthProxy(sipTest.opts, func(email string) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sipTest.signInRegexp = regexp.MustCompile(signInRedirectPattern)
+	sipTest.signInProviderRegexp = regexp.MustCompile(signInSkipProvider)
+
+	return &sipTest, nil
+}
+
+func (sipTest *SignInPageTest) GetEndpoint(endpoint string) (int, string) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", endpoint, strings.NewReader(""))
+	sipTest.proxy.ServeHTTP(rw, req)
+	return rw.Code, rw.Body.String()
+}
+
+type AlwaysSuccessfulValidator struct {
+}
+
+func (AlwaysSuccessfulValidator) Validate(user, password string) bool {
+	return true
+}
+
+func TestManualSignInStoresUserGroupsInTheSession(t *testing.T) {
+	userGroups := []string{"somegroup", "someothergroup"}
+
+	opts := baseTestOptions()
+	opts.HtpasswdUserGroups = userGroups
+	err := validation.Validate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.basicAuthValidator = AlwaysSuccessfulValidator{}
+
+	rw := httptest.NewRecorder()
+	formData := url.Values{}
+	formData.Set("username", "someuser")
+	formData.Set("password", "somepass")
+	signInReq, _ := http.NewRequest(http.MethodPost, "/oauth2/sign_in", nil)
+	addFormCSRFToken(t, proxy, signInReq, formData)
+	proxy.ServeHTTP(rw, signInReq)
+
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	req, _ := http.NewRequest(http.MethodGet, "/something", strings.NewReader(formData.Encode()))
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	s, err := proxy.sessionStore.Load(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, userGroups, s.Groups)
+}
+
+// addFormCSRFToken posts the form with a valid CSRF token in the request,
+// along with the form CSRF cookie, as the sign-in and sign-out forms do
+func addFormCSRFToken(t *testing.T, proxy *OAuthProxy, req *http.Request, form url.Values) {
+	token, cookie, err := cookies.MakeFormCSRFCookie(req, proxy.CookieOptions, time.Now())
+	require.NoError(t, err)
+	req.AddCookie(cookie)
+
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(cookies.FormCSRFTokenField, token)
+	body := form.Encode()
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+}
+
+type ManualSignInValidator struct{}
+
+func (ManualSignInValidator) Validate(user, password string) bool {
+	switch {
+	case user == "admin" && password == "adminPass":
+		return true
+	default:
+		return false
+	}
+}
+
+func ManualSignInWithCredentials(t *testing.T, user, pass string) int {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.basicAuthValidator = ManualSignInValidator{}
+
+	rw := httptest.NewRecorder()
+	formData := url.Values{}
+	formData.Set("username", user)
+	formData.Set("password", pass)
+	signInReq, _ := http.NewRequest(http.MethodPost, "/oauth2/sign_in", nil)
+	addFormCSRFToken(t, proxy, signInReq, formData)
+	proxy.ServeHTTP(rw, signInReq)
+
+	return rw.Code
+}
+
+func TestManualSignInEmptyUsernameAlert(t *testing.T) {
+	statusCode := ManualSignInWithCredentials(t, "", "")
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestManualSignInInvalidCredentialsAlert(t *testing.T) {
+	statusCode := ManualSignInWithCredentials(t, "admin", "")
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+}
+
+func TestManualSignInCorrectCredentials(t *testing.T) {
+	statusCode := ManualSignInWithCredentials(t, "admin", "adminPass")
+	assert.Equal(t, http.StatusFound, statusCode)
+}
+
+func TestManualSignInCSRFToken(t *testing.T) {
+	opts := baseTestOptions()
+	require.NoError(t, validation.Validate(opts))
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	proxy.basicAuthValidator = ManualSignInValidator{}
+
+	newSignInRequest := func() *http.Request {
+		formData := url.Values{}
+		formData.Set("username", "admin")
+		formData.Set("password", "adminPass")
+		req := httptest.NewRequest(http.MethodPost, "/oauth2/sign_in", strings.NewReader(formData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	sessionCookie := func(rw *httptest.ResponseRecorder) bool {
+		for _, cookie := range rw.Result().Cookies() {
+			if cookie.Name == opts.Cookie.Name && cookie.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("the sign in page renders a token for the login form", func(t *testing.T) {
+		proxy.pageWriter = &pagewriter.WriterFuncs{
+			SignInPageFunc: func(rw http.ResponseWriter, _ *http.Request, _ string, _ int, csrfToken string) {
+				_, _ = rw.Write([]byte(csrfToken))
+			},
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/sign_in", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		token := rw.Body.String()
+		require.NotEmpty(t, token)
+
+		req := newSignInRequest()
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		form := url.Values{"username": {"admin"}, "password": {"adminPass"}, "csrf_token": {token}}
+		req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+		req.ContentLength = int64(len(form.Encode()))
+
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.True(t, sessionCookie(rw))
+	})
+
+	t.Run("the login form is rejected without a token", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, newSignInRequest())
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.False(t, sessionCookie(rw))
+	})
+
+	t.Run("the login form is rejected with another token", func(t *testing.T) {
+		req := newSignInRequest()
+		_, cookie, err := cookies.MakeFormCSRFCookie(req, proxy.CookieOptions, time.Now())
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		other, _, err := cookies.MakeFormCSRFCookie(req, proxy.CookieOptions, time.Now())
+		require.NoError(t, err)
+		form := url.Values{"username": {"admin"}, "password": {"adminPass"}, "csrf_token": {other}}
+		req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+		req.ContentLength = int64(len(form.Encode()))
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.False(t, sessionCookie(rw))
+	})
+}
+
+func TestProviderFallback(t *testing.T) {
+	var status int32 = http.StatusOK
+	idp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer idp.Close()
+
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(email string) bool { return true })
+	assert.NoError(t, err)
+	proxy.basicAuthValidator = ManualSignInValidator{}
+	proxy.fallbackMode = options.FallbackModeAuto
+	proxy.providerFallback = fallback.NewMonitor(options.ProviderFallback{
+		Provider:            options.FallbackProviderHtpasswd,
+		Mode:                options.FallbackModeAuto,
+		HealthCheckInterval: time.Second,
+	}, []string{idp.URL}, prometheus.NewRegistry())
+
+	signIn := func() *httptest.ResponseRecorder {
+		formData := url.Values{}
+		formData.Set("username", "admin")
+		formData.Set("password", "adminPass")
+		req, _ := http.NewRequest(http.MethodPost, "/oauth2/sign_in", nil)
+		addFormCSRFToken(t, proxy, req, formData)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	start := func() int {
+		req, _ := http.NewRequest(http.MethodGet, "/oauth2/start", nil)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	t.Run("the login form is refused while the primary provider is available", func(t *testing.T) {
+		proxy.providerFallback.Check(context.Background())
+		rw := signIn()
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Result().Cookies())
+		assert.Equal(t, http.StatusFound, start())
+	})
+
+	t.Run("the login form signs in while the primary provider is unavailable", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusBadGateway)
+		proxy.providerFallback.Check(context.Background())
+		rw := signIn()
+		assert.Equal(t, http.StatusFound, rw.Code)
+
+		req, _ := http.NewRequest(http.MethodGet, "/something", nil)
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		s, err := proxy.sessionStore.Load(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "admin", s.User)
+		assert.Equal(t, options.FallbackProviderHtpasswd, s.AuthProvider)
+
+		// The sign in page is rendered in place of the provider's login flow
+		assert.Equal(t, http.StatusOK, start())
+	})
+
+	t.Run("the login form is always accepted in offer mode", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusOK)
+		proxy.providerFallback.Check(context.Background())
+		proxy.fallbackMode = options.FallbackModeOffer
+		assert.Equal(t, http.StatusFound, signIn().Code)
+		assert.Equal(t, http.StatusFound, start())
+	})
+}
+
+func TestSignInPageIncludesTargetRedirect(t *testing.T) {
+	sipTest, err := NewSignInPageTest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const endpoint = "/some/random/endpoint"
+
+	code, body := sipTest.GetEndpoint(endpoint)
+	assert.Equal(t, 403, code)
+
+	match := sipTest.signInRegexp.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Did not find pattern in body: " +
+			signInRedirectPattern + "\nBody:\n" + body)
+	}
+	if match[1] != endpoint {
+		t.Fatal(`expected redirect to "` + endpoint +
+			`", but was "` + match[1] + `"`)
+	}
+}
+
+func TestSignInPageInvalidQueryStringReturnsBadRequest(t *testing.T) {
+	sipTest, err := NewSignInPageTest(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const endpoint = "/?q=%va"
+
+	code, _ := sipTest.GetEndpoint(endpoint)
+	assert.Equal(t, 400, code)
+}
+
+func TestSignInPageDirectAccessRedirectsToRoot(t *testing.T) {
+	sipTest, err := NewSignInPageTest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := sipTest.GetEndpoint("/oauth2/sign_in")
+	assert.Equal(t, 200, code)
+
+	match := sipTest.signInRegexp.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Did not find pattern in body: " +
+			signInRedirectPattern + "\nBody:\n" + body)
+	}
+	if match[1] != "/" {
+		t.Fatal(`expected redirect to "/", but was "` + match[1] + `"`)
+	}
+}
+
+func TestSignInPageSkipProvider(t *testing.T) {
+	sipTest, err := NewSignInPageTest(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := "/some/random/endpoint"
+
+	code, body := sipTest.GetEndpoint(endpoint)
+	assert.Equal(t, 302, code)
+
+	match := sipTest.signInProviderRegexp.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Did not find pattern in body: " +
+			signInSkipProvider + "\nBody:\n" + body)
+	}
+}
+
+func TestSignInPageSkipProviderDirect(t *testing.T) {
+	sipTest, err := NewSignInPageTest(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := "/sign_in"
+
+	code, body := sipTest.GetEndpoint(endpoint)
+	assert.Equal(t, 302, code)
+
+	match := sipTest.signInProviderRegexp.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Did not find pattern in body: " +
+			signInSkipProvider + "\nBody:\n" + body)
+	}
+}
+
+type ProcessCookieTest struct {
+	opts         *options.Options
+	proxy        *OAuthProxy
+	rw           *httptest.ResponseRecorder
+	req          *http.Request
+	validateUser bool
+}
+
+type ProcessCookieTestOpts struct {
+	providerValidateCookieResponse bool
+}
+
+type OptionsModifier func(*options.Options)
+
+func NewProcessCookieTest(opts ProcessCookieTestOpts, modifiers ...OptionsModifier) (*ProcessCookieTest, error) {
+	var pcTest ProcessCookieTest
+
+	pcTest.opts = baseTestOptions()
+	for _, modifier := range modifiers {
+		modifier(pcTest.opts)
+	}
+	// First, set the CookieRefresh option so proxy.AesCipher is created,
+	// needed to encrypt the access_token.
+	pcTest.opts.Cookie.Refresh = time.Hour
+	err := validation.Validate(pcTest.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
+		return pcTest.validateUser
+	})
+	if err != nil {
+		return nil, err
+	}
+	testProvider := &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   opts.providerValidateCookieResponse,
+	}
+
+	groups := pcTest.opts.Providers[0].AllowedGroups
+	testProvider.AllowedGroups = make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		testProvider.AllowedGroups[group] = struct{}{}
+	}
+	deniedGroups := pcTest.opts.Providers[0].DeniedGroups
+	testProvider.DeniedGroups = make(map[string]struct{}, len(deniedGroups))
+	for _, group := range deniedGroups {
+		testProvider.DeniedGroups[group] = struct{}{}
+	}
+	pcTest.proxy.provider = testProvider
+
+	// Now, zero-out proxy.CookieRefresh for the cases that don't involve
+	// access_token validation.
+	pcTest.proxy.CookieOptions.Refresh = time.Duration(0)
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.req, _ = http.NewRequest("GET", "/", strings.NewReader(""))
+	pcTest.validateUser = true
+	return &pcTest, nil
+}
+
+func NewProcessCookieTestWithDefaults() (*ProcessCookieTest, error) {
+	return NewProcessCookieTest(ProcessCookieTestOpts{
+		providerValidateCookieResponse: true,
+	})
+}
+
+func NewProcessCookieTestWithOptionsModifiers(modifiers ...OptionsModifier) (*ProcessCookieTest, error) {
+	return NewProcessCookieTest(ProcessCookieTestOpts{
+		providerValidateCookieResponse: true,
+	}, modifiers...)
+}
+
+func (p *ProcessCookieTest) SaveSession(s *sessions.SessionState) error {
+	err := p.proxy.SaveSession(p.rw, p.req, s)
+	if err != nil {
+		return err
+	}
+	for _, cookie := range p.rw.Result().Cookies() {
+		p.req.AddCookie(cookie)
+	}
+	return nil
+}
+
+func (p *ProcessCookieTest) LoadCookiedSession() (*sessions.SessionState, error) {
+	return p.proxy.LoadCookiedSession(p.req)
+}
+
+func TestLoadCookiedSession(t *testing.T) {
+	pcTest, err := NewProcessCookieTestWithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Now()
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: &created}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	session, err := pcTest.LoadCookiedSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, "", session.User)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+}
+
+func TestProcessCookieNoCookieError(t *testing.T) {
+	pcTest, err := NewProcessCookieTestWithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := pcTest.LoadCookiedSession()
+	assert.Error(t, err, "cookie \"_oauth2_proxy\" not present")
+	if session != nil {
+		t.Errorf("expected nil session. got %#v", session)
+	}
+}
+
+func TestProcessCookieRefreshNotSet(t *testing.T) {
+	pcTest, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+		opts.Cookie.Expire = time.Duration(23) * time.Hour
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference := time.Now().Add(time.Duration(-2) * time.Hour)
+
+	startSession := &sessions.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &reference}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	session, err := pcTest.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	if session.Age() < time.Duration(-2)*time.Hour {
+		t.Errorf("cookie too young %v", session.Age())
+	}
+	assert.Equal(t, startSession.Email, session.Email)
+}
+
+func TestProcessCookieFailIfCookieExpired(t *testing.T) {
+	pcTest, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+		opts.Cookie.Expire = time.Duration(24) * time.Hour
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &sessions.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &reference}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	session, err := pcTest.LoadCookiedSession()
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
+	pcTest, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+		opts.Cookie.Expire = time.Duration(24) * time.Hour
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &sessions.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &reference}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	pcTest.proxy.CookieOptions.Refresh = time.Hour
+	session, err := pcTest.LoadCookiedSession()
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestInvalidSessionCookieIsCleared(t *testing.T) {
+	// sessionCookie returns a session cookie created by a proxy with the secret
+	sessionCookie := func(t *testing.T, secret string) *http.Cookie {
+		pcTest, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+			opts.Cookie.Secret = secret
+		})
+		require.NoError(t, err)
+
+		created := time.Now()
+		require.NoError(t, pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", CreatedAt: &created}))
+		cookies := pcTest.rw.Result().Cookies()
+		require.Len(t, cookies, 1)
+		return cookies[0]
+	}
+
+	testCases := map[string]struct {
+		cookie func(t *testing.T) *http.Cookie
+	}{
+		"with a cookie encrypted with a different secret": {
+			cookie: func(t *testing.T) *http.Cookie {
+				return sessionCookie(t, "0123456789abcdefghijklmnopqrstuv")
+			},
+		},
+		"with a truncated cookie value": {
+			cookie: func(t *testing.T) *http.Cookie {
+				cookie := sessionCookie(t, rawCookieSecret)
+				cookie.Value = cookie.Value[:len(cookie.Value)-8]
+				return cookie
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		for _, resetPage := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s and the session reset page set to %t", name, resetPage), func(t *testing.T) {
+				logs := &bytes.Buffer{}
+				logger.SetOutput(logs)
+				defer logger.SetOutput(os.Stdout)
+
+				pcTest, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+					opts.Session.ResetPage = resetPage
+				})
+				require.NoError(t, err)
+
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.AddCookie(tc.cookie(t))
+				rw := httptest.NewRecorder()
+				pcTest.proxy.ServeHTTP(rw, req)
+
+				// Every session cookie is expired immediately
+				cleared := false
+				for _, cookie := range rw.Result().Cookies() {
+					if cookie.Name == pcTest.opts.Cookie.Name {
+						cleared = true
+						assert.Equal(t, "", cookie.Value)
+						assert.True(t, cookie.Expires.Before(time.Now()))
+					}
+				}
+				assert.True(t, cleared, "the session cookie should be cleared")
+				assert.Contains(t, logs.String(), "Session cookie could not be decoded (bad signature)")
+
+				if resetPage {
+					assert.Equal(t, http.StatusUnauthorized, rw.Code)
+					assert.Contains(t, rw.Body.String(), "Your session has been reset. Please sign in again.")
+				} else {
+					assert.Equal(t, http.StatusForbidden, rw.Code)
+					assert.NotContains(t, rw.Body.String(), "Your session has been reset.")
+				}
+
+				// With the cookie cleared, the next request starts the login flow
+				rw = httptest.NewRecorder()
+				pcTest.proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+				assert.Equal(t, http.StatusForbidden, rw.Code)
+				assert.NotContains(t, rw.Body.String(), "Your session has been reset.")
+			})
+		}
+	}
+}
+
+func NewUserInfoEndpointTest() (*ProcessCookieTest, error) {
+	pcTest, err := NewProcessCookieTestWithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	pcTest.req, _ = http.NewRequest("GET",
+		pcTest.opts.ProxyPrefix+"/userinfo", nil)
+	return pcTest, nil
+}
+
+func TestUserInfoEndpointAccepted(t *testing.T) {
+	testCases := []struct {
+		name             string
+		session          *sessions.SessionState
+		expectedResponse string
+	}{
+		{
+			name: "Full session",
+			session: &sessions.SessionState{
+				User:        "john.doe",
+				Email:       "john.doe@example.com",
+				Groups:      []string{"example", "groups"},
+				AccessToken: "my_access_token",
+			},
+			expectedResponse: "{\"user\":\"john.doe\",\"email\":\"john.doe@example.com\",\"groups\":[\"example\",\"groups\"]}\n",
+		},
+		{
+			name: "Minimal session",
+			session: &sessions.SessionState{
+				User:   "john.doe",
+				Email:  "john.doe@example.com",
+				Groups: []string{"example", "groups"},
+			},
+			expectedResponse: "{\"user\":\"john.doe\",\"email\":\"john.doe@example.com\",\"groups\":[\"example\",\"groups\"]}\n",
+		},
+		{
+			name: "No groups",
+			session: &sessions.SessionState{
+				User:        "john.doe",
+				Email:       "john.doe@example.com",
+				AccessToken: "my_access_token",
+			},
+			expectedResponse: "{\"user\":\"john.doe\",\"email\":\"john.doe@example.com\"}\n",
+		},
+		{
+			name: "With Preferred Username",
+			session: &sessions.SessionState{
+				User:              "john.doe",
+				PreferredUsername: "john",
+				Email:             "john.doe@example.com",
+				Groups:            []string{"example", "groups"},
+				AccessToken:       "my_access_token",
+			},
+			expectedResponse: "{\"user\":\"john.doe\",\"email\":\"john.doe@example.com\",\"groups\":[\"example\",\"groups\"],\"preferredUsername\":\"john\"}\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test, err := NewUserInfoEndpointTest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = test.SaveSession(tc.session)
+			assert.NoError(t, err)
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+			assert.Equal(t, http.StatusOK, test.rw.Code)
+			bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+			assert.Equal(t, tc.expectedResponse, string(bodyBytes))
+		})
+	}
+}
+
+func TestUserInfoEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
+	test, err := NewUserInfoEndpointTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+func NewSessionRefreshEndpointTest(method string) (*ProcessCookieTest, error) {
+	pcTest, err := NewProcessCookieTestWithDefaults()
+	if err != nil {
+		return nil, err
+	}
+	pcTest.req, _ = http.NewRequest(method,
+		pcTest.opts.ProxyPrefix+"/refresh", nil)
+	pcTest.req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	return pcTest, nil
+}
+
+func TestSessionRefreshEndpoint(t *testing.T) {
+	errRefresh := errors.New("refresh failed")
+
+	testCases := []struct {
+		name               string
+		method             string
+		omitHeader         bool
+		sessionAge         time.Duration
+		noSession          bool
+		refreshErr         error
+		expectedCode       int
+		expectRefresh      bool
+		expectedRetryAfter string
+		expectCleared      bool
+	}{
+		{
+			name:          "Successful refresh",
+			method:        http.MethodPost,
+			sessionAge:    time.Minute,
+			expectedCode:  http.StatusOK,
+			expectRefresh: true,
+		},
+		{
+			name:         "Wrong method",
+			method:       http.MethodGet,
+			sessionAge:   time.Minute,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:         "Missing CSRF header",
+			method:       http.MethodPost,
+			omitHeader:   true,
+			sessionAge:   time.Minute,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "No session",
+			method:       http.MethodPost,
+			noSession:    true,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Refreshed too recently",
+			method:             http.MethodPost,
+			sessionAge:         10 * time.Second,
+			expectedCode:       http.StatusTooManyRequests,
+			expectedRetryAfter: "20",
+		},
+		{
+			name:          "Provider cannot refresh",
+			method:        http.MethodPost,
+			sessionAge:    time.Minute,
+			refreshErr:    middleware.ErrSessionNotRefreshed,
+			expectedCode:  http.StatusUnauthorized,
+			expectRefresh: true,
+		},
+		{
+			name:          "Refresh error",
+			method:        http.MethodPost,
+			sessionAge:    time.Minute,
+			refreshErr:    errRefresh,
+			expectedCode:  http.StatusUnauthorized,
+			expectRefresh: true,
+			expectCleared: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test, err := NewSessionRefreshEndpointTest(tc.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.omitHeader {
+				test.req.Header.Del("X-Requested-With")
+			}
+
+			now := time.Now().Truncate(time.Second)
+			clock.Set(now)
+			defer clock.Reset()
+
+			created := now.Add(-tc.sessionAge)
+			expires := created.Add(time.Hour)
+			if !tc.noSession {
+				err = test.SaveSession(&sessions.SessionState{
+					Email:       "john.doe@example.com",
+					AccessToken: "my_access_token",
+					CreatedAt:   &created,
+					ExpiresOn:   &expires,
+				})
+				assert.NoError(t, err)
+			}
+			test.rw = httptest.NewRecorder()
+
+			var refreshed bool
+			refreshedAt := now.Add(time.Minute)
+			test.proxy.sessionRefresher = func(_ http.ResponseWriter, _ *http.Request, s *sessions.SessionState) error {
+				refreshed = true
+				if tc.refreshErr != nil {
+					return tc.refreshErr
+				}
+				s.CreatedAt = &refreshedAt
+				s.ExpiresOn = &refreshedAt
+				return nil
+			}
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+			assert.Equal(t, tc.expectedCode, test.rw.Code)
+			assert.Equal(t, tc.expectRefresh, refreshed)
+			assert.Equal(t, tc.expectedRetryAfter, test.rw.Header().Get("Retry-After"))
+			assert.Equal(t, applicationJSON, test.rw.Header().Get("Content-Type"))
+
+			var cleared bool
+			for _, cookie := range test.rw.Result().Cookies() {
+				if cookie.Name == test.opts.Cookie.Name && cookie.Expires.Before(now) {
+					cleared = true
+				}
+			}
+			assert.Equal(t, tc.expectCleared, cleared)
+
+			if tc.expectedCode == http.StatusOK {
+				timestamp := refreshedAt.Format(time.RFC3339)
+				expectedResponse := fmt.Sprintf("{\"createdAt\":%q,\"expiresOn\":%q}\n", timestamp, timestamp)
+				bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+				assert.Equal(t, expectedResponse, string(bodyBytes))
+			}
+		})
+	}
+}
+
+func TestEncodedUrlsStayEncoded(t *testing.T) {
+	encodeTest, err := NewSignInPageTest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := encodeTest.GetEndpoint("/%2F/test1/%2F/test2")
+	assert.Equal(t, 403, code)
+}
+
+func NewAuthOnlyEndpointTest(querystring string, modifiers ...OptionsModifier) (*ProcessCookieTest, error) {
+	pcTest, err := NewProcessCookieTestWithOptionsModifiers(modifiers...)
+	if err != nil {
+		return nil, err
+	}
+	pcTest.req, _ = http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s/auth%s", pcTest.opts.ProxyPrefix, querystring),
+		nil)
+	return pcTest, nil
+}
+
+func TestAuthOnlyEndpointAccepted(t *testing.T) {
+	test, err := NewAuthOnlyEndpointTest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Now()
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &created}
+	err = test.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
+	test, err := NewAuthOnlyEndpointTest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "Unauthorized\n", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnExpiration(t *testing.T) {
+	test, err := NewAuthOnlyEndpointTest("", func(opts *options.Options) {
+		opts.Cookie.Expire = time.Duration(24) * time.Hour
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &reference}
+	err = test.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "Unauthorized\n", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
+	test, err := NewAuthOnlyEndpointTest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Now()
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &created}
+	err = test.SaveSession(startSession)
+	assert.NoError(t, err)
+	test.validateUser = false
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "Unauthorized\n", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
+	var pcTest ProcessCookieTest
+
+	pcTest.opts = baseTestOptions()
+	pcTest.opts.InjectResponseHeaders = []options.Header{
+		{
+			Name: "X-Auth-Request-User",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Email",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "email",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Groups",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "groups",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Forwarded-Preferred-Username",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "preferred_username",
+					},
+				},
+			},
+		},
+	}
+	pcTest.opts.Providers[0].AllowedGroups = []string{"oauth_groups"}
+	err := validation.Validate(pcTest.opts)
+	assert.NoError(t, err)
+
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
+		return pcTest.validateUser
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcTest.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   true,
+	}
+
+	pcTest.validateUser = true
+
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.req, _ = http.NewRequest("GET",
+		pcTest.opts.ProxyPrefix+"/auth", nil)
+
+	created := time.Now()
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Groups: []string{"oauth_groups"}, Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: &created}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusAccepted, pcTest.rw.Code)
+	assert.Equal(t, "oauth_user", pcTest.rw.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, startSession.Groups, pcTest.rw.Header().Values("X-Auth-Request-Groups"))
+	assert.Equal(t, "oauth_user@example.com", pcTest.rw.Header().Get("X-Auth-Request-Email"))
+}
+
+func TestAuthOnlyEndpointAuthResponse(t *testing.T) {
+	claimHeader := func(name, claim, prefix string) options.Header {
+		return options.Header{
+			Name: name,
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim:  claim,
+						Prefix: prefix,
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name                    string
+		authResponse            options.AuthResponse
+		expectedHeaders         http.Header
+		expectedRedirectHeaders http.Header
+	}{
+		{
+			// Matches the Traefik forwardAuth example in the documentation
+			name: "Traefik",
+			authResponse: options.AuthResponse{
+				Headers: []options.Header{
+					claimHeader("User", "user", ""),
+					claimHeader("Email", "email", ""),
+					claimHeader("Groups", "groups", ""),
+				},
+				PrefixHeaders:  true,
+				RedirectHeader: "Location",
+			},
+			expectedHeaders: http.Header{
+				"X-Auth-Request-User":   []string{"oauth_user"},
+				"X-Auth-Request-Email":  []string{"oauth_user@example.com"},
+				"X-Auth-Request-Groups": []string{"oauth_groups,admins"},
+			},
+			expectedRedirectHeaders: http.Header{
+				"Location":               []string{"https://app.example.com/oauth2/start?rd=https%3A%2F%2Fapp.example.com%2Fdashboard%3Ftab%3D1"},
+				"Content-Type":           []string{"text/plain; charset=utf-8"},
+				"X-Content-Type-Options": []string{"nosniff"},
+			},
+		},
+		{
+			// Matches the Envoy ext_authz example in the documentation
+			name: "Envoy",
+			authResponse: options.AuthResponse{
+				Headers: []options.Header{
+					claimHeader("X-User", "user", ""),
+					claimHeader("X-Email", "email", ""),
+					claimHeader("Authorization", "access_token", "Bearer "),
+				},
+			},
+			expectedHeaders: http.Header{
+				"X-User":        []string{"oauth_user"},
+				"X-Email":       []string{"oauth_user@example.com"},
+				"Authorization": []string{"Bearer oauth_token"},
+			},
+			expectedRedirectHeaders: http.Header{
+				"Content-Type":           []string{"text/plain; charset=utf-8"},
+				"X-Content-Type-Options": []string{"nosniff"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var pcTest ProcessCookieTest
+
+			pcTest.opts = baseTestOptions()
+			pcTest.opts.InjectResponseHeaders = []options.Header{
+				claimHeader("X-Forwarded-Preferred-Username", "preferred_username", ""),
+			}
+			pcTest.opts.AuthResponse = tc.authResponse
+			pcTest.opts.ReverseProxy = true
+			pcTest.opts.WhitelistDomains = []string{"app.example.com"}
+			err := validation.Validate(pcTest.opts)
+			assert.NoError(t, err)
+
+			pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
+				return pcTest.validateUser
+			})
+			assert.NoError(t, err)
+			pcTest.proxy.provider = &TestProvider{
+				ProviderData: &providers.ProviderData{},
+				ValidToken:   true,
+			}
+			pcTest.validateUser = true
+
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+				req.Header.Set("X-Forwarded-Proto", "https")
+				req.Header.Set("X-Forwarded-Host", "app.example.com")
+				req.Header.Set("X-Forwarded-Uri", "/dashboard?tab=1")
+				return req
+			}
+
+			// Without a session
+			rw := httptest.NewRecorder()
+			pcTest.proxy.ServeHTTP(rw, newRequest())
+			assert.Equal(t, http.StatusUnauthorized, rw.Code)
+			assert.Equal(t, tc.expectedRedirectHeaders, rw.Header())
+
+			// With a session
+			pcTest.rw = httptest.NewRecorder()
+			pcTest.req = newRequest()
+			created := time.Now()
+			startSession := &sessions.SessionState{
+				User:              "oauth_user",
+				Groups:            []string{"oauth_groups", "admins"},
+				Email:             "oauth_user@example.com",
+				PreferredUsername: "oauth_preferred",
+				AccessToken:       "oauth_token",
+				CreatedAt:         &created,
+			}
+			err = pcTest.SaveSession(startSession)
+			assert.NoError(t, err)
+
+			rw = httptest.NewRecorder()
+			pcTest.proxy.ServeHTTP(rw, pcTest.req)
+			assert.Equal(t, http.StatusAccepted, rw.Code)
+			assert.Equal(t, tc.expectedHeaders, rw.Header())
+		})
+	}
+}
+
+func TestAuthOnlyEndpointSetBasicAuthTrueRequestHeaders(t *testing.T) {
+	var pcTest ProcessCookieTest
+
+	pcTest.opts = baseTestOptions()
+	pcTest.opts.InjectResponseHeaders = []options.Header{
+		{
+			Name: "X-Auth-Request-User",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Email",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "email",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Groups",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "groups",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Forwarded-Preferred-Username",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "preferred_username",
+					},
+				},
+			},
+		},
+		{
+			Name: "Authorization",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+						BasicAuthPassword: &options.SecretSource{
+							Value: []byte("This is a secure password"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	err := validation.Validate(pcTest.opts)
+	assert.NoError(t, err)
+
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
+		return pcTest.validateUser
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcTest.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   true,
+	}
+
+	pcTest.validateUser = true
+
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.req, _ = http.NewRequest("GET",
+		pcTest.opts.ProxyPrefix+"/auth", nil)
+
+	created := time.Now()
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: &created}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusAccepted, pcTest.rw.Code)
+	assert.Equal(t, "oauth_user", pcTest.rw.Header().Values("X-Auth-Request-User")[0])
+	assert.Equal(t, "oauth_user@example.com", pcTest.rw.Header().Values("X-Auth-Request-Email")[0])
+	expectedHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("oauth_user:This is a secure password"))
+	assert.Equal(t, expectedHeader, pcTest.rw.Header().Values("Authorization")[0])
+}
+
+func TestAuthOnlyEndpointSetBasicAuthFalseRequestHeaders(t *testing.T) {
+	var pcTest ProcessCookieTest
+
+	pcTest.opts = baseTestOptions()
+	pcTest.opts.InjectResponseHeaders = []options.Header{
+		{
+			Name: "X-Auth-Request-User",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Email",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "email",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Auth-Request-Groups",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "groups",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Forwarded-Preferred-Username",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "preferred_username",
+					},
+				},
+			},
+		},
+	}
+	err := validation.Validate(pcTest.opts)
+	assert.NoError(t, err)
+
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
+		return pcTest.validateUser
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcTest.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   true,
+	}
+
+	pcTest.validateUser = true
+
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.req, _ = http.NewRequest("GET",
+		pcTest.opts.ProxyPrefix+"/auth", nil)
+
+	created := time.Now()
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: &created}
+	err = pcTest.SaveSession(startSession)
+	assert.NoError(t, err)
+
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusAccepted, pcTest.rw.Code)
+	assert.Equal(t, "oauth_user", pcTest.rw.Header().Values("X-Auth-Request-User")[0])
+	assert.Equal(t, "oauth_user@example.com", pcTest.rw.Header().Values("X-Auth-Request-Email")[0])
+	assert.Equal(t, 0, len(pcTest.rw.Header().Values("Authorization")), "should not have Authorization header entries")
+}
+
+func TestAuthSkippedForPreflightRequests(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthPreflight = true
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	upstreamURL, _ := url.Parse(upstreamServer.URL)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.provider = NewTestProvider(upstreamURL, "")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/preflight-request", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "response", rw.Body.String())
+}
+
+func TestCORSPreflightRoutes(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	testCases := []struct {
+		name               string
+		method             string
+		path               string
+		origin             string
+		requestMethod      string
+		respondToPreflight bool
+		expectedCode       int
+		expectedBody       string
+		expectedAllowed    string
+	}{
+		{
+			name:          "preflight to a preflight route is passed to the upstream",
+			method:        "OPTIONS",
+			path:          "/api/users",
+			origin:        "https://app.example.com",
+			requestMethod: "POST",
+			expectedCode:  200,
+			expectedBody:  "response",
+		},
+		{
+			name:               "preflight to a preflight route is answered by the proxy",
+			method:             "OPTIONS",
+			path:               "/api/users",
+			origin:             "https://app.example.com",
+			requestMethod:      "POST",
+			respondToPreflight: true,
+			expectedCode:       204,
+			expectedAllowed:    "https://app.example.com",
+		},
+		{
+			name:          "preflight from a disallowed origin requires authentication",
+			method:        "OPTIONS",
+			path:          "/api/users",
+			origin:        "https://evil.com",
+			requestMethod: "POST",
+			expectedCode:  403,
+		},
+		{
+			name:          "preflight to another route requires authentication",
+			method:        "OPTIONS",
+			path:          "/admin",
+			origin:        "https://app.example.com",
+			requestMethod: "POST",
+			expectedCode:  403,
+		},
+		{
+			name:         "OPTIONS request that is not a preflight requires authentication",
+			method:       "OPTIONS",
+			path:         "/api/users",
+			origin:       "https://app.example.com",
+			expectedCode: 403,
+		},
+		{
+			name:          "other methods to a preflight route require authentication",
+			method:        "GET",
+			path:          "/api/users",
+			origin:        "https://app.example.com",
+			requestMethod: "POST",
+			expectedCode:  403,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   upstreamServer.URL,
+						Path: "/",
+						URI:  upstreamServer.URL,
+					},
+				},
+			}
+			opts.CORS.AllowedOrigins = []string{"https://app.example.com"}
+			opts.CORS.PreflightRoutes = []string{"^/api/"}
+			opts.CORS.RespondToPreflight = tc.respondToPreflight
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return false })
+			assert.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Origin", tc.origin)
+			if tc.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+			}
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, rw.Body.String())
+			}
+			assert.Equal(t, tc.expectedAllowed, rw.Header().Get("Access-Control-Allow-Origin"))
+		})
+	}
+}
+
+func TestUpstreamDisableIdentityHeaders(t *testing.T) {
+	receivedHeaders := map[string]http.Header{}
+	newUpstream := func(id string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedHeaders[id] = r.Header.Clone()
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	ownUpstream := newUpstream("own")
+	agentUpstream := newUpstream("agent")
+
+	opts := baseTestOptions()
+	opts.SignatureKey = "sha256:7d9e1aa87a5954e6f9fc59266b3af9d7c35fda2d"
+	opts.InjectRequestHeaders = []options.Header{
+		{
+			Name:   "X-Forwarded-Email",
+			Values: []options.HeaderValue{{ClaimSource: &options.ClaimSource{Claim: "email"}}},
+		},
+		{
+			Name:   "X-Forwarded-Access-Token",
+			Values: []options.HeaderValue{{ClaimSource: &options.ClaimSource{Claim: "access_token"}}},
+		},
+	}
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "own",
+				Path: "/own/",
+				URI:  ownUpstream.URL,
+			},
+			{
+				ID:                     "agent",
+				Path:                   "/agent/",
+				URI:                    agentUpstream.URL,
+				DisableIdentityHeaders: true,
+				DisableSignature:       true,
+			},
+		},
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+
+	created := time.Now()
+	session := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: &created}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.NoError(t, proxy.SaveSession(rw, req, session))
+	sessionCookies := rw.Result().Cookies()
+
+	for _, path := range []string{"/own/", "/agent/"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, cookie := range sessionCookies {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, path)
+	}
+
+	own := receivedHeaders["own"]
+	assert.Equal(t, "john.doe@example.com", own.Get("X-Forwarded-Email"))
+	assert.Equal(t, "my_access_token", own.Get("X-Forwarded-Access-Token"))
+	assert.Equal(t, "john.doe@example.com", own.Get("GAP-Auth"))
+	assert.NotEmpty(t, own.Get("GAP-Signature"))
+
+	agent := receivedHeaders["agent"]
+	assert.NotNil(t, agent)
+	for _, header := range []string{"X-Forwarded-Email", "X-Forwarded-Access-Token", "GAP-Auth", "GAP-Signature"} {
+		assert.Empty(t, agent.Values(header), header)
+	}
+}
+
+type SignatureAuthenticator struct {
+	auth hmacauth.HmacAuth
+}
+
+func (v *SignatureAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) {
+	result, headerSig, computedSig := v.auth.AuthenticateRequest(r)
+
+	var msg string
+	switch result {
+	case hmacauth.ResultNoSignature:
+		msg = "no signature received"
+	case hmacauth.ResultMatch:
+		msg = "signatures match"
+	case hmacauth.ResultMismatch:
+		msg = fmt.Sprintf(
+			"signatures do not match:\n  received: %s\n  computed: %s",
+			headerSig,
+			computedSig)
+	default:
+		panic("unknown result value: " + result.String())
+	}
+
+	_, err := w.Write([]byte(msg))
+	if err != nil {
+		panic(err)
+	}
+}
+
+type SignatureTest struct {
+	opts          *options.Options
+	upstream      *httptest.Server
+	upstreamHost  string
+	provider      *httptest.Server
+	header        http.Header
+	rw            *httptest.ResponseRecorder
+	authenticator *SignatureAuthenticator
+	authProvider  providers.Provider
+}
+
+func NewSignatureTest() (*SignatureTest, error) {
+	opts := baseTestOptions()
+	opts.EmailDomains = []string{"acm.org"}
+
+	authenticator := &SignatureAuthenticator{}
+	upstreamServer := httptest.NewServer(
+		http.HandlerFunc(authenticator.Authenticate))
+	upstreamURL, err := url.Parse(upstreamServer.URL)
+	if err != nil {
+		return nil, err
+	}
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+
+	providerHandler := func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`{"access_token": "my_auth_token"}`))
+		if err != nil {
+			panic(err)
+		}
+	}
+	provider := httptest.NewServer(http.HandlerFunc(providerHandler))
+	providerURL, err := url.Parse(provider.URL)
+	if err != nil {
+		return nil, err
+	}
+	testProvider := NewTestProvider(providerURL, "mbland@acm.org")
+
+	return &SignatureTest{
+		opts,
+		upstreamServer,
+		upstreamURL.Host,
+		provider,
+		make(http.Header),
+		httptest.NewRecorder(),
+		authenticator,
+		testProvider,
+	}, nil
+}
+
+func (st *SignatureTest) Close() {
+	st.provider.Close()
+	st.upstream.Close()
+}
+
+// fakeNetConn simulates an http.Request.Body buffer that will be consumed
+// when it is read by the hmacauth.HmacAuth if not handled properly. See:
+//
+//	https://github.com/18F/hmacauth/pull/4
+type fakeNetConn struct {
+	reqBody string
+}
+
+func (fnc *fakeNetConn) Read(p []byte) (n int, err error) {
+	if bodyLen := len(fnc.reqBody); bodyLen != 0 {
+		copy(p, fnc.reqBody)
+		fnc.reqBody = ""
+		return bodyLen, io.EOF
+	}
+	return 0, io.EOF
+}
+
+func (st *SignatureTest) MakeRequestWithExpectedKey(method, body, key string) error {
+	err := validation.Validate(st.opts)
+	if err != nil {
+		return err
+	}
+	proxy, err := NewOAuthProxy(st.opts, func(email string) bool { return true })
+	if err != nil {
+		return err
+	}
+	proxy.provider = st.authProvider
+
+	var bodyBuf io.ReadCloser
+	if body != "" {
+		bodyBuf = ioutil.NopCloser(&fakeNetConn{reqBody: body})
+	}
+	req := httptest.NewRequest(method, "/foo/bar", bodyBuf)
+	req.Header = st.header
+
+	state := &sessions.SessionState{
+		Email: "mbland@acm.org", AccessToken: "my_access_token"}
+	err = proxy.SaveSession(st.rw, req, state)
+	if err != nil {
+		return err
+	}
+	for _, c := range st.rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	// This is used by the upstream to validate the signature.
+	st.authenticator.auth = hmacauth.NewHmacAuth(
+		crypto.SHA1, []byte(key), upstream.SignatureHeader, upstream.SignatureHeaders)
+	proxy.ServeHTTP(st.rw, req)
+
+	return nil
+}
+
+func TestRequestSignature(t *testing.T) {
+	testCases := map[string]struct {
+		method string
+		body   string
+		key    string
+		resp   string
+	}{
+		"No request signature": {
+			method: "GET",
+			body:   "",
+			key:    "",
+			resp:   "no signature received",
+		},
+		"Get request": {
+			method: "GET",
+			body:   "",
+			key:    "7d9e1aa87a5954e6f9fc59266b3af9d7c35fda2d",
+			resp:   "signatures match",
+		},
+		"Post request": {
+			method: "POST",
+			body:   `{ "hello": "world!" }`,
+			key:    "d90df39e2d19282840252612dd7c81421a372f61",
+			resp:   "signatures match",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			st, err := NewSignatureTest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(st.Close)
+			if tc.key != "" {
+				st.opts.SignatureKey = fmt.Sprintf("sha1:%s", tc.key)
+			}
+			err = st.MakeRequestWithExpectedKey(tc.method, tc.body, tc.key)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, st.rw.Code)
+			assert.Equal(t, tc.resp, st.rw.Body.String())
+		})
+	}
+}
+
+type ajaxRequestTest struct {
+	opts  *options.Options
+	proxy *OAuthProxy
+}
+
+func newAjaxRequestTest(forceJSONErrors bool) (*ajaxRequestTest, error) {
+	test := &ajaxRequestTest{}
+	test.opts = baseTestOptions()
+	test.opts.ForceJSONErrors = forceJSONErrors
+	err := validation.Validate(test.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	test.proxy, err = NewOAuthProxy(test.opts, func(email string) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+func (test *ajaxRequestTest) getEndpoint(endpoint string, header http.Header) (int, http.Header, []byte, error) {
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, endpoint, strings.NewReader(""))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header = header
+	test.proxy.ServeHTTP(rw, req)
+	return rw.Code, rw.Header(), rw.Body.Bytes(), nil
+}
+
+func testAjaxUnauthorizedRequest(t *testing.T, header http.Header, forceJSONErrors bool) {
+	test, err := newAjaxRequestTest(forceJSONErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "/test"
+
+	code, rh, body, err := test.getEndpoint(endpoint, header)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	mime := rh.Get("Content-Type")
+	assert.Equal(t, applicationJSON, mime)
+	assert.Equal(t, []byte("{}"), body)
+}
+func TestAjaxUnauthorizedRequest1(t *testing.T) {
+	header := make(http.Header)
+	header.Add("accept", applicationJSON)
+
+	testAjaxUnauthorizedRequest(t, header, false)
+}
+
+func TestAjaxUnauthorizedRequest2(t *testing.T) {
+	header := make(http.Header)
+	header.Add("Accept", applicationJSON)
+
+	testAjaxUnauthorizedRequest(t, header, false)
+}
+
+func TestAjaxUnauthorizedRequestAccept1(t *testing.T) {
+	header := make(http.Header)
+	header.Add("Accept", "application/json, text/plain, */*")
+
+	testAjaxUnauthorizedRequest(t, header, false)
+}
+
+func TestForceJSONErrorsUnauthorizedRequest(t *testing.T) {
+	testAjaxUnauthorizedRequest(t, nil, true)
+}
+
+func TestProblemJSONErrorsUnauthorizedRequest(t *testing.T) {
+	test := &ajaxRequestTest{}
+	test.opts = baseTestOptions()
+	test.opts.Templates.ProblemJSON = true
+	err := validation.Validate(test.opts)
+	assert.NoError(t, err)
+	test.proxy, err = NewOAuthProxy(test.opts, func(email string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+
+	header := make(http.Header)
+	header.Add("Accept", "text/html")
+	code, rh, body, err := test.getEndpoint("/test?foo=bar", header)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "application/problem+json", rh.Get("Content-Type"))
+
+	var problem map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &problem))
+	assert.Equal(t, "Unauthorized", problem["title"])
+	assert.Equal(t, float64(http.StatusUnauthorized), problem["status"])
+	assert.Equal(t, "/oauth2/sign_in?rd=%2Ftest%3Ffoo%3Dbar", problem["loginUrl"])
+}
+
+func TestAjaxForbiddendRequest(t *testing.T) {
+	test, err := newAjaxRequestTest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "/test"
+	header := make(http.Header)
+	code, rh, _, err := test.getEndpoint(endpoint, header)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, code)
+	mime := rh.Get("Content-Type")
+	assert.NotEqual(t, applicationJSON, mime)
+}
+
+func TestAPIClientRules(t *testing.T) {
+	opts := baseTestOptions()
+	opts.APIClientRules = []string{
+		"browser:User-Agent~Mozilla/",
+		"api:!Accept",
+		"api:User-Agent~^curl/",
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+	test := &ajaxRequestTest{opts: opts, proxy: proxy}
+
+	testCases := map[string]struct {
+		header       http.Header
+		expectedCode int
+	}{
+		"With no Accept header": {
+			header:       http.Header{"User-Agent": []string{"Electron/13.1.7"}},
+			expectedCode: http.StatusUnauthorized,
+		},
+		"With a curl User-Agent": {
+			header:       http.Header{"Accept": []string{"*/*"}, "User-Agent": []string{"curl/7.79.1"}},
+			expectedCode: http.StatusUnauthorized,
+		},
+		"With a browser without an Accept header": {
+			header:       http.Header{"User-Agent": []string{"Mozilla/5.0 (X11; Linux x86_64)"}},
+			expectedCode: http.StatusForbidden,
+		},
+		"With a JSON Accept header not matched by the rules": {
+			header:       http.Header{"Accept": []string{applicationJSON}, "User-Agent": []string{"Go-http-client/1.1"}},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			code, rh, _, err := test.getEndpoint("/test", tc.header)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedCode, code)
+			if tc.expectedCode == http.StatusUnauthorized {
+				assert.Equal(t, applicationJSON, rh.Get("Content-Type"))
+			} else {
+				assert.NotEqual(t, applicationJSON, rh.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestClearSplitCookie(t *testing.T) {
+	opts := baseTestOptions()
+	opts.Cookie.Secret = base64CookieSecret
+	opts.Cookie.Name = "oauth2"
+	opts.Cookie.Domains = []string{"abc"}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	store, err := sessionscookie.NewCookieSessionStore(&opts.Session, &opts.Cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := OAuthProxy{CookieOptions: &opts.Cookie, sessionStore: store}
+	var rw = httptest.NewRecorder()
+	req := httptest.NewRequest("get", "/", nil)
+
+	req.AddCookie(&http.Cookie{
+		Name:  "test1",
+		Value: "test1",
+	})
+	req.AddCookie(&http.Cookie{
+		Name:  "oauth2_0",
+		Value: "oauth2_0",
+	})
+	req.AddCookie(&http.Cookie{
+		Name:  "oauth2_1",
+		Value: "oauth2_1",
+	})
+
+	err = p.ClearSessionCookie(rw, req)
+	assert.NoError(t, err)
+	header := rw.Header()
+
+	assert.Equal(t, 2, len(header["Set-Cookie"]), "should have 3 set-cookie header entries")
+}
+
+func TestClearSingleCookie(t *testing.T) {
+	opts := baseTestOptions()
+	opts.Cookie.Name = "oauth2"
+	opts.Cookie.Domains = []string{"abc"}
+	store, err := sessionscookie.NewCookieSessionStore(&opts.Session, &opts.Cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := OAuthProxy{CookieOptions: &opts.Cookie, sessionStore: store}
+	var rw = httptest.NewRecorder()
+	req := httptest.NewRequest("get", "/", nil)
+
+	req.AddCookie(&http.Cookie{
+		Name:  "test1",
+		Value: "test1",
+	})
+	req.AddCookie(&http.Cookie{
+		Name:  "oauth2",
+		Value: "oauth2",
+	})
+
+	err = p.ClearSessionCookie(rw, req)
+	assert.NoError(t, err)
+	header := rw.Header()
+
+	assert.Equal(t, 1, len(header["Set-Cookie"]), "should have 1 set-cookie header entries")
+}
+
+type NoOpKeySet struct {
+}
+
+func (NoOpKeySet) VerifySignature(_ context.Context, jwt string) (payload []byte, err error) {
+	splitStrings := strings.Split(jwt, ".")
+	payloadString := splitStrings[1]
+	return base64.RawURLEncoding.DecodeString(payloadString)
+}
+
+func TestGetJwtSession(t *testing.T) {
+	/* token payload:
+	{
+	  "sub": "1234567890",
+	  "aud": "https://test.myapp.com",
+	  "name": "John Doe",
+	  "email": "john@example.com",
+	  "iss": "https://issuer.example.com",
+	  "iat": 1553691215,
+	  "exp": 1912151821
+	}
+	*/
+	goodJwt := "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." +
+		"eyJzdWIiOiIxMjM0NTY3ODkwIiwiYXVkIjoiaHR0cHM6Ly90ZXN0Lm15YXBwLmNvbSIsIm5hbWUiOiJKb2huIERvZSIsImVtY" +
+		"WlsIjoiam9obkBleGFtcGxlLmNvbSIsImlzcyI6Imh0dHBzOi8vaXNzdWVyLmV4YW1wbGUuY29tIiwiaWF0IjoxNTUzNjkxMj" +
+		"E1LCJleHAiOjE5MTIxNTE4MjF9." +
+		"rLVyzOnEldUq_pNkfa-WiV8TVJYWyZCaM2Am_uo8FGg11zD7l-qmz3x1seTvqpH6Y0Ty00fmv6dJnGnC8WMnPXQiodRTfhBSe" +
+		"OKZMu0HkMD2sg52zlKkbfLTO6ic5VnbVgwjjrB8am_Ta6w7kyFUaB5C1BsIrrLMldkWEhynbb8"
+
+	keyset := NoOpKeySet{}
+	verifier := oidc.NewVerifier("https://issuer.example.com", keyset,
+		&oidc.Config{ClientID: "https://test.myapp.com", SkipExpiryCheck: true,
+			SkipClientIDCheck: true})
+	verificationOptions := internaloidc.IDTokenVerificationOptions{
+		AudienceClaims: []string{"aud"},
+		ClientID:       "https://test.myapp.com",
+		ExtraAudiences: []string{},
+	}
+	internalVerifier := internaloidc.NewVerifier(verifier, verificationOptions)
+
+	test, err := NewAuthOnlyEndpointTest("", func(opts *options.Options) {
+		opts.InjectRequestHeaders = []options.Header{
+			{
+				Name: "Authorization",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim:  "id_token",
+							Prefix: "Bearer ",
+						},
+					},
+				},
+			},
+			{
+				Name: "X-Forwarded-User",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim: "user",
+						},
+					},
+				},
+			},
+			{
+				Name: "X-Forwarded-Email",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim: "email",
+						},
+					},
+				},
+			},
+		}
+
+		opts.InjectResponseHeaders = []options.Header{
+			{
+				Name: "Authorization",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim:  "id_token",
+							Prefix: "Bearer ",
+						},
+					},
+				},
+			},
+			{
+				Name: "X-Auth-Request-User",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim: "user",
+						},
+					},
+				},
+			},
+			{
+				Name: "X-Auth-Request-Email",
+				Values: []options.HeaderValue{
+					{
+						ClaimSource: &options.ClaimSource{
+							Claim: "email",
+						},
+					},
+				},
+			},
+		}
+		opts.SkipJwtBearerTokens = true
+		opts.SetJWTBearerVerifiers(append(opts.GetJWTBearerVerifiers(), internalVerifier))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, _ := test.proxy.provider.(*TestProvider)
+	tp.GroupValidator = func(s string) bool {
+		return true
+	}
+
+	authHeader := fmt.Sprintf("Bearer %s", goodJwt)
+	test.req.Header = map[string][]string{
+		"Authorization": {authHeader},
+	}
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	if test.rw.Code >= 400 {
+		t.Fatalf("expected 3xx got %d", test.rw.Code)
+	}
+
+	// Check PassAuthorization, should overwrite Basic header
+	assert.Equal(t, test.req.Header.Get("Authorization"), authHeader)
+	assert.Equal(t, test.req.Header.Get("X-Forwarded-User"), "1234567890")
+	assert.Equal(t, test.req.Header.Get("X-Forwarded-Email"), "john@example.com")
+
+	// SetAuthorization and SetXAuthRequest
+	assert.Equal(t, test.rw.Header().Get("Authorization"), authHeader)
+	assert.Equal(t, test.rw.Header().Get("X-Auth-Request-User"), "1234567890")
+	assert.Equal(t, test.rw.Header().Get("X-Auth-Request-Email"), "john@example.com")
+}
+
+func Test_prepareNoCache(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prepareNoCache(w)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	mux.ServeHTTP(rec, req)
+
+	for k, v := range noCacheHeaders {
+		assert.Equal(t, rec.Header().Get(k), v)
+	}
+}
+
+func Test_noCacheHeaders(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("upstream"))
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRegex = []string{".*"}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("not exist in response from upstream", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/upstream", nil)
+		proxy.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "upstream", rec.Body.String())
+
+		// checking noCacheHeaders does not exists in response headers from upstream
+		for k := range noCacheHeaders {
+			assert.Equal(t, "", rec.Header().Get(k))
+		}
+	})
+
+	t.Run("has no-cache", func(t *testing.T) {
+		tests := []struct {
+			path       string
+			hasNoCache bool
+		}{
+			{
+				path:       "/oauth2/sign_in",
+				hasNoCache: true,
+			},
+			{
+				path:       "/oauth2/sign_out",
+				hasNoCache: true,
+			},
+			{
+				path:       "/oauth2/start",
+				hasNoCache: true,
+			},
+			{
+				path:       "/oauth2/callback",
+				hasNoCache: true,
+			},
+			{
+				path:       "/oauth2/auth",
+				hasNoCache: false,
+			},
+			{
+				path:       "/oauth2/userinfo",
+				hasNoCache: true,
+			},
+			{
+				path:       "/upstream",
+				hasNoCache: false,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.path, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				proxy.ServeHTTP(rec, req)
+				cacheControl := rec.Result().Header.Get("Cache-Control")
+				if tt.hasNoCache != (strings.Contains(cacheControl, "no-cache")) {
+					t.Errorf(`unexpected "Cache-Control" header: %s`, cacheControl)
+				}
+			})
+		}
+
+	})
+}
+
+func baseTestOptions() *options.Options {
+	opts := options.NewOptions()
+	opts.Cookie.Secret = rawCookieSecret
+	opts.Providers[0].ID = "providerID"
+	opts.Providers[0].ClientID = clientID
+	opts.Providers[0].ClientSecret = clientSecret
+	opts.EmailDomains = []string{"*"}
+
+	// Default injected headers for legacy configuration
+	opts.InjectRequestHeaders = []options.Header{
+		{
+			Name: "Authorization",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+						BasicAuthPassword: &options.SecretSource{
+							Value: []byte(base64.StdEncoding.EncodeToString([]byte("This is a secure password"))),
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Forwarded-User",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+					},
+				},
+			},
+		},
+		{
+			Name: "X-Forwarded-Email",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "email",
+					},
+				},
+			},
+		},
+	}
+
+	return opts
+}
+
+func TestTrustedIPs(t *testing.T) {
+	tests := []struct {
+		name               string
+		trustedIPs         []string
+		reverseProxy       bool
+		realClientIPHeader string
+		req                *http.Request
+		expectTrusted      bool
+	}{
+		// Check unconfigured behavior.
+		{
+			name:               "Default",
+			trustedIPs:         nil,
+			reverseProxy:       false,
+			realClientIPHeader: "X-Real-IP", // Default value
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check using req.RemoteAddr (Options.ReverseProxy == false).
+		{
+			name:               "WithRemoteAddr",
+			trustedIPs:         []string{"127.0.0.1"},
+			reverseProxy:       false,
+			realClientIPHeader: "X-Real-IP", // Default value
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.RemoteAddr = "127.0.0.1:43670"
+				return req
+			}(),
+			expectTrusted: true,
+		},
+		// Check ignores req.RemoteAddr match when behind a reverse proxy / missing header.
+		{
+			name:               "IgnoresRemoteAddrInReverseProxyMode",
+			trustedIPs:         []string{"127.0.0.1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Real-IP", // Default value
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.RemoteAddr = "127.0.0.1:44324"
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check successful trusting of localhost in IPv4.
+		{
+			name:               "TrustsLocalhostInReverseProxyMode",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "127.0.0.1")
+				return req
+			}(),
+			expectTrusted: true,
+		},
+		// Check successful trusting of localhost in IPv6.
+		{
+			name:               "TrustsIP6LocalostInReverseProxyMode",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "::1")
+				return req
+			}(),
+			expectTrusted: true,
+		},
+		// Check does not trust random IPv4 address.
+		{
+			name:               "DoesNotTrustRandomIP4Address",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "12.34.56.78")
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check does not trust random IPv6 address.
+		{
+			name:               "DoesNotTrustRandomIP6Address",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "::2")
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check respects correct header.
+		{
+			name:               "RespectsCorrectHeaderInReverseProxyMode",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Real-IP", "::1")
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check doesn't trust if garbage is provided.
+		{
+			name:               "DoesNotTrustGarbageInReverseProxyMode",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       true,
+			realClientIPHeader: "X-Forwarded-For",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.Header.Add("X-Forwarded-For", "adsfljk29242as!!")
+				return req
+			}(),
+			expectTrusted: false,
+		},
+		// Check doesn't trust if garbage is provided (no reverse-proxy).
+		{
+			name:               "DoesNotTrustGarbage",
+			trustedIPs:         []string{"127.0.0.0/8", "::1"},
+			reverseProxy:       false,
+			realClientIPHeader: "X-Real-IP",
+			req: func() *http.Request {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.RemoteAddr = "adsfljk29242as!!"
+				return req
+			}(),
+			expectTrusted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:     "static",
+						Path:   "/",
+						Static: true,
+					},
+				},
+			}
+			opts.TrustedIPs = tt.trustedIPs
+			opts.ReverseProxy = tt.reverseProxy
+			opts.RealClientIPHeader = tt.realClientIPHeader
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+			rw := httptest.NewRecorder()
+
+			proxy.ServeHTTP(rw, tt.req)
+			if tt.expectTrusted {
+				assert.Equal(t, 200, rw.Code)
+			} else {
+				assert.Equal(t, 403, rw.Code)
+			}
+		})
+	}
+}
+
+func TestBuildRequestIDTrust(t *testing.T) {
+	tests := []struct {
+		name            string
+		requestIDTrust  string
+		trustedProxyIPs []string
+		remoteAddr      string
+		expectTrusted   bool
+	}{
+		{
+			name:           "AlwaysTrustsAnyPeer",
+			requestIDTrust: options.RequestIDTrustAlways,
+			remoteAddr:     "12.34.56.78:443",
+			expectTrusted:  true,
+		},
+		{
+			name:            "NeverTrustsTrustedProxy",
+			requestIDTrust:  options.RequestIDTrustNever,
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			remoteAddr:      "10.1.2.3:443",
+			expectTrusted:   false,
+		},
+		{
+			name:            "TrustsTrustedProxy",
+			requestIDTrust:  options.RequestIDTrustTrustedProxies,
+			trustedProxyIPs: []string{"10.0.0.0/8", "::1"},
+			remoteAddr:      "10.1.2.3:443",
+			expectTrusted:   true,
+		},
+		{
+			name:            "TrustsTrustedProxyIP6",
+			requestIDTrust:  options.RequestIDTrustTrustedProxies,
+			trustedProxyIPs: []string{"10.0.0.0/8", "::1"},
+			remoteAddr:      "[::1]:443",
+			expectTrusted:   true,
+		},
+		{
+			name:            "DoesNotTrustOtherPeers",
+			requestIDTrust:  options.RequestIDTrustTrustedProxies,
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			remoteAddr:      "12.34.56.78:443",
+			expectTrusted:   false,
+		},
+		{
+			name:           "DoesNotTrustWithoutTrustedProxies",
+			requestIDTrust: options.RequestIDTrustTrustedProxies,
+			remoteAddr:     "10.1.2.3:443",
+			expectTrusted:  false,
+		},
+		{
+			name:            "DoesNotTrustGarbage",
+			requestIDTrust:  options.RequestIDTrustTrustedProxies,
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			remoteAddr:      "adsfljk29242as!!",
+			expectTrusted:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.Logging.RequestIDTrust = tt.requestIDTrust
+			opts.TrustedProxyIPs = tt.trustedProxyIPs
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			assert.Equal(t, tt.expectTrusted, buildRequestIDTrust(opts)(req))
+		})
+	}
+}
+
+func TestSanitizeForwardedHeaders(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		err := json.NewEncoder(w).Encode(map[string]string{
+			"X-Forwarded-For":  r.Header.Get("X-Forwarded-For"),
+			"X-Forwarded-Host": r.Header.Get("X-Forwarded-Host"),
+			"X-Real-IP":        r.Header.Get("X-Real-IP"),
+			"Forwarded":        r.Header.Get("Forwarded"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{"GET=^/public"}
+	opts.ReverseProxy = true
+	opts.RealClientIPHeader = "X-Forwarded-For"
+	opts.TrustedProxyIPs = []string{"10.0.0.0/8"}
+	opts.SanitizeForwardedHeaders = true
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name                string
+		remoteAddr          string
+		expectedHeaders     map[string]string
+		expectedRedirectURI string
+	}{
+		{
+			name:       "Chained through a trusted load balancer",
+			remoteAddr: "10.0.0.1:34567",
+			expectedHeaders: map[string]string{
+				"X-Forwarded-For":  "1.2.3.4, 10.0.0.1",
+				"X-Forwarded-Host": "app.example.com",
+				"X-Real-IP":        "1.2.3.4",
+				"Forwarded":        "for=1.2.3.4",
+			},
+			expectedRedirectURI: "https://app.example.com/oauth2/callback",
+		},
+		{
+			name:       "Direct client connection",
+			remoteAddr: "12.34.56.78:34567",
+			expectedHeaders: map[string]string{
+				"X-Forwarded-For":  "12.34.56.78",
+				"X-Forwarded-Host": "",
+				"X-Real-IP":        "12.34.56.78",
+				"Forwarded":        "",
+			},
+			expectedRedirectURI: "https://oauth2-proxy.example.com/oauth2/callback",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			newRequest := func(path string) *http.Request {
+				req := httptest.NewRequest("GET", "http://oauth2-proxy.example.com"+path, nil)
+				req.RemoteAddr = tc.remoteAddr
+				req.Header.Set("X-Forwarded-For", "1.2.3.4")
+				req.Header.Set("X-Forwarded-Proto", "https")
+				req.Header.Set("X-Forwarded-Host", "app.example.com")
+				req.Header.Set("X-Real-IP", "1.2.3.4")
+				req.Header.Set("Forwarded", "for=1.2.3.4")
+				return req
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, newRequest("/public"))
+			assert.Equal(t, 200, rw.Code)
+
+			headers := map[string]string{}
+			assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &headers))
+			assert.Equal(t, tc.expectedHeaders, headers)
+
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, newRequest("/oauth2/start"))
+			assert.Equal(t, 302, rw.Code)
+
+			location, err := url.Parse(rw.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedRedirectURI, location.Query().Get("redirect_uri"))
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("upstream"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{"^/public"}
+	opts.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	opts.CORS.AllowCredentials = true
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name                string
+		method              string
+		path                string
+		origin              string
+		expectedStatus      int
+		expectedAllowOrigin string
+	}{
+		{
+			name:                "Preflight to an endpoint without a session",
+			method:              "OPTIONS",
+			path:                "/oauth2/userinfo",
+			origin:              "https://app.example.com",
+			expectedStatus:      204,
+			expectedAllowOrigin: "https://app.example.com",
+		},
+		{
+			name:                "Request to an endpoint without a session",
+			method:              "GET",
+			path:                "/oauth2/userinfo",
+			origin:              "https://app.example.com",
+			expectedStatus:      401,
+			expectedAllowOrigin: "https://app.example.com",
+		},
+		{
+			name:                "Preflight to the auth endpoint",
+			method:              "OPTIONS",
+			path:                "/oauth2/auth",
+			origin:              "https://app.example.com",
+			expectedStatus:      204,
+			expectedAllowOrigin: "https://app.example.com",
+		},
+		{
+			name:                "Request to an endpoint from a disallowed origin",
+			method:              "GET",
+			path:                "/oauth2/userinfo",
+			origin:              "https://evil.example.com",
+			expectedStatus:      401,
+			expectedAllowOrigin: "",
+		},
+		{
+			name:                "Request to an upstream",
+			method:              "GET",
+			path:                "/public",
+			origin:              "https://app.example.com",
+			expectedStatus:      200,
+			expectedAllowOrigin: "",
+		},
+		{
+			name:                "Preflight to an upstream",
+			method:              "OPTIONS",
+			path:                "/public",
+			origin:              "https://app.example.com",
+			expectedStatus:      200,
+			expectedAllowOrigin: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Origin", tc.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			rw := httptest.NewRecorder()
+
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedStatus, rw.Code)
+			assert.Equal(t, tc.expectedAllowOrigin, rw.Header().Get("Access-Control-Allow-Origin"))
+			if tc.expectedAllowOrigin == "" {
+				assert.Empty(t, rw.Header().Get("Access-Control-Allow-Credentials"))
+			}
+		})
+	}
+}
+
+func Test_buildRoutesAllowlist(t *testing.T) {
+	type expectedAllowedRoute struct {
+		method      string
+		negate      bool
+		regexString string
+	}
+
+	testCases := []struct {
+		name           string
+		skipAuthRegex  []string
+		skipAuthRoutes []string
+		expectedRoutes []expectedAllowedRoute
+		shouldError    bool
+	}{
+		{
+			name:           "No skip auth configured",
+			skipAuthRegex:  []string{},
+			skipAuthRoutes: []string{},
+			expectedRoutes: []expectedAllowedRoute{},
+			shouldError:    false,
+		},
+		{
+			name: "Only skipAuthRegex configured",
+			skipAuthRegex: []string{
+				"^/foo/bar",
+				"^/baz/[0-9]+/thing",
+			},
+			skipAuthRoutes: []string{},
+			expectedRoutes: []expectedAllowedRoute{
+				{
+					method:      "",
+					negate:      false,
+					regexString: "^/foo/bar",
+				},
+				{
+					method:      "",
+					negate:      false,
+					regexString: "^/baz/[0-9]+/thing",
+				},
+			},
+			shouldError: false,
+		},
+		{
+			name:          "Only skipAuthRoutes configured",
+			skipAuthRegex: []string{},
+			skipAuthRoutes: []string{
+				"GET=^/foo/bar",
+				"POST=^/baz/[0-9]+/thing",
+				"^/all/methods$",
+				"WEIRD=^/methods/are/allowed",
+				"PATCH=/second/equals?are=handled&just=fine",
+				"!=^/api",
+				"METHOD!=^/api",
+			},
+			expectedRoutes: []expectedAllowedRoute{
+				{
+					method:      "GET",
+					negate:      false,
+					regexString: "^/foo/bar",
+				},
+				{
+					method:      "POST",
+					negate:      false,
+					regexString: "^/baz/[0-9]+/thing",
+				},
+				{
+					method:      "",
+					negate:      false,
+					regexString: "^/all/methods$",
+				},
+				{
+					method:      "WEIRD",
+					negate:      false,
+					regexString: "^/methods/are/allowed",
+				},
+				{
+					method:      "PATCH",
+					negate:      false,
+					regexString: "/second/equals?are=handled&just=fine",
+				},
+				{
+					method:      "",
+					negate:      true,
+					regexString: "^/api",
+				},
+				{
+					method:      "METHOD",
+					negate:      true,
+					regexString: "^/api",
+				},
+			},
+			shouldError: false,
+		},
+		{
+			name: "Both skipAuthRegexes and skipAuthRoutes configured",
+			skipAuthRegex: []string{
+				"^/foo/bar/regex",
+				"^/baz/[0-9]+/thing/regex",
+			},
+			skipAuthRoutes: []string{
+				"GET=^/foo/bar",
+				"POST=^/baz/[0-9]+/thing",
+				"^/all/methods$",
+			},
+			expectedRoutes: []expectedAllowedRoute{
+				{
+					method:      "",
+					regexString: "^/foo/bar/regex",
+				},
+				{
+					method:      "",
+					regexString: "^/baz/[0-9]+/thing/regex",
+				},
+				{
+					method:      "GET",
+					regexString: "^/foo/bar",
+				},
+				{
+					method:      "POST",
+					regexString: "^/baz/[0-9]+/thing",
+				},
+				{
+					method:      "",
+					regexString: "^/all/methods$",
+				},
+			},
+			shouldError: false,
+		},
+		{
+			name: "Invalid skipAuthRegex entry",
+			skipAuthRegex: []string{
+				"^/foo/bar",
+				"^/baz/[0-9]+/thing",
+				"(bad[regex",
+			},
+			skipAuthRoutes: []string{},
+			expectedRoutes: []expectedAllowedRoute{},
+			shouldError:    true,
+		},
+		{
+			name:          "Invalid skipAuthRoutes entry",
+			skipAuthRegex: []string{},
+			skipAuthRoutes: []string{
+				"GET=^/foo/bar",
+				"POST=^/baz/[0-9]+/thing",
+				"^/all/methods$",
+				"PUT=(bad[regex",
+			},
+			expectedRoutes: []expectedAllowedRoute{},
+			shouldError:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &options.Options{
+				SkipAuthRegex:  tc.skipAuthRegex,
+				SkipAuthRoutes: tc.skipAuthRoutes,
+			}
+			routes, err := buildRoutesAllowlist(opts)
+			if tc.shouldError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			for i, route := range routes {
+				assert.Greater(t, len(tc.expectedRoutes), i)
+				assert.Equal(t, route.method, tc.expectedRoutes[i].method)
+				assert.Equal(t, route.negate, tc.expectedRoutes[i].negate)
+				assert.Equal(t, route.pathRegex.String(), tc.expectedRoutes[i].regexString)
+			}
+		})
+	}
+}
+
+func TestApiRoutes(t *testing.T) {
+
+	ajaxAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("AJAX API Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(ajaxAPIServer.Close)
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("API Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(apiServer.Close)
+
+	uiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("API Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(uiServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   apiServer.URL,
+				Path: "/api",
+				URI:  apiServer.URL,
+			},
+			{
+				ID:   ajaxAPIServer.URL,
+				Path: "/ajaxapi",
+				URI:  ajaxAPIServer.URL,
+			},
+			{
+				ID:   uiServer.URL,
+				Path: "/ui",
+				URI:  uiServer.URL,
+			},
+		},
+	}
+	opts.APIRoutes = []string{
+		"^/api",
+	}
+	opts.SkipProviderButton = true
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		contentType    string
+		url            string
+		shouldRedirect bool
+	}{
+		{
+			name:           "AJAX request matching API regex",
+			contentType:    "application/json",
+			url:            "/api/v1/UserInfo",
+			shouldRedirect: false,
+		},
+		{
+			name:           "AJAX request not matching API regex",
+			contentType:    "application/json",
+			url:            "/ajaxapi/v1/UserInfo",
+			shouldRedirect: false,
+		},
+		{
+			name:           "Other Request matching API regex",
+			contentType:    "application/grpcwebtext",
+			url:            "/api/v1/UserInfo",
+			shouldRedirect: false,
+		},
+		{
+			name:           "UI request",
+			contentType:    "html",
+			url:            "/ui/index.html",
+			shouldRedirect: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			req.Header.Set("Accept", tc.contentType)
+			assert.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			if tc.shouldRedirect {
+				assert.Equal(t, 302, rw.Code)
+			} else {
+				assert.Equal(t, 401, rw.Code)
+			}
+		})
+	}
+}
+
+func TestAllowedRequest(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("Allowed Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRegex = []string{
+		"^/skip/auth/regex$",
+	}
+	opts.SkipAuthRoutes = []string{
+		"GET=^/skip/auth/routes/get",
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		method  string
+		url     string
+		allowed bool
+	}{
+		{
+			name:    "Regex GET allowed",
+			method:  "GET",
+			url:     "/skip/auth/regex",
+			allowed: true,
+		},
+		{
+			name:    "Regex POST allowed ",
+			method:  "POST",
+			url:     "/skip/auth/regex",
+			allowed: true,
+		},
+		{
+			name:    "Regex denied",
+			method:  "GET",
+			url:     "/wrong/denied",
+			allowed: false,
+		},
+		{
+			name:    "Route allowed",
+			method:  "GET",
+			url:     "/skip/auth/routes/get",
+			allowed: true,
+		},
+		{
+			name:    "Route denied with wrong method",
+			method:  "PATCH",
+			url:     "/skip/auth/routes/get",
+			allowed: false,
+		},
+		{
+			name:    "Route denied with wrong path",
+			method:  "GET",
+			url:     "/skip/auth/routes/wrong/path",
+			allowed: false,
+		},
+		{
+			name:    "Route denied with wrong path and method",
+			method:  "POST",
+			url:     "/skip/auth/routes/wrong/path",
+			allowed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.allowed, proxy.isAllowedRoute(req))
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			if tc.allowed {
+				assert.Equal(t, 200, rw.Code)
+				assert.Equal(t, "Allowed Request", rw.Body.String())
+			} else {
+				assert.Equal(t, 403, rw.Code)
+			}
+		})
+	}
+}
+
+func TestAllowedRequestNegateWithoutMethod(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("Allowed Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{
+		"!=^/api", // any non-api routes
+		"POST=^/api/public-entity/?$",
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		method  string
+		url     string
+		allowed bool
+	}{
+		{
+			name:    "Some static file allowed",
+			method:  "GET",
+			url:     "/static/file.txt",
+			allowed: true,
+		},
+		{
+			name:    "POST to contact form allowed",
+			method:  "POST",
+			url:     "/contact",
+			allowed: true,
+		},
+		{
+			name:    "Regex POST allowed",
+			method:  "POST",
+			url:     "/api/public-entity",
+			allowed: true,
+		},
+		{
+			name:    "Regex POST with trailing slash allowed",
+			method:  "POST",
+			url:     "/api/public-entity/",
+			allowed: true,
+		},
+		{
+			name:    "Regex GET api route denied",
+			method:  "GET",
+			url:     "/api/users",
+			allowed: false,
+		},
+		{
+			name:    "Regex POST api route denied",
+			method:  "POST",
+			url:     "/api/users",
+			allowed: false,
+		},
+		{
+			name:    "Regex DELETE api route denied",
+			method:  "DELETE",
+			url:     "/api/users/1",
+			allowed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.allowed, proxy.isAllowedRoute(req))
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			if tc.allowed {
+				assert.Equal(t, 200, rw.Code)
+				assert.Equal(t, "Allowed Request", rw.Body.String())
+			} else {
+				assert.Equal(t, 403, rw.Code)
+			}
+		})
+	}
+}
+
+func TestAllowedRequestNegateWithMethod(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("Allowed Request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{
+		"GET!=^/api", // any non-api routes
+		"POST=^/api/public-entity/?$",
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		method  string
+		url     string
+		allowed bool
+	}{
+		{
+			name:    "Some static file allowed",
+			method:  "GET",
+			url:     "/static/file.txt",
+			allowed: true,
+		},
+		{
+			name:    "POST to contact form not allowed",
+			method:  "POST",
+			url:     "/contact",
+			allowed: false,
+		},
+		{
+			name:    "Regex POST allowed",
+			method:  "POST",
+			url:     "/api/public-entity",
+			allowed: true,
+		},
+		{
+			name:    "Regex POST with trailing slash allowed",
+			method:  "POST",
+			url:     "/api/public-entity/",
+			allowed: true,
+		},
+		{
+			name:    "Regex GET api route denied",
+			method:  "GET",
+			url:     "/api/users",
+			allowed: false,
+		},
+		{
+			name:    "Regex POST api route denied",
+			method:  "POST",
+			url:     "/api/users",
+			allowed: false,
+		},
+		{
+			name:    "Regex DELETE api route denied",
+			method:  "DELETE",
+			url:     "/api/users/1",
+			allowed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.allowed, proxy.isAllowedRoute(req))
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			if tc.allowed {
+				assert.Equal(t, 200, rw.Code)
+				assert.Equal(t, "Allowed Request", rw.Body.String())
+			} else {
+				assert.Equal(t, 403, rw.Code)
+			}
+		})
+	}
+}
+
+func TestProxyAllowedGroups(t *testing.T) {
+	tests := []struct {
+		name               string
+		allowedGroups      []string
+		groups             []string
+		expectUnauthorized bool
+	}{
+		{"NoAllowedGroups", []string{}, []string{}, false},
+		{"NoAllowedGroupsUserHasGroups", []string{}, []string{"a", "b"}, false},
+		{"UserInAllowedGroup", []string{"a"}, []string{"a", "b"}, false},
+		{"UserNotInAllowedGroup", []string{"a"}, []string{"c"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailAddress := "test"
+			created := time.Now()
+
+			session := &sessions.SessionState{
+				Groups:      tt.groups,
+				Email:       emailAddress,
+				AccessToken: "oauth_token",
+				CreatedAt:   &created,
+			}
+
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			}))
+			t.Cleanup(upstreamServer.Close)
+
+			test, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+				opts.Providers[0].AllowedGroups = tt.allowedGroups
+				opts.UpstreamServers = options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						{
+							ID:   upstreamServer.URL,
+							Path: "/",
+							URI:  upstreamServer.URL,
+						},
+					},
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.req, _ = http.NewRequest("GET", "/", nil)
+
+			test.req.Header.Add("accept", applicationJSON)
+			err = test.SaveSession(session)
+			assert.NoError(t, err)
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			if tt.expectUnauthorized {
+				assert.Equal(t, http.StatusForbidden, test.rw.Code)
+			} else {
+				assert.Equal(t, http.StatusOK, test.rw.Code)
+			}
+		})
+	}
+}
+
+func TestProxyDenyLists(t *testing.T) {
+	tests := []struct {
+		name          string
+		deniedEmails  []string
+		deniedDomains []string
+		allowedGroups []string
+		deniedGroups  []string
+		groups        []string
+		expectDenied  bool
+	}{
+		{"NoDenyLists", nil, nil, nil, nil, []string{"a"}, false},
+		{"EmailDenied", []string{"Contractor@Example.com"}, nil, nil, nil, nil, true},
+		{"EmailNotDenied", []string{"other@example.com"}, nil, nil, nil, nil, false},
+		{"EmailDomainDenied", nil, []string{"example.com"}, nil, nil, nil, true},
+		{"EmailSubdomainNotDenied", nil, []string{"sub.example.com"}, nil, nil, nil, false},
+		{"GroupDenied", nil, nil, nil, []string{"suspended"}, []string{"a", "suspended"}, true},
+		{"GroupDeniedOverridesAllowedGroup", nil, nil, []string{"a"}, []string{"suspended"}, []string{"a", "suspended"}, true},
+		{"GroupNotDenied", nil, nil, []string{"a"}, []string{"suspended"}, []string{"a"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created := time.Now()
+
+			session := &sessions.SessionState{
+				Groups:      tt.groups,
+				Email:       "contractor@example.com",
+				AccessToken: "oauth_token",
+				CreatedAt:   &created,
+			}
+
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			}))
+			t.Cleanup(upstreamServer.Close)
+
+			test, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+				opts.DeniedEmails = tt.deniedEmails
+				opts.DeniedEmailDomains = tt.deniedDomains
+				opts.Providers[0].AllowedGroups = tt.allowedGroups
+				opts.Providers[0].DeniedGroups = tt.deniedGroups
+				opts.UpstreamServers = options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						{
+							ID:   upstreamServer.URL,
+							Path: "/",
+							URI:  upstreamServer.URL,
+						},
+					},
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.req, _ = http.NewRequest("GET", "/", nil)
+			err = test.SaveSession(session)
+			assert.NoError(t, err)
+			test.rw = httptest.NewRecorder()
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			var cleared bool
+			for _, cookie := range test.rw.Result().Cookies() {
+				if cookie.Name == test.opts.Cookie.Name && cookie.Value == "" {
+					cleared = true
+				}
+			}
+
+			if tt.expectDenied {
+				assert.Equal(t, http.StatusForbidden, test.rw.Code)
+				assert.True(t, cleared, "expected the session to be cleared")
+			} else {
+				assert.Equal(t, http.StatusOK, test.rw.Code)
+				assert.False(t, cleared, "expected the session not to be cleared")
+			}
+		})
+	}
+}
+
+func TestOAuthCallbackDenyLists(t *testing.T) {
+	const emailAddress = "michael.bland@gsa.gov"
+
+	tests := []struct {
+		name          string
+		deniedEmails  []string
+		deniedDomains []string
+		expectedCode  int
+	}{
+		{"NotDenied", []string{"other@gsa.gov"}, []string{"example.com"}, http.StatusFound},
+		{"EmailDenied", []string{emailAddress}, nil, http.StatusForbidden},
+		{"EmailDomainDenied", nil, []string{"GSA.gov"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+				ValidToken: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(patTest.Close)
+			patTest.proxy.deniedEmailValidator = NewDenyValidator(tt.deniedEmails, tt.deniedDomains)
+
+			code, cookie := patTest.getCallbackEndpoint()
+			assert.Equal(t, tt.expectedCode, code)
+			if tt.expectedCode != http.StatusFound {
+				assert.Equal(t, "", cookie)
+			}
+		})
+	}
+}
+
+func TestAppState(t *testing.T) {
+	tests := []struct {
+		name             string
+		query            string
+		expectedStart    int
+		expectedLocation string
+	}{
+		{"WithoutAppState", "?rd=%2Ffoo", http.StatusFound, "/foo"},
+		{"WithAppState", "?rd=%2Ffoo%3Fbar%3D1%23baz&app_state=deep%2Flink%22%3E%3Cscript%3E", http.StatusFound, "/foo?bar=1&ui_state=deep%2Flink%22%3E%3Cscript%3E#baz"},
+		{"WithTooLargeAppState", "?rd=%2Ffoo&app_state=" + strings.Repeat("a", 33), http.StatusBadRequest, ""},
+		{"WithControlCharacters", "?rd=%2Ffoo&app_state=a%0Ab", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patTest, err := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+				ValidToken: true,
+			})
+			require.NoError(t, err)
+			t.Cleanup(patTest.Close)
+			patTest.proxy.appState = redirect.AppState{
+				Parameter:         "app_state",
+				RedirectParameter: "ui_state",
+				MaxSize:           32,
+			}
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/oauth2/start"+tt.query, nil)
+			patTest.proxy.ServeHTTP(rw, req)
+			require.Equal(t, tt.expectedStart, rw.Code)
+			if tt.expectedStart != http.StatusFound {
+				return
+			}
+
+			loginURL, err := url.Parse(rw.Header().Get("Location"))
+			require.NoError(t, err)
+			req = httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=callback_code&state="+url.QueryEscape(loginURL.Query().Get("state")), nil)
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+
+			rw = httptest.NewRecorder()
+			patTest.proxy.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusFound, rw.Code)
+			assert.Equal(t, tt.expectedLocation, rw.Header().Get("Location"))
+		})
+	}
+}
+
+func TestAuthOnlyAllowedGroups(t *testing.T) {
+	testCases := []struct {
+		name               string
+		allowedGroups      []string
+		groups             []string
+		querystring        string
+		expectedStatusCode int
+	}{
+		{
+			name:               "NoAllowedGroups",
+			allowedGroups:      []string{},
+			groups:             []string{},
+			querystring:        "",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "NoAllowedGroupsUserHasGroups",
+			allowedGroups:      []string{},
+			groups:             []string{"a", "b"},
+			querystring:        "",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInAllowedGroup",
+			allowedGroups:      []string{"a"},
+			groups:             []string{"a", "b"},
+			querystring:        "",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserNotInAllowedGroup",
+			allowedGroups:      []string{"a"},
+			groups:             []string{"c"},
+			querystring:        "",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "UserInQuerystringGroup",
+			allowedGroups:      []string{"a", "b"},
+			groups:             []string{"a", "c"},
+			querystring:        "?allowed_groups=a",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInMultiParamQuerystringGroup",
+			allowedGroups:      []string{"a", "b"},
+			groups:             []string{"b"},
+			querystring:        "?allowed_groups=a&allowed_groups=b,d",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInOnlyQuerystringGroup",
+			allowedGroups:      []string{},
+			groups:             []string{"a", "c"},
+			querystring:        "?allowed_groups=a,b",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInDelimitedQuerystringGroup",
+			allowedGroups:      []string{"a", "b", "c"},
+			groups:             []string{"c"},
+			querystring:        "?allowed_groups=a,c",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserNotInQuerystringGroup",
+			allowedGroups:      []string{},
+			groups:             []string{"c"},
+			querystring:        "?allowed_groups=a,b",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInConfigGroupNotInQuerystringGroup",
+			allowedGroups:      []string{"a", "b", "c"},
+			groups:             []string{"c"},
+			querystring:        "?allowed_groups=a,b",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInQuerystringGroupNotInConfigGroup",
+			allowedGroups:      []string{"a", "b"},
+			groups:             []string{"c"},
+			querystring:        "?allowed_groups=b,c",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emailAddress := "test"
+			created := time.Now()
+
+			session := &sessions.SessionState{
+				Groups:      tc.groups,
+				Email:       emailAddress,
+				AccessToken: "oauth_token",
+				CreatedAt:   &created,
+			}
+
+			test, err := NewAuthOnlyEndpointTest(tc.querystring, func(opts *options.Options) {
+				opts.Providers[0].AllowedGroups = tc.allowedGroups
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.SaveSession(session)
+			assert.NoError(t, err)
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			assert.Equal(t, tc.expectedStatusCode, test.rw.Code)
+		})
+	}
+}
+
+func TestAuthOnlyAllowedGroupsWithSkipMethods(t *testing.T) {
+	testCases := []struct {
+		name               string
+		groups             []string
+		method             string
+		ip                 string
+		withSession        bool
+		expectedStatusCode int
+	}{
+		{
+			name:               "UserWithGroupSkipAuthPreflight",
+			groups:             []string{"a", "c"},
+			method:             "OPTIONS",
+			ip:                 "1.2.3.5:43670",
+			withSession:        true,
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserWithGroupTrustedIp",
+			groups:             []string{"a", "c"},
+			method:             "GET",
+			ip:                 "1.2.3.4:43670",
+			withSession:        true,
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserWithoutGroupSkipAuthPreflight",
+			groups:             []string{"c"},
+			method:             "OPTIONS",
+			ip:                 "1.2.3.5:43670",
+			withSession:        true,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserWithoutGroupTrustedIp",
+			groups:             []string{"c"},
+			method:             "GET",
+			ip:                 "1.2.3.4:43670",
+			withSession:        true,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserWithoutSessionSkipAuthPreflight",
+			method:             "OPTIONS",
+			ip:                 "1.2.3.5:43670",
+			withSession:        false,
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserWithoutSessionTrustedIp",
+			method:             "GET",
+			ip:                 "1.2.3.4:43670",
+			withSession:        false,
+			expectedStatusCode: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test, err := NewAuthOnlyEndpointTest("?allowed_groups=a,b", func(opts *options.Options) {
+				opts.SkipAuthPreflight = true
+				opts.TrustedIPs = []string{"1.2.3.4"}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.req.Method = tc.method
+			test.req.RemoteAddr = tc.ip
+
+			if tc.withSession {
+				created := time.Now()
+				session := &sessions.SessionState{
+					Groups:      tc.groups,
+					Email:       "test",
+					AccessToken: "oauth_token",
+					CreatedAt:   &created,
+				}
+				err = test.SaveSession(session)
+			}
+			assert.NoError(t, err)
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			assert.Equal(t, tc.expectedStatusCode, test.rw.Code)
+		})
+	}
+}
+
+func TestAuthOnlyAllowedEmailDomains(t *testing.T) {
+	testCases := []struct {
+		name               string
+		email              string
+		querystring        string
+		expectedStatusCode int
+	}{
+		{
+			name:               "NotEmailRestriction",
+			email:              "toto@example.com",
+			querystring:        "",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInAllowedEmailDomain",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserNotInAllowedEmailDomain",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=a.example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserNotInAllowedEmailDomains",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=a.example.com,b.example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInAllowedEmailDomains",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=a.example.com,example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInAllowedEmailDomainWildcard",
+			email:              "toto@foo.example.com",
+			querystring:        "?allowed_email_domains=*.example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserNotInAllowedEmailDomainWildcard",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=*.a.example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInAllowedEmailDomainsWildcard",
+			email:              "toto@example.com",
+			querystring:        "?allowed_email_domains=*.a.example.com,*.b.example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInAllowedEmailDomainsWildcard",
+			email:              "toto@c.example.com",
+			querystring:        "?allowed_email_domains=a.b.c.example.com,*.c.example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := []string{}
+
+			created := time.Now()
+
+			session := &sessions.SessionState{
+				Groups:      groups,
+				Email:       tc.email,
+				AccessToken: "oauth_token",
+				CreatedAt:   &created,
+			}
+
+			test, err := NewAuthOnlyEndpointTest(tc.querystring, func(opts *options.Options) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.SaveSession(session)
+			assert.NoError(t, err)
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			assert.Equal(t, tc.expectedStatusCode, test.rw.Code)
+		})
+	}
+}
+
+func TestAuthOnlyAllowedEmails(t *testing.T) {
+	testCases := []struct {
+		name               string
+		email              string
+		querystring        string
+		expectedStatusCode int
+	}{
+		{
+			name:               "NotEmailRestriction",
+			email:              "toto@example.com",
+			querystring:        "",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserInAllowedEmail",
+			email:              "toto@example.com",
+			querystring:        "?allowed_emails=toto@example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "UserNotInAllowedEmail",
+			email:              "toto@example.com",
+			querystring:        "?allowed_emails=tete@example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserNotInAllowedEmails",
+			email:              "toto@example.com",
+			querystring:        "?allowed_emails=tete@example.com,tutu@example.com",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "UserInAllowedEmails",
+			email:              "toto@example.com",
+			querystring:        "?allowed_emails=tete@example.com,toto@example.com",
+			expectedStatusCode: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := []string{}
+
+			created := time.Now()
+
+			session := &sessions.SessionState{
+				Groups:      groups,
+				Email:       tc.email,
+				AccessToken: "oauth_token",
+				CreatedAt:   &created,
+			}
+
+			test, err := NewAuthOnlyEndpointTest(tc.querystring, func(opts *options.Options) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.SaveSession(session)
+			assert.NoError(t, err)
+
+			test.proxy.ServeHTTP(test.rw, test.req)
+
+			assert.Equal(t, tc.expectedStatusCode, test.rw.Code)
+		})
+	}
+}
+
+type logoutTestProvider struct {
+	*TestProvider
+	logoutURL string
+}
+
+func (tp *logoutTestProvider) GetLogoutURL(_ *sessions.SessionState, finalRedirect string) string {
+	return tp.logoutURL + "?logout_uri=" + url.QueryEscape(finalRedirect)
+}
+
+func TestSignOutProviderLogout(t *testing.T) {
+	testCases := map[string]struct {
+		logoutURL        string
+		expectedLocation string
+	}{
+		"Provider without a logout URL": {
+			logoutURL:        "",
+			expectedLocation: "/foo",
+		},
+		"Provider with a logout URL": {
+			logoutURL:        "https://idp.example.com/logout",
+			expectedLocation: "https://idp.example.com/logout?logout_uri=%2Ffoo",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			opts := baseTestOptions()
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+
+			testProvider := NewTestProvider(&url.URL{Host: "idp.example.com"}, "")
+			if tc.logoutURL != "" {
+				proxy.provider = &logoutTestProvider{TestProvider: testProvider, logoutURL: tc.logoutURL}
+			} else {
+				proxy.provider = testProvider
+			}
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/oauth2/sign_out?rd=%2Ffoo", nil)
+			addFormCSRFToken(t, proxy, req, nil)
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusFound, rw.Code)
+			assert.Equal(t, tc.expectedLocation, rw.Header().Get("Location"))
+		})
+	}
+}
+
+type revokeTestProvider struct {
+	*TestProvider
+	revoked *sessions.SessionState
+	err     error
+}
+
+func (tp *revokeTestProvider) RevokeSession(_ context.Context, s *sessions.SessionState) error {
+	tp.revoked = s
+	return tp.err
+}
+
+func TestSignOutRevokesSession(t *testing.T) {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+	provider := &revokeTestProvider{TestProvider: NewTestProvider(&url.URL{Host: "idp.example.com"}, "")}
+	proxy.provider = provider
+
+	created := time.Now()
+	session := &sessions.SessionState{Email: "john.doe@example.com", RefreshToken: "my_refresh_token", CreatedAt: &created}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/sign_out", nil)
+	addFormCSRFToken(t, proxy, req, nil)
+	assert.NoError(t, proxy.SaveSession(rw, req, session))
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusFound, rw.Code)
+	if assert.NotNil(t, provider.revoked) {
+		assert.Equal(t, "my_refresh_token", provider.revoked.RefreshToken)
+	}
+}
+
+func TestSignOutConfirmation(t *testing.T) {
+	testCases := map[string]struct {
+		method           string
+		allowGet         bool
+		redirectURL      string
+		query            string
+		withoutCSRFToken bool
+		expectedCode     int
+		expectedLocation string
+		expectedBody     []string
+	}{
+		"GET renders the confirmation page": {
+			method:       http.MethodGet,
+			query:        "?rd=%2Ffoo&clear=all",
+			expectedCode: http.StatusOK,
+			expectedBody: []string{
+				`<form method="POST" action="/oauth2/sign_out" class="block">`,
+				`<input type="hidden" name="rd" value="/foo">`,
+				`<input type="hidden" name="clear" value="all">`,
+				`<input type="hidden" name="csrf_token" value="`,
+				"john.doe@example.com",
+			},
+		},
+		"GET renders the sign out redirect URL": {
+			method:       http.MethodGet,
+			redirectURL:  "https://www.example.com/signed-out",
+			expectedCode: http.StatusOK,
+			expectedBody: []string{
+				`<input type="hidden" name="rd" value="https://www.example.com/signed-out">`,
+			},
+		},
+		"GET signs out when allowed": {
+			method:           http.MethodGet,
+			allowGet:         true,
+			query:            "?rd=%2Ffoo",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "/foo",
+		},
+		"POST signs out to the sign out redirect URL": {
+			method:           http.MethodPost,
+			redirectURL:      "https://www.example.com/signed-out",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://www.example.com/signed-out",
+		},
+		"POST signs out to the redirect of the request": {
+			method:           http.MethodPost,
+			redirectURL:      "https://www.example.com/signed-out",
+			query:            "?rd=%2Ffoo",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "/foo",
+		},
+		"POST without a CSRF token is forbidden": {
+			method:           http.MethodPost,
+			query:            "?rd=%2Ffoo",
+			withoutCSRFToken: true,
+			expectedCode:     http.StatusForbidden,
+			expectedBody:     []string{invalidFormCSRFMessage},
+		},
+		"POST without a CSRF token signs out when GET is allowed": {
+			method:           http.MethodPost,
+			allowGet:         true,
+			query:            "?rd=%2Ffoo",
+			withoutCSRFToken: true,
+			expectedCode:     http.StatusFound,
+			expectedLocation: "/foo",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.WhitelistDomains = []string{"www.example.com"}
+			opts.SignOut.AllowGet = tc.allowGet
+			opts.SignOut.RedirectURL = tc.redirectURL
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+			provider := &revokeTestProvider{TestProvider: NewTestProvider(&url.URL{Host: "idp.example.com"}, "")}
+			proxy.provider = provider
+
+			created := time.Now()
+			session := &sessions.SessionState{Email: "john.doe@example.com", RefreshToken: "my_refresh_token", CreatedAt: &created}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "/oauth2/sign_out"+tc.query, nil)
+			if tc.method == http.MethodPost && !tc.withoutCSRFToken {
+				addFormCSRFToken(t, proxy, req, nil)
+			}
+			assert.NoError(t, proxy.SaveSession(rw, req, session))
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectedLocation, rw.Header().Get("Location"))
+			for _, expected := range tc.expectedBody {
+				assert.Contains(t, rw.Body.String(), expected)
+			}
+			switch tc.expectedCode {
+			case http.StatusOK:
+				// Users are only signed out once they confirm, the page only
+				// sets the cookie of its form's CSRF token
+				assert.Nil(t, provider.revoked)
+				if assert.Len(t, rw.Result().Cookies(), 1) {
+					assert.Equal(t, "_oauth2_proxy_form_csrf", rw.Result().Cookies()[0].Name)
+				}
+			case http.StatusForbidden:
+				assert.Nil(t, provider.revoked)
+				assert.Empty(t, rw.Result().Cookies())
+			default:
+				assert.NotNil(t, provider.revoked)
+			}
+		})
+	}
+}
+
+func TestLoopbackRedirects(t *testing.T) {
+	testCases := map[string]struct {
+		rd               string
+		expectedLocation string
+	}{
+		"IPv4 loopback": {
+			rd:               "http://127.0.0.1:51234/callback",
+			expectedLocation: "http://127.0.0.1:51234/callback",
+		},
+		"IPv6 loopback with brackets": {
+			rd:               "http://[::1]:51234/callback",
+			expectedLocation: "http://[::1]:51234/callback",
+		},
+		"localhost": {
+			rd:               "http://localhost:51234/callback",
+			expectedLocation: "http://localhost:51234/callback",
+		},
+		"loopback outside of the ports": {
+			rd:               "http://127.0.0.1:8080/callback",
+			expectedLocation: "/",
+		},
+		"domain starting with localhost": {
+			rd:               "http://localhost.evil.com:51234/callback",
+			expectedLocation: "/",
+		},
+		"http domain": {
+			rd:               "http://app.example.com/callback",
+			expectedLocation: "/",
+		},
+	}
+
+	opts := baseTestOptions()
+	opts.Redirect.AllowLoopback = true
+	opts.Redirect.LoopbackPorts = "49152-65535"
+	require.NoError(t, validation.Validate(opts))
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/oauth2/sign_out?rd="+url.QueryEscape(tc.rd), nil)
+			addFormCSRFToken(t, proxy, req, nil)
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusFound, rw.Code)
+			assert.Equal(t, tc.expectedLocation, rw.Header().Get("Location"))
+		})
+	}
+}
+
+func TestUnauthorizedSessionIsRevoked(t *testing.T) {
+	testCases := map[string]struct {
+		revokeErr error
+	}{
+		"when the tokens are revoked": {},
+		"when revoking the tokens fails": {
+			revokeErr: errors.New("provider unavailable"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := baseTestOptions()
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return false })
+			assert.NoError(t, err)
+			provider := &revokeTestProvider{
+				TestProvider: NewTestProvider(&url.URL{Host: "idp.example.com"}, ""),
+				err:          tc.revokeErr,
+			}
+			proxy.provider = provider
+
+			created := time.Now()
+			session := &sessions.SessionState{Email: "john.doe@example.com", RefreshToken: "my_refresh_token", CreatedAt: &created}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			assert.NoError(t, proxy.SaveSession(rw, req, session))
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			if assert.NotNil(t, provider.revoked) {
+				assert.Equal(t, "my_refresh_token", provider.revoked.RefreshToken)
+			}
+			// The session is removed locally even if it couldn't be revoked
+			cookies := rw.Result().Cookies()
+			if assert.Len(t, cookies, 1) {
+				assert.Equal(t, opts.Cookie.Name, cookies[0].Name)
+				assert.Equal(t, "", cookies[0].Value)
+			}
+		})
+	}
+}
+
+func TestSignOutClearsSplitCookies(t *testing.T) {
+	opts := baseTestOptions()
+	opts.Cookie.Domains = []string{"www.example.com", ".example.com"}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+
+	// A random token can't be compressed, so the session needs 3 cookies
+	token := make([]byte, 6000)
+	_, err = rand.Read(token)
+	assert.NoError(t, err)
+
+	created := time.Now()
+	session := &sessions.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: base64.RawURLEncoding.EncodeToString(token),
+		CreatedAt:   &created,
+	}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/oauth2/sign_out", nil)
+	addFormCSRFToken(t, proxy, req, nil)
+	assert.NoError(t, proxy.SaveSession(rw, req, session))
+	sessionCookies := rw.Result().Cookies()
+	assert.Len(t, sessionCookies, 3)
+	for _, cookie := range sessionCookies {
+		req.AddCookie(cookie)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	cleared := map[string]bool{}
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Value == "" && cookie.Expires.Before(time.Now()) {
+			cleared[cookie.Name+"@"+cookie.Domain] = true
+		}
+	}
+	for _, cookie := range sessionCookies {
+		for _, domain := range opts.Cookie.Domains {
+			// The leading dot is dropped when the Set-Cookie header is parsed
+			assert.True(t, cleared[cookie.Name+"@"+strings.TrimPrefix(domain, ".")], "%s should be cleared from %s", cookie.Name, domain)
+		}
+	}
+}
+
+func TestSignOutClearsAllCookies(t *testing.T) {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+
+	requestCookies := []string{"_oauth2_proxy_0", "_oauth2_proxy_1", "_oauth2_proxy_csrf", "_oauth2_proxy_csrf_abc", "_oauth2_proxy_provider", "upstream"}
+
+	testCases := []struct {
+		name            string
+		query           string
+		expectedCleared []string
+	}{
+		{
+			name:            "Without clear",
+			expectedCleared: []string{"_oauth2_proxy_0", "_oauth2_proxy_1"},
+		},
+		{
+			name:            "With clear=all",
+			query:           "?clear=all",
+			expectedCleared: []string{"_oauth2_proxy_0", "_oauth2_proxy_1", "_oauth2_proxy_csrf", "_oauth2_proxy_csrf_abc", "_oauth2_proxy_form_csrf", "_oauth2_proxy_provider"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/oauth2/sign_out"+tc.query, nil)
+			addFormCSRFToken(t, proxy, req, nil)
+			for _, name := range requestCookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: "value"})
+			}
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusFound, rw.Code)
+
+			cleared := map[string]bool{}
+			for _, cookie := range rw.Result().Cookies() {
+				if cookie.Value == "" && cookie.Expires.Before(time.Now()) {
+					cleared[cookie.Name] = true
+				}
+			}
+			expected := map[string]bool{}
+			for _, name := range tc.expectedCleared {
+				expected[name] = true
+			}
+			assert.Equal(t, expected, cleared)
+		})
+	}
+}
+
+func TestRequestHeaderLimits(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.MaxRequestCookies = 5
+	opts.MaxRequestHeaderBytes = 4096
+	err := validation.Validate(opts)
+	require.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	require.NoError(t, err)
+
+	created := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rw := httptest.NewRecorder()
+	require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: "my_access_token",
+		CreatedAt:   &created,
+	}))
+	sessionCookies := rw.Result().Cookies()
+
+	testCases := []struct {
+		name         string
+		path         string
+		cookies      int
+		header       string
+		accept       string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Within the limits",
+			path:         "/reports?id=1",
+			cookies:      4,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "With too many cookies",
+			path:         "/reports?id=1",
+			cookies:      5,
+			expectedCode: http.StatusRequestHeaderFieldsTooLarge,
+			expectedBody: "/oauth2/sign_out?clear=all&amp;rd=%2Freports%3Fid%3D1",
+		},
+		{
+			name:         "With too large headers",
+			path:         "/reports",
+			header:       strings.Repeat("a", 4096),
+			expectedCode: http.StatusRequestHeaderFieldsTooLarge,
+			expectedBody: "/oauth2/sign_out?clear=all&amp;rd=%2Freports",
+		},
+		{
+			name:         "With too many cookies preferring JSON",
+			path:         "/reports",
+			cookies:      5,
+			accept:       "application/json",
+			expectedCode: http.StatusRequestHeaderFieldsTooLarge,
+			expectedBody: `"clearCookiesUrl":"/oauth2/sign_out?clear=all\u0026rd=%2Freports"`,
+		},
+		{
+			name:         "To the proxy's endpoints",
+			path:         "/oauth2/sign_out?clear=all",
+			cookies:      5,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for _, cookie := range sessionCookies {
+				req.AddCookie(cookie)
+			}
+			for i := 0; i < tc.cookies; i++ {
+				req.AddCookie(&http.Cookie{Name: fmt.Sprintf("upstream_%d", i), Value: "value"})
+			}
+			if tc.header != "" {
+				req.Header.Set("X-Large", tc.header)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Contains(t, rw.Body.String(), tc.expectedBody)
+		})
+	}
+}
+
+func TestProviderCookieSuffixAndProxyPrefix(t *testing.T) {
+	opts := baseTestOptions()
+	opts.Providers[0].CookieSuffix = "_app"
+	opts.Providers[0].ProxyPrefix = "/app/oauth2"
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+	assert.Equal(t, "_oauth2_proxy", opts.Cookie.Name)
+	assert.Equal(t, "/oauth2", opts.ProxyPrefix)
+
+	t.Run("CSRF cookie name derives from the provider cookie name", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/app/oauth2/start", nil)
+		proxy.ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.Contains(t, rw.Header().Get("Location"), url.QueryEscape("/app/oauth2/callback"))
+		setCookies := rw.Result().Cookies()
+		if assert.Len(t, setCookies, 1) {
+			assert.True(t, strings.HasPrefix(setCookies[0].Name, "_oauth2_proxy_app_csrf"), setCookies[0].Name)
+		}
+	})
+
+	t.Run("sign out only clears the provider's own session cookie", func(t *testing.T) {
+		created := time.Now()
+		session := &sessions.SessionState{Email: "john.doe@example.com", CreatedAt: &created}
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/app/oauth2/sign_out", nil)
+		addFormCSRFToken(t, proxy, req, nil)
+		assert.NoError(t, proxy.SaveSession(rw, req, session))
+		setCookies := rw.Result().Cookies()
+		if assert.Len(t, setCookies, 1) {
+			assert.Equal(t, "_oauth2_proxy_app", setCookies[0].Name)
+			req.AddCookie(setCookies[0])
+		}
+		// The session cookie of another proxy sharing the cookie domain
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "other"})
+
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusFound, rw.Code)
+
+		cleared := []string{}
+		for _, cookie := range rw.Result().Cookies() {
+			cleared = append(cleared, cookie.Name)
+		}
+		assert.Equal(t, []string{"_oauth2_proxy_app"}, cleared)
+	})
+}
+
+func TestExternalURLPrefix(t *testing.T) {
+	testCases := map[string]struct {
+		// preserved is set when the ingress preserves the prefix in requests
+		preserved   bool
+		routePrefix string
+		appPath     string
+	}{
+		"with an ingress that strips the prefix": {
+			preserved:   false,
+			routePrefix: "/oauth2",
+			appPath:     "/foo",
+		},
+		"with an ingress that preserves the prefix": {
+			preserved:   true,
+			routePrefix: "/myapp/oauth2",
+			appPath:     "/myapp/foo",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.ExternalURLPrefix = "/myapp"
+			opts.ExternalURLPrefixRoutes = tc.preserved
+			require.NoError(t, validation.Validate(opts))
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			require.NoError(t, err)
+
+			// The sign in page links to the endpoints and returns to the
+			// requested page under the prefix
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tc.appPath, nil))
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Contains(t, rw.Body.String(), `action="/myapp/oauth2/start"`)
+			assert.Contains(t, rw.Body.String(), `name="rd" value="/myapp/foo"`)
+
+			// The redirect URI and CSRF cookie are under the prefix
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tc.routePrefix+"/start?rd=%2Fmyapp%2Ffoo", nil))
+			assert.Equal(t, http.StatusFound, rw.Code)
+			location, err := url.Parse(rw.Header().Get("Location"))
+			require.NoError(t, err)
+			assert.Equal(t, "https://example.com/myapp/oauth2/callback", location.Query().Get("redirect_uri"))
+			setCookies := rw.Result().Cookies()
+			if assert.Len(t, setCookies, 1) {
+				assert.Equal(t, "/myapp", setCookies[0].Path)
+			}
+
+			// Signing out returns to the root of the prefix
+			rw = httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tc.routePrefix+"/sign_out", nil)
+			addFormCSRFToken(t, proxy, req, nil)
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusFound, rw.Code)
+			assert.Equal(t, "/myapp/", rw.Header().Get("Location"))
+
+			// The endpoints are only served under the route prefix
+			rw = httptest.NewRecorder()
+			otherPrefix := "/myapp/oauth2"
+			if tc.preserved {
+				otherPrefix = "/oauth2"
+			}
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, otherPrefix+"/start", nil))
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+		})
+	}
+}
+
+func TestResponseHeaderPolicy(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		rw.Header().Set("Content-Security-Policy", "default-src 'none'")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.ResponseHeaderPolicy = []options.ResponseHeaderPolicy{
+		{Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+		{Name: "X-Frame-Options", Value: "DENY"},
+		{Name: "Content-Security-Policy", Value: "default-src 'self'", Overwrite: true},
+	}
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+			{
+				ID:   "embedded",
+				Path: "/embedded/",
+				URI:  upstreamServer.URL,
+				ResponseHeaderPolicy: []options.ResponseHeaderPolicy{
+					{Name: "Content-Security-Policy", Value: "frame-ancestors https://example.com"},
+				},
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{"^/public", "^/embedded/"}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		path            string
+		expectedCode    int
+		expectedHeaders map[string]string
+	}{
+		"the sign in page": {
+			path:         "/private",
+			expectedCode: http.StatusForbidden,
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Frame-Options":           "DENY",
+				"Content-Security-Policy":   "default-src 'self'",
+			},
+		},
+		"an error page": {
+			path:         "/oauth2/callback?error=access_denied",
+			expectedCode: http.StatusForbidden,
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Frame-Options":           "DENY",
+				"Content-Security-Policy":   "default-src 'self'",
+			},
+		},
+		"an upstream": {
+			path:         "/public",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Content-Security-Policy":   "default-src 'self'",
+			},
+		},
+		"an upstream with its own policy": {
+			path:         "/embedded/",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Content-Security-Policy":   "default-src 'none'",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			for header, value := range tc.expectedHeaders {
+				assert.Equal(t, value, rw.Header().Get(header), header)
+			}
+		})
+	}
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	opts := baseTestOptions()
+	opts.RequireRecentAuth = []string{"^/admin/=10m"}
+	statusCode := http.StatusOK
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:         "app",
+				Path:       "/",
+				Static:     true,
+				StaticCode: &statusCode,
+			},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	ago := func(d time.Duration) *time.Time {
+		t := time.Now().Add(-d)
+		return &t
+	}
+
+	testCases := map[string]struct {
+		path             string
+		authTime         *time.Time
+		idToken          string
+		accept           string
+		expectedCode     int
+		expectedLocation string
+	}{
+		"a matching route with a recent authentication": {
+			path:         "/admin/users",
+			authTime:     ago(5 * time.Minute),
+			expectedCode: http.StatusOK,
+		},
+		"a matching route with an old authentication": {
+			path:             "/admin/users?page=2",
+			authTime:         ago(20 * time.Minute),
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/oauth2/start?max_age=600&prompt=login&rd=%2Fadmin%2Fusers%3Fpage%3D2",
+		},
+		"a matching route with a session without an auth time": {
+			path:             "/admin/users",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/oauth2/start?max_age=600&prompt=login&rd=%2Fadmin%2Fusers",
+		},
+		"a matching route with a recent auth_time claim in the ID token": {
+			path:         "/admin/users",
+			idToken:      testIDTokenWithClaims(t, map[string]interface{}{"auth_time": time.Now().Add(-time.Minute).Unix()}),
+			expectedCode: http.StatusOK,
+		},
+		"a non-matching route with an old authentication": {
+			path:         "/users",
+			authTime:     ago(20 * time.Minute),
+			expectedCode: http.StatusOK,
+		},
+		"an API request to a matching route with an old authentication": {
+			path:         "/admin/users",
+			authTime:     ago(20 * time.Minute),
+			accept:       "application/json",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			created := time.Now()
+			saveRW := httptest.NewRecorder()
+			require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+				Email:     "john.doe@example.com",
+				IDToken:   tc.idToken,
+				CreatedAt: &created,
+				AuthTime:  tc.authTime,
+			}))
+			for _, cookie := range saveRW.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectedLocation, rw.Header().Get("Location"))
+
+			if tc.expectedCode == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer error="insufficient_user_authentication", error_description="Authentication within the last 10m0s is required", max_age=600`, rw.Header().Get("WWW-Authenticate"))
+				assert.JSONEq(t, `{"error":"insufficient_user_authentication","error_description":"Authentication within the last 10m0s is required"}`, rw.Body.String())
+			}
+		})
+	}
+
+	t.Run("the start of the login flow asks the provider to re-authenticate", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/start?max_age=600&prompt=login&rd=%2Fadmin%2Fusers", nil))
+		assert.Equal(t, http.StatusFound, rw.Code)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "login", location.Query().Get("prompt"))
+		assert.Equal(t, "600", location.Query().Get("max_age"))
+	})
+}
+
+func TestRouteAccessRules(t *testing.T) {
+	opts := baseTestOptions()
+	opts.ReverseProxy = true
+	opts.RealClientIPHeader = "X-Forwarded-For"
+	opts.TrustedIPs = []string{"192.0.2.10"}
+	opts.RouteAccessRules = []string{
+		"internal:path~^/internal/&cidr=10.0.0.0/8,fd00::/8&group=ops",
+	}
+	statusCode := http.StatusOK
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:         "app",
+				Path:       "/",
+				Static:     true,
+				StaticCode: &statusCode,
+			},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		path         string
+		clientIP     string
+		groups       []string
+		noSession    bool
+		expectedCode int
+		expectedLog  string
+	}{
+		"an IPv4 client in the network and the group": {
+			path:         "/internal/dashboard",
+			clientIP:     "10.1.2.3",
+			groups:       []string{"ops"},
+			expectedCode: http.StatusOK,
+		},
+		"an IPv6 client in the network and the group": {
+			path:         "/internal/dashboard",
+			clientIP:     "fd00::1",
+			groups:       []string{"ops"},
+			expectedCode: http.StatusOK,
+		},
+		"a client outside the network with a valid session": {
+			path:         "/internal/dashboard",
+			clientIP:     "203.0.113.1",
+			groups:       []string{"ops"},
+			expectedCode: http.StatusForbidden,
+			expectedLog:  `Denied authorization via route access rule: denied by route access rule "internal": client IP 203.0.113.1 is not in 10.0.0.0/8, fd00::/8`,
+		},
+		"a client in the network outside the group": {
+			path:         "/internal/dashboard",
+			clientIP:     "10.1.2.3",
+			groups:       []string{"dev"},
+			expectedCode: http.StatusForbidden,
+			expectedLog:  `Denied authorization via route access rule: denied by route access rule "internal": the user is not a member of any of the rule's groups`,
+		},
+		"a client outside the network on another route": {
+			path:         "/public",
+			clientIP:     "203.0.113.1",
+			groups:       []string{"dev"},
+			expectedCode: http.StatusOK,
+		},
+		"a trusted IP without a session": {
+			path:         "/internal/dashboard",
+			clientIP:     "192.0.2.10",
+			noSession:    true,
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			logger.SetOutput(logs)
+			defer logger.SetOutput(os.Stdout)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("X-Forwarded-For", tc.clientIP)
+			if !tc.noSession {
+				created := time.Now()
+				saveRW := httptest.NewRecorder()
+				require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+					Email:     "john.doe@example.com",
+					Groups:    tc.groups,
+					CreatedAt: &created,
+				}))
+				for _, cookie := range saveRW.Result().Cookies() {
+					req.AddCookie(cookie)
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Contains(t, logs.String(), tc.expectedLog)
+		})
+	}
+}
+
+func TestUpstreamPolicies(t *testing.T) {
+	opts := baseTestOptions()
+	opts.ReverseProxy = true
+	opts.RealClientIPHeader = "X-Forwarded-For"
+	statusCode := http.StatusOK
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:         "app",
+				Path:       "/",
+				Static:     true,
+				StaticCode: &statusCode,
+				Policies: []options.UpstreamPolicy{
+					{Name: "public", Path: "^/public/", Methods: []string{http.MethodGet}, AllowAnonymous: true},
+					{Name: "admin", Path: "^/admin/", CIDRs: []string{"10.0.0.0/8"}, Groups: []string{"admins"}},
+					{Name: "no-admin", Action: options.UpstreamPolicyDeny, Path: "^/admin/"},
+					{Name: "read", Methods: []string{http.MethodGet, http.MethodHead}},
+					{Name: "write", Methods: []string{http.MethodPost}, Groups: []string{"writers"}},
+				},
+			},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		method       string
+		path         string
+		clientIP     string
+		groups       []string
+		noSession    bool
+		expectedCode int
+		expectedLog  string
+	}{
+		"an anonymous request allowed by a policy": {
+			method:       http.MethodGet,
+			path:         "/public/page",
+			noSession:    true,
+			expectedCode: http.StatusOK,
+		},
+		"an anonymous request with another method": {
+			method:       http.MethodPost,
+			path:         "/public/page",
+			noSession:    true,
+			expectedCode: http.StatusForbidden,
+			expectedLog:  "No valid authentication in request. Initiating login.",
+		},
+		"an anonymous request to a path requiring a session": {
+			method:       http.MethodGet,
+			path:         "/dashboard",
+			noSession:    true,
+			expectedCode: http.StatusForbidden,
+			expectedLog:  "No valid authentication in request. Initiating login.",
+		},
+		"an admin in the network": {
+			method:       http.MethodGet,
+			path:         "/admin/users",
+			clientIP:     "10.1.2.3",
+			groups:       []string{"admins"},
+			expectedCode: http.StatusOK,
+		},
+		"an admin outside the network": {
+			method:       http.MethodGet,
+			path:         "/admin/users",
+			clientIP:     "203.0.113.1",
+			groups:       []string{"admins"},
+			expectedCode: http.StatusForbidden,
+			expectedLog:  `Denied authorization for upstream "app": the request is denied by policy "no-admin"`,
+		},
+		"a user reading": {
+			method:       http.MethodGet,
+			path:         "/dashboard",
+			groups:       []string{"dev"},
+			expectedCode: http.StatusOK,
+		},
+		"a user writing outside the group": {
+			method:       http.MethodPost,
+			path:         "/dashboard",
+			groups:       []string{"dev"},
+			expectedCode: http.StatusForbidden,
+			expectedLog:  `Denied authorization for upstream "app": the request matches none of its policies`,
+		},
+		"a user writing in the group": {
+			method:       http.MethodPost,
+			path:         "/dashboard",
+			groups:       []string{"writers"},
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			logger.SetOutput(logs)
+			defer logger.SetOutput(os.Stdout)
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.clientIP != "" {
+				req.Header.Set("X-Forwarded-For", tc.clientIP)
+			}
+			if !tc.noSession {
+				created := time.Now()
+				saveRW := httptest.NewRecorder()
+				require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+					Email:     "john.doe@example.com",
+					Groups:    tc.groups,
+					CreatedAt: &created,
+				}))
+				for _, cookie := range saveRW.Result().Cookies() {
+					req.AddCookie(cookie)
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Contains(t, logs.String(), tc.expectedLog)
+		})
+	}
+}
+
+func TestRouteAccessWindows(t *testing.T) {
+	opts := baseTestOptions()
+	opts.RouteAccessRules = []string{
+		"vendor:path~^/vendor-portal/&group=contractors&days=mon-fri&hours=09:00-17:00&tz=Europe/Paris",
+	}
+	statusCode := http.StatusOK
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:         "app",
+				Path:       "/",
+				Static:     true,
+				StaticCode: &statusCode,
+			},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		now          time.Time
+		expectedCode int
+		expectedBody string
+		expectedLog  string
+	}{
+		"during the window": {
+			now:          time.Date(2026, 10, 14, 7, 30, 0, 0, time.UTC),
+			expectedCode: http.StatusOK,
+		},
+		"outside the window": {
+			now:          time.Date(2026, 10, 17, 7, 30, 0, 0, time.UTC),
+			expectedCode: http.StatusForbidden,
+			expectedBody: "This page can only be accessed during its access window: mon-fri 09:00-17:00 Europe/Paris.",
+			expectedLog:  `Denied authorization via route access rule: denied by route access rule "vendor": the request at Sat 09:30 CEST is outside the access window mon-fri 09:00-17:00 Europe/Paris`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			logger.SetOutput(logs)
+			defer logger.SetOutput(os.Stdout)
+			proxy.clock.Set(tc.now)
+
+			req := httptest.NewRequest(http.MethodGet, "/vendor-portal/orders", nil)
+			created := time.Now()
+			saveRW := httptest.NewRecorder()
+			require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+				Email:     "contractor@example.com",
+				Groups:    []string{"contractors"},
+				CreatedAt: &created,
+			}))
+			for _, cookie := range saveRW.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Contains(t, rw.Body.String(), tc.expectedBody)
+			assert.Contains(t, logs.String(), tc.expectedLog)
+		})
+	}
+}
+
+func TestSetAuthTime(t *testing.T) {
+	authTime := time.Unix(1650000000, 0)
+	session := &sessions.SessionState{
+		IDToken: testIDTokenWithClaims(t, map[string]interface{}{"auth_time": authTime.Unix()}),
+	}
+	setAuthTime(context.Background(), session)
+	require.NotNil(t, session.AuthTime)
+	assert.Equal(t, authTime, *session.AuthTime)
+
+	// Without an auth_time claim, the user authenticated at the login
+	session = &sessions.SessionState{}
+	setAuthTime(context.Background(), session)
+	require.NotNil(t, session.AuthTime)
+	assert.WithinDuration(t, time.Now(), *session.AuthTime, time.Minute)
+}
+
+// testIDTokenWithClaims returns an unsigned ID token with the claims
+func testIDTokenWithClaims(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func TestOAuthCallbackProviderError(t *testing.T) {
+	testCases := map[string]struct {
+		query            string
+		hideDescription  bool
+		expectedContains []string
+		expectedMissing  []string
+	}{
+		"With only an error": {
+			query: "error=access_denied",
+			expectedContains: []string{
+				"Login Failed: The upstream identity provider returned an error.",
+				"Provider Error: access_denied",
+				"Request ID: ",
+				`href="/oauth2/start?rd=%2F"`,
+			},
+			expectedMissing: []string{"Description:"},
+		},
+		"With an error description": {
+			query: "error=invalid_request&error_description=Email+domain+%3Cb%3Enot%3C%2Fb%3E+allowed",
+			expectedContains: []string{
+				"Provider Error: invalid_request",
+				"Description: Email domain &lt;b&gt;not&lt;/b&gt; allowed",
+			},
+		},
+		"With the description hidden": {
+			query:            "error=invalid_request&error_description=Email+domain+is+not+allowed",
+			hideDescription:  true,
+			expectedContains: []string{"Provider Error: invalid_request"},
+			expectedMissing:  []string{"Description:", "Email domain is not allowed"},
+		},
+		"With a state, preserves the redirect": {
+			query:            "error=access_denied&state=nonce1234%3A%2Ffoo%2Fbar",
+			expectedContains: []string{`href="/oauth2/start?rd=%2Ffoo%2Fbar"`},
+		},
+		"With an invalid redirect in the state, retries to the root": {
+			query:            "error=access_denied&state=nonce1234%3Ahttps%3A%2F%2Fevil.example.com%2F",
+			expectedContains: []string{`href="/oauth2/start?rd=%2F"`},
+			expectedMissing:  []string{"evil.example.com"},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.Templates.HideProviderErrorDescription = tc.hideDescription
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?"+tc.query, nil)
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			for _, expected := range tc.expectedContains {
+				assert.Contains(t, rw.Body.String(), expected)
+			}
+			for _, missing := range tc.expectedMissing {
+				assert.NotContains(t, rw.Body.String(), missing)
+			}
+		})
+	}
+}
+
+type unverifiedEmailTestProvider struct {
+	*TestProvider
+}
+
+func (tp *unverifiedEmailTestProvider) Redeem(_ context.Context, _ string, _ string, _ string) (*sessions.SessionState, error) {
+	return nil, fmt.Errorf("%w: unverified@example.com", providers.ErrEmailNotVerified)
+}
+
+func TestOAuthCallbackUnverifiedEmail(t *testing.T) {
+	opts := baseTestOptions()
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+	proxy.provider = &unverifiedEmailTestProvider{TestProvider: NewTestProvider(&url.URL{Host: "idp.example.com"}, "")}
+
+	csrf, err := cookies.NewCSRF(proxy.CookieOptions, "")
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/oauth2/callback?code=callback_code&state=%s", encodeState(csrf.HashOAuthState(), "%2F")), nil)
+	csrfCookie, err := csrf.SetCookie(httptest.NewRecorder(), req)
+	assert.NoError(t, err)
+	req.AddCookie(csrfCookie)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Login Failed: Your email address has not been verified.")
+}
+
+type redeemingTestProvider struct {
+	*TestProvider
+}
+
+func (tp *redeemingTestProvider) Redeem(_ context.Context, _ string, _ string, _ string) (*sessions.SessionState, error) {
+	return &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "access_token"}, nil
+}
+
+func TestOAuthLongRedirect(t *testing.T) {
+	longRedirect := "/dashboard?state=" + strings.Repeat("a", 8192)
+
+	testCases := []struct {
+		name             string
+		action           string
+		expectedCode     int
+		expectedRedirect string
+	}{
+		{
+			name:             "Truncates the redirect to its path",
+			action:           options.RedirectMaxLengthTruncate,
+			expectedCode:     http.StatusFound,
+			expectedRedirect: "/dashboard",
+		},
+		{
+			name:         "Denies the login",
+			action:       options.RedirectMaxLengthDeny,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.Redirect.MaxLengthAction = tc.action
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+			testProvider := NewTestProvider(&url.URL{Host: "idp.example.com"}, "john.doe@example.com")
+			testProvider.ValidToken = true
+			proxy.provider = &redeemingTestProvider{TestProvider: testProvider}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/start?rd="+url.QueryEscape(longRedirect), nil))
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			if tc.expectedCode != http.StatusFound {
+				assert.Contains(t, rw.Body.String(), "Login Failed: The address of the page you requested is too long to return to after signing in.")
+				return
+			}
+
+			loginURL, err := url.Parse(rw.Header().Get("Location"))
+			assert.NoError(t, err)
+			state := loginURL.Query().Get("state")
+			assert.Less(t, len(state), opts.Redirect.MaxLength)
+
+			// Complete the login with the state and CSRF cookie from the start of the flow
+			req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusFound, rw.Code)
+			assert.Equal(t, tc.expectedRedirect, rw.Header().Get("Location"))
+		})
+	}
+}
+
+func TestClaimEnrichment(t *testing.T) {
+	var directoryStatus int32 = http.StatusOK
+	directory := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		request := struct {
+			Email string `json:"email"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		rw.WriteHeader(int(atomic.LoadInt32(&directoryStatus)))
+		if request.Email == "john.doe@example.com" {
+			_, _ = rw.Write([]byte(`{"cost_center": "CC-1234", "manager": {"email": "jane.roe@example.com"}}`))
+		}
+	}))
+	t.Cleanup(directory.Close)
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(rw, "cost-center=%s manager=%s", req.Header.Get("X-Cost-Center"), req.Header.Get("X-Manager"))
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	claimHeader := func(name, claim string) options.Header {
+		return options.Header{
+			Name:   name,
+			Values: []options.HeaderValue{{ClaimSource: &options.ClaimSource{Claim: claim}}},
+		}
+	}
+
+	testCases := []struct {
+		name            string
+		failOpen        bool
+		directoryStatus int32
+		expectedCode    int
+		expectedBody    string
+	}{
+		{
+			name:            "Injects the enriched claims into the upstream request headers",
+			directoryStatus: http.StatusOK,
+			expectedCode:    http.StatusFound,
+			expectedBody:    "cost-center=CC-1234 manager=jane.roe@example.com",
+		},
+		{
+			name:            "Denies the login when the directory fails",
+			directoryStatus: http.StatusInternalServerError,
+			expectedCode:    http.StatusInternalServerError,
+		},
+		{
+			name:            "Allows the login without the enriched claims when failing open",
+			failOpen:        true,
+			directoryStatus: http.StatusInternalServerError,
+			expectedCode:    http.StatusFound,
+			expectedBody:    "cost-center= manager=",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&directoryStatus, tc.directoryStatus)
+
+			opts := baseTestOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{{ID: "app", Path: "/", URI: upstreamServer.URL}},
+			}
+			opts.InjectRequestHeaders = []options.Header{
+				claimHeader("X-Cost-Center", "directory_cost_center"),
+				claimHeader("X-Manager", "directory_manager.email"),
+			}
+			opts.ClaimEnrichment.URL = directory.URL
+			opts.ClaimEnrichment.FailOpen = tc.failOpen
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+			testProvider := NewTestProvider(&url.URL{Host: "idp.example.com"}, "john.doe@example.com")
+			testProvider.ValidToken = true
+			proxy.provider = &redeemingTestProvider{TestProvider: testProvider}
+
+			csrf, err := cookies.NewCSRF(proxy.CookieOptions, "")
+			assert.NoError(t, err)
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/oauth2/callback?code=callback_code&state=%s", encodeState(csrf.HashOAuthState(), "%2F")), nil)
+			csrfCookie, err := csrf.SetCookie(httptest.NewRecorder(), req)
+			assert.NoError(t, err)
+			req.AddCookie(csrfCookie)
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			if tc.expectedCode != http.StatusFound {
+				assert.Contains(t, rw.Body.String(), "Login Failed: Your account details could not be loaded.")
+				return
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tc.expectedBody, rw.Body.String())
+		})
+	}
+}
+
+func TestExternalAuthz(t *testing.T) {
+	var decisions int32
+	authz := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&decisions, 1)
+		input := struct {
+			Request struct {
+				Method string `json:"method"`
+				Path   string `json:"path"`
+			} `json:"request"`
+			Session struct {
+				Email string `json:"email"`
+			} `json:"session"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+		switch {
+		case input.Request.Path == "/unavailable":
+			rw.WriteHeader(http.StatusInternalServerError)
+		case input.Request.Method == http.MethodDelete && input.Session.Email != "admin@example.com":
+			_, _ = rw.Write([]byte(`{"allow": false, "reason": "only admins can delete"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"allow": true}`))
+		}
+	}))
+	t.Cleanup(authz.Close)
+
+	testCases := []struct {
+		name              string
+		method            string
+		path              string
+		email             string
+		noSession         bool
+		failOpen          bool
+		authOnly          bool
+		expectedCode      int
+		expectedDecisions int32
+		expectedLog       string
+	}{
+		{
+			name:              "Proxies the requests the endpoint allows",
+			method:            http.MethodDelete,
+			path:              "/documents/42",
+			email:             "admin@example.com",
+			expectedCode:      http.StatusOK,
+			expectedDecisions: 1,
+		},
+		{
+			name:              "Denies the requests the endpoint denies",
+			method:            http.MethodDelete,
+			path:              "/documents/42",
+			email:             "john.doe@example.com",
+			expectedCode:      http.StatusForbidden,
+			expectedDecisions: 1,
+			expectedLog:       "Denied authorization via external authorization: denied by the external authorization endpoint: only admins can delete",
+		},
+		{
+			name:              "Responds with a 503 when the endpoint fails",
+			method:            http.MethodGet,
+			path:              "/unavailable",
+			email:             "john.doe@example.com",
+			expectedCode:      http.StatusServiceUnavailable,
+			expectedDecisions: 1,
+		},
+		{
+			name:              "Proxies the requests when the endpoint fails when failing open",
+			method:            http.MethodGet,
+			path:              "/unavailable",
+			email:             "john.doe@example.com",
+			failOpen:          true,
+			expectedCode:      http.StatusOK,
+			expectedDecisions: 1,
+		},
+		{
+			name:              "Does not authorize the requests skipping authentication",
+			method:            http.MethodDelete,
+			path:              "/public/page",
+			noSession:         true,
+			expectedCode:      http.StatusOK,
+			expectedDecisions: 0,
+		},
+		{
+			name:              "Accepts the auth requests the endpoint allows",
+			method:            http.MethodDelete,
+			path:              "/documents/42",
+			email:             "admin@example.com",
+			authOnly:          true,
+			expectedCode:      http.StatusAccepted,
+			expectedDecisions: 1,
+		},
+		{
+			name:              "Denies the auth requests the endpoint denies for the forwarded URI",
+			method:            http.MethodDelete,
+			path:              "/documents/42",
+			email:             "john.doe@example.com",
+			authOnly:          true,
+			expectedCode:      http.StatusForbidden,
+			expectedDecisions: 1,
+			expectedLog:       "Denied authorization via external authorization: denied by the external authorization endpoint: only admins can delete",
+		},
+		{
+			name:              "Responds to the auth requests with a 503 when the endpoint fails",
+			method:            http.MethodGet,
+			path:              "/unavailable",
+			email:             "john.doe@example.com",
+			authOnly:          true,
+			expectedCode:      http.StatusServiceUnavailable,
+			expectedDecisions: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&decisions, 0)
+			logs := &bytes.Buffer{}
+			logger.SetOutput(logs)
+			defer logger.SetOutput(os.Stdout)
+
+			opts := baseTestOptions()
+			statusCode := http.StatusOK
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{{ID: "app", Path: "/", Static: true, StaticCode: &statusCode}},
+			}
+			opts.SkipAuthRegex = []string{"^/public/"}
+			opts.ExternalAuthz.URL = authz.URL
+			opts.ExternalAuthz.FailOpen = tc.failOpen
+			opts.ReverseProxy = true
+			require.NoError(t, validation.Validate(opts))
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.authOnly {
+				req = httptest.NewRequest(tc.method, "/oauth2/auth", nil)
+				req.Header.Set("X-Forwarded-Uri", tc.path)
+			}
+			if !tc.noSession {
+				created := time.Now()
+				saveRW := httptest.NewRecorder()
+				require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+					Email:     tc.email,
+					CreatedAt: &created,
+				}))
+				for _, cookie := range saveRW.Result().Cookies() {
+					req.AddCookie(cookie)
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectedDecisions, atomic.LoadInt32(&decisions))
+			assert.Contains(t, logs.String(), tc.expectedLog)
+		})
+	}
+}
+
+func TestUpstreamTokenExchange(t *testing.T) {
+	var exchanges int32
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&exchanges, 1)
+		assert.NoError(t, req.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", req.PostForm.Get("grant_type"))
+		assert.Equal(t, clientID, req.PostForm.Get("client_id"))
+		_, _ = fmt.Fprintf(rw, `{"access_token": "%s-for-%s", "token_type": "Bearer", "expires_in": 300}`, req.PostForm.Get("audience"), req.PostForm.Get("subject_token"))
+	}))
+	t.Cleanup(tokenEndpoint.Close)
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.Providers[0].RedeemURL = tokenEndpoint.URL
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:            "orders",
+				Path:          "/orders/",
+				URI:           upstreamServer.URL,
+				TokenExchange: &options.UpstreamTokenExchange{Audience: "orders-api"},
+			},
+			{ID: "app", Path: "/", URI: upstreamServer.URL},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		created := time.Now()
+		saveRW := httptest.NewRecorder()
+		require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+			Email:       "john.doe@example.com",
+			User:        "john.doe",
+			AccessToken: "access-token",
+			CreatedAt:   &created,
+		}))
+		for _, cookie := range saveRW.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("/orders/42")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "Bearer orders-api-for-access-token", rw.Body.String())
+
+	rw = serve("/orders/43")
+	assert.Equal(t, "Bearer orders-api-for-access-token", rw.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+
+	rw = serve("/page")
+	assert.NotContains(t, rw.Body.String(), "orders-api")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exchanges))
+}
+
+func TestSessionExpiry(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/page" {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			rw.Header().Set("Content-Type", "application/json")
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{{ID: "app", Path: "/", URI: upstreamServer.URL}},
+	}
+	opts.Cookie.Expire = time.Hour
+	opts.SessionExpiry.Header = true
+	opts.SessionExpiry.SilentRenew = true
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	now := time.Now().Truncate(time.Second)
+	clock.Set(now)
+	defer clock.Reset()
+
+	sessionRequest := func(method, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		created := now.Add(-15 * time.Minute)
+		saveRW := httptest.NewRecorder()
+		require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+			Email:     "john.doe@example.com",
+			CreatedAt: &created,
+		}))
+		for _, cookie := range saveRW.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	t.Run("the endpoint reports when the session lapses", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, sessionRequest(http.MethodGet, "/oauth2/session/expiry"))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+
+		expected := fmt.Sprintf(`{"expiresAt":%q,"expiresIn":2700,"renewURL":"/oauth2/start?prompt=none"}`, now.Add(45*time.Minute).Format(time.RFC3339))
+		assert.JSONEq(t, expected, rw.Body.String())
+	})
+
+	t.Run("the endpoint requires a session", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/session/expiry", nil))
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	})
+
+	t.Run("the endpoint only allows GET", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, sessionRequest(http.MethodPost, "/oauth2/session/expiry"))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodGet, rw.Header().Get("Allow"))
+	})
+
+	t.Run("proxied pages have the expiry header", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, sessionRequest(http.MethodGet, "/page"))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "2700", rw.Header().Get(middleware.SessionExpiresInHeader))
+	})
+
+	t.Run("proxied API responses don't have the expiry header", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, sessionRequest(http.MethodGet, "/api"))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Header().Get(middleware.SessionExpiresInHeader))
+	})
+
+	t.Run("the start of the login flow asks the provider not to prompt the user", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/start?prompt=none&rd=%2Fpage", nil))
+		assert.Equal(t, http.StatusFound, rw.Code)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "none", location.Query().Get("prompt"))
+	})
+
+	t.Run("a renewal requiring a login returns to the application with the session", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := sessionRequest(http.MethodGet, "/oauth2/callback?error=login_required&state=nonce1234%3A%2Fpage%3Ftab%3D2")
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.Equal(t, "/page?oauth2_renew_error=login_required&tab=2", rw.Header().Get("Location"))
+		for _, cookie := range rw.Result().Cookies() {
+			assert.NotEqual(t, opts.Cookie.Name, cookie.Name)
+		}
+
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, sessionRequest(http.MethodGet, "/oauth2/session/expiry"))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	})
+
+	t.Run("a renewal with an invalid redirect returns to the root", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/callback?error=interaction_required&state=nonce1234%3Ahttps%3A%2F%2Fevil.example.com%2F", nil))
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.Equal(t, "/?oauth2_renew_error=interaction_required", rw.Header().Get("Location"))
+	})
+
+	t.Run("other provider errors show the error page", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/callback?error=access_denied", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	})
+}
+
+func TestSessionDebugHeaders(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	failRefresh := false
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/token" && failRefresh:
+			rw.WriteHeader(http.StatusInternalServerError)
+		case req.URL.Path == "/token":
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"access_token":"refreshed-access-token","expires_in":3600}`))
+		default:
+			rw.WriteHeader(http.StatusOK)
+		}
+	}))
+	t.Cleanup(providerServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{{ID: "app", Path: "/", URI: upstreamServer.URL}},
+	}
+	opts.Providers[0].RedeemURL = providerServer.URL + "/token"
+	opts.Providers[0].ValidateURL = providerServer.URL + "/validate"
+	opts.Cookie.Refresh = time.Minute
+	opts.SessionDebug.OptInHeader = "X-Debug-Session"
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	now := time.Now().Truncate(time.Second)
+	clock.Set(now)
+	defer clock.Reset()
+
+	sessionRequest := func(target string, age time.Duration) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Debug-Session", "1")
+		created := now.Add(-age)
+		expires := now.Add(10 * time.Minute)
+		saveRW := httptest.NewRecorder()
+		require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+			Email:        "john.doe@example.com",
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token",
+			CreatedAt:    &created,
+			ExpiresOn:    &expires,
+		}))
+		for _, cookie := range saveRW.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	testCases := []struct {
+		name              string
+		age               time.Duration
+		failRefresh       bool
+		expectedAge       string
+		expectedExpiresIn string
+		expectedRefreshed string
+	}{
+		{
+			name:              "a session that doesn't need refreshing",
+			age:               30 * time.Second,
+			expectedAge:       "30",
+			expectedExpiresIn: "600",
+			expectedRefreshed: "false",
+		},
+		{
+			name:              "a session refreshed by the request",
+			age:               2 * time.Minute,
+			expectedAge:       "0",
+			expectedExpiresIn: "3600",
+			expectedRefreshed: "true",
+		},
+		{
+			name:              "a session that failed to refresh",
+			age:               2 * time.Minute,
+			failRefresh:       true,
+			expectedAge:       "120",
+			expectedExpiresIn: "600",
+			expectedRefreshed: "failed",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, target := range []string{"/page", "/oauth2/auth"} {
+			t.Run(tc.name+" on "+target, func(t *testing.T) {
+				failRefresh = tc.failRefresh
+
+				rw := httptest.NewRecorder()
+				proxy.ServeHTTP(rw, sessionRequest(target, tc.age))
+				assert.Less(t, rw.Code, 300)
+				assert.Equal(t, tc.expectedAge, rw.Header().Get(middleware.SessionAgeHeader))
+				assert.Equal(t, tc.expectedExpiresIn, rw.Header().Get(middleware.SessionTokenExpiresInHeader))
+				assert.Equal(t, tc.expectedRefreshed, rw.Header().Get(middleware.SessionRefreshedHeader))
+			})
+		}
+	}
+
+	t.Run("requests without the opt-in header don't have the debug headers", func(t *testing.T) {
+		failRefresh = false
+		req := sessionRequest("/page", 2*time.Minute)
+		req.Header.Del("X-Debug-Session")
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Header().Get(middleware.SessionAgeHeader))
+		assert.Empty(t, rw.Header().Get(middleware.SessionTokenExpiresInHeader))
+		assert.Empty(t, rw.Header().Get(middleware.SessionRefreshedHeader))
+	})
+}
+
+func TestAutoRedirectKnownProvider(t *testing.T) {
+	testCases := map[string]struct {
+		disabled         bool
+		path             string
+		providerID       string
+		tamper           bool
+		expectedCode     int
+		expectedLocation string
+	}{
+		"Redirects from the sign-in page to the known provider": {
+			path:             "/oauth2/sign_in?rd=%2Ffoo",
+			providerID:       "providerID",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "/oauth2/start?rd=%2Ffoo",
+		},
+		"Redirects unauthenticated requests to the known provider": {
+			path:             "/foo?bar=baz",
+			providerID:       "providerID",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "/oauth2/start?rd=%2Ffoo%3Fbar%3Dbaz",
+		},
+		"Shows the sign-in page without a provider cookie": {
+			path:         "/oauth2/sign_in?rd=%2Ffoo",
+			expectedCode: http.StatusOK,
+		},
+		"Shows the sign-in page when disabled": {
+			disabled:     true,
+			path:         "/oauth2/sign_in?rd=%2Ffoo",
+			providerID:   "providerID",
+			expectedCode: http.StatusOK,
+		},
+		"Shows the sign-in page when prompted to select a provider": {
+			path:         "/oauth2/sign_in?rd=%2Ffoo&prompt=select",
+			providerID:   "providerID",
+			expectedCode: http.StatusOK,
+		},
+		"Shows the sign-in page for a provider that isn't configured": {
+			path:         "/oauth2/sign_in?rd=%2Ffoo",
+			providerID:   "otherProviderID",
+			expectedCode: http.StatusOK,
+		},
+		"Shows the sign-in page for a tampered provider cookie": {
+			path:         "/oauth2/sign_in?rd=%2Ffoo",
+			providerID:   "providerID",
+			tamper:       true,
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			opts := baseTestOptions()
+			opts.AutoRedirectKnownProvider = !tc.disabled
+			err := validation.Validate(opts)
+			assert.NoError(t, err)
+
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.providerID != "" {
+				cookie, err := cookies.MakeProviderCookie(req, tc.providerID, &opts.Cookie, time.Now())
+				assert.NoError(t, err)
+				if tc.tamper {
+					cookie.Value = base64.URLEncoding.EncodeToString([]byte("otherProviderID")) + cookie.Value[strings.Index(cookie.Value, "|"):]
+				}
+				req.AddCookie(cookie)
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectedLocation, rw.Header().Get("Location"))
+		})
+	}
+}
+
+func TestSetProviderCookie(t *testing.T) {
+	opts := baseTestOptions()
+	opts.AutoRedirectKnownProvider = true
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/callback", nil)
+	proxy.setProviderCookie(rw, req)
+
+	setCookies := rw.Result().Cookies()
+	assert.Len(t, setCookies, 1)
+	assert.Equal(t, "_oauth2_proxy_provider", setCookies[0].Name)
+
+	req = httptest.NewRequest(http.MethodGet, "/oauth2/sign_in", nil)
+	req.AddCookie(setCookies[0])
+	providerID, ok := cookies.LoadProviderCookie(req, &opts.Cookie)
+	assert.True(t, ok)
+	assert.Equal(t, "providerID", providerID)
+}
+
+func TestSignedURL(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		err := json.NewEncoder(w).Encode(map[string]string{
+			"RequestURI":       r.RequestURI,
+			"X-Forwarded-User": r.Header.Get("X-Forwarded-User"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	keyFile, err := ioutil.TempFile("", "oauth2-proxy-signed-url-key")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(keyFile.Name()) })
+	_, err = keyFile.WriteString("0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	require.NoError(t, keyFile.Close())
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SignedURL.KeyFile = keyFile.Name()
+	opts.WhitelistDomains = []string{"app.example.com"}
+	opts.Redirect.AllowLoopback = true
+	err = validation.Validate(opts)
+	require.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	require.NoError(t, err)
+
+	now := time.Now().Truncate(time.Second)
+	clock.Set(now)
+	defer clock.Reset()
+
+	signURL := func(params url.Values, withSession bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth2/sign-url", strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		if withSession {
+			rw := httptest.NewRecorder()
+			require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{
+				Email:       "john.doe@example.com",
+				AccessToken: "my_access_token",
+				CreatedAt:   &now,
+			}))
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	t.Run("Signing", func(t *testing.T) {
+		testCases := []struct {
+			name         string
+			params       url.Values
+			noSession    bool
+			expectedCode int
+		}{
+			{
+				name:         "Without a session",
+				params:       url.Values{"url": []string{"/reports/1"}},
+				noSession:    true,
+				expectedCode: http.StatusUnauthorized,
+			},
+			{
+				name:         "Without a url",
+				params:       url.Values{},
+				expectedCode: http.StatusBadRequest,
+			},
+			{
+				name:         "With a url under the proxy prefix",
+				params:       url.Values{"url": []string{"/oauth2/userinfo"}},
+				expectedCode: http.StatusBadRequest,
+			},
+			{
+				name:         "With a lifetime over the maximum",
+				params:       url.Values{"url": []string{"/reports/1"}, "expires_in": []string{"2h"}},
+				expectedCode: http.StatusBadRequest,
+			},
+			{
+				name:         "With an invalid client IP",
+				params:       url.Values{"url": []string{"/reports/1"}, "client_ip": []string{"localhost"}},
+				expectedCode: http.StatusBadRequest,
+			},
+			{
+				name:         "With a url to a domain that isn't allowed",
+				params:       url.Values{"url": []string{"https://evil.example.org/reports/1"}},
+				expectedCode: http.StatusBadRequest,
+			},
+			{
+				name:         "With a url to a loopback address",
+				params:       url.Values{"url": []string{"http://[::1]:51234/reports/1"}},
+				expectedCode: http.StatusOK,
+			},
+			{
+				name:         "With a url to a domain starting with localhost",
+				params:       url.Values{"url": []string{"http://localhost.evil.com:51234/reports/1"}},
+				expectedCode: http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				rw := signURL(tc.params, !tc.noSession)
+				assert.Equal(t, tc.expectedCode, rw.Code)
+				assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+			})
+		}
+	})
+
+	testCases := []struct {
+		name          string
+		params        url.Values
+		method        string
+		remoteAddr    string
+		after         time.Duration
+		expectedCode  int
+		expectedQuery string
+	}{
+		{
+			name:          "With a valid signature",
+			params:        url.Values{"url": []string{"https://app.example.com/reports/1?format=pdf"}},
+			expectedCode:  http.StatusOK,
+			expectedQuery: "/reports/1?format=pdf",
+		},
+		{
+			name:         "With another method",
+			params:       url.Values{"url": []string{"/reports/1"}},
+			method:       http.MethodDelete,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:          "With the signed method",
+			params:        url.Values{"url": []string{"/reports/1"}, "method": []string{"delete"}},
+			method:        http.MethodDelete,
+			expectedCode:  http.StatusOK,
+			expectedQuery: "/reports/1",
+		},
+		{
+			name:         "After it expired",
+			params:       url.Values{"url": []string{"/reports/1"}, "expires_in": []string{"5m"}},
+			after:        5 * time.Minute,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:          "Bound to the client IP",
+			params:        url.Values{"url": []string{"/reports/1"}, "client_ip": []string{"1.2.3.4"}},
+			remoteAddr:    "1.2.3.4:43670",
+			expectedCode:  http.StatusOK,
+			expectedQuery: "/reports/1",
+		},
+		{
+			name:         "Bound to another client IP",
+			params:       url.Values{"url": []string{"/reports/1"}, "client_ip": []string{"1.2.3.4"}},
+			remoteAddr:   "5.6.7.8:43670",
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := signURL(tc.params, true)
+			require.Equal(t, http.StatusOK, rw.Code)
+			signedURLInfo := struct {
+				URL       string    `json:"url"`
+				ExpiresOn time.Time `json:"expiresOn"`
+			}{}
+			require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &signedURLInfo))
+
+			expiresIn := time.Hour
+			if tc.params.Get("expires_in") != "" {
+				expiresIn, err = time.ParseDuration(tc.params.Get("expires_in"))
+				require.NoError(t, err)
+			}
+			assert.True(t, now.Add(expiresIn).Equal(signedURLInfo.ExpiresOn))
+
+			require.NoError(t, clock.Add(tc.after))
+			defer clock.Set(now)
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, signedURLInfo.URL, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+
+			if tc.expectedCode == http.StatusOK {
+				upstreamRequest := map[string]string{}
+				require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &upstreamRequest))
+				// The signed URL parameters aren't passed to the upstream
+				assert.Equal(t, tc.expectedQuery, upstreamRequest["RequestURI"])
+				assert.Equal(t, "", upstreamRequest["X-Forwarded-User"])
+			}
+		})
+	}
+}
+
+func TestSignedURLAuthorization(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	authz := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Request struct {
+				Path string `json:"path"`
+			} `json:"request"`
+			Session *struct {
+				Email string `json:"email"`
+			} `json:"session"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+		switch {
+		case strings.HasPrefix(input.Request.Path, "/reports/denied/"):
+			_, _ = rw.Write([]byte(`{"allow": false, "reason": "denied"}`))
+		case strings.HasPrefix(input.Request.Path, "/reports/private/") && input.Session == nil:
+			_, _ = rw.Write([]byte(`{"allow": false, "reason": "requires a session"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"allow": true}`))
+		}
+	}))
+	t.Cleanup(authz.Close)
+
+	keyFile, err := ioutil.TempFile("", "oauth2-proxy-signed-url-key")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(keyFile.Name()) })
+	_, err = keyFile.WriteString("0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	require.NoError(t, keyFile.Close())
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+				Policies: []options.UpstreamPolicy{
+					{Name: "reports", Path: "^/reports/", Methods: []string{http.MethodGet}},
+					{Name: "admins", Groups: []string{"admins"}},
+				},
+			},
+		},
+	}
+	opts.SignedURL.KeyFile = keyFile.Name()
+	opts.RouteAccessRules = []string{"office:path~^/reports/office/&cidr=192.168.0.0/16"}
+	opts.RequireRecentAuth = []string{"^/reports/recent/=10m"}
+	opts.ExternalAuthz.URL = authz.URL
+	err = validation.Validate(opts)
+	require.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	require.NoError(t, err)
+
+	now := time.Now().Truncate(time.Second)
+	clock.Set(now)
+	defer clock.Reset()
+
+	testCases := []struct {
+		name             string
+		url              string
+		groups           []string
+		authenticatedAgo time.Duration
+		signerAddr       string
+		remoteAddr       string
+		expectedSignCode int
+		expectedCode     int
+	}{
+		{
+			name:             "To a path allowed without groups",
+			url:              "/reports/1",
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:             "To a path the signer isn't allowed",
+			url:              "/admin/page",
+			expectedSignCode: http.StatusForbidden,
+		},
+		{
+			name:             "To a path requiring the groups of the signer",
+			url:              "/admin/page",
+			groups:           []string{"admins"},
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusForbidden,
+		},
+		{
+			name:             "To a path of the client network",
+			url:              "/reports/office/1",
+			signerAddr:       "192.168.1.2:43670",
+			remoteAddr:       "192.168.1.3:43670",
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:             "To a path of another client network",
+			url:              "/reports/office/1",
+			signerAddr:       "192.168.1.2:43670",
+			remoteAddr:       "203.0.113.1:43670",
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusForbidden,
+		},
+		{
+			name:             "To a path of the client network from outside it",
+			url:              "/reports/office/1",
+			signerAddr:       "203.0.113.1:43670",
+			expectedSignCode: http.StatusForbidden,
+		},
+		{
+			name:             "To a path requiring a recent authentication",
+			url:              "/reports/recent/1",
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:             "To a path requiring an authentication more recent than the signer's",
+			url:              "/reports/recent/1",
+			authenticatedAgo: time.Hour,
+			expectedSignCode: http.StatusForbidden,
+		},
+		{
+			name:             "To a path the external authorization denies",
+			url:              "/reports/denied/1",
+			expectedSignCode: http.StatusForbidden,
+		},
+		{
+			name:             "To a path the external authorization denies without a session",
+			url:              "/reports/private/1",
+			expectedSignCode: http.StatusOK,
+			expectedCode:     http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := url.Values{"url": []string{tc.url}}
+			req := httptest.NewRequest(http.MethodPost, "/oauth2/sign-url", strings.NewReader(params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Requested-With", "XMLHttpRequest")
+			if tc.signerAddr != "" {
+				req.RemoteAddr = tc.signerAddr
+			}
+			authTime := now.Add(-tc.authenticatedAgo)
+			rw := httptest.NewRecorder()
+			require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{
+				Email:       "john.doe@example.com",
+				AccessToken: "my_access_token",
+				Groups:      tc.groups,
+				CreatedAt:   &now,
+				AuthTime:    &authTime,
+			}))
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			require.Equal(t, tc.expectedSignCode, rw.Code)
+			if tc.expectedSignCode != http.StatusOK {
+				return
+			}
+
+			signedURLInfo := struct {
+				URL string `json:"url"`
+			}{}
+			require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &signedURLInfo))
+
+			// The signed request is authorized without the session of the signer
+			req = httptest.NewRequest(http.MethodGet, signedURLInfo.URL, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			rw = httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expectedCode, rw.Code)
+		})
+	}
+}
+
+func TestOpaqueBearerTokenIntrospection(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	introspectionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("token") == "active-token" {
+			_, _ = w.Write([]byte(`{"active":true,"sub":"1234567890","email":"john@example.com"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"active":false}`))
+	}))
+	t.Cleanup(introspectionServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.Introspection.URL = introspectionServer.URL
+	opts.Introspection.ClientID = "proxy"
+	opts.Introspection.ClientSecret = "secret"
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		authorization          string
+		expectedCode           int
+		expectedAuthentication string
+	}{
+		"an active token": {
+			authorization: "Bearer active-token",
+			expectedCode:  http.StatusOK,
+		},
+		"an inactive token": {
+			authorization:          "Bearer inactive-token",
+			expectedCode:           http.StatusUnauthorized,
+			expectedAuthentication: `Bearer error="invalid_token"`,
+		},
+		"no token": {
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectedAuthentication, rw.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestProbeCredentials(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := fmt.Fprintf(w, "user=%s token=%s", r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Probe-Token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	const (
+		uptimeToken = "uptime-0123456789abcdef"
+		statusToken = "status-0123456789abcdef"
+	)
+	dir := t.TempDir()
+	uptimeTokenFile := filepath.Join(dir, "uptime")
+	statusTokenFile := filepath.Join(dir, "status")
+	require.NoError(t, ioutil.WriteFile(uptimeTokenFile, []byte(uptimeToken), 0600))
+	require.NoError(t, ioutil.WriteFile(statusTokenFile, []byte(statusToken), 0600))
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.InjectRequestHeaders = []options.Header{
+		{
+			Name: "X-Forwarded-User",
+			Values: []options.HeaderValue{
+				{
+					ClaimSource: &options.ClaimSource{
+						Claim: "user",
+					},
+				},
+			},
+		},
+	}
+	opts.Probe.Credentials = []string{
+		"uptime:token-file=" + uptimeTokenFile + "&path=/status/",
+		"status:token-file=" + statusTokenFile + "&path=/status/&user=status-probe",
+	}
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		method       string
+		path         string
+		token        string
+		expectedCode int
+		expectedBody string
+	}{
+		"a probe without an identity": {
+			method:       http.MethodGet,
+			path:         "/status/page",
+			token:        uptimeToken,
+			expectedCode: http.StatusOK,
+			expectedBody: "user= token=",
+		},
+		"a probe with a synthetic identity": {
+			method:       http.MethodGet,
+			path:         "/status/page",
+			token:        statusToken,
+			expectedCode: http.StatusOK,
+			expectedBody: "user=status-probe token=",
+		},
+		"a probe outside of its paths": {
+			method:       http.MethodGet,
+			path:         "/admin",
+			token:        uptimeToken,
+			expectedCode: http.StatusForbidden,
+		},
+		"a probe outside of its methods": {
+			method:       http.MethodPost,
+			path:         "/status/page",
+			token:        uptimeToken,
+			expectedCode: http.StatusForbidden,
+		},
+		"an unknown token": {
+			method:       http.MethodGet,
+			path:         "/status/page",
+			token:        "unknown-0123456789abcdef",
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("X-Probe-Token", tc.token)
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			if tc.expectedBody != "" {
+				assert.Equal(t, tc.expectedBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	events := make(chan sessionevents.Event, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event sessionevents.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	t.Cleanup(webhookServer.Close)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600))
+
+	opts := baseTestOptions()
+	opts.RouteAccessRules = []string{"admin:path~^/admin/&group=admins"}
+	opts.SessionEvents.WebhookURL = "https://siem.example.com/events"
+	opts.SessionEvents.SigningKeyFiles = []string{keyFile}
+	opts.SessionEvents.Types = []string{options.SessionEventLogout, options.SessionEventAuthorizationDenied}
+	require.NoError(t, validation.Validate(opts))
+
+	// The webhook is only validated to be https
+	opts.SessionEvents.WebhookURL = webhookServer.URL
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	t.Cleanup(proxy.sessionEvents.Stop)
+
+	newRequest := func(method, target string) *http.Request {
+		created := time.Now()
+		req := httptest.NewRequest(method, target, nil)
+		if method == http.MethodPost {
+			addFormCSRFToken(t, proxy, req, nil)
+		}
+		rw := httptest.NewRecorder()
+		require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{
+			Email:     "john.doe@example.com",
+			Groups:    []string{"users"},
+			CreatedAt: &created,
+		}))
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	receive := func() sessionevents.Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a session event")
+			return sessionevents.Event{}
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodGet, "/admin/users"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	event := receive()
+	assert.Equal(t, options.SessionEventAuthorizationDenied, event.Type)
+	assert.Equal(t, "john.doe@example.com", event.Username)
+	assert.Equal(t, string(logger.AuthFailure), event.Status)
+	assert.Contains(t, event.Message, "Denied authorization via route access rule")
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodPost, "/oauth2/sign_out"))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	event = receive()
+	assert.Equal(t, options.SessionEventLogout, event.Type)
+	assert.Equal(t, "john.doe@example.com", event.Username)
+	assert.Equal(t, http.MethodPost, event.RequestMethod)
+	assert.Equal(t, "Signed out", event.Message)
+}
+
+func TestAuditLog(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+			{
+				ID:       "billing",
+				Path:     "/billing/",
+				URI:      upstreamServer.URL,
+				Policies: []options.UpstreamPolicy{{Groups: []string{"finance"}}},
+			},
+		},
+	}
+	opts.RouteAccessRules = []string{"admin:path~^/admin/&group=admins"}
+	opts.Audit.File = auditFile
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	newRequest := func(method, target string) *http.Request {
+		created := time.Now()
+		req := httptest.NewRequest(method, target, nil)
+		if method == http.MethodPost {
+			addFormCSRFToken(t, proxy, req, nil)
+		}
+		rw := httptest.NewRecorder()
+		require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{
+			Email:        "john.doe@example.com",
+			Groups:       []string{"users"},
+			AuthProvider: "providerID",
+			CreatedAt:    &created,
+		}))
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodGet, "/reports"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodGet, "/admin/users"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodGet, "/billing/invoices"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newRequest(http.MethodPost, "/oauth2/sign_out"))
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	proxy.auditLogger.Stop()
+	data, err := ioutil.ReadFile(auditFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 4)
+
+	events := make([]audit.Event, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &events[i]))
+		assert.Equal(t, audit.SchemaVersion, events[i].SchemaVersion)
+		assert.Equal(t, &audit.User{Email: "john.doe@example.com", Groups: []string{"users"}, Provider: "providerID"}, events[i].User)
+	}
+
+	assert.Equal(t, options.AuditEventUpstreamAccess, events[0].Type)
+	assert.Equal(t, "app", events[0].Upstream)
+	assert.Equal(t, http.StatusOK, events[0].Status)
+	assert.Equal(t, "/reports", events[0].Path)
+
+	assert.Equal(t, options.AuditEventAuthorizationDenied, events[1].Type)
+	assert.Equal(t, audit.OutcomeFailure, events[1].Outcome)
+	assert.Contains(t, events[1].Message, "Denied authorization via route access rule")
+
+	assert.Equal(t, options.AuditEventAuthorizationDenied, events[2].Type)
+	assert.Equal(t, audit.OutcomeFailure, events[2].Outcome)
+	assert.Equal(t, "billing", events[2].Upstream)
+	assert.Equal(t, "Denied authorization via upstream: the request matches none of its policies", events[2].Message)
+
+	assert.Equal(t, options.AuditEventSessionRevoked, events[3].Type)
+	assert.Equal(t, audit.OutcomeSuccess, events[3].Outcome)
+	assert.Equal(t, "Signed out", events[3].Message)
+}
+
+func TestCrawlerDetection(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("upstream"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   upstreamServer.URL,
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	opts.SkipAuthRoutes = []string{"GET=^/public/"}
+	opts.Crawlers.Detection = true
+	opts.Crawlers.ResponseStatus = http.StatusNotFound
+	err := validation.Validate(opts)
+	assert.NoError(t, err)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		crawler = "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+		browser = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+	)
+	testCases := map[string]struct {
+		path          string
+		userAgent     string
+		expectedCode  int
+		expectCookies bool
+	}{
+		"a crawler requesting a protected route": {
+			path:         "/private",
+			userAgent:    crawler,
+			expectedCode: http.StatusNotFound,
+		},
+		"a crawler starting a sign in flow": {
+			path:         "/oauth2/start?rd=%2Fprivate",
+			userAgent:    crawler,
+			expectedCode: http.StatusNotFound,
+		},
+		"a crawler requesting the sign in page": {
+			path:         "/oauth2/sign_in",
+			userAgent:    crawler,
+			expectedCode: http.StatusNotFound,
+		},
+		"a crawler requesting the callback": {
+			path:         "/oauth2/callback?code=code&state=state",
+			userAgent:    crawler,
+			expectedCode: http.StatusNotFound,
+		},
+		"a crawler requesting a skip auth route": {
+			path:         "/public/index.html",
+			userAgent:    crawler,
+			expectedCode: http.StatusOK,
+		},
+		"a user starting a sign in flow": {
+			path:          "/oauth2/start?rd=%2Fprivate",
+			userAgent:     browser,
+			expectedCode:  http.StatusFound,
+			expectCookies: true,
+		},
+		"a user requesting a protected route": {
+			path:         "/private",
+			userAgent:    browser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("User-Agent", tc.userAgent)
+			proxy.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.expectedCode, rw.Code)
+			assert.Equal(t, tc.expectCookies, len(rw.Header().Values("Set-Cookie")) > 0)
+		})
+	}
+}
+
+func TestDynamicUpstreams(t *testing.T) {
+	newUpstreamServer := func(body string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := w.Write([]byte(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	appServer := newUpstreamServer("app")
+	previewServer := newUpstreamServer("preview")
+
+	dir, err := ioutil.TempDir("", "dynamic-upstreams")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	writeUpstream := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	writeUpstream("pr-1.json", fmt.Sprintf(`{"id": "pr-1", "path": "/pr-1/", "uri": %q, "ttl": "1h"}`, previewServer.URL))
+	writeUpstream("shadow.json", fmt.Sprintf(`{"id": "shadow", "path": "/app/admin/", "uri": %q}`, previewServer.URL))
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/app/",
+				URI:  appServer.URL,
+			},
+		},
+	}
+	opts.DynamicUpstreams.Dir = dir
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	serve := func(path string, session bool) *httptest.ResponseRecorder {
+		var groups []string
+		if session {
+			groups = []string{}
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, newDebugRequest(t, proxy, path, "127.0.0.1", groups))
+		return rw
+	}
+
+	t.Run("proxies to the registered upstreams", func(t *testing.T) {
+		rw := serve("/pr-1/index.html", true)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "preview", rw.Body.String())
+	})
+
+	t.Run("never shadows the configured upstreams", func(t *testing.T) {
+		rw := serve("/app/admin/", true)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "app", rw.Body.String())
+	})
+
+	t.Run("lists the dynamic upstreams with a session", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve("/oauth2/dynamic-upstreams", false).Code)
+
+		rw := serve("/oauth2/dynamic-upstreams", true)
+		require.Equal(t, http.StatusOK, rw.Code)
+		var list struct {
+			Upstreams []struct {
+				File    string     `json:"file"`
+				State   string     `json:"state"`
+				ID      string     `json:"id"`
+				Expires *time.Time `json:"expires"`
+				Error   string     `json:"error"`
+			} `json:"upstreams"`
+		}
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &list))
+		require.Len(t, list.Upstreams, 2)
+		assert.Equal(t, "pr-1.json", list.Upstreams[0].File)
+		assert.Equal(t, "registered", list.Upstreams[0].State)
+		assert.NotNil(t, list.Upstreams[0].Expires)
+		assert.Equal(t, "shadow.json", list.Upstreams[1].File)
+		assert.Equal(t, "rejected", list.Upstreams[1].State)
+		assert.Contains(t, list.Upstreams[1].Error, "overlapping the path \"/app/\"")
+	})
+}
+
+func TestHasH2CUpstream(t *testing.T) {
+	upstreams := func(uris ...string) options.UpstreamConfig {
+		config := options.UpstreamConfig{}
+		for _, uri := range uris {
+			config.Upstreams = append(config.Upstreams, options.Upstream{URI: uri})
+		}
+		return config
+	}
+
+	assert.False(t, hasH2CUpstream(upstreams()))
+	assert.False(t, hasH2CUpstream(upstreams("http://app.internal", "file:///var/www")))
+	assert.True(t, hasH2CUpstream(upstreams("http://app.internal", "h2c://grpc.internal:50051")))
+}
+
+// testWebSocketDrainer records the deadline of the context the WebSockets
+// are drained with
+type testWebSocketDrainer struct {
+	http.Handler
+	drained  bool
+	deadline time.Time
+}
+
+func (d *testWebSocketDrainer) DrainWebSockets(ctx context.Context) {
+	d.drained = true
+	d.deadline, _ = ctx.Deadline()
+}
+
+func TestDrainWebSockets(t *testing.T) {
+	drainer := &testWebSocketDrainer{Handler: http.NotFoundHandler()}
+	p := &OAuthProxy{upstreamProxy: drainer, webSocketDrainTimeout: time.Minute}
+
+	start := time.Now()
+	p.drainWebSockets()
+	assert.True(t, drainer.drained)
+	assert.WithinDuration(t, start.Add(time.Minute), drainer.deadline, 5*time.Second)
+
+	// Proxies that don't proxy WebSockets aren't drained
+	p = &OAuthProxy{upstreamProxy: http.NotFoundHandler(), webSocketDrainTimeout: time.Minute}
+	p.drainWebSockets()
+}
+
+func TestUpstreamsHealth(t *testing.T) {
+	appServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Write([]byte("app"))
+	}))
+	t.Cleanup(appServer.Close)
+
+	interval := options.Duration(time.Hour)
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/app/",
+				URI:  appServer.URL,
+				HealthCheck: &options.UpstreamHealthCheck{
+					Path:     "/healthz",
+					Interval: &interval,
+				},
+			},
+			{
+				ID:   "other",
+				Path: "/other/",
+				URI:  appServer.URL,
+			},
+		},
+	}
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	serve := func(method string, session bool) *httptest.ResponseRecorder {
+		var groups []string
+		if session {
+			groups = []string{}
+		}
+		req := newDebugRequest(t, proxy, "/oauth2/upstreams", "127.0.0.1", groups)
+		req.Method = method
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	t.Run("requires a session", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, false).Code)
+	})
+
+	t.Run("only allows GET", func(t *testing.T) {
+		rw := serve(http.MethodPost, true)
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodGet, rw.Header().Get("Allow"))
+	})
+
+	t.Run("lists the health checked upstreams", func(t *testing.T) {
+		rw := serve(http.MethodGet, true)
+		require.Equal(t, http.StatusOK, rw.Code)
+		var list struct {
+			Upstreams []struct {
+				ID       string `json:"id"`
+				Healthy  bool   `json:"healthy"`
+				Backends []struct {
+					URI     string `json:"uri"`
+					Healthy bool   `json:"healthy"`
+				} `json:"backends"`
+			} `json:"upstreams"`
+		}
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &list))
+		require.Len(t, list.Upstreams, 1)
+		assert.Equal(t, "app", list.Upstreams[0].ID)
+		assert.True(t, list.Upstreams[0].Healthy)
+		require.Len(t, list.Upstreams[0].Backends, 1)
+		assert.Equal(t, appServer.URL, list.Upstreams[0].Backends[0].URI)
+	})
+
+	t.Run("is not registered without health checks", func(t *testing.T) {
+		opts := baseTestOptions()
+		opts.UpstreamServers = options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:   "app",
+					Path: "/",
+					URI:  appServer.URL,
+				},
+			},
+		}
+		require.NoError(t, validation.Validate(opts))
+
+		proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+		require.NoError(t, err)
+		assert.Nil(t, proxy.upstreamHealth)
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, newDebugRequest(t, proxy, "/oauth2/upstreams", "127.0.0.1", []string{}))
+		assert.Equal(t, "app", rw.Body.String())
+	})
+}
+
+func TestBearerSessions(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	var upstreamAuthorization atomic.Value
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamAuthorization.Store(req.Header.Get("Authorization"))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	t.Cleanup(providerServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{{ID: "api", Path: "/", URI: upstreamServer.URL}},
+	}
+	opts.InjectRequestHeaders = nil
+	opts.Session.Type = options.RedisSessionStoreType
+	opts.Session.Redis.ConnectionURL = "redis://" + mr.Addr()
+	opts.Session.BearerTokens = true
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	providerURL, _ := url.Parse(providerServer.URL)
+	testProvider := NewTestProvider(providerURL, "john.doe@example.com")
+	testProvider.ValidToken = true
+	proxy.provider = testProvider
+
+	serve := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// The login flow sets no CSRF cookie, the state carries the CSRF
+	rw := serve(http.MethodGet, "/oauth2/start", "")
+	require.Equal(t, http.StatusFound, rw.Code)
+	assert.Empty(t, rw.Header().Values("Set-Cookie"))
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	state := loginURL.Query().Get("state")
+
+	rw = serve(http.MethodGet, "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), "")
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Header().Values("Set-Cookie"))
+	assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+	tokenInfo := struct {
+		Token     string `json:"token"`
+		TokenType string `json:"tokenType"`
+		ExpiresIn int64  `json:"expiresIn"`
+	}{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &tokenInfo))
+	require.NotEmpty(t, tokenInfo.Token)
+	assert.Equal(t, "Bearer", tokenInfo.TokenType)
+	assert.Equal(t, int64(opts.Cookie.Expire/time.Second), tokenInfo.ExpiresIn)
+
+	t.Run("states that weren't issued by the proxy are rejected", func(t *testing.T) {
+		rw := serve(http.MethodGet, "/oauth2/callback?code=callback_code&state="+url.QueryEscape("forged:/"), "")
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+	})
+
+	t.Run("requests without a token get a JSON error", func(t *testing.T) {
+		rw := serve(http.MethodGet, "/api", "")
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+		assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+	})
+
+	t.Run("the token isn't passed on to upstreams", func(t *testing.T) {
+		rw := serve(http.MethodGet, "/api", tokenInfo.Token)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Header().Values("Set-Cookie"))
+		assert.Equal(t, "", upstreamAuthorization.Load())
+	})
+
+	t.Run("sessions are only deleted by DELETE requests", func(t *testing.T) {
+		rw := serve(http.MethodPost, "/oauth2/session", tokenInfo.Token)
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, http.MethodDelete, rw.Header().Get("Allow"))
+	})
+
+	t.Run("deleting a session signs it out", func(t *testing.T) {
+		rw := serve(http.MethodDelete, "/oauth2/session", tokenInfo.Token)
+		assert.Equal(t, http.StatusNoContent, rw.Code)
+		assert.Empty(t, rw.Header().Values("Set-Cookie"))
+
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api", tokenInfo.Token).Code)
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/oauth2/session", tokenInfo.Token).Code)
+	})
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	t.Cleanup(providerServer.Close)
+
+	newProxy := func(t *testing.T, policy string) *OAuthProxy {
+		opts := baseTestOptions()
+		opts.Session.Type = options.MemorySessionStoreType
+		opts.Session.MaxPerUser = 1
+		opts.Session.MaxPerUserPolicy = policy
+		require.NoError(t, validation.Validate(opts))
+
+		proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+		require.NoError(t, err)
+		providerURL, _ := url.Parse(providerServer.URL)
+		testProvider := NewTestProvider(providerURL, "john.doe@example.com")
+		testProvider.ValidToken = true
+		proxy.provider = testProvider
+		return proxy
+	}
+
+	// login signs in, returning the callback response
+	login := func(t *testing.T, proxy *OAuthProxy) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/start", nil))
+		require.Equal(t, http.StatusFound, rw.Code)
+		loginURL, err := url.Parse(rw.Header().Get("Location"))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=callback_code&state="+url.QueryEscape(loginURL.Query().Get("state")), nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	userInfo := func(proxy *OAuthProxy, callback *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		for _, cookie := range callback.Result().Cookies() {
+			if cookie.Name == proxy.CookieOptions.Name {
+				req.AddCookie(cookie)
+			}
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	t.Run("new logins are refused past the maximum", func(t *testing.T) {
+		proxy := newProxy(t, options.SessionMaxPerUserRejectNew)
+		first := login(t, proxy)
+		require.Equal(t, http.StatusFound, first.Code)
+
+		rw := login(t, proxy)
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Contains(t, rw.Body.String(), "You have too many active sessions")
+
+		rw = userInfo(proxy, first)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `{"user":"","email":"john.doe@example.com","sessions":1}`, rw.Body.String())
+	})
+
+	t.Run("the oldest sessions are evicted past the maximum", func(t *testing.T) {
+		proxy := newProxy(t, options.SessionMaxPerUserEvictOldest)
+		first := login(t, proxy)
+		require.Equal(t, http.StatusFound, first.Code)
+		second := login(t, proxy)
+		require.Equal(t, http.StatusFound, second.Code)
+
+		assert.Equal(t, http.StatusUnauthorized, userInfo(proxy, first).Code)
+		rw := userInfo(proxy, second)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `{"user":"","email":"john.doe@example.com","sessions":1}`, rw.Body.String())
+	})
+}
+
+func TestRequestDebugLogging(t *testing.T) {
+	var upstreamHeaders http.Header
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamHeaders = req.Header
+		rw.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{{ID: "app", Path: "/", URI: upstreamServer.URL}},
+	}
+	opts.Logging.StandardEnabled = false
+	opts.Logging.RequestDebug = options.RequestDebugLog{
+		Header: "X-Debug-Logging",
+		Secret: "debug-secret",
+		Emails: []string{"admin@example.com"},
+	}
+	require.NoError(t, validation.Validate(opts))
+	defer logger.SetStandardEnabled(true)
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		email       string
+		debugHeader string
+		expectDebug bool
+	}{
+		{
+			name:        "with the request debug secret",
+			email:       "john.doe@example.com",
+			debugHeader: "debug-secret",
+			expectDebug: true,
+		},
+		{
+			name:        "with another request debug header value",
+			email:       "john.doe@example.com",
+			debugHeader: "guess",
+			expectDebug: false,
+		},
+		{
+			name:        "with a request debug email",
+			email:       "admin@example.com",
+			expectDebug: true,
+		},
+		{
+			name:        "with another email",
+			email:       "john.doe@example.com",
+			expectDebug: false,
+		},
+	}
+
+	created := time.Now()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := bytes.NewBuffer(nil)
+			logger.SetOutput(logs)
+			defer logger.SetOutput(os.Stdout)
+
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			if tc.debugHeader != "" {
+				req.Header.Set("X-Debug-Logging", tc.debugHeader)
+			}
+			saveRW := httptest.NewRecorder()
+			require.NoError(t, proxy.SaveSession(saveRW, req, &sessions.SessionState{
+				Email:       tc.email,
+				AccessToken: "access-token",
+				CreatedAt:   &created,
+			}))
+			for _, cookie := range saveRW.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			require.Equal(t, http.StatusOK, rw.Code)
+			assert.NotContains(t, upstreamHeaders, "X-Debug-Logging")
+
+			if tc.expectDebug {
+				assert.Contains(t, logs.String(), `Routing GET /page to upstream "app"`)
+			} else {
+				assert.NotContains(t, logs.String(), "Routing GET /page")
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	var received http.Header
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	opts := baseTestOptions()
+	opts.UpstreamServers = options.UpstreamConfig{
+		Upstreams: []options.Upstream{
+			{
+				ID:   "app",
+				Path: "/",
+				URI:  upstreamServer.URL,
+			},
+		},
+	}
+	err := validation.Validate(opts)
+	require.NoError(t, err)
+	proxy, err := NewOAuthProxy(opts, func(_ string) bool { return true })
+	require.NoError(t, err)
+
+	created := time.Now()
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{Email: "john.doe@example.com", CreatedAt: &created}))
+
+	req = httptest.NewRequest(http.MethodGet, "/page", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String(), span.Name())
+		spans[span.SpanKind().String()+" "+span.Name()] = span
+	}
+	require.Len(t, spans, 5)
+	server := spans["server HTTP GET"]
+	route := spans["internal upstream.route"]
+	client := spans["client HTTP GET"]
+	require.NotNil(t, server)
+	require.NotNil(t, route)
+	require.NotNil(t, client)
+
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), spans["internal session.load"].Parent().SpanID())
+	assert.Equal(t, server.SpanContext().SpanID(), spans["internal authorize"].Parent().SpanID())
+	assert.Contains(t, spans["internal authorize"].Attributes(), tracing.AuthorizationKey.String("allowed"))
+	assert.Equal(t, server.SpanContext().SpanID(), route.Parent().SpanID())
+	assert.Equal(t, route.SpanContext().SpanID(), client.Parent().SpanID())
+
+	// The upstream continues the trace from the client span
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01", traceID, client.SpanContext().SpanID()), received.Get("traceparent"))
+}
@@ -0,0 +1,311 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/introspection"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+)
+
+// providerSelector serves each request with the proxy of one of the
+// providers.
+// The requests under the proxy prefix of a provider are served by its proxy,
+// otherwise the provider is selected by the request host, the request path or
+// the session cookie of the request, falling back to the first provider.
+// Providers with DisableCookieSelection are never selected by their session
+// cookie.
+type providerSelector struct {
+	// globalPrefix is the route prefix of the global proxy prefix, the
+	// requests under it are served at the route prefix of the selected
+	// provider
+	globalPrefix string
+	reverseProxy bool
+	proxies      []*providerProxy
+}
+
+// providerProxy is the proxy of a provider, with the requests it is selected
+// for
+type providerProxy struct {
+	proxy        *OAuthProxy
+	routePrefix  string
+	cookieName   string
+	hosts        []string
+	pathPrefixes []string
+
+	// cookieSelection is whether the session cookie of the provider selects
+	// it for the requests outside of its hosts and path prefixes
+	cookieSelection bool
+}
+
+// buildOtherProviders creates the providers after the first provider, which
+// are only served when several providers are configured
+func buildOtherProviders(opts *options.Options) ([]providers.Provider, error) {
+	others := make([]providers.Provider, 0, len(opts.Providers)-1)
+	for _, providerOpts := range opts.Providers[1:] {
+		provider, err := providers.NewProvider(providerOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error intiailising provider %q: %v", providerOpts.ID, err)
+		}
+		provider.Data().StoreClaims = opts.Session.StoreClaims
+		others = append(others, provider)
+	}
+	return others, nil
+}
+
+// buildSignInProviders lists the providers offered by the sign in page of the
+// first provider, with the proxy prefix their sign in starts at.
+// The list is empty when there is a single provider, which is signed in with
+// the login button of the page.
+func buildSignInProviders(opts *options.Options, provider providers.Provider, otherProviders []providers.Provider) []pagewriter.SignInProvider {
+	if len(otherProviders) == 0 {
+		return nil
+	}
+
+	all := append([]providers.Provider{provider}, otherProviders...)
+	signInProviders := make([]pagewriter.SignInProvider, 0, len(all))
+	for i, p := range all {
+		providerOpts := providerOptions(opts, opts.Providers[i])
+		signInProviders = append(signInProviders, pagewriter.SignInProvider{
+			Name:        buildProviderName(p, opts.Providers[i].Name),
+			ProxyPrefix: applyExternalURLPrefix(providerOpts).ProxyPrefix,
+		})
+	}
+	return signInProviders
+}
+
+// providerOptions returns the options of the provider alone, with the
+// overrides of the provider applied
+func providerOptions(opts *options.Options, provider options.Provider) *options.Options {
+	single := *opts
+	single.Providers = options.Providers{provider}
+	return applyProviderOverrides(&single)
+}
+
+// buildProviderSelector builds the proxies of the other providers and the
+// selector serving the requests with the proxies of all the providers.
+// The proxies of the other providers are copies of the proxy with their own
+// session store, cookies, endpoints and pages, sharing the upstreams and the
+// middleware of the proxy.
+func (p *OAuthProxy) buildProviderSelector(opts *options.Options, routePrefix string, otherProviders []providers.Provider, introspector *introspection.Introspector) (*providerSelector, error) {
+	selector := &providerSelector{
+		globalPrefix: buildRoutePrefix(opts),
+		reverseProxy: opts.ReverseProxy,
+		proxies: []*providerProxy{{
+			proxy:           p,
+			routePrefix:     routePrefix,
+			cookieName:      p.CookieOptions.Name,
+			hosts:           opts.Providers[0].Hosts,
+			pathPrefixes:    opts.Providers[0].PathPrefixes,
+			cookieSelection: !opts.Providers[0].DisableCookieSelection,
+		}},
+	}
+
+	for i, provider := range otherProviders {
+		providerOpts := opts.Providers[i+1]
+		proxy, proxyRoutePrefix, err := p.newProviderProxy(opts, providerOpts, provider, introspector)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %v", providerOpts.ID, err)
+		}
+		logger.Printf("Serving the %s provider %q at %s", provider.Data().ProviderName, providerOpts.ID, proxy.ProxyPrefix)
+		selector.proxies = append(selector.proxies, &providerProxy{
+			proxy:           proxy,
+			routePrefix:     proxyRoutePrefix,
+			cookieName:      proxy.CookieOptions.Name,
+			hosts:           providerOpts.Hosts,
+			pathPrefixes:    providerOpts.PathPrefixes,
+			cookieSelection: !providerOpts.DisableCookieSelection,
+		})
+	}
+	return selector, nil
+}
+
+// newProviderProxy copies the proxy for the provider, returning the copy with
+// the route prefix of its endpoints
+func (p *OAuthProxy) newProviderProxy(baseOpts *options.Options, providerOpts options.Provider, provider providers.Provider, introspector *introspection.Introspector) (*OAuthProxy, string, error) {
+	opts := providerOptions(baseOpts, providerOpts)
+	routePrefix := buildRoutePrefix(opts)
+	opts = applyExternalURLPrefix(opts)
+
+	sessionStore, err := buildSessionStore(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	backchannelLogout, err := newBackchannelLogout(opts, provider, sessionStore)
+	if err != nil {
+		return nil, "", fmt.Errorf("error initialising back-channel logout: %v", err)
+	}
+	if err := checkDeviceAuthorization(opts, provider); err != nil {
+		return nil, "", fmt.Errorf("error initialising device authorization: %v", err)
+	}
+	pageWriter, err := buildPageWriter(opts, provider, p.basicAuthValidator, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	appDirector, signOutDirector := buildAppDirectors(opts, p.redirectValidator)
+
+	// The redirect URL is shared with the other providers, the callback of
+	// the provider is at its own proxy prefix, on the host the provider is
+	// selected for
+	redirectURL := *p.redirectURL
+	redirectURL.Path = opts.ProxyPrefix + oauthCallbackPath
+	if len(providerOpts.Hosts) > 0 {
+		redirectURL.Scheme = ""
+		redirectURL.Host = ""
+	}
+
+	proxy := *p
+	proxy.CookieOptions = &opts.Cookie
+	proxy.SignInPath = fmt.Sprintf("%s/sign_in", opts.ProxyPrefix)
+	proxy.ProxyPrefix = opts.ProxyPrefix
+	proxy.provider = provider
+	proxy.providerID = providerOpts.ID
+	proxy.sessionStore = sessionStore
+	proxy.redirectURL = &redirectURL
+	proxy.sessionChain = buildSessionChain(opts, provider, sessionStore, p.basicAuthValidator, introspector, p.sessionEvents, p.auditLogger, p.claimEnricher)
+	proxy.sessionRefresher = buildSessionRefresher(opts, provider, sessionStore, p.claimEnricher)
+	proxy.backchannelLogout = backchannelLogout
+	proxy.providerFallback = nil
+	proxy.providerSelector = nil
+	proxy.pageWriter = pageWriter
+	proxy.appDirector = appDirector
+	proxy.signOutDirector = signOutDirector
+	proxy.buildHeaderLimitsChain(opts)
+	proxy.buildServeMux(routePrefix)
+	return &proxy, routePrefix, nil
+}
+
+func (s *providerSelector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if selected := s.selectByProxyPrefix(req.URL.Path); selected != nil {
+		selected.proxy.serveMux.ServeHTTP(rw, req)
+		return
+	}
+
+	selected := s.selectProxy(req)
+	selected.proxy.serveMux.ServeHTTP(rw, s.rewriteGlobalPrefix(req, selected.routePrefix))
+}
+
+// selectByProxyPrefix returns the proxy of the provider with the longest
+// proxy prefix of its own the path is under, if any
+func (s *providerSelector) selectByProxyPrefix(path string) *providerProxy {
+	var selected *providerProxy
+	for _, proxy := range s.proxies {
+		if proxy.routePrefix == s.globalPrefix || !hasPathPrefix(path, proxy.routePrefix) {
+			continue
+		}
+		if selected == nil || len(proxy.routePrefix) > len(selected.routePrefix) {
+			selected = proxy
+		}
+	}
+	return selected
+}
+
+// selectProxy selects the proxy of the provider of the request host,
+// otherwise of the longest path prefix of the request, otherwise of the first
+// session cookie of the request, falling back to the first provider whose
+// sign in page lists all the providers
+func (s *providerSelector) selectProxy(req *http.Request) *providerProxy {
+	host := s.requestHost(req)
+	for _, proxy := range s.proxies {
+		for _, pattern := range proxy.hosts {
+			if matchProviderHost(host, pattern) {
+				return proxy
+			}
+		}
+	}
+
+	var selected *providerProxy
+	selectedLength := 0
+	path := s.requestPath(req)
+	for _, proxy := range s.proxies {
+		for _, prefix := range proxy.pathPrefixes {
+			if hasPathPrefix(path, strings.TrimSuffix(prefix, "/")) && len(prefix) > selectedLength {
+				selected = proxy
+				selectedLength = len(prefix)
+			}
+		}
+	}
+	if selected != nil {
+		return selected
+	}
+
+	for _, proxy := range s.proxies {
+		if !proxy.cookieSelection {
+			continue
+		}
+		if hasCookie(req, proxy.cookieName) || hasCookie(req, proxy.cookieName+"_0") {
+			return proxy
+		}
+	}
+	return s.proxies[0]
+}
+
+// requestHost returns the host of the request without its port, which is the
+// forwarded host when the proxy runs behind a reverse proxy
+func (s *providerSelector) requestHost(req *http.Request) string {
+	host := req.Host
+	if forwarded := req.Header.Get(requestutil.XForwardedHost); s.reverseProxy && forwarded != "" {
+		host = forwarded
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// requestPath returns the path of the request, which is the path of the
+// forwarded URI when the proxy authenticates requests for a reverse proxy
+func (s *providerSelector) requestPath(req *http.Request) string {
+	if forwarded := req.Header.Get(requestutil.XForwardedURI); s.reverseProxy && forwarded != "" {
+		if uri, err := url.ParseRequestURI(forwarded); err == nil {
+			return uri.Path
+		}
+	}
+	return req.URL.Path
+}
+
+// rewriteGlobalPrefix moves a request under the global proxy prefix to the
+// route prefix of the selected provider, so that the global endpoints serve
+// the provider selected for the request
+func (s *providerSelector) rewriteGlobalPrefix(req *http.Request, routePrefix string) *http.Request {
+	if routePrefix == s.globalPrefix || !hasPathPrefix(req.URL.Path, s.globalPrefix) {
+		return req
+	}
+
+	rewritten := new(http.Request)
+	*rewritten = *req
+	rewritten.URL = new(url.URL)
+	*rewritten.URL = *req.URL
+	rewritten.URL.Path = routePrefix + strings.TrimPrefix(req.URL.Path, s.globalPrefix)
+	if req.URL.RawPath != "" {
+		rewritten.URL.RawPath = routePrefix + strings.TrimPrefix(req.URL.RawPath, s.globalPrefix)
+	}
+	return rewritten
+}
+
+// matchProviderHost reports whether the host matches the host of a provider,
+// which is either the host itself or a "*." wildcard of its subdomains
+func matchProviderHost(host, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// hasPathPrefix reports whether the path is the prefix or is under it
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func hasCookie(req *http.Request, name string) bool {
+	_, err := req.Cookie(name)
+	return err == nil
+}
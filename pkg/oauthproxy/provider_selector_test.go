@@ -0,0 +1,152 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProviderSelectorTestProxy returns a proxy of the default provider and of
+// an admin provider with its own client, cookies and proxy prefix
+func newProviderSelectorTestProxy(t *testing.T, configure func(admin *options.Provider)) *OAuthProxy {
+	opts := baseTestOptions()
+	admin := opts.Providers[0]
+	admin.ID = "admin"
+	admin.Name = "Admin"
+	admin.ClientID = "admin-client"
+	admin.CookieSuffix = "_admin"
+	admin.ProxyPrefix = "/admin/oauth2"
+	if configure != nil {
+		configure(&admin)
+	}
+	opts.Providers = append(opts.Providers, admin)
+	require.NoError(t, validation.Validate(opts))
+
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, proxy.providerSelector)
+	return proxy
+}
+
+// startClientID starts the sign in of the request, returning the client ID
+// and the redirect URI of the login URL the user is sent to
+func startClientID(t *testing.T, proxy *OAuthProxy, req *http.Request) (string, string) {
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusFound, rw.Code)
+
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	return loginURL.Query().Get("client_id"), loginURL.Query().Get("redirect_uri")
+}
+
+func TestProviderSelector(t *testing.T) {
+	t.Run("lists the providers on the sign in page", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, nil)
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/sign_in", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), `action="/oauth2/start"`)
+		assert.Contains(t, rw.Body.String(), `action="/admin/oauth2/start"`)
+		assert.Contains(t, rw.Body.String(), "Sign in with Admin")
+	})
+
+	t.Run("serves the endpoints of the providers at their proxy prefix", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, nil)
+
+		clientID, redirectURI := startClientID(t, proxy, httptest.NewRequest(http.MethodGet, "http://example.com/admin/oauth2/start", nil))
+		assert.Equal(t, "admin-client", clientID)
+		assert.Equal(t, "https://example.com/admin/oauth2/callback", redirectURI)
+
+		clientID, redirectURI = startClientID(t, proxy, httptest.NewRequest(http.MethodGet, "http://example.com/oauth2/start", nil))
+		assert.Equal(t, clientID, proxy.provider.Data().ClientID)
+		assert.Equal(t, "https://example.com/oauth2/callback", redirectURI)
+	})
+
+	t.Run("selects the provider of the request host", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, func(admin *options.Provider) {
+			admin.Hosts = []string{"*.admin.example.com"}
+		})
+
+		clientID, redirectURI := startClientID(t, proxy, httptest.NewRequest(http.MethodGet, "http://eu.admin.example.com:8080/oauth2/start", nil))
+		assert.Equal(t, "admin-client", clientID)
+		assert.Equal(t, "https://eu.admin.example.com:8080/admin/oauth2/callback", redirectURI)
+
+		clientID, _ = startClientID(t, proxy, httptest.NewRequest(http.MethodGet, "http://admin.example.com/oauth2/start", nil))
+		assert.Equal(t, clientID, proxy.provider.Data().ClientID)
+	})
+
+	t.Run("selects the provider of the request path", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, func(admin *options.Provider) {
+			admin.PathPrefixes = []string{"/admin/"}
+		})
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Contains(t, rw.Body.String(), `action="/admin/oauth2/start"`)
+		assert.NotContains(t, rw.Body.String(), `action="/oauth2/start"`)
+
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/administration", nil))
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Contains(t, rw.Body.String(), `action="/oauth2/start"`)
+	})
+
+	t.Run("serves the global endpoints with the provider of the session cookie", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, nil)
+		admin := proxy.providerSelector.proxies[1].proxy
+
+		rw := httptest.NewRecorder()
+		require.NoError(t, admin.SaveSession(rw, httptest.NewRequest(http.MethodGet, "/admin/oauth2/callback", nil), &sessions.SessionState{
+			Email: "john.doe@example.com",
+			User:  "jdoe",
+		}))
+		cookies := rw.Result().Cookies()
+		require.NotEmpty(t, cookies)
+		assert.Equal(t, "_oauth2_proxy_admin", cookies[0].Name)
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), "john.doe@example.com")
+
+		// The session of a provider isn't a session of the other providers
+		_, err := proxy.LoadCookiedSession(req)
+		assert.Error(t, err)
+	})
+
+	t.Run("doesn't select a provider by its session cookie when disabled", func(t *testing.T) {
+		proxy := newProviderSelectorTestProxy(t, func(admin *options.Provider) {
+			admin.DisableCookieSelection = true
+		})
+		admin := proxy.providerSelector.proxies[1].proxy
+
+		rw := httptest.NewRecorder()
+		require.NoError(t, admin.SaveSession(rw, httptest.NewRequest(http.MethodGet, "/admin/oauth2/callback", nil), &sessions.SessionState{
+			Email: "john.doe@example.com",
+			User:  "jdoe",
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+		assert.NotContains(t, rw.Body.String(), "john.doe@example.com")
+	})
+}
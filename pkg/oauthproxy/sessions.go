@@ -0,0 +1,122 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/audit"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const managementSessionsPath = "/sessions"
+
+// ManagementSessions lists the sessions of the session inventory on the
+// management server with a GET, and revokes them with a DELETE.
+// Sessions are selected by the `id` of their record, or by the `user` or
+// `email` of their user, which are required to revoke sessions so that the
+// whole store is never revoked by mistake.
+// Listed sessions are returned as `{"sessions": [...]}`, and the number of
+// revoked sessions as `{"revoked": 1}`.
+// Revoked sessions are removed from the session store, so that they are
+// signed out on every replica sharing the store.
+func (p *OAuthProxy) ManagementSessions(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodDelete {
+		rw.Header().Set("Allow", "GET, DELETE")
+		p.errorJSON(rw, req, http.StatusMethodNotAllowed)
+		return
+	}
+	inventory, ok := p.sessionStore.(sessionsapi.SessionInventory)
+	if !ok {
+		p.errorJSON(rw, req, http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	id, user, email := query.Get("id"), query.Get("user"), query.Get("email")
+	if req.Method == http.MethodDelete && id == "" && user == "" && email == "" {
+		p.errorJSON(rw, req, http.StatusBadRequest)
+		return
+	}
+
+	records, err := inventory.ListSessions(req.Context())
+	if err != nil {
+		logger.Errorf("Error listing the sessions of the session inventory: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return
+	}
+	selected := []sessionsapi.SessionRecord{}
+	for _, record := range records {
+		if (id == "" || record.ID == id) &&
+			(user == "" || record.User == user) &&
+			(email == "" || strings.EqualFold(record.Email, email)) {
+			selected = append(selected, record)
+		}
+	}
+
+	if req.Method == http.MethodGet {
+		writeManagementJSON(rw, struct {
+			Sessions []sessionsapi.SessionRecord `json:"sessions"`
+		}{Sessions: selected})
+		return
+	}
+
+	if id != "" && len(selected) == 0 {
+		p.errorJSON(rw, req, http.StatusNotFound)
+		return
+	}
+	revoked := 0
+	for _, record := range selected {
+		if !p.revokeStoredSession(rw, req, inventory, record) {
+			return
+		}
+		revoked++
+	}
+	writeManagementJSON(rw, struct {
+		Revoked int `json:"revoked"`
+	}{Revoked: revoked})
+}
+
+// revokeStoredSession revokes the session of the record, recording it in the
+// auth and audit logs. The error response is written when the session can't
+// be revoked.
+// Sessions revoked by another request in the meantime are skipped.
+func (p *OAuthProxy) revokeStoredSession(rw http.ResponseWriter, req *http.Request, inventory sessionsapi.SessionInventory, record sessionsapi.SessionRecord) bool {
+	err := inventory.RevokeSession(req.Context(), record.ID)
+	if errors.Is(err, sessionsapi.ErrSessionNotFound) {
+		return true
+	}
+	if err != nil {
+		logger.Errorf("Error revoking a session of the session inventory: %v", err)
+		p.errorJSON(rw, req, http.StatusInternalServerError)
+		return false
+	}
+
+	// The management server may be protected with basic auth, whose user is
+	// recorded as the user revoking the session
+	username, _, _ := req.BasicAuth()
+	identity := record.Email
+	if identity == "" {
+		identity = record.User
+	}
+	logger.PrintAuthf(username, req, logger.AuthSuccess, "Revoked the stored session %s of %s", record.ID, identity)
+	p.recordAudit(options.AuditEventSessionRevoked, req, &sessionsapi.SessionState{
+		User:              record.User,
+		Email:             record.Email,
+		PreferredUsername: record.PreferredUsername,
+		Groups:            record.Groups,
+		AuthProvider:      record.Provider,
+	}, audit.OutcomeSuccess, "Revoked session %s on the management server", record.ID)
+	return true
+}
+
+// writeManagementJSON writes the JSON response of a management endpoint
+func writeManagementJSON(rw http.ResponseWriter, body interface{}) {
+	rw.Header().Set("Content-Type", applicationJSON)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		logger.Errorf("Error encoding the management response: %v", err)
+	}
+}
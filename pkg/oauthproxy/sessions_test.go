@@ -0,0 +1,137 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementSessions(t *testing.T) {
+	serve := func(t *testing.T, handler http.Handler, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	newProxy := func(t *testing.T) (*OAuthProxy, http.Handler) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", func(opts *options.Options) {
+			opts.Session.Type = options.MemorySessionStoreType
+			opts.Session.Inventory = true
+			opts.Management.Sessions = true
+			opts.Management.AllowedIPs = []string{"192.0.2.1"}
+		})
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+		return proxy, handler
+	}
+
+	// login saves a new session, returning a request with its session cookie
+	login := func(t *testing.T, proxy *OAuthProxy, session *sessionsapi.SessionState) *http.Request {
+		rw := httptest.NewRecorder()
+		require.NoError(t, proxy.sessionStore.Save(rw, httptest.NewRequest(http.MethodGet, "/oauth2/callback", nil), session))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	loaded := func(t *testing.T, proxy *OAuthProxy, req *http.Request) bool {
+		session, err := proxy.sessionStore.Load(req)
+		return err == nil && session != nil
+	}
+
+	listed := func(t *testing.T, rw *httptest.ResponseRecorder) []sessionsapi.SessionRecord {
+		var body struct {
+			Sessions []sessionsapi.SessionRecord `json:"sessions"`
+		}
+		require.NoError(t, json.NewDecoder(bytes.NewReader(rw.Body.Bytes())).Decode(&body))
+		return body.Sessions
+	}
+
+	revoked := func(t *testing.T, rw *httptest.ResponseRecorder) int {
+		var body struct {
+			Revoked int `json:"revoked"`
+		}
+		require.NoError(t, json.NewDecoder(bytes.NewReader(rw.Body.Bytes())).Decode(&body))
+		return body.Revoked
+	}
+
+	t.Run("is not served by default", func(t *testing.T) {
+		proxy, opts := newManagementTestProxy(t, "127.0.0.1:0", nil)
+		handler, err := proxy.buildManagementHandler(opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodGet, "/sessions").Code)
+	})
+
+	t.Run("lists the sessions of the users", func(t *testing.T) {
+		proxy, handler := newProxy(t)
+		login(t, proxy, &sessionsapi.SessionState{User: "jane", Email: "jane@example.com", AccessToken: "access-token"})
+		login(t, proxy, &sessionsapi.SessionState{User: "john", Email: "john@example.com"})
+
+		rw := serve(t, handler, http.MethodGet, "/sessions")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.NotContains(t, rw.Body.String(), "access-token")
+		sessions := listed(t, rw)
+		require.Len(t, sessions, 2)
+		assert.Equal(t, "jane", sessions[0].User)
+		assert.Equal(t, "john", sessions[1].User)
+
+		sessions = listed(t, serve(t, handler, http.MethodGet, "/sessions?email=John@example.com"))
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "john", sessions[0].User)
+
+		assert.Empty(t, listed(t, serve(t, handler, http.MethodGet, "/sessions?user=unknown")))
+	})
+
+	t.Run("revokes a session", func(t *testing.T) {
+		proxy, handler := newProxy(t)
+		first := login(t, proxy, &sessionsapi.SessionState{User: "jane"})
+		second := login(t, proxy, &sessionsapi.SessionState{User: "jane"})
+
+		sessions := listed(t, serve(t, handler, http.MethodGet, "/sessions?user=jane"))
+		require.Len(t, sessions, 2)
+
+		rw := serve(t, handler, http.MethodDelete, "/sessions?id="+sessions[0].ID)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, 1, revoked(t, rw))
+		assert.False(t, loaded(t, proxy, first))
+		assert.True(t, loaded(t, proxy, second))
+
+		assert.Equal(t, http.StatusNotFound, serve(t, handler, http.MethodDelete, "/sessions?id="+sessions[0].ID).Code)
+	})
+
+	t.Run("revokes all sessions of a user", func(t *testing.T) {
+		proxy, handler := newProxy(t)
+		first := login(t, proxy, &sessionsapi.SessionState{User: "jane"})
+		second := login(t, proxy, &sessionsapi.SessionState{User: "jane"})
+		other := login(t, proxy, &sessionsapi.SessionState{User: "john"})
+
+		rw := serve(t, handler, http.MethodDelete, "/sessions?user=jane")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, 2, revoked(t, rw))
+		assert.False(t, loaded(t, proxy, first))
+		assert.False(t, loaded(t, proxy, second))
+		assert.True(t, loaded(t, proxy, other))
+	})
+
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		_, handler := newProxy(t)
+
+		assert.Equal(t, http.StatusBadRequest, serve(t, handler, http.MethodDelete, "/sessions").Code)
+
+		rw := serve(t, handler, http.MethodPost, "/sessions")
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, "GET, DELETE", rw.Header().Get("Allow"))
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 import (
 	"encoding/csv"
@@ -108,6 +108,38 @@ func NewValidator(domains []string, usersFile string) func(string) bool {
 	return newValidatorImpl(domains, usersFile, nil, func() {})
 }
 
+// NewDenyValidator constructs a function to check whether email addresses are
+// denied, either individually or by domain.
+// Matching mirrors NewValidator: emails are case insensitive and domains
+// prefixed with a . or *. also match their subdomains.
+func NewDenyValidator(emails []string, domains []string) func(string) bool {
+	deniedEmails := make(map[string]struct{}, len(emails))
+	for _, email := range emails {
+		deniedEmails[strings.ToLower(strings.TrimSpace(email))] = struct{}{}
+	}
+
+	var denyAll bool
+	deniedDomains := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain == "*" {
+			denyAll = true
+			continue
+		}
+		deniedDomains = append(deniedDomains, strings.ToLower(domain))
+	}
+
+	return func(email string) bool {
+		if email == "" {
+			return false
+		}
+		email = strings.ToLower(email)
+		if _, ok := deniedEmails[email]; ok {
+			return true
+		}
+		return denyAll || isEmailValidWithDomains(email, deniedDomains)
+	}
+}
+
 // isEmailValidWithDomains checks if the authenticated email is validated against the provided domain
 func isEmailValidWithDomains(email string, allowedDomains []string) bool {
 	for _, domain := range allowedDomains {
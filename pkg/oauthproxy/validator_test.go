@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 import (
 	"io/ioutil"
@@ -420,3 +420,95 @@ func TestValidatorCases(t *testing.T) {
 		})
 	}
 }
+
+func TestDenyValidatorCases(t *testing.T) {
+	testCases := []struct {
+		name           string
+		deniedEmails   []string
+		deniedDomains  []string
+		email          string
+		expectedDenied bool
+	}{
+		{
+			name:           "EmailInDenyList",
+			deniedEmails:   []string{"xyzzy@example.com", "plugh@example.com"},
+			email:          "plugh@example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailInDenyListCaseInsensitive",
+			deniedEmails:   []string{"xyzzy@example.com", "Plugh@Example.com"},
+			email:          "PLUGH@example.COM",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailNotInDenyList",
+			deniedEmails:   []string{"xyzzy@example.com", "plugh@example.com"},
+			email:          "foo@example.com",
+			expectedDenied: false,
+		},
+		{
+			name:           "EmailInDeniedDomain",
+			deniedDomains:  []string{"example.com"},
+			email:          "foo@example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailInDeniedDomainCaseInsensitive",
+			deniedDomains:  []string{"Example.COM"},
+			email:          "Foo@example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailInSubdomainOfDeniedDomain",
+			deniedDomains:  []string{"example.com"},
+			email:          "foo@bar.example.com",
+			expectedDenied: false,
+		},
+		{
+			name:           "EmailInDeniedSubdomain",
+			deniedDomains:  []string{".example.com"},
+			email:          "foo@bar.example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailInDeniedSubdomainWildcard",
+			deniedDomains:  []string{"*.example.com"},
+			email:          "foo@bar.example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmailNotInDeniedSubdomainWildcard",
+			deniedDomains:  []string{"*.example.com"},
+			email:          "foo@example.com",
+			expectedDenied: false,
+		},
+		{
+			name:           "CheckForEqualityNotSuffix",
+			deniedDomains:  []string{"company.com"},
+			email:          "foo@evilcompany.com",
+			expectedDenied: false,
+		},
+		{
+			name:           "DenyAllDomains",
+			deniedDomains:  []string{"*"},
+			email:          "foo@example.com",
+			expectedDenied: true,
+		},
+		{
+			name:           "EmptyEmail",
+			deniedEmails:   []string{""},
+			deniedDomains:  []string{"*"},
+			email:          "",
+			expectedDenied: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			denied := NewDenyValidator(tc.deniedEmails, tc.deniedDomains)
+			g.Expect(denied(tc.email)).To(Equal(tc.expectedDenied))
+		})
+	}
+}
@@ -0,0 +1,4 @@
+package oauthproxy
+
+// Version is shown in the footer of the default sign-in and error pages
+var Version = "undefined"
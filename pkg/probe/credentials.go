@@ -0,0 +1,283 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+)
+
+// minTokenSize is the minimum size of a probe token
+const minTokenSize = 16
+
+var (
+	// ErrNoCredential is returned when authenticating a request which doesn't
+	// present a probe token
+	ErrNoCredential = errors.New("no probe token presented")
+
+	// ErrUnknownToken is returned when the probe token of a request doesn't
+	// match any probe credential, including those that have been revoked
+	ErrUnknownToken = errors.New("probe token doesn't match any probe credential")
+)
+
+// Credentials are the static credentials of monitoring probes. A request
+// presenting the token of a credential in the probe header is allowed
+// without a session, but only with the methods and to the path prefixes of
+// the credential.
+type Credentials struct {
+	header      string
+	credentials []*credential
+}
+
+// credential is a single named credential, in the format:
+// `<name>:token-file=<path>&path=<prefix>[,<prefix>...][&method=<method>[,<method>...]][&user=<user>]`
+// The methods default to GET and HEAD.
+type credential struct {
+	name      string
+	tokenFile string
+	prefixes  []string
+	methods   map[string]struct{}
+	user      string
+
+	// tokenHash is the SHA256 hash of the token, so that tokens of any size
+	// are compared in constant time. It is nil when the credential is revoked.
+	tokenHash []byte
+	mu        sync.RWMutex
+}
+
+// Credential is the probe credential a request was authenticated with
+type Credential struct {
+	// Name is the name of the credential
+	Name string
+	// User is the synthetic identity of the probe, if any
+	User string
+}
+
+// ScopeError describes why a request presenting a valid probe token is
+// outside of the scope of its credential
+type ScopeError struct {
+	// Credential is the name of the credential
+	Credential string
+	// Reason is the part of the scope the request is outside of
+	Reason string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("request is outside of the scope of probe credential %q: %s", e.Credential, e.Reason)
+}
+
+// NewCredentials parses the credentials and loads their tokens.
+func NewCredentials(opts options.Probe) (*Credentials, error) {
+	if opts.Header == "" {
+		return nil, errors.New("no probe credential header configured")
+	}
+
+	c := &Credentials{header: http.CanonicalHeaderKey(opts.Header)}
+	names := make(map[string]struct{}, len(opts.Credentials))
+	for _, raw := range opts.Credentials {
+		parsed, err := parseCredential(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe credential %q: %v", raw, err)
+		}
+		if _, ok := names[parsed.name]; ok {
+			return nil, fmt.Errorf("invalid probe credential %q: the name %q is already used", raw, parsed.name)
+		}
+		names[parsed.name] = struct{}{}
+
+		if err := parsed.loadToken(); err != nil {
+			return nil, fmt.Errorf("invalid probe credential %q: %v", raw, err)
+		}
+		c.credentials = append(c.credentials, parsed)
+	}
+	return c, nil
+}
+
+// WatchTokenFiles loads the token of each credential again when its token
+// file changes, so that credentials can be rotated or revoked individually.
+// A credential is revoked when its token file is emptied, or can no longer
+// be read.
+func (c *Credentials) WatchTokenFiles(done <-chan bool) error {
+	for _, cred := range c.credentials {
+		cred := cred
+		if err := watcher.WatchFileForUpdates(cred.tokenFile, done, func() {
+			if err := cred.loadToken(); err != nil {
+				logger.Errorf("Revoking probe credential %q: %v", cred.name, err)
+				cred.revoke()
+			}
+		}); err != nil {
+			return fmt.Errorf("could not watch token file of probe credential %q: %v", cred.name, err)
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the credential whose token the request presents,
+// provided the method and path of the request are in its scope.
+// ErrNoCredential is returned when the request doesn't present a probe
+// token, ErrUnknownToken when the token doesn't match a credential and a
+// ScopeError when the request is outside the scope of the credential.
+func (c *Credentials) Authenticate(req *http.Request) (Credential, error) {
+	token := req.Header.Get(c.header)
+	if token == "" {
+		return Credential{}, ErrNoCredential
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	var matched *credential
+	// Every credential is compared, so that the time taken doesn't reveal
+	// which credential matched
+	for _, cred := range c.credentials {
+		if cred.matches(hash[:]) && matched == nil {
+			matched = cred
+		}
+	}
+	if matched == nil {
+		return Credential{}, ErrUnknownToken
+	}
+
+	if reason := matched.outOfScope(req); reason != "" {
+		return Credential{}, &ScopeError{Credential: matched.name, Reason: reason}
+	}
+	return Credential{Name: matched.name, User: matched.user}, nil
+}
+
+// Strip removes the probe token from the request, so that it isn't sent to
+// the upstream
+func (c *Credentials) Strip(req *http.Request) {
+	req.Header.Del(c.header)
+}
+
+func (c *credential) matches(hash []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tokenHash != nil && subtle.ConstantTimeCompare(c.tokenHash, hash) == 1
+}
+
+// outOfScope returns the reason the request is outside of the scope of the
+// credential, if it is
+func (c *credential) outOfScope(req *http.Request) string {
+	if _, ok := c.methods[req.Method]; !ok {
+		return fmt.Sprintf("method %s is not allowed", req.Method)
+	}
+
+	// Paths with dot segments or repeated slashes could match a prefix
+	// without being under it once they are resolved
+	reqPath := req.URL.Path
+	cleaned := path.Clean(reqPath)
+	if strings.HasSuffix(reqPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != reqPath {
+		return fmt.Sprintf("path %q is not canonical", reqPath)
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(reqPath, prefix) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("path %q is not under %s", reqPath, strings.Join(c.prefixes, ", "))
+}
+
+// loadToken reads the token of the credential from its token file.
+// The credential is revoked when the file is empty.
+func (c *credential) loadToken() error {
+	data, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read token file %q: %v", c.tokenFile, err)
+	}
+	token := bytes.TrimSpace(data)
+	if len(token) == 0 {
+		logger.Printf("Probe credential %q is revoked: its token file %q is empty", c.name, c.tokenFile)
+		c.revoke()
+		return nil
+	}
+	if len(token) < minTokenSize {
+		return fmt.Errorf("token in %q must be at least %d bytes, got %d bytes", c.tokenFile, minTokenSize, len(token))
+	}
+
+	hash := sha256.Sum256(token)
+	c.mu.Lock()
+	c.tokenHash = hash[:]
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *credential) revoke() {
+	c.mu.Lock()
+	c.tokenHash = nil
+	c.mu.Unlock()
+}
+
+func parseCredential(raw string) (*credential, error) {
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.New("expected format <name>:token-file=<path>&path=<prefix>[,<prefix>...][&method=<method>[,<method>...]][&user=<user>]")
+	}
+
+	parsed := &credential{name: parts[0], methods: map[string]struct{}{}}
+	for _, c := range strings.Split(parts[1], "&") {
+		if err := parsed.parseCondition(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if parsed.tokenFile == "" {
+		return nil, errors.New("a token-file=<path> condition is required")
+	}
+	if len(parsed.prefixes) == 0 {
+		return nil, errors.New("a path=<prefix> condition is required")
+	}
+	if len(parsed.methods) == 0 {
+		parsed.methods[http.MethodGet] = struct{}{}
+		parsed.methods[http.MethodHead] = struct{}{}
+	}
+	return parsed, nil
+}
+
+func (c *credential) parseCondition(condition string) error {
+	switch {
+	case strings.HasPrefix(condition, "token-file="):
+		if c.tokenFile != "" {
+			return errors.New("only one token-file=<path> condition is allowed")
+		}
+		c.tokenFile = strings.TrimPrefix(condition, "token-file=")
+		if c.tokenFile == "" {
+			return fmt.Errorf("condition %q has an empty path", condition)
+		}
+	case strings.HasPrefix(condition, "path="):
+		for _, prefix := range strings.Split(strings.TrimPrefix(condition, "path="), ",") {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("condition %q has a path prefix %q which isn't absolute", condition, prefix)
+			}
+			c.prefixes = append(c.prefixes, prefix)
+		}
+	case strings.HasPrefix(condition, "method="):
+		for _, method := range strings.Split(strings.TrimPrefix(condition, "method="), ",") {
+			if method == "" {
+				return fmt.Errorf("condition %q has an empty method", condition)
+			}
+			c.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	case strings.HasPrefix(condition, "user="):
+		if c.user != "" {
+			return errors.New("only one user=<user> condition is allowed")
+		}
+		c.user = strings.TrimPrefix(condition, "user=")
+		if c.user == "" {
+			return fmt.Errorf("condition %q has an empty user", condition)
+		}
+	default:
+		return fmt.Errorf("unknown condition %q, expected token-file=<path>, path=<prefixes>, method=<methods> or user=<user>", condition)
+	}
+	return nil
+}
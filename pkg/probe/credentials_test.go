@@ -0,0 +1,246 @@
+package probe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials Suite", func() {
+	const (
+		uptimeToken = "uptime-0123456789abcdef"
+		statusToken = "status-0123456789abcdef"
+	)
+
+	var (
+		dir             string
+		uptimeTokenFile string
+		statusTokenFile string
+	)
+
+	writeToken := func(file, token string) {
+		Expect(ioutil.WriteFile(file, []byte(token+"\n"), 0600)).To(Succeed())
+	}
+
+	newCredentials := func(credentials ...string) (*Credentials, error) {
+		return NewCredentials(options.Probe{
+			Credentials: credentials,
+			Header:      options.DefaultProbeCredentialHeader,
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "probe")
+		Expect(err).ToNot(HaveOccurred())
+
+		uptimeTokenFile = filepath.Join(dir, "uptime")
+		statusTokenFile = filepath.Join(dir, "status")
+		writeToken(uptimeTokenFile, uptimeToken)
+		writeToken(statusTokenFile, statusToken)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("NewCredentials", func() {
+		DescribeTable("rejects invalid credentials",
+			func(credential func() string, expectedError string) {
+				_, err := newCredentials(credential())
+				Expect(err).To(MatchError(ContainSubstring(expectedError)))
+			},
+			Entry("without a name", func() string {
+				return ":token-file=" + uptimeTokenFile + "&path=/status/"
+			}, "expected format <name>:token-file=<path>"),
+			Entry("without a token file", func() string {
+				return "uptime:path=/status/"
+			}, "a token-file=<path> condition is required"),
+			Entry("without a path", func() string {
+				return "uptime:token-file=" + uptimeTokenFile
+			}, "a path=<prefix> condition is required"),
+			Entry("with a relative path", func() string {
+				return "uptime:token-file=" + uptimeTokenFile + "&path=status/"
+			}, `has a path prefix "status/" which isn't absolute`),
+			Entry("with an unknown condition", func() string {
+				return "uptime:token-file=" + uptimeTokenFile + "&path=/status/&cidr=10.0.0.0/8"
+			}, `unknown condition "cidr=10.0.0.0/8"`),
+			Entry("with a missing token file", func() string {
+				return "uptime:token-file=" + filepath.Join(dir, "missing") + "&path=/status/"
+			}, "could not read token file"),
+			Entry("with a short token", func() string {
+				writeToken(uptimeTokenFile, "short")
+				return "uptime:token-file=" + uptimeTokenFile + "&path=/status/"
+			}, "must be at least 16 bytes, got 5 bytes"),
+		)
+
+		It("rejects duplicate names", func() {
+			_, err := newCredentials(
+				"uptime:token-file="+uptimeTokenFile+"&path=/status/",
+				"uptime:token-file="+statusTokenFile+"&path=/health/",
+			)
+			Expect(err).To(MatchError(ContainSubstring(`the name "uptime" is already used`)))
+		})
+
+		It("requires a header", func() {
+			_, err := NewCredentials(options.Probe{})
+			Expect(err).To(MatchError("no probe credential header configured"))
+		})
+	})
+
+	Context("Authenticate", func() {
+		var credentials *Credentials
+
+		BeforeEach(func() {
+			var err error
+			credentials, err = newCredentials(
+				"uptime:token-file="+uptimeTokenFile+"&path=/status/,/app/health",
+				"status:token-file="+statusTokenFile+"&path=/api/status&method=get,post&user=status-probe",
+			)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		type authenticateTableInput struct {
+			method             string
+			target             string
+			token              string
+			expectedCredential Credential
+			expectedError      error
+		}
+
+		DescribeTable("with a request",
+			func(in authenticateTableInput) {
+				req := httptest.NewRequest(in.method, in.target, nil)
+				if in.token != "" {
+					req.Header.Set("X-Probe-Token", in.token)
+				}
+
+				credential, err := credentials.Authenticate(req)
+				if in.expectedError != nil {
+					Expect(err).To(Equal(in.expectedError))
+				} else {
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(credential).To(Equal(in.expectedCredential))
+			},
+			Entry("without a token", authenticateTableInput{
+				method:        http.MethodGet,
+				target:        "/status/",
+				expectedError: ErrNoCredential,
+			}),
+			Entry("with an unknown token", authenticateTableInput{
+				method:        http.MethodGet,
+				target:        "/status/",
+				token:         "unknown-0123456789abcdef",
+				expectedError: ErrUnknownToken,
+			}),
+			Entry("with a default method under a path prefix", authenticateTableInput{
+				method:             http.MethodHead,
+				target:             "/status/index.html",
+				token:              uptimeToken,
+				expectedCredential: Credential{Name: "uptime"},
+			}),
+			Entry("with a path under the second path prefix", authenticateTableInput{
+				method:             http.MethodGet,
+				target:             "/app/health?verbose=1",
+				token:              uptimeToken,
+				expectedCredential: Credential{Name: "uptime"},
+			}),
+			Entry("with a configured method and a user", authenticateTableInput{
+				method:             http.MethodPost,
+				target:             "/api/status",
+				token:              statusToken,
+				expectedCredential: Credential{Name: "status", User: "status-probe"},
+			}),
+			Entry("with a method outside the scope", authenticateTableInput{
+				method:        http.MethodPost,
+				target:        "/status/",
+				token:         uptimeToken,
+				expectedError: &ScopeError{Credential: "uptime", Reason: "method POST is not allowed"},
+			}),
+			Entry("with a path outside the scope", authenticateTableInput{
+				method:        http.MethodGet,
+				target:        "/api/status",
+				token:         uptimeToken,
+				expectedError: &ScopeError{Credential: "uptime", Reason: `path "/api/status" is not under /status/, /app/health`},
+			}),
+			Entry("with a path escaping a path prefix", authenticateTableInput{
+				method:        http.MethodGet,
+				target:        "/status/../admin",
+				token:         uptimeToken,
+				expectedError: &ScopeError{Credential: "uptime", Reason: `path "/status/../admin" is not canonical`},
+			}),
+			Entry("with an encoded path escaping a path prefix", authenticateTableInput{
+				method:        http.MethodGet,
+				target:        "/status/%2e%2e/admin",
+				token:         uptimeToken,
+				expectedError: &ScopeError{Credential: "uptime", Reason: `path "/status/../admin" is not canonical`},
+			}),
+		)
+
+		It("strips the token from the request", func() {
+			req := httptest.NewRequest(http.MethodGet, "/status/", nil)
+			req.Header.Set("X-Probe-Token", uptimeToken)
+			credentials.Strip(req)
+			Expect(req.Header.Get("X-Probe-Token")).To(BeEmpty())
+		})
+	})
+
+	Context("WatchTokenFiles", func() {
+		var (
+			credentials *Credentials
+			done        chan bool
+		)
+
+		authenticate := func(token string) error {
+			req := httptest.NewRequest(http.MethodGet, "/status/", nil)
+			req.Header.Set("X-Probe-Token", token)
+			_, err := credentials.Authenticate(req)
+			return err
+		}
+
+		BeforeEach(func() {
+			var err error
+			credentials, err = newCredentials(
+				"uptime:token-file="+uptimeTokenFile+"&path=/status/",
+				"status:token-file="+statusTokenFile+"&path=/status/",
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			done = make(chan bool)
+			Expect(credentials.WatchTokenFiles(done)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			close(done)
+		})
+
+		It("revokes a credential when its token file is emptied", func() {
+			writeToken(uptimeTokenFile, "")
+			Eventually(func() error { return authenticate(uptimeToken) }, time.Second, 10*time.Millisecond).Should(Equal(ErrUnknownToken))
+			Expect(authenticate(statusToken)).To(Succeed())
+		})
+
+		It("rotates a credential when its token file changes", func() {
+			rotated := fmt.Sprintf("rotated-%s", uptimeToken)
+			writeToken(uptimeTokenFile, rotated)
+			Eventually(func() error { return authenticate(rotated) }, time.Second, 10*time.Millisecond).Should(Succeed())
+			Expect(authenticate(uptimeToken)).To(Equal(ErrUnknownToken))
+		})
+
+		It("revokes a credential when its new token is invalid", func() {
+			writeToken(uptimeTokenFile, "short")
+			Eventually(func() error { return authenticate(uptimeToken) }, time.Second, 10*time.Millisecond).Should(Equal(ErrUnknownToken))
+			Expect(authenticate("short")).To(Equal(ErrUnknownToken))
+		})
+	})
+})
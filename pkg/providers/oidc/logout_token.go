@@ -0,0 +1,156 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+)
+
+const (
+	// backchannelLogoutEvent is the member of the events claim that makes a
+	// token a back-channel logout token
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	// logoutTokenMaxAge is how long after they were issued logout tokens are
+	// accepted, as they don't need to have an expiry
+	logoutTokenMaxAge = 5 * time.Minute
+
+	// logoutTokenLeeway is how far in the future logout tokens may have been
+	// issued, to allow for the clock skew between the provider and the proxy
+	logoutTokenLeeway = time.Minute
+
+	// maxSeenLogoutTokens bounds the number of logout token IDs remembered to
+	// reject replayed logout tokens
+	maxSeenLogoutTokens = 10000
+)
+
+// LogoutToken holds the claims of a verified OIDC Back-Channel Logout token
+// identifying the sessions to sign out: either the session of the provider
+// with the SessionID, or all sessions of the Subject
+type LogoutToken struct {
+	Issuer    string
+	Subject   string
+	SessionID string
+}
+
+// LogoutTokenVerifier verifies the logout tokens sent by the provider to the
+// back-channel logout endpoint
+type LogoutTokenVerifier interface {
+	Verify(ctx context.Context, rawLogoutToken string) (*LogoutToken, error)
+}
+
+// logoutTokenVerifier verifies logout tokens with an IDTokenVerifier, as they
+// are signed and addressed in the same way as ID tokens, before checking the
+// claims specific to logout tokens
+type logoutTokenVerifier struct {
+	verifier IDTokenVerifier
+	clock    clock.Clock
+	seen     seenLogoutTokens
+}
+
+// NewLogoutTokenVerifier constructs a LogoutTokenVerifier from an
+// IDTokenVerifier that doesn't check the expiry of tokens, as logout tokens
+// need not have an exp claim. Their iat claim is checked instead.
+func NewLogoutTokenVerifier(verifier IDTokenVerifier) LogoutTokenVerifier {
+	return &logoutTokenVerifier{
+		verifier: verifier,
+	}
+}
+
+// Verify verifies the logout token, returning the sessions it signs out
+func (v *logoutTokenVerifier) Verify(ctx context.Context, rawLogoutToken string) (*LogoutToken, error) {
+	token, err := v.verifier.Verify(ctx, rawLogoutToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		ID        string                     `json:"jti"`
+		SessionID string                     `json:"sid"`
+		Events    map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse logout token claims: %v", err)
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return nil, fmt.Errorf("logout token events must include %s", backchannelLogoutEvent)
+	}
+	// ID tokens have a nonce, so a nonce means an ID token is replayed as a
+	// logout token
+	if token.Nonce != "" {
+		return nil, errors.New("logout token must not have a nonce")
+	}
+	if token.Subject == "" && claims.SessionID == "" {
+		return nil, errors.New("logout token must have a sub or sid claim")
+	}
+	if claims.ID == "" {
+		return nil, errors.New("logout token must have a jti claim")
+	}
+
+	now := v.clock.Now()
+	switch {
+	case token.IssuedAt.IsZero():
+		return nil, errors.New("logout token must have an iat claim")
+	case token.IssuedAt.After(now.Add(logoutTokenLeeway)):
+		return nil, fmt.Errorf("logout token was issued in the future, at %s", token.IssuedAt.UTC().Format(time.RFC3339))
+	case now.Sub(token.IssuedAt) > logoutTokenMaxAge:
+		return nil, fmt.Errorf("logout token was issued more than %s ago, at %s", logoutTokenMaxAge, token.IssuedAt.UTC().Format(time.RFC3339))
+	case !token.Expiry.IsZero() && !now.Before(token.Expiry):
+		return nil, fmt.Errorf("logout token expired at %s", token.Expiry.UTC().Format(time.RFC3339))
+	}
+
+	// The token is remembered for as long as its iat claim is accepted, after
+	// which a replay is rejected as issued too long ago
+	if !v.seen.add(token.Issuer+"\x00"+claims.ID, token.IssuedAt.Add(logoutTokenMaxAge), now) {
+		return nil, fmt.Errorf("logout token %s was already used", claims.ID)
+	}
+
+	return &LogoutToken{
+		Issuer:    token.Issuer,
+		Subject:   token.Subject,
+		SessionID: claims.SessionID,
+	}, nil
+}
+
+// seenLogoutTokens remembers the IDs of the logout tokens verified until they
+// are no longer accepted, so that replayed logout tokens are rejected
+type seenLogoutTokens struct {
+	mu       sync.Mutex
+	expiries map[string]time.Time
+}
+
+// add remembers the token ID until it expires, returning false when it was
+// already seen. Expired IDs are removed when the cache is full, and the ID
+// expiring first if none have expired.
+func (s *seenLogoutTokens) add(id string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiries == nil {
+		s.expiries = map[string]time.Time{}
+	}
+	if expiry, ok := s.expiries[id]; ok && now.Before(expiry) {
+		return false
+	}
+
+	if len(s.expiries) >= maxSeenLogoutTokens {
+		var first string
+		for seen, expiry := range s.expiries {
+			if !now.Before(expiry) {
+				delete(s.expiries, seen)
+			} else if first == "" || expiry.Before(s.expiries[first]) {
+				first = seen
+			}
+		}
+		if len(s.expiries) >= maxSeenLogoutTokens {
+			delete(s.expiries, first)
+		}
+	}
+	s.expiries[id] = expires
+	return true
+}
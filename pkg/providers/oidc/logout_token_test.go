@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LogoutTokenVerifier", func() {
+	now := time.Unix(1700000000, 0)
+
+	type logoutTokenTableInput struct {
+		claims        map[string]interface{}
+		expectedToken *LogoutToken
+		expectedError string
+	}
+
+	logoutClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":    "https://foo",
+			"aud":    "1226737",
+			"iat":    now.Add(-time.Second).Unix(),
+			"jti":    "bWJq",
+			"sub":    "248289761001",
+			"sid":    "08a5019c-17e1-4977-8f42-65a12843ea02",
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		return claims
+	}
+
+	// newLogoutToken signs the claims, returning the token with a verifier of
+	// the key it is signed with
+	newLogoutToken := func(claims map[string]interface{}) (string, *logoutTokenVerifier) {
+		payload, err := json.Marshal(claims)
+		Expect(err).ToNot(HaveOccurred())
+		token, err := createToken(payload)
+		Expect(err).ToNot(HaveOccurred())
+
+		config := &oidc.Config{
+			ClientID:          "1226737",
+			SkipClientIDCheck: true,
+			SkipExpiryCheck:   true,
+		}
+		verifier := &logoutTokenVerifier{
+			verifier: NewVerifier(oidc.NewVerifier("https://foo", &testVerifier{jwk: token.PublicKey}, config), IDTokenVerificationOptions{
+				AudienceClaims: []string{"aud"},
+				ClientID:       "1226737",
+			}),
+		}
+		verifier.clock.Set(now)
+		return token.Token, verifier
+	}
+
+	DescribeTable("when verifying a logout token",
+		func(in logoutTokenTableInput) {
+			token, verifier := newLogoutToken(in.claims)
+
+			logoutToken, err := verifier.Verify(context.Background(), token)
+			if in.expectedError != "" {
+				Expect(err).To(MatchError(in.expectedError))
+				Expect(logoutToken).To(BeNil())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logoutToken).To(Equal(in.expectedToken))
+		},
+		Entry("with a session ID and subject", logoutTokenTableInput{
+			claims: logoutClaims(nil),
+			expectedToken: &LogoutToken{
+				Issuer:    "https://foo",
+				Subject:   "248289761001",
+				SessionID: "08a5019c-17e1-4977-8f42-65a12843ea02",
+			},
+		}),
+		Entry("with only a subject", logoutTokenTableInput{
+			claims: logoutClaims(map[string]interface{}{"sid": nil}),
+			expectedToken: &LogoutToken{
+				Issuer:  "https://foo",
+				Subject: "248289761001",
+			},
+		}),
+		Entry("with only a session ID and an expiry", logoutTokenTableInput{
+			claims: logoutClaims(map[string]interface{}{"sub": nil, "exp": now.Add(time.Minute).Unix()}),
+			expectedToken: &LogoutToken{
+				Issuer:    "https://foo",
+				SessionID: "08a5019c-17e1-4977-8f42-65a12843ea02",
+			},
+		}),
+		Entry("with another audience", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"aud": "7817818"}),
+			expectedError: "audience from claim aud with value [7817818] does not match with any of allowed audiences map[1226737:{}]",
+		}),
+		Entry("without the back-channel logout event", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"events": map[string]interface{}{"http://schemas.openid.net/event/other": map[string]interface{}{}}}),
+			expectedError: "logout token events must include http://schemas.openid.net/event/backchannel-logout",
+		}),
+		Entry("with a nonce", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"nonce": "n-0S6_WzA2Mj"}),
+			expectedError: "logout token must not have a nonce",
+		}),
+		Entry("without a session ID or subject", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"sub": nil, "sid": nil}),
+			expectedError: "logout token must have a sub or sid claim",
+		}),
+		Entry("without a token ID", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"jti": nil}),
+			expectedError: "logout token must have a jti claim",
+		}),
+		Entry("without an issue time", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"iat": nil}),
+			expectedError: "logout token must have an iat claim",
+		}),
+		Entry("issued in the future", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}),
+			expectedError: "logout token was issued in the future, at 2023-11-14T22:15:20Z",
+		}),
+		Entry("issued too long ago", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"iat": now.Add(-10 * time.Minute).Unix()}),
+			expectedError: "logout token was issued more than 5m0s ago, at 2023-11-14T22:03:20Z",
+		}),
+		Entry("expired", logoutTokenTableInput{
+			claims:        logoutClaims(map[string]interface{}{"exp": now.Unix()}),
+			expectedError: "logout token expired at 2023-11-14T22:13:20Z",
+		}),
+	)
+
+	It("rejects the replays of a logout token", func() {
+		token, verifier := newLogoutToken(logoutClaims(nil))
+		_, err := verifier.Verify(context.Background(), token)
+		Expect(err).ToNot(HaveOccurred())
+
+		logoutToken, err := verifier.Verify(context.Background(), token)
+		Expect(err).To(MatchError("logout token bWJq was already used"))
+		Expect(logoutToken).To(BeNil())
+
+		verifier.clock.Set(now.Add(logoutTokenMaxAge))
+		_, err = verifier.Verify(context.Background(), token)
+		Expect(err).To(MatchError("logout token was issued more than 5m0s ago, at 2023-11-14T22:13:19Z"))
+	})
+
+	It("bounds the number of logout token IDs it remembers", func() {
+		seen := &seenLogoutTokens{}
+		for i := 0; i < maxSeenLogoutTokens; i++ {
+			Expect(seen.add(fmt.Sprintf("id-%d", i), now.Add(time.Duration(i+1)*time.Second), now)).To(BeTrue())
+		}
+		Expect(seen.add("id-1", now.Add(time.Minute), now)).To(BeFalse())
+
+		// The ID expiring first is removed when none have expired
+		Expect(seen.add("new", now.Add(time.Hour), now)).To(BeTrue())
+		Expect(seen.expiries).To(HaveLen(maxSeenLogoutTokens))
+		Expect(seen.expiries).ToNot(HaveKey("id-0"))
+
+		// The 9 expired IDs are removed once the cache is full again
+		later := now.Add(10 * time.Second)
+		Expect(seen.add("newer", now.Add(time.Hour), later)).To(BeTrue())
+		Expect(seen.expiries).To(HaveLen(maxSeenLogoutTokens - 9 + 1))
+		Expect(seen.add("id-0", now.Add(time.Hour), later)).To(BeTrue())
+	})
+})
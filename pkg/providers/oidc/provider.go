@@ -16,6 +16,9 @@ type providerJSON struct {
 	TokenURL             string   `json:"token_endpoint"`
 	JWKsURL              string   `json:"jwks_uri"`
 	UserInfoURL          string   `json:"userinfo_endpoint"`
+	RevocationURL        string   `json:"revocation_endpoint"`
+	EndSessionURL        string   `json:"end_session_endpoint"`
+	DeviceAuthURL        string   `json:"device_authorization_endpoint"`
 	CodeChallengeAlgs    []string `json:"code_challenge_methods_supported"`
 	SupportedSigningAlgs []string `json:"id_token_signing_alg_values_supported"`
 }
@@ -23,10 +26,13 @@ type providerJSON struct {
 // Endpoints represents the endpoints discovered as part of the OIDC discovery process
 // that will be used by the authentication providers.
 type Endpoints struct {
-	AuthURL     string
-	TokenURL    string
-	JWKsURL     string
-	UserInfoURL string
+	AuthURL       string
+	TokenURL      string
+	JWKsURL       string
+	UserInfoURL   string
+	RevocationURL string
+	EndSessionURL string
+	DeviceAuthURL string
 }
 
 // PKCE holds information relevant to the PKCE (code challenge) support of the
@@ -69,6 +75,9 @@ func NewProvider(ctx context.Context, issuerURL string, skipIssuerVerification b
 		tokenURL:             p.TokenURL,
 		jwksURL:              p.JWKsURL,
 		userInfoURL:          p.UserInfoURL,
+		revocationURL:        p.RevocationURL,
+		endSessionURL:        p.EndSessionURL,
+		deviceAuthURL:        p.DeviceAuthURL,
 		codeChallengeAlgs:    p.CodeChallengeAlgs,
 		supportedSigningAlgs: p.SupportedSigningAlgs,
 	}, nil
@@ -80,6 +89,9 @@ type discoveryProvider struct {
 	tokenURL             string
 	jwksURL              string
 	userInfoURL          string
+	revocationURL        string
+	endSessionURL        string
+	deviceAuthURL        string
 	codeChallengeAlgs    []string
 	supportedSigningAlgs []string
 }
@@ -87,10 +99,13 @@ type discoveryProvider struct {
 // Endpoints returns the discovered endpoints needed for an authentication provider.
 func (p *discoveryProvider) Endpoints() Endpoints {
 	return Endpoints{
-		AuthURL:     p.authURL,
-		TokenURL:    p.tokenURL,
-		JWKsURL:     p.jwksURL,
-		UserInfoURL: p.userInfoURL,
+		AuthURL:       p.authURL,
+		TokenURL:      p.tokenURL,
+		JWKsURL:       p.jwksURL,
+		UserInfoURL:   p.userInfoURL,
+		RevocationURL: p.revocationURL,
+		EndSessionURL: p.endSessionURL,
+		DeviceAuthURL: p.deviceAuthURL,
 	}
 }
 
@@ -2,11 +2,9 @@ package oidc
 
 import (
 	"context"
-	"encoding/json"
-	"net"
 	"net/http"
 
-	"github.com/oauth2-proxy/mockoidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -16,28 +14,18 @@ var _ = Describe("Provider", func() {
 	type newProviderTableInput struct {
 		skipIssuerVerification bool
 		expectedError          string
-		middlewares            func(*mockoidc.MockOIDC) []func(http.Handler) http.Handler
+		modify                 func(*fakeidp.Server)
 	}
 
 	DescribeTable("NewProvider", func(in *newProviderTableInput) {
-		m, err := mockoidc.NewServer(nil)
+		m, err := fakeidp.New(fakeidp.Options{})
 		Expect(err).ToNot(HaveOccurred())
+		defer m.Close()
 
-		if in.middlewares != nil {
-			middlewares := in.middlewares(m)
-			for _, middlware := range middlewares {
-				m.AddMiddleware(middlware)
-			}
+		if in.modify != nil {
+			in.modify(m)
 		}
 
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
-		Expect(err).ToNot(HaveOccurred())
-
-		Expect(m.Start(ln, nil)).To(Succeed())
-		defer func() {
-			Expect(m.Shutdown()).To(Succeed())
-		}()
-
 		provider, err := NewProvider(context.Background(), m.Issuer(), in.skipIssuerVerification)
 		if in.expectedError != "" {
 			Expect(err).To(MatchError(HavePrefix(in.expectedError)))
@@ -49,7 +37,7 @@ var _ = Describe("Provider", func() {
 		Expect(endpoints.AuthURL).To(Equal(m.AuthorizationEndpoint()))
 		Expect(endpoints.TokenURL).To(Equal(m.TokenEndpoint()))
 		Expect(endpoints.JWKsURL).To(Equal(m.JWKSEndpoint()))
-		Expect(endpoints.UserInfoURL).To(Equal(m.UserinfoEndpoint()))
+		Expect(endpoints.UserInfoURL).To(Equal(m.UserInfoEndpoint()))
 	},
 		Entry("with issuer verification and the issuer matches", &newProviderTableInput{
 			skipIssuerVerification: false,
@@ -59,44 +47,29 @@ var _ = Describe("Provider", func() {
 		}),
 		Entry("with issuer verification and an invalid issuer", &newProviderTableInput{
 			skipIssuerVerification: false,
-			middlewares: func(m *mockoidc.MockOIDC) []func(http.Handler) http.Handler {
-				return []func(http.Handler) http.Handler{
-					newInvalidIssuerMiddleware(m),
-				}
-			},
-			expectedError: "oidc: issuer did not match the issuer returned by provider",
+			modify:                 setInvalidIssuer,
+			expectedError:          "oidc: issuer did not match the issuer returned by provider",
 		}),
 		Entry("with skip issuer verification and an invalid issuer", &newProviderTableInput{
 			skipIssuerVerification: true,
-			middlewares: func(m *mockoidc.MockOIDC) []func(http.Handler) http.Handler {
-				return []func(http.Handler) http.Handler{
-					newInvalidIssuerMiddleware(m),
-				}
-			},
+			modify:                 setInvalidIssuer,
 		}),
 		Entry("when the issuer returns a bad response", &newProviderTableInput{
 			skipIssuerVerification: false,
-			middlewares: func(m *mockoidc.MockOIDC) []func(http.Handler) http.Handler {
-				return []func(http.Handler) http.Handler{
-					newBadRequestMiddleware(),
-				}
+			modify: func(m *fakeidp.Server) {
+				m.FailNext(fakeidp.DiscoveryEndpoint, fakeidp.Failure{Status: http.StatusBadRequest})
 			},
 			expectedError: "failed to discover OIDC configuration: unexpected status \"400\"",
 		}),
 	)
 
 	It("with code challenges supported on the provider, shold populate PKCE information", func() {
-		m, err := mockoidc.NewServer(nil)
+		m, err := fakeidp.New(fakeidp.Options{})
 		Expect(err).ToNot(HaveOccurred())
-		m.AddMiddleware(newCodeChallengeIssuerMiddleware(m))
-
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
-		Expect(err).ToNot(HaveOccurred())
-
-		Expect(m.Start(ln, nil)).To(Succeed())
-		defer func() {
-			Expect(m.Shutdown()).To(Succeed())
-		}()
+		defer m.Close()
+		m.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.CodeChallengeMethodsSupported = []string{"S256", "plain"}
+		})
 
 		provider, err := NewProvider(context.Background(), m.Issuer(), false)
 		Expect(err).ToNot(HaveOccurred())
@@ -105,88 +78,61 @@ var _ = Describe("Provider", func() {
 	})
 
 	It("with signing algorithms supported on the provider, should populate signature information", func() {
-		m, err := mockoidc.NewServer(nil)
+		m, err := fakeidp.New(fakeidp.Options{})
 		Expect(err).ToNot(HaveOccurred())
-		m.AddMiddleware(newSigningAlgsIssuerMiddleware(m))
+		defer m.Close()
+		m.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.IDTokenSigningAlgValuesSupported = []string{"RS256", "HS256"}
+		})
 
-		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		provider, err := NewProvider(context.Background(), m.Issuer(), false)
 		Expect(err).ToNot(HaveOccurred())
 
-		Expect(m.Start(ln, nil)).To(Succeed())
-		defer func() {
-			Expect(m.Shutdown()).To(Succeed())
-		}()
+		Expect(provider.SupportedSigningAlgs()).To(ConsistOf("RS256", "HS256"))
+	})
+
+	It("with a revocation endpoint on the provider, should populate the revocation URL", func() {
+		m, err := fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+		defer m.Close()
+		m.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.RevocationEndpoint = d.Issuer + "/revoke"
+		})
 
 		provider, err := NewProvider(context.Background(), m.Issuer(), false)
 		Expect(err).ToNot(HaveOccurred())
 
-		Expect(provider.SupportedSigningAlgs()).To(ConsistOf("RS256", "HS256"))
+		Expect(provider.Endpoints().RevocationURL).To(Equal(m.Issuer() + "/revoke"))
 	})
-})
 
-func newInvalidIssuerMiddleware(m *mockoidc.MockOIDC) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			p := providerJSON{
-				Issuer:      "invalid",
-				AuthURL:     m.AuthorizationEndpoint(),
-				TokenURL:    m.TokenEndpoint(),
-				JWKsURL:     m.JWKSEndpoint(),
-				UserInfoURL: m.UserinfoEndpoint(),
-			}
-			data, err := json.Marshal(p)
-			if err != nil {
-				rw.WriteHeader(500)
-			}
-			rw.Write(data)
+	It("with an end session endpoint on the provider, should populate the end session URL", func() {
+		m, err := fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+		defer m.Close()
+		m.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.EndSessionEndpoint = d.Issuer + "/logout"
 		})
-	}
-}
 
-func newCodeChallengeIssuerMiddleware(m *mockoidc.MockOIDC) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			p := providerJSON{
-				Issuer:            m.Issuer(),
-				AuthURL:           m.AuthorizationEndpoint(),
-				TokenURL:          m.TokenEndpoint(),
-				JWKsURL:           m.JWKSEndpoint(),
-				UserInfoURL:       m.UserinfoEndpoint(),
-				CodeChallengeAlgs: []string{"S256", "plain"},
-			}
-			data, err := json.Marshal(p)
-			if err != nil {
-				rw.WriteHeader(500)
-			}
-			rw.Write(data)
-		})
-	}
-}
+		provider, err := NewProvider(context.Background(), m.Issuer(), false)
+		Expect(err).ToNot(HaveOccurred())
 
-func newSigningAlgsIssuerMiddleware(m *mockoidc.MockOIDC) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			p := providerJSON{
-				Issuer:               m.Issuer(),
-				AuthURL:              m.AuthorizationEndpoint(),
-				TokenURL:             m.TokenEndpoint(),
-				JWKsURL:              m.JWKSEndpoint(),
-				UserInfoURL:          m.UserinfoEndpoint(),
-				SupportedSigningAlgs: []string{"RS256", "HS256"},
-			}
-			data, err := json.Marshal(p)
-			if err != nil {
-				rw.WriteHeader(500)
-			}
-			rw.Write(data)
-		})
-	}
-}
+		Expect(provider.Endpoints().EndSessionURL).To(Equal(m.Issuer() + "/logout"))
+	})
 
-func newBadRequestMiddleware() func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			rw.WriteHeader(400)
-		})
-	}
+	It("with a device authorization endpoint on the provider, should populate the device authorization URL", func() {
+		m, err := fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+		defer m.Close()
+
+		provider, err := NewProvider(context.Background(), m.Issuer(), false)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(provider.Endpoints().DeviceAuthURL).To(Equal(m.DeviceAuthorizationEndpoint()))
+	})
+})
+
+func setInvalidIssuer(m *fakeidp.Server) {
+	m.ModifyDiscovery(func(d *fakeidp.Discovery) {
+		d.Issuer = "invalid"
+	})
 }
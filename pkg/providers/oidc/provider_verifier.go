@@ -14,6 +14,7 @@ type ProviderVerifier interface {
 	DiscoveryEnabled() bool
 	Provider() DiscoveryProvider
 	Verifier() IDTokenVerifier
+	LogoutTokenVerifier() LogoutTokenVerifier
 }
 
 // ProviderVerifierOptions allows you to configure a ProviderVerifier
@@ -99,6 +100,12 @@ func NewProviderVerifier(ctx context.Context, opts ProviderVerifierOptions) (Pro
 	}
 	verifier := NewVerifier(verifierBuilder(opts.toOIDCConfig()), opts.toVerificationOptions())
 
+	// Logout tokens need not have an expiry, the logout token verifier checks
+	// when they were issued instead
+	logoutConfig := opts.toOIDCConfig()
+	logoutConfig.SkipExpiryCheck = true
+	logoutTokenVerifier := NewLogoutTokenVerifier(NewVerifier(verifierBuilder(logoutConfig), opts.toVerificationOptions()))
+
 	if provider == nil {
 		// To avoid the possibility of nil pointers, always return an empty provider if discovery didn't occur.
 		// Users are expected to check whether discovery was enabled before using the provider.
@@ -109,6 +116,7 @@ func NewProviderVerifier(ctx context.Context, opts ProviderVerifierOptions) (Pro
 		discoveryEnabled: !opts.SkipDiscovery,
 		provider:         provider,
 		verifier:         verifier,
+		logoutVerifier:   logoutTokenVerifier,
 	}, nil
 }
 
@@ -145,6 +153,7 @@ type providerVerifier struct {
 	discoveryEnabled bool
 	provider         DiscoveryProvider
 	verifier         IDTokenVerifier
+	logoutVerifier   LogoutTokenVerifier
 }
 
 // DiscoveryEnabled returns whether the provider verifier was constructed
@@ -162,3 +171,8 @@ func (p *providerVerifier) Provider() DiscoveryProvider {
 func (p *providerVerifier) Verifier() IDTokenVerifier {
 	return p.verifier
 }
+
+// LogoutTokenVerifier returns the back-channel logout token verifier
+func (p *providerVerifier) LogoutTokenVerifier() LogoutTokenVerifier {
+	return p.logoutVerifier
+}
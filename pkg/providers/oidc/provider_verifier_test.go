@@ -5,23 +5,23 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/oauth2-proxy/mockoidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("ProviderVerifier", func() {
-	var m *mockoidc.MockOIDC
+	var m *fakeidp.Server
 
 	BeforeEach(func() {
 		var err error
-		m, err = mockoidc.Run()
+		m, err = fakeidp.New(fakeidp.Options{})
 		Expect(err).ToNot(HaveOccurred())
 	})
 
 	AfterEach(func() {
-		Expect(m.Shutdown()).To(Succeed())
+		m.Close()
 	})
 
 	type newProviderVerifierTableInput struct {
@@ -32,7 +32,7 @@ var _ = Describe("ProviderVerifier", func() {
 	DescribeTable("when constructing the provider verifier", func(in *newProviderVerifierTableInput) {
 		opts := ProviderVerifierOptions{
 			AudienceClaims: []string{"aud"},
-			ClientID:       m.Config().ClientID,
+			ClientID:       m.ClientID(),
 			ExtraAudiences: []string{},
 			IssuerURL:      m.Issuer(),
 		}
@@ -55,7 +55,7 @@ var _ = Describe("ProviderVerifier", func() {
 			Expect(endpoints.AuthURL).To(Equal(m.AuthorizationEndpoint()))
 			Expect(endpoints.TokenURL).To(Equal(m.TokenEndpoint()))
 			Expect(endpoints.JWKsURL).To(Equal(m.JWKSEndpoint()))
-			Expect(endpoints.UserInfoURL).To(Equal(m.UserinfoEndpoint()))
+			Expect(endpoints.UserInfoURL).To(Equal(m.UserInfoEndpoint()))
 		}
 	},
 		Entry("should be succesfful when discovering the OIDC provider", &newProviderVerifierTableInput{
@@ -97,7 +97,7 @@ var _ = Describe("ProviderVerifier", func() {
 	DescribeTable("when constructing the provider verifier", func(in *verifierTableInput) {
 		opts := ProviderVerifierOptions{
 			AudienceClaims: []string{"aud"},
-			ClientID:       m.Config().ClientID,
+			ClientID:       m.ClientID(),
 			ExtraAudiences: []string{},
 			IssuerURL:      m.Issuer(),
 		}
@@ -110,7 +110,7 @@ var _ = Describe("ProviderVerifier", func() {
 
 		now := time.Now()
 		claims := jwt.StandardClaims{
-			Audience:  m.Config().ClientID,
+			Audience:  m.ClientID(),
 			Issuer:    m.Issuer(),
 			ExpiresAt: now.Add(1 * time.Hour).Unix(),
 			IssuedAt:  now.Unix(),
@@ -120,7 +120,7 @@ var _ = Describe("ProviderVerifier", func() {
 			in.modifyClaims(&claims)
 		}
 
-		rawIDToken, err := m.Keypair.SignJWT(claims)
+		rawIDToken, err := m.SignJWT(claims)
 		Expect(err).ToNot(HaveOccurred())
 
 		idToken, err := pv.Verifier().Verify(context.Background(), rawIDToken)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/bitly/go-simplejson"
@@ -46,6 +47,16 @@ func NewClaimExtractor(ctx context.Context, idToken string, profileURL *url.URL,
 	}, nil
 }
 
+// NewJSONClaimExtractor constructs a new ClaimExtractor from claims that have
+// already been decoded, eg. from a token introspection response.
+// The claims are not looked up from a profile URL.
+func NewJSONClaimExtractor(ctx context.Context, claims *simplejson.Json) ClaimExtractor {
+	return &claimExtractor{
+		ctx:         ctx,
+		tokenClaims: claims,
+	}
+}
+
 // claimExtractor implements the ClaimExtractor interface
 type claimExtractor struct {
 	profileURL     *url.URL
@@ -63,7 +74,11 @@ func (c *claimExtractor) GetClaim(claim string) (interface{}, bool, error) {
 		return nil, false, nil
 	}
 
-	if value := getClaimFrom(claim, c.tokenClaims); value != nil {
+	value, err := getClaimFrom(claim, c.tokenClaims)
+	if err != nil {
+		return nil, false, err
+	}
+	if value != nil {
 		return value, true, nil
 	}
 
@@ -76,7 +91,11 @@ func (c *claimExtractor) GetClaim(claim string) (interface{}, bool, error) {
 		c.profileClaims = profileClaims
 	}
 
-	if value := getClaimFrom(claim, c.profileClaims); value != nil {
+	value, err = getClaimFrom(claim, c.profileClaims)
+	if err != nil {
+		return nil, false, err
+	}
+	if value != nil {
 		return value, true, nil
 	}
 
@@ -138,12 +157,129 @@ func parseJWT(p string) ([]byte, error) {
 	return payload, nil
 }
 
+// claimPathStep is a single step of a claim path.
+// It either selects a key of an object, an index of an array, or with a
+// wildcard, every entry of an array.
+type claimPathStep struct {
+	key      string
+	index    int
+	wildcard bool
+}
+
+// parseClaimPath splits a claim into the steps of its path.
+// Keys are separated by dots and may be followed by any number of `[N]` indexes
+// or `[*]` wildcards, eg: `resource.roles[*].name`.
+func parseClaimPath(claim string) ([]claimPathStep, error) {
+	steps := []claimPathStep{}
+	for _, part := range strings.Split(claim, ".") {
+		key := part
+		selectors := ""
+		if i := strings.Index(part, "["); i >= 0 {
+			key, selectors = part[:i], part[i:]
+		}
+		if key == "" {
+			return nil, fmt.Errorf("invalid claim path %q: empty claim name", claim)
+		}
+		steps = append(steps, claimPathStep{key: key})
+
+		for selectors != "" {
+			end := strings.Index(selectors, "]")
+			if !strings.HasPrefix(selectors, "[") || end < 0 {
+				return nil, fmt.Errorf("invalid claim path %q: expected [N] or [*] after %q", claim, key)
+			}
+			selector := selectors[1:end]
+			selectors = selectors[end+1:]
+
+			if selector == "*" {
+				steps = append(steps, claimPathStep{wildcard: true})
+				continue
+			}
+			index, err := strconv.Atoi(selector)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid claim path %q: array index %q must be a number or *", claim, selector)
+			}
+			steps = append(steps, claimPathStep{index: index})
+		}
+	}
+	return steps, nil
+}
+
 // getClaimFrom gets a claim from a Json object.
-// It can accept either a single claim name or a json path.
-// Paths with indexes are not supported.
-func getClaimFrom(claim string, src *simplejson.Json) interface{} {
-	claimParts := strings.Split(claim, ".")
-	return src.GetPath(claimParts...).Interface()
+// It can accept either a single claim name or a claim path, as parsed by
+// parseClaimPath.
+// A path with a wildcard returns the selected values as a slice, these must
+// all be scalar values.
+// Arrays of objects are only returned for single claim names, where they are
+// flattened into JSON strings when coerced, paths must use a wildcard to select
+// a scalar field from each object instead.
+func getClaimFrom(claim string, src *simplejson.Json) (interface{}, error) {
+	steps, err := parseClaimPath(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{src.Interface()}
+	wildcard := false
+	for _, step := range steps {
+		next := []interface{}{}
+		for _, value := range values {
+			switch {
+			case step.key != "":
+				if obj, ok := value.(map[string]interface{}); ok && obj[step.key] != nil {
+					next = append(next, obj[step.key])
+				}
+			case step.wildcard:
+				if arr, ok := value.([]interface{}); ok {
+					next = append(next, arr...)
+				}
+			default:
+				if arr, ok := value.([]interface{}); ok && step.index < len(arr) && arr[step.index] != nil {
+					next = append(next, arr[step.index])
+				}
+			}
+		}
+		values = next
+		wildcard = wildcard || step.wildcard
+	}
+
+	if !wildcard {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		if len(steps) > 1 && containsObjects(values[0]) {
+			return nil, fmt.Errorf("claim %q is an array of objects: use a wildcard to select a field from each object, eg: %s[*].name", claim, claim)
+		}
+		return values[0], nil
+	}
+
+	selected := []interface{}{}
+	for _, value := range values {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("claim %q selects objects or arrays: the wildcard must select a string, number or boolean field", claim)
+		case nil:
+			continue
+		}
+		selected = append(selected, value)
+	}
+	if len(selected) == 0 {
+		return nil, nil
+	}
+	return selected, nil
+}
+
+// containsObjects checks whether the value is an array containing objects
+func containsObjects(value interface{}) bool {
+	arr, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, entry := range arr {
+		if _, ok := entry.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // coerceClaim tries to convert the value into the destination interface type.
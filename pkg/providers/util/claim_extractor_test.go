@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"sync/atomic"
 
+	"github.com/bitly/go-simplejson"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -41,6 +42,27 @@ const (
           "username": "nestedUser"
         }
       }
+    }`
+	claimPathPayload = `{
+      "ext": {
+        "uid": 1234567890123,
+        "active": true
+      },
+      "resource": {
+        "roles": [
+          {
+            "name": "admin",
+            "scopes": ["read", "write"]
+          },
+          {
+            "name": "viewer",
+            "scopes": ["read"]
+          },
+          {
+            "description": "no name"
+          }
+        ]
+      }
     }`
 	complexGroupsPayload = `{
       "groups": [
@@ -277,6 +299,22 @@ var _ = Describe("Claim Extractor Suite", func() {
 		Expect(value).To(BeNil())
 	})
 
+	It("GetClaim should get nested claims from decoded claims", func() {
+		claims, err := simplejson.NewJson([]byte(nestedClaimPayload))
+		Expect(err).ToNot(HaveOccurred())
+		claimExtractor := NewJSONClaimExtractor(context.Background(), claims)
+
+		value, exists, err := claimExtractor.GetClaim("auth.user.username")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeTrue())
+		Expect(value).To(Equal("nestedUser"))
+
+		value, exists, err = claimExtractor.GetClaim("email")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+		Expect(value).To(BeNil())
+	})
+
 	type getClaimIntoTableInput struct {
 		testClaimExtractorOpts
 		into          interface{}
@@ -390,6 +428,110 @@ var _ = Describe("Claim Extractor Suite", func() {
 			}),
 			expectedError: nil,
 		}),
+		Entry("retrieves a scalar field from each object with a wildcard", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles[*].name",
+			into:          stringSlicePointer([]string{}),
+			expectExists:  true,
+			expectedValue: stringSlicePointer([]string{"admin", "viewer"}),
+			expectedError: nil,
+		}),
+		Entry("retrieves every entry of nested arrays with wildcards", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles[*].scopes[*]",
+			into:          stringSlicePointer([]string{}),
+			expectExists:  true,
+			expectedValue: stringSlicePointer([]string{"read", "write", "read"}),
+			expectedError: nil,
+		}),
+		Entry("retrieves an array entry by index", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles[1].name",
+			into:          stringPointer(""),
+			expectExists:  true,
+			expectedValue: stringPointer("viewer"),
+			expectedError: nil,
+		}),
+		Entry("stringifies a nested number claim", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "ext.uid",
+			into:          stringPointer(""),
+			expectExists:  true,
+			expectedValue: stringPointer("1234567890123"),
+			expectedError: nil,
+		}),
+		Entry("stringifies a nested bool claim", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "ext.active",
+			into:          stringPointer(""),
+			expectExists:  true,
+			expectedValue: stringPointer("true"),
+			expectedError: nil,
+		}),
+		Entry("returns an error when a path selects an array of objects", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles",
+			into:          stringSlicePointer([]string{}),
+			expectExists:  false,
+			expectedValue: stringSlicePointer([]string{}),
+			expectedError: errors.New("could not get claim \"resource.roles\": claim \"resource.roles\" is an array of objects: use a wildcard to select a field from each object, eg: resource.roles[*].name"),
+		}),
+		Entry("returns an error when a wildcard selects objects", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles[*]",
+			into:          stringSlicePointer([]string{}),
+			expectExists:  false,
+			expectedValue: stringSlicePointer([]string{}),
+			expectedError: errors.New("could not get claim \"resource.roles[*]\": claim \"resource.roles[*]\" selects objects or arrays: the wildcard must select a string, number or boolean field"),
+		}),
+		Entry("returns an error with an invalid claim path", getClaimIntoTableInput{
+			testClaimExtractorOpts: testClaimExtractorOpts{
+				idTokenPayload:        claimPathPayload,
+				setProfileURL:         true,
+				profileRequestHeaders: newAuthorizedHeader(),
+				profileRequestHandler: shouldNotBeRequestedProfileHandler,
+			},
+			claim:         "resource.roles[first].name",
+			into:          stringSlicePointer([]string{}),
+			expectExists:  false,
+			expectedValue: stringSlicePointer([]string{}),
+			expectedError: errors.New("could not get claim \"resource.roles[first].name\": invalid claim path \"resource.roles[first].name\": array index \"first\" must be a number or *"),
+		}),
 		Entry("does not return an error when the claim does not exist", getClaimIntoTableInput{
 			testClaimExtractorOpts: testClaimExtractorOpts{
 				idTokenPayload:        basicIDTokenPayload,
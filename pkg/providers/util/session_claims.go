@@ -0,0 +1,151 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// SelectClaims copies the claims at each of the dot separated claim paths from
+// the extractor, keeping the nesting of the path, so that only these claims
+// are stored in the session.
+// Claims that don't exist are skipped.
+func SelectClaims(extractor ClaimExtractor, paths []string) (map[string]interface{}, error) {
+	selected := map[string]interface{}{}
+	for _, path := range paths {
+		keys := strings.Split(path, ".")
+		value, exists, err := extractor.GetClaim(keys[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not get claim %q: %v", keys[0], err)
+		}
+		if !exists {
+			continue
+		}
+
+		for _, key := range keys[1:] {
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = obj[key]
+		}
+		if value == nil {
+			continue
+		}
+		setClaimPath(selected, keys, value)
+	}
+	return selected, nil
+}
+
+// setClaimPath sets the value at the path of keys, creating any objects along
+// the path that don't exist yet
+func setClaimPath(claims map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := claims[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			claims[key] = next
+		}
+		claims = next
+	}
+	claims[keys[len(keys)-1]] = value
+}
+
+// IsSelectedClaim checks whether a claim, or a claim path as parsed by
+// parseClaimPath, is within one of the dot separated claim paths copied by
+// SelectClaims.
+func IsSelectedClaim(claim string, paths []string) bool {
+	steps, err := parseClaimPath(claim)
+	if err != nil {
+		return false
+	}
+	keys := []string{}
+	for _, step := range steps {
+		if step.key == "" {
+			break
+		}
+		keys = append(keys, step.key)
+	}
+
+	for _, path := range paths {
+		pathKeys := strings.Split(path, ".")
+		if len(pathKeys) <= len(keys) && strings.Join(keys[:len(pathKeys)], ".") == path {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSessionClaimExtractor constructs a ClaimExtractor for the claims of a
+// session that aren't fields of the session itself.
+// These are the claims stored in the session, when claims were selected,
+// otherwise the claims of the session's ID token, along with the enriched
+// claims of the session.
+// If the session has none of these, no ClaimExtractor is returned.
+func NewSessionClaimExtractor(ctx context.Context, session *sessions.SessionState) (ClaimExtractor, error) {
+	if session.Claims == nil && len(session.EnrichedClaims) == 0 {
+		if session.IDToken == "" {
+			return nil, nil
+		}
+		return NewClaimExtractor(ctx, session.IDToken, nil, nil)
+	}
+
+	claims, err := sessionClaims(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(session.EnrichedClaims) > 0 {
+		enriched, err := roundTripClaims(session.EnrichedClaims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse enriched session claims: %v", err)
+		}
+		for name, value := range enriched.MustMap() {
+			claims.Set(name, value)
+		}
+	}
+
+	return &claimExtractor{
+		ctx:         ctx,
+		tokenClaims: claims,
+	}, nil
+}
+
+// sessionClaims returns the claims stored in the session, when claims were
+// selected, otherwise the claims of the session's ID token, if it has one
+func sessionClaims(session *sessions.SessionState) (*simplejson.Json, error) {
+	if session.Claims != nil {
+		claims, err := roundTripClaims(session.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse session claims: %v", err)
+		}
+		return claims, nil
+	}
+	if session.IDToken == "" {
+		return simplejson.New(), nil
+	}
+
+	payload, err := parseJWT(session.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ID Token: %v", err)
+	}
+	claims, err := simplejson.NewJson(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ID Token payload: %v", err)
+	}
+	return claims, nil
+}
+
+// roundTripClaims round trips the claims through JSON, so that values decoded
+// from the session have the same types as those of an ID token
+func roundTripClaims(claims map[string]interface{}) (*simplejson.Json, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	return simplejson.NewJson(payload)
+}
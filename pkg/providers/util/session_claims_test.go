@@ -0,0 +1,118 @@
+package util
+
+import (
+	"context"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Claims Suite", func() {
+	Context("SelectClaims", func() {
+		It("copies only the selected claims, keeping their nesting", func() {
+			extractor, err := NewClaimExtractor(context.Background(), createJWTFromPayload(claimPathPayload), nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := SelectClaims(extractor, []string{"ext.active", "resource.roles", "missing", "ext.active.missing"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(HaveLen(2))
+			Expect(claims).To(HaveKeyWithValue("ext", map[string]interface{}{"active": true}))
+			Expect(claims).To(HaveKey("resource"))
+			Expect(claims["resource"]).To(HaveKey("roles"))
+		})
+	})
+
+	Context("NewSessionClaimExtractor", func() {
+		It("reads claims stored in a decoded session", func() {
+			extractor, err := NewClaimExtractor(context.Background(), createJWTFromPayload(claimPathPayload), nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			claims, err := SelectClaims(extractor, []string{"ext.uid", "resource"})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Check the claims survive encoding the session for storage
+			cipher, err := encryption.NewCFBCipher([]byte("0123456789abcdef"))
+			Expect(err).ToNot(HaveOccurred())
+			encoded, err := (&sessions.SessionState{Claims: claims}).EncodeSessionState(cipher, true)
+			Expect(err).ToNot(HaveOccurred())
+			session, err := sessions.DecodeSessionState(encoded, cipher, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			sessionExtractor, err := NewSessionClaimExtractor(context.Background(), session)
+			Expect(err).ToNot(HaveOccurred())
+
+			var uid string
+			Expect(sessionExtractor.GetClaimInto("ext.uid", &uid)).To(BeTrue())
+			Expect(uid).To(Equal("1234567890123"))
+
+			var names []string
+			Expect(sessionExtractor.GetClaimInto("resource.roles[*].name", &names)).To(BeTrue())
+			Expect(names).To(Equal([]string{"admin", "viewer"}))
+
+			exists, err := sessionExtractor.GetClaimInto("ext.active", &uid)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("reads claims from the ID token without stored claims", func() {
+			extractor, err := NewSessionClaimExtractor(context.Background(), &sessions.SessionState{
+				IDToken: createJWTFromPayload(basicIDTokenPayload),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			var user string
+			Expect(extractor.GetClaimInto("user", &user)).To(BeTrue())
+			Expect(user).To(Equal("idTokenUser"))
+		})
+
+		It("reads enriched claims along with the claims of the ID token", func() {
+			extractor, err := NewSessionClaimExtractor(context.Background(), &sessions.SessionState{
+				IDToken: createJWTFromPayload(basicIDTokenPayload),
+				EnrichedClaims: map[string]interface{}{
+					"directory_cost_center": "CC-1234",
+					"directory_manager":     map[string]interface{}{"email": "manager@example.com"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			var user, costCenter, manager string
+			Expect(extractor.GetClaimInto("user", &user)).To(BeTrue())
+			Expect(user).To(Equal("idTokenUser"))
+			Expect(extractor.GetClaimInto("directory_cost_center", &costCenter)).To(BeTrue())
+			Expect(costCenter).To(Equal("CC-1234"))
+			Expect(extractor.GetClaimInto("directory_manager.email", &manager)).To(BeTrue())
+			Expect(manager).To(Equal("manager@example.com"))
+		})
+
+		It("reads enriched claims without stored claims or an ID token", func() {
+			extractor, err := NewSessionClaimExtractor(context.Background(), &sessions.SessionState{
+				EnrichedClaims: map[string]interface{}{"directory_cost_center": "CC-1234"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			var costCenter string
+			Expect(extractor.GetClaimInto("directory_cost_center", &costCenter)).To(BeTrue())
+			Expect(costCenter).To(Equal("CC-1234"))
+		})
+
+		It("returns no extractor without stored claims or an ID token", func() {
+			extractor, err := NewSessionClaimExtractor(context.Background(), &sessions.SessionState{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(extractor).To(BeNil())
+		})
+	})
+
+	DescribeTable("IsSelectedClaim",
+		func(claim string, expected bool) {
+			Expect(IsSelectedClaim(claim, []string{"tenant", "resource.roles"})).To(Equal(expected))
+		},
+		Entry("with a selected claim", "tenant", true),
+		Entry("with a path within a selected claim", "resource.roles[*].name", true),
+		Entry("with the parent of a selected claim", "resource", false),
+		Entry("with a claim that isn't selected", "email_address", false),
+		Entry("with a claim sharing a prefix", "tenant_id", false),
+		Entry("with an invalid claim path", "resource.", false),
+	)
+})
@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 )
 
 // Builder allows users to construct a request and then execute the
@@ -107,6 +109,8 @@ func (r *builder) do() Result {
 	}
 
 	defer resp.Body.Close()
+	// The query is omitted as it may carry tokens
+	logger.DebugfContext(r.context, "%s %s://%s%s: %d", req.Method, req.URL.Scheme, req.URL.Host, req.URL.Path, resp.StatusCode)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		r.result = &result{err: fmt.Errorf("error reading response body: %v", err)}
@@ -0,0 +1,34 @@
+package responsewriter
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Wrapper is embedded by the ResponseWriters wrapping another ResponseWriter,
+// to implement the `http.Hijacker` and `http.Flusher` interfaces that actual
+// ResponseWriters implement to support websockets and streamed responses.
+// Wrappers recording when the response is hijacked or flushed override these
+// methods, calling those of the Wrapper.
+type Wrapper struct {
+	http.ResponseWriter
+}
+
+// Hijack hijacks the connection of the wrapped ResponseWriter. Implements the
+// `http.Hijacker` interface
+func (w Wrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// Flush sends any buffered data of the wrapped ResponseWriter to the client.
+// Implements the `http.Flusher` interface
+func (w Wrapper) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
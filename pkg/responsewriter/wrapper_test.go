@@ -0,0 +1,56 @@
+package responsewriter
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// hijackableRecorder is a ResponseRecorder whose connection can be hijacked
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+// plainWriter is a ResponseWriter that can neither be hijacked nor flushed
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+var _ = Describe("Wrapper", func() {
+	It("hijacks the connection of the wrapped ResponseWriter", func() {
+		rw := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+		_, _, err := Wrapper{ResponseWriter: rw}.Hijack()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rw.hijacked).To(BeTrue())
+	})
+
+	It("fails to hijack ResponseWriters that aren't Hijackers", func() {
+		_, _, err := Wrapper{ResponseWriter: httptest.NewRecorder()}.Hijack()
+		Expect(err).To(MatchError("http.Hijacker is not available on writer"))
+	})
+
+	It("flushes the wrapped ResponseWriter", func() {
+		rw := httptest.NewRecorder()
+
+		Wrapper{ResponseWriter: rw}.Flush()
+		Expect(rw.Flushed).To(BeTrue())
+	})
+
+	It("ignores flushes of ResponseWriters that aren't Flushers", func() {
+		rw := httptest.NewRecorder()
+
+		Wrapper{ResponseWriter: plainWriter{ResponseWriter: rw}}.Flush()
+		Expect(rw.Flushed).To(BeFalse())
+	})
+})
@@ -0,0 +1,269 @@
+package routeaccess
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+)
+
+// Rules restrict the requests to the routes whose path they match to the
+// client networks, groups, providers and access windows of the rule. Every
+// rule matching the path of a request must be satisfied for the request to be
+// allowed.
+type Rules []rule
+
+// rule is a single named rule, in the format:
+// `<name>:path~<regex>&<requirement>[&<requirement>...]`
+// The requirements are:
+// - `cidr=<cidr>[,<cidr>...]`: the client IP is in one of the networks
+// - `group=<group>[,<group>...]`: the user is a member of one of the groups
+// - `provider=<id>[,<id>...]`: the session was authenticated by a provider
+// - `days=<day>[-<day>][,...]`: the request is on one of the days of the week
+// - `hours=<hh:mm>-<hh:mm>`: the request is between the clock times, the
+// window ends the next day when the end is before the start
+// - `not-after=<RFC3339 time>`: the request is before the time
+// Each requirement may be given multiple times, other than the hours and the
+// not-after time, and at least one is required. The client networks, the
+// groups, the providers and the access window must all be satisfied.
+// The days and hours are evaluated in the `tz=<IANA time zone>` of the rule,
+// UTC by default. They are compared to the wall clock time of the time zone,
+// so that windows keep their clock times across DST transitions.
+type rule struct {
+	name      string
+	pathRegex *regexp.Regexp
+	networks  *ip.NetSet
+	cidrs     []string
+	groups    map[string]struct{}
+	providers map[string]struct{}
+	window    *window
+}
+
+// DeniedError describes the rule a request failed to satisfy
+type DeniedError struct {
+	// Rule is the name of the rule
+	Rule string
+	// Reason is the requirement of the rule that was not satisfied
+	Reason string
+	// Window describes the access window of the rule when the request was
+	// denied for being outside of it, rather than for the client or session
+	Window string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("denied by route access rule %q: %s", e.Rule, e.Reason)
+}
+
+// RuleInfo describes a rule, for debugging the rules
+type RuleInfo struct {
+	Name   string   `json:"name"`
+	Path   string   `json:"path"`
+	CIDRs  []string `json:"cidrs,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Providers are the IDs of the providers the session must have been
+	// authenticated by
+	Providers []string `json:"providers,omitempty"`
+	// Window describes the access window of the rule
+	Window string `json:"window,omitempty"`
+}
+
+// NewRules parses the rules, keeping their order
+func NewRules(rules []string) (Rules, error) {
+	parsed := make(Rules, 0, len(rules))
+	names := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		rule, err := parseRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", r, err)
+		}
+		if _, ok := names[rule.name]; ok {
+			return nil, fmt.Errorf("invalid rule %q: the name %q is already used", r, rule.name)
+		}
+		names[rule.name] = struct{}{}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// Authorize checks the request to the path at the time from the client IP,
+// by a user with the groups whose session was authenticated by the provider,
+// against the rules matching the path.
+// The client IP is nil when it could not be determined, and the groups are
+// nil and the provider empty for requests without a session. They all fail
+// the rules requiring them.
+// A DeniedError is returned for the first rule that is not satisfied.
+func (r Rules) Authorize(path string, now time.Time, clientIP net.IP, groups []string, provider string) error {
+	for _, rule := range r {
+		if !rule.pathRegex.MatchString(path) {
+			continue
+		}
+		if reason := rule.deny(clientIP, groups, provider); reason != "" {
+			return &DeniedError{Rule: rule.name, Reason: reason}
+		}
+		if rule.window != nil {
+			if reason := rule.window.deny(now); reason != "" {
+				return &DeniedError{Rule: rule.name, Reason: reason, Window: rule.window.String()}
+			}
+		}
+	}
+	return nil
+}
+
+// Info describes the rules, in the order they are evaluated
+func (r Rules) Info() []RuleInfo {
+	infos := make([]RuleInfo, 0, len(r))
+	for _, rule := range r {
+		infos = append(infos, rule.info())
+	}
+	return infos
+}
+
+// Matching describes the rules matching the path, which a request to the
+// path must satisfy
+func (r Rules) Matching(path string) []RuleInfo {
+	infos := []RuleInfo{}
+	for _, rule := range r {
+		if rule.pathRegex.MatchString(path) {
+			infos = append(infos, rule.info())
+		}
+	}
+	return infos
+}
+
+func (r rule) info() RuleInfo {
+	groups := make([]string, 0, len(r.groups))
+	for group := range r.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var providers []string
+	for provider := range r.providers {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	info := RuleInfo{
+		Name:      r.name,
+		Path:      r.pathRegex.String(),
+		CIDRs:     r.cidrs,
+		Groups:    groups,
+		Providers: providers,
+	}
+	if r.window != nil {
+		info.Window = r.window.String()
+	}
+	return info
+}
+
+// deny returns the reason the rule is not satisfied, if it isn't
+func (r rule) deny(clientIP net.IP, groups []string, provider string) string {
+	if r.networks != nil {
+		if clientIP == nil {
+			return "the client IP could not be determined"
+		}
+		if !r.networks.Has(clientIP) {
+			return fmt.Sprintf("client IP %s is not in %s", clientIP, strings.Join(r.cidrs, ", "))
+		}
+	}
+	if len(r.groups) > 0 && !r.hasGroup(groups) {
+		return "the user is not a member of any of the rule's groups"
+	}
+	if len(r.providers) > 0 {
+		if _, ok := r.providers[provider]; !ok {
+			return "the session was not authenticated by any of the rule's providers"
+		}
+	}
+	return ""
+}
+
+func (r rule) hasGroup(groups []string) bool {
+	for _, group := range groups {
+		if _, ok := r.groups[group]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRule(r string) (rule, error) {
+	parts := strings.SplitN(r, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return rule{}, errors.New("expected format <name>:path~<regex>&<requirement>[&<requirement>...]")
+	}
+
+	parsed := rule{name: parts[0], groups: map[string]struct{}{}, providers: map[string]struct{}{}}
+	w := &window{location: time.UTC}
+	for _, c := range strings.Split(parts[1], "&") {
+		if isWindowCondition(c) {
+			if err := w.parseCondition(c); err != nil {
+				return rule{}, err
+			}
+			continue
+		}
+		if err := parsed.parseCondition(c); err != nil {
+			return rule{}, err
+		}
+	}
+
+	if parsed.pathRegex == nil {
+		return rule{}, errors.New("a path~<regex> condition is required")
+	}
+	if !w.empty() {
+		parsed.window = w
+	} else if w.timezone != "" {
+		return rule{}, errors.New("the tz condition requires a days or hours requirement")
+	}
+	if parsed.networks == nil && len(parsed.groups) == 0 && len(parsed.providers) == 0 && parsed.window == nil {
+		return rule{}, errors.New("at least one cidr, group, provider, days, hours or not-after requirement is required")
+	}
+	return parsed, nil
+}
+
+func (r *rule) parseCondition(c string) error {
+	switch {
+	case strings.HasPrefix(c, "path~"):
+		if r.pathRegex != nil {
+			return errors.New("only one path~<regex> condition is allowed")
+		}
+		pathRegex, err := regexp.Compile(strings.TrimPrefix(c, "path~"))
+		if err != nil {
+			return fmt.Errorf("condition %q has an invalid regex: %v", c, err)
+		}
+		r.pathRegex = pathRegex
+	case strings.HasPrefix(c, "cidr="):
+		for _, cidr := range strings.Split(strings.TrimPrefix(c, "cidr="), ",") {
+			ipNet := ip.ParseIPNet(strings.TrimSpace(cidr))
+			if ipNet == nil {
+				return fmt.Errorf("condition %q has an invalid IP network %q", c, cidr)
+			}
+			if r.networks == nil {
+				r.networks = ip.NewNetSet()
+			}
+			r.networks.AddIPNet(*ipNet)
+			r.cidrs = append(r.cidrs, ipNet.String())
+		}
+	case strings.HasPrefix(c, "group="):
+		for _, group := range strings.Split(strings.TrimPrefix(c, "group="), ",") {
+			if group == "" {
+				return fmt.Errorf("condition %q has an empty group", c)
+			}
+			r.groups[group] = struct{}{}
+		}
+	case strings.HasPrefix(c, "provider="):
+		for _, provider := range strings.Split(strings.TrimPrefix(c, "provider="), ",") {
+			if provider == "" {
+				return fmt.Errorf("condition %q has an empty provider", c)
+			}
+			r.providers[provider] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unknown condition %q, expected path~<regex>, cidr=<cidrs>, group=<groups>, provider=<providers>, days=<days>, hours=<hh:mm-hh:mm>, tz=<time zone> or not-after=<time>", c)
+	}
+	return nil
+}
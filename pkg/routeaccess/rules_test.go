@@ -0,0 +1,218 @@
+package routeaccess
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+	rules := []string{
+		"internal:path~^/internal/&cidr=10.0.0.0/8,fd00::/8&group=ops",
+		"admin:path~^/internal/admin/&group=admins,owners",
+		"metrics:path~^/metrics$&cidr=192.168.0.0/16&cidr=2001:db8::/32",
+		"billing:path~^/billing/&provider=azure,okta",
+		"vendor:path~^/vendor-portal/&group=contractors&days=mon-fri&hours=09:00-17:00&tz=Europe/Paris",
+		"break-glass:path~^/break-glass/&not-after=2026-11-01T00:00:00Z",
+	}
+
+	type authorizeTableInput struct {
+		path           string
+		now            time.Time
+		clientIP       string
+		groups         []string
+		provider       string
+		expectedRule   string
+		expectedErr    string
+		expectedWindow string
+	}
+
+	DescribeTable("Authorize",
+		func(in authorizeTableInput) {
+			parsed, err := NewRules(rules)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = parsed.Authorize(in.path, in.now, net.ParseIP(in.clientIP), in.groups, in.provider)
+			if in.expectedErr == "" {
+				Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(in.expectedErr))
+			Expect(err.(*DeniedError).Rule).To(Equal(in.expectedRule))
+			Expect(err.(*DeniedError).Window).To(Equal(in.expectedWindow))
+		},
+		Entry("a path without rules", authorizeTableInput{
+			path:     "/public",
+			clientIP: "203.0.113.1",
+		}),
+		Entry("an allowed IPv4 client in the group", authorizeTableInput{
+			path:     "/internal/dashboard",
+			clientIP: "10.1.2.3",
+			groups:   []string{"dev", "ops"},
+		}),
+		Entry("an allowed IPv6 client in the group", authorizeTableInput{
+			path:     "/internal/dashboard",
+			clientIP: "fd12:3456::1",
+			groups:   []string{"ops"},
+		}),
+		Entry("a client outside the networks in the group", authorizeTableInput{
+			path:         "/internal/dashboard",
+			clientIP:     "203.0.113.1",
+			groups:       []string{"ops"},
+			expectedRule: "internal",
+			expectedErr:  `denied by route access rule "internal": client IP 203.0.113.1 is not in 10.0.0.0/8, fd00::/8`,
+		}),
+		Entry("an allowed client outside the group", authorizeTableInput{
+			path:         "/internal/dashboard",
+			clientIP:     "10.1.2.3",
+			groups:       []string{"dev"},
+			expectedRule: "internal",
+			expectedErr:  `denied by route access rule "internal": the user is not a member of any of the rule's groups`,
+		}),
+		Entry("an allowed client without a session", authorizeTableInput{
+			path:         "/internal/dashboard",
+			clientIP:     "10.1.2.3",
+			expectedRule: "internal",
+			expectedErr:  `denied by route access rule "internal": the user is not a member of any of the rule's groups`,
+		}),
+		Entry("a client whose IP is unknown", authorizeTableInput{
+			path:         "/internal/dashboard",
+			groups:       []string{"ops"},
+			expectedRule: "internal",
+			expectedErr:  `denied by route access rule "internal": the client IP could not be determined`,
+		}),
+		Entry("a path matching every rule", authorizeTableInput{
+			path:     "/internal/admin/users",
+			clientIP: "10.1.2.3",
+			groups:   []string{"ops", "owners"},
+		}),
+		Entry("a path matching a rule that isn't satisfied", authorizeTableInput{
+			path:         "/internal/admin/users",
+			clientIP:     "10.1.2.3",
+			groups:       []string{"ops"},
+			expectedRule: "admin",
+			expectedErr:  `denied by route access rule "admin": the user is not a member of any of the rule's groups`,
+		}),
+		Entry("a network only rule with a client in a later range", authorizeTableInput{
+			path:     "/metrics",
+			clientIP: "2001:db8::10",
+		}),
+		Entry("a network only rule with a client outside the ranges", authorizeTableInput{
+			path:         "/metrics",
+			clientIP:     "10.1.2.3",
+			expectedRule: "metrics",
+			expectedErr:  `denied by route access rule "metrics": client IP 10.1.2.3 is not in 192.168.0.0/16, 2001:db8::/32`,
+		}),
+		Entry("a provider rule with a session of the providers", authorizeTableInput{
+			path:     "/billing/invoices",
+			clientIP: "203.0.113.1",
+			provider: "okta",
+		}),
+		Entry("a provider rule with a session of another provider", authorizeTableInput{
+			path:         "/billing/invoices",
+			clientIP:     "203.0.113.1",
+			provider:     "htpasswd",
+			expectedRule: "billing",
+			expectedErr:  `denied by route access rule "billing": the session was not authenticated by any of the rule's providers`,
+		}),
+		Entry("a provider rule without a session", authorizeTableInput{
+			path:         "/billing/invoices",
+			clientIP:     "203.0.113.1",
+			expectedRule: "billing",
+			expectedErr:  `denied by route access rule "billing": the session was not authenticated by any of the rule's providers`,
+		}),
+		Entry("a window rule during business hours", authorizeTableInput{
+			path:   "/vendor-portal/orders",
+			now:    time.Date(2026, 10, 14, 7, 30, 0, 0, time.UTC),
+			groups: []string{"contractors"},
+		}),
+		Entry("a window rule outside business hours", authorizeTableInput{
+			path:           "/vendor-portal/orders",
+			now:            time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC),
+			groups:         []string{"contractors"},
+			expectedRule:   "vendor",
+			expectedErr:    `denied by route access rule "vendor": the request at Wed 08:30 CEST is outside the access window mon-fri 09:00-17:00 Europe/Paris`,
+			expectedWindow: "mon-fri 09:00-17:00 Europe/Paris",
+		}),
+		Entry("a window rule during business hours outside the group", authorizeTableInput{
+			path:         "/vendor-portal/orders",
+			now:          time.Date(2026, 10, 14, 7, 30, 0, 0, time.UTC),
+			groups:       []string{"staff"},
+			expectedRule: "vendor",
+			expectedErr:  `denied by route access rule "vendor": the user is not a member of any of the rule's groups`,
+		}),
+		Entry("a not-after rule before the time", authorizeTableInput{
+			path: "/break-glass/console",
+			now:  time.Date(2026, 10, 31, 23, 59, 59, 0, time.UTC),
+		}),
+		Entry("a not-after rule at the time", authorizeTableInput{
+			path:           "/break-glass/console",
+			now:            time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+			expectedRule:   "break-glass",
+			expectedErr:    `denied by route access rule "break-glass": the access window of the rule ended at 2026-11-01T00:00:00Z`,
+			expectedWindow: "until 2026-11-01T00:00:00Z",
+		}),
+	)
+
+	DescribeTable("NewRules errors",
+		func(rule string, expectedErr string) {
+			_, err := NewRules([]string{rule})
+			Expect(err).To(MatchError(expectedErr))
+		},
+		Entry("without a name", "path~^/internal/&group=ops",
+			`invalid rule "path~^/internal/&group=ops": expected format <name>:path~<regex>&<requirement>[&<requirement>...]`),
+		Entry("without a path", "internal:group=ops",
+			`invalid rule "internal:group=ops": a path~<regex> condition is required`),
+		Entry("without a requirement", "internal:path~^/internal/",
+			`invalid rule "internal:path~^/internal/": at least one cidr, group, provider, days, hours or not-after requirement is required`),
+		Entry("with a time zone alone", "internal:path~^/internal/&tz=Europe/Paris",
+			`invalid rule "internal:path~^/internal/&tz=Europe/Paris": the tz condition requires a days or hours requirement`),
+		Entry("with an invalid regex", "internal:path~^/(internal/&group=ops",
+			"invalid rule \"internal:path~^/(internal/&group=ops\": condition \"path~^/(internal/\" has an invalid regex: error parsing regexp: missing closing ): `^/(internal/`"),
+		Entry("with an invalid network", "internal:path~^/internal/&cidr=10.0.0.0/33",
+			`invalid rule "internal:path~^/internal/&cidr=10.0.0.0/33": condition "cidr=10.0.0.0/33" has an invalid IP network "10.0.0.0/33"`),
+		Entry("with an empty group", "internal:path~^/internal/&group=ops,",
+			`invalid rule "internal:path~^/internal/&group=ops,": condition "group=ops," has an empty group`),
+		Entry("with an unknown condition", "internal:path~^/internal/&email=ops@example.com",
+			`invalid rule "internal:path~^/internal/&email=ops@example.com": unknown condition "email=ops@example.com", expected path~<regex>, cidr=<cidrs>, group=<groups>, provider=<providers>, days=<days>, hours=<hh:mm-hh:mm>, tz=<time zone> or not-after=<time>`),
+		Entry("with an empty provider", "internal:path~^/internal/&provider=",
+			`invalid rule "internal:path~^/internal/&provider=": condition "provider=" has an empty provider`),
+	)
+
+	It("describes the rules in order", func() {
+		parsed, err := NewRules(rules)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.Info()).To(Equal([]RuleInfo{
+			{Name: "internal", Path: "^/internal/", CIDRs: []string{"10.0.0.0/8", "fd00::/8"}, Groups: []string{"ops"}},
+			{Name: "admin", Path: "^/internal/admin/", Groups: []string{"admins", "owners"}},
+			{Name: "metrics", Path: "^/metrics$", CIDRs: []string{"192.168.0.0/16", "2001:db8::/32"}, Groups: []string{}},
+			{Name: "billing", Path: "^/billing/", Groups: []string{}, Providers: []string{"azure", "okta"}},
+			{Name: "vendor", Path: "^/vendor-portal/", Groups: []string{"contractors"}, Window: "mon-fri 09:00-17:00 Europe/Paris"},
+			{Name: "break-glass", Path: "^/break-glass/", Groups: []string{}, Window: "until 2026-11-01T00:00:00Z"},
+		}))
+	})
+
+	DescribeTable("Matching",
+		func(path string, expectedRules []string) {
+			parsed, err := NewRules(rules)
+			Expect(err).ToNot(HaveOccurred())
+
+			names := []string{}
+			for _, info := range parsed.Matching(path) {
+				names = append(names, info.Name)
+			}
+			Expect(names).To(Equal(expectedRules))
+		},
+		Entry("a path without rules", "/public", []string{}),
+		Entry("a path matching one rule", "/internal/dashboard", []string{"internal"}),
+		Entry("a path matching every rule", "/internal/admin/users", []string{"internal", "admin"}),
+	)
+
+	It("rejects rules with the same name", func() {
+		_, err := NewRules([]string{"internal:path~^/a/&group=ops", "internal:path~^/b/&group=ops"})
+		Expect(err).To(MatchError(`invalid rule "internal:path~^/b/&group=ops": the name "internal" is already used`))
+	})
+})
@@ -0,0 +1,197 @@
+package routeaccess
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	// The time zones of the rules are loaded from the embedded database when
+	// the system has none, as in the alpine image
+	_ "time/tzdata"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is the access window of a rule, from its days, hours, tz and
+// not-after conditions
+type window struct {
+	// days are the days of the week requests are allowed on, every day when
+	// nil. For hours ending the next day, the day is the one they start on.
+	days     map[time.Weekday]struct{}
+	daySpecs []string
+
+	// hours is set when requests are only allowed between the start and the
+	// end, in minutes since midnight
+	hours bool
+	start int
+	end   int
+
+	location *time.Location
+	timezone string
+
+	notAfter *time.Time
+}
+
+// isWindowCondition checks whether the condition is one of the access window
+func isWindowCondition(c string) bool {
+	for _, prefix := range []string{"days=", "hours=", "tz=", "not-after="} {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *window) parseCondition(c string) error {
+	switch {
+	case strings.HasPrefix(c, "days="):
+		return w.parseDays(c, strings.TrimPrefix(c, "days="))
+	case strings.HasPrefix(c, "hours="):
+		if w.hours {
+			return errors.New("only one hours condition is allowed")
+		}
+		return w.parseHours(c, strings.TrimPrefix(c, "hours="))
+	case strings.HasPrefix(c, "tz="):
+		if w.timezone != "" {
+			return errors.New("only one tz condition is allowed")
+		}
+		timezone := strings.TrimPrefix(c, "tz=")
+		location, err := time.LoadLocation(timezone)
+		if timezone == "" || err != nil {
+			return fmt.Errorf("condition %q has an unknown time zone", c)
+		}
+		w.location = location
+		w.timezone = timezone
+	case strings.HasPrefix(c, "not-after="):
+		if w.notAfter != nil {
+			return errors.New("only one not-after condition is allowed")
+		}
+		notAfter, err := time.Parse(time.RFC3339, strings.TrimPrefix(c, "not-after="))
+		if err != nil {
+			return fmt.Errorf("condition %q has an invalid time, expected RFC 3339 (eg. 2006-01-02T15:04:05Z)", c)
+		}
+		w.notAfter = &notAfter
+	}
+	return nil
+}
+
+// parseDays adds the days and ranges of days, which may wrap around the end
+// of the week, to the days of the window
+func (w *window) parseDays(c, spec string) error {
+	if w.days == nil {
+		w.days = map[time.Weekday]struct{}{}
+	}
+	for _, days := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.ToLower(strings.TrimSpace(days)), "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("condition %q has an invalid day %q, expected sun, mon, tue, wed, thu, fri or sat", c, days)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("condition %q has an invalid day %q, expected sun, mon, tue, wed, thu, fri or sat", c, days)
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = struct{}{}
+			if day == last {
+				break
+			}
+		}
+		w.daySpecs = append(w.daySpecs, strings.Join(bounds, "-"))
+	}
+	return nil
+}
+
+func (w *window) parseHours(c, spec string) error {
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("condition %q has invalid hours, expected hh:mm-hh:mm", c)
+	}
+	start, err := time.Parse("15:04", bounds[0])
+	if err != nil {
+		return fmt.Errorf("condition %q has invalid hours, expected hh:mm-hh:mm", c)
+	}
+	end, err := time.Parse("15:04", bounds[1])
+	if err != nil {
+		return fmt.Errorf("condition %q has invalid hours, expected hh:mm-hh:mm", c)
+	}
+	w.hours = true
+	w.start = start.Hour()*60 + start.Minute()
+	w.end = end.Hour()*60 + end.Minute()
+	if w.start == w.end {
+		return fmt.Errorf("condition %q has hours starting and ending at the same time", c)
+	}
+	return nil
+}
+
+// empty checks whether the window has no requirement, in which case it
+// allows every request
+func (w *window) empty() bool {
+	return w.days == nil && !w.hours && w.notAfter == nil
+}
+
+// deny returns the reason the request at the time is outside the window, if
+// it is
+func (w *window) deny(now time.Time) string {
+	if w.notAfter != nil && !now.Before(*w.notAfter) {
+		return fmt.Sprintf("the access window of the rule ended at %s", w.notAfter.Format(time.RFC3339))
+	}
+	if w.days == nil && !w.hours {
+		return ""
+	}
+
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	outside := fmt.Sprintf("the request at %s is outside the access window %s", local.Format("Mon 15:04 MST"), w)
+	if w.hours {
+		switch {
+		case w.start < w.end:
+			if minute < w.start || minute >= w.end {
+				return outside
+			}
+		case minute >= w.start:
+			// The hours started today
+		case minute < w.end:
+			// The hours started the day before
+			day = (day + 6) % 7
+		default:
+			return outside
+		}
+	}
+	if w.days != nil {
+		if _, ok := w.days[day]; !ok {
+			return outside
+		}
+	}
+	return ""
+}
+
+// String describes the window, eg. `mon-fri 09:00-17:00 Europe/Paris`
+func (w *window) String() string {
+	parts := []string{}
+	if w.days != nil {
+		parts = append(parts, strings.Join(w.daySpecs, ","))
+	}
+	if w.hours {
+		parts = append(parts, fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60))
+	}
+	if len(parts) > 0 {
+		parts = append(parts, w.location.String())
+	}
+	if w.notAfter != nil {
+		parts = append(parts, "until "+w.notAfter.Format(time.RFC3339))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,94 @@
+package routeaccess
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access windows", func() {
+	DescribeTable("Authorize",
+		func(rule string, now time.Time, allowed bool) {
+			parsed, err := NewRules([]string{rule})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = parsed.Authorize("/vendor-portal/", now, nil, nil, "")
+			if allowed {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		},
+		Entry("business hours before the DST change at 08:30 CET",
+			"vendor:path~^/vendor-portal/&hours=09:00-17:00&tz=Europe/Paris",
+			time.Date(2026, 3, 27, 7, 30, 0, 0, time.UTC), false),
+		Entry("business hours after the DST change at 09:30 CEST",
+			"vendor:path~^/vendor-portal/&hours=09:00-17:00&tz=Europe/Paris",
+			time.Date(2026, 4, 1, 7, 30, 0, 0, time.UTC), true),
+		Entry("hours skipped by the DST change, before the change",
+			"vendor:path~^/vendor-portal/&hours=02:00-04:00&tz=Europe/Paris",
+			time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC), false),
+		Entry("hours skipped by the DST change, after the change",
+			"vendor:path~^/vendor-portal/&hours=02:00-04:00&tz=Europe/Paris",
+			time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), true),
+		Entry("hours repeated by the DST change, the first time",
+			"vendor:path~^/vendor-portal/&hours=02:00-03:00&tz=Europe/Paris",
+			time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), true),
+		Entry("hours repeated by the DST change, the second time",
+			"vendor:path~^/vendor-portal/&hours=02:00-03:00&tz=Europe/Paris",
+			time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC), true),
+		Entry("the end of the hours",
+			"vendor:path~^/vendor-portal/&hours=09:00-17:00",
+			time.Date(2026, 10, 14, 17, 0, 0, 0, time.UTC), false),
+		Entry("overnight hours on the day they start",
+			"vendor:path~^/vendor-portal/&days=fri&hours=22:00-06:00",
+			time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true),
+		Entry("overnight hours on the next day",
+			"vendor:path~^/vendor-portal/&days=fri&hours=22:00-06:00",
+			time.Date(2026, 10, 17, 5, 0, 0, 0, time.UTC), true),
+		Entry("overnight hours starting the day before another day",
+			"vendor:path~^/vendor-portal/&days=fri&hours=22:00-06:00",
+			time.Date(2026, 10, 16, 5, 0, 0, 0, time.UTC), false),
+		Entry("overnight hours on another day",
+			"vendor:path~^/vendor-portal/&days=fri&hours=22:00-06:00",
+			time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC), false),
+		Entry("days wrapping around the week",
+			"vendor:path~^/vendor-portal/&days=fri-mon",
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), true),
+		Entry("a day outside days wrapping around the week",
+			"vendor:path~^/vendor-portal/&days=fri-mon",
+			time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC), false),
+		Entry("days in the time zone",
+			"vendor:path~^/vendor-portal/&days=thu&tz=Asia/Tokyo",
+			time.Date(2026, 10, 14, 16, 0, 0, 0, time.UTC), true),
+		Entry("days and a not-after time before it",
+			"vendor:path~^/vendor-portal/&days=mon,wed&not-after=2026-10-15T00:00:00+02:00",
+			time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC), true),
+		Entry("days and a not-after time after it",
+			"vendor:path~^/vendor-portal/&days=mon,wed&not-after=2026-10-14T12:00:00+02:00",
+			time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC), false),
+	)
+
+	DescribeTable("NewRules errors",
+		func(rule string, expectedErr string) {
+			_, err := NewRules([]string{"vendor:path~^/vendor-portal/&" + rule})
+			Expect(err).To(MatchError(`invalid rule "vendor:path~^/vendor-portal/&` + rule + `": ` + expectedErr))
+		},
+		Entry("with an invalid day", "days=mon-fry",
+			`condition "days=mon-fry" has an invalid day "mon-fry", expected sun, mon, tue, wed, thu, fri or sat`),
+		Entry("with invalid hours", "hours=9-17",
+			`condition "hours=9-17" has invalid hours, expected hh:mm-hh:mm`),
+		Entry("with hours without an end", "hours=09:00",
+			`condition "hours=09:00" has invalid hours, expected hh:mm-hh:mm`),
+		Entry("with empty hours", "hours=09:00-09:00",
+			`condition "hours=09:00-09:00" has hours starting and ending at the same time`),
+		Entry("with two hours", "hours=09:00-12:00&hours=14:00-17:00",
+			`only one hours condition is allowed`),
+		Entry("with an unknown time zone", "hours=09:00-17:00&tz=Europe/Nowhere",
+			`condition "tz=Europe/Nowhere" has an unknown time zone`),
+		Entry("with an invalid not-after time", "not-after=2026-12-31",
+			`condition "not-after=2026-12-31" has an invalid time, expected RFC 3339 (eg. 2006-01-02T15:04:05Z)`),
+	)
+})
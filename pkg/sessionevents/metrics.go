@@ -0,0 +1,39 @@
+package sessionevents
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics records the queued, delivered and dropped session events
+type metrics struct {
+	queued    prometheus.Gauge
+	delivered *prometheus.CounterVec
+	dropped   *prometheus.CounterVec
+}
+
+// newMetrics registers the session event metrics with the registerer.
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	return &metrics{
+		queued: collector.Register(registerer, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_session_events_queued",
+				Help: "Number of session events queued for delivery to the webhook.",
+			},
+		)).(prometheus.Gauge),
+		delivered: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_session_events_delivered_total",
+				Help: "Total number of session events delivered to the webhook by type.",
+			},
+			[]string{"type"},
+		)).(*prometheus.CounterVec),
+		dropped: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_session_events_dropped_total",
+				Help: "Total number of session events dropped by type and reason: queue_full or delivery_failed.",
+			},
+			[]string{"type", "reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
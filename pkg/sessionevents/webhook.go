@@ -0,0 +1,361 @@
+package sessionevents
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// SignatureHeader is the header events are signed in, with a
+	// `sha256=<hex HMAC>` signature of the body for each signing key
+	SignatureHeader = "X-OAuth2-Proxy-Signature"
+
+	// minKeySize is the minimum size of a signing key, the size of a SHA256
+	// HMAC
+	minKeySize = sha256.Size
+
+	// maxSigningKeys is the number of signing keys: the current key, and the
+	// key being rotated to or from
+	maxSigningKeys = 2
+
+	// The initial and maximum wait between the retries of a delivery
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+
+	// The reasons events are dropped
+	dropQueueFull = "queue_full"
+	dropFailed    = "delivery_failed"
+)
+
+// Event is the JSON body delivered to the webhook.
+// It has the fields of the auth log, with the type of the event.
+type Event struct {
+	Type          string `json:"type"`
+	Client        string `json:"client"`
+	Host          string `json:"host"`
+	Protocol      string `json:"protocol"`
+	RequestID     string `json:"requestID"`
+	RequestMethod string `json:"requestMethod"`
+	Timestamp     string `json:"timestamp"`
+	UserAgent     string `json:"userAgent"`
+	Username      string `json:"username"`
+	Status        string `json:"status"`
+	Message       string `json:"message"`
+}
+
+// queuedEvent is an event waiting to be delivered
+type queuedEvent struct {
+	eventType string
+	body      []byte
+}
+
+// Webhook delivers session events to a webhook in the background, signed
+// with an HMAC of each signing key.
+// Events are queued in memory, so that sending them never blocks the request
+// they are sent for. Deliveries that fail are retried with exponential
+// backoff, and events are dropped, by the drop policy, while the queue is
+// full.
+type Webhook struct {
+	url        string
+	keys       [][]byte
+	types      map[string]struct{}
+	dropOldest bool
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+
+	queue   chan queuedEvent
+	mu      sync.Mutex
+	metrics *metrics
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWebhook loads the signing keys and starts delivering the events sent to
+// the webhook, until it is stopped
+func NewWebhook(opts options.SessionEvents, registerer prometheus.Registerer) (*Webhook, error) {
+	u, err := url.Parse(opts.WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid webhook url %q: the scheme must be http or https", opts.WebhookURL)
+	}
+	if opts.QueueSize <= 0 {
+		return nil, fmt.Errorf("queue size (%d) must be positive", opts.QueueSize)
+	}
+	if opts.MaxRetries < 0 {
+		return nil, fmt.Errorf("max retries (%d) must not be negative", opts.MaxRetries)
+	}
+	if opts.Timeout <= 0 {
+		return nil, fmt.Errorf("timeout (%s) must be positive", opts.Timeout)
+	}
+
+	var dropOldest bool
+	switch opts.DropPolicy {
+	case options.SessionEventsDropNewest, "":
+	case options.SessionEventsDropOldest:
+		dropOldest = true
+	default:
+		return nil, fmt.Errorf("unknown drop policy %q: must be %q or %q", opts.DropPolicy, options.SessionEventsDropNewest, options.SessionEventsDropOldest)
+	}
+
+	keys, err := LoadSigningKeys(opts.SigningKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	types, err := eventTypes(opts.Types)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{
+		url:        opts.WebhookURL,
+		keys:       keys,
+		types:      types,
+		dropOldest: dropOldest,
+		maxRetries: opts.MaxRetries,
+		backoff:    initialBackoff,
+		client:     &http.Client{Timeout: opts.Timeout},
+		queue:      make(chan queuedEvent, opts.QueueSize),
+		metrics:    newMetrics(registerer),
+		done:       make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.deliverQueued()
+	return w, nil
+}
+
+// LoadSigningKeys reads the signing keys from the key files, the current key
+// and at most one key being rotated to or from
+func LoadSigningKeys(files []string) ([][]byte, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no signing key file configured")
+	}
+	if len(files) > maxSigningKeys {
+		return nil, fmt.Errorf("at most %d signing key files can be configured, got %d", maxSigningKeys, len(files))
+	}
+
+	keys := make([][]byte, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read signing key file %q: %v", file, err)
+		}
+		key := bytes.TrimSpace(data)
+		if len(key) < minKeySize {
+			return nil, fmt.Errorf("signing key in %q must be at least %d bytes, got %d bytes", file, minKeySize, len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// eventTypes returns the set of event types to deliver, all of them when
+// none are selected
+func eventTypes(selected []string) (map[string]struct{}, error) {
+	all := []string{
+		options.SessionEventLogin,
+		options.SessionEventLogout,
+		options.SessionEventRefreshFailure,
+		options.SessionEventAuthorizationDenied,
+		options.SessionEventFallbackLogin,
+		options.SessionEventEvicted,
+		options.SessionEventMaintenance,
+	}
+	if len(selected) == 0 {
+		selected = all
+	}
+
+	types := map[string]struct{}{}
+	for _, eventType := range selected {
+		known := false
+		for _, name := range all {
+			if eventType == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown session event %q: must be one of %s", eventType, strings.Join(all, ", "))
+		}
+		types[eventType] = struct{}{}
+	}
+	return types, nil
+}
+
+// Send queues an event of the type for delivery, when the type is selected.
+// The event has the auth log fields of the request, with the message
+// formatted in the manner of fmt.Sprintf.
+// The request is nil for events that aren't caused by a request, such as the
+// maintenance mode being toggled by a signal, and the request fields are then
+// left empty.
+func (w *Webhook) Send(eventType, username string, req *http.Request, status logger.AuthStatus, format string, a ...interface{}) {
+	if _, ok := w.types[eventType]; !ok {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Username:  username,
+		Status:    string(status),
+		Message:   fmt.Sprintf(format, a...),
+	}
+	if req != nil {
+		event.Client = logger.GetClient(req)
+		event.Host = requestutil.GetRequestHost(req)
+		event.Protocol = req.Proto
+		event.RequestMethod = req.Method
+		event.UserAgent = req.UserAgent()
+		if scope := middlewareapi.GetRequestScope(req); scope != nil {
+			event.RequestID = scope.RequestID
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Error encoding session event: %v", err)
+		return
+	}
+	w.enqueue(queuedEvent{eventType: eventType, body: body})
+}
+
+// enqueue queues the event without waiting, applying the drop policy when the
+// queue is full
+func (w *Webhook) enqueue(event queuedEvent) {
+	// The queue is only drained of the oldest event under the lock, so that
+	// the event is queued once the oldest is dropped
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		select {
+		case w.queue <- event:
+			w.metrics.queued.Inc()
+			return
+		default:
+		}
+
+		if !w.dropOldest {
+			w.metrics.dropped.WithLabelValues(event.eventType, dropQueueFull).Inc()
+			return
+		}
+		select {
+		case oldest := <-w.queue:
+			w.metrics.queued.Dec()
+			w.metrics.dropped.WithLabelValues(oldest.eventType, dropQueueFull).Inc()
+		default:
+		}
+	}
+}
+
+// Stop stops delivering events, waiting for any delivery in progress.
+// Events still queued are not delivered.
+func (w *Webhook) Stop() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+// deliverQueued delivers the queued events one at a time, in the order they
+// were sent, until the webhook is stopped
+func (w *Webhook) deliverQueued() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case event := <-w.queue:
+			w.metrics.queued.Dec()
+			if w.deliverWithRetries(event) {
+				w.metrics.delivered.WithLabelValues(event.eventType).Inc()
+			} else {
+				w.metrics.dropped.WithLabelValues(event.eventType, dropFailed).Inc()
+			}
+		}
+	}
+}
+
+// deliverWithRetries delivers the event, retrying failures that may be
+// temporary with exponential backoff, and returns whether it was delivered
+func (w *Webhook) deliverWithRetries(event queuedEvent) bool {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.deliver(event)
+		if err == nil {
+			return true
+		}
+		if !retry || attempt >= w.maxRetries {
+			logger.Errorf("Error delivering %s session event to the webhook: %v", event.eventType, err)
+			return false
+		}
+
+		select {
+		case <-w.done:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// deliver posts the event to the webhook, returning whether a failure may be
+// temporary
+func (w *Webhook) deliver(event queuedEvent) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(event.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, w.sign(event.body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// sign returns the signatures of the body with each signing key, so that
+// the webhook can verify it with either key while the keys are rotated
+func (w *Webhook) sign(body []byte) string {
+	signatures := make([]string, 0, len(w.keys))
+	for _, key := range w.keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		signatures = append(signatures, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(signatures, ",")
+}
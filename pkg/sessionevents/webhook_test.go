@@ -0,0 +1,297 @@
+package sessionevents
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	currentKey  = "0123456789abcdef0123456789abcdef"
+	previousKey = "fedcba9876543210fedcba9876543210"
+)
+
+// receivedEvent is an event received by the webhook server
+type receivedEvent struct {
+	event      Event
+	signatures []string
+}
+
+var _ = Describe("Webhook", func() {
+	var server *httptest.Server
+	var webhook *Webhook
+	var keyFiles []string
+
+	var mu sync.Mutex
+	var received []receivedEvent
+	// statuses are the statuses of the next responses of the server
+	var statuses []int
+	// release is closed to let the server respond, when it is set
+	var release chan struct{}
+
+	BeforeEach(func() {
+		received = nil
+		statuses = nil
+		release = nil
+
+		keyFiles = nil
+		for _, key := range []string{currentKey, previousKey} {
+			f, err := ioutil.TempFile("", "oauth2-proxy-session-events-key")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = f.WriteString(key + "\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			keyFiles = append(keyFiles, f.Name())
+		}
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			Expect(req.Method).To(Equal(http.MethodPost))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+			if release != nil {
+				<-release
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(statuses) > 0 {
+				status := statuses[0]
+				statuses = statuses[1:]
+				if status != http.StatusOK {
+					rw.WriteHeader(status)
+					return
+				}
+			}
+
+			body, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+			var event Event
+			Expect(json.Unmarshal(body, &event)).To(Succeed())
+			// The signatures must be of the body as it was received
+			for i, signature := range strings.Split(req.Header.Get(SignatureHeader), ",") {
+				key := []string{currentKey, previousKey}[i]
+				mac := hmac.New(sha256.New, []byte(key))
+				mac.Write(body)
+				Expect(signature).To(Equal("sha256=" + hex.EncodeToString(mac.Sum(nil))))
+			}
+			received = append(received, receivedEvent{
+				event:      event,
+				signatures: strings.Split(req.Header.Get(SignatureHeader), ","),
+			})
+		}))
+	})
+
+	AfterEach(func() {
+		if webhook != nil {
+			webhook.Stop()
+			webhook = nil
+		}
+		server.Close()
+		for _, file := range keyFiles {
+			Expect(os.Remove(file)).To(Succeed())
+		}
+	})
+
+	newWebhook := func(modify func(*options.SessionEvents)) *Webhook {
+		opts := options.SessionEvents{
+			WebhookURL:      server.URL,
+			SigningKeyFiles: keyFiles[:1],
+			QueueSize:       10,
+			DropPolicy:      options.SessionEventsDropNewest,
+			MaxRetries:      2,
+			Timeout:         time.Second,
+		}
+		if modify != nil {
+			modify(&opts)
+		}
+		w, err := NewWebhook(opts, prometheus.NewRegistry())
+		Expect(err).ToNot(HaveOccurred())
+		w.backoff = time.Millisecond
+		return w
+	}
+
+	receivedEvents := func() []receivedEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedEvent{}, received...)
+	}
+
+	receivedMessages := func() []string {
+		messages := []string{}
+		for _, r := range receivedEvents() {
+			messages = append(messages, r.event.Message)
+		}
+		return messages
+	}
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/oauth2/callback", nil)
+		req.Header.Set("User-Agent", "test-agent")
+		return middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{RequestID: "request-1"})
+	}
+
+	It("delivers events with the fields of the auth log", func() {
+		webhook = newWebhook(nil)
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "Authenticated via %s", "OAuth2")
+
+		Eventually(receivedEvents).Should(HaveLen(1))
+		event := receivedEvents()[0].event
+		Expect(event.Timestamp).ToNot(BeEmpty())
+		event.Timestamp = ""
+		Expect(event).To(Equal(Event{
+			Type:          options.SessionEventLogin,
+			Client:        "192.0.2.1:1234",
+			Host:          "app.example.com",
+			Protocol:      "HTTP/1.1",
+			RequestID:     "request-1",
+			RequestMethod: http.MethodGet,
+			UserAgent:     "test-agent",
+			Username:      "john.doe@example.com",
+			Status:        string(logger.AuthSuccess),
+			Message:       "Authenticated via OAuth2",
+		}))
+		Expect(receivedEvents()[0].signatures).To(HaveLen(1))
+		Eventually(func() float64 {
+			return testutil.ToFloat64(webhook.metrics.delivered.WithLabelValues(options.SessionEventLogin))
+		}).Should(Equal(float64(1)))
+		Expect(testutil.ToFloat64(webhook.metrics.queued)).To(Equal(float64(0)))
+	})
+
+	It("delivers events without a request", func() {
+		webhook = newWebhook(nil)
+		webhook.Send(options.SessionEventMaintenance, "", nil, logger.AuthSuccess, "Maintenance mode enabled by %s", "SIGUSR1")
+
+		Eventually(receivedEvents).Should(HaveLen(1))
+		event := receivedEvents()[0].event
+		Expect(event.Timestamp).ToNot(BeEmpty())
+		event.Timestamp = ""
+		Expect(event).To(Equal(Event{
+			Type:    options.SessionEventMaintenance,
+			Status:  string(logger.AuthSuccess),
+			Message: "Maintenance mode enabled by SIGUSR1",
+		}))
+	})
+
+	It("signs events with both keys while they are rotated", func() {
+		webhook = newWebhook(func(opts *options.SessionEvents) {
+			opts.SigningKeyFiles = keyFiles
+		})
+		webhook.Send(options.SessionEventLogout, "john.doe@example.com", newRequest(), logger.AuthSuccess, "Signed out")
+
+		Eventually(receivedEvents).Should(HaveLen(1))
+		Expect(receivedEvents()[0].signatures).To(HaveLen(2))
+	})
+
+	It("only delivers the selected events", func() {
+		webhook = newWebhook(func(opts *options.SessionEvents) {
+			opts.Types = []string{options.SessionEventAuthorizationDenied}
+		})
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "login")
+		webhook.Send(options.SessionEventAuthorizationDenied, "john.doe@example.com", newRequest(), logger.AuthFailure, "denied")
+
+		Eventually(receivedMessages).Should(Equal([]string{"denied"}))
+		Consistently(receivedMessages, 50*time.Millisecond).Should(Equal([]string{"denied"}))
+	})
+
+	It("retries deliveries that fail temporarily", func() {
+		statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+		webhook = newWebhook(nil)
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "login")
+
+		Eventually(receivedMessages).Should(Equal([]string{"login"}))
+	})
+
+	It("drops events once the retries are exhausted", func() {
+		statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+		webhook = newWebhook(nil)
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "login")
+
+		Eventually(func() float64 {
+			return testutil.ToFloat64(webhook.metrics.dropped.WithLabelValues(options.SessionEventLogin, dropFailed))
+		}).Should(Equal(float64(1)))
+		Expect(receivedEvents()).To(BeEmpty())
+	})
+
+	It("doesn't retry events rejected by the webhook", func() {
+		statuses = []int{http.StatusBadRequest}
+		webhook = newWebhook(nil)
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "rejected")
+		webhook.Send(options.SessionEventLogin, "john.doe@example.com", newRequest(), logger.AuthSuccess, "delivered")
+
+		Eventually(receivedMessages).Should(Equal([]string{"delivered"}))
+		Expect(testutil.ToFloat64(webhook.metrics.dropped.WithLabelValues(options.SessionEventLogin, dropFailed))).To(Equal(float64(1)))
+	})
+
+	Context("when the queue is full", func() {
+		// sendWhileBlocked sends events while the first is being delivered,
+		// filling the queue of one event, then lets the webhook respond
+		sendWhileBlocked := func() {
+			release = make(chan struct{})
+			webhook.Send(options.SessionEventLogin, "", newRequest(), logger.AuthSuccess, "first")
+			Eventually(func() float64 { return testutil.ToFloat64(webhook.metrics.queued) }).Should(Equal(float64(0)))
+
+			start := time.Now()
+			for _, message := range []string{"second", "third", "fourth"} {
+				webhook.Send(options.SessionEventLogin, "", newRequest(), logger.AuthSuccess, message)
+			}
+			// Sending events never waits for their delivery
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+			Expect(testutil.ToFloat64(webhook.metrics.queued)).To(Equal(float64(1)))
+			Expect(testutil.ToFloat64(webhook.metrics.dropped.WithLabelValues(options.SessionEventLogin, dropQueueFull))).To(Equal(float64(2)))
+			close(release)
+		}
+
+		It("drops the newest events with the drop-newest policy", func() {
+			webhook = newWebhook(func(opts *options.SessionEvents) {
+				opts.QueueSize = 1
+			})
+			sendWhileBlocked()
+
+			Eventually(receivedMessages).Should(Equal([]string{"first", "second"}))
+		})
+
+		It("drops the oldest events with the drop-oldest policy", func() {
+			webhook = newWebhook(func(opts *options.SessionEvents) {
+				opts.QueueSize = 1
+				opts.DropPolicy = options.SessionEventsDropOldest
+			})
+			sendWhileBlocked()
+
+			Eventually(receivedMessages).Should(Equal([]string{"first", "fourth"}))
+		})
+	})
+
+	It("rejects invalid options", func() {
+		_, err := NewWebhook(options.SessionEvents{
+			WebhookURL:      server.URL,
+			SigningKeyFiles: keyFiles,
+			Types:           []string{"session_created"},
+			QueueSize:       1,
+			Timeout:         time.Second,
+		}, prometheus.NewRegistry())
+		Expect(err).To(MatchError(`unknown session event "session_created": must be one of login, logout, refresh_failure, authorization_denied, fallback_login, session_evicted, maintenance`))
+
+		_, err = NewWebhook(options.SessionEvents{
+			WebhookURL:      server.URL,
+			SigningKeyFiles: append(keyFiles, keyFiles[0]),
+			QueueSize:       1,
+			Timeout:         time.Second,
+		}, prometheus.NewRegistry())
+		Expect(err).To(MatchError("at most 2 signing key files can be configured, got 3"))
+	})
+})
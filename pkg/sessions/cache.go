@@ -0,0 +1,158 @@
+package sessions
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+)
+
+// maxCachedSessions bounds the number of sessions kept in memory
+const maxCachedSessions = 10000
+
+// cachedSessionStore wraps a persistent SessionStore, caching the sessions it
+// loads in memory by the hash of their session cookie.
+type cachedSessionStore struct {
+	sessions.SessionStore
+
+	cookieName string
+	maxAge     time.Duration
+	clock      clock.Clock
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedSession
+}
+
+// cachedSession is a copy of a loaded session along with when it was loaded
+type cachedSession struct {
+	session  sessions.SessionState
+	loadedAt time.Time
+}
+
+// NewCachedSessionStore wraps the SessionStore so that the sessions it loads
+// are cached in memory, to be served while the store is unavailable.
+// Cached sessions are kept for at most the cookie expiry, and are removed when
+// the session is cleared.
+func NewCachedSessionStore(store sessions.SessionStore, cookieOpts *options.Cookie) sessions.SessionStore {
+	return &cachedSessionStore{
+		SessionStore: store,
+		cookieName:   cookieOpts.Name,
+		maxAge:       cookieOpts.Expire,
+		entries:      make(map[[sha256.Size]byte]cachedSession),
+	}
+}
+
+// Load loads the session from the wrapped store, caching it
+func (c *cachedSessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
+	session, err := c.SessionStore.Load(req)
+	if err != nil || session == nil {
+		return session, err
+	}
+
+	if key, ok := c.cacheKey(req); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.entries) >= maxCachedSessions {
+			// Evict an arbitrary session to make room
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+		c.entries[key] = cachedSession{session: *session, loadedAt: c.clock.Now()}
+	}
+	return session, nil
+}
+
+// Clear clears the session from the wrapped store and the cache
+func (c *cachedSessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	if key, ok := c.cacheKey(req); ok {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	return c.SessionStore.Clear(rw, req)
+}
+
+// CountUserSessions counts the sessions of the user with the wrapped store,
+// when it tracks the sessions of each user
+func (c *cachedSessionStore) CountUserSessions(ctx context.Context, s *sessions.SessionState) (int, error) {
+	counter, ok := c.SessionStore.(sessions.UserSessionCounter)
+	if !ok {
+		return 0, errors.New("the session store doesn't track the sessions of users")
+	}
+	return counter.CountUserSessions(ctx, s)
+}
+
+// ClearProviderSessions clears the sessions of the provider session with the
+// wrapped store, when it tracks provider sessions
+func (c *cachedSessionStore) ClearProviderSessions(ctx context.Context, issuer, subject, sessionID string) (int, error) {
+	revoker, ok := c.SessionStore.(sessions.ProviderSessionRevoker)
+	if !ok {
+		return 0, errors.New("the session store doesn't track provider sessions")
+	}
+	return revoker.ClearProviderSessions(ctx, issuer, subject, sessionID)
+}
+
+// ListSessions lists the sessions of the wrapped store, when it keeps a
+// session inventory
+func (c *cachedSessionStore) ListSessions(ctx context.Context) ([]sessions.SessionRecord, error) {
+	inventory, ok := c.SessionStore.(sessions.SessionInventory)
+	if !ok {
+		return nil, errors.New("the session store doesn't keep a session inventory")
+	}
+	return inventory.ListSessions(ctx)
+}
+
+// RevokeSession revokes the session with the wrapped store, when it keeps a
+// session inventory.
+// The session can't be removed from the cache, which has no record of it, but
+// cached sessions are only served while the store is unavailable.
+func (c *cachedSessionStore) RevokeSession(ctx context.Context, id string) error {
+	inventory, ok := c.SessionStore.(sessions.SessionInventory)
+	if !ok {
+		return errors.New("the session store doesn't keep a session inventory")
+	}
+	return inventory.RevokeSession(ctx, id)
+}
+
+// LoadCached returns a copy of the session last loaded for the request's
+// session cookie, unless it has expired.
+// The copy has no lock as the session can't be refreshed while the store is
+// unavailable.
+func (c *cachedSessionStore) LoadCached(req *http.Request) *sessions.SessionState {
+	key, ok := c.cacheKey(req)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.session.IsExpired() || (c.maxAge > 0 && c.clock.Since(entry.loadedAt) > c.maxAge) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	session := entry.session
+	session.Lock = &sessions.NoOpLock{}
+	return &session
+}
+
+// cacheKey returns the hash of the request's session cookie
+func (c *cachedSessionStore) cacheKey(req *http.Request) ([sha256.Size]byte, bool) {
+	cookie, err := req.Cookie(c.cookieName)
+	if err != nil || cookie.Value == "" {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256([]byte(cookie.Value)), true
+}
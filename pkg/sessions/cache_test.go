@@ -0,0 +1,88 @@
+package sessions_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeSessionStore loads its session, or fails with its error
+type fakeSessionStore struct {
+	session *sessionsapi.SessionState
+	err     error
+}
+
+func (f *fakeSessionStore) Save(http.ResponseWriter, *http.Request, *sessionsapi.SessionState) error {
+	return nil
+}
+
+func (f *fakeSessionStore) Load(*http.Request) (*sessionsapi.SessionState, error) {
+	return f.session, f.err
+}
+
+func (f *fakeSessionStore) Clear(http.ResponseWriter, *http.Request) error {
+	return nil
+}
+
+var _ = Describe("NewCachedSessionStore", func() {
+	var store *fakeSessionStore
+	var cache sessionsapi.SessionCache
+	var req *http.Request
+
+	BeforeEach(func() {
+		clock.Set(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC))
+
+		store = &fakeSessionStore{session: &sessionsapi.SessionState{User: "user", Email: "user@example.com"}}
+		ss := sessions.NewCachedSessionStore(store, &options.Cookie{
+			Name:   "_oauth2_proxy",
+			Expire: time.Hour,
+		})
+		cache = ss.(sessionsapi.SessionCache)
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "ticket"})
+		_, err := ss.Load(req)
+		Expect(err).ToNot(HaveOccurred())
+
+		store.session, store.err = nil, &sessionsapi.StoreUnavailableError{Err: errors.New("connection refused")}
+		_, err = ss.Load(req)
+		Expect(err).To(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		clock.Reset()
+	})
+
+	It("serves the last loaded session", func() {
+		session := cache.LoadCached(req)
+		Expect(session).ToNot(BeNil())
+		Expect(session.User).To(Equal("user"))
+		Expect(session.Email).To(Equal("user@example.com"))
+		Expect(session.Lock).To(BeAssignableToTypeOf(&sessionsapi.NoOpLock{}))
+	})
+
+	It("doesn't serve sessions for other cookies", func() {
+		other := httptest.NewRequest(http.MethodGet, "/", nil)
+		other.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "other"})
+		Expect(cache.LoadCached(other)).To(BeNil())
+		Expect(cache.LoadCached(httptest.NewRequest(http.MethodGet, "/", nil))).To(BeNil())
+	})
+
+	It("doesn't serve sessions older than the cookie expiry", func() {
+		Expect(clock.Add(2 * time.Hour)).To(Succeed())
+		Expect(cache.LoadCached(req)).To(BeNil())
+	})
+
+	It("doesn't serve cleared sessions", func() {
+		Expect(cache.(sessionsapi.SessionStore).Clear(httptest.NewRecorder(), req)).To(Succeed())
+		Expect(cache.LoadCached(req)).To(BeNil())
+	})
+})
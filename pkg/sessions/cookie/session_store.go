@@ -1,17 +1,21 @@
 package cookie
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
-	"regexp"
 	"time"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	pkgcookies "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/redis"
 )
 
 const (
@@ -19,6 +23,10 @@ const (
 	// including the cookie name, value, attributes; IE (http.cookie).String()
 	// Most browsers' max is 4096 -- but we give ourselves some leeway
 	maxCookieLength = 4000
+
+	// How long a refreshed session is kept in Redis for the concurrent
+	// requests that still send the cookie of the session before the refresh
+	refreshedSessionTTL = time.Minute
 )
 
 // Ensure CookieSessionStore implements the interface
@@ -30,6 +38,18 @@ type SessionStore struct {
 	Cookie       *options.Cookie
 	CookieCipher encryption.Cipher
 	Minimal      bool
+
+	// RefreshLocks locks the refreshes of sessions across replicas, and
+	// keeps the refreshed sessions for the requests waiting for the lock.
+	// Optional.
+	RefreshLocks redis.Client
+}
+
+// refreshLock is the lock of the refreshes of a session, keyed by the tokens
+// of the session as it was loaded from the cookie
+type refreshLock struct {
+	sessions.Lock
+	key string
 }
 
 // Save takes a sessions.SessionState and stores the information from it
@@ -42,6 +62,9 @@ func (s *SessionStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessi
 	if err != nil {
 		return err
 	}
+	if err := s.publishRefreshedSession(req.Context(), ss, value); err != nil {
+		return err
+	}
 	return s.setSessionCookie(rw, req, value, *ss.CreatedAt)
 }
 
@@ -53,30 +76,82 @@ func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 		// always http.ErrNoCookie
 		return nil, err
 	}
-	val, _, ok := encryption.Validate(c, s.Cookie.Secret, s.Cookie.Expire)
-	if !ok {
-		return nil, errors.New("cookie signature not valid")
+	val, _, err := encryption.ValidateCookie(c, s.Cookie.Secret, s.Cookie.Expire)
+	if err != nil {
+		return nil, fmt.Errorf("session cookie failed validation: %w", err)
 	}
 
 	session, err := sessions.DecodeSessionState(val, s.CookieCipher, true)
 	if err != nil {
 		return nil, err
 	}
+	if s.RefreshLocks != nil {
+		return s.loadRefreshedSession(req.Context(), session), nil
+	}
 	return session, nil
 }
 
-// Clear clears any saved session information by writing a cookie to
-// clear the session
-func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
-	// matches CookieName, CookieName_<number>
-	var cookieNameRegex = regexp.MustCompile(fmt.Sprintf("^%s(_\\d+)?$", s.Cookie.Name))
+// loadRefreshedSession replaces the session with the session it was refreshed
+// to by another request, if it was, and locks its refreshes in Redis.
+// Errors reading the refreshed session are logged, keeping the session of the
+// cookie, which is refreshed again if it needs to be.
+func (s *SessionStore) loadRefreshedSession(ctx context.Context, session *sessions.SessionState) *sessions.SessionState {
+	key := s.refreshKey(session)
+	value, err := s.RefreshLocks.Get(ctx, key+".refreshed")
+	switch {
+	case err == nil:
+		refreshed, err := sessions.DecodeSessionState(value, s.CookieCipher, true)
+		if err != nil {
+			logger.Errorf("Error decoding the refreshed session: %v", err)
+			break
+		}
+		session = refreshed
+		key = s.refreshKey(session)
+	case !errors.Is(err, goredis.Nil):
+		logger.Errorf("Error loading the refreshed session: %v", err)
+	}
 
-	for _, c := range req.Cookies() {
-		if cookieNameRegex.MatchString(c.Name) {
-			clearCookie := s.makeCookie(req, c.Name, "", time.Hour*-1, time.Now())
+	session.Lock = &refreshLock{
+		Lock: s.RefreshLocks.Lock(key),
+		key:  key,
+	}
+	return session
+}
 
-			http.SetCookie(rw, clearCookie)
-		}
+// publishRefreshedSession keeps the value of a refreshed session in Redis for
+// the requests that still send the cookie of the session before the refresh,
+// so that they don't refresh it again, eg. with a refresh token the provider
+// has already rotated.
+func (s *SessionStore) publishRefreshedSession(ctx context.Context, ss *sessions.SessionState, value []byte) error {
+	lock, ok := ss.Lock.(*refreshLock)
+	if !ok || s.RefreshLocks == nil || lock.key == s.refreshKey(ss) {
+		return nil
+	}
+	if err := s.RefreshLocks.Set(ctx, lock.key+".refreshed", value, refreshedSessionTTL); err != nil {
+		return fmt.Errorf("error publishing the refreshed session: %v", err)
+	}
+	return nil
+}
+
+// refreshKey identifies the session in Redis by a hash of its tokens and
+// creation time, which are the same for all requests with its cookie until it
+// is refreshed
+func (s *SessionStore) refreshKey(ss *sessions.SessionState) string {
+	h := sha256.New()
+	if ss.CreatedAt != nil {
+		fmt.Fprintf(h, "%d\x00", ss.CreatedAt.UnixNano())
+	}
+	for _, value := range []string{ss.AccessToken, ss.IDToken, ss.RefreshToken, ss.Email, ss.User} {
+		fmt.Fprintf(h, "%s\x00", value)
+	}
+	return fmt.Sprintf("%s-refresh-%s", s.Cookie.Name, hex.EncodeToString(h.Sum(nil)))
+}
+
+// Clear clears any saved session information by writing cookies to clear
+// the session, including any split session cookies, from every cookie domain
+func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	for _, c := range pkgcookies.MakeClearCookiesFromOptions(req, s.Cookie.Name, s.Cookie, time.Now()) {
+		http.SetCookie(rw, c)
 	}
 
 	return nil
@@ -145,11 +220,19 @@ func NewCookieSessionStore(opts *options.SessionOptions, cookieOpts *options.Coo
 		return nil, fmt.Errorf("error initialising cipher: %v", err)
 	}
 
-	return &SessionStore{
+	store := &SessionStore{
 		CookieCipher: cipher,
 		Cookie:       cookieOpts,
 		Minimal:      opts.Cookie.Minimal,
-	}, nil
+	}
+	if opts.Cookie.RefreshLock {
+		client, err := redis.NewRedisClient(opts.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("error constructing redis client for the refresh lock: %v", err)
+		}
+		store.RefreshLocks = client
+	}
+	return store, nil
 }
 
 // splitCookie reads the full cookie generated to store the session and splits
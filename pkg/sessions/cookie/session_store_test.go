@@ -1,13 +1,16 @@
 package cookie
 
 import (
+	"context"
 	"fmt"
 	mathrand "math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
@@ -32,6 +35,104 @@ var _ = Describe("Cookie SessionStore Tests", func() {
 			opts.Type = options.CookieSessionStoreType
 			return NewCookieSessionStore(opts, cookieOpts)
 		}, nil)
+
+	Context("with a refresh lock", func() {
+		var (
+			mr          *miniredis.Miniredis
+			store       *SessionStore
+			ctx         context.Context
+			loginCookie *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			var err error
+			mr, err = miniredis.Run()
+			Expect(err).ToNot(HaveOccurred())
+
+			opts := &options.SessionOptions{
+				Type:   options.CookieSessionStoreType,
+				Cookie: options.CookieStoreOptions{RefreshLock: true},
+				Redis:  options.RedisStoreOptions{ConnectionURL: "redis://" + mr.Addr()},
+			}
+			cookieOpts := &options.Cookie{
+				Name:   "_oauth2_proxy",
+				Path:   "/",
+				Expire: 168 * time.Hour,
+				Secret: "0123456789abcdef0123456789abcdef",
+			}
+			ss, err := NewCookieSessionStore(opts, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			store = ss.(*SessionStore)
+			ctx = context.Background()
+
+			created := time.Now().Add(-time.Hour)
+			loginCookie = httptest.NewRecorder()
+			Expect(store.Save(loginCookie, httptest.NewRequest("", "/", nil), &sessionsapi.SessionState{
+				Email:        "john@example.com",
+				AccessToken:  "AccessToken",
+				RefreshToken: "RefreshToken",
+				CreatedAt:    &created,
+			})).To(Succeed())
+		})
+
+		AfterEach(func() {
+			mr.Close()
+		})
+
+		requestWithCookies := func(rw *httptest.ResponseRecorder) *http.Request {
+			req := httptest.NewRequest("", "/", nil)
+			for _, c := range rw.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			return req
+		}
+
+		It("locks the refreshes of the session across requests", func() {
+			first, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+			second, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(first.ObtainLock(ctx, time.Second)).To(Succeed())
+			Expect(second.ObtainLock(ctx, time.Second)).To(Equal(sessionsapi.ErrLockNotObtained))
+			Expect(first.ReleaseLock(ctx)).To(Succeed())
+			Expect(second.ObtainLock(ctx, time.Second)).To(Succeed())
+		})
+
+		It("loads the refreshed session for the requests with the cookie of the session before the refresh", func() {
+			session, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.ObtainLock(ctx, time.Second)).To(Succeed())
+
+			session.AccessToken = "RefreshedAccessToken"
+			session.RefreshToken = "RotatedRefreshToken"
+			session.CreatedAtNow()
+			Expect(store.Save(httptest.NewRecorder(), httptest.NewRequest("", "/", nil), session)).To(Succeed())
+			Expect(session.ReleaseLock(ctx)).To(Succeed())
+
+			reloaded, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reloaded.AccessToken).To(Equal("RefreshedAccessToken"))
+			Expect(reloaded.RefreshToken).To(Equal("RotatedRefreshToken"))
+
+			keys := mr.Keys()
+			Expect(keys).To(HaveLen(1))
+			Expect(keys[0]).To(HaveSuffix(".refreshed"))
+			Expect(mr.TTL(keys[0])).To(Equal(refreshedSessionTTL))
+
+			mr.FastForward(refreshedSessionTTL)
+			expired, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expired.RefreshToken).To(Equal("RefreshToken"))
+		})
+
+		It("doesn't publish sessions saved without a refresh", func() {
+			session, err := store.Load(requestWithCookies(loginCookie))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Save(httptest.NewRecorder(), httptest.NewRequest("", "/", nil), session)).To(Succeed())
+			Expect(mr.Keys()).To(BeEmpty())
+		})
+	})
 })
 
 func Test_copyCookie(t *testing.T) {
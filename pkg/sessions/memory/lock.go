@@ -0,0 +1,84 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// Lock is a lock on a session in a memory SessionStore.
+// Only the Lock that obtained the lock may refresh or release it.
+type Lock struct {
+	store *SessionStore
+	key   string
+}
+
+// lockEntry is an obtained lock with its expiry
+type lockEntry struct {
+	holder  *Lock
+	expires time.Time
+}
+
+// Obtain obtains the lock for the key, unless another Lock holds it.
+func (l *Lock) Obtain(_ context.Context, expiration time.Duration) error {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	if held := l.held(); held != nil && held.holder != l {
+		return sessions.ErrLockNotObtained
+	}
+	l.store.locks[l.key] = &lockEntry{
+		holder:  l,
+		expires: l.store.clock.Now().Add(expiration),
+	}
+	return nil
+}
+
+// Refresh extends the expiry of the lock held by this Lock.
+func (l *Lock) Refresh(_ context.Context, expiration time.Duration) error {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	held := l.held()
+	if held == nil || held.holder != l {
+		return sessions.ErrNotLocked
+	}
+	held.expires = l.store.clock.Now().Add(expiration)
+	return nil
+}
+
+// Peek returns true, if the lock is still applied.
+func (l *Lock) Peek(_ context.Context) (bool, error) {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	return l.held() != nil, nil
+}
+
+// Release releases the lock held by this Lock.
+func (l *Lock) Release(_ context.Context) error {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	held := l.held()
+	if held == nil || held.holder != l {
+		return sessions.ErrNotLocked
+	}
+	delete(l.store.locks, l.key)
+	return nil
+}
+
+// held returns the unexpired lock for the key, removing it once it expires.
+// The store must be locked.
+func (l *Lock) held() *lockEntry {
+	held, ok := l.store.locks[l.key]
+	if !ok {
+		return nil
+	}
+	if !l.store.clock.Now().Before(held.expires) {
+		delete(l.store.locks, l.key)
+		return nil
+	}
+	return held
+}
@@ -0,0 +1,222 @@
+package memory
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SessionStore is an implementation of the persistence.Store
+// interface that stores sessions in memory.
+// Sessions are lost when the process restarts and aren't shared between
+// replicas, so it is only suitable for testing and ephemeral deployments.
+type SessionStore struct {
+	maxEntries int
+
+	// entries holds the *entry values, ordered from most to least recently used
+	entries *list.List
+	keys    map[string]*list.Element
+	locks   map[string]*lockEntry
+	// indexes holds the creation time of the session keys of each user index
+	indexes map[string]map[string]time.Time
+	mu      sync.Mutex
+
+	metrics *storeMetrics
+	clock   clock.Clock
+}
+
+// entry is a session stored with its expiry
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemorySessionStore initialises a new instance of the SessionStore and
+// wraps it in a persistence.Manager
+func NewMemorySessionStore(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessions.SessionStore, error) {
+	ms, err := newSessionStore(opts.Memory, prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("WARNING: Sessions are stored in memory: they are lost when OAuth2 Proxy restarts and are not shared between replicas. Use a redis session store for production.")
+	manager, err := persistence.NewManager(ms, opts, cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+func newSessionStore(opts options.MemoryStoreOptions, registerer prometheus.Registerer) (*SessionStore, error) {
+	if opts.MaxEntries <= 0 {
+		return nil, fmt.Errorf("memory_store_max_entries must be greater than 0, got %d", opts.MaxEntries)
+	}
+
+	return &SessionStore{
+		maxEntries: opts.MaxEntries,
+		entries:    list.New(),
+		keys:       map[string]*list.Element{},
+		locks:      map[string]*lockEntry{},
+		indexes:    map[string]map[string]time.Time{},
+		metrics:    newStoreMetrics(registerer),
+	}, nil
+}
+
+// Save stores the encrypted session under the key until it expires, evicting
+// the least recently used sessions if the store is full
+func (store *SessionStore) Save(_ context.Context, key string, value []byte, exp time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	e := &entry{
+		key:     key,
+		value:   value,
+		expires: store.clock.Now().Add(exp),
+	}
+	if elem, ok := store.keys[key]; ok {
+		elem.Value = e
+		store.entries.MoveToFront(elem)
+		return nil
+	}
+
+	if store.entries.Len() >= store.maxEntries {
+		store.removeExpired()
+	}
+	for store.entries.Len() >= store.maxEntries {
+		store.remove(store.entries.Back())
+		store.metrics.evictions.Inc()
+	}
+	store.keys[key] = store.entries.PushFront(e)
+	store.metrics.entries.Set(float64(store.entries.Len()))
+	return nil
+}
+
+// Load reads the encrypted session stored under the key
+func (store *SessionStore) Load(_ context.Context, key string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	elem, ok := store.keys[key]
+	if !ok {
+		return nil, errors.New("error loading memory session: session not found")
+	}
+	e := elem.Value.(*entry)
+	if !store.clock.Now().Before(e.expires) {
+		store.remove(elem)
+		store.metrics.entries.Set(float64(store.entries.Len()))
+		return nil, errors.New("error loading memory session: session expired")
+	}
+
+	store.entries.MoveToFront(elem)
+	return e.value, nil
+}
+
+// Clear removes the session stored under the key
+func (store *SessionStore) Clear(_ context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if elem, ok := store.keys[key]; ok {
+		store.remove(elem)
+		store.metrics.entries.Set(float64(store.entries.Len()))
+	}
+	return nil
+}
+
+// Lock creates a lock object for sessions.SessionState
+func (store *SessionStore) Lock(key string) sessions.Lock {
+	return &Lock{
+		store: store,
+		key:   key,
+	}
+}
+
+// AddToIndex adds the session key to the user index. The index is kept as
+// long as it has sessions, so the expiration is unused.
+func (store *SessionStore) AddToIndex(_ context.Context, index string, key string, created time.Time, _ time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	keys, ok := store.indexes[index]
+	if !ok {
+		keys = map[string]time.Time{}
+		store.indexes[index] = keys
+	}
+	keys[key] = created
+	return nil
+}
+
+// IndexedKeys returns the session keys of the user index from the oldest
+// session, removing the keys of the sessions that expired or were evicted
+func (store *SessionStore) IndexedKeys(_ context.Context, index string) ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	keys := store.indexes[index]
+	now := store.clock.Now()
+	indexed := []string{}
+	for key := range keys {
+		elem, ok := store.keys[key]
+		if !ok || !now.Before(elem.Value.(*entry).expires) {
+			delete(keys, key)
+			continue
+		}
+		indexed = append(indexed, key)
+	}
+	if len(keys) == 0 {
+		delete(store.indexes, index)
+	}
+
+	sort.Slice(indexed, func(i, j int) bool {
+		return keys[indexed[i]].Before(keys[indexed[j]])
+	})
+	return indexed, nil
+}
+
+// RemoveFromIndex removes the session keys from the user index
+func (store *SessionStore) RemoveFromIndex(_ context.Context, index string, keys ...string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, key := range keys {
+		delete(store.indexes[index], key)
+	}
+	if len(store.indexes[index]) == 0 {
+		delete(store.indexes, index)
+	}
+	return nil
+}
+
+// removeExpired removes every expired session and lock from the store
+func (store *SessionStore) removeExpired() {
+	now := store.clock.Now()
+	for elem := store.entries.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*entry).expires) {
+			store.remove(elem)
+		}
+		elem = prev
+	}
+	for key, held := range store.locks {
+		if !now.Before(held.expires) {
+			delete(store.locks, key)
+		}
+	}
+}
+
+func (store *SessionStore) remove(elem *list.Element) {
+	store.entries.Remove(elem)
+	delete(store.keys, elem.Value.(*entry).key)
+}
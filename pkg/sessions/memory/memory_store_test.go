@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/tests"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSessionStore(t *testing.T) {
+	logger.SetOutput(GinkgoWriter)
+	logger.SetErrOutput(GinkgoWriter)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Memory SessionStore")
+}
+
+var _ = Describe("Memory SessionStore Tests", func() {
+	var ms *SessionStore
+
+	tests.RunSessionStoreTests(
+		func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+			opts.Type = options.MemorySessionStoreType
+			opts.Memory.MaxEntries = 100
+
+			ss, err := NewMemorySessionStore(opts, cookieOpts)
+			if err != nil {
+				return nil, err
+			}
+
+			// Capture the store so that we can move its clock forward
+			ms = ss.(*persistence.Manager).Store.(*SessionStore)
+			ms.clock.Set(time.Now())
+			return ss, nil
+		},
+		func(d time.Duration) error {
+			return ms.clock.Add(d)
+		},
+	)
+
+	Context("with a full store", func() {
+		var ctx context.Context
+
+		BeforeEach(func() {
+			ctx = context.Background()
+
+			var err error
+			ms, err = newSessionStore(options.MemoryStoreOptions{MaxEntries: 3}, prometheus.NewRegistry())
+			Expect(err).ToNot(HaveOccurred())
+			ms.clock.Set(time.Now())
+
+			Expect(ms.Save(ctx, "a", []byte("a"), time.Hour)).To(Succeed())
+			Expect(ms.Save(ctx, "b", []byte("b"), time.Minute)).To(Succeed())
+			Expect(ms.Save(ctx, "c", []byte("c"), time.Hour)).To(Succeed())
+			Expect(testutil.ToFloat64(ms.metrics.entries)).To(Equal(float64(3)))
+		})
+
+		It("evicts the least recently used session", func() {
+			_, err := ms.Load(ctx, "a")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ms.Save(ctx, "d", []byte("d"), time.Hour)).To(Succeed())
+
+			_, err = ms.Load(ctx, "b")
+			Expect(err).To(MatchError("error loading memory session: session not found"))
+			for _, key := range []string{"a", "c", "d"} {
+				value, err := ms.Load(ctx, key)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal([]byte(key)))
+			}
+			Expect(testutil.ToFloat64(ms.metrics.entries)).To(Equal(float64(3)))
+			Expect(testutil.ToFloat64(ms.metrics.evictions)).To(Equal(float64(1)))
+		})
+
+		It("removes expired sessions before evicting any", func() {
+			Expect(ms.clock.Add(2 * time.Minute)).To(Succeed())
+
+			Expect(ms.Save(ctx, "d", []byte("d"), time.Hour)).To(Succeed())
+
+			_, err := ms.Load(ctx, "b")
+			Expect(err).To(HaveOccurred())
+			for _, key := range []string{"a", "c", "d"} {
+				_, err := ms.Load(ctx, key)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(testutil.ToFloat64(ms.metrics.evictions)).To(Equal(float64(0)))
+		})
+
+		It("replaces an existing session without evicting any", func() {
+			Expect(ms.Save(ctx, "a", []byte("updated"), time.Hour)).To(Succeed())
+
+			value, err := ms.Load(ctx, "a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal([]byte("updated")))
+			Expect(testutil.ToFloat64(ms.metrics.entries)).To(Equal(float64(3)))
+			Expect(testutil.ToFloat64(ms.metrics.evictions)).To(Equal(float64(0)))
+		})
+
+		It("doesn't load an expired session", func() {
+			Expect(ms.clock.Add(2 * time.Minute)).To(Succeed())
+
+			_, err := ms.Load(ctx, "b")
+			Expect(err).To(MatchError("error loading memory session: session expired"))
+			Expect(testutil.ToFloat64(ms.metrics.entries)).To(Equal(float64(2)))
+		})
+	})
+
+	Context("with a lock", func() {
+		It("can't be obtained, refreshed or released by another lock", func() {
+			var err error
+			ms, err = newSessionStore(options.MemoryStoreOptions{MaxEntries: 3}, prometheus.NewRegistry())
+			Expect(err).ToNot(HaveOccurred())
+			ctx := context.Background()
+
+			lock := ms.Lock("a")
+			other := ms.Lock("a")
+			Expect(lock.Obtain(ctx, time.Minute)).To(Succeed())
+
+			Expect(other.Obtain(ctx, time.Minute)).To(MatchError(sessionsapi.ErrLockNotObtained))
+			Expect(other.Refresh(ctx, time.Minute)).To(MatchError(sessionsapi.ErrNotLocked))
+			Expect(other.Release(ctx)).To(MatchError(sessionsapi.ErrNotLocked))
+			Expect(other.Peek(ctx)).To(BeTrue())
+
+			Expect(lock.Release(ctx)).To(Succeed())
+			Expect(other.Obtain(ctx, time.Minute)).To(Succeed())
+		})
+	})
+
+	It("requires a maximum number of entries", func() {
+		_, err := newSessionStore(options.MemoryStoreOptions{}, prometheus.NewRegistry())
+		Expect(err).To(MatchError("memory_store_max_entries must be greater than 0, got 0"))
+	})
+
+	Context("with user indexes", func() {
+		var ctx context.Context
+
+		BeforeEach(func() {
+			ctx = context.Background()
+
+			var err error
+			ms, err = newSessionStore(options.MemoryStoreOptions{MaxEntries: 3}, prometheus.NewRegistry())
+			Expect(err).ToNot(HaveOccurred())
+			ms.clock.Set(time.Now())
+		})
+
+		It("lists the indexed sessions still in the store from the oldest", func() {
+			now := time.Now()
+			Expect(ms.Save(ctx, "a", []byte("a"), time.Hour)).To(Succeed())
+			Expect(ms.Save(ctx, "b", []byte("b"), time.Minute)).To(Succeed())
+			Expect(ms.Save(ctx, "c", []byte("c"), time.Hour)).To(Succeed())
+			Expect(ms.AddToIndex(ctx, "user", "c", now, time.Hour)).To(Succeed())
+			Expect(ms.AddToIndex(ctx, "user", "a", now.Add(-time.Hour), time.Hour)).To(Succeed())
+			Expect(ms.AddToIndex(ctx, "user", "b", now.Add(-time.Minute), time.Hour)).To(Succeed())
+
+			Expect(ms.IndexedKeys(ctx, "user")).To(Equal([]string{"a", "b", "c"}))
+
+			Expect(ms.clock.Add(2 * time.Minute)).To(Succeed())
+			Expect(ms.Clear(ctx, "c")).To(Succeed())
+			Expect(ms.IndexedKeys(ctx, "user")).To(Equal([]string{"a"}))
+
+			Expect(ms.RemoveFromIndex(ctx, "user", "a")).To(Succeed())
+			Expect(ms.IndexedKeys(ctx, "user")).To(BeEmpty())
+			Expect(ms.indexes).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,31 @@
+package memory
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// storeMetrics records the number of sessions in the memory session store, to
+// catch stores that are too small for the number of users
+type storeMetrics struct {
+	entries   prometheus.Gauge
+	evictions prometheus.Counter
+}
+
+// newStoreMetrics registers the store metrics with the registerer.
+func newStoreMetrics(registerer prometheus.Registerer) *storeMetrics {
+	return &storeMetrics{
+		entries: collector.Register(registerer, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_memory_sessions",
+				Help: "Number of sessions stored in memory.",
+			},
+		)).(prometheus.Gauge),
+		evictions: collector.Register(registerer, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_memory_session_evictions_total",
+				Help: "Total number of unexpired sessions evicted from memory as the store was full.",
+			},
+		)).(prometheus.Counter),
+	}
+}
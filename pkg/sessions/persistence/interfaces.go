@@ -16,3 +16,17 @@ type Store interface {
 	Clear(context.Context, string) error
 	Lock(key string) sessions.Lock
 }
+
+// UserIndex is implemented by persistent Stores that can index the keys of the
+// sessions of each user, so that the concurrent sessions of users can be
+// limited.
+type UserIndex interface {
+	// AddToIndex adds the session key to the index, with the time the session
+	// was created, keeping the index for at least the expiration.
+	AddToIndex(ctx context.Context, index string, key string, created time.Time, exp time.Duration) error
+	// IndexedKeys returns the session keys of the index whose sessions are
+	// still in the store, from the oldest session to the newest.
+	IndexedKeys(ctx context.Context, index string) ([]string, error)
+	// RemoveFromIndex removes the session keys from the index.
+	RemoveFromIndex(ctx context.Context, index string, keys ...string) error
+}
@@ -0,0 +1,156 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption/kms"
+)
+
+// recordSuffix is appended to the key of a session to create the key of its
+// record in the session inventory
+const recordSuffix = ".record"
+
+// ListSessions returns the records of the sessions in the Store, from the
+// oldest session to the newest, when the Manager keeps a session inventory.
+// Sessions whose record is missing, as they were cleared while listing, are
+// left out.
+func (m *Manager) ListSessions(ctx context.Context) ([]sessions.SessionRecord, error) {
+	if !m.Inventory {
+		return nil, errors.New("the session inventory is not kept")
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	keys, err := m.Store.(UserIndex).IndexedKeys(listCtx, m.inventoryIndexKey())
+	if err != nil {
+		return nil, fmt.Errorf("error listing the sessions of the inventory: %v", err)
+	}
+
+	records := make([]sessions.SessionRecord, 0, len(keys))
+	for _, key := range keys {
+		record, err := m.loadSessionRecord(ctx, key)
+		if errors.Is(err, sessions.ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+// RevokeSession removes the session with the ID of its record from the Store,
+// so that it is signed out on every replica sharing the Store
+func (m *Manager) RevokeSession(ctx context.Context, id string) error {
+	if !m.Inventory {
+		return errors.New("the session inventory is not kept")
+	}
+
+	// Only the keys of sessions have a record, so that other keys of the
+	// Store can't be cleared
+	if _, err := m.loadSessionRecord(ctx, id); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return m.clearKey(ctx, id)
+}
+
+// saveSessionRecord saves the record of the session saved with the ticket in
+// the session inventory, expiring along with the session
+func (m *Manager) saveSessionRecord(req *http.Request, tckt *ticket, s *sessions.SessionState) error {
+	if !m.Inventory {
+		return nil
+	}
+
+	expiresOn := time.Now().Add(m.Options.Expire)
+	val, err := json.Marshal(sessions.SessionRecord{
+		ID:                tckt.id,
+		User:              s.User,
+		Email:             s.Email,
+		PreferredUsername: s.PreferredUsername,
+		Groups:            s.Groups,
+		Provider:          s.AuthProvider,
+		CreatedAt:         s.CreatedAt,
+		ExpiresOn:         &expiresOn,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding the record of the session: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+	defer cancel()
+	if m.Envelope != nil {
+		val, err = m.Envelope.Encrypt(ctx, val)
+		if err != nil {
+			return fmt.Errorf("failed to envelope encrypt the record of the session: %w", err)
+		}
+	}
+	if err := m.Store.Save(ctx, tckt.id+recordSuffix, val, m.Options.Expire); err != nil {
+		return fmt.Errorf("error saving the record of the session: %v", err)
+	}
+	if err := m.Store.(UserIndex).AddToIndex(ctx, m.inventoryIndexKey(), tckt.id, *s.CreatedAt, m.Options.Expire); err != nil {
+		return fmt.Errorf("error indexing the record of the session: %v", err)
+	}
+	return nil
+}
+
+// loadSessionRecord loads the record of the session with the key, returning
+// sessions.ErrSessionNotFound when it isn't in the Store
+func (m *Manager) loadSessionRecord(ctx context.Context, key string) (*sessions.SessionRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	val, err := m.Store.Load(ctx, key+recordSuffix)
+	var unavailable *sessions.StoreUnavailableError
+	if errors.As(err, &unavailable) {
+		return nil, fmt.Errorf("error loading the record of the session: %w", err)
+	}
+	if err != nil {
+		return nil, sessions.ErrSessionNotFound
+	}
+	if m.Envelope != nil && kms.IsEnveloped(val) {
+		val, err = m.Envelope.Decrypt(ctx, val)
+		if err != nil {
+			return nil, fmt.Errorf("failed to envelope decrypt the record of the session: %w", err)
+		}
+	}
+
+	record := &sessions.SessionRecord{}
+	if err := json.Unmarshal(val, record); err != nil {
+		return nil, fmt.Errorf("error decoding the record of the session: %v", err)
+	}
+	return record, nil
+}
+
+// clearKey clears the session with the key from the Store, along with its
+// record when the session inventory is kept
+func (m *Manager) clearKey(ctx context.Context, key string) error {
+	if err := m.Store.Clear(ctx, key); err != nil {
+		return err
+	}
+	if !m.Inventory {
+		return nil
+	}
+	if err := m.Store.Clear(ctx, key+recordSuffix); err != nil {
+		return fmt.Errorf("error clearing the record of the session: %v", err)
+	}
+	if err := m.Store.(UserIndex).RemoveFromIndex(ctx, m.inventoryIndexKey(), key); err != nil {
+		return fmt.Errorf("error removing the session from the inventory: %v", err)
+	}
+	return nil
+}
+
+// inventoryIndexKey returns the key of the index of every session of the
+// session inventory
+func (m *Manager) inventoryIndexKey() string {
+	return m.Options.Name + "-inventory"
+}
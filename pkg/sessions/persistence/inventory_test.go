@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/tests"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Inventory Tests", func() {
+	var (
+		ms         *tests.MockStore
+		m          *Manager
+		cookieOpts *options.Cookie
+	)
+
+	BeforeEach(func() {
+		ms = tests.NewMockStore()
+		cookieOpts = &options.Cookie{
+			Name:   "_oauth2_proxy",
+			Path:   "/",
+			Expire: time.Hour,
+			Secret: "0123456789abcdef0123456789abcdef",
+		}
+		var err error
+		m, err = NewManager(ms, &options.SessionOptions{Inventory: true}, cookieOpts)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// login saves a new session, returning a request with its ticket cookie
+	login := func(session *sessionsapi.SessionState) *http.Request {
+		rw := httptest.NewRecorder()
+		loginReq := httptest.NewRequest("GET", "http://example.com/callback", nil)
+		Expect(m.Save(rw, loginReq, session)).To(Succeed())
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	It("lists the records of the sessions", func() {
+		login(&sessionsapi.SessionState{
+			User:         "jane",
+			Email:        "jane@example.com",
+			Groups:       []string{"admins"},
+			AuthProvider: "oidc",
+			AccessToken:  "access-token",
+		})
+		login(&sessionsapi.SessionState{User: "john"})
+
+		records, err := m.ListSessions(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+
+		Expect(records[0].ID).To(HavePrefix("_oauth2_proxy-"))
+		Expect(records[0].User).To(Equal("jane"))
+		Expect(records[0].Email).To(Equal("jane@example.com"))
+		Expect(records[0].Groups).To(Equal([]string{"admins"}))
+		Expect(records[0].Provider).To(Equal("oidc"))
+		Expect(records[0].CreatedAt).ToNot(BeNil())
+		Expect(records[0].ExpiresOn).ToNot(BeNil())
+		Expect(records[1].User).To(Equal("john"))
+	})
+
+	It("revokes sessions by the ID of their record", func() {
+		first := login(&sessionsapi.SessionState{User: "jane"})
+		second := login(&sessionsapi.SessionState{User: "john"})
+
+		records, err := m.ListSessions(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.RevokeSession(context.Background(), records[0].ID)).To(Succeed())
+
+		_, err = m.Load(first)
+		Expect(err).To(HaveOccurred())
+		_, err = m.Load(second)
+		Expect(err).ToNot(HaveOccurred())
+
+		records, err = m.ListSessions(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].User).To(Equal("john"))
+
+		Expect(m.RevokeSession(context.Background(), "_oauth2_proxy-inventory")).To(MatchError(sessionsapi.ErrSessionNotFound))
+	})
+
+	It("removes the records of the sessions that are cleared or expire", func() {
+		req := login(&sessionsapi.SessionState{User: "jane"})
+		Expect(m.Clear(httptest.NewRecorder(), req)).To(Succeed())
+		login(&sessionsapi.SessionState{User: "john"})
+
+		records, err := m.ListSessions(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(1))
+
+		ms.FastForward(2 * time.Hour)
+		records, err = m.ListSessions(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(BeEmpty())
+	})
+
+	It("doesn't keep the inventory unless enabled", func() {
+		m, err := NewManager(ms, &options.SessionOptions{}, cookieOpts)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = m.ListSessions(context.Background())
+		Expect(err).To(MatchError("the session inventory is not kept"))
+		Expect(m.RevokeSession(context.Background(), "_oauth2_proxy-0123")).To(MatchError("the session inventory is not kept"))
+	})
+})
@@ -1,28 +1,99 @@
 package persistence
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption/kms"
 )
 
+// storeTimeout is the maximum time allowed for each operation on the Store.
+// Operations are also abandoned when the request is cancelled.
+const storeTimeout = 5 * time.Second
+
 // Manager wraps a Store and handles the implementation details of the
 // sessions.SessionStore with its use of session tickets
 type Manager struct {
 	Store   Store
 	Options *options.Cookie
+
+	// Envelope envelope encrypts the sessions saved in the Store, if set
+	Envelope *kms.Envelope
+
+	// Bearer is set when tickets are presented as bearer tokens in the
+	// Authorization header, and given to clients in the request scope,
+	// instead of cookies
+	Bearer bool
+
+	// MaxPerUser is the maximum number of concurrent sessions of each user,
+	// tracked in the UserIndex of the Store. 0 means no limit.
+	MaxPerUser int
+
+	// EvictOldest is set when the oldest sessions of a user are removed to
+	// save a new session past the maximum, instead of refusing it
+	EvictOldest bool
+
+	// ProviderSessions is set when sessions are tracked in the UserIndex of
+	// the Store by the provider session of their ID token, so that they can
+	// be cleared by back-channel logout
+	ProviderSessions bool
+
+	// Inventory is set when a record of the user of each session is saved
+	// alongside it, indexed in the UserIndex of the Store, so that the
+	// sessions can be listed and revoked
+	Inventory bool
 }
 
 // NewManager creates a Manager that can wrap a Store and manage the
-// sessions.SessionStore implementation details
-func NewManager(store Store, cookieOpts *options.Cookie) *Manager {
-	return &Manager{
+// sessions.SessionStore implementation details.
+// Sessions are envelope encrypted when a KMS is configured in the options.
+func NewManager(store Store, opts *options.SessionOptions, cookieOpts *options.Cookie) (*Manager, error) {
+	m := &Manager{
 		Store:   store,
 		Options: cookieOpts,
+		Bearer:  opts.BearerTokens,
 	}
+
+	if opts.MaxPerUser > 0 {
+		if _, ok := store.(UserIndex); !ok {
+			return nil, errors.New("the session store can't limit the sessions per user")
+		}
+		m.MaxPerUser = opts.MaxPerUser
+		m.EvictOldest = opts.MaxPerUserPolicy == options.SessionMaxPerUserEvictOldest
+	}
+
+	if opts.BackchannelLogout {
+		if _, ok := store.(UserIndex); !ok {
+			return nil, errors.New("the session store can't track the provider sessions of back-channel logout")
+		}
+		m.ProviderSessions = true
+	}
+
+	if opts.Inventory {
+		if _, ok := store.(UserIndex); !ok {
+			return nil, errors.New("the session store can't keep a session inventory")
+		}
+		m.Inventory = true
+	}
+
+	keys, err := kms.NewKMS(context.Background(), opts.KMS)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing session kms: %v", err)
+	}
+	if keys != nil {
+		m.Envelope = kms.NewEnvelope(keys)
+	}
+	return m, nil
 }
 
 // Save saves a session in a persistent Store. Save will generate (or reuse an
@@ -33,35 +104,72 @@ func (m *Manager) Save(rw http.ResponseWriter, req *http.Request, s *sessions.Se
 		s.CreatedAtNow()
 	}
 
-	tckt, err := decodeTicketFromRequest(req, m.Options)
+	tckt, err := m.decodeTicket(req)
 	if err != nil {
 		tckt, err = newTicket(m.Options)
 		if err != nil {
 			return fmt.Errorf("error creating a session ticket: %v", err)
 		}
+		// Refreshed sessions are already counted in the sessions of the user
+		if err := m.limitUserSessions(req, s); err != nil {
+			return err
+		}
 	}
 
 	err = tckt.saveSession(s, func(key string, val []byte, exp time.Duration) error {
-		return m.Store.Save(req.Context(), key, val, exp)
+		ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+		defer cancel()
+		if m.Envelope != nil {
+			var err error
+			val, err = m.Envelope.Encrypt(ctx, val)
+			if err != nil {
+				return fmt.Errorf("failed to envelope encrypt the session: %w", err)
+			}
+		}
+		return m.Store.Save(ctx, key, val, exp)
 	})
 	if err != nil {
 		return err
 	}
+	if err := m.indexUserSession(req, tckt, s); err != nil {
+		return err
+	}
+	if err := m.indexProviderSession(req, tckt, s); err != nil {
+		return err
+	}
+	if err := m.saveSessionRecord(req, tckt, s); err != nil {
+		return err
+	}
 
+	if m.Bearer {
+		return tckt.setBearerToken(req, s)
+	}
 	return tckt.setCookie(rw, req, s)
 }
 
 // Load reads sessions.SessionState information from a session store. It will
 // use the session ticket from the http.Request's cookie.
 func (m *Manager) Load(req *http.Request) (*sessions.SessionState, error) {
-	tckt, err := decodeTicketFromRequest(req, m.Options)
+	tckt, err := m.decodeTicket(req)
 	if err != nil {
 		return nil, err
 	}
 
 	return tckt.loadSession(
 		func(key string) ([]byte, error) {
-			return m.Store.Load(req.Context(), key)
+			ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+			defer cancel()
+			val, err := m.Store.Load(ctx, key)
+			// Sessions saved before envelope encryption was enabled are
+			// loaded as they are, and envelope encrypted when next saved
+			if err != nil || m.Envelope == nil || !kms.IsEnveloped(val) {
+				return val, err
+			}
+			val, err = m.Envelope.Decrypt(ctx, val)
+			if err != nil {
+				return nil, fmt.Errorf("failed to envelope decrypt the session: %w", err)
+			}
+			return val, nil
 		},
 		m.Store.Lock,
 	)
@@ -70,6 +178,10 @@ func (m *Manager) Load(req *http.Request) (*sessions.SessionState, error) {
 // Clear clears any saved session information for a given ticket cookie.
 // Then it clears all session data for that ticket in the Store.
 func (m *Manager) Clear(rw http.ResponseWriter, req *http.Request) error {
+	if m.Bearer {
+		return m.clearBearer(req)
+	}
+
 	tckt, err := decodeTicketFromRequest(req, m.Options)
 	if err != nil {
 		// Always clear the cookie, even when we can't load a cookie from
@@ -87,6 +199,220 @@ func (m *Manager) Clear(rw http.ResponseWriter, req *http.Request) error {
 
 	tckt.clearCookie(rw, req)
 	return tckt.clearSession(func(key string) error {
-		return m.Store.Clear(req.Context(), key)
+		ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+		defer cancel()
+		return m.clearKey(ctx, key)
+	})
+}
+
+// clearBearer clears all session data for the ticket of the request's bearer
+// token in the Store. There is no cookie to clear.
+func (m *Manager) clearBearer(req *http.Request) error {
+	tckt, err := decodeTicketFromBearer(req, m.Options)
+	if err == http.ErrNoCookie {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding ticket to clear session: %v", err)
+	}
+	return tckt.clearSession(func(key string) error {
+		ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+		defer cancel()
+		return m.clearKey(ctx, key)
 	})
 }
+
+// decodeTicket decodes the ticket of the request, from its bearer token or
+// from its cookie
+func (m *Manager) decodeTicket(req *http.Request) (*ticket, error) {
+	if m.Bearer {
+		return decodeTicketFromBearer(req, m.Options)
+	}
+	return decodeTicketFromRequest(req, m.Options)
+}
+
+// CountUserSessions returns the number of sessions the user of the session has
+// in the Store, when the sessions per user are limited
+func (m *Manager) CountUserSessions(ctx context.Context, s *sessions.SessionState) (int, error) {
+	index, ok := m.userIndexKey(s)
+	if !ok {
+		return 0, errors.New("the sessions of the user are not tracked")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	keys, err := m.Store.(UserIndex).IndexedKeys(ctx, index)
+	if err != nil {
+		return 0, fmt.Errorf("error listing the sessions of the user: %v", err)
+	}
+	return len(keys), nil
+}
+
+// limitUserSessions checks that the user of a new session has fewer sessions
+// than the maximum. Otherwise sessions.ErrTooManySessions is returned, or the
+// oldest sessions of the user are removed to make room for the new session,
+// which are counted in the request scope.
+func (m *Manager) limitUserSessions(req *http.Request, s *sessions.SessionState) error {
+	index, ok := m.userIndexKey(s)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+	defer cancel()
+	userIndex := m.Store.(UserIndex)
+	keys, err := userIndex.IndexedKeys(ctx, index)
+	if err != nil {
+		return fmt.Errorf("error listing the sessions of the user: %v", err)
+	}
+	excess := len(keys) - m.MaxPerUser + 1
+	if excess <= 0 {
+		return nil
+	}
+	if !m.EvictOldest {
+		return sessions.ErrTooManySessions
+	}
+
+	evicted := keys[:excess]
+	for _, key := range evicted {
+		if err := m.Store.Clear(ctx, key); err != nil {
+			return fmt.Errorf("error evicting a session of the user: %v", err)
+		}
+	}
+	if err := userIndex.RemoveFromIndex(ctx, index, evicted...); err != nil {
+		return fmt.Errorf("error removing evicted sessions of the user: %v", err)
+	}
+	if scope := middlewareapi.GetRequestScope(req); scope != nil {
+		scope.EvictedSessions += len(evicted)
+	}
+	return nil
+}
+
+// indexUserSession adds the session saved with the ticket to the sessions of
+// its user
+func (m *Manager) indexUserSession(req *http.Request, tckt *ticket, s *sessions.SessionState) error {
+	index, ok := m.userIndexKey(s)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+	defer cancel()
+	if err := m.Store.(UserIndex).AddToIndex(ctx, index, tckt.id, *s.CreatedAt, m.Options.Expire); err != nil {
+		return fmt.Errorf("error indexing the session of the user: %v", err)
+	}
+	return nil
+}
+
+// userIndexKey returns the key of the index of the sessions of the session's
+// user, from its hashed email or user name. Sessions are only indexed when the
+// sessions per user are limited, and sessions without a user never are.
+func (m *Manager) userIndexKey(s *sessions.SessionState) (string, bool) {
+	user := s.Email
+	if user == "" {
+		user = s.User
+	}
+	if m.MaxPerUser == 0 || user == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%s-users-%x", m.Options.Name, sha256.Sum256([]byte(user))), true
+}
+
+// ClearProviderSessions removes the sessions of the provider session with the
+// session ID, or all sessions of the subject when the session ID is empty,
+// returning the number of sessions removed
+func (m *Manager) ClearProviderSessions(ctx context.Context, issuer, subject, sessionID string) (int, error) {
+	if !m.ProviderSessions {
+		return 0, errors.New("the provider sessions are not tracked")
+	}
+
+	index := m.providerSubjectIndexKey(issuer, subject)
+	if sessionID != "" {
+		index = m.providerSessionIndexKey(issuer, sessionID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	userIndex := m.Store.(UserIndex)
+	keys, err := userIndex.IndexedKeys(ctx, index)
+	if err != nil {
+		return 0, fmt.Errorf("error listing the sessions of the provider session: %v", err)
+	}
+	for _, key := range keys {
+		if err := m.Store.Clear(ctx, key); err != nil {
+			return 0, fmt.Errorf("error clearing a session of the provider session: %v", err)
+		}
+	}
+	if err := userIndex.RemoveFromIndex(ctx, index, keys...); err != nil {
+		return 0, fmt.Errorf("error removing the cleared sessions of the provider session: %v", err)
+	}
+	return len(keys), nil
+}
+
+// indexProviderSession adds the session saved with the ticket to the sessions
+// of its provider session and of its subject, when the provider sessions are
+// tracked. Sessions without an ID token, or whose ID token has no issuer,
+// can't be signed out by the provider and are not indexed.
+func (m *Manager) indexProviderSession(req *http.Request, tckt *ticket, s *sessions.SessionState) error {
+	if !m.ProviderSessions || s.IDToken == "" {
+		return nil
+	}
+	claims, err := parseIDTokenClaims(s.IDToken)
+	if err != nil || claims.Issuer == "" {
+		return nil
+	}
+
+	indexes := []string{}
+	if claims.Subject != "" {
+		indexes = append(indexes, m.providerSubjectIndexKey(claims.Issuer, claims.Subject))
+	}
+	if claims.SessionID != "" {
+		indexes = append(indexes, m.providerSessionIndexKey(claims.Issuer, claims.SessionID))
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), storeTimeout)
+	defer cancel()
+	for _, index := range indexes {
+		if err := m.Store.(UserIndex).AddToIndex(ctx, index, tckt.id, *s.CreatedAt, m.Options.Expire); err != nil {
+			return fmt.Errorf("error indexing the provider session of the session: %v", err)
+		}
+	}
+	return nil
+}
+
+// providerSubjectIndexKey returns the key of the index of the sessions of the
+// subject of the issuer
+func (m *Manager) providerSubjectIndexKey(issuer, subject string) string {
+	return fmt.Sprintf("%s-subjects-%x", m.Options.Name, sha256.Sum256([]byte(issuer+"\x00"+subject)))
+}
+
+// providerSessionIndexKey returns the key of the index of the sessions of the
+// provider session of the issuer
+func (m *Manager) providerSessionIndexKey(issuer, sessionID string) string {
+	return fmt.Sprintf("%s-sids-%x", m.Options.Name, sha256.Sum256([]byte(issuer+"\x00"+sessionID)))
+}
+
+// idTokenClaims are the claims of an ID token identifying its provider session
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+}
+
+// parseIDTokenClaims parses the claims of the ID token of a session without
+// verifying it, as it was verified when the session was created
+func parseIDTokenClaims(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %v", err)
+	}
+	claims := &idTokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	return claims, nil
+}
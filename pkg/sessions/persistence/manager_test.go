@@ -1,12 +1,19 @@
 package persistence
 
 import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption/kms"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/tests"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Persistence Manager Tests", func() {
@@ -15,11 +22,383 @@ var _ = Describe("Persistence Manager Tests", func() {
 		ms = tests.NewMockStore()
 	})
 	tests.RunSessionStoreTests(
-		func(_ *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
-			return NewManager(ms, cookieOpts), nil
+		func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+			return NewManager(ms, opts, cookieOpts)
 		},
 		func(d time.Duration) error {
 			ms.FastForward(d)
 			return nil
 		})
+
+	Context("with envelope encryption", func() {
+		tests.RunSessionStoreTests(
+			func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+				opts.KMS = options.KMSOptions{
+					Type: options.LocalKMSType,
+					Key:  "0123456789abcdefghijklmnopqrstuv",
+				}
+				return NewManager(ms, opts, cookieOpts)
+			},
+			func(d time.Duration) error {
+				ms.FastForward(d)
+				return nil
+			})
+	})
+
+	Context("migrating to envelope encryption", func() {
+		const (
+			oldKey = "0123456789abcdef0123456789abcdef"
+			newKey = "fedcba9876543210fedcba9876543210"
+		)
+
+		var cookieOpts *options.Cookie
+
+		BeforeEach(func() {
+			cookieOpts = &options.Cookie{
+				Name:   "_oauth2_proxy",
+				Path:   "/",
+				Expire: time.Hour,
+				Secret: "0123456789abcdef0123456789abcdef",
+			}
+		})
+
+		newManager := func(keys ...string) *Manager {
+			m := &Manager{Store: ms, Options: cookieOpts}
+			if len(keys) > 0 {
+				rawKeys := [][]byte{}
+				for _, key := range keys {
+					rawKeys = append(rawKeys, []byte(key))
+				}
+				local, err := kms.NewLocalKMS(rawKeys...)
+				Expect(err).ToNot(HaveOccurred())
+				m.Envelope = kms.NewEnvelope(local)
+			}
+			return m
+		}
+
+		// save saves the session, returning a request with the ticket cookie
+		save := func(m *Manager, req *http.Request, session *sessionsapi.SessionState) *http.Request {
+			rw := httptest.NewRecorder()
+			Expect(m.Save(rw, req, session)).To(Succeed())
+
+			next := httptest.NewRequest("GET", "http://example.com/", nil)
+			for _, cookie := range rw.Result().Cookies() {
+				next.AddCookie(cookie)
+			}
+			return next
+		}
+
+		// stored returns the value stored for the ticket of the request
+		stored := func(req *http.Request) []byte {
+			tckt, err := decodeTicketFromRequest(req, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			val, err := ms.Load(context.Background(), tckt.id)
+			Expect(err).ToNot(HaveOccurred())
+			return val
+		}
+
+		It("envelope encrypts sessions saved before it was enabled when they are next saved", func() {
+			req := save(newManager(), httptest.NewRequest("GET", "http://example.com/", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+			Expect(kms.IsEnveloped(stored(req))).To(BeFalse())
+
+			m := newManager(oldKey)
+			session, err := m.Load(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Email).To(Equal("user@example.com"))
+
+			req = save(m, req, session)
+			Expect(kms.IsEnveloped(stored(req))).To(BeTrue())
+
+			session, err = m.Load(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Email).To(Equal("user@example.com"))
+		})
+
+		It("re-wraps sessions with the current key when they are next saved", func() {
+			req := save(newManager(oldKey), httptest.NewRequest("GET", "http://example.com/", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+
+			rotated := newManager(newKey, oldKey)
+			session, err := rotated.Load(req)
+			Expect(err).ToNot(HaveOccurred())
+			req = save(rotated, req, session)
+
+			// The old key is no longer needed to load the session
+			session, err = newManager(newKey).Load(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Email).To(Equal("user@example.com"))
+		})
+
+		It("fails to load sessions wrapped with an unknown key", func() {
+			req := save(newManager(oldKey), httptest.NewRequest("GET", "http://example.com/", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+
+			_, err := newManager(newKey).Load(req)
+			Expect(err).To(MatchError(ContainSubstring("failed to envelope decrypt the session: unknown local kms key")))
+		})
+	})
+
+	Context("with a maximum of sessions per user", func() {
+		var cookieOpts *options.Cookie
+
+		BeforeEach(func() {
+			cookieOpts = &options.Cookie{
+				Name:   "_oauth2_proxy",
+				Path:   "/",
+				Expire: time.Hour,
+				Secret: "0123456789abcdef0123456789abcdef",
+			}
+		})
+
+		newManager := func(policy string) *Manager {
+			m, err := NewManager(ms, &options.SessionOptions{MaxPerUser: 2, MaxPerUserPolicy: policy}, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			return m
+		}
+
+		// login saves a new session of the user created at the time, returning
+		// a request with its ticket cookie and the request scope of the login
+		login := func(m *Manager, email string, created time.Time) (*http.Request, *middlewareapi.RequestScope, error) {
+			scope := &middlewareapi.RequestScope{}
+			loginReq := middlewareapi.AddRequestScope(httptest.NewRequest("GET", "http://example.com/callback", nil), scope)
+			rw := httptest.NewRecorder()
+			err := m.Save(rw, loginReq, &sessionsapi.SessionState{Email: email, CreatedAt: &created})
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			return req, scope, err
+		}
+
+		It("refuses new sessions past the maximum", func() {
+			m := newManager(options.SessionMaxPerUserRejectNew)
+			now := time.Now()
+			first, _, err := login(m, "user@example.com", now.Add(-2*time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = login(m, "user@example.com", now.Add(-time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = login(m, "user@example.com", now)
+			Expect(err).To(Equal(sessionsapi.ErrTooManySessions))
+
+			// Other users and refreshed sessions aren't limited
+			_, _, err = login(m, "other@example.com", now)
+			Expect(err).ToNot(HaveOccurred())
+			session, err := m.Load(first)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Save(httptest.NewRecorder(), first, session)).To(Succeed())
+
+			count, err := m.CountUserSessions(context.Background(), session)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(2))
+		})
+
+		It("evicts the oldest sessions past the maximum", func() {
+			m := newManager(options.SessionMaxPerUserEvictOldest)
+			now := time.Now()
+			first, _, err := login(m, "user@example.com", now.Add(-2*time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			second, _, err := login(m, "user@example.com", now.Add(-time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+
+			third, scope, err := login(m, "user@example.com", now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scope.EvictedSessions).To(Equal(1))
+
+			_, err = m.Load(first)
+			Expect(err).To(HaveOccurred())
+			for _, req := range []*http.Request{second, third} {
+				_, err = m.Load(req)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("counts the sessions that are still in the store", func() {
+			m := newManager(options.SessionMaxPerUserRejectNew)
+			req, _, err := login(m, "user@example.com", time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Clear(httptest.NewRecorder(), req)).To(Succeed())
+
+			_, _, err = login(m, "user@example.com", time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			count, err := m.CountUserSessions(context.Background(), &sessionsapi.SessionState{Email: "user@example.com"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("doesn't track the sessions without a maximum", func() {
+			m, err := NewManager(ms, &options.SessionOptions{}, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = login(m, "user@example.com", time.Now())
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = m.CountUserSessions(context.Background(), &sessionsapi.SessionState{Email: "user@example.com"})
+			Expect(err).To(MatchError("the sessions of the user are not tracked"))
+		})
+	})
+
+	Context("with back-channel logout", func() {
+		var (
+			m          *Manager
+			cookieOpts *options.Cookie
+		)
+
+		BeforeEach(func() {
+			cookieOpts = &options.Cookie{
+				Name:   "_oauth2_proxy",
+				Path:   "/",
+				Expire: time.Hour,
+				Secret: "0123456789abcdef0123456789abcdef",
+			}
+			var err error
+			m, err = NewManager(ms, &options.SessionOptions{BackchannelLogout: true}, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		// idToken returns an unsigned ID token with the claims, the Manager
+		// doesn't verify the ID tokens of sessions
+		idToken := func(claims string) string {
+			return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+		}
+
+		// login saves a new session with the ID token, returning a request
+		// with its ticket cookie
+		login := func(token string) *http.Request {
+			rw := httptest.NewRecorder()
+			loginReq := httptest.NewRequest("GET", "http://example.com/callback", nil)
+			Expect(m.Save(rw, loginReq, &sessionsapi.SessionState{Email: "user@example.com", IDToken: token})).To(Succeed())
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			for _, cookie := range rw.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			return req
+		}
+
+		It("clears the sessions of a provider session", func() {
+			first := login(idToken(`{"iss":"https://idp.example.com","sub":"user","sid":"first"}`))
+			second := login(idToken(`{"iss":"https://idp.example.com","sub":"user","sid":"second"}`))
+
+			cleared, err := m.ClearProviderSessions(context.Background(), "https://idp.example.com", "user", "first")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(1))
+
+			_, err = m.Load(first)
+			Expect(err).To(HaveOccurred())
+			_, err = m.Load(second)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("clears all sessions of a subject without a session ID", func() {
+			first := login(idToken(`{"iss":"https://idp.example.com","sub":"user","sid":"first"}`))
+			second := login(idToken(`{"iss":"https://idp.example.com","sub":"user"}`))
+			other := login(idToken(`{"iss":"https://other.example.com","sub":"user"}`))
+
+			cleared, err := m.ClearProviderSessions(context.Background(), "https://idp.example.com", "user", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(2))
+
+			for _, req := range []*http.Request{first, second} {
+				_, err = m.Load(req)
+				Expect(err).To(HaveOccurred())
+			}
+			_, err = m.Load(other)
+			Expect(err).ToNot(HaveOccurred())
+
+			cleared, err = m.ClearProviderSessions(context.Background(), "https://idp.example.com", "user", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(0))
+		})
+
+		It("doesn't index sessions without a valid ID token", func() {
+			login("")
+			login("not-a-jwt")
+			login(idToken(`{"sub":"user"}`))
+
+			cleared, err := m.ClearProviderSessions(context.Background(), "", "user", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cleared).To(Equal(0))
+		})
+
+		It("doesn't track the provider sessions unless enabled", func() {
+			m, err := NewManager(ms, &options.SessionOptions{}, cookieOpts)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = m.ClearProviderSessions(context.Background(), "https://idp.example.com", "user", "")
+			Expect(err).To(MatchError("the provider sessions are not tracked"))
+		})
+	})
+
+	Context("with bearer tokens", func() {
+		var m *Manager
+
+		BeforeEach(func() {
+			m = &Manager{
+				Store: ms,
+				Options: &options.Cookie{
+					Name:   "_oauth2_proxy",
+					Path:   "/",
+					Expire: time.Hour,
+					Secret: "0123456789abcdef0123456789abcdef",
+				},
+				Bearer: true,
+			}
+		})
+
+		// save saves the session, returning the response and the session
+		// token of the request scope
+		save := func(req *http.Request, session *sessionsapi.SessionState) (*httptest.ResponseRecorder, string) {
+			scope := &middlewareapi.RequestScope{}
+			rw := httptest.NewRecorder()
+			Expect(m.Save(rw, middlewareapi.AddRequestScope(req, scope), session)).To(Succeed())
+			return rw, scope.SessionToken
+		}
+
+		bearerRequest := func(token string) *http.Request {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req
+		}
+
+		It("gives the ticket as a session token instead of a cookie", func() {
+			rw, token := save(httptest.NewRequest("GET", "http://example.com/callback", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+			Expect(rw.Header().Values("Set-Cookie")).To(BeEmpty())
+			Expect(token).ToNot(BeEmpty())
+
+			session, err := m.Load(bearerRequest(token))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Email).To(Equal("user@example.com"))
+
+			// Refreshed sessions keep their token
+			rw, refreshed := save(bearerRequest(token), session)
+			Expect(rw.Header().Values("Set-Cookie")).To(BeEmpty())
+			Expect(refreshed).To(Equal(token))
+		})
+
+		It("ignores session cookies", func() {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "ticket"})
+			_, err := m.Load(req)
+			Expect(err).To(Equal(http.ErrNoCookie))
+		})
+
+		It("rejects tampered tokens", func() {
+			_, token := save(httptest.NewRequest("GET", "http://example.com/callback", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+			_, err := m.Load(bearerRequest(token + "x"))
+			Expect(err).To(MatchError(ContainSubstring("session ticket bearer token failed validation")))
+		})
+
+		It("clears the session of the token without setting cookies", func() {
+			_, token := save(httptest.NewRequest("GET", "http://example.com/callback", nil), &sessionsapi.SessionState{Email: "user@example.com"})
+
+			rw := httptest.NewRecorder()
+			Expect(m.Clear(rw, bearerRequest(token))).To(Succeed())
+			Expect(rw.Header().Values("Set-Cookie")).To(BeEmpty())
+
+			_, err := m.Load(bearerRequest(token))
+			Expect(err).To(HaveOccurred())
+
+			// Requests without a token have nothing to clear
+			Expect(m.Clear(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))).To(Succeed())
+		})
+	})
 })
@@ -12,12 +12,17 @@ import (
 	"strings"
 	"time"
 
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 )
 
+// bearerPrefix is the prefix of the Authorization header of requests
+// presenting a ticket as a bearer token
+const bearerPrefix = "Bearer "
+
 // saveFunc performs a persistent store's save functionality using
 // a key string, value []byte & (optional) expiration time.Duration
 type saveFunc func(string, []byte, time.Duration) error
@@ -100,15 +105,34 @@ func decodeTicketFromRequest(req *http.Request, cookieOpts *options.Cookie) (*ti
 	}
 
 	// An existing cookie exists, try to retrieve the ticket
-	val, _, ok := encryption.Validate(requestCookie, cookieOpts.Secret, cookieOpts.Expire)
-	if !ok {
-		return nil, fmt.Errorf("session ticket cookie failed validation: %v", err)
+	val, _, err := encryption.ValidateCookie(requestCookie, cookieOpts.Secret, cookieOpts.Expire)
+	if err != nil {
+		return nil, fmt.Errorf("session ticket cookie failed validation: %w", err)
 	}
 
 	// Valid cookie, decode the ticket
 	return decodeTicket(string(val), cookieOpts)
 }
 
+// decodeTicketFromBearer retrieves a potential ticket bearer token from the
+// Authorization header of a request and decodes it to a ticket.
+// http.ErrNoCookie is returned when the request has no bearer token, so that
+// it is handled in the same way as a request without a ticket cookie.
+func decodeTicketFromBearer(req *http.Request, cookieOpts *options.Cookie) (*ticket, error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) <= len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return nil, http.ErrNoCookie
+	}
+
+	// The bearer token is signed like a ticket cookie
+	tokenCookie := &http.Cookie{Name: cookieOpts.Name, Value: strings.TrimSpace(auth[len(bearerPrefix):])}
+	val, _, err := encryption.ValidateCookie(tokenCookie, cookieOpts.Secret, cookieOpts.Expire)
+	if err != nil {
+		return nil, fmt.Errorf("session ticket bearer token failed validation: %w", err)
+	}
+	return decodeTicket(string(val), cookieOpts)
+}
+
 // saveSession encodes the SessionState with the ticket's secret and persists
 // it to disk via the passed saveFunc.
 func (t *ticket) saveSession(s *sessions.SessionState, saver saveFunc) error {
@@ -130,7 +154,12 @@ func (t *ticket) saveSession(s *sessions.SessionState, saver saveFunc) error {
 func (t *ticket) loadSession(loader loadFunc, initLock initLockFunc) (*sessions.SessionState, error) {
 	ciphertext, err := loader(t.id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load the session state with the ticket: %v", err)
+		loadErr := fmt.Errorf("failed to load the session state with the ticket: %v", err)
+		if isStoreUnavailable(err) {
+			// Keep the error distinguishable from a session that wasn't found
+			return nil, &sessions.StoreUnavailableError{Err: loadErr}
+		}
+		return nil, loadErr
 	}
 	c, err := t.makeCipher()
 	if err != nil {
@@ -146,6 +175,13 @@ func (t *ticket) loadSession(loader loadFunc, initLock initLockFunc) (*sessions.
 	return sessionState, nil
 }
 
+// isStoreUnavailable checks whether the error is a
+// sessions.StoreUnavailableError
+func isStoreUnavailable(err error) bool {
+	var unavailable *sessions.StoreUnavailableError
+	return errors.As(err, &unavailable)
+}
+
 // clearSession uses the passed clearFunc to delete a session stored with a
 // key of ticket.id
 func (t *ticket) clearSession(clearer clearFunc) error {
@@ -168,17 +204,38 @@ func (t *ticket) setCookie(rw http.ResponseWriter, req *http.Request, s *session
 	return nil
 }
 
+// setBearerToken sets the signed encoded ticket as the session token of the
+// request scope, for the client to present as a bearer token
+func (t *ticket) setBearerToken(req *http.Request, s *sessions.SessionState) error {
+	token, err := encryption.SignedValue(t.options.Secret, t.options.Name, []byte(t.encodeTicket()), *s.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if scope := middlewareapi.GetRequestScope(req); scope != nil {
+		scope.SessionToken = token
+	}
+	return nil
+}
+
 // clearCookie removes any cookies that would be where this ticket
-// would set them
+// would set them, along with any split cookies left from the cookie session
+// store, from every cookie domain
 func (t *ticket) clearCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, cookies.MakeCookieFromOptions(
-		req,
-		t.options.Name,
-		"",
-		t.options,
-		time.Hour*-1,
-		time.Now(),
-	))
+	clearCookies := cookies.MakeClearCookiesFromOptions(req, t.options.Name, t.options, time.Now())
+	if len(clearCookies) == 0 {
+		// Always clear the ticket cookie, even if it wasn't sent
+		clearCookies = append(clearCookies, cookies.MakeCookieFromOptions(
+			req,
+			t.options.Name,
+			"",
+			t.options,
+			time.Hour*-1,
+			time.Now(),
+		))
+	}
+	for _, c := range clearCookies {
+		http.SetCookie(rw, c)
+	}
 }
 
 // makeCookie makes a cookie, signing the value if present
@@ -204,7 +261,7 @@ func (t *ticket) makeCookie(req *http.Request, value string, expires time.Durati
 func (t *ticket) makeCipher() (encryption.Cipher, error) {
 	c, err := encryption.NewGCMCipher(t.secret)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make an AES-GCM cipher from the ticket secret: %v", err)
+		return nil, fmt.Errorf("failed to make an AES-GCM cipher from the ticket secret: %w", err)
 	}
 	return c, nil
 }
@@ -0,0 +1,223 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// dialerFunc dials connections to redis nodes, the default dialer of go-redis
+// is used when it is nil
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newAddressesClient builds the client for the sentinel or cluster addresses.
+// When the DNSRefreshInterval is set, the client connects to each address the
+// hostnames resolve to instead, and they are resolved again at the interval.
+func newAddressesClient(opts options.RedisStoreOptions, addrs []string, tlsConfig *tls.Config, build func([]string, dialerFunc) Client) (Client, error) {
+	if opts.DNSRefreshInterval <= 0 {
+		return build(addrs, nil), nil
+	}
+
+	c := &resolvingClient{
+		hosts:     addrs,
+		interval:  opts.DNSRefreshInterval,
+		tlsConfig: tlsConfig,
+		lookup:    net.DefaultResolver.LookupHost,
+		build:     build,
+		done:      make(chan struct{}),
+	}
+	if err := c.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// resolvingClient is a Client for the addresses the hostnames of the sentinel
+// or cluster connection URLs resolve to, such as the members of a headless
+// service, rather than for the hostnames themselves.
+// The hostnames are resolved again at the interval, and a new client for the
+// addresses replaces the current one when they change.
+type resolvingClient struct {
+	hosts     []string
+	interval  time.Duration
+	tlsConfig *tls.Config
+	lookup    func(ctx context.Context, host string) ([]string, error)
+	build     func([]string, dialerFunc) Client
+
+	mu     sync.RWMutex
+	addrs  []string
+	client Client
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Client = (*resolvingClient)(nil)
+
+// run resolves the hostnames at the interval until the client is closed
+func (c *resolvingClient) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.refresh(context.Background()); err != nil {
+				logger.Errorf("Error resolving redis addresses, keeping the previous addresses: %v", err)
+			}
+		}
+	}
+}
+
+// refresh resolves the hostnames, and replaces the client when the addresses
+// have changed.
+// The replaced client is closed after the interval, so that commands and locks
+// in use can complete.
+func (c *resolvingClient) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+
+	addrs, serverNames, err := c.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if reflect.DeepEqual(addrs, c.addrs) {
+		c.mu.Unlock()
+		return nil
+	}
+	previous := c.client
+	c.addrs = addrs
+	c.client = c.build(addrs, c.dialer(serverNames))
+	c.mu.Unlock()
+
+	if previous != nil {
+		logger.Printf("Redis addresses changed to %v", addrs)
+		time.AfterFunc(c.interval, func() {
+			if err := previous.Close(); err != nil {
+				logger.Errorf("Error closing the redis client for the previous addresses: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// resolve returns the sorted addresses of the hostnames, and the hostname each
+// address was resolved from.
+// Addresses that are already IP addresses are kept as they are.
+func (c *resolvingClient) resolve(ctx context.Context) ([]string, map[string]string, error) {
+	var addrs []string
+	serverNames := make(map[string]string)
+	for _, hostPort := range c.hosts {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid redis address %q: %v", hostPort, err)
+		}
+		if net.ParseIP(host) != nil {
+			addrs = append(addrs, hostPort)
+			continue
+		}
+
+		ips, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not resolve %q: %v", host, err)
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, port)
+			if _, ok := serverNames[addr]; !ok {
+				addrs = append(addrs, addr)
+				serverNames[addr] = host
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, serverNames, nil
+}
+
+// dialer returns the dialer for the resolved addresses.
+// go-redis verifies TLS certificates against the address it dials, so
+// connections to resolved addresses are verified against their hostname.
+func (c *resolvingClient) dialer(serverNames map[string]string) dialerFunc {
+	if c.tlsConfig == nil || c.tlsConfig.ServerName != "" || len(serverNames) == 0 {
+		return nil
+	}
+
+	// The timeouts of the default go-redis dialer
+	netDialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 5 * time.Minute,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := c.tlsConfig
+		if serverName, ok := serverNames[addr]; ok {
+			config = config.Clone()
+			config.ServerName = serverName
+		}
+		return (&tls.Dialer{NetDialer: netDialer, Config: config}).DialContext(ctx, network, addr)
+	}
+}
+
+// current returns the client for the current addresses
+func (c *resolvingClient) current() Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+func (c *resolvingClient) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.current().Get(ctx, key)
+}
+
+func (c *resolvingClient) Lock(key string) sessions.Lock {
+	return c.current().Lock(key)
+}
+
+func (c *resolvingClient) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return c.current().Set(ctx, key, value, expiration)
+}
+
+func (c *resolvingClient) Del(ctx context.Context, key string) error {
+	return c.current().Del(ctx, key)
+}
+
+func (c *resolvingClient) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.current().Expire(ctx, key, expiration)
+}
+
+func (c *resolvingClient) TTLs(ctx context.Context, keys []string) ([]time.Duration, error) {
+	return c.current().TTLs(ctx, keys)
+}
+
+func (c *resolvingClient) ScanKeys(ctx context.Context, match string, count int64, fn func(keys []string) error) error {
+	return c.current().ScanKeys(ctx, match, count, fn)
+}
+
+func (c *resolvingClient) ZAdd(ctx context.Context, key string, member string, score float64, expiration time.Duration) error {
+	return c.current().ZAdd(ctx, key, member, score, expiration)
+}
+
+func (c *resolvingClient) ZRange(ctx context.Context, key string) ([]string, error) {
+	return c.current().ZRange(ctx, key)
+}
+
+func (c *resolvingClient) ZRem(ctx context.Context, key string, members ...string) error {
+	return c.current().ZRem(ctx, key, members...)
+}
+
+// Close stops resolving the hostnames and closes the current client
+func (c *resolvingClient) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.current().Close()
+}
@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// addressesClient is a Client recording the addresses it was built for
+type addressesClient struct {
+	Client
+	addrs  []string
+	dialer dialerFunc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *addressesClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *addressesClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+var _ = Describe("Resolving Client Tests", func() {
+	var client *resolvingClient
+	var resolved map[string][]string
+	var resolveErr error
+
+	BeforeEach(func() {
+		resolved = map[string][]string{
+			"redis.default.svc.cluster.local": {"10.0.0.2", "10.0.0.1"},
+		}
+		resolveErr = nil
+
+		client = &resolvingClient{
+			hosts:    []string{"redis.default.svc.cluster.local:26379", "10.0.0.9:26379"},
+			interval: 10 * time.Millisecond,
+			lookup: func(_ context.Context, host string) ([]string, error) {
+				return resolved[host], resolveErr
+			},
+			build: func(addrs []string, dialer dialerFunc) Client {
+				return &addressesClient{addrs: addrs, dialer: dialer}
+			},
+			done: make(chan struct{}),
+		}
+		Expect(client.refresh(context.Background())).To(Succeed())
+	})
+
+	It("connects to each address of the hostnames", func() {
+		Expect(client.current().(*addressesClient).addrs).To(Equal([]string{
+			"10.0.0.1:26379",
+			"10.0.0.2:26379",
+			"10.0.0.9:26379",
+		}))
+	})
+
+	It("replaces the client when the addresses change", func() {
+		previous := client.current().(*addressesClient)
+
+		Expect(client.refresh(context.Background())).To(Succeed())
+		Expect(client.current()).To(BeIdenticalTo(previous))
+
+		resolved["redis.default.svc.cluster.local"] = []string{"10.0.0.3"}
+		Expect(client.refresh(context.Background())).To(Succeed())
+		Expect(client.current().(*addressesClient).addrs).To(Equal([]string{"10.0.0.3:26379", "10.0.0.9:26379"}))
+
+		// The previous client is only closed after the interval
+		Expect(previous.isClosed()).To(BeFalse())
+		Eventually(previous.isClosed).Should(BeTrue())
+	})
+
+	It("keeps the client when the hostnames can't be resolved", func() {
+		previous := client.current()
+		resolveErr = errors.New("no such host")
+		Expect(client.refresh(context.Background())).To(MatchError(`could not resolve "redis.default.svc.cluster.local": no such host`))
+		Expect(client.current()).To(BeIdenticalTo(previous))
+	})
+
+	It("verifies TLS connections against the hostnames", func() {
+		Expect(client.current().(*addressesClient).dialer).To(BeNil())
+
+		client.tlsConfig = &tls.Config{}
+		client.addrs = nil
+		Expect(client.refresh(context.Background())).To(Succeed())
+		Expect(client.current().(*addressesClient).dialer).ToNot(BeNil())
+	})
+
+	It("closes the current client", func() {
+		current := client.current().(*addressesClient)
+		Expect(client.Close()).To(Succeed())
+		Expect(current.isClosed()).To(BeTrue())
+		Expect(client.Close()).To(Succeed())
+	})
+})
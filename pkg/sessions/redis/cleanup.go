@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// cleanupScanCount is the number of keys requested from each SCAN call
+	cleanupScanCount = 100
+
+	// cleanupLockKey is appended to the cookie name to create the key locked by
+	// the replica running the cleanup
+	cleanupLockKey = "cleanup"
+
+	// ticketIDLength is the length of the hex encoded ticket IDs used as
+	// session keys
+	ticketIDLength = 32
+)
+
+// The types of keys managed by the cleanup
+const (
+	sessionKeyType = "session"
+	lockKeyType    = "lock"
+	csrfKeyType    = "csrf"
+)
+
+// sessionCleaner periodically scans redis for keys belonging to OAuth2 Proxy
+// that would otherwise never expire.
+// Keys without an expiry are deleted and keys with an expiry beyond their
+// intended lifetime have the expiry shortened to that lifetime.
+// Only one replica cleans up at each interval, whichever obtains the cleanup
+// lock first.
+type sessionCleaner struct {
+	client        Client
+	interval      time.Duration
+	keysPerSecond int
+	cookieName    string
+
+	// lifetimes are the intended lifetimes of each key type.
+	// A lifetime of 0 means keys of the type are not expected to expire.
+	lifetimes map[string]time.Duration
+
+	metrics *cleanupMetrics
+}
+
+// cleanupResult counts the keys found and cleaned up during a cleanup
+type cleanupResult struct {
+	sessions    int
+	csrfEntries int
+	deleted     map[string]int
+	capped      map[string]int
+}
+
+// newSessionCleaner creates a sessionCleaner for the keys saved with the
+// cookie options given.
+func newSessionCleaner(client Client, opts options.RedisStoreOptions, cookieOpts *options.Cookie, registerer prometheus.Registerer) *sessionCleaner {
+	return &sessionCleaner{
+		client:        client,
+		interval:      opts.CleanupInterval,
+		keysPerSecond: opts.CleanupKeysPerSecond,
+		cookieName:    cookieOpts.Name,
+		lifetimes: map[string]time.Duration{
+			sessionKeyType: cookieOpts.Expire,
+			// Locks are only held while a session is refreshed, they should never
+			// outlive the session itself
+			lockKeyType: cookieOpts.Expire,
+			csrfKeyType: cookieOpts.CSRFExpire,
+		},
+		metrics: newCleanupMetrics(registerer),
+	}
+}
+
+// Run cleans up the keys at each interval until the context is cancelled.
+func (c *sessionCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.runOnce(ctx)
+		}
+	}
+}
+
+// runOnce cleans up the keys if no other replica has cleaned them up during
+// this interval.
+func (c *sessionCleaner) runOnce(ctx context.Context) {
+	// The lock is not released once the cleanup is complete, so that it only
+	// runs once per interval across all replicas
+	lock := c.client.Lock(fmt.Sprintf("%s.%s", c.cookieName, cleanupLockKey))
+	err := lock.Obtain(ctx, c.interval)
+	if errors.Is(err, sessions.ErrLockNotObtained) {
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error obtaining redis session cleanup lock: %v", err)
+		return
+	}
+
+	start := time.Now()
+	result, err := c.cleanup(ctx, lock)
+	c.metrics.recordCleanedKeys(result)
+	if err != nil {
+		logger.Errorf("Error cleaning up redis sessions: %v", err)
+		return
+	}
+	// Only complete scans give the number of live keys
+	c.metrics.recordLiveKeys(result)
+	logger.Printf("Cleaned up redis sessions in %s: found %d sessions and %d CSRF entries, deleted %d keys without an expiry, shortened the expiry of %d keys",
+		time.Since(start), result.sessions, result.csrfEntries, sum(result.deleted), sum(result.capped))
+}
+
+// cleanup scans all keys belonging to OAuth2 Proxy, cleaning them up in
+// batches.
+// The scan is rate limited to the configured keys per second and the lock is
+// refreshed after each batch, so that no other replica starts cleaning up while
+// this one is still running.
+func (c *sessionCleaner) cleanup(ctx context.Context, lock sessions.Lock) (*cleanupResult, error) {
+	result := &cleanupResult{
+		deleted: make(map[string]int),
+		capped:  make(map[string]int),
+	}
+
+	// Matches both session keys (name-id) and CSRF keys (name_csrf)
+	match := EscapeGlob(c.cookieName) + "[-_]*"
+	err := c.client.ScanKeys(ctx, match, cleanupScanCount, func(keys []string) error {
+		if err := c.cleanupBatch(ctx, keys, result); err != nil {
+			return err
+		}
+		if err := lock.Refresh(ctx, c.interval); err != nil {
+			return fmt.Errorf("could not refresh cleanup lock: %v", err)
+		}
+		return c.wait(ctx, len(keys))
+	})
+	return result, err
+}
+
+// cleanupBatch checks the TTLs of the keys and cleans up any without an expiry
+// or with an expiry beyond their intended lifetime.
+func (c *sessionCleaner) cleanupBatch(ctx context.Context, keys []string, result *cleanupResult) error {
+	managed := []string{}
+	keyTypes := []string{}
+	for _, key := range keys {
+		if keyType := c.keyType(key); keyType != "" {
+			managed = append(managed, key)
+			keyTypes = append(keyTypes, keyType)
+		}
+	}
+	if len(managed) == 0 {
+		return nil
+	}
+
+	ttls, err := c.client.TTLs(ctx, managed)
+	if err != nil {
+		return fmt.Errorf("could not get key TTLs: %v", err)
+	}
+
+	for i, key := range managed {
+		keyType := keyTypes[i]
+		lifetime := c.lifetimes[keyType]
+		ttl := ttls[i]
+
+		switch {
+		case ttl == -2:
+			// The key expired since it was scanned
+			continue
+		case lifetime == 0:
+			// Keys are saved without an expiry when the lifetime is 0
+		case ttl == -1:
+			if err := c.client.Del(ctx, key); err != nil {
+				return fmt.Errorf("could not delete key %q: %v", key, err)
+			}
+			result.deleted[keyType]++
+			continue
+		case ttl > lifetime:
+			if err := c.client.Expire(ctx, key, lifetime); err != nil {
+				return fmt.Errorf("could not shorten expiry of key %q: %v", key, err)
+			}
+			result.capped[keyType]++
+		}
+
+		switch keyType {
+		case sessionKeyType:
+			result.sessions++
+		case csrfKeyType:
+			result.csrfEntries++
+		}
+	}
+	return nil
+}
+
+// keyType determines the type of a key belonging to OAuth2 Proxy.
+// Keys of any other type, such as the redis health check keys, are ignored.
+func (c *sessionCleaner) keyType(key string) string {
+	if strings.HasPrefix(key, c.cookieName+"_csrf") {
+		return csrfKeyType
+	}
+
+	id := strings.TrimPrefix(key, c.cookieName+"-")
+	if id == key {
+		return ""
+	}
+	keyType := sessionKeyType
+	if strings.HasSuffix(id, "."+LockSuffix) {
+		id = strings.TrimSuffix(id, "."+LockSuffix)
+		keyType = lockKeyType
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != ticketIDLength {
+		return ""
+	}
+	return keyType
+}
+
+// wait rate limits the scan, waiting long enough for the number of keys
+// scanned to be within the keys per second
+func (c *sessionCleaner) wait(ctx context.Context, scanned int) error {
+	timer := time.NewTimer(time.Duration(scanned) * time.Second / time.Duration(c.keysPerSecond))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// EscapeGlob escapes the special characters of a redis glob pattern, so that
+// it only matches the string itself
+func EscapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func sum(counts map[string]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
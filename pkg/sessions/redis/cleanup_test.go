@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Redis Session Cleanup", func() {
+	const (
+		sessionKey      = "_oauth2_proxy-0123456789abcdef0123456789abcdef"
+		otherSessionKey = "_oauth2_proxy-fedcba9876543210fedcba9876543210"
+		lockKey         = "_oauth2_proxy-0123456789abcdef0123456789abcdef.lock"
+		csrfKey         = "_oauth2_proxy_csrf_abcdef"
+		otherCSRFKey    = "_oauth2_proxy_csrf"
+		healthCheckKey  = "_oauth2_proxy-healthcheck-abcdef"
+		unrelatedKey    = "unrelated-0123456789abcdef0123456789abcdef"
+	)
+
+	var mr *miniredis.Miniredis
+	var registry *prometheus.Registry
+	var cleaner *sessionCleaner
+
+	newCleaner := func(client Client) *sessionCleaner {
+		return newSessionCleaner(client, options.RedisStoreOptions{
+			CleanupInterval:      time.Minute,
+			CleanupKeysPerSecond: 1000000,
+		}, &options.Cookie{
+			Name:       "_oauth2_proxy",
+			Expire:     time.Hour,
+			CSRFExpire: 15 * time.Minute,
+		}, registry)
+	}
+
+	BeforeEach(func() {
+		var err error
+		mr, err = miniredis.Run()
+		Expect(err).ToNot(HaveOccurred())
+		registry = prometheus.NewRegistry()
+
+		client, err := NewRedisClient(options.RedisStoreOptions{ConnectionURL: "redis://" + mr.Addr()})
+		Expect(err).ToNot(HaveOccurred())
+		cleaner = newCleaner(client)
+
+		for _, key := range []string{sessionKey, lockKey, otherCSRFKey, healthCheckKey, unrelatedKey} {
+			Expect(mr.Set(key, "value")).To(Succeed())
+		}
+		Expect(mr.Set(otherSessionKey, "value")).To(Succeed())
+		mr.SetTTL(otherSessionKey, 30*time.Minute)
+		Expect(mr.Set(csrfKey, "value")).To(Succeed())
+		mr.SetTTL(csrfKey, 24*time.Hour)
+	})
+
+	AfterEach(func() {
+		mr.Close()
+	})
+
+	It("deletes keys without an expiry and shortens expiries beyond the key lifetime", func() {
+		cleaner.runOnce(context.Background())
+
+		// Session, lock and CSRF keys without an expiry are deleted
+		Expect(mr.Exists(sessionKey)).To(BeFalse())
+		Expect(mr.Exists(lockKey)).To(BeFalse())
+		Expect(mr.Exists(otherCSRFKey)).To(BeFalse())
+
+		// Keys with an expiry within their lifetime are kept
+		Expect(mr.TTL(otherSessionKey)).To(Equal(30 * time.Minute))
+
+		// Keys with an expiry beyond their lifetime are shortened
+		Expect(mr.TTL(csrfKey)).To(Equal(15 * time.Minute))
+
+		// Keys not created by sessions are never touched
+		Expect(mr.Exists(healthCheckKey)).To(BeTrue())
+		Expect(mr.TTL(healthCheckKey)).To(Equal(time.Duration(0)))
+		Expect(mr.Exists(unrelatedKey)).To(BeTrue())
+
+		Expect(testutil.ToFloat64(cleaner.metrics.sessions)).To(Equal(1.0))
+		Expect(testutil.ToFloat64(cleaner.metrics.csrfEntries)).To(Equal(1.0))
+		Expect(testutil.ToFloat64(cleaner.metrics.cleanedKeys.WithLabelValues("session", "deleted"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(cleaner.metrics.cleanedKeys.WithLabelValues("lock", "deleted"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(cleaner.metrics.cleanedKeys.WithLabelValues("csrf", "deleted"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(cleaner.metrics.cleanedKeys.WithLabelValues("csrf", "expiry_shortened"))).To(Equal(1.0))
+	})
+
+	It("only cleans up once per interval across replicas", func() {
+		// Another replica has already cleaned up during this interval
+		Expect(cleaner.client.Lock("_oauth2_proxy.cleanup").Obtain(context.Background(), time.Minute)).To(Succeed())
+
+		cleaner.runOnce(context.Background())
+		Expect(mr.Exists(sessionKey)).To(BeTrue())
+
+		// The lock isn't released, so that the next replica waits for the next interval
+		cleaner.runOnce(context.Background())
+		Expect(mr.Exists(sessionKey)).To(BeTrue())
+
+		mr.FastForward(time.Minute)
+		cleaner.runOnce(context.Background())
+		Expect(mr.Exists(sessionKey)).To(BeFalse())
+	})
+
+	It("keeps keys without an expiry when sessions have no expiry", func() {
+		cleaner.lifetimes[sessionKeyType] = 0
+		cleaner.lifetimes[lockKeyType] = 0
+
+		cleaner.runOnce(context.Background())
+		Expect(mr.Exists(sessionKey)).To(BeTrue())
+		Expect(mr.Exists(lockKey)).To(BeTrue())
+		Expect(testutil.ToFloat64(cleaner.metrics.sessions)).To(Equal(2.0))
+	})
+
+	It("scans every master with a cluster", func() {
+		client, err := NewRedisClient(options.RedisStoreOptions{
+			UseCluster:            true,
+			ClusterConnectionURLs: []string{"redis://" + mr.Addr()},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cleaner = newCleaner(client)
+
+		cleaner.runOnce(context.Background())
+		Expect(mr.Exists(sessionKey)).To(BeFalse())
+		Expect(mr.TTL(csrfKey)).To(Equal(15 * time.Minute))
+		Expect(testutil.ToFloat64(cleaner.metrics.sessions)).To(Equal(1.0))
+	})
+
+	It("escapes glob characters in the cookie name", func() {
+		Expect(EscapeGlob("_oauth2_proxy[*]")).To(Equal(`_oauth2_proxy\[\*\]`))
+	})
+})
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -14,6 +15,13 @@ type Client interface {
 	Lock(key string) sessions.Lock
 	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
 	Del(ctx context.Context, key string) error
+	Expire(ctx context.Context, key string, expiration time.Duration) error
+	TTLs(ctx context.Context, keys []string) ([]time.Duration, error)
+	ScanKeys(ctx context.Context, match string, count int64, fn func(keys []string) error) error
+	ZAdd(ctx context.Context, key string, member string, score float64, expiration time.Duration) error
+	ZRange(ctx context.Context, key string) ([]string, error)
+	ZRem(ctx context.Context, key string, members ...string) error
+	Close() error
 }
 
 var _ Client = (*client)(nil)
@@ -40,6 +48,30 @@ func (c *client) Del(ctx context.Context, key string) error {
 	return c.Client.Del(ctx, key).Err()
 }
 
+func (c *client) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.Client.Expire(ctx, key, expiration).Err()
+}
+
+func (c *client) TTLs(ctx context.Context, keys []string) ([]time.Duration, error) {
+	return getTTLs(ctx, c.Client, keys)
+}
+
+func (c *client) ScanKeys(ctx context.Context, match string, count int64, fn func(keys []string) error) error {
+	return scanKeys(ctx, c.Client, match, count, fn)
+}
+
+func (c *client) ZAdd(ctx context.Context, key string, member string, score float64, expiration time.Duration) error {
+	return zAdd(ctx, c.Client, key, member, score, expiration)
+}
+
+func (c *client) ZRange(ctx context.Context, key string) ([]string, error) {
+	return c.Client.ZRange(ctx, key, 0, -1).Result()
+}
+
+func (c *client) ZRem(ctx context.Context, key string, members ...string) error {
+	return zRem(ctx, c.Client, key, members)
+}
+
 func (c *client) Lock(key string) sessions.Lock {
 	return NewLock(c.Client, key)
 }
@@ -68,6 +100,102 @@ func (c *clusterClient) Del(ctx context.Context, key string) error {
 	return c.ClusterClient.Del(ctx, key).Err()
 }
 
+func (c *clusterClient) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.ClusterClient.Expire(ctx, key, expiration).Err()
+}
+
+func (c *clusterClient) TTLs(ctx context.Context, keys []string) ([]time.Duration, error) {
+	return getTTLs(ctx, c.ClusterClient, keys)
+}
+
+// ScanKeys scans the keys of every master in the cluster.
+// The masters are scanned concurrently, but fn is never called concurrently.
+func (c *clusterClient) ScanKeys(ctx context.Context, match string, count int64, fn func(keys []string) error) error {
+	var mutex sync.Mutex
+	return c.ClusterClient.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		return scanKeys(ctx, master, match, count, func(keys []string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return fn(keys)
+		})
+	})
+}
+
+func (c *clusterClient) ZAdd(ctx context.Context, key string, member string, score float64, expiration time.Duration) error {
+	return zAdd(ctx, c.ClusterClient, key, member, score, expiration)
+}
+
+func (c *clusterClient) ZRange(ctx context.Context, key string) ([]string, error) {
+	return c.ClusterClient.ZRange(ctx, key, 0, -1).Result()
+}
+
+func (c *clusterClient) ZRem(ctx context.Context, key string, members ...string) error {
+	return zRem(ctx, c.ClusterClient, key, members)
+}
+
 func (c *clusterClient) Lock(key string) sessions.Lock {
 	return NewLock(c.ClusterClient, key)
 }
+
+// getTTLs gets the TTLs of all of the keys in a single pipeline.
+// Keys without an expiry have a TTL of -1 and missing keys have a TTL of -2.
+func getTTLs(ctx context.Context, c redis.Cmdable, keys []string) ([]time.Duration, error) {
+	pipe := c.Pipeline()
+	cmds := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.TTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	ttls := make([]time.Duration, len(keys))
+	for i, cmd := range cmds {
+		ttls[i] = cmd.Val()
+	}
+	return ttls, nil
+}
+
+// scanKeys iterates over the keys matching the pattern using the SCAN cursor,
+// calling fn with each page of keys.
+func scanKeys(ctx context.Context, c redis.Cmdable, match string, count int64, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, match, count).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// zAdd adds the member to the sorted set with the score and sets the expiry of
+// the sorted set, in a single transaction.
+func zAdd(ctx context.Context, c redis.Cmdable, key string, member string, score float64, expiration time.Duration) error {
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: member})
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	return err
+}
+
+// zRem removes the members from the sorted set
+func zRem(ctx context.Context, c redis.Cmdable, key string, members []string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return c.ZRem(ctx, key, values...).Err()
+}
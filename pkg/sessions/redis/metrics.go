@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cleanupMetrics records the results of the redis session cleanup
+type cleanupMetrics struct {
+	sessions    prometheus.Gauge
+	csrfEntries prometheus.Gauge
+	cleanedKeys *prometheus.CounterVec
+}
+
+// newCleanupMetrics registers the cleanup metrics with the registerer.
+func newCleanupMetrics(registerer prometheus.Registerer) *cleanupMetrics {
+	return &cleanupMetrics{
+		sessions: collector.Register(registerer, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_redis_sessions",
+				Help: "Number of sessions stored in redis at the last cleanup.",
+			},
+		)).(prometheus.Gauge),
+		csrfEntries: collector.Register(registerer, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_redis_csrf_entries",
+				Help: "Number of CSRF entries stored in redis at the last cleanup.",
+			},
+		)).(prometheus.Gauge),
+		cleanedKeys: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_redis_cleanup_keys_total",
+				Help: "Total number of redis keys cleaned up by key type and action.",
+			},
+			[]string{"type", "action"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// recordCleanedKeys counts the keys deleted or with a shortened expiry
+func (m *cleanupMetrics) recordCleanedKeys(result *cleanupResult) {
+	for keyType, count := range result.deleted {
+		m.cleanedKeys.WithLabelValues(keyType, "deleted").Add(float64(count))
+	}
+	for keyType, count := range result.capped {
+		m.cleanedKeys.WithLabelValues(keyType, "expiry_shortened").Add(float64(count))
+	}
+}
+
+// recordLiveKeys sets the number of live sessions and CSRF entries
+func (m *cleanupMetrics) recordLiveKeys(result *cleanupResult) {
+	m.sessions.Set(float64(result.sessions))
+	m.csrfEntries.Set(float64(result.csrfEntries))
+}
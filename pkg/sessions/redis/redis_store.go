@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // SessionStore is an implementation of the persistence.Store
@@ -29,10 +31,19 @@ func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.Cook
 		return nil, fmt.Errorf("error constructing redis client: %v", err)
 	}
 
+	if opts.Redis.CleanupInterval > 0 {
+		cleaner := newSessionCleaner(client, opts.Redis, cookieOpts, prometheus.DefaultRegisterer)
+		go cleaner.Run(context.Background())
+	}
+
 	rs := &SessionStore{
 		Client: client,
 	}
-	return persistence.NewManager(rs, cookieOpts), nil
+	manager, err := persistence.NewManager(rs, opts, cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+	return manager, nil
 }
 
 // Save takes a sessions.SessionState and stores the information from it
@@ -49,9 +60,13 @@ func (store *SessionStore) Save(ctx context.Context, key string, value []byte, e
 // cookie within the HTTP request object
 func (store *SessionStore) Load(ctx context.Context, key string) ([]byte, error) {
 	value, err := store.Client.Get(ctx, key)
-	if err != nil {
+	if errors.Is(err, redis.Nil) {
 		return nil, fmt.Errorf("error loading redis session: %v", err)
 	}
+	if err != nil {
+		// Any other error means redis couldn't be reached or failed to respond
+		return nil, &sessions.StoreUnavailableError{Err: fmt.Errorf("error loading redis session: %w", err)}
+	}
 	return value, nil
 }
 
@@ -70,6 +85,56 @@ func (store *SessionStore) Lock(key string) sessions.Lock {
 	return store.Client.Lock(key)
 }
 
+// AddToIndex adds the session key to the user index, a sorted set of the
+// session keys by creation time expiring with the newest session
+func (store *SessionStore) AddToIndex(ctx context.Context, index string, key string, created time.Time, exp time.Duration) error {
+	err := store.Client.ZAdd(ctx, index, key, float64(created.UnixMilli()), exp)
+	if err != nil {
+		return fmt.Errorf("error indexing redis session: %v", err)
+	}
+	return nil
+}
+
+// IndexedKeys returns the session keys of the user index from the oldest
+// session, removing the keys of the sessions that have expired or been
+// cleared
+func (store *SessionStore) IndexedKeys(ctx context.Context, index string) ([]string, error) {
+	keys, err := store.Client.ZRange(ctx, index)
+	if err != nil {
+		return nil, fmt.Errorf("error listing indexed redis sessions: %v", err)
+	}
+	if len(keys) == 0 {
+		return keys, nil
+	}
+
+	ttls, err := store.Client.TTLs(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("error listing indexed redis sessions: %v", err)
+	}
+	indexed := []string{}
+	missing := []string{}
+	for i, key := range keys {
+		// Missing keys have a TTL of -2
+		if ttls[i] == -2 {
+			missing = append(missing, key)
+			continue
+		}
+		indexed = append(indexed, key)
+	}
+	if err := store.RemoveFromIndex(ctx, index, missing...); err != nil {
+		return nil, err
+	}
+	return indexed, nil
+}
+
+// RemoveFromIndex removes the session keys from the user index
+func (store *SessionStore) RemoveFromIndex(ctx context.Context, index string, keys ...string) error {
+	if err := store.Client.ZRem(ctx, index, keys...); err != nil {
+		return fmt.Errorf("error removing indexed redis sessions: %v", err)
+	}
+	return nil
+}
+
 // NewRedisClient makes a redis.Client (either standalone, sentinel aware, or
 // redis cluster)
 func NewRedisClient(opts options.RedisStoreOptions) (Client, error) {
@@ -98,15 +163,20 @@ func buildSentinelClient(opts options.RedisStoreOptions) (Client, error) {
 		return nil, err
 	}
 
-	client := redis.NewFailoverClient(&redis.FailoverOptions{
-		MasterName:       opts.SentinelMasterName,
-		SentinelAddrs:    addrs,
-		SentinelPassword: opts.SentinelPassword,
-		Password:         opts.Password,
-		TLSConfig:        opt.TLSConfig,
-		IdleTimeout:      time.Duration(opts.IdleTimeout) * time.Second,
+	return newAddressesClient(opts, addrs, opt.TLSConfig, func(addrs []string, dialer dialerFunc) Client {
+		client := redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.SentinelMasterName,
+			SentinelAddrs:    addrs,
+			SentinelUsername: opts.SentinelUsername,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			TLSConfig:        opt.TLSConfig,
+			Dialer:           dialer,
+			IdleTimeout:      time.Duration(opts.IdleTimeout) * time.Second,
+		})
+		return newClient(client)
 	})
-	return newClient(client), nil
 }
 
 // buildClusterClient makes a redis.Client that is Redis Cluster aware
@@ -120,13 +190,17 @@ func buildClusterClient(opts options.RedisStoreOptions) (Client, error) {
 		return nil, err
 	}
 
-	client := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:       addrs,
-		Password:    opts.Password,
-		TLSConfig:   opt.TLSConfig,
-		IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+	return newAddressesClient(opts, addrs, opt.TLSConfig, func(addrs []string, dialer dialerFunc) Client {
+		client := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       addrs,
+			Username:    opts.Username,
+			Password:    opts.Password,
+			TLSConfig:   opt.TLSConfig,
+			Dialer:      dialer,
+			IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+		})
+		return newClusterClient(client)
 	})
-	return newClusterClient(client), nil
 }
 
 // buildStandaloneClient makes a redis.Client that connects to a simple
@@ -137,6 +211,9 @@ func buildStandaloneClient(opts options.RedisStoreOptions) (Client, error) {
 		return nil, fmt.Errorf("unable to parse redis url: %s", err)
 	}
 
+	if opts.Username != "" {
+		opt.Username = opts.Username
+	}
 	if opts.Password != "" {
 		opt.Password = opts.Password
 	}
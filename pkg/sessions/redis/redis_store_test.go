@@ -23,7 +23,10 @@ import (
 	. "github.com/onsi/gomega"
 )
 
-const redisPassword = "0123456789abcdefghijklmnopqrstuv"
+const (
+	redisUsername = "oauth2-proxy"
+	redisPassword = "0123456789abcdefghijklmnopqrstuv"
+)
 
 // wrappedRedisLogger wraps a logger so that we can coerce the logger to
 // fit the expected signature for go-redis logging
@@ -122,6 +125,44 @@ var _ = Describe("Redis SessionStore Tests", func() {
 		},
 	)
 
+	Context("with user indexes", func() {
+		var store *SessionStore
+		var ctx context.Context
+
+		BeforeEach(func() {
+			ctx = context.Background()
+			client, err := NewRedisClient(options.RedisStoreOptions{ConnectionURL: "redis://" + mr.Addr()})
+			Expect(err).ToNot(HaveOccurred())
+			store = &SessionStore{Client: client}
+
+			// Capture the session store so that we can close the client
+			ss = &persistence.Manager{Store: store}
+		})
+
+		It("lists the indexed sessions still in redis from the oldest", func() {
+			now := time.Now()
+			Expect(store.Save(ctx, "a", []byte("a"), time.Hour)).To(Succeed())
+			Expect(store.Save(ctx, "b", []byte("b"), time.Minute)).To(Succeed())
+			Expect(store.Save(ctx, "c", []byte("c"), time.Hour)).To(Succeed())
+			Expect(store.AddToIndex(ctx, "user", "c", now, time.Hour)).To(Succeed())
+			Expect(store.AddToIndex(ctx, "user", "a", now.Add(-time.Hour), time.Hour)).To(Succeed())
+			Expect(store.AddToIndex(ctx, "user", "b", now.Add(-time.Minute), time.Hour)).To(Succeed())
+			Expect(mr.TTL("user")).To(Equal(time.Hour))
+
+			Expect(store.IndexedKeys(ctx, "user")).To(Equal([]string{"a", "b", "c"}))
+
+			mr.FastForward(2 * time.Minute)
+			Expect(store.Clear(ctx, "c")).To(Succeed())
+			Expect(store.IndexedKeys(ctx, "user")).To(Equal([]string{"a"}))
+			members, err := mr.ZMembers("user")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(members).To(Equal([]string{"a"}))
+
+			Expect(store.RemoveFromIndex(ctx, "user", "a")).To(Succeed())
+			Expect(store.IndexedKeys(ctx, "user")).To(BeEmpty())
+		})
+	})
+
 	Context("with sentinel", func() {
 		var ms *minisentinel.Sentinel
 
@@ -258,6 +299,111 @@ var _ = Describe("Redis SessionStore Tests", func() {
 		})
 	})
 
+	Context("with a redis ACL user", func() {
+		BeforeEach(func() {
+			mr.RequireUserAuth(redisUsername, redisPassword)
+		})
+
+		tests.RunSessionStoreTests(
+			func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+				// Set the connection URL
+				opts.Type = options.RedisSessionStoreType
+				opts.Redis.ConnectionURL = "redis://" + mr.Addr()
+				opts.Redis.Username = redisUsername
+				opts.Redis.Password = redisPassword
+
+				// Capture the session store so that we can close the client
+				var err error
+				ss, err = NewRedisSessionStore(opts, cookieOpts)
+				return ss, err
+			},
+			func(d time.Duration) error {
+				mr.FastForward(d)
+				return nil
+			},
+		)
+
+		Context("with sentinel", func() {
+			var ms *minisentinel.Sentinel
+
+			BeforeEach(func() {
+				ms = minisentinel.NewSentinel(mr)
+				Expect(ms.Start()).To(Succeed())
+			})
+
+			AfterEach(func() {
+				ms.Close()
+			})
+
+			tests.RunSessionStoreTests(
+				func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+					// Set the sentinel connection URL
+					sentinelAddr := "redis://" + ms.Addr()
+					opts.Type = options.RedisSessionStoreType
+					opts.Redis.SentinelConnectionURLs = []string{sentinelAddr}
+					opts.Redis.UseSentinel = true
+					opts.Redis.SentinelMasterName = ms.MasterInfo().Name
+					opts.Redis.Username = redisUsername
+					opts.Redis.Password = redisPassword
+
+					// Capture the session store so that we can close the client
+					var err error
+					ss, err = NewRedisSessionStore(opts, cookieOpts)
+					return ss, err
+				},
+				func(d time.Duration) error {
+					mr.FastForward(d)
+					return nil
+				},
+			)
+		})
+
+		Context("with cluster", func() {
+			tests.RunSessionStoreTests(
+				func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+					clusterAddr := "redis://" + mr.Addr()
+					opts.Type = options.RedisSessionStoreType
+					opts.Redis.ClusterConnectionURLs = []string{clusterAddr}
+					opts.Redis.UseCluster = true
+					opts.Redis.Username = redisUsername
+					opts.Redis.Password = redisPassword
+
+					// Capture the session store so that we can close the client
+					var err error
+					ss, err = NewRedisSessionStore(opts, cookieOpts)
+					return ss, err
+				},
+				func(d time.Duration) error {
+					mr.FastForward(d)
+					return nil
+				},
+			)
+		})
+
+		Context("with cluster and a DNS refresh interval", func() {
+			tests.RunSessionStoreTests(
+				func(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+					clusterAddr := "redis://" + mr.Addr()
+					opts.Type = options.RedisSessionStoreType
+					opts.Redis.ClusterConnectionURLs = []string{clusterAddr}
+					opts.Redis.UseCluster = true
+					opts.Redis.Username = redisUsername
+					opts.Redis.Password = redisPassword
+					opts.Redis.DNSRefreshInterval = time.Minute
+
+					// Capture the session store so that we can close the client
+					var err error
+					ss, err = NewRedisSessionStore(opts, cookieOpts)
+					return ss, err
+				},
+				func(d time.Duration) error {
+					mr.FastForward(d)
+					return nil
+				},
+			)
+		})
+	})
+
 	Context("with TLS connection", func() {
 		BeforeEach(func() {
 			mr.Close()
@@ -0,0 +1,68 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sessionCleaner periodically deletes the expired sessions, locks and user
+// index entries from the tables of the store.
+// Expired rows are never loaded, but are only deleted by the cleanup.
+// Every replica cleans up, the deletes of replicas cleaning up at the same
+// time don't conflict.
+type sessionCleaner struct {
+	store    *SessionStore
+	interval time.Duration
+
+	metrics *cleanupMetrics
+}
+
+// newSessionCleaner creates a sessionCleaner for the tables of the store
+func newSessionCleaner(store *SessionStore, interval time.Duration, registerer prometheus.Registerer) *sessionCleaner {
+	return &sessionCleaner{
+		store:    store,
+		interval: interval,
+		metrics:  newCleanupMetrics(registerer),
+	}
+}
+
+// Run cleans up the tables at each interval until the context is cancelled.
+func (c *sessionCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.runOnce(ctx)
+		}
+	}
+}
+
+// runOnce deletes the expired rows of each table
+func (c *sessionCleaner) runOnce(ctx context.Context) {
+	start := time.Now()
+	now := c.store.now()
+	deleted := map[string]int64{}
+	for _, table := range []struct{ name, rowType string }{
+		{c.store.tables.sessions, sessionRowType},
+		{c.store.tables.locks, lockRowType},
+		{c.store.tables.userIndex, userIndexRowType},
+	} {
+		n, err := c.store.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE expires_at <= ?", table.name), now)
+		if err != nil {
+			logger.Errorf("Error cleaning up expired sql sessions from %q: %v", table.name, err)
+			return
+		}
+		deleted[table.rowType] = n
+		c.metrics.deletedRows.WithLabelValues(table.rowType).Add(float64(n))
+	}
+	logger.Printf("Cleaned up sql sessions in %s: deleted %d expired sessions, %d locks and %d user index entries",
+		time.Since(start), deleted[sessionRowType], deleted[lockRowType], deleted[userIndexRowType])
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("SQL SessionStore Cleanup", func() {
+	It("deletes the expired rows of each table", func() {
+		store, mock, db, now := newMockStore(postgresDialect)
+		defer db.Close()
+		cleaner := newSessionCleaner(store, 0, prometheus.NewRegistry())
+
+		mock.ExpectExec("DELETE FROM oauth2_proxy_sessions WHERE expires_at <= $1").
+			WithArgs(now.UnixMilli()).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_locks WHERE expires_at <= $1").
+			WithArgs(now.UnixMilli()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_user_index WHERE expires_at <= $1").
+			WithArgs(now.UnixMilli()).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		cleaner.runOnce(context.Background())
+
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		Expect(testutil.ToFloat64(cleaner.metrics.deletedRows.WithLabelValues(sessionRowType))).To(Equal(float64(3)))
+		Expect(testutil.ToFloat64(cleaner.metrics.deletedRows.WithLabelValues(lockRowType))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(cleaner.metrics.deletedRows.WithLabelValues(userIndexRowType))).To(Equal(float64(2)))
+	})
+
+	It("stops cleaning up when the database fails", func() {
+		store, mock, db, _ := newMockStore(mysqlDialect)
+		defer db.Close()
+		cleaner := newSessionCleaner(store, 0, prometheus.NewRegistry())
+
+		mock.ExpectExec("DELETE FROM oauth2_proxy_sessions WHERE expires_at <= ?").
+			WillReturnError(errors.New("connection refused"))
+		cleaner.runOnce(context.Background())
+
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		Expect(testutil.CollectAndCount(cleaner.metrics.deletedRows)).To(Equal(0))
+	})
+})
@@ -0,0 +1,137 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// dialect is the SQL of a database that differs from the other databases
+type dialect struct {
+	// driver is the name of the database/sql driver
+	driver string
+
+	// numberedPlaceholders is set when the placeholders of the driver are
+	// numbered ($1, $2...) rather than ?
+	numberedPlaceholders bool
+
+	// conflictUpdate is appended to an insert to update the given columns of
+	// the row with the same primary key instead
+	conflictUpdate func(primaryKey []string, columns []string) string
+
+	// isDuplicateKey checks whether the error is the violation of a primary key
+	isDuplicateKey func(error) bool
+
+	// migrations are the schema migrations, from the oldest
+	migrations []migration
+}
+
+// postgresDialect is the dialect of PostgreSQL databases
+var postgresDialect = dialect{
+	driver:               options.PostgresSQLDriver,
+	numberedPlaceholders: true,
+	conflictUpdate: func(primaryKey []string, columns []string) string {
+		updates := make([]string, 0, len(columns))
+		for _, column := range columns {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(primaryKey, ", "), strings.Join(updates, ", "))
+	},
+	isDuplicateKey: func(err error) bool {
+		var pqErr *pq.Error
+		// unique_violation
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+	migrations: []migration{
+		{
+			version: 1,
+			statements: func(t tables) []string {
+				return []string{
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (session_key VARCHAR(255) NOT NULL PRIMARY KEY, value BYTEA NOT NULL, expires_at BIGINT NOT NULL)", t.sessions),
+					fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires_at ON %s (expires_at)", t.sessions, t.sessions),
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (lock_key VARCHAR(255) NOT NULL PRIMARY KEY, holder VARCHAR(64) NOT NULL, expires_at BIGINT NOT NULL)", t.locks),
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (index_key VARCHAR(255) NOT NULL, session_key VARCHAR(255) NOT NULL, created_at BIGINT NOT NULL, expires_at BIGINT NOT NULL, PRIMARY KEY (index_key, session_key))", t.userIndex),
+					fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires_at ON %s (expires_at)", t.userIndex, t.userIndex),
+				}
+			},
+		},
+	},
+}
+
+// mysqlDialect is the dialect of MySQL and MariaDB databases
+var mysqlDialect = dialect{
+	driver: options.MySQLSQLDriver,
+	conflictUpdate: func(_ []string, columns []string) string {
+		updates := make([]string, 0, len(columns))
+		for _, column := range columns {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+		}
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s", strings.Join(updates, ", "))
+	},
+	isDuplicateKey: func(err error) bool {
+		var mysqlErr *mysql.MySQLError
+		// ER_DUP_ENTRY
+		return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+	},
+	migrations: []migration{
+		{
+			version: 1,
+			statements: func(t tables) []string {
+				// MySQL can't create indexes only if they don't exist, so they
+				// are created with their tables
+				return []string{
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (session_key VARCHAR(255) NOT NULL PRIMARY KEY, value MEDIUMBLOB NOT NULL, expires_at BIGINT NOT NULL, INDEX %s_expires_at (expires_at))", t.sessions, t.sessions),
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (lock_key VARCHAR(255) NOT NULL PRIMARY KEY, holder VARCHAR(64) NOT NULL, expires_at BIGINT NOT NULL)", t.locks),
+					fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (index_key VARCHAR(255) NOT NULL, session_key VARCHAR(255) NOT NULL, created_at BIGINT NOT NULL, expires_at BIGINT NOT NULL, PRIMARY KEY (index_key, session_key), INDEX %s_expires_at (expires_at))", t.userIndex, t.userIndex),
+				}
+			},
+		},
+	},
+}
+
+// dialectForDriver returns the dialect of the driver option
+func dialectForDriver(driver string) (dialect, error) {
+	switch driver {
+	case options.PostgresSQLDriver:
+		return postgresDialect, nil
+	case options.MySQLSQLDriver:
+		return mysqlDialect, nil
+	default:
+		return dialect{}, fmt.Errorf("unknown sql_store_driver %q: must be postgres or mysql", driver)
+	}
+}
+
+// rebind replaces the ? placeholders of the query with the placeholders of
+// the driver.
+// The queries of the store have no string literals, so every ? is a
+// placeholder.
+func (d dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// upsert returns the statement inserting the row of the columns, or updating
+// the update columns of the row with the same primary key
+func (d dialect) upsert(table string, primaryKey []string, update []string) string {
+	columns := append(append([]string{}, primaryKey...), update...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s",
+		table, strings.Join(columns, ", "), placeholders, d.conflictUpdate(primaryKey, update))
+}
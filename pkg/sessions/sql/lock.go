@@ -0,0 +1,88 @@
+package sql
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// Lock is a lock on a session in a SessionStore, held in its locks table.
+// Only the Lock that obtained the lock may refresh or release it.
+type Lock struct {
+	store  *SessionStore
+	key    string
+	holder string
+}
+
+// Obtain obtains the lock for the key, unless another Lock holds it.
+// Expired locks are removed first, so that they can be obtained.
+func (l *Lock) Obtain(ctx context.Context, expiration time.Duration) error {
+	if l.holder == "" {
+		nonce, err := encryption.Nonce(16)
+		if err != nil {
+			return fmt.Errorf("error generating the sql lock holder: %v", err)
+		}
+		l.holder = hex.EncodeToString(nonce)
+	}
+
+	t := l.store.tables
+	if _, err := l.store.exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE lock_key = ? AND expires_at <= ?", t.locks), l.key, l.store.now()); err != nil {
+		return fmt.Errorf("error removing expired sql lock: %v", err)
+	}
+	extended, err := l.store.exec(ctx, fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE lock_key = ? AND holder = ?", t.locks), l.store.expiresAt(expiration), l.key, l.holder)
+	if err != nil {
+		return fmt.Errorf("error obtaining sql lock: %v", err)
+	}
+	if extended > 0 {
+		return nil
+	}
+
+	_, err = l.store.exec(ctx, fmt.Sprintf("INSERT INTO %s (lock_key, holder, expires_at) VALUES (?, ?, ?)", t.locks), l.key, l.holder, l.store.expiresAt(expiration))
+	if l.store.dialect.isDuplicateKey(err) {
+		return sessions.ErrLockNotObtained
+	}
+	if err != nil {
+		return fmt.Errorf("error obtaining sql lock: %v", err)
+	}
+	return nil
+}
+
+// Refresh extends the expiry of the lock held by this Lock.
+func (l *Lock) Refresh(ctx context.Context, expiration time.Duration) error {
+	query := fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE lock_key = ? AND holder = ? AND expires_at > ?", l.store.tables.locks)
+	refreshed, err := l.store.exec(ctx, query, l.store.expiresAt(expiration), l.key, l.holder, l.store.now())
+	if err != nil {
+		return fmt.Errorf("error refreshing sql lock: %v", err)
+	}
+	if refreshed == 0 {
+		return sessions.ErrNotLocked
+	}
+	return nil
+}
+
+// Peek returns true, if the lock is still applied.
+func (l *Lock) Peek(ctx context.Context) (bool, error) {
+	var held int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE lock_key = ? AND expires_at > ?", l.store.tables.locks)
+	if err := l.store.db.QueryRowContext(ctx, l.store.dialect.rebind(query), l.key, l.store.now()).Scan(&held); err != nil {
+		return false, fmt.Errorf("error peeking sql lock: %v", err)
+	}
+	return held > 0, nil
+}
+
+// Release releases the lock held by this Lock.
+func (l *Lock) Release(ctx context.Context) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE lock_key = ? AND holder = ?", l.store.tables.locks)
+	released, err := l.store.exec(ctx, query, l.key, l.holder)
+	if err != nil {
+		return fmt.Errorf("error releasing sql lock: %v", err)
+	}
+	if released == 0 {
+		return sessions.ErrNotLocked
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package sql
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The types of rows deleted by the cleanup
+const (
+	sessionRowType   = "session"
+	lockRowType      = "lock"
+	userIndexRowType = "user_index"
+)
+
+// cleanupMetrics records the results of the sql session cleanup
+type cleanupMetrics struct {
+	deletedRows *prometheus.CounterVec
+}
+
+// newCleanupMetrics registers the cleanup metrics with the registerer.
+func newCleanupMetrics(registerer prometheus.Registerer) *cleanupMetrics {
+	return &cleanupMetrics{
+		deletedRows: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_sql_session_cleanup_deleted_rows_total",
+				Help: "Total number of expired rows deleted from the sql session store by the cleanup, by type of row.",
+			},
+			[]string{"type"},
+		)).(*prometheus.CounterVec),
+	}
+}
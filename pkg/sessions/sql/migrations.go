@@ -0,0 +1,73 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// migration is a change to the schema of the tables of the store, applied
+// once per database.
+// Statements must be safe to apply again, as replicas starting at the same
+// time may both apply a migration.
+type migration struct {
+	version    int
+	statements func(tables) []string
+}
+
+// migrate applies the migrations of the dialect that haven't been applied to
+// the tables yet, recording each in the schema migrations table.
+func migrate(ctx context.Context, db *sql.DB, d dialect, t tables, now int64) error {
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)", t.migrations)); err != nil {
+		return fmt.Errorf("could not create the schema migrations table: %v", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", t.migrations)).Scan(&current); err != nil {
+		return fmt.Errorf("could not read the schema version: %v", err)
+	}
+
+	for _, m := range d.migrations {
+		if m.version <= current {
+			continue
+		}
+		applied, err := applyMigration(ctx, db, d, t, m, now)
+		if err != nil {
+			return fmt.Errorf("could not apply schema migration %d: %v", m.version, err)
+		}
+		if applied {
+			logger.Printf("Applied sql session store schema migration %d to %q", m.version, t.sessions)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration in a transaction, which isn't atomic
+// with MySQL, as it commits its schema changes immediately.
+// The migration is not applied when another replica has just applied it.
+func applyMigration(ctx context.Context, db *sql.DB, d dialect, t tables, m migration, now int64) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		// Rolling back a committed transaction has no effect
+		_ = tx.Rollback()
+	}()
+
+	for _, statement := range m.statements(t) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, d.rebind(fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES (?, ?)", t.migrations)), m.version, now)
+	if d.isDuplicateKey(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,104 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SQL SessionStore Migrations", func() {
+	const (
+		createMigrations = "CREATE TABLE IF NOT EXISTS oauth2_proxy_sessions_schema_migrations (version INTEGER NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)"
+		currentVersion   = "SELECT COALESCE(MAX(version), 0) FROM oauth2_proxy_sessions_schema_migrations"
+	)
+
+	var (
+		ctx   context.Context
+		store *SessionStore
+		mock  sqlmock.Sqlmock
+		db    *sql.DB
+		now   time.Time
+	)
+
+	newStore := func(d dialect) {
+		store, mock, db, now = newMockStore(d)
+	}
+
+	AfterEach(func() {
+		mock.ExpectClose()
+		Expect(db.Close()).To(Succeed())
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	// expectMigration expects the statements of the first migration of the
+	// dialect, returning the insert of its version
+	expectMigration := func(d dialect, insertVersion string) *sqlmock.ExpectedExec {
+		mock.ExpectBegin()
+		for _, statement := range d.migrations[0].statements(store.tables) {
+			mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		return mock.ExpectExec(insertVersion).WithArgs(1, now.UnixMilli())
+	}
+
+	DescribeTable("creates the tables of a new database",
+		func(d dialect, insertVersion string, sessionsTable string) {
+			newStore(d)
+			Expect(d.migrations[0].statements(store.tables)[0]).To(Equal(sessionsTable))
+
+			mock.ExpectExec(createMigrations).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(currentVersion).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+			expectMigration(d, insertVersion).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			Expect(migrate(ctx, db, d, store.tables, store.now())).To(Succeed())
+		},
+		Entry("with postgres", postgresDialect,
+			"INSERT INTO oauth2_proxy_sessions_schema_migrations (version, applied_at) VALUES ($1, $2)",
+			"CREATE TABLE IF NOT EXISTS oauth2_proxy_sessions (session_key VARCHAR(255) NOT NULL PRIMARY KEY, value BYTEA NOT NULL, expires_at BIGINT NOT NULL)"),
+		Entry("with mysql", mysqlDialect,
+			"INSERT INTO oauth2_proxy_sessions_schema_migrations (version, applied_at) VALUES (?, ?)",
+			"CREATE TABLE IF NOT EXISTS oauth2_proxy_sessions (session_key VARCHAR(255) NOT NULL PRIMARY KEY, value MEDIUMBLOB NOT NULL, expires_at BIGINT NOT NULL, INDEX oauth2_proxy_sessions_expires_at (expires_at))"),
+	)
+
+	It("skips the migrations already applied", func() {
+		newStore(postgresDialect)
+		mock.ExpectExec(createMigrations).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(currentVersion).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+
+		Expect(migrate(ctx, db, postgresDialect, store.tables, store.now())).To(Succeed())
+	})
+
+	It("succeeds when another replica applies the migration at the same time", func() {
+		newStore(mysqlDialect)
+		mock.ExpectExec(createMigrations).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(currentVersion).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+		expectMigration(mysqlDialect, "INSERT INTO oauth2_proxy_sessions_schema_migrations (version, applied_at) VALUES (?, ?)").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"})
+		mock.ExpectRollback()
+
+		Expect(migrate(ctx, db, mysqlDialect, store.tables, store.now())).To(Succeed())
+	})
+
+	It("fails when a migration can't be applied", func() {
+		newStore(postgresDialect)
+		mock.ExpectExec(createMigrations).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(currentVersion).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+		mock.ExpectBegin()
+		mock.ExpectExec(postgresDialect.migrations[0].statements(store.tables)[0]).
+			WillReturnError(errors.New("permission denied for schema public"))
+		mock.ExpectRollback()
+
+		Expect(migrate(ctx, db, postgresDialect, store.tables, store.now())).To(MatchError("could not apply schema migration 1: permission denied for schema public"))
+	})
+})
@@ -0,0 +1,241 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	// The drivers of the supported databases
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// migrationTimeout is the maximum time allowed to migrate the schema of the
+// tables when the store is created
+const migrationTimeout = 30 * time.Second
+
+// tableNameRegex matches the table names that can be used in queries
+// without quoting
+var tableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,47}$`)
+
+// SessionStore is an implementation of the persistence.Store
+// interface that stores sessions in a PostgreSQL or MySQL database.
+// The sessions are encrypted by the persistence.Manager before they are
+// saved, with the secret of the session's ticket which is only sent to the
+// client.
+type SessionStore struct {
+	db      *sql.DB
+	dialect dialect
+	tables  tables
+	clock   clock.Clock
+}
+
+// tables are the names of the tables of the store
+type tables struct {
+	sessions   string
+	locks      string
+	userIndex  string
+	migrations string
+}
+
+// newTables names the tables of the store after the sessions table
+func newTables(table string) tables {
+	return tables{
+		sessions:   table,
+		locks:      table + "_locks",
+		userIndex:  table + "_user_index",
+		migrations: table + "_schema_migrations",
+	}
+}
+
+// NewSQLSessionStore initialises a new instance of the SessionStore, migrating
+// the schema of its tables, and wraps it in a persistence.Manager
+func NewSQLSessionStore(opts *options.SessionOptions, cookieOpts *options.Cookie) (sessions.SessionStore, error) {
+	d, err := dialectForDriver(opts.SQL.Driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(d.driver, opts.SQL.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sql session store database: %v", err)
+	}
+	db.SetMaxOpenConns(opts.SQL.MaxOpenConns)
+
+	store, err := newSessionStore(db, d, opts.SQL.Table)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	if err := migrate(ctx, db, d, store.tables, store.now()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error migrating sql session store: %v", err)
+	}
+
+	if opts.SQL.CleanupInterval > 0 {
+		cleaner := newSessionCleaner(store, opts.SQL.CleanupInterval, prometheus.DefaultRegisterer)
+		go cleaner.Run(context.Background())
+	}
+
+	manager, err := persistence.NewManager(store, opts, cookieOpts)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return manager, nil
+}
+
+// ValidateTableName checks that the sessions table can be named in queries,
+// with room for the suffixes of the other tables of the store
+func ValidateTableName(table string) error {
+	if !tableNameRegex.MatchString(table) {
+		return fmt.Errorf("invalid sql_store_table %q: must be at most 48 letters, digits and underscores, not starting with a digit", table)
+	}
+	return nil
+}
+
+func newSessionStore(db *sql.DB, d dialect, table string) (*SessionStore, error) {
+	if err := ValidateTableName(table); err != nil {
+		return nil, err
+	}
+	return &SessionStore{
+		db:      db,
+		dialect: d,
+		tables:  newTables(table),
+	}, nil
+}
+
+// Save stores the encrypted session under the key until it expires
+func (store *SessionStore) Save(ctx context.Context, key string, value []byte, exp time.Duration) error {
+	query := store.dialect.upsert(store.tables.sessions, []string{"session_key"}, []string{"value", "expires_at"})
+	if _, err := store.exec(ctx, query, key, value, store.expiresAt(exp)); err != nil {
+		return fmt.Errorf("error saving sql session: %v", err)
+	}
+	return nil
+}
+
+// Load reads the encrypted session stored under the key, unless it has
+// expired
+func (store *SessionStore) Load(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	query := fmt.Sprintf("SELECT value FROM %s WHERE session_key = ? AND expires_at > ?", store.tables.sessions)
+	err := store.db.QueryRowContext(ctx, store.dialect.rebind(query), key, store.now()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("error loading sql session: session not found")
+	}
+	if err != nil {
+		// Any other error means the database couldn't be reached or failed to
+		// respond
+		return nil, &sessions.StoreUnavailableError{Err: fmt.Errorf("error loading sql session: %w", err)}
+	}
+	return value, nil
+}
+
+// Clear removes the session stored under the key
+func (store *SessionStore) Clear(ctx context.Context, key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE session_key = ?", store.tables.sessions)
+	if _, err := store.exec(ctx, query, key); err != nil {
+		return fmt.Errorf("error clearing the session from the sql session store: %v", err)
+	}
+	return nil
+}
+
+// Lock creates a lock object for sessions.SessionState
+func (store *SessionStore) Lock(key string) sessions.Lock {
+	return &Lock{
+		store: store,
+		key:   key,
+	}
+}
+
+// AddToIndex adds the session key to the user index, with the creation time
+// of the session, until the session expires
+func (store *SessionStore) AddToIndex(ctx context.Context, index string, key string, created time.Time, exp time.Duration) error {
+	query := store.dialect.upsert(store.tables.userIndex, []string{"index_key", "session_key"}, []string{"created_at", "expires_at"})
+	if _, err := store.exec(ctx, query, index, key, created.UnixMilli(), store.expiresAt(exp)); err != nil {
+		return fmt.Errorf("error indexing sql session: %v", err)
+	}
+	return nil
+}
+
+// IndexedKeys returns the session keys of the user index from the oldest
+// session, removing the keys of the sessions that have expired or been
+// cleared
+func (store *SessionStore) IndexedKeys(ctx context.Context, index string) ([]string, error) {
+	remove := fmt.Sprintf("DELETE FROM %[1]s WHERE index_key = ? AND NOT EXISTS (SELECT 1 FROM %[2]s WHERE %[2]s.session_key = %[1]s.session_key AND %[2]s.expires_at > ?)",
+		store.tables.userIndex, store.tables.sessions)
+	if _, err := store.exec(ctx, remove, index, store.now()); err != nil {
+		return nil, fmt.Errorf("error listing indexed sql sessions: %v", err)
+	}
+
+	query := fmt.Sprintf("SELECT session_key FROM %s WHERE index_key = ? ORDER BY created_at, session_key", store.tables.userIndex)
+	rows, err := store.db.QueryContext(ctx, store.dialect.rebind(query), index)
+	if err != nil {
+		return nil, fmt.Errorf("error listing indexed sql sessions: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("error listing indexed sql sessions: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing indexed sql sessions: %v", err)
+	}
+	return keys, nil
+}
+
+// RemoveFromIndex removes the session keys from the user index
+func (store *SessionStore) RemoveFromIndex(ctx context.Context, index string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	query := fmt.Sprintf("DELETE FROM %s WHERE index_key = ? AND session_key IN (%s)", store.tables.userIndex, placeholders)
+	args := []interface{}{index}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	if _, err := store.exec(ctx, query, args...); err != nil {
+		return fmt.Errorf("error removing indexed sql sessions: %v", err)
+	}
+	return nil
+}
+
+// exec executes the statement with the placeholders of the driver, returning
+// the number of rows affected
+func (store *SessionStore) exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	result, err := store.db.ExecContext(ctx, store.dialect.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// now returns the current time in the unix milliseconds the expiry of rows is
+// stored in
+func (store *SessionStore) now() int64 {
+	return store.clock.Now().UnixMilli()
+}
+
+// expiresAt returns the expiry of a row saved now with the expiration
+func (store *SessionStore) expiresAt(exp time.Duration) int64 {
+	return store.clock.Now().Add(exp).UnixMilli()
+}
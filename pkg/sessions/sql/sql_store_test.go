@@ -0,0 +1,231 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+func TestSessionStore(t *testing.T) {
+	logger.SetOutput(GinkgoWriter)
+	logger.SetErrOutput(GinkgoWriter)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SQL SessionStore")
+}
+
+// newMockStore creates a SessionStore of the dialect on a mock database, at a
+// fixed time
+func newMockStore(d dialect) (*SessionStore, sqlmock.Sqlmock, *sql.DB, time.Time) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	Expect(err).ToNot(HaveOccurred())
+	store, err := newSessionStore(db, d, "oauth2_proxy_sessions")
+	Expect(err).ToNot(HaveOccurred())
+
+	now := time.Unix(1700000000, 0)
+	store.clock.Set(now)
+	return store, mock, db, now
+}
+
+var _ = Describe("SQL SessionStore Tests", func() {
+	var (
+		ctx   context.Context
+		store *SessionStore
+		mock  sqlmock.Sqlmock
+		db    *sql.DB
+		now   time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store, mock, db, now = newMockStore(postgresDialect)
+	})
+
+	AfterEach(func() {
+		mock.ExpectClose()
+		Expect(db.Close()).To(Succeed())
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+
+	DescribeTable("saves sessions with the upsert of the database",
+		func(d dialect, expected string) {
+			store.dialect = d
+			mock.ExpectExec(expected).
+				WithArgs("_oauth2_proxy-1234", []byte("encrypted"), now.Add(time.Hour).UnixMilli()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			Expect(store.Save(ctx, "_oauth2_proxy-1234", []byte("encrypted"), time.Hour)).To(Succeed())
+		},
+		Entry("with postgres", postgresDialect,
+			"INSERT INTO oauth2_proxy_sessions (session_key, value, expires_at) VALUES ($1, $2, $3) ON CONFLICT (session_key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at"),
+		Entry("with mysql", mysqlDialect,
+			"INSERT INTO oauth2_proxy_sessions (session_key, value, expires_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), expires_at = VALUES(expires_at)"),
+	)
+
+	Context("when loading sessions", func() {
+		const query = "SELECT value FROM oauth2_proxy_sessions WHERE session_key = $1 AND expires_at > $2"
+
+		It("loads the unexpired session", func() {
+			mock.ExpectQuery(query).
+				WithArgs("_oauth2_proxy-1234", now.UnixMilli()).
+				WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow([]byte("encrypted")))
+			Expect(store.Load(ctx, "_oauth2_proxy-1234")).To(Equal([]byte("encrypted")))
+		})
+
+		It("returns an error when the session doesn't exist or has expired", func() {
+			mock.ExpectQuery(query).
+				WithArgs("_oauth2_proxy-1234", now.UnixMilli()).
+				WillReturnRows(sqlmock.NewRows([]string{"value"}))
+			_, err := store.Load(ctx, "_oauth2_proxy-1234")
+			Expect(err).To(MatchError("error loading sql session: session not found"))
+			Expect(err).ToNot(BeAssignableToTypeOf(&sessionsapi.StoreUnavailableError{}))
+		})
+
+		It("returns a store unavailable error when the database fails", func() {
+			mock.ExpectQuery(query).
+				WithArgs("_oauth2_proxy-1234", now.UnixMilli()).
+				WillReturnError(errors.New("connection refused"))
+			_, err := store.Load(ctx, "_oauth2_proxy-1234")
+			var unavailable *sessionsapi.StoreUnavailableError
+			Expect(errors.As(err, &unavailable)).To(BeTrue())
+			Expect(err).To(MatchError("error loading sql session: connection refused"))
+		})
+	})
+
+	It("clears sessions", func() {
+		mock.ExpectExec("DELETE FROM oauth2_proxy_sessions WHERE session_key = $1").
+			WithArgs("_oauth2_proxy-1234").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		Expect(store.Clear(ctx, "_oauth2_proxy-1234")).To(Succeed())
+	})
+
+	Context("with a lock", func() {
+		var lock *Lock
+
+		BeforeEach(func() {
+			lock = store.Lock("_oauth2_proxy-1234").(*Lock)
+			lock.holder = "holder"
+		})
+
+		expectRemoveExpired := func() {
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_locks WHERE lock_key = $1 AND expires_at <= $2").
+				WithArgs("_oauth2_proxy-1234", now.UnixMilli()).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		expectExtend := func(extended int64) {
+			mock.ExpectExec("UPDATE oauth2_proxy_sessions_locks SET expires_at = $1 WHERE lock_key = $2 AND holder = $3").
+				WithArgs(now.Add(time.Second).UnixMilli(), "_oauth2_proxy-1234", "holder").
+				WillReturnResult(sqlmock.NewResult(0, extended))
+		}
+		expectInsert := func() *sqlmock.ExpectedExec {
+			return mock.ExpectExec("INSERT INTO oauth2_proxy_sessions_locks (lock_key, holder, expires_at) VALUES ($1, $2, $3)").
+				WithArgs("_oauth2_proxy-1234", "holder", now.Add(time.Second).UnixMilli())
+		}
+
+		It("obtains the lock when no other lock holds it", func() {
+			expectRemoveExpired()
+			expectExtend(0)
+			expectInsert().WillReturnResult(sqlmock.NewResult(0, 1))
+			Expect(lock.Obtain(ctx, time.Second)).To(Succeed())
+		})
+
+		It("doesn't obtain the lock held by another lock", func() {
+			expectRemoveExpired()
+			expectExtend(0)
+			expectInsert().WillReturnError(&pq.Error{Code: "23505"})
+			Expect(lock.Obtain(ctx, time.Second)).To(Equal(sessionsapi.ErrLockNotObtained))
+		})
+
+		It("extends the lock it already holds", func() {
+			expectRemoveExpired()
+			expectExtend(1)
+			Expect(lock.Obtain(ctx, time.Second)).To(Succeed())
+		})
+
+		It("generates a holder for each lock", func() {
+			other := store.Lock("_oauth2_proxy-1234").(*Lock)
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_locks WHERE lock_key = $1 AND expires_at <= $2").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("UPDATE oauth2_proxy_sessions_locks SET expires_at = $1 WHERE lock_key = $2 AND holder = $3").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO oauth2_proxy_sessions_locks (lock_key, holder, expires_at) VALUES ($1, $2, $3)").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			Expect(other.Obtain(ctx, time.Second)).To(Succeed())
+			Expect(other.holder).To(HaveLen(32))
+			Expect(other.holder).ToNot(Equal(lock.holder))
+		})
+
+		It("refreshes the unexpired lock it holds", func() {
+			mock.ExpectExec("UPDATE oauth2_proxy_sessions_locks SET expires_at = $1 WHERE lock_key = $2 AND holder = $3 AND expires_at > $4").
+				WithArgs(now.Add(time.Second).UnixMilli(), "_oauth2_proxy-1234", "holder", now.UnixMilli()).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			Expect(lock.Refresh(ctx, time.Second)).To(Equal(sessionsapi.ErrNotLocked))
+		})
+
+		It("peeks at the unexpired lock", func() {
+			mock.ExpectQuery("SELECT COUNT(*) FROM oauth2_proxy_sessions_locks WHERE lock_key = $1 AND expires_at > $2").
+				WithArgs("_oauth2_proxy-1234", now.UnixMilli()).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			Expect(lock.Peek(ctx)).To(BeTrue())
+		})
+
+		It("only releases the lock it holds", func() {
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_locks WHERE lock_key = $1 AND holder = $2").
+				WithArgs("_oauth2_proxy-1234", "holder").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_locks WHERE lock_key = $1 AND holder = $2").
+				WithArgs("_oauth2_proxy-1234", "holder").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			Expect(lock.Release(ctx)).To(Succeed())
+			Expect(lock.Release(ctx)).To(Equal(sessionsapi.ErrNotLocked))
+		})
+	})
+
+	Context("with user indexes", func() {
+		It("indexes the sessions of the user until they expire", func() {
+			created := now.Add(-time.Minute)
+			mock.ExpectExec("INSERT INTO oauth2_proxy_sessions_user_index (index_key, session_key, created_at, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT (index_key, session_key) DO UPDATE SET created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at").
+				WithArgs("_oauth2_proxy-user-abcd", "_oauth2_proxy-1234", created.UnixMilli(), now.Add(time.Hour).UnixMilli()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			Expect(store.AddToIndex(ctx, "_oauth2_proxy-user-abcd", "_oauth2_proxy-1234", created, time.Hour)).To(Succeed())
+		})
+
+		It("lists the indexed sessions that still exist from the oldest", func() {
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_user_index WHERE index_key = $1 AND NOT EXISTS (SELECT 1 FROM oauth2_proxy_sessions WHERE oauth2_proxy_sessions.session_key = oauth2_proxy_sessions_user_index.session_key AND oauth2_proxy_sessions.expires_at > $2)").
+				WithArgs("_oauth2_proxy-user-abcd", now.UnixMilli()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("SELECT session_key FROM oauth2_proxy_sessions_user_index WHERE index_key = $1 ORDER BY created_at, session_key").
+				WithArgs("_oauth2_proxy-user-abcd").
+				WillReturnRows(sqlmock.NewRows([]string{"session_key"}).AddRow("_oauth2_proxy-1").AddRow("_oauth2_proxy-2"))
+			Expect(store.IndexedKeys(ctx, "_oauth2_proxy-user-abcd")).To(Equal([]string{"_oauth2_proxy-1", "_oauth2_proxy-2"}))
+		})
+
+		It("removes sessions from the index", func() {
+			mock.ExpectExec("DELETE FROM oauth2_proxy_sessions_user_index WHERE index_key = $1 AND session_key IN ($2, $3)").
+				WithArgs("_oauth2_proxy-user-abcd", "_oauth2_proxy-1", "_oauth2_proxy-2").
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			Expect(store.RemoveFromIndex(ctx, "_oauth2_proxy-user-abcd", "_oauth2_proxy-1", "_oauth2_proxy-2")).To(Succeed())
+			Expect(store.RemoveFromIndex(ctx, "_oauth2_proxy-user-abcd")).To(Succeed())
+		})
+	})
+
+	DescribeTable("refuses table names that can't be used in queries",
+		func(table string) {
+			_, err := newSessionStore(db, postgresDialect, table)
+			Expect(err).To(MatchError(ContainSubstring("invalid sql_store_table")))
+		},
+		Entry("with a schema", "auth.sessions"),
+		Entry("with a quote", "sessions\"; DROP TABLE users; --"),
+		Entry("starting with a digit", "1sessions"),
+		Entry("empty", ""),
+	)
+})
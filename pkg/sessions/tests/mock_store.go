@@ -3,6 +3,7 @@ package tests
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -19,6 +20,7 @@ type entry struct {
 type MockStore struct {
 	cache     map[string]entry
 	lockCache map[string]*MockLock
+	indexes   map[string]map[string]time.Time
 	elapsed   time.Duration
 }
 
@@ -27,6 +29,7 @@ func NewMockStore() *MockStore {
 	return &MockStore{
 		cache:     map[string]entry{},
 		lockCache: map[string]*MockLock{},
+		indexes:   map[string]map[string]time.Time{},
 		elapsed:   0 * time.Second,
 	}
 }
@@ -56,6 +59,37 @@ func (s *MockStore) Clear(_ context.Context, key string) error {
 	return nil
 }
 
+// AddToIndex adds the key to an index with its creation time
+func (s *MockStore) AddToIndex(_ context.Context, index string, key string, created time.Time, _ time.Duration) error {
+	if s.indexes[index] == nil {
+		s.indexes[index] = map[string]time.Time{}
+	}
+	s.indexes[index][key] = created
+	return nil
+}
+
+// IndexedKeys returns the keys of an index still cached, from the oldest
+func (s *MockStore) IndexedKeys(_ context.Context, index string) ([]string, error) {
+	keys := []string{}
+	for key := range s.indexes[index] {
+		if entry, ok := s.cache[key]; ok && entry.expiration > s.elapsed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.indexes[index][keys[i]].Before(s.indexes[index][keys[j]])
+	})
+	return keys, nil
+}
+
+// RemoveFromIndex removes the keys from an index
+func (s *MockStore) RemoveFromIndex(_ context.Context, index string, keys ...string) error {
+	for _, key := range keys {
+		delete(s.indexes[index], key)
+	}
+	return nil
+}
+
 func (s *MockStore) Lock(key string) sessions.Lock {
 	if s.lockCache[key] != nil {
 		return s.lockCache[key]
@@ -0,0 +1,38 @@
+package signedurl
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var (
+	keysDir string
+)
+
+func TestSignedURLSuite(t *testing.T) {
+	logger.SetOutput(GinkgoWriter)
+	logger.SetErrOutput(GinkgoWriter)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Signed URL")
+}
+
+var _ = BeforeSuite(func() {
+	dir, err := ioutil.TempDir("", "oauth2-proxy-signedurl-suite")
+	Expect(err).ToNot(HaveOccurred())
+	keysDir = dir
+
+	Expect(ioutil.WriteFile(path.Join(keysDir, "key"), []byte("0123456789abcdef0123456789abcdef\n"), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(path.Join(keysDir, "rotated"), []byte("fedcba9876543210fedcba9876543210"), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(path.Join(keysDir, "short"), []byte("too short"), 0600)).To(Succeed())
+})
+
+var _ = AfterSuite(func() {
+	Expect(os.RemoveAll(keysDir)).To(Succeed())
+})
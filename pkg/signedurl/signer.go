@@ -0,0 +1,206 @@
+package signedurl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+)
+
+const (
+	// ExpiresParam is the query parameter holding the unix time a signed URL
+	// expires at
+	ExpiresParam = "oauth2_expires"
+
+	// BindIPParam is the query parameter marking the signature of a signed URL
+	// as bound to the IP address of the client
+	BindIPParam = "oauth2_bind_ip"
+
+	// SignatureParam is the query parameter holding the signature of a signed
+	// URL
+	SignatureParam = "oauth2_signature"
+
+	// minKeySize is the minimum size of the signing key, the size of a SHA256
+	// HMAC
+	minKeySize = sha256.Size
+)
+
+var (
+	// ErrNotSigned is returned when verifying a request without a signature
+	ErrNotSigned = errors.New("request is not signed")
+
+	// ErrInvalidSignature is returned when the signature of a request doesn't
+	// match its method, path, expiry or client IP
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrExpired is returned when a signed URL has expired
+	ErrExpired = errors.New("signed URL has expired")
+)
+
+// Signer signs URLs so that a request to the URL, with the same method, is
+// allowed until the URL expires without the client having a session.
+// The signature is an HMAC of the method, path, query, expiry and optionally
+// the client IP of the request, so replacing the key revokes all URLs signed
+// with the previous key.
+type Signer struct {
+	key         []byte
+	maxLifetime time.Duration
+
+	clock clock.Clock
+}
+
+// NewSigner loads the key to sign URLs with.
+func NewSigner(opts options.SignedURL) (*Signer, error) {
+	if opts.KeyFile == "" {
+		return nil, errors.New("no key file configured")
+	}
+	if opts.MaxLifetime <= 0 {
+		return nil, errors.New("max lifetime must be positive")
+	}
+
+	data, err := ioutil.ReadFile(opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file %q: %v", opts.KeyFile, err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("key in %q must be at least %d bytes, got %d bytes", opts.KeyFile, minKeySize, len(key))
+	}
+
+	return &Signer{
+		key:         key,
+		maxLifetime: opts.MaxLifetime,
+	}, nil
+}
+
+// Key returns the key URLs are signed with
+func (s *Signer) Key() []byte {
+	return s.key
+}
+
+// MaxLifetime returns the maximum lifetime of a signed URL
+func (s *Signer) MaxLifetime() time.Duration {
+	return s.maxLifetime
+}
+
+// Sign returns the target with the signature and expiry added to its query,
+// allowing requests with the method until the lifetime has passed.
+// When a client IP is given, only requests from the client IP are allowed.
+func (s *Signer) Sign(method string, target *url.URL, lifetime time.Duration, clientIP net.IP) (*url.URL, time.Time, error) {
+	if lifetime <= 0 {
+		return nil, time.Time{}, errors.New("lifetime must be positive")
+	}
+	if lifetime > s.maxLifetime {
+		return nil, time.Time{}, fmt.Errorf("lifetime %s exceeds the maximum lifetime of %s", lifetime, s.maxLifetime)
+	}
+
+	expires := s.clock.Now().Add(lifetime).Truncate(time.Second)
+
+	signed := *target
+	query := withoutParams(target.Query())
+	bindIP := clientIP != nil
+	query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	if bindIP {
+		query.Set(BindIPParam, "1")
+	}
+	query.Set(SignatureParam, s.signature(method, signed.EscapedPath(), withoutParams(query), expires.Unix(), clientIP))
+	signed.RawQuery = query.Encode()
+
+	return &signed, expires, nil
+}
+
+// Verify checks that the request has a valid signature for its method, path
+// and query, and the client IP when the signature is bound to it, and that it
+// hasn't expired.
+// URLs that expire later than the maximum lifetime from now are rejected, as
+// they were signed with a longer maximum lifetime than is now allowed.
+func (s *Signer) Verify(req *http.Request, clientIP net.IP) error {
+	query := req.URL.Query()
+	signature := query.Get(SignatureParam)
+	if signature == "" {
+		return ErrNotSigned
+	}
+
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid expiry %q", ErrInvalidSignature, query.Get(ExpiresParam))
+	}
+	var boundIP net.IP
+	if query.Get(BindIPParam) != "" {
+		if clientIP == nil {
+			return fmt.Errorf("%w: could not determine the client IP", ErrInvalidSignature)
+		}
+		boundIP = clientIP
+	}
+
+	expected := s.signature(req.Method, req.URL.EscapedPath(), withoutParams(query), expires, boundIP)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	now := s.clock.Now()
+	expiresAt := time.Unix(expires, 0)
+	if !now.Before(expiresAt) {
+		return fmt.Errorf("%w at %s", ErrExpired, expiresAt.UTC().Format(time.RFC3339))
+	}
+	if expiresAt.Sub(now) > s.maxLifetime {
+		return fmt.Errorf("%w: lifetime exceeds the maximum lifetime of %s", ErrInvalidSignature, s.maxLifetime)
+	}
+	return nil
+}
+
+// IsSigned returns whether the request has a signature
+func IsSigned(req *http.Request) bool {
+	return req.URL.Query().Get(SignatureParam) != ""
+}
+
+// Strip removes the signature and expiry from the query of the request, so
+// that they aren't passed to the upstream.
+func Strip(req *http.Request) {
+	req.URL.RawQuery = withoutParams(req.URL.Query()).Encode()
+	req.RequestURI = req.URL.RequestURI()
+}
+
+// signature is the HMAC of the request, its expiry and the client IP when the
+// signature is bound to it
+func (s *Signer) signature(method, path string, query url.Values, expires int64, clientIP net.IP) string {
+	var ip string
+	if clientIP != nil {
+		ip = clientIP.String()
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		query.Encode(),
+		strconv.FormatInt(expires, 10),
+		ip,
+	}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withoutParams returns a copy of the query without the signed URL parameters
+func withoutParams(query url.Values) url.Values {
+	stripped := url.Values{}
+	for name, values := range query {
+		switch name {
+		case ExpiresParam, BindIPParam, SignatureParam:
+			continue
+		}
+		stripped[name] = values
+	}
+	return stripped
+}
@@ -0,0 +1,212 @@
+package signedurl
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed URL Signer Suite", func() {
+	now := time.Unix(1650000000, 0)
+	clientIP := net.ParseIP("10.0.0.1")
+
+	newSigner := func(key string, maxLifetime time.Duration) *Signer {
+		signer, err := NewSigner(options.SignedURL{
+			KeyFile:     path.Join(keysDir, key),
+			MaxLifetime: maxLifetime,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		signer.clock.Set(now)
+		return signer
+	}
+
+	type newSignerTableInput struct {
+		keyFile       string
+		maxLifetime   time.Duration
+		expectedError string
+	}
+
+	DescribeTable("NewSigner",
+		func(in newSignerTableInput) {
+			opts := options.SignedURL{MaxLifetime: in.maxLifetime}
+			if in.keyFile != "" {
+				opts.KeyFile = path.Join(keysDir, in.keyFile)
+			}
+			_, err := NewSigner(opts)
+			Expect(err).To(MatchError(ContainSubstring(in.expectedError)))
+		},
+		Entry("without a key file", newSignerTableInput{
+			maxLifetime:   time.Hour,
+			expectedError: "no key file configured",
+		}),
+		Entry("without a max lifetime", newSignerTableInput{
+			keyFile:       "key",
+			expectedError: "max lifetime must be positive",
+		}),
+		Entry("with a missing key file", newSignerTableInput{
+			keyFile:       "missing",
+			maxLifetime:   time.Hour,
+			expectedError: "could not read key file",
+		}),
+		Entry("with a short key", newSignerTableInput{
+			keyFile:       "short",
+			maxLifetime:   time.Hour,
+			expectedError: "must be at least 32 bytes, got 9 bytes",
+		}),
+	)
+
+	It("rejects lifetimes over the maximum", func() {
+		signer := newSigner("key", time.Hour)
+		_, _, err := signer.Sign(http.MethodGet, &url.URL{Path: "/"}, 2*time.Hour, nil)
+		Expect(err).To(MatchError("lifetime 2h0m0s exceeds the maximum lifetime of 1h0m0s"))
+	})
+
+	type verifyTableInput struct {
+		bindIP      bool
+		maxLifetime time.Duration
+		// modify the request after the URL has been signed
+		modify        func(*Signer, *http.Request) *Signer
+		expectedError error
+	}
+
+	DescribeTable("Verify",
+		func(in verifyTableInput) {
+			signer := newSigner("key", time.Hour)
+			defer signer.clock.Reset()
+
+			var bindIP net.IP
+			if in.bindIP {
+				bindIP = clientIP
+			}
+			target, err := url.Parse("https://app.example.com/reports/2022%2F04?format=pdf&oauth2_expires=1")
+			Expect(err).ToNot(HaveOccurred())
+			signed, expires, err := signer.Sign(http.MethodGet, target, 10*time.Minute, bindIP)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expires).To(Equal(now.Add(10 * time.Minute)))
+			Expect(signed.Host).To(Equal("app.example.com"))
+			Expect(signed.Query().Get("format")).To(Equal("pdf"))
+			Expect(signed.Query().Get(ExpiresParam)).To(Equal("1650000600"))
+
+			req := httptest.NewRequest(http.MethodGet, signed.String(), nil)
+			Expect(IsSigned(req)).To(BeTrue())
+			verifier := signer
+			if in.modify != nil {
+				verifier = in.modify(signer, req)
+			}
+
+			err = verifier.Verify(req, clientIP)
+			if in.expectedError == nil {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(errors.Is(err, in.expectedError)).To(BeTrue(), "unexpected error: %v", err)
+			}
+		},
+		Entry("with a valid signature", verifyTableInput{}),
+		Entry("with a valid signature bound to the client IP", verifyTableInput{
+			bindIP: true,
+		}),
+		Entry("with another client IP", verifyTableInput{
+			bindIP: true,
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				Expect(signer.Verify(req, net.ParseIP("10.0.0.2"))).To(MatchError(ErrInvalidSignature))
+				Expect(signer.Verify(req, nil)).ToNot(Succeed())
+				return signer
+			},
+		}),
+		Entry("with the IP binding removed", verifyTableInput{
+			bindIP: true,
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				req.URL.RawQuery = removeParam(req.URL.Query(), BindIPParam)
+				return signer
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("with another method", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				req.Method = http.MethodPost
+				return signer
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("with another path", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				req.URL.Path = "/reports/2022/05"
+				req.URL.RawPath = ""
+				return signer
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("with another query", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				query := req.URL.Query()
+				query.Set("format", "csv")
+				req.URL.RawQuery = query.Encode()
+				return signer
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("with an extended expiry", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				query := req.URL.Query()
+				query.Set(ExpiresParam, "1650003600")
+				req.URL.RawQuery = query.Encode()
+				return signer
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("without a signature", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				req.URL.RawQuery = removeParam(req.URL.Query(), SignatureParam)
+				Expect(IsSigned(req)).To(BeFalse())
+				return signer
+			},
+			expectedError: ErrNotSigned,
+		}),
+		Entry("after it expired", verifyTableInput{
+			modify: func(signer *Signer, req *http.Request) *Signer {
+				Expect(signer.clock.Add(10 * time.Minute)).To(Succeed())
+				return signer
+			},
+			expectedError: ErrExpired,
+		}),
+		Entry("after the key was rotated", verifyTableInput{
+			modify: func(_ *Signer, req *http.Request) *Signer {
+				return newSigner("rotated", time.Hour)
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+		Entry("after the max lifetime was reduced", verifyTableInput{
+			modify: func(_ *Signer, req *http.Request) *Signer {
+				return newSigner("key", 5*time.Minute)
+			},
+			expectedError: ErrInvalidSignature,
+		}),
+	)
+
+	It("strips the signed URL parameters", func() {
+		signer := newSigner("key", time.Hour)
+		defer signer.clock.Reset()
+
+		signed, _, err := signer.Sign(http.MethodGet, &url.URL{Path: "/download", RawQuery: "file=a.txt"}, time.Minute, clientIP)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest(http.MethodGet, signed.String(), nil)
+		Strip(req)
+		Expect(req.URL.RawQuery).To(Equal("file=a.txt"))
+		Expect(req.RequestURI).To(Equal("/download?file=a.txt"))
+	})
+})
+
+func removeParam(query url.Values, name string) string {
+	query.Del(name)
+	return query.Encode()
+}
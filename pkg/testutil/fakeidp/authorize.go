@@ -0,0 +1,156 @@
+package fakeidp
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// codeExpiry is how long the authorization codes can be redeemed for
+const codeExpiry = 10 * time.Minute
+
+// Consent is the decision of the user on an authorization, from the
+// authorization endpoint or the verification of a device code
+type Consent struct {
+	// Deny refuses the authorization with the Error, access_denied by
+	// default, and its Description
+	Deny        bool
+	Error       string
+	Description string
+
+	// Claims replace the claims of the user for the tokens of the
+	// authorization, eg. to sign in as another user
+	Claims map[string]interface{}
+}
+
+// grant is an authorization of the client, which the codes, access tokens and
+// refresh tokens refer to
+type grant struct {
+	claims map[string]interface{}
+	scope  string
+	nonce  string
+
+	redirectURI         string
+	codeChallenge       string
+	codeChallengeMethod string
+
+	// expires is when the code or access token expires
+	expires time.Time
+}
+
+// ScriptConsent queues the decisions of the next authorizations, in order.
+// The authorizations are approved with the claims of the user once the
+// scripted decisions have all been used.
+func (s *Server) ScriptConsent(consents ...Consent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.consents = append(s.consents, consents...)
+}
+
+// nextConsent returns the next scripted decision, with the claims of the user
+// unless it replaces them. The mutex must be held.
+func (s *Server) nextConsent() Consent {
+	consent := Consent{}
+	if len(s.consents) > 0 {
+		consent = s.consents[0]
+		s.consents = s.consents[1:]
+	}
+	if consent.Deny && consent.Error == "" {
+		consent.Error = "access_denied"
+	}
+	if consent.Claims == nil {
+		consent.Claims = s.claims()
+	}
+	return consent
+}
+
+// serveAuthorization approves or denies the authorization request straight
+// away, according to the scripted consent, redirecting to the client with a
+// code or an error
+func (s *Server) serveAuthorization(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.Form.Get("client_id") != s.opts.ClientID {
+		writeError(rw, http.StatusBadRequest, "invalid_client", "unknown client_id")
+		return
+	}
+	redirectURI, err := url.Parse(req.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		writeError(rw, http.StatusBadRequest, "invalid_request", "redirect_uri must be an absolute URL")
+		return
+	}
+	if req.Form.Get("response_type") != "code" {
+		s.redirectError(rw, req, "unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	challenge := req.Form.Get("code_challenge")
+	method := req.Form.Get("code_challenge_method")
+	if challenge != "" && method == "" {
+		method = encryption.CodeChallengeMethodPlain
+	}
+	if method != "" && method != encryption.CodeChallengeMethodPlain && method != encryption.CodeChallengeMethodS256 {
+		s.redirectError(rw, req, "invalid_request", "unsupported code_challenge_method")
+		return
+	}
+
+	s.mutex.Lock()
+	consent := s.nextConsent()
+	if consent.Deny {
+		s.mutex.Unlock()
+		s.redirectError(rw, req, consent.Error, consent.Description)
+		return
+	}
+	code := randomToken()
+	s.codes[code] = &grant{
+		claims:              consent.Claims,
+		scope:               req.Form.Get("scope"),
+		nonce:               req.Form.Get("nonce"),
+		redirectURI:         redirectURI.String(),
+		codeChallenge:       challenge,
+		codeChallengeMethod: method,
+		expires:             s.Clock.Now().Add(codeExpiry),
+	}
+	s.mutex.Unlock()
+
+	query := redirectURI.Query()
+	query.Set("code", code)
+	if state := req.Form.Get("state"); state != "" {
+		query.Set("state", state)
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(rw, req, redirectURI.String(), http.StatusFound)
+}
+
+// redirectError redirects an authorization request to the client with the
+// error
+func (s *Server) redirectError(rw http.ResponseWriter, req *http.Request, code, description string) {
+	redirectURI, err := url.Parse(req.FormValue("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		writeError(rw, http.StatusBadRequest, code, description)
+		return
+	}
+	query := redirectURI.Query()
+	query.Set("error", code)
+	if description != "" {
+		query.Set("error_description", description)
+	}
+	if state := req.FormValue("state"); state != "" {
+		query.Set("state", state)
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(rw, req, redirectURI.String(), http.StatusFound)
+}
+
+// randomToken generates the opaque codes and tokens
+func randomToken() string {
+	b, err := encryption.Nonce(32)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,112 @@
+package fakeidp_test
+
+import (
+	"context"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Authorization", func() {
+	var s *fakeidp.Server
+
+	BeforeEach(func() {
+		var err error
+		s, err = fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	verify := func(token *oauth2.Token) *oidc.IDToken {
+		rawIDToken, ok := token.Extra("id_token").(string)
+		Expect(ok).To(BeTrue())
+		verifier := oidc.NewVerifier(s.Issuer(), oidc.NewRemoteKeySet(context.Background(), s.JWKSEndpoint()), &oidc.Config{ClientID: s.ClientID()})
+		idToken, err := verifier.Verify(context.Background(), rawIDToken)
+		Expect(err).ToNot(HaveOccurred())
+		return idToken
+	}
+
+	It("approves the authorization with the claims of the user", func() {
+		query := authorize(s, oauth2.SetAuthURLParam("nonce", "nonce1234"))
+		Expect(query.Get("state")).To(Equal("state1234"))
+
+		token, err := oauth2Config(s).Exchange(context.Background(), query.Get("code"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.AccessToken).ToNot(BeEmpty())
+		Expect(token.RefreshToken).ToNot(BeEmpty())
+
+		idToken := verify(token)
+		Expect(idToken.Subject).To(Equal("1234567890"))
+		Expect(idToken.Nonce).To(Equal("nonce1234"))
+		claims := map[string]interface{}{}
+		Expect(idToken.Claims(&claims)).To(Succeed())
+		Expect(claims).To(HaveKeyWithValue("email", "jane.doe@example.com"))
+		Expect(claims).To(HaveKeyWithValue("groups", ConsistOf("admins", "developers")))
+	})
+
+	It("redeems each code once", func() {
+		query := authorize(s)
+		_, err := oauth2Config(s).Exchange(context.Background(), query.Get("code"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = oauth2Config(s).Exchange(context.Background(), query.Get("code"))
+		Expect(err).To(MatchError(ContainSubstring("unknown or expired code")))
+	})
+
+	It("follows the scripted consent", func() {
+		s.ScriptConsent(
+			fakeidp.Consent{Deny: true},
+			fakeidp.Consent{Deny: true, Error: "login_required", Description: "the user must sign in"},
+			fakeidp.Consent{Claims: map[string]interface{}{"sub": "other", "email": "john.doe@example.com"}},
+		)
+
+		query := authorize(s)
+		Expect(query.Get("error")).To(Equal("access_denied"))
+		Expect(query.Get("state")).To(Equal("state1234"))
+		Expect(query.Has("code")).To(BeFalse())
+
+		query = authorize(s)
+		Expect(query.Get("error")).To(Equal("login_required"))
+		Expect(query.Get("error_description")).To(Equal("the user must sign in"))
+
+		Expect(verify(login(s)).Subject).To(Equal("other"))
+		Expect(verify(login(s)).Subject).To(Equal("1234567890"))
+	})
+
+	It("redirects with the injected failures", func() {
+		s.FailNext(fakeidp.AuthorizationEndpoint, fakeidp.Failure{Error: "temporarily_unavailable"})
+
+		query := authorize(s)
+		Expect(query.Get("error")).To(Equal("temporarily_unavailable"))
+		Expect(s.Requests(fakeidp.AuthorizationEndpoint)).To(Equal(1))
+	})
+
+	DescribeTable("checks the code verifier",
+		func(method, verifier string, expectedErr string) {
+			challenge, err := encryption.GenerateCodeChallenge(method, "verifier1234")
+			Expect(err).ToNot(HaveOccurred())
+			query := authorize(s,
+				oauth2.SetAuthURLParam("code_challenge", challenge),
+				oauth2.SetAuthURLParam("code_challenge_method", method),
+			)
+
+			_, err = oauth2Config(s).Exchange(context.Background(), query.Get("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+			if expectedErr == "" {
+				Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("with a S256 challenge", "S256", "verifier1234", ""),
+		Entry("with a plain challenge", "plain", "verifier1234", ""),
+		Entry("with a wrong verifier", "S256", "verifier5678", "code_verifier does not match the code_challenge"),
+		Entry("without a verifier", "S256", "", "code_verifier does not match the code_challenge"),
+	)
+})
@@ -0,0 +1,151 @@
+package fakeidp
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+)
+
+// userCodeAlphabet has no vowels or ambiguous letters, as recommended by
+// RFC 8628
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// deviceGrant is a device authorization, waiting for the user to verify its
+// user code until it expires
+type deviceGrant struct {
+	grant
+	userCode string
+	verified bool
+	consent  Consent
+}
+
+// deviceAuthorizationResponse is the response of the device authorization
+// endpoint
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+func (s *Server) serveDeviceAuthorization(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "invalid_request", "the device authorization endpoint only accepts POST requests")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !s.authenticateClient(req) {
+		writeError(rw, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	deviceCode := randomToken()
+	userCode, err := newUserCode()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	s.mutex.Lock()
+	s.devices[deviceCode] = &deviceGrant{
+		grant: grant{
+			scope:   req.PostForm.Get("scope"),
+			expires: s.Clock.Now().Add(s.opts.DeviceCodeExpiry),
+		},
+		userCode: userCode,
+	}
+	s.mutex.Unlock()
+
+	verificationURI := s.Issuer() + DeviceVerificationPath
+	writeJSON(rw, http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int64(s.opts.DeviceCodeExpiry.Seconds()),
+		Interval:                int64(s.opts.DevicePollInterval.Seconds()),
+	})
+}
+
+// VerifyDevice completes the verification of the user code, as the user does
+// at the verification URI, approving or denying the device according to the
+// scripted consent
+func (s *Server) VerifyDevice(userCode string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, device := range s.devices {
+		if device.userCode != userCode {
+			continue
+		}
+		if device.verified {
+			return errors.New("the user code has already been verified")
+		}
+		if !s.Clock.Now().Before(device.expires) {
+			return errors.New("the user code has expired")
+		}
+		device.verified = true
+		device.consent = s.nextConsent()
+		device.claims = device.consent.Claims
+		return nil
+	}
+	return fmt.Errorf("unknown user code %q", userCode)
+}
+
+// serveDeviceVerification verifies the user_code query parameter, standing in
+// for the page the user enters it on
+func (s *Server) serveDeviceVerification(rw http.ResponseWriter, req *http.Request) {
+	if err := s.VerifyDevice(req.URL.Query().Get("user_code")); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("The device has been verified, you can return to it."))
+}
+
+// redeemDeviceCode issues tokens for a device code once its user code has
+// been verified and approved, and tells the client to keep polling until then
+func (s *Server) redeemDeviceCode(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	deviceCode := req.PostForm.Get("device_code")
+	device, ok := s.devices[deviceCode]
+	if ok && device.verified {
+		delete(s.devices, deviceCode)
+	}
+	s.mutex.Unlock()
+
+	switch {
+	case !ok:
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "unknown device code")
+	case device.verified && device.consent.Deny:
+		writeError(rw, http.StatusBadRequest, device.consent.Error, device.consent.Description)
+	case device.verified:
+		s.issueTokens(rw, &device.grant, "", true)
+	case !s.Clock.Now().Before(device.expires):
+		writeError(rw, http.StatusBadRequest, "expired_token", "the device code has expired")
+	default:
+		writeError(rw, http.StatusBadRequest, "authorization_pending", "the user code has not been verified yet")
+	}
+}
+
+// newUserCode generates a user code in the XXXX-XXXX format
+func newUserCode() (string, error) {
+	code := make([]byte, 0, 9)
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, userCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
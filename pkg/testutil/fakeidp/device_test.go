@@ -0,0 +1,96 @@
+package fakeidp_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Device authorization", func() {
+	var s *fakeidp.Server
+
+	BeforeEach(func() {
+		var err error
+		s, err = fakeidp.New(fakeidp.Options{DeviceCodeExpiry: time.Minute})
+		Expect(err).ToNot(HaveOccurred())
+		s.Clock.Set(time.Now())
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	post := func(endpoint string, form url.Values) map[string]interface{} {
+		req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(s.ClientID(), s.ClientSecret())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body := map[string]interface{}{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		return body
+	}
+
+	authorizeDevice := func() map[string]interface{} {
+		device := post(s.DeviceAuthorizationEndpoint(), url.Values{"scope": {"openid email"}})
+		Expect(device).To(HaveKeyWithValue("verification_uri", s.Issuer()+fakeidp.DeviceVerificationPath))
+		Expect(device["user_code"]).To(MatchRegexp(`^[B-Z]{4}-[B-Z]{4}$`))
+		Expect(device).To(HaveKeyWithValue("expires_in", float64(60)))
+		Expect(device).To(HaveKeyWithValue("interval", float64(5)))
+		return device
+	}
+
+	poll := func(device map[string]interface{}) map[string]interface{} {
+		return post(s.TokenEndpoint(), url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device["device_code"].(string)},
+		})
+	}
+
+	It("issues tokens once the user code is verified", func() {
+		device := authorizeDevice()
+		Expect(poll(device)).To(HaveKeyWithValue("error", "authorization_pending"))
+
+		resp, err := http.Get(device["verification_uri_complete"].(string))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK), string(body))
+
+		token := poll(device)
+		Expect(token).To(HaveKey("access_token"))
+		Expect(token).To(HaveKey("id_token"))
+		Expect(token).To(HaveKeyWithValue("scope", "openid email"))
+
+		Expect(poll(device)).To(HaveKeyWithValue("error", "invalid_grant"))
+	})
+
+	It("denies the device with the scripted consent", func() {
+		s.ScriptConsent(fakeidp.Consent{Deny: true})
+		device := authorizeDevice()
+
+		Expect(s.VerifyDevice(device["user_code"].(string))).To(Succeed())
+		Expect(s.VerifyDevice(device["user_code"].(string))).To(MatchError("the user code has already been verified"))
+		Expect(poll(device)).To(HaveKeyWithValue("error", "access_denied"))
+	})
+
+	It("expires the device codes", func() {
+		device := authorizeDevice()
+		Expect(s.Clock.Add(time.Minute)).To(Succeed())
+
+		Expect(poll(device)).To(HaveKeyWithValue("error", "expired_token"))
+		Expect(s.VerifyDevice(device["user_code"].(string))).To(MatchError("the user code has expired"))
+		Expect(s.VerifyDevice("BCDF-GHJK")).To(MatchError(`unknown user code "BCDF-GHJK"`))
+	})
+})
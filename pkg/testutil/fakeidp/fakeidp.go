@@ -0,0 +1,367 @@
+// Package fakeidp provides a fake OpenID Connect provider, to test OAuth2
+// Proxy and its configurations end to end without a real identity provider.
+//
+// The provider serves discovery, a JWKS whose keys can be rotated, an
+// authorization endpoint whose consent can be scripted, a token endpoint for
+// the authorization code, refresh token and device code grants, userinfo,
+// token introspection and device authorization. Failures can be injected into
+// any endpoint.
+package fakeidp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+)
+
+// The paths of the endpoints, relative to the issuer
+const (
+	DiscoveryPath           = "/.well-known/openid-configuration"
+	JWKSPath                = "/jwks"
+	AuthorizationPath       = "/authorize"
+	TokenPath               = "/token"
+	UserInfoPath            = "/userinfo"
+	IntrospectionPath       = "/introspect"
+	DeviceAuthorizationPath = "/device/code"
+	DeviceVerificationPath  = "/device"
+)
+
+const (
+	deviceCodeGrantType       = "urn:ietf:params:oauth:grant-type:device_code"
+	defaultClientID           = "oauth2-proxy"
+	defaultClientSecret       = "secret"
+	defaultAccessTokenExpiry  = time.Hour
+	defaultDeviceCodeExpiry   = 10 * time.Minute
+	defaultDevicePollInterval = 5 * time.Second
+)
+
+// Endpoint identifies an endpoint of the provider, to inject failures into
+type Endpoint string
+
+// The endpoints of the provider
+const (
+	DiscoveryEndpoint           Endpoint = "discovery"
+	JWKSEndpoint                Endpoint = "jwks"
+	AuthorizationEndpoint       Endpoint = "authorization"
+	TokenEndpoint               Endpoint = "token"
+	UserInfoEndpoint            Endpoint = "userinfo"
+	IntrospectionEndpoint       Endpoint = "introspection"
+	DeviceAuthorizationEndpoint Endpoint = "device_authorization"
+)
+
+// Options configure the provider. The zero value is a working provider with
+// a single client and user.
+type Options struct {
+	// ClientID and ClientSecret are the credentials of the only client,
+	// "oauth2-proxy" and "secret" by default
+	ClientID     string
+	ClientSecret string
+
+	// Claims are the claims of the user, added to the ID tokens, userinfo
+	// and introspection responses. Defaults to DefaultClaims.
+	Claims map[string]interface{}
+
+	// AccessTokenExpiry is the lifetime of the access and ID tokens, 1 hour
+	// by default
+	AccessTokenExpiry time.Duration
+
+	// RotateRefreshTokens issues a new refresh token on each refresh,
+	// invalidating the one it was refreshed with
+	RotateRefreshTokens bool
+
+	// OmitRefreshIDToken leaves the ID token out of the responses to refresh
+	// token grants, as some providers do
+	OmitRefreshIDToken bool
+
+	// DeviceCodeExpiry is the lifetime of the device codes, 10 minutes by
+	// default, and DevicePollInterval the interval clients must poll the
+	// token endpoint at, 5 seconds by default
+	DeviceCodeExpiry   time.Duration
+	DevicePollInterval time.Duration
+}
+
+// DefaultClaims returns the claims of the default user
+func DefaultClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":                "1234567890",
+		"email":              "jane.doe@example.com",
+		"email_verified":     true,
+		"name":               "Jane Doe",
+		"preferred_username": "jane.doe",
+		"groups":             []string{"admins", "developers"},
+	}
+}
+
+// Discovery is the OpenID Connect discovery document of the provider
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+}
+
+// Failure is an error response injected into an endpoint
+type Failure struct {
+	// Status is the HTTP status of the response
+	Status int
+	// Error and Description are the OAuth2 error of the response, written as
+	// JSON when Error is set, or as a redirect for the authorization
+	// endpoint
+	Error       string
+	Description string
+}
+
+// Server is a fake OpenID Connect provider, serving over HTTP on the
+// loopback interface
+type Server struct {
+	// Clock is the clock the tokens and device codes expire with
+	Clock clock.Clock
+
+	opts   Options
+	server *httptest.Server
+
+	mutex         sync.Mutex
+	keys          []*signingKey
+	discovery     []func(*Discovery)
+	failures      map[Endpoint][]Failure
+	requests      map[Endpoint]int
+	consents      []Consent
+	codes         map[string]*grant
+	accessTokens  map[string]*grant
+	refreshTokens map[string]*grant
+	devices       map[string]*deviceGrant
+}
+
+// New starts a fake provider, which must be closed once the test is done
+func New(opts Options) (*Server, error) {
+	if opts.ClientID == "" {
+		opts.ClientID = defaultClientID
+	}
+	if opts.ClientSecret == "" {
+		opts.ClientSecret = defaultClientSecret
+	}
+	if opts.Claims == nil {
+		opts.Claims = DefaultClaims()
+	}
+	if opts.AccessTokenExpiry == 0 {
+		opts.AccessTokenExpiry = defaultAccessTokenExpiry
+	}
+	if opts.DeviceCodeExpiry == 0 {
+		opts.DeviceCodeExpiry = defaultDeviceCodeExpiry
+	}
+	if opts.DevicePollInterval == 0 {
+		opts.DevicePollInterval = defaultDevicePollInterval
+	}
+
+	key, err := newSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		opts:          opts,
+		keys:          []*signingKey{key},
+		failures:      map[Endpoint][]Failure{},
+		requests:      map[Endpoint]int{},
+		codes:         map[string]*grant{},
+		accessTokens:  map[string]*grant{},
+		refreshTokens: map[string]*grant{},
+		devices:       map[string]*deviceGrant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(DiscoveryPath, s.endpoint(DiscoveryEndpoint, s.serveDiscovery))
+	mux.Handle(JWKSPath, s.endpoint(JWKSEndpoint, s.serveJWKS))
+	mux.Handle(AuthorizationPath, s.endpoint(AuthorizationEndpoint, s.serveAuthorization))
+	mux.Handle(TokenPath, s.endpoint(TokenEndpoint, s.serveToken))
+	mux.Handle(UserInfoPath, s.endpoint(UserInfoEndpoint, s.serveUserInfo))
+	mux.Handle(IntrospectionPath, s.endpoint(IntrospectionEndpoint, s.serveIntrospection))
+	mux.Handle(DeviceAuthorizationPath, s.endpoint(DeviceAuthorizationEndpoint, s.serveDeviceAuthorization))
+	mux.Handle(DeviceVerificationPath, http.HandlerFunc(s.serveDeviceVerification))
+	s.server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// Close shuts the provider down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Issuer is the issuer URL of the provider, which its discovery document is
+// served under
+func (s *Server) Issuer() string {
+	return s.server.URL
+}
+
+// ClientID is the ID of the client of the provider
+func (s *Server) ClientID() string {
+	return s.opts.ClientID
+}
+
+// ClientSecret is the secret of the client of the provider
+func (s *Server) ClientSecret() string {
+	return s.opts.ClientSecret
+}
+
+// AuthorizationEndpoint is the URL of the authorization endpoint
+func (s *Server) AuthorizationEndpoint() string {
+	return s.server.URL + AuthorizationPath
+}
+
+// TokenEndpoint is the URL of the token endpoint
+func (s *Server) TokenEndpoint() string {
+	return s.server.URL + TokenPath
+}
+
+// JWKSEndpoint is the URL of the JSON Web Key Set
+func (s *Server) JWKSEndpoint() string {
+	return s.server.URL + JWKSPath
+}
+
+// UserInfoEndpoint is the URL of the userinfo endpoint
+func (s *Server) UserInfoEndpoint() string {
+	return s.server.URL + UserInfoPath
+}
+
+// IntrospectionEndpoint is the URL of the token introspection endpoint
+func (s *Server) IntrospectionEndpoint() string {
+	return s.server.URL + IntrospectionPath
+}
+
+// DeviceAuthorizationEndpoint is the URL of the device authorization
+// endpoint
+func (s *Server) DeviceAuthorizationEndpoint() string {
+	return s.server.URL + DeviceAuthorizationPath
+}
+
+// SetClaims replaces the claims of the user for the tokens issued from now on
+func (s *Server) SetClaims(claims map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.opts.Claims = claims
+}
+
+// ModifyDiscovery changes the discovery document served by the provider,
+// eg. to advertise other endpoints or a different issuer. The modifications
+// are applied in order to the default document.
+func (s *Server) ModifyDiscovery(modify func(*Discovery)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.discovery = append(s.discovery, modify)
+}
+
+// FailNext makes the next requests to the endpoint fail with the failures, in
+// order. The endpoint responds normally again once they have all been used.
+func (s *Server) FailNext(endpoint Endpoint, failures ...Failure) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failures...)
+}
+
+// Requests returns the number of requests the endpoint has received,
+// including those that failed
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[endpoint]
+}
+
+// endpoint counts the requests to the endpoint and responds with the next
+// failure injected into it, if any, before calling the handler
+func (s *Server) endpoint(endpoint Endpoint, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.mutex.Lock()
+		s.requests[endpoint]++
+		var failure *Failure
+		if failures := s.failures[endpoint]; len(failures) > 0 {
+			failure = &failures[0]
+			s.failures[endpoint] = failures[1:]
+		}
+		s.mutex.Unlock()
+
+		if failure == nil {
+			handler(rw, req)
+			return
+		}
+		if endpoint == AuthorizationEndpoint && failure.Status == 0 {
+			s.redirectError(rw, req, failure.Error, failure.Description)
+			return
+		}
+		status := failure.Status
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		if failure.Error == "" {
+			rw.WriteHeader(status)
+			return
+		}
+		writeError(rw, status, failure.Error, failure.Description)
+	})
+}
+
+func (s *Server) serveDiscovery(rw http.ResponseWriter, _ *http.Request) {
+	discovery := &Discovery{
+		Issuer:                            s.Issuer(),
+		AuthorizationEndpoint:             s.AuthorizationEndpoint(),
+		TokenEndpoint:                     s.TokenEndpoint(),
+		JWKSURI:                           s.JWKSEndpoint(),
+		UserInfoEndpoint:                  s.UserInfoEndpoint(),
+		IntrospectionEndpoint:             s.IntrospectionEndpoint(),
+		DeviceAuthorizationEndpoint:       s.DeviceAuthorizationEndpoint(),
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   []string{"openid", "email", "profile", "groups", "offline_access"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", deviceCodeGrantType},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256", "plain"},
+		ClaimsSupported:                   []string{"sub", "email", "email_verified", "name", "preferred_username", "groups"},
+	}
+	s.mutex.Lock()
+	for _, modify := range s.discovery {
+		modify(discovery)
+	}
+	s.mutex.Unlock()
+	writeJSON(rw, http.StatusOK, discovery)
+}
+
+// claims returns a copy of the claims of the user
+func (s *Server) claims() map[string]interface{} {
+	claims := make(map[string]interface{}, len(s.opts.Claims))
+	for key, value := range s.opts.Claims {
+		claims[key] = value
+	}
+	return claims
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+// writeError writes an OAuth2 error response
+func writeError(rw http.ResponseWriter, status int, code, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	writeJSON(rw, status, body)
+}
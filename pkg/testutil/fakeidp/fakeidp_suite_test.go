@@ -0,0 +1,65 @@
+package fakeidp_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+)
+
+const redirectURL = "https://app.example.com/oauth2/callback"
+
+func TestFakeIdPSuite(t *testing.T) {
+	logger.SetOutput(GinkgoWriter)
+	logger.SetErrOutput(GinkgoWriter)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fake IdP")
+}
+
+// oauth2Config is the configuration of a client of the provider
+func oauth2Config(s *fakeidp.Server) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     s.ClientID(),
+		ClientSecret: s.ClientSecret(),
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   s.AuthorizationEndpoint(),
+			TokenURL:  s.TokenEndpoint(),
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}
+}
+
+// authorize sends an authorization request, returning the query of the
+// redirect to the client
+func authorize(s *fakeidp.Server, opts ...oauth2.AuthCodeOption) url.Values {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(oauth2Config(s).AuthCodeURL("state1234", opts...))
+	Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+	Expect(resp.StatusCode).To(Equal(http.StatusFound))
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	Expect(err).ToNot(HaveOccurred())
+	Expect(location.Scheme + "://" + location.Host + location.Path).To(Equal(redirectURL))
+	return location.Query()
+}
+
+// login signs in through the authorization endpoint and redeems the code
+func login(s *fakeidp.Server) *oauth2.Token {
+	query := authorize(s)
+	Expect(query.Get("code")).ToNot(BeEmpty())
+	token, err := oauth2Config(s).Exchange(context.Background(), query.Get("code"))
+	Expect(err).ToNot(HaveOccurred())
+	return token
+}
@@ -0,0 +1,79 @@
+package fakeidp_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	var s *fakeidp.Server
+
+	BeforeEach(func() {
+		var err error
+		s, err = fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("serves its discovery document", func() {
+		provider, err := oidc.NewProvider(context.Background(), s.Issuer())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(provider.Endpoint().AuthURL).To(Equal(s.AuthorizationEndpoint()))
+		Expect(provider.Endpoint().TokenURL).To(Equal(s.TokenEndpoint()))
+
+		var discovery fakeidp.Discovery
+		Expect(provider.Claims(&discovery)).To(Succeed())
+		Expect(discovery.UserInfoEndpoint).To(Equal(s.UserInfoEndpoint()))
+		Expect(discovery.JWKSURI).To(Equal(s.JWKSEndpoint()))
+		Expect(discovery.IntrospectionEndpoint).To(Equal(s.IntrospectionEndpoint()))
+		Expect(discovery.DeviceAuthorizationEndpoint).To(Equal(s.DeviceAuthorizationEndpoint()))
+		Expect(discovery.CodeChallengeMethodsSupported).To(ConsistOf("S256", "plain"))
+	})
+
+	It("serves the modified discovery document", func() {
+		s.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.RevocationEndpoint = d.Issuer + "/revoke"
+		})
+		s.ModifyDiscovery(func(d *fakeidp.Discovery) {
+			d.Issuer = "https://other.example.com"
+		})
+
+		_, err := oidc.NewProvider(context.Background(), s.Issuer())
+		Expect(err).To(MatchError(ContainSubstring("oidc: issuer did not match the issuer returned by provider")))
+
+		resp, err := http.Get(s.Issuer() + fakeidp.DiscoveryPath)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		var discovery fakeidp.Discovery
+		Expect(json.NewDecoder(resp.Body).Decode(&discovery)).To(Succeed())
+		Expect(discovery.Issuer).To(Equal("https://other.example.com"))
+		Expect(discovery.RevocationEndpoint).To(Equal(s.Issuer() + "/revoke"))
+	})
+
+	It("fails the next requests with the injected failures", func() {
+		s.FailNext(fakeidp.DiscoveryEndpoint,
+			fakeidp.Failure{Status: http.StatusServiceUnavailable},
+			fakeidp.Failure{Status: http.StatusBadRequest, Error: "invalid_request"},
+		)
+
+		_, err := oidc.NewProvider(context.Background(), s.Issuer())
+		Expect(err).To(MatchError(ContainSubstring("503 Service Unavailable")))
+		_, err = oidc.NewProvider(context.Background(), s.Issuer())
+		Expect(err).To(MatchError(ContainSubstring(`400 Bad Request: {"error":"invalid_request"}`)))
+		_, err = oidc.NewProvider(context.Background(), s.Issuer())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.Requests(fakeidp.DiscoveryEndpoint)).To(Equal(3))
+		Expect(s.Requests(fakeidp.TokenEndpoint)).To(Equal(0))
+	})
+})
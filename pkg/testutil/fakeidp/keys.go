@@ -0,0 +1,88 @@
+package fakeidp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// signingKey is a key the provider signs JWTs with, identified by its JWK
+// thumbprint
+type signingKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+func newSigningKey() (*signingKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate signing key: %v", err)
+	}
+	thumbprint, err := (&jose.JSONWebKey{Key: &key.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute the thumbprint of the signing key: %v", err)
+	}
+	return &signingKey{id: base64.RawURLEncoding.EncodeToString(thumbprint), key: key}, nil
+}
+
+// RotateKeys generates a new signing key, which the JWTs are signed with from
+// now on, and returns its key ID. The previous keys are still published in
+// the JWKS, until they are retired.
+func (s *Server) RotateKeys() (string, error) {
+	key, err := newSigningKey()
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = append([]*signingKey{key}, s.keys...)
+	return key.id, nil
+}
+
+// RetireKeys removes the keys replaced by RotateKeys from the JWKS, so that
+// the JWTs they signed no longer verify
+func (s *Server) RetireKeys() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = s.keys[:1]
+}
+
+// KeyID returns the ID of the key the JWTs are signed with
+func (s *Server) KeyID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keys[0].id
+}
+
+// SignJWT signs the claims with the current signing key of the provider, eg.
+// to build ID tokens with specific claims
+func (s *Server) SignJWT(claims jwt.Claims) (string, error) {
+	s.mutex.Lock()
+	key := s.keys[0]
+	s.mutex.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.key)
+}
+
+func (s *Server) serveJWKS(rw http.ResponseWriter, _ *http.Request) {
+	s.mutex.Lock()
+	keySet := jose.JSONWebKeySet{}
+	for _, key := range s.keys {
+		keySet.Keys = append(keySet.Keys, jose.JSONWebKey{
+			Key:       &key.key.PublicKey,
+			KeyID:     key.id,
+			Algorithm: "RS256",
+			Use:       "sig",
+		})
+	}
+	s.mutex.Unlock()
+	writeJSON(rw, http.StatusOK, keySet)
+}
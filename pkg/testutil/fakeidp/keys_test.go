@@ -0,0 +1,67 @@
+package fakeidp_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keys", func() {
+	var s *fakeidp.Server
+	var verifier *oidc.IDTokenVerifier
+
+	BeforeEach(func() {
+		var err error
+		s, err = fakeidp.New(fakeidp.Options{})
+		Expect(err).ToNot(HaveOccurred())
+		verifier = oidc.NewVerifier(s.Issuer(), oidc.NewRemoteKeySet(context.Background(), s.JWKSEndpoint()), &oidc.Config{ClientID: s.ClientID()})
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	sign := func() string {
+		rawIDToken, err := s.SignJWT(jwt.StandardClaims{
+			Audience:  s.ClientID(),
+			Issuer:    s.Issuer(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			Subject:   "user",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return rawIDToken
+	}
+
+	It("signs tokens verified with the JWKS", func() {
+		idToken, err := verifier.Verify(context.Background(), sign())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(idToken.Subject).To(Equal("user"))
+	})
+
+	It("keeps publishing the previous keys until they are retired", func() {
+		previousKeyID := s.KeyID()
+		previous := sign()
+
+		keyID, err := s.RotateKeys()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keyID).ToNot(Equal(previousKeyID))
+		Expect(s.KeyID()).To(Equal(keyID))
+
+		_, err = verifier.Verify(context.Background(), sign())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifier.Verify(context.Background(), previous)
+		Expect(err).ToNot(HaveOccurred())
+
+		s.RetireKeys()
+		verifier = oidc.NewVerifier(s.Issuer(), oidc.NewRemoteKeySet(context.Background(), s.JWKSEndpoint()), &oidc.Config{ClientID: s.ClientID()})
+		_, err = verifier.Verify(context.Background(), previous)
+		Expect(err).To(MatchError(ContainSubstring("failed to verify signature")))
+		_, err = verifier.Verify(context.Background(), sign())
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,234 @@
+package fakeidp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+)
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// RevokeTokens invalidates every access and refresh token issued so far, as
+// when the user's session at the provider ends
+func (s *Server) RevokeTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accessTokens = map[string]*grant{}
+	s.refreshTokens = map[string]*grant{}
+}
+
+// authenticateClient checks the credentials of the client, given with basic
+// authentication or in the form
+func (s *Server) authenticateClient(req *http.Request) bool {
+	clientID, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientID = req.PostForm.Get("client_id")
+		clientSecret = req.PostForm.Get("client_secret")
+	}
+	return clientID == s.opts.ClientID && clientSecret == s.opts.ClientSecret
+}
+
+func (s *Server) serveToken(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "invalid_request", "the token endpoint only accepts POST requests")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !s.authenticateClient(req) {
+		writeError(rw, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	switch grantType := req.PostForm.Get("grant_type"); grantType {
+	case "authorization_code":
+		s.redeemCode(rw, req)
+	case "refresh_token":
+		s.refresh(rw, req)
+	case deviceCodeGrantType:
+		s.redeemDeviceCode(rw, req)
+	default:
+		writeError(rw, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant_type "+grantType)
+	}
+}
+
+// redeemCode issues tokens for an authorization code, which can only be
+// redeemed once, with the redirect URI and code verifier it was requested
+// with
+func (s *Server) redeemCode(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	code := req.PostForm.Get("code")
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mutex.Unlock()
+
+	switch {
+	case !ok || !s.Clock.Now().Before(g.expires):
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case req.PostForm.Get("redirect_uri") != g.redirectURI:
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	case g.codeChallenge != "":
+		challenge, err := encryption.GenerateCodeChallenge(g.codeChallengeMethod, req.PostForm.Get("code_verifier"))
+		if err != nil || challenge != g.codeChallenge {
+			writeError(rw, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+			return
+		}
+	}
+	s.issueTokens(rw, g, "", true)
+}
+
+// refresh issues an access token for a refresh token, along with a new
+// refresh token when they are rotated
+func (s *Server) refresh(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	refreshToken := req.PostForm.Get("refresh_token")
+	g, ok := s.refreshTokens[refreshToken]
+	if ok && s.opts.RotateRefreshTokens {
+		delete(s.refreshTokens, refreshToken)
+		refreshToken = ""
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		writeError(rw, http.StatusBadRequest, "invalid_grant", "unknown or revoked refresh token")
+		return
+	}
+	s.issueTokens(rw, g, refreshToken, !s.opts.OmitRefreshIDToken)
+}
+
+// issueTokens writes a new access token for the grant, with the refresh token
+// or a new one when it is empty, and an ID token for openid scopes
+func (s *Server) issueTokens(rw http.ResponseWriter, g *grant, refreshToken string, withIDToken bool) {
+	now := s.Clock.Now()
+	accessToken := randomToken()
+	if refreshToken == "" {
+		refreshToken = randomToken()
+	}
+
+	s.mutex.Lock()
+	accessGrant := *g
+	accessGrant.expires = now.Add(s.opts.AccessTokenExpiry)
+	s.accessTokens[accessToken] = &accessGrant
+	s.refreshTokens[refreshToken] = g
+	s.mutex.Unlock()
+
+	resp := tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.opts.AccessTokenExpiry.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        g.scope,
+	}
+	if withIDToken && hasScope(g.scope, "openid") {
+		claims := jwt.MapClaims{}
+		for key, value := range g.claims {
+			claims[key] = value
+		}
+		claims["iss"] = s.Issuer()
+		claims["aud"] = s.opts.ClientID
+		claims["iat"] = now.Unix()
+		claims["exp"] = accessGrant.expires.Unix()
+		if g.nonce != "" {
+			claims["nonce"] = g.nonce
+		}
+		idToken, err := s.SignJWT(claims)
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		resp.IDToken = idToken
+	}
+	writeJSON(rw, http.StatusOK, resp)
+}
+
+// accessGrant returns the grant of an access token that hasn't expired
+func (s *Server) accessGrant(accessToken string) (*grant, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	g, ok := s.accessTokens[accessToken]
+	if !ok || !s.Clock.Now().Before(g.expires) {
+		return nil, false
+	}
+	return g, true
+}
+
+func (s *Server) serveUserInfo(rw http.ResponseWriter, req *http.Request) {
+	accessToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	g, ok := s.accessGrant(accessToken)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(rw, http.StatusUnauthorized, "invalid_token", "unknown or expired access token")
+		return
+	}
+	writeJSON(rw, http.StatusOK, g.claims)
+}
+
+// serveIntrospection describes access and refresh tokens as in RFC 7662,
+// with the claims of their user
+func (s *Server) serveIntrospection(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "invalid_request", "the introspection endpoint only accepts POST requests")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !s.authenticateClient(req) {
+		writeError(rw, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	token := req.PostForm.Get("token")
+	g, ok := s.accessGrant(token)
+	tokenType := "Bearer"
+	if !ok {
+		s.mutex.Lock()
+		g, ok = s.refreshTokens[token]
+		s.mutex.Unlock()
+		tokenType = "refresh_token"
+	}
+	if !ok {
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+
+	resp := map[string]interface{}{}
+	for key, value := range g.claims {
+		resp[key] = value
+	}
+	resp["active"] = true
+	resp["client_id"] = s.opts.ClientID
+	resp["iss"] = s.Issuer()
+	resp["token_type"] = tokenType
+	if g.scope != "" {
+		resp["scope"] = g.scope
+	}
+	if tokenType == "Bearer" {
+		resp["exp"] = g.expires.Unix()
+	}
+	writeJSON(rw, http.StatusOK, resp)
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package fakeidp_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Tokens", func() {
+	var s *fakeidp.Server
+
+	newServer := func(opts fakeidp.Options) {
+		var err error
+		s, err = fakeidp.New(opts)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	refresh := func(refreshToken string) (*oauth2.Token, error) {
+		return oauth2Config(s).TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	}
+
+	userInfo := func(accessToken string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodGet, s.UserInfoEndpoint(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body := map[string]interface{}{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		return resp.StatusCode, body
+	}
+
+	introspect := func(token, clientSecret string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, s.IntrospectionEndpoint(), strings.NewReader(url.Values{"token": {token}}.Encode()))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(s.ClientID(), clientSecret)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body := map[string]interface{}{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		return resp.StatusCode, body
+	}
+
+	It("refreshes with the same refresh token", func() {
+		newServer(fakeidp.Options{})
+		token := login(s)
+
+		refreshed, err := refresh(token.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshed.AccessToken).ToNot(Equal(token.AccessToken))
+		Expect(refreshed.RefreshToken).To(Equal(token.RefreshToken))
+		Expect(refreshed.Extra("id_token")).ToNot(BeEmpty())
+
+		_, err = refresh(token.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("rotates the refresh tokens", func() {
+		newServer(fakeidp.Options{RotateRefreshTokens: true, OmitRefreshIDToken: true})
+		token := login(s)
+
+		refreshed, err := refresh(token.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(refreshed.RefreshToken).ToNot(Equal(token.RefreshToken))
+		Expect(refreshed.Extra("id_token")).To(BeNil())
+
+		_, err = refresh(token.RefreshToken)
+		Expect(err).To(MatchError(ContainSubstring("unknown or revoked refresh token")))
+		_, err = refresh(refreshed.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("expires the access tokens", func() {
+		newServer(fakeidp.Options{AccessTokenExpiry: time.Minute})
+		s.Clock.Set(time.Now())
+		token := login(s)
+		Expect(token.Expiry).To(BeTemporally("~", time.Now().Add(time.Minute), 5*time.Second))
+
+		status, body := userInfo(token.AccessToken)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(HaveKeyWithValue("email", "jane.doe@example.com"))
+
+		Expect(s.Clock.Add(time.Minute)).To(Succeed())
+		status, body = userInfo(token.AccessToken)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		Expect(body).To(HaveKeyWithValue("error", "invalid_token"))
+	})
+
+	It("revokes the tokens", func() {
+		newServer(fakeidp.Options{})
+		token := login(s)
+		s.RevokeTokens()
+
+		status, _ := userInfo(token.AccessToken)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		_, err := refresh(token.RefreshToken)
+		Expect(err).To(MatchError(ContainSubstring("invalid_grant")))
+	})
+
+	It("fails the token requests with the injected failures", func() {
+		newServer(fakeidp.Options{})
+		token := login(s)
+		s.FailNext(fakeidp.TokenEndpoint, fakeidp.Failure{Status: http.StatusServiceUnavailable, Error: "temporarily_unavailable"})
+
+		_, err := refresh(token.RefreshToken)
+		Expect(err).To(MatchError(ContainSubstring("temporarily_unavailable")))
+		_, err = refresh(token.RefreshToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Requests(fakeidp.TokenEndpoint)).To(Equal(3))
+	})
+
+	It("refuses clients with invalid credentials", func() {
+		newServer(fakeidp.Options{ClientSecret: "other"})
+		query := authorize(s)
+
+		config := oauth2Config(s)
+		config.ClientSecret = "wrong"
+		_, err := config.Exchange(context.Background(), query.Get("code"))
+		Expect(err).To(MatchError(ContainSubstring("invalid_client")))
+	})
+
+	It("introspects the tokens", func() {
+		newServer(fakeidp.Options{})
+		token := login(s)
+
+		status, body := introspect(token.AccessToken, s.ClientSecret())
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(HaveKeyWithValue("active", true))
+		Expect(body).To(HaveKeyWithValue("sub", "1234567890"))
+		Expect(body).To(HaveKeyWithValue("client_id", s.ClientID()))
+		Expect(body).To(HaveKeyWithValue("token_type", "Bearer"))
+		Expect(body).To(HaveKeyWithValue("scope", "openid email profile"))
+		Expect(body).To(HaveKey("exp"))
+
+		_, body = introspect(token.RefreshToken, s.ClientSecret())
+		Expect(body).To(HaveKeyWithValue("active", true))
+		Expect(body).To(HaveKeyWithValue("token_type", "refresh_token"))
+
+		_, body = introspect("unknown", s.ClientSecret())
+		Expect(body).To(Equal(map[string]interface{}{"active": false}))
+
+		status, _ = introspect(token.AccessToken, "wrong")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,292 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// otlpExportTimeout is the timeout of each export of spans to the collector,
+// the default timeout of OTLP exporters
+const otlpExportTimeout = 10 * time.Second
+
+// otlpExporter exports spans to an OTLP/HTTP collector in the JSON encoding
+// of the OTLP protocol
+type otlpExporter struct {
+	endpoint string
+	headers  http.Header
+	client   *http.Client
+}
+
+// newOTLPExporter creates an exporter posting the spans to the traces
+// endpoint of a collector, with the headers
+func newOTLPExporter(endpoint string, headers http.Header) *otlpExporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: otlpExportTimeout},
+	}
+}
+
+// ExportSpans posts the spans to the collector, failing unless the collector
+// accepts them with a 2xx response
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(newOTLPTraces(spans))
+	if err != nil {
+		return fmt.Errorf("could not encode spans: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not build export request: %v", err)
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not export %d spans: %v", len(spans), err)
+	}
+	defer resp.Body.Close()
+	// The body is read so that the connection is reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("could not export %d spans: unexpected status %d", len(spans), resp.StatusCode)
+	}
+	return nil
+}
+
+// Shutdown closes the idle connections to the collector
+func (e *otlpExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// The OTLP JSON encoding of traces.
+// Trace and span IDs are hex encoded, and 64 bit integers are encoded as
+// strings.
+type otlpTraces struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string            `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+// The OTLP status codes, which differ from the values of the codes package
+const (
+	otlpStatusUnset = 0
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// newOTLPTraces groups the spans by their resource and instrumentation scope
+func newOTLPTraces(spans []sdktrace.ReadOnlySpan) *otlpTraces {
+	traces := &otlpTraces{}
+	resources := map[attribute.Distinct]*otlpResourceSpans{}
+	scopes := map[attribute.Distinct]map[instrumentation.Scope]*otlpScopeSpans{}
+
+	for _, span := range spans {
+		res := span.Resource()
+		key := res.Equivalent()
+		resourceSpans, ok := resources[key]
+		if !ok {
+			resourceSpans = &otlpResourceSpans{
+				Resource:  otlpResource{Attributes: newOTLPAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			}
+			resources[key] = resourceSpans
+			scopes[key] = map[instrumentation.Scope]*otlpScopeSpans{}
+			traces.ResourceSpans = append(traces.ResourceSpans, resourceSpans)
+		}
+
+		scope := span.InstrumentationScope()
+		scopeSpans, ok := scopes[key][scope]
+		if !ok {
+			scopeSpans = &otlpScopeSpans{
+				Scope:     otlpScope{Name: scope.Name, Version: scope.Version},
+				SchemaURL: scope.SchemaURL,
+			}
+			scopes[key][scope] = scopeSpans
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+		}
+		scopeSpans.Spans = append(scopeSpans.Spans, newOTLPSpan(span))
+	}
+	return traces
+}
+
+// newOTLPSpan encodes the span
+func newOTLPSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	sc := span.SpanContext()
+	encoded := otlpSpan{
+		TraceID:    sc.TraceID().String(),
+		SpanID:     sc.SpanID().String(),
+		TraceState: sc.TraceState().String(),
+		Name:       span.Name(),
+		// The span kinds of the trace package have the values of OTLP
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: formatUnixNano(span.StartTime()),
+		EndTimeUnixNano:   formatUnixNano(span.EndTime()),
+		Attributes:        newOTLPAttributes(span.Attributes()),
+		Status:            newOTLPStatus(span.Status()),
+	}
+	if parent := span.Parent(); parent.HasSpanID() {
+		encoded.ParentSpanID = parent.SpanID().String()
+	}
+	for _, event := range span.Events() {
+		encoded.Events = append(encoded.Events, otlpEvent{
+			TimeUnixNano: formatUnixNano(event.Time),
+			Name:         event.Name,
+			Attributes:   newOTLPAttributes(event.Attributes),
+		})
+	}
+	return encoded
+}
+
+// newOTLPStatus encodes the status of a span
+func newOTLPStatus(status sdktrace.Status) otlpStatus {
+	switch status.Code {
+	case codes.Error:
+		return otlpStatus{Code: otlpStatusError, Message: status.Description}
+	case codes.Ok:
+		return otlpStatus{Code: otlpStatusOk}
+	default:
+		return otlpStatus{Code: otlpStatusUnset}
+	}
+}
+
+// newOTLPAttributes encodes the attributes
+func newOTLPAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		encoded = append(encoded, otlpKeyValue{Key: string(attr.Key), Value: newOTLPValue(attr.Value)})
+	}
+	return encoded
+}
+
+// newOTLPValue encodes an attribute value
+func newOTLPValue(value attribute.Value) otlpAnyValue {
+	switch value.Type() {
+	case attribute.BOOL:
+		v := value.AsBool()
+		return otlpAnyValue{BoolValue: &v}
+	case attribute.INT64:
+		v := strconv.FormatInt(value.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &v}
+	case attribute.FLOAT64:
+		v := value.AsFloat64()
+		return otlpAnyValue{DoubleValue: &v}
+	case attribute.BOOLSLICE:
+		values := []otlpAnyValue{}
+		for _, v := range value.AsBoolSlice() {
+			values = append(values, newOTLPValue(attribute.BoolValue(v)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.INT64SLICE:
+		values := []otlpAnyValue{}
+		for _, v := range value.AsInt64Slice() {
+			values = append(values, newOTLPValue(attribute.Int64Value(v)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.FLOAT64SLICE:
+		values := []otlpAnyValue{}
+		for _, v := range value.AsFloat64Slice() {
+			values = append(values, newOTLPValue(attribute.Float64Value(v)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.STRINGSLICE:
+		values := []otlpAnyValue{}
+		for _, v := range value.AsStringSlice() {
+			values = append(values, newOTLPValue(attribute.StringValue(v)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	default:
+		v := value.Emit()
+		return otlpAnyValue{StringValue: &v}
+	}
+}
+
+// formatUnixNano encodes the time as the string of its nanoseconds since the
+// Unix epoch
+func formatUnixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
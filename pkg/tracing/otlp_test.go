@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("OTLP Exporter Suite", func() {
+	start := time.Unix(1600000000, 5)
+	end := start.Add(1500 * time.Millisecond)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	parentID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+
+	span := tracetest.SpanStub{
+		Name: "HTTP GET",
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}),
+		Parent: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  parentID,
+			Remote:  true,
+		}),
+		SpanKind:  trace.SpanKindClient,
+		StartTime: start,
+		EndTime:   end,
+		Attributes: []attribute.KeyValue{
+			attribute.String("http.method", "GET"),
+			attribute.Int("http.status_code", 502),
+			attribute.Bool("oauth2_proxy.session.found", true),
+			attribute.Float64("ratio", 0.5),
+			attribute.StringSlice("groups", []string{"admins", "devs"}),
+		},
+		Events: []sdktrace.Event{{
+			Name:       "exception",
+			Time:       end,
+			Attributes: []attribute.KeyValue{attribute.String("exception.message", "unexpected EOF")},
+		}},
+		Status:                 sdktrace.Status{Code: codes.Error, Description: "unexpected EOF"},
+		Resource:               resource.NewSchemaless(attribute.String("service.name", "oauth2-proxy")),
+		InstrumentationLibrary: instrumentation.Scope{Name: instrumentationName},
+	}
+
+	It("encodes the spans in the OTLP JSON encoding", func() {
+		root := span
+		root.Name = "HTTP GET /"
+		root.SpanKind = trace.SpanKindServer
+		root.Parent = trace.SpanContext{}
+		root.Attributes = nil
+		root.Events = nil
+		root.Status = sdktrace.Status{Code: codes.Ok}
+
+		encoded, err := json.Marshal(newOTLPTraces(tracetest.SpanStubs{span, root}.Snapshots()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(encoded).To(MatchJSON(`{
+			"resourceSpans": [{
+				"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "oauth2-proxy"}}]},
+				"scopeSpans": [{
+					"scope": {"name": "github.com/oauth2-proxy/oauth2-proxy/v7"},
+					"spans": [{
+						"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+						"spanId": "00f067aa0ba902b7",
+						"parentSpanId": "b7ad6b7169203331",
+						"name": "HTTP GET",
+						"kind": 3,
+						"startTimeUnixNano": "1600000000000000005",
+						"endTimeUnixNano": "1600000001500000005",
+						"attributes": [
+							{"key": "http.method", "value": {"stringValue": "GET"}},
+							{"key": "http.status_code", "value": {"intValue": "502"}},
+							{"key": "oauth2_proxy.session.found", "value": {"boolValue": true}},
+							{"key": "ratio", "value": {"doubleValue": 0.5}},
+							{"key": "groups", "value": {"arrayValue": {"values": [{"stringValue": "admins"}, {"stringValue": "devs"}]}}}
+						],
+						"events": [{
+							"timeUnixNano": "1600000001500000005",
+							"name": "exception",
+							"attributes": [{"key": "exception.message", "value": {"stringValue": "unexpected EOF"}}]
+						}],
+						"status": {"code": 2, "message": "unexpected EOF"}
+					}, {
+						"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+						"spanId": "00f067aa0ba902b7",
+						"name": "HTTP GET /",
+						"kind": 2,
+						"startTimeUnixNano": "1600000000000000005",
+						"endTimeUnixNano": "1600000001500000005",
+						"status": {"code": 1}
+					}]
+				}]
+			}]
+		}`))
+	})
+
+	It("groups the spans by their resource and scope", func() {
+		other := span
+		other.InstrumentationLibrary = instrumentation.Scope{Name: "other"}
+		otherResource := span
+		otherResource.Resource = resource.NewSchemaless(attribute.String("service.name", "other"))
+
+		traces := newOTLPTraces(tracetest.SpanStubs{span, other, span, otherResource}.Snapshots())
+		Expect(traces.ResourceSpans).To(HaveLen(2))
+		Expect(traces.ResourceSpans[0].ScopeSpans).To(HaveLen(2))
+		Expect(traces.ResourceSpans[0].ScopeSpans[0].Spans).To(HaveLen(2))
+		Expect(traces.ResourceSpans[0].ScopeSpans[1].Scope.Name).To(Equal("other"))
+		Expect(traces.ResourceSpans[1].ScopeSpans).To(HaveLen(1))
+	})
+
+	Context("ExportSpans", func() {
+		var collector *httptest.Server
+		var status int
+		var bodies chan string
+
+		BeforeEach(func() {
+			status = http.StatusOK
+			bodies = make(chan string, 1)
+			collector = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				bodies <- req.Header.Get("Authorization") + " " + string(body)
+				rw.WriteHeader(status)
+			}))
+		})
+
+		AfterEach(func() {
+			collector.Close()
+		})
+
+		It("posts the spans to the collector with the headers", func() {
+			exporter := newOTLPExporter(collector.URL, http.Header{"Authorization": []string{"Bearer token"}})
+			Expect(exporter.ExportSpans(context.Background(), tracetest.SpanStubs{span}.Snapshots())).To(Succeed())
+			Expect(exporter.Shutdown(context.Background())).To(Succeed())
+
+			body := <-bodies
+			Expect(strings.HasPrefix(body, `Bearer token {"resourceSpans":`)).To(BeTrue())
+		})
+
+		It("doesn't post empty batches", func() {
+			exporter := newOTLPExporter(collector.URL, nil)
+			Expect(exporter.ExportSpans(context.Background(), nil)).To(Succeed())
+			Expect(bodies).To(BeEmpty())
+		})
+
+		It("fails when the collector rejects the spans", func() {
+			status = http.StatusBadRequest
+			exporter := newOTLPExporter(collector.URL, nil)
+			Expect(exporter.ExportSpans(context.Background(), tracetest.SpanStubs{span}.Snapshots())).To(MatchError("could not export 1 spans: unexpected status 400"))
+		})
+
+		It("fails when the collector can't be reached", func() {
+			exporter := newOTLPExporter(collector.URL, nil)
+			collector.Close()
+			err := exporter.ExportSpans(context.Background(), tracetest.SpanStubs{span}.Snapshots())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("could not export 1 spans: "))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpguts"
+)
+
+// instrumentationName is the name of the tracer of the proxy's spans
+const instrumentationName = "github.com/oauth2-proxy/oauth2-proxy/v7"
+
+// The attributes of the proxy's spans
+const (
+	// RequestIDKey is the ID of the request, as logged
+	RequestIDKey = attribute.Key("oauth2_proxy.request_id")
+	// UpstreamKey is the ID of the upstream the request is routed to
+	UpstreamKey = attribute.Key("oauth2_proxy.upstream")
+	// SessionFoundKey is whether the request has a session
+	SessionFoundKey = attribute.Key("oauth2_proxy.session.found")
+	// AuthorizationKey is the outcome of the authorization of the request
+	AuthorizationKey = attribute.Key("oauth2_proxy.authorization")
+)
+
+// propagator propagates the W3C trace context and baggage of requests
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Tracer returns the tracer of the proxy's spans, from the global tracer
+// provider.
+// Until Configure sets the provider, the spans aren't recorded, but they
+// still carry the trace context propagated by the client.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Configure sets the global propagator, and, when the options have an OTLP
+// endpoint, the global tracer provider exporting the sampled spans to it.
+// The returned function flushes the spans still to be exported and stops the
+// exporter, it is called once the proxy has stopped serving requests.
+func Configure(opts options.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if opts.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	headers, err := ParseOTLPHeaders(opts.OTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(newOTLPExporter(opts.OTLPEndpoint, headers)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(opts.ServiceName))),
+		// The sampling decision of the client is followed for the traces it
+		// propagates
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Errorf("Error exporting traces: %v", err)
+	}))
+	otel.SetTracerProvider(provider)
+
+	logger.Printf("Exporting traces to %s", opts.OTLPEndpoint)
+	return provider.Shutdown, nil
+}
+
+// ParseOTLPHeaders parses the headers sent with the exported traces, in the
+// `Name=value` format
+func ParseOTLPHeaders(headers []string) (http.Header, error) {
+	parsed := http.Header{}
+	for _, header := range headers {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || !httpguts.ValidHeaderFieldName(parts[0]) || !httpguts.ValidHeaderFieldValue(parts[1]) {
+			return nil, fmt.Errorf("invalid OTLP header %q: must be Name=value", header)
+		}
+		parsed.Add(parts[0], parts[1])
+	}
+	return parsed, nil
+}
+
+// Extract returns the context with the trace context propagated in the
+// request headers, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent, tracestate and baggage headers propagating
+// the trace context of ctx
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// End ends the span, setting its status to the error, if any
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// newAuthorizationConflict wraps the handler so that the Authorization header
+// of client requests, when an Authorization header is injected from the
+// user's session, is sent to the upstream according to its
+// AuthorizationConflict policy.
+// The handler is returned unchanged with the overwrite policy, where the
+// injected header has already replaced the client's.
+func newAuthorizationConflict(upstream options.Upstream, next http.Handler) http.Handler {
+	switch upstream.AuthorizationConflict {
+	case options.AuthorizationConflictPreserveClient:
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if client := clientAuthorization(req); client != "" {
+				req.Header.Set("Authorization", client)
+			}
+			next.ServeHTTP(rw, req)
+		})
+	case options.AuthorizationConflictMoveClient:
+		header := clientAuthorizationHeader(upstream)
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.Header.Del(header)
+			if client := clientAuthorization(req); client != "" {
+				req.Header.Set(header, client)
+
+				// Injected headers preserving the request value are joined
+				// to the client's
+				switch injected := req.Header.Get("Authorization"); {
+				case injected == client:
+					req.Header.Del("Authorization")
+				case strings.HasPrefix(injected, client+","):
+					req.Header.Set("Authorization", strings.TrimPrefix(injected, client+","))
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	default:
+		return next
+	}
+}
+
+// clientAuthorization returns the Authorization header of the client request
+// recorded before an Authorization header was injected from the session
+func clientAuthorization(req *http.Request) string {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil {
+		return ""
+	}
+	return scope.ClientAuthorization
+}
+
+// clientAuthorizationHeader returns the header the client's Authorization
+// header is moved to with the move-client policy
+func clientAuthorizationHeader(upstream options.Upstream) string {
+	if upstream.ClientAuthorizationHeader == "" {
+		return options.DefaultClientAuthorizationHeader
+	}
+	return upstream.ClientAuthorizationHeader
+}
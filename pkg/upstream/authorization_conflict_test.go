@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorization Conflict Suite", func() {
+	const (
+		injected    = "Basic am9objpzZWNyZXQ="
+		clientToken = "Bearer client-token"
+	)
+
+	type authorizationConflictTableInput struct {
+		policy              string
+		clientHeader        string
+		authorization       string
+		clientAuthorization string
+		requestHeaders      map[string]string
+		expectedHeaders     map[string]string
+	}
+
+	DescribeTable("newAuthorizationConflict",
+		func(in authorizationConflictTableInput) {
+			var upstreamHeaders http.Header
+			handler := newAuthorizationConflict(options.Upstream{
+				ID:                        "app",
+				AuthorizationConflict:     in.policy,
+				ClientAuthorizationHeader: in.clientHeader,
+			}, http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				upstreamHeaders = req.Header
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			if in.authorization != "" {
+				req.Header.Set("Authorization", in.authorization)
+			}
+			for name, value := range in.requestHeaders {
+				req.Header.Set(name, value)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				ClientAuthorization: in.clientAuthorization,
+			})
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			for name, value := range in.expectedHeaders {
+				Expect(upstreamHeaders.Get(name)).To(Equal(value), name)
+			}
+		},
+		Entry("overwrite with a client token", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictOverwrite,
+			authorization:       injected,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization":                          injected,
+				options.DefaultClientAuthorizationHeader: "",
+			},
+		}),
+		Entry("preserve-client with a client token", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictPreserveClient,
+			authorization:       injected,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization": clientToken,
+			},
+		}),
+		Entry("preserve-client without a client token", authorizationConflictTableInput{
+			policy:        options.AuthorizationConflictPreserveClient,
+			authorization: injected,
+			expectedHeaders: map[string]string{
+				"Authorization": injected,
+			},
+		}),
+		Entry("move-client with a client token", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictMoveClient,
+			authorization:       injected,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization":                          injected,
+				options.DefaultClientAuthorizationHeader: clientToken,
+			},
+		}),
+		Entry("move-client with a client token to a configured header", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictMoveClient,
+			clientHeader:        "X-Api-Authorization",
+			authorization:       injected,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization":       injected,
+				"X-Api-Authorization": clientToken,
+			},
+		}),
+		Entry("move-client with a client token joined to the injected header", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictMoveClient,
+			authorization:       clientToken + "," + injected,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization":                          injected,
+				options.DefaultClientAuthorizationHeader: clientToken,
+			},
+		}),
+		Entry("move-client with a client token and nothing injected", authorizationConflictTableInput{
+			policy:              options.AuthorizationConflictMoveClient,
+			authorization:       clientToken,
+			clientAuthorization: clientToken,
+			expectedHeaders: map[string]string{
+				"Authorization":                          "",
+				options.DefaultClientAuthorizationHeader: clientToken,
+			},
+		}),
+		Entry("move-client without a client token removes the client's header", authorizationConflictTableInput{
+			policy:         options.AuthorizationConflictMoveClient,
+			authorization:  injected,
+			requestHeaders: map[string]string{options.DefaultClientAuthorizationHeader: "spoofed"},
+			expectedHeaders: map[string]string{
+				"Authorization":                          injected,
+				options.DefaultClientAuthorizationHeader: "",
+			},
+		}),
+	)
+})
@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// upstreamBackend is one of the servers the requests to an upstream are
+// balanced across
+type upstreamBackend struct {
+	target    *url.URL
+	host      string
+	weight    int
+	handler   http.Handler
+	wsHandler http.Handler
+	transport *http.Transport
+
+	// wsTransport is set when the WebSocket connections of the backend are
+	// proxied
+	wsTransport *http.Transport
+
+	// dns is set when the connections of the backend are balanced across the
+	// addresses of its host
+	dns *dnsBalancer
+
+	// health is set when the backend is health checked
+	health *backendHealth
+
+	// inFlight is the number of requests in flight to the backend, including
+	// open WebSocket connections
+	inFlight int
+	// currentWeight is the weight of the backend in the current round of the
+	// smooth weighted round robin
+	currentWeight int
+}
+
+// backendBalancer balances the requests to an upstream across its healthy
+// backends, in turn in proportion to their weights, or to the backend with
+// the fewest requests in flight relative to its weight.
+// While none of the backends is healthy, requests are sent to the fallback,
+// or render the error page without one.
+type backendBalancer struct {
+	upstream     string
+	policy       string
+	backends     []*upstreamBackend
+	fallback     *upstreamBackend
+	errorHandler ProxyErrorHandler
+	metrics      *balancerMetrics
+
+	mu sync.Mutex
+	// next is the backend the ties between backends with as few requests in
+	// flight start from, so that they are also taken in turn
+	next int
+}
+
+// newBackendBalancer creates the balancer of the backends of the upstream.
+// Backends without a weight have a weight of 1.
+func newBackendBalancer(upstream options.Upstream, backends []*upstreamBackend, fallback *upstreamBackend, errorHandler ProxyErrorHandler, metrics *balancerMetrics) *backendBalancer {
+	for _, backend := range backends {
+		if backend.weight <= 0 {
+			backend.weight = 1
+		}
+	}
+	return &backendBalancer{
+		upstream:     upstream.ID,
+		policy:       upstream.LoadBalancing,
+		backends:     backends,
+		fallback:     fallback,
+		errorHandler: errorHandler,
+		metrics:      metrics,
+	}
+}
+
+// serveHTTP proxies the request to the next backend
+func (b *backendBalancer) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	backend := b.acquire()
+	if backend == nil {
+		b.handleError(rw, req)
+		return
+	}
+	defer b.release(backend)
+	backend.handler.ServeHTTP(rw, req)
+}
+
+// serveWebSocket proxies the WebSocket connection to the next backend
+func (b *backendBalancer) serveWebSocket(rw http.ResponseWriter, req *http.Request) {
+	backend := b.acquire()
+	if backend == nil {
+		b.handleError(rw, req)
+		return
+	}
+	defer b.release(backend)
+	backend.wsHandler.ServeHTTP(rw, req)
+}
+
+// handleError renders the error of the requests to upstreams without a
+// healthy backend, as the reverse proxies render connection failures
+func (b *backendBalancer) handleError(rw http.ResponseWriter, req *http.Request) {
+	if b.errorHandler != nil {
+		b.errorHandler(rw, req, errNoHealthyBackends)
+		return
+	}
+	logger.Errorf("Error proxying to upstream server: %v", errNoHealthyBackends)
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// acquire picks the backend of the next request among the healthy backends,
+// or the fallback when none is healthy, and counts the request as in flight
+// to it until it is released.
+// It returns nil when no backend is healthy and there is no fallback.
+func (b *backendBalancer) acquire() *upstreamBackend {
+	b.mu.Lock()
+	healthy := make([]*upstreamBackend, 0, len(b.backends))
+	for _, backend := range b.backends {
+		if backend.health.isHealthy() {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	var backend *upstreamBackend
+	switch {
+	case len(healthy) == 0 && b.fallback == nil:
+		b.mu.Unlock()
+		return nil
+	case len(healthy) == 0:
+		backend = b.fallback
+	case b.policy == options.LoadBalancingLeastConnections:
+		backend = b.leastConnections(healthy)
+	default:
+		backend = b.roundRobin(healthy)
+	}
+	backend.inFlight++
+	b.mu.Unlock()
+
+	if b.metrics != nil {
+		b.metrics.requests.WithLabelValues(b.upstream, backend.host).Inc()
+	}
+	return backend
+}
+
+// release counts the request to the backend as no longer in flight
+func (b *backendBalancer) release(backend *upstreamBackend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	backend.inFlight--
+}
+
+// roundRobin picks the backends in turn with the smooth weighted round robin
+// of nginx, so that the requests to backends with larger weights are spread
+// between the requests to the others rather than sent in bursts
+func (b *backendBalancer) roundRobin(backends []*upstreamBackend) *upstreamBackend {
+	var picked *upstreamBackend
+	total := 0
+	for _, backend := range backends {
+		backend.currentWeight += backend.weight
+		total += backend.weight
+		if picked == nil || backend.currentWeight > picked.currentWeight {
+			picked = backend
+		}
+	}
+	picked.currentWeight -= total
+	return picked
+}
+
+// leastConnections picks the backend with the fewest requests in flight
+// relative to its weight
+func (b *backendBalancer) leastConnections(backends []*upstreamBackend) *upstreamBackend {
+	var picked *upstreamBackend
+	for i := range backends {
+		backend := backends[(b.next+i)%len(backends)]
+		// Compares inFlight/weight without dividing
+		if picked == nil || backend.inFlight*picked.weight < picked.inFlight*backend.weight {
+			picked = backend
+		}
+	}
+	b.next = (b.next + 1) % len(backends)
+	return picked
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Upstream Balancer Suite", func() {
+	// newBackends creates backends with the weights, named a, b, c...
+	newBackends := func(weights ...int) []*upstreamBackend {
+		backends := []*upstreamBackend{}
+		for i, weight := range weights {
+			backends = append(backends, &upstreamBackend{host: string(rune('a' + i)), weight: weight})
+		}
+		return backends
+	}
+
+	// pick acquires the backends of n requests, without releasing them
+	pick := func(b *backendBalancer, n int) string {
+		picked := ""
+		for i := 0; i < n; i++ {
+			picked += b.acquire().host
+		}
+		return picked
+	}
+
+	Context("round robin", func() {
+		It("takes the backends in turn", func() {
+			b := newBackendBalancer(options.Upstream{ID: "app"}, newBackends(1, 1, 1), nil, nil, nil)
+			Expect(pick(b, 6)).To(Equal("abcabc"))
+		})
+
+		It("spreads the requests in proportion to the weights", func() {
+			b := newBackendBalancer(options.Upstream{ID: "app", LoadBalancing: options.LoadBalancingRoundRobin}, newBackends(5, 1, 1), nil, nil, nil)
+			Expect(pick(b, 7)).To(Equal("aabacaa"))
+		})
+
+		It("gives backends without a weight a weight of 1", func() {
+			b := newBackendBalancer(options.Upstream{ID: "app"}, newBackends(0, 2), nil, nil, nil)
+			Expect(pick(b, 6)).To(Equal("babbab"))
+		})
+	})
+
+	Context("least connections", func() {
+		upstream := options.Upstream{ID: "app", LoadBalancing: options.LoadBalancingLeastConnections}
+
+		It("picks the backend with the fewest requests in flight", func() {
+			b := newBackendBalancer(upstream, newBackends(1, 1), nil, nil, nil)
+			a := b.acquire()
+			Expect(a.host).To(Equal("a"))
+			Expect(pick(b, 1)).To(Equal("b"))
+
+			b.release(a)
+			Expect(pick(b, 1)).To(Equal("a"))
+		})
+
+		It("takes the backends in turn when they have as few requests in flight", func() {
+			b := newBackendBalancer(upstream, newBackends(1, 1, 1), nil, nil, nil)
+			picked := ""
+			for i := 0; i < 4; i++ {
+				backend := b.acquire()
+				picked += backend.host
+				b.release(backend)
+			}
+			Expect(picked).To(Equal("abca"))
+		})
+
+		It("weighs the requests in flight", func() {
+			b := newBackendBalancer(upstream, newBackends(3, 1), nil, nil, nil)
+			Expect(pick(b, 8)).To(Equal("abaaabaa"))
+		})
+	})
+
+	It("balances the requests of an upstream across its backends", func() {
+		servers := []*httptest.Server{}
+		for _, name := range []string{"primary", "secondary"} {
+			name := name
+			servers = append(servers, httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(name + " " + req.URL.RequestURI()))
+			})))
+		}
+		defer func() {
+			for _, server := range servers {
+				server.Close()
+			}
+		}()
+
+		u, err := url.Parse(servers[0].URL)
+		Expect(err).ToNot(HaveOccurred())
+		backend, err := url.Parse(servers[1].URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		upstream := options.Upstream{
+			ID:       "app",
+			Backends: []options.UpstreamBackend{{URI: servers[1].URL, Weight: 2}},
+		}
+		metrics := newBalancerMetrics(prometheus.NewRegistry())
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, metrics, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		bodies := []string{}
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/path?query=1", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			bodies = append(bodies, rw.Body.String())
+		}
+		Expect(strings.Join(bodies, ", ")).To(Equal("secondary /path?query=1, primary /path?query=1, secondary /path?query=1"))
+
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("app", u.Host))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("app", backend.Host))).To(Equal(float64(2)))
+	})
+})
@@ -0,0 +1,181 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+const (
+	// bodyRejectedContentLength is the rejection reason when the
+	// Content-Length of a request is above the limit
+	bodyRejectedContentLength = "content_length"
+
+	// bodyRejectedStreamed is the rejection reason when a request without a
+	// Content-Length crossed the limit while it was streamed to the upstream
+	bodyRejectedStreamed = "streamed"
+)
+
+// errRequestBodyTooLarge is returned to the upstream transport once a
+// request body crosses the limit, aborting the upstream request
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// newBodyLimiter wraps the handler so that request bodies larger than the
+// upstream's MaxRequestBodySize are rejected with a 413 response.
+// The handler is returned unchanged when the upstream has no limit.
+func newBodyLimiter(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer, metrics *bodyLimitMetrics) http.Handler {
+	if upstream.MaxRequestBodySize <= 0 {
+		return handler
+	}
+	return &bodyLimiter{
+		upstream: upstream.ID,
+		limit:    upstream.MaxRequestBodySize,
+		handler:  handler,
+		writer:   writer,
+		metrics:  metrics,
+	}
+}
+
+// bodyLimiter limits the size of the request bodies sent to an upstream.
+type bodyLimiter struct {
+	upstream string
+	limit    int64
+	handler  http.Handler
+	writer   pagewriter.Writer
+	metrics  *bodyLimitMetrics
+}
+
+// ServeHTTP rejects requests whose Content-Length is above the limit, and
+// streams the bodies of requests without a Content-Length through a counting
+// reader, so that they are never buffered.
+// WebSocket upgrade requests are always served, as their frames aren't part
+// of the request body.
+func (l *bodyLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if isWebSocketUpgrade(req) || req.Body == nil || req.Body == http.NoBody {
+		l.handler.ServeHTTP(rw, req)
+		return
+	}
+	if req.ContentLength > l.limit {
+		l.reject(rw, req, bodyRejectedContentLength)
+		return
+	}
+	if req.ContentLength >= 0 {
+		// The server never reads more than the Content-Length
+		l.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	body := &limitedBody{ReadCloser: req.Body, remaining: l.limit}
+	limited := &bodyLimitResponse{Wrapper: responsewriter.Wrapper{ResponseWriter: rw}, body: body}
+	req.Body = body
+	l.handler.ServeHTTP(limited, req)
+
+	if body.isExceeded() && !limited.wroteHeader {
+		l.reject(rw, req, bodyRejectedStreamed)
+	}
+}
+
+// reject counts the rejected request and writes a 413 error page
+func (l *bodyLimiter) reject(rw http.ResponseWriter, req *http.Request, reason string) {
+	l.metrics.rejected.WithLabelValues(l.upstream, reason).Inc()
+
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = l.upstream
+
+	logger.Errorf("Rejected request to upstream %q: request body larger than %d bytes (%s)", l.upstream, l.limit, reason)
+	l.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusRequestEntityTooLarge,
+		RequestID: scope.RequestID,
+		AppError:  fmt.Sprintf("request body larger than %d bytes for upstream %s", l.limit, l.upstream),
+		Messages:  []interface{}{"The request is too large."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
+
+// limitedBody counts the bytes read from a request body, and fails once
+// more than the remaining bytes are read.
+// It is read by the upstream transport, while the response is written by the
+// handler, so the exceeded flag is accessed atomically.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+// Read reads from the body until the limit is crossed, when it returns
+// errRequestBodyTooLarge
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.isExceeded() {
+		return 0, errRequestBodyTooLarge
+	}
+	// Read one byte more than remains, to tell if the limit is crossed
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		atomic.StoreInt32(&b.exceeded, 1)
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, errRequestBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) isExceeded() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// bodyLimitResponse discards the response written once the request body has
+// crossed the limit, the proxy error page of the aborted upstream request, so
+// that the 413 response can be written instead.
+// Responses the upstream started before the limit was crossed are written
+// as they are.
+type bodyLimitResponse struct {
+	responsewriter.Wrapper
+	body        *limitedBody
+	wroteHeader bool
+	discard     bool
+}
+
+// WriteHeader writes the response header, unless the request body has
+// crossed the limit
+func (r *bodyLimitResponse) WriteHeader(code int) {
+	if r.wroteHeader || r.discard {
+		return
+	}
+	if r.body.isExceeded() {
+		r.discard = true
+		return
+	}
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the response body, unless the response is discarded
+func (r *bodyLimitResponse) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.discard {
+		return len(b), nil
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter, unless the response is
+// discarded
+func (r *bodyLimitResponse) Flush() {
+	if !r.discard {
+		r.Wrapper.Flush()
+	}
+}
@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Request Body Limit Suite", func() {
+	const limit = 16
+
+	var metrics *bodyLimitMetrics
+	var writer *pagewriter.WriterFuncs
+	var upstreamServer *httptest.Server
+	var received string
+	var handler http.Handler
+
+	BeforeEach(func() {
+		metrics = newBodyLimitMetrics(prometheus.NewRegistry())
+		writer = &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				rw.WriteHeader(opts.Status)
+			},
+		}
+
+		received = ""
+		upstreamServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return
+			}
+			received = string(body)
+			rw.WriteHeader(http.StatusCreated)
+		}))
+		u, err := url.Parse(upstreamServer.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.ErrorHandler = func(rw http.ResponseWriter, _ *http.Request, _ error) {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+		handler = newBodyLimiter(options.Upstream{ID: "uploads", MaxRequestBodySize: limit}, proxy, writer, metrics)
+	})
+
+	AfterEach(func() {
+		upstreamServer.Close()
+	})
+
+	serve := func(body string, chunked bool, modify func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		if modify != nil {
+			modify(req)
+		}
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.rejected.WithLabelValues("uploads", reason))
+	}
+
+	It("returns the handler unchanged without a limit", func() {
+		next := http.NewServeMux()
+		Expect(newBodyLimiter(options.Upstream{ID: "uploads"}, next, writer, metrics)).To(BeIdenticalTo(next))
+	})
+
+	It("rejects requests with a Content-Length above the limit before they are proxied", func() {
+		rw := serve(strings.Repeat("a", limit+1), false, nil)
+		Expect(rw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(received).To(BeEmpty())
+		Expect(rejected(bodyRejectedContentLength)).To(Equal(float64(1)))
+	})
+
+	It("proxies requests with a Content-Length within the limit", func() {
+		rw := serve(strings.Repeat("a", limit), false, nil)
+		Expect(rw.Code).To(Equal(http.StatusCreated))
+		Expect(received).To(Equal(strings.Repeat("a", limit)))
+	})
+
+	It("proxies streamed requests within the limit", func() {
+		rw := serve(strings.Repeat("b", limit), true, nil)
+		Expect(rw.Code).To(Equal(http.StatusCreated))
+		Expect(received).To(Equal(strings.Repeat("b", limit)))
+		Expect(rejected(bodyRejectedStreamed)).To(Equal(float64(0)))
+	})
+
+	It("aborts streamed requests once they cross the limit", func() {
+		rw := serve(strings.Repeat("b", 4*limit), true, nil)
+		Expect(rw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(received).To(BeEmpty())
+		Expect(rejected(bodyRejectedStreamed)).To(Equal(float64(1)))
+	})
+
+	It("never limits WebSocket upgrade requests", func() {
+		rw := serve(strings.Repeat("c", 2*limit), false, func(req *http.Request) {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+		})
+		Expect(rw.Code).ToNot(Equal(http.StatusRequestEntityTooLarge))
+		Expect(rejected(bodyRejectedContentLength)).To(Equal(float64(0)))
+	})
+})
@@ -0,0 +1,202 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// eventStreamContentType is the media type of server-sent events, whose
+// responses are always streamed
+const eventStreamContentType = "text/event-stream"
+
+// responseBuffering decides how the responses of an upstream are sent to the
+// client: buffered in memory, flushed after each write, or as the reverse
+// proxy writes them
+type responseBuffering struct {
+	buffer         bool
+	maxBufferSize  int64
+	streamingTypes map[string]struct{}
+}
+
+// newResponseBuffering creates the response buffering of the upstream, or
+// returns nil when its responses are sent as the reverse proxy writes them
+func newResponseBuffering(upstream options.Upstream) *responseBuffering {
+	if !upstream.BufferResponses && len(upstream.StreamingContentTypes) == 0 {
+		return nil
+	}
+
+	maxBufferSize := upstream.MaxResponseBufferSize
+	if maxBufferSize == 0 {
+		maxBufferSize = options.DefaultUpstreamMaxResponseBufferSize
+	}
+	streamingTypes := map[string]struct{}{}
+	for _, contentType := range upstream.StreamingContentTypes {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			streamingTypes[mediaType] = struct{}{}
+		}
+	}
+
+	return &responseBuffering{
+		buffer:         upstream.BufferResponses,
+		maxBufferSize:  maxBufferSize,
+		streamingTypes: streamingTypes,
+	}
+}
+
+// wrap returns the response writer the response to the request is written
+// to. Its finish must be called once the handler has returned without
+// panicking, to send a buffered response.
+func (b *responseBuffering) wrap(rw http.ResponseWriter, req *http.Request) *bufferedResponse {
+	return &bufferedResponse{
+		Wrapper:   responsewriter.Wrapper{ResponseWriter: rw},
+		buffering: b,
+		head:      req.Method == http.MethodHead,
+	}
+}
+
+// isStreaming checks whether the response with the content type is streamed
+func (b *responseBuffering) isStreaming(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == eventStreamContentType {
+		return true
+	}
+	_, ok := b.streamingTypes[mediaType]
+	return ok
+}
+
+// The modes of buffered responses, decided when their status is written
+const (
+	responsePending = iota
+	responseBuffered
+	responseStreamed
+	responsePassed
+)
+
+// bufferedResponse is a custom http.ResponseWriter that buffers the response
+// in memory until it is finished, or its body exceeds the maximum buffer
+// size, or flushes the response after each write when it is streamed.
+type bufferedResponse struct {
+	responsewriter.Wrapper
+	buffering *responseBuffering
+	head      bool
+
+	mode   int
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader decides how the response is sent, from its headers.
+// Informational responses are sent to the client straight away.
+func (r *bufferedResponse) WriteHeader(code int) {
+	switch {
+	case r.mode != responsePending:
+		if r.mode != responseBuffered {
+			r.ResponseWriter.WriteHeader(code)
+		}
+		return
+	case code >= 100 && code < 200 && code != http.StatusSwitchingProtocols:
+		r.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	r.status = code
+	header := r.Header()
+	switch {
+	case r.buffering.isStreaming(header.Get("Content-Type")):
+		r.mode = responseStreamed
+	case r.buffering.buffer && code != http.StatusSwitchingProtocols && !r.exceedsBuffer(header.Get("Content-Length")):
+		r.mode = responseBuffered
+		return
+	default:
+		r.mode = responsePassed
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// exceedsBuffer checks whether the Content-Length of the response is larger
+// than the maximum buffer size
+func (r *bufferedResponse) exceedsBuffer(contentLength string) bool {
+	length, err := strconv.ParseInt(contentLength, 10, 64)
+	return err == nil && length > r.buffering.maxBufferSize
+}
+
+// Write buffers the body of the response, until it exceeds the maximum
+// buffer size, or sends it to the client
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	if r.mode == responsePending {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	switch r.mode {
+	case responseBuffered:
+		if int64(r.body.Len()+len(b)) <= r.buffering.maxBufferSize {
+			return r.body.Write(b)
+		}
+		// The response is too large to be buffered, the part already
+		// buffered is sent before the rest is passed on
+		r.mode = responsePassed
+		r.ResponseWriter.WriteHeader(r.status)
+		if _, err := r.ResponseWriter.Write(r.body.Bytes()); err != nil {
+			return 0, err
+		}
+		r.body = bytes.Buffer{}
+		return r.ResponseWriter.Write(b)
+	case responseStreamed:
+		n, err := r.ResponseWriter.Write(b)
+		r.Wrapper.Flush()
+		return n, err
+	default:
+		return r.ResponseWriter.Write(b)
+	}
+}
+
+// Flush sends any buffered data to the client, unless the response is
+// buffered until it is finished. Implements the `http.Flusher` interface
+func (r *bufferedResponse) Flush() {
+	if r.mode != responseBuffered {
+		r.Wrapper.Flush()
+	}
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (r *bufferedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.mode = responsePassed
+	return r.Wrapper.Hijack()
+}
+
+// finish sends the buffered response, with its Content-Length when the
+// upstream didn't send one
+func (r *bufferedResponse) finish() {
+	if r.mode != responseBuffered {
+		return
+	}
+	r.mode = responsePassed
+
+	header := r.Header()
+	if !r.head && header.Get("Content-Length") == "" && bodyAllowed(r.status) {
+		header.Del("Transfer-Encoding")
+		header.Set("Content-Length", strconv.Itoa(r.body.Len()))
+	}
+	r.ResponseWriter.WriteHeader(r.status)
+	if r.body.Len() > 0 {
+		// Errors writing to the client are left to the server
+		_, _ = r.ResponseWriter.Write(r.body.Bytes())
+	}
+}
+
+// bodyAllowed checks whether a response with the status may have a body, as
+// defined by RFC 7230 section 3.3
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified && status >= 200
+}
@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response Buffering Suite", func() {
+	It("isn't set up without buffering or streaming content types", func() {
+		Expect(newResponseBuffering(options.Upstream{})).To(BeNil())
+		Expect(newResponseBuffering(options.Upstream{BufferResponses: true}).maxBufferSize).To(Equal(int64(options.DefaultUpstreamMaxResponseBufferSize)))
+	})
+
+	Context("with a response writer", func() {
+		buffering := newResponseBuffering(options.Upstream{
+			BufferResponses:       true,
+			MaxResponseBufferSize: 8,
+			StreamingContentTypes: []string{"application/x-ndjson"},
+		})
+
+		newResponse := func(method string) (*bufferedResponse, *httptest.ResponseRecorder) {
+			rw := httptest.NewRecorder()
+			return buffering.wrap(rw, httptest.NewRequest(method, "/", nil)), rw
+		}
+
+		It("holds the response back until it is finished", func() {
+			buffered, rw := newResponse(http.MethodGet)
+			buffered.Header().Set("Content-Type", "text/plain")
+			buffered.WriteHeader(http.StatusCreated)
+			buffered.Write([]byte("abc"))
+			buffered.Flush()
+			buffered.Write([]byte("def"))
+			Expect(rw.Body.Len()).To(Equal(0))
+			Expect(rw.Flushed).To(BeFalse())
+
+			buffered.finish()
+			Expect(rw.Code).To(Equal(http.StatusCreated))
+			Expect(rw.Header().Get("Content-Length")).To(Equal("6"))
+			Expect(rw.Body.String()).To(Equal("abcdef"))
+		})
+
+		It("sends the responses exceeding the buffer as they are written", func() {
+			buffered, rw := newResponse(http.MethodGet)
+			buffered.Write([]byte("abcdef"))
+			buffered.Write([]byte("ghijkl"))
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("abcdefghijkl"))
+
+			buffered.finish()
+			Expect(rw.Header().Get("Content-Length")).To(BeEmpty())
+			Expect(rw.Body.String()).To(Equal("abcdefghijkl"))
+		})
+
+		It("doesn't buffer the responses whose Content-Length exceeds the buffer", func() {
+			buffered, rw := newResponse(http.MethodGet)
+			buffered.Header().Set("Content-Length", "1024")
+			buffered.WriteHeader(http.StatusOK)
+			buffered.Write([]byte("abc"))
+			Expect(rw.Body.String()).To(Equal("abc"))
+		})
+
+		It("doesn't set a Content-Length on the responses to HEAD requests", func() {
+			buffered, rw := newResponse(http.MethodHead)
+			buffered.Header().Set("Content-Type", "text/plain")
+			buffered.WriteHeader(http.StatusOK)
+			buffered.finish()
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Header().Get("Content-Length")).To(BeEmpty())
+		})
+
+		It("flushes the streamed responses after each write", func() {
+			for _, contentType := range []string{"text/event-stream", "application/x-ndjson; charset=utf-8"} {
+				buffered, rw := newResponse(http.MethodGet)
+				buffered.Header().Set("Content-Type", contentType)
+				buffered.WriteHeader(http.StatusOK)
+				buffered.Write([]byte("{}\n"))
+				Expect(rw.Body.String()).To(Equal("{}\n"))
+				Expect(rw.Flushed).To(BeTrue())
+			}
+		})
+
+		It("sends informational responses straight away", func() {
+			buffered, rw := newResponse(http.MethodGet)
+			buffered.WriteHeader(http.StatusEarlyHints)
+			Expect(rw.Code).To(Equal(http.StatusEarlyHints))
+		})
+	})
+
+	It("buffers the responses of the upstream", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.Write([]byte("hello "))
+			rw.(http.Flusher).Flush()
+			rw.Write([]byte("world"))
+		}))
+		defer server.Close()
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err := newHTTPUpstreamProxy(options.Upstream{ID: "app", URI: server.URL, BufferResponses: true}, u, nil, nil, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, "/", nil), &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Header().Get("Content-Length")).To(Equal("11"))
+		Expect(rw.Body.String()).To(Equal("hello world"))
+	})
+})
@@ -0,0 +1,642 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// CachePurger is implemented by the proxy created by NewProxy, so that the
+// response caches of the upstreams can be purged at runtime.
+type CachePurger interface {
+	// PurgeCache removes the cached responses of the upstream with the ID,
+	// or of every upstream when the ID is empty, and returns the IDs of the
+	// upstreams whose caches were purged.
+	PurgeCache(ctx context.Context, id string) ([]string, error)
+}
+
+// cacheHeader is the response header telling whether the response was served
+// from the cache
+const cacheHeader = "X-Cache"
+
+// The results of requests to cached upstreams, sent in the cacheHeader
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS"
+)
+
+// cacheableStatus are the statuses of the responses that are cacheable by
+// default, as defined by RFC 9110.
+// Partial responses are left out as Range requests bypass the cache.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// newResponseCache wraps the handler so that the upstream's responses to GET
+// and HEAD requests are served from a cache until they expire, in memory or
+// in the Redis server of the redis client
+func newResponseCache(upstream options.Upstream, handler http.Handler, metrics *cacheMetrics, redis *cacheRedisClient) (*responseCache, error) {
+	ttl := options.DefaultUpstreamCacheTTL
+	if upstream.Cache.TTL != nil {
+		ttl = upstream.Cache.TTL.Duration()
+	}
+	maxEntrySize := upstream.Cache.MaxEntrySize
+	if maxEntrySize == 0 {
+		maxEntrySize = options.DefaultUpstreamCacheMaxEntrySize
+	}
+
+	var store cacheStore
+	switch upstream.Cache.Store {
+	case "", options.UpstreamCacheStoreMemory:
+		maxSize := upstream.Cache.MaxSize
+		if maxSize == 0 {
+			maxSize = options.DefaultUpstreamCacheMaxSize
+		}
+		store = newMemoryCacheStore(upstream.ID, maxSize, metrics)
+	case options.UpstreamCacheStoreRedis:
+		client, err := redis.get()
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the redis cache: %v", err)
+		}
+		store = newRedisCacheStore(upstream.ID, client, ttl)
+	default:
+		return nil, fmt.Errorf("unknown cache store %q", upstream.Cache.Store)
+	}
+
+	return &responseCache{
+		upstream:           upstream.ID,
+		handler:            handler,
+		ttl:                ttl,
+		maxEntrySize:       maxEntrySize,
+		varyOnUser:         upstream.Cache.VaryOnUser,
+		allowAuthorization: upstream.Cache.AllowAuthorization,
+		bypassHeader:       upstream.Cache.BypassHeader,
+		metrics:            metrics,
+		store:              store,
+	}, nil
+}
+
+// responseCache caches the responses of an upstream handler
+type responseCache struct {
+	upstream           string
+	handler            http.Handler
+	ttl                time.Duration
+	maxEntrySize       int64
+	varyOnUser         bool
+	allowAuthorization bool
+	bypassHeader       string
+	metrics            *cacheMetrics
+	store              cacheStore
+	clock              clock.Clock
+}
+
+// cacheStore stores the cached responses of an upstream
+type cacheStore interface {
+	// get returns the cached response to the request, if it hasn't expired
+	get(ctx context.Context, key cacheKey, req *http.Request, now time.Time) *cacheEntry
+
+	// set caches the response to the requests with the key, and the values
+	// of the vary headers of the request
+	set(ctx context.Context, key cacheKey, vary []string, entry *cacheEntry, now time.Time)
+
+	// invalidate removes the cached responses to the requests for the URL,
+	// whatever their method and user
+	invalidate(ctx context.Context, url string, now time.Time)
+
+	// purge removes all the cached responses
+	purge(ctx context.Context) error
+}
+
+// cacheKey identifies the requests to the same URL, with the same method
+// and, with VaryOnUser, from the same user
+type cacheKey struct {
+	// url is the host and URI of the requests
+	url string
+	// request is the method and user of the requests
+	request string
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	size    int64
+	stored  time.Time
+	expires time.Time
+
+	// key and variant identify the element of the response in the memory
+	// store
+	key     cacheKey
+	variant string
+}
+
+// ServeHTTP serves the request from the cache when a response to an
+// identical request is cached, or from the upstream, caching its response.
+// Requests with the bypass header are always served by the upstream, their
+// response replacing the cached response.
+// Successful requests with other methods, such as POST, invalidate the
+// cached responses to their URL.
+func (c *responseCache) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !c.cacheable(req) {
+		c.metrics.requests.WithLabelValues(c.upstream, "bypass").Inc()
+		recorder := &cacheResponse{Wrapper: responsewriter.Wrapper{ResponseWriter: rw}, result: cacheBypass}
+		c.handler.ServeHTTP(recorder, req)
+		if invalidates(req.Method, recorder.status) {
+			c.store.invalidate(req.Context(), cacheURL(req), c.clock.Now())
+		}
+		return
+	}
+
+	result := cacheMiss
+	key := c.key(req)
+	if c.bypassHeader != "" && req.Header.Get(c.bypassHeader) != "" {
+		result = cacheBypass
+	} else if entry := c.store.get(req.Context(), key, req, c.clock.Now()); entry != nil {
+		c.metrics.requests.WithLabelValues(c.upstream, "hit").Inc()
+		c.serve(rw, req, entry)
+		return
+	}
+
+	c.metrics.requests.WithLabelValues(c.upstream, strings.ToLower(result)).Inc()
+	recorder := &cacheResponse{
+		Wrapper:     responsewriter.Wrapper{ResponseWriter: rw},
+		result:      result,
+		before:      rw.Header().Clone(),
+		maxBodySize: c.maxEntrySize,
+		record:      true,
+	}
+	c.handler.ServeHTTP(recorder, req)
+	c.storeResponse(key, req, recorder)
+}
+
+// cacheable checks whether the request can be served from the cache
+func (c *responseCache) cacheable(req *http.Request) bool {
+	switch {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		return false
+	case req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "":
+		return false
+	case req.Header.Get("Authorization") != "" && !c.allowAuthorization:
+		return false
+	}
+	return true
+}
+
+// invalidates checks whether the response to a request with the method
+// invalidates the cached responses to its URL, as defined by RFC 9111: the
+// responses to unsafe methods that didn't fail do
+func invalidates(method string, status int) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return status != 0 && status < http.StatusBadRequest
+}
+
+// cacheURL is the host and URI of the request
+func cacheURL(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// key identifies the requests to the same URL, with the same method and, with
+// VaryOnUser, from the same user
+func (c *responseCache) key(req *http.Request) cacheKey {
+	key := cacheKey{url: cacheURL(req), request: req.Method}
+	if c.varyOnUser {
+		var user string
+		if scope := middleware.GetRequestScope(req); scope != nil && scope.Session != nil {
+			user = scope.Session.User + "\n" + scope.Session.Email
+		}
+		key.request += "\n" + user
+	}
+	return key
+}
+
+// variant identifies the requests with the same values of the headers
+func variant(req *http.Request, vary []string) string {
+	values := make([]string, 0, len(vary))
+	for _, name := range vary {
+		values = append(values, strings.Join(req.Header.Values(name), ","))
+	}
+	return strings.Join(values, "\n")
+}
+
+// serve writes the cached response
+func (c *responseCache) serve(rw http.ResponseWriter, req *http.Request, entry *cacheEntry) {
+	// The request is reported as served by the upstream
+	if scope := middleware.GetRequestScope(req); scope != nil {
+		scope.Upstream = c.upstream
+	}
+
+	header := rw.Header()
+	for name, values := range entry.header {
+		header[name] = append([]string{}, values...)
+	}
+	header.Set("Age", strconv.Itoa(int(c.clock.Now().Sub(entry.stored).Seconds())))
+	header.Set(cacheHeader, cacheHit)
+	rw.WriteHeader(entry.status)
+	if req.Method != http.MethodHead {
+		_, _ = rw.Write(entry.body)
+	}
+}
+
+// storeResponse caches the recorded response when it can be cached
+func (c *responseCache) storeResponse(key cacheKey, req *http.Request, recorder *cacheResponse) {
+	ttl := c.responseTTL(req, recorder)
+	if ttl <= 0 {
+		return
+	}
+
+	now := c.clock.Now()
+	header := recorder.cachedHeader()
+	vary := varyHeaders(header)
+	entry := &cacheEntry{
+		status:  recorder.status,
+		header:  header,
+		body:    recorder.body.Bytes(),
+		stored:  now,
+		expires: now.Add(ttl),
+		variant: variant(req, vary),
+	}
+	entry.size = int64(len(entry.body)) + headerSize(header)
+	c.store.set(req.Context(), key, vary, entry, now)
+}
+
+// purge removes all the cached responses of the upstream
+func (c *responseCache) purge(ctx context.Context) error {
+	if err := c.store.purge(ctx); err != nil {
+		return fmt.Errorf("could not purge the cache of upstream %q: %v", c.upstream, err)
+	}
+	logger.Printf("Purged the cache of upstream %q", c.upstream)
+	return nil
+}
+
+// PurgeCache removes the cached responses of the upstream with the ID, or of
+// every upstream when the ID is empty, including the dynamic upstreams
+func (m *multiUpstreamProxy) PurgeCache(ctx context.Context, id string) ([]string, error) {
+	caches := m.loadConfigured().caches
+	if dynamic := m.loadDynamic(); dynamic != nil {
+		caches = append(append([]*responseCache{}, caches...), dynamic.caches...)
+	}
+
+	purged := []string{}
+	for _, cache := range caches {
+		if id != "" && cache.upstream != id {
+			continue
+		}
+		if err := cache.purge(ctx); err != nil {
+			return purged, err
+		}
+		purged = append(purged, cache.upstream)
+	}
+	return purged, nil
+}
+
+// newMemoryCacheStore creates a store caching the responses in memory,
+// evicting the least recently used responses to stay within the maximum size
+func newMemoryCacheStore(upstream string, maxSize int64, metrics *cacheMetrics) *memoryCacheStore {
+	return &memoryCacheStore{
+		upstream: upstream,
+		maxSize:  maxSize,
+		metrics:  metrics,
+		lru:      list.New(),
+		urls:     map[string]map[string]*cachedURL{},
+	}
+}
+
+// memoryCacheStore caches the responses of an upstream in memory
+type memoryCacheStore struct {
+	upstream string
+	maxSize  int64
+	metrics  *cacheMetrics
+
+	mutex sync.Mutex
+	// size is the total size of the cached responses
+	size int64
+	// lru holds the *cacheEntry of the cached responses, from the most to
+	// the least recently used
+	lru *list.List
+	// urls holds the cached responses by URL, then by method and user
+	urls map[string]map[string]*cachedURL
+}
+
+// cachedURL holds the cached responses to the requests of a URL, one for
+// each value of the request headers the responses vary on
+type cachedURL struct {
+	vary     []string
+	variants map[string]*list.Element
+}
+
+// get returns the cached response to the request, if it hasn't expired
+func (s *memoryCacheStore) get(_ context.Context, key cacheKey, req *http.Request, now time.Time) *cacheEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cached, ok := s.urls[key.url][key.request]
+	if !ok {
+		return nil
+	}
+	element, ok := cached.variants[variant(req, cached.vary)]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		s.remove(element)
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return entry
+}
+
+// set caches the response, evicting the least recently used responses to
+// stay within the maximum size
+func (s *memoryCacheStore) set(_ context.Context, key cacheKey, vary []string, entry *cacheEntry, _ time.Time) {
+	if entry.size > s.maxSize {
+		return
+	}
+	entry.key = key
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The response replaces the previous response to the variant, and
+	// responses varying on other headers replace all the previous responses
+	if cached, ok := s.urls[key.url][key.request]; ok {
+		for variant, element := range cached.variants {
+			if variant == entry.variant || !equalHeaders(cached.vary, vary) {
+				s.remove(element)
+			}
+		}
+	}
+	cached, ok := s.urls[key.url][key.request]
+	if !ok {
+		cached = &cachedURL{vary: vary, variants: map[string]*list.Element{}}
+		if s.urls[key.url] == nil {
+			s.urls[key.url] = map[string]*cachedURL{}
+		}
+		s.urls[key.url][key.request] = cached
+	}
+	cached.variants[entry.variant] = s.lru.PushFront(entry)
+	s.size += entry.size
+
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+		s.metrics.evictions.WithLabelValues(s.upstream).Inc()
+	}
+}
+
+// invalidate removes the cached responses to the requests for the URL
+func (s *memoryCacheStore) invalidate(_ context.Context, url string, _ time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, cached := range s.urls[url] {
+		for _, element := range cached.variants {
+			s.remove(element)
+		}
+	}
+}
+
+// purge removes all the cached responses
+func (s *memoryCacheStore) purge(_ context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.size = 0
+	s.lru.Init()
+	s.urls = map[string]map[string]*cachedURL{}
+	return nil
+}
+
+// remove removes the cached response of the element.
+// The mutex must be held.
+func (s *memoryCacheStore) remove(element *list.Element) {
+	entry := s.lru.Remove(element).(*cacheEntry)
+	s.size -= entry.size
+	requests := s.urls[entry.key.url]
+	if cached, ok := requests[entry.key.request]; ok && cached.variants[entry.variant] == element {
+		delete(cached.variants, entry.variant)
+		if len(cached.variants) == 0 {
+			delete(requests, entry.key.request)
+		}
+		if len(requests) == 0 {
+			delete(s.urls, entry.key.url)
+		}
+	}
+}
+
+// responseTTL returns how long the recorded response can be cached for, or
+// zero if it can't be cached
+func (c *responseCache) responseTTL(req *http.Request, recorder *cacheResponse) time.Duration {
+	if !recorder.complete(req.Method == http.MethodHead) || !cacheableStatus[recorder.status] {
+		return 0
+	}
+	header := recorder.header
+	if len(header.Values("Set-Cookie")) > 0 {
+		return 0
+	}
+	for _, vary := range varyHeaders(header) {
+		if vary == "*" {
+			return 0
+		}
+	}
+
+	ttl := c.ttl
+	directives := cacheControl(header)
+	for _, directive := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[directive]; ok {
+			return 0
+		}
+	}
+	maxAge, ok := directives["s-maxage"]
+	if !ok {
+		maxAge, ok = directives["max-age"]
+	}
+	if ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0
+		}
+		if age := time.Duration(seconds) * time.Second; age < ttl {
+			ttl = age
+		}
+	}
+	return ttl
+}
+
+// cacheControl parses the directives of the Cache-Control header
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// varyHeaders returns the sorted, canonical names of the Vary header
+func varyHeaders(header http.Header) []string {
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+func equalHeaders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// headerSize approximates the memory used by the header
+func headerSize(header http.Header) int64 {
+	var size int64
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// cacheResponse is a custom http.ResponseWriter that sets the X-Cache header
+// of the response and, when recording, keeps a copy of the response to cache
+// it.
+type cacheResponse struct {
+	responsewriter.Wrapper
+
+	result string
+	// before is the header of the response before the upstream handler was
+	// called, the headers set by the proxy itself aren't cached
+	before http.Header
+
+	record      bool
+	maxBodySize int64
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	// failed is set when the body is too large to be cached or could not be
+	// written to the client in full
+	failed bool
+}
+
+// WriteHeader writes the status code for the Response
+func (r *cacheResponse) WriteHeader(s int) {
+	// Informational responses are sent on as they are
+	if s < http.StatusOK || r.status != 0 {
+		r.ResponseWriter.WriteHeader(s)
+		return
+	}
+
+	r.status = s
+	r.ResponseWriter.Header().Set(cacheHeader, r.result)
+	if r.record {
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Write writes the response using the ResponseWriter
+func (r *cacheResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.record && !r.failed {
+		if int64(r.body.Len()+len(b)) > r.maxBodySize {
+			r.failed = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	size, err := r.ResponseWriter.Write(b)
+	if err != nil {
+		r.failed = true
+	}
+	return size, err
+}
+
+// complete checks whether the whole response was recorded.
+// Responses to HEAD requests have no body, whatever their Content-Length.
+func (r *cacheResponse) complete(head bool) bool {
+	if !r.record || r.failed || r.status == 0 {
+		return false
+	}
+	if length := r.header.Get("Content-Length"); length != "" && !head {
+		return length == strconv.Itoa(r.body.Len())
+	}
+	return true
+}
+
+// cachedHeader returns the headers of the response set by the upstream
+// handler, that weren't already set on the response before it was called
+func (r *cacheResponse) cachedHeader() http.Header {
+	header := http.Header{}
+	for name, values := range r.header {
+		if name == cacheHeader || strings.Join(r.before.Values(name), "\n") == strings.Join(values, "\n") {
+			continue
+		}
+		header[name] = values
+	}
+	return header
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (r *cacheResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.failed = true
+	return r.Wrapper.Hijack()
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *cacheResponse) Flush() {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.Wrapper.Flush()
+}
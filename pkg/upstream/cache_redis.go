@@ -0,0 +1,236 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/redis"
+)
+
+// redisCacheKeyPrefix is the prefix of the keys of the cached responses in
+// Redis, followed by the upstream ID
+const redisCacheKeyPrefix = "oauth2-proxy-cache:"
+
+// cacheRedisClient connects to the Redis server of the response caches
+// stored in Redis the first time one of them is registered, so that the
+// proxy doesn't connect to Redis when no upstream caches its responses there
+type cacheRedisClient struct {
+	opts options.RedisStoreOptions
+
+	once   sync.Once
+	client redis.Client
+	err    error
+}
+
+// newCacheRedisClient creates the client of the Redis server with the options
+func newCacheRedisClient(opts options.RedisStoreOptions) *cacheRedisClient {
+	return &cacheRedisClient{opts: opts}
+}
+
+// get returns the client, connecting to the Redis server the first time
+func (c *cacheRedisClient) get() (redis.Client, error) {
+	c.once.Do(func() {
+		c.client, c.err = redis.NewRedisClient(c.opts)
+	})
+	return c.client, c.err
+}
+
+// newRedisCacheStore creates a store caching the responses of the upstream
+// in Redis, where they expire with their cached responses.
+// The TTL is the longest responses are cached for.
+func newRedisCacheStore(upstream string, client redis.Client, ttl time.Duration) *redisCacheStore {
+	return &redisCacheStore{
+		upstream: upstream,
+		client:   client,
+		prefix:   redisCacheKeyPrefix + upstream + ":",
+		ttl:      ttl,
+	}
+}
+
+// redisCacheStore caches the responses of an upstream in Redis, so that they
+// are shared by all the instances of the proxy.
+// The responses to the requests of a URL with the same method and user are
+// stored under one key, with the generation of the URL they were cached in:
+// invalidating the URL starts a new generation, so that the responses to
+// the requests of every user are invalidated at once.
+type redisCacheStore struct {
+	upstream string
+	client   redis.Client
+	prefix   string
+	ttl      time.Duration
+}
+
+// redisCachedURL is the value of the key of the responses to the requests
+// of a URL with the same method and user
+type redisCachedURL struct {
+	Generation string                       `json:"generation,omitempty"`
+	Vary       []string                     `json:"vary,omitempty"`
+	Variants   map[string]redisCachedResult `json:"variants"`
+}
+
+// redisCachedResult is a cached response in Redis
+type redisCachedResult struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// get returns the cached response to the request, if it hasn't expired and
+// its URL hasn't been invalidated since it was cached.
+// Errors are logged, and the request is served by the upstream.
+func (s *redisCacheStore) get(ctx context.Context, key cacheKey, req *http.Request, now time.Time) *cacheEntry {
+	cached, _, err := s.load(ctx, key)
+	if err != nil {
+		logger.Errorf("Error loading the cached response of upstream %q from redis: %v", s.upstream, err)
+		return nil
+	}
+	if cached == nil {
+		return nil
+	}
+
+	result, ok := cached.Variants[variant(req, cached.Vary)]
+	if !ok || !now.Before(result.Expires) {
+		return nil
+	}
+	return &cacheEntry{
+		status:  result.Status,
+		header:  result.Header,
+		body:    result.Body,
+		stored:  result.Stored,
+		expires: result.Expires,
+	}
+}
+
+// set caches the response along with the unexpired responses to the other
+// values of the vary headers, the key expiring with the last of them.
+// Errors are logged, the response is then not cached.
+func (s *redisCacheStore) set(ctx context.Context, key cacheKey, vary []string, entry *cacheEntry, now time.Time) {
+	cached, generation, err := s.load(ctx, key)
+	if err != nil {
+		logger.Errorf("Error caching the response of upstream %q in redis: %v", s.upstream, err)
+		return
+	}
+	if cached == nil || !equalHeaders(cached.Vary, vary) {
+		// Responses varying on other headers replace the previous responses
+		cached = &redisCachedURL{Generation: generation, Vary: vary, Variants: map[string]redisCachedResult{}}
+	}
+
+	cached.Variants[entry.variant] = redisCachedResult{
+		Status:  entry.status,
+		Header:  entry.header,
+		Body:    entry.body,
+		Stored:  entry.stored,
+		Expires: entry.expires,
+	}
+	var expires time.Time
+	for variant, result := range cached.Variants {
+		if !now.Before(result.Expires) {
+			delete(cached.Variants, variant)
+			continue
+		}
+		if result.Expires.After(expires) {
+			expires = result.Expires
+		}
+	}
+
+	value, err := json.Marshal(cached)
+	if err != nil {
+		logger.Errorf("Error caching the response of upstream %q in redis: %v", s.upstream, err)
+		return
+	}
+	if err := s.client.Set(ctx, s.urlKey(key), value, expires.Sub(now)); err != nil {
+		logger.Errorf("Error caching the response of upstream %q in redis: %v", s.upstream, err)
+	}
+}
+
+// invalidate starts a new generation of the URL, so that the responses
+// cached in the previous generations are no longer served.
+// The generation only needs to outlive the responses cached before it, which
+// are cached for the TTL at most.
+func (s *redisCacheStore) invalidate(ctx context.Context, url string, _ time.Time) {
+	nonce, err := encryption.Nonce(16)
+	if err != nil {
+		logger.Errorf("Error invalidating the cached responses of upstream %q in redis: %v", s.upstream, err)
+		return
+	}
+	if err := s.client.Set(ctx, s.generationKey(url), []byte(hex.EncodeToString(nonce)), s.ttl); err != nil {
+		logger.Errorf("Error invalidating the cached responses of upstream %q in redis: %v", s.upstream, err)
+	}
+}
+
+// purge deletes all the keys of the upstream
+func (s *redisCacheStore) purge(ctx context.Context) error {
+	return s.client.ScanKeys(ctx, redis.EscapeGlob(s.prefix)+"*", 100, func(keys []string) error {
+		for _, key := range keys {
+			if err := s.client.Del(ctx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load returns the cached responses of the key and the current generation of
+// their URL. The responses are nil when there are none, or when they were
+// cached in a previous generation.
+func (s *redisCacheStore) load(ctx context.Context, key cacheKey) (*redisCachedURL, string, error) {
+	generation, err := s.generation(ctx, key.url)
+	if err != nil {
+		return nil, "", err
+	}
+	value, err := s.client.Get(ctx, s.urlKey(key))
+	if errors.Is(err, goredis.Nil) {
+		return nil, generation, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	cached := &redisCachedURL{}
+	if err := json.Unmarshal(value, cached); err != nil {
+		return nil, "", err
+	}
+	if cached.Generation != generation {
+		return nil, generation, nil
+	}
+	return cached, generation, nil
+}
+
+// generation returns the current generation of the URL, empty until it is
+// first invalidated
+func (s *redisCacheStore) generation(ctx context.Context, url string) (string, error) {
+	value, err := s.client.Get(ctx, s.generationKey(url))
+	if errors.Is(err, goredis.Nil) {
+		return "", nil
+	}
+	return string(value), err
+}
+
+// urlKey is the key of the responses to the requests with the key, hashed so
+// that the URL and user can't be read from Redis
+func (s *redisCacheStore) urlKey(key cacheKey) string {
+	return s.prefix + hash(key.url+"\n"+key.request)
+}
+
+// generationKey is the key of the generation of the URL
+func (s *redisCacheStore) generationKey(url string) string {
+	return s.prefix + "generation:" + hash(url)
+}
+
+// hash returns the hex encoded SHA-256 hash of the value
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,141 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Redis Response Cache Suite", func() {
+	var mr *miniredis.Miniredis
+	var redis *cacheRedisClient
+	var metrics *cacheMetrics
+	var calls int
+
+	// handler responds with the report of the user, varying on the
+	// Accept-Language of the request
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		rw.Header().Set("Vary", "Accept-Language")
+		_, _ = rw.Write([]byte("report in " + req.Header.Get("Accept-Language")))
+	})
+
+	BeforeEach(func() {
+		var err error
+		mr, err = miniredis.Run()
+		Expect(err).ToNot(HaveOccurred())
+		redis = newCacheRedisClient(options.RedisStoreOptions{ConnectionURL: "redis://" + mr.Addr()})
+		metrics = newCacheMetrics(prometheus.NewRegistry())
+		calls = 0
+	})
+
+	AfterEach(func() {
+		client, err := redis.get()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.Close()).To(Succeed())
+		mr.Close()
+	})
+
+	newCache := func(id string, cache options.UpstreamCache) *responseCache {
+		cache.Store = options.UpstreamCacheStoreRedis
+		c, err := newResponseCache(options.Upstream{ID: id, Cache: &cache}, handler, metrics, redis)
+		Expect(err).ToNot(HaveOccurred())
+		return c
+	}
+
+	serve := func(handler http.Handler, method, language string, session *sessionsapi.SessionState) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://dashboard.example.com/api/report?range=7d", nil)
+		req.Header.Set("Accept-Language", language)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("shares the cached responses between the caches of the upstream", func() {
+		first := newCache("dashboard", options.UpstreamCache{})
+		second := newCache("dashboard", options.UpstreamCache{})
+
+		Expect(serve(first, http.MethodGet, "en", nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(first, http.MethodGet, "fr", nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+
+		rw := serve(second, http.MethodGet, "en", nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("report in en"))
+		rw = serve(second, http.MethodGet, "fr", nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("report in fr"))
+		Expect(calls).To(Equal(2))
+
+		other := newCache("reports", options.UpstreamCache{})
+		Expect(serve(other, http.MethodGet, "en", nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+	})
+
+	It("expires the cached responses with their TTL", func() {
+		ttl := options.Duration(time.Minute)
+		cache := newCache("dashboard", options.UpstreamCache{TTL: &ttl})
+		cache.clock.Set(time.Unix(1650000000, 0))
+
+		serve(cache, http.MethodGet, "en", nil)
+		Expect(cache.clock.Add(30 * time.Second)).To(Succeed())
+		rw := serve(cache, http.MethodGet, "en", nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Header().Get("Age")).To(Equal("30"))
+
+		Expect(cache.clock.Add(30 * time.Second)).To(Succeed())
+		Expect(serve(cache, http.MethodGet, "en", nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+
+		mr.FastForward(time.Minute)
+		Expect(mr.Keys()).To(BeEmpty())
+	})
+
+	It("invalidates the cached responses of every user after successful unsafe requests", func() {
+		alice := &sessionsapi.SessionState{Email: "alice@example.com"}
+		bob := &sessionsapi.SessionState{Email: "bob@example.com"}
+		cache := newCache("dashboard", options.UpstreamCache{VaryOnUser: true})
+
+		serve(cache, http.MethodGet, "en", alice)
+		serve(cache, http.MethodGet, "en", bob)
+		Expect(serve(cache, http.MethodGet, "en", bob).Header().Get(cacheHeader)).To(Equal(cacheHit))
+
+		serve(cache, http.MethodPost, "en", alice)
+		Expect(serve(cache, http.MethodGet, "en", alice).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(cache, http.MethodGet, "en", bob).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(cache, http.MethodGet, "en", bob).Header().Get(cacheHeader)).To(Equal(cacheHit))
+	})
+
+	It("purges the cached responses of the upstream", func() {
+		cache := newCache("dashboard", options.UpstreamCache{})
+		other := newCache("reports", options.UpstreamCache{})
+
+		serve(cache, http.MethodGet, "en", nil)
+		serve(other, http.MethodGet, "en", nil)
+		Expect(cache.purge(context.Background())).To(Succeed())
+
+		Expect(serve(cache, http.MethodGet, "en", nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(other, http.MethodGet, "en", nil).Header().Get(cacheHeader)).To(Equal(cacheHit))
+	})
+
+	It("serves requests from the upstream when redis is unavailable", func() {
+		cache := newCache("dashboard", options.UpstreamCache{})
+		mr.Close()
+
+		rw := serve(cache, http.MethodGet, "en", nil)
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(rw.Body.String()).To(Equal("report in en"))
+	})
+})
@@ -0,0 +1,359 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Response Cache Suite", func() {
+	var metrics *cacheMetrics
+	var calls int
+
+	// upstreamHandler responds with the body and headers, counting the
+	// requests that reach the upstream
+	upstreamHandler := func(status int, header map[string]string, body string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			for name, value := range header {
+				rw.Header().Set(name, value)
+			}
+			rw.WriteHeader(status)
+			_, _ = rw.Write([]byte(body))
+		})
+	}
+
+	newCache := func(cache options.UpstreamCache, handler http.Handler) *responseCache {
+		c, err := newResponseCache(options.Upstream{ID: "dashboard", Cache: &cache}, handler, metrics, nil)
+		Expect(err).ToNot(HaveOccurred())
+		return c
+	}
+
+	serve := func(handler http.Handler, method string, header map[string]string, session *sessionsapi.SessionState) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://dashboard.example.com/api/report?range=7d", nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	results := func(result string) float64 {
+		return testutil.ToFloat64(metrics.requests.WithLabelValues("dashboard", result))
+	}
+
+	BeforeEach(func() {
+		metrics = newCacheMetrics(prometheus.NewRegistry())
+		calls = 0
+	})
+
+	type responseCacheTableInput struct {
+		cache          options.UpstreamCache
+		method         string
+		requestHeaders map[string]string
+		status         int
+		headers        map[string]string
+		body           string
+		expectedCache  []string
+		expectedCalls  int
+	}
+
+	DescribeTable("when requests are repeated",
+		func(in responseCacheTableInput) {
+			method := in.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			status := in.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			body := in.body
+			if body == "" {
+				body = "report"
+			}
+			cache := newCache(in.cache, upstreamHandler(status, in.headers, body))
+
+			var responses []string
+			for i := 0; i < 2; i++ {
+				rw := serve(cache, method, in.requestHeaders, nil)
+				Expect(rw.Code).To(Equal(status))
+				if method != http.MethodHead {
+					Expect(rw.Body.String()).To(Equal(body))
+				}
+				responses = append(responses, rw.Header().Get(cacheHeader))
+			}
+			Expect(responses).To(Equal(in.expectedCache))
+			Expect(calls).To(Equal(in.expectedCalls))
+
+			var hits, misses, bypasses float64
+			for _, result := range in.expectedCache {
+				switch result {
+				case cacheHit:
+					hits++
+				case cacheMiss:
+					misses++
+				case cacheBypass:
+					bypasses++
+				}
+			}
+			Expect(results("hit")).To(Equal(hits))
+			Expect(results("miss")).To(Equal(misses))
+			Expect(results("bypass")).To(Equal(bypasses))
+		},
+		Entry("caches GET responses", responseCacheTableInput{
+			expectedCache: []string{cacheMiss, cacheHit},
+			expectedCalls: 1,
+		}),
+		Entry("caches HEAD responses", responseCacheTableInput{
+			method:        http.MethodHead,
+			expectedCache: []string{cacheMiss, cacheHit},
+			expectedCalls: 1,
+		}),
+		Entry("caches 404 responses", responseCacheTableInput{
+			status:        http.StatusNotFound,
+			expectedCache: []string{cacheMiss, cacheHit},
+			expectedCalls: 1,
+		}),
+		Entry("bypasses POST requests", responseCacheTableInput{
+			method:        http.MethodPost,
+			expectedCache: []string{cacheBypass, cacheBypass},
+			expectedCalls: 2,
+		}),
+		Entry("bypasses Range requests", responseCacheTableInput{
+			requestHeaders: map[string]string{"Range": "bytes=0-1"},
+			expectedCache:  []string{cacheBypass, cacheBypass},
+			expectedCalls:  2,
+		}),
+		Entry("bypasses requests with an Authorization header", responseCacheTableInput{
+			requestHeaders: map[string]string{"Authorization": "Bearer token"},
+			expectedCache:  []string{cacheBypass, cacheBypass},
+			expectedCalls:  2,
+		}),
+		Entry("caches requests with an Authorization header when allowed", responseCacheTableInput{
+			cache:          options.UpstreamCache{AllowAuthorization: true},
+			requestHeaders: map[string]string{"Authorization": "Bearer token"},
+			expectedCache:  []string{cacheMiss, cacheHit},
+			expectedCalls:  1,
+		}),
+		Entry("doesn't cache no-store responses", responseCacheTableInput{
+			headers:       map[string]string{"Cache-Control": "no-store"},
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache private responses", responseCacheTableInput{
+			headers:       map[string]string{"Cache-Control": "private, max-age=60"},
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache max-age=0 responses", responseCacheTableInput{
+			headers:       map[string]string{"Cache-Control": "max-age=0"},
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache responses setting cookies", responseCacheTableInput{
+			headers:       map[string]string{"Set-Cookie": "theme=dark"},
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache responses varying on everything", responseCacheTableInput{
+			headers:       map[string]string{"Vary": "*"},
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache server errors", responseCacheTableInput{
+			status:        http.StatusInternalServerError,
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("doesn't cache bodies larger than the maximum entry size", responseCacheTableInput{
+			cache:         options.UpstreamCache{MaxEntrySize: 16},
+			body:          strings.Repeat("report", 10),
+			expectedCache: []string{cacheMiss, cacheMiss},
+			expectedCalls: 2,
+		}),
+		Entry("bypasses requests with the bypass header", responseCacheTableInput{
+			cache:          options.UpstreamCache{BypassHeader: "X-Cache-Bypass"},
+			requestHeaders: map[string]string{"X-Cache-Bypass": "1"},
+			expectedCache:  []string{cacheBypass, cacheBypass},
+			expectedCalls:  2,
+		}),
+	)
+
+	It("refreshes the cached response with the bypass header", func() {
+		report := "first report"
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			_, _ = rw.Write([]byte(report))
+		})
+		cache := newCache(options.UpstreamCache{BypassHeader: "X-Cache-Bypass"}, handler)
+
+		Expect(serve(cache, http.MethodGet, nil, nil).Body.String()).To(Equal("first report"))
+		report = "second report"
+		Expect(serve(cache, http.MethodGet, nil, nil).Body.String()).To(Equal("first report"))
+
+		rw := serve(cache, http.MethodGet, map[string]string{"X-Cache-Bypass": "1"}, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheBypass))
+		Expect(rw.Body.String()).To(Equal("second report"))
+		rw = serve(cache, http.MethodGet, nil, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("second report"))
+		Expect(calls).To(Equal(2))
+	})
+
+	It("invalidates the cached responses of every user after successful unsafe requests", func() {
+		status := http.StatusOK
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			if req.Method == http.MethodPost {
+				rw.WriteHeader(status)
+				return
+			}
+			_, _ = rw.Write([]byte("report"))
+		})
+		alice := &sessionsapi.SessionState{Email: "alice@example.com"}
+		bob := &sessionsapi.SessionState{Email: "bob@example.com"}
+		cache := newCache(options.UpstreamCache{VaryOnUser: true}, handler)
+
+		serve(cache, http.MethodGet, nil, alice)
+		serve(cache, http.MethodGet, nil, bob)
+		serve(cache, http.MethodHead, nil, bob)
+		Expect(serve(cache, http.MethodGet, nil, alice).Header().Get(cacheHeader)).To(Equal(cacheHit))
+
+		status = http.StatusForbidden
+		serve(cache, http.MethodPost, nil, alice)
+		Expect(serve(cache, http.MethodGet, nil, bob).Header().Get(cacheHeader)).To(Equal(cacheHit))
+
+		status = http.StatusNoContent
+		serve(cache, http.MethodPost, nil, alice)
+		Expect(serve(cache, http.MethodGet, nil, alice).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(cache, http.MethodGet, nil, bob).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(serve(cache, http.MethodHead, nil, bob).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+	})
+
+	It("purges the cached responses", func() {
+		cache := newCache(options.UpstreamCache{}, upstreamHandler(http.StatusOK, nil, "report"))
+
+		serve(cache, http.MethodGet, nil, nil)
+		Expect(serve(cache, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheHit))
+
+		Expect(cache.purge(context.Background())).To(Succeed())
+		Expect(cache.store.(*memoryCacheStore).size).To(BeZero())
+		Expect(serve(cache, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+	})
+
+	It("expires responses after the TTL or max-age", func() {
+		ttl := options.Duration(time.Minute)
+		cache := newCache(options.UpstreamCache{TTL: &ttl}, upstreamHandler(http.StatusOK, nil, "report"))
+		cache.clock.Set(time.Unix(1650000000, 0))
+
+		Expect(serve(cache, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(cache.clock.Add(59 * time.Second)).To(Succeed())
+		rw := serve(cache, http.MethodGet, nil, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Header().Get("Age")).To(Equal("59"))
+		Expect(cache.clock.Add(time.Second)).To(Succeed())
+		Expect(serve(cache, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+
+		maxAge := newCache(options.UpstreamCache{TTL: &ttl}, upstreamHandler(http.StatusOK, map[string]string{"Cache-Control": "public, max-age=10"}, "report"))
+		maxAge.clock.Set(time.Unix(1650000000, 0))
+		Expect(serve(maxAge, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+		Expect(maxAge.clock.Add(10 * time.Second)).To(Succeed())
+		Expect(serve(maxAge, http.MethodGet, nil, nil).Header().Get(cacheHeader)).To(Equal(cacheMiss))
+	})
+
+	It("caches responses for each value of the headers they vary on", func() {
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			rw.Header().Set("Vary", "Accept-Language")
+			_, _ = rw.Write([]byte("report in " + req.Header.Get("Accept-Language")))
+		})
+		cache := newCache(options.UpstreamCache{}, handler)
+
+		english := map[string]string{"Accept-Language": "en"}
+		french := map[string]string{"Accept-Language": "fr"}
+		Expect(serve(cache, http.MethodGet, english, nil).Body.String()).To(Equal("report in en"))
+		Expect(serve(cache, http.MethodGet, french, nil).Body.String()).To(Equal("report in fr"))
+
+		rw := serve(cache, http.MethodGet, english, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("report in en"))
+		rw = serve(cache, http.MethodGet, french, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("report in fr"))
+		Expect(calls).To(Equal(2))
+	})
+
+	It("caches responses for each user with VaryOnUser", func() {
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			_, _ = rw.Write([]byte("report for " + middlewareapi.GetRequestScope(req).Session.Email))
+		})
+		alice := &sessionsapi.SessionState{Email: "alice@example.com"}
+		bob := &sessionsapi.SessionState{Email: "bob@example.com"}
+
+		shared := newCache(options.UpstreamCache{}, handler)
+		Expect(serve(shared, http.MethodGet, nil, alice).Body.String()).To(Equal("report for alice@example.com"))
+		Expect(serve(shared, http.MethodGet, nil, bob).Body.String()).To(Equal("report for alice@example.com"))
+
+		perUser := newCache(options.UpstreamCache{VaryOnUser: true}, handler)
+		Expect(serve(perUser, http.MethodGet, nil, alice).Body.String()).To(Equal("report for alice@example.com"))
+		Expect(serve(perUser, http.MethodGet, nil, bob).Body.String()).To(Equal("report for bob@example.com"))
+		rw := serve(perUser, http.MethodGet, nil, alice)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Body.String()).To(Equal("report for alice@example.com"))
+	})
+
+	It("doesn't cache the headers set before the upstream handler", func() {
+		cache := newCache(options.UpstreamCache{}, upstreamHandler(http.StatusOK, map[string]string{"Content-Type": "text/plain"}, "report"))
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("GAP-Auth", req.Header.Get("X-User"))
+			cache.ServeHTTP(rw, req)
+		})
+
+		Expect(serve(handler, http.MethodGet, map[string]string{"X-User": "alice"}, nil).Header().Get("GAP-Auth")).To(Equal("alice"))
+		rw := serve(handler, http.MethodGet, map[string]string{"X-User": "bob"}, nil)
+		Expect(rw.Header().Get(cacheHeader)).To(Equal(cacheHit))
+		Expect(rw.Header().Get("GAP-Auth")).To(Equal("bob"))
+		Expect(rw.Header().Get("Content-Type")).To(Equal("text/plain"))
+	})
+
+	It("evicts the least recently used responses to stay within the maximum size", func() {
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			_, _ = rw.Write([]byte(strings.Repeat("x", 100)))
+		})
+		cache := newCache(options.UpstreamCache{MaxSize: 250}, handler)
+		get := func(path string) string {
+			req := httptest.NewRequest(http.MethodGet, "http://dashboard.example.com"+path, nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			cache.ServeHTTP(rw, req)
+			return rw.Header().Get(cacheHeader)
+		}
+
+		Expect(get("/first")).To(Equal(cacheMiss))
+		Expect(get("/second")).To(Equal(cacheMiss))
+		Expect(get("/first")).To(Equal(cacheHit))
+		Expect(get("/third")).To(Equal(cacheMiss))
+		Expect(testutil.ToFloat64(metrics.evictions.WithLabelValues("dashboard"))).To(Equal(1.0))
+
+		Expect(get("/first")).To(Equal(cacheHit))
+		Expect(get("/third")).To(Equal(cacheHit))
+		Expect(get("/second")).To(Equal(cacheMiss))
+		Expect(cache.store.(*memoryCacheStore).size).To(BeNumerically("<=", 250))
+	})
+})
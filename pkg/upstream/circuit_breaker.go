@@ -0,0 +1,344 @@
+package upstream
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// circuitBuckets is the number of buckets the window of a circuit breaker is
+// divided into, the requests leaving the window a bucket at a time
+const circuitBuckets = 10
+
+// circuitState is the state of a circuit breaker, whose value is reported by
+// the state metric
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// String returns the name of the state
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// newCircuitBreaker wraps the handler so that requests to the upstream are
+// rejected with a 503 response while its circuit is open, filling in the
+// defaults of the upstream's CircuitBreaker.
+func newCircuitBreaker(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer, metrics *circuitBreakerMetrics) *circuitBreaker {
+	opts := upstream.CircuitBreaker
+	b := &circuitBreaker{
+		upstream:         upstream.ID,
+		errorRatePercent: options.DefaultCircuitBreakerErrorRatePercent,
+		minimumRequests:  options.DefaultCircuitBreakerMinimumRequests,
+		window:           options.DefaultCircuitBreakerWindow,
+		coolDown:         options.DefaultCircuitBreakerCoolDown,
+		halfOpenRequests: options.DefaultCircuitBreakerHalfOpenRequests,
+		handler:          handler,
+		writer:           writer,
+		metrics:          metrics,
+	}
+	if opts.ErrorRatePercent > 0 {
+		b.errorRatePercent = opts.ErrorRatePercent
+	}
+	if opts.MinimumRequests > 0 {
+		b.minimumRequests = opts.MinimumRequests
+	}
+	if opts.Window != nil {
+		b.window = opts.Window.Duration()
+	}
+	if opts.CoolDown != nil {
+		b.coolDown = opts.CoolDown.Duration()
+	}
+	if opts.HalfOpenRequests > 0 {
+		b.halfOpenRequests = opts.HalfOpenRequests
+	}
+
+	metrics.state.WithLabelValues(b.upstream).Set(float64(circuitClosed))
+	return b
+}
+
+// circuitBreaker stops sending requests to an upstream for a cool-down
+// period once too many of its recent requests have failed, so that requests
+// to a failing upstream are rejected at once rather than waiting for it to
+// time out.
+type circuitBreaker struct {
+	upstream         string
+	errorRatePercent int
+	minimumRequests  int
+	window           time.Duration
+	coolDown         time.Duration
+	halfOpenRequests int
+
+	handler http.Handler
+	writer  pagewriter.Writer
+	metrics *circuitBreakerMetrics
+
+	mu    sync.Mutex
+	state circuitState
+	// generation is incremented on every change of state, so that the
+	// results of requests sent in a previous state are ignored
+	generation int
+	// buckets hold the results of the requests in the window while the
+	// circuit is closed, oldest first
+	buckets []circuitBucket
+	// openedAt is when the circuit was last opened
+	openedAt time.Time
+	// trials and succeeded count the trial requests sent, and those that
+	// succeeded, while the circuit is half-open
+	trials    int
+	succeeded int
+
+	clock clock.Clock
+}
+
+// circuitBucket counts the requests, and the failed requests, that
+// completed within a slice of the window starting at start
+type circuitBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// ServeHTTP serves the request unless the circuit is open, recording whether
+// it failed once the response is started.
+func (b *circuitBreaker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	generation, ok := b.allow()
+	if !ok {
+		b.reject(rw, req)
+		return
+	}
+
+	resp := &circuitResponse{Wrapper: responsewriter.Wrapper{ResponseWriter: rw}, breaker: b, generation: generation, req: req}
+	b.handler.ServeHTTP(resp, req)
+	resp.record(http.StatusOK)
+}
+
+// allow returns whether a request may be sent to the upstream, and the
+// generation of the state it was sent in.
+// The circuit is half-open once the cool-down has passed, when only the
+// trial requests are sent.
+func (b *circuitBreaker) allow() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if b.clock.Since(b.openedAt) < b.coolDown {
+			return 0, false
+		}
+		b.setState(circuitHalfOpen)
+		b.trials, b.succeeded = 0, 0
+	}
+	if b.state == circuitHalfOpen {
+		if b.trials >= b.halfOpenRequests {
+			return 0, false
+		}
+		b.trials++
+	}
+	return b.generation, true
+}
+
+// release releases the trial of a request sent while the circuit was
+// half-open without a result, so that another trial request can be sent
+func (b *circuitBreaker) release(generation int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == circuitHalfOpen {
+		b.trials--
+	}
+}
+
+// done records the result of a request sent in the generation.
+// The circuit opens when the error rate is reached while it is closed, or a
+// trial request fails while it is half-open, and closes once all the trial
+// requests have succeeded.
+func (b *circuitBreaker) done(generation int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case circuitClosed:
+		requests, failures := b.recordResult(failed)
+		if requests >= b.minimumRequests && failures*100 >= b.errorRatePercent*requests {
+			logger.Errorf("Opening the circuit of upstream %q for %s: %d of its last %d requests failed", b.upstream, b.coolDown, failures, requests)
+			b.open()
+		}
+	case circuitHalfOpen:
+		if failed {
+			logger.Errorf("Opening the circuit of upstream %q for %s: a trial request failed", b.upstream, b.coolDown)
+			b.open()
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.halfOpenRequests {
+			logger.Printf("Closing the circuit of upstream %q: its trial requests succeeded", b.upstream)
+			b.buckets = nil
+			b.setState(circuitClosed)
+		}
+	}
+}
+
+// recordResult adds the result to the window, dropping the buckets that have
+// left it, and returns the number of requests and failures in the window
+func (b *circuitBreaker) recordResult(failed bool) (int, int) {
+	now := b.clock.Now()
+	bucketSize := b.window / circuitBuckets
+	if bucketSize <= 0 {
+		bucketSize = b.window
+	}
+
+	expired := 0
+	for expired < len(b.buckets) && now.Sub(b.buckets[expired].start) >= b.window {
+		expired++
+	}
+	b.buckets = b.buckets[expired:]
+
+	start := now.Truncate(bucketSize)
+	if len(b.buckets) == 0 || !b.buckets[len(b.buckets)-1].start.Equal(start) {
+		b.buckets = append(b.buckets, circuitBucket{start: start})
+	}
+	bucket := &b.buckets[len(b.buckets)-1]
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+
+	requests, failures := 0, 0
+	for _, bucket := range b.buckets {
+		requests += bucket.requests
+		failures += bucket.failures
+	}
+	return requests, failures
+}
+
+// open opens the circuit for the cool-down
+func (b *circuitBreaker) open() {
+	b.openedAt = b.clock.Now()
+	b.buckets = nil
+	b.setState(circuitOpen)
+}
+
+// setState changes the state of the circuit, starting a new generation
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	b.generation++
+	b.metrics.state.WithLabelValues(b.upstream).Set(float64(state))
+}
+
+// retryAfter returns the seconds until the circuit is half-open again, at
+// least 1
+func (b *circuitBreaker) retryAfter() string {
+	b.mu.Lock()
+	remaining := b.coolDown - b.clock.Since(b.openedAt)
+	b.mu.Unlock()
+
+	seconds := int(math.Ceil(remaining.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// reject counts the rejected request and writes a 503 error page asking the
+// client to retry once the circuit may be closed
+func (b *circuitBreaker) reject(rw http.ResponseWriter, req *http.Request) {
+	b.metrics.rejected.WithLabelValues(b.upstream).Inc()
+
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = b.upstream
+
+	logger.Errorf("Rejected request to upstream %q: the circuit is open", b.upstream)
+	rw.Header().Set("Retry-After", b.retryAfter())
+	b.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusServiceUnavailable,
+		RequestID: scope.RequestID,
+		AppError:  "the circuit of upstream " + b.upstream + " is open",
+		Messages:  []interface{}{"The upstream server is unavailable, please try again later."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
+
+// circuitResponse is a custom http.ResponseWriter that records the result of
+// the request with the circuit breaker when the response is started.
+// Responses with a 5xx status are failures, including the error pages of
+// requests that couldn't be sent to the upstream, unless the request was
+// cancelled by the client.
+type circuitResponse struct {
+	responsewriter.Wrapper
+
+	breaker    *circuitBreaker
+	generation int
+	req        *http.Request
+	recorded   bool
+}
+
+// record records the result of the request, once
+func (r *circuitResponse) record(status int) {
+	if r.recorded {
+		return
+	}
+	r.recorded = true
+
+	failed := status >= http.StatusInternalServerError
+	if failed && r.req.Context().Err() != nil {
+		r.breaker.release(r.generation)
+		return
+	}
+	r.breaker.done(r.generation, failed)
+}
+
+// Write writes the response using the ResponseWriter
+func (r *circuitResponse) Write(b []byte) (int, error) {
+	// The status will be StatusOK if WriteHeader has not been called yet
+	r.record(http.StatusOK)
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteHeader writes the status code for the Response
+func (r *circuitResponse) WriteHeader(s int) {
+	r.record(s)
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (r *circuitResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// WebSocket connections are hijacked once they are upgraded
+	r.record(http.StatusSwitchingProtocols)
+	return r.Wrapper.Hijack()
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *circuitResponse) Flush() {
+	r.record(http.StatusOK)
+	r.Wrapper.Flush()
+}
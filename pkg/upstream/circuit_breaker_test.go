@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Circuit Breaker Suite", func() {
+	var metrics *circuitBreakerMetrics
+	var writer *pagewriter.WriterFuncs
+	var status int
+	var requests int
+
+	// handler counts the requests sent to the upstream, responding with
+	// the current status
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		requests++
+		rw.WriteHeader(status)
+	})
+
+	BeforeEach(func() {
+		metrics = newCircuitBreakerMetrics(prometheus.NewRegistry())
+		writer = &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				rw.WriteHeader(opts.Status)
+			},
+		}
+		status = http.StatusOK
+		requests = 0
+	})
+
+	duration := func(d time.Duration) *options.Duration {
+		o := options.Duration(d)
+		return &o
+	}
+
+	newBreaker := func(opts options.UpstreamCircuitBreaker) *circuitBreaker {
+		breaker := newCircuitBreaker(options.Upstream{
+			ID:             "flapping",
+			CircuitBreaker: &opts,
+		}, handler, writer, metrics)
+		breaker.clock.Set(time.Unix(1650000000, 0))
+		return breaker
+	}
+
+	serve := func(breaker http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("", "/", nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		breaker.ServeHTTP(rw, req)
+		return rw
+	}
+
+	state := func() float64 {
+		return testutil.ToFloat64(metrics.state.WithLabelValues("flapping"))
+	}
+
+	It("fills in the defaults", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{})
+		Expect(breaker.errorRatePercent).To(Equal(options.DefaultCircuitBreakerErrorRatePercent))
+		Expect(breaker.minimumRequests).To(Equal(options.DefaultCircuitBreakerMinimumRequests))
+		Expect(breaker.window).To(Equal(options.DefaultCircuitBreakerWindow))
+		Expect(breaker.coolDown).To(Equal(options.DefaultCircuitBreakerCoolDown))
+		Expect(breaker.halfOpenRequests).To(Equal(options.DefaultCircuitBreakerHalfOpenRequests))
+		Expect(state()).To(Equal(float64(circuitClosed)))
+	})
+
+	It("opens once the error rate is reached, and rejects requests until the cool-down has passed", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{
+			ErrorRatePercent: 50,
+			MinimumRequests:  4,
+			CoolDown:         duration(30 * time.Second),
+		})
+
+		status = http.StatusBadGateway
+		for i := 0; i < 3; i++ {
+			Expect(serve(breaker).Code).To(Equal(http.StatusBadGateway))
+		}
+		Expect(state()).To(Equal(float64(circuitClosed)))
+
+		status = http.StatusOK
+		Expect(serve(breaker).Code).To(Equal(http.StatusOK))
+		Expect(state()).To(Equal(float64(circuitOpen)))
+		Expect(requests).To(Equal(4))
+
+		Expect(breaker.clock.Add(10500 * time.Millisecond)).To(Succeed())
+		rejected := serve(breaker)
+		Expect(rejected.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rejected.Header().Get("Retry-After")).To(Equal("20"))
+		Expect(requests).To(Equal(4))
+		Expect(testutil.ToFloat64(metrics.rejected.WithLabelValues("flapping"))).To(Equal(1.0))
+	})
+
+	It("doesn't open before the minimum number of requests", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{MinimumRequests: 5})
+
+		status = http.StatusInternalServerError
+		for i := 0; i < 4; i++ {
+			serve(breaker)
+		}
+		Expect(state()).To(Equal(float64(circuitClosed)))
+		Expect(serve(breaker).Code).To(Equal(http.StatusInternalServerError))
+		Expect(state()).To(Equal(float64(circuitOpen)))
+	})
+
+	It("doesn't count server errors that have left the window", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{
+			MinimumRequests: 2,
+			Window:          duration(10 * time.Second),
+		})
+
+		status = http.StatusInternalServerError
+		serve(breaker)
+		Expect(breaker.clock.Add(10 * time.Second)).To(Succeed())
+
+		status = http.StatusOK
+		serve(breaker)
+		serve(breaker)
+		Expect(state()).To(Equal(float64(circuitClosed)))
+	})
+
+	It("closes once the trial requests succeed", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{
+			MinimumRequests:  1,
+			CoolDown:         duration(30 * time.Second),
+			HalfOpenRequests: 2,
+		})
+
+		status = http.StatusServiceUnavailable
+		serve(breaker)
+		Expect(state()).To(Equal(float64(circuitOpen)))
+		Expect(breaker.clock.Add(30 * time.Second)).To(Succeed())
+
+		status = http.StatusOK
+		Expect(serve(breaker).Code).To(Equal(http.StatusOK))
+		Expect(state()).To(Equal(float64(circuitHalfOpen)))
+		Expect(serve(breaker).Code).To(Equal(http.StatusOK))
+		Expect(state()).To(Equal(float64(circuitClosed)))
+		Expect(serve(breaker).Code).To(Equal(http.StatusOK))
+	})
+
+	It("reopens when a trial request fails", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{
+			MinimumRequests: 1,
+			CoolDown:        duration(30 * time.Second),
+		})
+
+		status = http.StatusBadGateway
+		serve(breaker)
+		Expect(breaker.clock.Add(30 * time.Second)).To(Succeed())
+		Expect(serve(breaker).Code).To(Equal(http.StatusBadGateway))
+		Expect(state()).To(Equal(float64(circuitOpen)))
+
+		rejected := serve(breaker)
+		Expect(rejected.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rejected.Header().Get("Retry-After")).To(Equal("30"))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("only sends the trial requests while half-open", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{MinimumRequests: 1})
+
+		status = http.StatusBadGateway
+		serve(breaker)
+		Expect(breaker.clock.Add(options.DefaultCircuitBreakerCoolDown)).To(Succeed())
+
+		generation, ok := breaker.allow()
+		Expect(ok).To(BeTrue())
+		Expect(serve(breaker).Code).To(Equal(http.StatusServiceUnavailable))
+
+		breaker.done(generation, false)
+		Expect(state()).To(Equal(float64(circuitClosed)))
+	})
+
+	It("releases the trial of requests cancelled by the client", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{MinimumRequests: 1})
+
+		status = http.StatusBadGateway
+		serve(breaker)
+		Expect(breaker.clock.Add(options.DefaultCircuitBreakerCoolDown)).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("", "/", nil).WithContext(ctx)
+		breaker.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(state()).To(Equal(float64(circuitHalfOpen)))
+
+		status = http.StatusOK
+		Expect(serve(breaker).Code).To(Equal(http.StatusOK))
+		Expect(state()).To(Equal(float64(circuitClosed)))
+	})
+
+	It("ignores the results of requests sent before the circuit opened", func() {
+		breaker := newBreaker(options.UpstreamCircuitBreaker{MinimumRequests: 1})
+
+		generation, ok := breaker.allow()
+		Expect(ok).To(BeTrue())
+
+		status = http.StatusBadGateway
+		serve(breaker)
+		Expect(state()).To(Equal(float64(circuitOpen)))
+
+		breaker.done(generation, false)
+		Expect(state()).To(Equal(float64(circuitOpen)))
+	})
+})
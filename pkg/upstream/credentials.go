@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
+)
+
+// newUpstreamCredentials loads the credentials OAuth2 Proxy sends to the
+// upstream on its own behalf, independent of the user's identity.
+func newUpstreamCredentials(upstream options.Upstream) (http.Header, error) {
+	credentials := http.Header{}
+
+	if upstream.BasicAuthUser != "" {
+		if upstream.BasicAuthPassword == nil {
+			return nil, fmt.Errorf("basicAuthUser requires a basicAuthPassword")
+		}
+		password, err := util.GetSecretValue(upstream.BasicAuthPassword)
+		if err != nil {
+			return nil, fmt.Errorf("error loading basicAuthPassword: %v", err)
+		}
+		auth := upstream.BasicAuthUser + ":" + string(password)
+		credentials.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	for _, header := range upstream.CredentialHeaders {
+		// Reset the header so that credential headers replace basic auth
+		credentials.Del(header.Name)
+		for _, value := range header.Values {
+			if value.SecretSource == nil || value.ClaimSource != nil || value.TemplateSource != nil {
+				return nil, fmt.Errorf("credential header %q may only have secret values", header.Name)
+			}
+			secret, err := util.GetSecretValue(value.SecretSource)
+			if err != nil {
+				return nil, fmt.Errorf("error loading value for credential header %q: %v", header.Name, err)
+			}
+			credentials.Add(header.Name, string(secret))
+		}
+	}
+
+	return credentials, nil
+}
+
+// setProxyCredentials sets the proxy.Director so that upstream requests carry
+// the credentials, replacing any values of the headers from the client or
+// injected from the user's identity.
+// The credentials are only added to the outbound request, so they are never
+// seen by the other handlers or by other upstreams.
+func setProxyCredentials(proxy *httputil.ReverseProxy, credentials http.Header) {
+	if len(credentials) == 0 {
+		return
+	}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		for name, values := range credentials {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream Credentials Suite", func() {
+	var passwordFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "oauth2-proxy-upstream-password")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString("s3cr3t")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		passwordFile = f.Name()
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(passwordFile)).To(Succeed())
+	})
+
+	type credentialsTableInput struct {
+		upstream        func() options.Upstream
+		requestHeaders  http.Header
+		expectedHeaders http.Header
+		expectedErr     string
+	}
+
+	DescribeTable("proxying with upstream credentials",
+		func(in credentialsTableInput) {
+			upstream := in.upstream()
+			upstream.ID = "credentials"
+
+			u, err := url.Parse(serverAddr)
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, nil, nil)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Header = in.requestHeaders.Clone()
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+
+			request := testHTTPRequest{}
+			Expect(json.Unmarshal(rw.Body.Bytes(), &request)).To(Succeed())
+			for name, values := range in.expectedHeaders {
+				Expect(request.Header).To(HaveKeyWithValue(name, values))
+			}
+
+			// The credentials are only added to the outbound request
+			Expect(req.Header).To(Equal(in.requestHeaders))
+		},
+		Entry("with basic auth from a file, replacing the user's authorization", credentialsTableInput{
+			upstream: func() options.Upstream {
+				return options.Upstream{
+					URI:               serverAddr,
+					BasicAuthUser:     "proxy",
+					BasicAuthPassword: &options.SecretSource{FromFile: passwordFile},
+				}
+			},
+			requestHeaders: http.Header{
+				"Authorization": []string{"Bearer user-token"},
+			},
+			expectedHeaders: http.Header{
+				// proxy:s3cr3t
+				"Authorization": []string{"Basic cHJveHk6czNjcjN0"},
+			},
+		}),
+		Entry("with a credential header, replacing the client's value", credentialsTableInput{
+			upstream: func() options.Upstream {
+				return options.Upstream{
+					URI: serverAddr,
+					CredentialHeaders: []options.Header{
+						{
+							Name: "X-Api-Key",
+							Values: []options.HeaderValue{
+								{SecretSource: &options.SecretSource{FromFile: passwordFile}},
+							},
+						},
+					},
+				}
+			},
+			requestHeaders: http.Header{
+				"X-Api-Key":         []string{"spoofed"},
+				"X-Forwarded-Email": []string{"john.doe@example.com"},
+			},
+			expectedHeaders: http.Header{
+				"X-Api-Key":         []string{"s3cr3t"},
+				"X-Forwarded-Email": []string{"john.doe@example.com"},
+			},
+		}),
+		Entry("with a credential header replacing basic auth", credentialsTableInput{
+			upstream: func() options.Upstream {
+				return options.Upstream{
+					URI:               serverAddr,
+					BasicAuthUser:     "proxy",
+					BasicAuthPassword: &options.SecretSource{Value: []byte("s3cr3t")},
+					CredentialHeaders: []options.Header{
+						{
+							Name: "Authorization",
+							Values: []options.HeaderValue{
+								{SecretSource: &options.SecretSource{Value: []byte("ApiKey abc")}},
+							},
+						},
+					},
+				}
+			},
+			requestHeaders: http.Header{},
+			expectedHeaders: http.Header{
+				"Authorization": []string{"ApiKey abc"},
+			},
+		}),
+		Entry("with a credential header from a claim", credentialsTableInput{
+			upstream: func() options.Upstream {
+				return options.Upstream{
+					URI: serverAddr,
+					CredentialHeaders: []options.Header{
+						{
+							Name: "X-Api-Key",
+							Values: []options.HeaderValue{
+								{ClaimSource: &options.ClaimSource{Claim: "email"}},
+							},
+						},
+					},
+				}
+			},
+			expectedErr: "credential header \"X-Api-Key\" may only have secret values",
+		}),
+		Entry("with basic auth without a password", credentialsTableInput{
+			upstream: func() options.Upstream {
+				return options.Upstream{
+					URI:           serverAddr,
+					BasicAuthUser: "proxy",
+				}
+			},
+			expectedErr: "basicAuthUser requires a basicAuthPassword",
+		}),
+	)
+})
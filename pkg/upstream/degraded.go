@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// DegradedHeader is the request header set on requests proxied to upstreams
+// while the session store is unavailable
+const DegradedHeader = "X-Auth-Degraded"
+
+// newSessionStorePolicy wraps the handler so that requests served while the
+// session store is unavailable are handled according to the upstream's
+// session store unavailable policy, or the global policy if the upstream
+// doesn't override it.
+func newSessionStorePolicy(upstream options.Upstream, globalPolicy string, handler http.Handler, writer pagewriter.Writer, metrics *degradedMetrics) http.Handler {
+	policy := upstream.SessionStoreUnavailable
+	if policy == "" {
+		policy = globalPolicy
+	}
+	return &sessionStorePolicy{
+		upstream: upstream.ID,
+		policy:   policy,
+		handler:  handler,
+		writer:   writer,
+		metrics:  metrics,
+	}
+}
+
+// sessionStorePolicy applies the session store unavailable policy of an
+// upstream to degraded requests.
+type sessionStorePolicy struct {
+	upstream string
+	policy   string
+	handler  http.Handler
+	writer   pagewriter.Writer
+	metrics  *degradedMetrics
+}
+
+// ServeHTTP serves degraded requests anonymously or with their cached session,
+// or rejects them with a 503 response, as the policy dictates.
+// The DegradedHeader is removed from requests that aren't degraded so that it
+// can't be set by clients.
+func (p *sessionStorePolicy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req.Header.Del(DegradedHeader)
+
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || !scope.SessionDegraded {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	switch {
+	case p.policy == options.SessionStoreFailOpenAnonymous:
+		for _, header := range scope.IdentityHeaders {
+			req.Header.Del(header)
+		}
+		rw.Header().Del("GAP-Auth")
+	case p.policy == options.SessionStoreFailOpenCached && scope.Session != nil:
+		// The identity headers were injected from the cached session
+	default:
+		p.reject(rw, req, scope)
+		return
+	}
+
+	logger.Printf("Session store unavailable: serving degraded request to upstream %q (%s)", p.upstream, p.policy)
+	p.metrics.requests.WithLabelValues(p.upstream, p.policy).Inc()
+	req.Header.Set(DegradedHeader, "true")
+	p.handler.ServeHTTP(rw, req)
+}
+
+// reject responds with a 503 as the request can't be served without the
+// session store
+func (p *sessionStorePolicy) reject(rw http.ResponseWriter, req *http.Request, scope *middleware.RequestScope) {
+	logger.Errorf("Session store unavailable: rejected request to upstream %q (%s)", p.upstream, p.policy)
+	p.metrics.requests.WithLabelValues(p.upstream, degradedRejected).Inc()
+	p.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusServiceUnavailable,
+		RequestID: scope.RequestID,
+		AppError:  "the session store is unavailable",
+		Messages:  []interface{}{"Your session could not be loaded, please try again later."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
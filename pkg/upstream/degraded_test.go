@@ -0,0 +1,117 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Session Store Policy Suite", func() {
+	type sessionStorePolicyTableInput struct {
+		upstreamPolicy  string
+		globalPolicy    string
+		degraded        bool
+		session         *sessionsapi.SessionState
+		expectedCode    int
+		expectedHeaders http.Header
+		expectedOutcome string
+	}
+
+	DescribeTable("newSessionStorePolicy",
+		func(in sessionStorePolicyTableInput) {
+			metrics := newDegradedMetrics(prometheus.NewRegistry())
+			writer := &pagewriter.WriterFuncs{
+				ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+					rw.WriteHeader(opts.Status)
+				},
+			}
+
+			var upstreamHeaders http.Header
+			handler := newSessionStorePolicy(options.Upstream{
+				ID:                      "app",
+				SessionStoreUnavailable: in.upstreamPolicy,
+			}, in.globalPolicy, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				upstreamHeaders = req.Header
+				rw.WriteHeader(http.StatusOK)
+			}), writer, metrics)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(DegradedHeader, "true")
+			req.Header.Set("X-Forwarded-User", "spoofed")
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				Session:         in.session,
+				SessionDegraded: in.degraded,
+				IdentityHeaders: []string{"X-Forwarded-User"},
+			})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			if in.expectedCode == http.StatusOK {
+				for name := range in.expectedHeaders {
+					Expect(upstreamHeaders.Get(name)).To(Equal(in.expectedHeaders.Get(name)), name)
+				}
+			}
+			if in.expectedOutcome != "" {
+				Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("app", in.expectedOutcome))).To(Equal(1.0))
+			}
+		},
+		Entry("removes the degraded header from requests that aren't degraded", sessionStorePolicyTableInput{
+			globalPolicy: options.SessionStoreFailOpenAnonymous,
+			expectedCode: http.StatusOK,
+			expectedHeaders: http.Header{
+				DegradedHeader:     []string{""},
+				"X-Forwarded-User": []string{"spoofed"},
+			},
+		}),
+		Entry("rejects degraded requests when failing closed", sessionStorePolicyTableInput{
+			globalPolicy:    options.SessionStoreFailClosed,
+			degraded:        true,
+			session:         &sessionsapi.SessionState{User: "cached"},
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedOutcome: degradedRejected,
+		}),
+		Entry("serves degraded requests anonymously", sessionStorePolicyTableInput{
+			globalPolicy: options.SessionStoreFailOpenAnonymous,
+			degraded:     true,
+			expectedCode: http.StatusOK,
+			expectedHeaders: http.Header{
+				DegradedHeader:     []string{"true"},
+				"X-Forwarded-User": []string{""},
+			},
+			expectedOutcome: options.SessionStoreFailOpenAnonymous,
+		}),
+		Entry("serves degraded requests with their cached session", sessionStorePolicyTableInput{
+			globalPolicy: options.SessionStoreFailOpenCached,
+			degraded:     true,
+			session:      &sessionsapi.SessionState{User: "cached"},
+			expectedCode: http.StatusOK,
+			expectedHeaders: http.Header{
+				DegradedHeader: []string{"true"},
+			},
+			expectedOutcome: options.SessionStoreFailOpenCached,
+		}),
+		Entry("rejects degraded requests without a cached session", sessionStorePolicyTableInput{
+			globalPolicy:    options.SessionStoreFailOpenCached,
+			degraded:        true,
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedOutcome: degradedRejected,
+		}),
+		Entry("applies the upstream policy over the global policy", sessionStorePolicyTableInput{
+			upstreamPolicy:  options.SessionStoreFailClosed,
+			globalPolicy:    options.SessionStoreFailOpenAnonymous,
+			degraded:        true,
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedOutcome: degradedRejected,
+		}),
+	)
+})
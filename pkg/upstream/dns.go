@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// dnsBalancer periodically re-resolves the hostname of an upstream server and
+// dials new connections to each of its addresses in turn, rather than to the
+// address the standard resolver happens to return first.
+// Connections to addresses that disappear are closed once idle, so that
+// traffic moves to the new addresses after the members of the hostname change.
+// Transports can only close all of their idle connections, so idle
+// connections to the remaining addresses are closed with them, and dialed
+// again across the new addresses.
+type dnsBalancer struct {
+	upstream string
+	host     string
+	interval time.Duration
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	metrics  *dnsMetrics
+
+	mu    sync.Mutex
+	addrs []string
+	conns map[string]map[*balancedConn]struct{}
+
+	next uint32
+
+	// stopped is closed by stop
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newDNSBalancer resolves the hostname of the upstream, and starts
+// re-resolving it at the upstream's DNSRefreshInterval.
+func newDNSBalancer(upstream options.Upstream, host string, metrics *dnsMetrics) *dnsBalancer {
+	b := &dnsBalancer{
+		upstream: upstream.ID,
+		host:     host,
+		interval: upstream.DNSRefreshInterval.Duration(),
+		lookup:   net.DefaultResolver.LookupIPAddr,
+		dial:     newUpstreamDialer(upstream).DialContext,
+		metrics:  metrics,
+		conns:    make(map[string]map[*balancedConn]struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b.refresh(context.Background())
+	go b.run()
+	return b
+}
+
+// attach configures the transport to dial connections through the balancer
+func (b *dnsBalancer) attach(transport *http.Transport) {
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return b.dialContext(ctx, transport, network, address)
+	}
+}
+
+// run re-resolves the hostname at the interval, until the balancer is
+// stopped
+func (b *dnsBalancer) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopped:
+			return
+		case <-ticker.C:
+			b.refresh(context.Background())
+		}
+	}
+}
+
+// stop stops re-resolving the hostname, once the upstream has been replaced
+// by a reload
+func (b *dnsBalancer) stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopped)
+	})
+}
+
+// refresh resolves the hostname, and updates the addresses connections are
+// dialed to when they have changed.
+// The previous addresses are kept when the hostname can't be resolved.
+// Idle connections are closed while there are connections to addresses that
+// are no longer resolved, as those in use when their address was removed
+// only become idle later.
+func (b *dnsBalancer) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, b.interval)
+	defer cancel()
+
+	ipAddrs, err := b.lookup(ctx, b.host)
+	if err == nil && len(ipAddrs) > 0 {
+		addrs := make([]string, 0, len(ipAddrs))
+		for _, ipAddr := range ipAddrs {
+			addrs = append(addrs, ipAddr.String())
+		}
+		sort.Strings(addrs)
+		b.update(addrs)
+	} else {
+		logger.Errorf("Error resolving %q for upstream %q, keeping the previous addresses: %v", b.host, b.upstream, err)
+	}
+
+	for _, transport := range b.staleTransports() {
+		transport.CloseIdleConnections()
+	}
+}
+
+// update replaces the addresses, logging the change
+func (b *dnsBalancer) update(addrs []string) {
+	b.mu.Lock()
+	added, removed := diffAddrs(b.addrs, addrs)
+	b.addrs = addrs
+	b.mu.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	logger.Printf("upstream %q: addresses of %q changed to %v (added %v, removed %v)", b.upstream, b.host, addrs, added, removed)
+	b.metrics.addresses.WithLabelValues(b.upstream).Set(float64(len(addrs)))
+}
+
+// staleTransports returns the transports with connections to addresses that
+// are no longer resolved
+func (b *dnsBalancer) staleTransports() []*http.Transport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stale := map[*http.Transport]struct{}{}
+	for addr, conns := range b.conns {
+		if containsAddr(b.addrs, addr) {
+			continue
+		}
+		for conn := range conns {
+			stale[conn.transport] = struct{}{}
+		}
+	}
+
+	transports := make([]*http.Transport, 0, len(stale))
+	for transport := range stale {
+		transports = append(transports, transport)
+	}
+	return transports
+}
+
+// dialContext dials connections to the hostname for the transport to each of
+// its resolved addresses in turn, trying the next address when the dial fails.
+// Other hosts, and the hostname before it has been resolved, are dialed with
+// the standard resolver.
+func (b *dnsBalancer) dialContext(ctx context.Context, transport *http.Transport, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	addrs := b.addrs
+	b.mu.Unlock()
+	if host != b.host || len(addrs) == 0 {
+		return b.dial(ctx, network, address)
+	}
+
+	start := int(atomic.AddUint32(&b.next, 1) - 1)
+	for i := range addrs {
+		addr := addrs[(start+i)%len(addrs)]
+		var conn net.Conn
+		conn, err = b.dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return b.track(transport, addr, conn), nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// track records the connection to the address, so that the idle connections
+// of its transport can be closed once the address is no longer resolved
+func (b *dnsBalancer) track(transport *http.Transport, addr string, conn net.Conn) net.Conn {
+	bc := &balancedConn{Conn: conn, transport: transport}
+	bc.onClose = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.conns[addr], bc)
+		if len(b.conns[addr]) == 0 {
+			delete(b.conns, addr)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns[addr] == nil {
+		b.conns[addr] = make(map[*balancedConn]struct{})
+	}
+	b.conns[addr][bc] = struct{}{}
+	return bc
+}
+
+// balancedConn is a connection dialed by the dnsBalancer for a transport,
+// which stops being tracked once it is closed
+type balancedConn struct {
+	net.Conn
+	transport *http.Transport
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (c *balancedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// diffAddrs returns the addresses that were added to and removed from the
+// sorted previous addresses
+func diffAddrs(previous, current []string) (added, removed []string) {
+	for _, addr := range current {
+		if !containsAddr(previous, addr) {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range previous {
+		if !containsAddr(current, addr) {
+			removed = append(removed, addr)
+		}
+	}
+	return added, removed
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	i := sort.SearchStrings(addrs, addr)
+	return i < len(addrs) && addrs[i] == addr
+}
@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("DNS Balancer Suite", func() {
+	var balancer *dnsBalancer
+	var metrics *dnsMetrics
+	var server *httptest.Server
+
+	var mu sync.Mutex
+	var resolved []net.IPAddr
+	var resolveErr error
+	var dialed []string
+
+	setResolved := func(ips ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		resolved = nil
+		for _, ip := range ips {
+			resolved = append(resolved, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+	}
+
+	getDialed := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, dialed...)
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+		metrics = newDNSMetrics(prometheus.NewRegistry())
+
+		mu.Lock()
+		resolveErr = nil
+		dialed = nil
+		mu.Unlock()
+		setResolved("10.0.0.2", "10.0.0.1")
+
+		balancer = &dnsBalancer{
+			upstream: "app",
+			host:     "app.default.svc.cluster.local",
+			interval: time.Minute,
+			lookup: func(_ context.Context, host string) ([]net.IPAddr, error) {
+				Expect(host).To(Equal("app.default.svc.cluster.local"))
+				mu.Lock()
+				defer mu.Unlock()
+				return resolved, resolveErr
+			},
+			// Every address is served by the test server
+			dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				mu.Lock()
+				dialed = append(dialed, address)
+				mu.Unlock()
+				if address == "10.0.0.3:8080" {
+					return nil, errors.New("connection refused")
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+			metrics: metrics,
+			conns:   make(map[string]map[*balancedConn]struct{}),
+		}
+		balancer.refresh(context.Background())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("records the resolved addresses", func() {
+		Expect(balancer.addrs).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		Expect(testutil.ToFloat64(metrics.addresses.WithLabelValues("app"))).To(Equal(2.0))
+	})
+
+	It("keeps the previous addresses when the hostname can't be resolved", func() {
+		mu.Lock()
+		resolveErr = errors.New("no such host")
+		mu.Unlock()
+		balancer.refresh(context.Background())
+		Expect(balancer.addrs).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+
+		setResolved()
+		mu.Lock()
+		resolveErr = nil
+		mu.Unlock()
+		balancer.refresh(context.Background())
+		Expect(balancer.addrs).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+	})
+
+	It("spreads connections across the addresses", func() {
+		for i := 0; i < 4; i++ {
+			conn, err := balancer.dialContext(context.Background(), &http.Transport{}, "tcp", "app.default.svc.cluster.local:8080")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+		}
+		Expect(getDialed()).To(Equal([]string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "10.0.0.2:8080"}))
+		Expect(balancer.conns).To(BeEmpty())
+	})
+
+	It("tries the next address when a dial fails", func() {
+		setResolved("10.0.0.2", "10.0.0.3")
+		balancer.refresh(context.Background())
+
+		for i := 0; i < 2; i++ {
+			conn, err := balancer.dialContext(context.Background(), &http.Transport{}, "tcp", "app.default.svc.cluster.local:8080")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+		}
+		Expect(getDialed()).To(Equal([]string{"10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.2:8080"}))
+	})
+
+	It("dials other hosts with the standard resolver", func() {
+		conn, err := balancer.dialContext(context.Background(), &http.Transport{}, "tcp", "other.example.com:8080")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+		Expect(getDialed()).To(Equal([]string{"other.example.com:8080"}))
+	})
+
+	It("closes idle connections to addresses that are no longer resolved", func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		balancer.attach(transport)
+		client := &http.Client{Transport: transport}
+
+		get := func() {
+			resp, err := client.Get("http://app.default.svc.cluster.local:8080/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+		}
+
+		// The idle connection is reused while its address is resolved
+		get()
+		get()
+		Expect(getDialed()).To(Equal([]string{"10.0.0.1:8080"}))
+		balancer.refresh(context.Background())
+		get()
+		Expect(getDialed()).To(Equal([]string{"10.0.0.1:8080"}))
+
+		setResolved("10.0.0.2", "10.0.0.4")
+		balancer.refresh(context.Background())
+		Expect(testutil.ToFloat64(metrics.addresses.WithLabelValues("app"))).To(Equal(2.0))
+		Eventually(func() int {
+			balancer.mu.Lock()
+			defer balancer.mu.Unlock()
+			return len(balancer.conns)
+		}).Should(Equal(0))
+
+		get()
+		Expect(getDialed()).To(Equal([]string{"10.0.0.1:8080", "10.0.0.4:8080"}))
+	})
+})
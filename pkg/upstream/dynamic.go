@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// DynamicRouter is implemented by the proxy created by NewProxy, so that
+// upstreams can be registered and removed while it serves requests.
+type DynamicRouter interface {
+	// SetDynamicUpstreams replaces the dynamic upstreams, which are matched
+	// before the upstreams the proxy was created with.
+	// The upstreams that can't be registered are returned with their error
+	// by ID, all the others are registered.
+	SetDynamicUpstreams(upstreams []options.Upstream) map[string]error
+}
+
+// SetDynamicUpstreams registers the dynamic upstreams with a new serveMux,
+// which then atomically replaces the serveMux of the previous dynamic
+// upstreams. Requests already being served by the previous upstreams aren't
+// interrupted: they are drained in the background before the idle
+// connections of the previous upstreams are closed. The upstreams the proxy
+// was created with are never changed.
+func (m *multiUpstreamProxy) SetDynamicUpstreams(upstreams []options.Upstream) map[string]error {
+	dynamic := m.newChildProxy(m.proxyRawPath)
+
+	errs := map[string]error{}
+	sorted := sortByPathLongest(append([]options.Upstream{}, upstreams...))
+	for _, upstream := range sorted {
+		if err := dynamic.register(upstream, sorted, m.sigData, m.writer); err != nil {
+			errs[upstream.ID] = err
+		}
+	}
+
+	registerTrailingSlashHandler(dynamic.serveMux)
+	previous, _ := m.dynamic.Swap(dynamic).(*multiUpstreamProxy)
+	if previous != nil {
+		go previous.drain()
+	}
+	return errs
+}
+
+// loadDynamic returns the proxy of the dynamic upstreams, or nil if they
+// haven't been set
+func (m *multiUpstreamProxy) loadDynamic() *multiUpstreamProxy {
+	dynamic, _ := m.dynamic.Load().(*multiUpstreamProxy)
+	return dynamic
+}
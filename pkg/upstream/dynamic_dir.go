@@ -0,0 +1,249 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DynamicUpstreamRegistered is the state of the dynamic upstreams
+	// serving requests
+	DynamicUpstreamRegistered = "registered"
+
+	// DynamicUpstreamRejected is the state of the files that couldn't be
+	// registered, they are retried when they change
+	DynamicUpstreamRejected = "rejected"
+
+	// DynamicUpstreamExpired is the state of the dynamic upstreams removed
+	// after their TTL, they are registered again when their file is modified
+	DynamicUpstreamExpired = "expired"
+)
+
+// DynamicUpstreamValidator validates a dynamic upstream before it is
+// registered. The upstreams accepted before it, from the files sorted by
+// name, are given so that their IDs and paths aren't reused.
+type DynamicUpstreamValidator func(upstream options.DynamicUpstream, accepted []options.Upstream) error
+
+// DynamicUpstreamEntry is the state of a file of the dynamic upstreams
+// directory
+type DynamicUpstreamEntry struct {
+	File     string     `json:"file"`
+	State    string     `json:"state"`
+	ID       string     `json:"id,omitempty"`
+	Path     string     `json:"path,omitempty"`
+	URI      string     `json:"uri,omitempty"`
+	Modified time.Time  `json:"modified"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// DynamicUpstreamsDir registers the upstreams defined by the JSON files of
+// a directory with a DynamicRouter, reloading them all whenever a file
+// changes and removing them once their TTL has passed.
+type DynamicUpstreamsDir struct {
+	dir        string
+	defaultTTL time.Duration
+	router     DynamicRouter
+	validate   DynamicUpstreamValidator
+	metrics    *dynamicMetrics
+	clock      clock.Clock
+
+	mutex   sync.Mutex
+	entries []DynamicUpstreamEntry
+	timer   *time.Timer
+}
+
+// NewDynamicUpstreamsDir creates a DynamicUpstreamsDir for the dynamic
+// upstreams options. The upstreams aren't registered until Load is called.
+func NewDynamicUpstreamsDir(opts options.DynamicUpstreams, router DynamicRouter, validate DynamicUpstreamValidator, registerer prometheus.Registerer) *DynamicUpstreamsDir {
+	return &DynamicUpstreamsDir{
+		dir:        opts.Dir,
+		defaultTTL: opts.DefaultTTL,
+		router:     router,
+		validate:   validate,
+		metrics:    newDynamicMetrics(registerer),
+	}
+}
+
+// Watch loads the upstreams of the directory, and then reloads them every
+// time a JSON file of the directory changes, until done is closed.
+func (d *DynamicUpstreamsDir) Watch(done <-chan bool) error {
+	if err := d.Load(); err != nil {
+		return err
+	}
+	return watcher.WatchDirForUpdates(d.dir, ".json", done, func() {
+		if err := d.Load(); err != nil {
+			logger.Errorf("error loading dynamic upstreams: %v", err)
+		}
+	})
+}
+
+// Load reads the JSON files of the directory and replaces the dynamic
+// upstreams of the router with those that are valid and haven't expired.
+// Files that can't be registered are logged and skipped, they never prevent
+// the other upstreams from being registered.
+func (d *DynamicUpstreamsDir) Load() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("could not list dynamic upstreams: %v", err)
+	}
+	sort.Strings(files)
+
+	now := d.clock.Now()
+	entries := []DynamicUpstreamEntry{}
+	accepted := []options.Upstream{}
+	var next *time.Time
+	for _, file := range files {
+		entry, upstream := d.loadFile(file, now)
+		if entry.State == DynamicUpstreamRegistered {
+			if err := d.validate(upstream, accepted); err != nil {
+				entry.State = DynamicUpstreamRejected
+				entry.Error = err.Error()
+			} else {
+				accepted = append(accepted, upstream.Upstream)
+				if entry.Expires != nil && (next == nil || entry.Expires.Before(*next)) {
+					next = entry.Expires
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	errs := d.router.SetDynamicUpstreams(accepted)
+	for i, entry := range entries {
+		if err, ok := errs[entry.ID]; ok && entry.State == DynamicUpstreamRegistered {
+			entries[i].State = DynamicUpstreamRejected
+			entries[i].Error = err.Error()
+		}
+	}
+	d.logChanges(entries)
+	d.entries = entries
+	d.updateMetrics()
+	d.scheduleExpiry(next, now)
+	return nil
+}
+
+// loadFile parses the dynamic upstream of a file, and returns its entry in
+// the registered state unless it couldn't be parsed or has expired
+func (d *DynamicUpstreamsDir) loadFile(file string, now time.Time) (DynamicUpstreamEntry, options.DynamicUpstream) {
+	entry := DynamicUpstreamEntry{
+		File:  filepath.Base(file),
+		State: DynamicUpstreamRejected,
+	}
+	upstream := options.DynamicUpstream{}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry, upstream
+	}
+	entry.Modified = info.ModTime()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry, upstream
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&upstream); err != nil {
+		entry.Error = fmt.Sprintf("invalid JSON: %v", err)
+		return entry, upstream
+	}
+	entry.ID = upstream.ID
+	entry.Path = upstream.Path
+	entry.URI = upstream.URI
+
+	ttl := d.defaultTTL
+	if upstream.TTL != nil {
+		ttl = upstream.TTL.Duration()
+	}
+	if ttl > 0 {
+		expires := entry.Modified.Add(ttl)
+		entry.Expires = &expires
+		if !now.Before(expires) {
+			entry.State = DynamicUpstreamExpired
+			return entry, upstream
+		}
+	}
+
+	entry.State = DynamicUpstreamRegistered
+	return entry, upstream
+}
+
+// logChanges logs the files whose state differs from the previous load
+func (d *DynamicUpstreamsDir) logChanges(entries []DynamicUpstreamEntry) {
+	previous := map[string]DynamicUpstreamEntry{}
+	for _, entry := range d.entries {
+		previous[entry.File] = entry
+	}
+	for _, entry := range entries {
+		if prev, ok := previous[entry.File]; ok && prev.State == entry.State && prev.Error == entry.Error && prev.Modified.Equal(entry.Modified) {
+			continue
+		}
+		switch entry.State {
+		case DynamicUpstreamRegistered:
+			logger.Printf("Registered dynamic upstream %q from %s for path %q", entry.ID, entry.File, entry.Path)
+		case DynamicUpstreamExpired:
+			logger.Printf("Dynamic upstream %q from %s has expired", entry.ID, entry.File)
+		default:
+			logger.Errorf("Rejected dynamic upstream from %s: %s", entry.File, entry.Error)
+		}
+	}
+}
+
+// updateMetrics counts the entries by state
+func (d *DynamicUpstreamsDir) updateMetrics() {
+	counts := map[string]int{
+		DynamicUpstreamRegistered: 0,
+		DynamicUpstreamRejected:   0,
+		DynamicUpstreamExpired:    0,
+	}
+	for _, entry := range d.entries {
+		counts[entry.State]++
+	}
+	for state, count := range counts {
+		d.metrics.upstreams.WithLabelValues(state).Set(float64(count))
+	}
+}
+
+// scheduleExpiry reloads the upstreams when the next registered upstream
+// expires, replacing any previously scheduled reload
+func (d *DynamicUpstreamsDir) scheduleExpiry(next *time.Time, now time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if next == nil {
+		return
+	}
+	d.timer = time.AfterFunc(next.Sub(now), func() {
+		if err := d.Load(); err != nil {
+			logger.Errorf("error removing expired dynamic upstreams: %v", err)
+		}
+	})
+}
+
+// Entries returns the state of the files of the directory as of the last
+// load, sorted by file name
+func (d *DynamicUpstreamsDir) Entries() []DynamicUpstreamEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]DynamicUpstreamEntry{}, d.entries...)
+}
@@ -0,0 +1,189 @@
+package upstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDynamicRouter records the upstreams it is given
+type fakeDynamicRouter struct {
+	upstreams []options.Upstream
+	errs      map[string]error
+}
+
+func (f *fakeDynamicRouter) SetDynamicUpstreams(upstreams []options.Upstream) map[string]error {
+	f.upstreams = upstreams
+	return f.errs
+}
+
+var _ = Describe("Dynamic Upstreams Directory Suite", func() {
+	var dir string
+	var router *fakeDynamicRouter
+	var registry *prometheus.Registry
+	var dynamicDir *DynamicUpstreamsDir
+	var defaultTTL time.Duration
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dynamic-upstreams")
+		Expect(err).ToNot(HaveOccurred())
+		router = &fakeDynamicRouter{}
+		registry = prometheus.NewRegistry()
+		defaultTTL = 0
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	newDynamicDir := func() {
+		validate := func(upstream options.DynamicUpstream, accepted []options.Upstream) error {
+			for _, existing := range accepted {
+				if existing.Path == upstream.Path {
+					return errors.New("duplicate path")
+				}
+			}
+			return nil
+		}
+		dynamicDir = NewDynamicUpstreamsDir(options.DynamicUpstreams{
+			Dir:        dir,
+			DefaultTTL: defaultTTL,
+		}, router, validate, registry)
+	}
+
+	writeFile := func(name, content string, modified time.Time) {
+		file := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(Succeed())
+		Expect(os.Chtimes(file, modified, modified)).To(Succeed())
+	}
+
+	states := func() map[string]string {
+		result := map[string]string{}
+		for _, entry := range dynamicDir.Entries() {
+			result[entry.File] = entry.State
+		}
+		return result
+	}
+
+	count := func(state string) float64 {
+		return testutil.ToFloat64(dynamicDir.metrics.upstreams.WithLabelValues(state))
+	}
+
+	It("registers the valid upstreams of the JSON files", func() {
+		now := time.Now()
+		writeFile("pr-1.json", `{"id": "pr-1", "path": "/pr-1/", "uri": "http://pr-1.preview:8080"}`, now)
+		writeFile("pr-2.json", `{"id": "pr-2", "path": "/pr-2/", "uri": "http://pr-2.preview:8080", "ttl": "1h"}`, now)
+		writeFile("notes.txt", `not an upstream`, now)
+		newDynamicDir()
+
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(router.upstreams).To(HaveLen(2))
+		Expect(router.upstreams[0].ID).To(Equal("pr-1"))
+		Expect(router.upstreams[1].ID).To(Equal("pr-2"))
+		Expect(states()).To(Equal(map[string]string{
+			"pr-1.json": DynamicUpstreamRegistered,
+			"pr-2.json": DynamicUpstreamRegistered,
+		}))
+
+		entries := dynamicDir.Entries()
+		Expect(entries[0].Expires).To(BeNil())
+		Expect(entries[1].Expires).ToNot(BeNil())
+		Expect(entries[1].Expires.Sub(entries[1].Modified)).To(Equal(time.Hour))
+		Expect(count(DynamicUpstreamRegistered)).To(Equal(float64(2)))
+	})
+
+	It("rejects invalid files without affecting the others", func() {
+		now := time.Now()
+		writeFile("a.json", `{"id": "a", "path": "/preview/", "uri": "http://a.preview:8080"}`, now)
+		writeFile("b.json", `{"id": "b", "path": "/preview/", "uri": "http://b.preview:8080"}`, now)
+		writeFile("c.json", `{"id": "c", "path": "/c/", "uri": "http://c.preview:8080", "unknown": true}`, now)
+		writeFile("d.json", `{"id": "d",`, now)
+		writeFile("e.json", `{"id": "e", "path": "/e/", "uri": "http://e.preview:8080"}`, now)
+		newDynamicDir()
+
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(router.upstreams).To(HaveLen(2))
+		Expect(states()).To(Equal(map[string]string{
+			"a.json": DynamicUpstreamRegistered,
+			"b.json": DynamicUpstreamRejected,
+			"c.json": DynamicUpstreamRejected,
+			"d.json": DynamicUpstreamRejected,
+			"e.json": DynamicUpstreamRegistered,
+		}))
+		Expect(dynamicDir.Entries()[1].Error).To(Equal("duplicate path"))
+		Expect(count(DynamicUpstreamRejected)).To(Equal(float64(3)))
+	})
+
+	It("rejects the upstreams the router can't register", func() {
+		writeFile("a.json", `{"id": "a", "path": "/a/", "uri": "http://a.preview:8080"}`, time.Now())
+		router.errs = map[string]error{"a": errors.New("could not register")}
+		newDynamicDir()
+
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(dynamicDir.Entries()[0].State).To(Equal(DynamicUpstreamRejected))
+		Expect(dynamicDir.Entries()[0].Error).To(Equal("could not register"))
+	})
+
+	It("removes the upstreams once their TTL has passed since their file was modified", func() {
+		now := time.Now()
+		defaultTTL = time.Hour
+		writeFile("old.json", `{"id": "old", "path": "/old/", "uri": "http://old.preview:8080"}`, now.Add(-2*time.Hour))
+		writeFile("long.json", `{"id": "long", "path": "/long/", "uri": "http://long.preview:8080", "ttl": "3h"}`, now.Add(-2*time.Hour))
+		writeFile("new.json", `{"id": "new", "path": "/new/", "uri": "http://new.preview:8080"}`, now)
+		writeFile("forever.json", `{"id": "forever", "path": "/forever/", "uri": "http://forever.preview:8080", "ttl": "0s"}`, now.Add(-24*time.Hour))
+		newDynamicDir()
+
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(states()).To(Equal(map[string]string{
+			"forever.json": DynamicUpstreamRegistered,
+			"long.json":    DynamicUpstreamRegistered,
+			"new.json":     DynamicUpstreamRegistered,
+			"old.json":     DynamicUpstreamExpired,
+		}))
+		Expect(count(DynamicUpstreamExpired)).To(Equal(float64(1)))
+
+		dynamicDir.clock.Set(now.Add(90 * time.Minute))
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(states()).To(Equal(map[string]string{
+			"forever.json": DynamicUpstreamRegistered,
+			"long.json":    DynamicUpstreamExpired,
+			"new.json":     DynamicUpstreamExpired,
+			"old.json":     DynamicUpstreamExpired,
+		}))
+		Expect(router.upstreams).To(HaveLen(1))
+	})
+
+	It("registers expired upstreams again when their file is modified", func() {
+		defaultTTL = time.Hour
+		writeFile("pr-1.json", `{"id": "pr-1", "path": "/pr-1/", "uri": "http://pr-1.preview:8080"}`, time.Now().Add(-2*time.Hour))
+		newDynamicDir()
+
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(states()["pr-1.json"]).To(Equal(DynamicUpstreamExpired))
+
+		writeFile("pr-1.json", `{"id": "pr-1", "path": "/pr-1/", "uri": "http://pr-1.preview:8080"}`, time.Now())
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(states()["pr-1.json"]).To(Equal(DynamicUpstreamRegistered))
+	})
+
+	It("removes the upstreams of removed files", func() {
+		writeFile("pr-1.json", `{"id": "pr-1", "path": "/pr-1/", "uri": "http://pr-1.preview:8080"}`, time.Now())
+		newDynamicDir()
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(router.upstreams).To(HaveLen(1))
+
+		Expect(os.Remove(filepath.Join(dir, "pr-1.json"))).To(Succeed())
+		Expect(dynamicDir.Load()).To(Succeed())
+		Expect(router.upstreams).To(BeEmpty())
+		Expect(dynamicDir.Entries()).To(BeEmpty())
+	})
+})
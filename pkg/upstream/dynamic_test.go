@@ -0,0 +1,100 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dynamic Router Suite", func() {
+	var proxy http.Handler
+
+	staticUpstream := func(id, path string, code int) options.Upstream {
+		return options.Upstream{
+			ID:         id,
+			Path:       path,
+			Static:     true,
+			StaticCode: &code,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		proxy, err = NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				staticUpstream("app", "/", http.StatusOK),
+				staticUpstream("api", "/api/", http.StatusAccepted),
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	serve := func(path string) int {
+		rw := httptest.NewRecorder()
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, path, nil), &middlewareapi.RequestScope{})
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	It("routes to the dynamic upstreams before the configured upstreams", func() {
+		errs := proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+			staticUpstream("preview-2", "/preview-2/", http.StatusNoContent),
+		})
+		Expect(errs).To(BeEmpty())
+
+		Expect(serve("/preview-1/page")).To(Equal(http.StatusCreated))
+		Expect(serve("/preview-2/")).To(Equal(http.StatusNoContent))
+		Expect(serve("/api/users")).To(Equal(http.StatusAccepted))
+		Expect(serve("/other")).To(Equal(http.StatusOK))
+	})
+
+	It("redirects the dynamic upstream paths without a trailing slash", func() {
+		proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+		})
+		Expect(serve("/preview-1")).To(Equal(http.StatusMovedPermanently))
+	})
+
+	It("replaces the previous dynamic upstreams", func() {
+		router := proxy.(DynamicRouter)
+		router.SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+		})
+		router.SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-2", "/preview-2/", http.StatusNoContent),
+		})
+
+		Expect(serve("/preview-1/page")).To(Equal(http.StatusOK))
+		Expect(serve("/preview-2/page")).To(Equal(http.StatusNoContent))
+	})
+
+	It("registers the other upstreams when one can't be registered", func() {
+		errs := proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			{ID: "broken", Path: "/broken/", URI: "ftp://broken.internal"},
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+		})
+		Expect(errs).To(HaveLen(1))
+		Expect(errs).To(HaveKey("broken"))
+
+		Expect(serve("/preview-1/page")).To(Equal(http.StatusCreated))
+		Expect(serve("/broken/page")).To(Equal(http.StatusOK))
+	})
+
+	It("lists and matches the dynamic routes", func() {
+		proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+		})
+
+		routes := proxy.(RouteTable)
+		Expect(routes.Routes()[0].ID).To(Equal("preview-1"))
+		match := routes.MatchRoute(http.MethodGet, "/preview-1/page")
+		Expect(match.Route).ToNot(BeNil())
+		Expect(match.Route.ID).To(Equal("preview-1"))
+	})
+})
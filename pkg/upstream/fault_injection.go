@@ -0,0 +1,137 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// The faults injected into the requests to upstreams
+const (
+	faultDelay = "delay"
+	faultAbort = "abort"
+)
+
+// faultInjector delays, or aborts, a sample of the requests of an experiment
+// to an upstream
+type faultInjector struct {
+	upstream    string
+	header      string
+	groups      []string
+	percent     int
+	delay       time.Duration
+	abortStatus int
+
+	handler http.Handler
+	writer  pagewriter.Writer
+	metrics *faultMetrics
+
+	// sample decides whether a fault is injected into a request
+	sample func() bool
+}
+
+// newFaultInjector wraps the handler so that the faults of the upstream's
+// FaultInjection are injected into the requests of its experiment.
+func newFaultInjector(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer, metrics *faultMetrics) *faultInjector {
+	opts := upstream.FaultInjection
+
+	var delay time.Duration
+	if opts.Delay != nil {
+		delay = opts.Delay.Duration()
+	}
+
+	f := &faultInjector{
+		upstream:    upstream.ID,
+		header:      opts.Header,
+		groups:      opts.Groups,
+		percent:     opts.Percent,
+		delay:       delay,
+		abortStatus: opts.AbortStatusCode,
+		handler:     handler,
+		writer:      writer,
+		metrics:     metrics,
+	}
+	f.sample = func() bool {
+		/* #nosec G404 */
+		return rand.Intn(100) < f.percent
+	}
+	return f
+}
+
+// ServeHTTP injects the faults into the sampled requests of the experiment,
+// and serves the other requests as they are.
+func (f *faultInjector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !f.inExperiment(req) || !f.sample() {
+		f.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if f.delay > 0 {
+		f.metrics.injected.WithLabelValues(f.upstream, faultDelay).Inc()
+		logger.DebugfContext(req.Context(), "Delaying request to upstream %q by %s with a fault injection", f.upstream, f.delay)
+		if !f.wait(req) {
+			// The client is gone, there is no one to respond to
+			return
+		}
+	}
+
+	if f.abortStatus != 0 {
+		f.metrics.injected.WithLabelValues(f.upstream, faultAbort).Inc()
+		logger.DebugfContext(req.Context(), "Aborting request to upstream %q with %d with a fault injection", f.upstream, f.abortStatus)
+		f.abort(rw, req)
+		return
+	}
+	f.handler.ServeHTTP(rw, req)
+}
+
+// inExperiment checks whether the request carries the header of the
+// experiment, and has a session in one of its groups, when they are set
+func (f *faultInjector) inExperiment(req *http.Request) bool {
+	if f.header != "" && req.Header.Get(f.header) == "" {
+		return false
+	}
+	if len(f.groups) == 0 {
+		return true
+	}
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		return false
+	}
+	return containsAny(f.groups, scope.Session.Groups)
+}
+
+// wait holds the request for the delay, returning false if the request is
+// cancelled first
+func (f *faultInjector) wait(req *http.Request) bool {
+	timer := time.NewTimer(f.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// abort answers the request with the error page of the abort status, without
+// sending it to the upstream
+func (f *faultInjector) abort(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = f.upstream
+
+	f.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    f.abortStatus,
+		RequestID: scope.RequestID,
+		AppError:  fmt.Sprintf("fault injected into upstream %s", f.upstream),
+		Messages:  []interface{}{"The request was aborted by a fault injection experiment."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Fault Injection Suite", func() {
+	var metrics *faultMetrics
+	var writer *pagewriter.WriterFuncs
+	var requests int
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		requests++
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	BeforeEach(func() {
+		metrics = newFaultMetrics(prometheus.NewRegistry())
+		writer = &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				rw.WriteHeader(opts.Status)
+			},
+		}
+		requests = 0
+	})
+
+	duration := func(d time.Duration) *options.Duration {
+		o := options.Duration(d)
+		return &o
+	}
+
+	newInjector := func(opts options.UpstreamFaultInjection) *faultInjector {
+		return newFaultInjector(options.Upstream{
+			ID:             "chaos",
+			FaultInjection: &opts,
+		}, handler, writer, metrics)
+	}
+
+	serve := func(injector http.Handler, req *http.Request, session *sessionsapi.SessionState) *httptest.ResponseRecorder {
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		injector.ServeHTTP(rw, req)
+		return rw
+	}
+
+	injected := func(fault string) float64 {
+		return testutil.ToFloat64(metrics.injected.WithLabelValues("chaos", fault))
+	}
+
+	It("aborts the requests carrying the header of the experiment", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Header:          "X-Chaos-Experiment",
+			Percent:         100,
+			AbortStatusCode: http.StatusServiceUnavailable,
+		})
+
+		req := httptest.NewRequest("", "/", nil)
+		req.Header.Set("X-Chaos-Experiment", "outage")
+		Expect(serve(injector, req, nil).Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(requests).To(Equal(0))
+		Expect(injected(faultAbort)).To(Equal(float64(1)))
+
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), nil).Code).To(Equal(http.StatusOK))
+		Expect(requests).To(Equal(1))
+		Expect(injected(faultAbort)).To(Equal(float64(1)))
+	})
+
+	It("only injects faults into the requests of the groups of the experiment", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Groups:          []string{"chaos"},
+			Percent:         100,
+			AbortStatusCode: http.StatusBadGateway,
+		})
+
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), &sessionsapi.SessionState{Groups: []string{"sre", "chaos"}}).Code).To(Equal(http.StatusBadGateway))
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), &sessionsapi.SessionState{Groups: []string{"sre"}}).Code).To(Equal(http.StatusOK))
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), nil).Code).To(Equal(http.StatusOK))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("requires both the header and the groups when they are set", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Header:          "X-Chaos-Experiment",
+			Groups:          []string{"chaos"},
+			Percent:         100,
+			AbortStatusCode: http.StatusBadGateway,
+		})
+		session := &sessionsapi.SessionState{Groups: []string{"chaos"}}
+
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), session).Code).To(Equal(http.StatusOK))
+
+		req := httptest.NewRequest("", "/", nil)
+		req.Header.Set("X-Chaos-Experiment", "1")
+		Expect(serve(injector, req, session).Code).To(Equal(http.StatusBadGateway))
+	})
+
+	It("delays the requests before sending them to the upstream", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Groups:  []string{"chaos"},
+			Percent: 100,
+			Delay:   duration(50 * time.Millisecond),
+		})
+
+		start := time.Now()
+		rw := serve(injector, httptest.NewRequest("", "/", nil), &sessionsapi.SessionState{Groups: []string{"chaos"}})
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(requests).To(Equal(1))
+		Expect(injected(faultDelay)).To(Equal(float64(1)))
+		Expect(injected(faultAbort)).To(Equal(float64(0)))
+	})
+
+	It("stops delaying the requests whose client is gone", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Groups:          []string{"chaos"},
+			Percent:         100,
+			Delay:           duration(time.Hour),
+			AbortStatusCode: http.StatusGatewayTimeout,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest("", "/", nil).WithContext(ctx)
+		serve(injector, req, &sessionsapi.SessionState{Groups: []string{"chaos"}})
+		Expect(requests).To(Equal(0))
+		Expect(injected(faultDelay)).To(Equal(float64(1)))
+		Expect(injected(faultAbort)).To(Equal(float64(0)))
+	})
+
+	It("only injects faults into the sampled requests", func() {
+		injector := newInjector(options.UpstreamFaultInjection{
+			Groups:          []string{"chaos"},
+			Percent:         10,
+			AbortStatusCode: http.StatusServiceUnavailable,
+		})
+		sampled := false
+		injector.sample = func() bool { return sampled }
+		session := &sessionsapi.SessionState{Groups: []string{"chaos"}}
+
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), session).Code).To(Equal(http.StatusOK))
+		sampled = true
+		Expect(serve(injector, httptest.NewRequest("", "/", nil), session).Code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -1,33 +1,62 @@
 package upstream
 
 import (
+	"fmt"
+	"mime"
 	"net/http"
+	"os"
+	"path"
 	"runtime"
 	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 )
 
-const fileScheme = "file"
+const (
+	fileScheme = "file"
+
+	// indexFile is the file served for the requests of directories
+	indexFile = "index.html"
+)
+
+// precompressedEncodings are the content encodings of the precompressed
+// files served next to the files, in order of preference
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{encoding: "br", extension: ".br"},
+	{encoding: "gzip", extension: ".gz"},
+}
 
 // newFileServer creates a new fileServer that can serve requests
 // to a file system location.
-func newFileServer(id, path, fileSystemPath string) http.Handler {
+// Without FileServer options, the files are served by http.FileServer.
+func newFileServer(id, path, fileSystemPath string, opts *options.UpstreamFileServer) http.Handler {
 	return &fileServer{
 		upstream: id,
-		handler:  newFileServerForPath(path, fileSystemPath),
+		handler:  newFileServerForPath(path, fileSystemPath, opts),
 	}
 }
 
 // newFileServerForPath creates a http.Handler to serve files from the filesystem
-func newFileServerForPath(path string, filesystemPath string) http.Handler {
+func newFileServerForPath(path string, filesystemPath string, opts *options.UpstreamFileServer) http.Handler {
 	// Windows fileSSystemPath will be be prefixed with `/`, eg`/C:/...,
 	// if they were parsed by url.Parse`
 	if runtime.GOOS == "windows" {
 		filesystemPath = strings.TrimPrefix(filesystemPath, "/")
 	}
 
-	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
+	root := http.Dir(filesystemPath)
+	if opts == nil {
+		return http.StripPrefix(path, http.FileServer(root))
+	}
+	return http.StripPrefix(path, &fileSystemHandler{
+		root:    root,
+		listing: http.FileServer(root),
+		opts:    *opts,
+	})
 }
 
 // fileServer represents a single filesystem upstream proxy
@@ -46,3 +75,149 @@ func (u *fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	u.handler.ServeHTTP(rw, req)
 }
+
+// fileSystemHandler serves the files of a file upstream with FileServer
+// options.
+// Like http.FileServer, directories are redirected to their path with a
+// trailing slash and served their index.html, and the conditional and range
+// requests of files are handled by http.ServeContent.
+type fileSystemHandler struct {
+	root    http.FileSystem
+	listing http.Handler
+	opts    options.UpstreamFileServer
+}
+
+// ServeHTTP serves the file, directory or index of the request path
+func (h *fileSystemHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path)
+	info, err := h.stat(name)
+	switch {
+	case os.IsNotExist(err) && h.isIndexFallback(req, name):
+		name = "/" + indexFile
+		info, err = h.stat(name)
+	case err == nil && info.IsDir():
+		h.serveDir(rw, req, name)
+		return
+	}
+	if err != nil || info.IsDir() {
+		http.NotFound(rw, req)
+		return
+	}
+
+	h.serveFile(rw, req, name)
+}
+
+// isIndexFallback returns whether the request of a path that doesn't exist
+// is served the index of the root directory
+func (h *fileSystemHandler) isIndexFallback(req *http.Request, name string) bool {
+	if !h.opts.IndexFallback || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	return path.Ext(name) == ""
+}
+
+// serveDir serves the index.html of the directory, or its listing unless
+// listings are disabled
+func (h *fileSystemHandler) serveDir(rw http.ResponseWriter, req *http.Request, name string) {
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		// The redirect is relative, as the path of the upstream was stripped
+		// from the request path
+		target := path.Base(req.URL.Path) + "/"
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		rw.Header().Set("Location", target)
+		rw.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	index := path.Join(name, indexFile)
+	if info, err := h.stat(index); err == nil && !info.IsDir() {
+		h.serveFile(rw, req, index)
+		return
+	}
+	if h.opts.DisableDirectoryListing {
+		http.NotFound(rw, req)
+		return
+	}
+	h.listing.ServeHTTP(rw, req)
+}
+
+// serveFile serves the file with its Cache-Control and ETag, or its
+// precompressed variant when the client accepts its encoding
+func (h *fileSystemHandler) serveFile(rw http.ResponseWriter, req *http.Request, name string) {
+	cacheControl := h.opts.CacheControl
+	if path.Base(name) == indexFile {
+		cacheControl = h.opts.IndexCacheControl
+	}
+	if cacheControl != "" {
+		rw.Header().Set("Cache-Control", cacheControl)
+	}
+
+	served := name
+	if h.opts.Precompressed {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		for _, variant := range precompressedEncodings {
+			if !acceptsEncoding(req, variant.encoding) {
+				continue
+			}
+			if info, err := h.stat(name + variant.extension); err == nil && !info.IsDir() {
+				served = name + variant.extension
+				rw.Header().Set("Content-Encoding", variant.encoding)
+				contentType := mime.TypeByExtension(path.Ext(name))
+				if contentType == "" {
+					contentType = "application/octet-stream"
+				}
+				rw.Header().Set("Content-Type", contentType)
+				break
+			}
+		}
+	}
+
+	file, err := h.root.Open(served)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if h.opts.ETags {
+		rw.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	}
+	http.ServeContent(rw, req, name, info.ModTime(), file)
+}
+
+// stat returns the info of the file of the root
+func (h *fileSystemHandler) stat(name string) (os.FileInfo, error) {
+	file, err := h.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// acceptsEncoding returns whether the Accept-Encoding of the request accepts
+// the content encoding, other than with a quality of 0
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, accepted := range strings.Split(header, ",") {
+			params := strings.Split(accepted, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+				continue
+			}
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); q == "q=0" || strings.HasPrefix(q, "q=0.") && strings.Trim(q[4:], "0") == "" {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
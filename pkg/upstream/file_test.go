@@ -3,11 +3,14 @@ package upstream
 import (
 	"crypto/rand"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -33,7 +36,7 @@ var _ = Describe("File Server Suite", func() {
 		Expect(err).ToNot(HaveOccurred())
 		id = string(idBytes)
 
-		handler = newFileServer(id, "/files", filesDir)
+		handler = newFileServer(id, "/files", filesDir, nil)
 	})
 
 	AfterEach(func() {
@@ -60,4 +63,113 @@ var _ = Describe("File Server Suite", func() {
 		Entry("for a non-existent file inside the path", "/files/baz", 404, pageNotFound),
 		Entry("for a non-existent file oustide the path", "/baz", 404, pageNotFound),
 	)
+
+	Context("with file server options", func() {
+		var opts *options.UpstreamFileServer
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "file-server")
+			Expect(err).ToNot(HaveOccurred())
+			for name, content := range map[string]string{
+				"index.html":        "index",
+				"app.js":            "app",
+				"app.js.br":         "brotli app",
+				"app.js.gz":         "gzip app",
+				"docs/guide.txt":    "guide",
+				"admin/index.html":  "admin index",
+				"assets/logo.svg":   "<svg/>",
+				"assets/logo.svg.x": "unrelated",
+			} {
+				file := filepath.Join(dir, name)
+				Expect(os.MkdirAll(filepath.Dir(file), 0700)).To(Succeed())
+				Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(Succeed())
+			}
+			opts = &options.UpstreamFileServer{}
+		})
+
+		serve := func(method, requestPath string, headers map[string]string) *httptest.ResponseRecorder {
+			handler := newFileServer(id, "/app", dir, opts)
+			req := httptest.NewRequest(method, requestPath, nil)
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("serves the root index for the client-side routes with the index fallback", func() {
+			opts.IndexFallback = true
+			opts.IndexCacheControl = "no-cache"
+			opts.CacheControl = "public, max-age=31536000, immutable"
+
+			rw := serve(http.MethodGet, "/app/users/42", nil)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("index"))
+			Expect(rw.Header().Get("Cache-Control")).To(Equal("no-cache"))
+
+			rw = serve(http.MethodGet, "/app/app.js", nil)
+			Expect(rw.Body.String()).To(Equal("app"))
+			Expect(rw.Header().Get("Cache-Control")).To(Equal("public, max-age=31536000, immutable"))
+
+			Expect(serve(http.MethodGet, "/app/missing.js", nil).Code).To(Equal(http.StatusNotFound))
+			Expect(serve(http.MethodPost, "/app/users/42", nil).Code).To(Equal(http.StatusNotFound))
+
+			opts.IndexFallback = false
+			Expect(serve(http.MethodGet, "/app/users/42", nil).Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("serves the index of directories, and disables their listings", func() {
+			rw := serve(http.MethodGet, "/app/admin", nil)
+			Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+			Expect(rw.Header().Get("Location")).To(Equal("admin/"))
+
+			Expect(serve(http.MethodGet, "/app/admin/", nil).Body.String()).To(Equal("admin index"))
+
+			rw = serve(http.MethodGet, "/app/docs/", nil)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(ContainSubstring("guide.txt"))
+
+			opts.DisableDirectoryListing = true
+			Expect(serve(http.MethodGet, "/app/docs/", nil).Code).To(Equal(http.StatusNotFound))
+			Expect(serve(http.MethodGet, "/app/docs/guide.txt", nil).Body.String()).To(Equal("guide"))
+		})
+
+		It("revalidates the files with their ETag", func() {
+			opts.ETags = true
+
+			rw := serve(http.MethodGet, "/app/app.js", nil)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			etag := rw.Header().Get("ETag")
+			Expect(etag).To(HavePrefix(`W/"3-`))
+
+			rw = serve(http.MethodGet, "/app/app.js", map[string]string{"If-None-Match": etag})
+			Expect(rw.Code).To(Equal(http.StatusNotModified))
+		})
+
+		It("serves the precompressed files to the clients accepting their encoding", func() {
+			opts.Precompressed = true
+
+			rw := serve(http.MethodGet, "/app/app.js", map[string]string{"Accept-Encoding": "gzip, deflate, br"})
+			Expect(rw.Body.String()).To(Equal("brotli app"))
+			Expect(rw.Header().Get("Content-Encoding")).To(Equal("br"))
+			Expect(rw.Header().Get("Content-Type")).To(HavePrefix("text/javascript"))
+			Expect(rw.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+
+			rw = serve(http.MethodGet, "/app/app.js", map[string]string{"Accept-Encoding": "br;q=0, gzip"})
+			Expect(rw.Body.String()).To(Equal("gzip app"))
+			Expect(rw.Header().Get("Content-Encoding")).To(Equal("gzip"))
+
+			rw = serve(http.MethodGet, "/app/app.js", nil)
+			Expect(rw.Body.String()).To(Equal("app"))
+			Expect(rw.Header().Get("Content-Encoding")).To(BeEmpty())
+
+			rw = serve(http.MethodGet, "/app/assets/logo.svg", map[string]string{"Accept-Encoding": "br, gzip"})
+			Expect(rw.Body.String()).To(Equal("<svg/>"))
+			Expect(rw.Header().Get("Content-Encoding")).To(BeEmpty())
+		})
+	})
 })
@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cScheme is the scheme of upstreams served over HTTP/2 without TLS, such
+// as gRPC servers inside a cluster
+const h2cScheme = "h2c"
+
+// configureH2CTransport registers the h2c scheme with the transport, so that
+// requests to h2c URLs are sent over HTTP/2 without TLS rather than being
+// downgraded to HTTP/1.1.
+// Connections are dialed with the DialContext of the transport when they are
+// opened, so that the dial timeout and the DNS balancer apply to them.
+func configureH2CTransport(transport *http.Transport) {
+	h2 := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return transport.DialContext(context.Background(), network, addr)
+		},
+		DisableCompression: transport.DisableCompression,
+	}
+	transport.RegisterProtocol(h2cScheme, &h2cRoundTripper{transport: h2})
+}
+
+// h2cRoundTripper sends the requests to h2c URLs with the HTTP/2 transport,
+// which only sends requests to http URLs without TLS
+type h2cRoundTripper struct {
+	transport *http2.Transport
+}
+
+// RoundTrip sends the request to the http URL of the h2c URL, without
+// modifying the request
+func (t *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	r.URL = toHTTPURL(req.URL)
+	return t.transport.RoundTrip(&r)
+}
+
+// toHTTPURL returns the http URL of an h2c URL, for the requests sent to h2c
+// upstreams over HTTP/1.1, such as WebSocket upgrades, and the absolute URLs
+// h2c upstreams link to themselves with.
+// Other URLs are returned unchanged.
+func toHTTPURL(u *url.URL) *url.URL {
+	if u.Scheme != h2cScheme {
+		return u
+	}
+	httpURL := *u
+	httpURL.Scheme = httpScheme
+	return &httpURL
+}
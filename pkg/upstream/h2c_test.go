@@ -0,0 +1,112 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var _ = Describe("H2C Upstream Suite", func() {
+	type upstreamRequest struct {
+		proto string
+		te    string
+		body  string
+	}
+
+	var server *httptest.Server
+	var requests chan upstreamRequest
+
+	BeforeEach(func() {
+		requests = make(chan upstreamRequest, 1)
+		server = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			requests <- upstreamRequest{
+				proto: req.Proto,
+				te:    req.Header.Get("Te"),
+				body:  string(body),
+			}
+
+			rw.Header().Set("Trailer", "Grpc-Status")
+			rw.Header().Set("Content-Type", "application/grpc")
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte("message"))
+			rw.(http.Flusher).Flush()
+			rw.Header().Set("Grpc-Status", "0")
+			// Trailers that weren't announced are sent too
+			rw.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+		}), &http2.Server{}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newH2CProxy := func() http.Handler {
+		u, err := url.Parse(strings.Replace(server.URL, "http://", "h2c://", 1))
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err := newHTTPUpstreamProxy(options.Upstream{ID: "grpc", URI: u.String()}, u, nil, nil, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		return handler
+	}
+
+	It("proxies requests over HTTP/2 with the trailers of their responses", func() {
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", strings.NewReader("hello"))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+
+		rw := httptest.NewRecorder()
+		newH2CProxy().ServeHTTP(rw, req)
+
+		var received upstreamRequest
+		Eventually(requests).Should(Receive(&received))
+		Expect(received).To(Equal(upstreamRequest{
+			proto: "HTTP/2.0",
+			te:    "trailers",
+			body:  "hello",
+		}))
+
+		resp := rw.Result()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal("message"))
+		Expect(resp.Trailer.Get("Grpc-Status")).To(Equal("0"))
+		Expect(resp.Trailer.Get("Grpc-Message")).To(Equal("done"))
+	})
+
+	It("probes the health of the servers over HTTP/2", func() {
+		u, err := url.Parse(strings.Replace(server.URL, "http://", "h2c://", 1))
+		Expect(err).ToNot(HaveOccurred())
+		backend := newUpstreamBackend(options.Upstream{ID: "grpc"}, u, 1, nil, nil, nil, nil)
+
+		req, err := http.NewRequest(http.MethodGet, u.String()+"/healthz", nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := backend.transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.ProtoMajor).To(Equal(2))
+	})
+
+	It("upgrades WebSocket connections over HTTP/1.1", func() {
+		u, err := url.Parse("h2c://upstream.internal:8080")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(toHTTPURL(u).String()).To(Equal("http://upstream.internal:8080"))
+		Expect(u.Scheme).To(Equal(h2cScheme))
+
+		wsProxy := newWebSocketReverseProxy(u, options.Upstream{})
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		wsProxy.Director(req)
+		Expect(req.URL.Scheme).To(Equal(httpScheme))
+	})
+})
@@ -0,0 +1,81 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+)
+
+// HandlerFactory creates the handlers of upstreams with a custom scheme, such
+// as `s3://` or `lambda://`, for programs embedding the proxy as a library.
+// Factories are registered with RegisterScheme.
+type HandlerFactory interface {
+	// NewHandler creates the handler serving the requests routed to the
+	// upstream, whose URI has been parsed into u.
+	// The handler is wrapped like the handlers of the built in schemes, so
+	// the upstream's limits, cache and header options apply to it.
+	// The writer renders the error pages of the proxy.
+	NewHandler(upstream options.Upstream, u *url.URL, writer pagewriter.Writer) (http.Handler, error)
+}
+
+// HandlerFactoryFunc is a function creating the handlers of upstreams with a
+// custom scheme, implementing HandlerFactory
+type HandlerFactoryFunc func(upstream options.Upstream, u *url.URL, writer pagewriter.Writer) (http.Handler, error)
+
+// NewHandler calls the function
+func (f HandlerFactoryFunc) NewHandler(upstream options.Upstream, u *url.URL, writer pagewriter.Writer) (http.Handler, error) {
+	return f(upstream, u, writer)
+}
+
+// builtinSchemes are the schemes served by the proxy itself, which can't be
+// registered
+var builtinSchemes = map[string]struct{}{
+	fileScheme:  {},
+	httpScheme:  {},
+	httpsScheme: {},
+	h2cScheme:   {},
+	unixScheme:  {},
+}
+
+var (
+	handlerFactoriesMu sync.RWMutex
+	handlerFactories   = map[string]HandlerFactory{}
+)
+
+// RegisterScheme registers the factory of the handlers of upstreams whose URI
+// has the scheme, for the proxies created by NewProxy once it is registered.
+// Schemes are case insensitive. The schemes of the proxy, and schemes that
+// are already registered, can't be registered.
+func RegisterScheme(scheme string, factory HandlerFactory) error {
+	scheme = strings.ToLower(scheme)
+	if scheme == "" {
+		return fmt.Errorf("could not register handler factory: empty scheme")
+	}
+	if factory == nil {
+		return fmt.Errorf("could not register handler factory for scheme %q: nil factory", scheme)
+	}
+	if _, ok := builtinSchemes[scheme]; ok {
+		return fmt.Errorf("could not register handler factory for scheme %q: the scheme is built in", scheme)
+	}
+
+	handlerFactoriesMu.Lock()
+	defer handlerFactoriesMu.Unlock()
+	if _, ok := handlerFactories[scheme]; ok {
+		return fmt.Errorf("could not register handler factory for scheme %q: the scheme is already registered", scheme)
+	}
+	handlerFactories[scheme] = factory
+	return nil
+}
+
+// getHandlerFactory returns the factory registered for the scheme, if any
+func getHandlerFactory(scheme string) (HandlerFactory, bool) {
+	handlerFactoriesMu.RLock()
+	defer handlerFactoriesMu.RUnlock()
+	factory, ok := handlerFactories[strings.ToLower(scheme)]
+	return factory, ok
+}
@@ -0,0 +1,87 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler Factory Suite", func() {
+	// bucketFactory serves the requests to s3 style upstreams with the bucket
+	// and path of the request
+	bucketFactory := HandlerFactoryFunc(func(upstream options.Upstream, u *url.URL, _ pagewriter.Writer) (http.Handler, error) {
+		if u.Host == "" {
+			return nil, errors.New("no bucket")
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Upstream", upstream.ID)
+			rw.Write([]byte("bucket " + u.Host + " " + req.URL.Path))
+		}), nil
+	})
+
+	newProxy := func(upstream options.Upstream) (http.Handler, error) {
+		return NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{upstream},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+	}
+
+	It("routes the requests to upstreams with a registered scheme to the handler of the factory", func() {
+		Expect(RegisterScheme("Bucket", bucketFactory)).To(Succeed())
+
+		proxy, err := newProxy(options.Upstream{
+			ID:   "assets",
+			Path: "/assets/",
+			URI:  "bucket://static-assets",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest(http.MethodGet, "/assets/logo.png", nil)
+		scope := &middlewareapi.RequestScope{}
+		req = middlewareapi.AddRequestScope(req, scope)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("bucket static-assets /assets/logo.png"))
+		Expect(rw.Header().Get("X-Upstream")).To(Equal("assets"))
+		Expect(scope.Upstream).To(Equal("assets"))
+	})
+
+	It("returns the errors of the factory", func() {
+		Expect(RegisterScheme("emptybucket", bucketFactory)).To(Succeed())
+
+		_, err := newProxy(options.Upstream{
+			ID:   "assets",
+			Path: "/assets/",
+			URI:  "emptybucket:///logo.png",
+		})
+		Expect(err).To(MatchError("could not register emptybucket upstream \"assets\": no bucket"))
+	})
+
+	It("rejects schemes without a factory", func() {
+		_, err := newProxy(options.Upstream{
+			ID:   "assets",
+			Path: "/assets/",
+			URI:  "unregistered://static-assets",
+		})
+		Expect(err).To(MatchError("unknown scheme for upstream \"assets\": \"unregistered\""))
+	})
+
+	It("can't register built in, registered or empty schemes", func() {
+		Expect(RegisterScheme("HTTPS", bucketFactory)).To(MatchError("could not register handler factory for scheme \"https\": the scheme is built in"))
+		Expect(RegisterScheme("unix", bucketFactory)).To(MatchError("could not register handler factory for scheme \"unix\": the scheme is built in"))
+
+		Expect(RegisterScheme("twice", bucketFactory)).To(Succeed())
+		Expect(RegisterScheme("Twice", bucketFactory)).To(MatchError("could not register handler factory for scheme \"twice\": the scheme is already registered"))
+
+		Expect(RegisterScheme("", bucketFactory)).To(MatchError("could not register handler factory: empty scheme"))
+		Expect(RegisterScheme("nil", nil)).To(MatchError("could not register handler factory for scheme \"nil\": nil factory"))
+	})
+})
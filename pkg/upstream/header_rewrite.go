@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// headerRewrite is a compiled HeaderRewrite of an upstream
+type headerRewrite struct {
+	name    string
+	action  string
+	value   string
+	pattern *regexp.Regexp
+}
+
+// newHeaderRewrites wraps the handler so that the requests to the upstream
+// and its responses are rewritten with the upstream's HeaderRewrites.
+// The handler is returned unchanged when there are no rewrites.
+func newHeaderRewrites(upstream options.Upstream, next http.Handler) (http.Handler, error) {
+	if upstream.HeaderRewrites == nil {
+		return next, nil
+	}
+	request, err := compileHeaderRewrites(upstream.HeaderRewrites.Request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request header rewrite for upstream %q: %v", upstream.ID, err)
+	}
+	response, err := compileHeaderRewrites(upstream.HeaderRewrites.Response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response header rewrite for upstream %q: %v", upstream.ID, err)
+	}
+	if len(request) == 0 && len(response) == 0 {
+		return next, nil
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		applyHeaderRewrites(request, req.Header)
+		if len(response) > 0 {
+			rw = &headerRewriteResponse{Wrapper: responsewriter.Wrapper{ResponseWriter: rw}, rewrites: response}
+		}
+		next.ServeHTTP(rw, req)
+	}), nil
+}
+
+// compileHeaderRewrites compiles the patterns of the rewrites
+func compileHeaderRewrites(rewrites []options.HeaderRewrite) ([]headerRewrite, error) {
+	compiled := make([]headerRewrite, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		r := headerRewrite{
+			name:   http.CanonicalHeaderKey(rewrite.Name),
+			action: rewrite.Action,
+			value:  rewrite.Value,
+		}
+		switch rewrite.Action {
+		case options.HeaderRewriteAdd, options.HeaderRewriteSet, options.HeaderRewriteRemove:
+		case options.HeaderRewriteReplace:
+			pattern, err := regexp.Compile(rewrite.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for header %q: %v", rewrite.Pattern, rewrite.Name, err)
+			}
+			r.pattern = pattern
+		default:
+			return nil, fmt.Errorf("unknown action %q for header %q", rewrite.Action, rewrite.Name)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+// applyHeaderRewrites applies the rewrites to the headers, in order
+func applyHeaderRewrites(rewrites []headerRewrite, header http.Header) {
+	for _, r := range rewrites {
+		switch r.action {
+		case options.HeaderRewriteAdd:
+			header.Add(r.name, r.value)
+		case options.HeaderRewriteSet:
+			header.Set(r.name, r.value)
+		case options.HeaderRewriteRemove:
+			header.Del(r.name)
+		case options.HeaderRewriteReplace:
+			values := header.Values(r.name)
+			if len(values) == 0 {
+				continue
+			}
+			rewritten := make([]string, 0, len(values))
+			for _, value := range values {
+				rewritten = append(rewritten, r.pattern.ReplaceAllString(value, r.value))
+			}
+			header[r.name] = rewritten
+		}
+	}
+}
+
+// headerRewriteResponse is a custom http.ResponseWriter that applies the
+// response header rewrites before the response is started.
+type headerRewriteResponse struct {
+	responsewriter.Wrapper
+
+	rewrites []headerRewrite
+	applied  bool
+}
+
+// apply applies the rewrites once, to the headers of the response
+func (r *headerRewriteResponse) apply() {
+	if r.applied {
+		return
+	}
+	r.applied = true
+	applyHeaderRewrites(r.rewrites, r.ResponseWriter.Header())
+}
+
+// Write writes the response using the ResponseWriter
+func (r *headerRewriteResponse) Write(b []byte) (int, error) {
+	r.apply()
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteHeader writes the status code for the Response
+func (r *headerRewriteResponse) WriteHeader(s int) {
+	r.apply()
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *headerRewriteResponse) Flush() {
+	r.apply()
+	r.Wrapper.Flush()
+}
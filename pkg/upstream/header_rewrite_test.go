@@ -0,0 +1,155 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header Rewrite Suite", func() {
+	type headerRewriteTableInput struct {
+		rewrites        []options.HeaderRewrite
+		headers         http.Header
+		expectedHeaders http.Header
+	}
+
+	newRewrites := func(request, response []options.HeaderRewrite, next http.Handler) http.Handler {
+		handler, err := newHeaderRewrites(options.Upstream{
+			ID: "app",
+			HeaderRewrites: &options.UpstreamHeaderRewrites{
+				Request:  request,
+				Response: response,
+			},
+		}, next)
+		Expect(err).ToNot(HaveOccurred())
+		return handler
+	}
+
+	tableEntries := []TableEntry{
+		Entry("adds a value", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "x-forwarded-for", Action: options.HeaderRewriteAdd, Value: "10.0.0.2"},
+			},
+			headers:         http.Header{"X-Forwarded-For": []string{"10.0.0.1"}},
+			expectedHeaders: http.Header{"X-Forwarded-For": []string{"10.0.0.1", "10.0.0.2"}},
+		}),
+		Entry("sets a value", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "X-Api-Key", Action: options.HeaderRewriteSet, Value: "static"},
+			},
+			headers:         http.Header{"X-Api-Key": []string{"client", "other"}},
+			expectedHeaders: http.Header{"X-Api-Key": []string{"static"}},
+		}),
+		Entry("removes a header", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "set-cookie", Action: options.HeaderRewriteRemove},
+			},
+			headers:         http.Header{"Set-Cookie": []string{"a=b", "c=d"}, "Content-Type": []string{"text/plain"}},
+			expectedHeaders: http.Header{"Content-Type": []string{"text/plain"}},
+		}),
+		Entry("replaces the matches of a pattern in each value", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "Link", Action: options.HeaderRewriteReplace, Pattern: "http://app.internal(/[^>]*)", Value: "https://app.example.com$1"},
+			},
+			headers:         http.Header{"Link": []string{"<http://app.internal/a>; rel=next", "<http://other/b>; rel=prev"}},
+			expectedHeaders: http.Header{"Link": []string{"<https://app.example.com/a>; rel=next", "<http://other/b>; rel=prev"}},
+		}),
+		Entry("doesn't add headers when replacing a missing header", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "Server", Action: options.HeaderRewriteReplace, Pattern: ".*", Value: "proxy"},
+			},
+			headers:         http.Header{},
+			expectedHeaders: http.Header{},
+		}),
+		Entry("applies the rewrites in order", headerRewriteTableInput{
+			rewrites: []options.HeaderRewrite{
+				{Name: "X-Env", Action: options.HeaderRewriteRemove},
+				{Name: "X-Env", Action: options.HeaderRewriteAdd, Value: "staging"},
+				{Name: "X-Env", Action: options.HeaderRewriteReplace, Pattern: "^staging$", Value: "production"},
+			},
+			headers:         http.Header{"X-Env": []string{"dev"}},
+			expectedHeaders: http.Header{"X-Env": []string{"production"}},
+		}),
+	}
+
+	DescribeTable("rewriting request headers",
+		func(in headerRewriteTableInput) {
+			var upstreamHeaders http.Header
+			handler := newRewrites(in.rewrites, nil, http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				upstreamHeaders = req.Header
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			req.Header = in.headers.Clone()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			Expect(upstreamHeaders).To(Equal(in.expectedHeaders))
+		},
+		tableEntries...,
+	)
+
+	DescribeTable("rewriting response headers",
+		func(in headerRewriteTableInput) {
+			handler := newRewrites(nil, in.rewrites, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				for name, values := range in.headers.Clone() {
+					rw.Header()[name] = values
+				}
+				rw.WriteHeader(http.StatusOK)
+			}))
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+			Expect(rw.Header()).To(Equal(in.expectedHeaders))
+		},
+		tableEntries...,
+	)
+
+	It("rewrites the response headers when the body is written without a status", func() {
+		handler := newRewrites(nil, []options.HeaderRewrite{
+			{Name: "Set-Cookie", Action: options.HeaderRewriteRemove},
+		}, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Set-Cookie", "session=abc")
+			_, err := rw.Write([]byte("body"))
+			Expect(err).ToNot(HaveOccurred())
+		}))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+		Expect(rw.Header()).ToNot(HaveKey("Set-Cookie"))
+		Expect(rw.Body.String()).To(Equal("body"))
+	})
+
+	It("rewrites the response headers when the response is flushed", func() {
+		handler := newRewrites(nil, []options.HeaderRewrite{
+			{Name: "X-Stream", Action: options.HeaderRewriteSet, Value: "rewritten"},
+		}, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("X-Stream", "original")
+			rw.(http.Flusher).Flush()
+		}))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+		Expect(rw.Flushed).To(BeTrue())
+		Expect(rw.Header().Get("X-Stream")).To(Equal("rewritten"))
+	})
+
+	It("returns the handler unchanged without rewrites", func() {
+		next := http.RedirectHandler("/", http.StatusFound)
+		handler, err := newHeaderRewrites(options.Upstream{ID: "app", HeaderRewrites: &options.UpstreamHeaderRewrites{}}, next)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler).To(BeIdenticalTo(next))
+	})
+
+	It("fails with an invalid pattern", func() {
+		_, err := newHeaderRewrites(options.Upstream{
+			ID: "app",
+			HeaderRewrites: &options.UpstreamHeaderRewrites{
+				Response: []options.HeaderRewrite{{Name: "Location", Action: options.HeaderRewriteReplace, Pattern: "(http"}},
+			},
+		}, http.NotFoundHandler())
+		Expect(err).To(MatchError(ContainSubstring("invalid response header rewrite for upstream \"app\": invalid pattern \"(http\" for header \"Location\"")))
+	})
+})
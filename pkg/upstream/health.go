@@ -0,0 +1,278 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// errNoHealthyBackends is the error rendered for the requests to upstreams
+// whose servers are all unhealthy, when they have no fallback
+var errNoHealthyBackends = errors.New("all the servers of the upstream are unhealthy")
+
+// HealthTable reports the health of the servers of the upstreams of the
+// proxy created by NewProxy, for the upstreams with health checks
+type HealthTable interface {
+	// Health returns the health of the upstreams in the order they are
+	// matched
+	Health() []UpstreamHealth
+}
+
+// UpstreamHealth is the health of the servers of an upstream
+type UpstreamHealth struct {
+	ID string `json:"id"`
+	// Healthy is set while any of the servers is healthy
+	Healthy  bool            `json:"healthy"`
+	Backends []BackendHealth `json:"backends"`
+	// Fallback is the server requests are sent to while none is healthy
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// BackendHealth is the health of one of the servers of an upstream
+type BackendHealth struct {
+	URI       string     `json:"uri"`
+	Healthy   bool       `json:"healthy"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// backendHealth is the state of a server of an upstream, as determined by
+// its last probes
+type backendHealth struct {
+	mutex     sync.Mutex
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck *time.Time
+	lastError string
+}
+
+// healthChecker probes the servers of an upstream at the interval, marking
+// them unhealthy when they fail the unhealthy threshold of probes in a row,
+// and healthy again when they pass the healthy threshold of probes in a row.
+// Servers are healthy until they are first probed.
+type healthChecker struct {
+	upstream           string
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	credentials        http.Header
+	backends           []*upstreamBackend
+	fallback           *url.URL
+	metrics            *healthMetrics
+	clock              clock.Clock
+
+	// stopped is closed by Stop
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newHealthChecker creates the health checker of the servers of the
+// upstream, which are probed with the credentials of the upstream.
+// The servers aren't probed until Start is called.
+func newHealthChecker(upstream options.Upstream, backends []*upstreamBackend, fallback *url.URL, credentials http.Header, metrics *healthMetrics) *healthChecker {
+	check := upstream.HealthCheck
+	c := &healthChecker{
+		upstream:           upstream.ID,
+		path:               check.Path,
+		interval:           options.DefaultUpstreamHealthCheckInterval,
+		timeout:            options.DefaultUpstreamHealthCheckTimeout,
+		healthyThreshold:   check.HealthyThreshold,
+		unhealthyThreshold: check.UnhealthyThreshold,
+		credentials:        credentials,
+		backends:           backends,
+		fallback:           fallback,
+		metrics:            metrics,
+		stopped:            make(chan struct{}),
+	}
+	if c.path == "" {
+		c.path = options.DefaultUpstreamHealthCheckPath
+	}
+	if check.Interval != nil {
+		c.interval = check.Interval.Duration()
+	}
+	if check.Timeout != nil {
+		c.timeout = check.Timeout.Duration()
+	}
+	if c.healthyThreshold <= 0 {
+		c.healthyThreshold = options.DefaultUpstreamHealthyThreshold
+	}
+	if c.unhealthyThreshold <= 0 {
+		c.unhealthyThreshold = options.DefaultUpstreamUnhealthyThreshold
+	}
+
+	for _, backend := range backends {
+		backend.health = &backendHealth{healthy: true}
+		c.setHealthyMetric(backend, true)
+	}
+	return c
+}
+
+// Start probes the servers straight away, and then at every interval until
+// done is closed, or the checker is stopped
+func (c *healthChecker) Start(done <-chan bool) {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			c.Check(context.Background())
+			select {
+			case <-done:
+				return
+			case <-c.stopped:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops probing the servers, once the upstream has been replaced by a
+// reload
+func (c *healthChecker) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
+
+// Check probes every server once, in parallel, and updates their health
+func (c *healthChecker) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, backend := range c.backends {
+		wg.Add(1)
+		go func(backend *upstreamBackend) {
+			defer wg.Done()
+			c.record(backend, c.probe(ctx, backend))
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// probe checks that the server responds to a GET request of the path with a
+// 2xx or 3xx status. The probe is sent with the transport of the server, and
+// redirects aren't followed.
+func (c *healthChecker) probe(ctx context.Context, backend *upstreamBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	target := *backend.target
+	target.Path = c.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("invalid health check path %q: %v", c.path, err)
+	}
+	for name, values := range c.credentials {
+		req.Header[name] = values
+	}
+
+	resp, err := backend.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record updates the health of the server with the result of a probe,
+// logging the transitions between healthy and unhealthy
+func (c *healthChecker) record(backend *upstreamBackend, failure error) {
+	health := backend.health
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := c.clock.Now()
+	health.lastCheck = &now
+	if failure == nil {
+		health.successes++
+		health.failures = 0
+		health.lastError = ""
+		if !health.healthy && health.successes >= c.healthyThreshold {
+			logger.Printf("upstream %q server %q is healthy again after passing %d health checks", c.upstream, redactURI(backend.target.String()), health.successes)
+			health.healthy = true
+			c.setHealthyMetric(backend, true)
+		}
+		return
+	}
+
+	health.failures++
+	health.successes = 0
+	health.lastError = failure.Error()
+	if health.healthy && health.failures >= c.unhealthyThreshold {
+		logger.Errorf("upstream %q server %q is unhealthy after failing %d health checks, it is no longer sent requests: %v", c.upstream, redactURI(backend.target.String()), health.failures, failure)
+		health.healthy = false
+		c.setHealthyMetric(backend, false)
+	}
+}
+
+func (c *healthChecker) setHealthyMetric(backend *upstreamBackend, healthy bool) {
+	if c.metrics == nil {
+		return
+	}
+	value := float64(0)
+	if healthy {
+		value = 1
+	}
+	c.metrics.healthy.WithLabelValues(c.upstream, backend.host).Set(value)
+}
+
+// report returns the health of the servers of the upstream
+func (c *healthChecker) report() UpstreamHealth {
+	report := UpstreamHealth{
+		ID:       c.upstream,
+		Backends: []BackendHealth{},
+	}
+	for _, backend := range c.backends {
+		backend.health.mutex.Lock()
+		report.Backends = append(report.Backends, BackendHealth{
+			URI:       redactURI(backend.target.String()),
+			Healthy:   backend.health.healthy,
+			LastCheck: backend.health.lastCheck,
+			LastError: backend.health.lastError,
+		})
+		report.Healthy = report.Healthy || backend.health.healthy
+		backend.health.mutex.Unlock()
+	}
+	if c.fallback != nil {
+		report.Fallback = redactURI(c.fallback.String())
+	}
+	return report
+}
+
+// isHealthy returns whether requests can be sent to the server: servers
+// without health checks are always healthy
+func (h *backendHealth) isHealthy() bool {
+	if h == nil {
+		return true
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.healthy
+}
+
+// Health returns the health of the servers of the upstreams with health
+// checks, in the order they are matched
+func (m *multiUpstreamProxy) Health() []UpstreamHealth {
+	health := []UpstreamHealth{}
+	for _, check := range m.loadConfigured().healthChecks {
+		health = append(health, check.report())
+	}
+	return health
+}
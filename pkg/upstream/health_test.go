@@ -0,0 +1,263 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// healthServer is a server whose responses to health checks can be changed
+type healthServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	probes []*http.Request
+}
+
+func newHealthServer(name string) *healthServer {
+	s := &healthServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			s.mu.Lock()
+			s.probes = append(s.probes, req)
+			status := s.status
+			s.mu.Unlock()
+			if status == http.StatusFound {
+				rw.Header().Set("Location", "/login")
+			}
+			rw.WriteHeader(status)
+			return
+		}
+		rw.Write([]byte(name))
+	}))
+	return s
+}
+
+func (s *healthServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *healthServer) lastProbe() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.probes) == 0 {
+		return nil
+	}
+	return s.probes[len(s.probes)-1]
+}
+
+var _ = Describe("Upstream Health Check Suite", func() {
+	var primary, secondary, fallback *healthServer
+	var metrics *healthMetrics
+
+	BeforeEach(func() {
+		primary = newHealthServer("primary")
+		secondary = newHealthServer("secondary")
+		fallback = newHealthServer("fallback")
+		metrics = newHealthMetrics(prometheus.NewRegistry())
+	})
+
+	AfterEach(func() {
+		primary.Close()
+		secondary.Close()
+		fallback.Close()
+	})
+
+	hour := options.Duration(time.Hour)
+
+	// newChecker creates the health checker of backends to the servers,
+	// without starting it
+	newChecker := func(check options.UpstreamHealthCheck, servers ...*healthServer) (*healthChecker, []*upstreamBackend) {
+		upstream := options.Upstream{ID: "app", HealthCheck: &check}
+		backends := []*upstreamBackend{}
+		for _, server := range servers {
+			u, err := url.Parse(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			backends = append(backends, newUpstreamBackend(upstream, u, 1, http.Header{"X-Api-Key": []string{"secret"}}, nil, nil, nil))
+		}
+		return newHealthChecker(upstream, backends, nil, http.Header{"X-Api-Key": []string{"secret"}}, metrics), backends
+	}
+
+	healthyMetric := func(server *healthServer) float64 {
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		return testutil.ToFloat64(metrics.healthy.WithLabelValues("app", u.Host))
+	}
+
+	It("marks servers unhealthy once they fail the unhealthy threshold of probes in a row", func() {
+		checker, backends := newChecker(options.UpstreamHealthCheck{Path: "/healthz", UnhealthyThreshold: 2}, primary)
+		Expect(backends[0].health.isHealthy()).To(BeTrue())
+		Expect(healthyMetric(primary)).To(Equal(float64(1)))
+
+		primary.setStatus(http.StatusServiceUnavailable)
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeTrue())
+
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeFalse())
+		Expect(healthyMetric(primary)).To(Equal(float64(0)))
+
+		report := checker.report()
+		Expect(report.Healthy).To(BeFalse())
+		Expect(report.Backends).To(HaveLen(1))
+		Expect(report.Backends[0].URI).To(Equal(primary.URL))
+		Expect(report.Backends[0].LastCheck).ToNot(BeNil())
+		Expect(report.Backends[0].LastError).To(Equal("responded with 503"))
+	})
+
+	It("marks servers healthy again once they pass the healthy threshold of probes in a row", func() {
+		checker, backends := newChecker(options.UpstreamHealthCheck{Path: "/healthz", HealthyThreshold: 2, UnhealthyThreshold: 1}, primary)
+
+		primary.setStatus(http.StatusInternalServerError)
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeFalse())
+
+		primary.setStatus(http.StatusOK)
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeFalse())
+
+		// A failure resets the probes passed in a row
+		primary.setStatus(http.StatusInternalServerError)
+		checker.Check(context.Background())
+		primary.setStatus(http.StatusOK)
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeFalse())
+
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeTrue())
+		Expect(healthyMetric(primary)).To(Equal(float64(1)))
+		Expect(checker.report().Backends[0].LastError).To(BeEmpty())
+	})
+
+	It("probes the path with the credentials of the upstream without following redirects", func() {
+		checker, backends := newChecker(options.UpstreamHealthCheck{Path: "/healthz", UnhealthyThreshold: 1}, primary)
+
+		primary.setStatus(http.StatusFound)
+		checker.Check(context.Background())
+		Expect(backends[0].health.isHealthy()).To(BeTrue())
+
+		probe := primary.lastProbe()
+		Expect(probe).ToNot(BeNil())
+		Expect(probe.Method).To(Equal(http.MethodGet))
+		Expect(probe.Header.Get("X-Api-Key")).To(Equal("secret"))
+	})
+
+	It("fails probes that time out", func() {
+		slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		timeout := options.Duration(10 * time.Millisecond)
+		upstream := options.Upstream{ID: "app", HealthCheck: &options.UpstreamHealthCheck{Timeout: &timeout, UnhealthyThreshold: 1}}
+		u, err := url.Parse(slow.URL)
+		Expect(err).ToNot(HaveOccurred())
+		backend := newUpstreamBackend(upstream, u, 1, nil, nil, nil, nil)
+		checker := newHealthChecker(upstream, []*upstreamBackend{backend}, nil, nil, nil)
+
+		checker.Check(context.Background())
+		Expect(backend.health.isHealthy()).To(BeFalse())
+		Expect(checker.report().Backends[0].LastError).To(ContainSubstring("context deadline exceeded"))
+	})
+
+	Context("with an upstream proxy", func() {
+		// serve serves a request with the handler, returning its status and body
+		serve := func(handler http.Handler) (int, string) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw.Code, rw.Body.String()
+		}
+
+		newProxy := func(check *options.UpstreamHealthCheck) *httpUpstreamProxy {
+			u, err := url.Parse(primary.URL)
+			Expect(err).ToNot(HaveOccurred())
+			upstream := options.Upstream{
+				ID:          "app",
+				Backends:    []options.UpstreamBackend{{URI: secondary.URL}},
+				HealthCheck: check,
+			}
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, nil, metrics)
+			Expect(err).ToNot(HaveOccurred())
+			return handler.(*httpUpstreamProxy)
+		}
+
+		It("only balances the requests across the healthy servers", func() {
+			primary.setStatus(http.StatusServiceUnavailable)
+			proxy := newProxy(&options.UpstreamHealthCheck{Path: "/healthz", Interval: &hour, UnhealthyThreshold: 1})
+			Eventually(func() bool { return proxy.health.backends[0].health.isHealthy() }).Should(BeFalse())
+
+			for i := 0; i < 3; i++ {
+				_, body := serve(proxy)
+				Expect(body).To(Equal("secondary"))
+			}
+		})
+
+		It("sends the requests to the fallback while all the servers are unhealthy", func() {
+			primary.setStatus(http.StatusServiceUnavailable)
+			secondary.setStatus(http.StatusServiceUnavailable)
+			proxy := newProxy(&options.UpstreamHealthCheck{Path: "/healthz", Interval: &hour, UnhealthyThreshold: 1, FallbackURI: fallback.URL})
+			Eventually(func() bool { return proxy.health.report().Healthy }).Should(BeFalse())
+
+			status, body := serve(proxy)
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("fallback"))
+			Expect(proxy.health.report().Fallback).To(Equal(fallback.URL))
+		})
+
+		It("renders the error page while all the servers are unhealthy without a fallback", func() {
+			primary.setStatus(http.StatusServiceUnavailable)
+			secondary.setStatus(http.StatusServiceUnavailable)
+			proxy := newProxy(&options.UpstreamHealthCheck{Path: "/healthz", Interval: &hour, UnhealthyThreshold: 1})
+			Eventually(func() bool { return proxy.health.report().Healthy }).Should(BeFalse())
+
+			status, _ := serve(proxy)
+			Expect(status).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	It("reports the health of the upstreams with health checks", func() {
+		proxy, err := NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:          "app",
+					Path:        "/",
+					URI:         primary.URL,
+					HealthCheck: &options.UpstreamHealthCheck{Path: "/healthz", Interval: &hour},
+				},
+				{
+					ID:   "api",
+					Path: "/api/",
+					URI:  secondary.URL,
+				},
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		health := proxy.(HealthTable)
+		Eventually(func() *time.Time { return health.Health()[0].Backends[0].LastCheck }).ShouldNot(BeNil())
+
+		report := health.Health()
+		Expect(report).To(HaveLen(1))
+		Expect(report[0].ID).To(Equal("app"))
+		Expect(report[0].Healthy).To(BeTrue())
+		Expect(report[0].Backends).To(HaveLen(1))
+		Expect(report[0].Backends[0].URI).To(Equal(primary.URL))
+		Expect(report[0].Backends[0].Healthy).To(BeTrue())
+	})
+})
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -9,6 +10,8 @@ import (
 	"github.com/mbland/hmacauth"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
 )
 
 const (
@@ -38,38 +41,187 @@ var SignatureHeaders = []string{
 
 // newHTTPUpstreamProxy creates a new httpUpstreamProxy that can serve requests
 // to a single upstream host.
-func newHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, errorHandler ProxyErrorHandler) http.Handler {
+// When the upstream has a DNSRefreshInterval, connections to the host are
+// spread across its addresses, which are recorded in the DNS metrics.
+// Failures reading upstream response bodies are counted in the stream
+// metrics.
+// When the upstream has a Mirror, a sample of the requests is mirrored to it,
+// counted in the mirror metrics.
+// When the upstream has Backends, requests are balanced across them and the
+// host of the URI, counted in the balancer metrics.
+// When the upstream has a HealthCheck, requests are only balanced across the
+// servers passing their probes, whose health is recorded in the health
+// metrics.
+func newHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, errorHandler ProxyErrorHandler, metrics *dnsMetrics, streamMetrics *streamMetrics, mirrorMetrics *mirrorMetrics, balancerMetrics *balancerMetrics, healthMetrics *healthMetrics) (http.Handler, error) {
+	credentials, err := newUpstreamCredentials(upstream)
+	if err != nil {
+		return nil, err
+	}
+	clientTLS, err := newUpstreamClientTLS(upstream)
+	if err != nil {
+		return nil, err
+	}
+	mirror, err := newRequestMirror(upstream, mirrorMetrics)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror: %v", err)
+	}
+	rewrite := newResponseRewrite(upstream, u)
+
 	// Set path to empty so that request paths start at the server root
 	u.Path = ""
 
-	// Create a ReverseProxy
-	proxy := newReverseProxy(u, upstream, errorHandler)
+	backend := newUpstreamBackend(upstream, u, 1, credentials, clientTLS, errorHandler, metrics)
+	proxy, wsProxy := backend.handler, backend.wsHandler
+	backends := []*upstreamBackend{backend}
+	var health *healthChecker
+	if len(upstream.Backends) > 0 || upstream.HealthCheck != nil {
+		for _, b := range upstream.Backends {
+			target, err := url.Parse(b.URI)
+			if err != nil {
+				return nil, fmt.Errorf("invalid backend %q: %v", b.URI, err)
+			}
+			target.Path = ""
+			backends = append(backends, newUpstreamBackend(upstream, target, b.Weight, credentials, clientTLS, errorHandler, metrics))
+		}
 
-	// Set up a WebSocket proxy if required
-	var wsProxy http.Handler
-	if upstream.ProxyWebSockets == nil || *upstream.ProxyWebSockets {
-		wsProxy = newWebSocketReverseProxy(u, upstream.InsecureSkipTLSVerify)
+		var fallback *upstreamBackend
+		if upstream.HealthCheck != nil {
+			var fallbackURL *url.URL
+			if upstream.HealthCheck.FallbackURI != "" {
+				fallbackURL, err = url.Parse(upstream.HealthCheck.FallbackURI)
+				if err != nil {
+					return nil, fmt.Errorf("invalid fallback: %v", err)
+				}
+				fallbackURL.Path = ""
+				// The DNS of the fallback isn't balanced
+				fallbackUpstream := upstream
+				fallbackUpstream.DNSRefreshInterval = nil
+				fallback = newUpstreamBackend(fallbackUpstream, fallbackURL, 1, credentials, clientTLS, errorHandler, metrics)
+			}
+			health = newHealthChecker(upstream, backends, fallbackURL, credentials, healthMetrics)
+			health.Start(nil)
+		}
+
+		balancer := newBackendBalancer(upstream, backends, fallback, errorHandler, balancerMetrics)
+		proxy = http.HandlerFunc(balancer.serveHTTP)
+		if wsProxy != nil {
+			wsProxy = http.HandlerFunc(balancer.serveWebSocket)
+		}
+		if fallback != nil {
+			backends = append(backends, fallback)
+		}
 	}
 
 	var auth hmacauth.HmacAuth
-	if sigData != nil {
+	if sigData != nil && !upstream.DisableSignature {
 		auth = hmacauth.NewHmacAuth(sigData.Hash, []byte(sigData.Key), SignatureHeader, SignatureHeaders)
 	}
 
 	return &httpUpstreamProxy{
-		upstream:  upstream.ID,
+		upstream:          upstream.ID,
+		handler:           proxy,
+		wsHandler:         wsProxy,
+		auth:              auth,
+		pathRewrite:       newUpstreamPathRewrite(upstream),
+		rewrite:           rewrite,
+		errorHandler:      errorHandler,
+		sendGAPAuth:       !upstream.DisableIdentityHeaders,
+		retryStreamErrors: upstream.RetryStreamErrors,
+		retry:             newRetryPolicy(upstream),
+		buffering:         newResponseBuffering(upstream),
+		streamMetrics:     streamMetrics,
+		mirror:            mirror,
+		health:            health,
+		backends:          backends,
+	}, nil
+}
+
+// newUpstreamBackend creates the reverse proxies of one of the servers of the
+// upstream, and of its WebSocket connections when they are proxied
+func newUpstreamBackend(upstream options.Upstream, u *url.URL, weight int, credentials http.Header, clientTLS *upstreamClientTLS, errorHandler ProxyErrorHandler, metrics *dnsMetrics) *upstreamBackend {
+	// Create a ReverseProxy
+	proxy := newReverseProxy(u, upstream, errorHandler)
+	setProxyCredentials(proxy, credentials)
+	clientTLS.configure(proxy.Transport.(*http.Transport))
+	// Rewritten responses refer to the server they were sent by
+	if rewrite := newResponseRewrite(upstream, u); rewrite != nil {
+		proxy.ModifyResponse = rewrite.modifyResponse
+	}
+	setProxyStreamAttempt(proxy)
+
+	// The DNS balancer only balances the connections of upstreams with a
+	// single server
+	var balancer *dnsBalancer
+	if upstream.DNSRefreshInterval != nil && len(upstream.Backends) == 0 {
+		balancer = newDNSBalancer(upstream, u.Hostname(), metrics)
+		balancer.attach(proxy.Transport.(*http.Transport))
+	}
+
+	backend := &upstreamBackend{
+		target:    u,
+		host:      u.Host,
+		weight:    weight,
 		handler:   proxy,
-		wsHandler: wsProxy,
-		auth:      auth,
+		transport: proxy.Transport.(*http.Transport),
+		dns:       balancer,
+	}
+
+	// Set up a WebSocket proxy if required
+	if upstream.ProxyWebSockets == nil || *upstream.ProxyWebSockets {
+		ws := newWebSocketReverseProxy(u, upstream)
+		setProxyCredentials(ws, credentials)
+		clientTLS.configure(ws.Transport.(*http.Transport))
+		if balancer != nil {
+			balancer.attach(ws.Transport.(*http.Transport))
+		}
+		// The idle timeout wraps the connections dialed by the balancer
+		if upstream.WebSocketIdleTimeout != nil {
+			setWebSocketIdleTimeout(ws.Transport.(*http.Transport), upstream.WebSocketIdleTimeout.Duration())
+		}
+		backend.wsHandler = ws
+		backend.wsTransport = ws.Transport.(*http.Transport)
 	}
+	return backend
 }
 
 // httpUpstreamProxy represents a single HTTP(S) upstream proxy
 type httpUpstreamProxy struct {
-	upstream  string
-	handler   http.Handler
-	wsHandler http.Handler
-	auth      hmacauth.HmacAuth
+	upstream     string
+	handler      http.Handler
+	wsHandler    http.Handler
+	auth         hmacauth.HmacAuth
+	pathRewrite  upstreamPathRewrite
+	errorHandler ProxyErrorHandler
+
+	// rewrite is set when the upstream responses are rewritten
+	rewrite *responseRewrite
+
+	// sendGAPAuth is unset when identity headers are disabled for the
+	// upstream, so that signed requests don't include the GAP-Auth header
+	sendGAPAuth bool
+
+	// retryStreamErrors is set when requests whose upstream response fails
+	// before any of the body is sent are retried once
+	retryStreamErrors bool
+	streamMetrics     *streamMetrics
+
+	// retry is set when the attempts failing to reach the upstream, or
+	// answered with a retryable status, are retried
+	retry *retryPolicy
+
+	// buffering is set when the responses are buffered, or streamed by
+	// content type
+	buffering *responseBuffering
+
+	// mirror is set when a sample of the requests is mirrored
+	mirror *requestMirror
+
+	// health is set when the servers of the upstream are health checked
+	health *healthChecker
+
+	// backends are the servers of the upstream, including its fallback, so
+	// that they can be closed once the upstream is replaced by a reload
+	backends []*upstreamBackend
 }
 
 // ServeHTTP proxies requests to the upstream provider while signing the
@@ -79,33 +231,130 @@ func (h *httpUpstreamProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	// If scope is nil, this will panic.
 	// A scope should always be injected before this handler is called.
 	scope.Upstream = h.upstream
+	logger.DebugfContext(req.Context(), "Routing %s %s to upstream %q", req.Method, req.URL.Path, h.upstream)
+
+	// Rewrite the path before signing so that the signature matches the
+	// request received by the upstream
+	if err := h.pathRewrite.rewrite(req); err != nil {
+		h.handleError(rw, req, err)
+		return
+	}
 
 	// TODO (@NickMeves) - Deprecate GAP-Signature & remove GAP-Auth
 	if h.auth != nil {
-		req.Header.Set("GAP-Auth", rw.Header().Get("GAP-Auth"))
+		if h.sendGAPAuth {
+			req.Header.Set("GAP-Auth", rw.Header().Get("GAP-Auth"))
+		}
 		h.auth.SignRequest(req)
 	}
+	// The mirror is sent a copy of the request received by the upstream, once
+	// the upstream has responded
+	if h.mirror != nil {
+		if send := h.mirror.capture(req); send != nil {
+			defer send()
+		}
+	}
 	if h.wsHandler != nil && strings.EqualFold(req.Header.Get("Connection"), "upgrade") && req.Header.Get("Upgrade") == "websocket" {
+		// WebSocket connections aren't traced, but carry on the trace of the
+		// request they are upgraded from
+		tracing.Inject(req.Context(), req.Header)
 		h.wsHandler.ServeHTTP(rw, req)
-	} else {
-		h.handler.ServeHTTP(rw, req)
+		return
+	}
+	if h.rewrite != nil {
+		req = h.rewrite.prepareRequest(req)
+	}
+	if h.buffering != nil {
+		// Aborted responses panic, so a partly buffered response is never
+		// sent as if it were complete
+		buffered := h.buffering.wrap(rw, req)
+		h.serveStream(buffered, req)
+		buffered.finish()
+		return
+	}
+	h.serveStream(rw, req)
+}
+
+// handleError renders the error with the errorHandler, if one was provided.
+func (h *httpUpstreamProxy) handleError(rw http.ResponseWriter, req *http.Request, err error) {
+	if h.errorHandler != nil {
+		h.errorHandler(rw, req, err)
+		return
+	}
+	logger.Errorf("Error proxying to upstream server: %v", err)
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// upstreamPathRewrite strips the upstream path from, and then prepends a path
+// to, request paths before they are proxied to the upstream.
+type upstreamPathRewrite struct {
+	stripPrefix string
+	prependPath string
+}
+
+// newUpstreamPathRewrite creates the path rewrite for the StripPath and
+// PrependPath options of the upstream.
+func newUpstreamPathRewrite(upstream options.Upstream) upstreamPathRewrite {
+	rewrite := upstreamPathRewrite{
+		prependPath: strings.TrimSuffix(upstream.PrependPath, "/"),
+	}
+	if upstream.StripPath {
+		rewrite.stripPrefix = strings.TrimSuffix(upstream.Path, "/")
+	}
+	return rewrite
+}
+
+// rewrite updates the request path and RequestURI.
+// The prefix is stripped before the path is prepended, and a request for
+// exactly the prefix is proxied to the root of the prepended path.
+// Eg: With a Path of `/service/`, StripPath and a PrependPath of `/api`:
+// - `/service/foo` is proxied as `/api/foo`
+// - `/service/` is proxied as `/api/`
+// The escaped path is rewritten so that encoded characters are kept.
+func (r upstreamPathRewrite) rewrite(req *http.Request) error {
+	if r.stripPrefix == "" && r.prependPath == "" {
+		return nil
+	}
+
+	reqURL, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		return fmt.Errorf("could not parse request URI: %v", err)
 	}
+
+	rawPath := reqURL.EscapedPath()
+	if r.stripPrefix != "" {
+		if !strings.HasPrefix(rawPath, r.stripPrefix) {
+			// The route matched the unescaped path, so strip from that instead
+			rawPath = (&url.URL{Path: reqURL.Path}).EscapedPath()
+		}
+		rawPath = strings.TrimPrefix(rawPath, r.stripPrefix)
+		if !strings.HasPrefix(rawPath, "/") {
+			rawPath = "/" + rawPath
+		}
+	}
+	rawPath = r.prependPath + rawPath
+
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("could not unescape rewritten path %q: %v", rawPath, err)
+	}
+	reqURL.Path, reqURL.RawPath = path, rawPath
+	req.URL.Path, req.URL.RawPath = path, rawPath
+	req.RequestURI = reqURL.String()
+	return nil
 }
 
 // newReverseProxy creates a new reverse proxy for proxying requests to upstream
 // servers based on the upstream configuration provided.
 // The proxy should render an error page if there are failures connecting to the
 // upstream server.
-func newReverseProxy(target *url.URL, upstream options.Upstream, errorHandler ProxyErrorHandler) http.Handler {
+func newReverseProxy(target *url.URL, upstream options.Upstream, errorHandler ProxyErrorHandler) *httputil.ReverseProxy {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
 	// Inherit default transport options from Go's stdlib
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 
-	// Change default duration for waiting for an upstream response
-	if upstream.Timeout != nil {
-		transport.ResponseHeaderTimeout = upstream.Timeout.Duration()
-	}
+	configureUpstreamTransport(transport, upstream)
 
 	// Configure options on the SingleHostReverseProxy
 	if upstream.FlushInterval != nil {
@@ -119,6 +368,10 @@ func newReverseProxy(target *url.URL, upstream options.Upstream, errorHandler Pr
 	if upstream.InsecureSkipTLSVerify {
 		transport.TLSClientConfig.InsecureSkipVerify = true
 	}
+	configureUpstreamTLS(transport, upstream)
+	if target.Scheme == h2cScheme {
+		configureH2CTransport(transport)
+	}
 
 	// Ensure we always pass the original request path
 	setProxyDirector(proxy)
@@ -163,16 +416,19 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 }
 
 // newWebSocketReverseProxy creates a new reverse proxy for proxying websocket connections.
-func newWebSocketReverseProxy(u *url.URL, skipTLSVerify bool) http.Handler {
-	wsProxy := httputil.NewSingleHostReverseProxy(u)
+func newWebSocketReverseProxy(u *url.URL, upstream options.Upstream) *httputil.ReverseProxy {
+	// WebSocket connections to h2c upstreams are upgraded over HTTP/1.1
+	wsProxy := httputil.NewSingleHostReverseProxy(toHTTPURL(u))
 
 	// Inherit default transport options from Go's stdlib
 	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newUpstreamDialContext(upstream)
 
 	/* #nosec G402 */
-	if skipTLSVerify {
+	if upstream.InsecureSkipTLSVerify {
 		transport.TLSClientConfig.InsecureSkipVerify = true
 	}
+	configureUpstreamTLS(transport, upstream)
 
 	// Apply the customized transport to our proxy before returning it
 	wsProxy.Transport = transport
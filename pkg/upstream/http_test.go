@@ -75,7 +75,8 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			u, err := url.Parse(*in.serverAddr)
 			Expect(err).ToNot(HaveOccurred())
 
-			handler := newHTTPUpstreamProxy(upstream, u, in.signatureData, in.errorHandler)
+			handler, err := newHTTPUpstreamProxy(upstream, u, in.signatureData, in.errorHandler, nil, nil, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 			handler.ServeHTTP(rw, req)
 
 			Expect(rw.Code).To(Equal(in.expectedResponse.code))
@@ -331,22 +332,26 @@ var _ = Describe("HTTP Upstream Suite", func() {
 		u, err := url.Parse(serverAddr)
 		Expect(err).ToNot(HaveOccurred())
 
-		handler := newHTTPUpstreamProxy(upstream, u, nil, nil)
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
 		httpUpstream, ok := handler.(*httpUpstreamProxy)
 		Expect(ok).To(BeTrue())
 
 		// Override the handler to just run the director and not actually send the request
+		var proxied *http.Request
 		requestInterceptor := func(h http.Handler) http.Handler {
 			return http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
 				proxy, ok := h.(*httputil.ReverseProxy)
 				Expect(ok).To(BeTrue())
 				proxy.Director(req)
+				proxied = req
 			})
 		}
 		httpUpstream.handler = requestInterceptor(httpUpstream.handler)
 
 		httpUpstream.ServeHTTP(rw, req)
-		Expect(req.Host).To(Equal(strings.TrimPrefix(serverAddr, "http://")))
+		Expect(proxied).ToNot(BeNil())
+		Expect(proxied.Host).To(Equal(strings.TrimPrefix(serverAddr, "http://")))
 	})
 
 	type newUpstreamTableInput struct {
@@ -371,7 +376,8 @@ var _ = Describe("HTTP Upstream Suite", func() {
 				Timeout:               &in.timeout,
 			}
 
-			handler := newHTTPUpstreamProxy(upstream, u, in.sigData, in.errorHandler)
+			handler, err := newHTTPUpstreamProxy(upstream, u, in.sigData, in.errorHandler, nil, nil, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 			upstreamProxy, ok := handler.(*httpUpstreamProxy)
 			Expect(ok).To(BeTrue())
 
@@ -386,7 +392,9 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			transport, ok := proxy.Transport.(*http.Transport)
 			Expect(ok).To(BeTrue())
 			Expect(transport.ResponseHeaderTimeout).To(Equal(in.timeout.Duration()))
-			Expect(proxy.ErrorHandler != nil).To(Equal(in.errorHandler != nil))
+			// The proxies always have an error handler, so that the errors of
+			// attempts that are retried can be held back
+			Expect(proxy.ErrorHandler).ToNot(BeNil())
 			if in.skipVerify {
 				Expect(transport.TLSClientConfig.InsecureSkipVerify).To(Equal(true))
 			}
@@ -461,9 +469,10 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			u, err := url.Parse(serverAddr)
 			Expect(err).ToNot(HaveOccurred())
 
-			handler := newHTTPUpstreamProxy(upstream, u, nil, nil)
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 
-			proxyServer = httptest.NewServer(middleware.NewScope(false, "X-Request-Id")(handler))
+			proxyServer = httptest.NewServer(middleware.NewScope(false, "X-Request-Id", func(*http.Request) bool { return true })(handler))
 		})
 
 		AfterEach(func() {
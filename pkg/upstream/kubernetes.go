@@ -0,0 +1,316 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// kubernetesServiceAccountDir is where the token, CA and namespace of
+	// the service account are mounted in pods
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// kubernetesWatchTimeout is how long the API server keeps a watch open
+	// before it is resumed
+	kubernetesWatchTimeout = 5 * time.Minute
+
+	// kubernetesMinBackoff and kubernetesMaxBackoff bound the wait before
+	// listing or watching again after a failure, which is doubled for each
+	// consecutive failure
+	kubernetesMinBackoff = time.Second
+	kubernetesMaxBackoff = 30 * time.Second
+)
+
+// errKubernetesWatchExpired is returned by watches whose resource version is
+// too old, the objects have to be listed again
+var errKubernetesWatchExpired = errors.New("the resource version of the watch has expired")
+
+// kubernetesObjectMeta is the metadata of a Kubernetes object
+type kubernetesObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+// kubernetesList is a list of Kubernetes objects, with the resource version
+// the objects can be watched from
+type kubernetesList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// kubernetesWatchEvent is an event of a watch of Kubernetes objects
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubernetesStatus is the status the API server responds with on errors
+type kubernetesStatus struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// kubernetesClient lists and watches the objects of the Kubernetes API
+// server, authenticating with the token of the service account of the pod
+type kubernetesClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// newInClusterKubernetesClient creates the client of the API server of the
+// cluster the pod runs in, from its environment and service account
+func newInClusterKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CA of the Kubernetes API server: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("could not parse the CA of the Kubernetes API server")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(kubernetesServiceAccountDir, "token"),
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// inClusterKubernetesNamespace returns the namespace of the pod
+func inClusterKubernetesNamespace() (string, error) {
+	namespace, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace"))
+	if err != nil {
+		return "", fmt.Errorf("could not read the namespace of the pod: %v", err)
+	}
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+// get requests the path of the API server, returning the response when it
+// is successful. The token is read for every request, as it is rotated by
+// the kubelet.
+func (c *kubernetesClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the service account token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	status := kubernetesStatus{}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(body, &status); err != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(body))
+	}
+	if resp.StatusCode == http.StatusGone {
+		return nil, errKubernetesWatchExpired
+	}
+	return nil, fmt.Errorf("unexpected status %d from %s: %s", resp.StatusCode, path, status.Message)
+}
+
+// list lists the objects of the path matching the label selector
+func (c *kubernetesClient) list(ctx context.Context, path, selector string) (kubernetesList, error) {
+	list := kubernetesList{}
+	resp, err := c.get(ctx, path, url.Values{"labelSelector": {selector}})
+	if err != nil {
+		return list, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return list, fmt.Errorf("could not decode the list of %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// watch watches the objects of the path matching the label selector, from
+// the resource version, calling the handler with each event until the API
+// server ends the watch or the context is cancelled
+func (c *kubernetesClient) watch(ctx context.Context, path, selector, version string, handler func(kubernetesWatchEvent)) error {
+	resp, err := c.get(ctx, path, url.Values{
+		"labelSelector":   {selector},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {fmt.Sprintf("%d", int(kubernetesWatchTimeout.Seconds()))},
+		"watch":           {"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := kubernetesWatchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("could not decode the watch of %s: %v", path, err)
+		}
+
+		if event.Type == "ERROR" {
+			status := kubernetesStatus{}
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return fmt.Errorf("could not decode the error of the watch of %s: %v", path, err)
+			}
+			if status.Code == http.StatusGone {
+				return errKubernetesWatchExpired
+			}
+			return fmt.Errorf("watch of %s failed: %s", path, status.Message)
+		}
+		handler(event)
+	}
+}
+
+// kubernetesInformer keeps the objects of a path, selected by label, in sync
+// with the API server: they are listed, and then watched for changes from
+// the version listed, and listed again whenever the watch can't be resumed.
+// The objects are given to update, by name, every time they change.
+type kubernetesInformer struct {
+	client   *kubernetesClient
+	path     string
+	selector string
+	update   func(objects map[string]json.RawMessage)
+
+	objects map[string]json.RawMessage
+}
+
+// list lists the objects, replacing those previously listed or watched, and
+// returns the resource version to watch them from
+func (i *kubernetesInformer) list(ctx context.Context) (string, error) {
+	list, err := i.client.list(ctx, i.path, i.selector)
+	if err != nil {
+		return "", err
+	}
+
+	i.objects = map[string]json.RawMessage{}
+	for _, item := range list.Items {
+		object := struct {
+			Metadata kubernetesObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(item, &object); err != nil {
+			return "", fmt.Errorf("could not decode the list of %s: %v", i.path, err)
+		}
+		i.objects[object.Metadata.Name] = item
+	}
+	i.notify()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// apply updates the objects with the event of a watch, returning the
+// resource version of the object
+func (i *kubernetesInformer) apply(event kubernetesWatchEvent) string {
+	object := struct {
+		Metadata kubernetesObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(event.Object, &object); err != nil {
+		logger.Errorf("Error decoding the watch event of %s: %v", i.path, err)
+		return ""
+	}
+
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		i.objects[object.Metadata.Name] = event.Object
+	case "DELETED":
+		delete(i.objects, object.Metadata.Name)
+	default:
+		// Bookmarks only move the resource version forward
+		return object.Metadata.ResourceVersion
+	}
+	i.notify()
+	return object.Metadata.ResourceVersion
+}
+
+// notify gives a copy of the objects to update
+func (i *kubernetesInformer) notify() {
+	objects := make(map[string]json.RawMessage, len(i.objects))
+	for name, object := range i.objects {
+		objects[name] = object
+	}
+	i.update(objects)
+}
+
+// run watches the objects from the resource version until the context is
+// cancelled, listing them again when the watch has expired, and waiting
+// before trying again when the API server can't be reached
+func (i *kubernetesInformer) run(ctx context.Context, version string) {
+	backoff := kubernetesMinBackoff
+	for ctx.Err() == nil {
+		var err error
+		if version == "" {
+			version, err = i.list(ctx)
+		} else {
+			err = i.client.watch(ctx, i.path, i.selector, version, func(event kubernetesWatchEvent) {
+				if v := i.apply(event); v != "" {
+					version = v
+				}
+			})
+			if errors.Is(err, errKubernetesWatchExpired) {
+				version = ""
+				continue
+			}
+		}
+		if err == nil {
+			backoff = kubernetesMinBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Errorf("Error watching %s, retrying in %s: %v", i.path, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > kubernetesMaxBackoff {
+			backoff = kubernetesMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// KubernetesUpstreamRegistered is the state of the Services whose
+	// upstream serves requests with their ready endpoints
+	KubernetesUpstreamRegistered = "registered"
+
+	// KubernetesUpstreamRejected is the state of the Services that couldn't
+	// be registered, they are retried when they change
+	KubernetesUpstreamRejected = "rejected"
+
+	// KubernetesUpstreamUnavailable is the state of the Services without
+	// any ready endpoints, whose upstream responds with a 503
+	KubernetesUpstreamUnavailable = "unavailable"
+
+	// KubernetesUpstreamAnnotation is the annotation of a Service with the
+	// JSON upstream options of its upstream
+	KubernetesUpstreamAnnotation = "oauth2-proxy.github.io/upstream"
+
+	// KubernetesPortAnnotation is the annotation of a Service with the name
+	// or number of the port of its upstream
+	KubernetesPortAnnotation = "oauth2-proxy.github.io/port"
+
+	// kubernetesServiceNameLabel is the label of the EndpointSlices with the
+	// name of their Service
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+)
+
+// kubernetesService is a Kubernetes Service
+type kubernetesService struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []kubernetesServicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+// kubernetesServicePort is a port of a Kubernetes Service
+type kubernetesServicePort struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	AppProtocol string `json:"appProtocol"`
+}
+
+// kubernetesEndpointSlice is a Kubernetes EndpointSlice
+type kubernetesEndpointSlice struct {
+	Metadata    kubernetesObjectMeta `json:"metadata"`
+	AddressType string               `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+// KubernetesUpstreamEntry is the state of a Service discovered as an
+// upstream
+type KubernetesUpstreamEntry struct {
+	Service   string `json:"service"`
+	State     string `json:"state"`
+	ID        string `json:"id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Endpoints int    `json:"endpoints"`
+	Error     string `json:"error,omitempty"`
+}
+
+// KubernetesDiscovery registers the Services of a Kubernetes namespace that
+// match a label selector as upstreams with a DynamicRouter, balancing each
+// upstream across the ready endpoints of the EndpointSlices of its Service.
+// The upstreams are registered again whenever a Service or EndpointSlice
+// changes.
+type KubernetesDiscovery struct {
+	client    *kubernetesClient
+	namespace string
+	selector  string
+	router    DynamicRouter
+	validate  DynamicUpstreamValidator
+	metrics   *kubernetesDiscoveryMetrics
+
+	mutex    sync.Mutex
+	services map[string]json.RawMessage
+	slices   map[string]json.RawMessage
+	listed   bool
+	entries  []KubernetesUpstreamEntry
+}
+
+// NewKubernetesDiscovery creates a KubernetesDiscovery for the Kubernetes
+// discovery options, with the API server of the cluster the pod runs in.
+// The upstreams aren't registered until Watch is called.
+func NewKubernetesDiscovery(opts options.KubernetesDiscovery, router DynamicRouter, validate DynamicUpstreamValidator, registerer prometheus.Registerer) (*KubernetesDiscovery, error) {
+	client, err := newInClusterKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace, err = inClusterKubernetesNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newKubernetesDiscovery(client, namespace, opts.Selector, router, validate, registerer), nil
+}
+
+// newKubernetesDiscovery creates a KubernetesDiscovery with the client
+func newKubernetesDiscovery(client *kubernetesClient, namespace, selector string, router DynamicRouter, validate DynamicUpstreamValidator, registerer prometheus.Registerer) *KubernetesDiscovery {
+	return &KubernetesDiscovery{
+		client:    client,
+		namespace: namespace,
+		selector:  selector,
+		router:    router,
+		validate:  validate,
+		metrics:   newKubernetesDiscoveryMetrics(registerer),
+		services:  map[string]json.RawMessage{},
+		slices:    map[string]json.RawMessage{},
+	}
+}
+
+// Watch lists the Services and EndpointSlices and registers their upstreams,
+// and then watches them for changes in the background until done is closed.
+// Errors listing them at first are returned, later errors are logged and
+// retried without changing the upstreams.
+func (d *KubernetesDiscovery) Watch(done <-chan bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// A nil done is never closed, the upstreams are watched until exit
+		<-done
+		cancel()
+	}()
+
+	informers := []*kubernetesInformer{
+		{
+			client:   d.client,
+			path:     fmt.Sprintf("/api/v1/namespaces/%s/services", d.namespace),
+			selector: d.selector,
+			update:   d.updateServices,
+		},
+		{
+			client:   d.client,
+			path:     fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", d.namespace),
+			selector: d.selector,
+			update:   d.updateSlices,
+		},
+	}
+
+	versions := make([]string, len(informers))
+	for i, informer := range informers {
+		version, err := informer.list(ctx)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("could not list the upstreams of namespace %q: %v", d.namespace, err)
+		}
+		versions[i] = version
+	}
+	d.mutex.Lock()
+	d.listed = true
+	d.sync()
+	d.mutex.Unlock()
+
+	for i, informer := range informers {
+		go informer.run(ctx, versions[i])
+	}
+	return nil
+}
+
+// updateServices replaces the Services and registers their upstreams again,
+// once both the Services and EndpointSlices have been listed
+func (d *KubernetesDiscovery) updateServices(services map[string]json.RawMessage) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.services = services
+	if d.listed {
+		d.sync()
+	}
+}
+
+// updateSlices replaces the EndpointSlices and registers the upstreams
+// again, once both the Services and EndpointSlices have been listed
+func (d *KubernetesDiscovery) updateSlices(slices map[string]json.RawMessage) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.slices = slices
+	if d.listed {
+		d.sync()
+	}
+}
+
+// sync replaces the dynamic upstreams of the router with the upstreams of
+// the Services, sorted by name, that are valid.
+// Services that can't be registered are logged and skipped, they never
+// prevent the other upstreams from being registered.
+func (d *KubernetesDiscovery) sync() {
+	slices := map[string][]kubernetesEndpointSlice{}
+	for name, raw := range d.slices {
+		slice := kubernetesEndpointSlice{}
+		if err := json.Unmarshal(raw, &slice); err != nil {
+			logger.Errorf("Error decoding EndpointSlice %q: %v", name, err)
+			continue
+		}
+		service := slice.Metadata.Labels[kubernetesServiceNameLabel]
+		slices[service] = append(slices[service], slice)
+	}
+
+	names := make([]string, 0, len(d.services))
+	for name := range d.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := []KubernetesUpstreamEntry{}
+	accepted := []options.Upstream{}
+	for _, name := range names {
+		entry, upstream := d.loadService(name, slices[name])
+		if entry.State != KubernetesUpstreamRejected {
+			if err := d.validate(options.DynamicUpstream{Upstream: upstream}, accepted); err != nil {
+				entry.State = KubernetesUpstreamRejected
+				entry.Error = err.Error()
+			} else {
+				if entry.State == KubernetesUpstreamUnavailable {
+					upstream = unavailableUpstream(upstream)
+				}
+				accepted = append(accepted, upstream)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	errs := d.router.SetDynamicUpstreams(accepted)
+	for i, entry := range entries {
+		if err, ok := errs[entry.ID]; ok && entry.State != KubernetesUpstreamRejected {
+			entries[i].State = KubernetesUpstreamRejected
+			entries[i].Error = err.Error()
+		}
+	}
+	d.logChanges(entries)
+	d.entries = entries
+	d.updateMetrics()
+}
+
+// loadService creates the upstream of the Service from its annotations,
+// with the ready endpoints of its EndpointSlices, and returns its entry in
+// the registered state, or the unavailable state when it has no ready
+// endpoints, unless it couldn't be parsed.
+// The URI of upstreams without ready endpoints is the cluster DNS name of
+// the Service, so that they can be validated.
+func (d *KubernetesDiscovery) loadService(name string, slices []kubernetesEndpointSlice) (KubernetesUpstreamEntry, options.Upstream) {
+	entry := KubernetesUpstreamEntry{
+		Service: name,
+		State:   KubernetesUpstreamRejected,
+	}
+	upstream := options.Upstream{}
+
+	service := kubernetesService{}
+	if err := json.Unmarshal(d.services[name], &service); err != nil {
+		entry.Error = fmt.Sprintf("invalid Service: %v", err)
+		return entry, upstream
+	}
+	if raw, ok := service.Metadata.Annotations[KubernetesUpstreamAnnotation]; ok {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&upstream); err != nil {
+			entry.Error = fmt.Sprintf("invalid %s annotation: %v", KubernetesUpstreamAnnotation, err)
+			return entry, upstream
+		}
+	}
+	if upstream.ID == "" {
+		upstream.ID = fmt.Sprintf("%s/%s", d.namespace, name)
+	}
+	if upstream.Path == "" {
+		upstream.Path = fmt.Sprintf("/%s/", name)
+	}
+	entry.ID = upstream.ID
+	entry.Path = upstream.Path
+
+	if upstream.URI != "" || len(upstream.Backends) > 0 {
+		entry.Error = fmt.Sprintf("invalid %s annotation: the uri and backends are the endpoints of the Service", KubernetesUpstreamAnnotation)
+		return entry, upstream
+	}
+	port, err := selectServicePort(service)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry, upstream
+	}
+	scheme := "http"
+	if port.AppProtocol == "https" || port.Name == "https" {
+		scheme = "https"
+	}
+
+	endpoints := readyEndpoints(slices, port, scheme)
+	entry.Endpoints = len(endpoints)
+	if len(endpoints) == 0 {
+		upstream.URI = fmt.Sprintf("%s://%s.%s.svc:%d", scheme, name, d.namespace, port.Port)
+		entry.State = KubernetesUpstreamUnavailable
+		return entry, upstream
+	}
+	upstream.URI = endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		upstream.Backends = append(upstream.Backends, options.UpstreamBackend{URI: endpoint})
+	}
+	entry.State = KubernetesUpstreamRegistered
+	return entry, upstream
+}
+
+// selectServicePort returns the port of the Service named or numbered by its
+// port annotation, or its only port when it has none
+func selectServicePort(service kubernetesService) (kubernetesServicePort, error) {
+	ports := service.Spec.Ports
+	selected, ok := service.Metadata.Annotations[KubernetesPortAnnotation]
+	if !ok {
+		if len(ports) != 1 {
+			return kubernetesServicePort{}, fmt.Errorf("the Service has %d ports: select one with the %s annotation", len(ports), KubernetesPortAnnotation)
+		}
+		return ports[0], nil
+	}
+
+	for _, port := range ports {
+		if port.Name == selected || strconv.Itoa(port.Port) == selected {
+			return port, nil
+		}
+	}
+	return kubernetesServicePort{}, fmt.Errorf("the Service has no port %q", selected)
+}
+
+// readyEndpoints returns the sorted URIs of the ready endpoints of the
+// EndpointSlices, with the target of the Service port.
+// Endpoints without a ready condition are ready, as the condition is
+// optional, and only the first address of each endpoint is used, as the
+// others are the same endpoint.
+func readyEndpoints(slices []kubernetesEndpointSlice, port kubernetesServicePort, scheme string) []string {
+	uris := map[string]struct{}{}
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		target := 0
+		for _, slicePort := range slice.Ports {
+			name := ""
+			if slicePort.Name != nil {
+				name = *slicePort.Name
+			}
+			if name == port.Name && slicePort.Port != nil {
+				target = *slicePort.Port
+			}
+		}
+		if target == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 || (endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			uris[fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(target)))] = struct{}{}
+		}
+	}
+
+	sorted := make([]string, 0, len(uris))
+	for uri := range uris {
+		sorted = append(sorted, uri)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// unavailableUpstream returns the static upstream registered in place of
+// the upstream of a Service without ready endpoints, so that its requests
+// aren't routed to the configured upstreams
+func unavailableUpstream(upstream options.Upstream) options.Upstream {
+	code := http.StatusServiceUnavailable
+	return options.Upstream{
+		ID:         upstream.ID,
+		Path:       upstream.Path,
+		Static:     true,
+		StaticCode: &code,
+	}
+}
+
+// logChanges logs the Services whose state differs from the previous sync
+func (d *KubernetesDiscovery) logChanges(entries []KubernetesUpstreamEntry) {
+	previous := map[string]KubernetesUpstreamEntry{}
+	for _, entry := range d.entries {
+		previous[entry.Service] = entry
+	}
+	for _, entry := range entries {
+		if prev, ok := previous[entry.Service]; ok && prev == entry {
+			continue
+		}
+		switch entry.State {
+		case KubernetesUpstreamRegistered:
+			logger.Printf("Registered Kubernetes upstream %q from Service %q for path %q with %d endpoints", entry.ID, entry.Service, entry.Path, entry.Endpoints)
+		case KubernetesUpstreamUnavailable:
+			logger.Errorf("Kubernetes upstream %q from Service %q has no ready endpoints", entry.ID, entry.Service)
+		default:
+			logger.Errorf("Rejected Kubernetes upstream from Service %q: %s", entry.Service, entry.Error)
+		}
+	}
+}
+
+// updateMetrics counts the entries by state
+func (d *KubernetesDiscovery) updateMetrics() {
+	counts := map[string]int{
+		KubernetesUpstreamRegistered:  0,
+		KubernetesUpstreamRejected:    0,
+		KubernetesUpstreamUnavailable: 0,
+	}
+	for _, entry := range d.entries {
+		counts[entry.State]++
+	}
+	for state, count := range counts {
+		d.metrics.upstreams.WithLabelValues(state).Set(float64(count))
+	}
+}
+
+// Entries returns the state of the Services as of the last sync, sorted by
+// name
+func (d *KubernetesDiscovery) Entries() []KubernetesUpstreamEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]KubernetesUpstreamEntry{}, d.entries...)
+}
@@ -0,0 +1,255 @@
+package upstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Kubernetes Discovery Suite", func() {
+	const (
+		servicesPath = "/api/v1/namespaces/apps/services"
+		slicesPath   = "/apis/discovery.k8s.io/v1/namespaces/apps/endpointslices"
+	)
+
+	var api *fakeKubernetesAPI
+	var server *httptest.Server
+	var router *fakeDynamicRouter
+	var discovery *KubernetesDiscovery
+	var done chan bool
+	var dir string
+
+	service := func(name string, annotations map[string]string, ports ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":        name,
+				"namespace":   "apps",
+				"labels":      map[string]string{"oauth2-proxy/expose": "true"},
+				"annotations": annotations,
+			},
+			"spec": map[string]interface{}{"ports": ports},
+		}
+	}
+
+	port := func(name string, number int) map[string]interface{} {
+		return map[string]interface{}{"name": name, "port": number}
+	}
+
+	endpoint := func(address string, ready bool) map[string]interface{} {
+		return map[string]interface{}{
+			"addresses":  []string{address},
+			"conditions": map[string]interface{}{"ready": ready},
+		}
+	}
+
+	slice := func(name, service, version string, portName string, target int, endpoints ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":            name,
+				"namespace":       "apps",
+				"resourceVersion": version,
+				"labels": map[string]string{
+					"oauth2-proxy/expose":        "true",
+					"kubernetes.io/service-name": service,
+				},
+			},
+			"addressType": "IPv4",
+			"endpoints":   endpoints,
+			"ports":       []map[string]interface{}{{"name": portName, "port": target}},
+		}
+	}
+
+	BeforeEach(func() {
+		api = newFakeKubernetesAPI()
+		server = httptest.NewServer(api)
+		router = &fakeDynamicRouter{}
+		done = make(chan bool)
+
+		var err error
+		dir, err = ioutil.TempDir("", "kubernetes-discovery")
+		Expect(err).ToNot(HaveOccurred())
+		tokenFile := filepath.Join(dir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("service-account-token"), 0600)).To(Succeed())
+
+		validate := func(upstream options.DynamicUpstream, accepted []options.Upstream) error {
+			for _, existing := range accepted {
+				if existing.Path == upstream.Path {
+					return errors.New("duplicate path")
+				}
+			}
+			return nil
+		}
+		client := &kubernetesClient{server: server.URL, tokenFile: tokenFile, client: server.Client()}
+		discovery = newKubernetesDiscovery(client, "apps", "oauth2-proxy/expose=true", router, validate, prometheus.NewRegistry())
+	})
+
+	AfterEach(func() {
+		close(done)
+		server.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// upstreams returns the upstreams of the router, which are set while the
+	// discovery is locked
+	upstreams := func() []options.Upstream {
+		discovery.mutex.Lock()
+		defer discovery.mutex.Unlock()
+		return router.upstreams
+	}
+
+	states := func() map[string]string {
+		result := map[string]string{}
+		for _, entry := range discovery.Entries() {
+			result[entry.Service] = entry.State
+		}
+		return result
+	}
+
+	count := func(state string) float64 {
+		return testutil.ToFloat64(discovery.metrics.upstreams.WithLabelValues(state))
+	}
+
+	It("registers the Services with their ready endpoints as backends", func() {
+		api.lists[servicesPath] = []interface{}{
+			service("app", nil, port("http", 80)),
+			service("api", map[string]string{
+				KubernetesUpstreamAnnotation: `{"path":"/v1/","passHostHeader":false}`,
+				KubernetesPortAnnotation:     "https",
+			}, port("metrics", 9090), map[string]interface{}{"name": "https", "port": 443, "appProtocol": "https"}),
+		}
+		api.lists[slicesPath] = []interface{}{
+			slice("app-a", "app", "1", "http", 8080, endpoint("10.0.0.2", true), endpoint("10.0.0.1", true), endpoint("10.0.0.3", false)),
+			slice("app-b", "app", "1", "http", 8080, endpoint("10.0.1.1", true)),
+			slice("api-a", "api", "1", "https", 8443, endpoint("10.0.2.1", true)),
+		}
+		Expect(discovery.Watch(done)).To(Succeed())
+
+		passHostHeader := false
+		Expect(upstreams()).To(Equal([]options.Upstream{
+			{
+				ID:             "apps/api",
+				Path:           "/v1/",
+				URI:            "https://10.0.2.1:8443",
+				PassHostHeader: &passHostHeader,
+			},
+			{
+				ID:   "apps/app",
+				Path: "/app/",
+				URI:  "http://10.0.0.1:8080",
+				Backends: []options.UpstreamBackend{
+					{URI: "http://10.0.0.2:8080"},
+					{URI: "http://10.0.1.1:8080"},
+				},
+			},
+		}))
+		Expect(discovery.Entries()).To(ContainElement(KubernetesUpstreamEntry{
+			Service:   "app",
+			State:     KubernetesUpstreamRegistered,
+			ID:        "apps/app",
+			Path:      "/app/",
+			Endpoints: 3,
+		}))
+		Expect(count(KubernetesUpstreamRegistered)).To(Equal(2.0))
+	})
+
+	It("rejects the Services that can't be registered, and registers the others", func() {
+		api.lists[servicesPath] = []interface{}{
+			service("app", nil, port("http", 80)),
+			service("ports", nil, port("http", 80), port("grpc", 9000)),
+			service("annotation", map[string]string{KubernetesUpstreamAnnotation: `{"paht":"/annotation/"}`}, port("http", 80)),
+			service("uri", map[string]string{KubernetesUpstreamAnnotation: `{"uri":"http://example.com"}`}, port("http", 80)),
+			service("duplicate", map[string]string{KubernetesUpstreamAnnotation: `{"path":"/app/"}`}, port("http", 80)),
+		}
+		api.lists[slicesPath] = []interface{}{
+			slice("app-a", "app", "1", "http", 8080, endpoint("10.0.0.1", true)),
+			slice("duplicate-a", "duplicate", "1", "http", 8080, endpoint("10.0.1.1", true)),
+		}
+		Expect(discovery.Watch(done)).To(Succeed())
+
+		Expect(upstreams()).To(HaveLen(1))
+		Expect(upstreams()[0].ID).To(Equal("apps/app"))
+		Expect(states()).To(Equal(map[string]string{
+			"annotation": KubernetesUpstreamRejected,
+			"app":        KubernetesUpstreamRegistered,
+			"duplicate":  KubernetesUpstreamRejected,
+			"ports":      KubernetesUpstreamRejected,
+			"uri":        KubernetesUpstreamRejected,
+		}))
+
+		errs := map[string]string{}
+		for _, entry := range discovery.Entries() {
+			errs[entry.Service] = entry.Error
+		}
+		Expect(errs["ports"]).To(Equal("the Service has 2 ports: select one with the oauth2-proxy.github.io/port annotation"))
+		Expect(errs["annotation"]).To(ContainSubstring(`invalid oauth2-proxy.github.io/upstream annotation: json: unknown field "paht"`))
+		Expect(errs["uri"]).To(Equal("invalid oauth2-proxy.github.io/upstream annotation: the uri and backends are the endpoints of the Service"))
+		Expect(errs["duplicate"]).To(Equal("duplicate path"))
+		Expect(count(KubernetesUpstreamRejected)).To(Equal(4.0))
+	})
+
+	It("responds with a 503 for the Services without ready endpoints", func() {
+		api.lists[servicesPath] = []interface{}{
+			service("app", nil, port("http", 80)),
+		}
+		api.lists[slicesPath] = []interface{}{
+			slice("app-a", "app", "1", "http", 8080, endpoint("10.0.0.1", false)),
+		}
+		Expect(discovery.Watch(done)).To(Succeed())
+
+		code := http.StatusServiceUnavailable
+		Expect(upstreams()).To(Equal([]options.Upstream{
+			{ID: "apps/app", Path: "/app/", Static: true, StaticCode: &code},
+		}))
+		Expect(states()).To(Equal(map[string]string{"app": KubernetesUpstreamUnavailable}))
+		Expect(count(KubernetesUpstreamUnavailable)).To(Equal(1.0))
+	})
+
+	It("registers the upstreams again as the endpoints and Services change", func() {
+		api.lists[servicesPath] = []interface{}{
+			service("app", nil, port("http", 80)),
+		}
+		api.lists[slicesPath] = []interface{}{
+			slice("app-a", "app", "1", "http", 8080, endpoint("10.0.0.1", true)),
+		}
+		Expect(discovery.Watch(done)).To(Succeed())
+		Expect(upstreams()[0].URI).To(Equal("http://10.0.0.1:8080"))
+
+		api.events(slicesPath) <- kubernetesWatchEvent{Type: "MODIFIED", Object: rawObject(
+			slice("app-a", "app", "2", "http", 8080, endpoint("10.0.0.1", false), endpoint("10.0.0.4", true)),
+		)}
+		Eventually(func() string {
+			return upstreams()[0].URI
+		}).Should(Equal("http://10.0.0.4:8080"))
+
+		api.events(servicesPath) <- kubernetesWatchEvent{Type: "ADDED", Object: rawObject(
+			service("api", nil, port("http", 80)),
+		)}
+		Eventually(states).Should(Equal(map[string]string{
+			"api": KubernetesUpstreamUnavailable,
+			"app": KubernetesUpstreamRegistered,
+		}))
+
+		api.events(servicesPath) <- kubernetesWatchEvent{Type: "DELETED", Object: rawObject(
+			service("app", nil, port("http", 80)),
+		)}
+		Eventually(states).Should(Equal(map[string]string{"api": KubernetesUpstreamUnavailable}))
+		Expect(upstreams()).To(HaveLen(1))
+	})
+
+	It("returns the errors listing the Services", func() {
+		api.status[servicesPath] = http.StatusForbidden
+
+		err := discovery.Watch(done)
+		Expect(err).To(MatchError(`could not list the upstreams of namespace "apps": unexpected status 403 from /api/v1/namespaces/apps/services: services is forbidden`))
+		Expect(router.upstreams).To(BeNil())
+	})
+})
@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeKubernetesAPI serves the lists of objects by path, and streams the
+// events sent to the watches of a path
+type fakeKubernetesAPI struct {
+	mutex   sync.Mutex
+	lists   map[string][]interface{}
+	status  map[string]int
+	watches map[string]chan kubernetesWatchEvent
+	listed  map[string]int
+}
+
+func newFakeKubernetesAPI() *fakeKubernetesAPI {
+	return &fakeKubernetesAPI{
+		lists:   map[string][]interface{}{},
+		status:  map[string]int{},
+		watches: map[string]chan kubernetesWatchEvent{},
+		listed:  map[string]int{},
+	}
+}
+
+// events returns the channel of the events of the watches of the path
+func (f *fakeKubernetesAPI) events(path string) chan kubernetesWatchEvent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.watches[path]; !ok {
+		f.watches[path] = make(chan kubernetesWatchEvent, 10)
+	}
+	return f.watches[path]
+}
+
+// listCount returns how many times the objects of the path were listed
+func (f *fakeKubernetesAPI) listCount(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.listed[path]
+}
+
+func (f *fakeKubernetesAPI) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer service-account-token" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Query().Get("labelSelector") != "oauth2-proxy/expose=true" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	path := req.URL.Path
+	if req.URL.Query().Get("watch") == "true" {
+		events := f.events(path)
+		rw.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				Expect(json.NewEncoder(rw).Encode(event)).To(Succeed())
+				rw.(http.Flusher).Flush()
+			}
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.listed[path]++
+	if status, ok := f.status[path]; ok {
+		rw.WriteHeader(status)
+		rw.Write([]byte(`{"kind":"Status","message":"services is forbidden","code":403}`))
+		return
+	}
+	items := f.lists[path]
+	if items == nil {
+		items = []interface{}{}
+	}
+	Expect(json.NewEncoder(rw).Encode(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "10"},
+		"items":    items,
+	})).To(Succeed())
+}
+
+// rawObject encodes the object as it is sent by the API server
+func rawObject(object interface{}) json.RawMessage {
+	raw, err := json.Marshal(object)
+	Expect(err).ToNot(HaveOccurred())
+	return raw
+}
+
+var _ = Describe("Kubernetes Client Suite", func() {
+	const path = "/api/v1/namespaces/apps/services"
+
+	var api *fakeKubernetesAPI
+	var server *httptest.Server
+	var client *kubernetesClient
+	var dir string
+
+	BeforeEach(func() {
+		api = newFakeKubernetesAPI()
+		server = httptest.NewServer(api)
+
+		var err error
+		dir, err = ioutil.TempDir("", "kubernetes")
+		Expect(err).ToNot(HaveOccurred())
+		tokenFile := filepath.Join(dir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("service-account-token\n"), 0600)).To(Succeed())
+		client = &kubernetesClient{server: server.URL, tokenFile: tokenFile, client: server.Client()}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("lists the objects with the service account token", func() {
+		api.lists[path] = []interface{}{
+			map[string]interface{}{"metadata": map[string]interface{}{"name": "app"}},
+		}
+
+		list, err := client.list(context.Background(), path, "oauth2-proxy/expose=true")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list.Metadata.ResourceVersion).To(Equal("10"))
+		Expect(list.Items).To(HaveLen(1))
+	})
+
+	It("returns the message of the errors of the API server", func() {
+		api.status[path] = http.StatusForbidden
+
+		_, err := client.list(context.Background(), path, "oauth2-proxy/expose=true")
+		Expect(err).To(MatchError("unexpected status 403 from /api/v1/namespaces/apps/services: services is forbidden"))
+	})
+
+	It("watches the objects, and lists them again once the watch has expired", func() {
+		api.lists[path] = []interface{}{
+			map[string]interface{}{"metadata": map[string]interface{}{"name": "app"}},
+		}
+		updates := make(chan map[string]json.RawMessage, 10)
+		informer := &kubernetesInformer{
+			client:   client,
+			path:     path,
+			selector: "oauth2-proxy/expose=true",
+			update: func(objects map[string]json.RawMessage) {
+				updates <- objects
+			},
+		}
+
+		version, err := informer.list(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal("10"))
+		Expect(<-updates).To(HaveKey("app"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go informer.run(ctx, version)
+
+		events := api.events(path)
+		events <- kubernetesWatchEvent{Type: "ADDED", Object: rawObject(map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "api", "resourceVersion": "11"},
+		})}
+		Expect(<-updates).To(And(HaveKey("app"), HaveKey("api")))
+
+		events <- kubernetesWatchEvent{Type: "DELETED", Object: rawObject(map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "app", "resourceVersion": "12"},
+		})}
+		objects := <-updates
+		Expect(objects).To(HaveKey("api"))
+		Expect(objects).ToNot(HaveKey("app"))
+
+		events <- kubernetesWatchEvent{Type: "ERROR", Object: rawObject(map[string]interface{}{
+			"kind": "Status", "code": http.StatusGone, "message": "too old resource version",
+		})}
+		Expect(<-updates).To(And(HaveKey("app"), Not(HaveKey("api"))))
+		Expect(api.listCount(path)).To(Equal(2))
+	})
+})
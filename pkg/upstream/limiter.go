@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// rejectedQueueFull is the rejection reason when the queue has no space
+	rejectedQueueFull = "queue_full"
+
+	// rejectedQueueTimeout is the rejection reason when a request waited in
+	// the queue for longer than the queue timeout
+	rejectedQueueTimeout = "queue_timeout"
+
+	// rejectedCancelled is the rejection reason when a request was cancelled
+	// while it waited in the queue
+	rejectedCancelled = "cancelled"
+)
+
+// newConcurrencyLimiter wraps the handler so that at most the upstream's
+// MaxConcurrentRequests are served at once.
+// Each upstream has its own limiter, so one upstream being saturated never
+// delays requests to the others.
+func newConcurrencyLimiter(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer, metrics *limiterMetrics) http.Handler {
+	queueTimeout := options.DefaultUpstreamQueueTimeout
+	if upstream.QueueTimeout != nil {
+		queueTimeout = upstream.QueueTimeout.Duration()
+	}
+
+	// Clients are asked to retry once a queued request would have timed out
+	retryAfter := int(math.Ceil(queueTimeout.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	return &concurrencyLimiter{
+		upstream:     upstream.ID,
+		slots:        make(chan struct{}, upstream.MaxConcurrentRequests),
+		queue:        make(chan struct{}, upstream.QueueSize),
+		queueTimeout: queueTimeout,
+		retryAfter:   strconv.Itoa(retryAfter),
+		handler:      handler,
+		writer:       writer,
+		metrics:      metrics,
+	}
+}
+
+// concurrencyLimiter limits the requests in flight to an upstream, queueing
+// requests above the limit until a slot is free.
+type concurrencyLimiter struct {
+	upstream string
+
+	// slots holds a value for each request in flight
+	slots chan struct{}
+	// queue holds a value for each request waiting for a slot
+	queue chan struct{}
+
+	queueTimeout time.Duration
+	retryAfter   string
+	handler      http.Handler
+	writer       pagewriter.Writer
+	metrics      *limiterMetrics
+}
+
+// ServeHTTP serves the request once a slot is free.
+// Requests that can't be queued, or wait for too long, are rejected with a
+// 503 response.
+func (l *concurrencyLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if reason := l.acquire(req); reason != "" {
+		l.reject(rw, req, reason)
+		return
+	}
+	defer func() { <-l.slots }()
+
+	inFlight := l.metrics.inFlight.WithLabelValues(l.upstream)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	l.handler.ServeHTTP(rw, req)
+}
+
+// acquire takes a slot for the request, waiting in the queue if there are
+// none free.
+// It returns the reason the request was rejected if no slot was taken.
+func (l *concurrencyLimiter) acquire(req *http.Request) string {
+	select {
+	case l.slots <- struct{}{}:
+		return ""
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return rejectedQueueFull
+	}
+	queued := l.metrics.queued.WithLabelValues(l.upstream)
+	queued.Inc()
+	defer func() {
+		<-l.queue
+		queued.Dec()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return rejectedQueueTimeout
+	case <-req.Context().Done():
+		return rejectedCancelled
+	}
+}
+
+// reject counts the rejected request and writes a 503 error page asking the
+// client to retry later
+func (l *concurrencyLimiter) reject(rw http.ResponseWriter, req *http.Request, reason string) {
+	l.metrics.rejected.WithLabelValues(l.upstream, reason).Inc()
+
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = l.upstream
+
+	logger.Errorf("Rejected request to upstream %q: too many concurrent requests (%s)", l.upstream, reason)
+	rw.Header().Set("Retry-After", l.retryAfter)
+	l.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusServiceUnavailable,
+		RequestID: scope.RequestID,
+		AppError:  "too many concurrent requests to upstream " + l.upstream,
+		Messages:  []interface{}{"The upstream server is busy, please try again later."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Concurrency Limiter Suite", func() {
+	var metrics *limiterMetrics
+	var writer *pagewriter.WriterFuncs
+	var started chan struct{}
+	var unblock chan struct{}
+
+	// blockingHandler signals when each request starts, then waits until it
+	// is unblocked
+	blockingHandler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	BeforeEach(func() {
+		metrics = newLimiterMetrics(prometheus.NewRegistry())
+		writer = &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				rw.WriteHeader(opts.Status)
+			},
+		}
+		started = make(chan struct{}, 10)
+		unblock = make(chan struct{})
+	})
+
+	serve := func(handler http.Handler) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			defer GinkgoRecover()
+			req := httptest.NewRequest("", "/", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			done <- rw
+		}()
+		return done
+	}
+
+	queueTimeout := func(d time.Duration) *options.Duration {
+		duration := options.Duration(d)
+		return &duration
+	}
+
+	It("rejects requests when the queue is full", func() {
+		limiter := newConcurrencyLimiter(options.Upstream{
+			ID:                    "legacy",
+			MaxConcurrentRequests: 1,
+			QueueSize:             1,
+			QueueTimeout:          queueTimeout(2500 * time.Millisecond),
+		}, blockingHandler, writer, metrics)
+
+		first := serve(limiter)
+		Eventually(started).Should(Receive())
+		Expect(testutil.ToFloat64(metrics.inFlight.WithLabelValues("legacy"))).To(Equal(1.0))
+
+		queued := serve(limiter)
+		Eventually(func() float64 { return testutil.ToFloat64(metrics.queued.WithLabelValues("legacy")) }).Should(Equal(1.0))
+
+		var rejected *httptest.ResponseRecorder
+		Eventually(serve(limiter)).Should(Receive(&rejected))
+		Expect(rejected.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rejected.Header().Get("Retry-After")).To(Equal("3"))
+		Expect(testutil.ToFloat64(metrics.rejected.WithLabelValues("legacy", rejectedQueueFull))).To(Equal(1.0))
+
+		// Completing the first request lets the queued request through
+		unblock <- struct{}{}
+		Eventually(first).Should(Receive())
+		Eventually(started).Should(Receive())
+		unblock <- struct{}{}
+
+		var rw *httptest.ResponseRecorder
+		Eventually(queued).Should(Receive(&rw))
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(testutil.ToFloat64(metrics.inFlight.WithLabelValues("legacy"))).To(Equal(0.0))
+		Expect(testutil.ToFloat64(metrics.queued.WithLabelValues("legacy"))).To(Equal(0.0))
+	})
+
+	It("rejects requests that wait for longer than the queue timeout", func() {
+		limiter := newConcurrencyLimiter(options.Upstream{
+			ID:                    "legacy",
+			MaxConcurrentRequests: 1,
+			QueueSize:             1,
+			QueueTimeout:          queueTimeout(10 * time.Millisecond),
+		}, blockingHandler, writer, metrics)
+
+		first := serve(limiter)
+		Eventually(started).Should(Receive())
+
+		var rw *httptest.ResponseRecorder
+		Eventually(serve(limiter)).Should(Receive(&rw))
+		Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rw.Header().Get("Retry-After")).To(Equal("1"))
+		Expect(testutil.ToFloat64(metrics.rejected.WithLabelValues("legacy", rejectedQueueTimeout))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.queued.WithLabelValues("legacy"))).To(Equal(0.0))
+
+		unblock <- struct{}{}
+		Eventually(first).Should(Receive())
+	})
+
+	It("doesn't limit other upstreams", func() {
+		legacy := newConcurrencyLimiter(options.Upstream{
+			ID:                    "legacy",
+			MaxConcurrentRequests: 1,
+		}, blockingHandler, writer, metrics)
+		other := newConcurrencyLimiter(options.Upstream{
+			ID:                    "other",
+			MaxConcurrentRequests: 1,
+		}, blockingHandler, writer, metrics)
+
+		first := serve(legacy)
+		Eventually(started).Should(Receive())
+
+		var rw *httptest.ResponseRecorder
+		Eventually(serve(legacy)).Should(Receive(&rw))
+		Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+
+		second := serve(other)
+		Eventually(started).Should(Receive())
+		Expect(testutil.ToFloat64(metrics.inFlight.WithLabelValues("other"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.rejected.WithLabelValues("other", rejectedQueueFull))).To(Equal(0.0))
+
+		close(unblock)
+		Eventually(first).Should(Receive())
+		Eventually(second).Should(Receive())
+	})
+})
@@ -0,0 +1,390 @@
+package upstream
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// limiterMetrics records the state of the upstream concurrency limiters
+type limiterMetrics struct {
+	inFlight *prometheus.GaugeVec
+	queued   *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}
+
+// newLimiterMetrics registers the limiter metrics with the registerer.
+func newLimiterMetrics(registerer prometheus.Registerer) *limiterMetrics {
+	return &limiterMetrics{
+		inFlight: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_requests_in_flight",
+				Help: "Number of requests in flight to concurrency limited upstreams.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.GaugeVec),
+		queued: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_requests_queued",
+				Help: "Number of requests waiting for concurrency limited upstreams.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.GaugeVec),
+		rejected: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_requests_rejected_total",
+				Help: "Total number of requests rejected by upstream concurrency limits by reason.",
+			},
+			[]string{"upstream", "reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// bodyLimitMetrics counts the requests rejected by upstream request body
+// size limits
+type bodyLimitMetrics struct {
+	rejected *prometheus.CounterVec
+}
+
+// newBodyLimitMetrics registers the request body limit metrics with the
+// registerer.
+func newBodyLimitMetrics(registerer prometheus.Registerer) *bodyLimitMetrics {
+	return &bodyLimitMetrics{
+		rejected: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_request_body_rejected_total",
+				Help: "Total number of requests rejected by upstream request body size limits by reason: content_length or streamed.",
+			},
+			[]string{"upstream", "reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// rateLimitMetrics counts the requests rejected by upstream rate limits
+type rateLimitMetrics struct {
+	rejected *prometheus.CounterVec
+}
+
+// newRateLimitMetrics registers the rate limit metrics with the registerer.
+func newRateLimitMetrics(registerer prometheus.Registerer) *rateLimitMetrics {
+	return &rateLimitMetrics{
+		rejected: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_rate_limited_total",
+				Help: "Total number of requests rejected by upstream rate limits by the key they were limited by: user or ip.",
+			},
+			[]string{"upstream", "key"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// timingMetrics records the requests served by upstreams, and how long
+// upstreams take to respond
+type timingMetrics struct {
+	requests        *prometheus.CounterVec
+	active          *prometheus.GaugeVec
+	timeToFirstByte *prometheus.HistogramVec
+	duration        *prometheus.HistogramVec
+}
+
+// newTimingMetrics registers the timing metrics with the registerer.
+func newTimingMetrics(registerer prometheus.Registerer) *timingMetrics {
+	return &timingMetrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_requests_total",
+				Help: "Total number of requests served by upstreams by the class of their response status: 1xx, 2xx, 3xx, 4xx or 5xx.",
+			},
+			[]string{"upstream", "status_class"},
+		)).(*prometheus.CounterVec),
+		active: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_requests_active",
+				Help: "Number of requests being served by upstreams, including the requests waiting for concurrency limits.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.GaugeVec),
+		timeToFirstByte: collector.Register(registerer, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "oauth2_proxy_upstream_time_to_first_byte_seconds",
+				Help:    "Time from proxying a request until the upstream started the response.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"upstream"},
+		)).(*prometheus.HistogramVec),
+		duration: collector.Register(registerer, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "oauth2_proxy_upstream_request_duration_seconds",
+				Help:    "Time from proxying a request until the response to the client completed.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"upstream"},
+		)).(*prometheus.HistogramVec),
+	}
+}
+
+// degradedRejected is the outcome of degraded requests that were rejected
+const degradedRejected = "rejected"
+
+// degradedMetrics counts the requests served while the session store is
+// unavailable
+type degradedMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+// newDegradedMetrics registers the degraded request metrics with the
+// registerer.
+func newDegradedMetrics(registerer prometheus.Registerer) *degradedMetrics {
+	return &degradedMetrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_session_store_degraded_requests_total",
+				Help: "Total number of requests to upstreams while the session store was unavailable by outcome: the policy they were served with, or rejected.",
+			},
+			[]string{"upstream", "outcome"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// dnsMetrics records the addresses resolved for upstreams that re-resolve
+// their hostname
+type dnsMetrics struct {
+	addresses *prometheus.GaugeVec
+}
+
+// newDNSMetrics registers the DNS metrics with the registerer.
+func newDNSMetrics(registerer prometheus.Registerer) *dnsMetrics {
+	return &dnsMetrics{
+		addresses: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_backend_addresses",
+				Help: "Number of addresses resolved for the hostname of upstreams with a DNS refresh interval.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.GaugeVec),
+	}
+}
+
+// streamMetrics counts the failures reading upstream response bodies
+type streamMetrics struct {
+	errors *prometheus.CounterVec
+}
+
+// newStreamMetrics registers the stream error metrics with the registerer.
+func newStreamMetrics(registerer prometheus.Registerer) *streamMetrics {
+	return &streamMetrics{
+		errors: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_stream_errors_total",
+				Help: "Total number of upstream responses that failed after the upstream started the response by error class and outcome: retried, error_page or aborted.",
+			},
+			[]string{"upstream", "class", "outcome"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// mirrorMetrics counts the requests mirrored to the mirrors of upstreams
+type mirrorMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+// newMirrorMetrics registers the mirror metrics with the registerer.
+func newMirrorMetrics(registerer prometheus.Registerer) *mirrorMetrics {
+	return &mirrorMetrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_mirror_requests_total",
+				Help: "Total number of sampled requests to mirrored upstreams by result: sent, error, skipped or dropped.",
+			},
+			[]string{"upstream", "result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// faultMetrics counts the faults injected into the requests to upstreams
+type faultMetrics struct {
+	injected *prometheus.CounterVec
+}
+
+// newFaultMetrics registers the fault injection metrics with the registerer.
+func newFaultMetrics(registerer prometheus.Registerer) *faultMetrics {
+	return &faultMetrics{
+		injected: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_faults_injected_total",
+				Help: "Total number of faults injected into the requests to upstreams by fault: delay or abort.",
+			},
+			[]string{"upstream", "fault"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// balancerMetrics counts the requests sent to each backend of upstreams with
+// multiple backends
+type balancerMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+// newBalancerMetrics registers the backend balancing metrics with the
+// registerer.
+func newBalancerMetrics(registerer prometheus.Registerer) *balancerMetrics {
+	return &balancerMetrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_backend_requests_total",
+				Help: "Total number of requests balanced to each backend of upstreams with multiple backends.",
+			},
+			[]string{"upstream", "backend"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// healthMetrics records the health of the servers of upstreams with health
+// checks
+type healthMetrics struct {
+	healthy *prometheus.GaugeVec
+}
+
+// newHealthMetrics registers the health check metrics with the registerer.
+func newHealthMetrics(registerer prometheus.Registerer) *healthMetrics {
+	return &healthMetrics{
+		healthy: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_backend_healthy",
+				Help: "Whether each server of upstreams with health checks is passing its health checks (1) or not (0).",
+			},
+			[]string{"upstream", "backend"},
+		)).(*prometheus.GaugeVec),
+	}
+}
+
+// circuitBreakerMetrics records the state of the circuit breakers of
+// upstreams, and the requests they rejected
+type circuitBreakerMetrics struct {
+	state    *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}
+
+// newCircuitBreakerMetrics registers the circuit breaker metrics with the
+// registerer.
+func newCircuitBreakerMetrics(registerer prometheus.Registerer) *circuitBreakerMetrics {
+	return &circuitBreakerMetrics{
+		state: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_upstream_circuit_breaker_state",
+				Help: "State of the circuit breakers of upstreams: closed (0), half-open (1) or open (2).",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.GaugeVec),
+		rejected: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_circuit_breaker_rejected_total",
+				Help: "Total number of requests rejected by the circuit breakers of upstreams.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// cacheMetrics counts the requests to upstreams with a response cache
+type cacheMetrics struct {
+	requests  *prometheus.CounterVec
+	evictions *prometheus.CounterVec
+}
+
+// newCacheMetrics registers the response cache metrics with the registerer.
+func newCacheMetrics(registerer prometheus.Registerer) *cacheMetrics {
+	return &cacheMetrics{
+		requests: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_cache_requests_total",
+				Help: "Total number of requests to upstreams with a response cache by result: hit, miss or bypass.",
+			},
+			[]string{"upstream", "result"},
+		)).(*prometheus.CounterVec),
+		evictions: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_cache_evictions_total",
+				Help: "Total number of responses evicted from upstream response caches to stay within their maximum size.",
+			},
+			[]string{"upstream"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// dynamicMetrics counts the upstreams of the dynamic upstreams directory
+type dynamicMetrics struct {
+	upstreams *prometheus.GaugeVec
+}
+
+// newDynamicMetrics registers the dynamic upstream metrics with the
+// registerer.
+func newDynamicMetrics(registerer prometheus.Registerer) *dynamicMetrics {
+	return &dynamicMetrics{
+		upstreams: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_dynamic_upstreams",
+				Help: "Number of files of the dynamic upstreams directory by state: registered, rejected or expired.",
+			},
+			[]string{"state"},
+		)).(*prometheus.GaugeVec),
+	}
+}
+
+// kubernetesDiscoveryMetrics counts the upstreams discovered from Kubernetes
+// Services
+type kubernetesDiscoveryMetrics struct {
+	upstreams *prometheus.GaugeVec
+}
+
+// newKubernetesDiscoveryMetrics registers the Kubernetes discovery metrics
+// with the registerer.
+func newKubernetesDiscoveryMetrics(registerer prometheus.Registerer) *kubernetesDiscoveryMetrics {
+	return &kubernetesDiscoveryMetrics{
+		upstreams: collector.Register(registerer, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "oauth2_proxy_kubernetes_upstreams",
+				Help: "Number of Kubernetes Services discovered as upstreams by state: registered, rejected or unavailable.",
+			},
+			[]string{"state"},
+		)).(*prometheus.GaugeVec),
+	}
+}
+
+// tokenExchangeMetrics counts the exchanges of the access tokens of sessions
+// for the tokens of upstreams
+type tokenExchangeMetrics struct {
+	exchanges *prometheus.CounterVec
+}
+
+// newTokenExchangeMetrics registers the token exchange metrics with the
+// registerer.
+func newTokenExchangeMetrics(registerer prometheus.Registerer) *tokenExchangeMetrics {
+	return &tokenExchangeMetrics{
+		exchanges: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_token_exchanges_total",
+				Help: "Total number of tokens sent to upstreams in exchange for the access token of the session by result: exchanged, cached or error.",
+			},
+			[]string{"upstream", "result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+// reloadMetrics counts the reloads of the configured upstreams
+type reloadMetrics struct {
+	reloads *prometheus.CounterVec
+}
+
+// newReloadMetrics registers the upstream reload metrics with the
+// registerer.
+func newReloadMetrics(registerer prometheus.Registerer) *reloadMetrics {
+	return &reloadMetrics{
+		reloads: collector.Register(registerer, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "oauth2_proxy_upstream_reloads_total",
+				Help: "Total number of reloads of the configured upstreams by result: success or failure.",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
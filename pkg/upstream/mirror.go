@@ -0,0 +1,244 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// The results of mirrored requests
+const (
+	mirrorSent    = "sent"
+	mirrorError   = "error"
+	mirrorSkipped = "skipped"
+	mirrorDropped = "dropped"
+)
+
+// maxMirrorsInFlight bounds the mirrored requests in flight for each
+// upstream, so that a slow mirror can't accumulate requests
+const maxMirrorsInFlight = 100
+
+// hopHeaders are the hop-by-hop headers, which aren't mirrored or subject
+// to the allowed request headers
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// requestMirror sends copies of a sample of the requests to an upstream to
+// its mirror
+type requestMirror struct {
+	upstream           string
+	target             *url.URL
+	samplePercent      int
+	maxBodySize        int64
+	allowNonIdempotent bool
+	client             *http.Client
+	inFlight           chan struct{}
+	metrics            *mirrorMetrics
+
+	// sample decides whether a request is mirrored
+	sample func() bool
+	// wg tracks the mirrored requests in flight
+	wg sync.WaitGroup
+}
+
+// newRequestMirror creates the request mirror of the upstream, or returns nil
+// when the upstream isn't mirrored
+func newRequestMirror(upstream options.Upstream, metrics *mirrorMetrics) (*requestMirror, error) {
+	if upstream.Mirror == nil {
+		return nil, nil
+	}
+
+	target, err := url.Parse(upstream.Mirror.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := options.DefaultUpstreamMirrorTimeout
+	if upstream.Mirror.Timeout != nil {
+		timeout = upstream.Mirror.Timeout.Duration()
+	}
+	maxBodySize := upstream.Mirror.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = options.DefaultUpstreamMirrorMaxBodySize
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	/* #nosec G402 */
+	if upstream.InsecureSkipTLSVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	m := &requestMirror{
+		upstream:           upstream.ID,
+		target:             target,
+		samplePercent:      upstream.Mirror.SamplePercent,
+		maxBodySize:        maxBodySize,
+		allowNonIdempotent: upstream.Mirror.AllowNonIdempotent,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			// Redirects are for the client of the upstream to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, maxMirrorsInFlight),
+		metrics:  metrics,
+	}
+	m.sample = func() bool {
+		/* #nosec G404 */
+		return rand.Intn(100) < m.samplePercent
+	}
+	return m, nil
+}
+
+// capture prepares a copy of the request to mirror, when it is sampled.
+// The body is copied as the request is proxied, without buffering it for
+// the upstream, and the copy is sent by the returned function once the
+// upstream has responded.
+// Nil is returned for requests that aren't mirrored.
+func (m *requestMirror) capture(req *http.Request) func() {
+	if !m.sample() || isWebSocketUpgrade(req) || (!m.allowNonIdempotent && !isIdempotent(req.Method)) {
+		return nil
+	}
+	if req.ContentLength > m.maxBodySize {
+		m.metrics.requests.WithLabelValues(m.upstream, mirrorSkipped).Inc()
+		return nil
+	}
+
+	target := *req.URL
+	target.Scheme, target.Host, target.User = m.target.Scheme, m.target.Host, nil
+	mirrored := &http.Request{
+		Method:        req.Method,
+		URL:           &target,
+		Header:        req.Header.Clone(),
+		ContentLength: req.ContentLength,
+	}
+	for _, header := range hopHeaders {
+		mirrored.Header.Del(header)
+	}
+
+	// Like the ReverseProxy, requests with a Content-Length of 0 are sent
+	// without reading their body
+	var body *mirrorBody
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		body = &mirrorBody{ReadCloser: req.Body, limit: m.maxBodySize}
+		req.Body = body
+	}
+
+	return func() {
+		if body != nil {
+			data, ok := body.captured()
+			if !ok {
+				// The upstream didn't read the whole body, or it was too large
+				m.metrics.requests.WithLabelValues(m.upstream, mirrorSkipped).Inc()
+				return
+			}
+			mirrored.Body = ioutil.NopCloser(bytes.NewReader(data))
+			mirrored.ContentLength = int64(len(data))
+		}
+		m.send(req.Context(), mirrored)
+	}
+}
+
+// send sends the mirrored request in the background, discarding its
+// response.
+// Requests are dropped when too many are already in flight.
+func (m *requestMirror) send(ctx context.Context, mirrored *http.Request) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.metrics.requests.WithLabelValues(m.upstream, mirrorDropped).Inc()
+		return
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.inFlight }()
+
+		// The mirrored request isn't cancelled with the request it copies
+		resp, err := m.client.Do(mirrored.WithContext(context.Background()))
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			logger.DebugfContext(ctx, "Error mirroring request for upstream %q: %v", m.upstream, err)
+			m.metrics.requests.WithLabelValues(m.upstream, mirrorError).Inc()
+			return
+		}
+		m.metrics.requests.WithLabelValues(m.upstream, mirrorSent).Inc()
+	}()
+}
+
+// isIdempotent checks whether the method is idempotent, as defined by
+// RFC 7231 section 4.2.2
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// mirrorBody copies the request body as it is read, up to the limit.
+// It is read by the transport of the upstream, which may still be reading it
+// after the upstream has responded, so the copy is guarded by a mutex.
+type mirrorBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	eof      bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// captured returns the copy of the body, if the whole body was read and it
+// was within the limit
+func (b *mirrorBody) captured() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.overflow || !b.eof {
+		return nil, false
+	}
+	return append([]byte{}, b.buf.Bytes()...), true
+}
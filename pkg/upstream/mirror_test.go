@@ -0,0 +1,232 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// mirroredRequest is a request received by the mirror server
+type mirroredRequest struct {
+	method string
+	uri    string
+	email  string
+	body   string
+}
+
+var _ = Describe("Upstream Mirror Suite", func() {
+	var upstreamServer *httptest.Server
+	var mirrorServer *httptest.Server
+	var metrics *mirrorMetrics
+
+	var mu sync.Mutex
+	var mirrored []mirroredRequest
+	// mirrorDelay delays the responses of the mirror server
+	var mirrorDelay time.Duration
+
+	BeforeEach(func() {
+		mirrored = nil
+		mirrorDelay = 0
+
+		upstreamServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+			rw.Header().Set(contentType, "text/plain")
+			rw.Header().Set("X-Upstream", "primary")
+			rw.WriteHeader(http.StatusCreated)
+			rw.Write([]byte(req.Method + " " + req.URL.RequestURI() + " " + string(body)))
+		}))
+		mirrorServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+
+			mu.Lock()
+			mirrored = append(mirrored, mirroredRequest{
+				method: req.Method,
+				uri:    req.URL.RequestURI(),
+				email:  req.Header.Get("X-Forwarded-Email"),
+				body:   string(body),
+			})
+			mu.Unlock()
+
+			time.Sleep(mirrorDelay)
+			// The responses of the mirror are discarded
+			rw.Header().Set("X-Upstream", "mirror")
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("mirror"))
+		}))
+
+		metrics = newMirrorMetrics(prometheus.NewRegistry())
+	})
+
+	AfterEach(func() {
+		upstreamServer.Close()
+		mirrorServer.Close()
+	})
+
+	mirroredRequests := func() []mirroredRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]mirroredRequest{}, mirrored...)
+	}
+
+	mirrorResults := func(result string) func() float64 {
+		return func() float64 {
+			return testutil.ToFloat64(metrics.requests.WithLabelValues("app", result))
+		}
+	}
+
+	// newProxy creates a proxy to the upstream server, mirroring to the mirror
+	// server with the mirror options, unless they are nil
+	newProxy := func(mirror *options.UpstreamMirror) *httpUpstreamProxy {
+		u, err := url.Parse(upstreamServer.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		upstream := options.Upstream{
+			ID:          "app",
+			Path:        "/app/",
+			StripPath:   true,
+			PrependPath: "/v1",
+		}
+		if mirror != nil {
+			mirror.URI = mirrorServer.URL
+			upstream.Mirror = mirror
+		}
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, metrics, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		return handler.(*httpUpstreamProxy)
+	}
+
+	// serve serves the request with the proxy, returning the dumped response
+	serve := func(proxy http.Handler, method, target, body string) string {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Forwarded-Email", "john.doe@example.com")
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		resp := rw.Result()
+		// The date of the responses may differ
+		resp.Header.Del("Date")
+
+		dump, err := httputil.DumpResponse(resp, true)
+		Expect(err).ToNot(HaveOccurred())
+		return string(dump)
+	}
+
+	It("serves identical responses with and without mirroring", func() {
+		withoutMirror := newProxy(nil)
+		withMirror := newProxy(&options.UpstreamMirror{SamplePercent: 100})
+
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			expected := serve(withoutMirror, method, "/app/users?page=2", "body of "+method)
+			Expect(expected).To(ContainSubstring("201 Created"))
+			Expect(serve(withMirror, method, "/app/users?page=2", "body of "+method)).To(Equal(expected))
+		}
+
+		Eventually(mirrorResults(mirrorSent)).Should(Equal(float64(3)))
+		Expect(mirroredRequests()).To(ConsistOf(
+			mirroredRequest{method: http.MethodGet, uri: "/v1/users?page=2", email: "john.doe@example.com", body: "body of GET"},
+			mirroredRequest{method: http.MethodPut, uri: "/v1/users?page=2", email: "john.doe@example.com", body: "body of PUT"},
+			mirroredRequest{method: http.MethodDelete, uri: "/v1/users?page=2", email: "john.doe@example.com", body: "body of DELETE"},
+		))
+	})
+
+	It("only mirrors the sampled requests", func() {
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 50})
+		sampled := false
+		proxy.mirror.sample = func() bool {
+			sampled = !sampled
+			return sampled
+		}
+
+		for _, path := range []string{"/app/1", "/app/2", "/app/3", "/app/4"} {
+			serve(proxy, http.MethodGet, path, "")
+		}
+
+		Eventually(mirrorResults(mirrorSent)).Should(Equal(float64(2)))
+		Expect(mirroredRequests()).To(ConsistOf(
+			mirroredRequest{method: http.MethodGet, uri: "/v1/1", email: "john.doe@example.com"},
+			mirroredRequest{method: http.MethodGet, uri: "/v1/3", email: "john.doe@example.com"},
+		))
+	})
+
+	It("doesn't mirror non-idempotent requests by default", func() {
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 100})
+
+		for _, method := range []string{http.MethodPost, http.MethodPatch} {
+			Expect(serve(proxy, method, "/app/users", "new user")).To(ContainSubstring(method + " /v1/users new user"))
+		}
+		serve(proxy, http.MethodGet, "/app/users", "")
+
+		Eventually(mirrorResults(mirrorSent)).Should(Equal(float64(1)))
+		Expect(mirroredRequests()).To(ConsistOf(
+			mirroredRequest{method: http.MethodGet, uri: "/v1/users", email: "john.doe@example.com"},
+		))
+	})
+
+	It("mirrors non-idempotent requests when they are allowed", func() {
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 100, AllowNonIdempotent: true})
+
+		serve(proxy, http.MethodPost, "/app/users", "new user")
+
+		Eventually(mirrorResults(mirrorSent)).Should(Equal(float64(1)))
+		Expect(mirroredRequests()).To(ConsistOf(
+			mirroredRequest{method: http.MethodPost, uri: "/v1/users", email: "john.doe@example.com", body: "new user"},
+		))
+	})
+
+	It("skips requests with bodies larger than the max body size", func() {
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 100, MaxBodySize: 4})
+
+		Expect(serve(proxy, http.MethodPut, "/app/users", "too large")).To(ContainSubstring("PUT /v1/users too large"))
+
+		// Bodies of unknown length are skipped once they are read
+		req := httptest.NewRequest(http.MethodPut, "/app/users", ioutil.NopCloser(strings.NewReader("too large")))
+		req.ContentLength = -1
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{}))
+		Expect(rw.Body.String()).To(Equal("PUT /v1/users too large"))
+
+		Expect(mirrorResults(mirrorSkipped)()).To(Equal(float64(2)))
+		Consistently(mirroredRequests, 100*time.Millisecond).Should(BeEmpty())
+	})
+
+	It("counts failed mirrored requests without affecting the response", func() {
+		timeout := options.Duration(50 * time.Millisecond)
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 100, Timeout: &timeout})
+		expected := serve(newProxy(nil), http.MethodGet, "/app/users", "")
+
+		mirrorDelay = 200 * time.Millisecond
+		start := time.Now()
+		Expect(serve(proxy, http.MethodGet, "/app/users", "")).To(Equal(expected))
+		Expect(time.Since(start)).To(BeNumerically("<", mirrorDelay))
+
+		Eventually(mirrorResults(mirrorError)).Should(Equal(float64(1)))
+		Expect(mirrorResults(mirrorSent)()).To(Equal(float64(0)))
+	})
+
+	It("drops mirrored requests when too many are in flight", func() {
+		proxy := newProxy(&options.UpstreamMirror{SamplePercent: 100})
+		for i := 0; i < maxMirrorsInFlight; i++ {
+			proxy.mirror.inFlight <- struct{}{}
+		}
+
+		Expect(serve(proxy, http.MethodGet, "/app/users", "")).To(ContainSubstring("GET /v1/users"))
+
+		Expect(mirrorResults(mirrorDropped)()).To(Equal(float64(1)))
+		Expect(mirroredRequests()).To(BeEmpty())
+	})
+})
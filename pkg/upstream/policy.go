@@ -0,0 +1,308 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
+)
+
+// AnonymousAccess decides which requests the proxy created by NewProxy
+// serves without a session, so that they aren't asked to sign in.
+type AnonymousAccess interface {
+	// AllowsAnonymous returns whether the policies of the upstream the
+	// request is routed to allow it without a session
+	AllowsAnonymous(req *http.Request) bool
+}
+
+// PolicyAuthorizer authorizes requests to the proxy created by NewProxy with
+// the policies of their upstream outside of the upstream's handler, for the
+// requests that aren't proxied with a session, such as signed URLs.
+type PolicyAuthorizer interface {
+	// AuthorizePolicies returns why the policies of the upstream the request
+	// is routed to deny it with the session, or nil when they allow it or
+	// the upstream has no policies. The session is nil for requests without
+	// a session, which only match the policies without groups or claims.
+	AuthorizePolicies(req *http.Request, session *sessions.SessionState) error
+}
+
+// upstreamPolicies authorizes the requests to an upstream with its Policies,
+// the first policy matching a request allowing or denying it.
+type upstreamPolicies struct {
+	upstream           string
+	policies           []upstreamPolicy
+	realClientIPParser ipapi.RealClientIPParser
+	handler            http.Handler
+	writer             pagewriter.Writer
+	recordDenial       DenialFunc
+}
+
+// upstreamPolicy is a parsed authorization policy
+type upstreamPolicy struct {
+	name           string
+	deny           bool
+	path           *regexp.Regexp
+	methods        []string
+	networks       *ip.NetSet
+	groups         []string
+	claims         []options.UpstreamClaimMatch
+	allowAnonymous bool
+}
+
+// newUpstreamPolicies wraps the handler so that the requests with a session
+// are only served when they are allowed by the upstream's Policies.
+// Denied requests are recorded with the denial func, when it is set.
+// It returns nil when the upstream has no policies.
+func newUpstreamPolicies(upstream options.Upstream, realClientIPParser ipapi.RealClientIPParser, handler http.Handler, writer pagewriter.Writer, recordDenial DenialFunc) (*upstreamPolicies, error) {
+	if len(upstream.Policies) == 0 {
+		return nil, nil
+	}
+
+	policies := make([]upstreamPolicy, 0, len(upstream.Policies))
+	for i, policy := range upstream.Policies {
+		parsed, err := newUpstreamPolicy(i, policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %q for upstream %q: %v", parsed.name, upstream.ID, err)
+		}
+		policies = append(policies, parsed)
+	}
+	return &upstreamPolicies{
+		upstream:           upstream.ID,
+		policies:           policies,
+		realClientIPParser: realClientIPParser,
+		handler:            handler,
+		writer:             writer,
+		recordDenial:       recordDenial,
+	}, nil
+}
+
+// newUpstreamPolicy parses the policy at the index of the upstream's Policies
+func newUpstreamPolicy(index int, policy options.UpstreamPolicy) (upstreamPolicy, error) {
+	parsed := upstreamPolicy{
+		name:           policy.Name,
+		deny:           policy.Action == options.UpstreamPolicyDeny,
+		methods:        policy.Methods,
+		groups:         policy.Groups,
+		claims:         policy.Claims,
+		allowAnonymous: policy.AllowAnonymous,
+	}
+	if parsed.name == "" {
+		parsed.name = fmt.Sprintf("policies[%d]", index)
+	}
+
+	if policy.Path != "" {
+		path, err := regexp.Compile(policy.Path)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid path %q: %v", policy.Path, err)
+		}
+		parsed.path = path
+	}
+	for _, cidr := range policy.CIDRs {
+		ipNet := ip.ParseIPNet(cidr)
+		if ipNet == nil {
+			return parsed, fmt.Errorf("invalid cidr %q", cidr)
+		}
+		if parsed.networks == nil {
+			parsed.networks = ip.NewNetSet()
+		}
+		parsed.networks.AddIPNet(*ipNet)
+	}
+	return parsed, nil
+}
+
+// ServeHTTP serves the requests allowed by the first policy they match, and
+// rejects all others with a 403 response.
+// Requests without a session, such as degraded requests served anonymously,
+// must match a policy allowing them anonymously, unless the proxy allowed them
+// without authentication.
+func (p *upstreamPolicies) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.AuthenticationSkipped {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	reason := p.denyReason(req, scope.Session)
+	if reason == "" && scope.Session == nil && !p.allowsAnonymous(req) {
+		reason = "the request requires a session"
+	}
+	if reason != "" {
+		p.reject(rw, req, scope, reason)
+		return
+	}
+	p.handler.ServeHTTP(rw, req)
+}
+
+// denyReason returns why the request with the session is denied, or an empty
+// string when the first policy it matches allows it
+func (p *upstreamPolicies) denyReason(req *http.Request, session *sessions.SessionState) string {
+	policy := p.match(req, session)
+	switch {
+	case policy == nil:
+		return "the request matches none of its policies"
+	case policy.deny:
+		return fmt.Sprintf("the request is denied by policy %q", policy.name)
+	}
+	return ""
+}
+
+// allowsAnonymous returns whether the first policy the request matches,
+// without a session, allows it anonymously
+func (p *upstreamPolicies) allowsAnonymous(req *http.Request) bool {
+	policy := p.match(req, nil)
+	return policy != nil && !policy.deny && policy.allowAnonymous
+}
+
+// match returns the first policy matching the request with the session, or
+// nil when none match
+func (p *upstreamPolicies) match(req *http.Request, session *sessions.SessionState) *upstreamPolicy {
+	var clientIP net.IP
+	clientIPParsed := false
+	var extractor util.ClaimExtractor
+	extractorCreated := false
+
+	for i := range p.policies {
+		policy := &p.policies[i]
+		if policy.path != nil && !policy.path.MatchString(req.URL.Path) {
+			continue
+		}
+		if len(policy.methods) > 0 && !containsAny(policy.methods, []string{req.Method}) {
+			continue
+		}
+		if policy.networks != nil {
+			if !clientIPParsed {
+				clientIP = p.clientIP(req)
+				clientIPParsed = true
+			}
+			if clientIP == nil || !policy.networks.Has(clientIP) {
+				continue
+			}
+		}
+
+		if len(policy.groups) == 0 && len(policy.claims) == 0 {
+			return policy
+		}
+		if session == nil {
+			continue
+		}
+		if len(policy.groups) > 0 && !containsAny(policy.groups, session.Groups) {
+			continue
+		}
+		if !extractorCreated && len(policy.claims) > 0 {
+			var err error
+			extractor, err = util.NewSessionClaimExtractor(req.Context(), session)
+			if err != nil {
+				logger.Errorf("Error reading the claims of the session for the policies of upstream %q: %v", p.upstream, err)
+			}
+			extractorCreated = true
+		}
+		if p.matchClaims(policy, extractor, session) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// matchClaims checks that the session has one of the values of each of the
+// claims of the policy
+func (p *upstreamPolicies) matchClaims(policy *upstreamPolicy, extractor util.ClaimExtractor, session *sessions.SessionState) bool {
+	for _, claim := range policy.claims {
+		values, err := getSessionClaimValues(extractor, session, claim.Claim)
+		if err != nil {
+			logger.Errorf("Error matching the session to policy %q of upstream %q: %v", policy.name, p.upstream, err)
+			return false
+		}
+		if !containsAny(claim.Values, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP returns the client IP of the request, or nil when it can't be
+// determined, so that it matches none of the policies with CIDRs
+func (p *upstreamPolicies) clientIP(req *http.Request) net.IP {
+	clientIP, err := ip.GetClientIP(p.realClientIPParser, req)
+	if err != nil {
+		logger.Errorf("Error obtaining real IP for the policies of upstream %q: %v", p.upstream, err)
+		return nil
+	}
+	return clientIP
+}
+
+// reject responds with a 403 with the reason the request was denied for
+func (p *upstreamPolicies) reject(rw http.ResponseWriter, req *http.Request, scope *middleware.RequestScope, reason string) {
+	var email string
+	if scope.Session != nil {
+		email = scope.Session.Email
+	}
+	logger.PrintAuthf(email, req, logger.AuthFailure, "Denied authorization for upstream %q: %s", p.upstream, reason)
+	if p.recordDenial != nil {
+		p.recordDenial(req, scope.Session, p.upstream, reason)
+	}
+	p.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusForbidden,
+		RequestID: scope.RequestID,
+		AppError:  reason,
+		Messages:  []interface{}{"You are not allowed to access this page."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
+
+// AllowsAnonymous checks the request against the policies of the dynamic
+// upstream matching it, or else of the configured upstream matching it
+func (m *multiUpstreamProxy) AllowsAnonymous(req *http.Request) bool {
+	policies := m.matchPolicies(req)
+	return policies != nil && policies.allowsAnonymous(req)
+}
+
+// AuthorizePolicies checks the request with the session against the policies
+// of the dynamic upstream matching it, or else of the configured upstream
+// matching it
+func (m *multiUpstreamProxy) AuthorizePolicies(req *http.Request, session *sessions.SessionState) error {
+	policies := m.matchPolicies(req)
+	if policies == nil {
+		return nil
+	}
+	if reason := policies.denyReason(req, session); reason != "" {
+		return fmt.Errorf("denied by the policies of upstream %q: %s", policies.upstream, reason)
+	}
+	return nil
+}
+
+// matchPolicies returns the policies of the dynamic upstream matching the
+// request, or else of the configured upstream matching it, or nil when the
+// upstream has no policies
+func (m *multiUpstreamProxy) matchPolicies(req *http.Request) *upstreamPolicies {
+	if dynamic := m.loadDynamic(); dynamic != nil {
+		var match mux.RouteMatch
+		if dynamic.serveMux.Match(req, &match) {
+			return dynamic.routePolicies(match)
+		}
+	}
+
+	configured := m.loadConfigured()
+	var match mux.RouteMatch
+	if !configured.serveMux.Match(req, &match) {
+		return nil
+	}
+	return configured.routePolicies(match)
+}
+
+// routePolicies returns the policies of the upstream of the matched route
+func (m *multiUpstreamProxy) routePolicies(match mux.RouteMatch) *upstreamPolicies {
+	if match.Route == nil {
+		return nil
+	}
+	return m.policies[match.Route.GetName()]
+}
@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy Suite", func() {
+	var proxy http.Handler
+	var denials []string
+
+	static := func(id, path string, policies ...options.UpstreamPolicy) options.Upstream {
+		code := http.StatusOK
+		return options.Upstream{
+			ID:         id,
+			Path:       path,
+			Static:     true,
+			StaticCode: &code,
+			Policies:   policies,
+		}
+	}
+
+	BeforeEach(func() {
+		denials = nil
+		recordDenial := func(_ *http.Request, _ *sessionsapi.SessionState, upstream string, reason string) {
+			denials = append(denials, upstream+": "+reason)
+		}
+
+		var err error
+		proxy, err = NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				static("app", "/app/",
+					options.UpstreamPolicy{Name: "health", Path: "^/app/health$", AllowAnonymous: true},
+					options.UpstreamPolicy{Name: "office", Path: "^/app/reports/", CIDRs: []string{"192.168.0.0/16"}},
+					options.UpstreamPolicy{Name: "reports", Action: options.UpstreamPolicyDeny, Path: "^/app/reports/"},
+					options.UpstreamPolicy{Methods: []string{http.MethodDelete}, Claims: []options.UpstreamClaimMatch{
+						{Claim: "email", Values: []string{"admin@example.com"}},
+					}},
+					options.UpstreamPolicy{Methods: []string{http.MethodGet}, Groups: []string{"users", "admins"}},
+				),
+				static("open", "/open/"),
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, recordDenial)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	type policyTableInput struct {
+		method       string
+		path         string
+		remoteAddr   string
+		session      *sessionsapi.SessionState
+		skipped      bool
+		degraded     bool
+		expectedCode int
+		expectedBody string
+	}
+
+	DescribeTable("authorizes the requests with the first matching policy",
+		func(in policyTableInput) {
+			req := httptest.NewRequest(in.method, in.path, nil)
+			if in.remoteAddr != "" {
+				req.RemoteAddr = in.remoteAddr
+			}
+			scope := &middlewareapi.RequestScope{
+				Session:               in.session,
+				AuthenticationSkipped: in.skipped,
+				SessionDegraded:       in.degraded,
+			}
+			req = middlewareapi.AddRequestScope(req, scope)
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			if in.expectedBody != "" {
+				Expect(rw.Body.String()).To(Equal(in.expectedBody))
+			}
+			if in.expectedCode == http.StatusForbidden {
+				Expect(denials).To(HaveLen(1))
+				Expect(denials[0]).To(HavePrefix("app: "))
+			} else {
+				Expect(denials).To(BeEmpty())
+			}
+		},
+		Entry("without a session", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/page",
+			expectedCode: http.StatusForbidden,
+			expectedBody: "403 - the request matches none of its policies",
+		}),
+		Entry("without a session to an anonymous path", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/health",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("without a session skipping authentication", policyTableInput{
+			method:       http.MethodPost,
+			path:         "/app/page",
+			skipped:      true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("degraded without a session", policyTableInput{
+			method:       http.MethodPost,
+			path:         "/app/reports/q1",
+			remoteAddr:   "192.168.1.2:40000",
+			degraded:     true,
+			expectedCode: http.StatusForbidden,
+			expectedBody: "403 - the request requires a session",
+		}),
+		Entry("degraded without a session to a denied path", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/reports/q1",
+			remoteAddr:   "203.0.113.1:40000",
+			degraded:     true,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `403 - the request is denied by policy "reports"`,
+		}),
+		Entry("in one of the groups", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Groups: []string{"admins"}},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("in none of the groups", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Groups: []string{"guests"}},
+			expectedCode: http.StatusForbidden,
+			expectedBody: "403 - the request matches none of its policies",
+		}),
+		Entry("with the claim of the method", policyTableInput{
+			method:       http.MethodDelete,
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Email: "admin@example.com"},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("without the claim of the method", policyTableInput{
+			method:       http.MethodDelete,
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Email: "user@example.com", Groups: []string{"users"}},
+			expectedCode: http.StatusForbidden,
+		}),
+		Entry("from the network of the path", policyTableInput{
+			method:       http.MethodPost,
+			path:         "/app/reports/q1",
+			remoteAddr:   "192.168.1.2:40000",
+			session:      &sessionsapi.SessionState{Email: "office@example.com"},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("from outside the network of the path", policyTableInput{
+			method:       http.MethodGet,
+			path:         "/app/reports/q1",
+			remoteAddr:   "203.0.113.1:40000",
+			session:      &sessionsapi.SessionState{Groups: []string{"users"}},
+			expectedCode: http.StatusForbidden,
+			expectedBody: `403 - the request is denied by policy "reports"`,
+		}),
+		Entry("to an upstream without policies", policyTableInput{
+			method:       http.MethodPost,
+			path:         "/open/page",
+			session:      &sessionsapi.SessionState{Groups: []string{"guests"}},
+			expectedCode: http.StatusOK,
+		}),
+	)
+
+	type anonymousTableInput struct {
+		method   string
+		path     string
+		expected bool
+	}
+
+	DescribeTable("allows the anonymous requests matching an anonymous policy first",
+		func(in anonymousTableInput) {
+			req := httptest.NewRequest(in.method, in.path, nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			Expect(proxy.(AnonymousAccess).AllowsAnonymous(req)).To(Equal(in.expected))
+		},
+		Entry("to an anonymous path", anonymousTableInput{
+			method:   http.MethodGet,
+			path:     "/app/health",
+			expected: true,
+		}),
+		Entry("to another path", anonymousTableInput{
+			method:   http.MethodGet,
+			path:     "/app/page",
+			expected: false,
+		}),
+		Entry("to an upstream without policies", anonymousTableInput{
+			method:   http.MethodGet,
+			path:     "/open/page",
+			expected: false,
+		}),
+		Entry("to no upstream", anonymousTableInput{
+			method:   http.MethodGet,
+			path:     "/missing",
+			expected: false,
+		}),
+	)
+
+	type authorizeTableInput struct {
+		method        string
+		path          string
+		remoteAddr    string
+		session       *sessionsapi.SessionState
+		expectedError string
+	}
+
+	DescribeTable("authorizes the requests outside of the upstream with the first matching policy",
+		func(in authorizeTableInput) {
+			req := httptest.NewRequest(in.method, in.path, nil)
+			if in.remoteAddr != "" {
+				req.RemoteAddr = in.remoteAddr
+			}
+			err := proxy.(PolicyAuthorizer).AuthorizePolicies(req, in.session)
+			if in.expectedError != "" {
+				Expect(err).To(MatchError(in.expectedError))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+		},
+		Entry("with a session in one of the groups", authorizeTableInput{
+			method:  http.MethodGet,
+			path:    "/app/page",
+			session: &sessionsapi.SessionState{Groups: []string{"users"}},
+		}),
+		Entry("with a session in none of the groups", authorizeTableInput{
+			method:        http.MethodGet,
+			path:          "/app/page",
+			session:       &sessionsapi.SessionState{Groups: []string{"guests"}},
+			expectedError: `denied by the policies of upstream "app": the request matches none of its policies`,
+		}),
+		Entry("without a session to a path of the groups", authorizeTableInput{
+			method:        http.MethodGet,
+			path:          "/app/page",
+			expectedError: `denied by the policies of upstream "app": the request matches none of its policies`,
+		}),
+		Entry("without a session from the network of the path", authorizeTableInput{
+			method:     http.MethodGet,
+			path:       "/app/reports/q1",
+			remoteAddr: "192.168.1.2:40000",
+		}),
+		Entry("without a session from outside the network of the path", authorizeTableInput{
+			method:        http.MethodGet,
+			path:          "/app/reports/q1",
+			remoteAddr:    "203.0.113.1:40000",
+			expectedError: `denied by the policies of upstream "app": the request is denied by policy "reports"`,
+		}),
+		Entry("to an upstream without policies", authorizeTableInput{
+			method: http.MethodGet,
+			path:   "/open/page",
+		}),
+		Entry("to no upstream", authorizeTableInput{
+			method: http.MethodGet,
+			path:   "/missing",
+		}),
+	)
+
+	It("allows the anonymous requests by the policies of the dynamic upstreams", func() {
+		errs := proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			static("docs", "/docs/", options.UpstreamPolicy{AllowAnonymous: true}),
+		})
+		Expect(errs).To(BeEmpty())
+
+		req := httptest.NewRequest(http.MethodGet, "/docs/index", nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		Expect(proxy.(AnonymousAccess).AllowsAnonymous(req)).To(BeTrue())
+	})
+
+	It("fails to register the upstreams with invalid policies", func() {
+		_, err := NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				static("app", "/app/", options.UpstreamPolicy{CIDRs: []string{"10.0.0.0/33"}}),
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).To(MatchError(`could not register static upstream "app": invalid policy "policies[0]" for upstream "app": invalid cidr "10.0.0.0/33"`))
+	})
+})
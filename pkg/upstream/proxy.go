@@ -1,99 +1,481 @@
 package upstream
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/header"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ProxyErrorHandler is a function that will be used to render error pages when
 // HTTP proxies fail to connect to upstream servers.
 type ProxyErrorHandler func(http.ResponseWriter, *http.Request, error)
 
+// DenialFunc records a request the policies or token requirements of an
+// upstream denied, with the session of the request, if any, and the reason
+// it was denied for
+type DenialFunc func(req *http.Request, session *sessionsapi.SessionState, upstream string, reason string)
+
 // NewProxy creates a new multiUpstreamProxy that can serve requests directed to
 // multiple upstreams.
-func NewProxy(upstreams options.UpstreamConfig, sigData *options.SignatureData, writer pagewriter.Writer) (http.Handler, error) {
+// Requests slower than the slow request threshold are logged.
+// The response header policy is applied to the responses of every upstream,
+// extended by the upstream's own policy.
+// Requests served while the session store is unavailable are handled with the
+// session store unavailable policy, unless the upstream overrides it.
+// The cookies named after the proxy cookie name are stripped from the
+// requests to upstreams with StripProxyCookies.
+// The response caches stored in Redis connect to the Redis server of the
+// cache redis options.
+// Upstreams rate limited by client IP use the real client IP parsed by the
+// real client IP parser, when it is set.
+// The tokens of upstreams with a TokenExchange are exchanged with the token
+// exchanger, which must be set for them.
+// Requests denied by the policies or token requirements of an upstream are
+// recorded with the denial func, when it is set.
+func NewProxy(upstreams options.UpstreamConfig, sigData *options.SignatureData, writer pagewriter.Writer, slowRequests options.SlowRequestLog, responseHeaderPolicy []options.ResponseHeaderPolicy, sessionStoreUnavailable string, proxyCookieName string, cacheRedis options.RedisStoreOptions, realClientIPParser ipapi.RealClientIPParser, tokenExchanger TokenExchanger, recordDenial DenialFunc) (http.Handler, error) {
 	m := &multiUpstreamProxy{
-		serveMux: mux.NewRouter(),
+		serveMux:                mux.NewRouter(),
+		requests:                &requestTracker{},
+		slowRequests:            slowRequests,
+		responseHeaderPolicy:    responseHeaderPolicy,
+		sessionStoreUnavailable: sessionStoreUnavailable,
+		proxyCookieName:         proxyCookieName,
+		realClientIPParser:      realClientIPParser,
+		recordDenial:            recordDenial,
+		limiterMetrics:          newLimiterMetrics(prometheus.DefaultRegisterer),
+		bodyLimitMetrics:        newBodyLimitMetrics(prometheus.DefaultRegisterer),
+		rateLimitMetrics:        newRateLimitMetrics(prometheus.DefaultRegisterer),
+		faultMetrics:            newFaultMetrics(prometheus.DefaultRegisterer),
+		timingMetrics:           newTimingMetrics(prometheus.DefaultRegisterer),
+		degradedMetrics:         newDegradedMetrics(prometheus.DefaultRegisterer),
+		dnsMetrics:              newDNSMetrics(prometheus.DefaultRegisterer),
+		streamMetrics:           newStreamMetrics(prometheus.DefaultRegisterer),
+		mirrorMetrics:           newMirrorMetrics(prometheus.DefaultRegisterer),
+		balancerMetrics:         newBalancerMetrics(prometheus.DefaultRegisterer),
+		healthMetrics:           newHealthMetrics(prometheus.DefaultRegisterer),
+		cacheMetrics:            newCacheMetrics(prometheus.DefaultRegisterer),
+		circuitBreakerMetrics:   newCircuitBreakerMetrics(prometheus.DefaultRegisterer),
+		tokenExchangeMetrics:    newTokenExchangeMetrics(prometheus.DefaultRegisterer),
+		webSockets:              newWebSocketConnections(),
+		cacheRedis:              newCacheRedisClient(cacheRedis),
+		tokenExchanger:          tokenExchanger,
+		exchangedTokens:         newExchangedTokens(),
+		proxyRawPath:            upstreams.ProxyRawPath,
+		sigData:                 sigData,
+		writer:                  writer,
 	}
 
-	if upstreams.ProxyRawPath {
-		m.serveMux.UseEncodedPath()
+	configured, err := m.newConfiguredProxy(upstreams)
+	if err != nil {
+		return nil, err
 	}
+	m.configured.Store(configured)
+	return m, nil
+}
 
+// newChildProxy creates a proxy without upstreams sharing the settings,
+// metrics and WebSocket connections of the proxy, for the configured or
+// dynamic upstreams
+func (m *multiUpstreamProxy) newChildProxy(proxyRawPath bool) *multiUpstreamProxy {
+	child := &multiUpstreamProxy{
+		serveMux:                mux.NewRouter(),
+		requests:                &requestTracker{},
+		policies:                map[string]*upstreamPolicies{},
+		slowRequests:            m.slowRequests,
+		responseHeaderPolicy:    m.responseHeaderPolicy,
+		sessionStoreUnavailable: m.sessionStoreUnavailable,
+		proxyCookieName:         m.proxyCookieName,
+		realClientIPParser:      m.realClientIPParser,
+		recordDenial:            m.recordDenial,
+		limiterMetrics:          m.limiterMetrics,
+		bodyLimitMetrics:        m.bodyLimitMetrics,
+		rateLimitMetrics:        m.rateLimitMetrics,
+		faultMetrics:            m.faultMetrics,
+		timingMetrics:           m.timingMetrics,
+		degradedMetrics:         m.degradedMetrics,
+		dnsMetrics:              m.dnsMetrics,
+		streamMetrics:           m.streamMetrics,
+		mirrorMetrics:           m.mirrorMetrics,
+		balancerMetrics:         m.balancerMetrics,
+		healthMetrics:           m.healthMetrics,
+		cacheMetrics:            m.cacheMetrics,
+		circuitBreakerMetrics:   m.circuitBreakerMetrics,
+		tokenExchangeMetrics:    m.tokenExchangeMetrics,
+		webSockets:              m.webSockets,
+		cacheRedis:              m.cacheRedis,
+		tokenExchanger:          m.tokenExchanger,
+		exchangedTokens:         m.exchangedTokens,
+	}
+	if proxyRawPath {
+		child.serveMux.UseEncodedPath()
+	}
+	return child
+}
+
+// newConfiguredProxy registers the configured upstreams with a new child
+// proxy. The proxy is closed when any of the upstreams can't be registered.
+func (m *multiUpstreamProxy) newConfiguredProxy(upstreams options.UpstreamConfig) (*multiUpstreamProxy, error) {
+	configured := m.newChildProxy(upstreams.ProxyRawPath)
 	for _, upstream := range sortByPathLongest(upstreams.Upstreams) {
-		if upstream.Static {
-			if err := m.registerStaticResponseHandler(upstream, writer); err != nil {
-				return nil, fmt.Errorf("could not register static upstream %q: %v", upstream.ID, err)
-			}
-			continue
+		if err := configured.register(upstream, upstreams.Upstreams, m.sigData, m.writer); err != nil {
+			configured.close()
+			return nil, err
 		}
+	}
 
-		u, err := url.Parse(upstream.URI)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing URI for upstream %q: %w", upstream.ID, err)
+	registerTrailingSlashHandler(configured.serveMux)
+	return configured, nil
+}
+
+// register registers the handler of the upstream with the serveMux.
+// The upstreams are those the upstream is registered with, so that static
+// templates can list them.
+func (m *multiUpstreamProxy) register(upstream options.Upstream, upstreams []options.Upstream, sigData *options.SignatureData, writer pagewriter.Writer) error {
+	if upstream.Static {
+		if err := m.registerStaticResponseHandler(upstream, upstreams, writer); err != nil {
+			return fmt.Errorf("could not register static upstream %q: %v", upstream.ID, err)
 		}
-		switch u.Scheme {
-		case fileScheme:
-			if err := m.registerFileServer(upstream, u, writer); err != nil {
-				return nil, fmt.Errorf("could not register file upstream %q: %v", upstream.ID, err)
-			}
-		case httpScheme, httpsScheme:
-			if err := m.registerHTTPUpstreamProxy(upstream, u, sigData, writer); err != nil {
-				return nil, fmt.Errorf("could not register HTTP upstream %q: %v", upstream.ID, err)
-			}
-		default:
-			return nil, fmt.Errorf("unknown scheme for upstream %q: %q", upstream.ID, u.Scheme)
+		return nil
+	}
+
+	if isTemplatedURI(upstream.URI) {
+		if err := m.registerTemplatedUpstreamProxy(upstream, sigData, writer); err != nil {
+			return fmt.Errorf("could not register templated upstream %q: %v", upstream.ID, err)
 		}
+		return nil
 	}
 
-	registerTrailingSlashHandler(m.serveMux)
-	return m, nil
+	u, err := url.Parse(upstream.URI)
+	if err != nil {
+		return fmt.Errorf("error parsing URI for upstream %q: %w", upstream.ID, err)
+	}
+	switch u.Scheme {
+	case fileScheme:
+		if err := m.registerFileServer(upstream, u, writer); err != nil {
+			return fmt.Errorf("could not register file upstream %q: %v", upstream.ID, err)
+		}
+	case httpScheme, httpsScheme, h2cScheme:
+		if err := m.registerHTTPUpstreamProxy(upstream, u, sigData, writer); err != nil {
+			return fmt.Errorf("could not register HTTP upstream %q: %v", upstream.ID, err)
+		}
+	case unixScheme:
+		if err := m.registerHTTPUpstreamProxy(upstream, unixSocketHTTPURL(), sigData, writer); err != nil {
+			return fmt.Errorf("could not register unix socket upstream %q: %v", upstream.ID, err)
+		}
+	default:
+		factory, ok := getHandlerFactory(u.Scheme)
+		if !ok {
+			return fmt.Errorf("unknown scheme for upstream %q: %q", upstream.ID, u.Scheme)
+		}
+		if err := m.registerCustomHandler(upstream, u, factory, writer); err != nil {
+			return fmt.Errorf("could not register %s upstream %q: %v", u.Scheme, upstream.ID, err)
+		}
+	}
+	return nil
 }
 
 // multiUpstreamProxy will serve requests directed to multiple upstream servers
 // registered in the serverMux.
 type multiUpstreamProxy struct {
-	serveMux *mux.Router
+	serveMux                *mux.Router
+	slowRequests            options.SlowRequestLog
+	responseHeaderPolicy    []options.ResponseHeaderPolicy
+	sessionStoreUnavailable string
+	proxyCookieName         string
+	realClientIPParser      ipapi.RealClientIPParser
+	recordDenial            DenialFunc
+	limiterMetrics          *limiterMetrics
+	bodyLimitMetrics        *bodyLimitMetrics
+	rateLimitMetrics        *rateLimitMetrics
+	faultMetrics            *faultMetrics
+	timingMetrics           *timingMetrics
+	degradedMetrics         *degradedMetrics
+	dnsMetrics              *dnsMetrics
+	streamMetrics           *streamMetrics
+	mirrorMetrics           *mirrorMetrics
+	balancerMetrics         *balancerMetrics
+	healthMetrics           *healthMetrics
+	cacheMetrics            *cacheMetrics
+	circuitBreakerMetrics   *circuitBreakerMetrics
+	tokenExchangeMetrics    *tokenExchangeMetrics
+
+	// webSockets tracks the WebSocket connections proxied to the upstreams,
+	// including the dynamic upstreams
+	webSockets *webSocketConnections
+
+	// routes describes the upstreams in the order they were registered
+	routes []Route
+
+	// healthChecks are the health checks of the upstreams in the order they
+	// were registered
+	healthChecks []*healthChecker
+
+	// httpProxies are the HTTP upstream proxies in the order they were
+	// registered, closed once they are replaced by a reload
+	httpProxies []*httpUpstreamProxy
+
+	// requests tracks the requests served by the upstreams, so that they can
+	// be drained once the upstreams are replaced by a reload
+	requests *requestTracker
+
+	// cacheRedis is the client of the response caches stored in Redis,
+	// shared with the dynamic upstreams
+	cacheRedis *cacheRedisClient
+
+	// tokenExchanger exchanges the access tokens of sessions for the tokens
+	// of the upstreams with a TokenExchange, which are cached in
+	// exchangedTokens, shared with the dynamic upstreams
+	tokenExchanger  TokenExchanger
+	exchangedTokens *exchangedTokens
+
+	// caches are the response caches of the upstreams in the order they
+	// were registered
+	caches []*responseCache
+
+	// policies are the authorization policies of the upstreams, by ID
+	policies map[string]*upstreamPolicies
+
+	// The settings the dynamic upstreams are registered with
+	proxyRawPath bool
+	sigData      *options.SignatureData
+	writer       pagewriter.Writer
+
+	// dynamic holds the *multiUpstreamProxy of the dynamic upstreams, once
+	// they are set
+	dynamic atomic.Value
+
+	// configured holds the *multiUpstreamProxy of the configured upstreams,
+	// replaced every time they are reloaded
+	configured atomic.Value
 }
 
 // ServerHTTP handles HTTP requests.
+// Requests matching a dynamic upstream are served by it, any other requests
+// by the upstreams the proxy was created with.
+// The request is routed in the upstream route span of its trace.
 func (m *multiUpstreamProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	m.serveMux.ServeHTTP(rw, req)
+	ctx, span := tracing.Tracer().Start(req.Context(), "upstream.route")
+	defer span.End()
+	m.route(rw, req.WithContext(ctx))
+
+	if scope := middleware.GetRequestScope(req); scope != nil && scope.Upstream != "" {
+		span.SetAttributes(tracing.UpstreamKey.String(scope.Upstream))
+	}
+}
+
+// route serves the request with the handler of the dynamic upstream matching
+// it, or else of the configured upstream matching it
+func (m *multiUpstreamProxy) route(rw http.ResponseWriter, req *http.Request) {
+	if dynamic := m.loadDynamic(); dynamic != nil {
+		var match mux.RouteMatch
+		if dynamic.serveMux.Match(req, &match) {
+			defer dynamic.requests.track()()
+			dynamic.serveMux.ServeHTTP(rw, req)
+			return
+		}
+	}
+	configured := m.loadConfigured()
+	defer configured.requests.track()()
+	configured.serveMux.ServeHTTP(rw, req)
 }
 
 // registerStaticResponseHandler registers a static response handler with at the given path.
-func (m *multiUpstreamProxy) registerStaticResponseHandler(upstream options.Upstream, writer pagewriter.Writer) error {
-	logger.Printf("mapping path %q => static response %d", upstream.Path, derefStaticCode(upstream.StaticCode))
-	return m.registerHandler(upstream, newStaticResponseHandler(upstream.ID, upstream.StaticCode), writer)
+// When the upstream has a StaticTemplate, StaticBody or StaticHeaders, the
+// response is rendered from them with the list of all upstreams.
+func (m *multiUpstreamProxy) registerStaticResponseHandler(upstream options.Upstream, upstreams []options.Upstream, writer pagewriter.Writer) error {
+	if upstream.StaticTemplate == "" && upstream.StaticBody == "" && len(upstream.StaticHeaders) == 0 {
+		logger.Printf("mapping path %q => static response %d", upstream.Path, derefStaticCode(upstream.StaticCode))
+		return m.registerHandler(upstream, newStaticResponseHandler(upstream.ID, upstream.StaticCode, upstream.StaticContentType), writer)
+	}
+
+	handler, err := newStaticTemplateHandler(upstream, upstreams, writer)
+	if err != nil {
+		return err
+	}
+	if upstream.StaticTemplate != "" {
+		logger.Printf("mapping path %q => static template %q with response %d", upstream.Path, upstream.StaticTemplate, derefStaticCode(upstream.StaticCode))
+	} else {
+		logger.Printf("mapping path %q => templated static response %d", upstream.Path, derefStaticCode(upstream.StaticCode))
+	}
+	return m.registerHandler(upstream, handler, writer)
 }
 
 // registerFileServer registers a new fileServer based on the configuration given.
 func (m *multiUpstreamProxy) registerFileServer(upstream options.Upstream, u *url.URL, writer pagewriter.Writer) error {
 	logger.Printf("mapping path %q => file system %q", upstream.Path, u.Path)
-	return m.registerHandler(upstream, newFileServer(upstream.ID, upstream.Path, u.Path), writer)
+	return m.registerHandler(upstream, newFileServer(upstream.ID, upstream.Path, u.Path, upstream.FileServer), writer)
 }
 
 // registerHTTPUpstreamProxy registers a new httpUpstreamProxy based on the configuration given.
+// Upstreams with a CircuitBreaker have the proxy wrapped in a circuit breaker.
 func (m *multiUpstreamProxy) registerHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, writer pagewriter.Writer) error {
+	handler, err := newHTTPUpstreamProxy(upstream, u, sigData, writer.ProxyErrorHandler, m.dnsMetrics, m.streamMetrics, m.mirrorMetrics, m.balancerMetrics, m.healthMetrics)
+	if err != nil {
+		return err
+	}
+	m.httpProxies = append(m.httpProxies, handler.(*httpUpstreamProxy))
+	if health := handler.(*httpUpstreamProxy).health; health != nil {
+		m.healthChecks = append(m.healthChecks, health)
+	}
 	logger.Printf("mapping path %q => upstream %q", upstream.Path, upstream.URI)
-	return m.registerHandler(upstream, newHTTPUpstreamProxy(upstream, u, sigData, writer.ProxyErrorHandler), writer)
+	for _, backend := range upstream.Backends {
+		logger.Printf("balancing upstream %q => backend %q", upstream.ID, backend.URI)
+	}
+	if upstream.Mirror != nil {
+		logger.Printf("mirroring %d%% of the requests to upstream %q => %q", upstream.Mirror.SamplePercent, upstream.ID, upstream.Mirror.URI)
+	}
+	if upstream.CircuitBreaker != nil {
+		logger.Printf("breaking the circuit of upstream %q when its requests fail", upstream.ID)
+		handler = newCircuitBreaker(upstream, handler, writer, m.circuitBreakerMetrics)
+	}
+	return m.registerHandler(upstream, handler, writer)
+}
+
+// registerTemplatedUpstreamProxy registers a new templatedUpstreamProxy based on the configuration given.
+// Upstreams with a CircuitBreaker have the proxy wrapped in a circuit breaker,
+// shared by all the hosts of the templated URI.
+func (m *multiUpstreamProxy) registerTemplatedUpstreamProxy(upstream options.Upstream, sigData *options.SignatureData, writer pagewriter.Writer) error {
+	handler, err := newTemplatedUpstreamProxy(upstream, sigData, writer)
+	if err != nil {
+		return err
+	}
+	logger.Printf("mapping path %q => templated upstream %q", upstream.Path, upstream.URI)
+	if upstream.CircuitBreaker != nil {
+		logger.Printf("breaking the circuit of upstream %q when its requests fail", upstream.ID)
+		handler = newCircuitBreaker(upstream, handler, writer, m.circuitBreakerMetrics)
+	}
+	return m.registerHandler(upstream, handler, writer)
+}
+
+// registerCustomHandler registers the handler created by the factory of a
+// custom scheme, which is recorded as the upstream of the requests it serves.
+// Upstreams with a CircuitBreaker have the handler wrapped in a circuit
+// breaker, counting its 5xx responses as failures.
+func (m *multiUpstreamProxy) registerCustomHandler(upstream options.Upstream, u *url.URL, factory HandlerFactory, writer pagewriter.Writer) error {
+	custom, err := factory.NewHandler(upstream, u, writer)
+	if err != nil {
+		return err
+	}
+	var handler http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := middleware.GetRequestScope(req)
+		// If scope is nil, this will panic.
+		// A scope should always be injected before this handler is called.
+		scope.Upstream = upstream.ID
+		custom.ServeHTTP(rw, req)
+	})
+	logger.Printf("mapping path %q => %s upstream %q", upstream.Path, u.Scheme, upstream.URI)
+	if upstream.CircuitBreaker != nil {
+		logger.Printf("breaking the circuit of upstream %q when its requests fail", upstream.ID)
+		handler = newCircuitBreaker(upstream, handler, writer, m.circuitBreakerMetrics)
+	}
+	return m.registerHandler(upstream, handler, writer)
 }
 
 // registerHandler ensures the given handler is regiestered with the serveMux.
+// Upstreams with DisableIdentityHeaders have the identity headers removed
+// once the request has been routed to them, and all upstreams are sent their
+// PassTLSHeaders in place of any the client set. The client's Authorization
+// header is then restored or moved as the upstream's AuthorizationConflict
+// policy dictates, and the client headers are filtered by the upstream's
+// allowed request headers and cookie options.
+// Upstreams with MaxConcurrentRequests have the handler wrapped in a
+// concurrency limiter, and all handlers are timed, including any time spent
+// waiting for the limiter. Requests with bodies larger than the upstream's
+// MaxRequestBodySize are rejected before they are queued.
+// Upstreams with a Cache serve cached responses before requests are limited
+// or queued.
+// Requests served while the session store is unavailable are handled with
+// the upstream's session store unavailable policy before they are queued.
+// Bearer tokens are checked against the upstream's token requirements before
+// that, and WebSocket upgrade requests against its WebSocket policy.
+// Upstreams with a FaultInjection have faults injected into the requests
+// that pass these checks, before they are rate limited.
+// Requests with a session are authorized by the upstream's policies before
+// their bearer tokens are checked.
+// The response header policy is applied to all responses, including those
+// rejected by the limiter.
 func (m *multiUpstreamProxy) registerHandler(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer) error {
+	handler, err := newHeaderRewrites(upstream, handler)
+	if err != nil {
+		return err
+	}
+	handler = m.webSockets.track(handler)
+	handler, err = newTokenExchange(upstream, m.tokenExchanger, m.exchangedTokens, handler, writer, m.tokenExchangeMetrics)
+	if err != nil {
+		return err
+	}
+	handler = newRequestHeaderFilter(upstream, m.proxyCookieName, handler)
+	handler = newAuthorizationConflict(upstream, handler)
+	if upstream.DisableIdentityHeaders {
+		handler = stripIdentityHeaders(handler)
+	}
+	handler = newTLSHeaders(upstream, handler)
+	if upstream.MaxConcurrentRequests > 0 {
+		logger.Printf("limiting upstream %q to %d concurrent requests with a queue of %d", upstream.ID, upstream.MaxConcurrentRequests, upstream.QueueSize)
+		handler = newConcurrencyLimiter(upstream, handler, writer, m.limiterMetrics)
+	}
+	if upstream.MaxRequestBodySize > 0 {
+		logger.Printf("limiting request bodies to upstream %q to %d bytes", upstream.ID, upstream.MaxRequestBodySize)
+		handler = newBodyLimiter(upstream, handler, writer, m.bodyLimitMetrics)
+	}
+	if upstream.Cache != nil {
+		logger.Printf("caching responses of upstream %q", upstream.ID)
+		cache, err := newResponseCache(upstream, handler, m.cacheMetrics, m.cacheRedis)
+		if err != nil {
+			return err
+		}
+		m.caches = append(m.caches, cache)
+		handler = cache
+	}
+	if upstream.RateLimit != nil {
+		limiter := newRateLimiter(upstream, m.realClientIPParser, handler, writer, m.rateLimitMetrics)
+		logger.Printf("rate limiting requests to upstream %q to %g per second for each %s", upstream.ID, limiter.rate, limiter.key)
+		handler = limiter
+	}
+	if upstream.FaultInjection != nil {
+		logger.Printf("injecting faults into %d%% of the experiment requests to upstream %q", upstream.FaultInjection.Percent, upstream.ID)
+		handler = newFaultInjector(upstream, handler, writer, m.faultMetrics)
+	}
+	handler = newSessionStorePolicy(upstream, m.sessionStoreUnavailable, handler, writer, m.degradedMetrics)
+	handler = newTokenRequirements(upstream, handler, writer, m.recordDenial)
+	policies, err := newUpstreamPolicies(upstream, m.realClientIPParser, handler, writer, m.recordDenial)
+	if err != nil {
+		return err
+	}
+	if policies != nil {
+		m.policies[upstream.ID] = policies
+		handler = policies
+	}
+	handler = newWebSocketPolicy(upstream, handler, writer)
+	if policy := header.NewResponsePolicy(m.responseHeaderPolicy, upstream.ResponseHeaderPolicy); !policy.Empty() {
+		handler = policy.Handler(handler)
+	}
+	handler = newUpstreamTiming(upstream.ID, handler, m.slowRequests, m.timingMetrics)
+	m.routes = append(m.routes, newRoute(upstream))
+
+	// The routes are named after the upstream so that they can be matched
+	// to it
 	if upstream.RewriteTarget == "" {
-		m.registerSimpleHandler(upstream.Path, handler)
+		route := m.registerSimpleHandler(upstream.Path, handler).Name(upstream.ID)
+		if matcher := newSessionMatcher(upstream); matcher != nil {
+			route.MatcherFunc(matcher.Match)
+		}
 		return nil
 	}
 
@@ -102,12 +484,11 @@ func (m *multiUpstreamProxy) registerHandler(upstream options.Upstream, handler
 
 // registerSimpleHandler maintains the behaviour of the go standard serveMux
 // by ensuring any path with a trailing `/` matches all paths under that prefix.
-func (m *multiUpstreamProxy) registerSimpleHandler(path string, handler http.Handler) {
+func (m *multiUpstreamProxy) registerSimpleHandler(path string, handler http.Handler) *mux.Route {
 	if strings.HasSuffix(path, "/") {
-		m.serveMux.PathPrefix(path).Handler(handler)
-	} else {
-		m.serveMux.Path(path).Handler(handler)
+		return m.serveMux.PathPrefix(path).Handler(handler)
 	}
+	return m.serveMux.Path(path).Handler(handler)
 }
 
 // registerRewriteHandler ensures the handler is registered for all paths
@@ -122,9 +503,12 @@ func (m *multiUpstreamProxy) registerRewriteHandler(upstream options.Upstream, h
 
 	rewrite := newRewritePath(rewriteRegExp, upstream.RewriteTarget, writer)
 	h := alice.New(rewrite).Then(handler)
-	m.serveMux.MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
+	route := m.serveMux.MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
 		return rewriteRegExp.MatchString(req.URL.Path)
-	}).Handler(h)
+	}).Handler(h).Name(upstream.ID)
+	if matcher := newSessionMatcher(upstream); matcher != nil {
+		route.MatcherFunc(matcher.Match)
+	}
 
 	return nil
 }
@@ -143,7 +527,9 @@ func registerTrailingSlashHandler(serveMux *mux.Router) {
 		// If we pass through the match then the matched backed will be served
 		// instead of the redirect handler.
 		m := &mux.RouteMatch{}
-		slashReq := req.Clone(context.Background())
+		// The request keeps its scope, so that the routes of upstreams
+		// with a SessionMatch can match it
+		slashReq := req.Clone(req.Context())
 		slashReq.URL.Path += "/"
 		return serveMux.Match(slashReq, m)
 	}).Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -157,8 +543,15 @@ func registerTrailingSlashHandler(serveMux *mux.Router) {
 // precedence (note this is the input to the rewrite logic).
 // This does not account for when a rewrite would actually make the path shorter.
 // This should maintain the sorting behaviour of the standard go serve mux.
+// Upstreams with a SessionMatch take precedence over those without one with
+// the same path, and are otherwise kept in the order they are configured.
 func sortByPathLongest(in []options.Upstream) []options.Upstream {
-	sort.Slice(in, func(i, j int) bool {
+	// Upstreams matching sessions go before the upstream serving the other
+	// sessions, which the stable sort keeps for upstreams with the same path
+	sort.SliceStable(in, func(i, j int) bool {
+		return in[i].SessionMatch != nil && in[j].SessionMatch == nil
+	})
+	sort.SliceStable(in, func(i, j int) bool {
 		iRW := in[i].RewriteTarget
 		jRW := in[j].RewriteTarget
 
@@ -180,3 +573,17 @@ func sortByPathLongest(in []options.Upstream) []options.Upstream {
 	})
 	return in
 }
+
+// stripIdentityHeaders removes the request headers injected with the identity
+// of the session before the request is passed to the upstream handler.
+func stripIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := middleware.GetRequestScope(req)
+		if scope != nil {
+			for _, header := range scope.IdentityHeaders {
+				req.Header.Del(header)
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -98,10 +98,30 @@ var _ = Describe("Proxy Suite", func() {
 							RewriteTarget: "/double-match/rewrite/$1",
 							URI:           serverAddr,
 						},
+						{
+							ID:        "strip-path-backend",
+							Path:      "/strip/",
+							URI:       serverAddr,
+							StripPath: true,
+						},
+						{
+							ID:          "prepend-path-backend",
+							Path:        "/prepend/",
+							URI:         serverAddr,
+							StripPath:   true,
+							PrependPath: "/api",
+						},
+						{
+							ID:          "prepend-single-path-backend",
+							Path:        "/prepend-single-path",
+							URI:         serverAddr,
+							StripPath:   true,
+							PrependPath: "/api/",
+						},
 					}
 				}
 
-				upstreamServer, err := NewProxy(upstreams, sigData, writer)
+				upstreamServer, err := NewProxy(upstreams, sigData, writer, options.SlowRequestLog{}, nil, options.SessionStoreFailClosed, "", options.RedisStoreOptions{}, nil, nil, nil)
 				Expect(err).ToNot(HaveOccurred())
 
 				req := middlewareapi.AddRequestScope(
@@ -312,6 +332,101 @@ var _ = Describe("Proxy Suite", func() {
 				},
 				upstream: "double-match-rewrite",
 			}),
+			Entry("with a request to a backend with a stripped path", &proxyTableInput{
+				target: "http://example.localhost/strip/1234",
+				response: testHTTPResponse{
+					code: 200,
+					header: map[string][]string{
+						contentType: {applicationJSON},
+					},
+					request: testHTTPRequest{
+						Method: "GET",
+						URL:    "http://example.localhost/1234",
+						Header: map[string][]string{
+							"Gap-Auth":      {""},
+							"Gap-Signature": {"sha256 eIEPos43Tj8Y1W5JevB+9EaXK5dzXQ73M17NWl9XNCM="},
+						},
+						Body:       []byte{},
+						Host:       "example.localhost",
+						RequestURI: "http://example.localhost/1234",
+					},
+				},
+				upstream: "strip-path-backend",
+			}),
+			Entry("with a request to exactly the stripped path", &proxyTableInput{
+				target: "http://example.localhost/strip/",
+				response: testHTTPResponse{
+					code: 200,
+					header: map[string][]string{
+						contentType: {applicationJSON},
+					},
+					request: testHTTPRequest{
+						Method: "GET",
+						URL:    "http://example.localhost/",
+						Header: map[string][]string{
+							"Gap-Auth":      {""},
+							"Gap-Signature": {"sha256 aW8LbP59bby2KL7QASoKoSc8PVjYn9Y2SkyZHGajEA8="},
+						},
+						Body:       []byte{},
+						Host:       "example.localhost",
+						RequestURI: "http://example.localhost/",
+					},
+				},
+				upstream: "strip-path-backend",
+			}),
+			Entry("with a request to the stripped path, missing the trailing slash", &proxyTableInput{
+				target: "http://example.localhost/strip",
+				response: testHTTPResponse{
+					code: 301,
+					header: map[string][]string{
+						contentType: {textHTMLUTF8},
+						"Location":  {"http://example.localhost/strip/"},
+					},
+					raw: "<a href=\"http://example.localhost/strip/\">Moved Permanently</a>.\n\n",
+				},
+			}),
+			Entry("with a request to a backend with a stripped and prepended path", &proxyTableInput{
+				target: "http://example.localhost/prepend/foo%2Fbar?baz=1",
+				response: testHTTPResponse{
+					code: 200,
+					header: map[string][]string{
+						contentType: {applicationJSON},
+					},
+					request: testHTTPRequest{
+						Method: "GET",
+						URL:    "http://example.localhost/api/foo%2Fbar?baz=1",
+						Header: map[string][]string{
+							"Gap-Auth":      {""},
+							"Gap-Signature": {"sha256 NQaihLjJl6ZcK8k6ynTp2UUlGRMK3AC2WHb8AoWTq3s="},
+						},
+						Body:       []byte{},
+						Host:       "example.localhost",
+						RequestURI: "http://example.localhost/api/foo%2Fbar?baz=1",
+					},
+				},
+				upstream: "prepend-path-backend",
+			}),
+			Entry("with a request to exactly a stripped single path", &proxyTableInput{
+				target: "http://example.localhost/prepend-single-path",
+				response: testHTTPResponse{
+					code: 200,
+					header: map[string][]string{
+						contentType: {applicationJSON},
+					},
+					request: testHTTPRequest{
+						Method: "GET",
+						URL:    "http://example.localhost/api/",
+						Header: map[string][]string{
+							"Gap-Auth":      {""},
+							"Gap-Signature": {"sha256 pLLur5rshq/QbN1WsNBvpl6VK4CJ2xwGVE7IGMwXNLY="},
+						},
+						Body:       []byte{},
+						Host:       "example.localhost",
+						RequestURI: "http://example.localhost/api/",
+					},
+				},
+				upstream: "prepend-single-path-backend",
+			}),
 			Entry("containing an escaped '/' without ProxyRawPath", &proxyTableInput{
 				target: "http://example.localhost/%2F/test1/%2F/test2",
 				response: testHTTPResponse{
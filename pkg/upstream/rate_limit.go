@@ -0,0 +1,204 @@
+package upstream
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// minRateLimitSweepInterval is the shortest interval at which the full
+// buckets of a rate limiter are removed, so that upstreams with high rates
+// aren't swept on every request
+const minRateLimitSweepInterval = time.Minute
+
+// newRateLimiter wraps the handler so that the requests of each user, or
+// client IP, to the upstream are limited to the upstream's RateLimit,
+// filling in its defaults.
+func newRateLimiter(upstream options.Upstream, realClientIPParser ipapi.RealClientIPParser, handler http.Handler, writer pagewriter.Writer, metrics *rateLimitMetrics) *rateLimiter {
+	opts := upstream.RateLimit
+
+	period := options.DefaultUpstreamRateLimitPeriod
+	if opts.Period != nil {
+		period = opts.Period.Duration()
+	}
+	burst := opts.Requests
+	if opts.Burst > 0 {
+		burst = opts.Burst
+	}
+	key := options.RateLimitKeyUser
+	if opts.Key != "" {
+		key = opts.Key
+	}
+
+	rate := float64(opts.Requests) / period.Seconds()
+	sweepInterval := time.Duration(float64(burst) / rate * float64(time.Second))
+	if sweepInterval < minRateLimitSweepInterval {
+		sweepInterval = minRateLimitSweepInterval
+	}
+
+	return &rateLimiter{
+		upstream:           upstream.ID,
+		key:                key,
+		rate:               rate,
+		burst:              float64(burst),
+		sweepInterval:      sweepInterval,
+		realClientIPParser: realClientIPParser,
+		handler:            handler,
+		writer:             writer,
+		metrics:            metrics,
+		buckets:            map[string]*tokenBucket{},
+	}
+}
+
+// rateLimiter limits the rate of the requests to an upstream with a token
+// bucket per user, or client IP.
+type rateLimiter struct {
+	upstream string
+	key      string
+
+	// rate is the number of tokens refilled per second
+	rate float64
+	// burst is the number of tokens of a full bucket
+	burst float64
+	// sweepInterval is the interval at which the full buckets are removed
+	sweepInterval time.Duration
+
+	realClientIPParser ipapi.RealClientIPParser
+	handler            http.Handler
+	writer             pagewriter.Writer
+	metrics            *rateLimitMetrics
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	clock     clock.Clock
+}
+
+// tokenBucket holds the tokens left to a user, or client IP, as of when it
+// was last updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// ServeHTTP serves the request if there is a token left in the bucket of its
+// user, or client IP.
+// Requests are otherwise rejected with a 429 response.
+func (l *rateLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	keyType, key := l.requestKey(req)
+	if wait, ok := l.take(keyType+":"+key, l.clock.Now()); !ok {
+		l.reject(rw, req, keyType, key, wait)
+		return
+	}
+	l.handler.ServeHTTP(rw, req)
+}
+
+// requestKey returns the type and value of the key the request is limited
+// by: the user of its session when the upstream is limited by user, and its
+// client IP otherwise.
+func (l *rateLimiter) requestKey(req *http.Request) (string, string) {
+	if l.key == options.RateLimitKeyUser {
+		if session := middleware.GetRequestScope(req).Session; session != nil {
+			if session.User != "" {
+				return options.RateLimitKeyUser, session.User
+			}
+			if session.Email != "" {
+				return options.RateLimitKeyUser, session.Email
+			}
+		}
+	}
+
+	// Requests whose real client IP can't be parsed are limited by the IP
+	// they are connected from, so that an invalid header doesn't bypass the
+	// limit
+	clientIP, err := ip.GetClientIP(l.realClientIPParser, req)
+	if err != nil || clientIP == nil {
+		clientIP, err = ip.GetClientIP(nil, req)
+	}
+	if err != nil {
+		return options.RateLimitKeyIP, req.RemoteAddr
+	}
+	return options.RateLimitKeyIP, clientIP.String()
+}
+
+// take takes a token from the bucket of the key.
+// It returns how long until a token is refilled when the bucket is empty.
+func (l *rateLimiter) take(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.sweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = l.refill(bucket, now)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+}
+
+// refill returns the tokens of the bucket as of now
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed <= 0 {
+		return bucket.tokens
+	}
+	return math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+}
+
+// sweep removes the buckets that have been refilled, as they are the same
+// as the new buckets of their keys, so that the buckets of users and clients
+// that stopped making requests aren't kept forever
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if l.refill(bucket, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// reject counts the rejected request and writes a 429 error page asking the
+// client to retry once a token is refilled
+func (l *rateLimiter) reject(rw http.ResponseWriter, req *http.Request, keyType, key string, wait time.Duration) {
+	l.metrics.rejected.WithLabelValues(l.upstream, keyType).Inc()
+
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = l.upstream
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	logger.Errorf("Rejected request to upstream %q: rate limit exceeded by %s %s", l.upstream, keyType, key)
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	l.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusTooManyRequests,
+		RequestID: scope.RequestID,
+		AppError:  "rate limit exceeded for upstream " + l.upstream,
+		Messages:  []interface{}{"Too many requests, please try again later."},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
@@ -0,0 +1,175 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Rate Limit Suite", func() {
+	var metrics *rateLimitMetrics
+	var writer *pagewriter.WriterFuncs
+	var requests int
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		requests++
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	BeforeEach(func() {
+		metrics = newRateLimitMetrics(prometheus.NewRegistry())
+		writer = &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				rw.WriteHeader(opts.Status)
+			},
+		}
+		requests = 0
+	})
+
+	duration := func(d time.Duration) *options.Duration {
+		o := options.Duration(d)
+		return &o
+	}
+
+	newLimiter := func(opts options.UpstreamRateLimit) *rateLimiter {
+		limiter := newRateLimiter(options.Upstream{
+			ID:        "busy",
+			RateLimit: &opts,
+		}, nil, handler, writer, metrics)
+		limiter.clock.Set(time.Unix(1650000000, 0))
+		return limiter
+	}
+
+	serve := func(limiter http.Handler, remoteAddr string, session *sessionsapi.SessionState) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		limiter.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rejected := func(key string) float64 {
+		return testutil.ToFloat64(metrics.rejected.WithLabelValues("busy", key))
+	}
+
+	It("fills in the defaults", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{Requests: 10})
+		Expect(limiter.key).To(Equal(options.RateLimitKeyUser))
+		Expect(limiter.rate).To(Equal(float64(10)))
+		Expect(limiter.burst).To(Equal(float64(10)))
+	})
+
+	It("rejects the requests above the burst until a token is refilled", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{
+			Requests: 1,
+			Period:   duration(10 * time.Second),
+			Burst:    2,
+		})
+		session := &sessionsapi.SessionState{User: "alice"}
+
+		Expect(serve(limiter, "10.0.0.1:1234", session).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.1:1234", session).Code).To(Equal(http.StatusOK))
+		rw := serve(limiter, "10.0.0.1:1234", session)
+		Expect(rw.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(rw.Header().Get("Retry-After")).To(Equal("10"))
+		Expect(requests).To(Equal(2))
+		Expect(rejected(options.RateLimitKeyUser)).To(Equal(float64(1)))
+
+		limiter.clock.Add(4 * time.Second)
+		rw = serve(limiter, "10.0.0.1:1234", session)
+		Expect(rw.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(rw.Header().Get("Retry-After")).To(Equal("6"))
+
+		limiter.clock.Add(6 * time.Second)
+		Expect(serve(limiter, "10.0.0.1:1234", session).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.1:1234", session).Code).To(Equal(http.StatusTooManyRequests))
+		Expect(requests).To(Equal(3))
+	})
+
+	It("limits each user separately, whatever their client IP", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{Requests: 1, Period: duration(time.Minute)})
+		alice := &sessionsapi.SessionState{User: "alice"}
+		bob := &sessionsapi.SessionState{Email: "bob@example.com"}
+
+		Expect(serve(limiter, "10.0.0.1:1234", alice).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.2:1234", alice).Code).To(Equal(http.StatusTooManyRequests))
+		Expect(serve(limiter, "10.0.0.1:1234", bob).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.1:1234", bob).Code).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("limits the requests without a session by their client IP", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{Requests: 1, Period: duration(time.Minute)})
+
+		Expect(serve(limiter, "10.0.0.1:1234", nil).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.1:5678", nil).Code).To(Equal(http.StatusTooManyRequests))
+		Expect(serve(limiter, "10.0.0.2:1234", nil).Code).To(Equal(http.StatusOK))
+		Expect(rejected(options.RateLimitKeyIP)).To(Equal(float64(1)))
+	})
+
+	It("limits each client IP separately, whatever their user, with the ip key", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{
+			Requests: 1,
+			Period:   duration(time.Minute),
+			Key:      options.RateLimitKeyIP,
+		})
+
+		Expect(serve(limiter, "10.0.0.1:1234", &sessionsapi.SessionState{User: "alice"}).Code).To(Equal(http.StatusOK))
+		Expect(serve(limiter, "10.0.0.1:1234", &sessionsapi.SessionState{User: "bob"}).Code).To(Equal(http.StatusTooManyRequests))
+		Expect(rejected(options.RateLimitKeyIP)).To(Equal(float64(1)))
+	})
+
+	It("limits by the real client IP when it is parsed", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{
+			Requests: 1,
+			Period:   duration(time.Minute),
+			Key:      options.RateLimitKeyIP,
+		})
+		parser, err := ip.GetRealClientIPParser("X-Real-IP", nil)
+		Expect(err).ToNot(HaveOccurred())
+		limiter.realClientIPParser = parser
+
+		req := func(realIP string) int {
+			req := httptest.NewRequest("", "/", nil)
+			req.RemoteAddr = "192.168.0.1:1234"
+			req.Header.Set("X-Real-IP", realIP)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			limiter.ServeHTTP(rw, req)
+			return rw.Code
+		}
+
+		Expect(req("10.0.0.1")).To(Equal(http.StatusOK))
+		Expect(req("10.0.0.2")).To(Equal(http.StatusOK))
+		Expect(req("10.0.0.1")).To(Equal(http.StatusTooManyRequests))
+
+		By("limiting invalid real client IPs by the IP they are connected from")
+		Expect(req("invalid")).To(Equal(http.StatusOK))
+		Expect(req("also-invalid")).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("removes the buckets that have been refilled", func() {
+		limiter := newLimiter(options.UpstreamRateLimit{Requests: 1, Period: duration(time.Minute)})
+
+		Expect(serve(limiter, "10.0.0.1:1234", nil).Code).To(Equal(http.StatusOK))
+		limiter.clock.Add(30 * time.Second)
+		Expect(serve(limiter, "10.0.0.2:1234", nil).Code).To(Equal(http.StatusOK))
+		Expect(limiter.buckets).To(HaveLen(2))
+
+		limiter.clock.Add(45 * time.Second)
+		Expect(serve(limiter, "10.0.0.3:1234", nil).Code).To(Equal(http.StatusOK))
+		Expect(limiter.buckets).To(HaveLen(2))
+		Expect(limiter.buckets).To(HaveKey("ip:10.0.0.2"))
+		Expect(limiter.buckets).To(HaveKey("ip:10.0.0.3"))
+	})
+})
@@ -0,0 +1,208 @@
+package upstream
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConfigRouter is implemented by the proxy created by NewProxy, so that the
+// upstreams it was created with can be replaced while it serves requests.
+type ConfigRouter interface {
+	// SetUpstreams replaces the configured upstreams with the upstreams.
+	// The previous upstreams are kept when any of the upstreams can't be
+	// registered.
+	SetUpstreams(upstreams options.UpstreamConfig) error
+}
+
+// SetUpstreams registers the upstreams with a new serveMux, which then
+// atomically replaces the serveMux of the configured upstreams.
+// Requests already being served by the previous upstreams aren't
+// interrupted: they are drained in the background, and the health checks
+// and DNS refreshes of the previous upstreams are then stopped and their
+// idle connections closed. The dynamic upstreams are never changed.
+func (m *multiUpstreamProxy) SetUpstreams(upstreams options.UpstreamConfig) error {
+	configured, err := m.newConfiguredProxy(upstreams)
+	if err != nil {
+		return err
+	}
+
+	previous, _ := m.configured.Swap(configured).(*multiUpstreamProxy)
+	if previous != nil {
+		go func() {
+			previous.drain()
+			logger.Printf("Drained the requests of the replaced upstreams")
+		}()
+	}
+	return nil
+}
+
+// loadConfigured returns the proxy of the configured upstreams, or the proxy
+// itself when it is the proxy of the configured or dynamic upstreams
+func (m *multiUpstreamProxy) loadConfigured() *multiUpstreamProxy {
+	if configured, ok := m.configured.Load().(*multiUpstreamProxy); ok {
+		return configured
+	}
+	return m
+}
+
+// drain waits for the requests being served by the upstreams to be served,
+// including their WebSocket connections, and then closes the upstreams
+func (m *multiUpstreamProxy) drain() {
+	m.requests.drain()
+	m.close()
+}
+
+// close stops the health checks and DNS refreshes of the HTTP upstreams, and
+// closes their idle connections
+func (m *multiUpstreamProxy) close() {
+	for _, proxy := range m.httpProxies {
+		proxy.close()
+	}
+}
+
+// close stops the health checks of the upstream, and closes its backends
+func (h *httpUpstreamProxy) close() {
+	if h.health != nil {
+		h.health.Stop()
+	}
+	for _, backend := range h.backends {
+		backend.close()
+	}
+}
+
+// close stops refreshing the DNS of the backend, and closes its idle
+// connections
+func (b *upstreamBackend) close() {
+	if b.dns != nil {
+		b.dns.stop()
+	}
+	b.transport.CloseIdleConnections()
+	if b.wsTransport != nil {
+		b.wsTransport.CloseIdleConnections()
+	}
+}
+
+// requestTracker tracks the requests being served by the upstreams of a
+// proxy, until it is drained
+type requestTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// track tracks a request until the returned function is called.
+// Requests routed after the tracker started draining, with the previous
+// upstreams, aren't waited for.
+func (t *requestTracker) track() func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return func() {}
+	}
+	t.wg.Add(1)
+	return t.wg.Done
+}
+
+// drain waits for the tracked requests to be served
+func (t *requestTracker) drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// UpstreamConfigLoader loads the upstream configuration again, and validates
+// it as at startup
+type UpstreamConfigLoader func() (options.UpstreamConfig, error)
+
+// UpstreamConfigWatcher reloads the upstreams of a ConfigRouter whenever the
+// configuration files or the upstream config directory change, or the
+// process receives a SIGHUP.
+// The upstreams are kept when the configuration can't be loaded, or is
+// invalid, until it is fixed.
+type UpstreamConfigWatcher struct {
+	files   []string
+	dir     string
+	load    UpstreamConfigLoader
+	router  ConfigRouter
+	metrics *reloadMetrics
+
+	mutex sync.Mutex
+}
+
+// NewUpstreamConfigWatcher creates an UpstreamConfigWatcher of the files, and
+// of the YAML files of the directory, when it is set. The upstreams aren't
+// reloaded until Watch or Reload is called.
+func NewUpstreamConfigWatcher(files []string, dir string, load UpstreamConfigLoader, router ConfigRouter, registerer prometheus.Registerer) *UpstreamConfigWatcher {
+	return &UpstreamConfigWatcher{
+		files:   files,
+		dir:     dir,
+		load:    load,
+		router:  router,
+		metrics: newReloadMetrics(registerer),
+	}
+}
+
+// Watch reloads the upstreams every time a file, or a YAML file of the
+// directory, changes, and on SIGHUP, until done is closed.
+func (w *UpstreamConfigWatcher) Watch(done <-chan bool) error {
+	reload := func() {
+		if err := w.Reload(); err != nil {
+			logger.Errorf("Error reloading upstreams, keeping the previous upstreams: %v", err)
+		}
+	}
+	for _, file := range w.files {
+		if err := watcher.WatchFileForUpdates(file, done, reload); err != nil {
+			return err
+		}
+	}
+	if w.dir != "" {
+		if err := watcher.WatchDirForUpdates(w.dir, ".yaml", done, reload); err != nil {
+			return err
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				logger.Printf("reloading upstreams after SIGHUP")
+				reload()
+			}
+		}
+	}()
+	return nil
+}
+
+// Reload loads the upstream configuration, and replaces the upstreams of
+// the router with its upstreams
+func (w *UpstreamConfigWatcher) Reload() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	upstreams, err := w.load()
+	if err == nil {
+		err = w.router.SetUpstreams(upstreams)
+	}
+	if err != nil {
+		w.metrics.reloads.WithLabelValues("failure").Inc()
+		return fmt.Errorf("could not reload upstreams: %v", err)
+	}
+
+	w.metrics.reloads.WithLabelValues("success").Inc()
+	logger.Printf("Reloaded %d upstreams", len(upstreams.Upstreams))
+	return nil
+}
@@ -0,0 +1,219 @@
+package upstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Upstream Reload Suite", func() {
+	var proxy http.Handler
+
+	staticUpstream := func(id, path string, code int) options.Upstream {
+		return options.Upstream{
+			ID:         id,
+			Path:       path,
+			Static:     true,
+			StaticCode: &code,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		proxy, err = NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				staticUpstream("app", "/", http.StatusOK),
+				staticUpstream("api", "/api/", http.StatusAccepted),
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	serve := func(path string) int {
+		rw := httptest.NewRecorder()
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, path, nil), &middlewareapi.RequestScope{})
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	It("replaces the configured upstreams", func() {
+		err := proxy.(ConfigRouter).SetUpstreams(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				staticUpstream("app", "/", http.StatusOK),
+				staticUpstream("admin", "/admin/", http.StatusCreated),
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(serve("/admin/users")).To(Equal(http.StatusCreated))
+		Expect(serve("/api/users")).To(Equal(http.StatusOK))
+
+		routes := proxy.(RouteTable).Routes()
+		Expect(routes).To(HaveLen(2))
+		Expect(routes[0].ID).To(Equal("admin"))
+		Expect(routes[1].ID).To(Equal("app"))
+	})
+
+	It("keeps the previous upstreams when an upstream can't be registered", func() {
+		err := proxy.(ConfigRouter).SetUpstreams(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				staticUpstream("app", "/", http.StatusOK),
+				{ID: "admin", Path: "/admin/", URI: "ftp://admin.internal"},
+			},
+		})
+		Expect(err).To(MatchError(`unknown scheme for upstream "admin": "ftp"`))
+
+		Expect(serve("/api/users")).To(Equal(http.StatusAccepted))
+		Expect(serve("/admin/users")).To(Equal(http.StatusOK))
+	})
+
+	It("keeps the dynamic upstreams", func() {
+		proxy.(DynamicRouter).SetDynamicUpstreams([]options.Upstream{
+			staticUpstream("preview-1", "/preview-1/", http.StatusCreated),
+		})
+		Expect(proxy.(ConfigRouter).SetUpstreams(options.UpstreamConfig{
+			Upstreams: []options.Upstream{staticUpstream("app", "/", http.StatusOK)},
+		})).To(Succeed())
+
+		Expect(serve("/preview-1/page")).To(Equal(http.StatusCreated))
+		Expect(serve("/api/users")).To(Equal(http.StatusOK))
+	})
+
+	It("drains the requests of the replaced upstreams before stopping their health checks", func() {
+		release := make(chan struct{})
+		received := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				received <- struct{}{}
+				<-release
+			}
+		}))
+		defer server.Close()
+
+		Expect(proxy.(ConfigRouter).SetUpstreams(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{ID: "app", Path: "/", URI: server.URL, HealthCheck: &options.UpstreamHealthCheck{}},
+			},
+		})).To(Succeed())
+		previous := proxy.(*multiUpstreamProxy).loadConfigured()
+		health := previous.httpProxies[0].health
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			Expect(serve("/slow")).To(Equal(http.StatusOK))
+		}()
+		<-received
+
+		Expect(proxy.(ConfigRouter).SetUpstreams(options.UpstreamConfig{
+			Upstreams: []options.Upstream{staticUpstream("app", "/", http.StatusAccepted)},
+		})).To(Succeed())
+		Expect(serve("/fast")).To(Equal(http.StatusAccepted))
+		Consistently(health.stopped).ShouldNot(BeClosed())
+
+		close(release)
+		wg.Wait()
+		Eventually(health.stopped).Should(BeClosed())
+	})
+})
+
+// fakeConfigRouter records the upstreams it is set with
+type fakeConfigRouter struct {
+	mutex     sync.Mutex
+	upstreams []options.UpstreamConfig
+	err       error
+}
+
+func (r *fakeConfigRouter) SetUpstreams(upstreams options.UpstreamConfig) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.upstreams = append(r.upstreams, upstreams)
+	return nil
+}
+
+func (r *fakeConfigRouter) reloads() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.upstreams)
+}
+
+var _ = Describe("Upstream Config Watcher Suite", func() {
+	var dir string
+	var router *fakeConfigRouter
+	var registry *prometheus.Registry
+	var loadErr error
+
+	load := func() (options.UpstreamConfig, error) {
+		if loadErr != nil {
+			return options.UpstreamConfig{}, loadErr
+		}
+		return options.UpstreamConfig{Upstreams: []options.Upstream{{ID: "app", Path: "/"}}}, nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "upstream-config")
+		Expect(err).ToNot(HaveOccurred())
+		router = &fakeConfigRouter{}
+		registry = prometheus.NewRegistry()
+		loadErr = nil
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reloads the upstreams, counting the reloads by result", func() {
+		w := NewUpstreamConfigWatcher(nil, "", load, router, registry)
+		Expect(w.Reload()).To(Succeed())
+		Expect(router.upstreams).To(HaveLen(1))
+
+		loadErr = errors.New("invalid upstream configuration")
+		Expect(w.Reload()).To(MatchError("could not reload upstreams: invalid upstream configuration"))
+
+		loadErr = nil
+		router.err = errors.New("unknown scheme")
+		Expect(w.Reload()).To(MatchError("could not reload upstreams: unknown scheme"))
+		Expect(router.upstreams).To(HaveLen(1))
+
+		Expect(testutil.ToFloat64(w.metrics.reloads.WithLabelValues("success"))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(w.metrics.reloads.WithLabelValues("failure"))).To(Equal(float64(2)))
+	})
+
+	It("reloads the upstreams when the files or the YAML files of the directory change", func() {
+		file := filepath.Join(dir, "oauth2-proxy.yaml")
+		Expect(ioutil.WriteFile(file, []byte("upstreamConfig: {}"), 0600)).To(Succeed())
+		configDir := filepath.Join(dir, "upstreams")
+		Expect(os.Mkdir(configDir, 0700)).To(Succeed())
+
+		done := make(chan bool)
+		defer close(done)
+		w := NewUpstreamConfigWatcher([]string{file}, configDir, load, router, registry)
+		Expect(w.Watch(done)).To(Succeed())
+
+		Expect(ioutil.WriteFile(file, []byte("upstreamConfig: {upstreams: []}"), 0600)).To(Succeed())
+		Eventually(router.reloads).Should(BeNumerically(">=", 1))
+
+		reloads := router.reloads()
+		Expect(ioutil.WriteFile(filepath.Join(configDir, "README.md"), []byte("upstreams"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(configDir, "app.yaml"), []byte("- id: app"), 0600)).To(Succeed())
+		Eventually(router.reloads).Should(BeNumerically(">", reloads))
+	})
+})
@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// webSocketUpgradeHeaders are the client headers WebSocket upgrade requests
+// need, which are sent with the hop-by-hop upgrade headers
+var webSocketUpgradeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-WebSocket-Key",
+	"Sec-WebSocket-Version",
+	"Sec-WebSocket-Extensions",
+	webSocketProtocolHeader,
+}
+
+// requestHeaderFilter removes the client request headers that aren't sent to
+// an upstream before the request is passed to the upstream handler
+type requestHeaderFilter struct {
+	// allowed is set when only the allowed client headers are sent, it holds
+	// the canonical header names
+	allowed map[string]struct{}
+	// proxyHeaders are set by the proxy before the filter, and are always
+	// sent when only the allowed headers are
+	proxyHeaders []string
+
+	passCookies bool
+	// proxyCookieName is set when the proxy's own cookies are stripped
+	proxyCookieName string
+}
+
+// newRequestHeaderFilter wraps the handler so that requests are filtered
+// with the upstream's AllowedRequestHeaders, PassCookies and
+// StripProxyCookies options.
+// The handler is returned unchanged when none of them are set.
+// The filter runs before the request is signed, so that the signature
+// matches the headers received by the upstream.
+func newRequestHeaderFilter(upstream options.Upstream, proxyCookieName string, next http.Handler) http.Handler {
+	f := &requestHeaderFilter{
+		passCookies: upstream.PassCookies == nil || *upstream.PassCookies,
+	}
+	if upstream.StripProxyCookies {
+		f.proxyCookieName = proxyCookieName
+	}
+	if upstream.AllowedRequestHeaders != nil {
+		f.allowed = map[string]struct{}{}
+		for _, header := range upstream.AllowedRequestHeaders {
+			f.allowed[http.CanonicalHeaderKey(header)] = struct{}{}
+		}
+		f.proxyHeaders = append([]string{DegradedHeader, options.TLSHeaderForwardedProto}, sslHeaders...)
+		if upstream.AuthorizationConflict == options.AuthorizationConflictMoveClient {
+			f.proxyHeaders = append(f.proxyHeaders, clientAuthorizationHeader(upstream))
+		}
+	}
+	if f.allowed == nil && f.passCookies && f.proxyCookieName == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.filter(req)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// filter removes the headers of the request that aren't sent to the upstream
+func (f *requestHeaderFilter) filter(req *http.Request) {
+	if f.allowed != nil {
+		keep := f.keptHeaders(req)
+		for name := range req.Header {
+			if _, ok := keep[name]; !ok {
+				req.Header.Del(name)
+			}
+		}
+	}
+
+	if !f.passCookies {
+		req.Header.Del("Cookie")
+	} else if f.proxyCookieName != "" {
+		f.stripProxyCookies(req)
+	}
+}
+
+// keptHeaders returns the canonical names of the headers kept when only the
+// allowed client headers are sent
+func (f *requestHeaderFilter) keptHeaders(req *http.Request) map[string]struct{} {
+	keep := map[string]struct{}{"Cookie": {}}
+	for name := range f.allowed {
+		keep[name] = struct{}{}
+	}
+	for _, name := range f.proxyHeaders {
+		keep[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	if scope := middleware.GetRequestScope(req); scope != nil {
+		for _, name := range scope.IdentityHeaders {
+			keep[http.CanonicalHeaderKey(name)] = struct{}{}
+		}
+	}
+
+	// Hop-by-hop headers are removed by the reverse proxies, which keep the
+	// headers upgrading WebSocket requests
+	for _, name := range hopHeaders {
+		delete(keep, name)
+	}
+	// The reverse proxies only keep a TE header announcing support for
+	// trailers, which gRPC servers require
+	keep["Te"] = struct{}{}
+	if isWebSocketUpgrade(req) {
+		for _, name := range webSocketUpgradeHeaders {
+			keep[http.CanonicalHeaderKey(name)] = struct{}{}
+		}
+	}
+	return keep
+}
+
+// stripProxyCookies removes the session cookie, including the parts of split
+// session cookies, and the CSRF cookies from the Cookie header
+func (f *requestHeaderFilter) stripProxyCookies(req *http.Request) {
+	cookies := req.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if !isProxyCookie(f.proxyCookieName, cookie.Name) {
+			kept = append(kept, cookie.String())
+		}
+	}
+	if len(kept) == len(cookies) {
+		return
+	}
+	if len(kept) == 0 {
+		req.Header.Del("Cookie")
+		return
+	}
+	req.Header.Set("Cookie", strings.Join(kept, "; "))
+}
+
+// isProxyCookie checks whether the cookie is the session cookie named
+// cookieName, a part of a split session cookie (`<name>_<n>`) or a CSRF
+// cookie (`<name>_csrf` or `<name>_csrf_<state>`)
+func isProxyCookie(cookieName, name string) bool {
+	if name == cookieName {
+		return true
+	}
+	suffix := strings.TrimPrefix(name, cookieName+"_")
+	if suffix == name || suffix == "" {
+		return false
+	}
+	if suffix == "csrf" || strings.HasPrefix(suffix, "csrf_") {
+		return true
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
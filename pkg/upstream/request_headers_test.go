@@ -0,0 +1,210 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Header Filter Suite", func() {
+	const proxyCookieName = "_oauth2_proxy"
+	passCookies := false
+
+	type requestHeaderFilterTableInput struct {
+		upstream        options.Upstream
+		requestHeaders  http.Header
+		identityHeaders []string
+		expectedHeaders http.Header
+	}
+
+	DescribeTable("newRequestHeaderFilter",
+		func(in requestHeaderFilterTableInput) {
+			var received http.Header
+			handler := newRequestHeaderFilter(in.upstream, proxyCookieName, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				received = req.Header.Clone()
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header = in.requestHeaders
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				IdentityHeaders: in.identityHeaders,
+			})
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(received).To(Equal(in.expectedHeaders))
+		},
+		Entry("without any options", requestHeaderFilterTableInput{
+			upstream: options.Upstream{ID: "app"},
+			requestHeaders: http.Header{
+				"X-Unknown": []string{"value"},
+				"Cookie":    []string{"_oauth2_proxy=session; theme=dark"},
+			},
+			expectedHeaders: http.Header{
+				"X-Unknown": []string{"value"},
+				"Cookie":    []string{"_oauth2_proxy=session; theme=dark"},
+			},
+		}),
+		Entry("with allowed request headers", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{"accept", "X-Request-Id"},
+			},
+			requestHeaders: http.Header{
+				"Accept":       []string{"text/html", "application/json"},
+				"X-Request-Id": []string{"  abc 123 "},
+				"X-Unknown":    []string{"value"},
+				"Referer":      []string{"https://example.com"},
+				"Keep-Alive":   []string{"timeout=5"},
+				"Cookie":       []string{"theme=dark"},
+			},
+			expectedHeaders: http.Header{
+				"Accept":       []string{"text/html", "application/json"},
+				"X-Request-Id": []string{"  abc 123 "},
+				"Cookie":       []string{"theme=dark"},
+			},
+		}),
+		Entry("with allowed request headers and headers set by the proxy", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{"Accept"},
+			},
+			requestHeaders: http.Header{
+				"X-Forwarded-Email": []string{"john.doe@example.com"},
+				"Authorization":     []string{"Bearer token"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Ssl-Protocol":    []string{"TLSv1.3"},
+				"X-Auth-Degraded":   []string{"true"},
+				"X-Forwarded-Host":  []string{"spoofed.example.com"},
+			},
+			identityHeaders: []string{"X-Forwarded-Email", "authorization"},
+			expectedHeaders: http.Header{
+				"X-Forwarded-Email": []string{"john.doe@example.com"},
+				"Authorization":     []string{"Bearer token"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Ssl-Protocol":    []string{"TLSv1.3"},
+				"X-Auth-Degraded":   []string{"true"},
+			},
+		}),
+		Entry("with allowed request headers and the move-client authorization conflict", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                        "app",
+				AllowedRequestHeaders:     []string{"Accept"},
+				AuthorizationConflict:     options.AuthorizationConflictMoveClient,
+				ClientAuthorizationHeader: "X-Api-Authorization",
+			},
+			requestHeaders: http.Header{
+				"Authorization":       []string{"Basic am9objpzZWNyZXQ="},
+				"X-Api-Authorization": []string{"Bearer client-token"},
+			},
+			identityHeaders: []string{"Authorization"},
+			expectedHeaders: http.Header{
+				"Authorization":       []string{"Basic am9objpzZWNyZXQ="},
+				"X-Api-Authorization": []string{"Bearer client-token"},
+			},
+		}),
+		Entry("with allowed request headers and a WebSocket upgrade", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{},
+			},
+			requestHeaders: http.Header{
+				"Connection":             []string{"Upgrade"},
+				"Upgrade":                []string{"websocket"},
+				"Sec-Websocket-Key":      []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-Websocket-Version":  []string{"13"},
+				"Sec-Websocket-Protocol": []string{"chat"},
+				"X-Unknown":              []string{"value"},
+			},
+			expectedHeaders: http.Header{
+				"Connection":             []string{"Upgrade"},
+				"Upgrade":                []string{"websocket"},
+				"Sec-Websocket-Key":      []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-Websocket-Version":  []string{"13"},
+				"Sec-Websocket-Protocol": []string{"chat"},
+			},
+		}),
+		Entry("with allowed request headers and a request that isn't upgraded", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{},
+			},
+			requestHeaders: http.Header{
+				"Connection":        []string{"keep-alive"},
+				"Sec-Websocket-Key": []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			},
+			expectedHeaders: http.Header{},
+		}),
+		Entry("with allowed request headers and a gRPC request", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{"Content-Type"},
+			},
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/grpc"},
+				"Te":           []string{"trailers"},
+				"Trailer":      []string{"Grpc-Status"},
+			},
+			expectedHeaders: http.Header{
+				"Content-Type": []string{"application/grpc"},
+				"Te":           []string{"trailers"},
+			},
+		}),
+		Entry("with passCookies disabled", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:          "app",
+				PassCookies: &passCookies,
+			},
+			requestHeaders: http.Header{
+				"Accept": []string{"text/html"},
+				"Cookie": []string{"_oauth2_proxy=session; theme=dark"},
+			},
+			expectedHeaders: http.Header{
+				"Accept": []string{"text/html"},
+			},
+		}),
+		Entry("with stripProxyCookies", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                "app",
+				StripProxyCookies: true,
+			},
+			requestHeaders: http.Header{
+				"Cookie": []string{"_oauth2_proxy_0=part; theme=dark; _oauth2_proxy=session", "_oauth2_proxy_csrf_abc=csrf; _oauth2_proxy_1=part; _oauth2_proxy_theme=light"},
+			},
+			expectedHeaders: http.Header{
+				"Cookie": []string{"theme=dark; _oauth2_proxy_theme=light"},
+			},
+		}),
+		Entry("with stripProxyCookies and only the proxy's cookies", requestHeaderFilterTableInput{
+			upstream: options.Upstream{
+				ID:                    "app",
+				AllowedRequestHeaders: []string{"Accept"},
+				StripProxyCookies:     true,
+			},
+			requestHeaders: http.Header{
+				"Accept": []string{"text/html"},
+				"Cookie": []string{"_oauth2_proxy=session; _oauth2_proxy_csrf=csrf"},
+			},
+			expectedHeaders: http.Header{
+				"Accept": []string{"text/html"},
+			},
+		}),
+	)
+
+	DescribeTable("isProxyCookie",
+		func(name string, expected bool) {
+			Expect(isProxyCookie(proxyCookieName, name)).To(Equal(expected))
+		},
+		Entry("the session cookie", "_oauth2_proxy", true),
+		Entry("a part of a split session cookie", "_oauth2_proxy_12", true),
+		Entry("a CSRF cookie", "_oauth2_proxy_csrf", true),
+		Entry("a per request CSRF cookie", "_oauth2_proxy_csrf_abcdef", true),
+		Entry("a cookie with the name as a prefix", "_oauth2_proxy_theme", false),
+		Entry("a cookie with the name and a trailing underscore", "_oauth2_proxy_", false),
+		Entry("another cookie", "theme", false),
+	)
+})
@@ -0,0 +1,365 @@
+package upstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+)
+
+// replacingReaderBufferSize is the size of the reads from rewritten bodies
+const replacingReaderBufferSize = 32 * 1024
+
+// rewritableContentTypes are the media types of the bodies that are rewritten
+var rewritableContentTypes = map[string]struct{}{
+	"text/html":        {},
+	"application/json": {},
+}
+
+// gzipReaders and gzipWriters pool the gzip decompressors and compressors of
+// rewritten bodies, which are expensive to allocate for each response
+var (
+	gzipReaders sync.Pool
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+type externalURLContextKey struct{}
+
+// responseRewrite rewrites the absolute URLs of an upstream server in its
+// responses to the URL the upstream is reached at through the proxy.
+type responseRewrite struct {
+	upstreamURL      string
+	externalURL      string
+	replacements     []replacement
+	identityEncoding bool
+}
+
+// replacement is a find-and-replace pair of a body rewrite
+type replacement struct {
+	find    []byte
+	replace []byte
+}
+
+// newResponseRewrite creates the response rewrite of the upstream, or nil if
+// the upstream responses are not rewritten.
+func newResponseRewrite(upstream options.Upstream, u *url.URL) *responseRewrite {
+	if upstream.ResponseRewrite == nil {
+		return nil
+	}
+
+	rewrite := &responseRewrite{
+		upstreamURL:      strings.TrimSuffix(toHTTPURL(u).String(), "/"),
+		externalURL:      strings.TrimSuffix(upstream.ResponseRewrite.ExternalURL, "/"),
+		identityEncoding: upstream.ResponseRewrite.IdentityEncoding,
+	}
+	for _, pair := range upstream.ResponseRewrite.BodyReplacements {
+		rewrite.replacements = append(rewrite.replacements, replacement{
+			find:    []byte(pair.Find),
+			replace: []byte(pair.Replace),
+		})
+	}
+	return rewrite
+}
+
+// prepareRequest records the external URL of the request for rewriting its
+// response, and restricts the encodings the upstream may respond with to
+// those whose bodies can be rewritten, so that brotli or zstd encoded bodies
+// aren't requested.
+// Ranges of the body can't be rewritten either, so the full body is
+// requested instead.
+// Rewriting only the headers leaves the request unchanged.
+func (r *responseRewrite) prepareRequest(req *http.Request) *http.Request {
+	if len(r.replacements) > 0 {
+		if !r.identityEncoding && acceptsGzip(req) {
+			req.Header.Set("Accept-Encoding", "gzip")
+		} else {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	externalURL := r.externalURL
+	if externalURL == "" {
+		externalURL = fmt.Sprintf("%s://%s", requestutil.GetRequestProto(req), requestutil.GetRequestHost(req))
+	}
+	return req.WithContext(context.WithValue(req.Context(), externalURLContextKey{}, externalURL))
+}
+
+// modifyResponse rewrites the Location and Content-Location headers of the
+// upstream response, and streams its body through the body replacements.
+// Only identity and gzip encoded bodies are rewritten, bodies in other
+// encodings, such as brotli or zstd from upstreams ignoring the
+// Accept-Encoding of the request, are sent unchanged with their
+// Content-Encoding and Content-Length.
+// The proxy sends rewritten bodies chunked as their length isn't known, and
+// their ETag is weakened as they are no longer byte for byte the upstream's.
+func (r *responseRewrite) modifyResponse(resp *http.Response) error {
+	externalURL, _ := resp.Request.Context().Value(externalURLContextKey{}).(string)
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(name); value != "" {
+			resp.Header.Set(name, r.rewriteURL(value, externalURL))
+		}
+	}
+
+	if len(r.replacements) == 0 || !hasResponseBody(resp) || resp.StatusCode == http.StatusPartialContent ||
+		!isRewritableContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	switch contentCoding(resp.Header) {
+	case "":
+		resp.Body = newReplacingReader(resp.Body, r.replacements)
+	case "gzip":
+		body, err := newGzipReplacingReader(resp.Body, r.replacements)
+		if err != nil {
+			return fmt.Errorf("could not decompress the response body: %v", err)
+		}
+		resp.Body = body
+	default:
+		// Bodies in other encodings can't be rewritten
+		return nil
+	}
+
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// contentCoding returns the content coding of the body, which is empty for
+// identity encoded bodies. Bodies encoded several times return their list of
+// codings, which can't be rewritten.
+func contentCoding(header http.Header) string {
+	codings := []string{}
+	for _, coding := range strings.Split(strings.Join(header.Values("Content-Encoding"), ","), ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "x-gzip":
+			codings = append(codings, "gzip")
+		default:
+			codings = append(codings, coding)
+		}
+	}
+	return strings.Join(codings, ", ")
+}
+
+// rewriteURL replaces the upstream URL at the start of the value with the
+// external URL
+func (r *responseRewrite) rewriteURL(value, externalURL string) string {
+	if !strings.HasPrefix(value, r.upstreamURL) {
+		return value
+	}
+	rest := value[len(r.upstreamURL):]
+	if rest != "" && !strings.ContainsAny(rest[:1], "/?#") {
+		// The value is for another host, eg. `http://app.internal.example`
+		// for an upstream of `http://app.internal`
+		return value
+	}
+	return externalURL + rest
+}
+
+// hasResponseBody checks whether the response can have a body
+func hasResponseBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return resp.Body != nil && resp.Body != http.NoBody
+}
+
+// isRewritableContentType checks whether bodies of the content type are
+// rewritten
+func isRewritableContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, ok := rewritableContentTypes[mediaType]
+	return ok
+}
+
+// acceptsGzip checks whether the client accepts gzip encoded responses
+func acceptsGzip(req *http.Request) bool {
+	for _, coding := range strings.Split(strings.Join(req.Header.Values("Accept-Encoding"), ","), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		quality := strings.TrimSpace(params)
+		if !strings.HasPrefix(quality, "q=") {
+			return true
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(quality, "q="), 64)
+		return err == nil && q > 0
+	}
+	return false
+}
+
+// replacingReader streams a body through find-and-replace pairs.
+// At each position of the body, the first pair whose find matches is
+// replaced. Enough of the body is held back between reads to match finds
+// across the boundaries of the underlying reads.
+type replacingReader struct {
+	src          io.ReadCloser
+	replacements []replacement
+	maxFind      int
+
+	buf     []byte
+	pending []byte
+	out     []byte
+	err     error
+}
+
+func newReplacingReader(src io.ReadCloser, replacements []replacement) *replacingReader {
+	maxFind := 0
+	for _, r := range replacements {
+		if len(r.find) > maxFind {
+			maxFind = len(r.find)
+		}
+	}
+	return &replacingReader{
+		src:          src,
+		replacements: replacements,
+		maxFind:      maxFind,
+		buf:          make([]byte, replacingReaderBufferSize),
+	}
+}
+
+// Read returns the replaced body
+func (r *replacingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.src.Read(r.buf)
+		r.pending = append(r.pending, r.buf[:n]...)
+		r.err = err
+		r.replace()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// replace moves the pending body to the output, replacing the finds that
+// match. Once the source is read, the pending body is moved in full.
+func (r *replacingReader) replace() {
+	done := r.err != nil
+	start, i := 0, 0
+	for i < len(r.pending) {
+		if !done && len(r.pending)-i < r.maxFind {
+			break
+		}
+		if rep, ok := r.match(r.pending[i:]); ok {
+			r.out = append(r.out, r.pending[start:i]...)
+			r.out = append(r.out, rep.replace...)
+			i += len(rep.find)
+			start = i
+			continue
+		}
+		i++
+	}
+	r.out = append(r.out, r.pending[start:i]...)
+	r.pending = append(r.pending[:0], r.pending[i:]...)
+}
+
+// match returns the first replacement whose find is a prefix of the body
+func (r *replacingReader) match(body []byte) (replacement, bool) {
+	for _, rep := range r.replacements {
+		if len(rep.find) > 0 && bytes.HasPrefix(body, rep.find) {
+			return rep, true
+		}
+	}
+	return replacement{}, false
+}
+
+// Close closes the source body
+func (r *replacingReader) Close() error {
+	return r.src.Close()
+}
+
+// gzipReplacingReader decompresses a gzip encoded body, streams it through
+// a replacingReader and compresses it again
+type gzipReplacingReader struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func newGzipReplacingReader(src io.ReadCloser, replacements []replacement) (io.ReadCloser, error) {
+	zr, err := newGzipReader(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer gzipReaders.Put(zr)
+		pw.CloseWithError(compressReplaced(pw, newReplacingReader(ioutil.NopCloser(zr), replacements)))
+	}()
+	return &gzipReplacingReader{PipeReader: pr, src: src}, nil
+}
+
+// newGzipReader returns a pooled gzip reader of the source
+func newGzipReader(src io.Reader) (*gzip.Reader, error) {
+	zr, ok := gzipReaders.Get().(*gzip.Reader)
+	if !ok {
+		return gzip.NewReader(src)
+	}
+	if err := zr.Reset(src); err != nil {
+		gzipReaders.Put(zr)
+		return nil, err
+	}
+	return zr, nil
+}
+
+// compressReplaced compresses the replaced body, flushing after each read so
+// that the body is still streamed
+func compressReplaced(w io.Writer, body io.Reader) error {
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(w)
+	defer gzipWriters.Put(zw)
+	buf := make([]byte, replacingReaderBufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := zw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := zw.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return zw.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops the compression and closes the source body
+func (r *gzipReplacingReader) Close() error {
+	r.PipeReader.Close()
+	return r.src.Close()
+}
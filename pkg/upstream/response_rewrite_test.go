@@ -0,0 +1,472 @@
+package upstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing/iotest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response Rewrite Suite", func() {
+	type replacingReaderTableInput struct {
+		body         string
+		replacements []options.BodyReplacement
+		expectedBody string
+	}
+
+	DescribeTable("replacingReader",
+		func(in replacingReaderTableInput) {
+			rewrite := newResponseRewrite(options.Upstream{
+				ResponseRewrite: &options.UpstreamResponseRewrite{BodyReplacements: in.replacements},
+			}, &url.URL{})
+
+			// Reading a byte at a time splits the finds across reads
+			src := ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(in.body)))
+			body, err := ioutil.ReadAll(newReplacingReader(src, rewrite.replacements))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal(in.expectedBody))
+		},
+		Entry("with no matches", replacingReaderTableInput{
+			body:         `<a href="/foo">foo</a>`,
+			replacements: []options.BodyReplacement{{Find: "http://app.internal", Replace: "https://app.example.com"}},
+			expectedBody: `<a href="/foo">foo</a>`,
+		}),
+		Entry("with matches", replacingReaderTableInput{
+			body:         `<a href="http://app.internal/foo">http://app.internal</a>`,
+			replacements: []options.BodyReplacement{{Find: "http://app.internal", Replace: "https://app.example.com"}},
+			expectedBody: `<a href="https://app.example.com/foo">https://app.example.com</a>`,
+		}),
+		Entry("with a match at the end of the body", replacingReaderTableInput{
+			body:         `{"url":"http://app.internal`,
+			replacements: []options.BodyReplacement{{Find: "http://app.internal", Replace: "https://app.example.com"}},
+			expectedBody: `{"url":"https://app.example.com`,
+		}),
+		Entry("with a partial match at the end of the body", replacingReaderTableInput{
+			body:         `{"url":"http://app.inter`,
+			replacements: []options.BodyReplacement{{Find: "http://app.internal", Replace: "https://app.example.com"}},
+			expectedBody: `{"url":"http://app.inter`,
+		}),
+		Entry("with several replacements", replacingReaderTableInput{
+			body: `http://app.internal:8080/a http://app.internal/b`,
+			replacements: []options.BodyReplacement{
+				{Find: "http://app.internal:8080", Replace: "https://app.example.com"},
+				{Find: "http://app.internal", Replace: "https://www.example.com"},
+			},
+			expectedBody: `https://app.example.com/a https://www.example.com/b`,
+		}),
+		Entry("with replacements that aren't replaced again", replacingReaderTableInput{
+			body: `foo`,
+			replacements: []options.BodyReplacement{
+				{Find: "foo", Replace: "bar"},
+				{Find: "bar", Replace: "baz"},
+			},
+			expectedBody: `bar`,
+		}),
+	)
+
+	type rewriteTableInput struct {
+		rewrite          *options.UpstreamResponseRewrite
+		requestHeaders   http.Header
+		responseHeaders  http.Header
+		responseBody     string
+		gzipResponse     bool
+		expectedHeaders  http.Header
+		expectedEncoding string
+		expectedBody     string
+
+		// encodedResponseBody is sent instead of the responseBody, with the
+		// Content-Encoding of the responseHeaders, and is expected to be
+		// proxied unchanged
+		encodedResponseBody    []byte
+		expectedRequestHeaders http.Header
+	}
+
+	DescribeTable("newHTTPUpstreamProxy with a responseRewrite",
+		func(in rewriteTableInput) {
+			var acceptEncoding string
+			var requestHeaders http.Header
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				acceptEncoding = req.Header.Get("Accept-Encoding")
+				requestHeaders = req.Header.Clone()
+				for name, values := range in.responseHeaders {
+					rw.Header()[name] = values
+				}
+
+				body := []byte(in.responseBody)
+				if in.encodedResponseBody != nil {
+					body = in.encodedResponseBody
+				}
+				if in.gzipResponse {
+					rw.Header().Set("Content-Encoding", "gzip")
+					buf := &bytes.Buffer{}
+					zw := gzip.NewWriter(buf)
+					_, err := zw.Write(body)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(zw.Close()).To(Succeed())
+					body = buf.Bytes()
+				}
+				rw.Write(body)
+			}))
+			defer upstreamServer.Close()
+
+			u, err := url.Parse(upstreamServer.URL)
+			Expect(err).ToNot(HaveOccurred())
+			upstream := options.Upstream{
+				ID:              "rewrite",
+				Path:            "/",
+				URI:             upstreamServer.URL,
+				ResponseRewrite: in.rewrite,
+			}
+			// The upstream URL is only known once the server is started
+			for i := range upstream.ResponseRewrite.BodyReplacements {
+				upstream.ResponseRewrite.BodyReplacements[i].Find = strings.ReplaceAll(upstream.ResponseRewrite.BodyReplacements[i].Find, "$upstream", upstreamServer.URL)
+			}
+			for name, values := range in.responseHeaders {
+				for i := range values {
+					values[i] = strings.ReplaceAll(values[i], "$upstream", upstreamServer.URL)
+				}
+				in.responseHeaders[name] = values
+			}
+			in.responseBody = strings.ReplaceAll(in.responseBody, "$upstream", upstreamServer.URL)
+			in.expectedBody = strings.ReplaceAll(in.expectedBody, "$upstream", upstreamServer.URL)
+
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil, nil, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/foo", nil)
+			for name, values := range in.requestHeaders {
+				req.Header[name] = values
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			for name := range in.expectedHeaders {
+				Expect(rw.Header().Get(name)).To(Equal(in.expectedHeaders.Get(name)), name)
+			}
+			Expect(acceptEncoding).To(Equal(in.expectedEncoding))
+			for name := range in.expectedRequestHeaders {
+				Expect(requestHeaders.Get(name)).To(Equal(in.expectedRequestHeaders.Get(name)), name)
+			}
+
+			body := rw.Body.Bytes()
+			if in.encodedResponseBody != nil {
+				Expect(body).To(Equal(in.encodedResponseBody))
+				return
+			}
+			if rw.Header().Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				Expect(err).ToNot(HaveOccurred())
+				body, err = ioutil.ReadAll(zr)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(string(body)).To(Equal(in.expectedBody))
+		},
+		Entry("rewrites the Location and Content-Location headers", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{},
+			responseHeaders: http.Header{
+				"Location":         []string{"$upstream/bar?baz=1"},
+				"Content-Location": []string{"$upstream"},
+				"Content-Type":     []string{textHTMLUTF8},
+			},
+			responseBody: `<a href="$upstream/bar">bar</a>`,
+			expectedHeaders: http.Header{
+				"Location":         []string{"https://app.example.com/bar?baz=1"},
+				"Content-Location": []string{"https://app.example.com"},
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     `<a href="$upstream/bar">bar</a>`,
+		}),
+		Entry("rewrites the headers with the configured external URL", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				ExternalURL: "https://www.example.com/app/",
+			},
+			responseHeaders: http.Header{
+				"Location": []string{"$upstream/bar"},
+			},
+			expectedHeaders: http.Header{
+				"Location": []string{"https://www.example.com/app/bar"},
+			},
+			expectedEncoding: "gzip",
+		}),
+		Entry("doesn't rewrite the headers for other hosts", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{},
+			responseHeaders: http.Header{
+				"Location": []string{"https://auth.example.com/login"},
+			},
+			expectedHeaders: http.Header{
+				"Location": []string{"https://auth.example.com/login"},
+			},
+			expectedEncoding: "gzip",
+		}),
+		Entry("rewrites html bodies", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+			},
+			responseHeaders: http.Header{
+				"Content-Type": []string{textHTMLUTF8},
+			},
+			responseBody: `<a href="$upstream/bar">bar</a>`,
+			expectedHeaders: http.Header{
+				"Content-Length": []string{""},
+			},
+			expectedEncoding: "identity",
+			expectedBody:     `<a href="https://app.example.com/bar">bar</a>`,
+		}),
+		Entry("rewrites gzip encoded json bodies", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"br, gzip;q=0.8"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type": []string{applicationJSON},
+			},
+			responseBody: `{"next":"$upstream/bar"}`,
+			gzipResponse: true,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{"gzip"},
+				"Content-Length":   []string{""},
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     `{"next":"https://app.example.com/bar"}`,
+		}),
+		Entry("requests identity encoding when configured", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+				IdentityEncoding: true,
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"gzip"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type": []string{applicationJSON},
+			},
+			responseBody: `{"next":"$upstream/bar"}`,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{""},
+			},
+			expectedEncoding: "identity",
+			expectedBody:     `{"next":"https://app.example.com/bar"}`,
+		}),
+		Entry("doesn't rewrite other content types", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+			},
+			responseHeaders: http.Header{
+				"Content-Type": []string{"text/css"},
+			},
+			responseBody:     `a { background: url($upstream/bar.png) }`,
+			expectedEncoding: "identity",
+			expectedBody:     `a { background: url($upstream/bar.png) }`,
+		}),
+		Entry("passes brotli encoded bodies through when only rewriting the headers", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"br, gzip"},
+				"Range":           []string{"bytes=0-"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":     []string{textHTMLUTF8},
+				"Content-Encoding": []string{"br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+				"Location":         []string{"$upstream/bar"},
+			},
+			encodedResponseBody: brotliHTML,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{"br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+				"Location":         []string{"https://app.example.com/bar"},
+			},
+			expectedEncoding: "br, gzip",
+			expectedRequestHeaders: http.Header{
+				"Range": []string{"bytes=0-"},
+			},
+		}),
+		Entry("doesn't request brotli encoded bodies when rewriting the body", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"br, zstd"},
+				"Range":           []string{"bytes=100-"},
+				"If-Range":        []string{`"v1"`},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":  []string{textHTMLUTF8},
+				"Accept-Ranges": []string{"bytes"},
+				"Etag":          []string{`"v1"`},
+			},
+			responseBody: `<a href="$upstream/bar">bar</a>`,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{""},
+				"Content-Length":   []string{""},
+				"Accept-Ranges":    []string{""},
+				"Etag":             []string{`W/"v1"`},
+			},
+			expectedEncoding: "identity",
+			expectedRequestHeaders: http.Header{
+				"Range":    []string{""},
+				"If-Range": []string{""},
+			},
+			expectedBody: `<a href="https://app.example.com/bar">bar</a>`,
+		}),
+		Entry("passes brotli encoded bodies through when the upstream ignores the Accept-Encoding", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "http://", Replace: "https://"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"br, gzip"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":     []string{textHTMLUTF8},
+				"Content-Encoding": []string{"br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+				"Etag":             []string{`"v1"`},
+			},
+			encodedResponseBody: brotliHTML,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{"br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+				"Etag":             []string{`"v1"`},
+			},
+			expectedEncoding: "gzip",
+		}),
+		Entry("passes zstd encoded bodies through when the upstream ignores the Accept-Encoding", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "http://", Replace: "https://"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"zstd"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":     []string{applicationJSON},
+				"Content-Encoding": []string{"zstd"},
+				"Content-Length":   []string{strconv.Itoa(len(zstdJSON))},
+			},
+			encodedResponseBody: zstdJSON,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{"zstd"},
+				"Content-Length":   []string{strconv.Itoa(len(zstdJSON))},
+			},
+			expectedEncoding: "identity",
+		}),
+		Entry("passes bodies encoded several times through", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "http://", Replace: "https://"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"gzip"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":     []string{textHTMLUTF8},
+				"Content-Encoding": []string{"gzip, br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+			},
+			encodedResponseBody: brotliHTML,
+			expectedHeaders: http.Header{
+				"Content-Encoding": []string{"gzip, br"},
+				"Content-Length":   []string{strconv.Itoa(len(brotliHTML))},
+			},
+			expectedEncoding: "gzip",
+		}),
+		Entry("rewrites x-gzip encoded bodies", rewriteTableInput{
+			rewrite: &options.UpstreamResponseRewrite{
+				BodyReplacements: []options.BodyReplacement{{Find: "$upstream", Replace: "https://app.example.com"}},
+			},
+			requestHeaders: http.Header{
+				"Accept-Encoding": []string{"gzip"},
+			},
+			responseHeaders: http.Header{
+				"Content-Type":     []string{applicationJSON},
+				"Content-Encoding": []string{"X-Gzip"},
+			},
+			responseBody: `{"next":"$upstream/bar"}`,
+			gzipResponse: true,
+			expectedHeaders: http.Header{
+				"Content-Length": []string{""},
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     `{"next":"https://app.example.com/bar"}`,
+		}),
+	)
+
+	It("passes brotli encoded bodies through the response header policy", func() {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			Expect(req.Header.Get("Accept-Encoding")).To(Equal("br"))
+			rw.Header().Set("Content-Type", textHTMLUTF8)
+			rw.Header().Set("Content-Encoding", "br")
+			rw.Write(brotliHTML)
+		}))
+		defer upstreamServer.Close()
+
+		upstreams := options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:   "app",
+					Path: "/",
+					URI:  upstreamServer.URL,
+					ResponseHeaderPolicy: []options.ResponseHeaderPolicy{
+						{Name: "X-Frame-Options", Value: "DENY"},
+					},
+				},
+			},
+		}
+		handler, err := NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+		Expect(rw.Header().Get("Content-Encoding")).To(Equal("br"))
+		Expect(rw.Body.Bytes()).To(Equal(brotliHTML))
+	})
+})
+
+var (
+	brotliHTML = brotliUncompressed([]byte(`<a href="http://app.internal/bar">bar</a>`))
+	zstdJSON   = zstdRaw([]byte(`{"next":"http://app.internal/bar"}`))
+)
+
+// brotliUncompressed encodes the data, of up to 64KiB, as a brotli stream of
+// a single uncompressed meta-block, without needing a brotli encoder
+func brotliUncompressed(data []byte) []byte {
+	// WBITS of 16, a meta-block of 4 nibbles of MLEN-1 that isn't last and
+	// is uncompressed, padded to the next byte
+	header := uint32(len(data)-1)<<4 | 1<<20
+	stream := []byte{byte(header), byte(header >> 8), byte(header >> 16)}
+	stream = append(stream, data...)
+	// The last meta-block, which is empty
+	return append(stream, 0x03)
+}
+
+// zstdRaw encodes the data, of up to 255 bytes, as a zstd frame of a single
+// raw block, without needing a zstd encoder
+func zstdRaw(data []byte) []byte {
+	// The magic number, and a single segment frame header with a 1 byte
+	// content size
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, byte(len(data))}
+	// The last block, which is raw
+	block := uint32(len(data))<<3 | 1
+	frame = append(frame, byte(block), byte(block>>8), byte(block>>16))
+	return append(frame, data...)
+}
@@ -0,0 +1,217 @@
+package upstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// retryableStatusError is held by an attempt whose upstream response has a
+// retryable status, in place of the response, which is discarded
+type retryableStatusError struct {
+	status int
+}
+
+// Error describes the discarded response
+func (e *retryableStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with retryable status %d", e.status)
+}
+
+// retryPolicy retries the attempts at proxying requests to an upstream that
+// fail to reach the upstream, or are answered with a retryable status,
+// before any of the response is sent to the client
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	statusCodes map[int]struct{}
+	errors      map[string]struct{}
+	maxBodySize int64
+
+	// jitter returns a random duration up to the given duration, replaced
+	// in tests
+	jitter func(time.Duration) time.Duration
+}
+
+// newRetryPolicy creates the retry policy of the upstream, filling in the
+// defaults of its Retry, or returns nil when the upstream has none
+func newRetryPolicy(upstream options.Upstream) *retryPolicy {
+	opts := upstream.Retry
+	if opts == nil {
+		return nil
+	}
+
+	p := &retryPolicy{
+		maxAttempts: options.DefaultUpstreamRetryMaxAttempts,
+		backoff:     options.DefaultUpstreamRetryBackoff,
+		maxBackoff:  options.DefaultUpstreamRetryMaxBackoff,
+		statusCodes: map[int]struct{}{},
+		errors:      map[string]struct{}{},
+		maxBodySize: options.DefaultUpstreamRetryMaxBodySize,
+		jitter: func(d time.Duration) time.Duration {
+			/* #nosec G404 */
+			return time.Duration(rand.Int63n(int64(d) + 1))
+		},
+	}
+	if opts.MaxAttempts > 0 {
+		p.maxAttempts = opts.MaxAttempts
+	}
+	if opts.Backoff != nil {
+		p.backoff = opts.Backoff.Duration()
+	}
+	if opts.MaxBackoff != nil {
+		p.maxBackoff = opts.MaxBackoff.Duration()
+	}
+	if opts.MaxBodySize > 0 {
+		p.maxBodySize = opts.MaxBodySize
+	}
+
+	statusCodes := opts.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, code := range statusCodes {
+		p.statusCodes[code] = struct{}{}
+	}
+	classes := opts.Errors
+	if len(classes) == 0 {
+		classes = []string{options.UpstreamRetryErrorConnect, options.UpstreamRetryErrorReset}
+	}
+	for _, class := range classes {
+		p.errors[class] = struct{}{}
+	}
+	return p
+}
+
+// bufferBody reads the body of the request so that it can be sent to the
+// upstream again, returning whether the request can be retried.
+// Bodies larger than the MaxBodySize, or that fail to be read, are sent to
+// the upstream as they are, starting with the part already read, and the
+// request isn't retried.
+func (p *retryPolicy) bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil, true
+	}
+	if req.ContentLength > p.maxBodySize {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, p.maxBodySize+1))
+	if err != nil || int64(len(body)) > p.maxBodySize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// setBody sets the buffered body on the request of an attempt
+func setBody(req *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// retryReason returns why the attempt, which failed with the held error,
+// should be retried: the retryable status code or the class of connection
+// failure. Requests that aren't idempotent are only retried when they
+// weren't sent to the upstream.
+func (p *retryPolicy) retryReason(req *http.Request, attempt *streamAttempt) (string, bool) {
+	var statusErr *retryableStatusError
+	if errors.As(attempt.heldErr, &statusErr) {
+		return fmt.Sprintf("status_%d", statusErr.status), true
+	}
+
+	class := classifyRetryError(attempt.heldErr)
+	if _, ok := p.errors[class]; !ok {
+		return "", false
+	}
+	if !isRetryIdempotent(req) && attempt.wasSent() {
+		return "", false
+	}
+	return class, true
+}
+
+// retriesStatus returns whether responses with the status are retried, which
+// is only safe for idempotent requests, as the upstream has received them
+func (p *retryPolicy) retriesStatus(req *http.Request, status int) bool {
+	_, ok := p.statusCodes[status]
+	return ok && isRetryIdempotent(req)
+}
+
+// wait returns the wait before the retry, counted from 1: the backoff
+// doubled for each earlier retry, up to the MaxBackoff, less a jitter of up
+// to half of it
+func (p *retryPolicy) wait(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - p.jitter(d/2)
+}
+
+// sleep waits before the retry, returning false if the request is cancelled
+// first
+func (p *retryPolicy) sleep(req *http.Request, retry int) bool {
+	timer := time.NewTimer(p.wait(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// isRetryIdempotent returns whether the request can be sent to the upstream
+// again once the upstream may have received it: its method must be
+// idempotent, or it must have an Idempotency-Key, like the Go transport's
+// own retries.
+func isRetryIdempotent(req *http.Request) bool {
+	if isIdempotent(req.Method) {
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// classifyRetryError returns the class of a connection failure of an
+// attempt, or an empty class when the failure is never retried
+func classifyRetryError(err error) string {
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return options.UpstreamRetryErrorConnect
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return options.UpstreamRetryErrorTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return options.UpstreamRetryErrorReset
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,213 @@
+package upstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream Retry Suite", func() {
+	noBackoff := options.Duration(0)
+
+	var upstreamServer *httptest.Server
+	var logs *bytes.Buffer
+	// bodies receives the request bodies received by the upstream
+	var bodies chan string
+
+	// failures is the number of requests the upstream fails, with the
+	// failure, before it responds successfully
+	var failures int32
+	var failure func(rw http.ResponseWriter)
+	var requests int32
+
+	BeforeEach(func() {
+		failures = 1
+		failure = func(rw http.ResponseWriter) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte("unavailable"))
+		}
+		atomic.StoreInt32(&requests, 0)
+		bodies = make(chan string, 5)
+		upstreamServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+			bodies <- string(body)
+
+			if atomic.AddInt32(&requests, 1) > failures {
+				rw.Write([]byte("hello"))
+				return
+			}
+			failure(rw)
+		}))
+
+		logs = &bytes.Buffer{}
+		logger.SetErrOutput(logs)
+	})
+
+	AfterEach(func() {
+		logger.SetErrOutput(GinkgoWriter)
+		upstreamServer.Close()
+	})
+
+	// serve proxies the request to the upstream server, or to the URI, with
+	// the retry, returning the response and the request scope
+	serve := func(uri string, retry *options.UpstreamRetry, req *http.Request) (*httptest.ResponseRecorder, *middlewareapi.RequestScope) {
+		if uri == "" {
+			uri = upstreamServer.URL
+		}
+		u, err := url.Parse(uri)
+		Expect(err).ToNot(HaveOccurred())
+
+		errorHandler := func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte("upstream failed: " + err.Error()))
+		}
+		handler, err := newHTTPUpstreamProxy(options.Upstream{ID: "app", Retry: retry}, u, nil, errorHandler, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		scope := &middlewareapi.RequestScope{}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, middlewareapi.AddRequestScope(req, scope))
+		return rw, scope
+	}
+
+	Context("when the upstream responds with a retryable status", func() {
+		It("retries idempotent requests", func() {
+			req := httptest.NewRequest(http.MethodPut, "/items/1", strings.NewReader("item"))
+			rw, scope := serve("", &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("hello"))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+			Expect(<-bodies).To(Equal("item"))
+			Expect(<-bodies).To(Equal("item"))
+			Expect(scope.UpstreamRetries).To(Equal(1))
+			Expect(logs.String()).To(ContainSubstring(`upstream request retried: upstream="app" path="/items/1" attempt=1 reason=status_503`))
+		})
+
+		It("sends the response of the last attempt", func() {
+			failures = 5
+			req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+			rw, scope := serve("", &options.UpstreamRetry{MaxAttempts: 2, Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rw.Body.String()).To(Equal("unavailable"))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+			Expect(scope.UpstreamRetries).To(Equal(1))
+		})
+
+		It("doesn't retry statuses that aren't listed", func() {
+			req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+			rw, _ := serve("", &options.UpstreamRetry{StatusCodes: []int{http.StatusBadGateway}}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+
+		It("doesn't retry requests that aren't idempotent", func() {
+			req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("item"))
+			rw, scope := serve("", &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+			Expect(scope.UpstreamRetries).To(Equal(0))
+		})
+
+		It("retries requests with an Idempotency-Key", func() {
+			req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("item"))
+			req.Header.Set("Idempotency-Key", "8e03978e")
+			rw, _ := serve("", &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(<-bodies).To(Equal("item"))
+			Expect(<-bodies).To(Equal("item"))
+		})
+
+		It("doesn't retry requests with a body larger than the MaxBodySize, which is sent whole", func() {
+			req := httptest.NewRequest(http.MethodPut, "/items/1", strings.NewReader("a large item"))
+			req.ContentLength = -1
+			rw, _ := serve("", &options.UpstreamRetry{Backoff: &noBackoff, MaxBodySize: 4}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+			Expect(<-bodies).To(Equal("a large item"))
+		})
+	})
+
+	Context("when the connection to the upstream fails", func() {
+		BeforeEach(func() {
+			// Close the connection before responding
+			failure = func(rw http.ResponseWriter) {
+				conn, _, err := rw.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				conn.Close()
+			}
+		})
+
+		It("retries idempotent requests whose connection is closed", func() {
+			req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+			rw, scope := serve("", &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("hello"))
+			Expect(scope.UpstreamRetries).To(Equal(1))
+			Expect(logs.String()).To(ContainSubstring(`attempt=1 reason=reset`))
+		})
+
+		It("doesn't retry requests that aren't idempotent once they were sent", func() {
+			req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("item"))
+			rw, _ := serve("", &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusBadGateway))
+			Expect(rw.Body.String()).To(HavePrefix("upstream failed: "))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+
+		It("retries requests that aren't idempotent when the upstream can't be connected to", func() {
+			closed := httptest.NewServer(http.NotFoundHandler())
+			closed.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("item"))
+			rw, scope := serve(closed.URL, &options.UpstreamRetry{Backoff: &noBackoff}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusBadGateway))
+			Expect(rw.Body.String()).To(ContainSubstring("connection refused"))
+			Expect(scope.UpstreamRetries).To(Equal(2))
+			Expect(logs.String()).To(ContainSubstring(`attempt=2 reason=connect`))
+		})
+
+		It("doesn't retry the errors that aren't listed", func() {
+			req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+			rw, _ := serve("", &options.UpstreamRetry{Errors: []string{options.UpstreamRetryErrorConnect}}, req)
+
+			Expect(rw.Code).To(Equal(http.StatusBadGateway))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+	})
+
+	It("doubles the backoff up to the MaxBackoff, less the jitter", func() {
+		backoff, maxBackoff := options.Duration(100*time.Millisecond), options.Duration(time.Second)
+		policy := newRetryPolicy(options.Upstream{Retry: &options.UpstreamRetry{Backoff: &backoff, MaxBackoff: &maxBackoff}})
+		policy.jitter = func(d time.Duration) time.Duration { return d }
+
+		Expect(policy.wait(1)).To(Equal(50 * time.Millisecond))
+		Expect(policy.wait(2)).To(Equal(100 * time.Millisecond))
+		Expect(policy.wait(3)).To(Equal(200 * time.Millisecond))
+		Expect(policy.wait(5)).To(Equal(500 * time.Millisecond))
+
+		policy.jitter = func(time.Duration) time.Duration { return 0 }
+		Expect(policy.wait(1)).To(Equal(100 * time.Millisecond))
+		Expect(policy.wait(10)).To(Equal(time.Second))
+	})
+})
@@ -32,6 +32,7 @@ func rewritePath(rewriteRegExp *regexp.Regexp, rewriteTarget string, writer page
 				Status:    http.StatusInternalServerError,
 				RequestID: middleware.GetRequestScope(req).RequestID,
 				AppError:  fmt.Sprintf("Could not parse request URI: %v", err),
+				Accept:    req.Header.Get("Accept"),
 			})
 			return
 		}
@@ -45,6 +46,7 @@ func rewritePath(rewriteRegExp *regexp.Regexp, rewriteTarget string, writer page
 				Status:    http.StatusInternalServerError,
 				RequestID: middleware.GetRequestScope(req).RequestID,
 				AppError:  fmt.Sprintf("Could not parse rewrite URI: %v", err),
+				Accept:    req.Header.Get("Accept"),
 			})
 			return
 		}
@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// The types of upstream routes
+const (
+	routeTypeHTTP      = "http"
+	routeTypeFile      = "file"
+	routeTypeStatic    = "static"
+	routeTypeTemplated = "templated"
+)
+
+// RouteTable describes the routes of the proxy created by NewProxy, so that
+// the routing of requests can be debugged.
+type RouteTable interface {
+	// Routes returns the routes in the order they are matched
+	Routes() []Route
+	// MatchRoute returns the route a request with the method and path would
+	// be proxied to, without a session, so that upstreams with a
+	// SessionMatch never match
+	MatchRoute(method, path string) RouteMatch
+}
+
+// Route describes an upstream registered with the proxy.
+// Upstreams are matched by the request path, and the session of the request
+// for upstreams with a SessionMatch.
+type Route struct {
+	ID            string                        `json:"id"`
+	Path          string                        `json:"path"`
+	SessionMatch  *options.UpstreamSessionMatch `json:"sessionMatch,omitempty"`
+	Type          string                        `json:"type"`
+	URI           string                        `json:"uri,omitempty"`
+	Backends      []string                      `json:"backends,omitempty"`
+	RewriteTarget string                        `json:"rewriteTarget,omitempty"`
+	StripPath     bool                          `json:"stripPath,omitempty"`
+	PrependPath   string                        `json:"prependPath,omitempty"`
+	StaticCode    int                           `json:"staticCode,omitempty"`
+	Policies      []options.UpstreamPolicy      `json:"policies,omitempty"`
+}
+
+// RouteMatch is the route a request would be proxied to
+type RouteMatch struct {
+	// Route is the matching route, if any
+	Route *Route `json:"route"`
+	// Redirect is the path the request would be redirected to first, when
+	// only the path with a trailing slash matches a route
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// newRoute describes the upstream, with any credentials in its URI redacted
+func newRoute(upstream options.Upstream) Route {
+	route := Route{
+		ID:            upstream.ID,
+		Path:          upstream.Path,
+		SessionMatch:  upstream.SessionMatch,
+		URI:           redactURI(upstream.URI),
+		RewriteTarget: upstream.RewriteTarget,
+		StripPath:     upstream.StripPath,
+		PrependPath:   upstream.PrependPath,
+		Policies:      upstream.Policies,
+	}
+	for _, backend := range upstream.Backends {
+		route.Backends = append(route.Backends, backend.URI)
+	}
+
+	switch {
+	case upstream.Static:
+		route.Type = routeTypeStatic
+		route.StaticCode = derefStaticCode(upstream.StaticCode)
+	case isTemplatedURI(upstream.URI):
+		route.Type = routeTypeTemplated
+	case strings.HasPrefix(upstream.URI, fileScheme+"://"):
+		route.Type = routeTypeFile
+	default:
+		route.Type = routeTypeHTTP
+	}
+	return route
+}
+
+// redactURI replaces the password of any user info in the URI
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// Templated URIs can't be parsed, keep only the scheme when they have
+		// user info
+		if i := strings.Index(uri, "@"); i >= 0 {
+			if j := strings.Index(uri, "://"); j >= 0 && j < i {
+				return uri[:j+3] + "xxxxx" + uri[i:]
+			}
+		}
+		return uri
+	}
+	return u.Redacted()
+}
+
+// Routes returns the routes in the order they are matched, starting with
+// those of the dynamic upstreams
+func (m *multiUpstreamProxy) Routes() []Route {
+	routes := []Route{}
+	if dynamic := m.loadDynamic(); dynamic != nil {
+		routes = append(routes, dynamic.routes...)
+	}
+	return append(routes, m.loadConfigured().routes...)
+}
+
+// MatchRoute matches a request with the method and path against the serveMux,
+// without serving it
+func (m *multiUpstreamProxy) MatchRoute(method, path string) RouteMatch {
+	if dynamic := m.loadDynamic(); dynamic != nil {
+		if _, ok := dynamic.match(method, path); ok {
+			return dynamic.MatchRoute(method, path)
+		}
+	}
+
+	configured := m.loadConfigured()
+	route, ok := configured.match(method, path)
+	if ok && route == nil {
+		// Only the trailing slash redirect isn't named after an upstream
+		route, _ = configured.match(method, path+"/")
+		return RouteMatch{Route: route, Redirect: path + "/"}
+	}
+	return RouteMatch{Route: route}
+}
+
+// match returns the route of the upstream matching the request, or whether
+// another route matched
+func (m *multiUpstreamProxy) match(method, path string) (*Route, bool) {
+	req := &http.Request{
+		Method: method,
+		URL:    &url.URL{Path: path},
+		Header: http.Header{},
+	}
+	var match mux.RouteMatch
+	if !m.serveMux.Match(req, &match) {
+		return nil, false
+	}
+	for i := range m.routes {
+		if m.routes[i].ID == match.Route.GetName() {
+			route := m.routes[i]
+			return &route, true
+		}
+	}
+	return nil, true
+}
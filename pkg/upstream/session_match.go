@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
+)
+
+// sessionMatcher matches the route of an upstream with a SessionMatch to the
+// requests whose session, loaded by the session chain into the request
+// scope, matches it
+type sessionMatcher struct {
+	upstream string
+	groups   []string
+	claims   []options.UpstreamClaimMatch
+}
+
+// newSessionMatcher creates the matcher of the upstream's SessionMatch, or
+// returns nil when the upstream has none
+func newSessionMatcher(upstream options.Upstream) *sessionMatcher {
+	if upstream.SessionMatch == nil {
+		return nil
+	}
+
+	return &sessionMatcher{
+		upstream: upstream.ID,
+		groups:   upstream.SessionMatch.Groups,
+		claims:   upstream.SessionMatch.Claims,
+	}
+}
+
+// Match checks the session of the request against the SessionMatch.
+// Requests without a scope, such as those matched by the route table, or
+// without a session, never match.
+func (m *sessionMatcher) Match(req *http.Request, _ *mux.RouteMatch) bool {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		return false
+	}
+	session := scope.Session
+
+	if len(m.groups) > 0 && !containsAny(m.groups, session.Groups) {
+		return false
+	}
+	if len(m.claims) == 0 {
+		return true
+	}
+
+	extractor, err := util.NewSessionClaimExtractor(req.Context(), session)
+	if err != nil {
+		logger.Errorf("Error reading the claims of the session to match upstream %q: %v", m.upstream, err)
+		return false
+	}
+	for _, claim := range m.claims {
+		values, err := getSessionClaimValues(extractor, session, claim.Claim)
+		if err != nil {
+			logger.Errorf("Error matching the session to upstream %q: %v", m.upstream, err)
+			return false
+		}
+		if !containsAny(claim.Values, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// getSessionClaimValues returns the values of the claim, from the claims of
+// the session if it has any, or else from the fields of the session
+func getSessionClaimValues(extractor util.ClaimExtractor, session *sessions.SessionState, claim string) ([]string, error) {
+	if extractor != nil {
+		var values []string
+		exists, err := extractor.GetClaimInto(claim, &values)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return values, nil
+		}
+	}
+	return session.GetClaim(claim), nil
+}
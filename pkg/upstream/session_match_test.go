@@ -0,0 +1,146 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Match Suite", func() {
+	var proxy http.Handler
+
+	// Each upstream responds with its own static code, so that the upstream
+	// serving a request can be told from the response
+	static := func(id, path string, code int, match *options.UpstreamSessionMatch) options.Upstream {
+		return options.Upstream{
+			ID:           id,
+			Path:         path,
+			Static:       true,
+			StaticCode:   &code,
+			SessionMatch: match,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		proxy, err = NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				static("app", "/app/", http.StatusOK, nil),
+				// The upstreams matching sessions are matched in order, so
+				// the most specific goes first
+				static("eu-canary", "/app/", http.StatusNonAuthoritativeInfo, &options.UpstreamSessionMatch{
+					Groups: []string{"beta-testers"},
+					Claims: []options.UpstreamClaimMatch{
+						{Claim: "region.name", Values: []string{"eu-west", "eu-central"}},
+					},
+				}),
+				static("canary", "/app/", http.StatusAccepted, &options.UpstreamSessionMatch{
+					Groups: []string{"beta-testers"},
+				}),
+				static("admin", "/admin/", http.StatusAccepted, &options.UpstreamSessionMatch{
+					Claims: []options.UpstreamClaimMatch{
+						{Claim: "email", Values: []string{"admin@example.com"}},
+					},
+				}),
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	type sessionMatchTableInput struct {
+		path         string
+		session      *sessionsapi.SessionState
+		expectedCode int
+	}
+
+	DescribeTable("routes requests by their session",
+		func(in sessionMatchTableInput) {
+			req := httptest.NewRequest(http.MethodGet, in.path, nil)
+			scope := &middlewareapi.RequestScope{Session: in.session}
+			req = middlewareapi.AddRequestScope(req, scope)
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+		},
+		Entry("without a session", sessionMatchTableInput{
+			path:         "/app/",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a session in no matching group", sessionMatchTableInput{
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Groups: []string{"devs"}},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a session in a matching group", sessionMatchTableInput{
+			path:         "/app/page",
+			session:      &sessionsapi.SessionState{Groups: []string{"devs", "beta-testers"}},
+			expectedCode: http.StatusAccepted,
+		}),
+		Entry("with a session matching the groups of an upstream, but not its claims", sessionMatchTableInput{
+			path: "/app/page",
+			session: &sessionsapi.SessionState{
+				Groups: []string{"beta-testers"},
+				Claims: map[string]interface{}{"region": map[string]interface{}{"name": "us-east"}},
+			},
+			expectedCode: http.StatusAccepted,
+		}),
+		Entry("with a session matching the groups and claims of an upstream", sessionMatchTableInput{
+			path: "/app/page",
+			session: &sessionsapi.SessionState{
+				Groups: []string{"beta-testers"},
+				Claims: map[string]interface{}{"region": map[string]interface{}{"name": "eu-central"}},
+			},
+			expectedCode: http.StatusNonAuthoritativeInfo,
+		}),
+		Entry("with a session matching a field of the session", sessionMatchTableInput{
+			path:         "/admin/users",
+			session:      &sessionsapi.SessionState{Email: "admin@example.com"},
+			expectedCode: http.StatusAccepted,
+		}),
+		Entry("with a session not matching the only upstream of the path", sessionMatchTableInput{
+			path:         "/admin/users",
+			session:      &sessionsapi.SessionState{Email: "john.doe@example.com"},
+			expectedCode: http.StatusNotFound,
+		}),
+	)
+
+	It("redirects to the path with a trailing slash for the sessions matching it", func() {
+		serve := func(email string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				Session: &sessionsapi.SessionState{Email: email},
+			})
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			return rw
+		}
+
+		rw := serve("admin@example.com")
+		Expect(rw.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(rw.Header().Get("Location")).To(Equal("/admin/"))
+
+		Expect(serve("john.doe@example.com").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("matches the route table without a session", func() {
+		match := proxy.(RouteTable).MatchRoute(http.MethodGet, "/app/page")
+		Expect(match.Route).ToNot(BeNil())
+		Expect(match.Route.ID).To(Equal("app"))
+
+		routes := proxy.(RouteTable).Routes()
+		Expect(routes).To(HaveLen(4))
+		Expect(routes[0].ID).To(Equal("admin"))
+		Expect(routes[1].ID).To(Equal("eu-canary"))
+		Expect(routes[2].ID).To(Equal("canary"))
+		Expect(routes[2].SessionMatch).To(Equal(&options.UpstreamSessionMatch{Groups: []string{"beta-testers"}}))
+		Expect(routes[3].ID).To(Equal("app"))
+	})
+})
@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeSourceTimeout is how long configuring an upstream waits for the first
+// SVID from the Workload API
+const spiffeSourceTimeout = 30 * time.Second
+
+// spiffeSource provides the X.509 SVID of the proxy and the trust bundles its
+// upstream servers are verified against, kept up to date by the Workload API
+type spiffeSource interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+var (
+	spiffeSourcesMu sync.Mutex
+	spiffeSources   = map[string]spiffeSource{}
+
+	// newSPIFFESource connects to the Workload API at the address, waiting
+	// for the first SVID. It is replaced in tests.
+	newSPIFFESource = func(ctx context.Context, address string) (spiffeSource, error) {
+		return workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(
+			workloadapi.WithAddr(address),
+			workloadapi.WithLogger(spiffeLogger{}),
+		))
+	}
+)
+
+// upstreamSPIFFE holds the source of the SVIDs presented to an upstream, and
+// the authorizer of the SPIFFE IDs of its servers
+type upstreamSPIFFE struct {
+	source     spiffeSource
+	authorizer tlsconfig.Authorizer
+}
+
+// newUpstreamSPIFFE connects to the Workload API of the upstream's SPIFFE
+// options, or returns nil when the upstream has none
+func newUpstreamSPIFFE(upstream options.Upstream) (*upstreamSPIFFE, error) {
+	opts := upstream.SPIFFE
+	if opts == nil {
+		return nil, nil
+	}
+
+	authorizer, err := newSPIFFEAuthorizer(opts)
+	if err != nil {
+		return nil, err
+	}
+	source, err := getSPIFFESource(opts.EndpointSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamSPIFFE{
+		source:     source,
+		authorizer: authorizer,
+	}, nil
+}
+
+// newSPIFFEAuthorizer creates the authorizer of the SPIFFE IDs that are one
+// of the IDs, or a member of the trust domain
+func newSPIFFEAuthorizer(opts *options.UpstreamSPIFFE) (tlsconfig.Authorizer, error) {
+	ids := make(map[spiffeid.ID]struct{}, len(opts.IDs))
+	for _, value := range opts.IDs {
+		id, err := spiffeid.FromString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spiffe id %q: %v", value, err)
+		}
+		ids[id] = struct{}{}
+	}
+
+	var trustDomain spiffeid.TrustDomain
+	if opts.TrustDomain != "" {
+		var err error
+		trustDomain, err = spiffeid.TrustDomainFromString(opts.TrustDomain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spiffe trustDomain %q: %v", opts.TrustDomain, err)
+		}
+	}
+	if len(ids) == 0 && trustDomain.IsZero() {
+		return nil, errors.New("spiffe requires ids or a trustDomain")
+	}
+
+	return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		if _, ok := ids[id]; ok {
+			return nil
+		}
+		if !trustDomain.IsZero() && id.MemberOf(trustDomain) {
+			return nil
+		}
+		return fmt.Errorf("unexpected upstream SPIFFE ID %q", id)
+	}, nil
+}
+
+// getSPIFFESource returns the source of the Workload API at the address, or
+// at the SPIFFE_ENDPOINT_SOCKET when the address is empty, connecting to it
+// the first time it is used.
+// Sources are kept for the life of the process, so that the upstreams
+// configured again, when they are reloaded, share them.
+func getSPIFFESource(address string) (spiffeSource, error) {
+	if address == "" {
+		var ok bool
+		if address, ok = workloadapi.GetDefaultAddress(); !ok {
+			return nil, fmt.Errorf("spiffe has no endpointSocket, and %s is not set", workloadapi.SocketEnv)
+		}
+	}
+
+	spiffeSourcesMu.Lock()
+	defer spiffeSourcesMu.Unlock()
+	if source, ok := spiffeSources[address]; ok {
+		return source, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeSourceTimeout)
+	defer cancel()
+	source, err := newSPIFFESource(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not get an SVID from the SPIFFE Workload API at %s: %v", address, err)
+	}
+	logger.Printf("using the SPIFFE Workload API at %s for upstream workload identities", address)
+	spiffeSources[address] = source
+	return source, nil
+}
+
+// spiffeLogger logs the messages of the Workload API client
+type spiffeLogger struct{}
+
+func (spiffeLogger) Debugf(format string, args ...interface{}) {
+	logger.DebugfContext(context.Background(), "SPIFFE Workload API: "+format, args...)
+}
+
+func (spiffeLogger) Infof(format string, args ...interface{}) {
+	logger.Printf("SPIFFE Workload API: "+format, args...)
+}
+
+func (spiffeLogger) Warnf(format string, args ...interface{}) {
+	logger.Printf("SPIFFE Workload API: "+format, args...)
+}
+
+func (spiffeLogger) Errorf(format string, args ...interface{}) {
+	logger.Errorf("SPIFFE Workload API: "+format, args...)
+}
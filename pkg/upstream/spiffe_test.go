@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// staticSPIFFESource provides a fixed SVID and bundle in place of the
+// Workload API
+type staticSPIFFESource struct {
+	svid   *x509svid.SVID
+	bundle *x509bundle.Bundle
+}
+
+func (s *staticSPIFFESource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+func (s *staticSPIFFESource) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	return s.bundle.GetX509BundleForTrustDomain(td)
+}
+
+var _ = Describe("Upstream SPIFFE Suite", func() {
+	const socket = "unix:///run/spire/sockets/agent.sock"
+
+	var server *httptest.Server
+	var source *staticSPIFFESource
+	var connects []string
+	var restoreSource func(context.Context, string) (spiffeSource, error)
+
+	BeforeEach(func() {
+		trustDomain := spiffeid.RequireTrustDomainFromString("example.org")
+		ca, _, _ := issue(&x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "SPIRE CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+		serverCert, _, _ := issue(&x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			URIs:         []*url.URL{spiffeid.RequireFromPath(trustDomain, "/ledger").URL()},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca)
+		clientCert, _, _ := issue(&x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			URIs:         []*url.URL{spiffeid.RequireFromPath(trustDomain, "/oauth2-proxy").URL()},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+
+		source = &staticSPIFFESource{
+			svid: &x509svid.SVID{
+				ID:           spiffeid.RequireFromPath(trustDomain, "/oauth2-proxy"),
+				Certificates: []*x509.Certificate{clientCert.Leaf},
+				PrivateKey:   clientCert.PrivateKey.(crypto.Signer),
+			},
+			bundle: x509bundle.FromX509Authorities(trustDomain, []*x509.Certificate{ca.Leaf}),
+		}
+		connects = []string{}
+		restoreSource = newSPIFFESource
+		newSPIFFESource = func(_ context.Context, address string) (spiffeSource, error) {
+			connects = append(connects, address)
+			return source, nil
+		}
+		spiffeSources = map[string]spiffeSource{}
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.Leaf)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(req.TLS.PeerCertificates[0].URIs[0].String()))
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{*serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		newSPIFFESource = restoreSource
+		spiffeSources = map[string]spiffeSource{}
+	})
+
+	// get proxies a request to the server through the upstream
+	get := func(upstream options.Upstream) *httptest.ResponseRecorder {
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		upstream.ID = "ledger"
+		errorHandler := func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte(err.Error()))
+		}
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, errorHandler, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, "/", nil), &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("presents the SVID to the upstream, verifying its SPIFFE ID", func() {
+		rw := get(options.Upstream{SPIFFE: &options.UpstreamSPIFFE{
+			EndpointSocket: socket,
+			IDs:            []string{"spiffe://example.org/ledger"},
+		}})
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("spiffe://example.org/oauth2-proxy"))
+	})
+
+	It("accepts any SPIFFE ID of the trust domain", func() {
+		rw := get(options.Upstream{SPIFFE: &options.UpstreamSPIFFE{
+			EndpointSocket: socket,
+			TrustDomain:    "example.org",
+		}})
+		Expect(rw.Code).To(Equal(http.StatusOK))
+	})
+
+	It("rejects upstreams with unexpected SPIFFE IDs", func() {
+		rw := get(options.Upstream{SPIFFE: &options.UpstreamSPIFFE{
+			EndpointSocket: socket,
+			IDs:            []string{"spiffe://example.org/payments"},
+			TrustDomain:    "partner.example.com",
+		}})
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(rw.Body.String()).To(ContainSubstring(`unexpected upstream SPIFFE ID "spiffe://example.org/ledger"`))
+	})
+
+	It("shares the Workload API of an endpoint socket between upstreams", func() {
+		os.Setenv(workloadapi.SocketEnv, socket)
+		defer os.Unsetenv(workloadapi.SocketEnv)
+
+		for _, opts := range []*options.UpstreamSPIFFE{
+			{EndpointSocket: socket, TrustDomain: "example.org"},
+			{TrustDomain: "example.org"},
+			{EndpointSocket: "tcp://127.0.0.1:8081", TrustDomain: "example.org"},
+		} {
+			_, err := newUpstreamSPIFFE(options.Upstream{SPIFFE: opts})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(connects).To(Equal([]string{socket, "tcp://127.0.0.1:8081"}))
+	})
+
+	It("fails without an endpoint socket", func() {
+		_, err := newUpstreamSPIFFE(options.Upstream{SPIFFE: &options.UpstreamSPIFFE{TrustDomain: "example.org"}})
+		Expect(err).To(MatchError("spiffe has no endpointSocket, and SPIFFE_ENDPOINT_SOCKET is not set"))
+	})
+})
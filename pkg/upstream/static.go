@@ -1,28 +1,46 @@
 package upstream
 
 import (
+	"bytes"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"text/template"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 )
 
-const defaultStaticResponseCode = 200
+const (
+	defaultStaticResponseCode = 200
+
+	// defaultStaticTemplateContentType is the Content-Type of templated static
+	// responses when none is configured
+	defaultStaticTemplateContentType = "text/html; charset=utf-8"
+)
 
 // newStaticResponseHandler creates a new staticResponseHandler that serves a
 // a static response code.
-func newStaticResponseHandler(upstream string, code *int) http.Handler {
+func newStaticResponseHandler(upstream string, code *int, contentType string) http.Handler {
 	return &staticResponseHandler{
-		code:     derefStaticCode(code),
-		upstream: upstream,
+		code:        derefStaticCode(code),
+		upstream:    upstream,
+		contentType: contentType,
 	}
 }
 
 // staticResponseHandler responds with a static response with the given response code.
 type staticResponseHandler struct {
-	code     int
-	upstream string
+	code        int
+	upstream    string
+	contentType string
 }
 
 // ServeHTTP serves a static response.
@@ -32,6 +50,9 @@ func (s *staticResponseHandler) ServeHTTP(rw http.ResponseWriter, req *http.Requ
 	// A scope should always be injected before this handler is called.
 	scope.Upstream = s.upstream
 
+	if s.contentType != "" {
+		rw.Header().Set("Content-Type", s.contentType)
+	}
 	rw.WriteHeader(s.code)
 	_, err := fmt.Fprintf(rw, "Authenticated")
 	if err != nil {
@@ -39,6 +60,233 @@ func (s *staticResponseHandler) ServeHTTP(rw http.ResponseWriter, req *http.Requ
 	}
 }
 
+// staticTemplate is implemented by both html/template and text/template
+type staticTemplate interface {
+	Execute(io.Writer, interface{}) error
+}
+
+// staticTemplateData is the data static response templates are rendered with
+type staticTemplateData struct {
+	Email     string
+	User      string
+	Groups    []string
+	Claims    map[string]interface{}
+	Method    string
+	Path      string
+	Host      string
+	Query     url.Values
+	Headers   http.Header
+	Upstreams []staticTemplateUpstream
+}
+
+// staticTemplateUpstream describes a configured upstream to static response
+// templates
+type staticTemplateUpstream struct {
+	ID   string
+	Path string
+}
+
+// staticHeader is a header of a static response, whose value is rendered
+// from a template with the context of the request
+type staticHeader struct {
+	name  string
+	value *template.Template
+}
+
+// newStaticTemplateHandler creates a new staticTemplateHandler that renders
+// the upstream's StaticTemplate or StaticBody, and StaticHeaders, for each
+// request.
+// The templates are parsed once, HTML content types are rendered with
+// html/template so that values are escaped. Without a StaticTemplate or
+// StaticBody, the body is "Authenticated", like untemplated responses.
+func newStaticTemplateHandler(upstream options.Upstream, upstreams []options.Upstream, writer pagewriter.Writer) (http.Handler, error) {
+	contentType := upstream.StaticContentType
+	if contentType == "" && (upstream.StaticTemplate != "" || upstream.StaticBody != "") {
+		contentType = defaultStaticTemplateContentType
+	}
+
+	var tmpl staticTemplate
+	var err error
+	switch {
+	case upstream.StaticTemplate != "":
+		tmpl, err = parseStaticTemplate(upstream.StaticTemplate, contentType)
+	case upstream.StaticBody != "":
+		tmpl, err = parseStaticBody(upstream.StaticBody, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]staticHeader, 0, len(upstream.StaticHeaders))
+	for _, header := range upstream.StaticHeaders {
+		value, err := template.New(header.Name).Parse(header.Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse static header %s: %v", header.Name, err)
+		}
+		headers = append(headers, staticHeader{name: header.Name, value: value})
+	}
+
+	described := make([]staticTemplateUpstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		described = append(described, staticTemplateUpstream{ID: u.ID, Path: u.Path})
+	}
+
+	return &staticTemplateHandler{
+		code:        derefStaticCode(upstream.StaticCode),
+		upstream:    upstream.ID,
+		contentType: contentType,
+		template:    tmpl,
+		headers:     headers,
+		upstreams:   described,
+		writer:      writer,
+	}, nil
+}
+
+// parseStaticTemplate parses the template file, choosing the template package
+// by the content type of the response
+func parseStaticTemplate(path, contentType string) (staticTemplate, error) {
+	html, err := isHTMLContentType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(path)
+	if html {
+		tmpl, err := htmltemplate.New(name).ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse static template %s: %v", path, err)
+		}
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New(name).ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse static template %s: %v", path, err)
+	}
+	return tmpl, nil
+}
+
+// parseStaticBody parses the inline template of the body, choosing the
+// template package by the content type of the response
+func parseStaticBody(body, contentType string) (staticTemplate, error) {
+	html, err := isHTMLContentType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if html {
+		tmpl, err := htmltemplate.New("staticBody").Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse static body: %v", err)
+		}
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("staticBody").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse static body: %v", err)
+	}
+	return tmpl, nil
+}
+
+// isHTMLContentType returns whether static responses of the content type
+// are rendered with html/template
+func isHTMLContentType(contentType string) (bool, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, fmt.Errorf("invalid static content type %q: %v", contentType, err)
+	}
+	return mediaType == "text/html", nil
+}
+
+// staticTemplateHandler responds with a static response code, and a body
+// and headers rendered from templates with the context of the request.
+type staticTemplateHandler struct {
+	code        int
+	upstream    string
+	contentType string
+	template    staticTemplate
+	headers     []staticHeader
+	upstreams   []staticTemplateUpstream
+	writer      pagewriter.Writer
+
+	// logErrorOnce ensures template errors are only logged once, rather than
+	// for every request
+	logErrorOnce sync.Once
+}
+
+// ServeHTTP renders the template for the request.
+// If the template can't be rendered, the error page is served instead.
+func (s *staticTemplateHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = s.upstream
+
+	data := staticTemplateData{
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Host:      req.Host,
+		Query:     req.URL.Query(),
+		Headers:   req.Header,
+		Upstreams: s.upstreams,
+	}
+	if scope.Session != nil {
+		data.Email = scope.Session.Email
+		data.User = scope.Session.User
+		data.Groups = scope.Session.Groups
+		data.Claims = scope.Session.Claims
+	}
+
+	// Render the templates before writing anything, so that the error page
+	// can be served if any of them fails
+	body, headers, err := s.render(data)
+	if err != nil {
+		s.logErrorOnce.Do(func() {
+			logger.Errorf("Error rendering static template for upstream %q: %v", s.upstream, err)
+		})
+		s.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+			Status:    http.StatusInternalServerError,
+			RequestID: scope.RequestID,
+			AppError:  err.Error(),
+			Accept:    req.Header.Get("Accept"),
+		})
+		return
+	}
+
+	if s.contentType != "" {
+		rw.Header().Set("Content-Type", s.contentType)
+	}
+	for name, values := range headers {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(s.code)
+	if _, err := body.WriteTo(rw); err != nil {
+		logger.Errorf("Error writing static response: %v", err)
+	}
+}
+
+// render renders the body and the values of the headers, by canonical name
+func (s *staticTemplateHandler) render(data staticTemplateData) (*bytes.Buffer, http.Header, error) {
+	body := bytes.NewBufferString("Authenticated")
+	if s.template != nil {
+		body.Reset()
+		if err := s.template.Execute(body, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	headers := http.Header{}
+	for _, header := range s.headers {
+		var value bytes.Buffer
+		if err := header.value.Execute(&value, data); err != nil {
+			return nil, nil, err
+		}
+		headers.Add(header.name, value.String())
+	}
+	return body, headers, nil
+}
+
 // derefStaticCode returns the derefenced value, or the default if the value is nil
 func derefStaticCode(code *int) int {
 	if code != nil {
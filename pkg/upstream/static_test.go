@@ -3,10 +3,16 @@ package upstream
 import (
 	"crypto/rand"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -38,7 +44,7 @@ var _ = Describe("Static Response Suite", func() {
 			if in.staticCode != 0 {
 				code = &in.staticCode
 			}
-			handler := newStaticResponseHandler(id, code)
+			handler := newStaticResponseHandler(id, code, "")
 
 			req := httptest.NewRequest("", in.requestPath, nil)
 			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
@@ -83,4 +89,151 @@ var _ = Describe("Static Response Suite", func() {
 			expectedCode: http.StatusTeapot,
 		}),
 	)
+
+	Context("staticTemplate ServeHTTP", func() {
+		var templatePath string
+		var errorStatus int
+		var writer *pagewriter.WriterFuncs
+
+		upstreams := []options.Upstream{
+			{ID: "app", Path: "/app/"},
+			{ID: "static", Path: "/"},
+		}
+
+		BeforeEach(func() {
+			templatePath = path.Join(filesDir, "static.tmpl")
+			errorStatus = 0
+			writer = &pagewriter.WriterFuncs{
+				ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+					errorStatus = opts.Status
+					rw.WriteHeader(opts.Status)
+					rw.Write([]byte("Error Page"))
+				},
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(templatePath)).To(Succeed())
+		})
+
+		serve := func(upstream options.Upstream, session *sessionsapi.SessionState) *httptest.ResponseRecorder {
+			handler, err := newStaticTemplateHandler(upstream, upstreams, writer)
+			Expect(err).ToNot(HaveOccurred())
+
+			req := httptest.NewRequest("", "http://example.com/static/page?page=2", nil)
+			req.Header.Set("X-Name", "<admin>")
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			scope := middlewareapi.GetRequestScope(req)
+			Expect(scope.Upstream).To(Equal(id))
+			return rw
+		}
+
+		It("renders an HTML template with the request context", func() {
+			Expect(ioutil.WriteFile(templatePath, []byte(
+				`{{.Email}} {{.User}} {{range .Groups}}[{{.}}]{{end}} {{.Host}}{{.Path}}{{range .Upstreams}} {{.ID}}={{.Path}}{{end}}`,
+			), 0644)).To(Succeed())
+
+			rw := serve(options.Upstream{ID: id, Path: "/static/", StaticTemplate: templatePath}, &sessionsapi.SessionState{
+				Email:  "<b>user@example.com</b>",
+				User:   "user",
+				Groups: []string{"a", "b"},
+			})
+
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Header().Get(contentType)).To(Equal(textHTMLUTF8))
+			Expect(rw.Body.String()).To(Equal("&lt;b&gt;user@example.com&lt;/b&gt; user [a][b] example.com/static/page app=/app/ static=/"))
+		})
+
+		It("renders other content types without HTML escaping", func() {
+			Expect(ioutil.WriteFile(templatePath, []byte(`{"email":"{{.Email}}"}`), 0644)).To(Succeed())
+
+			code := http.StatusAccepted
+			rw := serve(options.Upstream{
+				ID:                id,
+				Path:              "/static/",
+				StaticCode:        &code,
+				StaticTemplate:    templatePath,
+				StaticContentType: applicationJSON,
+			}, &sessionsapi.SessionState{Email: "<user@example.com>"})
+
+			Expect(rw.Code).To(Equal(http.StatusAccepted))
+			Expect(rw.Header().Get(contentType)).To(Equal(applicationJSON))
+			Expect(rw.Body.String()).To(Equal(`{"email":"<user@example.com>"}`))
+		})
+
+		It("renders the error page when the template fails", func() {
+			Expect(ioutil.WriteFile(templatePath, []byte(`{{index .Groups 1}}`), 0644)).To(Succeed())
+
+			rw := serve(options.Upstream{ID: id, Path: "/static/", StaticTemplate: templatePath}, nil)
+
+			Expect(errorStatus).To(Equal(http.StatusInternalServerError))
+			Expect(rw.Code).To(Equal(http.StatusInternalServerError))
+			Expect(rw.Body.String()).To(Equal("Error Page"))
+		})
+
+		It("renders an inline body and headers with the request and claims", func() {
+			code := http.StatusServiceUnavailable
+			rw := serve(options.Upstream{
+				ID:                id,
+				Path:              "/static/",
+				StaticCode:        &code,
+				StaticBody:        `{"method":"{{.Method}}","page":"{{.Query.Get "page"}}","tenant":"{{.Claims.tenant}}"}`,
+				StaticContentType: applicationJSON,
+				StaticHeaders: []options.UpstreamStaticHeader{
+					{Name: "Retry-After", Value: "120"},
+					{Name: "Link", Value: "<https://{{.Host}}/status>; rel=status"},
+					{Name: "Link", Value: "<https://{{.Host}}{{.Path}}>; rel=canonical"},
+					{Name: "content-type", Value: "application/problem+json"},
+				},
+			}, &sessionsapi.SessionState{Claims: map[string]interface{}{"tenant": "acme"}})
+
+			Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rw.Header().Get(contentType)).To(Equal("application/problem+json"))
+			Expect(rw.Header().Get("Retry-After")).To(Equal("120"))
+			Expect(rw.Header().Values("Link")).To(Equal([]string{
+				"<https://example.com/status>; rel=status",
+				"<https://example.com/static/page>; rel=canonical",
+			}))
+			Expect(rw.Body.String()).To(Equal(`{"method":"GET","page":"2","tenant":"acme"}`))
+		})
+
+		It("escapes inline HTML bodies, and responds Authenticated with only headers", func() {
+			rw := serve(options.Upstream{ID: id, Path: "/static/", StaticBody: `<p>{{.Headers.Get "X-Name"}}</p>`}, nil)
+			Expect(rw.Header().Get(contentType)).To(Equal(textHTMLUTF8))
+			Expect(rw.Body.String()).To(Equal("<p>&lt;admin&gt;</p>"))
+
+			code := http.StatusFound
+			rw = serve(options.Upstream{
+				ID:            id,
+				Path:          "/static/",
+				StaticCode:    &code,
+				StaticHeaders: []options.UpstreamStaticHeader{{Name: "Location", Value: "https://new.example.com{{.Path}}"}},
+			}, nil)
+			Expect(rw.Code).To(Equal(http.StatusFound))
+			Expect(rw.Header().Get("Location")).To(Equal("https://new.example.com/static/page"))
+			Expect(rw.Body.String()).To(Equal("Authenticated"))
+		})
+
+		It("renders the error page when a header fails", func() {
+			rw := serve(options.Upstream{
+				ID:            id,
+				Path:          "/static/",
+				StaticHeaders: []options.UpstreamStaticHeader{{Name: "X-Group", Value: "{{index .Groups 1}}"}},
+			}, nil)
+
+			Expect(errorStatus).To(Equal(http.StatusInternalServerError))
+			Expect(rw.Header().Get("X-Group")).To(BeEmpty())
+		})
+
+		It("fails to create the handler with an invalid template", func() {
+			Expect(ioutil.WriteFile(templatePath, []byte(`{{.Email`), 0644)).To(Succeed())
+
+			_, err := newStaticTemplateHandler(options.Upstream{ID: id, StaticTemplate: templatePath}, upstreams, writer)
+			Expect(err).To(MatchError(ContainSubstring("could not parse static template " + templatePath)))
+		})
+	})
 })
@@ -0,0 +1,442 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The classes of errors reading an upstream response body
+const (
+	streamErrorTimeout       = "timeout"
+	streamErrorReset         = "reset"
+	streamErrorUnexpectedEOF = "unexpected_eof"
+	streamErrorOther         = "other"
+)
+
+// The outcomes of requests whose upstream response body failed
+const (
+	streamOutcomeRetried   = "retried"
+	streamOutcomeErrorPage = "error_page"
+	streamOutcomeAborted   = "aborted"
+)
+
+// streamAttemptKey is the context key of the streamAttempt of a request
+type streamAttemptKey struct{}
+
+// streamAttempt records the first error reading the upstream response body
+// of one attempt at proxying a request, and the address of the server it was
+// sent to
+type streamAttempt struct {
+	err     error
+	address string
+
+	// retry is set when the attempt can be retried, so that its connection
+	// failures and retryable responses are held back in heldErr rather than
+	// rendered
+	retry   *retryPolicy
+	heldErr error
+
+	// sent is set once the request headers have been written to the
+	// upstream, by the transport, so it is accessed atomically
+	sent int32
+}
+
+// wasSent returns whether the request was written to the upstream
+func (a *streamAttempt) wasSent() bool {
+	return atomic.LoadInt32(&a.sent) == 1
+}
+
+// upstreamBody records the errors reading an upstream response body in the
+// attempt
+type upstreamBody struct {
+	io.ReadCloser
+	attempt *streamAttempt
+}
+
+// Read reads the upstream response body, recording the first error other
+// than the end of the body
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.attempt.err == nil {
+		b.attempt.err = err
+	}
+	return n, err
+}
+
+// setProxyStreamAttempt sets the proxy.ModifyResponse so that errors reading
+// upstream response bodies are recorded in the streamAttempt of the request.
+// The body is wrapped before any other response modifications, so that they
+// read from it.
+// Upgraded connections are left alone, as the proxy needs their body to be
+// writable.
+// When the attempt can be retried, responses with a retryable status are
+// discarded, and the proxy.ErrorHandler holds back the errors of the attempt
+// instead of rendering them.
+func setProxyStreamAttempt(proxy *httputil.ReverseProxy) {
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(res *http.Response) error {
+		attempt, ok := res.Request.Context().Value(streamAttemptKey{}).(*streamAttempt)
+		if ok && attempt.retry != nil && attempt.retry.retriesStatus(res.Request, res.StatusCode) {
+			return &retryableStatusError{status: res.StatusCode}
+		}
+		if ok && res.StatusCode != http.StatusSwitchingProtocols {
+			res.Body = &upstreamBody{ReadCloser: res.Body, attempt: attempt}
+		}
+		if modifyResponse != nil {
+			return modifyResponse(res)
+		}
+		return nil
+	}
+
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		if attempt, ok := req.Context().Value(streamAttemptKey{}).(*streamAttempt); ok && attempt.retry != nil {
+			attempt.heldErr = err
+			return
+		}
+		if errorHandler != nil {
+			errorHandler(rw, req, err)
+			return
+		}
+		logger.Errorf("Error proxying to upstream server: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// serveStream proxies the request to the upstream, handling failures
+// reading the upstream response body once the upstream has started its
+// response.
+// Until the first byte of the body is written, the response is held back so
+// that the request can be retried, when the upstream allows it, or the error
+// handler can render the error. Once the response has been sent to the
+// client, the response is aborted so that the client can tell it is
+// incomplete: HTTP/1.1 chunked responses miss their terminal chunk, and
+// HTTP/2 streams are reset.
+// When the upstream has a Retry, the attempts that fail to reach the
+// upstream, or are answered with a retryable status, are retried up to its
+// MaxAttempts, with the buffered request body.
+// The address, duration and retries of the attempts are recorded in the
+// request scope for the request log, and each attempt is traced in a client
+// span.
+func (h *httpUpstreamProxy) serveStream(rw http.ResponseWriter, req *http.Request) {
+	retries := 0
+	if h.retryStreamErrors && isReplayable(req) {
+		retries = 1
+	}
+	policyRetries := 0
+	var body []byte
+	if h.retry != nil {
+		var ok bool
+		if body, ok = h.retry.bufferBody(req); ok {
+			policyRetries = h.retry.maxAttempts - 1
+		}
+	}
+	scope := middleware.GetRequestScope(req)
+
+	for retry := 0; ; retry++ {
+		attempt := &streamAttempt{}
+		if policyRetries > 0 {
+			attempt.retry = h.retry
+		}
+		stream := newStreamResponse(rw)
+		start := time.Now()
+		attemptReq, span := h.startAttemptSpan(newAttemptRequest(req, attempt), retry)
+		setBody(attemptReq, body)
+		aborted := h.serveAttempt(stream, attemptReq)
+		endAttemptSpan(span, attempt, stream)
+		if scope != nil {
+			scope.UpstreamDuration += time.Since(start)
+			if attempt.address != "" {
+				scope.UpstreamAddress = attempt.address
+			}
+		}
+
+		if attempt.heldErr != nil {
+			reason, ok := h.retry.retryReason(req, attempt)
+			if !ok || req.Context().Err() != nil || !h.retry.sleep(req, retry+1) {
+				h.handleError(rw, req, attempt.heldErr)
+				return
+			}
+			policyRetries--
+			if scope != nil {
+				scope.UpstreamRetries++
+			}
+			logger.Errorf("upstream request retried: upstream=%q path=%q attempt=%d reason=%s error=%v",
+				h.upstream,
+				req.URL.Path,
+				retry+1,
+				reason,
+				attempt.heldErr,
+			)
+			continue
+		}
+
+		// Errors once the client has gone away are not failures of the upstream
+		if attempt.err == nil || req.Context().Err() != nil {
+			if aborted {
+				panic(http.ErrAbortHandler)
+			}
+			stream.finish()
+			return
+		}
+
+		class := classifyStreamError(attempt.err)
+		switch {
+		case !stream.committed && retries > 0:
+			retries--
+			if scope != nil {
+				scope.UpstreamRetries++
+			}
+			h.recordStreamError(req, stream, class, streamOutcomeRetried, attempt.err)
+			continue
+		case !stream.committed:
+			h.recordStreamError(req, stream, class, streamOutcomeErrorPage, attempt.err)
+			h.handleError(rw, req, attempt.err)
+			return
+		default:
+			h.recordStreamError(req, stream, class, streamOutcomeAborted, attempt.err)
+			// Like the ReverseProxy, only abort when the server recovers the panic
+			if req.Context().Value(http.ServerContextKey) != nil {
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+	}
+}
+
+// newAttemptRequest returns the request of the attempt, whose context holds
+// the attempt and records the remote address of the connection it is sent on
+func newAttemptRequest(req *http.Request, attempt *streamAttempt) *http.Request {
+	ctx := context.WithValue(req.Context(), streamAttemptKey{}, attempt)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				attempt.address = addr.String()
+			}
+		},
+		WroteHeaders: func() {
+			atomic.StoreInt32(&attempt.sent, 1)
+		},
+	})
+	return req.WithContext(ctx)
+}
+
+// startAttemptSpan starts the client span of the attempt, whose trace context
+// is propagated to the upstream in the request headers
+func (h *httpUpstreamProxy) startAttemptSpan(req *http.Request, retry int) (*http.Request, trace.Span) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			tracing.UpstreamKey.String(h.upstream),
+		),
+	)
+	if retry > 0 {
+		span.SetAttributes(semconv.HTTPResendCountKey.Int(retry))
+	}
+	tracing.Inject(ctx, req.Header)
+	return req.WithContext(ctx), span
+}
+
+// endAttemptSpan ends the client span of the attempt, with the address of the
+// server it was sent to and the status of the response.
+// Errors reading the response body, and the connection failures held back
+// to retry the attempt, are errors of the span.
+func endAttemptSpan(span trace.Span, attempt *streamAttempt, stream *streamResponse) {
+	if host, port, err := net.SplitHostPort(attempt.address); err == nil {
+		span.SetAttributes(semconv.NetSockPeerAddrKey.String(host))
+		if port, err := strconv.Atoi(port); err == nil {
+			span.SetAttributes(semconv.NetSockPeerPortKey.Int(port))
+		}
+	}
+	status, err := stream.status, attempt.err
+	var statusErr *retryableStatusError
+	if errors.As(attempt.heldErr, &statusErr) {
+		status = statusErr.status
+	} else if err == nil {
+		err = attempt.heldErr
+	}
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		span.SetStatus(httpconv.ClientStatus(status))
+	}
+	tracing.End(span, err)
+}
+
+// serveAttempt serves the request with the proxy handler, returning whether
+// the handler aborted the response
+func (h *httpUpstreamProxy) serveAttempt(rw http.ResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			aborted = true
+		}
+	}()
+	h.handler.ServeHTTP(rw, req)
+	return false
+}
+
+// recordStreamError logs the upstream response body failure and counts it
+// in the stream error metric
+func (h *httpUpstreamProxy) recordStreamError(req *http.Request, stream *streamResponse, class, outcome string, err error) {
+	logger.Errorf("upstream response failed: upstream=%q path=%q status=%d bytes=%d class=%s outcome=%s error=%v",
+		h.upstream,
+		req.URL.Path,
+		stream.status,
+		stream.written,
+		class,
+		outcome,
+		err,
+	)
+	if h.streamMetrics != nil {
+		h.streamMetrics.errors.WithLabelValues(h.upstream, class, outcome).Inc()
+	}
+}
+
+// isReplayable returns whether the request can be sent to the upstream again:
+// it must be safe to repeat and have no body.
+func isReplayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.ContentLength == 0
+	default:
+		return false
+	}
+}
+
+// classifyStreamError returns the class of an error reading an upstream
+// response body
+func classifyStreamError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return streamErrorTimeout
+	case errors.Is(err, syscall.ECONNRESET):
+		return streamErrorReset
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return streamErrorUnexpectedEOF
+	default:
+		return streamErrorOther
+	}
+}
+
+// streamResponse is a custom http.ResponseWriter that holds back the
+// response headers until the first byte of the body is written or the
+// response is flushed, so that an attempt that fails before then can be
+// discarded.
+type streamResponse struct {
+	responsewriter.Wrapper
+
+	header    http.Header
+	status    int
+	committed bool
+	written   int
+}
+
+// newStreamResponse creates a streamResponse starting with the headers
+// already set on the response writer
+func newStreamResponse(rw http.ResponseWriter) *streamResponse {
+	return &streamResponse{
+		Wrapper: responsewriter.Wrapper{ResponseWriter: rw},
+		header:  rw.Header().Clone(),
+	}
+}
+
+// Header returns the headers held back, or those of the response writer once
+// the response has been sent
+func (s *streamResponse) Header() http.Header {
+	if s.committed {
+		return s.ResponseWriter.Header()
+	}
+	return s.header
+}
+
+// WriteHeader records the status code until the response is sent.
+// Informational responses are sent to the client straight away.
+func (s *streamResponse) WriteHeader(code int) {
+	switch {
+	case s.committed:
+		s.ResponseWriter.WriteHeader(code)
+	case code >= 100 && code < 200 && code != http.StatusSwitchingProtocols:
+		header := s.ResponseWriter.Header()
+		for name, values := range s.header {
+			header[name] = values
+		}
+		s.ResponseWriter.WriteHeader(code)
+		for name := range s.header {
+			delete(header, name)
+		}
+	case s.status == 0:
+		s.status = code
+	}
+}
+
+// Write sends the response before writing the body using the ResponseWriter
+func (s *streamResponse) Write(b []byte) (int, error) {
+	s.commit()
+	n, err := s.ResponseWriter.Write(b)
+	s.written += n
+	return n, err
+}
+
+// Flush sends the response and any buffered data to the client. Implements
+// the `http.Flusher` interface
+func (s *streamResponse) Flush() {
+	s.commit()
+	s.Wrapper.Flush()
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (s *streamResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.committed = true
+	return s.Wrapper.Hijack()
+}
+
+// finish sends the response if the handler completed without writing a body
+func (s *streamResponse) finish() {
+	if s.status != 0 {
+		s.commit()
+	}
+}
+
+// commit replaces the headers of the response writer with those held back
+// and writes the status, the first time it is called
+func (s *streamResponse) commit() {
+	if s.committed {
+		return
+	}
+	s.committed = true
+
+	header := s.ResponseWriter.Header()
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range s.header {
+		header[name] = values
+	}
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	s.ResponseWriter.WriteHeader(s.status)
+}
@@ -0,0 +1,329 @@
+package upstream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// halfBodyResponse sends half of its Content-Length
+	halfBodyResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 10\r\n\r\nhello"
+	// halfChunkedResponse is missing its terminal chunk
+	halfChunkedResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"
+	// headersOnlyResponse sends none of its Content-Length
+	headersOnlyResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 10\r\n\r\n"
+)
+
+var _ = Describe("Upstream Stream Suite", func() {
+	flushImmediately := options.Duration(-1)
+
+	var upstreamServer *httptest.Server
+	var proxyServer *httptest.Server
+	var metrics *streamMetrics
+	var logs *bytes.Buffer
+	// scopes receives the request scopes once the requests are served
+	var scopes chan *middlewareapi.RequestScope
+	// traceparents receives the traceparent headers of the requests received
+	// by the upstream
+	var traceparents chan string
+
+	// failedResponse is written by the upstream before it closes the
+	// connection, for the first failures requests
+	var failedResponse string
+	var failures int32
+	var requests int32
+
+	BeforeEach(func() {
+		failures = 1
+		atomic.StoreInt32(&requests, 0)
+		traceparents = make(chan string, 2)
+		upstreamServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case traceparents <- req.Header.Get("traceparent"):
+			default:
+			}
+			if atomic.AddInt32(&requests, 1) > failures {
+				rw.Header().Set(contentType, "text/plain")
+				rw.Write([]byte("helloworld"))
+				return
+			}
+			conn, _, err := rw.(http.Hijacker).Hijack()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte(failedResponse))
+			Expect(err).ToNot(HaveOccurred())
+		}))
+
+		metrics = newStreamMetrics(prometheus.NewRegistry())
+		scopes = make(chan *middlewareapi.RequestScope, 1)
+		logs = &bytes.Buffer{}
+		logger.SetErrOutput(logs)
+	})
+
+	AfterEach(func() {
+		logger.SetErrOutput(GinkgoWriter)
+		proxyServer.Close()
+		upstreamServer.Close()
+	})
+
+	// newProxyServer serves a proxy to the upstream server
+	newProxyServer := func(upstream options.Upstream, http2 bool) *httptest.Server {
+		u, err := url.Parse(upstreamServer.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		errorHandler := func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte("upstream failed: " + err.Error()))
+		}
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, errorHandler, nil, metrics, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scope := &middlewareapi.RequestScope{}
+			defer func() { scopes <- scope }()
+			handler.ServeHTTP(rw, middlewareapi.AddRequestScope(req, scope))
+		}))
+		if http2 {
+			server.EnableHTTP2 = true
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		return server
+	}
+
+	streamErrors := func(class, outcome string) float64 {
+		return testutil.ToFloat64(metrics.errors.WithLabelValues("app", class, outcome))
+	}
+
+	Context("when the upstream fails after sending part of the body", func() {
+		It("aborts HTTP/1.1 responses with a Content-Length", func() {
+			failedResponse = halfBodyResponse
+			// Flush the part of the body straight away, so the client receives it
+			proxyServer = newProxyServer(options.Upstream{ID: "app", FlushInterval: &flushImmediately}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).To(MatchError("unexpected EOF"))
+			Expect(string(body)).To(Equal("hello"))
+
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeAborted)).To(Equal(1.0))
+			Expect(logs.String()).To(ContainSubstring(`upstream response failed: upstream="app" path="/stream" status=200 bytes=5 class=unexpected_eof outcome=aborted`))
+		})
+
+		It("aborts chunked HTTP/1.1 responses without the terminal chunk", func() {
+			failedResponse = halfChunkedResponse
+			proxyServer = newProxyServer(options.Upstream{ID: "app"}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.TransferEncoding).To(Equal([]string{"chunked"}))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).To(MatchError("unexpected EOF"))
+			Expect(string(body)).To(Equal("hello"))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeAborted)).To(Equal(1.0))
+		})
+
+		It("resets HTTP/2 streams", func() {
+			failedResponse = halfChunkedResponse
+			proxyServer = newProxyServer(options.Upstream{ID: "app"}, true)
+
+			resp, err := proxyServer.Client().Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.ProtoMajor).To(Equal(2))
+
+			_, err = ioutil.ReadAll(resp.Body)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("stream error"))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeAborted)).To(Equal(1.0))
+		})
+
+		It("doesn't retry the request", func() {
+			failedResponse = halfBodyResponse
+			proxyServer = newProxyServer(options.Upstream{ID: "app", FlushInterval: &flushImmediately, RetryStreamErrors: true}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			_, err = ioutil.ReadAll(resp.Body)
+			Expect(err).To(MatchError("unexpected EOF"))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+	})
+
+	Context("when the upstream fails before sending any of the body", func() {
+		BeforeEach(func() {
+			failedResponse = headersOnlyResponse
+		})
+
+		It("renders the error", func() {
+			proxyServer = newProxyServer(options.Upstream{ID: "app"}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("upstream failed: unexpected EOF"))
+			Expect(resp.Header.Get(contentLength)).To(Equal("31"))
+
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeErrorPage)).To(Equal(1.0))
+			Expect(logs.String()).To(ContainSubstring("bytes=0 class=unexpected_eof outcome=error_page"))
+		})
+
+		It("retries the request when the upstream allows it", func() {
+			proxyServer = newProxyServer(options.Upstream{ID: "app", RetryStreamErrors: true}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("helloworld"))
+
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeRetried)).To(Equal(1.0))
+
+			scope := <-scopes
+			Expect(scope.UpstreamRetries).To(Equal(1))
+			Expect(scope.UpstreamAddress).To(Equal(upstreamServer.Listener.Addr().String()))
+		})
+
+		It("traces each attempt in a client span propagated to the upstream", func() {
+			recorder := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+			proxyServer = newProxyServer(options.Upstream{ID: "app", RetryStreamErrors: true}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			<-scopes
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(2))
+			for i, span := range spans {
+				Expect(span.Name()).To(Equal("HTTP GET"))
+				Expect(span.SpanKind()).To(Equal(trace.SpanKindClient))
+				Expect(span.Attributes()).To(ContainElement(tracing.UpstreamKey.String("app")))
+				Expect(span.Attributes()).To(ContainElement(semconv.HTTPStatusCodeKey.Int(http.StatusOK)))
+				sc := span.SpanContext()
+				Expect(<-traceparents).To(Equal(fmt.Sprintf("00-%s-%s-01", sc.TraceID(), sc.SpanID())), "attempt %d", i)
+			}
+			Expect(spans[0].Status().Code).To(Equal(codes.Error))
+			Expect(spans[0].Status().Description).To(Equal("unexpected EOF"))
+			Expect(spans[1].Status().Code).To(Equal(codes.Unset))
+			Expect(spans[1].Attributes()).To(ContainElement(semconv.HTTPResendCountKey.Int(1)))
+		})
+
+		It("retries the request only once", func() {
+			failures = 2
+			proxyServer = newProxyServer(options.Upstream{ID: "app", RetryStreamErrors: true}, false)
+
+			resp, err := http.Get(proxyServer.URL + "/stream")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeRetried)).To(Equal(1.0))
+			Expect(streamErrors(streamErrorUnexpectedEOF, streamOutcomeErrorPage)).To(Equal(1.0))
+		})
+
+		It("doesn't retry requests with a body", func() {
+			proxyServer = newProxyServer(options.Upstream{ID: "app", RetryStreamErrors: true}, false)
+
+			resp, err := http.Post(proxyServer.URL+"/stream", "text/plain", strings.NewReader("body"))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+	})
+
+	It("doesn't change responses that complete", func() {
+		failures = 0
+		proxyServer = newProxyServer(options.Upstream{ID: "app"}, false)
+
+		resp, err := http.Get(proxyServer.URL + "/stream")
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get(contentType)).To(Equal("text/plain"))
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal("helloworld"))
+		Expect(logs.String()).To(BeEmpty())
+
+		By("recording the upstream server details in the request scope")
+		scope := <-scopes
+		Expect(scope.UpstreamAddress).To(Equal(upstreamServer.Listener.Addr().String()))
+		Expect(scope.UpstreamDuration).To(BeNumerically(">", 0))
+		Expect(scope.UpstreamRetries).To(BeZero())
+	})
+})
+
+var _ = Describe("streamResponse", func() {
+	It("holds back the response until the body is written", func() {
+		rw := httptest.NewRecorder()
+		rw.Header().Set("X-Existing", "true")
+
+		stream := newStreamResponse(rw)
+		stream.Header().Set(contentType, textPlainUTF8)
+		stream.WriteHeader(http.StatusAccepted)
+		Expect(rw.Header()).To(Equal(http.Header{"X-Existing": {"true"}}))
+		Expect(stream.committed).To(BeFalse())
+
+		_, err := stream.Write([]byte("body"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rw.Code).To(Equal(http.StatusAccepted))
+		Expect(rw.Header()).To(Equal(http.Header{"X-Existing": {"true"}, contentType: {textPlainUTF8}}))
+		Expect(stream.written).To(Equal(4))
+	})
+
+	It("sends responses without a body when finished", func() {
+		rw := httptest.NewRecorder()
+		stream := newStreamResponse(rw)
+		stream.Header().Set("X-Upstream", "true")
+		stream.WriteHeader(http.StatusNoContent)
+		stream.finish()
+
+		Expect(rw.Code).To(Equal(http.StatusNoContent))
+		Expect(rw.Header().Get("X-Upstream")).To(Equal("true"))
+	})
+})
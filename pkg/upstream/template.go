@@ -0,0 +1,398 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/mbland/hmacauth"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
+)
+
+const (
+	// templatedUpstreamDNSCacheTTL is how long the addresses of templated
+	// upstream hosts are cached for
+	templatedUpstreamDNSCacheTTL = time.Minute
+
+	// templateClaimsField is the field of the template data holding claims
+	templateClaimsField = "Claims"
+)
+
+// claimValueRegex matches claim values that are safe to substitute into a
+// host, so that a claim can never point a request at an arbitrary server
+var claimValueRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type targetContextKey struct{}
+
+// isTemplatedURI checks whether the upstream URI is templated with claims
+func isTemplatedURI(uri string) bool {
+	return strings.Contains(uri, "{{")
+}
+
+// newTemplatedUpstreamProxy creates a new templatedUpstreamProxy, which selects
+// the upstream host per request by substituting claims from the session into
+// the upstream URI.
+func newTemplatedUpstreamProxy(upstream options.Upstream, sigData *options.SignatureData, writer pagewriter.Writer) (http.Handler, error) {
+	tmpl, claims, err := parseURITemplate(upstream.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := newUpstreamCredentials(upstream)
+	if err != nil {
+		return nil, err
+	}
+	clientTLS, err := newUpstreamClientTLS(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	var pattern *regexp.Regexp
+	if upstream.AllowedClaimPattern != "" {
+		pattern, err = regexp.Compile("^(?:" + upstream.AllowedClaimPattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed claim pattern %q: %v", upstream.AllowedClaimPattern, err)
+		}
+	}
+	if pattern == nil && len(upstream.AllowedClaimValues) == 0 {
+		return nil, fmt.Errorf("templated uri %q requires allowed claim values or an allowed claim pattern", upstream.URI)
+	}
+
+	allowed := make(map[string]struct{}, len(upstream.AllowedClaimValues))
+	for _, value := range upstream.AllowedClaimValues {
+		allowed[value] = struct{}{}
+	}
+
+	resolver := &cachingResolver{
+		ttl:     templatedUpstreamDNSCacheTTL,
+		lookup:  net.DefaultResolver.LookupHost,
+		dialer:  newUpstreamDialer(upstream),
+		entries: make(map[string]resolverEntry),
+	}
+
+	// The target is only known per request, so the director takes it from the
+	// request context rather than from the proxy
+	proxy := newReverseProxy(&url.URL{}, upstream, writer.ProxyErrorHandler)
+	proxy.Transport.(*http.Transport).DialContext = resolver.dialContext
+	passHostHeader := upstream.PassHostHeader == nil || *upstream.PassHostHeader
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		target := req.Context().Value(targetContextKey{}).(*url.URL)
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		if !passHostHeader {
+			req.Host = target.Host
+		}
+	}
+	setProxyCredentials(proxy, credentials)
+	clientTLS.configure(proxy.Transport.(*http.Transport))
+
+	var auth hmacauth.HmacAuth
+	if sigData != nil {
+		auth = hmacauth.NewHmacAuth(sigData.Hash, []byte(sigData.Key), SignatureHeader, SignatureHeaders)
+	}
+
+	return &templatedUpstreamProxy{
+		upstream:    upstream.ID,
+		template:    tmpl,
+		claims:      claims,
+		allowed:     allowed,
+		pattern:     pattern,
+		handler:     proxy,
+		resolver:    resolver,
+		auth:        auth,
+		pathRewrite: newUpstreamPathRewrite(upstream),
+		writer:      writer,
+	}, nil
+}
+
+// TemplatedURIClaims returns the names of the claims used by a templated
+// upstream URI.
+// It returns no claims if the URI isn't templated or is invalid.
+func TemplatedURIClaims(uri string) []string {
+	if !isTemplatedURI(uri) {
+		return nil
+	}
+	_, claims, err := parseURITemplate(uri)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// ValidateTemplatedURI checks that the templated upstream URI only substitutes
+// claims into the host of an HTTP(S) URI
+func ValidateTemplatedURI(uri string) error {
+	_, _, err := parseURITemplate(uri)
+	return err
+}
+
+// parseURITemplate parses the templated URI and returns the names of the
+// claims it uses.
+// Templates may only substitute claims, in the form `{{ .Claims.name }}`, into
+// the host of an HTTP(S) URI. As with other HTTP(S) upstreams, requests are
+// proxied with their own path, so the URI may not have a path.
+func parseURITemplate(uri string) (*template.Template, []string, error) {
+	scheme := strings.SplitN(uri, "://", 2)[0]
+	if scheme != httpScheme && scheme != httpsScheme {
+		return nil, nil, fmt.Errorf("templated uri %q must have an http or https scheme", uri)
+	}
+
+	tmpl, err := template.New("uri").Option("missingkey=error").Parse(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid templated uri %q: %v", uri, err)
+	}
+
+	var claims []string
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			continue
+		case *parse.ActionNode:
+			claim, ok := claimFromAction(n)
+			if !ok {
+				return nil, nil, fmt.Errorf("templated uri %q may only use claims, in the form {{ .Claims.name }}, but has %s", uri, n)
+			}
+			claims = append(claims, claim)
+		default:
+			return nil, nil, fmt.Errorf("templated uri %q may only use claims, in the form {{ .Claims.name }}, but has %s", uri, n)
+		}
+	}
+
+	// The claim actions have no separators, so the host ends at the first one
+	authority := strings.SplitN(uri, "://", 2)[1]
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		if authority[i:] != "/" {
+			return nil, nil, fmt.Errorf("templated uri %q may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream", uri)
+		}
+		authority = authority[:i]
+	}
+	if strings.Contains(authority, "@") {
+		return nil, nil, fmt.Errorf("templated uri %q may only substitute claims into the host, and can't have user info", uri)
+	}
+	return tmpl, claims, nil
+}
+
+// claimFromAction returns the claim name from a `{{ .Claims.name }}` action
+func claimFromAction(action *parse.ActionNode) (string, bool) {
+	if len(action.Pipe.Decl) != 0 || len(action.Pipe.Cmds) != 1 || len(action.Pipe.Cmds[0].Args) != 1 {
+		return "", false
+	}
+	field, ok := action.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 2 || field.Ident[0] != templateClaimsField {
+		return "", false
+	}
+	return field.Ident[1], true
+}
+
+// templatedUpstreamProxy represents an HTTP(S) upstream proxy whose host is
+// selected per request from the user's claims
+type templatedUpstreamProxy struct {
+	upstream    string
+	template    *template.Template
+	claims      []string
+	allowed     map[string]struct{}
+	pattern     *regexp.Regexp
+	handler     http.Handler
+	resolver    *cachingResolver
+	auth        hmacauth.HmacAuth
+	pathRewrite upstreamPathRewrite
+	writer      pagewriter.Writer
+}
+
+// ServeHTTP resolves the upstream for the request and proxies the request to it.
+// Requests without allowed values for all claims in the URI are forbidden.
+func (t *templatedUpstreamProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope.Upstream = t.upstream
+
+	target, err := t.resolveTarget(req.Context(), scope.Session)
+	if err != nil {
+		logger.Errorf("Error resolving upstream %q: %v", t.upstream, err)
+		t.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+			Status:    http.StatusForbidden,
+			RequestID: scope.RequestID,
+			AppError:  err.Error(),
+			Accept:    req.Header.Get("Accept"),
+		})
+		return
+	}
+	scope.Upstream = fmt.Sprintf("%s/%s", t.upstream, target.Host)
+
+	if err := t.pathRewrite.rewrite(req); err != nil {
+		t.writer.ProxyErrorHandler(rw, req, err)
+		return
+	}
+
+	// TODO (@NickMeves) - Deprecate GAP-Signature & remove GAP-Auth
+	if t.auth != nil {
+		req.Header.Set("GAP-Auth", rw.Header().Get("GAP-Auth"))
+		t.auth.SignRequest(req)
+	}
+
+	ctx := context.WithValue(req.Context(), targetContextKey{}, target)
+	t.handler.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+// resolveTarget renders the URI with the claims from the session
+func (t *templatedUpstreamProxy) resolveTarget(ctx context.Context, session *sessions.SessionState) (*url.URL, error) {
+	if session == nil {
+		return nil, fmt.Errorf("no session to take claims from")
+	}
+
+	extractor, err := util.NewSessionClaimExtractor(ctx, session)
+	if err != nil {
+		return nil, fmt.Errorf("could not read claims from session: %v", err)
+	}
+
+	claims := make(map[string]string, len(t.claims))
+	for _, claim := range t.claims {
+		value, err := getSessionClaim(extractor, session, claim)
+		if err != nil {
+			return nil, err
+		}
+		if !t.isAllowed(value) {
+			return nil, fmt.Errorf("claim %q has value %q, which is not allowed", claim, value)
+		}
+		claims[claim] = value
+	}
+
+	var uri bytes.Buffer
+	if err := t.template.Execute(&uri, map[string]interface{}{templateClaimsField: claims}); err != nil {
+		return nil, fmt.Errorf("could not render uri: %v", err)
+	}
+	target, err := url.Parse(uri.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rendered uri %q: %v", uri.String(), err)
+	}
+	if target.Host == "" || target.User != nil {
+		return nil, fmt.Errorf("rendered uri %q is not a valid upstream", uri.String())
+	}
+	return target, nil
+}
+
+// getSessionClaim gets a single string claim from the claims stored in the
+// session or its ID token, falling back to the fields of the session itself
+func getSessionClaim(extractor util.ClaimExtractor, session *sessions.SessionState, claim string) (string, error) {
+	if extractor != nil {
+		var value string
+		exists, err := extractor.GetClaimInto(claim, &value)
+		if err != nil {
+			return "", fmt.Errorf("could not get claim %q: %v", claim, err)
+		}
+		if exists {
+			return value, nil
+		}
+	}
+
+	values := session.GetClaim(claim)
+	if len(values) != 1 || values[0] == "" {
+		return "", fmt.Errorf("session has no single value for claim %q", claim)
+	}
+	return values[0], nil
+}
+
+// isAllowed checks the claim value is safe to use in a host, and is either an
+// allowed value or matches the allowed pattern
+func (t *templatedUpstreamProxy) isAllowed(value string) bool {
+	if !claimValueRegex.MatchString(value) {
+		return false
+	}
+	if _, ok := t.allowed[value]; ok {
+		return true
+	}
+	return t.pattern != nil && t.pattern.MatchString(value)
+}
+
+// cachingResolver dials upstream hosts using cached DNS results, so that hosts
+// selected per request aren't looked up on every new connection
+type cachingResolver struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dialer *net.Dialer
+	clock  clock.Clock
+
+	mutex   sync.Mutex
+	entries map[string]resolverEntry
+}
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dialContext dials the address after resolving its host through the cache
+func (r *cachingResolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := r.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = r.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve returns the cached addresses of the host, looking them up again once
+// they have expired
+func (r *cachingResolver) resolve(ctx context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	entry, ok := r.entries[host]
+	r.mutex.Unlock()
+	if ok && r.clock.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Drop expired entries so that the cache doesn't grow with old hosts
+	now := r.clock.Now()
+	for h, entry := range r.entries {
+		if !now.Before(entry.expires) {
+			delete(r.entries, h)
+		}
+	}
+	r.entries[host] = resolverEntry{addrs: addrs, expires: now.Add(r.ttl)}
+	return addrs, nil
+}
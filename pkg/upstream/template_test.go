@@ -0,0 +1,231 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Templated Upstream Suite", func() {
+	// newIDToken creates an unsigned ID token, sessions have already been
+	// verified by the time they reach the upstream
+	newIDToken := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		Expect(err).ToNot(HaveOccurred())
+		return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+	}
+
+	Context("templatedUpstreamProxy", func() {
+		type templatedUpstreamTableInput struct {
+			session          *sessionsapi.SessionState
+			expectedCode     int
+			expectedUpstream string
+			expectedLookups  []string
+		}
+
+		DescribeTable("ServeHTTP",
+			func(in *templatedUpstreamTableInput) {
+				_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+				Expect(err).ToNot(HaveOccurred())
+
+				writer := &pagewriter.WriterFuncs{
+					ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+						rw.WriteHeader(opts.Status)
+					},
+				}
+				handler, err := newTemplatedUpstreamProxy(options.Upstream{
+					ID:                  "tenants",
+					Path:                "/",
+					URI:                 "http://{{ .Claims.tenant }}.svc.cluster.local:" + port,
+					AllowedClaimValues:  []string{"tenant-a"},
+					AllowedClaimPattern: "team-[0-9]+",
+				}, nil, writer)
+				Expect(err).ToNot(HaveOccurred())
+
+				// Resolve all tenant hosts to the test server
+				lookups := []string{}
+				handler.(*templatedUpstreamProxy).resolver.lookup = func(_ context.Context, host string) ([]string, error) {
+					lookups = append(lookups, host)
+					return []string{"127.0.0.1"}, nil
+				}
+
+				// Make two requests to check the DNS results are cached
+				for i := 0; i < 2; i++ {
+					req := httptest.NewRequest("", "/foo", nil)
+					scope := &middlewareapi.RequestScope{Session: in.session}
+					req = middlewareapi.AddRequestScope(req, scope)
+					rw := httptest.NewRecorder()
+					handler.ServeHTTP(rw, req)
+
+					Expect(rw.Code).To(Equal(in.expectedCode))
+					if in.expectedCode == http.StatusOK {
+						// The resolved upstream includes the port of the test server
+						Expect(scope.Upstream).To(Equal(in.expectedUpstream + port))
+						request := testHTTPRequest{}
+						Expect(json.Unmarshal(rw.Body.Bytes(), &request)).To(Succeed())
+						Expect(request.RequestURI).To(Equal("/foo"))
+					} else {
+						Expect(scope.Upstream).To(Equal(in.expectedUpstream))
+					}
+				}
+				Expect(lookups).To(Equal(in.expectedLookups))
+			},
+			Entry("with an allowed claim value", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"tenant": "tenant-a"})},
+				expectedCode:     http.StatusOK,
+				expectedUpstream: "tenants/tenant-a.svc.cluster.local:",
+				expectedLookups:  []string{"tenant-a.svc.cluster.local"},
+			}),
+			Entry("with a claim value matching the pattern", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"tenant": "team-42"})},
+				expectedCode:     http.StatusOK,
+				expectedUpstream: "tenants/team-42.svc.cluster.local:",
+				expectedLookups:  []string{"team-42.svc.cluster.local"},
+			}),
+			Entry("with a claim value that isn't allowed", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"tenant": "tenant-b"})},
+				expectedCode:     http.StatusForbidden,
+				expectedUpstream: "tenants",
+				expectedLookups:  []string{},
+			}),
+			Entry("with a claim value pointing at another host", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"tenant": "team-1.attacker.example.com:80/"})},
+				expectedCode:     http.StatusForbidden,
+				expectedUpstream: "tenants",
+				expectedLookups:  []string{},
+			}),
+			Entry("with a non-string claim value", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"tenant": []string{"tenant-a", "team-1"}})},
+				expectedCode:     http.StatusForbidden,
+				expectedUpstream: "tenants",
+				expectedLookups:  []string{},
+			}),
+			Entry("without the claim", &templatedUpstreamTableInput{
+				session:          &sessionsapi.SessionState{IDToken: newIDToken(map[string]interface{}{"sub": "123"})},
+				expectedCode:     http.StatusForbidden,
+				expectedUpstream: "tenants",
+				expectedLookups:  []string{},
+			}),
+			Entry("without a session", &templatedUpstreamTableInput{
+				session:          nil,
+				expectedCode:     http.StatusForbidden,
+				expectedUpstream: "tenants",
+				expectedLookups:  []string{},
+			}),
+		)
+	})
+
+	Context("parseURITemplate", func() {
+		type parseURITemplateTableInput struct {
+			uri            string
+			expectedClaims []string
+			expectedErr    string
+		}
+
+		DescribeTable("with a templated uri",
+			func(in *parseURITemplateTableInput) {
+				_, claims, err := parseURITemplate(in.uri)
+				if in.expectedErr != "" {
+					Expect(err).To(MatchError(in.expectedErr))
+					return
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(claims).To(Equal(in.expectedClaims))
+			},
+			Entry("with a single claim", &parseURITemplateTableInput{
+				uri:            "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+				expectedClaims: []string{"tenant"},
+			}),
+			Entry("with multiple claims", &parseURITemplateTableInput{
+				uri:            "https://{{ .Claims.tenant }}.{{ .Claims.region }}.example.com",
+				expectedClaims: []string{"tenant", "region"},
+			}),
+			Entry("with a file scheme", &parseURITemplateTableInput{
+				uri:         "file:///var/lib/{{ .Claims.tenant }}",
+				expectedErr: "templated uri \"file:///var/lib/{{ .Claims.tenant }}\" must have an http or https scheme",
+			}),
+			Entry("with a templated scheme", &parseURITemplateTableInput{
+				uri:         "{{ .Claims.scheme }}://example.com",
+				expectedErr: "templated uri \"{{ .Claims.scheme }}://example.com\" must have an http or https scheme",
+			}),
+			Entry("with a function", &parseURITemplateTableInput{
+				uri:         "http://{{ .Claims.tenant | printf \"%s.evil\" }}.svc",
+				expectedErr: "templated uri \"http://{{ .Claims.tenant | printf \\\"%s.evil\\\" }}.svc\" may only use claims, in the form {{ .Claims.name }}, but has {{.Claims.tenant | printf \"%s.evil\"}}",
+			}),
+			Entry("with a conditional", &parseURITemplateTableInput{
+				uri:         "http://{{ if .Claims.tenant }}a{{ end }}.svc",
+				expectedErr: "templated uri \"http://{{ if .Claims.tenant }}a{{ end }}.svc\" may only use claims, in the form {{ .Claims.name }}, but has {{if .Claims.tenant}}a{{end}}",
+			}),
+			Entry("with a trailing slash", &parseURITemplateTableInput{
+				uri:            "https://{{ .Claims.tenant }}.example.com/",
+				expectedClaims: []string{"tenant"},
+			}),
+			Entry("with a path", &parseURITemplateTableInput{
+				uri:         "http://{{ .Claims.tenant }}.svc:8080/api",
+				expectedErr: "templated uri \"http://{{ .Claims.tenant }}.svc:8080/api\" may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream",
+			}),
+			Entry("with a templated path", &parseURITemplateTableInput{
+				uri:         "http://tenants.svc/{{ .Claims.tenant }}",
+				expectedErr: "templated uri \"http://tenants.svc/{{ .Claims.tenant }}\" may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream",
+			}),
+			Entry("with a templated query", &parseURITemplateTableInput{
+				uri:         "http://tenants.svc?tenant={{ .Claims.tenant }}",
+				expectedErr: "templated uri \"http://tenants.svc?tenant={{ .Claims.tenant }}\" may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream",
+			}),
+			Entry("with templated user info", &parseURITemplateTableInput{
+				uri:         "http://{{ .Claims.user }}@tenants.svc",
+				expectedErr: "templated uri \"http://{{ .Claims.user }}@tenants.svc\" may only substitute claims into the host, and can't have user info",
+			}),
+			Entry("with a field other than claims", &parseURITemplateTableInput{
+				uri:         "http://{{ .Host }}.svc",
+				expectedErr: "templated uri \"http://{{ .Host }}.svc\" may only use claims, in the form {{ .Claims.name }}, but has {{.Host}}",
+			}),
+		)
+	})
+
+	Context("cachingResolver", func() {
+		It("looks up hosts again once their results expire", func() {
+			lookups := 0
+			resolver := &cachingResolver{
+				ttl: time.Minute,
+				lookup: func(_ context.Context, host string) ([]string, error) {
+					lookups++
+					if host == "missing.svc.cluster.local" {
+						return nil, errors.New("no such host")
+					}
+					return []string{"10.0.0.1"}, nil
+				},
+				entries: make(map[string]resolverEntry),
+			}
+			resolver.clock.Set(time.Unix(1650000000, 0))
+
+			Expect(resolver.resolve(context.Background(), "tenant-a.svc.cluster.local")).To(Equal([]string{"10.0.0.1"}))
+			Expect(resolver.resolve(context.Background(), "tenant-a.svc.cluster.local")).To(Equal([]string{"10.0.0.1"}))
+			Expect(lookups).To(Equal(1))
+
+			Expect(resolver.clock.Add(time.Minute)).To(Succeed())
+			Expect(resolver.resolve(context.Background(), "tenant-a.svc.cluster.local")).To(Equal([]string{"10.0.0.1"}))
+			Expect(lookups).To(Equal(2))
+
+			// Failed lookups aren't cached
+			_, err := resolver.resolve(context.Background(), "missing.svc.cluster.local")
+			Expect(err).To(MatchError("no such host"))
+			_, err = resolver.resolve(context.Background(), "missing.svc.cluster.local")
+			Expect(err).To(MatchError("no such host"))
+			Expect(lookups).To(Equal(4))
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/responsewriter"
+)
+
+// newUpstreamTiming wraps the handler to record the time to first byte and
+// the total duration of requests to the upstream, along with the requests in
+// progress and the status classes of their responses.
+// Requests slower than the slow request threshold, and a sample of the
+// others, are logged.
+func newUpstreamTiming(upstream string, handler http.Handler, slowRequests options.SlowRequestLog, metrics *timingMetrics) http.Handler {
+	return &upstreamTiming{
+		upstream:     upstream,
+		handler:      handler,
+		slowRequests: slowRequests,
+		metrics:      metrics,
+	}
+}
+
+// upstreamTiming measures the requests served by an upstream handler
+type upstreamTiming struct {
+	upstream     string
+	handler      http.Handler
+	slowRequests options.SlowRequestLog
+	metrics      *timingMetrics
+}
+
+// ServeHTTP serves the request, recording how long the upstream took to
+// start and to complete the response.
+func (u *upstreamTiming) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	path := req.URL.Path
+
+	active := u.metrics.active.WithLabelValues(u.upstream)
+	active.Inc()
+	defer active.Dec()
+
+	timingRW := &timingResponse{Wrapper: responsewriter.Wrapper{ResponseWriter: rw}, start: start}
+	u.handler.ServeHTTP(timingRW, req)
+	duration := time.Since(start)
+
+	u.metrics.requests.WithLabelValues(u.upstream, statusClass(timingRW.status)).Inc()
+	u.metrics.duration.WithLabelValues(u.upstream).Observe(duration.Seconds())
+	if timingRW.firstByte > 0 {
+		u.metrics.timeToFirstByte.WithLabelValues(u.upstream).Observe(timingRW.firstByte.Seconds())
+	}
+
+	// A zero threshold disables slow request logging
+	if u.slowRequests.Threshold <= 0 {
+		return
+	}
+	slow := duration >= u.slowRequests.Threshold
+	if !slow && !u.sampled() {
+		return
+	}
+
+	logger.Printf("upstream request: upstream=%q path=%q duration=%s ttfb=%s status=%d bytes=%d slow=%t",
+		u.upstream,
+		truncatePath(path, u.slowRequests.MaxPathLength),
+		duration,
+		timingRW.firstByte,
+		timingRW.status,
+		timingRW.size,
+		slow,
+	)
+}
+
+// sampled picks whether to log a request below the slow request threshold
+func (u *upstreamTiming) sampled() bool {
+	if u.slowRequests.SampleRate <= 0 {
+		return false
+	}
+	// Sampling doesn't need a secure source of randomness
+	/* #nosec G404 */
+	return rand.Float64() < u.slowRequests.SampleRate
+}
+
+// statusClass returns the class of the response status, eg. `2xx`.
+// Responses that were never written are sent with a 200 status.
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// truncatePath shortens the path to the maximum length, if there is one
+func truncatePath(path string, maxLength int) string {
+	if maxLength <= 0 || len(path) <= maxLength {
+		return path
+	}
+	return path[:maxLength] + "..."
+}
+
+// timingResponse is a custom http.ResponseWriter that records when the
+// response was started, along with the status and size of the response.
+type timingResponse struct {
+	responsewriter.Wrapper
+
+	start     time.Time
+	firstByte time.Duration
+	status    int
+	size      int
+}
+
+// started records the time to first byte, and the status if WriteHeader has
+// not been called yet, when the response is first written
+func (r *timingResponse) started(status int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	r.firstByte = time.Since(r.start)
+}
+
+// Write writes the response using the ResponseWriter
+func (r *timingResponse) Write(b []byte) (int, error) {
+	// The status will be StatusOK if WriteHeader has not been called yet
+	r.started(http.StatusOK)
+	size, err := r.ResponseWriter.Write(b)
+	r.size += size
+	return size, err
+}
+
+// WriteHeader writes the status code for the Response
+func (r *timingResponse) WriteHeader(s int) {
+	r.started(s)
+	r.ResponseWriter.WriteHeader(s)
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets.
+// Hijacked connections are recorded with a 101 status, as the response
+// switching their protocol is written to the connection.
+func (r *timingResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := r.Wrapper.Hijack()
+	if err == nil {
+		r.started(http.StatusSwitchingProtocols)
+	}
+	return conn, buf, err
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *timingResponse) Flush() {
+	r.started(http.StatusOK)
+	r.Wrapper.Flush()
+}
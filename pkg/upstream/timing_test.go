@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Upstream Timing Suite", func() {
+	var registry *prometheus.Registry
+	var metrics *timingMetrics
+	var logs *bytes.Buffer
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		metrics = newTimingMetrics(registry)
+		logs = &bytes.Buffer{}
+		logger.SetOutput(logs)
+	})
+
+	AfterEach(func() {
+		logger.SetOutput(GinkgoWriter)
+	})
+
+	// sampleCount returns the number of observations of the named histogram
+	sampleCount := func(name string) uint64 {
+		families, err := registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				return family.GetMetric()[0].GetHistogram().GetSampleCount()
+			}
+		}
+		return 0
+	}
+
+	type timingTableInput struct {
+		slowRequests  options.SlowRequestLog
+		delay         time.Duration
+		path          string
+		expectedLog   string
+		expectedNoLog bool
+	}
+
+	DescribeTable("upstreamTiming ServeHTTP",
+		func(in timingTableInput) {
+			handler := newUpstreamTiming("legacy", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				time.Sleep(in.delay)
+				rw.WriteHeader(http.StatusAccepted)
+				rw.Write([]byte("response"))
+			}), in.slowRequests, metrics)
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("", in.path, nil))
+			Expect(rw.Code).To(Equal(http.StatusAccepted))
+
+			Expect(sampleCount("oauth2_proxy_upstream_request_duration_seconds")).To(Equal(uint64(1)))
+			Expect(sampleCount("oauth2_proxy_upstream_time_to_first_byte_seconds")).To(Equal(uint64(1)))
+
+			if in.expectedNoLog {
+				Expect(logs.String()).To(BeEmpty())
+				return
+			}
+			Expect(logs.String()).To(ContainSubstring(in.expectedLog))
+		},
+		Entry("with slow request logging disabled", timingTableInput{
+			slowRequests:  options.SlowRequestLog{Threshold: 0, SampleRate: 1},
+			delay:         5 * time.Millisecond,
+			path:          "/foo",
+			expectedNoLog: true,
+		}),
+		Entry("with a request below the threshold", timingTableInput{
+			slowRequests:  options.SlowRequestLog{Threshold: time.Minute},
+			path:          "/foo",
+			expectedNoLog: true,
+		}),
+		Entry("with a slow request", timingTableInput{
+			slowRequests: options.SlowRequestLog{Threshold: time.Millisecond},
+			delay:        5 * time.Millisecond,
+			path:         "/foo",
+			expectedLog:  `upstream="legacy" path="/foo" duration=`,
+		}),
+		Entry("with a slow request, logs the status and size", timingTableInput{
+			slowRequests: options.SlowRequestLog{Threshold: time.Millisecond},
+			delay:        5 * time.Millisecond,
+			path:         "/foo",
+			expectedLog:  "status=202 bytes=8 slow=true",
+		}),
+		Entry("with a slow request and a long path", timingTableInput{
+			slowRequests: options.SlowRequestLog{Threshold: time.Millisecond, MaxPathLength: 8},
+			delay:        5 * time.Millisecond,
+			path:         "/foo/bar/baz",
+			expectedLog:  `path="/foo/bar..."`,
+		}),
+		Entry("with a sampled request below the threshold", timingTableInput{
+			slowRequests: options.SlowRequestLog{Threshold: time.Minute, SampleRate: 1},
+			path:         "/foo",
+			expectedLog:  "slow=false",
+		}),
+	)
+
+	It("doesn't record the time to first byte without a response", func() {
+		handler := newUpstreamTiming("legacy", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), options.SlowRequestLog{}, metrics)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+
+		Expect(sampleCount("oauth2_proxy_upstream_request_duration_seconds")).To(Equal(uint64(1)))
+		Expect(sampleCount("oauth2_proxy_upstream_time_to_first_byte_seconds")).To(Equal(uint64(0)))
+	})
+
+	It("records the time to first byte when the response starts", func() {
+		var timingRW *timingResponse
+		handler := newUpstreamTiming("legacy", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			timingRW = rw.(*timingResponse)
+			rw.WriteHeader(http.StatusOK)
+			time.Sleep(10 * time.Millisecond)
+			rw.Write([]byte("response"))
+		}), options.SlowRequestLog{}, metrics)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+
+		Expect(timingRW.firstByte).To(BeNumerically("<", 10*time.Millisecond))
+	})
+
+	It("counts the requests by status class, and the requests in progress", func() {
+		status := http.StatusOK
+		var active float64
+		handler := newUpstreamTiming("legacy", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			active = testutil.ToFloat64(metrics.active.WithLabelValues("legacy"))
+			if status != 0 {
+				rw.WriteHeader(status)
+			}
+		}), options.SlowRequestLog{}, metrics)
+		serve := func(s int) {
+			status = s
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+		}
+
+		serve(http.StatusOK)
+		serve(http.StatusNoContent)
+		serve(0)
+		serve(http.StatusNotFound)
+		serve(http.StatusBadGateway)
+
+		Expect(active).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.active.WithLabelValues("legacy"))).To(Equal(0.0))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("legacy", "2xx"))).To(Equal(3.0))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("legacy", "4xx"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("legacy", "5xx"))).To(Equal(1.0))
+	})
+})
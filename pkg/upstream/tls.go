@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// configureUpstreamTLS sets the name sent to HTTPS upstreams with SNI, and
+// which their certificates are verified against, to the TLSServerName of the
+// upstream, and stops sending SNI when it is disabled.
+// The root CAs and client certificates of the transport are kept.
+func configureUpstreamTLS(transport *http.Transport, upstream options.Upstream) {
+	if upstream.TLSServerName != "" {
+		transport.TLSClientConfig.ServerName = upstream.TLSServerName
+	}
+	if upstream.DisableTLSSNI {
+		transport.DialTLSContext = newDialTLSWithoutSNI(transport)
+	}
+}
+
+// upstreamClientTLS holds the client certificate OAuth2 Proxy presents to an
+// HTTPS upstream, and the CAs the certificate of the upstream server is
+// verified against, or the SPIFFE workload identity replacing them
+type upstreamClientTLS struct {
+	certificate *tls.Certificate
+	rootCAs     *x509.CertPool
+	spiffe      *upstreamSPIFFE
+}
+
+// newUpstreamClientTLS loads the TLSClientCert, TLSClientKey and TLSCA of the
+// upstream, or connects to the Workload API of its SPIFFE options, or returns
+// nil when the upstream has none of them
+func newUpstreamClientTLS(upstream options.Upstream) (*upstreamClientTLS, error) {
+	if upstream.SPIFFE != nil {
+		spiffe, err := newUpstreamSPIFFE(upstream)
+		if err != nil {
+			return nil, err
+		}
+		return &upstreamClientTLS{spiffe: spiffe}, nil
+	}
+	if upstream.TLSClientCert == nil && upstream.TLSClientKey == nil && upstream.TLSCA == nil {
+		return nil, nil
+	}
+
+	clientTLS := &upstreamClientTLS{}
+	if upstream.TLSClientCert != nil || upstream.TLSClientKey != nil {
+		if upstream.TLSClientCert == nil || upstream.TLSClientKey == nil {
+			return nil, errors.New("tlsClientCert and tlsClientKey must be set together")
+		}
+		certData, err := util.GetSecretValue(upstream.TLSClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tlsClientCert: %v", err)
+		}
+		keyData, err := util.GetSecretValue(upstream.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tlsClientKey: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse tlsClientCert: %v", err)
+		}
+		clientTLS.certificate = &cert
+	}
+	if upstream.TLSCA != nil {
+		caData, err := util.GetSecretValue(upstream.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tlsCA: %v", err)
+		}
+		clientTLS.rootCAs = x509.NewCertPool()
+		if !clientTLS.rootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("could not parse tlsCA: no PEM encoded certificates found")
+		}
+	}
+	return clientTLS, nil
+}
+
+// configure sets the client certificate and CAs on the TLS config of the
+// transport. With SPIFFE, the current SVID is presented instead, and the
+// server is verified by its SPIFFE ID rather than by its hostname.
+// The transport is left unchanged when the upstream has no client TLS.
+func (c *upstreamClientTLS) configure(transport *http.Transport) {
+	if c == nil {
+		return
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if c.spiffe != nil {
+		tlsconfig.HookMTLSClientConfig(transport.TLSClientConfig, c.spiffe.source, c.spiffe.source, c.spiffe.authorizer)
+		return
+	}
+	if c.certificate != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*c.certificate}
+	}
+	if c.rootCAs != nil {
+		transport.TLSClientConfig.RootCAs = c.rootCAs
+	}
+}
+
+// newDialTLSWithoutSNI creates a dialer of TLS connections which don't send
+// SNI.
+// crypto/tls only verifies certificates against the name it sends, so the
+// certificate of the server is verified here against the server name of the
+// transport, or the host dialed.
+// The dialer of the transport is looked up for each connection, as the DNS
+// balancer may replace it once the transport is configured.
+func newDialTLSWithoutSNI(transport *http.Transport) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := transport.TLSClientConfig.Clone()
+		serverName := config.ServerName
+		if serverName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			serverName = host
+		}
+		if !config.InsecureSkipVerify {
+			config.VerifyConnection = newServerNameVerifier(config.RootCAs, serverName)
+		}
+		// Without a server name, the built in verification must be skipped,
+		// the certificate is verified by VerifyConnection instead
+		/* #nosec G402 */
+		config.InsecureSkipVerify = true
+		config.ServerName = ""
+
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// newServerNameVerifier creates a verifier of the certificate chain of TLS
+// connections, as crypto/tls verifies it, against the server name
+func newServerNameVerifier(roots *x509.CertPool, serverName string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("tls: the upstream server presented no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			DNSName:       serverName,
+		})
+		return err
+	}
+}
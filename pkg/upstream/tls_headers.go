@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+)
+
+// sslHeaders are the headers describing the client's TLS connection, they
+// are removed from all client requests so that they can't be spoofed
+var sslHeaders = []string{
+	options.TLSHeaderProtocol,
+	options.TLSHeaderCipher,
+	options.TLSHeaderClientCert,
+	options.TLSHeaderClientDN,
+}
+
+// tlsVersionNames are the names of the TLS versions in the X-SSL-Protocol
+// header, in the format used by nginx and haproxy
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// newTLSHeaders wraps the handler so that the client's X-SSL headers are
+// removed from requests, and the upstream's PassTLSHeaders are set from the
+// connection of the request instead.
+func newTLSHeaders(upstream options.Upstream, next http.Handler) http.Handler {
+	var pass []string
+	for _, header := range append([]string{options.TLSHeaderForwardedProto}, sslHeaders...) {
+		for _, name := range upstream.PassTLSHeaders {
+			if strings.EqualFold(name, header) {
+				pass = append(pass, header)
+				break
+			}
+		}
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, header := range sslHeaders {
+			req.Header.Del(header)
+		}
+		for _, header := range pass {
+			if value := tlsHeaderValue(header, req); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// tlsHeaderValue returns the value of the TLS header for the request, or an
+// empty string if it doesn't apply to the request's connection
+func tlsHeaderValue(header string, req *http.Request) string {
+	if header == options.TLSHeaderForwardedProto {
+		return forwardedProto(req)
+	}
+
+	state := req.TLS
+	if state == nil {
+		return ""
+	}
+	switch header {
+	case options.TLSHeaderProtocol:
+		return tlsVersionNames[state.Version]
+	case options.TLSHeaderCipher:
+		return tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch header {
+	case options.TLSHeaderClientCert:
+		var buf bytes.Buffer
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return ""
+		}
+		return url.QueryEscape(buf.String())
+	case options.TLSHeaderClientDN:
+		return cert.Subject.String()
+	}
+	return ""
+}
+
+// forwardedProto returns the scheme the client used to connect: from the
+// X-Forwarded-Proto header when the request came through a trusted reverse
+// proxy, and from the request's own connection otherwise
+func forwardedProto(req *http.Request) string {
+	if proto := req.Header.Get(requestutil.XForwardedProto); proto != "" && requestutil.IsProxied(req) {
+		return proto
+	}
+	if req.TLS != nil {
+		return httpsScheme
+	}
+	return httpScheme
+}
@@ -0,0 +1,179 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS Headers Suite", func() {
+	var clientCert *x509.Certificate
+
+	BeforeEach(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "client.example.com", Organization: []string{"Example"}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		clientCert, err = x509.ParseCertificate(der)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	allHeaders := []string{
+		options.TLSHeaderForwardedProto,
+		options.TLSHeaderProtocol,
+		options.TLSHeaderCipher,
+		options.TLSHeaderClientCert,
+		options.TLSHeaderClientDN,
+	}
+
+	type tlsHeadersTableInput struct {
+		passTLSHeaders  []string
+		reverseProxy    bool
+		requestHeaders  http.Header
+		tlsState        *tls.ConnectionState
+		withClientCert  bool
+		expectedHeaders map[string]string
+	}
+
+	DescribeTable("newTLSHeaders",
+		func(in tlsHeadersTableInput) {
+			var upstreamHeaders http.Header
+			handler := newTLSHeaders(options.Upstream{
+				ID:             "app",
+				PassTLSHeaders: in.passTLSHeaders,
+			}, http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				upstreamHeaders = req.Header
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			// Clients may try to spoof any of the headers
+			req.Header.Set(options.TLSHeaderProtocol, "TLSv1.3")
+			req.Header.Set(options.TLSHeaderCipher, "spoofed")
+			req.Header.Set(options.TLSHeaderClientCert, "spoofed")
+			req.Header.Set(options.TLSHeaderClientDN, "CN=admin")
+			for name, values := range in.requestHeaders {
+				req.Header[name] = values
+			}
+			if in.tlsState != nil {
+				state := *in.tlsState
+				if in.withClientCert {
+					state.PeerCertificates = []*x509.Certificate{clientCert}
+				}
+				req.TLS = &state
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{ReverseProxy: in.reverseProxy})
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			for _, header := range []string{options.TLSHeaderProtocol, options.TLSHeaderCipher, options.TLSHeaderClientCert, options.TLSHeaderClientDN} {
+				if _, ok := in.expectedHeaders[header]; !ok {
+					Expect(upstreamHeaders.Values(header)).To(BeEmpty(), header)
+				}
+			}
+			for header, value := range in.expectedHeaders {
+				if header == options.TLSHeaderClientCert && value != "" {
+					value = url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Raw})))
+				}
+				Expect(upstreamHeaders.Get(header)).To(Equal(value), header)
+			}
+		},
+		Entry("with plain HTTP", tlsHeadersTableInput{
+			passTLSHeaders: allHeaders,
+			requestHeaders: http.Header{
+				"X-Forwarded-Proto": []string{"https"},
+			},
+			expectedHeaders: map[string]string{
+				options.TLSHeaderForwardedProto: "http",
+			},
+		}),
+		Entry("with TLS terminated by a trusted reverse proxy", tlsHeadersTableInput{
+			passTLSHeaders: allHeaders,
+			reverseProxy:   true,
+			requestHeaders: http.Header{
+				"X-Forwarded-Proto": []string{"https"},
+			},
+			expectedHeaders: map[string]string{
+				options.TLSHeaderForwardedProto: "https",
+			},
+		}),
+		Entry("with a reverse proxy that doesn't set X-Forwarded-Proto", tlsHeadersTableInput{
+			passTLSHeaders: allHeaders,
+			reverseProxy:   true,
+			expectedHeaders: map[string]string{
+				options.TLSHeaderForwardedProto: "http",
+			},
+		}),
+		Entry("with direct TLS without a client certificate", tlsHeadersTableInput{
+			passTLSHeaders: allHeaders,
+			tlsState: &tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			},
+			expectedHeaders: map[string]string{
+				options.TLSHeaderForwardedProto: "https",
+				options.TLSHeaderProtocol:       "TLSv1.3",
+				options.TLSHeaderCipher:         "TLS_AES_128_GCM_SHA256",
+			},
+		}),
+		Entry("with direct TLS and a client certificate", tlsHeadersTableInput{
+			passTLSHeaders: allHeaders,
+			tlsState: &tls.ConnectionState{
+				Version:     tls.VersionTLS12,
+				CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			},
+			withClientCert: true,
+			expectedHeaders: map[string]string{
+				options.TLSHeaderForwardedProto: "https",
+				options.TLSHeaderProtocol:       "TLSv1.2",
+				options.TLSHeaderCipher:         "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+				options.TLSHeaderClientCert:     "pem",
+				options.TLSHeaderClientDN:       "CN=client.example.com,O=Example",
+			},
+		}),
+		Entry("with only the allowed headers", tlsHeadersTableInput{
+			passTLSHeaders: []string{"x-ssl-client-dn"},
+			requestHeaders: http.Header{
+				"X-Forwarded-Proto": []string{"https"},
+			},
+			tlsState: &tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			},
+			withClientCert: true,
+			expectedHeaders: map[string]string{
+				// X-Forwarded-Proto is left as the request had it
+				options.TLSHeaderForwardedProto: "https",
+				options.TLSHeaderClientDN:       "CN=client.example.com,O=Example",
+			},
+		}),
+		Entry("with no allowed headers", tlsHeadersTableInput{
+			tlsState: &tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			},
+			withClientCert:  true,
+			expectedHeaders: map[string]string{},
+		}),
+	)
+})
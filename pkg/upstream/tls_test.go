@@ -0,0 +1,271 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream TLS Suite", func() {
+	var server *httptest.Server
+	var roots *x509.CertPool
+	var serverNames []string
+	var mutex sync.Mutex
+
+	BeforeEach(func() {
+		serverNames = []string{}
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				serverNames = append(serverNames, hello.ServerName)
+				return nil, nil
+			},
+		}
+		server.StartTLS()
+
+		roots = x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	type upstreamTLSTableInput struct {
+		// host replaces the 127.0.0.1 host of the server URL, the certificate
+		// of the server is valid for *.example.com and 127.0.0.1
+		host                string
+		upstream            options.Upstream
+		expectedServerName  string
+		expectedErrContains string
+	}
+
+	DescribeTable("configureUpstreamTLS",
+		func(in upstreamTLSTableInput) {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+			if in.upstream.InsecureSkipTLSVerify {
+				transport.TLSClientConfig.InsecureSkipVerify = true
+			}
+			configureUpstreamTLS(transport, in.upstream)
+
+			target := server.URL
+			if in.host != "" {
+				target = strings.Replace(target, "127.0.0.1", in.host, 1)
+			}
+			resp, err := (&http.Client{Transport: transport}).Get(target)
+			if in.expectedErrContains != "" {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(in.expectedErrContains))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Body.Close()).To(Succeed())
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(serverNames).To(ConsistOf(in.expectedServerName))
+		},
+		Entry("verifies the host of the URI without a server name", upstreamTLSTableInput{
+			host:                "localhost",
+			expectedServerName:  "localhost",
+			expectedErrContains: "certificate is valid for",
+		}),
+		Entry("sends and verifies the server name instead of the host", upstreamTLSTableInput{
+			host:               "localhost",
+			upstream:           options.Upstream{TLSServerName: "example.com"},
+			expectedServerName: "example.com",
+		}),
+		Entry("sends and verifies the server name instead of an IP address", upstreamTLSTableInput{
+			upstream:           options.Upstream{TLSServerName: "example.com"},
+			expectedServerName: "example.com",
+		}),
+		Entry("rejects certificates that aren't valid for the server name", upstreamTLSTableInput{
+			upstream:            options.Upstream{TLSServerName: "internal.example.org"},
+			expectedServerName:  "internal.example.org",
+			expectedErrContains: "certificate is valid for",
+		}),
+		Entry("verifies the server name without sending SNI", upstreamTLSTableInput{
+			host:               "localhost",
+			upstream:           options.Upstream{TLSServerName: "example.com", DisableTLSSNI: true},
+			expectedServerName: "",
+		}),
+		Entry("rejects certificates that aren't valid for the server name without sending SNI", upstreamTLSTableInput{
+			upstream:            options.Upstream{TLSServerName: "internal.example.org", DisableTLSSNI: true},
+			expectedServerName:  "",
+			expectedErrContains: "certificate is valid for",
+		}),
+		Entry("verifies the host of the URI without sending SNI", upstreamTLSTableInput{
+			host:                "localhost",
+			upstream:            options.Upstream{DisableTLSSNI: true},
+			expectedServerName:  "",
+			expectedErrContains: "certificate is valid for",
+		}),
+		Entry("skips verification without sending SNI when it is insecure", upstreamTLSTableInput{
+			upstream:           options.Upstream{TLSServerName: "internal.example.org", DisableTLSSNI: true, InsecureSkipTLSVerify: true},
+			expectedServerName: "",
+		}),
+	)
+
+	It("configures the transports of the upstream proxies", func() {
+		upstream := options.Upstream{ID: "app", TLSServerName: "internal.example.org", DisableTLSSNI: true}
+		target, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, proxy := range []*http.Transport{
+			newReverseProxy(target, upstream, nil).Transport.(*http.Transport),
+			newWebSocketReverseProxy(target, upstream).Transport.(*http.Transport),
+		} {
+			Expect(proxy.TLSClientConfig.ServerName).To(Equal("internal.example.org"))
+			Expect(proxy.DialTLSContext).ToNot(BeNil())
+		}
+	})
+})
+
+// issue creates a certificate signed by the CA, or a self signed CA
+// certificate without a parent, and returns it with its PEM encoded
+// certificate and key
+func issue(template *x509.Certificate, parent *tls.Certificate) (*tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return cert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+var _ = Describe("Upstream Client TLS Suite", func() {
+	var server *httptest.Server
+	var caPEM, certPEM, keyPEM []byte
+
+	BeforeEach(func() {
+		ca, caCertPEM, _ := issue(&x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Example CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+		serverCert, _, _ := issue(&x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "app.internal"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca)
+		_, clientCertPEM, clientKeyPEM := issue(&x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "oauth2-proxy"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		caPEM, certPEM, keyPEM = caCertPEM, clientCertPEM, clientKeyPEM
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.Leaf)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{*serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// get proxies a request to the server through the upstream
+	get := func(upstream options.Upstream) *httptest.ResponseRecorder {
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		upstream.ID = "app"
+		errorHandler := func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte(err.Error()))
+		}
+		handler, err := newHTTPUpstreamProxy(upstream, u, nil, errorHandler, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := middlewareapi.AddRequestScope(httptest.NewRequest(http.MethodGet, "/", nil), &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("presents the client certificate to the upstream, verifying it against the CA", func() {
+		rw := get(options.Upstream{
+			TLSClientCert: &options.SecretSource{Value: certPEM},
+			TLSClientKey:  &options.SecretSource{Value: keyPEM},
+			TLSCA:         &options.SecretSource{Value: caPEM},
+		})
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("oauth2-proxy"))
+	})
+
+	It("fails when the upstream requires a client certificate", func() {
+		rw := get(options.Upstream{TLSCA: &options.SecretSource{Value: caPEM}})
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(rw.Body.String()).To(ContainSubstring("certificate required"))
+	})
+
+	It("fails when the certificate of the upstream isn't issued by a trusted CA", func() {
+		rw := get(options.Upstream{
+			TLSClientCert: &options.SecretSource{Value: certPEM},
+			TLSClientKey:  &options.SecretSource{Value: keyPEM},
+		})
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(rw.Body.String()).To(ContainSubstring("certificate signed by unknown authority"))
+	})
+
+	It("rejects invalid certificates and CAs", func() {
+		_, err := newUpstreamClientTLS(options.Upstream{
+			TLSClientCert: &options.SecretSource{Value: certPEM},
+			TLSClientKey:  &options.SecretSource{Value: caPEM},
+		})
+		Expect(err).To(MatchError(ContainSubstring("could not parse tlsClientCert: ")))
+
+		_, err = newUpstreamClientTLS(options.Upstream{TLSClientCert: &options.SecretSource{Value: certPEM}})
+		Expect(err).To(MatchError("tlsClientCert and tlsClientKey must be set together"))
+
+		_, err = newUpstreamClientTLS(options.Upstream{TLSCA: &options.SecretSource{Value: []byte("ca")}})
+		Expect(err).To(MatchError("could not parse tlsCA: no PEM encoded certificates found"))
+	})
+})
@@ -0,0 +1,251 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// The results of the token exchanges of upstreams
+	tokenExchangeExchanged = "exchanged"
+	tokenExchangeCached    = "cached"
+	tokenExchangeError     = "error"
+
+	// defaultExchangedTokenTTL is how long exchanged tokens are cached for
+	// when neither the provider nor the session says when they expire
+	defaultExchangedTokenTTL = time.Minute
+
+	// exchangedTokenExpiryMargin is removed from the lifetime of exchanged
+	// tokens, so that tokens about to expire aren't sent to upstreams
+	exchangedTokenExpiryMargin = 10 * time.Second
+
+	// maxExchangedTokens bounds the number of cached exchanged tokens
+	maxExchangedTokens = 10000
+)
+
+// TokenExchanger exchanges the access tokens of sessions for tokens for the
+// audiences of upstreams, such as the provider with OAuth 2.0 token exchange.
+type TokenExchanger interface {
+	// ExchangeToken returns a token for the audience and scopes in exchange
+	// for the subject token, and the duration it expires in, zero if unknown
+	ExchangeToken(ctx context.Context, subjectToken, audience string, scopes []string) (string, time.Duration, error)
+}
+
+// newTokenExchange wraps the handler so that requests with a session are
+// sent the token for the upstream's audience exchanged for the access token
+// of the session.
+// The access token of the session is never sent to the upstream: it is
+// replaced by the exchanged token in every header it was injected into, or
+// the header is removed when it can't be replaced.
+// The handler is returned unchanged when the upstream has no TokenExchange.
+func newTokenExchange(upstream options.Upstream, exchanger TokenExchanger, tokens *exchangedTokens, handler http.Handler, writer pagewriter.Writer, metrics *tokenExchangeMetrics) (http.Handler, error) {
+	if upstream.TokenExchange == nil {
+		return handler, nil
+	}
+	if exchanger == nil {
+		return nil, errors.New("tokenExchange is set, but tokens can't be exchanged with the provider")
+	}
+
+	header := upstream.TokenExchange.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	return &tokenExchange{
+		upstream:  upstream.ID,
+		audience:  upstream.TokenExchange.Audience,
+		scopes:    upstream.TokenExchange.Scopes,
+		header:    http.CanonicalHeaderKey(header),
+		exchanger: exchanger,
+		tokens:    tokens,
+		handler:   handler,
+		writer:    writer,
+		metrics:   metrics,
+	}, nil
+}
+
+// tokenExchange sends the requests to an upstream with the token exchanged
+// for the access token of their session.
+type tokenExchange struct {
+	upstream  string
+	audience  string
+	scopes    []string
+	header    string
+	exchanger TokenExchanger
+	tokens    *exchangedTokens
+	handler   http.Handler
+	writer    pagewriter.Writer
+	metrics   *tokenExchangeMetrics
+}
+
+// ServeHTTP sets the header of the exchanged token, rejecting the requests
+// whose token can't be exchanged with a 502 response.
+// Requests without a session, to allowed routes, are served unchanged.
+func (t *tokenExchange) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		t.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	token, err := t.token(req.Context(), scope.Session)
+	if err != nil {
+		t.metrics.exchanges.WithLabelValues(t.upstream, tokenExchangeError).Inc()
+		logger.Errorf("Error exchanging the access token of %s for upstream %q: %v", scope.Session.Email, t.upstream, err)
+		t.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+			Status:    http.StatusBadGateway,
+			RequestID: scope.RequestID,
+			AppError:  fmt.Sprintf("the access token could not be exchanged for upstream %q", t.upstream),
+			Accept:    req.Header.Get("Accept"),
+		})
+		return
+	}
+
+	replaceAccessToken(req.Header, scope.Session.AccessToken, token)
+	if t.header == "Authorization" {
+		req.Header.Set(t.header, "Bearer "+token)
+	} else {
+		req.Header.Set(t.header, token)
+	}
+	t.handler.ServeHTTP(rw, req)
+}
+
+// replaceAccessToken replaces the access token with the exchanged token in
+// the values of the headers it was injected into, such as the
+// X-Forwarded-Access-Token header.
+// The Basic Authorization headers carrying the access token are removed, as
+// the token is encoded in them with the user.
+func replaceAccessToken(header http.Header, accessToken, token string) {
+	for name, values := range header {
+		for i, value := range values {
+			if name == "Authorization" && hasBasicAccessToken(value, accessToken) {
+				header.Del(name)
+				break
+			}
+			values[i] = strings.ReplaceAll(value, accessToken, token)
+		}
+	}
+}
+
+// hasBasicAccessToken checks whether the Basic Authorization value carries
+// the access token
+func hasBasicAccessToken(value, accessToken string) bool {
+	encoded := strings.TrimPrefix(value, "Basic ")
+	if encoded == value {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	return err == nil && strings.Contains(string(decoded), accessToken)
+}
+
+// token returns the cached token for the session and audience, or else
+// exchanges the access token of the session for one
+func (t *tokenExchange) token(ctx context.Context, session *sessionsapi.SessionState) (string, error) {
+	if session.AccessToken == "" {
+		return "", errors.New("the session has no access token")
+	}
+
+	key := exchangedTokenKey(session.AccessToken, t.audience, t.scopes)
+	if token, ok := t.tokens.get(key); ok {
+		t.metrics.exchanges.WithLabelValues(t.upstream, tokenExchangeCached).Inc()
+		return token, nil
+	}
+
+	token, expiresIn, err := t.exchanger.ExchangeToken(ctx, session.AccessToken, t.audience, t.scopes)
+	if err != nil {
+		return "", err
+	}
+	t.metrics.exchanges.WithLabelValues(t.upstream, tokenExchangeExchanged).Inc()
+
+	now := t.tokens.clock.Now()
+	var expires time.Time
+	switch {
+	case expiresIn > 0:
+		expires = now.Add(expiresIn)
+	case session.ExpiresOn != nil:
+		expires = *session.ExpiresOn
+	default:
+		expires = now.Add(defaultExchangedTokenTTL)
+	}
+	t.tokens.set(key, token, expires.Add(-exchangedTokenExpiryMargin))
+	return token, nil
+}
+
+// exchangedTokenKey hashes the access token with the audience and scopes, so
+// that the access tokens of sessions aren't kept in the cache keys
+func exchangedTokenKey(accessToken, audience string, scopes []string) string {
+	sum := sha256.Sum256([]byte(accessToken + "\x00" + audience + "\x00" + strings.Join(scopes, " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// exchangedTokens caches the exchanged tokens of all the upstreams until they
+// expire, so that upstreams with the same audience share them.
+type exchangedTokens struct {
+	mu      sync.Mutex
+	entries map[string]exchangedToken
+	clock   clock.Clock
+}
+
+// exchangedToken is a cached exchanged token
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+func newExchangedTokens() *exchangedTokens {
+	return &exchangedTokens{entries: map[string]exchangedToken{}}
+}
+
+// get returns the token for the key, if it hasn't expired
+func (e *exchangedTokens) get(key string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !e.clock.Now().Before(entry.expires) {
+		delete(e.entries, key)
+		return "", false
+	}
+	return entry.token, true
+}
+
+// set caches the token until it expires. Expired tokens are removed when the
+// cache is full, and all tokens if none have expired.
+func (e *exchangedTokens) set(key, token string, expires time.Time) {
+	now := e.clock.Now()
+	if !now.Before(expires) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.entries) >= maxExchangedTokens {
+		for k, entry := range e.entries {
+			if !now.Before(entry.expires) {
+				delete(e.entries, k)
+			}
+		}
+		if len(e.entries) >= maxExchangedTokens {
+			e.entries = map[string]exchangedToken{}
+		}
+	}
+	e.entries[key] = exchangedToken{token: token, expires: expires}
+}
@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeTokenExchanger exchanges tokens for tokens naming the audience and the
+// subject token, recording the exchanges
+type fakeTokenExchanger struct {
+	mu        sync.Mutex
+	exchanges []string
+	expiresIn time.Duration
+	err       error
+}
+
+func (f *fakeTokenExchanger) ExchangeToken(_ context.Context, subjectToken, audience string, _ []string) (string, time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.exchanges = append(f.exchanges, subjectToken)
+	if f.err != nil {
+		return "", 0, f.err
+	}
+	return audience + ":" + subjectToken, f.expiresIn, nil
+}
+
+var _ = Describe("Token Exchange Suite", func() {
+	var (
+		exchanger *fakeTokenExchanger
+		proxy     http.Handler
+		now       time.Time
+	)
+
+	upstream := func(id, path, audience, header string) options.Upstream {
+		return options.Upstream{
+			ID:   id,
+			Path: path,
+			URI:  serverAddr,
+			TokenExchange: &options.UpstreamTokenExchange{
+				Audience: audience,
+				Header:   header,
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		exchanger = &fakeTokenExchanger{expiresIn: time.Minute}
+		var err error
+		proxy, err = NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				upstream("orders", "/orders/", "orders-api", ""),
+				upstream("orders-v2", "/v2/orders/", "orders-api", ""),
+				upstream("billing", "/billing/", "billing-api", "X-Billing-Token"),
+				{ID: "app", Path: "/", URI: serverAddr},
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, exchanger, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		now = time.Now()
+		proxy.(*multiUpstreamProxy).exchangedTokens.clock.Set(now)
+	})
+
+	serveWithHeaders := func(path string, session *sessionsapi.SessionState, headers http.Header) (*httptest.ResponseRecorder, http.Header) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, values := range headers {
+			req.Header[name] = values
+		}
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			return rw, nil
+		}
+
+		request := testHTTPRequest{}
+		Expect(json.Unmarshal(rw.Body.Bytes(), &request)).To(Succeed())
+		return rw, request.Header
+	}
+
+	serve := func(path string, session *sessionsapi.SessionState) (*httptest.ResponseRecorder, http.Header) {
+		return serveWithHeaders(path, session, http.Header{"Authorization": []string{"Bearer original"}})
+	}
+
+	It("sends the token exchanged for the access token of the session", func() {
+		_, header := serve("/orders/42", &sessionsapi.SessionState{AccessToken: "access"})
+		Expect(header.Get("Authorization")).To(Equal("Bearer orders-api:access"))
+		Expect(exchanger.exchanges).To(Equal([]string{"access"}))
+	})
+
+	It("sends the token alone in other headers", func() {
+		_, header := serve("/billing/invoices", &sessionsapi.SessionState{AccessToken: "access"})
+		Expect(header.Get("X-Billing-Token")).To(Equal("billing-api:access"))
+		Expect(header.Get("Authorization")).To(Equal("Bearer original"))
+	})
+
+	It("replaces the access token of the session in the headers it was injected into", func() {
+		_, header := serveWithHeaders("/billing/invoices", &sessionsapi.SessionState{AccessToken: "access"}, http.Header{
+			"Authorization":            []string{"Bearer access"},
+			"X-Forwarded-Access-Token": []string{"access"},
+			"X-Auth-Request-Token":     []string{"token=access"},
+			"X-Forwarded-User":         []string{"john"},
+		})
+		Expect(header.Get("X-Billing-Token")).To(Equal("billing-api:access"))
+		Expect(header.Get("Authorization")).To(Equal("Bearer billing-api:access"))
+		Expect(header.Get("X-Forwarded-Access-Token")).To(Equal("billing-api:access"))
+		Expect(header.Get("X-Auth-Request-Token")).To(Equal("token=billing-api:access"))
+		Expect(header.Get("X-Forwarded-User")).To(Equal("john"))
+	})
+
+	It("removes the basic authorization carrying the access token of the session", func() {
+		_, header := serveWithHeaders("/billing/invoices", &sessionsapi.SessionState{AccessToken: "access"}, http.Header{
+			"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("john:access"))},
+		})
+		Expect(header.Get("X-Billing-Token")).To(Equal("billing-api:access"))
+		Expect(header).ToNot(HaveKey("Authorization"))
+	})
+
+	It("caches the exchanged tokens per session and audience until they expire", func() {
+		session := &sessionsapi.SessionState{AccessToken: "access"}
+		serve("/orders/1", session)
+		_, header := serve("/v2/orders/2", session)
+		Expect(header.Get("Authorization")).To(Equal("Bearer orders-api:access"))
+		Expect(exchanger.exchanges).To(Equal([]string{"access"}))
+
+		serve("/orders/3", &sessionsapi.SessionState{AccessToken: "other"})
+		serve("/billing/invoices", session)
+		Expect(exchanger.exchanges).To(Equal([]string{"access", "other", "access"}))
+
+		proxy.(*multiUpstreamProxy).exchangedTokens.clock.Set(now.Add(time.Minute - exchangedTokenExpiryMargin))
+		serve("/orders/4", session)
+		Expect(exchanger.exchanges).To(HaveLen(4))
+	})
+
+	It("caches the exchanged tokens until the session expires when the provider doesn't say", func() {
+		exchanger.expiresIn = 0
+		expires := now.Add(time.Hour)
+		session := &sessionsapi.SessionState{AccessToken: "access", ExpiresOn: &expires}
+		serve("/orders/1", session)
+
+		proxy.(*multiUpstreamProxy).exchangedTokens.clock.Set(now.Add(30 * time.Minute))
+		serve("/orders/2", session)
+		Expect(exchanger.exchanges).To(HaveLen(1))
+	})
+
+	It("does not exchange the tokens of the requests without a session, or to other upstreams", func() {
+		_, header := serve("/orders/42", nil)
+		Expect(header.Get("Authorization")).To(Equal("Bearer original"))
+		_, header = serve("/page", &sessionsapi.SessionState{AccessToken: "access"})
+		Expect(header.Get("Authorization")).To(Equal("Bearer original"))
+		Expect(exchanger.exchanges).To(BeEmpty())
+	})
+
+	It("rejects the requests whose token can't be exchanged", func() {
+		exchanger.err = errors.New("got 400 from the token endpoint")
+		rw, _ := serve("/orders/42", &sessionsapi.SessionState{AccessToken: "access"})
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(rw.Body.String()).To(Equal(`502 - the access token could not be exchanged for upstream "orders"`))
+
+		exchanger.err = nil
+		rw, _ = serve("/orders/42", &sessionsapi.SessionState{})
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(exchanger.exchanges).To(HaveLen(1))
+	})
+
+	It("fails to register the upstreams exchanging tokens without a token exchanger", func() {
+		_, err := NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{upstream("orders", "/orders/", "orders-api", "")},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).To(MatchError(`could not register HTTP upstream "orders": tokenExchange is set, but tokens can't be exchanged with the provider`))
+	})
+})
@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// newTokenRequirements wraps the handler so that requests authenticated by a
+// bearer token are only served when the token has the upstream's
+// RequiredTokenAudiences and RequiredTokenScopes.
+// Requests authenticated otherwise are only served when the upstream doesn't
+// RequireBearerToken.
+// Rejected requests are recorded with the denial func, when it is set.
+// The handler is returned unchanged when the upstream has no requirements.
+func newTokenRequirements(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer, recordDenial DenialFunc) http.Handler {
+	if len(upstream.RequiredTokenAudiences) == 0 && len(upstream.RequiredTokenScopes) == 0 && !upstream.RequireBearerToken {
+		return handler
+	}
+	return &tokenRequirements{
+		upstream:           upstream.ID,
+		audiences:          upstream.RequiredTokenAudiences,
+		scopes:             upstream.RequiredTokenScopes,
+		requireBearerToken: upstream.RequireBearerToken,
+		handler:            handler,
+		writer:             writer,
+		recordDenial:       recordDenial,
+	}
+}
+
+// tokenRequirements checks the bearer token of requests against the
+// requirements of an upstream.
+type tokenRequirements struct {
+	upstream           string
+	audiences          []string
+	scopes             []string
+	requireBearerToken bool
+	handler            http.Handler
+	writer             pagewriter.Writer
+	recordDenial       DenialFunc
+}
+
+// ServeHTTP serves requests meeting the requirements, and rejects all others
+// with a 403 response.
+// Requests without a session, to allowed routes, are always served.
+func (t *tokenRequirements) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		t.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if err := t.check(scope.Session.BearerToken); err != "" {
+		t.reject(rw, req, scope, err)
+		return
+	}
+	t.handler.ServeHTTP(rw, req)
+}
+
+// check returns why the token doesn't meet the requirements, or an empty
+// string if it does.
+// The token is nil for sessions that weren't created from a bearer token.
+func (t *tokenRequirements) check(token *sessionsapi.BearerToken) string {
+	if token == nil {
+		if t.requireBearerToken {
+			return "requests must be authenticated with a bearer token"
+		}
+		return ""
+	}
+
+	if len(t.audiences) > 0 && !containsAny(token.Audiences, t.audiences) {
+		return fmt.Sprintf("the token audience must include one of: %s", strings.Join(t.audiences, ", "))
+	}
+
+	var missing []string
+	for _, scope := range t.scopes {
+		if !containsAny(token.Scopes, []string{scope}) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("the token is missing the required scopes: %s", strings.Join(missing, ", "))
+	}
+	return ""
+}
+
+// reject responds with a 403 explaining the requirement that wasn't met.
+// It is always written as JSON problem details, as bearer tokens are used by
+// API clients.
+func (t *tokenRequirements) reject(rw http.ResponseWriter, req *http.Request, scope *middleware.RequestScope, reason string) {
+	logger.PrintAuthf(scope.Session.Email, req, logger.AuthFailure, "Bearer token rejected for upstream %q: %s", t.upstream, reason)
+	if t.recordDenial != nil {
+		t.recordDenial(req, scope.Session, t.upstream, reason)
+	}
+	if scope.Session.BearerToken != nil {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", error_description=%q`, reason))
+	}
+	t.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusForbidden,
+		RequestID: scope.RequestID,
+		AppError:  reason,
+		Messages:  []interface{}{"Access to this upstream is denied: %s.", reason},
+		Accept:    "application/json",
+	})
+}
+
+// containsAny checks whether any of the values are in the list
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
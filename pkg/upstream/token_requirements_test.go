@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Token Requirements Suite", func() {
+	type tokenRequirementsTableInput struct {
+		audiences            []string
+		scopes               []string
+		requireBearerToken   bool
+		session              *sessionsapi.SessionState
+		expectedCode         int
+		expectedError        string
+		expectedAuthenticate string
+	}
+
+	DescribeTable("newTokenRequirements",
+		func(in tokenRequirementsTableInput) {
+			var errorOpts pagewriter.ErrorPageOpts
+			var denial string
+			writer := &pagewriter.WriterFuncs{
+				ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+					errorOpts = opts
+					rw.WriteHeader(opts.Status)
+				},
+			}
+
+			handler := newTokenRequirements(options.Upstream{
+				ID:                     "reports",
+				RequiredTokenAudiences: in.audiences,
+				RequiredTokenScopes:    in.scopes,
+				RequireBearerToken:     in.requireBearerToken,
+			}, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusOK)
+			}), writer, func(_ *http.Request, _ *sessionsapi.SessionState, upstream string, reason string) {
+				denial = upstream + ": " + reason
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				RequestID: "11111111-2222-4333-8444-555555555555",
+				Session:   in.session,
+			})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			Expect(rw.Header().Get("WWW-Authenticate")).To(Equal(in.expectedAuthenticate))
+			if in.expectedCode == http.StatusForbidden {
+				Expect(errorOpts.AppError).To(Equal(in.expectedError))
+				Expect(errorOpts.Accept).To(Equal("application/json"))
+				Expect(errorOpts.RequestID).To(Equal("11111111-2222-4333-8444-555555555555"))
+				Expect(denial).To(Equal("reports: " + in.expectedError))
+			} else {
+				Expect(denial).To(BeEmpty())
+			}
+		},
+		Entry("with no requirements", tokenRequirementsTableInput{
+			session: &sessionsapi.SessionState{
+				BearerToken: &sessionsapi.BearerToken{Audiences: []string{"billing"}},
+			},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a token for the upstream", tokenRequirementsTableInput{
+			audiences: []string{"reports", "reports-v1"},
+			scopes:    []string{"reports:read"},
+			session: &sessionsapi.SessionState{
+				BearerToken: &sessionsapi.BearerToken{
+					Audiences: []string{"reports-v1"},
+					Scopes:    []string{"openid", "reports:read"},
+				},
+			},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a token for another service", tokenRequirementsTableInput{
+			audiences: []string{"reports", "reports-v1"},
+			session: &sessionsapi.SessionState{
+				BearerToken: &sessionsapi.BearerToken{Audiences: []string{"billing"}},
+			},
+			expectedCode:         http.StatusForbidden,
+			expectedError:        "the token audience must include one of: reports, reports-v1",
+			expectedAuthenticate: `Bearer error="insufficient_scope", error_description="the token audience must include one of: reports, reports-v1"`,
+		}),
+		Entry("with a token missing scopes", tokenRequirementsTableInput{
+			scopes: []string{"reports:read", "reports:write"},
+			session: &sessionsapi.SessionState{
+				BearerToken: &sessionsapi.BearerToken{
+					Audiences: []string{"reports"},
+					Scopes:    []string{"reports:read"},
+				},
+			},
+			expectedCode:         http.StatusForbidden,
+			expectedError:        "the token is missing the required scopes: reports:write",
+			expectedAuthenticate: `Bearer error="insufficient_scope", error_description="the token is missing the required scopes: reports:write"`,
+		}),
+		Entry("with a session cookie", tokenRequirementsTableInput{
+			audiences:    []string{"reports"},
+			session:      &sessionsapi.SessionState{Email: "john.doe@example.com"},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a session cookie when a bearer token is required", tokenRequirementsTableInput{
+			audiences:          []string{"reports"},
+			requireBearerToken: true,
+			session:            &sessionsapi.SessionState{Email: "john.doe@example.com"},
+			expectedCode:       http.StatusForbidden,
+			expectedError:      "requests must be authenticated with a bearer token",
+		}),
+		Entry("without a session", tokenRequirementsTableInput{
+			audiences:          []string{"reports"},
+			requireBearerToken: true,
+			expectedCode:       http.StatusOK,
+		}),
+	)
+})
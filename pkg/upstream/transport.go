@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// upstreamDialKeepAlive is the interval of the TCP keep-alive probes of
+// connections to upstream servers, as in Go's default transport
+const upstreamDialKeepAlive = 30 * time.Second
+
+// configureUpstreamTransport applies the timeouts and connection pool options
+// of the upstream to its transport.
+// Each upstream has a transport of its own, so that a slow upstream can only
+// exhaust its own pool of connections.
+func configureUpstreamTransport(transport *http.Transport, upstream options.Upstream) {
+	transport.DialContext = newUpstreamDialContext(upstream)
+
+	// Change default duration for waiting for an upstream response
+	if upstream.ResponseHeaderTimeout != nil {
+		transport.ResponseHeaderTimeout = upstream.ResponseHeaderTimeout.Duration()
+	} else if upstream.Timeout != nil {
+		transport.ResponseHeaderTimeout = upstream.Timeout.Duration()
+	}
+
+	if upstream.MaxIdleConns > 0 {
+		transport.MaxIdleConns = upstream.MaxIdleConns
+		transport.MaxIdleConnsPerHost = upstream.MaxIdleConns
+	}
+	if upstream.IdleConnTimeout != nil {
+		transport.IdleConnTimeout = upstream.IdleConnTimeout.Duration()
+	}
+	transport.DisableKeepAlives = upstream.DisableKeepAlives
+}
+
+// newUpstreamDialContext returns the function dialing the connections to the
+// upstream: to its socket for unix socket upstreams, and to the address of
+// the request otherwise
+func newUpstreamDialContext(upstream options.Upstream) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := newUpstreamDialer(upstream)
+	socket := unixSocketPath(upstream.URI)
+	if socket == "" {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}
+
+// newUpstreamDialer creates the dialer of connections to the upstream, with
+// its dial timeout
+func newUpstreamDialer(upstream options.Upstream) *net.Dialer {
+	timeout := options.DefaultUpstreamDialTimeout
+	if upstream.DialTimeout != nil {
+		timeout = upstream.DialTimeout.Duration()
+	}
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: upstreamDialKeepAlive,
+	}
+}
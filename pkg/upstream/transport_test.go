@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream Transport Suite", func() {
+	type upstreamTransportTableInput struct {
+		upstream                      options.Upstream
+		expectedResponseHeaderTimeout time.Duration
+		expectedMaxIdleConns          int
+		expectedMaxIdleConnsPerHost   int
+		expectedIdleConnTimeout       time.Duration
+		expectedDisableKeepAlives     bool
+	}
+
+	second := options.Duration(time.Second)
+	fiveSeconds := options.Duration(5 * time.Second)
+
+	DescribeTable("configureUpstreamTransport",
+		func(in upstreamTransportTableInput) {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			configureUpstreamTransport(transport, in.upstream)
+
+			Expect(transport.DialContext).ToNot(BeNil())
+			Expect(transport.ResponseHeaderTimeout).To(Equal(in.expectedResponseHeaderTimeout))
+			Expect(transport.MaxIdleConns).To(Equal(in.expectedMaxIdleConns))
+			Expect(transport.MaxIdleConnsPerHost).To(Equal(in.expectedMaxIdleConnsPerHost))
+			Expect(transport.IdleConnTimeout).To(Equal(in.expectedIdleConnTimeout))
+			Expect(transport.DisableKeepAlives).To(Equal(in.expectedDisableKeepAlives))
+		},
+		Entry("keeps the defaults of the transport", upstreamTransportTableInput{
+			upstream:                options.Upstream{},
+			expectedMaxIdleConns:    100,
+			expectedIdleConnTimeout: 90 * time.Second,
+		}),
+		Entry("waits for the response headers for the timeout", upstreamTransportTableInput{
+			upstream:                      options.Upstream{Timeout: &fiveSeconds},
+			expectedResponseHeaderTimeout: 5 * time.Second,
+			expectedMaxIdleConns:          100,
+			expectedIdleConnTimeout:       90 * time.Second,
+		}),
+		Entry("prefers the response header timeout to the timeout", upstreamTransportTableInput{
+			upstream:                      options.Upstream{Timeout: &fiveSeconds, ResponseHeaderTimeout: &second},
+			expectedResponseHeaderTimeout: time.Second,
+			expectedMaxIdleConns:          100,
+			expectedIdleConnTimeout:       90 * time.Second,
+		}),
+		Entry("limits the idle connections in total and per host", upstreamTransportTableInput{
+			upstream:                    options.Upstream{MaxIdleConns: 10, IdleConnTimeout: &fiveSeconds},
+			expectedMaxIdleConns:        10,
+			expectedMaxIdleConnsPerHost: 10,
+			expectedIdleConnTimeout:     5 * time.Second,
+		}),
+		Entry("disables keep-alives", upstreamTransportTableInput{
+			upstream:                  options.Upstream{DisableKeepAlives: true},
+			expectedMaxIdleConns:      100,
+			expectedIdleConnTimeout:   90 * time.Second,
+			expectedDisableKeepAlives: true,
+		}),
+	)
+
+	DescribeTable("newUpstreamDialer",
+		func(upstream options.Upstream, expectedTimeout time.Duration) {
+			dialer := newUpstreamDialer(upstream)
+			Expect(dialer.Timeout).To(Equal(expectedTimeout))
+			Expect(dialer.KeepAlive).To(Equal(upstreamDialKeepAlive))
+		},
+		Entry("with the default dial timeout", options.Upstream{}, options.DefaultUpstreamDialTimeout),
+		Entry("with a dial timeout", options.Upstream{DialTimeout: &second}, time.Second),
+	)
+
+	It("gives each upstream a transport of its own", func() {
+		target, err := url.Parse("http://upstream:1234")
+		Expect(err).ToNot(HaveOccurred())
+
+		slow := newReverseProxy(target, options.Upstream{ID: "slow", MaxIdleConns: 1, DisableKeepAlives: true}, nil).Transport.(*http.Transport)
+		fast := newReverseProxy(target, options.Upstream{ID: "fast", MaxIdleConns: 50}, nil).Transport.(*http.Transport)
+		ws := newWebSocketReverseProxy(target, options.Upstream{ID: "fast", MaxIdleConns: 50}).Transport.(*http.Transport)
+
+		Expect(slow).ToNot(BeIdenticalTo(fast))
+		Expect(slow).ToNot(BeIdenticalTo(http.DefaultTransport))
+		Expect(slow.MaxIdleConns).To(Equal(1))
+		Expect(slow.DisableKeepAlives).To(BeTrue())
+		Expect(fast.MaxIdleConns).To(Equal(50))
+		Expect(fast.DisableKeepAlives).To(BeFalse())
+		Expect(ws.DialContext).ToNot(BeNil())
+	})
+})
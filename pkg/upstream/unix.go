@@ -0,0 +1,33 @@
+package upstream
+
+import (
+	"net/url"
+)
+
+const (
+	// unixScheme is the scheme of upstreams listening on a unix domain
+	// socket, eg. unix:///var/run/app.sock
+	unixScheme = "unix"
+
+	// unixSocketHost is the host requests to unix socket upstreams are sent
+	// to, which is their Host header when the host header isn't passed
+	unixSocketHost = "localhost"
+)
+
+// unixSocketHTTPURL returns the URL requests to unix socket upstreams are
+// sent to over HTTP.
+// The connections are dialed to the socket by the dialer of the upstream,
+// rather than to the host of the URL.
+func unixSocketHTTPURL() *url.URL {
+	return &url.URL{Scheme: httpScheme, Host: unixSocketHost}
+}
+
+// unixSocketPath returns the path of the socket of a unix socket upstream
+// URI, or an empty string for other URIs
+func unixSocketPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != unixScheme {
+		return ""
+	}
+	return u.Path
+}
@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unix Socket Upstream Suite", func() {
+	var dir, socket string
+	var server *http.Server
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "unix-upstream")
+		Expect(err).ToNot(HaveOccurred())
+		socket = filepath.Join(dir, "app.sock")
+
+		listener, err := net.Listen("unix", socket)
+		Expect(err).ToNot(HaveOccurred())
+		server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Host", req.Host)
+			rw.Write([]byte("socket " + req.URL.RequestURI()))
+		})}
+		go server.Serve(listener)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	serve := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("routes requests to the socket as it does to HTTP upstreams", func() {
+		falsum := false
+		proxy, err := NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:   "root",
+					Path: "/",
+					URI:  "unix://" + socket,
+				},
+				{
+					ID:             "app",
+					Path:           "/app/",
+					URI:            "unix://" + socket,
+					StripPath:      true,
+					PrependPath:    "/api",
+					PassHostHeader: &falsum,
+				},
+			},
+		}, nil, &pagewriter.WriterFuncs{}, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		rw := serve(proxy, "/index.html?q=1")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("socket /index.html?q=1"))
+		Expect(rw.Header().Get("X-Host")).To(Equal("example.com"))
+
+		rw = serve(proxy, "/app/users")
+		Expect(rw.Code).To(Equal(http.StatusOK))
+		Expect(rw.Body.String()).To(Equal("socket /api/users"))
+		Expect(rw.Header().Get("X-Host")).To(Equal(unixSocketHost))
+	})
+
+	It("renders the error page when the socket can't be dialed", func() {
+		var proxyErr error
+		writer := &pagewriter.WriterFuncs{
+			ProxyErrorFunc: func(rw http.ResponseWriter, _ *http.Request, err error) {
+				proxyErr = err
+				rw.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		proxy, err := NewProxy(options.UpstreamConfig{
+			Upstreams: []options.Upstream{
+				{
+					ID:   "missing",
+					Path: "/",
+					URI:  "unix://" + filepath.Join(dir, "missing.sock"),
+				},
+			},
+		}, nil, writer, options.SlowRequestLog{}, nil, "", "", options.RedisStoreOptions{}, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		rw := serve(proxy, "/")
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+		Expect(proxyErr).To(MatchError(ContainSubstring("missing.sock")))
+	})
+
+	DescribeTable("unixSocketPath",
+		func(uri, expected string) {
+			Expect(unixSocketPath(uri)).To(Equal(expected))
+		},
+		Entry("a unix socket uri", "unix:///var/run/app.sock", "/var/run/app.sock"),
+		Entry("an http uri", "http://localhost:8080/var/run", ""),
+		Entry("an invalid uri", ":", ""),
+	)
+})
@@ -0,0 +1,153 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocketDrainer is implemented by the proxy created by NewProxy, so that
+// the WebSocket connections it proxies can be drained on shutdown.
+type WebSocketDrainer interface {
+	// DrainWebSockets waits for the proxied WebSocket connections to be
+	// closed, closing those still open once the context is done.
+	// Upgrade requests received while draining are closed immediately.
+	DrainWebSockets(ctx context.Context)
+}
+
+// webSocketConnections tracks the WebSocket connections proxied to the
+// upstreams, which are served by their upgrade requests until they are
+// closed, so that they can be drained
+type webSocketConnections struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	cancels  map[*http.Request]context.CancelFunc
+	draining bool
+}
+
+// newWebSocketConnections creates the tracker of the WebSocket connections
+func newWebSocketConnections() *webSocketConnections {
+	return &webSocketConnections{
+		cancels: map[*http.Request]context.CancelFunc{},
+	}
+}
+
+// track wraps the handler so that WebSocket upgrade requests are tracked
+// until they are served, their connection being closed when it is drained.
+// The reverse proxies close the upstream connection, and so the client
+// connection, when the context of the upgrade request is cancelled.
+func (c *webSocketConnections) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !isWebSocketUpgrade(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		c.mu.Lock()
+		if c.draining {
+			c.mu.Unlock()
+			cancel()
+			next.ServeHTTP(rw, req)
+			return
+		}
+		c.cancels[req] = cancel
+		c.wg.Add(1)
+		c.mu.Unlock()
+
+		defer func() {
+			c.mu.Lock()
+			delete(c.cancels, req)
+			c.mu.Unlock()
+			c.wg.Done()
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// drain waits for the tracked connections to be closed, and closes those
+// still open once the context is done
+func (c *webSocketConnections) drain(ctx context.Context) {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+	c.mu.Unlock()
+	<-closed
+}
+
+// setWebSocketIdleTimeout makes the connections of the WebSocket transport
+// time out once no data has been read from or written to them for the
+// timeout.
+// The deadline of the upstream connection is extended on every read and
+// write, when it expires the reverse proxy closes the upgraded connection.
+func setWebSocketIdleTimeout(transport *http.Transport, timeout time.Duration) {
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		idle := &idleTimeoutConn{Conn: conn, timeout: timeout}
+		idle.extend()
+		return idle, nil
+	}
+}
+
+// idleTimeoutConn is a net.Conn whose deadline is extended by the timeout
+// whenever data is read from or written to it
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read reads from the connection, extending its deadline when data is read
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// Write writes to the connection, extending its deadline when data is
+// written
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// extend sets the deadline of the connection to the timeout from now
+func (c *idleTimeoutConn) extend() {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+// DrainWebSockets waits for the WebSocket connections proxied to the
+// upstreams to be closed, closing those still open once the context is done
+func (m *multiUpstreamProxy) DrainWebSockets(ctx context.Context) {
+	m.webSockets.drain(ctx)
+}
@@ -0,0 +1,202 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const webSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+// newWebSocketPolicy wraps the handler so that WebSocket upgrade requests are
+// only served from the upstream's WebSocketAllowedOrigins, and only
+// negotiate its WebSocketAllowedSubprotocols.
+// The handler is returned unchanged when the upstream has no policy.
+func newWebSocketPolicy(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer) http.Handler {
+	if len(upstream.WebSocketAllowedOrigins) == 0 && len(upstream.WebSocketAllowedSubprotocols) == 0 {
+		return handler
+	}
+
+	policy := &webSocketPolicy{
+		upstream:      upstream.ID,
+		requireOrigin: upstream.WebSocketRequireOrigin,
+		subprotocols:  map[string]struct{}{},
+		handler:       handler,
+		writer:        writer,
+	}
+	for _, origin := range upstream.WebSocketAllowedOrigins {
+		if o := parseWebSocketOrigin(origin); o != nil {
+			policy.origins = append(policy.origins, *o)
+		}
+	}
+	for _, subprotocol := range upstream.WebSocketAllowedSubprotocols {
+		policy.subprotocols[subprotocol] = struct{}{}
+	}
+	return policy
+}
+
+// webSocketPolicy checks the upgrade requests to an upstream against its
+// allowed origins and subprotocols.
+type webSocketPolicy struct {
+	upstream      string
+	origins       []webSocketOrigin
+	requireOrigin bool
+	subprotocols  map[string]struct{}
+	handler       http.Handler
+	writer        pagewriter.Writer
+}
+
+// ServeHTTP serves upgrade requests allowed by the policy, with only the
+// allowed subprotocols, and rejects all others with a 403 response.
+// Requests that aren't upgrade requests are always served.
+func (p *webSocketPolicy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !isWebSocketUpgrade(req) {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if reason := p.checkOrigin(req.Header.Get("Origin")); reason != "" {
+		p.reject(rw, req, reason)
+		return
+	}
+	if len(p.subprotocols) > 0 {
+		offered := webSocketSubprotocols(req.Header)
+		allowed := []string{}
+		for _, subprotocol := range offered {
+			if _, ok := p.subprotocols[subprotocol]; ok {
+				allowed = append(allowed, subprotocol)
+			}
+		}
+		if len(offered) > 0 && len(allowed) == 0 {
+			p.reject(rw, req, fmt.Sprintf("none of the subprotocols %q are allowed", strings.Join(offered, ", ")))
+			return
+		}
+		req.Header.Del(webSocketProtocolHeader)
+		if len(allowed) > 0 {
+			req.Header.Set(webSocketProtocolHeader, strings.Join(allowed, ", "))
+		}
+	}
+	p.handler.ServeHTTP(rw, req)
+}
+
+// checkOrigin returns why the origin isn't allowed, or an empty string if it
+// is
+func (p *webSocketPolicy) checkOrigin(origin string) string {
+	if len(p.origins) == 0 {
+		return ""
+	}
+	if origin == "" {
+		if p.requireOrigin {
+			return "the request has no Origin header"
+		}
+		return ""
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err == nil && u.Scheme != "" && u.Host != "" && u.Path == "" && u.User == nil {
+		for _, o := range p.origins {
+			if o.matches(u.Scheme, u.Host) {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("origin %q is not allowed", origin)
+}
+
+// reject responds with a 403 explaining why the upgrade request isn't
+// allowed, logging the origin it came from.
+func (p *webSocketPolicy) reject(rw http.ResponseWriter, req *http.Request, reason string) {
+	scope := middleware.GetRequestScope(req)
+	var email, requestID string
+	if scope != nil {
+		requestID = scope.RequestID
+		if scope.Session != nil {
+			email = scope.Session.Email
+		}
+	}
+
+	logger.PrintAuthf(email, req, logger.AuthFailure, "WebSocket upgrade rejected for upstream %q from origin %q: %s", p.upstream, req.Header.Get("Origin"), reason)
+	p.writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    http.StatusForbidden,
+		RequestID: requestID,
+		AppError:  reason,
+		Messages:  []interface{}{"The WebSocket connection is not allowed: %s.", reason},
+		Accept:    req.Header.Get("Accept"),
+	})
+}
+
+// isWebSocketUpgrade checks whether the request asks to upgrade the
+// connection to a WebSocket.
+// Any request the reverse proxies would upgrade is matched, including those
+// listing other Connection options.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken checks whether the comma separated values of the header
+// include the token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketSubprotocols returns the subprotocols offered by the request
+func webSocketSubprotocols(header http.Header) []string {
+	subprotocols := []string{}
+	for _, value := range header.Values(webSocketProtocolHeader) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				subprotocols = append(subprotocols, v)
+			}
+		}
+	}
+	return subprotocols
+}
+
+// webSocketOrigin is an allowed origin, optionally with a wildcard subdomain.
+type webSocketOrigin struct {
+	scheme   string
+	host     string
+	wildcard bool
+}
+
+// parseWebSocketOrigin parses an allowed origin in the form
+// scheme://host[:port] where the host may start with a `*.` wildcard.
+func parseWebSocketOrigin(origin string) *webSocketOrigin {
+	o := &webSocketOrigin{}
+	origin = strings.ToLower(origin)
+	if i := strings.Index(origin, "://*."); i >= 0 {
+		o.wildcard = true
+		origin = origin[:i] + "://" + origin[i+len("://*."):]
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil
+	}
+	o.scheme = u.Scheme
+	o.host = u.Host
+	return o
+}
+
+func (o webSocketOrigin) matches(scheme, host string) bool {
+	if scheme != o.scheme {
+		return false
+	}
+	if o.wildcard {
+		return strings.HasSuffix(host, "."+o.host)
+	}
+	return host == o.host
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocket Policy Suite", func() {
+	type webSocketPolicyTableInput struct {
+		requireOrigin        bool
+		noSubprotocols       bool
+		upgrade              bool
+		origin               string
+		subprotocols         []string
+		expectedCode         int
+		expectedError        string
+		expectedSubprotocols string
+	}
+
+	DescribeTable("newWebSocketPolicy",
+		func(in webSocketPolicyTableInput) {
+			var errorOpts pagewriter.ErrorPageOpts
+			writer := &pagewriter.WriterFuncs{
+				ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+					errorOpts = opts
+					rw.WriteHeader(opts.Status)
+				},
+			}
+
+			upstream := options.Upstream{
+				ID:                           "chat",
+				WebSocketAllowedOrigins:      []string{"https://app.example.com", "https://*.example.org"},
+				WebSocketAllowedSubprotocols: []string{"graphql-ws", "chat.v2"},
+				WebSocketRequireOrigin:       in.requireOrigin,
+			}
+			if in.noSubprotocols {
+				upstream.WebSocketAllowedSubprotocols = nil
+			}
+			var gotSubprotocols string
+			handler := newWebSocketPolicy(upstream, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				gotSubprotocols = req.Header.Get("Sec-WebSocket-Protocol")
+				rw.WriteHeader(http.StatusOK)
+			}), writer)
+
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			if in.upgrade {
+				req.Header.Set("Connection", "keep-alive, Upgrade")
+				req.Header.Set("Upgrade", "WebSocket")
+			}
+			if in.origin != "" {
+				req.Header.Set("Origin", in.origin)
+			}
+			for _, subprotocols := range in.subprotocols {
+				req.Header.Add("Sec-WebSocket-Protocol", subprotocols)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				RequestID: "11111111-2222-4333-8444-555555555555",
+			})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			if in.expectedCode == http.StatusForbidden {
+				Expect(errorOpts.AppError).To(Equal(in.expectedError))
+				Expect(errorOpts.RequestID).To(Equal("11111111-2222-4333-8444-555555555555"))
+			} else {
+				Expect(gotSubprotocols).To(Equal(in.expectedSubprotocols))
+			}
+		},
+		Entry("with a request that isn't an upgrade request", webSocketPolicyTableInput{
+			origin:               "https://evil.example.net",
+			subprotocols:         []string{"evil"},
+			expectedCode:         http.StatusOK,
+			expectedSubprotocols: "evil",
+		}),
+		Entry("with an allowed origin", webSocketPolicyTableInput{
+			upgrade:      true,
+			origin:       "https://app.example.com",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with an allowed wildcard origin", webSocketPolicyTableInput{
+			upgrade:      true,
+			origin:       "https://chat.eu.example.org",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with an origin that isn't allowed", webSocketPolicyTableInput{
+			upgrade:       true,
+			origin:        "https://evil.example.net",
+			expectedCode:  http.StatusForbidden,
+			expectedError: `origin "https://evil.example.net" is not allowed`,
+		}),
+		Entry("with the bare domain of a wildcard origin", webSocketPolicyTableInput{
+			upgrade:       true,
+			origin:        "https://example.org",
+			expectedCode:  http.StatusForbidden,
+			expectedError: `origin "https://example.org" is not allowed`,
+		}),
+		Entry("with an allowed host and another scheme", webSocketPolicyTableInput{
+			upgrade:       true,
+			origin:        "http://app.example.com",
+			expectedCode:  http.StatusForbidden,
+			expectedError: `origin "http://app.example.com" is not allowed`,
+		}),
+		Entry("without an origin", webSocketPolicyTableInput{
+			upgrade:      true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("without an origin when one is required", webSocketPolicyTableInput{
+			upgrade:       true,
+			requireOrigin: true,
+			expectedCode:  http.StatusForbidden,
+			expectedError: "the request has no Origin header",
+		}),
+		Entry("with allowed subprotocols", webSocketPolicyTableInput{
+			upgrade:              true,
+			origin:               "https://app.example.com",
+			subprotocols:         []string{"chat.v2, chat.v1", "graphql-ws"},
+			expectedCode:         http.StatusOK,
+			expectedSubprotocols: "chat.v2, graphql-ws",
+		}),
+		Entry("with no allowed subprotocols", webSocketPolicyTableInput{
+			upgrade:       true,
+			origin:        "https://app.example.com",
+			subprotocols:  []string{"chat.v1, mqtt"},
+			expectedCode:  http.StatusForbidden,
+			expectedError: `none of the subprotocols "chat.v1, mqtt" are allowed`,
+		}),
+		Entry("with any subprotocol when none are restricted", webSocketPolicyTableInput{
+			upgrade:              true,
+			noSubprotocols:       true,
+			origin:               "https://app.example.com",
+			subprotocols:         []string{"mqtt"},
+			expectedCode:         http.StatusOK,
+			expectedSubprotocols: "mqtt",
+		}),
+	)
+
+	It("returns the handler unchanged without a policy", func() {
+		handler := http.NewServeMux()
+		Expect(newWebSocketPolicy(options.Upstream{ID: "chat"}, handler, &pagewriter.WriterFuncs{})).To(BeIdenticalTo(handler))
+	})
+})
@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/websocket"
+)
+
+var _ = Describe("WebSocket Suite", func() {
+	var backend, proxyServer *httptest.Server
+	var connections *webSocketConnections
+
+	newProxyServer := func(idleTimeout *options.Duration) {
+		u, err := url.Parse(backend.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err := newHTTPUpstreamProxy(options.Upstream{
+			ID:                   "websocket",
+			WebSocketIdleTimeout: idleTimeout,
+		}, u, nil, nil, nil, nil, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		connections = newWebSocketConnections()
+		proxyServer = httptest.NewServer(middleware.NewScope(false, "X-Request-Id", func(*http.Request) bool { return true })(connections.track(handler)))
+	}
+
+	dial := func() (*websocket.Conn, error) {
+		return websocket.Dial(fmt.Sprintf("ws://%s/", proxyServer.Listener.Addr().String()), "", "http://example.localhost")
+	}
+
+	echo := func(ws *websocket.Conn, message string) error {
+		if err := websocket.Message.Send(ws, message); err != nil {
+			return err
+		}
+		var response string
+		if err := websocket.Message.Receive(ws, &response); err != nil {
+			return err
+		}
+		if response != message {
+			return fmt.Errorf("unexpected response %q", response)
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		backend = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+			_, _ = io.Copy(ws, ws)
+		}))
+	})
+
+	AfterEach(func() {
+		proxyServer.Close()
+		backend.Close()
+	})
+
+	Context("with an idle timeout", func() {
+		BeforeEach(func() {
+			timeout := options.Duration(200 * time.Millisecond)
+			newProxyServer(&timeout)
+		})
+
+		It("closes idle connections", func() {
+			ws, err := dial()
+			Expect(err).ToNot(HaveOccurred())
+			defer ws.Close()
+			Expect(echo(ws, "hello")).To(Succeed())
+
+			closed := make(chan error, 1)
+			go func() {
+				var message string
+				closed <- websocket.Message.Receive(ws, &message)
+			}()
+			Eventually(closed, time.Second).Should(Receive(HaveOccurred()))
+		})
+
+		It("keeps connections with activity open", func() {
+			ws, err := dial()
+			Expect(err).ToNot(HaveOccurred())
+			defer ws.Close()
+
+			for i := 0; i < 6; i++ {
+				Expect(echo(ws, fmt.Sprintf("message %d", i))).To(Succeed())
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+	})
+
+	Context("while draining", func() {
+		BeforeEach(func() {
+			newProxyServer(nil)
+		})
+
+		It("waits for the connections to be closed", func() {
+			ws, err := dial()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(echo(ws, "hello")).To(Succeed())
+
+			drained := make(chan struct{})
+			go func() {
+				defer close(drained)
+				connections.drain(context.Background())
+			}()
+			Consistently(drained, 200*time.Millisecond).ShouldNot(BeClosed())
+
+			// The connection keeps working until it is closed
+			Expect(echo(ws, "still open")).To(Succeed())
+			Expect(ws.Close()).To(Succeed())
+			Eventually(drained, time.Second).Should(BeClosed())
+		})
+
+		It("closes the connections still open once the context is done", func() {
+			ws, err := dial()
+			Expect(err).ToNot(HaveOccurred())
+			defer ws.Close()
+			Expect(echo(ws, "hello")).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			connections.drain(ctx)
+
+			var message string
+			Expect(websocket.Message.Receive(ws, &message)).ToNot(Succeed())
+		})
+
+		It("closes the connections upgraded after draining started", func() {
+			connections.drain(context.Background())
+
+			_, err := dial()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("serves requests that aren't upgrades", func() {
+			connections.drain(context.Background())
+
+			resp, err := http.Get(proxyServer.URL)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
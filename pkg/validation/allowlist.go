@@ -6,8 +6,11 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apiclient"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/redirect"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/routeaccess"
 )
 
 func validateAllowlists(o *options.Options) []string {
@@ -16,6 +19,10 @@ func validateAllowlists(o *options.Options) []string {
 	msgs = append(msgs, validateAuthRoutes(o)...)
 	msgs = append(msgs, validateAuthRegexes(o)...)
 	msgs = append(msgs, validateTrustedIPs(o)...)
+	msgs = append(msgs, validateTrustedProxyIPs(o)...)
+	msgs = append(msgs, validateProxyProtocolTrustedIPs(o)...)
+	msgs = append(msgs, validateWhitelistDomains(o)...)
+	msgs = append(msgs, validateSignOutRedirectURL(o)...)
 
 	if len(o.TrustedIPs) > 0 && o.ReverseProxy {
 		_, err := fmt.Fprintln(os.Stderr, "WARNING: mixing --trusted-ip with --reverse-proxy is a potential security vulnerability. An attacker can inject a trusted IP into an X-Real-IP or X-Forwarded-For header if they aren't properly protected outside of oauth2-proxy")
@@ -62,11 +69,96 @@ func validateTrustedIPs(o *options.Options) []string {
 	return msgs
 }
 
+// validateTrustedProxyIPs validates IP/CIDRs of trusted proxies
+func validateTrustedProxyIPs(o *options.Options) []string {
+	msgs := []string{}
+	for i, ipStr := range o.TrustedProxyIPs {
+		if nil == ip.ParseIPNet(ipStr) {
+			msgs = append(msgs, fmt.Sprintf("trusted_proxy_ips[%d] (%s) could not be recognized", i, ipStr))
+		}
+	}
+	return msgs
+}
+
+// validateProxyProtocolTrustedIPs validates IP/CIDRs of the load balancers
+// sending PROXY protocol headers
+func validateProxyProtocolTrustedIPs(o *options.Options) []string {
+	msgs := []string{}
+	if len(o.ProxyProtocolTrustedIPs) > 0 && !o.ProxyProtocol {
+		msgs = append(msgs, "proxy_protocol_trusted_ips is set, but proxy_protocol is not, this will have no effect.")
+	}
+	for i, ipStr := range o.ProxyProtocolTrustedIPs {
+		if nil == ip.ParseIPNet(ipStr) {
+			msgs = append(msgs, fmt.Sprintf("proxy_protocol_trusted_ips[%d] (%s) could not be recognized", i, ipStr))
+		}
+	}
+	return msgs
+}
+
+// validateWhitelistDomains validates URL patterns and regexes in the
+// redirect allowlist
+func validateWhitelistDomains(o *options.Options) []string {
+	msgs := []string{}
+	for i, domain := range o.WhitelistDomains {
+		if !redirect.IsPatternEntry(domain) {
+			continue
+		}
+		if err := redirect.ValidatePatternEntry(domain); err != nil {
+			msgs = append(msgs, fmt.Sprintf("whitelist_domains[%d] (%s) is invalid: %v", i, domain, err))
+		}
+	}
+	return msgs
+}
+
+// validateSignOutRedirectURL validates that the sign out redirect URL is
+// allowed by the redirect allowlist or loopback policy, as any other redirect
+// would be
+func validateSignOutRedirectURL(o *options.Options) []string {
+	redirectURL := o.SignOut.RedirectURL
+	if redirectURL == "" {
+		return []string{}
+	}
+	loopback := redirect.Loopback{Allow: o.Redirect.AllowLoopback, Ports: o.Redirect.LoopbackPorts}
+	if !redirect.NewValidator(o.WhitelistDomains, loopback).IsValidRedirect(redirectURL) {
+		return []string{fmt.Sprintf("sign_out_redirect_url (%s) must be a path or a URL allowed by whitelist_domains", redirectURL)}
+	}
+	return []string{}
+}
+
 // validateAPIRoutes validates regex paths passed with options.ApiRoutes
 func validateAPIRoutes(o *options.Options) []string {
 	return validateRegexes(o.APIRoutes)
 }
 
+// validateAPIClientRules validates the header rules passed with
+// options.APIClientRules
+func validateAPIClientRules(o *options.Options) []string {
+	msgs := []string{}
+	for i, rule := range o.APIClientRules {
+		if _, err := apiclient.NewRules([]string{rule}); err != nil {
+			msgs = append(msgs, fmt.Sprintf("api_client_rules[%d] is invalid: %v", i, err))
+		}
+	}
+	return msgs
+}
+
+// validateRouteAccessRules validates the rules passed with
+// options.RouteAccessRules
+func validateRouteAccessRules(o *options.Options) []string {
+	msgs := []string{}
+	for i, rule := range o.RouteAccessRules {
+		if _, err := routeaccess.NewRules([]string{rule}); err != nil {
+			msgs = append(msgs, fmt.Sprintf("route_access_rules[%d] is invalid: %v", i, err))
+		}
+	}
+	if len(msgs) == 0 {
+		if _, err := routeaccess.NewRules(o.RouteAccessRules); err != nil {
+			msgs = append(msgs, fmt.Sprintf("route_access_rules are invalid: %v", err))
+		}
+	}
+	return msgs
+}
+
 // validateRegexes validates all regexes and returns a list of messages in case of error
 func validateRegexes(regexes []string) []string {
 	msgs := []string{}
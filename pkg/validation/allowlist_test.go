@@ -24,6 +24,11 @@ var _ = Describe("Allowlist", func() {
 		errStrings []string
 	}
 
+	type validateWhitelistDomainsTableInput struct {
+		domains    []string
+		errStrings []string
+	}
+
 	DescribeTable("validateRoutes",
 		func(r *validateRoutesTableInput) {
 			opts := &options.Options{
@@ -122,4 +127,175 @@ var _ = Describe("Allowlist", func() {
 			},
 		}),
 	)
+
+	DescribeTable("validateTrustedProxyIPs",
+		func(t *validateTrustedIPsTableInput) {
+			opts := &options.Options{
+				TrustedProxyIPs: t.trustedIPs,
+			}
+			Expect(validateTrustedProxyIPs(opts)).To(ConsistOf(t.errStrings))
+		},
+		Entry("Valid IPs", &validateTrustedIPsTableInput{
+			trustedIPs: []string{"10.0.0.0/8", "::1"},
+			errStrings: []string{},
+		}),
+		Entry("Invalid IPs", &validateTrustedIPsTableInput{
+			trustedIPs: []string{"10.0.0.0/8", "proxy.local"},
+			errStrings: []string{
+				"trusted_proxy_ips[1] (proxy.local) could not be recognized",
+			},
+		}),
+	)
+
+	DescribeTable("validateProxyProtocolTrustedIPs",
+		func(proxyProtocol bool, trustedIPs []string, errStrings []string) {
+			opts := &options.Options{
+				ProxyProtocol:           proxyProtocol,
+				ProxyProtocolTrustedIPs: trustedIPs,
+			}
+			Expect(validateProxyProtocolTrustedIPs(opts)).To(ConsistOf(errStrings))
+		},
+		Entry("Without trusted IPs", true, []string{}, []string{}),
+		Entry("Valid IPs", true, []string{"10.0.0.0/8", "::1"}, []string{}),
+		Entry("Invalid IPs", true, []string{"10.0.0.0/8", "lb.local"}, []string{
+			"proxy_protocol_trusted_ips[1] (lb.local) could not be recognized",
+		}),
+		Entry("Without the PROXY protocol", false, []string{"10.0.0.0/8"}, []string{
+			"proxy_protocol_trusted_ips is set, but proxy_protocol is not, this will have no effect.",
+		}),
+	)
+
+	DescribeTable("validateAPIClientRules",
+		func(rules []string, errStrings []string) {
+			opts := &options.Options{
+				APIClientRules: rules,
+			}
+			Expect(validateAPIClientRules(opts)).To(ConsistOf(errStrings))
+		},
+		Entry("Valid rules", []string{
+			"browser:User-Agent~Mozilla/&!X-Requested-With",
+			"api:Authorization",
+			"api:Accept=application/json",
+		}, []string{}),
+		Entry("Invalid rules", []string{
+			"api:Authorization",
+			"Accept=application/json",
+			"api:User-Agent~(curl",
+		}, []string{
+			`api_client_rules[1] is invalid: invalid rule "Accept=application/json": expected format <api|browser>:<condition>[&<condition>...]`,
+			"api_client_rules[2] is invalid: invalid rule \"api:User-Agent~(curl\": condition \"User-Agent~(curl\" has an invalid regex: error parsing regexp: missing closing ): `(curl`",
+		}),
+	)
+
+	DescribeTable("validateRouteAccessRules",
+		func(rules []string, errStrings []string) {
+			opts := &options.Options{
+				RouteAccessRules: rules,
+			}
+			Expect(validateRouteAccessRules(opts)).To(ConsistOf(errStrings))
+		},
+		Entry("Valid rules", []string{
+			"internal:path~^/internal/&cidr=10.0.0.0/8,fd00::/8&group=ops",
+			"metrics:path~^/metrics$&cidr=192.168.0.0/16",
+		}, []string{}),
+		Entry("Invalid rules", []string{
+			"internal:path~^/internal/&cidr=10.0.0.0/8",
+			"path~^/admin/&group=admins",
+			"metrics:path~^/metrics$&cidr=metrics.local",
+		}, []string{
+			`route_access_rules[1] is invalid: invalid rule "path~^/admin/&group=admins": expected format <name>:path~<regex>&<requirement>[&<requirement>...]`,
+			`route_access_rules[2] is invalid: invalid rule "metrics:path~^/metrics$&cidr=metrics.local": condition "cidr=metrics.local" has an invalid IP network "metrics.local"`,
+		}),
+		Entry("Rules with the same name", []string{
+			"internal:path~^/internal/&cidr=10.0.0.0/8",
+			"internal:path~^/admin/&group=admins",
+		}, []string{
+			`route_access_rules are invalid: invalid rule "internal:path~^/admin/&group=admins": the name "internal" is already used`,
+		}),
+	)
+
+	DescribeTable("validateWhitelistDomains",
+		func(t *validateWhitelistDomainsTableInput) {
+			opts := &options.Options{
+				WhitelistDomains: t.domains,
+			}
+			Expect(validateWhitelistDomains(opts)).To(ConsistOf(t.errStrings))
+		},
+		Entry("Valid domains and patterns", &validateWhitelistDomainsTableInput{
+			domains: []string{
+				"foo.bar",
+				".bar.foo",
+				"*.wildcard.bar:*",
+				"https://*.preview.example.com:*/callback",
+				"http://localhost:8000-8010/callback",
+				"http://127.0.0.1:9000",
+				`~^https://[a-z]+\.review\.example\.com/callback$`,
+			},
+			errStrings: []string{},
+		}),
+		Entry("Patterns that match everything", &validateWhitelistDomainsTableInput{
+			domains: []string{
+				"https://*",
+				"https://*.com:*",
+				`~^https://.*$`,
+				`~^.*$`,
+			},
+			errStrings: []string{
+				"whitelist_domains[0] (https://*) is invalid: host must be specified",
+				"whitelist_domains[1] (https://*.com:*) is invalid: wildcard host \"*.com\" must be followed by at least two domain labels",
+				"whitelist_domains[2] (~^https://.*$) is invalid: pattern would allow redirects to any domain",
+				"whitelist_domains[3] (~^.*$) is invalid: pattern would allow redirects to any domain",
+			},
+		}),
+		Entry("Insecure and malformed patterns", &validateWhitelistDomainsTableInput{
+			domains: []string{
+				"http://example.com/callback",
+				"http://*.localhost",
+				"ftp://example.com",
+				"https://foo*.example.com",
+				"https://example.com:9000-8000",
+				"https://example.com/*/callback",
+				`~https://example\.com/`,
+				`~^https://(example\.com$`,
+			},
+			errStrings: []string{
+				"whitelist_domains[0] (http://example.com/callback) is invalid: http is only allowed for localhost, use https",
+				"whitelist_domains[1] (http://*.localhost) is invalid: wildcard host \"*.localhost\" must be followed by at least two domain labels",
+				"whitelist_domains[2] (ftp://example.com) is invalid: unsupported scheme \"ftp\", must be https",
+				"whitelist_domains[3] (https://foo*.example.com) is invalid: wildcards are only supported as the leftmost label of the host",
+				"whitelist_domains[4] (https://example.com:9000-8000) is invalid: invalid port range \"9000-8000\"",
+				"whitelist_domains[5] (https://example.com/*/callback) is invalid: wildcards are only supported at the end of the path",
+				"whitelist_domains[6] (~https://example\\.com/) is invalid: regex must be anchored with ^ and $ so that it matches the full redirect URL",
+				"whitelist_domains[7] (~^https://(example\\.com$) is invalid: error compiling regex: error parsing regexp: missing closing ): `^https://(example\\.com$`",
+			},
+		}),
+	)
+
+	DescribeTable("validateSignOutRedirectURL",
+		func(redirectURL string, allowLoopback bool, errStrings []string) {
+			opts := &options.Options{
+				WhitelistDomains: []string{".example.com"},
+				SignOut: options.SignOut{
+					RedirectURL: redirectURL,
+				},
+				Redirect: options.Redirect{
+					AllowLoopback: allowLoopback,
+				},
+			}
+			Expect(validateSignOutRedirectURL(opts)).To(ConsistOf(errStrings))
+		},
+		Entry("No redirect URL", "", false, []string{}),
+		Entry("A path", "/signed-out", false, []string{}),
+		Entry("An allowed URL", "https://www.example.com/signed-out", false, []string{}),
+		Entry("A URL that isn't allowed", "https://www.example.org/signed-out", false, []string{
+			"sign_out_redirect_url (https://www.example.org/signed-out) must be a path or a URL allowed by whitelist_domains",
+		}),
+		Entry("An open redirect", "//www.example.org", false, []string{
+			"sign_out_redirect_url (//www.example.org) must be a path or a URL allowed by whitelist_domains",
+		}),
+		Entry("A loopback URL", "http://127.0.0.1:8080/signed-out", true, []string{}),
+		Entry("A loopback URL that isn't allowed", "http://127.0.0.1:8080/signed-out", false, []string{
+			"sign_out_redirect_url (http://127.0.0.1:8080/signed-out) must be a path or a URL allowed by whitelist_domains",
+		}),
+	)
 })
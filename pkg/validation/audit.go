@@ -0,0 +1,66 @@
+package validation
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"runtime"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+)
+
+func validateAudit(o *options.Options) []string {
+	audit := o.Audit
+	if !audit.Enabled() {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if audit.Syslog {
+		if runtime.GOOS == "windows" {
+			msgs = append(msgs, "audit_log_syslog is not available on Windows")
+		}
+		if audit.SyslogAddress != "" {
+			if u, err := url.Parse(audit.SyslogAddress); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+				msgs = append(msgs, fmt.Sprintf("audit_log_syslog_address (%q) must be udp://host:port or tcp://host:port", audit.SyslogAddress))
+			}
+		}
+	}
+
+	if audit.WebhookURL != "" {
+		if u, err := url.Parse(audit.WebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("audit_log_webhook_url (%q) must be an https URL", audit.WebhookURL))
+		}
+		keys, err := sessionevents.LoadSigningKeys(audit.SigningKeyFiles)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid audit_log_signing_key_files: %v", err))
+		}
+		// A leaked cookie secret must not allow events to be forged
+		for _, key := range keys {
+			if bytes.Equal(key, []byte(o.Cookie.Secret)) || bytes.Equal(key, encryption.SecretBytes(o.Cookie.Secret)) {
+				msgs = append(msgs, "audit_log_signing_key_files must not contain the cookie_secret")
+			}
+		}
+		if audit.WebhookMaxRetries < 0 {
+			msgs = append(msgs, fmt.Sprintf("audit_log_webhook_max_retries (%d) must not be negative", audit.WebhookMaxRetries))
+		}
+		if audit.WebhookTimeout <= 0 {
+			msgs = append(msgs, fmt.Sprintf("audit_log_webhook_timeout (%q) must be positive", audit.WebhookTimeout.String()))
+		}
+	}
+
+	for _, eventType := range audit.Types {
+		switch eventType {
+		case options.AuditEventSessionCreated, options.AuditEventSessionRefreshed, options.AuditEventSessionRevoked, options.AuditEventAuthorizationDenied, options.AuditEventUpstreamAccess:
+		default:
+			msgs = append(msgs, fmt.Sprintf("audit_events (%q) must be one of: %s, %s, %s, %s or %s", eventType,
+				options.AuditEventSessionCreated, options.AuditEventSessionRefreshed, options.AuditEventSessionRevoked, options.AuditEventAuthorizationDenied, options.AuditEventUpstreamAccess))
+		}
+	}
+	if audit.QueueSize <= 0 {
+		msgs = append(msgs, fmt.Sprintf("audit_log_queue_size (%d) must be positive", audit.QueueSize))
+	}
+	return msgs
+}
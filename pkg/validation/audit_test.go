@@ -0,0 +1,125 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit", func() {
+	const signingKey = "0123456789abcdef0123456789abcdef"
+
+	var keyFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "oauth2-proxy-audit-key")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(signingKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		keyFile = f.Name()
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(keyFile)).To(Succeed())
+	})
+
+	type validateAuditTableInput struct {
+		file          string
+		syslogAddress string
+		webhookURL    string
+		keyFiles      int
+		types         []string
+		queueSize     int
+		maxRetries    int
+		timeout       time.Duration
+		cookieSecret  string
+		errStrings    []string
+	}
+
+	DescribeTable("validateAudit",
+		func(in validateAuditTableInput) {
+			opts := &options.Options{
+				Cookie: options.Cookie{Secret: in.cookieSecret},
+				Audit: options.Audit{
+					File:              in.file,
+					Syslog:            in.syslogAddress != "",
+					SyslogAddress:     in.syslogAddress,
+					WebhookURL:        in.webhookURL,
+					Types:             in.types,
+					QueueSize:         options.DefaultAuditQueueSize,
+					WebhookMaxRetries: in.maxRetries,
+					WebhookTimeout:    options.DefaultAuditWebhookTimeout,
+				},
+			}
+			for i := 0; i < in.keyFiles; i++ {
+				opts.Audit.SigningKeyFiles = append(opts.Audit.SigningKeyFiles, keyFile)
+			}
+			if in.queueSize != 0 {
+				opts.Audit.QueueSize = in.queueSize
+			}
+			if in.timeout != 0 {
+				opts.Audit.WebhookTimeout = in.timeout
+			}
+			Expect(validateAudit(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Disabled", validateAuditTableInput{
+			queueSize:  -1,
+			errStrings: []string{},
+		}),
+		Entry("With a file", validateAuditTableInput{
+			file:       "/var/log/oauth2-proxy/audit.log",
+			types:      []string{options.AuditEventSessionCreated, options.AuditEventUpstreamAccess},
+			errStrings: []string{},
+		}),
+		Entry("With a syslog server", validateAuditTableInput{
+			syslogAddress: "tcp://syslog.example.com:514",
+			errStrings:    []string{},
+		}),
+		Entry("With an invalid syslog server", validateAuditTableInput{
+			syslogAddress: "syslog.example.com:514",
+			errStrings: []string{
+				`audit_log_syslog_address ("syslog.example.com:514") must be udp://host:port or tcp://host:port`,
+			},
+		}),
+		Entry("With a webhook", validateAuditTableInput{
+			webhookURL: "https://siem.example.com/audit",
+			keyFiles:   1,
+			errStrings: []string{},
+		}),
+		Entry("With an http webhook without a signing key", validateAuditTableInput{
+			webhookURL: "http://siem.example.com/audit",
+			errStrings: []string{
+				`audit_log_webhook_url ("http://siem.example.com/audit") must be an https URL`,
+				"invalid audit_log_signing_key_files: no signing key file configured",
+			},
+		}),
+		Entry("With the cookie secret as the signing key", validateAuditTableInput{
+			webhookURL:   "https://siem.example.com/audit",
+			keyFiles:     1,
+			cookieSecret: signingKey,
+			errStrings: []string{
+				"audit_log_signing_key_files must not contain the cookie_secret",
+			},
+		}),
+		Entry("With invalid options", validateAuditTableInput{
+			webhookURL: "https://siem.example.com/audit",
+			keyFiles:   1,
+			types:      []string{"session_created", "login"},
+			queueSize:  -1,
+			maxRetries: -1,
+			timeout:    -time.Second,
+			errStrings: []string{
+				`audit_events ("login") must be one of: session_created, session_refreshed, session_revoked, authorization_denied or upstream_access`,
+				"audit_log_queue_size (-1) must be positive",
+				"audit_log_webhook_max_retries (-1) must not be negative",
+				`audit_log_webhook_timeout ("-1s") must be positive`,
+			},
+		}),
+	)
+})
@@ -0,0 +1,39 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateClaimEnrichment(o options.ClaimEnrichment) []string {
+	if o.URL == "" {
+		if o.FailOpen {
+			return []string{"claim_enrichment_fail_open is set, but claim_enrichment_url is not, this will have no effect."}
+		}
+		return []string{}
+	}
+
+	msgs := []string{}
+	if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("claim_enrichment_url (%q) must be an http or https URL", o.URL))
+	}
+	if o.Prefix == "" || strings.ContainsAny(o.Prefix, ".[]") {
+		msgs = append(msgs, fmt.Sprintf("claim_enrichment_prefix (%q) must be a non empty prefix of claim names, without dots or brackets", o.Prefix))
+	}
+	if o.Timeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("claim_enrichment_timeout (%q) must be positive", o.Timeout.String()))
+	}
+	if o.MaxResponseSize <= 0 {
+		msgs = append(msgs, fmt.Sprintf("claim_enrichment_max_response_size (%d) must be positive", o.MaxResponseSize))
+	}
+	return msgs
+}
+
+// isEnrichedClaim checks whether the claim, or claim path, is one of the
+// claims from the claim enrichment endpoint
+func isEnrichedClaim(o options.ClaimEnrichment, claim string) bool {
+	return o.URL != "" && o.Prefix != "" && strings.HasPrefix(claim, o.Prefix)
+}
@@ -0,0 +1,54 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Claim Enrichment", func() {
+	valid := func() options.ClaimEnrichment {
+		return options.ClaimEnrichment{
+			URL:             "https://directory.example.com/users",
+			Prefix:          options.DefaultClaimEnrichmentPrefix,
+			Timeout:         options.DefaultClaimEnrichmentTimeout,
+			MaxResponseSize: options.DefaultClaimEnrichmentMaxResponseSize,
+		}
+	}
+
+	DescribeTable("validateClaimEnrichment",
+		func(modify func(*options.ClaimEnrichment), expectedMsgs []string) {
+			o := valid()
+			modify(&o)
+			Expect(validateClaimEnrichment(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with valid options", func(o *options.ClaimEnrichment) {}, []string{}),
+		Entry("without a url", func(o *options.ClaimEnrichment) {
+			o.URL = ""
+		}, []string{}),
+		Entry("with fail open, but no url", func(o *options.ClaimEnrichment) {
+			o.URL = ""
+			o.FailOpen = true
+		}, []string{"claim_enrichment_fail_open is set, but claim_enrichment_url is not, this will have no effect."}),
+		Entry("with invalid options", func(o *options.ClaimEnrichment) {
+			o.URL = "ftp://directory.example.com"
+			o.Prefix = "directory."
+			o.Timeout = 0
+			o.MaxResponseSize = -1
+		}, []string{
+			"claim_enrichment_url (\"ftp://directory.example.com\") must be an http or https URL",
+			"claim_enrichment_prefix (\"directory.\") must be a non empty prefix of claim names, without dots or brackets",
+			"claim_enrichment_timeout (\"0s\") must be positive",
+			"claim_enrichment_max_response_size (-1) must be positive",
+		}),
+		Entry("with an empty prefix", func(o *options.ClaimEnrichment) {
+			o.Prefix = ""
+			o.Timeout = time.Second
+		}, []string{
+			"claim_enrichment_prefix (\"\") must be a non empty prefix of claim names, without dots or brackets",
+		}),
+	)
+})
@@ -19,6 +19,16 @@ func validateCookie(o options.Cookie) []string {
 			o.Expire.String()))
 	}
 
+	if o.RefreshJitter < 0 || o.RefreshJitter > 99 {
+		msgs = append(msgs, fmt.Sprintf("cookie_refresh_jitter (%d) must be a percentage between 0 and 99", o.RefreshJitter))
+	}
+	if o.RefreshWindow < 0 {
+		msgs = append(msgs, fmt.Sprintf("cookie_refresh_window (%q) must not be negative", o.RefreshWindow.String()))
+	}
+	if o.RefreshWindow > 0 && o.Refresh == 0 {
+		msgs = append(msgs, "cookie_refresh_window requires cookie_refresh to be set")
+	}
+
 	switch o.SameSite {
 	case "", "none", "lax", "strict":
 	default:
@@ -36,6 +36,8 @@ func TestValidateCookie(t *testing.T) {
 	invalidBase64SecretMsg := "cookie_secret must be 16, 24, or 32 bytes to create an AES cipher, but is 10 bytes"
 	refreshLongerThanExpireMsg := "cookie_refresh (\"1h0m0s\") must be less than cookie_expire (\"15m0s\")"
 	invalidSameSiteMsg := "cookie_samesite (\"invalid\") must be one of ['', 'lax', 'strict', 'none']"
+	invalidRefreshJitterMsg := "cookie_refresh_jitter (100) must be a percentage between 0 and 99"
+	refreshWindowWithoutRefreshMsg := "cookie_refresh_window requires cookie_refresh to be set"
 
 	testCases := []struct {
 		name       string
@@ -236,6 +238,43 @@ func TestValidateCookie(t *testing.T) {
 				invalidSameSiteMsg,
 			},
 		},
+		{
+			name: "with a refresh jitter and window",
+			cookie: options.Cookie{
+				Name:          validName,
+				Secret:        validSecret,
+				Expire:        time.Hour,
+				Refresh:       15 * time.Minute,
+				RefreshJitter: 20,
+				RefreshWindow: 5 * time.Minute,
+			},
+			errStrings: []string{},
+		},
+		{
+			name: "with an invalid refresh jitter",
+			cookie: options.Cookie{
+				Name:          validName,
+				Secret:        validSecret,
+				Expire:        time.Hour,
+				Refresh:       15 * time.Minute,
+				RefreshJitter: 100,
+			},
+			errStrings: []string{
+				invalidRefreshJitterMsg,
+			},
+		},
+		{
+			name: "with a refresh window without refresh",
+			cookie: options.Cookie{
+				Name:          validName,
+				Secret:        validSecret,
+				Expire:        time.Hour,
+				RefreshWindow: 5 * time.Minute,
+			},
+			errStrings: []string{
+				refreshWindowWithoutRefreshMsg,
+			},
+		},
 		{
 			name: "with a combination of configuration errors",
 			cookie: options.Cookie{
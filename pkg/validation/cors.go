@@ -0,0 +1,70 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateCORS(o options.CORS) []string {
+	msgs := []string{}
+	for i, origin := range o.AllowedOrigins {
+		if err := validateCORSOrigin(origin); err != nil {
+			msgs = append(msgs, fmt.Sprintf("cors_allowed_origins[%d] (%s) is invalid: %v", i, origin, err))
+		}
+	}
+	return append(msgs, validateCORSPreflight(o)...)
+}
+
+// validateCORSPreflight checks the preflight routes compile, and that there
+// are allowed origins for preflight requests to come from.
+func validateCORSPreflight(o options.CORS) []string {
+	msgs := []string{}
+	for _, route := range o.PreflightRoutes {
+		if _, err := regexp.Compile(route); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling cors_preflight_routes regex /%s/: %v", route, err))
+		}
+	}
+	if len(o.PreflightRoutes) > 0 && len(o.AllowedOrigins) == 0 {
+		msgs = append(msgs, "cors_preflight_routes requires cors_allowed_origins to be set")
+	}
+	if o.RespondToPreflight && len(o.PreflightRoutes) == 0 {
+		msgs = append(msgs, "cors_respond_to_preflight requires cors_preflight_routes to be set")
+	}
+	return msgs
+}
+
+// validateCORSOrigin checks that an allowed origin is in the form
+// scheme://host[:port], where the host may start with a `*.` wildcard.
+func validateCORSOrigin(origin string) error {
+	if origin == "*" || origin == "null" {
+		return fmt.Errorf("origin must be an explicit scheme and host")
+	}
+
+	hostStart := strings.Index(origin, "://") + len("://")
+	if hostStart < len("://") {
+		return fmt.Errorf("origin must include a scheme (eg https://)")
+	}
+	if strings.HasPrefix(origin[hostStart:], "*.") {
+		origin = origin[:hostStart] + origin[hostStart+len("*."):]
+		if !strings.Contains(origin[hostStart:], ".") {
+			return fmt.Errorf("wildcard host must be followed by at least two domain labels")
+		}
+	}
+
+	u, err := url.Parse(origin)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("scheme must be http or https")
+	case u.Host == "" || strings.Contains(u.Host, "*"):
+		return fmt.Errorf("host must be specified without wildcards other than a leading *.")
+	case u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("origin must not include userinfo, a path, a query or a fragment")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CORS", func() {
+	type validateCORSTableInput struct {
+		origins    []string
+		errStrings []string
+	}
+
+	DescribeTable("validateCORS",
+		func(in *validateCORSTableInput) {
+			Expect(validateCORS(options.CORS{AllowedOrigins: in.origins})).To(ConsistOf(in.errStrings))
+		},
+		Entry("Valid origins", &validateCORSTableInput{
+			origins: []string{
+				"https://app.example.com",
+				"https://*.example.com",
+				"http://localhost:3000",
+				"https://app.example.com/",
+			},
+			errStrings: []string{},
+		}),
+		Entry("Invalid origins", &validateCORSTableInput{
+			origins: []string{
+				"*",
+				"app.example.com",
+				"https://*.com",
+				"ftp://app.example.com",
+				"https://app.*.example.com",
+				"https://app.example.com/path",
+			},
+			errStrings: []string{
+				"cors_allowed_origins[0] (*) is invalid: origin must be an explicit scheme and host",
+				"cors_allowed_origins[1] (app.example.com) is invalid: origin must include a scheme (eg https://)",
+				"cors_allowed_origins[2] (https://*.com) is invalid: wildcard host must be followed by at least two domain labels",
+				"cors_allowed_origins[3] (ftp://app.example.com) is invalid: scheme must be http or https",
+				"cors_allowed_origins[4] (https://app.*.example.com) is invalid: host must be specified without wildcards other than a leading *.",
+				"cors_allowed_origins[5] (https://app.example.com/path) is invalid: origin must not include userinfo, a path, a query or a fragment",
+			},
+		}),
+	)
+
+	type validateCORSPreflightTableInput struct {
+		cors       options.CORS
+		errStrings []string
+	}
+
+	DescribeTable("validateCORS with preflight routes",
+		func(in *validateCORSPreflightTableInput) {
+			Expect(validateCORS(in.cors)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Valid preflight routes", &validateCORSPreflightTableInput{
+			cors: options.CORS{
+				AllowedOrigins:     []string{"https://app.example.com"},
+				PreflightRoutes:    []string{"^/api/", "^/graphql$"},
+				RespondToPreflight: true,
+			},
+			errStrings: []string{},
+		}),
+		Entry("Invalid preflight route regex", &validateCORSPreflightTableInput{
+			cors: options.CORS{
+				AllowedOrigins:  []string{"https://app.example.com"},
+				PreflightRoutes: []string{"^/api/(", "^/graphql$"},
+			},
+			errStrings: []string{
+				"error compiling cors_preflight_routes regex /^/api/(/: error parsing regexp: missing closing ): `^/api/(`",
+			},
+		}),
+		Entry("Preflight routes without allowed origins", &validateCORSPreflightTableInput{
+			cors: options.CORS{
+				PreflightRoutes: []string{"^/api/"},
+			},
+			errStrings: []string{
+				"cors_preflight_routes requires cors_allowed_origins to be set",
+			},
+		}),
+		Entry("Responding to preflight requests without preflight routes", &validateCORSPreflightTableInput{
+			cors: options.CORS{
+				AllowedOrigins:     []string{"https://app.example.com"},
+				RespondToPreflight: true,
+			},
+			errStrings: []string{
+				"cors_respond_to_preflight requires cors_preflight_routes to be set",
+			},
+		}),
+	)
+})
@@ -0,0 +1,33 @@
+package validation
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateCrawlers(o options.Crawlers) []string {
+	msgs := []string{}
+	if !o.Detection {
+		if len(o.UserAgents) > 0 {
+			msgs = append(msgs, "crawler_user_agents are set, but crawler_detection is disabled, this will have no effect.")
+		}
+		return msgs
+	}
+
+	if o.ResponseStatus != http.StatusForbidden && o.ResponseStatus != http.StatusNotFound {
+		msgs = append(msgs, fmt.Sprintf("invalid crawler_response_status (%d): must be 403 or 404", o.ResponseStatus))
+	}
+	for _, userAgent := range o.UserAgents {
+		if userAgent == "" {
+			msgs = append(msgs, "invalid crawler_user_agents: patterns must not be empty, they would match every request")
+			continue
+		}
+		if _, err := regexp.Compile(userAgent); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid crawler_user_agents pattern (%q): %v", userAgent, err))
+		}
+	}
+	return msgs
+}
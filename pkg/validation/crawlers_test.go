@@ -0,0 +1,41 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Crawlers", func() {
+	DescribeTable("validateCrawlers",
+		func(o options.Crawlers, expectedMsgs []string) {
+			Expect(validateCrawlers(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with crawler detection disabled", options.Crawlers{
+			ResponseStatus: options.DefaultCrawlerResponseStatus,
+		}, []string{}),
+		Entry("with the default user agents", options.Crawlers{
+			Detection:      true,
+			ResponseStatus: options.DefaultCrawlerResponseStatus,
+		}, []string{}),
+		Entry("with user agents and a 404 response status", options.Crawlers{
+			Detection:      true,
+			UserAgents:     []string{"^UptimeRobot/", "Bingbot|Googlebot"},
+			ResponseStatus: 404,
+		}, []string{}),
+		Entry("with invalid options", options.Crawlers{
+			Detection:      true,
+			UserAgents:     []string{"", "Googlebot("},
+			ResponseStatus: 200,
+		}, []string{
+			"invalid crawler_response_status (200): must be 403 or 404",
+			"invalid crawler_user_agents: patterns must not be empty, they would match every request",
+			"invalid crawler_user_agents pattern (\"Googlebot(\"): error parsing regexp: missing closing ): `Googlebot(`",
+		}),
+		Entry("with user agents, but crawler detection disabled", options.Crawlers{
+			UserAgents:     []string{"Googlebot"},
+			ResponseStatus: options.DefaultCrawlerResponseStatus,
+		}, []string{"crawler_user_agents are set, but crawler_detection is disabled, this will have no effect."}),
+	)
+})
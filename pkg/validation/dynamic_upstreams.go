@@ -0,0 +1,118 @@
+package validation
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateDynamicUpstreams(o options.DynamicUpstreams) []string {
+	msgs := []string{}
+	if o.Dir == "" {
+		if o.DefaultTTL != 0 {
+			msgs = append(msgs, "dynamic_upstreams_default_ttl is set, but dynamic_upstreams_dir is not, this will have no effect.")
+		}
+		return msgs
+	}
+
+	if info, err := os.Stat(o.Dir); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid dynamic_upstreams_dir (%q): %v", o.Dir, err))
+	} else if !info.IsDir() {
+		msgs = append(msgs, fmt.Sprintf("invalid dynamic_upstreams_dir (%q): not a directory", o.Dir))
+	}
+	if o.DefaultTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid dynamic_upstreams_default_ttl (%s): must not be negative", o.DefaultTTL))
+	}
+	return msgs
+}
+
+// ValidateDynamicUpstream validates an upstream registered at runtime with
+// the same checks as the upstreams of the configuration at startup.
+// The IDs and paths of the configured upstreams, and of the dynamic upstreams
+// already accepted, can't be reused. The path also can't overlap those of
+// the configured upstreams, other than the root path, so that the routes of
+// the configuration are never shadowed.
+func ValidateDynamicUpstream(o *options.Options, upstream options.DynamicUpstream, accepted []options.Upstream) error {
+	ids := make(map[string]struct{})
+	paths := make(map[string]struct{})
+	for _, existing := range append(append([]options.Upstream{}, o.UpstreamServers.Upstreams...), accepted...) {
+		ids[existing.ID] = struct{}{}
+		paths[existing.Path] = struct{}{}
+	}
+
+	msgs := validateUpstream(upstream.Upstream, ids, paths)
+	msgs = append(msgs, validateDynamicUpstreamOptions(upstream)...)
+	for _, configured := range o.UpstreamServers.Upstreams {
+		if pathsOverlap(configured, upstream.Path) {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has path %q overlapping the path %q of configured upstream %q", upstream.ID, upstream.Path, configured.Path, configured.ID))
+		}
+	}
+
+	// The checks across upstreams are run with the dynamic upstream alone
+	single := *o
+	single.UpstreamServers = options.UpstreamConfig{Upstreams: []options.Upstream{upstream.Upstream}}
+	msgs = append(msgs, validateUpstreamAuthorization(&single)...)
+	msgs = append(msgs, validateUpstreamTokenRequirements(&single)...)
+
+	if len(msgs) != 0 {
+		return fmt.Errorf("invalid dynamic upstream:\n  %s",
+			strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// validateDynamicUpstreamOptions checks the options that dynamic upstreams
+// can't use: rewrite targets, whose path patterns can't be checked for
+// overlaps, and DNS refresh and health checks, which are never stopped once
+// started.
+func validateDynamicUpstreamOptions(upstream options.DynamicUpstream) []string {
+	msgs := []string{}
+	if upstream.Path == "/" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has the root path: dynamic upstreams must have more specific paths", upstream.ID))
+	}
+	if upstream.RewriteTarget != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a rewriteTarget: dynamic upstreams can't rewrite paths", upstream.ID))
+	}
+	if upstream.DNSRefreshInterval != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a dnsRefreshInterval: dynamic upstreams can't refresh their DNS", upstream.ID))
+	}
+	if upstream.HealthCheck != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a healthCheck: dynamic upstreams can't be health checked", upstream.ID))
+	}
+	if upstream.TTL != nil && upstream.TTL.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid ttl (%s): must not be negative", upstream.ID, upstream.TTL.Duration()))
+	}
+	return msgs
+}
+
+// pathsOverlap checks whether requests to the path could be routed to the
+// configured upstream, or requests to the configured upstream to the path.
+// Root paths don't overlap more specific paths.
+func pathsOverlap(configured options.Upstream, path string) bool {
+	if configured.RewriteTarget != "" {
+		// The path is a pattern, which may match the path or paths under it
+		return regexpMatches(configured.Path, path)
+	}
+	if configured.Path == "/" || path == "/" {
+		return false
+	}
+	switch {
+	case configured.Path == path:
+		return true
+	case strings.HasSuffix(configured.Path, "/") && strings.HasPrefix(path, configured.Path):
+		return true
+	case strings.HasSuffix(path, "/") && strings.HasPrefix(configured.Path, path):
+		return true
+	}
+	return false
+}
+
+// regexpMatches checks whether the pattern matches the path, invalid patterns
+// are reported by the validation of their upstream
+func regexpMatches(pattern, path string) bool {
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(path)
+}
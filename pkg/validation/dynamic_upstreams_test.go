@@ -0,0 +1,131 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dynamic Upstreams", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dynamic-upstreams")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "file.json"), []byte("{}"), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	DescribeTable("validateDynamicUpstreams",
+		func(makeOpts func() options.DynamicUpstreams, expectedMsgs func() []string) {
+			Expect(validateDynamicUpstreams(makeOpts())).To(ConsistOf(expectedMsgs()))
+		},
+		Entry("without a directory", func() options.DynamicUpstreams {
+			return options.DynamicUpstreams{}
+		}, func() []string { return []string{} }),
+		Entry("with a directory and a default TTL", func() options.DynamicUpstreams {
+			return options.DynamicUpstreams{Dir: dir, DefaultTTL: time.Hour}
+		}, func() []string { return []string{} }),
+		Entry("with a missing directory", func() options.DynamicUpstreams {
+			return options.DynamicUpstreams{Dir: filepath.Join(dir, "missing")}
+		}, func() []string {
+			missing := filepath.Join(dir, "missing")
+			return []string{"invalid dynamic_upstreams_dir (\"" + missing + "\"): stat " + missing + ": no such file or directory"}
+		}),
+		Entry("with a file and a negative default TTL", func() options.DynamicUpstreams {
+			return options.DynamicUpstreams{Dir: filepath.Join(dir, "file.json"), DefaultTTL: -time.Hour}
+		}, func() []string {
+			return []string{
+				"invalid dynamic_upstreams_dir (\"" + filepath.Join(dir, "file.json") + "\"): not a directory",
+				"invalid dynamic_upstreams_default_ttl (-1h0m0s): must not be negative",
+			}
+		}),
+		Entry("with a default TTL, but no directory", func() options.DynamicUpstreams {
+			return options.DynamicUpstreams{DefaultTTL: time.Hour}
+		}, func() []string {
+			return []string{"dynamic_upstreams_default_ttl is set, but dynamic_upstreams_dir is not, this will have no effect."}
+		}),
+	)
+
+	Context("ValidateDynamicUpstream", func() {
+		var opts *options.Options
+
+		BeforeEach(func() {
+			opts = options.NewOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{ID: "app", Path: "/", URI: "http://app.internal:8080"},
+					{ID: "api", Path: "/api/", URI: "http://api.internal:8080"},
+					{ID: "health", Path: "/healthz", URI: "http://health.internal:8080"},
+					{ID: "legacy", Path: "^/legacy/(.*)$", URI: "http://legacy.internal:8080", RewriteTarget: "/$1"},
+				},
+			}
+		})
+
+		negativeTTL := options.Duration(-time.Minute)
+		dnsRefresh := options.Duration(time.Minute)
+
+		DescribeTable("validates the upstream",
+			func(upstream options.DynamicUpstream, accepted []options.Upstream, expectedErr string) {
+				err := ValidateDynamicUpstream(opts, upstream, accepted)
+				if expectedErr == "" {
+					Expect(err).ToNot(HaveOccurred())
+					return
+				}
+				Expect(err).To(MatchError(expectedErr))
+			},
+			Entry("with a valid upstream", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/pr-1/", URI: "http://pr-1.preview:8080"},
+			}, nil, ""),
+			Entry("with the ID and path of an accepted upstream", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/pr-1/", URI: "http://pr-1.preview:8080"},
+			}, []options.Upstream{{ID: "pr-1", Path: "/pr-1/"}},
+				"invalid dynamic upstream:\n"+
+					"  multiple upstreams found with id \"pr-1\": upstream ids must be unique\n"+
+					"  multiple upstreams found with path \"/pr-1/\": upstream paths must be unique"),
+			Entry("with the ID of a configured upstream", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "api", Path: "/pr-1/", URI: "http://pr-1.preview:8080"},
+			}, nil, "invalid dynamic upstream:\n  multiple upstreams found with id \"api\": upstream ids must be unique"),
+			Entry("with a path under a configured upstream", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/api/pr-1/", URI: "http://pr-1.preview:8080"},
+			}, nil, "invalid dynamic upstream:\n  upstream \"pr-1\" has path \"/api/pr-1/\" overlapping the path \"/api/\" of configured upstream \"api\""),
+			Entry("with a path prefixing an exact configured path", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/health", URI: "http://pr-1.preview:8080"},
+			}, nil, ""),
+			Entry("with a path matching a configured rewrite upstream", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/legacy/pr-1/", URI: "http://pr-1.preview:8080"},
+			}, nil, "invalid dynamic upstream:\n  upstream \"pr-1\" has path \"/legacy/pr-1/\" overlapping the path \"^/legacy/(.*)$\" of configured upstream \"legacy\""),
+			Entry("with options dynamic upstreams can't use", options.DynamicUpstream{
+				Upstream: options.Upstream{
+					ID:                 "pr-1",
+					Path:               "/",
+					URI:                "http://pr-1.preview:8080",
+					RewriteTarget:      "/app",
+					DNSRefreshInterval: &dnsRefresh,
+					HealthCheck:        &options.UpstreamHealthCheck{},
+				},
+				TTL: &negativeTTL,
+			}, nil,
+				"invalid dynamic upstream:\n"+
+					"  multiple upstreams found with path \"/\": upstream paths must be unique\n"+
+					"  upstream \"pr-1\" has the root path: dynamic upstreams must have more specific paths\n"+
+					"  upstream \"pr-1\" has a rewriteTarget: dynamic upstreams can't rewrite paths\n"+
+					"  upstream \"pr-1\" has a dnsRefreshInterval: dynamic upstreams can't refresh their DNS\n"+
+					"  upstream \"pr-1\" has a healthCheck: dynamic upstreams can't be health checked\n"+
+					"  upstream \"pr-1\" has invalid ttl (-1m0s): must not be negative"),
+			Entry("with an invalid URI", options.DynamicUpstream{
+				Upstream: options.Upstream{ID: "pr-1", Path: "/pr-1/"},
+			}, nil, "invalid dynamic upstream:\n  upstream \"pr-1\" has empty uri: uris are required for all non-static upstreams"),
+		)
+	})
+})
@@ -0,0 +1,40 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"golang.org/x/net/http/httpguts"
+)
+
+func validateExternalAuthz(o options.ExternalAuthz) []string {
+	if o.URL == "" {
+		if o.FailOpen {
+			return []string{"external_authz_fail_open is set, but external_authz_url is not, this will have no effect."}
+		}
+		return []string{}
+	}
+
+	msgs := []string{}
+	if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("external_authz_url (%q) must be an http or https URL", o.URL))
+	}
+	switch o.Type {
+	case options.ExternalAuthzTypeWebhook, options.ExternalAuthzTypeOPA:
+	default:
+		msgs = append(msgs, fmt.Sprintf("external_authz_type (%q) must be one of %q or %q", o.Type, options.ExternalAuthzTypeWebhook, options.ExternalAuthzTypeOPA))
+	}
+	if o.Timeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("external_authz_timeout (%q) must be positive", o.Timeout.String()))
+	}
+	if o.CacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("external_authz_cache_ttl (%q) must not be negative", o.CacheTTL.String()))
+	}
+	for _, header := range o.Headers {
+		if !httpguts.ValidHeaderFieldName(header) {
+			msgs = append(msgs, fmt.Sprintf("external_authz_headers contains an invalid header name %q", header))
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,54 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("External Authorization", func() {
+	valid := func() options.ExternalAuthz {
+		return options.ExternalAuthz{
+			URL:      "http://localhost:8181/v1/data/oauth2proxy/decision",
+			Type:     options.ExternalAuthzTypeOPA,
+			Timeout:  options.DefaultExternalAuthzTimeout,
+			CacheTTL: options.DefaultExternalAuthzCacheTTL,
+			Headers:  []string{"X-Tenant"},
+		}
+	}
+
+	DescribeTable("validateExternalAuthz",
+		func(modify func(*options.ExternalAuthz), expectedMsgs []string) {
+			o := valid()
+			modify(&o)
+			Expect(validateExternalAuthz(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with valid options", func(o *options.ExternalAuthz) {}, []string{}),
+		Entry("without a url", func(o *options.ExternalAuthz) {
+			o.URL = ""
+		}, []string{}),
+		Entry("with fail open, but no url", func(o *options.ExternalAuthz) {
+			o.URL = ""
+			o.FailOpen = true
+		}, []string{"external_authz_fail_open is set, but external_authz_url is not, this will have no effect."}),
+		Entry("with the cache disabled", func(o *options.ExternalAuthz) {
+			o.CacheTTL = 0
+		}, []string{}),
+		Entry("with invalid options", func(o *options.ExternalAuthz) {
+			o.URL = "localhost:8181"
+			o.Type = "grpc"
+			o.Timeout = 0
+			o.CacheTTL = -time.Second
+			o.Headers = []string{"X Tenant"}
+		}, []string{
+			"external_authz_url (\"localhost:8181\") must be an http or https URL",
+			"external_authz_type (\"grpc\") must be one of \"webhook\" or \"opa\"",
+			"external_authz_timeout (\"0s\") must be positive",
+			"external_authz_cache_ttl (\"-1s\") must not be negative",
+			"external_authz_headers contains an invalid header name \"X Tenant\"",
+		}),
+	)
+})
@@ -2,8 +2,12 @@ package validation
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/header"
 )
 
 func validateHeaders(headers []options.Header) []string {
@@ -16,6 +20,38 @@ func validateHeaders(headers []options.Header) []string {
 	return msgs
 }
 
+func validateAuthResponse(authResponse options.AuthResponse) []string {
+	msgs := prefixValues("headers: ", validateHeaders(authResponse.Headers)...)
+
+	if strings.ContainsAny(authResponse.RedirectHeader, " \t\r\n:") {
+		msgs = append(msgs, fmt.Sprintf("invalid redirectHeader %q: header names must not contain whitespace or colons", authResponse.RedirectHeader))
+	}
+	return msgs
+}
+
+// validateResponseHeaderPolicy checks that the headers of the policy have
+// valid, unique names.
+func validateResponseHeaderPolicy(policy []options.ResponseHeaderPolicy) []string {
+	msgs := []string{}
+	names := make(map[string]struct{})
+
+	for _, header := range policy {
+		switch {
+		case header.Name == "":
+			msgs = append(msgs, "header has empty name: names are required for all headers")
+		case strings.ContainsAny(header.Name, " \t\r\n:"):
+			msgs = append(msgs, fmt.Sprintf("invalid header %q: header names must not contain whitespace or colons", header.Name))
+		}
+
+		name := http.CanonicalHeaderKey(header.Name)
+		if _, ok := names[name]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple headers found with name %q: header names must be unique", header.Name))
+		}
+		names[name] = struct{}{}
+	}
+	return msgs
+}
+
 func validateHeader(header options.Header, names map[string]struct{}) []string {
 	msgs := []string{}
 
@@ -40,10 +76,12 @@ func validateHeader(header options.Header, names map[string]struct{}) []string {
 
 func validateHeaderValue(name string, value options.HeaderValue) []string {
 	switch {
-	case value.SecretSource != nil && value.ClaimSource == nil:
+	case value.SecretSource != nil && value.ClaimSource == nil && value.TemplateSource == nil:
 		return []string{validateSecretSource(*value.SecretSource)}
-	case value.SecretSource == nil && value.ClaimSource != nil:
+	case value.SecretSource == nil && value.ClaimSource != nil && value.TemplateSource == nil:
 		return validateHeaderValueClaimSource(*value.ClaimSource)
+	case value.SecretSource == nil && value.ClaimSource == nil && value.TemplateSource != nil:
+		return validateHeaderValueTemplateSource(name, *value.TemplateSource)
 	default:
 		return []string{"header value has multiple entries: only one entry per value is allowed"}
 	}
@@ -61,3 +99,23 @@ func validateHeaderValueClaimSource(claim options.ClaimSource) []string {
 	}
 	return msgs
 }
+
+func validateHeaderValueTemplateSource(name string, source options.TemplateSource) []string {
+	if source.Template == "" {
+		return []string{"template should not be empty"}
+	}
+	if _, err := header.ParseTemplate(name, source); err != nil {
+		return []string{err.Error()}
+	}
+	return []string{}
+}
+
+// templateSourceClaims returns the claims used by the template, in order
+func templateSourceClaims(source options.TemplateSource) []string {
+	claims := make([]string, 0, len(source.Claims))
+	for _, claim := range source.Claims {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims)
+	return claims
+}
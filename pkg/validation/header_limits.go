@@ -0,0 +1,18 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// validateRequestHeaderLimits validates the limits on the headers of requests
+// to upstreams
+func validateRequestHeaderLimits(o *options.Options) []string {
+	msgs := []string{}
+	if o.MaxRequestHeaderBytes < 0 {
+		msgs = append(msgs, "max_request_header_bytes must not be negative")
+	}
+	if o.MaxRequestCookies < 0 {
+		msgs = append(msgs, "max_request_cookies must not be negative")
+	}
+	return msgs
+}
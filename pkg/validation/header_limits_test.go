@@ -0,0 +1,42 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Header Limits", func() {
+	type validateRequestHeaderLimitsTableInput struct {
+		maxHeaderBytes int
+		maxCookies     int
+		errStrings     []string
+	}
+
+	DescribeTable("validateRequestHeaderLimits",
+		func(in validateRequestHeaderLimitsTableInput) {
+			opts := &options.Options{
+				MaxRequestHeaderBytes: in.maxHeaderBytes,
+				MaxRequestCookies:     in.maxCookies,
+			}
+			Expect(validateRequestHeaderLimits(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Disabled", validateRequestHeaderLimitsTableInput{
+			errStrings: []string{},
+		}),
+		Entry("With limits", validateRequestHeaderLimitsTableInput{
+			maxHeaderBytes: 16384,
+			maxCookies:     50,
+			errStrings:     []string{},
+		}),
+		Entry("With negative limits", validateRequestHeaderLimitsTableInput{
+			maxHeaderBytes: -1,
+			maxCookies:     -1,
+			errStrings: []string{
+				"max_request_header_bytes must not be negative",
+				"max_request_cookies must not be negative",
+			},
+		}),
+	)
+})
@@ -160,5 +160,129 @@ var _ = Describe("Headers", func() {
 				"invalid header \"With-Invalid-Basic-Auth\": invalid values: invalid basicAuthPassword: error loading secret from environent: no value for for key \"UNKNOWN_ENV\"",
 			},
 		}),
+		Entry("with a header with a valid template", validateHeaderTableInput{
+			headers: []options.Header{
+				{
+					Name: "X-User",
+					Values: []options.HeaderValue{
+						{
+							TemplateSource: &options.TemplateSource{
+								Template: "{{ .PreferredUsername }}@{{ .TenantID }}",
+								Claims:   map[string]string{"TenantID": "tid"},
+							},
+						},
+					},
+				},
+			},
+			expectedMsgs: []string{},
+		}),
+		Entry("with a header with invalid templates", validateHeaderTableInput{
+			headers: []options.Header{
+				{
+					Name: "With-Invalid-Template",
+					Values: []options.HeaderValue{
+						{
+							TemplateSource: &options.TemplateSource{},
+						},
+						{
+							TemplateSource: &options.TemplateSource{
+								Template: "{{ .TenantID }}",
+							},
+						},
+						{
+							ClaimSource: &options.ClaimSource{
+								Claim: "email",
+							},
+							TemplateSource: &options.TemplateSource{
+								Template: "{{ .Email }}",
+							},
+						},
+					},
+				},
+			},
+			expectedMsgs: []string{
+				"invalid header \"With-Invalid-Template\": invalid values: template should not be empty",
+				"invalid header \"With-Invalid-Template\": invalid values: template uses unknown field \"TenantID\": add it to claims",
+				"invalid header \"With-Invalid-Template\": invalid values: header value has multiple entries: only one entry per value is allowed",
+			},
+		}),
+	)
+
+	type validateAuthResponseTableInput struct {
+		authResponse options.AuthResponse
+		expectedMsgs []string
+	}
+
+	DescribeTable("validateAuthResponse",
+		func(in validateAuthResponseTableInput) {
+			Expect(validateAuthResponse(in.authResponse)).To(ConsistOf(in.expectedMsgs))
+		},
+		Entry("with valid headers and redirect header", validateAuthResponseTableInput{
+			authResponse: options.AuthResponse{
+				Headers:        []options.Header{validHeader1, validHeader2},
+				PrefixHeaders:  true,
+				RedirectHeader: "Location",
+			},
+			expectedMsgs: []string{},
+		}),
+		Entry("with invalid headers", validateAuthResponseTableInput{
+			authResponse: options.AuthResponse{
+				Headers: []options.Header{validHeader1, validHeader1},
+			},
+			expectedMsgs: []string{
+				"headers: multiple headers found with name \"X-Email\": header names must be unique",
+			},
+		}),
+		Entry("with an invalid redirect header", validateAuthResponseTableInput{
+			authResponse: options.AuthResponse{
+				RedirectHeader: "Redirect To:",
+			},
+			expectedMsgs: []string{
+				"invalid redirectHeader \"Redirect To:\": header names must not contain whitespace or colons",
+			},
+		}),
+	)
+
+	type validateResponseHeaderPolicyTableInput struct {
+		policy       []options.ResponseHeaderPolicy
+		expectedMsgs []string
+	}
+
+	DescribeTable("validateResponseHeaderPolicy",
+		func(in validateResponseHeaderPolicyTableInput) {
+			Expect(validateResponseHeaderPolicy(in.policy)).To(ConsistOf(in.expectedMsgs))
+		},
+		Entry("with valid headers", validateResponseHeaderPolicyTableInput{
+			policy: []options.ResponseHeaderPolicy{
+				{Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+				{Name: "Content-Security-Policy", Value: "default-src 'self'", Overwrite: true},
+			},
+			expectedMsgs: []string{},
+		}),
+		Entry("with an empty name", validateResponseHeaderPolicyTableInput{
+			policy: []options.ResponseHeaderPolicy{
+				{Value: "nosniff"},
+			},
+			expectedMsgs: []string{
+				"header has empty name: names are required for all headers",
+			},
+		}),
+		Entry("with an invalid name", validateResponseHeaderPolicyTableInput{
+			policy: []options.ResponseHeaderPolicy{
+				{Name: "Referrer Policy:", Value: "no-referrer"},
+			},
+			expectedMsgs: []string{
+				"invalid header \"Referrer Policy:\": header names must not contain whitespace or colons",
+			},
+		}),
+		Entry("with duplicate names", validateResponseHeaderPolicyTableInput{
+			policy: []options.ResponseHeaderPolicy{
+				{Name: "X-Frame-Options", Value: "DENY"},
+				{Name: "x-frame-options", Value: "SAMEORIGIN"},
+			},
+			expectedMsgs: []string{
+				"multiple headers found with name \"x-frame-options\": header names must be unique",
+			},
+		}),
 	)
 })
@@ -0,0 +1,22 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/assertion"
+)
+
+func validateIdentityAssertion(o options.IdentityAssertion) []string {
+	if o.SigningKeyFile == "" && o.SigningJWKSFile == "" {
+		if len(o.VerificationKeyFiles) > 0 {
+			return []string{"identity_assertion_verification_key_files requires identity_assertion_signing_key_file or identity_assertion_signing_jwks_file to be set"}
+		}
+		return []string{}
+	}
+
+	if _, err := assertion.NewSigner(o); err != nil {
+		return []string{fmt.Sprintf("invalid identity assertion configuration: %v", err)}
+	}
+	return []string{}
+}
@@ -0,0 +1,80 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identity Assertion", func() {
+	type validateIdentityAssertionTableInput struct {
+		opts       options.IdentityAssertion
+		errStrings []string
+	}
+
+	DescribeTable("validateIdentityAssertion",
+		func(in *validateIdentityAssertionTableInput) {
+			Expect(validateIdentityAssertion(in.opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Disabled", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				Header: options.DefaultIdentityAssertionHeader,
+				Expiry: time.Minute,
+			},
+			errStrings: []string{},
+		}),
+		Entry("Verification keys without a signing key", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				VerificationKeyFiles: []string{"/etc/oauth2-proxy/previous.pub"},
+				Header:               options.DefaultIdentityAssertionHeader,
+				Expiry:               time.Minute,
+			},
+			errStrings: []string{
+				"identity_assertion_verification_key_files requires identity_assertion_signing_key_file or identity_assertion_signing_jwks_file to be set",
+			},
+		}),
+		Entry("Missing signing key", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				SigningKeyFile: "/does/not/exist.pem",
+				Header:         options.DefaultIdentityAssertionHeader,
+				Expiry:         time.Minute,
+			},
+			errStrings: []string{
+				"invalid identity assertion configuration: could not read signing key file: /does/not/exist.pem",
+			},
+		}),
+		Entry("Missing signing JWKS", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				SigningJWKSFile: "/does/not/exist.json",
+				Header:          options.DefaultIdentityAssertionHeader,
+				Expiry:          time.Minute,
+			},
+			errStrings: []string{
+				"invalid identity assertion configuration: could not read signing JWKS file: /does/not/exist.json",
+			},
+		}),
+		Entry("Signing key and signing JWKS", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				SigningKeyFile:  "/etc/oauth2-proxy/signing.pem",
+				SigningJWKSFile: "/etc/oauth2-proxy/signing.json",
+				Header:          options.DefaultIdentityAssertionHeader,
+				Expiry:          time.Minute,
+			},
+			errStrings: []string{
+				"invalid identity assertion configuration: only one of a signing key file and a signing JWKS file may be configured",
+			},
+		}),
+		Entry("Expiry not set", &validateIdentityAssertionTableInput{
+			opts: options.IdentityAssertion{
+				SigningKeyFile: "/does/not/exist.pem",
+				Header:         options.DefaultIdentityAssertionHeader,
+			},
+			errStrings: []string{
+				"invalid identity assertion configuration: expiry must be greater than 0, got 0s",
+			},
+		}),
+	)
+})
@@ -0,0 +1,26 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateIntrospection(o options.Introspection) []string {
+	if o.URL == "" {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("introspection_url (%q) must be an http or https URL", o.URL))
+	}
+	if o.ClientSecret != "" && o.ClientID == "" {
+		msgs = append(msgs, "introspection_client_secret requires introspection_client_id to be set")
+	}
+	if o.CacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("introspection_cache_ttl (%q) must not be negative", o.CacheTTL.String()))
+	}
+	return msgs
+}
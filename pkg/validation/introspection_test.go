@@ -0,0 +1,44 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Introspection", func() {
+	DescribeTable("validateIntrospection",
+		func(introspection options.Introspection, errStrings []string) {
+			Expect(validateIntrospection(introspection)).To(ConsistOf(errStrings))
+		},
+		Entry("Disabled", options.Introspection{
+			CacheTTL: -time.Minute,
+		}, []string{}),
+		Entry("With client credentials", options.Introspection{
+			URL:          "https://auth.example.com/introspect",
+			ClientID:     "proxy",
+			ClientSecret: "secret",
+			CacheTTL:     time.Minute,
+		}, []string{}),
+		Entry("With an invalid URL", options.Introspection{
+			URL: "auth.example.com/introspect",
+		}, []string{
+			`introspection_url ("auth.example.com/introspect") must be an http or https URL`,
+		}),
+		Entry("With a client secret without a client ID", options.Introspection{
+			URL:          "https://auth.example.com/introspect",
+			ClientSecret: "secret",
+		}, []string{
+			"introspection_client_secret requires introspection_client_id to be set",
+		}),
+		Entry("With a negative cache TTL", options.Introspection{
+			URL:      "https://auth.example.com/introspect",
+			CacheTTL: -time.Minute,
+		}, []string{
+			`introspection_cache_ttl ("-1m0s") must not be negative`,
+		}),
+	)
+})
@@ -0,0 +1,31 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// kubernetesNamespaceRegex matches the names of Kubernetes namespaces, which
+// are DNS labels
+var kubernetesNamespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func validateKubernetesDiscovery(o *options.Options) []string {
+	msgs := []string{}
+	discovery := o.KubernetesDiscovery
+	if discovery.Selector == "" {
+		if discovery.Namespace != "" {
+			msgs = append(msgs, "kubernetes_discovery_namespace is set, but kubernetes_discovery_selector is not, this will have no effect.")
+		}
+		return msgs
+	}
+
+	if discovery.Namespace != "" && !kubernetesNamespaceRegex.MatchString(discovery.Namespace) {
+		msgs = append(msgs, fmt.Sprintf("invalid kubernetes_discovery_namespace (%q): must be a DNS label", discovery.Namespace))
+	}
+	if o.DynamicUpstreams.Dir != "" {
+		msgs = append(msgs, "kubernetes_discovery_selector and dynamic_upstreams_dir can't both be set: the discovered upstreams would replace the upstreams of the directory")
+	}
+	return msgs
+}
@@ -0,0 +1,36 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kubernetes Discovery", func() {
+	DescribeTable("validateKubernetesDiscovery",
+		func(o *options.Options, expectedMsgs []string) {
+			Expect(validateKubernetesDiscovery(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("without a selector", &options.Options{}, []string{}),
+		Entry("with a selector and a namespace", &options.Options{
+			KubernetesDiscovery: options.KubernetesDiscovery{Selector: "oauth2-proxy/expose=true", Namespace: "apps"},
+		}, []string{}),
+		Entry("with a namespace, but no selector", &options.Options{
+			KubernetesDiscovery: options.KubernetesDiscovery{Namespace: "apps"},
+		}, []string{
+			"kubernetes_discovery_namespace is set, but kubernetes_discovery_selector is not, this will have no effect.",
+		}),
+		Entry("with an invalid namespace", &options.Options{
+			KubernetesDiscovery: options.KubernetesDiscovery{Selector: "app", Namespace: "Apps_1"},
+		}, []string{
+			"invalid kubernetes_discovery_namespace (\"Apps_1\"): must be a DNS label",
+		}),
+		Entry("with a dynamic upstreams directory", &options.Options{
+			KubernetesDiscovery: options.KubernetesDiscovery{Selector: "app"},
+			DynamicUpstreams:    options.DynamicUpstreams{Dir: "/etc/oauth2-proxy/dynamic"},
+		}, []string{
+			"kubernetes_discovery_selector and dynamic_upstreams_dir can't both be set: the discovered upstreams would replace the upstreams of the directory",
+		}),
+	)
+})
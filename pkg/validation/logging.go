@@ -1,7 +1,9 @@
 package validation
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
@@ -10,6 +12,21 @@ import (
 
 // configureLogger is responsible for configuring the logger based on the options given
 func configureLogger(o options.Logging, msgs []string) []string {
+	switch o.RequestIDTrust {
+	case options.RequestIDTrustAlways, options.RequestIDTrustNever, options.RequestIDTrustTrustedProxies:
+	default:
+		msgs = append(msgs, fmt.Sprintf("request_id_trust (%s) must be one of: %s, %s, %s", o.RequestIDTrust,
+			options.RequestIDTrustAlways, options.RequestIDTrustNever, options.RequestIDTrustTrustedProxies))
+	}
+	switch o.RequestEncoding {
+	case logger.RequestLoggingEncodingText, logger.RequestLoggingEncodingJSON, logger.RequestLoggingEncodingLogfmt:
+	default:
+		msgs = append(msgs, fmt.Sprintf("request_logging_encoding (%s) must be one of: %s, %s, %s", o.RequestEncoding,
+			logger.RequestLoggingEncodingText, logger.RequestLoggingEncodingJSON, logger.RequestLoggingEncodingLogfmt))
+	}
+	msgs = append(msgs, validateSlowRequestLog(o.SlowRequests)...)
+	msgs = append(msgs, validateRequestDebugLog(o.RequestDebug)...)
+
 	// Setup the log file
 	if len(o.File.Filename) > 0 {
 		// Validate that the file/dir can be written
@@ -46,11 +63,13 @@ func configureLogger(o options.Logging, msgs []string) []string {
 	// Pass configuration values to the standard logger
 	logger.SetStandardEnabled(o.StandardEnabled)
 	logger.SetErrToInfo(o.ErrToInfo)
+	logger.SetDebugEnabled(o.DebugEnabled)
 	logger.SetAuthEnabled(o.AuthEnabled)
 	logger.SetReqEnabled(o.RequestEnabled)
 	logger.SetStandardTemplate(o.StandardFormat)
 	logger.SetAuthTemplate(o.AuthFormat)
 	logger.SetReqTemplate(o.RequestFormat)
+	logger.SetReqEncoding(o.RequestEncoding)
 
 	logger.SetExcludePaths(o.ExcludePaths)
 
@@ -60,3 +79,37 @@ func configureLogger(o options.Logging, msgs []string) []string {
 
 	return msgs
 }
+
+// validateSlowRequestLog checks the slow request threshold and path length
+// are not negative, and that the sample rate is a fraction
+func validateSlowRequestLog(o options.SlowRequestLog) []string {
+	msgs := []string{}
+	if o.Threshold < 0 {
+		msgs = append(msgs, fmt.Sprintf("slow_request_threshold (%s) must not be negative", o.Threshold))
+	}
+	if o.SampleRate < 0 || o.SampleRate > 1 {
+		msgs = append(msgs, fmt.Sprintf("slow_request_sample_rate (%v) must be between 0 and 1", o.SampleRate))
+	}
+	if o.MaxPathLength < 0 {
+		msgs = append(msgs, fmt.Sprintf("slow_request_max_path_length (%d) must not be negative", o.MaxPathLength))
+	}
+	return msgs
+}
+
+// validateRequestDebugLog checks the request debug header is a valid header
+// name, given along with its secret
+func validateRequestDebugLog(o options.RequestDebugLog) []string {
+	msgs := []string{}
+	switch header := o.Header; {
+	case header == "" && o.Secret != "":
+		msgs = append(msgs, "request_debug_secret is set without a request_debug_header, this will have no effect.")
+	case header == "":
+	case o.Secret == "":
+		msgs = append(msgs, "request_debug_header is set without a request_debug_secret, this will have no effect.")
+	case strings.ContainsAny(header, " ,;:\t\"()<>@/[]?={}"):
+		msgs = append(msgs, fmt.Sprintf("invalid request_debug_header (%q): must be a header name", header))
+	case isHopByHopHeader(header):
+		msgs = append(msgs, fmt.Sprintf("invalid request_debug_header (%q): must not be a hop-by-hop header", header))
+	}
+	return msgs
+}
@@ -0,0 +1,41 @@
+package validation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// validateMaintenance validates the options of the maintenance mode.
+// The maintenance file's directory is watched, so it must exist even while
+// the file doesn't.
+func validateMaintenance(o *options.Options) []string {
+	maintenance := o.Maintenance
+	msgs := []string{}
+
+	if maintenance.File != "" {
+		dir := filepath.Dir(maintenance.File)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			msgs = append(msgs, fmt.Sprintf("maintenance_file (%s) is invalid: its directory %s does not exist", maintenance.File, dir))
+		}
+	}
+	if maintenance.Signal && runtime.GOOS == "windows" {
+		msgs = append(msgs, "maintenance_signal is not supported on Windows")
+	}
+	if maintenance.RetryAfter < 0 {
+		msgs = append(msgs, fmt.Sprintf("maintenance_retry_after (%q) must not be negative", maintenance.RetryAfter.String()))
+	}
+
+	managed := o.ManagementServer.Enabled() && o.Management.Maintenance
+	if !maintenance.Enabled && maintenance.File == "" && !maintenance.Signal && !managed &&
+		(len(maintenance.BypassGroups) > 0 || maintenance.RetryAfter > 0 || maintenance.Unready) {
+		msgs = append(msgs, "maintenance options are set, but none of maintenance_mode, maintenance_file, maintenance_signal or management_maintenance are, this will have no effect.")
+	}
+	if maintenance.Unready && (!o.ManagementServer.Enabled() || !o.Management.Readiness) {
+		msgs = append(msgs, "maintenance_unready is set, but management_readiness is not served on a management server, this will have no effect.")
+	}
+	return msgs
+}
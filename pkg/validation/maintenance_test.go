@@ -0,0 +1,98 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Maintenance", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "oauth2-proxy-maintenance")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	type validateMaintenanceTableInput struct {
+		maintenance      options.Maintenance
+		management       options.Management
+		managementServer options.Server
+		// file is joined to the temporary directory when set
+		file       string
+		errStrings []string
+	}
+
+	DescribeTable("validateMaintenance",
+		func(in *validateMaintenanceTableInput) {
+			opts := &options.Options{
+				Maintenance:      in.maintenance,
+				Management:       in.management,
+				ManagementServer: in.managementServer,
+			}
+			if in.file != "" {
+				opts.Maintenance.File = filepath.Join(dir, in.file)
+			}
+
+			errStrings := []string{}
+			for _, errString := range in.errStrings {
+				errStrings = append(errStrings, os.Expand(errString, func(string) string { return dir }))
+			}
+			Expect(validateMaintenance(opts)).To(ConsistOf(errStrings))
+		},
+		Entry("No maintenance options", &validateMaintenanceTableInput{
+			errStrings: []string{},
+		}),
+		Entry("A maintenance file", &validateMaintenanceTableInput{
+			maintenance: options.Maintenance{
+				RetryAfter:   5 * time.Minute,
+				BypassGroups: []string{"admins"},
+			},
+			file:       "maintenance",
+			errStrings: []string{},
+		}),
+		Entry("A maintenance file in a missing directory", &validateMaintenanceTableInput{
+			file: "missing/maintenance",
+			errStrings: []string{
+				"maintenance_file (${dir}/missing/maintenance) is invalid: its directory ${dir}/missing does not exist",
+			},
+		}),
+		Entry("A negative retry after", &validateMaintenanceTableInput{
+			maintenance: options.Maintenance{Enabled: true, RetryAfter: -time.Second},
+			errStrings: []string{
+				`maintenance_retry_after ("-1s") must not be negative`,
+			},
+		}),
+		Entry("Options without a way to enable the maintenance mode", &validateMaintenanceTableInput{
+			maintenance: options.Maintenance{BypassGroups: []string{"admins"}},
+			errStrings: []string{
+				"maintenance options are set, but none of maintenance_mode, maintenance_file, maintenance_signal or management_maintenance are, this will have no effect.",
+			},
+		}),
+		Entry("The maintenance endpoint of the management server", &validateMaintenanceTableInput{
+			maintenance:      options.Maintenance{BypassGroups: []string{"admins"}, Unready: true},
+			management:       options.Management{Maintenance: true, Readiness: true},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			errStrings:       []string{},
+		}),
+		Entry("Unready without the readiness endpoint", &validateMaintenanceTableInput{
+			maintenance:      options.Maintenance{Signal: true, Unready: true},
+			management:       options.Management{Readiness: false},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			errStrings: []string{
+				"maintenance_unready is set, but management_readiness is not served on a management server, this will have no effect.",
+			},
+		}),
+	)
+})
@@ -0,0 +1,62 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+)
+
+// validateManagement validates the options of the management server.
+// The metrics can't be served by both the metrics and the management
+// servers, so that it is clear which of their auth options protects them.
+// The endpoints changing the state of the proxy, or exposing the sessions of
+// its users, can't be served without auth.
+func validateManagement(o *options.Options) []string {
+	msgs := []string{}
+	if !o.ManagementServer.Enabled() {
+		if o.Management.Pprof {
+			msgs = append(msgs, "management_pprof is set, but management_address is not, this will have no effect.")
+		}
+		if o.Management.Maintenance {
+			msgs = append(msgs, "management_maintenance is set, but management_address is not, this will have no effect.")
+		}
+		if o.Management.Cache {
+			msgs = append(msgs, "management_cache is set, but management_address is not, this will have no effect.")
+		}
+		if o.Management.Sessions {
+			msgs = append(msgs, "management_sessions is set, but management_address is not, this will have no effect.")
+		}
+		if o.Management.BearerToken != "" || o.Management.BasicAuth || len(o.Management.AllowedIPs) > 0 {
+			msgs = append(msgs, "management auth is set, but management_address is not, this will have no effect.")
+		}
+		return msgs
+	}
+
+	if o.Management.Metrics && o.MetricsServer.Enabled() {
+		msgs = append(msgs, "metrics_address and management_address are both set: unset metrics_address to serve /metrics on the management server, or set management_metrics to false")
+	}
+	if o.Management.Sessions && !o.Session.Inventory {
+		msgs = append(msgs, "management_sessions requires session_inventory to be set")
+	}
+	if o.Management.BearerToken == "" && !o.Management.BasicAuth && len(o.Management.AllowedIPs) == 0 {
+		if o.Management.Maintenance {
+			msgs = append(msgs, "management_maintenance requires management_bearer_token, management_basic_auth or management_allowed_ips to be set")
+		}
+		if o.Management.Cache {
+			msgs = append(msgs, "management_cache requires management_bearer_token, management_basic_auth or management_allowed_ips to be set")
+		}
+		if o.Management.Sessions {
+			msgs = append(msgs, "management_sessions requires management_bearer_token, management_basic_auth or management_allowed_ips to be set")
+		}
+	}
+	if o.Management.BasicAuth && o.HtpasswdFile == "" {
+		msgs = append(msgs, "management_basic_auth requires htpasswd_file to be set")
+	}
+	for i, ipStr := range o.Management.AllowedIPs {
+		if nil == ip.ParseIPNet(ipStr) {
+			msgs = append(msgs, fmt.Sprintf("management_allowed_ips[%d] (%s) could not be recognized", i, ipStr))
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,134 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Management", func() {
+	type validateManagementTableInput struct {
+		management       options.Management
+		managementServer options.Server
+		metricsServer    options.Server
+		htpasswdFile     string
+		sessionInventory bool
+		errStrings       []string
+	}
+
+	DescribeTable("validateManagement",
+		func(in *validateManagementTableInput) {
+			opts := &options.Options{
+				HtpasswdFile:     in.htpasswdFile,
+				Management:       in.management,
+				ManagementServer: in.managementServer,
+				MetricsServer:    in.metricsServer,
+				Session:          options.SessionOptions{Inventory: in.sessionInventory},
+			}
+			Expect(validateManagement(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("No management server", &validateManagementTableInput{
+			management: options.Management{Metrics: true},
+			errStrings: []string{},
+		}),
+		Entry("A disabled management server", &validateManagementTableInput{
+			management:       options.Management{Pprof: true},
+			managementServer: options.Server{BindAddress: "-"},
+			errStrings: []string{
+				"management_pprof is set, but management_address is not, this will have no effect.",
+			},
+		}),
+		Entry("The maintenance endpoint without a management server", &validateManagementTableInput{
+			management: options.Management{Maintenance: true},
+			errStrings: []string{
+				"management_maintenance is set, but management_address is not, this will have no effect.",
+			},
+		}),
+		Entry("The cache endpoint without a management server", &validateManagementTableInput{
+			management: options.Management{Cache: true},
+			errStrings: []string{
+				"management_cache is set, but management_address is not, this will have no effect.",
+			},
+		}),
+		Entry("The sessions endpoint without a management server", &validateManagementTableInput{
+			management:       options.Management{Sessions: true},
+			sessionInventory: true,
+			errStrings: []string{
+				"management_sessions is set, but management_address is not, this will have no effect.",
+			},
+		}),
+		Entry("The sessions endpoint with a session inventory", &validateManagementTableInput{
+			management:       options.Management{Sessions: true, BearerToken: "token"},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			sessionInventory: true,
+			errStrings:       []string{},
+		}),
+		Entry("The sessions endpoint without a session inventory", &validateManagementTableInput{
+			management:       options.Management{Sessions: true, AllowedIPs: []string{"127.0.0.1"}},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			errStrings: []string{
+				"management_sessions requires session_inventory to be set",
+			},
+		}),
+		Entry("Endpoints changing the state of the proxy without auth", &validateManagementTableInput{
+			management:       options.Management{Maintenance: true, Cache: true, Sessions: true},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			sessionInventory: true,
+			errStrings: []string{
+				"management_maintenance requires management_bearer_token, management_basic_auth or management_allowed_ips to be set",
+				"management_cache requires management_bearer_token, management_basic_auth or management_allowed_ips to be set",
+				"management_sessions requires management_bearer_token, management_basic_auth or management_allowed_ips to be set",
+			},
+		}),
+		Entry("Endpoints changing the state of the proxy with basic auth", &validateManagementTableInput{
+			management:       options.Management{Maintenance: true, Cache: true, BasicAuth: true},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			htpasswdFile:     "/etc/oauth2-proxy/htpasswd",
+			errStrings:       []string{},
+		}),
+		Entry("Auth without a management server", &validateManagementTableInput{
+			management: options.Management{BearerToken: "token"},
+			errStrings: []string{
+				"management auth is set, but management_address is not, this will have no effect.",
+			},
+		}),
+		Entry("A protected management server", &validateManagementTableInput{
+			management: options.Management{
+				Metrics:     true,
+				Pprof:       true,
+				BearerToken: "token",
+				BasicAuth:   true,
+				AllowedIPs:  []string{"10.0.0.0/8", "127.0.0.1"},
+			},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			htpasswdFile:     "/etc/oauth2-proxy/htpasswd",
+			errStrings:       []string{},
+		}),
+		Entry("Metrics on both the metrics and management servers", &validateManagementTableInput{
+			management:       options.Management{Metrics: true},
+			managementServer: options.Server{SecureBindAddress: "127.0.0.1:9201"},
+			metricsServer:    options.Server{BindAddress: "127.0.0.1:9100"},
+			errStrings: []string{
+				"metrics_address and management_address are both set: unset metrics_address to serve /metrics on the management server, or set management_metrics to false",
+			},
+		}),
+		Entry("The metrics server without metrics on the management server", &validateManagementTableInput{
+			management:       options.Management{Metrics: false},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			metricsServer:    options.Server{BindAddress: "127.0.0.1:9100"},
+			errStrings:       []string{},
+		}),
+		Entry("Basic auth without an htpasswd file and invalid allowed IPs", &validateManagementTableInput{
+			management: options.Management{
+				BasicAuth:  true,
+				AllowedIPs: []string{"not-an-ip"},
+			},
+			managementServer: options.Server{BindAddress: "127.0.0.1:9200"},
+			errStrings: []string{
+				"management_basic_auth requires htpasswd_file to be set",
+				"management_allowed_ips[0] (not-an-ip) could not be recognized",
+			},
+		}),
+	)
+})
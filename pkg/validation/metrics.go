@@ -0,0 +1,22 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+)
+
+// validateMetricsAuth validates the options protecting the metrics server
+func validateMetricsAuth(o *options.Options) []string {
+	msgs := []string{}
+	if o.MetricsAuth.BasicAuth && o.HtpasswdFile == "" {
+		msgs = append(msgs, "metrics_basic_auth requires htpasswd_file to be set")
+	}
+	for i, ipStr := range o.MetricsAuth.AllowedIPs {
+		if nil == ip.ParseIPNet(ipStr) {
+			msgs = append(msgs, fmt.Sprintf("metrics_allowed_ips[%d] (%s) could not be recognized", i, ipStr))
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,54 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	type validateMetricsAuthTableInput struct {
+		metricsAuth  options.MetricsAuth
+		htpasswdFile string
+		errStrings   []string
+	}
+
+	DescribeTable("validateMetricsAuth",
+		func(in *validateMetricsAuthTableInput) {
+			opts := &options.Options{
+				HtpasswdFile: in.htpasswdFile,
+				MetricsAuth:  in.metricsAuth,
+			}
+			Expect(validateMetricsAuth(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("No protection", &validateMetricsAuthTableInput{
+			errStrings: []string{},
+		}),
+		Entry("Valid protection", &validateMetricsAuthTableInput{
+			metricsAuth: options.MetricsAuth{
+				BearerToken: "token",
+				BasicAuth:   true,
+				AllowedIPs:  []string{"10.0.0.0/8", "127.0.0.1"},
+			},
+			htpasswdFile: "/etc/oauth2-proxy/htpasswd",
+			errStrings:   []string{},
+		}),
+		Entry("Basic auth without an htpasswd file", &validateMetricsAuthTableInput{
+			metricsAuth: options.MetricsAuth{
+				BasicAuth: true,
+			},
+			errStrings: []string{
+				"metrics_basic_auth requires htpasswd_file to be set",
+			},
+		}),
+		Entry("Invalid allowed IPs", &validateMetricsAuthTableInput{
+			metricsAuth: options.MetricsAuth{
+				AllowedIPs: []string{"10.0.0.0/8", "not-an-ip"},
+			},
+			errStrings: []string{
+				"metrics_allowed_ips[1] (not-an-ip) could not be recognized",
+			},
+		}),
+	)
+})
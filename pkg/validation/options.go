@@ -21,11 +21,49 @@ import (
 func Validate(o *options.Options) error {
 	msgs := validateCookie(o.Cookie)
 	msgs = append(msgs, validateSessionCookieMinimal(o)...)
+	msgs = append(msgs, validateSessionCookieRefreshLock(o)...)
 	msgs = append(msgs, validateRedisSessionStore(o)...)
+	msgs = append(msgs, validateRedisSessionCleanup(o)...)
+	msgs = append(msgs, validateMemorySessionStore(o)...)
+	msgs = append(msgs, validateSQLSessionStore(o)...)
+	msgs = append(msgs, validateSessionStoreClaims(o)...)
+	msgs = append(msgs, validateSessionKMS(o)...)
+	msgs = append(msgs, validateSessionStoreUnavailable(o)...)
+	msgs = append(msgs, validateSessionBearerTokens(o)...)
+	msgs = append(msgs, validateSessionMaxPerUser(o)...)
+	msgs = append(msgs, validateSessionBackchannelLogout(o)...)
+	msgs = append(msgs, validateSessionInventory(o)...)
 	msgs = append(msgs, prefixValues("injectRequestHeaders: ", validateHeaders(o.InjectRequestHeaders)...)...)
 	msgs = append(msgs, prefixValues("injectResponseHeaders: ", validateHeaders(o.InjectResponseHeaders)...)...)
+	msgs = append(msgs, prefixValues("authResponse: ", validateAuthResponse(o.AuthResponse)...)...)
+	msgs = append(msgs, prefixValues("responseHeaderPolicy: ", validateResponseHeaderPolicy(o.ResponseHeaderPolicy)...)...)
 	msgs = append(msgs, validateProviders(o)...)
 	msgs = append(msgs, validateAPIRoutes(o)...)
+	msgs = append(msgs, validateAPIClientRules(o)...)
+	msgs = append(msgs, validateRouteAccessRules(o)...)
+	msgs = append(msgs, validateCORS(o.CORS)...)
+	msgs = append(msgs, validateRedirect(o.Redirect)...)
+	msgs = append(msgs, validateMetricsAuth(o)...)
+	msgs = append(msgs, validateManagement(o)...)
+	msgs = append(msgs, validateMaintenance(o)...)
+	msgs = append(msgs, validateTracing(o.Tracing)...)
+	msgs = append(msgs, validateIdentityAssertion(o.IdentityAssertion)...)
+	msgs = append(msgs, validateSignedURL(o)...)
+	msgs = append(msgs, validateIntrospection(o.Introspection)...)
+	msgs = append(msgs, validateProbe(o.Probe)...)
+	msgs = append(msgs, validateSessionEvents(o)...)
+	msgs = append(msgs, validateAudit(o)...)
+	msgs = append(msgs, validateCrawlers(o.Crawlers)...)
+	msgs = append(msgs, validateSessionDebug(o.SessionDebug)...)
+	msgs = append(msgs, validateDynamicUpstreams(o.DynamicUpstreams)...)
+	msgs = append(msgs, validateKubernetesDiscovery(o)...)
+	msgs = append(msgs, validateProviderFallback(o)...)
+	msgs = append(msgs, validateClaimEnrichment(o.ClaimEnrichment)...)
+	msgs = append(msgs, validateExternalAuthz(o.ExternalAuthz)...)
+	msgs = append(msgs, validateRequestHeaderLimits(o)...)
+	msgs = append(msgs, validateServers(o)...)
+	msgs = append(msgs, validateExternalURLPrefix(o)...)
+	msgs = append(msgs, validateStrictSecurity(o)...)
 	msgs = configureLogger(o.Logging, msgs)
 	msgs = parseSignatureKey(o, msgs)
 
@@ -83,9 +121,15 @@ func Validate(o *options.Options) error {
 	}
 
 	msgs = append(msgs, validateUpstreams(o.UpstreamServers)...)
+	msgs = append(msgs, validateUpstreamAuthorization(o)...)
+	for _, warning := range authorizationHeaderWarnings(o.InjectRequestHeaders) {
+		logger.Printf("WARNING: %s", warning)
+	}
+	msgs = append(msgs, validateUpstreamTokenRequirements(o)...)
+	msgs = append(msgs, validateUpstreamCacheRedis(o)...)
 
 	if o.ReverseProxy {
-		parser, err := ip.GetRealClientIPParser(o.RealClientIPHeader)
+		parser, err := ip.GetRealClientIPParser(o.RealClientIPHeader, o.TrustedProxyIPs)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("real_client_ip_header (%s) not accepted parameter value: %v", o.RealClientIPHeader, err))
 		}
@@ -107,6 +151,17 @@ func Validate(o *options.Options) error {
 	return nil
 }
 
+func validateExternalURLPrefix(o *options.Options) []string {
+	msgs := []string{}
+	if o.ExternalURLPrefix != "" && (!strings.HasPrefix(o.ExternalURLPrefix, "/") || strings.HasSuffix(o.ExternalURLPrefix, "/")) {
+		msgs = append(msgs, fmt.Sprintf("invalid external_url_prefix (%q): must start with a / and not end with one", o.ExternalURLPrefix))
+	}
+	if o.ExternalURLPrefixRoutes && o.ExternalURLPrefix == "" {
+		msgs = append(msgs, "external_url_prefix_routes requires external_url_prefix to be set")
+	}
+	return msgs
+}
+
 func parseSignatureKey(o *options.Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
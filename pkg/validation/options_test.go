@@ -63,8 +63,7 @@ func TestGoogleGroupOptions(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 
 	expected := errorMsg([]string{
-		"missing setting: google-admin-email",
-		"missing setting: google-service-account-json"})
+		"missing setting: google-admin-email"})
 	assert.Equal(t, expected, err.Error())
 }
 
@@ -82,6 +81,20 @@ func TestGoogleGroupInvalidFile(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestGoogleGroupCheckConcurrency(t *testing.T) {
+	o := testOptions()
+	o.Providers[0].GoogleConfig.Groups = []string{"test_group"}
+	o.Providers[0].GoogleConfig.AdminEmail = "admin@example.com"
+	o.Providers[0].GoogleConfig.GroupCheckConcurrency = -1
+	err := Validate(o)
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid setting: google-group-check-concurrency (-1) must not be negative",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestInitializedOptions(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, Validate(o))
@@ -165,6 +178,85 @@ func TestGCPHealthcheck(t *testing.T) {
 	assert.Equal(t, nil, Validate(o))
 }
 
+func TestSlowRequestLog(t *testing.T) {
+	o := testOptions()
+	o.Logging.SlowRequests = options.SlowRequestLog{Threshold: time.Second, SampleRate: 0.01, MaxPathLength: 64}
+	assert.Equal(t, nil, Validate(o))
+
+	o = testOptions()
+	o.Logging.SlowRequests = options.SlowRequestLog{Threshold: -time.Second, SampleRate: 1.5, MaxPathLength: -1}
+	err := Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"slow_request_threshold (-1s) must not be negative",
+		"slow_request_sample_rate (1.5) must be between 0 and 1",
+		"slow_request_max_path_length (-1) must not be negative",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestRequestDebugLog(t *testing.T) {
+	o := testOptions()
+	o.Logging.RequestDebug = options.RequestDebugLog{
+		Header: "X-Debug-Logging",
+		Secret: "debug-secret",
+		Emails: []string{"admin@example.com"},
+	}
+	assert.Equal(t, nil, Validate(o))
+
+	o = testOptions()
+	o.Logging.RequestDebug = options.RequestDebugLog{Header: "X-Debug-Logging"}
+	err := Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"request_debug_header is set without a request_debug_secret, this will have no effect.",
+	})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.Logging.RequestDebug = options.RequestDebugLog{Secret: "debug-secret"}
+	err = Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected = errorMsg([]string{
+		"request_debug_secret is set without a request_debug_header, this will have no effect.",
+	})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.Logging.RequestDebug = options.RequestDebugLog{Header: "X-Debug: Logging", Secret: "debug-secret"}
+	err = Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected = errorMsg([]string{
+		"invalid request_debug_header (\"X-Debug: Logging\"): must be a header name",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestExternalURLPrefix(t *testing.T) {
+	o := testOptions()
+	o.ExternalURLPrefix = "/myapp"
+	o.ExternalURLPrefixRoutes = true
+	assert.Equal(t, nil, Validate(o))
+
+	o = testOptions()
+	o.ExternalURLPrefix = "myapp/"
+	err := Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"invalid external_url_prefix (\"myapp/\"): must start with a / and not end with one",
+	})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.ExternalURLPrefixRoutes = true
+	err = Validate(o)
+	assert.NotEqual(t, nil, err)
+	expected = errorMsg([]string{
+		"external_url_prefix_routes requires external_url_prefix to be set",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestRealClientIPHeader(t *testing.T) {
 	// Ensure nil if ReverseProxy not set.
 	o := testOptions()
@@ -179,14 +271,22 @@ func TestRealClientIPHeader(t *testing.T) {
 	assert.Equal(t, nil, Validate(o))
 	assert.NotNil(t, o.GetRealClientIPParser())
 
-	// Ensure unknown header format process an error.
+	// Ensure the RFC 7239 Forwarded header works along with trusted proxies.
 	o = testOptions()
 	o.ReverseProxy = true
 	o.RealClientIPHeader = "Forwarded"
+	o.TrustedProxyIPs = []string{"10.0.0.0/8", "fd00::/8"}
+	assert.Equal(t, nil, Validate(o))
+	assert.NotNil(t, o.GetRealClientIPParser())
+
+	// Ensure unknown header format process an error.
+	o = testOptions()
+	o.ReverseProxy = true
+	o.RealClientIPHeader = "X-Client-IP"
 	err := Validate(o)
 	assert.NotEqual(t, nil, err)
 	expected := errorMsg([]string{
-		"real_client_ip_header (Forwarded) not accepted parameter value: the http header key (Forwarded) is either invalid or unsupported",
+		"real_client_ip_header (X-Client-IP) not accepted parameter value: the http header key (X-Client-Ip) is either invalid or unsupported",
 	})
 	assert.Equal(t, expected, err.Error())
 	assert.Nil(t, o.GetRealClientIPParser())
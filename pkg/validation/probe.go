@@ -0,0 +1,26 @@
+package validation
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/probe"
+)
+
+func validateProbe(o options.Probe) []string {
+	if len(o.Credentials) == 0 {
+		return []string{}
+	}
+
+	// The headers sessions are loaded from can't also hold probe tokens
+	switch http.CanonicalHeaderKey(o.Header) {
+	case "Authorization", "Cookie":
+		return []string{fmt.Sprintf("probe_credential_header (%q) must not be a header sessions are loaded from", o.Header)}
+	}
+
+	if _, err := probe.NewCredentials(o); err != nil {
+		return []string{fmt.Sprintf("invalid probe credential configuration: %v", err)}
+	}
+	return []string{}
+}
@@ -0,0 +1,56 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Probe", func() {
+	var tokenFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "probe-token")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString("0123456789abcdef")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		tokenFile = f.Name()
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(tokenFile)).To(Succeed())
+	})
+
+	It("allows no credentials", func() {
+		Expect(validateProbe(options.Probe{})).To(BeEmpty())
+	})
+
+	It("allows valid credentials", func() {
+		Expect(validateProbe(options.Probe{
+			Credentials: []string{"uptime:token-file=" + tokenFile + "&path=/status/"},
+			Header:      options.DefaultProbeCredentialHeader,
+		})).To(BeEmpty())
+	})
+
+	It("rejects invalid credentials", func() {
+		Expect(validateProbe(options.Probe{
+			Credentials: []string{"uptime:token-file=" + tokenFile},
+			Header:      options.DefaultProbeCredentialHeader,
+		})).To(ConsistOf(
+			`invalid probe credential configuration: invalid probe credential "uptime:token-file=` + tokenFile + `": a path=<prefix> condition is required`,
+		))
+	})
+
+	It("rejects the Authorization header", func() {
+		Expect(validateProbe(options.Probe{
+			Credentials: []string{"uptime:token-file=" + tokenFile + "&path=/status/"},
+			Header:      "authorization",
+		})).To(ConsistOf(
+			`probe_credential_header ("authorization") must not be a header sessions are loaded from`,
+		))
+	})
+})
@@ -0,0 +1,31 @@
+package validation
+
+import (
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateProviderFallback(o *options.Options) []string {
+	f := o.ProviderFallback
+	if f.Provider == "" {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if f.Provider != options.FallbackProviderHtpasswd {
+		msgs = append(msgs, fmt.Sprintf("invalid fallback_provider (%q): must be %q", f.Provider, options.FallbackProviderHtpasswd))
+	} else if o.HtpasswdFile == "" {
+		msgs = append(msgs, "fallback_provider is htpasswd, but htpasswd_file is not set")
+	}
+	if f.Mode != options.FallbackModeAuto && f.Mode != options.FallbackModeOffer {
+		msgs = append(msgs, fmt.Sprintf("invalid fallback_provider_mode (%q): must be %q or %q", f.Mode, options.FallbackModeAuto, options.FallbackModeOffer))
+	}
+	if f.HealthCheckInterval <= 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid fallback_provider_health_check_interval (%s): must be positive", f.HealthCheckInterval))
+	}
+	if f.UnhealthyAfter < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid fallback_provider_unhealthy_after (%s): must not be negative", f.UnhealthyAfter))
+	}
+	return msgs
+}
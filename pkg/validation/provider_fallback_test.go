@@ -0,0 +1,47 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Provider Fallback", func() {
+	DescribeTable("validateProviderFallback",
+		func(htpasswdFile string, fallback options.ProviderFallback, expectedMsgs []string) {
+			o := &options.Options{HtpasswdFile: htpasswdFile, ProviderFallback: fallback}
+			Expect(validateProviderFallback(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("without a fallback provider", "", options.ProviderFallback{
+			Mode:                options.FallbackModeAuto,
+			HealthCheckInterval: options.DefaultFallbackHealthCheckInterval,
+		}, []string{}),
+		Entry("with the htpasswd fallback provider", "htpasswd.txt", options.ProviderFallback{
+			Provider:            options.FallbackProviderHtpasswd,
+			Mode:                options.FallbackModeOffer,
+			HealthCheckInterval: options.DefaultFallbackHealthCheckInterval,
+			UnhealthyAfter:      0,
+		}, []string{}),
+		Entry("with the htpasswd fallback provider, but no htpasswd file", "", options.ProviderFallback{
+			Provider:            options.FallbackProviderHtpasswd,
+			Mode:                options.FallbackModeAuto,
+			HealthCheckInterval: options.DefaultFallbackHealthCheckInterval,
+		}, []string{
+			"fallback_provider is htpasswd, but htpasswd_file is not set",
+		}),
+		Entry("with invalid settings", "htpasswd.txt", options.ProviderFallback{
+			Provider:            "oidc",
+			Mode:                "always",
+			HealthCheckInterval: 0,
+			UnhealthyAfter:      -time.Minute,
+		}, []string{
+			"invalid fallback_provider (\"oidc\"): must be \"htpasswd\"",
+			"invalid fallback_provider_mode (\"always\"): must be \"auto\" or \"offer\"",
+			"invalid fallback_provider_health_check_interval (0s): must be positive",
+			"invalid fallback_provider_unhealthy_after (-1m0s): must not be negative",
+		}),
+	)
+})
@@ -3,8 +3,13 @@ package validation
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 )
 
@@ -22,9 +27,122 @@ func validateProviders(o *options.Options) []string {
 	}
 
 	providerIDs := make(map[string]struct{})
+	cookieSuffixes := make(map[string]struct{})
+	proxyPrefixes := make(map[string]struct{})
+	hosts := make(map[string]struct{})
+	pathPrefixes := make(map[string]struct{})
 
-	for _, provider := range o.Providers {
+	for i, provider := range o.Providers {
 		msgs = append(msgs, validateProvider(provider, providerIDs)...)
+		msgs = append(msgs, validateAppleCookie(o, provider)...)
+		msgs = append(msgs, validateProviderOverrides(o, provider, cookieSuffixes, proxyPrefixes)...)
+		msgs = append(msgs, validateProviderSelection(provider, hosts, pathPrefixes)...)
+		if i > 0 {
+			msgs = append(msgs, validateOtherProvider(o, provider)...)
+		}
+	}
+	if len(o.Providers) > 1 {
+		for _, upstream := range o.UpstreamServers.Upstreams {
+			if upstream.TokenExchange != nil {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has a tokenExchange: token exchange is not supported with multiple providers", upstream.ID))
+			}
+		}
+	}
+
+	return msgs
+}
+
+// providerHostRegex matches the hosts a provider is selected for, which may
+// start with a "*." wildcard of the subdomains of the host
+var providerHostRegex = regexp.MustCompile(`^(?i)(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validateProviderSelection validates the hosts and path prefixes the
+// provider is selected for, ensuring that they select a single provider
+func validateProviderSelection(provider options.Provider, hosts, pathPrefixes map[string]struct{}) []string {
+	msgs := []string{}
+
+	for _, host := range provider.Hosts {
+		if !providerHostRegex.MatchString(host) {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid host (%q): must be a host name, optionally starting with a *. wildcard", provider.ID, host))
+		}
+		if _, ok := hosts[strings.ToLower(host)]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple providers found with host %q: provider hosts must be unique", host))
+		}
+		hosts[strings.ToLower(host)] = struct{}{}
+	}
+
+	for _, prefix := range provider.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid pathPrefix (%q): must start with a /", provider.ID, prefix))
+		}
+		if _, ok := pathPrefixes[prefix]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple providers found with path prefix %q: provider path prefixes must be unique", prefix))
+		}
+		pathPrefixes[prefix] = struct{}{}
+	}
+
+	return msgs
+}
+
+// validateOtherProvider validates a provider after the first provider, which
+// needs cookies and endpoints of its own as only the first provider uses the
+// global cookie name and proxy prefix
+func validateOtherProvider(o *options.Options, provider options.Provider) []string {
+	msgs := []string{}
+
+	if provider.CookieSuffix == "" {
+		msgs = append(msgs, fmt.Sprintf("provider %q has no cookieSuffix: only the first provider can use the global cookie name", provider.ID))
+	}
+	if provider.ProxyPrefix == "" || provider.ProxyPrefix == o.ProxyPrefix {
+		msgs = append(msgs, fmt.Sprintf("provider %q has no proxyPrefix of its own: only the first provider can use the global proxy prefix", provider.ID))
+	}
+
+	return msgs
+}
+
+// reservedCookieSuffix matches the suffixes added to the cookie name for split
+// session cookies, CSRF cookies and the provider cookie
+var reservedCookieSuffix = regexp.MustCompile(`^_(\d+|csrf.*|provider)$`)
+
+// validateProviderOverrides validates the cookie suffix and proxy prefix of
+// the provider, ensuring that they are unique across all providers so that
+// the providers don't share cookies or endpoints, and the cookie durations of
+// the provider
+func validateProviderOverrides(o *options.Options, provider options.Provider, cookieSuffixes, proxyPrefixes map[string]struct{}) []string {
+	msgs := []string{}
+
+	if provider.CookieSuffix != "" {
+		if _, ok := cookieSuffixes[provider.CookieSuffix]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple providers found with cookie suffix %q: provider cookie suffixes must be unique", provider.CookieSuffix))
+		}
+		cookieSuffixes[provider.CookieSuffix] = struct{}{}
+		if reservedCookieSuffix.MatchString(provider.CookieSuffix) {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid cookieSuffix (%q): must not clash with the names of split session cookies, CSRF cookies or the provider cookie", provider.ID, provider.CookieSuffix))
+		}
+		msgs = append(msgs, validateCookieName(o.Cookie.Name+provider.CookieSuffix)...)
+	}
+
+	if provider.ProxyPrefix != "" {
+		if _, ok := proxyPrefixes[provider.ProxyPrefix]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple providers found with proxy prefix %q: provider proxy prefixes must be unique", provider.ProxyPrefix))
+		}
+		proxyPrefixes[provider.ProxyPrefix] = struct{}{}
+		if !strings.HasPrefix(provider.ProxyPrefix, "/") || strings.HasSuffix(provider.ProxyPrefix, "/") {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid proxyPrefix (%q): must start with a / and not end with one", provider.ID, provider.ProxyPrefix))
+		}
+	}
+
+	if provider.CookieExpire != nil || provider.CookieRefresh != nil {
+		expire, refresh := o.Cookie.Expire, o.Cookie.Refresh
+		if provider.CookieExpire != nil {
+			expire = time.Duration(*provider.CookieExpire)
+		}
+		if provider.CookieRefresh != nil {
+			refresh = time.Duration(*provider.CookieRefresh)
+		}
+		if refresh >= expire {
+			msgs = append(msgs, fmt.Sprintf("provider %q has cookieRefresh (%q) that must be less than cookieExpire (%q)", provider.ID, refresh.String(), expire.String()))
+		}
 	}
 
 	return msgs
@@ -47,8 +165,8 @@ func validateProvider(provider options.Provider, providerIDs map[string]struct{}
 		msgs = append(msgs, "provider missing setting: client-id")
 	}
 
-	// login.gov uses a signed JWT to authenticate, not a client-secret
-	if provider.Type != "login.gov" {
+	// login.gov and apple use a signed JWT to authenticate, not a client-secret
+	if provider.Type != "login.gov" && provider.Type != options.AppleProvider {
 		if provider.ClientSecret == "" && provider.ClientSecretFile == "" {
 			msgs = append(msgs, "missing setting: client-secret or client-secret-file")
 		}
@@ -61,10 +179,116 @@ func validateProvider(provider options.Provider, providerIDs map[string]struct{}
 	}
 
 	msgs = append(msgs, validateGoogleConfig(provider)...)
+	msgs = append(msgs, validateAppleConfig(provider)...)
+	msgs = append(msgs, validateOIDCEmailVerification(provider)...)
+	msgs = append(msgs, validateOIDCLogout(provider)...)
+	msgs = append(msgs, validateGroupsNormalization(provider)...)
 
 	return msgs
 }
 
+// validateGroupsNormalization validates the regexes transforming and
+// filtering the groups of the provider
+func validateGroupsNormalization(provider options.Provider) []string {
+	msgs := []string{}
+	opts := provider.GroupsNormalization
+
+	if opts.Transform != "" {
+		if transform, err := regexp.Compile(opts.Transform); err != nil {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid groupsNormalization.transform (%q): %v", provider.ID, opts.Transform, err))
+		} else if transform.NumSubexp() < 1 {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid groupsNormalization.transform (%q): must have a capture group", provider.ID, opts.Transform))
+		}
+	}
+	for i, entry := range opts.Filter {
+		if !strings.HasPrefix(entry, "~") {
+			continue
+		}
+		if _, err := regexp.Compile(strings.TrimPrefix(entry, "~")); err != nil {
+			msgs = append(msgs, fmt.Sprintf("provider %q has invalid groupsNormalization.filter[%d] (%q): %v", provider.ID, i, entry, err))
+		}
+	}
+	if opts.MaxGroups < 0 {
+		msgs = append(msgs, fmt.Sprintf("provider %q has invalid groupsNormalization.maxGroups (%d): must not be negative", provider.ID, opts.MaxGroups))
+	}
+
+	return msgs
+}
+
+func validateOIDCEmailVerification(provider options.Provider) []string {
+	msgs := []string{}
+	switch provider.OIDCConfig.EmailVerification {
+	case "", options.EmailVerificationIfPresent, options.EmailVerificationRequired:
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid oidc-email-verification %q: must be one of %q or %q",
+			provider.OIDCConfig.EmailVerification, options.EmailVerificationIfPresent, options.EmailVerificationRequired))
+	}
+
+	if provider.OIDCConfig.EmailVerification == options.EmailVerificationRequired && provider.OIDCConfig.InsecureAllowUnverifiedEmail {
+		msgs = append(msgs, "oidc-email-verification \"required\" can not be used with insecure-oidc-allow-unverified-email")
+	}
+
+	return msgs
+}
+
+// validateOIDCLogout checks the URLs the users are sent to when signing out
+// of the provider
+func validateOIDCLogout(provider options.Provider) []string {
+	msgs := []string{}
+	if msg := validateAbsoluteURL("oidc-end-session-url", provider.OIDCConfig.EndSessionURL); msg != "" {
+		msgs = append(msgs, msg)
+	}
+	if msg := validateAbsoluteURL("oidc-post-logout-redirect-url", provider.OIDCConfig.PostLogoutRedirectURL); msg != "" {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func validateAbsoluteURL(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if u, err := url.Parse(value); err != nil || !u.IsAbs() {
+		return fmt.Sprintf("invalid %s %q: must be an absolute URL", name, value)
+	}
+	return ""
+}
+
+func validateAppleConfig(provider options.Provider) []string {
+	msgs := []string{}
+	if provider.Type != options.AppleProvider {
+		return msgs
+	}
+
+	if provider.AppleConfig.TeamID == "" {
+		msgs = append(msgs, "missing setting: apple-team-id")
+	}
+	if provider.AppleConfig.KeyID == "" {
+		msgs = append(msgs, "missing setting: apple-key-id")
+	}
+	if provider.AppleConfig.PrivateKeyFile == "" {
+		msgs = append(msgs, "missing setting: apple-private-key-file")
+	} else if keyData, err := ioutil.ReadFile(provider.AppleConfig.PrivateKeyFile); err != nil {
+		msgs = append(msgs, "could not read apple private key file: "+provider.AppleConfig.PrivateKeyFile)
+	} else if _, err := jwt.ParseECPrivateKeyFromPEM(keyData); err != nil {
+		msgs = append(msgs, fmt.Sprintf("apple private key file %s is not a valid EC private key: %v", provider.AppleConfig.PrivateKeyFile, err))
+	}
+
+	return msgs
+}
+
+// validateAppleCookie ensures that the CSRF cookie is sent with the callback
+// of Apple, which is a cross-site POST with its form_post response mode
+func validateAppleCookie(o *options.Options, provider options.Provider) []string {
+	if provider.Type != options.AppleProvider {
+		return []string{}
+	}
+	if o.Cookie.SameSite != "none" || !o.Cookie.Secure {
+		return []string{fmt.Sprintf("provider %q of type apple requires cookie_samesite to be \"none\" and cookie_secure: Apple posts the callback cross-site, so the CSRF cookie must be sent with it", provider.ID)}
+	}
+	return []string{}
+}
+
 func validateGoogleConfig(provider options.Provider) []string {
 	msgs := []string{}
 	if len(provider.GoogleConfig.Groups) > 0 ||
@@ -76,10 +300,14 @@ func validateGoogleConfig(provider options.Provider) []string {
 		if provider.GoogleConfig.AdminEmail == "" {
 			msgs = append(msgs, "missing setting: google-admin-email")
 		}
-		if provider.GoogleConfig.ServiceAccountJSON == "" {
-			msgs = append(msgs, "missing setting: google-service-account-json")
-		} else if _, err := os.Stat(provider.GoogleConfig.ServiceAccountJSON); err != nil {
-			msgs = append(msgs, fmt.Sprintf("invalid Google credentials file: %s", provider.GoogleConfig.ServiceAccountJSON))
+		// Application Default Credentials are used when no service account JSON is given
+		if provider.GoogleConfig.ServiceAccountJSON != "" {
+			if _, err := os.Stat(provider.GoogleConfig.ServiceAccountJSON); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid Google credentials file: %s", provider.GoogleConfig.ServiceAccountJSON))
+			}
+		}
+		if provider.GoogleConfig.GroupCheckConcurrency < 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: google-group-check-concurrency (%d) must not be negative", provider.GoogleConfig.GroupCheckConcurrency))
 		}
 	}
 
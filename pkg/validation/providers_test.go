@@ -1,6 +1,16 @@
 package validation
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"time"
+
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -31,6 +41,29 @@ var _ = Describe("Providers", func() {
 		ClientSecret: "ClientSecret",
 	}
 
+	withOverrides := func(provider options.Provider, cookieSuffix, proxyPrefix string) options.Provider {
+		provider.CookieSuffix = cookieSuffix
+		provider.ProxyPrefix = proxyPrefix
+		return provider
+	}
+
+	withSelection := func(provider options.Provider, hosts, pathPrefixes []string) options.Provider {
+		provider.Hosts = hosts
+		provider.PathPrefixes = pathPrefixes
+		return provider
+	}
+
+	withCookieDurations := func(provider options.Provider, expire, refresh *options.Duration) options.Provider {
+		provider.CookieExpire = expire
+		provider.CookieRefresh = refresh
+		return provider
+	}
+
+	durationPtr := func(d time.Duration) *options.Duration {
+		duration := options.Duration(d)
+		return &duration
+	}
+
 	missingProvider := "at least one provider has to be defined"
 	emptyIDMsg := "provider has empty id: ids are required for all providers"
 	duplicateProviderIDMsg := "multiple providers found with id ProviderID: provider ids must be unique"
@@ -46,13 +79,80 @@ var _ = Describe("Providers", func() {
 		}),
 		Entry("with valid providers", &validateProvidersTableInput{
 			options: &options.Options{
+				Providers: options.Providers{
+					validProvider,
+					withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"),
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with other providers using the global cookie name and proxy prefix", &validateProvidersTableInput{
+			options: &options.Options{
+				ProxyPrefix: "/oauth2",
 				Providers: options.Providers{
 					validProvider,
 					validLoginGovProvider,
+					withOverrides(options.Provider{ID: "ProviderIDGlobal", ClientID: "ClientID", ClientSecret: "ClientSecret"}, "_global", "/oauth2"),
+				},
+			},
+			errStrings: []string{
+				"provider \"ProviderIDLoginGov\" has no cookieSuffix: only the first provider can use the global cookie name",
+				"provider \"ProviderIDLoginGov\" has no proxyPrefix of its own: only the first provider can use the global proxy prefix",
+				"provider \"ProviderIDGlobal\" has no proxyPrefix of its own: only the first provider can use the global proxy prefix",
+			},
+		}),
+		Entry("with the hosts and path prefixes of the providers", &validateProvidersTableInput{
+			options: &options.Options{
+				Providers: options.Providers{
+					withSelection(validProvider, []string{"app.example.com", "*.apps.example.com"}, []string{"/app"}),
+					withSelection(withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"), []string{"Admin.Example.com"}, []string{"/admin", "/api/admin"}),
 				},
 			},
 			errStrings: []string{},
 		}),
+		Entry("with invalid and duplicate hosts and path prefixes", &validateProvidersTableInput{
+			options: &options.Options{
+				Providers: options.Providers{
+					withSelection(validProvider, []string{"app.example.com", "app.*.example.com", "https://example.com"}, []string{"/app", "admin"}),
+					withSelection(withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"), []string{"APP.example.com"}, []string{"/app"}),
+				},
+			},
+			errStrings: []string{
+				"provider \"ProviderID\" has invalid host (\"app.*.example.com\"): must be a host name, optionally starting with a *. wildcard",
+				"provider \"ProviderID\" has invalid host (\"https://example.com\"): must be a host name, optionally starting with a *. wildcard",
+				"provider \"ProviderID\" has invalid pathPrefix (\"admin\"): must start with a /",
+				"multiple providers found with host \"APP.example.com\": provider hosts must be unique",
+				"multiple providers found with path prefix \"/app\": provider path prefixes must be unique",
+			},
+		}),
+		Entry("with the cookie durations of a provider", &validateProvidersTableInput{
+			options: &options.Options{
+				Cookie: options.Cookie{Name: "_oauth2_proxy", Expire: 168 * time.Hour, Refresh: time.Hour},
+				Providers: options.Providers{
+					withCookieDurations(validProvider, nil, durationPtr(8*time.Hour)),
+					withCookieDurations(withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"), durationPtr(time.Hour), nil),
+				},
+			},
+			errStrings: []string{
+				"provider \"ProviderIDLoginGov\" has cookieRefresh (\"1h0m0s\") that must be less than cookieExpire (\"1h0m0s\")",
+			},
+		}),
+		Entry("with multiple providers and token exchange upstreams", &validateProvidersTableInput{
+			options: &options.Options{
+				Providers: options.Providers{
+					validProvider,
+					withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"),
+				},
+				UpstreamServers: options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						{ID: "api", Path: "/api", TokenExchange: &options.UpstreamTokenExchange{}},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"api\" has a tokenExchange: token exchange is not supported with multiple providers",
+			},
+		}),
 		Entry("with an empty providerID", &validateProvidersTableInput{
 			options: &options.Options{
 				Providers: options.Providers{
@@ -65,7 +165,7 @@ var _ = Describe("Providers", func() {
 			options: &options.Options{
 				Providers: options.Providers{
 					validProvider,
-					validProvider,
+					withOverrides(validProvider, "_app", "/app/oauth2"),
 				},
 			},
 			errStrings: []string{duplicateProviderIDMsg},
@@ -75,10 +175,245 @@ var _ = Describe("Providers", func() {
 				SkipProviderButton: true,
 				Providers: options.Providers{
 					validProvider,
-					validLoginGovProvider,
+					withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"),
 				},
 			},
 			errStrings: []string{skipButtonAndMultipleProvidersMsg},
 		}),
+		Entry("with unique cookie suffixes and proxy prefixes", &validateProvidersTableInput{
+			options: &options.Options{
+				Cookie: options.Cookie{Name: "_oauth2_proxy"},
+				Providers: options.Providers{
+					withOverrides(validProvider, "_app", "/app/oauth2"),
+					withOverrides(validLoginGovProvider, "_admin", "/admin/oauth2"),
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with duplicate cookie suffixes and proxy prefixes", &validateProvidersTableInput{
+			options: &options.Options{
+				Cookie: options.Cookie{Name: "_oauth2_proxy"},
+				Providers: options.Providers{
+					withOverrides(validProvider, "_app", "/app/oauth2"),
+					withOverrides(validLoginGovProvider, "_app", "/app/oauth2"),
+				},
+			},
+			errStrings: []string{
+				"multiple providers found with cookie suffix \"_app\": provider cookie suffixes must be unique",
+				"multiple providers found with proxy prefix \"/app/oauth2\": provider proxy prefixes must be unique",
+			},
+		}),
+		Entry("with an invalid cookie suffix and proxy prefix", &validateProvidersTableInput{
+			options: &options.Options{
+				Cookie: options.Cookie{Name: "_oauth2_proxy"},
+				Providers: options.Providers{
+					withOverrides(validProvider, "_app;", "app/oauth2/"),
+				},
+			},
+			errStrings: []string{
+				"invalid cookie name: \"_oauth2_proxy_app;\"",
+				"provider \"ProviderID\" has invalid proxyPrefix (\"app/oauth2/\"): must start with a / and not end with one",
+			},
+		}),
+		Entry("with cookie suffixes that clash with other cookies", &validateProvidersTableInput{
+			options: &options.Options{
+				Cookie: options.Cookie{Name: "_oauth2_proxy"},
+				Providers: options.Providers{
+					withOverrides(validProvider, "_1", ""),
+					withOverrides(validLoginGovProvider, "_csrf", "/admin/oauth2"),
+				},
+			},
+			errStrings: []string{
+				"provider \"ProviderID\" has invalid cookieSuffix (\"_1\"): must not clash with the names of split session cookies, CSRF cookies or the provider cookie",
+				"provider \"ProviderIDLoginGov\" has invalid cookieSuffix (\"_csrf\"): must not clash with the names of split session cookies, CSRF cookies or the provider cookie",
+			},
+		}),
+	)
+
+	Context("validateAppleConfig", func() {
+		encodePKCS8 := func(key interface{}) string {
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		}
+
+		type validateAppleConfigTableInput struct {
+			teamID     string
+			keyID      string
+			keyData    func() string
+			errStrings []string
+		}
+
+		DescribeTable("should validate the apple config",
+			func(in *validateAppleConfigTableInput) {
+				provider := options.Provider{
+					Type: options.AppleProvider,
+					AppleConfig: options.AppleOptions{
+						TeamID: in.teamID,
+						KeyID:  in.keyID,
+					},
+				}
+				if in.keyData != nil {
+					keyFile, err := ioutil.TempFile("", "apple-key-*.p8")
+					Expect(err).ToNot(HaveOccurred())
+					defer os.Remove(keyFile.Name())
+					_, err = keyFile.WriteString(in.keyData())
+					Expect(err).ToNot(HaveOccurred())
+					Expect(keyFile.Close()).To(Succeed())
+					provider.AppleConfig.PrivateKeyFile = keyFile.Name()
+				}
+
+				msgs := validateAppleConfig(provider)
+				Expect(msgs).To(HaveLen(len(in.errStrings)))
+				for i, msg := range msgs {
+					Expect(msg).To(MatchRegexp(in.errStrings[i]))
+				}
+			},
+			Entry("with a valid config", &validateAppleConfigTableInput{
+				teamID: "TEAMID1234",
+				keyID:  "KEYID12345",
+				keyData: func() string {
+					key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					Expect(err).ToNot(HaveOccurred())
+					return encodePKCS8(key)
+				},
+				errStrings: []string{},
+			}),
+			Entry("with missing settings", &validateAppleConfigTableInput{
+				errStrings: []string{
+					"^missing setting: apple-team-id$",
+					"^missing setting: apple-key-id$",
+					"^missing setting: apple-private-key-file$",
+				},
+			}),
+			Entry("with an RSA key", &validateAppleConfigTableInput{
+				teamID: "TEAMID1234",
+				keyID:  "KEYID12345",
+				keyData: func() string {
+					key, err := rsa.GenerateKey(rand.Reader, 2048)
+					Expect(err).ToNot(HaveOccurred())
+					return encodePKCS8(key)
+				},
+				errStrings: []string{
+					"^apple private key file .*apple-key-.*\\.p8 is not a valid EC private key: ",
+				},
+			}),
+			Entry("with a key file that isn't PEM", &validateAppleConfigTableInput{
+				teamID: "TEAMID1234",
+				keyID:  "KEYID12345",
+				keyData: func() string {
+					return "not a key"
+				},
+				errStrings: []string{
+					"^apple private key file .*apple-key-.*\\.p8 is not a valid EC private key: ",
+				},
+			}),
+		)
+
+		appleCookieMsg := `provider "apple" of type apple requires cookie_samesite to be "none" and cookie_secure: Apple posts the callback cross-site, so the CSRF cookie must be sent with it`
+
+		DescribeTable("should require a cross-site cookie for the apple callback",
+			func(providerType options.ProviderType, sameSite string, secure bool, errStrings []string) {
+				o := &options.Options{Cookie: options.Cookie{SameSite: sameSite, Secure: secure}}
+				provider := options.Provider{ID: "apple", Type: providerType}
+				Expect(validateAppleCookie(o, provider)).To(ConsistOf(errStrings))
+			},
+			Entry("with a SameSite=None secure cookie", options.AppleProvider, "none", true, []string{}),
+			Entry("with the default cookie", options.AppleProvider, "", true, []string{appleCookieMsg}),
+			Entry("with a SameSite=Lax cookie", options.AppleProvider, "lax", true, []string{appleCookieMsg}),
+			Entry("with a SameSite=None insecure cookie", options.AppleProvider, "none", false, []string{appleCookieMsg}),
+			Entry("with another provider", options.OIDCProvider, "", true, []string{}),
+		)
+	})
+
+	type validateOIDCEmailVerificationTableInput struct {
+		oidcConfig options.OIDCOptions
+		errStrings []string
+	}
+
+	DescribeTable("validateOIDCEmailVerification",
+		func(in *validateOIDCEmailVerificationTableInput) {
+			Expect(validateOIDCEmailVerification(options.Provider{OIDCConfig: in.oidcConfig})).To(ConsistOf(in.errStrings))
+		},
+		Entry("with the default mode", &validateOIDCEmailVerificationTableInput{
+			oidcConfig: options.OIDCOptions{},
+			errStrings: []string{},
+		}),
+		Entry("with the claim required", &validateOIDCEmailVerificationTableInput{
+			oidcConfig: options.OIDCOptions{
+				EmailVerification: options.EmailVerificationRequired,
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an unknown mode", &validateOIDCEmailVerificationTableInput{
+			oidcConfig: options.OIDCOptions{
+				EmailVerification: "always",
+			},
+			errStrings: []string{
+				"invalid oidc-email-verification \"always\": must be one of \"ifPresent\" or \"required\"",
+			},
+		}),
+		Entry("with the claim required and unverified emails allowed", &validateOIDCEmailVerificationTableInput{
+			oidcConfig: options.OIDCOptions{
+				EmailVerification:            options.EmailVerificationRequired,
+				InsecureAllowUnverifiedEmail: true,
+			},
+			errStrings: []string{
+				"oidc-email-verification \"required\" can not be used with insecure-oidc-allow-unverified-email",
+			},
+		}),
+	)
+
+	DescribeTable("validateOIDCLogout",
+		func(oidcConfig options.OIDCOptions, errStrings []string) {
+			Expect(validateOIDCLogout(options.Provider{OIDCConfig: oidcConfig})).To(ConsistOf(errStrings))
+		},
+		Entry("without logout URLs", options.OIDCOptions{}, []string{}),
+		Entry("with absolute URLs", options.OIDCOptions{
+			RPInitiatedLogout:     true,
+			EndSessionURL:         "https://idp.example.com/logout",
+			PostLogoutRedirectURL: "https://app.example.com/signed-out",
+		}, []string{}),
+		Entry("with relative URLs", options.OIDCOptions{
+			EndSessionURL:         "/logout",
+			PostLogoutRedirectURL: "signed-out",
+		}, []string{
+			"invalid oidc-end-session-url \"/logout\": must be an absolute URL",
+			"invalid oidc-post-logout-redirect-url \"signed-out\": must be an absolute URL",
+		}),
+	)
+
+	type validateGroupsNormalizationTableInput struct {
+		groupsNormalization options.GroupsNormalization
+		errStrings          []string
+	}
+
+	DescribeTable("validateGroupsNormalization",
+		func(in *validateGroupsNormalizationTableInput) {
+			Expect(validateGroupsNormalization(options.Provider{ID: "ldap", GroupsNormalization: in.groupsNormalization})).To(ConsistOf(in.errStrings))
+		},
+		Entry("with no normalization", &validateGroupsNormalizationTableInput{
+			errStrings: []string{},
+		}),
+		Entry("with a valid normalization", &validateGroupsNormalizationTableInput{
+			groupsNormalization: options.GroupsNormalization{
+				Transform: `^CN=([^,]+),`,
+				Filter:    []string{"app-", `~^team-[a-z]+$`},
+				MaxGroups: 100,
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid settings", &validateGroupsNormalizationTableInput{
+			groupsNormalization: options.GroupsNormalization{
+				Transform: `^CN=[^,]+,`,
+				Filter:    []string{"app-", `~^team-[a-z+$`},
+				MaxGroups: -1,
+			},
+			errStrings: []string{
+				"provider \"ldap\" has invalid groupsNormalization.transform (\"^CN=[^,]+,\"): must have a capture group",
+				"provider \"ldap\" has invalid groupsNormalization.filter[1] (\"~^team-[a-z+$\"): error parsing regexp: missing closing ]: `[a-z+$`",
+				"provider \"ldap\" has invalid groupsNormalization.maxGroups (-1): must not be negative",
+			},
+		}),
 	)
 })
@@ -0,0 +1,69 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/redirect"
+)
+
+func validateRedirect(o options.Redirect) []string {
+	msgs := []string{}
+	if o.MaxLength < 0 {
+		msgs = append(msgs, fmt.Sprintf("redirect_max_length must not be negative, got %d", o.MaxLength))
+	}
+	switch o.MaxLengthAction {
+	case options.RedirectMaxLengthTruncate, options.RedirectMaxLengthDeny:
+	default:
+		msgs = append(msgs, fmt.Sprintf("redirect_max_length_action (%s) must be one of %s or %s",
+			o.MaxLengthAction, options.RedirectMaxLengthTruncate, options.RedirectMaxLengthDeny))
+	}
+	msgs = append(msgs, validateLoopbackRedirects(o)...)
+	return append(msgs, validateAppState(o)...)
+}
+
+// validateLoopbackRedirects checks the ports of the loopback redirects
+func validateLoopbackRedirects(o options.Redirect) []string {
+	if o.LoopbackPorts == "" {
+		return []string{}
+	}
+	if !o.AllowLoopback {
+		return []string{"redirect_loopback_ports is set, but redirect_allow_loopback is not, this will have no effect."}
+	}
+	if err := redirect.ValidateLoopbackPorts(o.LoopbackPorts); err != nil {
+		return []string{fmt.Sprintf("redirect_loopback_ports (%s) is invalid: %v", o.LoopbackPorts, err)}
+	}
+	return []string{}
+}
+
+// appStateParameterRegex matches parameter names that don't need escaping
+var appStateParameterRegex = regexp.MustCompile(`^[A-Za-z0-9_.~-]+$`)
+
+// validateAppState checks the app state parameter names and size when the
+// app state is enabled
+func validateAppState(o options.Redirect) []string {
+	msgs := []string{}
+	if o.AppStateParameter == "" {
+		if o.AppStateRedirectParameter != "" {
+			msgs = append(msgs, "app_state_redirect_parameter is set, but no app_state_parameter, this will have no effect.")
+		}
+		return msgs
+	}
+
+	for name, param := range map[string]string{
+		"app_state_parameter":          o.AppStateParameter,
+		"app_state_redirect_parameter": o.AppStateRedirectParameter,
+	} {
+		if param != "" && !appStateParameterRegex.MatchString(param) {
+			msgs = append(msgs, fmt.Sprintf("%s (%s) must only contain letters, digits and the characters _.~-", name, param))
+		}
+	}
+	if o.AppStateParameter == "rd" {
+		msgs = append(msgs, "app_state_parameter must not be rd: the rd parameter is the redirect")
+	}
+	if o.AppStateMaxSize <= 0 || o.AppStateMaxSize > options.MaxAppStateMaxSize {
+		msgs = append(msgs, fmt.Sprintf("app_state_max_size must be between 1 and %d, got %d", options.MaxAppStateMaxSize, o.AppStateMaxSize))
+	}
+	return msgs
+}
@@ -0,0 +1,77 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redirect", func() {
+	DescribeTable("validateRedirect",
+		func(o options.Redirect, errStrings []string) {
+			Expect(validateRedirect(o)).To(ConsistOf(errStrings))
+		},
+		Entry("Default options", options.Redirect{
+			MaxLength:       options.DefaultRedirectMaxLength,
+			MaxLengthAction: options.RedirectMaxLengthTruncate,
+		}, []string{}),
+		Entry("No maximum length", options.Redirect{
+			MaxLength:       0,
+			MaxLengthAction: options.RedirectMaxLengthDeny,
+		}, []string{}),
+		Entry("Negative maximum length and unknown action", options.Redirect{
+			MaxLength:       -1,
+			MaxLengthAction: "drop",
+		}, []string{
+			"redirect_max_length must not be negative, got -1",
+			"redirect_max_length_action (drop) must be one of truncate or deny",
+		}),
+		Entry("With loopback redirects on a range of ports", options.Redirect{
+			MaxLength:       options.DefaultRedirectMaxLength,
+			MaxLengthAction: options.RedirectMaxLengthTruncate,
+			AllowLoopback:   true,
+			LoopbackPorts:   "49152-65535",
+		}, []string{}),
+		Entry("With invalid loopback redirect ports", options.Redirect{
+			MaxLength:       options.DefaultRedirectMaxLength,
+			MaxLengthAction: options.RedirectMaxLengthTruncate,
+			AllowLoopback:   true,
+			LoopbackPorts:   "8080-80",
+		}, []string{
+			"redirect_loopback_ports (8080-80) is invalid: invalid port range \"8080-80\"",
+		}),
+		Entry("With loopback redirect ports only", options.Redirect{
+			MaxLength:       options.DefaultRedirectMaxLength,
+			MaxLengthAction: options.RedirectMaxLengthTruncate,
+			LoopbackPorts:   "8080",
+		}, []string{
+			"redirect_loopback_ports is set, but redirect_allow_loopback is not, this will have no effect.",
+		}),
+		Entry("With an app state", options.Redirect{
+			MaxLength:                 options.DefaultRedirectMaxLength,
+			MaxLengthAction:           options.RedirectMaxLengthTruncate,
+			AppStateParameter:         "app_state",
+			AppStateRedirectParameter: "state_token",
+			AppStateMaxSize:           options.DefaultAppStateMaxSize,
+		}, []string{}),
+		Entry("With invalid app state options", options.Redirect{
+			MaxLength:                 options.DefaultRedirectMaxLength,
+			MaxLengthAction:           options.RedirectMaxLengthTruncate,
+			AppStateParameter:         "rd",
+			AppStateRedirectParameter: "app state",
+			AppStateMaxSize:           4096,
+		}, []string{
+			"app_state_parameter must not be rd: the rd parameter is the redirect",
+			"app_state_redirect_parameter (app state) must only contain letters, digits and the characters _.~-",
+			"app_state_max_size must be between 1 and 1024, got 4096",
+		}),
+		Entry("With an app state redirect parameter only", options.Redirect{
+			MaxLength:                 options.DefaultRedirectMaxLength,
+			MaxLengthAction:           options.RedirectMaxLengthTruncate,
+			AppStateRedirectParameter: "app_state",
+		}, []string{
+			"app_state_redirect_parameter is set, but no app_state_parameter, this will have no effect.",
+		}),
+	)
+})
@@ -0,0 +1,66 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// validateServers validates the TLS configuration of the proxy, metrics and
+// management servers, and the drain timeout of the WebSocket connections on
+// shutdown
+func validateServers(o *options.Options) []string {
+	msgs := prefixValues("server.TLS: ", validateServerTLS(o.Server.TLS)...)
+	msgs = append(msgs, prefixValues("metricsServer.TLS: ", validateServerTLS(o.MetricsServer.TLS)...)...)
+	msgs = append(msgs, prefixValues("managementServer.TLS: ", validateServerTLS(o.ManagementServer.TLS)...)...)
+	if o.WebSocketDrainTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("websocket_drain_timeout (%s) must not be negative", o.WebSocketDrainTimeout))
+	}
+	return msgs
+}
+
+// validateServerTLS validates the SNI certificates and reload interval.
+// Each hostname must be mapped to a single SNI certificate, so that it is
+// clear which one is presented.
+func validateServerTLS(t *options.TLS) []string {
+	msgs := []string{}
+	if t == nil {
+		return msgs
+	}
+
+	if t.ReloadInterval < 0 {
+		msgs = append(msgs, "ReloadInterval must not be negative")
+	}
+
+	certificates := map[string]int{}
+	for i, sni := range t.SNICertificates {
+		if len(sni.Hostnames) == 0 {
+			msgs = append(msgs, fmt.Sprintf("SNICertificates[%d] has no hostnames", i))
+		}
+		if sni.Cert == nil || sni.Key == nil {
+			msgs = append(msgs, fmt.Sprintf("SNICertificates[%d] must have both a cert and a key", i))
+		}
+
+		for _, hostname := range sni.Hostnames {
+			name := strings.ToLower(hostname)
+			if !isValidSNIHostname(name) {
+				msgs = append(msgs, fmt.Sprintf("SNICertificates[%d] has an invalid hostname %q: wildcards are only allowed as the first label, e.g. \"*.example.com\"", i, hostname))
+				continue
+			}
+			if j, ok := certificates[name]; ok && j != i {
+				msgs = append(msgs, fmt.Sprintf("hostname %q is mapped to both SNICertificates[%d] and SNICertificates[%d]", hostname, j, i))
+				continue
+			}
+			certificates[name] = i
+		}
+	}
+	return msgs
+}
+
+// isValidSNIHostname returns whether the hostname is non-empty, and either has
+// no wildcards or only a wildcard as its first label
+func isValidSNIHostname(hostname string) bool {
+	name := strings.TrimPrefix(hostname, "*.")
+	return name != "" && !strings.HasSuffix(name, ".") && !strings.Contains(name, "*")
+}
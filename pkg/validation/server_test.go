@@ -0,0 +1,96 @@
+package validation
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	cert := &options.SecretSource{FromFile: "/etc/tls/tls.crt"}
+	key := &options.SecretSource{FromFile: "/etc/tls/tls.key"}
+
+	type validateServersTableInput struct {
+		server        options.Server
+		metricsServer options.Server
+		drainTimeout  time.Duration
+		errStrings    []string
+	}
+
+	DescribeTable("validateServers",
+		func(in validateServersTableInput) {
+			opts := &options.Options{
+				Server:        in.server,
+				MetricsServer: in.metricsServer,
+
+				WebSocketDrainTimeout: in.drainTimeout,
+			}
+			Expect(validateServers(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Without TLS", validateServersTableInput{
+			errStrings: []string{},
+		}),
+		Entry("With SNI certificates", validateServersTableInput{
+			server: options.Server{
+				TLS: &options.TLS{
+					Cert: cert,
+					Key:  key,
+					SNICertificates: []options.SNICertificate{
+						{Hostnames: []string{"app.example.com", "*.app.example.com"}, Cert: cert, Key: key},
+						// Exact hostnames take precedence over wildcards
+						{Hostnames: []string{"admin.app.example.com"}, Cert: cert, Key: key},
+					},
+					ReloadInterval: options.Duration(time.Minute),
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("With invalid SNI certificates", validateServersTableInput{
+			server: options.Server{
+				TLS: &options.TLS{
+					Cert: cert,
+					Key:  key,
+					SNICertificates: []options.SNICertificate{
+						{Cert: cert},
+						{Hostnames: []string{"*", "app.*.example.com", "app.example.com."}, Cert: cert, Key: key},
+					},
+					ReloadInterval: options.Duration(-1),
+				},
+			},
+			errStrings: []string{
+				"server.TLS: ReloadInterval must not be negative",
+				"server.TLS: SNICertificates[0] has no hostnames",
+				"server.TLS: SNICertificates[0] must have both a cert and a key",
+				"server.TLS: SNICertificates[1] has an invalid hostname \"*\": wildcards are only allowed as the first label, e.g. \"*.example.com\"",
+				"server.TLS: SNICertificates[1] has an invalid hostname \"app.*.example.com\": wildcards are only allowed as the first label, e.g. \"*.example.com\"",
+				"server.TLS: SNICertificates[1] has an invalid hostname \"app.example.com.\": wildcards are only allowed as the first label, e.g. \"*.example.com\"",
+			},
+		}),
+		Entry("With a hostname mapped to different SNI certificates", validateServersTableInput{
+			metricsServer: options.Server{
+				TLS: &options.TLS{
+					Cert: cert,
+					Key:  key,
+					SNICertificates: []options.SNICertificate{
+						{Hostnames: []string{"*.example.com", "metrics.example.com"}, Cert: cert, Key: key},
+						{Hostnames: []string{"Metrics.example.com"}, Cert: cert, Key: key},
+					},
+				},
+			},
+			errStrings: []string{
+				"metricsServer.TLS: hostname \"Metrics.example.com\" is mapped to both SNICertificates[0] and SNICertificates[1]",
+			},
+		}),
+		Entry("With a WebSocket drain timeout", validateServersTableInput{
+			drainTimeout: 30 * time.Second,
+			errStrings:   []string{},
+		}),
+		Entry("With a negative WebSocket drain timeout", validateServersTableInput{
+			drainTimeout: -time.Second,
+			errStrings:   []string{"websocket_drain_timeout (-1s) must not be negative"},
+		}),
+	)
+})
@@ -0,0 +1,28 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+func validateSessionDebug(o options.SessionDebug) []string {
+	msgs := []string{}
+	for _, route := range o.HeaderRoutes {
+		if _, err := regexp.Compile(route); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid session_debug_header_routes pattern (%q): %v", route, err))
+		}
+	}
+
+	header := o.OptInHeader
+	switch {
+	case header == "":
+	case strings.ContainsAny(header, " ,;:\t\"()<>@/[]?={}"):
+		msgs = append(msgs, fmt.Sprintf("invalid session_debug_header_opt_in (%q): must be a header name", header))
+	case isHopByHopHeader(header):
+		msgs = append(msgs, fmt.Sprintf("invalid session_debug_header_opt_in (%q): must not be a hop-by-hop header", header))
+	}
+	return msgs
+}
@@ -0,0 +1,32 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Debug", func() {
+	DescribeTable("validateSessionDebug",
+		func(o options.SessionDebug, expectedMsgs []string) {
+			Expect(validateSessionDebug(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with the session debug headers disabled", options.SessionDebug{}, []string{}),
+		Entry("with routes and an opt-in header", options.SessionDebug{
+			HeaderRoutes: []string{"^/api/", "^/oauth2/auth$"},
+			OptInHeader:  "X-Debug-Session",
+		}, []string{}),
+		Entry("with an invalid route", options.SessionDebug{
+			HeaderRoutes: []string{"^/api/("},
+		}, []string{
+			"invalid session_debug_header_routes pattern (\"^/api/(\"): error parsing regexp: missing closing ): `^/api/(`",
+		}),
+		Entry("with an invalid opt-in header", options.SessionDebug{
+			OptInHeader: "X-Debug: true",
+		}, []string{"invalid session_debug_header_opt_in (\"X-Debug: true\"): must be a header name"}),
+		Entry("with a hop-by-hop opt-in header", options.SessionDebug{
+			OptInHeader: "Connection",
+		}, []string{"invalid session_debug_header_opt_in (\"Connection\"): must not be a hop-by-hop header"}),
+	)
+})
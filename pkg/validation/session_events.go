@@ -0,0 +1,56 @@
+package validation
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessionevents"
+)
+
+func validateSessionEvents(o *options.Options) []string {
+	events := o.SessionEvents
+	if events.WebhookURL == "" {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if u, err := url.Parse(events.WebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("session_events_webhook_url (%q) must be an https URL", events.WebhookURL))
+	}
+
+	keys, err := sessionevents.LoadSigningKeys(events.SigningKeyFiles)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid session_events_signing_key_files: %v", err))
+	}
+	// A leaked cookie secret must not allow events to be forged
+	for _, key := range keys {
+		if bytes.Equal(key, []byte(o.Cookie.Secret)) || bytes.Equal(key, encryption.SecretBytes(o.Cookie.Secret)) {
+			msgs = append(msgs, "session_events_signing_key_files must not contain the cookie_secret")
+		}
+	}
+
+	for _, eventType := range events.Types {
+		switch eventType {
+		case options.SessionEventLogin, options.SessionEventLogout, options.SessionEventRefreshFailure, options.SessionEventAuthorizationDenied, options.SessionEventFallbackLogin, options.SessionEventEvicted, options.SessionEventMaintenance:
+		default:
+			msgs = append(msgs, fmt.Sprintf("session_events (%q) must be one of: %s, %s, %s, %s, %s, %s or %s", eventType,
+				options.SessionEventLogin, options.SessionEventLogout, options.SessionEventRefreshFailure, options.SessionEventAuthorizationDenied, options.SessionEventFallbackLogin, options.SessionEventEvicted, options.SessionEventMaintenance))
+		}
+	}
+	if events.DropPolicy != options.SessionEventsDropNewest && events.DropPolicy != options.SessionEventsDropOldest {
+		msgs = append(msgs, fmt.Sprintf("session_events_drop_policy (%q) must be %s or %s", events.DropPolicy, options.SessionEventsDropNewest, options.SessionEventsDropOldest))
+	}
+	if events.QueueSize <= 0 {
+		msgs = append(msgs, fmt.Sprintf("session_events_queue_size (%d) must be positive", events.QueueSize))
+	}
+	if events.MaxRetries < 0 {
+		msgs = append(msgs, fmt.Sprintf("session_events_max_retries (%d) must not be negative", events.MaxRetries))
+	}
+	if events.Timeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("session_events_timeout (%q) must be positive", events.Timeout.String()))
+	}
+	return msgs
+}
@@ -0,0 +1,132 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Events", func() {
+	const signingKey = "0123456789abcdef0123456789abcdef"
+
+	var keyFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "oauth2-proxy-session-events-key")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(signingKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		keyFile = f.Name()
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(keyFile)).To(Succeed())
+	})
+
+	type validateSessionEventsTableInput struct {
+		webhookURL   string
+		keyFiles     int
+		types        []string
+		dropPolicy   string
+		queueSize    int
+		maxRetries   int
+		timeout      time.Duration
+		cookieSecret string
+		errStrings   []string
+	}
+
+	DescribeTable("validateSessionEvents",
+		func(in validateSessionEventsTableInput) {
+			opts := &options.Options{
+				Cookie: options.Cookie{Secret: in.cookieSecret},
+				SessionEvents: options.SessionEvents{
+					WebhookURL: in.webhookURL,
+					Types:      in.types,
+					DropPolicy: options.SessionEventsDropNewest,
+					QueueSize:  options.DefaultSessionEventsQueueSize,
+					MaxRetries: in.maxRetries,
+					Timeout:    options.DefaultSessionEventsTimeout,
+				},
+			}
+			for i := 0; i < in.keyFiles; i++ {
+				opts.SessionEvents.SigningKeyFiles = append(opts.SessionEvents.SigningKeyFiles, keyFile)
+			}
+			if in.dropPolicy != "" {
+				opts.SessionEvents.DropPolicy = in.dropPolicy
+			}
+			if in.queueSize != 0 {
+				opts.SessionEvents.QueueSize = in.queueSize
+			}
+			if in.timeout != 0 {
+				opts.SessionEvents.Timeout = in.timeout
+			}
+			Expect(validateSessionEvents(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Disabled", validateSessionEventsTableInput{
+			queueSize:  -1,
+			errStrings: []string{},
+		}),
+		Entry("With a webhook", validateSessionEventsTableInput{
+			webhookURL: "https://siem.example.com/events",
+			keyFiles:   1,
+			types:      []string{options.SessionEventLogin, options.SessionEventAuthorizationDenied},
+			dropPolicy: options.SessionEventsDropOldest,
+			errStrings: []string{},
+		}),
+		Entry("With two signing keys", validateSessionEventsTableInput{
+			webhookURL: "https://siem.example.com/events",
+			keyFiles:   2,
+			errStrings: []string{},
+		}),
+		Entry("With an http webhook", validateSessionEventsTableInput{
+			webhookURL: "http://siem.example.com/events",
+			keyFiles:   1,
+			errStrings: []string{
+				`session_events_webhook_url ("http://siem.example.com/events") must be an https URL`,
+			},
+		}),
+		Entry("Without a signing key", validateSessionEventsTableInput{
+			webhookURL: "https://siem.example.com/events",
+			errStrings: []string{
+				"invalid session_events_signing_key_files: no signing key file configured",
+			},
+		}),
+		Entry("With three signing keys", validateSessionEventsTableInput{
+			webhookURL: "https://siem.example.com/events",
+			keyFiles:   3,
+			errStrings: []string{
+				"invalid session_events_signing_key_files: at most 2 signing key files can be configured, got 3",
+			},
+		}),
+		Entry("With the cookie secret as the signing key", validateSessionEventsTableInput{
+			webhookURL:   "https://siem.example.com/events",
+			keyFiles:     1,
+			cookieSecret: signingKey,
+			errStrings: []string{
+				"session_events_signing_key_files must not contain the cookie_secret",
+			},
+		}),
+		Entry("With invalid options", validateSessionEventsTableInput{
+			webhookURL: "https://siem.example.com/events",
+			keyFiles:   1,
+			types:      []string{"login", "session_created"},
+			dropPolicy: "block",
+			queueSize:  -1,
+			maxRetries: -1,
+			timeout:    -time.Second,
+			errStrings: []string{
+				`session_events ("session_created") must be one of: login, logout, refresh_failure, authorization_denied, fallback_login, session_evicted or maintenance`,
+				`session_events_drop_policy ("block") must be drop-newest or drop-oldest`,
+				"session_events_queue_size (-1) must be positive",
+				"session_events_max_retries (-1) must not be negative",
+				`session_events_timeout ("-1s") must be positive`,
+			},
+		}),
+	)
+})
@@ -4,11 +4,16 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	providerutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/redis"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/sql"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
 )
 
 func validateSessionCookieMinimal(o *options.Options) []string {
@@ -16,8 +21,13 @@ func validateSessionCookieMinimal(o *options.Options) []string {
 		return []string{}
 	}
 
+	headers := []options.Header{}
+	headers = append(headers, o.InjectRequestHeaders...)
+	headers = append(headers, o.InjectResponseHeaders...)
+	headers = append(headers, o.AuthResponse.Headers...)
+
 	msgs := []string{}
-	for _, header := range append(o.InjectRequestHeaders, o.InjectResponseHeaders...) {
+	for _, header := range headers {
 		for _, value := range header.Values {
 			if value.ClaimSource != nil {
 				if value.ClaimSource.Claim == "access_token" {
@@ -39,6 +49,25 @@ func validateSessionCookieMinimal(o *options.Options) []string {
 	return msgs
 }
 
+// validateSessionCookieRefreshLock checks that the refreshes of sessions are
+// only locked for the cookie session store, in the Redis server configured by
+// the redis options
+func validateSessionCookieRefreshLock(o *options.Options) []string {
+	if !o.Session.Cookie.RefreshLock {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if o.Session.Type != options.CookieSessionStoreType {
+		msgs = append(msgs, "session_cookie_refresh_lock requires a cookie session store, other session stores lock the refreshes of their sessions")
+	}
+	redisOpts := o.Session.Redis
+	if redisOpts.ConnectionURL == "" && len(redisOpts.SentinelConnectionURLs) == 0 && len(redisOpts.ClusterConnectionURLs) == 0 {
+		msgs = append(msgs, "session_cookie_refresh_lock requires redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls to be set")
+	}
+	return append(msgs, validateRedisCredentials(redisOpts)...)
+}
+
 // validateRedisSessionStore builds a Redis Client from the options and
 // attempts to connect, Set, Get and Del a random health check key
 func validateRedisSessionStore(o *options.Options) []string {
@@ -46,10 +75,15 @@ func validateRedisSessionStore(o *options.Options) []string {
 		return []string{}
 	}
 
+	if msgs := validateRedisCredentials(o.Session.Redis); len(msgs) > 0 {
+		return msgs
+	}
+
 	client, err := redis.NewRedisClient(o.Session.Redis)
 	if err != nil {
 		return []string{fmt.Sprintf("unable to initialize a redis client: %v", err)}
 	}
+	defer client.Close()
 
 	n, err := encryption.Nonce(32)
 	if err != nil {
@@ -61,11 +95,262 @@ func validateRedisSessionStore(o *options.Options) []string {
 	return sendRedisConnectionTest(client, key, nonce)
 }
 
+// validateRedisCredentials checks that usernames are given with a password, as
+// redis ACL users can't authenticate without one
+func validateRedisCredentials(opts options.RedisStoreOptions) []string {
+	msgs := []string{}
+	if opts.Username != "" && opts.Password == "" && (opts.UseSentinel || opts.UseCluster) {
+		msgs = append(msgs, "redis_username requires redis_password to be set")
+	}
+	if opts.SentinelUsername != "" && opts.SentinelPassword == "" {
+		msgs = append(msgs, "redis_sentinel_username requires redis_sentinel_password to be set")
+	}
+	if opts.DNSRefreshInterval < 0 {
+		msgs = append(msgs, "redis_dns_refresh_interval must not be negative")
+	}
+	return msgs
+}
+
+// validateRedisSessionCleanup checks that the cleanup of redis sessions is
+// rate limited if it is enabled
+func validateRedisSessionCleanup(o *options.Options) []string {
+	if o.Session.Type != options.RedisSessionStoreType {
+		return []string{}
+	}
+
+	msgs := []string{}
+	redisOpts := o.Session.Redis
+	if redisOpts.CleanupInterval < 0 {
+		msgs = append(msgs, "redis_cleanup_interval must not be negative")
+	}
+	if redisOpts.CleanupInterval > 0 && redisOpts.CleanupKeysPerSecond <= 0 {
+		msgs = append(msgs, "redis_cleanup_keys_per_second must be greater than 0 when redis_cleanup_interval is set")
+	}
+	return msgs
+}
+
+// validateMemorySessionStore checks that the memory session store can hold
+// sessions
+func validateMemorySessionStore(o *options.Options) []string {
+	if o.Session.Type != options.MemorySessionStoreType {
+		return []string{}
+	}
+
+	if o.Session.Memory.MaxEntries <= 0 {
+		return []string{"memory_store_max_entries must be greater than 0"}
+	}
+	return []string{}
+}
+
+// validateSQLSessionStore checks that the sql session store has a supported
+// driver and a database to connect to
+func validateSQLSessionStore(o *options.Options) []string {
+	if o.Session.Type != options.SQLSessionStoreType {
+		return []string{}
+	}
+
+	msgs := []string{}
+	sqlOpts := o.Session.SQL
+	switch sqlOpts.Driver {
+	case options.PostgresSQLDriver, options.MySQLSQLDriver:
+	default:
+		msgs = append(msgs, fmt.Sprintf("unknown sql_store_driver %q: must be postgres or mysql", sqlOpts.Driver))
+	}
+	if sqlOpts.DSN == "" {
+		msgs = append(msgs, "sql_store_dsn must be set when session_store_type is sql")
+	}
+	if err := sql.ValidateTableName(sqlOpts.Table); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if sqlOpts.MaxOpenConns <= 0 {
+		msgs = append(msgs, "sql_store_max_open_connections must be greater than 0")
+	}
+	if sqlOpts.CleanupInterval < 0 {
+		msgs = append(msgs, "sql_store_cleanup_interval must not be negative")
+	}
+	return msgs
+}
+
+// validateSessionKMS checks that envelope encryption is only configured for
+// persistent session stores, with a key for the type of KMS
+func validateSessionKMS(o *options.Options) []string {
+	kmsOpts := o.Session.KMS
+	if kmsOpts.Type == "" {
+		if kmsOpts.Key != "" {
+			return []string{"session_kms_key requires session_kms_type to be set"}
+		}
+		return []string{}
+	}
+
+	msgs := []string{}
+	if o.Session.Type == options.CookieSessionStoreType {
+		msgs = append(msgs, "session_kms_type requires a redis, memory or sql session store")
+	}
+
+	switch kmsOpts.Type {
+	case options.LocalKMSType, options.GCPKMSType, options.AWSKMSType:
+	default:
+		return append(msgs, fmt.Sprintf("unknown session_kms_type %q: must be local, gcp or aws", kmsOpts.Type))
+	}
+
+	switch {
+	case kmsOpts.Key == "":
+		msgs = append(msgs, "session_kms_key must be set when session_kms_type is set")
+	case kmsOpts.Type == options.LocalKMSType:
+		switch len(encryption.SecretBytes(kmsOpts.Key)) {
+		case 16, 24, 32:
+		default:
+			msgs = append(msgs, "session_kms_key must be 16, 24, or 32 bytes to create a local kms key")
+		}
+	}
+	return msgs
+}
+
+// validateSessionStoreUnavailable checks that the global and upstream session
+// store unavailable policies are known
+func validateSessionStoreUnavailable(o *options.Options) []string {
+	msgs := []string{}
+	if !isSessionStorePolicy(o.Session.StoreUnavailable) {
+		msgs = append(msgs, fmt.Sprintf("unknown session_store_unavailable %q: must be fail-closed, fail-open-anonymous or fail-open-cached", o.Session.StoreUnavailable))
+	}
+	for _, upstream := range o.UpstreamServers.Upstreams {
+		if !isSessionStorePolicy(upstream.SessionStoreUnavailable) {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has unknown sessionStoreUnavailable %q: must be fail-closed, fail-open-anonymous or fail-open-cached", upstream.ID, upstream.SessionStoreUnavailable))
+		}
+	}
+	return msgs
+}
+
+// validateSessionBearerTokens checks that bearer sessions are kept in redis,
+// as their tokens are session tickets, and that no other bearer tokens are
+// accepted in the Authorization header
+func validateSessionBearerTokens(o *options.Options) []string {
+	if !o.Session.BearerTokens {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if o.Session.Type != options.RedisSessionStoreType {
+		msgs = append(msgs, "session_bearer_tokens requires a redis session store")
+	}
+	if o.SkipJwtBearerTokens {
+		msgs = append(msgs, "session_bearer_tokens cannot be used with skip_jwt_bearer_tokens")
+	}
+	if o.Introspection.URL != "" {
+		msgs = append(msgs, "session_bearer_tokens cannot be used with introspection_url")
+	}
+	return msgs
+}
+
+// validateSessionMaxPerUser checks that the sessions per user are only limited
+// with persistent session stores, which track the sessions of each user
+func validateSessionMaxPerUser(o *options.Options) []string {
+	msgs := []string{}
+	if o.Session.MaxPerUser < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid session_max_per_user (%d): must not be negative", o.Session.MaxPerUser))
+	}
+	if o.Session.MaxPerUser > 0 && o.Session.Type == options.CookieSessionStoreType {
+		msgs = append(msgs, "session_max_per_user requires a redis, memory or sql session store")
+	}
+	switch o.Session.MaxPerUserPolicy {
+	case "", options.SessionMaxPerUserRejectNew, options.SessionMaxPerUserEvictOldest:
+	default:
+		msgs = append(msgs, fmt.Sprintf("unknown session_max_per_user_policy %q: must be reject-new or evict-oldest", o.Session.MaxPerUserPolicy))
+	}
+	return msgs
+}
+
+// validateSessionBackchannelLogout checks that the sessions signed out by the
+// back-channel logouts of the provider are kept in a persistent session store
+func validateSessionBackchannelLogout(o *options.Options) []string {
+	if o.Session.BackchannelLogout && o.Session.Type == options.CookieSessionStoreType {
+		return []string{"session_backchannel_logout requires a redis, memory or sql session store"}
+	}
+	return []string{}
+}
+
+// validateSessionInventory checks that the sessions of the inventory are kept
+// in a persistent session store
+func validateSessionInventory(o *options.Options) []string {
+	if o.Session.Inventory && o.Session.Type == options.CookieSessionStoreType {
+		return []string{"session_inventory requires a redis, memory or sql session store"}
+	}
+	return []string{}
+}
+
+func isSessionStorePolicy(policy string) bool {
+	switch policy {
+	case "", options.SessionStoreFailClosed, options.SessionStoreFailOpenAnonymous, options.SessionStoreFailOpenCached:
+		return true
+	}
+	return false
+}
+
+// validateSessionStoreClaims checks that the session store claims are dot
+// separated claim paths, and that they include every claim used by headers and
+// templated upstream URIs, as all other claims are dropped from the session.
+// The enriched claims are always kept in the session.
+func validateSessionStoreClaims(o *options.Options) []string {
+	storeClaims := o.Session.StoreClaims
+	if len(storeClaims) == 0 {
+		return []string{}
+	}
+
+	msgs := []string{}
+	for _, path := range storeClaims {
+		for _, key := range strings.Split(path, ".") {
+			if key == "" || strings.ContainsAny(key, "[]") {
+				msgs = append(msgs, fmt.Sprintf("session_store_claims entry %q must be a claim name or a dot separated path of claim names", path))
+				break
+			}
+		}
+	}
+
+	isStored := func(claim string) bool {
+		return (&sessionsapi.SessionState{}).HasClaim(claim) || providerutil.IsSelectedClaim(claim, storeClaims) ||
+			isEnrichedClaim(o.ClaimEnrichment, claim)
+	}
+
+	headers := []options.Header{}
+	headers = append(headers, o.InjectRequestHeaders...)
+	headers = append(headers, o.InjectResponseHeaders...)
+	headers = append(headers, o.AuthResponse.Headers...)
+	for _, header := range headers {
+		for _, value := range header.Values {
+			if value.ClaimSource != nil && !isStored(value.ClaimSource.Claim) {
+				msgs = append(msgs,
+					fmt.Sprintf("claim %q for header %q is not stored in sessions: add it to session_store_claims", value.ClaimSource.Claim, header.Name))
+			}
+			if value.TemplateSource != nil {
+				for _, claim := range templateSourceClaims(*value.TemplateSource) {
+					if !isStored(claim) {
+						msgs = append(msgs,
+							fmt.Sprintf("claim %q for header %q is not stored in sessions: add it to session_store_claims", claim, header.Name))
+					}
+				}
+			}
+		}
+	}
+
+	for _, u := range o.UpstreamServers.Upstreams {
+		for _, claim := range upstream.TemplatedURIClaims(u.URI) {
+			if !isStored(claim) {
+				msgs = append(msgs,
+					fmt.Sprintf("claim %q for the uri of upstream %q is not stored in sessions: add it to session_store_claims", claim, u.ID))
+			}
+		}
+	}
+	return msgs
+}
+
 func sendRedisConnectionTest(client redis.Client, key string, val string) []string {
 	msgs := []string{}
 	ctx := context.Background()
 
 	err := client.Set(ctx, key, []byte(val), time.Duration(60)*time.Second)
+	if isRedisAuthError(err) {
+		return []string{fmt.Sprintf("unable to authenticate to redis, check redis_username and redis_password: %v", err)}
+	}
 	if err != nil {
 		msgs = append(msgs, fmt.Sprintf("unable to set a redis initialization key: %v", err))
 	} else {
@@ -86,3 +371,13 @@ func sendRedisConnectionTest(client redis.Client, key string, val string) []stri
 	}
 	return msgs
 }
+
+// isRedisAuthError returns whether redis rejected the credentials of the
+// connection, or requires credentials that weren't given
+func isRedisAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "NOAUTH")
+}
@@ -0,0 +1,29 @@
+package validation
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/signedurl"
+)
+
+func validateSignedURL(o *options.Options) []string {
+	if o.SignedURL.KeyFile == "" {
+		return []string{}
+	}
+
+	signer, err := signedurl.NewSigner(o.SignedURL)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid signed url configuration: %v", err)}
+	}
+
+	// A leaked cookie secret must not allow URLs to be signed, nor the other
+	// way around
+	key := signer.Key()
+	if bytes.Equal(key, []byte(o.Cookie.Secret)) || bytes.Equal(key, encryption.SecretBytes(o.Cookie.Secret)) {
+		return []string{"signed_url_key_file must not contain the cookie_secret"}
+	}
+	return []string{}
+}
@@ -0,0 +1,79 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed URL", func() {
+	const signedURLKey = "0123456789abcdef0123456789abcdef"
+
+	var keyFile string
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "oauth2-proxy-signed-url-key")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString(signedURLKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		keyFile = f.Name()
+	})
+
+	AfterEach(func() {
+		Expect(os.Remove(keyFile)).To(Succeed())
+	})
+
+	type validateSignedURLTableInput struct {
+		withKeyFile  bool
+		maxLifetime  time.Duration
+		cookieSecret string
+		errStrings   []string
+	}
+
+	DescribeTable("validateSignedURL",
+		func(in validateSignedURLTableInput) {
+			opts := &options.Options{
+				Cookie: options.Cookie{Secret: in.cookieSecret},
+				SignedURL: options.SignedURL{
+					MaxLifetime: in.maxLifetime,
+				},
+			}
+			if in.withKeyFile {
+				opts.SignedURL.KeyFile = keyFile
+			}
+			Expect(validateSignedURL(opts)).To(ConsistOf(in.errStrings))
+		},
+		Entry("Disabled", validateSignedURLTableInput{
+			maxLifetime:  time.Hour,
+			cookieSecret: signedURLKey,
+			errStrings:   []string{},
+		}),
+		Entry("With a key file", validateSignedURLTableInput{
+			withKeyFile:  true,
+			maxLifetime:  time.Hour,
+			cookieSecret: "secretthirtytwobytes+abcdefghijk",
+			errStrings:   []string{},
+		}),
+		Entry("Max lifetime not set", validateSignedURLTableInput{
+			withKeyFile:  true,
+			cookieSecret: "secretthirtytwobytes+abcdefghijk",
+			errStrings: []string{
+				"invalid signed url configuration: max lifetime must be positive",
+			},
+		}),
+		Entry("Key matching the cookie secret", validateSignedURLTableInput{
+			withKeyFile:  true,
+			maxLifetime:  time.Hour,
+			cookieSecret: signedURLKey,
+			errStrings: []string{
+				"signed_url_key_file must not contain the cookie_secret",
+			},
+		}),
+	)
+})
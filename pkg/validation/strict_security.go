@@ -0,0 +1,155 @@
+package validation
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// strictSecurityCheck is a check enforced by the strict security mode,
+// which returns the reason the options are refused, if any
+type strictSecurityCheck struct {
+	name  string
+	check func(o *options.Options) []string
+}
+
+// strictSecurityChecks are the checks of the strict security mode, by the
+// names they are exempted with
+var strictSecurityChecks = []strictSecurityCheck{
+	{name: "insecure-cookie", check: checkInsecureCookie},
+	{name: "tls-skip-verify", check: checkTLSSkipVerify},
+	{name: "http-redirect-url", check: checkHTTPRedirectURL},
+	{name: "short-cookie-secret", check: checkShortCookieSecret},
+	{name: "samesite-none-insecure", check: checkSameSiteNoneInsecure},
+}
+
+func validateStrictSecurity(o *options.Options) []string {
+	msgs := []string{}
+	if !o.StrictSecurity.Enabled {
+		if len(o.StrictSecurity.Exempt) > 0 {
+			msgs = append(msgs, "strict_security_exempt is set, but strict_security is not, this will have no effect.")
+		}
+		return msgs
+	}
+
+	exempt := map[string]bool{}
+	for _, name := range o.StrictSecurity.Exempt {
+		if !isStrictSecurityCheck(name) {
+			msgs = append(msgs, fmt.Sprintf("invalid strict_security_exempt (%q): must be one of %s", name, strings.Join(strictSecurityCheckNames(), ", ")))
+			continue
+		}
+		exempt[name] = true
+	}
+
+	enforced := []string{}
+	for _, c := range strictSecurityChecks {
+		if exempt[c.name] {
+			continue
+		}
+		enforced = append(enforced, c.name)
+		for _, reason := range c.check(o) {
+			msgs = append(msgs, fmt.Sprintf("strict_security (%s): %s", c.name, reason))
+		}
+	}
+	logger.Printf("Strict security mode enforcing: %s", strings.Join(enforced, ", "))
+	if len(exempt) > 0 {
+		logger.Printf("Strict security mode exempting: %s", strings.Join(o.StrictSecurity.Exempt, ", "))
+	}
+	return msgs
+}
+
+func isStrictSecurityCheck(name string) bool {
+	for _, c := range strictSecurityChecks {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func strictSecurityCheckNames() []string {
+	names := []string{}
+	for _, c := range strictSecurityChecks {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// checkInsecureCookie refuses cookies without the Secure flag, unless the
+// redirect URL is on localhost, where HTTPS is rarely available
+func checkInsecureCookie(o *options.Options) []string {
+	if o.Cookie.Secure {
+		return nil
+	}
+	redirectURL, err := url.Parse(o.RawRedirectURL)
+	if err == nil && o.RawRedirectURL != "" && isLocalhost(redirectURL.Hostname()) {
+		return nil
+	}
+	return []string{"cookie_secure must be true unless the redirect_url is on localhost"}
+}
+
+// checkTLSSkipVerify refuses skipping the verification of the certificates
+// of the provider and of the upstreams
+func checkTLSSkipVerify(o *options.Options) []string {
+	msgs := []string{}
+	if o.SSLInsecureSkipVerify {
+		msgs = append(msgs, "ssl_insecure_skip_verify must not be set")
+	}
+	for _, upstream := range o.UpstreamServers.Upstreams {
+		if upstream.InsecureSkipTLSVerify {
+			msgs = append(msgs, fmt.Sprintf("upstream %q must not set insecureSkipTLSVerify", upstream.ID))
+		}
+	}
+	return msgs
+}
+
+// checkHTTPRedirectURL refuses redirect URLs without TLS, including the
+// redirect URL defaulting to HTTP when none is configured
+func checkHTTPRedirectURL(o *options.Options) []string {
+	if o.RawRedirectURL == "" {
+		if !o.Cookie.Secure && !o.ReverseProxy {
+			return []string{"redirect_url must be set, redirects would default to insecure HTTP"}
+		}
+		return nil
+	}
+	redirectURL, err := url.Parse(o.RawRedirectURL)
+	if err == nil && redirectURL.Scheme == "http" {
+		return []string{fmt.Sprintf("redirect_url (%q) must use https", o.RawRedirectURL)}
+	}
+	return nil
+}
+
+// checkShortCookieSecret refuses cookie secrets shorter than 32 bytes,
+// invalid secrets are reported by the cookie validation
+func checkShortCookieSecret(o *options.Options) []string {
+	if o.Cookie.Secret == "" {
+		return nil
+	}
+	if length := len(encryption.SecretBytes(o.Cookie.Secret)); length < 32 {
+		return []string{fmt.Sprintf("cookie_secret must be 32 bytes, but is %d bytes", length)}
+	}
+	return nil
+}
+
+// checkSameSiteNoneInsecure refuses SameSite=None cookies without the
+// Secure flag, which browsers reject
+func checkSameSiteNoneInsecure(o *options.Options) []string {
+	if o.Cookie.SameSite == "none" && !o.Cookie.Secure {
+		return []string{"cookie_samesite \"none\" requires cookie_secure to be true"}
+	}
+	return nil
+}
+
+// isLocalhost checks whether the host is localhost or a loopback address
+func isLocalhost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,97 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Strict Security", func() {
+	secureOptions := func(modify func(*options.Options)) *options.Options {
+		o := &options.Options{
+			RawRedirectURL: "https://auth.example.com/oauth2/callback",
+			Cookie: options.Cookie{
+				Secret: "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=",
+				Secure: true,
+			},
+			StrictSecurity: options.StrictSecurity{Enabled: true},
+		}
+		if modify != nil {
+			modify(o)
+		}
+		return o
+	}
+
+	DescribeTable("validateStrictSecurity",
+		func(o *options.Options, expectedMsgs []string) {
+			Expect(validateStrictSecurity(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with secure options", secureOptions(nil), []string{}),
+		Entry("with strict security disabled", secureOptions(func(o *options.Options) {
+			o.StrictSecurity.Enabled = false
+			o.Cookie.Secure = false
+			o.SSLInsecureSkipVerify = true
+		}), []string{}),
+		Entry("with exemptions, but strict security disabled", secureOptions(func(o *options.Options) {
+			o.StrictSecurity = options.StrictSecurity{Exempt: []string{"tls-skip-verify"}}
+		}), []string{
+			"strict_security_exempt is set, but strict_security is not, this will have no effect.",
+		}),
+		Entry("with insecure cookies on localhost", secureOptions(func(o *options.Options) {
+			o.RawRedirectURL = "http://localhost:4180/oauth2/callback"
+			o.Cookie.Secure = false
+			o.StrictSecurity.Exempt = []string{"http-redirect-url"}
+		}), []string{}),
+		Entry("with insecure cookies on a public hostname", secureOptions(func(o *options.Options) {
+			o.Cookie.Secure = false
+		}), []string{
+			"strict_security (insecure-cookie): cookie_secure must be true unless the redirect_url is on localhost",
+		}),
+		Entry("with TLS verification skipped", secureOptions(func(o *options.Options) {
+			o.SSLInsecureSkipVerify = true
+			o.UpstreamServers = options.UpstreamConfig{Upstreams: []options.Upstream{
+				{ID: "verified", Path: "/", URI: "https://app.internal"},
+				{ID: "unverified", Path: "/legacy/", URI: "https://legacy.internal", InsecureSkipTLSVerify: true},
+			}}
+		}), []string{
+			"strict_security (tls-skip-verify): ssl_insecure_skip_verify must not be set",
+			"strict_security (tls-skip-verify): upstream \"unverified\" must not set insecureSkipTLSVerify",
+		}),
+		Entry("with an HTTP redirect URL", secureOptions(func(o *options.Options) {
+			o.RawRedirectURL = "http://auth.example.com/oauth2/callback"
+		}), []string{
+			"strict_security (http-redirect-url): redirect_url (\"http://auth.example.com/oauth2/callback\") must use https",
+		}),
+		Entry("without a redirect URL, defaulting to HTTP", secureOptions(func(o *options.Options) {
+			o.RawRedirectURL = ""
+			o.Cookie.Secure = false
+			o.StrictSecurity.Exempt = []string{"insecure-cookie"}
+		}), []string{
+			"strict_security (http-redirect-url): redirect_url must be set, redirects would default to insecure HTTP",
+		}),
+		Entry("with a short cookie secret", secureOptions(func(o *options.Options) {
+			o.Cookie.Secret = "0123456789abcdef"
+		}), []string{
+			"strict_security (short-cookie-secret): cookie_secret must be 32 bytes, but is 16 bytes",
+		}),
+		Entry("with SameSite=None without Secure", secureOptions(func(o *options.Options) {
+			o.RawRedirectURL = "https://localhost/oauth2/callback"
+			o.Cookie.Secure = false
+			o.Cookie.SameSite = "none"
+		}), []string{
+			"strict_security (samesite-none-insecure): cookie_samesite \"none\" requires cookie_secure to be true",
+		}),
+		Entry("with every check exempted", secureOptions(func(o *options.Options) {
+			o.RawRedirectURL = "http://auth.example.com/oauth2/callback"
+			o.Cookie = options.Cookie{Secret: "0123456789abcdef", SameSite: "none"}
+			o.SSLInsecureSkipVerify = true
+			o.StrictSecurity.Exempt = []string{"insecure-cookie", "tls-skip-verify", "http-redirect-url", "short-cookie-secret", "samesite-none-insecure"}
+		}), []string{}),
+		Entry("with an unknown exemption", secureOptions(func(o *options.Options) {
+			o.StrictSecurity.Exempt = []string{"cookie-secure"}
+		}), []string{
+			"invalid strict_security_exempt (\"cookie-secure\"): must be one of insecure-cookie, tls-skip-verify, http-redirect-url, short-cookie-secret, samesite-none-insecure",
+		}),
+	)
+})
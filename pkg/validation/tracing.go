@@ -0,0 +1,33 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/tracing"
+)
+
+func validateTracing(o options.Tracing) []string {
+	msgs := []string{}
+	if o.OTLPEndpoint == "" {
+		if len(o.OTLPHeaders) > 0 {
+			msgs = append(msgs, "tracing_otlp_headers are set, but tracing_otlp_endpoint is not, this will have no effect.")
+		}
+		return msgs
+	}
+
+	if u, err := url.Parse(o.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("tracing_otlp_endpoint (%q) must be an http or https URL", o.OTLPEndpoint))
+	}
+	if _, err := tracing.ParseOTLPHeaders(o.OTLPHeaders); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid tracing_otlp_headers: %v", err))
+	}
+	if o.ServiceName == "" {
+		msgs = append(msgs, "tracing_service_name must not be empty")
+	}
+	if o.SampleRatio < 0 || o.SampleRatio > 1 {
+		msgs = append(msgs, fmt.Sprintf("tracing_sample_ratio (%v) must be between 0 and 1", o.SampleRatio))
+	}
+	return msgs
+}
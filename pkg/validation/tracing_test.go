@@ -0,0 +1,42 @@
+package validation
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	DescribeTable("validateTracing",
+		func(o options.Tracing, expectedMsgs []string) {
+			Expect(validateTracing(o)).To(ConsistOf(expectedMsgs))
+		},
+		Entry("with tracing disabled", options.Tracing{
+			ServiceName: options.DefaultTracingServiceName,
+			SampleRatio: options.DefaultTracingSampleRatio,
+		}, []string{}),
+		Entry("with an endpoint and headers", options.Tracing{
+			OTLPEndpoint: "https://otel-collector.example.com:4318/v1/traces",
+			OTLPHeaders:  []string{"Authorization=Basic dXNlcjpwYXNz", "X-Tenant=proxy"},
+			ServiceName:  "auth-proxy",
+			SampleRatio:  0.25,
+		}, []string{}),
+		Entry("with invalid options", options.Tracing{
+			OTLPEndpoint: "otel-collector:4318",
+			OTLPHeaders:  []string{"Bad Header=value"},
+			ServiceName:  "",
+			SampleRatio:  1.5,
+		}, []string{
+			"tracing_otlp_endpoint (\"otel-collector:4318\") must be an http or https URL",
+			"invalid tracing_otlp_headers: invalid OTLP header \"Bad Header=value\": must be Name=value",
+			"tracing_service_name must not be empty",
+			"tracing_sample_ratio (1.5) must be between 0 and 1",
+		}),
+		Entry("with headers, but no endpoint", options.Tracing{
+			OTLPHeaders: []string{"X-Tenant=proxy"},
+			ServiceName: options.DefaultTracingServiceName,
+			SampleRatio: options.DefaultTracingSampleRatio,
+		}, []string{"tracing_otlp_headers are set, but tracing_otlp_endpoint is not, this will have no effect."}),
+	)
+})
@@ -2,11 +2,44 @@ package validation
 
 import (
 	"fmt"
+	"mime"
+	"net"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	upstreamproxy "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/net/http/httpguts"
 )
 
+// ValidateUpstreamConfig validates upstreams reloaded at runtime with the same
+// checks as the upstreams of the configuration at startup, including those
+// made across the upstreams and the rest of the options.
+func ValidateUpstreamConfig(o *options.Options, upstreams options.UpstreamConfig) error {
+	reloaded := *o
+	reloaded.UpstreamServers = upstreams
+
+	msgs := validateUpstreams(upstreams)
+	msgs = append(msgs, validateUpstreamAuthorization(&reloaded)...)
+	msgs = append(msgs, validateUpstreamTokenRequirements(&reloaded)...)
+	msgs = append(msgs, validateUpstreamCacheRedis(&reloaded)...)
+	msgs = append(msgs, validateSessionStoreUnavailable(&reloaded)...)
+	msgs = append(msgs, validateSessionStoreClaims(&reloaded)...)
+	msgs = append(msgs, validateStrictSecurity(&reloaded)...)
+
+	if len(msgs) != 0 {
+		return fmt.Errorf("invalid upstream configuration:\n  %s",
+			strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
 func validateUpstreams(upstreams options.UpstreamConfig) []string {
 	msgs := []string{}
 	ids := make(map[string]struct{})
@@ -37,17 +70,1187 @@ func validateUpstream(upstream options.Upstream, ids, paths map[string]struct{})
 	}
 	ids[upstream.ID] = struct{}{}
 
-	// Ensure upstream Paths are unique
-	if _, ok := paths[upstream.Path]; ok {
-		msgs = append(msgs, fmt.Sprintf("multiple upstreams found with path %q: upstream paths must be unique", upstream.Path))
+	// Ensure upstream Paths are unique, other than those of the upstreams
+	// matching sessions, which are matched before the upstream of the path
+	if upstream.SessionMatch == nil {
+		if _, ok := paths[upstream.Path]; ok {
+			msgs = append(msgs, fmt.Sprintf("multiple upstreams found with path %q: upstream paths must be unique", upstream.Path))
+		}
+		paths[upstream.Path] = struct{}{}
 	}
-	paths[upstream.Path] = struct{}{}
 
 	msgs = append(msgs, validateUpstreamURI(upstream)...)
+	msgs = append(msgs, validateUpstreamSessionMatch(upstream)...)
+	msgs = append(msgs, validateUpstreamPolicies(upstream)...)
+	msgs = append(msgs, validateUpstreamTokenExchange(upstream)...)
 	msgs = append(msgs, validateStaticUpstream(upstream)...)
+	msgs = append(msgs, validateUpstreamFileServer(upstream)...)
+	msgs = append(msgs, validateUpstreamPathRewrite(upstream)...)
+	msgs = append(msgs, validateUpstreamCredentials(upstream)...)
+	msgs = append(msgs, validateUpstreamAuthorizationConflict(upstream)...)
+	msgs = append(msgs, validateUpstreamConcurrency(upstream)...)
+	msgs = append(msgs, validateUpstreamRateLimit(upstream)...)
+	msgs = append(msgs, validateUpstreamFaultInjection(upstream)...)
+	msgs = append(msgs, validateUpstreamTransport(upstream)...)
+	msgs = append(msgs, validateUpstreamDNSRefresh(upstream)...)
+	msgs = append(msgs, validateUpstreamBackends(upstream)...)
+	msgs = append(msgs, validateUpstreamHealthCheck(upstream)...)
+	msgs = append(msgs, validateUpstreamCircuitBreaker(upstream)...)
+	msgs = append(msgs, validateUpstreamTLSServerName(upstream)...)
+	msgs = append(msgs, validateUpstreamClientTLS(upstream)...)
+	msgs = append(msgs, validateUpstreamSPIFFE(upstream)...)
+	msgs = append(msgs, validateUpstreamResponseRewrite(upstream)...)
+	msgs = append(msgs, validateUpstreamStreamRetries(upstream)...)
+	msgs = append(msgs, validateUpstreamRetry(upstream)...)
+	msgs = append(msgs, validateUpstreamTLSHeaders(upstream)...)
+	msgs = append(msgs, validateUpstreamWebSocketPolicy(upstream)...)
+	msgs = append(msgs, validateUpstreamMirror(upstream)...)
+	msgs = append(msgs, validateUpstreamResponseBuffering(upstream)...)
+	msgs = append(msgs, validateUpstreamCache(upstream)...)
+	msgs = append(msgs, validateUpstreamRequestHeaders(upstream)...)
+	msgs = append(msgs, validateUpstreamHeaderRewrites(upstream)...)
+	msgs = append(msgs, prefixValues(fmt.Sprintf("upstream %q has invalid responseHeaderPolicy: ", upstream.ID), validateResponseHeaderPolicy(upstream.ResponseHeaderPolicy)...)...)
+	return msgs
+}
+
+// validateUpstreamSessionMatch checks that the session match has groups or
+// claims, and that each claim has a name and values.
+func validateUpstreamSessionMatch(upstream options.Upstream) []string {
+	msgs := []string{}
+	match := upstream.SessionMatch
+	if match == nil {
+		return msgs
+	}
+
+	if len(match.Groups) == 0 && len(match.Claims) == 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has an empty sessionMatch: must have groups or claims", upstream.ID))
+	}
+	for i, claim := range match.Claims {
+		if claim.Claim == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid sessionMatch claims[%d]: claim is required", upstream.ID, i))
+		}
+		if len(claim.Values) == 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid sessionMatch claims[%d]: values are required", upstream.ID, i))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamPolicies checks the actions, paths, methods, networks and
+// claims of the authorization policies, and that only allow policies without
+// groups or claims allow anonymous requests.
+func validateUpstreamPolicies(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	anonymous := false
+	for i, policy := range upstream.Policies {
+		prefix := fmt.Sprintf("upstream %q has invalid policies[%d]: ", upstream.ID, i)
+		switch policy.Action {
+		case "", options.UpstreamPolicyAllow, options.UpstreamPolicyDeny:
+		default:
+			msgs = append(msgs, fmt.Sprintf("%sunknown action %q, must be %q or %q", prefix, policy.Action, options.UpstreamPolicyAllow, options.UpstreamPolicyDeny))
+		}
+		if _, err := regexp.Compile(policy.Path); err != nil {
+			msgs = append(msgs, fmt.Sprintf("%sinvalid path %q: %v", prefix, policy.Path, err))
+		}
+		for _, method := range policy.Methods {
+			if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, " \t/") {
+				msgs = append(msgs, fmt.Sprintf("%sinvalid method %q: must be an uppercase HTTP method", prefix, method))
+			}
+		}
+		for _, cidr := range policy.CIDRs {
+			if ip.ParseIPNet(cidr) == nil {
+				msgs = append(msgs, fmt.Sprintf("%scidr %q could not be recognized", prefix, cidr))
+			}
+		}
+		for j, claim := range policy.Claims {
+			if claim.Claim == "" {
+				msgs = append(msgs, fmt.Sprintf("%sclaims[%d]: claim is required", prefix, j))
+			}
+			if len(claim.Values) == 0 {
+				msgs = append(msgs, fmt.Sprintf("%sclaims[%d]: values are required", prefix, j))
+			}
+		}
+
+		if !policy.AllowAnonymous {
+			continue
+		}
+		anonymous = true
+		if policy.Action == options.UpstreamPolicyDeny {
+			msgs = append(msgs, fmt.Sprintf("%sdeny policies can't allow anonymous requests", prefix))
+		}
+		if len(policy.Groups) > 0 || len(policy.Claims) > 0 {
+			msgs = append(msgs, fmt.Sprintf("%spolicies with groups or claims can't allow anonymous requests, which have no session", prefix))
+		}
+	}
+
+	if anonymous && upstream.SessionMatch != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has policies allowing anonymous requests, but a sessionMatch, which requests without a session never match, this will have no effect.", upstream.ID))
+	}
+	return msgs
+}
+
+// validateUpstreamTokenExchange checks that the token exchange has an
+// audience and a valid header, which isn't replaced by the credentials of the
+// upstream, and is only set for HTTP(S) upstreams.
+func validateUpstreamTokenExchange(upstream options.Upstream) []string {
+	exchange := upstream.TokenExchange
+	if exchange == nil {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if upstream.Static || strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tokenExchange, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+	if exchange.Audience == "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tokenExchange without an audience", upstream.ID))
+	}
+	for _, scope := range exchange.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t") {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has tokenExchange with an invalid scope %q", upstream.ID, scope))
+		}
+	}
+
+	header := exchange.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	switch {
+	case strings.ContainsAny(header, " ,;:\t\"()<>@/[]?={}") || isHopByHopHeader(header):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tokenExchange with an invalid header (%q): must be a header name, other than a hop-by-hop header", upstream.ID, header))
+	case strings.EqualFold(header, "Authorization") && setsAuthorization(upstream):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tokenExchange sending the token in the Authorization header, which is replaced by its credentials", upstream.ID))
+	}
+	return msgs
+}
+
+// validateUpstreamConcurrency checks that the concurrency limit, queue and
+// request body size options are not negative, and that queue options are only
+// set with a limit.
+func validateUpstreamConcurrency(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	if upstream.MaxConcurrentRequests < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid maxConcurrentRequests (%d): must not be negative", upstream.ID, upstream.MaxConcurrentRequests))
+	}
+	if upstream.QueueSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid queueSize (%d): must not be negative", upstream.ID, upstream.QueueSize))
+	}
+	if upstream.QueueTimeout != nil && upstream.QueueTimeout.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid queueTimeout (%s): must be greater than 0", upstream.ID, upstream.QueueTimeout.Duration()))
+	}
+	if upstream.MaxConcurrentRequests == 0 && (upstream.QueueSize != 0 || upstream.QueueTimeout != nil) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has queueSize or queueTimeout, but no maxConcurrentRequests, this will have no effect.", upstream.ID))
+	}
+	if upstream.MaxRequestBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid maxRequestBodySize (%d): must not be negative", upstream.ID, upstream.MaxRequestBodySize))
+	}
+
+	return msgs
+}
+
+// validateUpstreamTransport checks that the timeouts and connection pool
+// options are positive, and only set for HTTP(S) upstreams.
+func validateUpstreamTransport(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	for _, timeout := range []struct {
+		name     string
+		duration *options.Duration
+	}{
+		{name: "dialTimeout", duration: upstream.DialTimeout},
+		{name: "responseHeaderTimeout", duration: upstream.ResponseHeaderTimeout},
+		{name: "idleConnTimeout", duration: upstream.IdleConnTimeout},
+	} {
+		if timeout.duration != nil && timeout.duration.Duration() <= 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid %s (%s): must be greater than 0", upstream.ID, timeout.name, timeout.duration.Duration()))
+		}
+	}
+	if upstream.MaxIdleConns < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid maxIdleConns (%d): must not be negative", upstream.ID, upstream.MaxIdleConns))
+	}
+
+	hasTransportOptions := upstream.DialTimeout != nil || upstream.ResponseHeaderTimeout != nil ||
+		upstream.MaxIdleConns != 0 || upstream.IdleConnTimeout != nil || upstream.DisableKeepAlives
+	if hasTransportOptions && (upstream.Static || strings.HasPrefix(upstream.URI, "file://")) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has connection options, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.DisableKeepAlives && (upstream.MaxIdleConns != 0 || upstream.IdleConnTimeout != nil) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has maxIdleConns or idleConnTimeout, but disableKeepAlives, this will have no effect.", upstream.ID))
+	}
+
+	return msgs
+}
+
+// validateUpstreamDNSRefresh checks that the DNS refresh interval is positive,
+// and only set for HTTP(S) upstreams with a hostname to resolve.
+func validateUpstreamDNSRefresh(upstream options.Upstream) []string {
+	msgs := []string{}
+	if upstream.DNSRefreshInterval == nil {
+		return msgs
+	}
+
+	if upstream.DNSRefreshInterval.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid dnsRefreshInterval (%s): must be greater than 0", upstream.ID, upstream.DNSRefreshInterval.Duration()))
+	}
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has dnsRefreshInterval, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has dnsRefreshInterval, but a templated uri: templated upstreams are resolved with the standard resolver", upstream.ID))
+	case strings.HasPrefix(upstream.URI, "unix://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has dnsRefreshInterval, but a unix socket uri, this will have no effect.", upstream.ID))
+	default:
+		if u, err := url.Parse(upstream.URI); err == nil && net.ParseIP(u.Hostname()) != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has dnsRefreshInterval, but its uri has an IP address rather than a hostname, this will have no effect.", upstream.ID))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamBackends checks that the backends have the scheme of the
+// HTTP(S) upstream URI and only a host, and that the load balancing policy
+// is known.
+func validateUpstreamBackends(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	switch upstream.LoadBalancing {
+	case "", options.LoadBalancingRoundRobin, options.LoadBalancingLeastConnections:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid loadBalancing (%q): must be one of %q or %q", upstream.ID, upstream.LoadBalancing, options.LoadBalancingRoundRobin, options.LoadBalancingLeastConnections))
+	}
+	if len(upstream.Backends) == 0 {
+		if upstream.LoadBalancing != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has loadBalancing, but no backends, this will have no effect.", upstream.ID))
+		}
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has backends, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+		return msgs
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has backends, but a templated uri: templated upstreams select their server per request", upstream.ID))
+		return msgs
+	case strings.HasPrefix(upstream.URI, "unix://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has backends, but a unix socket uri: requests can't be balanced across unix sockets", upstream.ID))
+		return msgs
+	case upstream.DNSRefreshInterval != nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has backends, but a dnsRefreshInterval: backends are balanced with the standard resolver", upstream.ID))
+	}
+
+	scheme := strings.SplitN(upstream.URI, "://", 2)[0]
+	for _, backend := range upstream.Backends {
+		u, err := url.Parse(backend.URI)
+		switch {
+		case err != nil:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid backend uri (%q): %v", upstream.ID, backend.URI, err))
+		case u.Scheme != scheme || u.Host == "":
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid backend uri (%q): must have a host and the scheme of the upstream uri (%s)", upstream.ID, backend.URI, scheme))
+		case strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid backend uri (%q): must only have a scheme and host, requests are sent with their own path", upstream.ID, backend.URI))
+		}
+		if backend.Weight < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid backend weight (%d): must not be negative", upstream.ID, backend.Weight))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamHealthCheck checks that the health check options are in
+// range, that the fallback has the scheme of the upstream URI and only a
+// host, and that only HTTP(S) upstreams are health checked.
+func validateUpstreamHealthCheck(upstream options.Upstream) []string {
+	msgs := []string{}
+	check := upstream.HealthCheck
+	if check == nil {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a healthCheck, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+		return msgs
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a healthCheck, but a templated uri: templated upstreams select their server per request", upstream.ID))
+		return msgs
+	}
+
+	if check.Path != "" && !strings.HasPrefix(check.Path, "/") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck path (%q): must start with /", upstream.ID, check.Path))
+	}
+	if check.Interval != nil && check.Interval.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck interval (%s): must be greater than 0", upstream.ID, check.Interval.Duration()))
+	}
+	if check.Timeout != nil && check.Timeout.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck timeout (%s): must be greater than 0", upstream.ID, check.Timeout.Duration()))
+	}
+	if check.HealthyThreshold < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck healthyThreshold (%d): must not be negative", upstream.ID, check.HealthyThreshold))
+	}
+	if check.UnhealthyThreshold < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck unhealthyThreshold (%d): must not be negative", upstream.ID, check.UnhealthyThreshold))
+	}
+
+	if check.FallbackURI != "" && strings.HasPrefix(upstream.URI, "unix://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a healthCheck fallbackURI, but a unix socket uri: unix socket upstreams can't fall back to another server", upstream.ID))
+	} else if check.FallbackURI != "" {
+		scheme := strings.SplitN(upstream.URI, "://", 2)[0]
+		u, err := url.Parse(check.FallbackURI)
+		switch {
+		case err != nil:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck fallbackURI (%q): %v", upstream.ID, check.FallbackURI, err))
+		case u.Scheme != scheme || u.Host == "":
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck fallbackURI (%q): must have a host and the scheme of the upstream uri (%s)", upstream.ID, check.FallbackURI, scheme))
+		case strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck fallbackURI (%q): must only have a scheme and host, requests are sent with their own path", upstream.ID, check.FallbackURI))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamRateLimit checks that the rate limit has a rate, that its
+// period and burst are valid, and that it is limited by a known key.
+func validateUpstreamRateLimit(upstream options.Upstream) []string {
+	msgs := []string{}
+	limit := upstream.RateLimit
+	if limit == nil {
+		return msgs
+	}
+
+	if limit.Requests <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit requests (%d): must be greater than 0", upstream.ID, limit.Requests))
+	}
+	if limit.Period != nil && limit.Period.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit period (%s): must be greater than 0", upstream.ID, limit.Period.Duration()))
+	}
+	if limit.Burst < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit burst (%d): must not be negative", upstream.ID, limit.Burst))
+	}
+	switch limit.Key {
+	case "", options.RateLimitKeyUser, options.RateLimitKeyIP:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has unknown rateLimit key %q: must be %s or %s", upstream.ID, limit.Key, options.RateLimitKeyUser, options.RateLimitKeyIP))
+	}
+
+	return msgs
+}
+
+// validateUpstreamFaultInjection checks that the fault injection is limited
+// to the requests of an experiment, by a header or groups, that its percent is
+// in range, and that it injects a delay or an abort status in range.
+func validateUpstreamFaultInjection(upstream options.Upstream) []string {
+	msgs := []string{}
+	fault := upstream.FaultInjection
+	if fault == nil {
+		return msgs
+	}
+
+	if fault.Header == "" && len(fault.Groups) == 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a faultInjection without a header or groups: faults must only be injected into the requests of an experiment", upstream.ID))
+	}
+	if fault.Header != "" && !httpguts.ValidHeaderFieldName(fault.Header) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid faultInjection header %q", upstream.ID, fault.Header))
+	}
+	if fault.Percent < 1 || fault.Percent > 100 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid faultInjection percent (%d): must be between 1 and 100", upstream.ID, fault.Percent))
+	}
+	if fault.Delay != nil && fault.Delay.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid faultInjection delay (%s): must be greater than 0", upstream.ID, fault.Delay.Duration()))
+	}
+	switch {
+	case fault.Delay == nil && fault.AbortStatusCode == 0:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a faultInjection without a delay or abortStatusCode: no faults will be injected", upstream.ID))
+	case fault.AbortStatusCode != 0 && (fault.AbortStatusCode < 400 || fault.AbortStatusCode > 599):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid faultInjection abortStatusCode (%d): must be between 400 and 599", upstream.ID, fault.AbortStatusCode))
+	}
+
+	return msgs
+}
+
+// validateUpstreamCircuitBreaker checks that the circuit breaker options are
+// in range, and that only the circuits of HTTP(S) upstreams are broken.
+func validateUpstreamCircuitBreaker(upstream options.Upstream) []string {
+	msgs := []string{}
+	breaker := upstream.CircuitBreaker
+	if breaker == nil {
+		return msgs
+	}
+
+	if upstream.Static || strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a circuitBreaker, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+		return msgs
+	}
+
+	if breaker.ErrorRatePercent < 0 || breaker.ErrorRatePercent > 100 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker errorRatePercent (%d): must be between 1 and 100", upstream.ID, breaker.ErrorRatePercent))
+	}
+	if breaker.MinimumRequests < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker minimumRequests (%d): must not be negative", upstream.ID, breaker.MinimumRequests))
+	}
+	if breaker.Window != nil && breaker.Window.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker window (%s): must be greater than 0", upstream.ID, breaker.Window.Duration()))
+	}
+	if breaker.CoolDown != nil && breaker.CoolDown.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker coolDown (%s): must be greater than 0", upstream.ID, breaker.CoolDown.Duration()))
+	}
+	if breaker.HalfOpenRequests < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker halfOpenRequests (%d): must not be negative", upstream.ID, breaker.HalfOpenRequests))
+	}
+
 	return msgs
 }
 
+// validateUpstreamTLSServerName checks that the TLS server name is a host
+// name, and that the TLS server name and SNI options are only set on HTTPS
+// upstreams.
+func validateUpstreamTLSServerName(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	https := !upstream.Static && strings.HasPrefix(upstream.URI, "https://")
+	if upstream.TLSServerName != "" {
+		if !https {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has tlsServerName, but is not an HTTPS upstream, this will have no effect.", upstream.ID))
+		}
+		if strings.ContainsAny(upstream.TLSServerName, ":/ ") {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid tlsServerName (%q): must be a host name without a scheme or port", upstream.ID, upstream.TLSServerName))
+		}
+	}
+	if upstream.DisableTLSSNI && !https {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has disableTLSSNI, but is not an HTTPS upstream, this will have no effect.", upstream.ID))
+	}
+	return msgs
+}
+
+// validateUpstreamClientTLS checks that the client certificate and key of the
+// upstream are set together, that their sources and that of the CA bundle are
+// valid, and that they are only set on HTTPS upstreams.
+func validateUpstreamClientTLS(upstream options.Upstream) []string {
+	msgs := []string{}
+	sources := []struct {
+		name   string
+		source *options.SecretSource
+	}{
+		{"tlsClientCert", upstream.TLSClientCert},
+		{"tlsClientKey", upstream.TLSClientKey},
+		{"tlsCA", upstream.TLSCA},
+	}
+
+	https := !upstream.Static && strings.HasPrefix(upstream.URI, "https://")
+	for _, s := range sources {
+		if s.source == nil {
+			continue
+		}
+		if !https {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has %s, but is not an HTTPS upstream, this will have no effect.", upstream.ID, s.name))
+		}
+		if msg := validateSecretSource(*s.source); msg != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid %s: %s", upstream.ID, s.name, msg))
+		}
+	}
+	switch {
+	case upstream.TLSClientCert != nil && upstream.TLSClientKey == nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tlsClientCert, but no tlsClientKey", upstream.ID))
+	case upstream.TLSClientCert == nil && upstream.TLSClientKey != nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tlsClientKey, but no tlsClientCert", upstream.ID))
+	}
+	return msgs
+}
+
+// validateUpstreamSPIFFE checks that the SPIFFE options of the upstream have
+// valid IDs or a valid trust domain, and a valid endpoint socket, and that
+// they are only set on HTTPS upstreams without the TLS options they replace.
+func validateUpstreamSPIFFE(upstream options.Upstream) []string {
+	msgs := []string{}
+	opts := upstream.SPIFFE
+	if opts == nil {
+		return msgs
+	}
+
+	if upstream.Static || !strings.HasPrefix(upstream.URI, "https://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has spiffe, but is not an HTTPS upstream, this will have no effect.", upstream.ID))
+	}
+	conflicts := []struct {
+		name string
+		set  bool
+	}{
+		{"tlsClientCert", upstream.TLSClientCert != nil},
+		{"tlsClientKey", upstream.TLSClientKey != nil},
+		{"tlsCA", upstream.TLSCA != nil},
+		{"insecureSkipTLSVerify", upstream.InsecureSkipTLSVerify},
+		{"disableTLSSNI", upstream.DisableTLSSNI},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has spiffe and %s: the SVIDs of the SPIFFE Workload API replace it", upstream.ID, c.name))
+		}
+	}
+
+	if len(opts.IDs) == 0 && opts.TrustDomain == "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid spiffe: must have ids or a trustDomain", upstream.ID))
+	}
+	for i, id := range opts.IDs {
+		if _, err := spiffeid.FromString(id); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid spiffe ids[%d] (%q): %v", upstream.ID, i, id, err))
+		}
+	}
+	if opts.TrustDomain != "" {
+		if _, err := spiffeid.TrustDomainFromString(opts.TrustDomain); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid spiffe trustDomain (%q): %v", upstream.ID, opts.TrustDomain, err))
+		}
+	}
+	if opts.EndpointSocket != "" {
+		if err := workloadapi.ValidateAddress(opts.EndpointSocket); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid spiffe endpointSocket (%q): %v", upstream.ID, opts.EndpointSocket, err))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamPathRewrite checks that the path to strip is a prefix rather
+// than a pattern, that the path to prepend is an absolute path, and that the
+// rewrite target only refers to capture groups of the path.
+func validateUpstreamPathRewrite(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	if upstream.StripPath && upstream.RewriteTarget != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has stripPath and a rewriteTarget: use the rewriteTarget to remove the path instead", upstream.ID))
+	}
+	if upstream.RewriteTarget != "" {
+		msgs = append(msgs, validateUpstreamRewriteTarget(upstream)...)
+	}
+	if upstream.PrependPath != "" && !strings.HasPrefix(upstream.PrependPath, "/") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid prependPath %q: the path must start with a '/'", upstream.ID, upstream.PrependPath))
+	}
+	if (upstream.StripPath || upstream.PrependPath != "") && strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has stripPath or prependPath, but is a file upstream, this will have no effect.", upstream.ID))
+	}
+
+	return msgs
+}
+
+// validateUpstreamRewriteTarget checks that the path of an upstream with a
+// rewrite target is a regular expression, and that the groups the target
+// refers to are captured by it.
+// Unknown groups are replaced with an empty string, such as `$1x`, which
+// refers to the group named `1x` rather than to the group 1 followed by `x`.
+func validateUpstreamRewriteTarget(upstream options.Upstream) []string {
+	pathRegExp, err := regexp.Compile(upstream.Path)
+	if err != nil {
+		return []string{fmt.Sprintf("upstream %q has invalid path %q for its rewriteTarget: %v", upstream.ID, upstream.Path, err)}
+	}
+
+	groups := map[string]struct{}{}
+	for i, name := range pathRegExp.SubexpNames() {
+		groups[strconv.Itoa(i)] = struct{}{}
+		if name != "" {
+			groups[name] = struct{}{}
+		}
+	}
+
+	msgs := []string{}
+	for _, ref := range rewriteTargetGroups(upstream.RewriteTarget) {
+		if _, ok := groups[ref]; !ok {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rewriteTarget %q: the path %q has no capture group %q, use ${1} to separate a group from the text following it", upstream.ID, upstream.RewriteTarget, upstream.Path, ref))
+		}
+	}
+	return msgs
+}
+
+// rewriteTargetGroups returns the names and numbers of the groups the rewrite
+// target refers to, as `$name` or `${name}`, in the syntax of
+// regexp.Expand
+func rewriteTargetGroups(target string) []string {
+	groups := []string{}
+	for i := 0; i < len(target); i++ {
+		if target[i] != '$' || i+1 == len(target) {
+			continue
+		}
+		if target[i+1] == '$' {
+			i++
+			continue
+		}
+
+		if target[i+1] == '{' {
+			end := strings.IndexByte(target[i+2:], '}')
+			if end <= 0 {
+				continue
+			}
+			groups = append(groups, target[i+2:i+2+end])
+			i += end + 2
+			continue
+		}
+
+		end := i + 1
+		for end < len(target) && isGroupNameChar(target[end]) {
+			end++
+		}
+		if end > i+1 {
+			groups = append(groups, target[i+1:end])
+			i = end - 1
+		}
+	}
+	return groups
+}
+
+// isGroupNameChar checks whether the character may be part of a group name
+// in a rewrite target
+func isGroupNameChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// validateUpstreamResponseRewrite checks that responses are only rewritten
+// for HTTP(S) upstreams, that the external URL is absolute and that body
+// replacements have text to find.
+func validateUpstreamResponseRewrite(upstream options.Upstream) []string {
+	msgs := []string{}
+	rewrite := upstream.ResponseRewrite
+	if rewrite == nil {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has responseRewrite, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has responseRewrite, but a templated uri: responses of templated upstreams can't be rewritten", upstream.ID))
+	}
+
+	if rewrite.ExternalURL != "" {
+		u, err := url.Parse(rewrite.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid responseRewrite externalURL %q: must be an absolute http or https URL", upstream.ID, rewrite.ExternalURL))
+		}
+	}
+	for i, replacement := range rewrite.BodyReplacements {
+		if replacement.Find == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has responseRewrite body replacement %d with an empty find", upstream.ID, i))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamStreamRetries checks that failed responses are only retried
+// for HTTP(S) upstreams without a templated URI.
+func validateUpstreamStreamRetries(upstream options.Upstream) []string {
+	msgs := []string{}
+	if !upstream.RetryStreamErrors {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has retryStreamErrors, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has retryStreamErrors, but a templated uri: requests to templated upstreams can't be retried", upstream.ID))
+	}
+
+	return msgs
+}
+
+// validateUpstreamRetry checks the retry options are only set for HTTP(S)
+// upstreams without a templated URI, and that they are valid.
+func validateUpstreamRetry(upstream options.Upstream) []string {
+	msgs := []string{}
+	retry := upstream.Retry
+	if retry == nil {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a retry, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+		return msgs
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a retry, but a templated uri: requests to templated upstreams can't be retried", upstream.ID))
+	}
+
+	if retry.MaxAttempts < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry maxAttempts (%d): must not be negative", upstream.ID, retry.MaxAttempts))
+	}
+	if retry.Backoff != nil && retry.Backoff.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry backoff (%s): must not be negative", upstream.ID, retry.Backoff.Duration()))
+	}
+	if retry.MaxBackoff != nil && retry.MaxBackoff.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry maxBackoff (%s): must not be negative", upstream.ID, retry.MaxBackoff.Duration()))
+	}
+	for _, code := range retry.StatusCodes {
+		if code < 400 || code > 599 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry status code (%d): must be a 4xx or 5xx status", upstream.ID, code))
+		}
+	}
+	for _, class := range retry.Errors {
+		switch class {
+		case options.UpstreamRetryErrorConnect, options.UpstreamRetryErrorReset, options.UpstreamRetryErrorTimeout:
+		default:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry error (%q): must be one of %q, %q or %q", upstream.ID, class,
+				options.UpstreamRetryErrorConnect, options.UpstreamRetryErrorReset, options.UpstreamRetryErrorTimeout))
+		}
+	}
+	if retry.MaxBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry maxBodySize (%d): must not be negative", upstream.ID, retry.MaxBodySize))
+	}
+
+	return msgs
+}
+
+// validateUpstreamTLSHeaders checks that the upstream is only passed known
+// TLS headers
+func validateUpstreamTLSHeaders(upstream options.Upstream) []string {
+	msgs := []string{}
+	known := []string{
+		options.TLSHeaderForwardedProto,
+		options.TLSHeaderProtocol,
+		options.TLSHeaderCipher,
+		options.TLSHeaderClientCert,
+		options.TLSHeaderClientDN,
+	}
+
+	for _, header := range upstream.PassTLSHeaders {
+		found := false
+		for _, name := range known {
+			if strings.EqualFold(header, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has unknown passTLSHeaders header %q: must be one of X-Forwarded-Proto, X-SSL-Protocol, X-SSL-Cipher, X-SSL-Client-Cert or X-SSL-Client-DN", upstream.ID, header))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamWebSocketPolicy checks that the allowed WebSocket origins
+// are valid origins, that the allowed subprotocols are tokens, that the idle
+// timeout is positive, and that the policy is only set for HTTP(S) upstreams.
+func validateUpstreamWebSocketPolicy(upstream options.Upstream) []string {
+	msgs := []string{}
+	if upstream.WebSocketRequireOrigin && len(upstream.WebSocketAllowedOrigins) == 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has webSocketRequireOrigin, but no webSocketAllowedOrigins, this will have no effect.", upstream.ID))
+	}
+	if upstream.WebSocketIdleTimeout != nil {
+		switch {
+		case upstream.WebSocketIdleTimeout.Duration() <= 0:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid webSocketIdleTimeout (%s): must be greater than 0", upstream.ID, upstream.WebSocketIdleTimeout.Duration()))
+		case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has webSocketIdleTimeout, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+		case upstream.ProxyWebSockets != nil && !*upstream.ProxyWebSockets:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has webSocketIdleTimeout, but proxyWebSockets is false, this will have no effect.", upstream.ID))
+		case strings.Contains(upstream.URI, "{{"):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has webSocketIdleTimeout, but a templated uri: the WebSocket connections of templated upstreams have no idle timeout", upstream.ID))
+		}
+	}
+	if len(upstream.WebSocketAllowedOrigins) == 0 && len(upstream.WebSocketAllowedSubprotocols) == 0 {
+		return msgs
+	}
+
+	if upstream.Static || strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a WebSocket policy, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+	for i, origin := range upstream.WebSocketAllowedOrigins {
+		if err := validateCORSOrigin(origin); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid webSocketAllowedOrigins[%d] (%s): %v", upstream.ID, i, origin, err))
+		}
+	}
+	for i, subprotocol := range upstream.WebSocketAllowedSubprotocols {
+		if subprotocol == "" || strings.ContainsAny(subprotocol, " ,;\t\"") {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid webSocketAllowedSubprotocols[%d] (%q): subprotocols must be tokens without separators", upstream.ID, i, subprotocol))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamResponseBuffering checks that the streaming content types
+// are media types, that the response buffer size is valid, and that only the
+// responses of HTTP(S) upstreams are buffered or streamed.
+func validateUpstreamResponseBuffering(upstream options.Upstream) []string {
+	msgs := []string{}
+	if !upstream.BufferResponses && len(upstream.StreamingContentTypes) == 0 {
+		if upstream.MaxResponseBufferSize != 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has maxResponseBufferSize, but doesn't buffer responses, this will have no effect.", upstream.ID))
+		}
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has bufferResponses or streamingContentTypes, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has bufferResponses or streamingContentTypes, but a templated uri: the responses of templated upstreams can't be buffered", upstream.ID))
+	}
+
+	for _, contentType := range upstream.StreamingContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid streamingContentTypes %q: %v", upstream.ID, contentType, err))
+		}
+	}
+	if upstream.MaxResponseBufferSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid maxResponseBufferSize (%d): must not be negative", upstream.ID, upstream.MaxResponseBufferSize))
+	}
+	if upstream.MaxResponseBufferSize != 0 && !upstream.BufferResponses {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has maxResponseBufferSize, but doesn't buffer responses, this will have no effect.", upstream.ID))
+	}
+
+	return msgs
+}
+
+// validateUpstreamMirror checks that the mirror URI is an HTTP(S) server
+// without a path, that the sample percentage, body size and timeout are in
+// range, and that only HTTP(S) upstreams are mirrored.
+func validateUpstreamMirror(upstream options.Upstream) []string {
+	msgs := []string{}
+	mirror := upstream.Mirror
+	if mirror == nil {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a mirror, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a mirror, but a templated uri: requests to templated upstreams can't be mirrored", upstream.ID))
+	}
+
+	u, err := url.Parse(mirror.URI)
+	switch {
+	case err != nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror uri (%q): %v", upstream.ID, mirror.URI, err))
+	case (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror uri (%q): must be an http or https URL", upstream.ID, mirror.URI))
+	case strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror uri (%q): must only have a scheme and host, requests are mirrored with their own path", upstream.ID, mirror.URI))
+	}
+	if mirror.SamplePercent < 1 || mirror.SamplePercent > 100 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror samplePercent (%d): must be from 1 to 100", upstream.ID, mirror.SamplePercent))
+	}
+	if mirror.MaxBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror maxBodySize (%d): must not be negative", upstream.ID, mirror.MaxBodySize))
+	}
+	if mirror.Timeout != nil && mirror.Timeout.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid mirror timeout (%s): must be greater than 0", upstream.ID, mirror.Timeout.Duration()))
+	}
+	return msgs
+}
+
+// validateUpstreamCache checks that the cache store is known, that the cache
+// TTL and sizes are in range, that the bypass header is a header name, and
+// that only HTTP(S) upstreams are cached.
+func validateUpstreamCache(upstream options.Upstream) []string {
+	msgs := []string{}
+	cache := upstream.Cache
+	if cache == nil {
+		return msgs
+	}
+
+	switch {
+	case upstream.Static || strings.HasPrefix(upstream.URI, "file://"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a cache, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	case strings.Contains(upstream.URI, "{{"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a cache, but a templated uri: responses of templated upstreams can't be cached", upstream.ID))
+	}
+
+	switch cache.Store {
+	case "", options.UpstreamCacheStoreMemory:
+	case options.UpstreamCacheStoreRedis:
+		if cache.MaxSize != 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has cache maxSize, but a redis store, this will have no effect.", upstream.ID))
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has unknown cache store %q: must be %s or %s", upstream.ID, cache.Store, options.UpstreamCacheStoreMemory, options.UpstreamCacheStoreRedis))
+	}
+	if cache.TTL != nil && cache.TTL.Duration() <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid cache ttl (%s): must be greater than 0", upstream.ID, cache.TTL.Duration()))
+	}
+	if cache.MaxEntrySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid cache maxEntrySize (%d): must not be negative", upstream.ID, cache.MaxEntrySize))
+	}
+	if cache.MaxSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid cache maxSize (%d): must not be negative", upstream.ID, cache.MaxSize))
+	}
+	if cache.MaxEntrySize > 0 && cache.MaxSize > 0 && cache.MaxEntrySize > cache.MaxSize {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid cache maxEntrySize (%d): must not be larger than maxSize (%d)", upstream.ID, cache.MaxEntrySize, cache.MaxSize))
+	}
+	if cache.BypassHeader != "" && strings.ContainsAny(cache.BypassHeader, " ,;:\t\"()<>@/[]?={}") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid cache bypassHeader (%q): must be a header name", upstream.ID, cache.BypassHeader))
+	}
+	return msgs
+}
+
+// validateUpstreamCacheRedis checks that the Redis server of the upstreams
+// caching their responses in Redis is configured by the redis options.
+func validateUpstreamCacheRedis(o *options.Options) []string {
+	msgs := []string{}
+	redis := o.Session.Redis
+	configured := redis.ConnectionURL != "" || len(redis.SentinelConnectionURLs) > 0 || len(redis.ClusterConnectionURLs) > 0
+	for _, upstream := range o.UpstreamServers.Upstreams {
+		if upstream.Cache != nil && upstream.Cache.Store == options.UpstreamCacheStoreRedis && !configured {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has a redis cache store, but no redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls is set", upstream.ID))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamRequestHeaders checks that the allowed request headers are
+// header names, other than the hop-by-hop headers that are always removed and
+// the Cookie header controlled by passCookies, and that the request header
+// options are only set for HTTP(S) upstreams.
+func validateUpstreamRequestHeaders(upstream options.Upstream) []string {
+	msgs := []string{}
+	if upstream.StripProxyCookies && upstream.PassCookies != nil && !*upstream.PassCookies {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has stripProxyCookies, but passCookies is false, this will have no effect.", upstream.ID))
+	}
+	if upstream.AllowedRequestHeaders == nil && upstream.PassCookies == nil && !upstream.StripProxyCookies {
+		return msgs
+	}
+
+	if upstream.Static || strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has request header options, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+	for i, header := range upstream.AllowedRequestHeaders {
+		switch {
+		case header == "" || strings.ContainsAny(header, " ,;:\t\"()<>@/[]?={}"):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid allowedRequestHeaders[%d] (%q): must be a header name", upstream.ID, i, header))
+		case strings.EqualFold(header, "Cookie"):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid allowedRequestHeaders[%d] (%q): cookies are sent unless passCookies is false", upstream.ID, i, header))
+		case isHopByHopHeader(header):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid allowedRequestHeaders[%d] (%q): hop-by-hop headers are always removed", upstream.ID, i, header))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamHeaderRewrites checks that the header rewrites have a
+// header name, a known action and, for replace actions, a valid pattern.
+func validateUpstreamHeaderRewrites(upstream options.Upstream) []string {
+	msgs := []string{}
+	if upstream.HeaderRewrites == nil {
+		return msgs
+	}
+
+	if len(upstream.HeaderRewrites.Request) > 0 && (upstream.Static || strings.HasPrefix(upstream.URI, "file://")) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has request headerRewrites, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+	msgs = append(msgs, validateHeaderRewrites(upstream.ID, "request", upstream.HeaderRewrites.Request)...)
+	msgs = append(msgs, validateHeaderRewrites(upstream.ID, "response", upstream.HeaderRewrites.Response)...)
+	return msgs
+}
+
+// validateHeaderRewrites checks the request or response header rewrites of an
+// upstream
+func validateHeaderRewrites(id, kind string, rewrites []options.HeaderRewrite) []string {
+	msgs := []string{}
+	for i, rewrite := range rewrites {
+		if rewrite.Name == "" || strings.ContainsAny(rewrite.Name, " ,;:\t\"()<>@/[]?={}") {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid headerRewrites.%s[%d] name (%q): must be a header name", id, kind, i, rewrite.Name))
+		} else if isHopByHopHeader(rewrite.Name) {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid headerRewrites.%s[%d] name (%q): hop-by-hop headers can't be rewritten", id, kind, i, rewrite.Name))
+		}
+
+		switch rewrite.Action {
+		case options.HeaderRewriteAdd, options.HeaderRewriteSet, options.HeaderRewriteRemove:
+			if rewrite.Pattern != "" {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has headerRewrites.%s[%d] pattern, but its action is not replace, this will have no effect.", id, kind, i))
+			}
+		case options.HeaderRewriteReplace:
+			if rewrite.Pattern == "" {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has invalid headerRewrites.%s[%d]: a pattern is required for the replace action", id, kind, i))
+			} else if _, err := regexp.Compile(rewrite.Pattern); err != nil {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has invalid headerRewrites.%s[%d] pattern (%q): %v", id, kind, i, rewrite.Pattern, err))
+			}
+		default:
+			msgs = append(msgs, fmt.Sprintf("upstream %q has unknown headerRewrites.%s[%d] action %q: must be add, set, remove or replace", id, kind, i, rewrite.Action))
+		}
+	}
+	return msgs
+}
+
+// isHopByHopHeader checks whether the header only applies to a single
+// connection, and so is never proxied
+func isHopByHopHeader(header string) bool {
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUpstreamCredentials checks that basic auth credentials are complete
+// and that credential headers only have secret values.
+func validateUpstreamCredentials(upstream options.Upstream) []string {
+	msgs := []string{}
+	if upstream.BasicAuthUser == "" && upstream.BasicAuthPassword == nil && len(upstream.CredentialHeaders) == 0 {
+		return msgs
+	}
+
+	if upstream.Static || strings.HasPrefix(upstream.URI, "file://") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has credentials, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+
+	switch {
+	case upstream.BasicAuthUser != "" && upstream.BasicAuthPassword == nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has basicAuthUser, but no basicAuthPassword", upstream.ID))
+	case upstream.BasicAuthUser == "" && upstream.BasicAuthPassword != nil:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has basicAuthPassword, but no basicAuthUser", upstream.ID))
+	case upstream.BasicAuthPassword != nil:
+		if msg := validateSecretSource(*upstream.BasicAuthPassword); msg != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid basicAuthPassword: %s", upstream.ID, msg))
+		}
+	}
+
+	for _, header := range upstream.CredentialHeaders {
+		if header.Name == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has a credential header with an empty name", upstream.ID))
+		}
+		for _, value := range header.Values {
+			if value.SecretSource == nil || value.ClaimSource != nil || value.TemplateSource != nil {
+				msgs = append(msgs, fmt.Sprintf("upstream %q credential header %q may only have secret values", upstream.ID, header.Name))
+				continue
+			}
+			if msg := validateSecretSource(*value.SecretSource); msg != "" {
+				msgs = append(msgs, fmt.Sprintf("upstream %q credential header %q has invalid value: %s", upstream.ID, header.Name, msg))
+			}
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamAuthorizationConflict checks that the authorization
+// conflict policy is known, and that the header the client's Authorization
+// header is moved to is a header name other than Authorization.
+func validateUpstreamAuthorizationConflict(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	switch upstream.AuthorizationConflict {
+	case "", options.AuthorizationConflictOverwrite, options.AuthorizationConflictPreserveClient, options.AuthorizationConflictMoveClient:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has unknown authorizationConflict %q: must be overwrite, preserve-client or move-client", upstream.ID, upstream.AuthorizationConflict))
+	}
+	if upstream.AuthorizationConflict != "" && upstream.AuthorizationConflict != options.AuthorizationConflictOverwrite &&
+		(upstream.Static || strings.HasPrefix(upstream.URI, "file://")) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has authorizationConflict, but is not an HTTP(S) upstream, this will have no effect.", upstream.ID))
+	}
+
+	header := upstream.ClientAuthorizationHeader
+	if header == "" {
+		return msgs
+	}
+	switch {
+	case upstream.AuthorizationConflict != options.AuthorizationConflictMoveClient:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has clientAuthorizationHeader, but authorizationConflict is not move-client, this will have no effect.", upstream.ID))
+	case strings.ContainsAny(header, " ,;:\t\"()<>@/[]?={}"):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid clientAuthorizationHeader (%q): must be a header name", upstream.ID, header))
+	case strings.EqualFold(header, "Authorization") || isHopByHopHeader(header):
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid clientAuthorizationHeader (%q): must not be the Authorization header or a hop-by-hop header", upstream.ID, header))
+	}
+	return msgs
+}
+
+// validateUpstreamAuthorization checks that upstream credentials don't
+// silently replace an Authorization header injected from the user's session,
+// unless the upstream explicitly allows it, and that authorization conflict
+// policies are only set when an Authorization header is injected.
+func validateUpstreamAuthorization(o *options.Options) []string {
+	msgs := []string{}
+
+	injectsAuthorization := false
+	userAuthorization := false
+	for _, header := range o.InjectRequestHeaders {
+		if !strings.EqualFold(header.Name, "Authorization") {
+			continue
+		}
+		injectsAuthorization = true
+		for _, value := range header.Values {
+			if value.ClaimSource != nil || value.TemplateSource != nil {
+				userAuthorization = true
+			}
+		}
+	}
+
+	for _, upstream := range o.UpstreamServers.Upstreams {
+		if !injectsAuthorization && upstream.AuthorizationConflict != "" && upstream.AuthorizationConflict != options.AuthorizationConflictOverwrite {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has authorizationConflict, but no Authorization header is injected by injectRequestHeaders, this will have no effect.", upstream.ID))
+		}
+		if !userAuthorization || upstream.OverrideAuthorization || !setsAuthorization(upstream) {
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("upstream %q has credentials that replace the Authorization header injected from the user's session: set overrideAuthorization to allow this", upstream.ID))
+	}
+	return msgs
+}
+
+// authorizationHeaderWarnings warns about Authorization request headers
+// injected with both basic auth credentials and other values, such as the
+// access token, which are joined into a single header that upstreams can't
+// parse.
+func authorizationHeaderWarnings(headers []options.Header) []string {
+	values := 0
+	basicAuth := false
+	for _, header := range headers {
+		if !strings.EqualFold(header.Name, "Authorization") {
+			continue
+		}
+		for _, value := range header.Values {
+			values++
+			if value.ClaimSource != nil && value.ClaimSource.BasicAuthPassword != nil {
+				basicAuth = true
+			}
+		}
+	}
+	if !basicAuth || values < 2 {
+		return []string{}
+	}
+	return []string{"injectRequestHeaders: the Authorization header is injected with basic auth credentials and other values, which are joined into a single header that upstreams won't be able to parse"}
+}
+
+// validateUpstreamTokenRequirements checks that the bearer token requirements
+// of upstreams have no empty values, and that bearer tokens are accepted for
+// them to apply to.
+func validateUpstreamTokenRequirements(o *options.Options) []string {
+	msgs := []string{}
+	for _, upstream := range o.UpstreamServers.Upstreams {
+		for _, audience := range upstream.RequiredTokenAudiences {
+			if audience == "" {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has an empty requiredTokenAudiences value", upstream.ID))
+			}
+		}
+		for _, scope := range upstream.RequiredTokenScopes {
+			if scope == "" {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has an empty requiredTokenScopes value", upstream.ID))
+			}
+		}
+
+		hasRequirements := len(upstream.RequiredTokenAudiences) > 0 || len(upstream.RequiredTokenScopes) > 0 || upstream.RequireBearerToken
+		if hasRequirements && !o.SkipJwtBearerTokens {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has bearer token requirements, but skip_jwt_bearer_tokens is not set: bearer tokens are not accepted", upstream.ID))
+		}
+	}
+	return msgs
+}
+
+// setsAuthorization checks whether the upstream credentials include an
+// Authorization header
+func setsAuthorization(upstream options.Upstream) bool {
+	if upstream.BasicAuthUser != "" {
+		return true
+	}
+	for _, header := range upstream.CredentialHeaders {
+		if strings.EqualFold(header.Name, "Authorization") {
+			return true
+		}
+	}
+	return false
+}
+
 // validateStaticUpstream checks that the StaticCode is only set when Static
 // is set, and that any options that do not make sense for a static upstream
 // are not set.
@@ -57,6 +1260,18 @@ func validateStaticUpstream(upstream options.Upstream) []string {
 	if !upstream.Static && upstream.StaticCode != nil {
 		msgs = append(msgs, fmt.Sprintf("upstream %q has staticCode (%d), but is not a static upstream, set 'static' for a static response", upstream.ID, *upstream.StaticCode))
 	}
+	if !upstream.Static && upstream.StaticTemplate != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has staticTemplate, but is not a static upstream, set 'static' for a static response", upstream.ID))
+	}
+	if !upstream.Static && upstream.StaticContentType != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has staticContentType, but is not a static upstream, set 'static' for a static response", upstream.ID))
+	}
+	if !upstream.Static && upstream.StaticBody != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has staticBody, but is not a static upstream, set 'static' for a static response", upstream.ID))
+	}
+	if !upstream.Static && len(upstream.StaticHeaders) > 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has staticHeaders, but is not a static upstream, set 'static' for a static response", upstream.ID))
+	}
 
 	// Checks after this only make sense when the upstream is static
 	if !upstream.Static {
@@ -78,10 +1293,54 @@ func validateStaticUpstream(upstream options.Upstream) []string {
 	if upstream.ProxyWebSockets != nil {
 		msgs = append(msgs, fmt.Sprintf("upstream %q has proxyWebSockets, but is a static upstream, this will have no effect.", upstream.ID))
 	}
+	if upstream.StripPath {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has stripPath, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.PrependPath != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has prependPath, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.StaticContentType != "" {
+		if _, _, err := mime.ParseMediaType(upstream.StaticContentType); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticContentType %q: %v", upstream.ID, upstream.StaticContentType, err))
+		}
+	}
+	if upstream.StaticTemplate != "" {
+		if _, err := template.ParseFiles(upstream.StaticTemplate); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticTemplate: %v", upstream.ID, err))
+		}
+	}
+	if upstream.StaticBody != "" {
+		if upstream.StaticTemplate != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has staticBody and staticTemplate: only one of them can be the body of the static response", upstream.ID))
+		}
+		if _, err := template.New("staticBody").Parse(upstream.StaticBody); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticBody: %v", upstream.ID, err))
+		}
+	}
+	for i, header := range upstream.StaticHeaders {
+		switch {
+		case header.Name == "" || strings.ContainsAny(header.Name, " ,;:\t\"()<>@/[]?={}"):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticHeaders[%d] name (%q): must be a header name", upstream.ID, i, header.Name))
+		case isHopByHopHeader(header.Name):
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticHeaders[%d] name (%q): hop-by-hop headers can't be set", upstream.ID, i, header.Name))
+		}
+		if _, err := template.New(header.Name).Parse(header.Value); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid staticHeaders[%d] value: %v", upstream.ID, i, err))
+		}
+	}
 
 	return msgs
 }
 
+// validateUpstreamFileServer checks that the FileServer is only set on file
+// upstreams
+func validateUpstreamFileServer(upstream options.Upstream) []string {
+	if upstream.FileServer != nil && (upstream.Static || !strings.HasPrefix(upstream.URI, "file://")) {
+		return []string{fmt.Sprintf("upstream %q has fileServer, but is not a file upstream, this will have no effect.", upstream.ID)}
+	}
+	return []string{}
+}
+
 func validateUpstreamURI(upstream options.Upstream) []string {
 	msgs := []string{}
 
@@ -95,6 +1354,13 @@ func validateUpstreamURI(upstream options.Upstream) []string {
 		return msgs
 	}
 
+	if strings.Contains(upstream.URI, "{{") {
+		return validateTemplatedUpstreamURI(upstream)
+	}
+	if len(upstream.AllowedClaimValues) > 0 || upstream.AllowedClaimPattern != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has allowed claim values, but its uri is not templated, this will have no effect.", upstream.ID))
+	}
+
 	u, err := url.Parse(upstream.URI)
 	if err != nil {
 		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid uri: %v", upstream.ID, err))
@@ -102,11 +1368,47 @@ func validateUpstreamURI(upstream options.Upstream) []string {
 	}
 
 	switch u.Scheme {
-	case "http", "https", "file":
+	case "http", "https", "h2c", "file":
 		// Valid, do nothing
+	case "unix":
+		if u.Host != "" || u.Path == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid unix socket uri: must be the absolute path of the socket, eg. unix:///var/run/app.sock", upstream.ID))
+		}
 	default:
 		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid scheme: %q", upstream.ID, u.Scheme))
 	}
 
 	return msgs
 }
+
+// validateTemplatedUpstreamURI checks that a templated URI is an HTTP(S) URI
+// and that the claim values substituted into it are restricted.
+func validateTemplatedUpstreamURI(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	switch strings.SplitN(upstream.URI, "://", 2)[0] {
+	case "http", "https":
+		// Valid, do nothing
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a templated uri, but templated uris must use the http or https scheme", upstream.ID))
+	}
+	if _, err := template.New("uri").Parse(upstream.URI); err != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid templated uri: %v", upstream.ID, err))
+	} else if len(msgs) == 0 {
+		// Claims may only be used in the host
+		if err := upstreamproxy.ValidateTemplatedURI(upstream.URI); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid templated uri: %v", upstream.ID, err))
+		}
+	}
+
+	if len(upstream.AllowedClaimValues) == 0 && upstream.AllowedClaimPattern == "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has a templated uri, but no allowedClaimValues or allowedClaimPattern: claim values must be restricted", upstream.ID))
+	}
+	if upstream.AllowedClaimPattern != "" {
+		if _, err := regexp.Compile(upstream.AllowedClaimPattern); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid allowedClaimPattern: %v", upstream.ID, err))
+		}
+	}
+
+	return msgs
+}
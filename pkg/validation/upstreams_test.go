@@ -16,8 +16,11 @@ var _ = Describe("Upstreams", func() {
 	}
 
 	flushInterval := options.Duration(5 * time.Second)
+	zeroDuration := options.Duration(0)
+	negativeDuration := options.Duration(-time.Second)
 	staticCode200 := 200
 	truth := true
+	falsehood := false
 
 	validHTTPUpstream := options.Upstream{
 		ID:   "validHTTPUpstream",
@@ -40,6 +43,10 @@ var _ = Describe("Upstreams", func() {
 	emptyURIMsg := "upstream \"foo\" has empty uri: uris are required for all non-static upstreams"
 	invalidURIMsg := "upstream \"foo\" has invalid uri: parse \":\": missing protocol scheme"
 	invalidURISchemeMsg := "upstream \"foo\" has invalid scheme: \"ftp\""
+	invalidUnixSocketURIMsg := "upstream \"foo\" has invalid unix socket uri: must be the absolute path of the socket, eg. unix:///var/run/app.sock"
+	dnsRefreshWithUnixSocketMsg := "upstream \"foo\" has dnsRefreshInterval, but a unix socket uri, this will have no effect."
+	backendsWithUnixSocketMsg := "upstream \"foo\" has backends, but a unix socket uri: requests can't be balanced across unix sockets"
+	fallbackWithUnixSocketMsg := "upstream \"foo\" has a healthCheck fallbackURI, but a unix socket uri: unix socket upstreams can't fall back to another server"
 	staticWithURIMsg := "upstream \"foo\" has uri, but is a static upstream, this will have no effect."
 	staticWithInsecureMsg := "upstream \"foo\" has insecureSkipTLSVerify, but is a static upstream, this will have no effect."
 	staticWithFlushIntervalMsg := "upstream \"foo\" has flushInterval, but is a static upstream, this will have no effect."
@@ -47,7 +54,87 @@ var _ = Describe("Upstreams", func() {
 	staticWithProxyWebSocketsMsg := "upstream \"foo\" has proxyWebSockets, but is a static upstream, this will have no effect."
 	multipleIDsMsg := "multiple upstreams found with id \"foo\": upstream ids must be unique"
 	multiplePathsMsg := "multiple upstreams found with path \"/foo\": upstream paths must be unique"
+	emptySessionMatchMsg := "upstream \"canary\" has an empty sessionMatch: must have groups or claims"
+	sessionMatchNoClaimMsg := "upstream \"canary\" has invalid sessionMatch claims[0]: claim is required"
+	sessionMatchNoValuesMsg := "upstream \"canary\" has invalid sessionMatch claims[1]: values are required"
 	staticCodeMsg := "upstream \"foo\" has staticCode (200), but is not a static upstream, set 'static' for a static response"
+	staticTemplateMsg := "upstream \"foo\" has staticTemplate, but is not a static upstream, set 'static' for a static response"
+	staticContentTypeMsg := "upstream \"foo\" has staticContentType, but is not a static upstream, set 'static' for a static response"
+	invalidStaticContentTypeMsg := "upstream \"foo\" has invalid staticContentType \"/html\": mime: no media type"
+	invalidStaticTemplateMsg := "upstream \"foo\" has invalid staticTemplate: open /nonexistent/static.html: no such file or directory"
+	invalidMaxConcurrentRequestsMsg := "upstream \"foo\" has invalid maxConcurrentRequests (-1): must not be negative"
+	invalidQueueSizeMsg := "upstream \"foo\" has invalid queueSize (-1): must not be negative"
+	invalidQueueTimeoutMsg := "upstream \"foo\" has invalid queueTimeout (0s): must be greater than 0"
+	queueWithoutLimitMsg := "upstream \"foo\" has queueSize or queueTimeout, but no maxConcurrentRequests, this will have no effect."
+	invalidMaxRequestBodySizeMsg := "upstream \"foo\" has invalid maxRequestBodySize (-1): must not be negative"
+	invalidDialTimeoutMsg := "upstream \"foo\" has invalid dialTimeout (0s): must be greater than 0"
+	invalidResponseHeaderTimeoutMsg := "upstream \"foo\" has invalid responseHeaderTimeout (0s): must be greater than 0"
+	invalidIdleConnTimeoutMsg := "upstream \"foo\" has invalid idleConnTimeout (0s): must be greater than 0"
+	invalidMaxIdleConnsMsg := "upstream \"foo\" has invalid maxIdleConns (-1): must not be negative"
+	connectionOptionsWithFileMsg := "upstream \"foo\" has connection options, but is not an HTTP(S) upstream, this will have no effect."
+	idleConnsWithoutKeepAlivesMsg := "upstream \"foo\" has maxIdleConns or idleConnTimeout, but disableKeepAlives, this will have no effect."
+	invalidLoadBalancingMsg := "upstream \"foo\" has invalid loadBalancing (\"random\"): must be one of \"round-robin\" or \"least-connections\""
+	loadBalancingWithoutBackendsMsg := "upstream \"foo\" has loadBalancing, but no backends, this will have no effect."
+	backendsWithFileMsg := "upstream \"foo\" has backends, but is not an HTTP(S) upstream, this will have no effect."
+	backendsWithTemplateMsg := "upstream \"foo\" has backends, but a templated uri: templated upstreams select their server per request"
+	backendsWithDNSRefreshMsg := "upstream \"foo\" has backends, but a dnsRefreshInterval: backends are balanced with the standard resolver"
+	backendSchemeMsg := "upstream \"foo\" has invalid backend uri (\"https://app-2.internal:8443\"): must have a host and the scheme of the upstream uri (http)"
+	backendPathMsg := "upstream \"foo\" has invalid backend uri (\"http://app-2.internal:8080/app\"): must only have a scheme and host, requests are sent with their own path"
+	invalidBackendWeightMsg := "upstream \"foo\" has invalid backend weight (-1): must not be negative"
+	healthCheckWithFileMsg := "upstream \"foo\" has a healthCheck, but is not an HTTP(S) upstream, this will have no effect."
+	healthCheckWithTemplateMsg := "upstream \"foo\" has a healthCheck, but a templated uri: templated upstreams select their server per request"
+	invalidHealthCheckPathMsg := "upstream \"foo\" has invalid healthCheck path (\"healthz\"): must start with /"
+	invalidHealthCheckIntervalMsg := "upstream \"foo\" has invalid healthCheck interval (0s): must be greater than 0"
+	invalidHealthCheckTimeoutMsg := "upstream \"foo\" has invalid healthCheck timeout (0s): must be greater than 0"
+	invalidHealthyThresholdMsg := "upstream \"foo\" has invalid healthCheck healthyThreshold (-1): must not be negative"
+	invalidUnhealthyThresholdMsg := "upstream \"foo\" has invalid healthCheck unhealthyThreshold (-1): must not be negative"
+	invalidFallbackSchemeMsg := "upstream \"foo\" has invalid healthCheck fallbackURI (\"https://status.internal\"): must have a host and the scheme of the upstream uri (http)"
+	invalidFallbackPathMsg := "upstream \"foo\" has invalid healthCheck fallbackURI (\"http://status.internal/down\"): must only have a scheme and host, requests are sent with their own path"
+	invalidRateLimitRequestsMsg := "upstream \"foo\" has invalid rateLimit requests (0): must be greater than 0"
+	invalidRateLimitPeriodMsg := "upstream \"foo\" has invalid rateLimit period (0s): must be greater than 0"
+	invalidRateLimitBurstMsg := "upstream \"foo\" has invalid rateLimit burst (-1): must not be negative"
+	unknownRateLimitKeyMsg := "upstream \"foo\" has unknown rateLimit key \"session\": must be user or ip"
+	faultInjectionExperimentMsg := "upstream \"foo\" has a faultInjection without a header or groups: faults must only be injected into the requests of an experiment"
+	invalidFaultInjectionHeaderMsg := "upstream \"foo\" has invalid faultInjection header \"X Chaos\""
+	invalidFaultInjectionPercentMsg := "upstream \"foo\" has invalid faultInjection percent (0): must be between 1 and 100"
+	invalidFaultInjectionDelayMsg := "upstream \"foo\" has invalid faultInjection delay (0s): must be greater than 0"
+	invalidFaultInjectionAbortMsg := "upstream \"foo\" has invalid faultInjection abortStatusCode (302): must be between 400 and 599"
+	bufferingNotHTTPMsg := "upstream \"foo\" has bufferResponses or streamingContentTypes, but is not an HTTP(S) upstream, this will have no effect."
+	invalidStreamingContentTypeMsg := "upstream \"foo\" has invalid streamingContentTypes \"ndjson/\": mime: expected token after slash"
+	invalidMaxResponseBufferSizeMsg := "upstream \"foo\" has invalid maxResponseBufferSize (-1): must not be negative"
+	unusedMaxResponseBufferSizeMsg := "upstream \"foo\" has maxResponseBufferSize, but doesn't buffer responses, this will have no effect."
+	faultInjectionNoFaultMsg := "upstream \"foo\" has a faultInjection without a delay or abortStatusCode: no faults will be injected"
+	circuitBreakerWithFileMsg := "upstream \"foo\" has a circuitBreaker, but is not an HTTP(S) upstream, this will have no effect."
+	invalidErrorRatePercentMsg := "upstream \"foo\" has invalid circuitBreaker errorRatePercent (101): must be between 1 and 100"
+	invalidMinimumRequestsMsg := "upstream \"foo\" has invalid circuitBreaker minimumRequests (-1): must not be negative"
+	invalidCircuitWindowMsg := "upstream \"foo\" has invalid circuitBreaker window (0s): must be greater than 0"
+	invalidCoolDownMsg := "upstream \"foo\" has invalid circuitBreaker coolDown (0s): must be greater than 0"
+	invalidHalfOpenRequestsMsg := "upstream \"foo\" has invalid circuitBreaker halfOpenRequests (-1): must not be negative"
+	invalidDNSRefreshIntervalMsg := "upstream \"foo\" has invalid dnsRefreshInterval (0s): must be greater than 0"
+	dnsRefreshWithFileMsg := "upstream \"foo\" has dnsRefreshInterval, but is not an HTTP(S) upstream, this will have no effect."
+	dnsRefreshWithTemplateMsg := "upstream \"foo\" has dnsRefreshInterval, but a templated uri: templated upstreams are resolved with the standard resolver"
+	dnsRefreshWithIPMsg := "upstream \"foo\" has dnsRefreshInterval, but its uri has an IP address rather than a hostname, this will have no effect."
+	tlsServerNameWithHTTPMsg := "upstream \"foo\" has tlsServerName, but is not an HTTPS upstream, this will have no effect."
+	disableTLSSNIWithHTTPMsg := "upstream \"foo\" has disableTLSSNI, but is not an HTTPS upstream, this will have no effect."
+	invalidTLSServerNameMsg := "upstream \"foo\" has invalid tlsServerName (\"internal.example.com:443\"): must be a host name without a scheme or port"
+	templatedURISchemeMsg := "upstream \"foo\" has a templated uri, but templated uris must use the http or https scheme"
+	templatedURIUnrestrictedMsg := "upstream \"foo\" has a templated uri, but no allowedClaimValues or allowedClaimPattern: claim values must be restricted"
+	invalidClaimPatternMsg := "upstream \"foo\" has invalid allowedClaimPattern: error parsing regexp: missing closing ]: `[a-z`"
+	allowedClaimsNotTemplatedMsg := "upstream \"foo\" has allowed claim values, but its uri is not templated, this will have no effect."
+	staticWithStripPathMsg := "upstream \"foo\" has stripPath, but is a static upstream, this will have no effect."
+	staticWithPrependPathMsg := "upstream \"foo\" has prependPath, but is a static upstream, this will have no effect."
+	invalidRewritePathMsg := "upstream \"foo\" has invalid path \"^/api/(.*$\" for its rewriteTarget: error parsing regexp: missing closing ): `^/api/(.*$`"
+	unknownRewriteGroupMsg := "upstream \"foo\" has invalid rewriteTarget \"/$2/$1x\": the path \"^/api/(.*)$\" has no capture group \"2\", use ${1} to separate a group from the text following it"
+	unknownRewriteNamedGroupMsg := "upstream \"foo\" has invalid rewriteTarget \"/$2/$1x\": the path \"^/api/(.*)$\" has no capture group \"1x\", use ${1} to separate a group from the text following it"
+	stripPathWithRewriteMsg := "upstream \"foo\" has stripPath and a rewriteTarget: use the rewriteTarget to remove the path instead"
+	invalidPrependPathMsg := "upstream \"foo\" has invalid prependPath \"api\": the path must start with a '/'"
+	fileWithPathRewriteMsg := "upstream \"foo\" has stripPath or prependPath, but is a file upstream, this will have no effect."
+	fileWithCredentialsMsg := "upstream \"foo\" has credentials, but is not an HTTP(S) upstream, this will have no effect."
+	basicAuthUserWithoutPasswordMsg := "upstream \"foo\" has basicAuthUser, but no basicAuthPassword"
+	credentialHeaderWithClaimMsg := "upstream \"foo\" credential header \"X-Api-Key\" may only have secret values"
+	overrideAuthorizationMsg := "upstream \"foo\" has credentials that replace the Authorization header injected from the user's session: set overrideAuthorization to allow this"
+
+	basicAuthPassword := &options.SecretSource{Value: []byte("password")}
 
 	DescribeTable("validateUpstreams",
 		func(o *validateUpstreamTableInput) {
@@ -139,6 +226,59 @@ var _ = Describe("Upstreams", func() {
 			},
 			errStrings: []string{invalidURISchemeMsg},
 		}),
+		Entry("with a unix socket URI", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo",
+						URI:         "unix:///var/run/app.sock",
+						StripPath:   true,
+						HealthCheck: &options.UpstreamHealthCheck{},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a unix socket URI without a path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "unix://var/run/app.sock",
+					},
+				},
+			},
+			errStrings: []string{invalidUnixSocketURIMsg},
+		}),
+		Entry("with a unix socket URI and options for other servers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "unix:///var/run/app.sock",
+						DNSRefreshInterval: &flushInterval,
+						Backends:           []options.UpstreamBackend{{URI: "unix:///var/run/other.sock"}},
+						HealthCheck:        &options.UpstreamHealthCheck{FallbackURI: "http://status.internal"},
+					},
+				},
+			},
+			errStrings: []string{dnsRefreshWithUnixSocketMsg, backendsWithUnixSocketMsg, fallbackWithUnixSocketMsg},
+		}),
+		Entry("with an h2c URI", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "h2c://grpc.internal:50051",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
 		Entry("with a static upstream and invalid optons", &validateUpstreamTableInput{
 			upstreams: options.UpstreamConfig{
 				Upstreams: []options.Upstream{
@@ -151,6 +291,8 @@ var _ = Describe("Upstreams", func() {
 						PassHostHeader:        &truth,
 						ProxyWebSockets:       &truth,
 						InsecureSkipTLSVerify: true,
+						StripPath:             true,
+						PrependPath:           "/api",
 					},
 				},
 			},
@@ -160,6 +302,8 @@ var _ = Describe("Upstreams", func() {
 				staticWithFlushIntervalMsg,
 				staticWithPassHostHeaderMsg,
 				staticWithProxyWebSocketsMsg,
+				staticWithStripPathMsg,
+				staticWithPrependPathMsg,
 			},
 		}),
 		Entry("with duplicate IDs", &validateUpstreamTableInput{
@@ -208,5 +352,2253 @@ var _ = Describe("Upstreams", func() {
 			},
 			errStrings: []string{emptyURIMsg, staticCodeMsg},
 		}),
-	)
+		Entry("when static template options are supplied without static", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "http://localhost:8080",
+						StaticTemplate:    "/nonexistent/static.html",
+						StaticContentType: "text/html",
+					},
+				},
+			},
+			errStrings: []string{staticTemplateMsg, staticContentTypeMsg},
+		}),
+		Entry("with a static upstream and invalid template options", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						Static:            true,
+						StaticTemplate:    "/nonexistent/static.html",
+						StaticContentType: "/html",
+					},
+				},
+			},
+			errStrings: []string{invalidStaticContentTypeMsg, invalidStaticTemplateMsg},
+		}),
+		Entry("with a file upstream with file server options", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo/",
+						URI:  "file:///var/www/app",
+						FileServer: &options.UpstreamFileServer{
+							IndexFallback:     true,
+							IndexCacheControl: "no-cache",
+							Precompressed:     true,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with file server options on an HTTP upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:         "foo",
+						Path:       "/foo/",
+						URI:        "http://localhost:8080",
+						FileServer: &options.UpstreamFileServer{IndexFallback: true},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has fileServer, but is not a file upstream, this will have no effect."},
+		}),
+		Entry("with a static upstream with a body and headers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						Static:            true,
+						StaticBody:        `{"user": "{{ .User }}"}`,
+						StaticContentType: "application/json",
+						StaticHeaders: []options.UpstreamStaticHeader{
+							{Name: "Cache-Control", Value: "no-store"},
+							{Name: "X-Path", Value: "{{ .Path }}"},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("when a static body and headers are supplied without static", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://localhost:8080",
+						StaticBody:    "maintenance",
+						StaticHeaders: []options.UpstreamStaticHeader{{Name: "Retry-After", Value: "120"}},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has staticBody, but is not a static upstream, set 'static' for a static response",
+				"upstream \"foo\" has staticHeaders, but is not a static upstream, set 'static' for a static response",
+			},
+		}),
+		Entry("with a static upstream with an invalid body and headers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:             "foo",
+						Path:           "/foo",
+						Static:         true,
+						StaticTemplate: "/nonexistent/static.html",
+						StaticBody:     "{{ .User",
+						StaticHeaders: []options.UpstreamStaticHeader{
+							{Name: "X Path", Value: "{{ .Path }}"},
+							{Name: "Connection", Value: "close"},
+							{Name: "Location", Value: "{{ .Path"},
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidStaticTemplateMsg,
+				"upstream \"foo\" has staticBody and staticTemplate: only one of them can be the body of the static response",
+				"upstream \"foo\" has invalid staticBody: template: staticBody:1: unclosed action",
+				"upstream \"foo\" has invalid staticHeaders[0] name (\"X Path\"): must be a header name",
+				"upstream \"foo\" has invalid staticHeaders[1] name (\"Connection\"): hop-by-hop headers can't be set",
+				"upstream \"foo\" has invalid staticHeaders[2] value: template: Location:1: unclosed action",
+			},
+		}),
+		Entry("with a concurrency limit and queue", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://localhost:8080",
+						MaxConcurrentRequests: 50,
+						QueueSize:             10,
+						QueueTimeout:          &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid concurrency options", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://localhost:8080",
+						MaxConcurrentRequests: -1,
+						QueueSize:             -1,
+						QueueTimeout:          &zeroDuration,
+					},
+				},
+			},
+			errStrings: []string{invalidMaxConcurrentRequestsMsg, invalidQueueSizeMsg, invalidQueueTimeoutMsg},
+		}),
+		Entry("with a queue but no concurrency limit", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:        "foo",
+						Path:      "/foo",
+						URI:       "http://localhost:8080",
+						QueueSize: 10,
+					},
+				},
+			},
+			errStrings: []string{queueWithoutLimitMsg},
+		}),
+		Entry("with a request body size limit", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://localhost:8080",
+						MaxRequestBodySize: 1 << 20,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid request body size limit", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://localhost:8080",
+						MaxRequestBodySize: -1,
+					},
+				},
+			},
+			errStrings: []string{invalidMaxRequestBodySizeMsg},
+		}),
+		Entry("with a DNS refresh interval", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://app.default.svc.cluster.local:8080",
+						DNSRefreshInterval: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with connection options", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://app.default.svc.cluster.local:8080",
+						DialTimeout:           &flushInterval,
+						ResponseHeaderTimeout: &flushInterval,
+						MaxIdleConns:          10,
+						IdleConnTimeout:       &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid connection options", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://app.default.svc.cluster.local:8080",
+						DialTimeout:           &zeroDuration,
+						ResponseHeaderTimeout: &zeroDuration,
+						MaxIdleConns:          -1,
+						IdleConnTimeout:       &zeroDuration,
+					},
+				},
+			},
+			errStrings: []string{invalidDialTimeoutMsg, invalidResponseHeaderTimeoutMsg, invalidIdleConnTimeoutMsg, invalidMaxIdleConnsMsg},
+		}),
+		Entry("with connection options for a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo",
+						URI:         "file://var/lib/foo",
+						DialTimeout: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{connectionOptionsWithFileMsg},
+		}),
+		Entry("with idle connection options and keep-alives disabled", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "http://app.default.svc.cluster.local:8080",
+						MaxIdleConns:      10,
+						DisableKeepAlives: true,
+					},
+				},
+			},
+			errStrings: []string{idleConnsWithoutKeepAlivesMsg},
+		}),
+		Entry("with backends", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://app-1.internal:8080",
+						Backends:      []options.UpstreamBackend{{URI: "http://app-2.internal:8080/", Weight: 2}, {URI: "http://10.0.0.3:8080"}},
+						LoadBalancing: options.LoadBalancingLeastConnections,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid load balancing policy", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://app-1.internal:8080",
+						LoadBalancing: "random",
+					},
+				},
+			},
+			errStrings: []string{invalidLoadBalancingMsg, loadBalancingWithoutBackendsMsg},
+		}),
+		Entry("with invalid backends", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app-1.internal:8080",
+						Backends: []options.UpstreamBackend{
+							{URI: "https://app-2.internal:8443"},
+							{URI: "http://app-2.internal:8080/app"},
+							{URI: "http://app-3.internal:8080", Weight: -1},
+						},
+					},
+				},
+			},
+			errStrings: []string{backendSchemeMsg, backendPathMsg, invalidBackendWeightMsg},
+		}),
+		Entry("with backends for a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:       "foo",
+						Path:     "/foo",
+						URI:      "file://var/lib/foo",
+						Backends: []options.UpstreamBackend{{URI: "http://app-2.internal:8080"}},
+					},
+				},
+			},
+			errStrings: []string{backendsWithFileMsg},
+		}),
+		Entry("with backends for a templated uri", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimValues: []string{"tenant-a"},
+						Backends:           []options.UpstreamBackend{{URI: "http://app-2.internal:8080"}},
+					},
+				},
+			},
+			errStrings: []string{backendsWithTemplateMsg},
+		}),
+		Entry("with backends and a DNS refresh interval", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://app-1.internal:8080",
+						Backends:           []options.UpstreamBackend{{URI: "http://app-2.internal:8080"}},
+						DNSRefreshInterval: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{backendsWithDNSRefreshMsg},
+		}),
+		Entry("with a health check", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app-1.internal:8080",
+						HealthCheck: &options.UpstreamHealthCheck{
+							Path:               "/healthz",
+							Interval:           &flushInterval,
+							Timeout:            &flushInterval,
+							HealthyThreshold:   1,
+							UnhealthyThreshold: 5,
+							FallbackURI:        "http://status.internal",
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid health check", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app-1.internal:8080",
+						HealthCheck: &options.UpstreamHealthCheck{
+							Path:               "healthz",
+							Interval:           &zeroDuration,
+							Timeout:            &zeroDuration,
+							HealthyThreshold:   -1,
+							UnhealthyThreshold: -1,
+							FallbackURI:        "https://status.internal",
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidHealthCheckPathMsg,
+				invalidHealthCheckIntervalMsg,
+				invalidHealthCheckTimeoutMsg,
+				invalidHealthyThresholdMsg,
+				invalidUnhealthyThresholdMsg,
+				invalidFallbackSchemeMsg,
+			},
+		}),
+		Entry("with a health check fallback with a path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo",
+						URI:         "http://app-1.internal:8080",
+						HealthCheck: &options.UpstreamHealthCheck{FallbackURI: "http://status.internal/down"},
+					},
+				},
+			},
+			errStrings: []string{invalidFallbackPathMsg},
+		}),
+		Entry("with a health check for a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo",
+						URI:         "file://var/lib/foo",
+						HealthCheck: &options.UpstreamHealthCheck{},
+					},
+				},
+			},
+			errStrings: []string{healthCheckWithFileMsg},
+		}),
+		Entry("with a health check for a templated uri", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimValues: []string{"tenant-a"},
+						HealthCheck:        &options.UpstreamHealthCheck{},
+					},
+				},
+			},
+			errStrings: []string{healthCheckWithTemplateMsg},
+		}),
+		Entry("with session matching upstreams sharing a path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+					},
+					{
+						ID:           "canary",
+						Path:         "/foo",
+						URI:          "http://canary",
+						SessionMatch: &options.UpstreamSessionMatch{Groups: []string{"beta-testers"}},
+					},
+					{
+						ID:   "eu",
+						Path: "/foo",
+						URI:  "http://eu",
+						SessionMatch: &options.UpstreamSessionMatch{
+							Claims: []options.UpstreamClaimMatch{{Claim: "region", Values: []string{"eu"}}},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an empty session match", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:           "canary",
+						Path:         "/foo",
+						URI:          "http://canary",
+						SessionMatch: &options.UpstreamSessionMatch{},
+					},
+				},
+			},
+			errStrings: []string{emptySessionMatchMsg},
+		}),
+		Entry("with invalid session match claims", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "canary",
+						Path: "/bar",
+						URI:  "http://canary",
+						SessionMatch: &options.UpstreamSessionMatch{
+							Claims: []options.UpstreamClaimMatch{
+								{Values: []string{"eu"}},
+								{Claim: "region"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				sessionMatchNoClaimMsg,
+				sessionMatchNoValuesMsg,
+			},
+		}),
+		Entry("with valid policies", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo/",
+						URI:  "http://foo",
+						Policies: []options.UpstreamPolicy{
+							{Path: "^/foo/public/", Methods: []string{"GET", "HEAD"}, AllowAnonymous: true},
+							{Action: options.UpstreamPolicyDeny, CIDRs: []string{"0.0.0.0/0"}, Path: "^/foo/admin/"},
+							{Action: options.UpstreamPolicyAllow, Groups: []string{"users"}, Claims: []options.UpstreamClaimMatch{
+								{Claim: "roles", Values: []string{"reader"}},
+							}},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid policies", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo/",
+						URI:  "http://foo",
+						Policies: []options.UpstreamPolicy{
+							{Action: "block", Path: "^/foo/(", Methods: []string{"get"}, CIDRs: []string{"10.0.0.0/33"}},
+							{Claims: []options.UpstreamClaimMatch{{Values: []string{"reader"}}, {Claim: "roles"}}},
+							{Action: options.UpstreamPolicyDeny, Groups: []string{"users"}, AllowAnonymous: true},
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid policies[0]: unknown action \"block\", must be \"allow\" or \"deny\"",
+				"upstream \"foo\" has invalid policies[0]: invalid path \"^/foo/(\": error parsing regexp: missing closing ): `^/foo/(`",
+				"upstream \"foo\" has invalid policies[0]: invalid method \"get\": must be an uppercase HTTP method",
+				"upstream \"foo\" has invalid policies[0]: cidr \"10.0.0.0/33\" could not be recognized",
+				"upstream \"foo\" has invalid policies[1]: claims[0]: claim is required",
+				"upstream \"foo\" has invalid policies[1]: claims[1]: values are required",
+				"upstream \"foo\" has invalid policies[2]: deny policies can't allow anonymous requests",
+				"upstream \"foo\" has invalid policies[2]: policies with groups or claims can't allow anonymous requests, which have no session",
+			},
+		}),
+		Entry("with a valid token exchange", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "orders",
+						Path: "/orders/",
+						URI:  "http://orders",
+						TokenExchange: &options.UpstreamTokenExchange{
+							Audience: "orders-api",
+							Scopes:   []string{"orders:read"},
+						},
+					},
+					{
+						ID:            "billing",
+						Path:          "/billing/",
+						URI:           "http://billing",
+						BasicAuthUser: "proxy",
+						BasicAuthPassword: &options.SecretSource{
+							Value: []byte("secret"),
+						},
+						TokenExchange: &options.UpstreamTokenExchange{
+							Audience: "billing-api",
+							Header:   "X-Billing-Token",
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid token exchange", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:         "orders",
+						Path:       "/orders/",
+						Static:     true,
+						StaticCode: &staticCode200,
+						TokenExchange: &options.UpstreamTokenExchange{
+							Scopes: []string{"orders:read orders:write"},
+							Header: "Connection",
+						},
+					},
+					{
+						ID:            "billing",
+						Path:          "/billing/",
+						URI:           "http://billing",
+						BasicAuthUser: "proxy",
+						BasicAuthPassword: &options.SecretSource{
+							Value: []byte("secret"),
+						},
+						TokenExchange: &options.UpstreamTokenExchange{
+							Audience: "billing-api",
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"orders\" has tokenExchange, but is not an HTTP(S) upstream, this will have no effect.",
+				"upstream \"orders\" has tokenExchange without an audience",
+				"upstream \"orders\" has tokenExchange with an invalid scope \"orders:read orders:write\"",
+				"upstream \"orders\" has tokenExchange with an invalid header (\"Connection\"): must be a header name, other than a hop-by-hop header",
+				"upstream \"billing\" has tokenExchange sending the token in the Authorization header, which is replaced by its credentials",
+			},
+		}),
+		Entry("with policies allowing anonymous requests and a session match", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:           "canary",
+						Path:         "/foo/",
+						URI:          "http://canary",
+						SessionMatch: &options.UpstreamSessionMatch{Groups: []string{"beta-testers"}},
+						Policies:     []options.UpstreamPolicy{{AllowAnonymous: true}},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"canary\" has policies allowing anonymous requests, but a sessionMatch, which requests without a session never match, this will have no effect."},
+		}),
+		Entry("with a valid rate limit", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						RateLimit: &options.UpstreamRateLimit{
+							Requests: 100,
+							Period:   &flushInterval,
+							Burst:    20,
+							Key:      options.RateLimitKeyIP,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid rate limit", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						RateLimit: &options.UpstreamRateLimit{
+							Period: &zeroDuration,
+							Burst:  -1,
+							Key:    "session",
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidRateLimitRequestsMsg,
+				invalidRateLimitPeriodMsg,
+				invalidRateLimitBurstMsg,
+				unknownRateLimitKeyMsg,
+			},
+		}),
+		Entry("with valid response buffering", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://foo",
+						StreamingContentTypes: []string{"application/x-ndjson"},
+						BufferResponses:       true,
+						MaxResponseBufferSize: 4096,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid response buffering", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						Static:                true,
+						StreamingContentTypes: []string{"ndjson/"},
+						MaxResponseBufferSize: -1,
+					},
+				},
+			},
+			errStrings: []string{
+				bufferingNotHTTPMsg,
+				invalidStreamingContentTypeMsg,
+				invalidMaxResponseBufferSizeMsg,
+				unusedMaxResponseBufferSizeMsg,
+			},
+		}),
+		Entry("with a response buffer size without buffering", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://foo",
+						MaxResponseBufferSize: 4096,
+					},
+				},
+			},
+			errStrings: []string{unusedMaxResponseBufferSizeMsg},
+		}),
+		Entry("with a valid fault injection", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						FaultInjection: &options.UpstreamFaultInjection{
+							Header:          "X-Chaos-Experiment",
+							Groups:          []string{"chaos"},
+							Percent:         10,
+							Delay:           &flushInterval,
+							AbortStatusCode: 503,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid fault injection", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						FaultInjection: &options.UpstreamFaultInjection{
+							Header:          "X Chaos",
+							Delay:           &zeroDuration,
+							AbortStatusCode: 302,
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidFaultInjectionHeaderMsg,
+				invalidFaultInjectionPercentMsg,
+				invalidFaultInjectionDelayMsg,
+				invalidFaultInjectionAbortMsg,
+			},
+		}),
+		Entry("with a fault injection outside of an experiment", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:             "foo",
+						Path:           "/foo",
+						URI:            "http://foo",
+						FaultInjection: &options.UpstreamFaultInjection{Percent: 100},
+					},
+				},
+			},
+			errStrings: []string{
+				faultInjectionExperimentMsg,
+				faultInjectionNoFaultMsg,
+			},
+		}),
+		Entry("with a valid circuit breaker", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						CircuitBreaker: &options.UpstreamCircuitBreaker{
+							ErrorRatePercent: 25,
+							MinimumRequests:  10,
+							Window:           &flushInterval,
+							CoolDown:         &flushInterval,
+							HalfOpenRequests: 3,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid circuit breaker", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://foo",
+						CircuitBreaker: &options.UpstreamCircuitBreaker{
+							ErrorRatePercent: 101,
+							MinimumRequests:  -1,
+							Window:           &zeroDuration,
+							CoolDown:         &zeroDuration,
+							HalfOpenRequests: -1,
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidErrorRatePercentMsg,
+				invalidMinimumRequestsMsg,
+				invalidCircuitWindowMsg,
+				invalidCoolDownMsg,
+				invalidHalfOpenRequestsMsg,
+			},
+		}),
+		Entry("with a circuit breaker for a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:             "foo",
+						Path:           "/foo",
+						URI:            "file://var/lib/foo",
+						CircuitBreaker: &options.UpstreamCircuitBreaker{},
+					},
+				},
+			},
+			errStrings: []string{circuitBreakerWithFileMsg},
+		}),
+		Entry("with an invalid DNS refresh interval", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://app.default.svc.cluster.local:8080",
+						DNSRefreshInterval: &zeroDuration,
+					},
+				},
+			},
+			errStrings: []string{invalidDNSRefreshIntervalMsg},
+		}),
+		Entry("with a DNS refresh interval for a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "file://var/lib/foo",
+						DNSRefreshInterval: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{dnsRefreshWithFileMsg},
+		}),
+		Entry("with a DNS refresh interval for a templated uri", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimValues: []string{"tenant-a"},
+						DNSRefreshInterval: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{dnsRefreshWithTemplateMsg},
+		}),
+		Entry("with a DNS refresh interval for an IP address", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://127.0.0.1:8080",
+						DNSRefreshInterval: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{dnsRefreshWithIPMsg},
+		}),
+		Entry("with a TLS server name and SNI disabled for an HTTPS upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "https://10.0.0.1:8443",
+						TLSServerName: "internal.example.com",
+						DisableTLSSNI: true,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a TLS server name and SNI disabled for an HTTP upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://10.0.0.1:8080",
+						TLSServerName: "internal.example.com",
+						DisableTLSSNI: true,
+					},
+				},
+			},
+			errStrings: []string{tlsServerNameWithHTTPMsg, disableTLSSNIWithHTTPMsg},
+		}),
+		Entry("with a client certificate and CA for an HTTPS upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "https://app.internal:8443",
+						TLSClientCert: &options.SecretSource{Value: []byte("cert")},
+						TLSClientKey:  &options.SecretSource{Value: []byte("key")},
+						TLSCA:         &options.SecretSource{Value: []byte("ca")},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a client certificate for an HTTP upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://app.internal:8080",
+						TLSClientCert: &options.SecretSource{Value: []byte("cert")},
+						TLSClientKey:  &options.SecretSource{Value: []byte("key")},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has tlsClientCert, but is not an HTTPS upstream, this will have no effect.",
+				"upstream \"foo\" has tlsClientKey, but is not an HTTPS upstream, this will have no effect.",
+			},
+		}),
+		Entry("with a client certificate without a key", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "https://app.internal:8443",
+						TLSClientCert: &options.SecretSource{Value: []byte("cert")},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has tlsClientCert, but no tlsClientKey"},
+		}),
+		Entry("with a client key without a certificate, and an invalid CA", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:           "foo",
+						Path:         "/foo",
+						URI:          "https://app.internal:8443",
+						TLSClientKey: &options.SecretSource{Value: []byte("key")},
+						TLSCA:        &options.SecretSource{Value: []byte("ca"), FromFile: "/etc/oauth2-proxy/ca.crt"},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid tlsCA: multiple values specified for secret source: specify either value, fromEnv of fromFile",
+				"upstream \"foo\" has tlsClientKey, but no tlsClientCert",
+			},
+		}),
+		Entry("with SPIFFE IDs and a trust domain", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "https://ledger.internal:8443",
+						SPIFFE: &options.UpstreamSPIFFE{
+							EndpointSocket: "unix:///run/spire/sockets/agent.sock",
+							IDs:            []string{"spiffe://example.org/ns/payments/sa/ledger"},
+							TrustDomain:    "partner.example.com",
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with SPIFFE for an HTTP upstream, without IDs or a trust domain", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:     "foo",
+						Path:   "/foo",
+						URI:    "http://ledger.internal:8080",
+						SPIFFE: &options.UpstreamSPIFFE{},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has spiffe, but is not an HTTPS upstream, this will have no effect.",
+				"upstream \"foo\" has invalid spiffe: must have ids or a trustDomain",
+			},
+		}),
+		Entry("with invalid SPIFFE options, and TLS options they replace", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "https://ledger.internal:8443",
+						TLSCA:                 &options.SecretSource{Value: []byte("ca")},
+						InsecureSkipTLSVerify: true,
+						SPIFFE: &options.UpstreamSPIFFE{
+							EndpointSocket: "/run/spire/sockets/agent.sock",
+							IDs:            []string{"https://example.org/ledger"},
+							TrustDomain:    "Example.org",
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has spiffe and tlsCA: the SVIDs of the SPIFFE Workload API replace it",
+				"upstream \"foo\" has spiffe and insecureSkipTLSVerify: the SVIDs of the SPIFFE Workload API replace it",
+				"upstream \"foo\" has invalid spiffe ids[0] (\"https://example.org/ledger\"): scheme is missing or invalid",
+				"upstream \"foo\" has invalid spiffe trustDomain (\"Example.org\"): trust domain characters are limited to lowercase letters, numbers, dots, dashes, and underscores",
+				"upstream \"foo\" has invalid spiffe endpointSocket (\"/run/spire/sockets/agent.sock\"): workload endpoint socket URI must have a \"tcp\" or \"unix\" scheme",
+			},
+		}),
+		Entry("with a TLS server name for a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						Static:        true,
+						TLSServerName: "internal.example.com",
+					},
+				},
+			},
+			errStrings: []string{tlsServerNameWithHTTPMsg},
+		}),
+		Entry("with an invalid TLS server name", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "https://10.0.0.1:8443",
+						TLSServerName: "internal.example.com:443",
+					},
+				},
+			},
+			errStrings: []string{invalidTLSServerNameMsg},
+		}),
+		Entry("with a templated uri with allowed claim values", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimValues: []string{"tenant-a", "tenant-b"},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a templated uri with an allowed claim pattern", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "https://{{ .Claims.tenant }}.svc.cluster.local",
+						AllowedClaimPattern: "tenant-[a-z]+",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a templated uri with a path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://{{ .Claims.tenant }}.svc.cluster.local:8080/api/",
+						AllowedClaimValues: []string{"tenant-a"},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid templated uri: templated uri \"http://{{ .Claims.tenant }}.svc.cluster.local:8080/api/\" may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream"},
+		}),
+		Entry("with a claim in the path of a templated uri", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://tenants.svc.cluster.local:8080/{{ .Claims.tenant }}",
+						AllowedClaimValues: []string{"tenant-a"},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid templated uri: templated uri \"http://tenants.svc.cluster.local:8080/{{ .Claims.tenant }}\" may only substitute claims into the host, and can't have a path, query or fragment: use prependPath to proxy to a path of the upstream"},
+		}),
+		Entry("with a templated uri without restricted claim values", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+					},
+				},
+			},
+			errStrings: []string{templatedURIUnrestrictedMsg},
+		}),
+		Entry("with a templated file uri and an invalid claim pattern", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "file:///var/lib/{{ .Claims.tenant }}",
+						AllowedClaimPattern: "[a-z",
+					},
+				},
+			},
+			errStrings: []string{templatedURISchemeMsg, invalidClaimPatternMsg},
+		}),
+		Entry("with allowed claim values without a templated uri", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                 "foo",
+						Path:               "/foo",
+						URI:                "http://localhost:8080",
+						AllowedClaimValues: []string{"tenant-a"},
+					},
+				},
+			},
+			errStrings: []string{allowedClaimsNotTemplatedMsg},
+		}),
+		Entry("with a rewriteTarget referring to the capture groups of the path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "^/api/(v[0-9]+)/(?P<rest>.*)$",
+						URI:           "http://localhost:8080",
+						RewriteTarget: "/${1}x/$rest?cost=$$1",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a rewriteTarget and an invalid path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "^/api/(.*$",
+						URI:           "http://localhost:8080",
+						RewriteTarget: "/$1",
+					},
+				},
+			},
+			errStrings: []string{invalidRewritePathMsg},
+		}),
+		Entry("with a rewriteTarget referring to unknown capture groups", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "^/api/(.*)$",
+						URI:           "http://localhost:8080",
+						RewriteTarget: "/$2/$1x",
+					},
+				},
+			},
+			errStrings: []string{unknownRewriteGroupMsg, unknownRewriteNamedGroupMsg},
+		}),
+		Entry("with stripPath and prependPath", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo/",
+						URI:         "http://localhost:8080",
+						StripPath:   true,
+						PrependPath: "/api",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with stripPath and a rewriteTarget", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "^/foo/(.*)$",
+						RewriteTarget: "/$1",
+						URI:           "http://localhost:8080",
+						StripPath:     true,
+					},
+				},
+			},
+			errStrings: []string{stripPathWithRewriteMsg},
+		}),
+		Entry("with a relative prependPath", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:          "foo",
+						Path:        "/foo/",
+						URI:         "http://localhost:8080",
+						PrependPath: "api",
+					},
+				},
+			},
+			errStrings: []string{invalidPrependPathMsg},
+		}),
+		Entry("with stripPath on a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:        "foo",
+						Path:      "/foo/",
+						URI:       "file://var/lib/foo",
+						StripPath: true,
+					},
+				},
+			},
+			errStrings: []string{fileWithPathRewriteMsg},
+		}),
+		Entry("with basic auth credentials", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "http://localhost:8080",
+						BasicAuthUser:     "user",
+						BasicAuthPassword: basicAuthPassword,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with basicAuthUser and no basicAuthPassword", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:            "foo",
+						Path:          "/foo",
+						URI:           "http://localhost:8080",
+						BasicAuthUser: "user",
+					},
+				},
+			},
+			errStrings: []string{basicAuthUserWithoutPasswordMsg},
+		}),
+		Entry("with a credential header from a claim", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://localhost:8080",
+						CredentialHeaders: []options.Header{
+							{
+								Name: "X-Api-Key",
+								Values: []options.HeaderValue{
+									{ClaimSource: &options.ClaimSource{Claim: "email"}},
+								},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{credentialHeaderWithClaimMsg},
+		}),
+		Entry("with credentials on a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "file://var/lib/foo",
+						BasicAuthUser:     "user",
+						BasicAuthPassword: basicAuthPassword,
+					},
+				},
+			},
+			errStrings: []string{fileWithCredentialsMsg},
+		}),
+		Entry("with a response rewrite", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						ResponseRewrite: &options.UpstreamResponseRewrite{
+							ExternalURL: "https://app.example.com",
+							BodyReplacements: []options.BodyReplacement{
+								{Find: "http://app.internal:8080", Replace: "https://app.example.com"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid response rewrite", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						ResponseRewrite: &options.UpstreamResponseRewrite{
+							ExternalURL: "/app",
+							BodyReplacements: []options.BodyReplacement{
+								{Find: "", Replace: "https://app.example.com"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid responseRewrite externalURL \"/app\": must be an absolute http or https URL",
+				"upstream \"foo\" has responseRewrite body replacement 0 with an empty find",
+			},
+		}),
+		Entry("with TLS headers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:             "foo",
+						Path:           "/foo",
+						URI:            "http://app.internal:8080",
+						PassTLSHeaders: []string{"X-Forwarded-Proto", "x-ssl-client-dn", "X-SSL-Client-Cert"},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an unknown TLS header", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:             "foo",
+						Path:           "/foo",
+						URI:            "http://app.internal:8080",
+						PassTLSHeaders: []string{"X-SSL-Client-Verify"},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has unknown passTLSHeaders header \"X-SSL-Client-Verify\": must be one of X-Forwarded-Proto, X-SSL-Protocol, X-SSL-Cipher, X-SSL-Client-Cert or X-SSL-Client-DN",
+			},
+		}),
+		Entry("with a WebSocket policy", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                           "foo",
+						Path:                         "/foo",
+						URI:                          "http://app.internal:8080",
+						WebSocketAllowedOrigins:      []string{"https://app.example.com", "https://*.example.com"},
+						WebSocketAllowedSubprotocols: []string{"graphql-ws", "v2.chat.example.com"},
+						WebSocketRequireOrigin:       true,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid WebSocket policy", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                           "foo",
+						Path:                         "/foo",
+						URI:                          "file:///var/www",
+						WebSocketAllowedOrigins:      []string{"*"},
+						WebSocketAllowedSubprotocols: []string{"graphql-ws, chat"},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has a WebSocket policy, but is not an HTTP(S) upstream, this will have no effect.",
+				"upstream \"foo\" has invalid webSocketAllowedOrigins[0] (*): origin must be an explicit scheme and host",
+				"upstream \"foo\" has invalid webSocketAllowedSubprotocols[0] (\"graphql-ws, chat\"): subprotocols must be tokens without separators",
+			},
+		}),
+		Entry("with a WebSocket idle timeout", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                   "foo",
+						Path:                 "/foo",
+						URI:                  "http://app.internal:8080",
+						WebSocketIdleTimeout: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid WebSocket idle timeout", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                   "foo",
+						Path:                 "/foo",
+						URI:                  "http://app.internal:8080",
+						WebSocketIdleTimeout: &zeroDuration,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid webSocketIdleTimeout (0s): must be greater than 0"},
+		}),
+		Entry("with a WebSocket idle timeout when WebSockets aren't proxied", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                   "foo",
+						Path:                 "/foo",
+						URI:                  "http://app.internal:8080",
+						ProxyWebSockets:      &falsehood,
+						WebSocketIdleTimeout: &flushInterval,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has webSocketIdleTimeout, but proxyWebSockets is false, this will have no effect."},
+		}),
+		Entry("with webSocketRequireOrigin without allowed origins", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                     "foo",
+						Path:                   "/foo",
+						URI:                    "http://app.internal:8080",
+						WebSocketRequireOrigin: true,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has webSocketRequireOrigin, but no webSocketAllowedOrigins, this will have no effect."},
+		}),
+		Entry("with a response rewrite on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:              "foo",
+						Path:            "/foo",
+						Static:          true,
+						ResponseRewrite: &options.UpstreamResponseRewrite{},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has responseRewrite, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with stream retries on an HTTP upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "http://app.internal:8080",
+						RetryStreamErrors: true,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with stream retries on a file upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "file:///var/www",
+						RetryStreamErrors: true,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has retryStreamErrors, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with stream retries on a templated upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimPattern: "[a-z]+",
+						RetryStreamErrors:   true,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has retryStreamErrors, but a templated uri: requests to templated upstreams can't be retried"},
+		}),
+		Entry("with a retry", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Retry: &options.UpstreamRetry{
+							MaxAttempts: 2,
+							Backoff:     &flushInterval,
+							StatusCodes: []int{429, 503},
+							Errors:      []string{"connect", "timeout"},
+							MaxBodySize: 4096,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid retry", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Retry: &options.UpstreamRetry{
+							MaxAttempts: -1,
+							Backoff:     &negativeDuration,
+							MaxBackoff:  &negativeDuration,
+							StatusCodes: []int{200},
+							Errors:      []string{"refused"},
+							MaxBodySize: -1,
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid retry maxAttempts (-1): must not be negative",
+				"upstream \"foo\" has invalid retry backoff (-1s): must not be negative",
+				"upstream \"foo\" has invalid retry maxBackoff (-1s): must not be negative",
+				"upstream \"foo\" has invalid retry status code (200): must be a 4xx or 5xx status",
+				"upstream \"foo\" has invalid retry error (\"refused\"): must be one of \"connect\", \"reset\" or \"timeout\"",
+				"upstream \"foo\" has invalid retry maxBodySize (-1): must not be negative",
+			},
+		}),
+		Entry("with a retry on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:         "foo",
+						Path:       "/foo",
+						Static:     true,
+						StaticCode: &staticCode200,
+						Retry:      &options.UpstreamRetry{},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a retry, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with a retry on a templated upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimPattern: "[a-z]+",
+						Retry:               &options.UpstreamRetry{},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a retry, but a templated uri: requests to templated upstreams can't be retried"},
+		}),
+		Entry("with a mirror", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Mirror: &options.UpstreamMirror{
+							URI:           "http://app-v2.internal:8080/",
+							SamplePercent: 10,
+							MaxBodySize:   4096,
+							Timeout:       &flushInterval,
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid mirror", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Mirror: &options.UpstreamMirror{
+							URI:           "app-v2.internal:8080",
+							SamplePercent: 101,
+							MaxBodySize:   -1,
+							Timeout:       &zeroDuration,
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid mirror uri (\"app-v2.internal:8080\"): must be an http or https URL",
+				"upstream \"foo\" has invalid mirror samplePercent (101): must be from 1 to 100",
+				"upstream \"foo\" has invalid mirror maxBodySize (-1): must not be negative",
+				"upstream \"foo\" has invalid mirror timeout (0s): must be greater than 0",
+			},
+		}),
+		Entry("with a mirror uri with a path", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Mirror: &options.UpstreamMirror{
+							URI:           "http://app-v2.internal:8080/v2",
+							SamplePercent: 10,
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid mirror uri (\"http://app-v2.internal:8080/v2\"): must only have a scheme and host, requests are mirrored with their own path"},
+		}),
+		Entry("with a mirror on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:     "foo",
+						Path:   "/foo",
+						Static: true,
+						Mirror: &options.UpstreamMirror{
+							URI:           "http://app-v2.internal:8080",
+							SamplePercent: 10,
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a mirror, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with a mirror on a templated upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimPattern: "[a-z]+",
+						Mirror: &options.UpstreamMirror{
+							URI:           "http://app-v2.internal:8080",
+							SamplePercent: 10,
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a mirror, but a templated uri: requests to templated upstreams can't be mirrored"},
+		}),
+		Entry("with a cache", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							TTL:          &flushInterval,
+							MaxEntrySize: 4096,
+							MaxSize:      1 << 20,
+							VaryOnUser:   true,
+							BypassHeader: "X-Cache-Bypass",
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a redis cache", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							Store:   options.UpstreamCacheStoreRedis,
+							MaxSize: 1 << 20,
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has cache maxSize, but a redis store, this will have no effect."},
+		}),
+		Entry("with an unknown cache store", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							Store: "disk",
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has unknown cache store \"disk\": must be memory or redis"},
+		}),
+		Entry("with an invalid cache bypass header", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							BypassHeader: "X-Cache: bypass",
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid cache bypassHeader (\"X-Cache: bypass\"): must be a header name"},
+		}),
+		Entry("with an invalid cache", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							TTL:          &zeroDuration,
+							MaxEntrySize: -1,
+							MaxSize:      -1,
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid cache ttl (0s): must be greater than 0",
+				"upstream \"foo\" has invalid cache maxEntrySize (-1): must not be negative",
+				"upstream \"foo\" has invalid cache maxSize (-1): must not be negative",
+			},
+		}),
+		Entry("with a cache entry size larger than the cache", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						Cache: &options.UpstreamCache{
+							MaxEntrySize: 2048,
+							MaxSize:      1024,
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has invalid cache maxEntrySize (2048): must not be larger than maxSize (1024)"},
+		}),
+		Entry("with a cache on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:     "foo",
+						Path:   "/foo",
+						Static: true,
+						Cache:  &options.UpstreamCache{},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a cache, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with a cache on a templated upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                  "foo",
+						Path:                "/foo",
+						URI:                 "http://{{ .Claims.tenant }}.svc.cluster.local:8080",
+						AllowedClaimPattern: "[a-z]+",
+						Cache:               &options.UpstreamCache{},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has a cache, but a templated uri: responses of templated upstreams can't be cached"},
+		}),
+		Entry("with allowed request headers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://app.internal:8080",
+						AllowedRequestHeaders: []string{"Accept", "content-type", "X-Request-Id"},
+						StripProxyCookies:     true,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid allowed request headers", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://app.internal:8080",
+						AllowedRequestHeaders: []string{"", "X-Request-Id: 1", "cookie", "Connection", "te"},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid allowedRequestHeaders[0] (\"\"): must be a header name",
+				"upstream \"foo\" has invalid allowedRequestHeaders[1] (\"X-Request-Id: 1\"): must be a header name",
+				"upstream \"foo\" has invalid allowedRequestHeaders[2] (\"cookie\"): cookies are sent unless passCookies is false",
+				"upstream \"foo\" has invalid allowedRequestHeaders[3] (\"Connection\"): hop-by-hop headers are always removed",
+				"upstream \"foo\" has invalid allowedRequestHeaders[4] (\"te\"): hop-by-hop headers are always removed",
+			},
+		}),
+		Entry("with stripProxyCookies and passCookies disabled", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                "foo",
+						Path:              "/foo",
+						URI:               "http://app.internal:8080",
+						PassCookies:       &falsehood,
+						StripProxyCookies: true,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has stripProxyCookies, but passCookies is false, this will have no effect."},
+		}),
+		Entry("with request header options on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						Static:                true,
+						AllowedRequestHeaders: []string{"Accept"},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has request header options, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with valid header rewrites", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						HeaderRewrites: &options.UpstreamHeaderRewrites{
+							Request: []options.HeaderRewrite{
+								{Name: "X-Api-Version", Action: options.HeaderRewriteSet, Value: "2"},
+								{Name: "Accept-Language", Action: options.HeaderRewriteRemove},
+							},
+							Response: []options.HeaderRewrite{
+								{Name: "Set-Cookie", Action: options.HeaderRewriteRemove},
+								{Name: "Location", Action: options.HeaderRewriteReplace, Pattern: "^http://(.*)$", Value: "https://$1"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid header rewrites", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:   "foo",
+						Path: "/foo",
+						URI:  "http://app.internal:8080",
+						HeaderRewrites: &options.UpstreamHeaderRewrites{
+							Request: []options.HeaderRewrite{
+								{Action: options.HeaderRewriteAdd, Value: "1"},
+								{Name: "Connection", Action: options.HeaderRewriteRemove},
+								{Name: "X-Api-Version", Action: "append"},
+							},
+							Response: []options.HeaderRewrite{
+								{Name: "Server", Action: options.HeaderRewriteReplace},
+								{Name: "Location", Action: options.HeaderRewriteReplace, Pattern: "(http"},
+								{Name: "Set-Cookie", Action: options.HeaderRewriteRemove, Pattern: "session"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid headerRewrites.request[0] name (\"\"): must be a header name",
+				"upstream \"foo\" has invalid headerRewrites.request[1] name (\"Connection\"): hop-by-hop headers can't be rewritten",
+				"upstream \"foo\" has unknown headerRewrites.request[2] action \"append\": must be add, set, remove or replace",
+				"upstream \"foo\" has invalid headerRewrites.response[0]: a pattern is required for the replace action",
+				"upstream \"foo\" has invalid headerRewrites.response[1] pattern (\"(http\"): error parsing regexp: missing closing ): `(http`",
+				"upstream \"foo\" has headerRewrites.response[2] pattern, but its action is not replace, this will have no effect.",
+			},
+		}),
+		Entry("with request header rewrites on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:     "foo",
+						Path:   "/foo",
+						Static: true,
+						HeaderRewrites: &options.UpstreamHeaderRewrites{
+							Request: []options.HeaderRewrite{
+								{Name: "X-Api-Version", Action: options.HeaderRewriteSet, Value: "2"},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has request headerRewrites, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with the move-client authorization conflict", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                        "foo",
+						Path:                      "/foo",
+						URI:                       "http://app.internal:8080",
+						AuthorizationConflict:     options.AuthorizationConflictMoveClient,
+						ClientAuthorizationHeader: "X-Api-Authorization",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an unknown authorization conflict", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						URI:                   "http://app.internal:8080",
+						AuthorizationConflict: "merge",
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has unknown authorizationConflict \"merge\": must be overwrite, preserve-client or move-client"},
+		}),
+		Entry("with an authorization conflict on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                    "foo",
+						Path:                  "/foo",
+						Static:                true,
+						AuthorizationConflict: options.AuthorizationConflictPreserveClient,
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has authorizationConflict, but is not an HTTP(S) upstream, this will have no effect."},
+		}),
+		Entry("with a clientAuthorizationHeader without the move-client authorization conflict", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                        "foo",
+						Path:                      "/foo",
+						URI:                       "http://app.internal:8080",
+						AuthorizationConflict:     options.AuthorizationConflictPreserveClient,
+						ClientAuthorizationHeader: "X-Api-Authorization",
+					},
+				},
+			},
+			errStrings: []string{"upstream \"foo\" has clientAuthorizationHeader, but authorizationConflict is not move-client, this will have no effect."},
+		}),
+		Entry("with invalid clientAuthorizationHeaders", &validateUpstreamTableInput{
+			upstreams: options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{
+						ID:                        "foo",
+						Path:                      "/foo",
+						URI:                       "http://app.internal:8080",
+						AuthorizationConflict:     options.AuthorizationConflictMoveClient,
+						ClientAuthorizationHeader: "X-Api: Authorization",
+					},
+					{
+						ID:                        "bar",
+						Path:                      "/bar",
+						URI:                       "http://app.internal:8080",
+						AuthorizationConflict:     options.AuthorizationConflictMoveClient,
+						ClientAuthorizationHeader: "authorization",
+					},
+				},
+			},
+			errStrings: []string{
+				"upstream \"foo\" has invalid clientAuthorizationHeader (\"X-Api: Authorization\"): must be a header name",
+				"upstream \"bar\" has invalid clientAuthorizationHeader (\"authorization\"): must not be the Authorization header or a hop-by-hop header",
+			},
+		}),
+	)
+
+	type validateUpstreamAuthorizationTableInput struct {
+		overrideAuthorization      bool
+		authorizationConflict      string
+		withoutAuthorizationHeader bool
+		errStrings                 []string
+	}
+
+	DescribeTable("validateUpstreamAuthorization",
+		func(in *validateUpstreamAuthorizationTableInput) {
+			o := &options.Options{
+				InjectRequestHeaders: []options.Header{
+					{
+						Name: "Authorization",
+						Values: []options.HeaderValue{
+							{ClaimSource: &options.ClaimSource{Claim: "access_token", Prefix: "Bearer "}},
+						},
+					},
+				},
+				UpstreamServers: options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						validHTTPUpstream,
+						{
+							ID:                    "foo",
+							Path:                  "/foo",
+							URI:                   "http://localhost:8080",
+							BasicAuthUser:         "user",
+							BasicAuthPassword:     basicAuthPassword,
+							OverrideAuthorization: in.overrideAuthorization,
+						},
+						{
+							ID:                    "bar",
+							Path:                  "/bar",
+							URI:                   "http://localhost:8081",
+							AuthorizationConflict: in.authorizationConflict,
+						},
+					},
+				},
+			}
+			if in.withoutAuthorizationHeader {
+				o.InjectRequestHeaders = nil
+			}
+			Expect(validateUpstreamAuthorization(o)).To(ConsistOf(in.errStrings))
+		},
+		Entry("with credentials replacing the user's Authorization header", &validateUpstreamAuthorizationTableInput{
+			overrideAuthorization: false,
+			errStrings:            []string{overrideAuthorizationMsg},
+		}),
+		Entry("with overrideAuthorization", &validateUpstreamAuthorizationTableInput{
+			overrideAuthorization: true,
+			errStrings:            []string{},
+		}),
+		Entry("with an authorization conflict policy", &validateUpstreamAuthorizationTableInput{
+			overrideAuthorization: true,
+			authorizationConflict: options.AuthorizationConflictMoveClient,
+			errStrings:            []string{},
+		}),
+		Entry("with an authorization conflict policy without an injected Authorization header", &validateUpstreamAuthorizationTableInput{
+			authorizationConflict:      options.AuthorizationConflictPreserveClient,
+			withoutAuthorizationHeader: true,
+			errStrings:                 []string{"upstream \"bar\" has authorizationConflict, but no Authorization header is injected by injectRequestHeaders, this will have no effect."},
+		}),
+		Entry("with the overwrite policy without an injected Authorization header", &validateUpstreamAuthorizationTableInput{
+			authorizationConflict:      options.AuthorizationConflictOverwrite,
+			withoutAuthorizationHeader: true,
+			errStrings:                 []string{},
+		}),
+	)
+
+	type authorizationHeaderWarningsTableInput struct {
+		headers  []options.Header
+		warnings []string
+	}
+
+	basicAuthValue := options.HeaderValue{
+		ClaimSource: &options.ClaimSource{Claim: "user", Prefix: "Basic ", BasicAuthPassword: basicAuthPassword},
+	}
+	accessTokenValue := options.HeaderValue{
+		ClaimSource: &options.ClaimSource{Claim: "access_token", Prefix: "Bearer "},
+	}
+	joinedAuthorizationMsg := "injectRequestHeaders: the Authorization header is injected with basic auth credentials and other values, which are joined into a single header that upstreams won't be able to parse"
+
+	DescribeTable("authorizationHeaderWarnings",
+		func(in *authorizationHeaderWarningsTableInput) {
+			Expect(authorizationHeaderWarnings(in.headers)).To(ConsistOf(in.warnings))
+		},
+		Entry("with basic auth credentials", &authorizationHeaderWarningsTableInput{
+			headers: []options.Header{
+				{Name: "Authorization", Values: []options.HeaderValue{basicAuthValue}},
+				{Name: "X-Forwarded-Access-Token", Values: []options.HeaderValue{accessTokenValue}},
+			},
+			warnings: []string{},
+		}),
+		Entry("with basic auth credentials and an access token", &authorizationHeaderWarningsTableInput{
+			headers: []options.Header{
+				{Name: "Authorization", Values: []options.HeaderValue{basicAuthValue, accessTokenValue}},
+			},
+			warnings: []string{joinedAuthorizationMsg},
+		}),
+		Entry("with basic auth credentials and an access token in another case", &authorizationHeaderWarningsTableInput{
+			headers: []options.Header{
+				{Name: "Authorization", Values: []options.HeaderValue{basicAuthValue}},
+				{Name: "authorization", Values: []options.HeaderValue{accessTokenValue}},
+			},
+			warnings: []string{joinedAuthorizationMsg},
+		}),
+		Entry("with several token values", &authorizationHeaderWarningsTableInput{
+			headers: []options.Header{
+				{Name: "Authorization", Values: []options.HeaderValue{accessTokenValue, accessTokenValue}},
+			},
+			warnings: []string{},
+		}),
+	)
+
+	type validateUpstreamTokenRequirementsTableInput struct {
+		skipJwtBearerTokens bool
+		audiences           []string
+		scopes              []string
+		requireBearerToken  bool
+		errStrings          []string
+	}
+
+	DescribeTable("validateUpstreamTokenRequirements",
+		func(in *validateUpstreamTokenRequirementsTableInput) {
+			o := &options.Options{
+				SkipJwtBearerTokens: in.skipJwtBearerTokens,
+				UpstreamServers: options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						validHTTPUpstream,
+						{
+							ID:                     "foo",
+							Path:                   "/foo",
+							URI:                    "http://localhost:8080",
+							RequiredTokenAudiences: in.audiences,
+							RequiredTokenScopes:    in.scopes,
+							RequireBearerToken:     in.requireBearerToken,
+						},
+					},
+				},
+			}
+			Expect(validateUpstreamTokenRequirements(o)).To(ConsistOf(in.errStrings))
+		},
+		Entry("with no requirements", &validateUpstreamTokenRequirementsTableInput{
+			errStrings: []string{},
+		}),
+		Entry("with requirements", &validateUpstreamTokenRequirementsTableInput{
+			skipJwtBearerTokens: true,
+			audiences:           []string{"foo"},
+			scopes:              []string{"foo:read"},
+			requireBearerToken:  true,
+			errStrings:          []string{},
+		}),
+		Entry("with empty values", &validateUpstreamTokenRequirementsTableInput{
+			skipJwtBearerTokens: true,
+			audiences:           []string{""},
+			scopes:              []string{""},
+			errStrings: []string{
+				"upstream \"foo\" has an empty requiredTokenAudiences value",
+				"upstream \"foo\" has an empty requiredTokenScopes value",
+			},
+		}),
+		Entry("without skip_jwt_bearer_tokens", &validateUpstreamTokenRequirementsTableInput{
+			requireBearerToken: true,
+			errStrings: []string{
+				"upstream \"foo\" has bearer token requirements, but skip_jwt_bearer_tokens is not set: bearer tokens are not accepted",
+			},
+		}),
+	)
+
+	type validateUpstreamCacheRedisTableInput struct {
+		store      string
+		redis      options.RedisStoreOptions
+		errStrings []string
+	}
+
+	DescribeTable("validateUpstreamCacheRedis",
+		func(in *validateUpstreamCacheRedisTableInput) {
+			o := &options.Options{
+				Session: options.SessionOptions{Redis: in.redis},
+				UpstreamServers: options.UpstreamConfig{
+					Upstreams: []options.Upstream{
+						validHTTPUpstream,
+						{
+							ID:    "foo",
+							Path:  "/foo",
+							URI:   "http://localhost:8080",
+							Cache: &options.UpstreamCache{Store: in.store},
+						},
+					},
+				},
+			}
+			Expect(validateUpstreamCacheRedis(o)).To(ConsistOf(in.errStrings))
+		},
+		Entry("with a memory store", &validateUpstreamCacheRedisTableInput{
+			errStrings: []string{},
+		}),
+		Entry("with a redis store", &validateUpstreamCacheRedisTableInput{
+			store:      options.UpstreamCacheStoreRedis,
+			redis:      options.RedisStoreOptions{ConnectionURL: "redis://localhost:6379"},
+			errStrings: []string{},
+		}),
+		Entry("with a redis cluster store", &validateUpstreamCacheRedisTableInput{
+			store:      options.UpstreamCacheStoreRedis,
+			redis:      options.RedisStoreOptions{UseCluster: true, ClusterConnectionURLs: []string{"redis://localhost:6379"}},
+			errStrings: []string{},
+		}),
+		Entry("with a redis store without a connection url", &validateUpstreamCacheRedisTableInput{
+			store: options.UpstreamCacheStoreRedis,
+			errStrings: []string{
+				"upstream \"foo\" has a redis cache store, but no redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls is set",
+			},
+		}),
+	)
+
+	Context("ValidateUpstreamConfig", func() {
+		var opts *options.Options
+
+		BeforeEach(func() {
+			opts = options.NewOptions()
+			opts.UpstreamServers = options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{ID: "app", Path: "/", URI: "http://app.internal:8080"},
+				},
+			}
+		})
+
+		It("accepts valid upstreams, without changing the options", func() {
+			err := ValidateUpstreamConfig(opts, options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{ID: "app", Path: "/", URI: "http://app.internal:8080"},
+					{ID: "api", Path: "/api/", URI: "http://api.internal:8080"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts.UpstreamServers.Upstreams).To(HaveLen(1))
+		})
+
+		It("checks the upstreams against each other and the rest of the options", func() {
+			err := ValidateUpstreamConfig(opts, options.UpstreamConfig{
+				Upstreams: []options.Upstream{
+					{ID: "app", Path: "/", URI: "http://app.internal:8080"},
+					{
+						ID:    "app",
+						Path:  "/api/",
+						URI:   "http://api.internal:8080",
+						Cache: &options.UpstreamCache{Store: options.UpstreamCacheStoreRedis},
+					},
+				},
+			})
+			Expect(err).To(MatchError("invalid upstream configuration:\n" +
+				"  multiple upstreams found with id \"app\": upstream ids must be unique\n" +
+				"  upstream \"app\" has a redis cache store, but no redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls is set"))
+		})
+	})
 })
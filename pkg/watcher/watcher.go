@@ -79,3 +79,38 @@ func WaitForReplacement(filename string, op fsnotify.Op, watcher *fsnotify.Watch
 		time.Sleep(sleepInterval)
 	}
 }
+
+// WatchDirForUpdates performs an action every time a file with the extension
+// is created, updated, renamed or removed in a directory on disk
+func WatchDirForUpdates(dir, ext string, done <-chan bool, action func()) error {
+	dir = filepath.Clean(dir)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher for '%s': %s", dir, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-done:
+				logger.Printf("shutting down watcher for: %s", dir)
+				return
+			case event := <-watcher.Events:
+				if filepath.Ext(event.Name) == ext && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) != 0 {
+					logger.Printf("reloading after event: %s", event)
+					action()
+				}
+			case err = <-watcher.Errors:
+				logger.Errorf("error watching '%s': %s", dir, err)
+			}
+		}
+	}()
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to add '%s' to watcher: %v", dir, err)
+	}
+	logger.Printf("watching '%s' for updates", dir)
+
+	return nil
+}
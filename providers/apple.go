@@ -0,0 +1,151 @@
+package providers
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+)
+
+const (
+	appleProviderName = "Apple"
+	appleDefaultScope = "openid email name"
+
+	// appleAudience is the audience Apple expects in client secret JWTs
+	appleAudience = "https://appleid.apple.com"
+
+	// appleClientSecretLifetime is how long a generated client secret is valid
+	// for. Apple allows up to 6 months, but short lived secrets limit the
+	// impact of one leaking.
+	appleClientSecretLifetime = time.Hour
+
+	// appleClientSecretRenewal is how long before expiry a new client secret
+	// is generated, so that requests in flight don't use an expired secret.
+	appleClientSecretRenewal = 5 * time.Minute
+)
+
+var (
+	// Default Login URL for Apple.
+	// Pre-parsed URL of https://appleid.apple.com/auth/authorize.
+	appleDefaultLoginURL = &url.URL{
+		Scheme: "https",
+		Host:   "appleid.apple.com",
+		Path:   "/auth/authorize",
+	}
+
+	// Default Redeem URL for Apple.
+	// Pre-parsed URL of https://appleid.apple.com/auth/token.
+	appleDefaultRedeemURL = &url.URL{
+		Scheme: "https",
+		Host:   "appleid.apple.com",
+		Path:   "/auth/token",
+	}
+)
+
+// AppleProvider represents a Sign in with Apple based Identity Provider
+type AppleProvider struct {
+	*OIDCProvider
+}
+
+var _ Provider = (*AppleProvider)(nil)
+
+// NewAppleProvider initiates a new AppleProvider
+func NewAppleProvider(p *ProviderData, opts options.AppleOptions) (*AppleProvider, error) {
+	p.setProviderDefaults(providerDefaults{
+		name:      appleProviderName,
+		loginURL:  appleDefaultLoginURL,
+		redeemURL: appleDefaultRedeemURL,
+		scope:     appleDefaultScope,
+	})
+	p.getAuthorizationHeaderFunc = makeOIDCHeader
+
+	key, err := loadAppleKey(opts.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure apple provider: %v", err)
+	}
+	secret := &appleClientSecret{
+		teamID:   opts.TeamID,
+		keyID:    opts.KeyID,
+		clientID: p.ClientID,
+		key:      key,
+	}
+	p.getClientSecretFunc = secret.get
+
+	return &AppleProvider{
+		OIDCProvider: &OIDCProvider{
+			ProviderData: p,
+			SkipNonce:    false,
+		},
+	}, nil
+}
+
+// GetLoginURL makes the LoginURL with the form_post response mode.
+// Apple requires this when the name or email scopes are requested, and only
+// sends the user's name in the form when they first authorize the app.
+func (p *AppleProvider) GetLoginURL(redirectURI, state, nonce string, extraParams url.Values) string {
+	extraParams.Set("response_mode", "form_post")
+	return p.OIDCProvider.GetLoginURL(redirectURI, state, nonce, extraParams)
+}
+
+// loadAppleKey reads the EC private key from a PEM encoded .p8 file
+func loadAppleKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", keyFile)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse EC private key from PEM file %s: %v", keyFile, err)
+	}
+	return key, nil
+}
+
+// appleClientSecret generates the ES256 signed JWTs that Apple requires as the
+// client secret. The JWT is reused until shortly before it expires.
+type appleClientSecret struct {
+	teamID   string
+	keyID    string
+	clientID string
+	key      *ecdsa.PrivateKey
+
+	mutex   sync.Mutex
+	secret  string
+	expires time.Time
+	clock   clock.Clock
+}
+
+// get returns the current client secret, generating a new one if it is about
+// to expire
+func (s *appleClientSecret) get() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	if s.secret != "" && now.Before(s.expires.Add(-appleClientSecretRenewal)) {
+		return s.secret, nil
+	}
+
+	expires := now.Add(appleClientSecretLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+		Issuer:    s.teamID,
+		Subject:   s.clientID,
+		Audience:  appleAudience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	token.Header["kid"] = s.keyID
+
+	secret, err := token.SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("could not sign client secret: %v", err)
+	}
+	s.secret = secret
+	s.expires = expires
+	return secret, nil
+}
@@ -0,0 +1,258 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	appleClientID = "com.example.app.signin"
+	appleTeamID   = "A1B2C3D4E5"
+	appleKeyID    = "ZYX9W8V7U6"
+
+	// appleIDTokenPayload is the payload of an ID token for a user who chose
+	// to hide their email. Apple sends the boolean claims as strings.
+	appleIDTokenPayload = `{
+  "iss": "https://appleid.apple.com",
+  "aud": "com.example.app.signin",
+  "exp": 1650003600,
+  "iat": 1650000000,
+  "sub": "001234.5f1c2e8a9b7d4c3ea1f02d5b8e7c9a41.1234",
+  "nonce": "a1b2c3d4",
+  "c_hash": "q4HcSVuKmQ3w1R2yFbtj0A",
+  "email": "x7k2m9p4q1@privaterelay.appleid.com",
+  "email_verified": "true",
+  "is_private_email": "true",
+  "auth_time": 1650000000,
+  "nonce_supported": true
+}`
+)
+
+// writeAppleKey writes a new EC private key to a .p8 file in PKCS #8 form, as
+// downloaded from the Apple developer portal
+func writeAppleKey(t *testing.T) (string, *ecdsa.PrivateKey) {
+	g := NewWithT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	keyFile := filepath.Join(t.TempDir(), "AuthKey_"+appleKeyID+".p8")
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	g.Expect(ioutil.WriteFile(keyFile, keyData, 0600)).To(Succeed())
+	return keyFile, key
+}
+
+// appleKeySet verifies ES256 signed ID tokens like those issued by Apple
+type appleKeySet struct {
+	key *ecdsa.PublicKey
+}
+
+func (k appleKeySet) VerifySignature(_ context.Context, rawJWT string) ([]byte, error) {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.Parse(rawJWT, func(token *jwt.Token) (interface{}, error) {
+		return k.key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.Split(rawJWT, ".")[1])
+}
+
+func newAppleProvider(t *testing.T, serverURL *url.URL, idTokenKey *ecdsa.PublicKey) *AppleProvider {
+	g := NewWithT(t)
+
+	keyFile, _ := writeAppleKey(t)
+	verificationOptions := internaloidc.IDTokenVerificationOptions{
+		AudienceClaims: []string{"aud"},
+		ClientID:       appleClientID,
+	}
+	providerData := &ProviderData{
+		ClientID: appleClientID,
+		RedeemURL: &url.URL{
+			Scheme: serverURL.Scheme,
+			Host:   serverURL.Host,
+			Path:   "/auth/token"},
+		ProfileURL:  &url.URL{},
+		EmailClaim:  "email",
+		GroupsClaim: options.OIDCGroupsClaim,
+		UserClaim:   "sub",
+		Verifier: internaloidc.NewVerifier(oidc.NewVerifier(
+			appleAudience,
+			appleKeySet{key: idTokenKey},
+			&oidc.Config{
+				ClientID:             appleClientID,
+				SupportedSigningAlgs: []string{"ES256"},
+				// The recorded token has long since expired
+				SkipExpiryCheck: true,
+			},
+		), verificationOptions),
+	}
+
+	provider, err := NewAppleProvider(providerData, options.AppleOptions{
+		TeamID:         appleTeamID,
+		KeyID:          appleKeyID,
+		PrivateKeyFile: keyFile,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	return provider
+}
+
+func TestNewAppleProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newAppleProvider(t, &url.URL{}, &key.PublicKey)
+
+	g.Expect(provider.Data().ProviderName).To(Equal("Apple"))
+	g.Expect(provider.Data().LoginURL.String()).To(Equal("https://appleid.apple.com/auth/authorize"))
+	g.Expect(provider.Data().Scope).To(Equal("openid email name"))
+	g.Expect(provider.SkipNonce).To(BeFalse())
+
+	_, err = NewAppleProvider(&ProviderData{}, options.AppleOptions{
+		PrivateKeyFile: filepath.Join(t.TempDir(), "missing.p8"),
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(HavePrefix("could not configure apple provider: could not read key file"))
+}
+
+func TestAppleProviderGetLoginURL(t *testing.T) {
+	g := NewWithT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newAppleProvider(t, &url.URL{}, &key.PublicKey)
+
+	loginURL, err := url.Parse(provider.GetLoginURL("https://app.example.com/oauth2/callback", "state1234", "nonce1234", url.Values{}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(loginURL.Query().Get("response_mode")).To(Equal("form_post"))
+	g.Expect(loginURL.Query().Get("nonce")).To(Equal("nonce1234"))
+	g.Expect(loginURL.Query().Get("scope")).To(Equal("openid email name"))
+}
+
+func TestAppleClientSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	keyFile, key := writeAppleKey(t)
+	loadedKey, err := loadAppleKey(keyFile)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(loadedKey.Equal(key)).To(BeTrue())
+
+	secret := &appleClientSecret{
+		teamID:   appleTeamID,
+		keyID:    appleKeyID,
+		clientID: appleClientID,
+		key:      loadedKey,
+	}
+	secret.clock.Set(time.Unix(1650000000, 0))
+
+	first, err := secret.get()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The fixed clock puts the expiry in the past, so only check the signature
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	claims := &jwt.StandardClaims{}
+	token, err := parser.ParseWithClaims(first, claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token.Method).To(Equal(jwt.SigningMethodES256))
+	g.Expect(token.Header["kid"]).To(Equal(appleKeyID))
+	g.Expect(claims.Issuer).To(Equal(appleTeamID))
+	g.Expect(claims.Subject).To(Equal(appleClientID))
+	g.Expect(claims.Audience).To(Equal("https://appleid.apple.com"))
+	g.Expect(claims.IssuedAt).To(Equal(int64(1650000000)))
+	g.Expect(claims.ExpiresAt).To(Equal(int64(1650003600)))
+
+	// The secret is reused until shortly before it expires
+	secret.clock.Add(54 * time.Minute)
+	second, err := secret.get()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(second).To(Equal(first))
+
+	secret.clock.Add(2 * time.Minute)
+	third, err := secret.get()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(third).ToNot(Equal(first))
+
+	claims = &jwt.StandardClaims{}
+	_, err = parser.ParseWithClaims(third, claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(claims.IssuedAt).To(Equal(int64(1650003360)))
+}
+
+func TestAppleProviderRedeem(t *testing.T) {
+	g := NewWithT(t)
+
+	idTokenKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	claims := jwt.MapClaims{}
+	g.Expect(json.Unmarshal([]byte(appleIDTokenPayload), &claims)).To(Succeed())
+	idToken, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(idTokenKey)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	body, err := json.Marshal(redeemTokenResponse{
+		AccessToken:  accessToken,
+		ExpiresIn:    3600,
+		TokenType:    "Bearer",
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var clientSecret string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, clientSecret, _ = req.BasicAuth()
+		rw.Header().Add("content-type", "application/json")
+		_, _ = rw.Write(body)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newAppleProvider(t, serverURL, &idTokenKey.PublicKey)
+
+	session, err := provider.Redeem(context.Background(), "https://app.example.com/oauth2/callback", "code1234", "")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(session.User).To(Equal("001234.5f1c2e8a9b7d4c3ea1f02d5b8e7c9a41.1234"))
+	g.Expect(session.Email).To(Equal("x7k2m9p4q1@privaterelay.appleid.com"))
+	g.Expect(session.IDToken).To(Equal(idToken))
+	g.Expect(session.RefreshToken).To(Equal(refreshToken))
+
+	// The generated JWT is sent as the client secret
+	expectedSecret, err := provider.GetClientSecret()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(clientSecret).To(Equal(expectedSecret))
+}
+
+func TestLoadAppleKeyNotEC(t *testing.T) {
+	g := NewWithT(t)
+
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+	g.Expect(ioutil.WriteFile(keyFile, []byte("not a key"), 0600)).To(Succeed())
+	_, err := loadAppleKey(keyFile)
+	g.Expect(err).To(HaveOccurred())
+}
@@ -154,7 +154,7 @@ func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code, codeVerif
 	if err == nil && email != "" {
 		session.Email = email
 	} else {
-		logger.Printf("unable to get email claim from id_token: %v", err)
+		logger.PrintfContext(ctx, "unable to get email claim from id_token: %v", err)
 	}
 
 	if session.Email == "" {
@@ -162,7 +162,7 @@ func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code, codeVerif
 		if err == nil && email != "" {
 			session.Email = email
 		} else {
-			logger.Printf("unable to get email claim from access token: %v", err)
+			logger.PrintfContext(ctx, "unable to get email claim from access token: %v", err)
 		}
 	}
 
@@ -220,14 +220,14 @@ func (p *AzureProvider) verifyTokenAndExtractEmail(ctx context.Context, rawIDTok
 		_, err := p.Verifier.Verify(ctx, rawIDToken)
 		// due to issues mentioned above, id_token may not be signed by AAD
 		if err == nil {
-			s, err := p.buildSessionFromClaims(rawIDToken, accessToken)
+			s, err := p.buildSessionFromClaims(ctx, rawIDToken, accessToken)
 			if err == nil {
 				email = s.Email
 			} else {
-				logger.Printf("unable to get claims from token: %v", err)
+				logger.PrintfContext(ctx, "unable to get claims from token: %v", err)
 			}
 		} else {
-			logger.Printf("unable to verify token: %v", err)
+			logger.PrintfContext(ctx, "unable to verify token: %v", err)
 		}
 	}
 
@@ -294,7 +294,7 @@ func (p *AzureProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sess
 	if err == nil && email != "" {
 		s.Email = email
 	} else {
-		logger.Printf("unable to get email claim from id_token: %v", err)
+		logger.PrintfContext(ctx, "unable to get email claim from id_token: %v", err)
 	}
 
 	if s.Email == "" {
@@ -302,7 +302,7 @@ func (p *AzureProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sess
 		if err == nil && email != "" {
 			s.Email = email
 		} else {
-			logger.Printf("unable to get email claim from access token: %v", err)
+			logger.PrintfContext(ctx, "unable to get email claim from access token: %v", err)
 		}
 	}
 
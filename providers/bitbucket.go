@@ -117,7 +117,7 @@ func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *sessions.Ses
 		Do().
 		UnmarshalInto(&emails)
 	if err != nil {
-		logger.Errorf("failed making request: %v", err)
+		logger.ErrorfContext(ctx, "failed making request: %v", err)
 		return "", err
 	}
 
@@ -133,7 +133,7 @@ func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *sessions.Ses
 			Do().
 			UnmarshalInto(&teams)
 		if err != nil {
-			logger.Errorf("failed requesting teams membership: %v", err)
+			logger.ErrorfContext(ctx, "failed requesting teams membership: %v", err)
 			return "", err
 		}
 		var found = false
@@ -144,7 +144,7 @@ func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *sessions.Ses
 			}
 		}
 		if !found {
-			logger.Error("team membership test failed, access denied")
+			logger.ErrorfContext(ctx, "team membership test failed, access denied")
 			return "", nil
 		}
 	}
@@ -163,7 +163,7 @@ func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *sessions.Ses
 			Do().
 			UnmarshalInto(&repositories)
 		if err != nil {
-			logger.Errorf("failed checking repository access: %v", err)
+			logger.ErrorfContext(ctx, "failed checking repository access: %v", err)
 			return "", err
 		}
 
@@ -175,7 +175,7 @@ func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *sessions.Ses
 			}
 		}
 		if !found {
-			logger.Error("repository access test failed, access denied")
+			logger.ErrorfContext(ctx, "repository access test failed, access denied")
 			return "", nil
 		}
 	}
@@ -0,0 +1,137 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+const (
+	cognitoProviderName = "AWS Cognito"
+
+	// cognitoGroupsClaim is the claim Cognito lists the user pool groups of the
+	// user in
+	cognitoGroupsClaim = "cognito:groups"
+
+	// cognitoTokenUseClaim identifies whether a Cognito token is an ID token
+	// or an access token
+	cognitoTokenUseClaim = "token_use"
+	cognitoIDTokenUse    = "id"
+)
+
+// CognitoProvider represents an AWS Cognito user pool based Identity Provider
+type CognitoProvider struct {
+	*OIDCProvider
+
+	logoutURI string
+}
+
+var _ Provider = (*CognitoProvider)(nil)
+
+// NewCognitoProvider initiates a new CognitoProvider
+func NewCognitoProvider(p *ProviderData, opts options.CognitoOptions) *CognitoProvider {
+	p.ProviderName = cognitoProviderName
+	p.getAuthorizationHeaderFunc = makeOIDCHeader
+
+	// Cognito doesn't have a `groups` claim, so use its own unless a
+	// different claim has been configured
+	if p.GroupsClaim == "" || p.GroupsClaim == options.OIDCGroupsClaim {
+		p.GroupsClaim = cognitoGroupsClaim
+	}
+
+	return &CognitoProvider{
+		OIDCProvider: &OIDCProvider{
+			ProviderData: p,
+			SkipNonce:    false,
+		},
+		logoutURI: opts.LogoutURI,
+	}
+}
+
+// GetLogoutURL returns the hosted UI logout endpoint so that signing out also
+// ends the user's Cognito session.
+// Cognito doesn't support RP-initiated logout, instead this endpoint takes the
+// client_id and the logout_uri to return to, which must be one of the sign out
+// URLs of the app client. The configured logout URI is used if set, otherwise
+// the finalRedirect is used if it is an absolute URL.
+func (p *CognitoProvider) GetLogoutURL(_ *sessions.SessionState, finalRedirect string) string {
+	logoutURI := p.logoutURI
+	if logoutURI == "" {
+		if u, err := url.Parse(finalRedirect); err == nil && u.IsAbs() {
+			logoutURI = finalRedirect
+		}
+	}
+	if logoutURI == "" || p.LoginURL == nil || p.LoginURL.Host == "" {
+		return ""
+	}
+
+	params := url.Values{}
+	params.Set("client_id", p.ClientID)
+	params.Set("logout_uri", logoutURI)
+
+	logoutURL := &url.URL{
+		Scheme:   p.LoginURL.Scheme,
+		Host:     p.LoginURL.Host,
+		Path:     "/logout",
+		RawQuery: params.Encode(),
+	}
+	return logoutURL.String()
+}
+
+// Redeem exchanges the OAuth2 authentication token for an ID token
+func (p *CognitoProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier string) (*sessions.SessionState, error) {
+	s, err := p.OIDCProvider.Redeem(ctx, redirectURL, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkTokenUse(ctx, s.IDToken); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RefreshSession uses the RefreshToken to fetch new Access and ID Tokens.
+// Cognito doesn't rotate refresh tokens, so the existing refresh token is kept
+// until it expires.
+func (p *CognitoProvider) RefreshSession(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	refreshed, err := p.OIDCProvider.RefreshSession(ctx, s)
+	if err != nil || !refreshed {
+		return refreshed, err
+	}
+	if err := p.checkTokenUse(ctx, s.IDToken); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateSessionFromToken converts Bearer IDTokens into sessions.
+// Cognito access tokens are rejected as they are not meant for the client.
+func (p *CognitoProvider) CreateSessionFromToken(ctx context.Context, token string) (*sessions.SessionState, error) {
+	if err := p.checkTokenUse(ctx, token); err != nil {
+		return nil, err
+	}
+	return p.OIDCProvider.CreateSessionFromToken(ctx, token)
+}
+
+// checkTokenUse ensures that an ID token was issued by Cognito as an ID token
+func (p *CognitoProvider) checkTokenUse(ctx context.Context, rawIDToken string) error {
+	if rawIDToken == "" {
+		return nil
+	}
+
+	extractor, err := p.getClaimExtractor(ctx, rawIDToken, "")
+	if err != nil {
+		return fmt.Errorf("id_token claims extraction failed: %v", err)
+	}
+	var tokenUse string
+	if _, err := extractor.GetClaimInto(cognitoTokenUseClaim, &tokenUse); err != nil {
+		return fmt.Errorf("could not extract token_use from ID Token: %v", err)
+	}
+	if tokenUse != cognitoIDTokenUse {
+		return fmt.Errorf("token has token_use %q, expected %q", tokenUse, cognitoIDTokenUse)
+	}
+	return nil
+}
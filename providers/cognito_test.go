@@ -0,0 +1,283 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	cognitoIssuer   = "https://cognito-idp.eu-west-1.amazonaws.com/eu-west-1_Ab12Cd34E"
+	cognitoClientID = "5r2s7t9v1x3z5b7d9f1h3j5l7n"
+
+	// cognitoIDTokenPayload is the payload of an ID token issued by a Cognito
+	// user pool for a user in two groups, one of them from a federated IdP
+	cognitoIDTokenPayload = `{
+  "at_hash": "q4HcSVuKmQ3w1R2yFbtj0A",
+  "sub": "6f1c2e8a-9b7d-4c3e-a1f0-2d5b8e7c9a41",
+  "cognito:groups": [
+    "admins",
+    "eu-west-1_Ab12Cd34E_Google"
+  ],
+  "email_verified": true,
+  "iss": "https://cognito-idp.eu-west-1.amazonaws.com/eu-west-1_Ab12Cd34E",
+  "cognito:username": "jane.doe",
+  "origin_jti": "0d6a5c1e-7b3f-4e2a-9c8d-1f4b6a2e3c5d",
+  "aud": "5r2s7t9v1x3z5b7d9f1h3j5l7n",
+  "event_id": "b7e4c2a9-3d1f-4a6b-8e5c-9f2d7a1b3c4e",
+  "token_use": "id",
+  "auth_time": 1650000000,
+  "exp": 1650003600,
+  "iat": 1650000000,
+  "jti": "e2f8a1c4-6b9d-4e3a-a7c5-3d1b9f6e2a8c",
+  "email": "jane.doe@example.com"
+}`
+
+	// cognitoAccessTokenPayload is the payload of the access token issued with
+	// the ID token above
+	cognitoAccessTokenPayload = `{
+  "sub": "6f1c2e8a-9b7d-4c3e-a1f0-2d5b8e7c9a41",
+  "cognito:groups": [
+    "admins",
+    "eu-west-1_Ab12Cd34E_Google"
+  ],
+  "iss": "https://cognito-idp.eu-west-1.amazonaws.com/eu-west-1_Ab12Cd34E",
+  "version": 2,
+  "client_id": "5r2s7t9v1x3z5b7d9f1h3j5l7n",
+  "origin_jti": "0d6a5c1e-7b3f-4e2a-9c8d-1f4b6a2e3c5d",
+  "event_id": "b7e4c2a9-3d1f-4a6b-8e5c-9f2d7a1b3c4e",
+  "token_use": "access",
+  "scope": "openid profile email",
+  "auth_time": 1650000000,
+  "exp": 1650003600,
+  "iat": 1650000000,
+  "jti": "4a9c2e7f-1b5d-4f8a-b3e6-7c2a9d4f1e5b",
+  "username": "jane.doe"
+}`
+)
+
+func newSignedCognitoToken(t *testing.T, payload string) string {
+	g := NewWithT(t)
+
+	claims := jwt.MapClaims{}
+	g.Expect(json.Unmarshal([]byte(payload), &claims)).To(Succeed())
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).ToNot(HaveOccurred())
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	g.Expect(err).ToNot(HaveOccurred())
+	return token
+}
+
+func newCognitoProvider(serverURL *url.URL, opts options.CognitoOptions) *CognitoProvider {
+	verificationOptions := internaloidc.IDTokenVerificationOptions{
+		AudienceClaims: []string{"aud"},
+		ClientID:       cognitoClientID,
+	}
+	providerData := &ProviderData{
+		ClientID:     cognitoClientID,
+		ClientSecret: oidcSecret,
+		LoginURL: &url.URL{
+			Scheme: "https",
+			Host:   "example.auth.eu-west-1.amazoncognito.com",
+			Path:   "/oauth2/authorize"},
+		RedeemURL: &url.URL{
+			Scheme: serverURL.Scheme,
+			Host:   serverURL.Host,
+			Path:   "/oauth2/token"},
+		ProfileURL:  &url.URL{},
+		Scope:       "openid email profile",
+		EmailClaim:  "email",
+		GroupsClaim: options.OIDCGroupsClaim,
+		UserClaim:   "sub",
+		Verifier: internaloidc.NewVerifier(oidc.NewVerifier(
+			cognitoIssuer,
+			mockJWKS{},
+			&oidc.Config{
+				ClientID: cognitoClientID,
+				// The recorded tokens have long since expired
+				SkipExpiryCheck: true,
+			},
+		), verificationOptions),
+	}
+
+	return NewCognitoProvider(providerData, opts)
+}
+
+func TestNewCognitoProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	provider := newCognitoProvider(&url.URL{}, options.CognitoOptions{})
+	g.Expect(provider.Data().ProviderName).To(Equal("AWS Cognito"))
+	g.Expect(provider.Data().GroupsClaim).To(Equal("cognito:groups"))
+	g.Expect(provider.SkipNonce).To(BeFalse())
+
+	customClaim := &ProviderData{GroupsClaim: "custom:roles"}
+	NewCognitoProvider(customClaim, options.CognitoOptions{})
+	g.Expect(customClaim.GroupsClaim).To(Equal("custom:roles"))
+}
+
+func TestCognitoProviderGetLogoutURL(t *testing.T) {
+	testCases := map[string]struct {
+		logoutURI         string
+		finalRedirect     string
+		expectedLogoutURL string
+	}{
+		"With a configured logout URI": {
+			logoutURI:         "https://app.example.com/signed-out",
+			finalRedirect:     "https://app.example.com/",
+			expectedLogoutURL: "https://example.auth.eu-west-1.amazoncognito.com/logout?client_id=5r2s7t9v1x3z5b7d9f1h3j5l7n&logout_uri=https%3A%2F%2Fapp.example.com%2Fsigned-out",
+		},
+		"Without a logout URI and an absolute redirect": {
+			finalRedirect:     "https://app.example.com/",
+			expectedLogoutURL: "https://example.auth.eu-west-1.amazoncognito.com/logout?client_id=5r2s7t9v1x3z5b7d9f1h3j5l7n&logout_uri=https%3A%2F%2Fapp.example.com%2F",
+		},
+		"Without a logout URI and a relative redirect": {
+			finalRedirect:     "/",
+			expectedLogoutURL: "",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+
+			provider := newCognitoProvider(&url.URL{}, options.CognitoOptions{LogoutURI: tc.logoutURI})
+			g.Expect(provider.GetLogoutURL(nil, tc.finalRedirect)).To(Equal(tc.expectedLogoutURL))
+		})
+	}
+}
+
+func TestCognitoProviderRedeem(t *testing.T) {
+	testCases := map[string]struct {
+		idTokenPayload  string
+		expectedError   string
+		expectedSession *sessions.SessionState
+	}{
+		"With an ID token": {
+			idTokenPayload: cognitoIDTokenPayload,
+			expectedSession: &sessions.SessionState{
+				User:   "6f1c2e8a-9b7d-4c3e-a1f0-2d5b8e7c9a41",
+				Email:  "jane.doe@example.com",
+				Groups: []string{"admins", "eu-west-1_Ab12Cd34E_Google"},
+			},
+		},
+		"With an access token in place of the ID token": {
+			idTokenPayload: `{"iss": "` + cognitoIssuer + `", "aud": "` + cognitoClientID + `", "sub": "6f1c2e8a-9b7d-4c3e-a1f0-2d5b8e7c9a41", "token_use": "access"}`,
+			expectedError:  `token has token_use "access", expected "id"`,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+
+			idToken := newSignedCognitoToken(t, tc.idTokenPayload)
+			accessToken := newSignedCognitoToken(t, cognitoAccessTokenPayload)
+			body, err := json.Marshal(redeemTokenResponse{
+				AccessToken:  accessToken,
+				ExpiresIn:    3600,
+				TokenType:    "Bearer",
+				RefreshToken: refreshToken,
+				IDToken:      idToken,
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+
+			serverURL, server := newOIDCServer(body)
+			defer server.Close()
+			provider := newCognitoProvider(serverURL, options.CognitoOptions{})
+
+			session, err := provider.Redeem(context.Background(), "https://app.example.com/oauth2/callback", "code1234", "")
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(session.User).To(Equal(tc.expectedSession.User))
+			g.Expect(session.Email).To(Equal(tc.expectedSession.Email))
+			g.Expect(session.Groups).To(Equal(tc.expectedSession.Groups))
+			g.Expect(session.IDToken).To(Equal(idToken))
+			g.Expect(session.AccessToken).To(Equal(accessToken))
+			g.Expect(session.RefreshToken).To(Equal(refreshToken))
+		})
+	}
+}
+
+func TestCognitoProviderRefreshSession(t *testing.T) {
+	g := NewWithT(t)
+
+	// Cognito doesn't return a new refresh token when refreshing
+	idToken := newSignedCognitoToken(t, cognitoIDTokenPayload)
+	accessToken := newSignedCognitoToken(t, cognitoAccessTokenPayload)
+	body, err := json.Marshal(redeemTokenResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   3600,
+		TokenType:   "Bearer",
+		IDToken:     idToken,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	serverURL, server := newOIDCServer(body)
+	defer server.Close()
+	provider := newCognitoProvider(serverURL, options.CognitoOptions{})
+
+	existingSession := &sessions.SessionState{
+		AccessToken:  "changeit",
+		IDToken:      "changeit",
+		RefreshToken: refreshToken,
+		Email:        "changeit",
+		User:         "changeit",
+	}
+	refreshed, err := provider.RefreshSession(context.Background(), existingSession)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(refreshed).To(BeTrue())
+	g.Expect(existingSession.AccessToken).To(Equal(accessToken))
+	g.Expect(existingSession.IDToken).To(Equal(idToken))
+	g.Expect(existingSession.RefreshToken).To(Equal(refreshToken))
+	g.Expect(existingSession.Email).To(Equal("jane.doe@example.com"))
+	g.Expect(existingSession.Groups).To(Equal([]string{"admins", "eu-west-1_Ab12Cd34E_Google"}))
+}
+
+func TestCognitoProviderCreateSessionFromToken(t *testing.T) {
+	testCases := map[string]struct {
+		payload       string
+		expectedError string
+	}{
+		"With an ID token": {
+			payload: cognitoIDTokenPayload,
+		},
+		"With an access token": {
+			payload:       cognitoAccessTokenPayload,
+			expectedError: `token has token_use "access", expected "id"`,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+
+			provider := newCognitoProvider(&url.URL{}, options.CognitoOptions{})
+			token := newSignedCognitoToken(t, tc.payload)
+
+			session, err := provider.CreateSessionFromToken(context.Background(), token)
+			if tc.expectedError != "" {
+				g.Expect(err).To(MatchError(tc.expectedError))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(session.Email).To(Equal("jane.doe@example.com"))
+			g.Expect(session.Groups).To(Equal([]string{"admins", "eu-west-1_Ab12Cd34E_Google"}))
+			g.Expect(session.IDToken).To(Equal(token))
+		})
+	}
+}
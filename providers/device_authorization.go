@@ -0,0 +1,164 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
+	"golang.org/x/oauth2"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceAuthorization is a device authorization (RFC 8628) started with the
+// provider, whose user code the user verifies at the verification URI while
+// the device polls for its tokens with the device code
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// DeviceTokenError is the OAuth2 error the token endpoint of the provider
+// answered a device code with, such as authorization_pending while the user
+// hasn't verified the user code yet
+type DeviceTokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *DeviceTokenError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// StartDeviceAuthorization starts a device authorization at the device
+// authorization endpoint of the provider, for the scope of the provider
+func (p *ProviderData) StartDeviceAuthorization(ctx context.Context) (*DeviceAuthorization, error) {
+	if p.DeviceAuthorizationURL == nil || p.DeviceAuthorizationURL.String() == "" {
+		return nil, ErrNotImplemented
+	}
+	clientSecret, err := p.GetClientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", clientSecret)
+	if p.Scope != "" {
+		params.Add("scope", p.Scope)
+	}
+
+	result := requests.New(p.DeviceAuthorizationURL.String()).
+		WithContext(ctx).
+		WithMethod("POST").
+		WithBody(bytes.NewBufferString(params.Encode())).
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		Do()
+	if result.Error() != nil {
+		return nil, result.Error()
+	}
+	if result.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %q: %s", result.StatusCode(), p.DeviceAuthorizationURL, result.Body())
+	}
+
+	var authorization DeviceAuthorization
+	if err := result.UnmarshalInto(&authorization); err != nil {
+		return nil, fmt.Errorf("error parsing the device authorization response: %v", err)
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" || authorization.VerificationURI == "" {
+		return nil, errors.New("the device authorization response has no device code, user code or verification URI")
+	}
+	return &authorization, nil
+}
+
+// RedeemDeviceCode redeems the device code of a device authorization for a
+// session, once the user has verified its user code.
+// Until then, it fails with the *DeviceTokenError of the provider.
+func (p *ProviderData) RedeemDeviceCode(ctx context.Context, deviceCode string) (*sessions.SessionState, error) {
+	token, err := p.redeemDeviceCode(ctx, deviceCode)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sessions.SessionState{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+	}
+	s.CreatedAtNow()
+	s.SetExpiresOn(token.Expiry)
+	return s, nil
+}
+
+// redeemDeviceCode polls the token endpoint of the provider for the tokens of
+// the device code, with the ID token in the extra fields of the token
+func (p *ProviderData) redeemDeviceCode(ctx context.Context, deviceCode string) (*oauth2.Token, error) {
+	if deviceCode == "" {
+		return nil, ErrMissingCode
+	}
+	clientSecret, err := p.GetClientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", deviceCodeGrantType)
+	params.Add("device_code", deviceCode)
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", clientSecret)
+
+	result := requests.New(p.RedeemURL.String()).
+		WithContext(ctx).
+		WithMethod("POST").
+		WithBody(bytes.NewBufferString(params.Encode())).
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		SetHeader("Accept", "application/json").
+		Do()
+	if result.Error() != nil {
+		return nil, result.Error()
+	}
+	if result.StatusCode() != http.StatusOK {
+		tokenErr := &DeviceTokenError{}
+		if err := json.Unmarshal(result.Body(), tokenErr); err == nil && tokenErr.Code != "" {
+			return nil, tokenErr
+		}
+		return nil, fmt.Errorf("got %d from %q: %s", result.StatusCode(), p.RedeemURL, result.Body())
+	}
+
+	var response struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := result.UnmarshalInto(&response); err != nil {
+		return nil, fmt.Errorf("error parsing the device code token response: %v", err)
+	}
+	if response.AccessToken == "" {
+		return nil, errors.New("no access token found in the device code token response")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  response.AccessToken,
+		TokenType:    response.TokenType,
+		RefreshToken: response.RefreshToken,
+	}
+	if response.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(map[string]interface{}{"id_token": response.IDToken}), nil
+}
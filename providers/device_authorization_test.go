@@ -0,0 +1,83 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeIdPDeviceSetup starts a fake identity provider, and an OIDCProvider
+// starting device authorizations at its device authorization endpoint
+func newFakeIdPDeviceSetup(t *testing.T) (*fakeidp.Server, *OIDCProvider) {
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{})
+	provider.DeviceAuthorizationURL, _ = url.Parse(server.DeviceAuthorizationEndpoint())
+	return server, provider
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	t.Run("redeems the device code once the user code is verified", func(t *testing.T) {
+		server, provider := newFakeIdPDeviceSetup(t)
+
+		authorization, err := provider.StartDeviceAuthorization(context.Background())
+		require.NoError(t, err)
+		assert.NotEmpty(t, authorization.DeviceCode)
+		assert.Regexp(t, `^[A-Z]{4}-[A-Z]{4}$`, authorization.UserCode)
+		assert.Equal(t, server.Issuer()+fakeidp.DeviceVerificationPath, authorization.VerificationURI)
+		assert.Equal(t, int64(5), authorization.Interval)
+
+		_, err = provider.RedeemDeviceCode(context.Background(), authorization.DeviceCode)
+		var tokenErr *DeviceTokenError
+		require.True(t, errors.As(err, &tokenErr))
+		assert.Equal(t, "authorization_pending", tokenErr.Code)
+
+		require.NoError(t, server.VerifyDevice(authorization.UserCode))
+		session, err := provider.RedeemDeviceCode(context.Background(), authorization.DeviceCode)
+		require.NoError(t, err)
+		assert.Equal(t, defaultIDToken.Email, session.Email)
+		assert.NotEmpty(t, session.AccessToken)
+		assert.NotEmpty(t, session.IDToken)
+		assert.NotNil(t, session.ExpiresOn)
+	})
+
+	t.Run("redeems the device code for the tokens without an ID token", func(t *testing.T) {
+		server, provider := newFakeIdPDeviceSetup(t)
+
+		authorization, err := provider.StartDeviceAuthorization(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, server.VerifyDevice(authorization.UserCode))
+
+		session, err := provider.ProviderData.RedeemDeviceCode(context.Background(), authorization.DeviceCode)
+		require.NoError(t, err)
+		assert.NotEmpty(t, session.AccessToken)
+		assert.Empty(t, session.IDToken)
+	})
+
+	t.Run("fails with the error of an unknown device code", func(t *testing.T) {
+		_, provider := newFakeIdPDeviceSetup(t)
+
+		_, err := provider.RedeemDeviceCode(context.Background(), "unknown")
+		assert.EqualError(t, err, "invalid_grant: unknown device code")
+
+		_, err = provider.RedeemDeviceCode(context.Background(), "")
+		assert.Equal(t, ErrMissingCode, err)
+	})
+
+	t.Run("fails when the provider refuses the client", func(t *testing.T) {
+		_, provider := newFakeIdPDeviceSetup(t)
+		provider.ClientSecret = "wrong"
+
+		_, err := provider.StartDeviceAuthorization(context.Background())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "got 401 from")
+	})
+
+	t.Run("isn't implemented without a device authorization URL", func(t *testing.T) {
+		_, err := (&ProviderData{}).StartDeviceAuthorization(context.Background())
+		assert.Equal(t, ErrNotImplemented, err)
+	})
+}
@@ -169,13 +169,13 @@ func (p *GitHubProvider) hasOrg(ctx context.Context, accessToken string) (bool,
 	presentOrgs := make([]string, 0, len(orgs))
 	for _, org := range orgs {
 		if p.Org == org.Login {
-			logger.Printf("Found Github Organization: %q", org.Login)
+			logger.PrintfContext(ctx, "Found Github Organization: %q", org.Login)
 			return true, nil
 		}
 		presentOrgs = append(presentOrgs, org.Login)
 	}
 
-	logger.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	logger.PrintfContext(ctx, "Missing Organization:%q in %v", p.Org, presentOrgs)
 	return false, nil
 }
 
@@ -277,7 +277,7 @@ func (p *GitHubProvider) hasOrgAndTeam(ctx context.Context, accessToken string)
 			ts := strings.Split(p.Team, ",")
 			for _, t := range ts {
 				if t == team.Slug {
-					logger.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
+					logger.PrintfContext(ctx, "Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
 					return true, nil
 				}
 			}
@@ -285,13 +285,13 @@ func (p *GitHubProvider) hasOrgAndTeam(ctx context.Context, accessToken string)
 		}
 	}
 	if hasOrg {
-		logger.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
+		logger.PrintfContext(ctx, "Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
 	} else {
 		var allOrgs []string
 		for org := range presentOrgs {
 			allOrgs = append(allOrgs, org)
 		}
-		logger.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+		logger.PrintfContext(ctx, "Missing Organization:%q in %#v", p.Org, allOrgs)
 	}
 	return false, nil
 }
@@ -380,7 +380,7 @@ func (p *GitHubProvider) isCollaborator(ctx context.Context, username, accessTok
 			result.StatusCode(), endpoint.String(), result.Body())
 	}
 
-	logger.Printf("got %d from %q %s", result.StatusCode(), endpoint.String(), result.Body())
+	logger.PrintfContext(ctx, "got %d from %q %s", result.StatusCode(), endpoint.String(), result.Body())
 
 	return true, nil
 }
@@ -7,10 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
@@ -18,7 +15,7 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
@@ -99,17 +96,15 @@ func NewGoogleProvider(p *ProviderData, opts options.GoogleOptions) (*GoogleProv
 		},
 	}
 
-	if opts.ServiceAccountJSON != "" {
-		file, err := os.Open(opts.ServiceAccountJSON)
+	if len(opts.Groups) > 0 {
+		checker, err := newGoogleGroupCheckerFromOptions(opts)
 		if err != nil {
-			return nil, fmt.Errorf("invalid Google credentials file: %s", opts.ServiceAccountJSON)
+			return nil, err
 		}
 
 		// Backwards compatibility with `--google-group` option
-		if len(opts.Groups) > 0 {
-			provider.setAllowedGroups(opts.Groups)
-		}
-		provider.setGroupRestriction(opts.Groups, opts.AdminEmail, file)
+		provider.setAllowedGroups(opts.Groups)
+		provider.setGroupRestriction(opts.Groups, checker, opts.GroupCacheTTL.Duration(), opts.GroupCheckConcurrency)
 	}
 
 	return provider, nil
@@ -210,55 +205,111 @@ func (p *GoogleProvider) EnrichSession(_ context.Context, s *sessions.SessionSta
 }
 
 // SetGroupRestriction configures the GoogleProvider to restrict access to the
-// specified group(s). AdminEmail has to be an administrative email on the domain that is
-// checked. CredentialsFile is the path to a json file containing a Google service
-// account credentials.
-//
-// TODO (@NickMeves) - Unit Test this OR refactor away from groupValidator func
-func (p *GoogleProvider) setGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
+// specified group(s), checked with the checker, concurrency groups at a time.
+// Memberships are cached in the session for cacheTTL from when they were
+// checked, to limit calls to the Google API on every refresh, and checked again
+// once they expire. When the Google API quota is exceeded, the
+// memberships of sessions that were already checked are trusted until the
+// check can be retried, rather than denying them.
+func (p *GoogleProvider) setGroupRestriction(groups []string, checker googleGroupChecker, cacheTTL time.Duration, concurrency int) {
 	p.groupValidator = func(s *sessions.SessionState) bool {
+		now := time.Now()
+		if s.GroupsExpiresOn != nil && now.Before(*s.GroupsExpiresOn) {
+			return len(s.Groups) > 0
+		}
+
 		// Reset our saved Groups in case membership changed
-		// This is used by `Authorize` on every request
-		s.Groups = make([]string, 0, len(groups))
-		for _, group := range groups {
-			if userInGroup(adminService, group, s.Email) {
-				s.Groups = append(s.Groups, group)
+		memberOf, err := checkGoogleGroups(context.Background(), checker, groups, s.Email, concurrency)
+		var quotaErr *googleQuotaError
+		if errors.As(err, &quotaErr) {
+			if len(s.Groups) == 0 {
+				logger.Errorf("error checking google groups of %s: %v", s.Email, err)
+				return false
 			}
+			retryAt := now.Add(quotaErr.retryAfter)
+			s.GroupsExpiresOn = &retryAt
+			logger.Errorf("error checking google groups of %s: %v, keeping the previous memberships until %s", s.Email, err, retryAt.Format(time.RFC3339))
+			return true
+		}
+
+		s.Groups = memberOf
+		s.GroupsExpiresOn = nil
+		if cacheTTL > 0 {
+			expires := now.Add(cacheTTL)
+			s.GroupsExpiresOn = &expires
 		}
 		return len(s.Groups) > 0
 	}
 }
 
-func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
-	data, err := ioutil.ReadAll(credentialsReader)
+// newGoogleGroupCheckerFromOptions creates the checker of the group
+// memberships: the Cloud Identity API with TransitiveMembership, and the
+// Admin SDK otherwise.
+func newGoogleGroupCheckerFromOptions(opts options.GoogleOptions) (googleGroupChecker, error) {
+	if opts.TransitiveMembership {
+		tokenSource, err := getGoogleTokenSource(opts.AdminEmail, opts.ServiceAccountJSON, []string{googleCloudIdentityScope})
+		if err != nil {
+			return nil, err
+		}
+		return newCloudIdentityGroupChecker(oauth2.NewClient(context.Background(), tokenSource), googleCloudIdentityURL), nil
+	}
+
+	adminService, err := getAdminService(opts.AdminEmail, opts.ServiceAccountJSON)
 	if err != nil {
-		logger.Fatal("can't read Google credentials file:", err)
+		return nil, err
 	}
-	conf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	return &adminGroupChecker{service: adminService}, nil
+}
+
+// getGoogleTokenSource creates a token source for the scopes that
+// impersonates the adminEmail.
+// A token is requested straight away so that misconfigured credentials are
+// reported on startup rather than on the first login.
+func getGoogleTokenSource(adminEmail, serviceAccountJSON string, scopes []string) (oauth2.TokenSource, error) {
+	tokenSource, serviceAccount, err := getAdminTokenSource(context.Background(), adminEmail, serviceAccountJSON, scopes)
 	if err != nil {
-		logger.Fatal("can't load Google credentials file:", err)
+		return nil, err
+	}
+	if _, err := tokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("could not obtain a Google API token for service account %s impersonating %s: %v. "+
+			"Check that the service account is allowed domain-wide delegation for the scopes %s and, "+
+			"when using Application Default Credentials without a key, that it has the Service Account Token Creator role on itself",
+			serviceAccount, adminEmail, err, strings.Join(scopes, ","))
 	}
-	conf.Subject = adminEmail
+	return tokenSource, nil
+}
 
-	ctx := context.Background()
-	client := conf.Client(ctx)
-	adminService, err := admin.NewService(ctx, option.WithHTTPClient(client))
+// getAdminService creates an Admin SDK client that impersonates the adminEmail.
+func getAdminService(adminEmail, serviceAccountJSON string) (*admin.Service, error) {
+	tokenSource, err := getGoogleTokenSource(adminEmail, serviceAccountJSON, googleAdminScopes)
 	if err != nil {
-		logger.Fatal(err)
+		return nil, err
 	}
-	return adminService
+
+	adminService, err := admin.NewService(context.Background(), option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("could not create Google Admin SDK client: %v", err)
+	}
+	return adminService, nil
 }
 
-func userInGroup(service *admin.Service, group string, email string) bool {
+// userInGroup checks the user's membership of the group with the Admin SDK.
+// Errors are logged and treated as the user not being a member, other than
+// the Admin SDK quota being exceeded, which is returned as a googleQuotaError.
+func userInGroup(service *admin.Service, group string, email string) (bool, error) {
 	// Use the HasMember API to checking for the user's presence in each group or nested subgroups
 	req := service.Members.HasMember(group, email)
 	r, err := req.Do()
 	if err == nil {
-		return r.IsMember
+		return r.IsMember, nil
 	}
 
 	gerr, ok := err.(*googleapi.Error)
+	if ok {
+		if quotaErr := googleAPIQuotaError(gerr); quotaErr != nil {
+			return false, quotaErr
+		}
+	}
 	switch {
 	case ok && gerr.Code == 404:
 		logger.Errorf("error checking membership in group %s: group does not exist", group)
@@ -271,18 +322,18 @@ func userInGroup(service *admin.Service, group string, email string) bool {
 		r, err := req.Do()
 		if err != nil {
 			logger.Errorf("error using get API to check member %s of google group %s: user not in the group", email, group)
-			return false
+			return false, nil
 		}
 
 		// If the non-domain user is found within the group, still verify that they are "ACTIVE".
 		// Do not count the user as belonging to a group if they have another status ("ARCHIVED", "SUSPENDED", or "UNKNOWN").
 		if r.Status == "ACTIVE" {
-			return true
+			return true, nil
 		}
 	default:
 		logger.Errorf("error checking group membership: %v", err)
 	}
-	return false
+	return false, nil
 }
 
 // RefreshSession uses the RefreshToken to fetch new Access and ID Tokens
@@ -0,0 +1,170 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// googleTokenURL is the endpoint that exchanges signed JWT assertions for
+	// access tokens
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+
+	// googleJWTBearerGrantType is the grant type for exchanging a JWT assertion
+	googleJWTBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// googleAdminScopes are the scopes needed to check group memberships with the
+// Admin SDK Directory API
+var googleAdminScopes = []string{
+	admin.AdminDirectoryUserReadonlyScope,
+	admin.AdminDirectoryGroupReadonlyScope,
+}
+
+// getAdminTokenSource returns a token source for the Google APIs that
+// impersonates the adminEmail with the scopes, and the email of the service
+// account used.
+//
+// If a service account JSON key is given it is used to sign the domain-wide
+// delegation assertion itself. Otherwise Application Default Credentials are
+// used, so that GKE Workload Identity or the GCE metadata server can be used
+// without a long-lived key. Service account keys found through ADC are used
+// directly, other ADC service accounts sign the assertion using the IAM
+// Credentials API.
+func getAdminTokenSource(ctx context.Context, adminEmail, serviceAccountJSON string, scopes []string) (oauth2.TokenSource, string, error) {
+	if serviceAccountJSON != "" {
+		data, err := ioutil.ReadFile(serviceAccountJSON)
+		if err != nil {
+			return nil, "", fmt.Errorf("can't read Google credentials file: %v", err)
+		}
+		return jwtTokenSource(ctx, adminEmail, data, scopes)
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx, iamcredentials.CloudPlatformScope)
+	if err != nil {
+		return nil, "", fmt.Errorf("no google-service-account-json was given and Application Default Credentials could not be found: %v", err)
+	}
+	if len(creds.JSON) > 0 {
+		var file struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(creds.JSON, &file); err != nil {
+			return nil, "", fmt.Errorf("can't parse Application Default Credentials: %v", err)
+		}
+		if file.Type != "service_account" {
+			return nil, "", fmt.Errorf("credentials of type %q found by Application Default Credentials can't be used to impersonate %s, use a service account instead", file.Type, adminEmail)
+		}
+		return jwtTokenSource(ctx, adminEmail, creds.JSON, scopes)
+	}
+
+	serviceAccount, err := metadata.Get("instance/service-accounts/default/email")
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get the service account email from the metadata server: %v", err)
+	}
+
+	iamService, err := iamcredentials.NewService(ctx, option.WithTokenSource(creds.TokenSource))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create Google IAM Credentials client: %v", err)
+	}
+
+	return oauth2.ReuseTokenSource(nil, &delegatedTokenSource{
+		ctx:            ctx,
+		iamService:     iamService,
+		tokenURL:       googleTokenURL,
+		serviceAccount: serviceAccount,
+		subject:        adminEmail,
+		scopes:         scopes,
+	}), serviceAccount, nil
+}
+
+// jwtTokenSource creates a token source from a service account JSON key
+func jwtTokenSource(ctx context.Context, adminEmail string, data []byte, scopes []string) (oauth2.TokenSource, string, error) {
+	conf, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't load Google credentials file: %v", err)
+	}
+	conf.Subject = adminEmail
+	return conf.TokenSource(ctx), conf.Email, nil
+}
+
+// delegatedTokenSource obtains tokens through domain-wide delegation for a
+// service account without access to its private key. The JWT assertion is
+// signed by the IAM Credentials API, which requires the credentials in use to
+// have the Service Account Token Creator role on the service account.
+type delegatedTokenSource struct {
+	ctx            context.Context
+	iamService     *iamcredentials.Service
+	tokenURL       string
+	serviceAccount string
+	subject        string
+	scopes         []string
+}
+
+// Token signs a new JWT assertion and exchanges it for an access token
+func (ts *delegatedTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   ts.serviceAccount,
+		"sub":   ts.subject,
+		"scope": strings.Join(ts.scopes, " "),
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	name := "projects/-/serviceAccounts/" + ts.serviceAccount
+	signed, err := ts.iamService.Projects.ServiceAccounts.
+		SignJwt(name, &iamcredentials.SignJwtRequest{Payload: string(claims)}).
+		Context(ts.ctx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not sign JWT as %s: %v", ts.serviceAccount, err)
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", googleJWTBearerGrantType)
+	params.Add("assertion", signed.SignedJwt)
+
+	var jsonResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = requests.New(ts.tokenURL).
+		WithContext(ts.ctx).
+		WithMethod("POST").
+		WithBody(bytes.NewBufferString(params.Encode())).
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		Do().
+		UnmarshalInto(&jsonResponse)
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange JWT for an access token: %v", err)
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, errors.New("no access token was returned")
+	}
+
+	return &oauth2.Token{
+		AccessToken: jsonResponse.AccessToken,
+		TokenType:   jsonResponse.TokenType,
+		Expiry:      now.Add(time.Duration(jsonResponse.ExpiresIn) * time.Second),
+	}, nil
+}
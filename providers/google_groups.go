@@ -0,0 +1,271 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// googleCloudIdentityURL is the Cloud Identity API endpoint transitive
+	// group memberships are checked with
+	googleCloudIdentityURL = "https://cloudidentity.googleapis.com/v1/"
+
+	// googleCloudIdentityScope is the scope needed to check transitive group
+	// memberships with the Cloud Identity API
+	googleCloudIdentityScope = "https://www.googleapis.com/auth/cloud-identity.groups.readonly"
+
+	// googleDefaultQuotaRetryAfter is how long memberships are trusted for
+	// once the Google API rejected a check for exceeding its quota, when the
+	// response has no Retry-After header
+	googleDefaultQuotaRetryAfter = time.Minute
+)
+
+// googleQuotaReasons are the reasons the Google API gives for rejecting
+// requests that exceed its quota
+var googleQuotaReasons = map[string]struct{}{
+	"rateLimitExceeded":     {},
+	"userRateLimitExceeded": {},
+	"quotaExceeded":         {},
+	"RATE_LIMIT_EXCEEDED":   {},
+}
+
+// errGoogleGroupNotFound is returned when a group doesn't exist
+var errGoogleGroupNotFound = errors.New("group does not exist")
+
+// googleGroupChecker checks whether users are members of Google groups
+type googleGroupChecker interface {
+	isMember(ctx context.Context, group, email string) (bool, error)
+}
+
+// googleQuotaError is returned when a membership check was rejected for
+// exceeding the Google API quota
+type googleQuotaError struct {
+	retryAfter time.Duration
+}
+
+func (e *googleQuotaError) Error() string {
+	return fmt.Sprintf("google API quota exceeded, retry after %s", e.retryAfter)
+}
+
+// adminGroupChecker checks memberships with the Admin SDK Directory API
+type adminGroupChecker struct {
+	service *admin.Service
+}
+
+func (c *adminGroupChecker) isMember(_ context.Context, group, email string) (bool, error) {
+	return userInGroup(c.service, group, email)
+}
+
+// cloudIdentityGroupChecker checks memberships, including those through
+// nested groups, with the checkTransitiveMembership method of the Cloud
+// Identity API.
+// The resource names groups are looked up by are cached, as they never
+// change.
+type cloudIdentityGroupChecker struct {
+	client  *http.Client
+	baseURL string
+
+	mutex sync.Mutex
+	names map[string]string
+}
+
+func newCloudIdentityGroupChecker(client *http.Client, baseURL string) *cloudIdentityGroupChecker {
+	return &cloudIdentityGroupChecker{
+		client:  client,
+		baseURL: baseURL,
+		names:   make(map[string]string),
+	}
+}
+
+func (c *cloudIdentityGroupChecker) isMember(ctx context.Context, group, email string) (bool, error) {
+	name, err := c.groupName(ctx, group)
+	if err != nil {
+		return false, err
+	}
+
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("member_key_id == '%s'", strings.ReplaceAll(email, "'", `\'`)))
+	var response struct {
+		HasMembership bool `json:"hasMembership"`
+	}
+	if err := c.get(ctx, name+"/memberships:checkTransitiveMembership", query, &response); err != nil {
+		return false, err
+	}
+	return response.HasMembership, nil
+}
+
+// groupName looks up the resource name of the group by its email
+func (c *cloudIdentityGroupChecker) groupName(ctx context.Context, group string) (string, error) {
+	c.mutex.Lock()
+	name, ok := c.names[group]
+	c.mutex.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	query := url.Values{}
+	query.Set("groupKey.id", group)
+	var response struct {
+		Name string `json:"name"`
+	}
+	if err := c.get(ctx, "groups:lookup", query, &response); err != nil {
+		return "", err
+	}
+	if response.Name == "" {
+		return "", errGoogleGroupNotFound
+	}
+
+	c.mutex.Lock()
+	c.names[group] = response.Name
+	c.mutex.Unlock()
+	return response.Name, nil
+}
+
+// get calls the method of the Cloud Identity API and decodes its response
+func (c *cloudIdentityGroupChecker) get(ctx context.Context, method string, query url.Values, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+method+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Cloud Identity response: %v", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return json.Unmarshal(body, into)
+	case resp.StatusCode == http.StatusNotFound:
+		return errGoogleGroupNotFound
+	case isGoogleQuotaResponse(resp.StatusCode, body):
+		return &googleQuotaError{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return fmt.Errorf("unexpected Cloud Identity response %d: %s", resp.StatusCode, body)
+}
+
+// isGoogleQuotaResponse checks whether a Google API error response rejected
+// the request for exceeding the quota
+func isGoogleQuotaResponse(code int, body []byte) bool {
+	if code == http.StatusTooManyRequests {
+		return true
+	}
+	if code != http.StatusForbidden {
+		return false
+	}
+	var response struct {
+		Error struct {
+			Status string `json:"status"`
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false
+	}
+	if response.Error.Status == "RESOURCE_EXHAUSTED" {
+		return true
+	}
+	for _, e := range response.Error.Errors {
+		if _, ok := googleQuotaReasons[e.Reason]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// googleAPIQuotaError returns a googleQuotaError if the Admin SDK error
+// rejected the request for exceeding the quota, and nil otherwise
+func googleAPIQuotaError(err *googleapi.Error) *googleQuotaError {
+	quota := err.Code == http.StatusTooManyRequests
+	for _, e := range err.Errors {
+		if _, ok := googleQuotaReasons[e.Reason]; ok && err.Code == http.StatusForbidden {
+			quota = true
+		}
+	}
+	if !quota {
+		return nil
+	}
+	return &googleQuotaError{retryAfter: parseRetryAfter(err.Header.Get("Retry-After"))}
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as a date,
+// defaulting to googleDefaultQuotaRetryAfter
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return googleDefaultQuotaRetryAfter
+}
+
+// checkGoogleGroups checks the user's membership of each group, with at most
+// concurrency checks in parallel, and returns the groups the user is a member
+// of in their configured order.
+// Groups that can't be checked are logged and skipped, unless the check
+// exceeded the Google API quota, when the googleQuotaError with the longest
+// retry is returned.
+func checkGoogleGroups(ctx context.Context, checker googleGroupChecker, groups []string, email string, concurrency int) ([]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	members := make([]bool, len(groups))
+	errs := make([]error, len(groups))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, group string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			members[i], errs[i] = checker.isMember(ctx, group, email)
+		}(i, group)
+	}
+	wg.Wait()
+
+	var quotaErr *googleQuotaError
+	memberOf := make([]string, 0, len(groups))
+	for i, group := range groups {
+		var qe *googleQuotaError
+		switch {
+		case errors.As(errs[i], &qe):
+			if quotaErr == nil || qe.retryAfter > quotaErr.retryAfter {
+				quotaErr = qe
+			}
+		case errs[i] != nil:
+			logger.Errorf("error checking membership of %s in google group %s: %v", email, group, errs[i])
+		case members[i]:
+			memberOf = append(memberOf, group)
+		}
+	}
+	if quotaErr != nil {
+		return nil, quotaErr
+	}
+	return memberOf, nil
+}
@@ -0,0 +1,208 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/gomega"
+	admin "google.golang.org/api/admin/directory/v1"
+	option "google.golang.org/api/option"
+)
+
+// newCloudIdentityServer serves the Cloud Identity lookup of group@example.com
+// and the transitive memberships of the members
+func newCloudIdentityServer(members map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/groups:lookup":
+			if r.URL.Query().Get("groupKey.id") != "group@example.com" {
+				http.Error(w, `{"error": {"code": 404, "status": "NOT_FOUND"}}`, http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, `{"name": "groups/abc123"}`)
+		case "/groups/abc123/memberships:checkTransitiveMembership":
+			for email, member := range members {
+				if r.URL.Query().Get("query") == fmt.Sprintf("member_key_id == '%s'", email) {
+					fmt.Fprintf(w, `{"hasMembership": %t}`, member)
+					return
+				}
+			}
+			fmt.Fprintln(w, `{"hasMembership": false}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestCloudIdentityGroupChecker(t *testing.T) {
+	// The Admin SDK only reports direct memberships
+	adminServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"isMember": false}`)
+	}))
+	defer adminServer.Close()
+	ciServer := newCloudIdentityServer(map[string]bool{"nested-member@example.com": true})
+	defer ciServer.Close()
+
+	g := NewWithT(t)
+	service, err := admin.NewService(context.Background(), option.WithHTTPClient(adminServer.Client()))
+	g.Expect(err).ToNot(HaveOccurred())
+	service.BasePath = adminServer.URL
+
+	direct, err := (&adminGroupChecker{service: service}).isMember(context.Background(), "group@example.com", "nested-member@example.com")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(direct).To(BeFalse())
+
+	checker := newCloudIdentityGroupChecker(ciServer.Client(), ciServer.URL+"/")
+	transitive, err := checker.isMember(context.Background(), "group@example.com", "nested-member@example.com")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(transitive).To(BeTrue())
+
+	nonMember, err := checker.isMember(context.Background(), "group@example.com", "non-member@example.com")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(nonMember).To(BeFalse())
+
+	_, err = checker.isMember(context.Background(), "missing@example.com", "nested-member@example.com")
+	g.Expect(err).To(Equal(errGoogleGroupNotFound))
+}
+
+func TestCloudIdentityGroupCheckerQuota(t *testing.T) {
+	testCases := map[string]struct {
+		status             int
+		body               string
+		retryAfter         string
+		expectedRetryAfter time.Duration
+	}{
+		"Too many requests with a Retry-After": {
+			status:             http.StatusTooManyRequests,
+			body:               `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED"}}`,
+			retryAfter:         "120",
+			expectedRetryAfter: 2 * time.Minute,
+		},
+		"Rate limit exceeded without a Retry-After": {
+			status:             http.StatusForbidden,
+			body:               `{"error": {"code": 403, "errors": [{"reason": "rateLimitExceeded"}]}}`,
+			expectedRetryAfter: googleDefaultQuotaRetryAfter,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				http.Error(w, tc.body, tc.status)
+			}))
+			defer ts.Close()
+
+			checker := newCloudIdentityGroupChecker(ts.Client(), ts.URL+"/")
+			_, err := checker.isMember(context.Background(), "group@example.com", "member@example.com")
+			g.Expect(err).To(Equal(&googleQuotaError{retryAfter: tc.expectedRetryAfter}))
+		})
+	}
+}
+
+// fakeGroupChecker reports the memberships of the groups, or the error,
+// counting the checks and the most run in parallel
+type fakeGroupChecker struct {
+	members map[string]bool
+	err     error
+
+	running     int32
+	maxParallel int32
+	calls       int32
+	mutex       sync.Mutex
+}
+
+func (c *fakeGroupChecker) isMember(_ context.Context, group, _ string) (bool, error) {
+	atomic.AddInt32(&c.calls, 1)
+	running := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	c.mutex.Lock()
+	if running > c.maxParallel {
+		c.maxParallel = running
+	}
+	c.mutex.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	return c.members[group], c.err
+}
+
+func TestCheckGoogleGroups(t *testing.T) {
+	g := NewWithT(t)
+	groups := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	checker := &fakeGroupChecker{members: map[string]bool{"b@example.com": true, "d@example.com": true}}
+
+	memberOf, err := checkGoogleGroups(context.Background(), checker, groups, "member@example.com", 2)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(memberOf).To(Equal([]string{"b@example.com", "d@example.com"}))
+	g.Expect(checker.calls).To(BeEquivalentTo(5))
+	g.Expect(checker.maxParallel).To(BeEquivalentTo(2))
+}
+
+func TestGoogleProviderGroupQuota(t *testing.T) {
+	testCases := map[string]struct {
+		previousGroups []string
+		expectedResult bool
+		expectedGroups []string
+	}{
+		"Sessions with previous memberships are kept": {
+			previousGroups: []string{"group@example.com"},
+			expectedResult: true,
+			expectedGroups: []string{"group@example.com"},
+		},
+		"Logins without previous memberships are denied": {
+			previousGroups: nil,
+			expectedResult: false,
+			expectedGroups: nil,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+			checker := &fakeGroupChecker{err: &googleQuotaError{retryAfter: 2 * time.Minute}}
+
+			p := newGoogleProvider(t)
+			p.setGroupRestriction([]string{"group@example.com"}, checker, time.Minute, 1)
+
+			expired := time.Now().Add(-time.Second)
+			s := &sessions.SessionState{Email: "member@example.com", Groups: tc.previousGroups, GroupsExpiresOn: &expired}
+			g.Expect(p.groupValidator(s)).To(Equal(tc.expectedResult))
+			g.Expect(s.Groups).To(Equal(tc.expectedGroups))
+			if tc.expectedResult {
+				g.Expect(*s.GroupsExpiresOn).To(BeTemporally("~", time.Now().Add(2*time.Minute), time.Second))
+
+				// The memberships are trusted until the retry
+				g.Expect(p.groupValidator(s)).To(BeTrue())
+				g.Expect(checker.calls).To(BeEquivalentTo(1))
+			}
+		})
+	}
+}
+
+func TestGoogleProviderGroupSessionCache(t *testing.T) {
+	g := NewWithT(t)
+	checker := &fakeGroupChecker{members: map[string]bool{"group@example.com": true}}
+
+	p := newGoogleProvider(t)
+	p.setGroupRestriction([]string{"group@example.com"}, checker, time.Minute, 1)
+
+	s := &sessions.SessionState{Email: "member@example.com"}
+	g.Expect(p.groupValidator(s)).To(BeTrue())
+	g.Expect(s.Groups).To(Equal([]string{"group@example.com"}))
+	g.Expect(*s.GroupsExpiresOn).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+
+	// The memberships of the session are trusted until they expire
+	s.Groups = []string{}
+	g.Expect(p.groupValidator(s)).To(BeFalse())
+	g.Expect(checker.calls).To(BeEquivalentTo(1))
+}
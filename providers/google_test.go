@@ -8,13 +8,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	. "github.com/onsi/gomega"
 	"github.com/stretchr/testify/assert"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/iamcredentials/v1"
 	option "google.golang.org/api/option"
 )
 
@@ -277,15 +280,131 @@ func TestGoogleProvider_userInGroup(t *testing.T) {
 
 	service.BasePath = ts.URL
 
-	result := userInGroup(service, "group@example.com", "member-in-domain@example.com")
+	result, err := userInGroup(service, "group@example.com", "member-in-domain@example.com")
+	assert.NoError(t, err)
 	assert.True(t, result)
 
-	result = userInGroup(service, "group@example.com", "member-out-of-domain@otherexample.com")
+	result, err = userInGroup(service, "group@example.com", "member-out-of-domain@otherexample.com")
+	assert.NoError(t, err)
 	assert.True(t, result)
 
-	result = userInGroup(service, "group@example.com", "non-member-in-domain@example.com")
+	result, err = userInGroup(service, "group@example.com", "non-member-in-domain@example.com")
+	assert.NoError(t, err)
 	assert.False(t, result)
 
-	result = userInGroup(service, "group@example.com", "non-member-out-of-domain@otherexample.com")
+	result, err = userInGroup(service, "group@example.com", "non-member-out-of-domain@otherexample.com")
+	assert.NoError(t, err)
 	assert.False(t, result)
 }
+
+func TestGoogleProviderGroupCache(t *testing.T) {
+	var hasMemberCalls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasMemberCalls++
+		if r.URL.Path == "/groups/group@example.com/hasMember/member@example.com" {
+			fmt.Fprintln(w, `{"isMember": true}`)
+		} else {
+			fmt.Fprintln(w, `{"isMember": false}`)
+		}
+	}))
+	defer ts.Close()
+
+	service, err := admin.NewService(context.Background(), option.WithHTTPClient(ts.Client()))
+	assert.NoError(t, err)
+	service.BasePath = ts.URL
+
+	testCases := map[string]struct {
+		cacheTTL              time.Duration
+		expectedHasMemberCall int
+	}{
+		"Memberships are cached in the session within the TTL": {
+			cacheTTL:              time.Minute,
+			expectedHasMemberCall: 2,
+		},
+		"Memberships are not cached with no TTL": {
+			cacheTTL:              0,
+			expectedHasMemberCall: 4,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+			hasMemberCalls = 0
+
+			p := newGoogleProvider(t)
+			p.setGroupRestriction([]string{"group@example.com"}, &adminGroupChecker{service: service}, tc.cacheTTL, options.DefaultGoogleGroupCheckConcurrency)
+
+			member := &sessions.SessionState{Email: "member@example.com"}
+			nonMember := &sessions.SessionState{Email: "non-member@example.com"}
+			for i := 0; i < 2; i++ {
+				g.Expect(p.groupValidator(member)).To(BeTrue())
+				g.Expect(member.Groups).To(Equal([]string{"group@example.com"}))
+
+				g.Expect(p.groupValidator(nonMember)).To(BeFalse())
+				g.Expect(nonMember.Groups).To(BeEmpty())
+			}
+			g.Expect(hasMemberCalls).To(Equal(tc.expectedHasMemberCall))
+
+			// Memberships are checked again once they expire, and other
+			// sessions of the user don't share them
+			expired := time.Now().Add(-time.Second)
+			member.GroupsExpiresOn = &expired
+			g.Expect(p.groupValidator(member)).To(BeTrue())
+			g.Expect(p.groupValidator(&sessions.SessionState{Email: "member@example.com"})).To(BeTrue())
+			g.Expect(hasMemberCalls).To(Equal(tc.expectedHasMemberCall + 2))
+		})
+	}
+}
+
+func TestGoogleDelegatedTokenSource(t *testing.T) {
+	g := NewWithT(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/-/serviceAccounts/proxy@project.iam.gserviceaccount.com:signJwt":
+			var body struct {
+				Payload string `json:"payload"`
+			}
+			g.Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+
+			var claims map[string]interface{}
+			g.Expect(json.Unmarshal([]byte(body.Payload), &claims)).To(Succeed())
+			g.Expect(claims).To(HaveKeyWithValue("iss", "proxy@project.iam.gserviceaccount.com"))
+			g.Expect(claims).To(HaveKeyWithValue("sub", "admin@example.com"))
+			g.Expect(claims).To(HaveKeyWithValue("scope", strings.Join(googleAdminScopes, " ")))
+			g.Expect(claims).To(HaveKeyWithValue("aud", "http://"+r.Host+"/token"))
+
+			fmt.Fprintln(w, `{"keyId": "1", "signedJwt": "signed.jwt.assertion"}`)
+		case "/token":
+			g.Expect(r.ParseForm()).To(Succeed())
+			g.Expect(r.PostForm.Get("grant_type")).To(Equal("urn:ietf:params:oauth:grant-type:jwt-bearer"))
+			g.Expect(r.PostForm.Get("assertion")).To(Equal("signed.jwt.assertion"))
+
+			fmt.Fprintln(w, `{"access_token": "delegated-token", "token_type": "Bearer", "expires_in": 3600}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	iamService, err := iamcredentials.NewService(ctx, option.WithHTTPClient(ts.Client()))
+	g.Expect(err).ToNot(HaveOccurred())
+	iamService.BasePath = ts.URL + "/"
+
+	tokenSource := &delegatedTokenSource{
+		ctx:            ctx,
+		iamService:     iamService,
+		tokenURL:       ts.URL + "/token",
+		serviceAccount: "proxy@project.iam.gserviceaccount.com",
+		subject:        "admin@example.com",
+		scopes:         googleAdminScopes,
+	}
+
+	token, err := tokenSource.Token()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token.AccessToken).To(Equal("delegated-token"))
+	g.Expect(token.TokenType).To(Equal("Bearer"))
+	g.Expect(token.Expiry).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+}
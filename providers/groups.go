@@ -0,0 +1,163 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// groupsNormalizer transforms, filters and caps the groups of a session
+type groupsNormalizer struct {
+	transform *regexp.Regexp
+	prefixes  []string
+	regexes   []*regexp.Regexp
+	maxGroups int
+}
+
+// newGroupsNormalizer compiles the groups normalization options, returning
+// nil when the groups are stored as the provider returns them
+func newGroupsNormalizer(opts options.GroupsNormalization) (*groupsNormalizer, error) {
+	if opts.Transform == "" && len(opts.Filter) == 0 && opts.MaxGroups <= 0 {
+		return nil, nil
+	}
+
+	n := &groupsNormalizer{maxGroups: opts.MaxGroups}
+	if opts.Transform != "" {
+		transform, err := regexp.Compile(opts.Transform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid groups transform %q: %v", opts.Transform, err)
+		}
+		if transform.NumSubexp() < 1 {
+			return nil, fmt.Errorf("invalid groups transform %q: must have a capture group", opts.Transform)
+		}
+		n.transform = transform
+	}
+	for _, entry := range opts.Filter {
+		if !strings.HasPrefix(entry, "~") {
+			n.prefixes = append(n.prefixes, entry)
+			continue
+		}
+		regex, err := regexp.Compile(strings.TrimPrefix(entry, "~"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid groups filter %q: %v", entry, err)
+		}
+		n.regexes = append(n.regexes, regex)
+	}
+	return n, nil
+}
+
+// normalize returns the transformed groups that pass the filter, without
+// duplicates and at most maxGroups of them.
+// Normalizing groups that are already normalized doesn't change them, as
+// transformed names no longer match the transform.
+func (n *groupsNormalizer) normalize(groups []string) []string {
+	if len(groups) == 0 {
+		return groups
+	}
+
+	normalized := make([]string, 0, len(groups))
+	seen := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		if n.transform != nil {
+			if match := n.transform.FindStringSubmatch(group); match != nil {
+				group = match[1]
+			}
+		}
+		if _, ok := seen[group]; ok || !n.allowed(group) {
+			continue
+		}
+		seen[group] = struct{}{}
+		normalized = append(normalized, group)
+	}
+
+	if n.maxGroups > 0 && len(normalized) > n.maxGroups {
+		logger.Printf("Warning: storing only the first %d of %d groups in the session, the others are ignored", n.maxGroups, len(normalized))
+		normalized = normalized[:n.maxGroups]
+	}
+	return normalized
+}
+
+// allowed returns whether the group passes the filter
+func (n *groupsNormalizer) allowed(group string) bool {
+	if len(n.prefixes) == 0 && len(n.regexes) == 0 {
+		return true
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(group, prefix) {
+			return true
+		}
+	}
+	for _, regex := range n.regexes {
+		if regex.MatchString(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizedGroupsProvider normalizes the groups of the sessions created,
+// enriched and refreshed by the provider, so that the groups are normalized
+// before they are stored in the session, compared to the allowed groups or
+// passed to the upstreams.
+type normalizedGroupsProvider struct {
+	Provider
+	normalizer *groupsNormalizer
+}
+
+// newNormalizedGroupsProvider wraps the provider to normalize the groups of
+// its sessions, when the groups normalization is configured
+func newNormalizedGroupsProvider(provider Provider, opts options.GroupsNormalization) (Provider, error) {
+	normalizer, err := newGroupsNormalizer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if normalizer == nil {
+		return provider, nil
+	}
+	return &normalizedGroupsProvider{Provider: provider, normalizer: normalizer}, nil
+}
+
+func (p *normalizedGroupsProvider) normalizeSession(s *sessions.SessionState) {
+	if s != nil {
+		s.Groups = p.normalizer.normalize(s.Groups)
+	}
+}
+
+func (p *normalizedGroupsProvider) Redeem(ctx context.Context, redirectURI, code, codeVerifier string) (*sessions.SessionState, error) {
+	s, err := p.Provider.Redeem(ctx, redirectURI, code, codeVerifier)
+	p.normalizeSession(s)
+	return s, err
+}
+
+func (p *normalizedGroupsProvider) EnrichSession(ctx context.Context, s *sessions.SessionState) error {
+	err := p.Provider.EnrichSession(ctx, s)
+	p.normalizeSession(s)
+	return err
+}
+
+// Authorize normalizes the groups before they are compared to the allowed
+// groups, and again after, as some providers look the groups up when
+// they authorize the session.
+func (p *normalizedGroupsProvider) Authorize(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	p.normalizeSession(s)
+	authorized, err := p.Provider.Authorize(ctx, s)
+	p.normalizeSession(s)
+	return authorized, err
+}
+
+func (p *normalizedGroupsProvider) RefreshSession(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	refreshed, err := p.Provider.RefreshSession(ctx, s)
+	p.normalizeSession(s)
+	return refreshed, err
+}
+
+func (p *normalizedGroupsProvider) CreateSessionFromToken(ctx context.Context, token string) (*sessions.SessionState, error) {
+	s, err := p.Provider.CreateSessionFromToken(ctx, token)
+	p.normalizeSession(s)
+	return s, err
+}
@@ -0,0 +1,177 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/gomega"
+)
+
+var ldapGroups = []string{
+	"CN=app-admins,OU=Groups,DC=corp,DC=example,DC=com",
+	"CN=app-users,OU=Groups,DC=corp,DC=example,DC=com",
+	"CN=vpn-users,OU=Groups,DC=corp,DC=example,DC=com",
+	"CN=app-users,OU=Legacy,DC=corp,DC=example,DC=com",
+	"CN=Domain Users,CN=Users,DC=corp,DC=example,DC=com",
+	"project:my-project",
+}
+
+// ldapGroupsProvider returns LDAP DNs as the groups of its sessions
+type ldapGroupsProvider struct {
+	*ProviderData
+	groups []string
+}
+
+func (p *ldapGroupsProvider) EnrichSession(_ context.Context, s *sessions.SessionState) error {
+	s.Groups = append([]string{}, p.groups...)
+	return nil
+}
+
+func (p *ldapGroupsProvider) RefreshSession(_ context.Context, s *sessions.SessionState) (bool, error) {
+	s.Groups = append([]string{}, p.groups...)
+	return true, nil
+}
+
+func (p *ldapGroupsProvider) CreateSessionFromToken(_ context.Context, _ string) (*sessions.SessionState, error) {
+	return &sessions.SessionState{Groups: append([]string{}, p.groups...)}, nil
+}
+
+func TestGroupsNormalizer(t *testing.T) {
+	testCases := map[string]struct {
+		opts     options.GroupsNormalization
+		expected []string
+	}{
+		"With a transform": {
+			opts: options.GroupsNormalization{
+				Transform: `^CN=([^,]+),`,
+			},
+			expected: []string{"app-admins", "app-users", "vpn-users", "Domain Users", "project:my-project"},
+		},
+		"With a transform and a prefix filter": {
+			opts: options.GroupsNormalization{
+				Transform: `^CN=([^,]+),`,
+				Filter:    []string{"app-", "project:"},
+			},
+			expected: []string{"app-admins", "app-users", "project:my-project"},
+		},
+		"With a regex filter": {
+			opts: options.GroupsNormalization{
+				Filter: []string{`~^CN=[^,]+,OU=Groups,`},
+			},
+			expected: []string{
+				"CN=app-admins,OU=Groups,DC=corp,DC=example,DC=com",
+				"CN=app-users,OU=Groups,DC=corp,DC=example,DC=com",
+				"CN=vpn-users,OU=Groups,DC=corp,DC=example,DC=com",
+			},
+		},
+		"With a maximum number of groups": {
+			opts: options.GroupsNormalization{
+				Transform: `^CN=([^,]+),`,
+				MaxGroups: 2,
+			},
+			expected: []string{"app-admins", "app-users"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			normalizer, err := newGroupsNormalizer(tc.opts)
+			g.Expect(err).ToNot(HaveOccurred())
+			normalized := normalizer.normalize(ldapGroups)
+			g.Expect(normalized).To(Equal(tc.expected))
+			// Normalizing the groups again doesn't change them
+			g.Expect(normalizer.normalize(normalized)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestNewGroupsNormalizerErrors(t *testing.T) {
+	testCases := map[string]struct {
+		opts        options.GroupsNormalization
+		expectedErr string
+	}{
+		"Without a capture group": {
+			opts:        options.GroupsNormalization{Transform: `^CN=[^,]+,`},
+			expectedErr: "invalid groups transform \"^CN=[^,]+,\": must have a capture group",
+		},
+		"With an invalid transform": {
+			opts:        options.GroupsNormalization{Transform: `^CN=(`},
+			expectedErr: "invalid groups transform \"^CN=(\": error parsing regexp: missing closing ): `^CN=(`",
+		},
+		"With an invalid filter": {
+			opts:        options.GroupsNormalization{Filter: []string{"app-", "~[a-"}},
+			expectedErr: "invalid groups filter \"~[a-\": error parsing regexp: missing closing ]: `[a-`",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+			_, err := newGroupsNormalizer(tc.opts)
+			g.Expect(err).To(MatchError(tc.expectedErr))
+		})
+	}
+}
+
+func TestNormalizedGroupsProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	data := &ProviderData{}
+	data.setAllowedGroups([]string{"app-admins"})
+	provider, err := newNormalizedGroupsProvider(&ldapGroupsProvider{ProviderData: data, groups: ldapGroups}, options.GroupsNormalization{
+		Transform: `^CN=([^,]+),`,
+		Filter:    []string{"app-"},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	expected := []string{"app-admins", "app-users"}
+
+	// At login
+	s := &sessions.SessionState{}
+	g.Expect(provider.EnrichSession(context.Background(), s)).To(Succeed())
+	g.Expect(s.Groups).To(Equal(expected))
+	authorized, err := provider.Authorize(context.Background(), s)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authorized).To(BeTrue())
+
+	// At refresh
+	s.Groups = nil
+	refreshed, err := provider.RefreshSession(context.Background(), s)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(refreshed).To(BeTrue())
+	g.Expect(s.Groups).To(Equal(expected))
+
+	// With bearer tokens
+	s, err = provider.CreateSessionFromToken(context.Background(), "token")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(s.Groups).To(Equal(expected))
+
+	// The allowed groups are compared to the transformed names
+	data.setAllowedGroups([]string{"CN=app-admins,OU=Groups,DC=corp,DC=example,DC=com"})
+	s = &sessions.SessionState{Groups: append([]string{}, ldapGroups...)}
+	authorized, err = provider.Authorize(context.Background(), s)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authorized).To(BeFalse())
+	g.Expect(s.Groups).To(Equal(expected))
+}
+
+func TestNewProviderNormalizesGroups(t *testing.T) {
+	g := NewWithT(t)
+
+	providerConfig := options.Provider{
+		ID:   "github",
+		Type: options.GitHubProvider,
+	}
+	provider, err := NewProvider(providerConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(provider).To(BeAssignableToTypeOf(&GitHubProvider{}))
+
+	providerConfig.GroupsNormalization.MaxGroups = 100
+	provider, err = NewProvider(providerConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(provider).To(BeAssignableToTypeOf(&normalizedGroupsProvider{}))
+	g.Expect(provider.Data()).ToNot(BeNil())
+}
@@ -61,16 +61,16 @@ func validateToken(ctx context.Context, p Provider, accessToken string, header h
 		WithHeaders(header).
 		Do()
 	if result.Error() != nil {
-		logger.Errorf("GET %s", stripToken(endpoint))
-		logger.Errorf("token validation request failed: %s", result.Error())
+		logger.ErrorfContext(ctx, "GET %s", stripToken(endpoint))
+		logger.ErrorfContext(ctx, "token validation request failed: %s", result.Error())
 		return false
 	}
 
-	logger.Printf("%d GET %s %s", result.StatusCode(), stripToken(endpoint), result.Body())
+	logger.PrintfContext(ctx, "%d GET %s %s", result.StatusCode(), stripToken(endpoint), result.Body())
 
 	if result.StatusCode() == 200 {
 		return true
 	}
-	logger.Errorf("token validation request failed: status %d - %s", result.StatusCode(), result.Body())
+	logger.ErrorfContext(ctx, "token validation request failed: status %d - %s", result.StatusCode(), result.Body())
 	return false
 }
@@ -79,7 +79,7 @@ func (p *KeycloakProvider) EnrichSession(ctx context.Context, s *sessions.Sessio
 		Do().
 		UnmarshalJSON()
 	if err != nil {
-		logger.Errorf("failed making request %v", err)
+		logger.ErrorfContext(ctx, "failed making request %v", err)
 		return err
 	}
 
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
@@ -70,6 +71,23 @@ func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifi
 	return p.createSession(ctx, token, false)
 }
 
+// RedeemDeviceCode redeems the device code of a device authorization for a
+// session of the ID token it is answered with, like an authorization code.
+// The session is marked as a device authorization, as the authorization
+// request had no nonce.
+func (p *OIDCProvider) RedeemDeviceCode(ctx context.Context, deviceCode string) (*sessions.SessionState, error) {
+	token, err := p.redeemDeviceCode(ctx, deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	s, err := p.createSession(ctx, token, false)
+	if err != nil {
+		return nil, err
+	}
+	s.DeviceAuthorization = true
+	return s, nil
+}
+
 // EnrichSession is called after Redeem to allow providers to enrich session fields
 // such as User, Email, Groups with provider specific API calls.
 func (p *OIDCProvider) EnrichSession(ctx context.Context, s *sessions.SessionState) error {
@@ -80,20 +98,22 @@ func (p *OIDCProvider) EnrichSession(ctx context.Context, s *sessions.SessionSta
 	return nil
 }
 
-// ValidateSession checks that the session's IDToken is still valid
+// ValidateSession checks that the session's IDToken is still valid.
+// The nonce isn't checked for sessions of device authorizations, which are
+// requested without one.
 func (p *OIDCProvider) ValidateSession(ctx context.Context, s *sessions.SessionState) bool {
 	_, err := p.Verifier.Verify(ctx, s.IDToken)
 	if err != nil {
-		logger.Errorf("id_token verification failed: %v", err)
+		logger.ErrorfContext(ctx, "id_token verification failed: %v", err)
 		return false
 	}
 
-	if p.SkipNonce {
+	if p.SkipNonce || s.DeviceAuthorization {
 		return true
 	}
-	err = p.checkNonce(s)
+	err = p.checkNonce(ctx, s)
 	if err != nil {
-		logger.Errorf("nonce verification failed: %v", err)
+		logger.ErrorfContext(ctx, "nonce verification failed: %v", err)
 		return false
 	}
 
@@ -152,6 +172,7 @@ func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sessi
 		s.User = newSession.User
 		s.Groups = newSession.Groups
 		s.PreferredUsername = newSession.PreferredUsername
+		s.Claims = newSession.Claims
 	}
 
 	s.AccessToken = newSession.AccessToken
@@ -169,7 +190,7 @@ func (p *OIDCProvider) CreateSessionFromToken(ctx context.Context, token string)
 		return nil, err
 	}
 
-	ss, err := p.buildSessionFromClaims(token, "")
+	ss, err := p.buildSessionFromClaims(ctx, token, "")
 	if err != nil {
 		return nil, err
 	}
@@ -182,6 +203,10 @@ func (p *OIDCProvider) CreateSessionFromToken(ctx context.Context, token string)
 	ss.AccessToken = token
 	ss.IDToken = token
 	ss.RefreshToken = ""
+	ss.BearerToken, err = middleware.NewBearerToken(idToken)
+	if err != nil {
+		return nil, err
+	}
 
 	ss.CreatedAtNow()
 	ss.SetExpiresOn(idToken.Expiry)
@@ -206,7 +231,7 @@ func (p *OIDCProvider) createSession(ctx context.Context, token *oauth2.Token, r
 	}
 
 	rawIDToken := getIDToken(token)
-	ss, err := p.buildSessionFromClaims(rawIDToken, token.AccessToken)
+	ss, err := p.buildSessionFromClaims(ctx, rawIDToken, token.AccessToken)
 	if err != nil {
 		return nil, err
 	}
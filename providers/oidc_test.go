@@ -3,7 +3,6 @@ package providers
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -15,6 +14,7 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	internaloidc "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/testutil/fakeidp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -106,66 +106,111 @@ func TestOIDCProviderGetLoginURL(t *testing.T) {
 	assert.NotContains(t, withNonce, "code_challenge_method")
 }
 
-func TestOIDCProviderRedeem(t *testing.T) {
-	idToken, _ := newSignedTestIDToken(defaultIDToken)
-	body, _ := json.Marshal(redeemTokenResponse{
-		AccessToken:  accessToken,
-		ExpiresIn:    10,
-		TokenType:    "Bearer",
-		RefreshToken: refreshToken,
-		IDToken:      idToken,
+// newFakeIdPOIDCSetup starts a fake identity provider for the user of the
+// default ID token, and an OIDCProvider redeeming its codes and verifying its
+// ID tokens with its JWKS
+func newFakeIdPOIDCSetup(t *testing.T, opts fakeidp.Options) (*fakeidp.Server, *OIDCProvider) {
+	opts.ClientID = oidcClientID
+	opts.ClientSecret = oidcSecret
+	opts.Claims = map[string]interface{}{
+		"sub":          defaultIDToken.Subject,
+		"email":        defaultIDToken.Email,
+		"phone_number": defaultIDToken.Phone,
+		"groups":       defaultIDToken.Groups,
+	}
+	server, err := fakeidp.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.Issuer())
+	provider := newOIDCProvider(serverURL, false)
+	provider.RedeemURL, _ = url.Parse(server.TokenEndpoint())
+	provider.ProfileURL, _ = url.Parse(server.UserInfoEndpoint())
+	provider.Verifier = internaloidc.NewVerifier(oidc.NewVerifier(
+		server.Issuer(),
+		oidc.NewRemoteKeySet(context.Background(), server.JWKSEndpoint()),
+		&oidc.Config{ClientID: oidcClientID},
+	), internaloidc.IDTokenVerificationOptions{
+		AudienceClaims: []string{"aud"},
+		ClientID:       oidcClientID,
 	})
+	return server, provider
+}
+
+// fakeIdPLogin signs in to the fake identity provider, returning the code of
+// the authorization
+func fakeIdPLogin(t *testing.T, server *fakeidp.Server, provider *OIDCProvider) string {
+	loginURL, _ := url.Parse(server.AuthorizationEndpoint())
+	loginURL.RawQuery = url.Values{
+		"client_id":     {provider.ClientID},
+		"redirect_uri":  {fakeIdPRedirectURL},
+		"response_type": {"code"},
+		"scope":         {provider.Scope},
+	}.Encode()
 
-	server, provider := newTestOIDCSetup(body)
-	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(loginURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code")
+}
+
+const fakeIdPRedirectURL = "https://myapp.com/oauth2/callback"
 
-	session, err := provider.Redeem(context.Background(), provider.RedeemURL.String(), "code1234", "")
+func TestOIDCProviderRedeem(t *testing.T) {
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{})
+
+	session, err := provider.Redeem(context.Background(), fakeIdPRedirectURL, fakeIdPLogin(t, server, provider), "")
 	assert.Equal(t, nil, err)
 	assert.Equal(t, defaultIDToken.Email, session.Email)
-	assert.Equal(t, accessToken, session.AccessToken)
-	assert.Equal(t, idToken, session.IDToken)
-	assert.Equal(t, refreshToken, session.RefreshToken)
+	assert.NotEmpty(t, session.AccessToken)
+	assert.NotEmpty(t, session.IDToken)
+	assert.NotEmpty(t, session.RefreshToken)
 	assert.Equal(t, "123456789", session.User)
+	assert.Equal(t, []string{"test:a", "test:b"}, session.Groups)
 }
 
 func TestOIDCProviderRedeem_custom_userid(t *testing.T) {
-	idToken, _ := newSignedTestIDToken(defaultIDToken)
-	body, _ := json.Marshal(redeemTokenResponse{
-		AccessToken:  accessToken,
-		ExpiresIn:    10,
-		TokenType:    "Bearer",
-		RefreshToken: refreshToken,
-		IDToken:      idToken,
-	})
-
-	server, provider := newTestOIDCSetup(body)
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{})
 	provider.EmailClaim = "phone_number"
-	defer server.Close()
 
-	session, err := provider.Redeem(context.Background(), provider.RedeemURL.String(), "code1234", "")
+	session, err := provider.Redeem(context.Background(), fakeIdPRedirectURL, fakeIdPLogin(t, server, provider), "")
 	assert.Equal(t, nil, err)
 	assert.Equal(t, defaultIDToken.Phone, session.Email)
 }
 
-func TestOIDCProviderRefreshSessionIfNeededWithoutIdToken(t *testing.T) {
+func TestOIDCProviderRedeemCodeTwice(t *testing.T) {
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{})
+	code := fakeIdPLogin(t, server, provider)
 
-	idToken, _ := newSignedTestIDToken(defaultIDToken)
-	body, _ := json.Marshal(redeemTokenResponse{
-		AccessToken:  accessToken,
-		ExpiresIn:    10,
-		TokenType:    "Bearer",
-		RefreshToken: refreshToken,
-	})
+	_, err := provider.Redeem(context.Background(), fakeIdPRedirectURL, code, "")
+	assert.NoError(t, err)
+	_, err = provider.Redeem(context.Background(), fakeIdPRedirectURL, code, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid_grant")
+}
 
-	server, provider := newTestOIDCSetup(body)
-	defer server.Close()
+func TestOIDCProviderRefreshSessionIfNeededWithoutIdToken(t *testing.T) {
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{OmitRefreshIDToken: true})
+	session, err := provider.Redeem(context.Background(), fakeIdPRedirectURL, fakeIdPLogin(t, server, provider), "")
+	assert.NoError(t, err)
 
 	existingSession := &sessions.SessionState{
 		AccessToken:  "changeit",
-		IDToken:      idToken,
+		IDToken:      session.IDToken,
 		CreatedAt:    nil,
 		ExpiresOn:    nil,
-		RefreshToken: refreshToken,
+		RefreshToken: session.RefreshToken,
 		Email:        "janedoe@example.com",
 		User:         "11223344",
 	}
@@ -174,32 +219,24 @@ func TestOIDCProviderRefreshSessionIfNeededWithoutIdToken(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, refreshed, true)
 	assert.Equal(t, "janedoe@example.com", existingSession.Email)
-	assert.Equal(t, accessToken, existingSession.AccessToken)
-	assert.Equal(t, idToken, existingSession.IDToken)
-	assert.Equal(t, refreshToken, existingSession.RefreshToken)
+	assert.NotEqual(t, "changeit", existingSession.AccessToken)
+	assert.NotEqual(t, session.AccessToken, existingSession.AccessToken)
+	assert.Equal(t, session.IDToken, existingSession.IDToken)
+	assert.Equal(t, session.RefreshToken, existingSession.RefreshToken)
 	assert.Equal(t, "11223344", existingSession.User)
 }
 
 func TestOIDCProviderRefreshSessionIfNeededWithIdToken(t *testing.T) {
-
-	idToken, _ := newSignedTestIDToken(defaultIDToken)
-	body, _ := json.Marshal(redeemTokenResponse{
-		AccessToken:  accessToken,
-		ExpiresIn:    10,
-		TokenType:    "Bearer",
-		RefreshToken: refreshToken,
-		IDToken:      idToken,
-	})
-
-	server, provider := newTestOIDCSetup(body)
-	defer server.Close()
+	server, provider := newFakeIdPOIDCSetup(t, fakeidp.Options{RotateRefreshTokens: true})
+	session, err := provider.Redeem(context.Background(), fakeIdPRedirectURL, fakeIdPLogin(t, server, provider), "")
+	assert.NoError(t, err)
 
 	existingSession := &sessions.SessionState{
 		AccessToken:  "changeit",
 		IDToken:      "changeit",
 		CreatedAt:    nil,
 		ExpiresOn:    nil,
-		RefreshToken: refreshToken,
+		RefreshToken: session.RefreshToken,
 		Email:        "changeit",
 		User:         "changeit",
 	}
@@ -208,9 +245,15 @@ func TestOIDCProviderRefreshSessionIfNeededWithIdToken(t *testing.T) {
 	assert.Equal(t, refreshed, true)
 	assert.Equal(t, defaultIDToken.Email, existingSession.Email)
 	assert.Equal(t, defaultIDToken.Subject, existingSession.User)
-	assert.Equal(t, accessToken, existingSession.AccessToken)
-	assert.Equal(t, idToken, existingSession.IDToken)
-	assert.Equal(t, refreshToken, existingSession.RefreshToken)
+	assert.NotEqual(t, "changeit", existingSession.AccessToken)
+	assert.NotEqual(t, "changeit", existingSession.IDToken)
+	assert.NotEqual(t, session.RefreshToken, existingSession.RefreshToken)
+
+	// The rotated refresh token can't be used again
+	existingSession.RefreshToken = session.RefreshToken
+	_, err = provider.RefreshSession(context.Background(), existingSession)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid_grant")
 }
 
 func TestOIDCProviderCreateSessionFromToken(t *testing.T) {
@@ -220,6 +263,7 @@ func TestOIDCProviderCreateSessionFromToken(t *testing.T) {
 		ExpectedUser   string
 		ExpectedEmail  string
 		ExpectedGroups []string
+		ExpectedScopes []string
 	}{
 		"Default IDToken": {
 			IDToken:        defaultIDToken,
@@ -253,6 +297,16 @@ func TestOIDCProviderCreateSessionFromToken(t *testing.T) {
 				"Just::A::String",
 			},
 		},
+		"IDToken with a scp claim": {
+			IDToken: idTokenClaims{
+				Scp:            []string{"reports:read", "reports:write"},
+				StandardClaims: standardClaims,
+			},
+			GroupsClaim:    "groups",
+			ExpectedUser:   "123456789",
+			ExpectedEmail:  "123456789",
+			ExpectedScopes: []string{"reports:read", "reports:write"},
+		},
 	}
 	for testName, tc := range testCases {
 		t.Run(testName, func(t *testing.T) {
@@ -272,6 +326,10 @@ func TestOIDCProviderCreateSessionFromToken(t *testing.T) {
 			assert.Equal(t, rawIDToken, ss.IDToken)
 			assert.Equal(t, rawIDToken, ss.AccessToken)
 			assert.Equal(t, "", ss.RefreshToken)
+			assert.Equal(t, &sessions.BearerToken{
+				Audiences: []string{oidcClientID},
+				Scopes:    tc.ExpectedScopes,
+			}, ss.BearerToken)
 		})
 	}
 }
@@ -0,0 +1,247 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
+)
+
+const (
+	oktaProviderName = "Okta"
+
+	// oktaDefaultScope requests a refresh token and access to the user's own
+	// groups through the Okta API
+	oktaDefaultScope = "openid email profile offline_access okta.users.read.self"
+
+	// oktaGroupsPath lists the groups of the user the access token was issued to
+	oktaGroupsPath = "/api/v1/users/me/groups"
+
+	// oktaGroupsPageSize is the number of groups requested per page
+	oktaGroupsPageSize = 200
+
+	// oktaRateLimitResetHeader is the time, in epoch seconds, at which the
+	// rate limit exceeded by a request resets
+	oktaRateLimitResetHeader = "X-Rate-Limit-Reset"
+
+	// oktaMaxRetries is the number of times a rate limited request is retried
+	oktaMaxRetries = 3
+
+	// oktaMaxRetryWait is the longest time to wait for a rate limit to reset
+	// before retrying, so that logins aren't held up indefinitely
+	oktaMaxRetryWait = 10 * time.Second
+)
+
+// OktaProvider represents an Okta based Identity Provider.
+// Groups are read from the Okta API as Okta only includes them in ID tokens if
+// a groups claim has been configured on the authorization server.
+type OktaProvider struct {
+	*OIDCProvider
+
+	groupsURL *url.URL
+	clock     clock.Clock
+}
+
+var _ Provider = (*OktaProvider)(nil)
+
+// NewOktaProvider initiates a new OktaProvider
+func NewOktaProvider(p *ProviderData, opts options.OIDCOptions) *OktaProvider {
+	p.ProviderName = oktaProviderName
+	p.getAuthorizationHeaderFunc = makeOIDCHeader
+
+	provider := &OktaProvider{
+		OIDCProvider: &OIDCProvider{
+			ProviderData: p,
+			SkipNonce:    opts.InsecureSkipNonce,
+		},
+	}
+
+	// The Okta API is served from the org URL, which is the host of the
+	// authorization server endpoints. The revocation endpoint sits next to
+	// the token endpoint for both the org and custom authorization servers,
+	// and is used unless one has been configured or discovered.
+	if p.RedeemURL != nil && p.RedeemURL.Host != "" {
+		provider.groupsURL = &url.URL{
+			Scheme: p.RedeemURL.Scheme,
+			Host:   p.RedeemURL.Host,
+			Path:   oktaGroupsPath,
+		}
+		if p.RevocationURL == nil || p.RevocationURL.String() == "" {
+			revokeURL := *p.RedeemURL
+			revokeURL.Path = strings.TrimSuffix(revokeURL.Path, "/token") + "/revoke"
+			p.RevocationURL = &revokeURL
+		}
+	}
+
+	return provider
+}
+
+// EnrichSession adds the user's Okta groups to the session.
+// The code has already been redeemed, so the user is still signed in with the
+// groups of the ID token when the Okta API can't be reached.
+func (p *OktaProvider) EnrichSession(ctx context.Context, s *sessions.SessionState) error {
+	if err := p.OIDCProvider.EnrichSession(ctx, s); err != nil {
+		return err
+	}
+	if err := p.addGroups(ctx, s); err != nil {
+		logger.ErrorfContext(ctx, "Error adding the Okta groups of %s to the session: %v", s.Email, err)
+	}
+	return nil
+}
+
+// RefreshSession uses the RefreshToken to fetch new Access and ID Tokens, and
+// fetches the user's groups again so that membership changes are picked up.
+// The previous refresh token is spent once the tokens are refreshed, so the
+// refreshed tokens are kept with the previous groups when the groups can't be
+// fetched.
+func (p *OktaProvider) RefreshSession(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	groups := s.Groups
+	refreshed, err := p.OIDCProvider.RefreshSession(ctx, s)
+	if err != nil || !refreshed {
+		return refreshed, err
+	}
+	if err := p.addGroups(ctx, s); err != nil {
+		logger.ErrorfContext(ctx, "Error refreshing the Okta groups of %s, keeping the previous groups: %v", s.Email, err)
+		s.Groups = groups
+	}
+	return true, nil
+}
+
+// RevokeSession revokes the tokens of the session, retrying when rate limited
+func (p *OktaProvider) RevokeSession(ctx context.Context, s *sessions.SessionState) error {
+	return p.revokeSession(ctx, s, p.doWithRetry)
+}
+
+// addGroups adds the groups from the Okta API to any groups already read from
+// the ID token
+func (p *OktaProvider) addGroups(ctx context.Context, s *sessions.SessionState) error {
+	if p.groupsURL == nil || s.AccessToken == "" {
+		return nil
+	}
+
+	groups, err := p.getGroups(ctx, s.AccessToken)
+	if err != nil {
+		return fmt.Errorf("could not get groups from Okta: %v", err)
+	}
+
+	seen := make(map[string]struct{}, len(s.Groups))
+	for _, group := range s.Groups {
+		seen[group] = struct{}{}
+	}
+	for _, group := range groups {
+		if _, ok := seen[group]; !ok {
+			seen[group] = struct{}{}
+			s.Groups = append(s.Groups, group)
+		}
+	}
+	return nil
+}
+
+// getGroups lists the names of all groups the user is a member of, following
+// the pagination links of the Okta API
+func (p *OktaProvider) getGroups(ctx context.Context, accessToken string) ([]string, error) {
+	endpoint := *p.groupsURL
+	endpoint.RawQuery = url.Values{"limit": {strconv.Itoa(oktaGroupsPageSize)}}.Encode()
+	next := endpoint.String()
+
+	var groups []string
+	for next != "" {
+		pageURL := next
+		result, err := p.doWithRetry(ctx, func() requests.Result {
+			return requests.New(pageURL).
+				WithContext(ctx).
+				WithHeaders(makeOIDCHeader(accessToken)).
+				Do()
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page []struct {
+			Profile struct {
+				Name string `json:"name"`
+			} `json:"profile"`
+		}
+		if err := result.UnmarshalInto(&page); err != nil {
+			return nil, err
+		}
+		for _, group := range page {
+			groups = append(groups, group.Profile.Name)
+		}
+
+		next, err = p.nextPage(result.Headers())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// nextPage returns the URL of the next page from the Link headers of a
+// response, or an empty string if this was the last page.
+// The access token is only ever sent to the Okta org the groups URL is on.
+func (p *OktaProvider) nextPage(header http.Header) (string, error) {
+	for _, link := range header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			segments := strings.Split(part, ";")
+			if len(segments) < 2 || strings.TrimSpace(segments[1]) != `rel="next"` {
+				continue
+			}
+
+			raw := strings.Trim(strings.TrimSpace(segments[0]), "<>")
+			next, err := url.Parse(raw)
+			if err != nil {
+				return "", fmt.Errorf("could not parse next page URL: %v", err)
+			}
+			if next.Scheme != p.groupsURL.Scheme || next.Host != p.groupsURL.Host {
+				return "", fmt.Errorf("next page URL %q is not on the Okta org %q", raw, p.groupsURL.Host)
+			}
+			return raw, nil
+		}
+	}
+	return "", nil
+}
+
+// doWithRetry makes a request to Okta, retrying it when it was rate limited.
+// Requests are retried once the rate limit resets, or with an exponential
+// backoff if Okta didn't say when that is.
+func (p *OktaProvider) doWithRetry(ctx context.Context, do func() requests.Result) (requests.Result, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		result := do()
+		if result.Error() != nil {
+			return nil, result.Error()
+		}
+		if result.StatusCode() != http.StatusTooManyRequests {
+			return result, nil
+		}
+		if attempt == oktaMaxRetries {
+			return nil, fmt.Errorf("rate limited by Okta after %d retries", oktaMaxRetries)
+		}
+
+		wait := backoff
+		if reset, err := strconv.ParseInt(result.Headers().Get(oktaRateLimitResetHeader), 10, 64); err == nil {
+			wait = time.Unix(reset, 0).Sub(p.clock.Now())
+		}
+		if wait > oktaMaxRetryWait {
+			return nil, fmt.Errorf("rate limited by Okta until %s", p.clock.Now().Add(wait).Format(time.RFC3339))
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-p.clock.After(wait):
+			}
+		}
+		backoff *= 2
+	}
+}
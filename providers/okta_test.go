@@ -0,0 +1,212 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/gomega"
+)
+
+func newOktaProvider(serverURL *url.URL) *OktaProvider {
+	providerData := &ProviderData{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcSecret,
+		RedeemURL: &url.URL{
+			Scheme: serverURL.Scheme,
+			Host:   serverURL.Host,
+			Path:   "/oauth2/default/v1/token"},
+	}
+	return NewOktaProvider(providerData, options.OIDCOptions{})
+}
+
+func TestNewOktaProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	provider := newOktaProvider(&url.URL{Scheme: "https", Host: "example.okta.com"})
+	g.Expect(provider.Data().ProviderName).To(Equal("Okta"))
+	g.Expect(provider.groupsURL.String()).To(Equal("https://example.okta.com/api/v1/users/me/groups"))
+	g.Expect(provider.Data().RevocationURL.String()).To(Equal("https://example.okta.com/oauth2/default/v1/revoke"))
+}
+
+func TestOktaProviderEnrichSession(t *testing.T) {
+	testCases := map[string]struct {
+		rateLimited    bool
+		nextPageHost   string
+		existingGroups []string
+		expectedGroups []string
+	}{
+		"With multiple pages of groups": {
+			expectedGroups: []string{"Everyone", "admins", "developers"},
+		},
+		"With groups from the ID token": {
+			existingGroups: []string{"admins", "from-token"},
+			expectedGroups: []string{"admins", "from-token", "Everyone", "developers"},
+		},
+		"When rate limited": {
+			rateLimited:    true,
+			expectedGroups: []string{"Everyone", "admins", "developers"},
+		},
+		"With a next page on another host": {
+			nextPageHost:   "attacker.example.com",
+			existingGroups: []string{"from-token"},
+			expectedGroups: []string{"from-token"},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var provider *OktaProvider
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+				g.Expect(req.URL.Path).To(Equal("/api/v1/users/me/groups"))
+				g.Expect(req.Header.Get("Authorization")).To(Equal("Bearer " + accessToken))
+
+				if tc.rateLimited && calls == 1 {
+					rw.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(provider.clock.Now().Unix(), 10))
+					rw.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+
+				rw.Header().Add("content-type", "application/json")
+				switch req.URL.Query().Get("after") {
+				case "":
+					nextPageHost := tc.nextPageHost
+					if nextPageHost == "" {
+						nextPageHost = req.Host
+					}
+					rw.Header().Add("Link", fmt.Sprintf(`<http://%s/api/v1/users/me/groups?limit=200>; rel="self"`, req.Host))
+					rw.Header().Add("Link", fmt.Sprintf(`<http://%s/api/v1/users/me/groups?after=00g2&limit=200>; rel="next"`, nextPageHost))
+					_, _ = rw.Write([]byte(`[{"id": "00g1", "profile": {"name": "Everyone"}}, {"id": "00g2", "profile": {"name": "admins"}}]`))
+				default:
+					_, _ = rw.Write([]byte(`[{"id": "00g3", "profile": {"name": "developers"}}]`))
+				}
+			}))
+			defer server.Close()
+			serverURL, err := url.Parse(server.URL)
+			g.Expect(err).ToNot(HaveOccurred())
+			provider = newOktaProvider(serverURL)
+			provider.clock.Set(time.Unix(1650000000, 0))
+
+			session := &sessions.SessionState{
+				Email:       "jane.doe@example.com",
+				AccessToken: accessToken,
+				Groups:      tc.existingGroups,
+			}
+			err = provider.EnrichSession(context.Background(), session)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(session.Groups).To(Equal(tc.expectedGroups))
+		})
+	}
+}
+
+func TestOktaProviderRateLimitWait(t *testing.T) {
+	g := NewWithT(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(1650000060, 10))
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newOktaProvider(serverURL)
+	provider.clock.Set(time.Unix(1650000000, 0))
+
+	// Logins aren't held up until a distant rate limit reset
+	session := &sessions.SessionState{Email: "jane.doe@example.com", AccessToken: accessToken}
+	g.Expect(provider.addGroups(context.Background(), session)).To(MatchError("could not get groups from Okta: rate limited by Okta until " + time.Unix(1650000060, 0).Format(time.RFC3339)))
+
+	// The user is still signed in, without the groups of the Okta API
+	g.Expect(provider.EnrichSession(context.Background(), session)).To(Succeed())
+	g.Expect(session.Groups).To(BeEmpty())
+}
+
+func TestOktaProviderRefreshSession(t *testing.T) {
+	g := NewWithT(t)
+
+	groupsStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("content-type", "application/json")
+		switch req.URL.Path {
+		case "/oauth2/default/v1/token":
+			_, _ = rw.Write([]byte(`{"access_token": "new-access-token", "refresh_token": "new-refresh-token", "token_type": "Bearer", "expires_in": 3600}`))
+		case "/api/v1/users/me/groups":
+			rw.WriteHeader(groupsStatus)
+			_, _ = rw.Write([]byte(`[{"id": "00g1", "profile": {"name": "Everyone"}}, {"id": "00g3", "profile": {"name": "developers"}}]`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newOktaProvider(serverURL)
+
+	session := &sessions.SessionState{
+		Email:        "jane.doe@example.com",
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Groups:       []string{"Everyone"},
+	}
+	refreshed, err := provider.RefreshSession(context.Background(), session)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(refreshed).To(BeTrue())
+	g.Expect(session.Groups).To(Equal([]string{"Everyone", "developers"}))
+
+	// The refreshed tokens are kept when the groups can't be fetched, as the
+	// previous refresh token has been spent
+	groupsStatus = http.StatusInternalServerError
+	session = &sessions.SessionState{
+		Email:        "jane.doe@example.com",
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Groups:       []string{"admins"},
+	}
+	refreshed, err = provider.RefreshSession(context.Background(), session)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(refreshed).To(BeTrue())
+	g.Expect(session.AccessToken).To(Equal("new-access-token"))
+	g.Expect(session.RefreshToken).To(Equal("new-refresh-token"))
+	g.Expect(session.Groups).To(Equal([]string{"admins"}))
+}
+
+func TestOktaProviderRevokeSession(t *testing.T) {
+	g := NewWithT(t)
+
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		g.Expect(req.Method).To(Equal(http.MethodPost))
+		g.Expect(req.URL.Path).To(Equal("/oauth2/default/v1/revoke"))
+		g.Expect(req.ParseForm()).To(Succeed())
+		form = req.PostForm
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	provider := newOktaProvider(serverURL)
+
+	err = provider.RevokeSession(context.Background(), &sessions.SessionState{RefreshToken: refreshToken})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(form.Get("token")).To(Equal(refreshToken))
+	g.Expect(form.Get("token_type_hint")).To(Equal("refresh_token"))
+	g.Expect(form.Get("client_id")).To(Equal(oidcClientID))
+	g.Expect(form.Get("client_secret")).To(Equal(oidcSecret))
+
+	// Sessions without a refresh token have nothing to revoke
+	form = nil
+	err = provider.RevokeSession(context.Background(), &sessions.SessionState{AccessToken: accessToken})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(form).To(BeNil())
+}
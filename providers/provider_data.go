@@ -33,10 +33,23 @@ type ProviderData struct {
 	ProfileURL        *url.URL
 	ProtectedResource *url.URL
 	ValidateURL       *url.URL
-	ClientID          string
-	ClientSecret      string
-	ClientSecretFile  string
-	Scope             string
+	RevocationURL     *url.URL
+	// DeviceAuthorizationURL is the device authorization endpoint of the
+	// device authorization grant (RFC 8628)
+	DeviceAuthorizationURL *url.URL
+	ClientID               string
+	ClientSecret           string
+	ClientSecretFile       string
+	Scope                  string
+	// RevokeAccessToken revokes the access token of sessions along with their
+	// refresh token
+	RevokeAccessToken bool
+	// EndSessionURL is the end session endpoint users are redirected to when
+	// they sign out, set when RP-initiated logout is enabled
+	EndSessionURL *url.URL
+	// PostLogoutRedirectURL is where the end session endpoint returns users to,
+	// instead of the sign out redirect
+	PostLogoutRedirectURL string
 	// The picked CodeChallenge Method or empty if none.
 	CodeChallengeMethod string
 	// Code challenge methods supported by the Provider
@@ -44,16 +57,28 @@ type ProviderData struct {
 
 	// Common OIDC options for any OIDC-based providers to consume
 	AllowUnverifiedEmail bool
+	EmailVerifiedClaim   string
+	EmailVerification    options.EmailVerificationMode
 	UserClaim            string
 	EmailClaim           string
 	GroupsClaim          string
 	Verifier             internaloidc.IDTokenVerifier
+	// LogoutTokenVerifier verifies the logout tokens of back-channel logout,
+	// it is set for the providers with an ID token Verifier
+	LogoutTokenVerifier internaloidc.LogoutTokenVerifier
+	// StoreClaims are the claim paths copied into the session, all other
+	// claims are dropped
+	StoreClaims []string
 
 	// Universal Group authorization data structure
 	// any provider can set to consume
 	AllowedGroups map[string]struct{}
+	// Universal Group deny list, members of these groups are denied even if
+	// they are members of an allowed group
+	DeniedGroups map[string]struct{}
 
 	getAuthorizationHeaderFunc func(string) http.Header
+	getClientSecretFunc        func() (string, error)
 	loginURLParameterDefaults  url.Values
 	loginURLParameterOverrides map[string]*regexp.Regexp
 }
@@ -62,6 +87,11 @@ type ProviderData struct {
 func (p *ProviderData) Data() *ProviderData { return p }
 
 func (p *ProviderData) GetClientSecret() (clientSecret string, err error) {
+	// Some providers generate their client secrets rather than configuring them
+	if p.getClientSecretFunc != nil {
+		return p.getClientSecretFunc()
+	}
+
 	if p.ClientSecret != "" || p.ClientSecretFile == "" {
 		return p.ClientSecret, nil
 	}
@@ -178,6 +208,14 @@ func (p *ProviderData) setAllowedGroups(groups []string) {
 	}
 }
 
+// setDeniedGroups organizes a group list into the DeniedGroups map
+func (p *ProviderData) setDeniedGroups(groups []string) {
+	p.DeniedGroups = make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		p.DeniedGroups[group] = struct{}{}
+	}
+}
+
 type providerDefaults struct {
 	name        string
 	loginURL    *url.URL
@@ -235,14 +273,14 @@ func (p *ProviderData) verifyIDToken(ctx context.Context, token *oauth2.Token) (
 
 // buildSessionFromClaims uses IDToken claims to populate a fresh SessionState
 // with non-Token related fields.
-func (p *ProviderData) buildSessionFromClaims(rawIDToken, accessToken string) (*sessions.SessionState, error) {
+func (p *ProviderData) buildSessionFromClaims(ctx context.Context, rawIDToken, accessToken string) (*sessions.SessionState, error) {
 	ss := &sessions.SessionState{}
 
 	if rawIDToken == "" {
 		return ss, nil
 	}
 
-	extractor, err := p.getClaimExtractor(rawIDToken, accessToken)
+	extractor, err := p.getClaimExtractor(ctx, rawIDToken, accessToken)
 	if err != nil {
 		return nil, err
 	}
@@ -263,25 +301,37 @@ func (p *ProviderData) buildSessionFromClaims(rawIDToken, accessToken string) (*
 		}
 	}
 
-	// `email_verified` must be present and explicitly set to `false` to be
-	// considered unverified.
+	if len(p.StoreClaims) > 0 {
+		ss.Claims, err = util.SelectClaims(extractor, p.StoreClaims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Unless the verified claim is required, it must be present and explicitly
+	// set to `false` to be considered unverified.
 	verifyEmail := (p.EmailClaim == options.OIDCEmailClaim) && !p.AllowUnverifiedEmail
 
+	verifiedClaim := p.EmailVerifiedClaim
+	if verifiedClaim == "" {
+		verifiedClaim = options.OIDCEmailVerifiedClaim
+	}
+
 	var verified bool
-	exists, err := extractor.GetClaimInto("email_verified", &verified)
+	exists, err := extractor.GetClaimInto(verifiedClaim, &verified)
 	if err != nil {
 		return nil, err
 	}
 
-	if verifyEmail && exists && !verified {
-		return nil, fmt.Errorf("email in id_token (%s) isn't verified", ss.Email)
+	if verifyEmail && !verified && (exists || p.EmailVerification == options.EmailVerificationRequired) {
+		return nil, fmt.Errorf("%w: %s", ErrEmailNotVerified, ss.Email)
 	}
 
 	return ss, nil
 }
 
-func (p *ProviderData) getClaimExtractor(rawIDToken, accessToken string) (util.ClaimExtractor, error) {
-	extractor, err := util.NewClaimExtractor(context.TODO(), rawIDToken, p.ProfileURL, p.getAuthorizationHeader(accessToken))
+func (p *ProviderData) getClaimExtractor(ctx context.Context, rawIDToken, accessToken string) (util.ClaimExtractor, error) {
+	extractor, err := util.NewClaimExtractor(ctx, rawIDToken, p.ProfileURL, p.getAuthorizationHeader(accessToken))
 	if err != nil {
 		return nil, fmt.Errorf("could not initialise claim extractor: %v", err)
 	}
@@ -290,8 +340,8 @@ func (p *ProviderData) getClaimExtractor(rawIDToken, accessToken string) (util.C
 }
 
 // checkNonce compares the session's nonce with the IDToken's nonce claim
-func (p *ProviderData) checkNonce(s *sessions.SessionState) error {
-	extractor, err := p.getClaimExtractor(s.IDToken, "")
+func (p *ProviderData) checkNonce(ctx context.Context, s *sessions.SessionState) error {
+	extractor, err := p.getClaimExtractor(ctx, s.IDToken, "")
 	if err != nil {
 		return fmt.Errorf("id_token claims extraction failed: %v", err)
 	}
@@ -118,7 +118,12 @@ type idTokenClaims struct {
 	Groups   interface{} `json:"groups,omitempty"`
 	Roles    interface{} `json:"roles,omitempty"`
 	Verified *bool       `json:"email_verified,omitempty"`
-	Nonce    string      `json:"nonce,omitempty"`
+	Ext      interface{} `json:"ext,omitempty"`
+	Resource interface{} `json:"resource,omitempty"`
+	Scp      interface{} `json:"scp,omitempty"`
+	// RenamedVerified mimics a provider using a non-standard claim for email_verified
+	RenamedVerified *bool  `json:"emailVerified,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -232,14 +237,36 @@ func TestProviderData_verifyIDToken(t *testing.T) {
 }
 
 func TestProviderData_buildSessionFromClaims(t *testing.T) {
+	missingVerifiedIDToken := defaultIDToken
+	missingVerifiedIDToken.Verified = nil
+
+	renamedVerifiedIDToken := missingVerifiedIDToken
+	renamedVerifiedIDToken.RenamedVerified = &verified
+
+	renamedUnverifiedIDToken := unverifiedIDToken
+	renamedUnverifiedIDToken.Verified = nil
+	renamedUnverifiedIDToken.RenamedVerified = &unverified
+
+	nestedClaimsIDToken := defaultIDToken
+	nestedClaimsIDToken.Ext = map[string]interface{}{"uid": 42}
+	nestedClaimsIDToken.Resource = map[string]interface{}{
+		"roles": []interface{}{
+			map[string]interface{}{"name": "admin"},
+			map[string]interface{}{"name": "viewer"},
+		},
+	}
+
 	testCases := map[string]struct {
-		IDToken         idTokenClaims
-		AllowUnverified bool
-		UserClaim       string
-		EmailClaim      string
-		GroupsClaim     string
-		ExpectedError   error
-		ExpectedSession *sessions.SessionState
+		IDToken            idTokenClaims
+		AllowUnverified    bool
+		EmailVerifiedClaim string
+		EmailVerification  options.EmailVerificationMode
+		UserClaim          string
+		EmailClaim         string
+		GroupsClaim        string
+		StoreClaims        []string
+		ExpectedError      error
+		ExpectedSession    *sessions.SessionState
 	}{
 		"Standard": {
 			IDToken:         defaultIDToken,
@@ -259,7 +286,82 @@ func TestProviderData_buildSessionFromClaims(t *testing.T) {
 			AllowUnverified: false,
 			EmailClaim:      "email",
 			GroupsClaim:     "groups",
-			ExpectedError:   errors.New("email in id_token (unverified@email.com) isn't verified"),
+			ExpectedError:   errors.New("email in id_token isn't verified: unverified@email.com"),
+		},
+		"Unverified Denied With Claim Required": {
+			IDToken:           unverifiedIDToken,
+			EmailVerification: options.EmailVerificationRequired,
+			EmailClaim:        "email",
+			GroupsClaim:       "groups",
+			ExpectedError:     errors.New("email in id_token isn't verified: unverified@email.com"),
+		},
+		"Verified With Claim Required": {
+			IDToken:           defaultIDToken,
+			EmailVerification: options.EmailVerificationRequired,
+			EmailClaim:        "email",
+			GroupsClaim:       "groups",
+			UserClaim:         "sub",
+			ExpectedSession: &sessions.SessionState{
+				User:              "123456789",
+				Email:             "janed@me.com",
+				Groups:            []string{"test:a", "test:b"},
+				PreferredUsername: "Jane Dobbs",
+			},
+		},
+		"Missing Verified Claim Allowed If Present": {
+			IDToken:           missingVerifiedIDToken,
+			EmailVerification: options.EmailVerificationIfPresent,
+			EmailClaim:        "email",
+			GroupsClaim:       "groups",
+			UserClaim:         "sub",
+			ExpectedSession: &sessions.SessionState{
+				User:              "123456789",
+				Email:             "janed@me.com",
+				Groups:            []string{"test:a", "test:b"},
+				PreferredUsername: "Jane Dobbs",
+			},
+		},
+		"Missing Verified Claim Denied With Claim Required": {
+			IDToken:           missingVerifiedIDToken,
+			EmailVerification: options.EmailVerificationRequired,
+			EmailClaim:        "email",
+			GroupsClaim:       "groups",
+			ExpectedError:     errors.New("email in id_token isn't verified: janed@me.com"),
+		},
+		"Missing Verified Claim Allowed With Unverified Allowed": {
+			IDToken:           missingVerifiedIDToken,
+			AllowUnverified:   true,
+			EmailVerification: options.EmailVerificationRequired,
+			EmailClaim:        "email",
+			GroupsClaim:       "groups",
+			UserClaim:         "sub",
+			ExpectedSession: &sessions.SessionState{
+				User:              "123456789",
+				Email:             "janed@me.com",
+				Groups:            []string{"test:a", "test:b"},
+				PreferredUsername: "Jane Dobbs",
+			},
+		},
+		"Renamed Verified Claim": {
+			IDToken:            renamedVerifiedIDToken,
+			EmailVerifiedClaim: "emailVerified",
+			EmailVerification:  options.EmailVerificationRequired,
+			EmailClaim:         "email",
+			GroupsClaim:        "groups",
+			UserClaim:          "sub",
+			ExpectedSession: &sessions.SessionState{
+				User:              "123456789",
+				Email:             "janed@me.com",
+				Groups:            []string{"test:a", "test:b"},
+				PreferredUsername: "Jane Dobbs",
+			},
+		},
+		"Renamed Unverified Claim": {
+			IDToken:            renamedUnverifiedIDToken,
+			EmailVerifiedClaim: "emailVerified",
+			EmailClaim:         "email",
+			GroupsClaim:        "groups",
+			ExpectedError:      errors.New("email in id_token isn't verified: unverified@email.com"),
 		},
 		"Unverified Allowed": {
 			IDToken:         unverifiedIDToken,
@@ -369,6 +471,25 @@ func TestProviderData_buildSessionFromClaims(t *testing.T) {
 				PreferredUsername: "Jane Dobbs",
 			},
 		},
+		"Nested User And Groups Claim Paths": {
+			IDToken:     nestedClaimsIDToken,
+			EmailClaim:  "email",
+			GroupsClaim: "resource.roles[*].name",
+			UserClaim:   "ext.uid",
+			ExpectedSession: &sessions.SessionState{
+				User:              "42",
+				Email:             "janed@me.com",
+				Groups:            []string{"admin", "viewer"},
+				PreferredUsername: "Jane Dobbs",
+			},
+		},
+		"Groups Claim Path Selecting Objects": {
+			IDToken:       nestedClaimsIDToken,
+			EmailClaim:    "email",
+			GroupsClaim:   "resource.roles",
+			UserClaim:     "sub",
+			ExpectedError: errors.New("could not get claim \"resource.roles\": claim \"resource.roles\" is an array of objects: use a wildcard to select a field from each object, eg: resource.roles[*].name"),
+		},
 		"Groups Claim Non Existent": {
 			IDToken:         defaultIDToken,
 			AllowUnverified: false,
@@ -395,6 +516,24 @@ func TestProviderData_buildSessionFromClaims(t *testing.T) {
 				PreferredUsername: "Jane Dobbs",
 			},
 		},
+		"Store Claims": {
+			IDToken:         defaultIDToken,
+			AllowUnverified: false,
+			EmailClaim:      "email",
+			GroupsClaim:     "groups",
+			UserClaim:       "sub",
+			StoreClaims:     []string{"roles", "phone_number", "missing"},
+			ExpectedSession: &sessions.SessionState{
+				User:              "123456789",
+				Email:             "janed@me.com",
+				Groups:            []string{"test:a", "test:b"},
+				PreferredUsername: "Jane Dobbs",
+				Claims: map[string]interface{}{
+					"roles":        []interface{}{"test:c", "test:d"},
+					"phone_number": "+4798765432",
+				},
+			},
+		},
 		"Groups Claim string values": {
 			IDToken:         defaultIDToken,
 			AllowUnverified: false,
@@ -425,20 +564,24 @@ func TestProviderData_buildSessionFromClaims(t *testing.T) {
 				), verificationOptions),
 			}
 			provider.AllowUnverifiedEmail = tc.AllowUnverified
+			provider.EmailVerifiedClaim = tc.EmailVerifiedClaim
+			provider.EmailVerification = tc.EmailVerification
 			provider.UserClaim = tc.UserClaim
 			provider.EmailClaim = tc.EmailClaim
 			provider.GroupsClaim = tc.GroupsClaim
+			provider.StoreClaims = tc.StoreClaims
 
 			rawIDToken, err := newSignedTestIDToken(tc.IDToken)
 			g.Expect(err).ToNot(HaveOccurred())
 
-			ss, err := provider.buildSessionFromClaims(rawIDToken, "")
+			ss, err := provider.buildSessionFromClaims(context.Background(), rawIDToken, "")
 			if err != nil {
-				g.Expect(err).To(Equal(tc.ExpectedError))
+				g.Expect(err).To(MatchError(tc.ExpectedError.Error()))
 			}
 			if ss != nil {
 				g.Expect(ss).To(Equal(tc.ExpectedSession))
 			}
+			g.Expect(ss == nil).To(Equal(tc.ExpectedSession == nil))
 		})
 	}
 }
@@ -494,7 +637,7 @@ func TestProviderData_checkNonce(t *testing.T) {
 				), verificationOptions),
 			}
 
-			if err := provider.checkNonce(tc.Session); err != nil {
+			if err := provider.checkNonce(context.Background(), tc.Session); err != nil {
 				g.Expect(err).To(Equal(tc.ExpectedError))
 			} else {
 				g.Expect(err).ToNot(HaveOccurred())
@@ -5,7 +5,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -29,6 +32,10 @@ var (
 	// but an attempt to call `Verifier.Verify` was about to be made.
 	ErrMissingOIDCVerifier = errors.New("oidc verifier is not configured")
 
+	// ErrEmailNotVerified is returned when the email verified claim of an
+	// id_token doesn't verify the user's email.
+	ErrEmailNotVerified = errors.New("email in id_token isn't verified")
+
 	_ Provider = (*ProviderData)(nil)
 )
 
@@ -40,6 +47,37 @@ func (p *ProviderData) GetLoginURL(redirectURI, state, _ string, extraParams url
 	return loginURL.String()
 }
 
+// GetLogoutURL returns the end session endpoint of the provider when
+// RP-initiated logout is enabled, with the session's ID token as a hint of
+// the session to end. Otherwise it returns an empty URL as by default signing
+// out only clears the local session and doesn't sign the user out of the
+// provider.
+// The provider returns the user to the post logout redirect URL if it is set,
+// otherwise to the finalRedirect if it is an absolute URL.
+func (p *ProviderData) GetLogoutURL(s *sessions.SessionState, finalRedirect string) string {
+	if p.EndSessionURL == nil || p.EndSessionURL.String() == "" {
+		return ""
+	}
+
+	logoutURL := *p.EndSessionURL
+	params := logoutURL.Query()
+	params.Set("client_id", p.ClientID)
+	if s != nil && s.IDToken != "" {
+		params.Set("id_token_hint", s.IDToken)
+	}
+	postLogoutRedirect := p.PostLogoutRedirectURL
+	if postLogoutRedirect == "" {
+		if u, err := url.Parse(finalRedirect); err == nil && u.IsAbs() {
+			postLogoutRedirect = finalRedirect
+		}
+	}
+	if postLogoutRedirect != "" {
+		params.Set("post_logout_redirect_uri", postLogoutRedirect)
+	}
+	logoutURL.RawQuery = params.Encode()
+	return logoutURL.String()
+}
+
 // Redeem provides a default implementation of the OAuth2 token redemption process
 // The codeVerifier is set if a code_verifier parameter should be sent for PKCE
 func (p *ProviderData) Redeem(ctx context.Context, redirectURL, code, codeVerifier string) (*sessions.SessionState, error) {
@@ -139,6 +177,118 @@ func (p *ProviderData) RefreshSession(_ context.Context, _ *sessions.SessionStat
 	return false, ErrNotImplemented
 }
 
+// RevokeSession revokes the tokens of the session at the RFC 7009 revocation
+// endpoint, so that the grant doesn't outlive the session.
+// ErrNotImplemented is returned when the provider has no revocation endpoint,
+// as sessions are then only removed locally.
+func (p *ProviderData) RevokeSession(ctx context.Context, s *sessions.SessionState) error {
+	return p.revokeSession(ctx, s, func(_ context.Context, do func() requests.Result) (requests.Result, error) {
+		result := do()
+		return result, result.Error()
+	})
+}
+
+// revokeSession revokes the refresh token of the session, and its access token
+// when RevokeAccessToken is set, making the requests with the doFunc
+func (p *ProviderData) revokeSession(ctx context.Context, s *sessions.SessionState, doFunc func(context.Context, func() requests.Result) (requests.Result, error)) error {
+	if p.RevocationURL == nil || p.RevocationURL.String() == "" {
+		return ErrNotImplemented
+	}
+	if s == nil {
+		return nil
+	}
+
+	var tokens [][2]string
+	if s.RefreshToken != "" {
+		tokens = append(tokens, [2]string{"refresh_token", s.RefreshToken})
+	}
+	if p.RevokeAccessToken && s.AccessToken != "" {
+		tokens = append(tokens, [2]string{"access_token", s.AccessToken})
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	clientSecret, err := p.GetClientSecret()
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		tokenType := strings.Replace(token[0], "_", " ", 1)
+
+		params := url.Values{}
+		params.Add("token", token[1])
+		params.Add("token_type_hint", token[0])
+		params.Add("client_id", p.ClientID)
+		params.Add("client_secret", clientSecret)
+
+		result, err := doFunc(ctx, func() requests.Result {
+			return requests.New(p.RevocationURL.String()).
+				WithContext(ctx).
+				WithMethod("POST").
+				WithBody(bytes.NewBufferString(params.Encode())).
+				SetHeader("Content-Type", "application/x-www-form-urlencoded").
+				Do()
+		})
+		if err != nil {
+			return fmt.Errorf("could not revoke %s: %v", tokenType, err)
+		}
+		if result.StatusCode() != http.StatusOK {
+			return fmt.Errorf("could not revoke %s: got %d from %q: %s", tokenType, result.StatusCode(), p.RevocationURL, result.Body())
+		}
+	}
+	return nil
+}
+
+// ExchangeToken exchanges the access token of a session for an access token
+// for the audience and scopes at the token endpoint, with OAuth 2.0 token
+// exchange (RFC 8693). It returns the token and the duration it expires in,
+// zero when the provider doesn't say.
+func (p *ProviderData) ExchangeToken(ctx context.Context, subjectToken, audience string, scopes []string) (string, time.Duration, error) {
+	clientSecret, err := p.GetClientSecret()
+	if err != nil {
+		return "", 0, err
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	params.Add("subject_token", subjectToken)
+	params.Add("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	params.Add("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	params.Add("audience", audience)
+	if len(scopes) > 0 {
+		params.Add("scope", strings.Join(scopes, " "))
+	}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", clientSecret)
+
+	result := requests.New(p.RedeemURL.String()).
+		WithContext(ctx).
+		WithMethod("POST").
+		WithBody(bytes.NewBufferString(params.Encode())).
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		Do()
+	if result.Error() != nil {
+		return "", 0, result.Error()
+	}
+	if result.StatusCode() != http.StatusOK {
+		return "", 0, fmt.Errorf("got %d from %q: %s", result.StatusCode(), p.RedeemURL, result.Body())
+	}
+
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := result.UnmarshalInto(&response); err != nil {
+		return "", 0, fmt.Errorf("error parsing the token exchange response: %v", err)
+	}
+	if response.AccessToken == "" {
+		return "", 0, errors.New("no access token found in the token exchange response")
+	}
+	return response.AccessToken, time.Duration(response.ExpiresIn) * time.Second, nil
+}
+
 // CreateSessionFromToken converts Bearer IDTokens into sessions
 func (p *ProviderData) CreateSessionFromToken(ctx context.Context, token string) (*sessions.SessionState, error) {
 	if p.Verifier != nil {
@@ -2,6 +2,9 @@ package providers
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
@@ -30,6 +33,145 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, ErrNotImplemented, err)
 }
 
+func TestProviderDataRevokeSession(t *testing.T) {
+	g := NewWithT(t)
+
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		g.Expect(req.Method).To(Equal(http.MethodPost))
+		g.Expect(req.ParseForm()).To(Succeed())
+		forms = append(forms, req.PostForm)
+		if req.PostForm.Get("token") == "invalid" {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	revocationURL, err := url.Parse(server.URL + "/revoke")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// Providers without a revocation endpoint only remove sessions locally
+	p := &ProviderData{ClientID: "client", ClientSecret: "secret"}
+	err = p.RevokeSession(context.Background(), &sessions.SessionState{RefreshToken: "refresh"})
+	g.Expect(err).To(Equal(ErrNotImplemented))
+
+	p.RevocationURL = revocationURL
+	err = p.RevokeSession(context.Background(), &sessions.SessionState{AccessToken: "access", RefreshToken: "refresh"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(forms).To(Equal([]url.Values{
+		{"token": {"refresh"}, "token_type_hint": {"refresh_token"}, "client_id": {"client"}, "client_secret": {"secret"}},
+	}))
+
+	forms = nil
+	p.RevokeAccessToken = true
+	err = p.RevokeSession(context.Background(), &sessions.SessionState{AccessToken: "access", RefreshToken: "refresh"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(forms).To(Equal([]url.Values{
+		{"token": {"refresh"}, "token_type_hint": {"refresh_token"}, "client_id": {"client"}, "client_secret": {"secret"}},
+		{"token": {"access"}, "token_type_hint": {"access_token"}, "client_id": {"client"}, "client_secret": {"secret"}},
+	}))
+
+	err = p.RevokeSession(context.Background(), &sessions.SessionState{RefreshToken: "invalid"})
+	g.Expect(err).To(MatchError(HavePrefix("could not revoke refresh token: got 503 from")))
+}
+
+func TestProviderDataGetLogoutURL(t *testing.T) {
+	endSessionURL, err := url.Parse("https://idp.example.com/logout?ui_locales=en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		endSessionURL         *url.URL
+		postLogoutRedirectURL string
+		session               *sessions.SessionState
+		finalRedirect         string
+		expectedLogoutURL     string
+	}{
+		"without rp-initiated logout": {
+			session:           &sessions.SessionState{IDToken: "id_token"},
+			finalRedirect:     "https://app.example.com/",
+			expectedLogoutURL: "",
+		},
+		"with an ID token and an absolute redirect": {
+			endSessionURL:     endSessionURL,
+			session:           &sessions.SessionState{IDToken: "id_token"},
+			finalRedirect:     "https://app.example.com/",
+			expectedLogoutURL: "https://idp.example.com/logout?client_id=client&id_token_hint=id_token&post_logout_redirect_uri=https%3A%2F%2Fapp.example.com%2F&ui_locales=en",
+		},
+		"without a session and a relative redirect": {
+			endSessionURL:     endSessionURL,
+			finalRedirect:     "/",
+			expectedLogoutURL: "https://idp.example.com/logout?client_id=client&ui_locales=en",
+		},
+		"with a post logout redirect URL": {
+			endSessionURL:         endSessionURL,
+			postLogoutRedirectURL: "https://app.example.com/signed-out",
+			session:               &sessions.SessionState{},
+			finalRedirect:         "https://app.example.com/",
+			expectedLogoutURL:     "https://idp.example.com/logout?client_id=client&post_logout_redirect_uri=https%3A%2F%2Fapp.example.com%2Fsigned-out&ui_locales=en",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			g := NewWithT(t)
+			p := &ProviderData{
+				ClientID:              "client",
+				EndSessionURL:         tc.endSessionURL,
+				PostLogoutRedirectURL: tc.postLogoutRedirectURL,
+			}
+			g.Expect(p.GetLogoutURL(tc.session, tc.finalRedirect)).To(Equal(tc.expectedLogoutURL))
+		})
+	}
+}
+
+func TestProviderDataExchangeToken(t *testing.T) {
+	g := NewWithT(t)
+
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		g.Expect(req.Method).To(Equal(http.MethodPost))
+		g.Expect(req.ParseForm()).To(Succeed())
+		forms = append(forms, req.PostForm)
+		switch req.PostForm.Get("subject_token") {
+		case "expired":
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"error": "invalid_grant"}`))
+		case "empty":
+			_, _ = rw.Write([]byte(`{"token_type": "Bearer"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"access_token": "exchanged", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": 300}`))
+		}
+	}))
+	defer server.Close()
+	tokenURL, err := url.Parse(server.URL + "/token")
+	g.Expect(err).ToNot(HaveOccurred())
+	p := &ProviderData{ClientID: "client", ClientSecret: "secret", RedeemURL: tokenURL}
+
+	token, expiresIn, err := p.ExchangeToken(context.Background(), "access", "orders-api", []string{"orders:read", "orders:write"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("exchanged"))
+	g.Expect(expiresIn).To(Equal(5 * time.Minute))
+	g.Expect(forms).To(Equal([]url.Values{{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":        {"access"},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:access_token"},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"audience":             {"orders-api"},
+		"scope":                {"orders:read orders:write"},
+		"client_id":            {"client"},
+		"client_secret":        {"secret"},
+	}}))
+
+	_, _, err = p.ExchangeToken(context.Background(), "expired", "orders-api", nil)
+	g.Expect(err).To(MatchError(fmt.Sprintf(`got 400 from %q: {"error": "invalid_grant"}`, tokenURL)))
+
+	_, _, err = p.ExchangeToken(context.Background(), "empty", "orders-api", nil)
+	g.Expect(err).To(MatchError("no access token found in the token exchange response"))
+}
+
 func TestCodeChallengeConfigured(t *testing.T) {
 	p := &ProviderData{
 		LoginURL: &url.URL{
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 
@@ -21,7 +22,9 @@ const (
 type Provider interface {
 	Data() *ProviderData
 	GetLoginURL(redirectURI, finalRedirect, nonce string, extraParams url.Values) string
+	GetLogoutURL(s *sessions.SessionState, finalRedirect string) string
 	Redeem(ctx context.Context, redirectURI, code, codeVerifier string) (*sessions.SessionState, error)
+	RedeemDeviceCode(ctx context.Context, deviceCode string) (*sessions.SessionState, error)
 	// Deprecated: Migrate to EnrichSession
 	GetEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error)
 	EnrichSession(ctx context.Context, s *sessions.SessionState) error
@@ -29,9 +32,18 @@ type Provider interface {
 	ValidateSession(ctx context.Context, s *sessions.SessionState) bool
 	RefreshSession(ctx context.Context, s *sessions.SessionState) (bool, error)
 	CreateSessionFromToken(ctx context.Context, token string) (*sessions.SessionState, error)
+	RevokeSession(ctx context.Context, s *sessions.SessionState) error
 }
 
 func NewProvider(providerConfig options.Provider) (Provider, error) {
+	provider, err := newProvider(providerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newNormalizedGroupsProvider(provider, providerConfig.GroupsNormalization)
+}
+
+func newProvider(providerConfig options.Provider) (Provider, error) {
 	providerData, err := newProviderDataFromConfig(providerConfig)
 	if err != nil {
 		return nil, fmt.Errorf("could not create provider data: %v", err)
@@ -39,10 +51,14 @@ func NewProvider(providerConfig options.Provider) (Provider, error) {
 	switch providerConfig.Type {
 	case options.ADFSProvider:
 		return NewADFSProvider(providerData, providerConfig.ADFSConfig), nil
+	case options.AppleProvider:
+		return NewAppleProvider(providerData, providerConfig.AppleConfig)
 	case options.AzureProvider:
 		return NewAzureProvider(providerData, providerConfig.AzureConfig), nil
 	case options.BitbucketProvider:
 		return NewBitbucketProvider(providerData, providerConfig.BitbucketConfig), nil
+	case options.CognitoProvider:
+		return NewCognitoProvider(providerData, providerConfig.CognitoConfig), nil
 	case options.DigitalOceanProvider:
 		return NewDigitalOceanProvider(providerData), nil
 	case options.FacebookProvider:
@@ -65,6 +81,8 @@ func NewProvider(providerConfig options.Provider) (Provider, error) {
 		return NewNextcloudProvider(providerData), nil
 	case options.OIDCProvider:
 		return NewOIDCProvider(providerData, providerConfig.OIDCConfig), nil
+	case options.OktaProvider:
+		return NewOktaProvider(providerData, providerConfig.OIDCConfig), nil
 	default:
 		return nil, fmt.Errorf("unknown provider type %q", providerConfig.Type)
 	}
@@ -72,10 +90,11 @@ func NewProvider(providerConfig options.Provider) (Provider, error) {
 
 func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData, error) {
 	p := &ProviderData{
-		Scope:            providerConfig.Scope,
-		ClientID:         providerConfig.ClientID,
-		ClientSecret:     providerConfig.ClientSecret,
-		ClientSecretFile: providerConfig.ClientSecretFile,
+		Scope:             providerConfig.Scope,
+		ClientID:          providerConfig.ClientID,
+		ClientSecret:      providerConfig.ClientSecret,
+		ClientSecretFile:  providerConfig.ClientSecretFile,
+		RevokeAccessToken: providerConfig.RevokeAccessToken,
 	}
 
 	needsVerifier, err := providerRequiresOIDCProviderVerifier(providerConfig.Type)
@@ -98,6 +117,7 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 		}
 
 		p.Verifier = pv.Verifier()
+		p.LogoutTokenVerifier = pv.LogoutTokenVerifier()
 		if pv.DiscoveryEnabled() {
 			// Use the discovered values rather than any specified values
 			endpoints := pv.Provider().Endpoints()
@@ -106,6 +126,17 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 			providerConfig.RedeemURL = endpoints.TokenURL
 			providerConfig.ProfileURL = endpoints.UserInfoURL
 			providerConfig.OIDCConfig.JwksURL = endpoints.JWKsURL
+			// Not all providers advertise their revocation endpoint, so it can
+			// still be configured
+			if providerConfig.RevocationURL == "" {
+				providerConfig.RevocationURL = endpoints.RevocationURL
+			}
+			if providerConfig.OIDCConfig.EndSessionURL == "" {
+				providerConfig.OIDCConfig.EndSessionURL = endpoints.EndSessionURL
+			}
+			if providerConfig.DeviceAuthorizationURL == "" {
+				providerConfig.DeviceAuthorizationURL = endpoints.DeviceAuthURL
+			}
 			p.SupportedCodeChallengeMethods = pkce.CodeChallengeAlgs
 		}
 	}
@@ -115,11 +146,13 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 		dst **url.URL
 		raw string
 	}{
-		"login":    {dst: &p.LoginURL, raw: providerConfig.LoginURL},
-		"redeem":   {dst: &p.RedeemURL, raw: providerConfig.RedeemURL},
-		"profile":  {dst: &p.ProfileURL, raw: providerConfig.ProfileURL},
-		"validate": {dst: &p.ValidateURL, raw: providerConfig.ValidateURL},
-		"resource": {dst: &p.ProtectedResource, raw: providerConfig.ProtectedResource},
+		"login":                {dst: &p.LoginURL, raw: providerConfig.LoginURL},
+		"redeem":               {dst: &p.RedeemURL, raw: providerConfig.RedeemURL},
+		"profile":              {dst: &p.ProfileURL, raw: providerConfig.ProfileURL},
+		"validate":             {dst: &p.ValidateURL, raw: providerConfig.ValidateURL},
+		"revocation":           {dst: &p.RevocationURL, raw: providerConfig.RevocationURL},
+		"device authorization": {dst: &p.DeviceAuthorizationURL, raw: providerConfig.DeviceAuthorizationURL},
+		"resource":             {dst: &p.ProtectedResource, raw: providerConfig.ProtectedResource},
 	} {
 		var err error
 		*u.dst, err = url.Parse(u.raw)
@@ -127,6 +160,16 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 			errs = append(errs, fmt.Errorf("could not parse %s URL: %v", name, err))
 		}
 	}
+	// Users are only sent to the end session endpoint when RP-initiated
+	// logout is enabled
+	if providerConfig.OIDCConfig.RPInitiatedLogout {
+		if providerConfig.OIDCConfig.EndSessionURL == "" {
+			errs = append(errs, errors.New("rp-initiated logout requires an end session URL, the provider doesn't advertise an end_session_endpoint"))
+		} else if p.EndSessionURL, err = url.Parse(providerConfig.OIDCConfig.EndSessionURL); err != nil {
+			errs = append(errs, fmt.Errorf("could not parse end session URL: %v", err))
+		}
+		p.PostLogoutRedirectURL = providerConfig.OIDCConfig.PostLogoutRedirectURL
+	}
 	// handle LoginURLParameters
 	errs = append(errs, p.compileLoginParams(providerConfig.LoginURLParameters)...)
 
@@ -136,6 +179,8 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 
 	// Make the OIDC options available to all providers that support it
 	p.AllowUnverifiedEmail = providerConfig.OIDCConfig.InsecureAllowUnverifiedEmail
+	p.EmailVerifiedClaim = providerConfig.OIDCConfig.EmailVerifiedClaim
+	p.EmailVerification = providerConfig.OIDCConfig.EmailVerification
 	p.EmailClaim = providerConfig.OIDCConfig.EmailClaim
 	p.GroupsClaim = providerConfig.OIDCConfig.GroupsClaim
 
@@ -153,10 +198,18 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 	}
 
 	if p.Scope == "" {
-		p.Scope = "openid email profile"
-
-		if len(providerConfig.AllowedGroups) > 0 {
-			p.Scope += " groups"
+		switch providerConfig.Type {
+		case options.AppleProvider:
+			// Apple rejects any scopes other than name and email
+			p.Scope = appleDefaultScope
+		case options.OktaProvider:
+			p.Scope = oktaDefaultScope
+		default:
+			p.Scope = "openid email profile"
+
+			if len(providerConfig.AllowedGroups) > 0 || len(providerConfig.DeniedGroups) > 0 {
+				p.Scope += " groups"
+			}
 		}
 	}
 	if providerConfig.OIDCConfig.UserIDClaim == "" {
@@ -164,6 +217,7 @@ func newProviderDataFromConfig(providerConfig options.Provider) (*ProviderData,
 	}
 
 	p.setAllowedGroups(providerConfig.AllowedGroups)
+	p.setDeniedGroups(providerConfig.DeniedGroups)
 
 	return p, nil
 }
@@ -185,7 +239,7 @@ func providerRequiresOIDCProviderVerifier(providerType options.ProviderType) (bo
 	case options.BitbucketProvider, options.DigitalOceanProvider, options.FacebookProvider, options.GitHubProvider,
 		options.GoogleProvider, options.KeycloakProvider, options.LinkedInProvider, options.LoginGovProvider, options.NextCloudProvider:
 		return false, nil
-	case options.ADFSProvider, options.AzureProvider, options.GitLabProvider, options.KeycloakOIDCProvider, options.OIDCProvider:
+	case options.ADFSProvider, options.AppleProvider, options.AzureProvider, options.CognitoProvider, options.GitLabProvider, options.KeycloakOIDCProvider, options.OIDCProvider, options.OktaProvider:
 		return true, nil
 	default:
 		return false, fmt.Errorf("unknown provider type: %s", providerType)
@@ -121,6 +121,42 @@ func TestURLsCorrectlyParsed(t *testing.T) {
 	g.Expect(pd.RedeemURL.String()).To(Equal(msTokenURL))
 }
 
+func TestRPInitiatedLogout(t *testing.T) {
+	g := NewWithT(t)
+
+	providerConfig := options.Provider{
+		ID:               providerID,
+		Type:             "oidc",
+		ClientID:         clientID,
+		ClientSecretFile: clientSecret,
+		LoginURL:         msAuthURL,
+		RedeemURL:        msTokenURL,
+		OIDCConfig: options.OIDCOptions{
+			IssuerURL:             msIssuerURL,
+			SkipDiscovery:         true,
+			JwksURL:               msKeysURL,
+			RPInitiatedLogout:     true,
+			PostLogoutRedirectURL: "https://app.example.com/signed-out",
+		},
+	}
+
+	_, err := newProviderDataFromConfig(providerConfig)
+	g.Expect(err).To(MatchError("rp-initiated logout requires an end session URL, the provider doesn't advertise an end_session_endpoint"))
+
+	providerConfig.OIDCConfig.EndSessionURL = "https://login.microsoftonline.com/fabrikamb2c.onmicrosoft.com/oauth2/v2.0/logout"
+	pd, err := newProviderDataFromConfig(providerConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pd.EndSessionURL.String()).To(Equal(providerConfig.OIDCConfig.EndSessionURL))
+	g.Expect(pd.PostLogoutRedirectURL).To(Equal("https://app.example.com/signed-out"))
+	g.Expect(pd.LogoutTokenVerifier).ToNot(BeNil())
+
+	// The end session URL is only used with rp-initiated logout
+	providerConfig.OIDCConfig.RPInitiatedLogout = false
+	pd, err = newProviderDataFromConfig(providerConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pd.EndSessionURL).To(BeNil())
+}
+
 func TestScope(t *testing.T) {
 	g := NewWithT(t)
 
@@ -129,6 +165,7 @@ func TestScope(t *testing.T) {
 		configuredScope string
 		expectedScope   string
 		allowedGroups   []string
+		deniedGroups    []string
 	}{
 		{
 			name:            "with no scope provided",
@@ -141,6 +178,12 @@ func TestScope(t *testing.T) {
 			expectedScope:   "openid email profile groups",
 			allowedGroups:   []string{"foo"},
 		},
+		{
+			name:            "with no scope provided and denied groups",
+			configuredScope: "",
+			expectedScope:   "openid email profile groups",
+			deniedGroups:    []string{"foo"},
+		},
 		{
 			name:            "with a configured scope provided",
 			configuredScope: "openid",
@@ -158,6 +201,7 @@ func TestScope(t *testing.T) {
 			RedeemURL:        msTokenURL,
 			Scope:            tc.configuredScope,
 			AllowedGroups:    tc.allowedGroups,
+			DeniedGroups:     tc.deniedGroups,
 			OIDCConfig: options.OIDCOptions{
 				IssuerURL:     msIssuerURL,
 				SkipDiscovery: true,
@@ -169,6 +213,7 @@ func TestScope(t *testing.T) {
 		g.Expect(err).ToNot(HaveOccurred())
 
 		g.Expect(pd.Scope).To(Equal(tc.expectedScope))
+		g.Expect(pd.DeniedGroups).To(HaveLen(len(tc.deniedGroups)))
 	}
 }
 